@@ -23,14 +23,16 @@ func NewAuthenticator() *Authenticator {
 	}
 }
 
-// SetPassword sets the password and enables authentication
+// SetPassword replaces the password, enabling authentication, or disables it
+// for the empty password. The change applies to the next AUTH; connections
+// already authenticated stay so.
 func (a *Authenticator) SetPassword(password string) {
 	a.mu.Lock()
 	defer a.mu.Unlock()
 
 	a.password = password
 	a.passwordHash = hashPassword(password)
-	a.enabled = true
+	a.enabled = password != ""
 }
 
 // GetPassword returns the current password
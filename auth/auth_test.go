@@ -43,6 +43,24 @@ func TestSetPassword(t *testing.T) {
 	}
 }
 
+func TestSetEmptyPasswordDisables(t *testing.T) {
+	auth := NewAuthenticator()
+	auth.SetPassword("secret")
+	auth.SetPassword("")
+
+	if auth.IsEnabled() {
+		t.Error("The empty password should disable authentication")
+	}
+	if !auth.IsAuthenticated("client1") {
+		t.Error("Every client should be authenticated without a password")
+	}
+
+	auth.SetPassword("again")
+	if !auth.IsEnabled() || auth.Authenticate("secret") || !auth.Authenticate("again") {
+		t.Error("Setting a password again should enable authentication with it")
+	}
+}
+
 func TestAuthenticate(t *testing.T) {
 	auth := NewAuthenticator()
 
@@ -0,0 +1,49 @@
+// Package cluster implements the hash slots of Redis Cluster over a static
+// topology, so that cluster-aware clients can shard keys over several
+// instances: every key belongs to one of SlotCount slots, and every slot is
+// served by one node of the Topology.
+package cluster
+
+import "strings"
+
+// SlotCount is the number of hash slots keys are spread over
+const SlotCount = 16384
+
+// crc16Table is the table of CRC16-CCITT (XMODEM), the checksum Redis hashes
+// keys with: polynomial 0x1021, initial value 0
+var crc16Table = func() (table [256]uint16) {
+	for i := range table {
+		crc := uint16(i) << 8
+		for bit := 0; bit < 8; bit++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+		table[i] = crc
+	}
+	return table
+}()
+
+// crc16 returns the CRC16-CCITT (XMODEM) checksum of s
+func crc16(s string) uint16 {
+	var crc uint16
+	for i := 0; i < len(s); i++ {
+		crc = crc<<8 ^ crc16Table[byte(crc>>8)^s[i]]
+	}
+	return crc
+}
+
+// KeySlot returns the hash slot of a key, the CRC16 of the key modulo
+// SlotCount. If the key has a hash tag, a non-empty substring between its
+// first { and the next }, only the tag is hashed, so that keys with the same
+// tag share a slot.
+func KeySlot(key string) int {
+	if start := strings.IndexByte(key, '{'); start >= 0 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+	return int(crc16(key)) & (SlotCount - 1)
+}
@@ -0,0 +1,51 @@
+package cluster
+
+import "testing"
+
+func TestCRC16(t *testing.T) {
+	// The check value of the specification
+	if crc := crc16("123456789"); crc != 0x31C3 {
+		t.Errorf("Expected 0x31C3, got %#04x", crc)
+	}
+}
+
+func TestKeySlot(t *testing.T) {
+	tests := []struct {
+		key  string
+		slot int
+	}{
+		{"", 0},
+		{"foo", 12182},
+		{"bar", 5061},
+		{"hello", 866},
+		{"somekey", 11058},
+		{"123456789", 0x31C3},
+	}
+	for _, tt := range tests {
+		if slot := KeySlot(tt.key); slot != tt.slot {
+			t.Errorf("KeySlot(%q): expected %d, got %d", tt.key, tt.slot, slot)
+		}
+	}
+}
+
+func TestKeySlotHashTags(t *testing.T) {
+	// The examples of the cluster specification: the key of each pair is
+	// hashed as its second string
+	tests := []struct {
+		key, hashed string
+	}{
+		{"{user1000}.following", "user1000"},
+		{"{user1000}.followers", "user1000"},
+		{"foo{}{bar}", "foo{}{bar}"},
+		{"foo{{bar}}zap", "{bar"},
+		{"foo{bar}{zap}", "bar"},
+		{"{foo}bar", "foo"},
+		{"foo{bar", "foo{bar"},
+		{"foo}bar{", "foo}bar{"},
+	}
+	for _, tt := range tests {
+		if slot, want := KeySlot(tt.key), int(crc16(tt.hashed))%SlotCount; slot != want {
+			t.Errorf("KeySlot(%q): expected the slot of %q, %d, got %d", tt.key, tt.hashed, want, slot)
+		}
+	}
+}
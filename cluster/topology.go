@@ -0,0 +1,115 @@
+package cluster
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// SlotRange is an inclusive range of hash slots
+type SlotRange struct {
+	Start, End int
+}
+
+// Node is an instance of the cluster and the slots it serves
+type Node struct {
+	ID    string
+	Host  string
+	Port  int
+	Slots []SlotRange
+}
+
+// Addr returns the address clients reach the node at, as host:port
+func (n *Node) Addr() string {
+	return net.JoinHostPort(n.Host, strconv.Itoa(n.Port))
+}
+
+// ParseNode parses the description of a node, as the fields of a
+// cluster-node directive:
+//
+//	<id> <host:port> <slot|start-end> [<slot|start-end> ...]
+func ParseNode(fields []string) (*Node, error) {
+	if len(fields) < 3 {
+		return nil, errors.New("expected <id> <host:port> <slot|start-end> ...")
+	}
+	host, portStr, err := net.SplitHostPort(fields[1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid address: %s", fields[1])
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 1 || port > 65535 {
+		return nil, fmt.Errorf("invalid port: %s", fields[1])
+	}
+
+	node := &Node{ID: fields[0], Host: host, Port: port}
+	for _, field := range fields[2:] {
+		startStr, endStr, isRange := strings.Cut(field, "-")
+		if !isRange {
+			endStr = startStr
+		}
+		start, err1 := strconv.Atoi(startStr)
+		end, err2 := strconv.Atoi(endStr)
+		if err1 != nil || err2 != nil || start < 0 || end >= SlotCount || start > end {
+			return nil, fmt.Errorf("invalid slot range: %s", field)
+		}
+		node.Slots = append(node.Slots, SlotRange{Start: start, End: end})
+	}
+	return node, nil
+}
+
+// Topology is the static layout of the cluster: its nodes, the one this
+// instance is, and the node serving each slot
+type Topology struct {
+	Nodes []*Node // In the order they are configured
+	Self  *Node
+
+	owners   [SlotCount]*Node // nil for a slot no node serves
+	assigned int
+}
+
+// NewTopology builds a topology from the descriptions of its nodes (see
+// ParseNode), each one a string of space-separated fields, and the ID of this
+// instance. A slot may be served by one node only.
+func NewTopology(myID string, nodes []string) (*Topology, error) {
+	t := &Topology{}
+	for _, description := range nodes {
+		node, err := ParseNode(strings.Fields(description))
+		if err != nil {
+			return nil, fmt.Errorf("cluster node %q: %w", description, err)
+		}
+		for _, other := range t.Nodes {
+			if other.ID == node.ID {
+				return nil, fmt.Errorf("cluster node %s configured twice", node.ID)
+			}
+		}
+		for _, r := range node.Slots {
+			for slot := r.Start; slot <= r.End; slot++ {
+				if owner := t.owners[slot]; owner != nil {
+					return nil, fmt.Errorf("slot %d served by both %s and %s", slot, owner.ID, node.ID)
+				}
+				t.owners[slot] = node
+				t.assigned++
+			}
+		}
+		if node.ID == myID {
+			t.Self = node
+		}
+		t.Nodes = append(t.Nodes, node)
+	}
+	if t.Self == nil {
+		return nil, fmt.Errorf("cluster-myid %q is not a configured cluster node", myID)
+	}
+	return t, nil
+}
+
+// Owner returns the node serving a slot, nil if none does
+func (t *Topology) Owner(slot int) *Node {
+	return t.owners[slot]
+}
+
+// AssignedSlots returns the number of slots some node serves
+func (t *Topology) AssignedSlots() int {
+	return t.assigned
+}
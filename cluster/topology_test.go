@@ -0,0 +1,69 @@
+package cluster
+
+import (
+	"strings"
+	"testing"
+)
+
+var threeNodes = []string{
+	"node-a 127.0.0.1:7000 0-5460",
+	"node-b 127.0.0.1:7001 5461-10922",
+	"node-c 127.0.0.1:7002 10923-16383",
+}
+
+func TestTopology(t *testing.T) {
+	topology, err := NewTopology("node-b", threeNodes)
+	if err != nil {
+		t.Fatalf("NewTopology: %v", err)
+	}
+	if topology.Self.ID != "node-b" || topology.Self.Addr() != "127.0.0.1:7001" {
+		t.Errorf("Expected node-b at 127.0.0.1:7001, got %s at %s", topology.Self.ID, topology.Self.Addr())
+	}
+	if n := topology.AssignedSlots(); n != SlotCount {
+		t.Errorf("Expected every slot to be assigned, got %d", n)
+	}
+	for slot, id := range map[int]string{0: "node-a", 5460: "node-a", 5461: "node-b", 10922: "node-b", 16383: "node-c"} {
+		if owner := topology.Owner(slot); owner == nil || owner.ID != id {
+			t.Errorf("Expected slot %d to be served by %s, got %v", slot, id, owner)
+		}
+	}
+}
+
+func TestTopologySingleSlotsAndGaps(t *testing.T) {
+	topology, err := NewTopology("a", []string{"a [::1]:7000 0-99 200 300-300"})
+	if err != nil {
+		t.Fatalf("NewTopology: %v", err)
+	}
+	if topology.Self.Addr() != "[::1]:7000" {
+		t.Errorf("Expected [::1]:7000, got %s", topology.Self.Addr())
+	}
+	if n := topology.AssignedSlots(); n != 102 {
+		t.Errorf("Expected 102 slots, got %d", n)
+	}
+	if topology.Owner(100) != nil || topology.Owner(200) == nil || topology.Owner(300) == nil {
+		t.Error("Expected slots 200 and 300 served and 100 not")
+	}
+}
+
+func TestTopologyErrors(t *testing.T) {
+	tests := []struct {
+		myID  string
+		nodes []string
+		err   string
+	}{
+		{"a", []string{"a 127.0.0.1:7000"}, "expected <id>"},
+		{"a", []string{"a 127.0.0.1 0-10"}, "invalid address"},
+		{"a", []string{"a 127.0.0.1:0 0-10"}, "invalid port"},
+		{"a", []string{"a 127.0.0.1:7000 10-5"}, "invalid slot range"},
+		{"a", []string{"a 127.0.0.1:7000 0-16384"}, "invalid slot range"},
+		{"a", []string{"a 127.0.0.1:7000 x"}, "invalid slot range"},
+		{"a", []string{"a 127.0.0.1:7000 0-10", "b 127.0.0.1:7001 10-20"}, "slot 10 served by both a and b"},
+		{"a", []string{"a 127.0.0.1:7000 0-10", "a 127.0.0.1:7001 11-20"}, "configured twice"},
+		{"c", threeNodes, "not a configured cluster node"},
+	}
+	for _, tt := range tests {
+		if _, err := NewTopology(tt.myID, tt.nodes); err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%v: expected an error containing %q, got %v", tt.nodes, tt.err, err)
+		}
+	}
+}
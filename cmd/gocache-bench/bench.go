@@ -0,0 +1,440 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/wangbo/gocache/protocol/resp"
+)
+
+// options configures a benchmark run
+type options struct {
+	addr      string
+	password  string
+	clients   int           // Concurrent connections
+	requests  int           // Requests per test
+	pipeline  int           // Requests sent before reading the replies
+	valueSize int           // Size of the values written, in bytes
+	keyspace  int           // Number of distinct keys; 0 uses a single key
+	timeout   time.Duration // Dial and read/write timeout
+}
+
+// benchTest is a workload: the command sent by every request, and the
+// commands preparing its keys
+type benchTest struct {
+	name    string
+	setup   func(o *options) [][][]byte
+	command func(o *options, r *rand.Rand) [][]byte
+}
+
+// benchTests are the workloads selectable with -t, named as in
+// redis-benchmark
+var benchTests = []benchTest{
+	{name: "set", command: func(o *options, r *rand.Rand) [][]byte {
+		return args("SET", o.key("key", r), o.value())
+	}},
+	{name: "get", setup: func(o *options) [][][]byte {
+		return [][][]byte{args("SET", o.key("key", nil), o.value())}
+	}, command: func(o *options, r *rand.Rand) [][]byte {
+		return args("GET", o.key("key", r))
+	}},
+	{name: "incr", command: func(o *options, r *rand.Rand) [][]byte {
+		return args("INCR", o.key("counter", r))
+	}},
+	{name: "lpush", command: func(o *options, r *rand.Rand) [][]byte {
+		return args("LPUSH", "mylist", o.value())
+	}},
+	{name: "lrange_100", setup: func(o *options) [][][]byte {
+		return [][][]byte{listOf("RPUSH", "mylist", 100, o.value())}
+	}, command: func(o *options, r *rand.Rand) [][]byte {
+		return args("LRANGE", "mylist", "0", "99")
+	}},
+	{name: "hset", command: func(o *options, r *rand.Rand) [][]byte {
+		return args("HSET", "myhash", o.key("element", r), o.value())
+	}},
+	{name: "sadd", command: func(o *options, r *rand.Rand) [][]byte {
+		return args("SADD", "myset", o.key("element", r))
+	}},
+	{name: "zadd", command: func(o *options, r *rand.Rand) [][]byte {
+		score := strconv.Itoa(r.Intn(1000))
+		return args("ZADD", "myzset", score, o.key("element", r))
+	}},
+	{name: "zrangebyscore", setup: func(o *options) [][][]byte {
+		cmd := args("ZADD", "myzset")
+		for i := 0; i < 100; i++ {
+			cmd = append(cmd, []byte(strconv.Itoa(i)), []byte("element:"+strconv.Itoa(i)))
+		}
+		return [][][]byte{cmd}
+	}, command: func(o *options, r *rand.Rand) [][]byte {
+		return args("ZRANGEBYSCORE", "myzset", "0", "99")
+	}},
+}
+
+// findTest returns the workload named name
+func findTest(name string) (benchTest, bool) {
+	for _, t := range benchTests {
+		if t.name == name {
+			return t, true
+		}
+	}
+	return benchTest{}, false
+}
+
+// mixTest returns a workload sending the commands of other workloads in
+// proportion to their weights, parsed from a list such as "get:9,set:1"
+func mixTest(spec string) (benchTest, error) {
+	type weighted struct {
+		test   benchTest
+		weight int
+	}
+	var parts []weighted
+	total := 0
+	for _, item := range strings.Split(spec, ",") {
+		name, weightStr, found := strings.Cut(strings.TrimSpace(item), ":")
+		weight := 1
+		if found {
+			w, err := strconv.Atoi(weightStr)
+			if err != nil || w <= 0 {
+				return benchTest{}, fmt.Errorf("invalid weight in %q", item)
+			}
+			weight = w
+		}
+		t, ok := findTest(name)
+		if !ok {
+			return benchTest{}, fmt.Errorf("unknown test %q", name)
+		}
+		parts = append(parts, weighted{t, weight})
+		total += weight
+	}
+
+	return benchTest{
+		name: "mix(" + spec + ")",
+		setup: func(o *options) [][][]byte {
+			var cmds [][][]byte
+			for _, p := range parts {
+				if p.test.setup != nil {
+					cmds = append(cmds, p.test.setup(o)...)
+				}
+			}
+			return cmds
+		},
+		command: func(o *options, r *rand.Rand) [][]byte {
+			n := r.Intn(total)
+			for _, p := range parts {
+				if n < p.weight {
+					return p.test.command(o, r)
+				}
+				n -= p.weight
+			}
+			return nil
+		},
+	}, nil
+}
+
+// key returns prefix:__rand_int__, or prefix:N with N random below the
+// keyspace size if one is set. r is nil for the key used in setup.
+func (o *options) key(prefix string, r *rand.Rand) string {
+	if o.keyspace <= 0 {
+		return prefix + ":__rand_int__"
+	}
+	if r == nil {
+		return prefix + ":0"
+	}
+	return prefix + ":" + strconv.Itoa(r.Intn(o.keyspace))
+}
+
+// value returns a value of the configured size
+func (o *options) value() string {
+	return strings.Repeat("x", o.valueSize)
+}
+
+func args(parts ...string) [][]byte {
+	cmd := make([][]byte, len(parts))
+	for i, p := range parts {
+		cmd[i] = []byte(p)
+	}
+	return cmd
+}
+
+// listOf returns cmd key followed by n copies of value
+func listOf(cmd, key string, n int, value string) [][]byte {
+	line := args(cmd, key)
+	for i := 0; i < n; i++ {
+		line = append(line, []byte(value))
+	}
+	return line
+}
+
+// result is the outcome of one workload
+type result struct {
+	name      string
+	requests  int
+	errors    int
+	elapsed   time.Duration
+	latencies []time.Duration // Sorted
+}
+
+// throughput returns the requests per second
+func (r *result) throughput() float64 {
+	if r.elapsed <= 0 {
+		return 0
+	}
+	return float64(r.requests) / r.elapsed.Seconds()
+}
+
+// percentile returns the latency below which a fraction p of the requests
+// completed
+func (r *result) percentile(p float64) time.Duration {
+	if len(r.latencies) == 0 {
+		return 0
+	}
+	i := int(p*float64(len(r.latencies))+0.5) - 1
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(r.latencies) {
+		i = len(r.latencies) - 1
+	}
+	return r.latencies[i]
+}
+
+// average returns the mean latency
+func (r *result) average() time.Duration {
+	if len(r.latencies) == 0 {
+		return 0
+	}
+	var sum time.Duration
+	for _, l := range r.latencies {
+		sum += l
+	}
+	return sum / time.Duration(len(r.latencies))
+}
+
+// errServerReply is returned by readReply for a RESP error reply
+var errServerReply = errors.New("error reply")
+
+// conn is a client connection sending pipelined commands
+type conn struct {
+	nc net.Conn
+	r  *bufio.Reader
+	w  *bufio.Writer
+	o  *options
+}
+
+func dial(o *options) (*conn, error) {
+	nc, err := net.DialTimeout("tcp", o.addr, o.timeout)
+	if err != nil {
+		return nil, err
+	}
+	c := &conn{nc: nc, r: bufio.NewReader(nc), w: bufio.NewWriter(nc), o: o}
+	if o.password != "" {
+		if err := c.do([][][]byte{args("AUTH", o.password)}); err != nil {
+			nc.Close()
+			return nil, fmt.Errorf("AUTH: %w", err)
+		}
+	}
+	return c, nil
+}
+
+// do sends cmds in one pipeline and reads their replies, returning the
+// first error reply
+func (c *conn) do(cmds [][][]byte) error {
+	if err := c.send(cmds); err != nil {
+		return err
+	}
+	var firstErr error
+	for range cmds {
+		if err := readReply(c.r); err != nil {
+			if !errors.Is(err, errServerReply) {
+				return err
+			}
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+// send writes cmds, serialized as RESP arrays of bulk strings
+func (c *conn) send(cmds [][][]byte) error {
+	c.nc.SetDeadline(time.Now().Add(c.o.timeout))
+	for _, cmd := range cmds {
+		if _, err := c.w.Write(resp.MakeMultiBulkReply(cmd).ToBytes()); err != nil {
+			return err
+		}
+	}
+	return c.w.Flush()
+}
+
+// readReply reads and discards one reply, returning errServerReply for an
+// error reply
+func readReply(r *bufio.Reader) error {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if len(line) < 3 || !strings.HasSuffix(line, "\r\n") {
+		return fmt.Errorf("malformed reply %q", line)
+	}
+	body := line[1 : len(line)-2]
+
+	switch line[0] {
+	case '+', ':':
+		return nil
+	case '-':
+		return fmt.Errorf("%w: %s", errServerReply, body)
+	case '$':
+		n, err := strconv.Atoi(body)
+		if err != nil {
+			return fmt.Errorf("malformed bulk length %q", body)
+		}
+		if n < 0 {
+			return nil
+		}
+		_, err = r.Discard(n + 2)
+		return err
+	case '*':
+		n, err := strconv.Atoi(body)
+		if err != nil {
+			return fmt.Errorf("malformed array length %q", body)
+		}
+		for i := 0; i < n; i++ {
+			if err := readReply(r); err != nil && !errors.Is(err, errServerReply) {
+				return err
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("unexpected reply %q", line)
+	}
+}
+
+// run runs a workload: o.clients connections send o.requests commands in
+// total, o.pipeline at a time. The latency of a request is the time from
+// sending its pipeline to reading its reply.
+func run(o *options, t benchTest) (*result, error) {
+	if t.setup != nil {
+		c, err := dial(o)
+		if err != nil {
+			return nil, err
+		}
+		err = c.do(t.setup(o))
+		c.nc.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s setup: %w", t.name, err)
+		}
+	}
+
+	conns := make([]*conn, o.clients)
+	for i := range conns {
+		c, err := dial(o)
+		if err != nil {
+			for _, c := range conns[:i] {
+				c.nc.Close()
+			}
+			return nil, err
+		}
+		conns[i] = c
+	}
+
+	var (
+		remaining = int64(o.requests)
+		errCount  atomic.Int64
+		wg        sync.WaitGroup
+		mu        sync.Mutex
+		latencies = make([]time.Duration, 0, o.requests)
+		firstErr  error
+	)
+	start := time.Now()
+	for i, c := range conns {
+		wg.Add(1)
+		go func(c *conn, seed int64) {
+			defer wg.Done()
+			defer c.nc.Close()
+			r := rand.New(rand.NewSource(seed))
+			local := make([]time.Duration, 0, o.requests/o.clients+o.pipeline)
+			cmds := make([][][]byte, 0, o.pipeline)
+
+			var err error
+			for err == nil {
+				n := atomic.AddInt64(&remaining, -int64(o.pipeline))
+				batch := o.pipeline
+				if n < 0 {
+					batch += int(n)
+				}
+				if batch <= 0 {
+					break
+				}
+
+				cmds = cmds[:0]
+				for j := 0; j < batch; j++ {
+					cmds = append(cmds, t.command(o, r))
+				}
+				sent := time.Now()
+				if err = c.send(cmds); err != nil {
+					break
+				}
+				for j := 0; j < batch; j++ {
+					if rerr := readReply(c.r); rerr != nil {
+						if !errors.Is(rerr, errServerReply) {
+							err = rerr
+							break
+						}
+						errCount.Add(1)
+					}
+					local = append(local, time.Since(sent))
+				}
+			}
+
+			mu.Lock()
+			latencies = append(latencies, local...)
+			if err != nil && firstErr == nil && !errors.Is(err, io.EOF) {
+				firstErr = err
+			}
+			mu.Unlock()
+		}(c, int64(i)+start.UnixNano())
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	if firstErr != nil {
+		return nil, fmt.Errorf("%s: %w", t.name, firstErr)
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	return &result{
+		name:      t.name,
+		requests:  len(latencies),
+		errors:    int(errCount.Load()),
+		elapsed:   elapsed,
+		latencies: latencies,
+	}, nil
+}
+
+// writeTable writes results as a Markdown table
+func writeTable(w io.Writer, o *options, results []*result) {
+	fmt.Fprintf(w, "clients: %d, pipeline: %d, value size: %d bytes, keyspace: %d\n\n",
+		o.clients, o.pipeline, o.valueSize, o.keyspace)
+	fmt.Fprintln(w, "| test | requests | errors | requests/s | avg (ms) | p50 (ms) | p95 (ms) | p99 (ms) | max (ms) |")
+	fmt.Fprintln(w, "|------|---------:|-------:|-----------:|---------:|---------:|---------:|---------:|---------:|")
+	for _, r := range results {
+		fmt.Fprintf(w, "| %s | %d | %d | %.0f | %s | %s | %s | %s | %s |\n",
+			r.name, r.requests, r.errors, r.throughput(),
+			ms(r.average()), ms(r.percentile(0.50)), ms(r.percentile(0.95)),
+			ms(r.percentile(0.99)), ms(r.percentile(1)))
+	}
+}
+
+func ms(d time.Duration) string {
+	return strconv.FormatFloat(float64(d)/float64(time.Millisecond), 'f', 3, 64)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/wangbo/gocache/config"
+	"github.com/wangbo/gocache/database"
+	"github.com/wangbo/gocache/server"
+)
+
+// startServer starts a server on a free loopback port and returns its
+// address
+func startServer(t *testing.T) string {
+	t.Helper()
+
+	db := database.MakeDB()
+	srv := server.MakeServer(&config.Properties{Bind: "127.0.0.1", Port: 0}, server.MakeHandler(db))
+	if err := srv.Listen(); err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	go srv.Serve()
+
+	t.Cleanup(func() {
+		srv.Stop()
+		db.Close()
+	})
+	return srv.Addr().String()
+}
+
+func TestRunEveryTest(t *testing.T) {
+	o := &options{
+		addr:      startServer(t),
+		clients:   4,
+		requests:  203,
+		pipeline:  8,
+		valueSize: 16,
+		keyspace:  50,
+		timeout:   5 * time.Second,
+	}
+
+	mix, err := mixTest("get:3,set:1,lrange_100")
+	if err != nil {
+		t.Fatalf("mixTest: %v", err)
+	}
+	var results []*result
+	for _, bt := range append(benchTests[:len(benchTests):len(benchTests)], mix) {
+		r, err := run(o, bt)
+		if err != nil {
+			t.Fatalf("%s: %v", bt.name, err)
+		}
+		if r.requests != o.requests || r.errors != 0 {
+			t.Errorf("%s: expected %d requests without errors, got %d with %d errors",
+				bt.name, o.requests, r.requests, r.errors)
+		}
+		if r.percentile(0.5) > r.percentile(0.99) || r.percentile(0.99) > r.percentile(1) {
+			t.Errorf("%s: percentiles out of order", bt.name)
+		}
+		results = append(results, r)
+	}
+
+	var table strings.Builder
+	writeTable(&table, o, results)
+	// Header, separator and one row per test after the settings line
+	if got, want := strings.Count(table.String(), "\n"), 4+len(results); got != want {
+		t.Errorf("Expected %d lines, got %d:\n%s", want, got, table.String())
+	}
+}
+
+func TestMixTestRejectsUnknownTests(t *testing.T) {
+	for _, spec := range []string{"get:9,nope:1", "get:0", "get:x"} {
+		if _, err := mixTest(spec); err == nil {
+			t.Errorf("%q: expected an error", spec)
+		}
+	}
+}
+
+func TestReadReply(t *testing.T) {
+	input := "+OK\r\n:12\r\n$3\r\nfoo\r\n$-1\r\n*2\r\n$1\r\na\r\n*1\r\n:1\r\n*-1\r\n-ERR bad\r\n"
+	r := bufio.NewReader(strings.NewReader(input))
+	for i := 0; i < 6; i++ {
+		if err := readReply(r); err != nil {
+			t.Fatalf("Reply %d: %v", i, err)
+		}
+	}
+	if err := readReply(r); !errors.Is(err, errServerReply) {
+		t.Errorf("Expected an error reply, got %v", err)
+	}
+	if _, err := r.ReadByte(); err == nil {
+		t.Error("Expected all input to be consumed")
+	}
+}
+
+func TestRunFailsWithoutServer(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+
+	o := &options{
+		addr:     net.JoinHostPort("127.0.0.1", strconv.Itoa(port)),
+		clients:  1,
+		requests: 1,
+		pipeline: 1,
+		timeout:  time.Second,
+	}
+	if _, err := run(o, benchTests[0]); err == nil {
+		t.Error("Expected an error dialing a closed port")
+	}
+}
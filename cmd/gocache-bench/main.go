@@ -0,0 +1,81 @@
+// Command gocache-bench is a load generator for GoCache, and any other
+// server speaking RESP, modeled on redis-benchmark so that the numbers of
+// both tools can be compared on the same machine:
+//
+//	gocache-bench -p 6379 -c 50 -n 100000 -P 16 -t set,get,lrange_100
+//	gocache-bench -mix get:9,set:1 -r 100000
+//
+// Each test is run in turn and the results are printed as a Markdown table
+// of throughput and latency percentiles.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func main() {
+	o := &options{}
+	host := flag.String("h", "127.0.0.1", "Server hostname")
+	port := flag.Int("p", 6379, "Server port")
+	flag.StringVar(&o.password, "a", "", "Password sent with AUTH")
+	flag.IntVar(&o.clients, "c", 50, "Number of parallel connections")
+	flag.IntVar(&o.requests, "n", 100000, "Total number of requests per test")
+	flag.IntVar(&o.pipeline, "P", 1, "Pipeline <numreq> requests")
+	flag.IntVar(&o.valueSize, "d", 3, "Data size of SET/GET values in bytes")
+	flag.IntVar(&o.keyspace, "r", 0, "Use random keys in a keyspace of this size")
+	flag.DurationVar(&o.timeout, "timeout", 10*time.Second, "Dial and I/O timeout")
+	tests := flag.String("t", allTests(), "Comma-separated list of tests to run")
+	mix := flag.String("mix", "", "Run one test mixing others by weight, e.g. get:9,set:1")
+	flag.Parse()
+
+	if o.clients < 1 || o.requests < 1 || o.pipeline < 1 || o.valueSize < 0 {
+		fmt.Fprintln(os.Stderr, "-c, -n and -P must be positive and -d not negative")
+		os.Exit(2)
+	}
+	o.addr = net.JoinHostPort(*host, strconv.Itoa(*port))
+
+	var selected []benchTest
+	if *mix != "" {
+		t, err := mixTest(*mix)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		selected = append(selected, t)
+	} else {
+		for _, name := range strings.Split(*tests, ",") {
+			t, ok := findTest(strings.ToLower(strings.TrimSpace(name)))
+			if !ok {
+				fmt.Fprintf(os.Stderr, "unknown test %q (available: %s)\n", name, allTests())
+				os.Exit(2)
+			}
+			selected = append(selected, t)
+		}
+	}
+
+	var results []*result
+	for _, t := range selected {
+		r, err := run(o, t)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		results = append(results, r)
+	}
+	writeTable(os.Stdout, o, results)
+}
+
+// allTests returns the names of all tests, comma-separated
+func allTests() string {
+	names := make([]string, len(benchTests))
+	for i, t := range benchTests {
+		names[i] = t.name
+	}
+	return strings.Join(names, ",")
+}
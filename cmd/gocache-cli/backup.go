@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/wangbo/gocache/persistence"
+	"github.com/wangbo/gocache/persistence/rdb"
+)
+
+// backup saves a backup of the server's data in dir, sending BACKUP through
+// c: the RDB the server streams back is written to a temporary file and
+// checked as --rdb-check checks files, its checksum included, before it is
+// named dump-<time>.rdb after now, in UTC. A backup cut short or corrupted
+// thus never takes the name of a good one. It returns the name of the file
+// and what it holds.
+func backup(c *client, dir string, now time.Time) (string, *persistence.CheckReport, error) {
+	if err := c.send([][]byte{[]byte("BACKUP")}); err != nil {
+		return "", nil, err
+	}
+	if err := c.w.Flush(); err != nil {
+		return "", nil, err
+	}
+
+	// The payload is a bulk string, read as a stream rather than as a reply
+	// so that it is never held in memory
+	header, err := c.r.ReadString('\n')
+	if err != nil {
+		return "", nil, fmt.Errorf("reading the backup: %w", err)
+	}
+	header = strings.TrimSuffix(header, "\r\n")
+	if strings.HasPrefix(header, "-") {
+		return "", nil, fmt.Errorf("BACKUP failed: %s", header[1:])
+	}
+	size, err := strconv.ParseInt(strings.TrimPrefix(header, "$"), 10, 64)
+	if !strings.HasPrefix(header, "$") || err != nil || size < 0 {
+		return "", nil, fmt.Errorf("unexpected reply to BACKUP: %.40q", header)
+	}
+
+	tmp, err := os.CreateTemp(dir, "backup-*.rdb.tmp")
+	if err != nil {
+		return "", nil, err
+	}
+	defer os.Remove(tmp.Name()) // Nothing to remove once renamed
+	if _, err := io.CopyN(tmp, c.r, size); err != nil {
+		tmp.Close()
+		return "", nil, fmt.Errorf("reading the backup: %w", err)
+	}
+	crlf := make([]byte, 2)
+	if _, err := io.ReadFull(c.r, crlf); err != nil || string(crlf) != "\r\n" {
+		tmp.Close()
+		return "", nil, errors.New("reading the backup: the bulk string does not end with CRLF")
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return "", nil, err
+	}
+	if err := tmp.Close(); err != nil {
+		return "", nil, err
+	}
+
+	report, err := rdb.Check(tmp.Name())
+	if err != nil {
+		return "", nil, fmt.Errorf("the backup is not valid: %w", err)
+	}
+	filename := filepath.Join(dir, "dump-"+now.UTC().Format("20060102-150405")+".rdb")
+	if err := os.Rename(tmp.Name(), filename); err != nil {
+		return "", nil, err
+	}
+	return filename, report, nil
+}
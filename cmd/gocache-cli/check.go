@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/wangbo/gocache/persistence"
+	"github.com/wangbo/gocache/persistence/aof"
+	"github.com/wangbo/gocache/persistence/rdb"
+)
+
+// keyTypes are the types a check report counts keys of, in the order they
+// are printed
+var keyTypes = []string{"string", "hash", "list", "set", "zset", "stream"}
+
+// checkFile checks the RDB or AOF file at filename, kind saying which, and
+// prints what it holds to out
+func checkFile(out io.Writer, kind, filename string) error {
+	var report *persistence.CheckReport
+	var err error
+	switch kind {
+	case "RDB":
+		report, err = rdb.Check(filename)
+	case "AOF":
+		report, err = aof.Check(filename)
+	}
+	if err != nil {
+		return fmt.Errorf("%s %s is not valid: %w", kind, filename, err)
+	}
+	printReport(out, kind, filename, report)
+	return nil
+}
+
+// printReport prints a check report: the size of the file, the number of
+// commands of an AOF, and the number of keys per type
+func printReport(out io.Writer, kind, filename string, report *persistence.CheckReport) {
+	fmt.Fprintf(out, "%s %s is valid: %d bytes\n", kind, filename, report.Size)
+	if kind == "AOF" {
+		fmt.Fprintf(out, "commands: %d\n", report.Commands)
+	}
+	fmt.Fprintf(out, "keys: %d\n", report.KeyCount())
+	for _, t := range keyTypes {
+		if n := report.Keys[t]; n > 0 {
+			fmt.Fprintf(out, "  %s: %d\n", t, n)
+		}
+	}
+	fmt.Fprintf(out, "expires: %d\n", report.Expires)
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/wangbo/gocache/auth"
+	"github.com/wangbo/gocache/config"
+	"github.com/wangbo/gocache/database"
+	"github.com/wangbo/gocache/persistence"
+	"github.com/wangbo/gocache/persistence/rdb"
+	"github.com/wangbo/gocache/protocol/resp"
+	"github.com/wangbo/gocache/server"
+)
+
+// startServer starts a server on a free loopback port, requiring password
+// if it is not empty, and returns its address and database
+func startServer(t *testing.T, password string) (string, *database.DB) {
+	t.Helper()
+
+	db := database.MakeDB()
+	authenticator := auth.NewAuthenticator()
+	authenticator.SetPassword(password)
+	srv := server.MakeServer(&config.Properties{Bind: "127.0.0.1", Port: 0}, server.MakeHandlerWithAuth(db, nil, authenticator))
+	if err := srv.Listen(); err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	go srv.Serve()
+
+	t.Cleanup(func() {
+		srv.Stop()
+		db.Close()
+	})
+	return srv.Addr().String(), db
+}
+
+// connect dials the server at addr
+func connect(t *testing.T, addr, password string) *client {
+	t.Helper()
+	c, err := dial(addr, password, 5*time.Second)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func TestPipe(t *testing.T) {
+	addr, _ := startServer(t, "")
+	c := connect(t, addr, "")
+
+	const n = 10000
+	var in bytes.Buffer
+	for i := 0; i < n; i++ {
+		cmd := [][]byte{[]byte("SET"), []byte("key:" + strconv.Itoa(i)), []byte("value " + strconv.Itoa(i))}
+		in.Write(resp.MakeMultiBulkReply(cmd).ToBytes())
+	}
+
+	var out bytes.Buffer
+	if status := runPipe(c, &in, &out); status != 0 {
+		t.Fatalf("Expected the pipe to succeed, got %d: %s", status, out.String())
+	}
+	if !strings.HasSuffix(out.String(), "errors: 0, replies: 10000\n") {
+		t.Errorf("Unexpected summary: %q", out.String())
+	}
+
+	reply, err := c.do([][]byte{[]byte("DBSIZE")})
+	if err != nil {
+		t.Fatalf("DBSIZE: %v", err)
+	}
+	if got := string(reply.ToBytes()); got != ":10000\r\n" {
+		t.Errorf("Expected 10000 keys, got %q", got)
+	}
+	reply, _ = c.do([][]byte{[]byte("GET"), []byte("key:9999")})
+	if got := rawReply(reply); got != "value 9999" {
+		t.Errorf("Expected the last value to be loaded, got %q", got)
+	}
+}
+
+func TestPipeErrors(t *testing.T) {
+	addr, _ := startServer(t, "")
+	c := connect(t, addr, "")
+
+	// Error replies are counted and printed; an input that is not valid
+	// RESP stops at its first invalid command
+	in := "*3\r\n$3\r\nSET\r\n$1\r\na\r\n$1\r\n1\r\n" +
+		"*2\r\n$4\r\nINCR\r\n$1\r\nx\r\n" +
+		"*4\r\n$4\r\nHSET\r\n$1\r\na\r\n$1\r\nf\r\n$1\r\nv\r\n" +
+		"*2\r\n$3\r\nGET\r\n$x\r\n" +
+		"*3\r\n$3\r\nSET\r\n$1\r\nb\r\n$1\r\n2\r\n"
+	var out bytes.Buffer
+	if status := runPipe(c, strings.NewReader(in), &out); status != 1 {
+		t.Errorf("Expected the pipe to fail, got %d", status)
+	}
+	got := out.String()
+	for _, want := range []string{"WRONGTYPE", "command 4 of the input", "errors: 1, replies: 3\n"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("Expected %q in the output, got %q", want, got)
+		}
+	}
+	if reply, _ := c.do([][]byte{[]byte("EXISTS"), []byte("b")}); string(reply.ToBytes()) != ":0\r\n" {
+		t.Errorf("Expected the commands after the invalid one not to be sent")
+	}
+}
+
+func TestREPL(t *testing.T) {
+	addr, _ := startServer(t, "secret")
+	if _, err := dial(addr, "wrong", 5*time.Second); err == nil {
+		t.Error("Expected a wrong password to fail")
+	}
+	c := connect(t, addr, "secret")
+
+	script := strings.Join([]string{
+		`SET greeting "hello world"`,
+		`SET bytes "a\x00\n\"b"`,
+		"GET greeting",
+		"GET bytes",
+		"GET missing",
+		"INCR counter",
+		"RPUSH list a b c d e f g h i j",
+		"LRANGE list 0 -1",
+		"LRANGE missing 0 -1",
+		"HSET h f v",
+		"NOSUCHCOMMAND",
+		`GET "unbalanced`,
+		"quit",
+		"GET greeting",
+	}, "\n")
+
+	var out bytes.Buffer
+	if err := repl(c, strings.NewReader(script), &out, replOptions{}); err != nil {
+		t.Fatalf("repl: %v", err)
+	}
+	want := "OK\n" +
+		"OK\n" +
+		"\"hello world\"\n" +
+		"\"a\\x00\\n\\\"b\"\n" +
+		"(nil)\n" +
+		"(integer) 1\n" +
+		"(integer) 10\n" +
+		" 1) \"a\"\n 2) \"b\"\n 3) \"c\"\n 4) \"d\"\n 5) \"e\"\n 6) \"f\"\n 7) \"g\"\n 8) \"h\"\n 9) \"i\"\n10) \"j\"\n" +
+		"(empty array)\n" +
+		"(integer) 1\n" +
+		"(error) ERR unknown command 'NOSUCHCOMMAND', with args beginning with: \n" +
+		"Invalid argument(s)\n"
+	if got := out.String(); got != want {
+		t.Errorf("Unexpected output:\n%s\nexpected:\n%s", got, want)
+	}
+
+	out.Reset()
+	script = "GET greeting\nLRANGE list 0 1\nGET missing\nINCR counter\n"
+	if err := repl(c, strings.NewReader(script), &out, replOptions{raw: true, prompt: "> "}); err != nil {
+		t.Fatalf("repl: %v", err)
+	}
+	if got, want := out.String(), "> hello world\n> a\nb\n> \n> 2\n> "; got != want {
+		t.Errorf("Unexpected raw output %q, expected %q", got, want)
+	}
+}
+
+func TestFormatNestedArray(t *testing.T) {
+	reply := resp.MakeArrayReply([]resp.Reply{
+		resp.MakeArrayReply([]resp.Reply{
+			resp.MakeBulkReply([]byte("1-1")),
+			resp.MakeMultiBulkReply([][]byte{[]byte("f"), []byte("v")}),
+		}),
+		resp.MakeIntReply(7),
+		resp.MakeNullMultiBulkReply(),
+	})
+	want := "1) 1) \"1-1\"\n" +
+		"   2) 1) \"f\"\n" +
+		"      2) \"v\"\n" +
+		"2) (integer) 7\n" +
+		"3) (nil)\n"
+	if got := formatReply(reply, ""); got != want {
+		t.Errorf("Unexpected output:\n%s\nexpected:\n%s", got, want)
+	}
+}
+
+func TestCheckFiles(t *testing.T) {
+	dir := t.TempDir()
+	db := database.MakeDB()
+	defer db.Close()
+	db.ExecCommand("SET", "a", "1", "EX", "100")
+	db.ExecCommand("SET", "b", "2")
+	db.ExecCommand("SADD", "s", "m")
+	rdbFile := filepath.Join(dir, "dump.rdb")
+	if err := rdb.SaveToFile(db, rdbFile); err != nil {
+		t.Fatalf("SaveToFile: %v", err)
+	}
+	info, _ := os.Stat(rdbFile)
+
+	var out bytes.Buffer
+	if err := checkFile(&out, "RDB", rdbFile); err != nil {
+		t.Fatalf("Expected the RDB to be valid: %v", err)
+	}
+	want := "RDB " + rdbFile + " is valid: " + strconv.FormatInt(info.Size(), 10) + " bytes\n" +
+		"keys: 3\n  string: 2\n  set: 1\nexpires: 1\n"
+	if got := out.String(); got != want {
+		t.Errorf("Unexpected output %q, expected %q", got, want)
+	}
+
+	aofFile := filepath.Join(dir, "appendonly.aof")
+	cmds := "*3\r\n$3\r\nSET\r\n$1\r\na\r\n$1\r\n1\r\n*4\r\n$4\r\nHSET\r\n$1\r\nh\r\n$1\r\nf\r\n"
+	os.WriteFile(aofFile, []byte(cmds), 0600)
+	out.Reset()
+	err := checkFile(&out, "AOF", aofFile)
+	if err == nil || !strings.Contains(err.Error(), "at offset 27: unexpected end of file") {
+		t.Errorf("Expected the truncated AOF to be reported, got %v", err)
+	}
+
+	os.WriteFile(aofFile, []byte(cmds+"$1\r\nv\r\n"), 0600)
+	if err := checkFile(&out, "AOF", aofFile); err != nil {
+		t.Fatalf("Expected the AOF to be valid: %v", err)
+	}
+	if got := out.String(); !strings.Contains(got, "commands: 2\nkeys: 2\n  string: 1\n  hash: 1\nexpires: 0\n") {
+		t.Errorf("Unexpected output %q", got)
+	}
+
+	// A file that is neither is reported, not loaded
+	os.WriteFile(rdbFile, []byte("*1\r\n$4\r\nPING\r\n"), 0600)
+	if err := checkFile(io.Discard, "RDB", rdbFile); err == nil {
+		t.Error("Expected an AOF to fail the RDB check")
+	}
+}
+
+func TestBackup(t *testing.T) {
+	addr, db := startServer(t, "")
+	c := connect(t, addr, "")
+	dir := t.TempDir()
+
+	// Without an RDB saver the server has nothing to send
+	if _, _, err := backup(c, dir, time.Now()); err == nil || !strings.Contains(err.Error(), "BACKUP failed") {
+		t.Errorf("Expected the error reply to fail the backup, got %v", err)
+	}
+	oldSaver := persistence.GetSaver()
+	persistence.RegisterSaver(&rdb.RDBSaver{})
+	defer persistence.RegisterSaver(oldSaver)
+
+	for i := 0; i < 100; i++ {
+		db.ExecCommand("SET", "key:"+strconv.Itoa(i), "value "+strconv.Itoa(i))
+	}
+	db.ExecCommand("SET", "ttl", "v", "EX", "1000")
+	db.ExecCommand("HSET", "h", "f", "v")
+	db.ExecCommand("RPUSH", "l", "a", "b")
+	db.ExecCommand("ZADD", "z", "2.5", "m")
+
+	now := time.Date(2026, 10, 16, 9, 30, 5, 0, time.FixedZone("UTC+8", 8*3600))
+	filename, report, err := backup(c, dir, now)
+	if err != nil {
+		t.Fatalf("backup: %v", err)
+	}
+	if want := filepath.Join(dir, "dump-20261016-013005.rdb"); filename != want {
+		t.Errorf("Expected the backup in %s, got %s", want, filename)
+	}
+	if report.KeyCount() != 104 || report.Expires != 1 {
+		t.Errorf("Unexpected report %+v", report)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("Expected only the backup in %s, got %v", dir, entries)
+	}
+
+	// The backup loads into the keyspace of the server
+	restored := database.MakeDB()
+	defer restored.Close()
+	if err := rdb.LoadFromFile(restored, filename); err != nil {
+		t.Fatalf("LoadFromFile: %v", err)
+	}
+	if got, want := len(restored.Keys()), len(db.Keys()); got != want {
+		t.Errorf("Expected %d keys, got %d", want, got)
+	}
+	reads := map[string][]string{
+		"string": {"GET"},
+		"hash":   {"HGETALL"},
+		"list":   {"LRANGE", "0", "-1"},
+		"zset":   {"ZRANGE", "0", "-1", "WITHSCORES"},
+	}
+	for _, key := range db.Keys() {
+		typ, _ := db.ExecCommand("TYPE", key)
+		read := append([]string{reads[string(typ[0])][0], key}, reads[string(typ[0])][1:]...)
+		want, _ := db.ExecCommand(read[0], read[1:]...)
+		got, err := restored.ExecCommand(read[0], read[1:]...)
+		if err != nil || fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("%v: backup has %q, server %q (%v)", read, got, want, err)
+		}
+		if _, hasTTL := db.ExpireTime(key); hasTTL {
+			if _, ok := restored.ExpireTime(key); !ok {
+				t.Errorf("Expected the TTL of %s to be backed up", key)
+			}
+		}
+	}
+
+	// The connection is still a client's
+	if reply, err := c.do([][]byte{[]byte("PING")}); err != nil || rawReply(reply) != "PONG" {
+		t.Errorf("Expected PONG after the backup, got %v, %v", reply, err)
+	}
+}
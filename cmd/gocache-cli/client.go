@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/wangbo/gocache/protocol/resp"
+)
+
+// client is a connection to a server, speaking RESP through the protocol
+// package: commands go out as arrays of bulk strings, replies are read with
+// resp.ReadReply
+type client struct {
+	nc net.Conn
+	r  *bufio.Reader
+	w  *bufio.Writer
+}
+
+// dial connects to addr, authenticating with password if it is not empty.
+// The timeout bounds the connection only: a command may block for as long
+// as the server makes it, as BLPOP does.
+func dial(addr, password string, timeout time.Duration) (*client, error) {
+	nc, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to %s: %w", addr, err)
+	}
+	c := &client{nc: nc, r: bufio.NewReader(nc), w: bufio.NewWriter(nc)}
+	if password != "" {
+		reply, err := c.do([][]byte{[]byte("AUTH"), []byte(password)})
+		if err == nil {
+			if e, ok := reply.(*resp.ErrReply); ok {
+				err = fmt.Errorf("AUTH failed: %s", e.Error)
+			}
+		}
+		if err != nil {
+			nc.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// do sends one command and reads its reply
+func (c *client) do(cmd [][]byte) (resp.Reply, error) {
+	if err := c.send(cmd); err != nil {
+		return nil, err
+	}
+	if err := c.w.Flush(); err != nil {
+		return nil, err
+	}
+	return resp.ReadReply(c.r)
+}
+
+// send buffers one command; the caller flushes c.w
+func (c *client) send(cmd [][]byte) error {
+	return resp.WriteReply(c.w, resp.MakeMultiBulkReply(cmd))
+}
+
+// Close closes the connection
+func (c *client) Close() error {
+	return c.nc.Close()
+}
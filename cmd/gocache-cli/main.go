@@ -0,0 +1,114 @@
+// Command gocache-cli is a command line client for GoCache, and any other
+// server speaking RESP, modeled on redis-cli:
+//
+//	gocache-cli -h 127.0.0.1 -p 6379 -a secret      # interactive
+//	gocache-cli -p 6379 SET key value               # one command
+//	gocache-cli --raw GET key                       # the value as it is
+//	gocache-cli --pipe < commands.resp              # mass loading
+//	gocache-cli --backup /var/backups/gocache       # off-box backup
+//	gocache-cli --rdb-check dump.rdb                # offline checks
+//	gocache-cli --aof-check appendonly.aof
+//
+// Without a command, commands are read from the standard input, a line each;
+// arguments may be quoted as in redis-cli. The checks load the file into an
+// empty in-memory database, without a server, and print the keys it holds
+// per type. A backup is checked the same way before it is named after the
+// time it was taken.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+func main() {
+	host := flag.String("h", "127.0.0.1", "Server hostname")
+	port := flag.Int("p", 6379, "Server port")
+	password := flag.String("a", "", "Password sent with AUTH")
+	raw := flag.Bool("raw", false, "Print replies as they are, without types or quotes")
+	pipeMode := flag.Bool("pipe", false, "Send the RESP commands of the standard input for mass loading")
+	backupDir := flag.String("backup", "", "Save a backup of the server's data to a timestamped RDB file in this directory")
+	rdbCheck := flag.String("rdb-check", "", "Check an RDB file and print the keys it holds")
+	aofCheck := flag.String("aof-check", "", "Check an AOF file and print the commands and keys it holds")
+	timeout := flag.Duration("timeout", 10*time.Second, "Dial timeout")
+	flag.Parse()
+
+	if *rdbCheck != "" || *aofCheck != "" {
+		kind, filename := "RDB", *rdbCheck
+		if *aofCheck != "" {
+			kind, filename = "AOF", *aofCheck
+		}
+		if err := checkFile(os.Stdout, kind, filename); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	addr := net.JoinHostPort(*host, strconv.Itoa(*port))
+	c, err := dial(addr, *password, *timeout)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer c.Close()
+
+	switch {
+	case *pipeMode:
+		os.Exit(runPipe(c, os.Stdin, os.Stdout))
+	case *backupDir != "":
+		filename, report, err := backup(c, *backupDir, time.Now())
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		printReport(os.Stdout, "RDB", filename, report)
+	case flag.NArg() > 0:
+		args := make([][]byte, flag.NArg())
+		for i, arg := range flag.Args() {
+			args[i] = []byte(arg)
+		}
+		reply, err := c.do(args)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		printReply(os.Stdout, reply, *raw)
+	default:
+		o := replOptions{raw: *raw}
+		if isTerminal(os.Stdin) {
+			o.prompt = addr + "> "
+		}
+		if err := repl(c, os.Stdin, os.Stdout, o); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+}
+
+// runPipe runs pipe and prints its summary as redis-cli --pipe does,
+// returning the exit status: 1 if a command failed or was not sent
+func runPipe(c *client, in io.Reader, out io.Writer) int {
+	stats, err := pipe(c, in, out)
+	if err != nil {
+		fmt.Fprintln(out, err)
+	} else {
+		fmt.Fprintln(out, "All data transferred. Last reply received from server.")
+	}
+	fmt.Fprintf(out, "errors: %d, replies: %d\n", stats.errors, stats.replies)
+	if err != nil || stats.errors > 0 {
+		return 1
+	}
+	return 0
+}
+
+// isTerminal reports whether f is a terminal, where the prompt is printed
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
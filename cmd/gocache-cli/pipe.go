@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync/atomic"
+
+	"github.com/wangbo/gocache/protocol/resp"
+)
+
+// pipeStats counts what a pipe sent and what the server replied
+type pipeStats struct {
+	replies int64
+	errors  int64
+}
+
+// pipe streams the commands of in to the server for mass loading, as
+// redis-cli --pipe does: in holds RESP commands, or inline ones, which are
+// sent without waiting for their replies while another loop reads the
+// replies and prints the error ones to out. It returns once every command
+// sent has its reply.
+//
+// The commands are parsed with the server's parser and sent again as
+// arrays, so that a file that is not valid RESP stops at its first invalid
+// command, whose number the error gives, rather than leaving the server's
+// parser in the middle of it.
+func pipe(c *client, in io.Reader, out io.Writer) (pipeStats, error) {
+	var sent atomic.Int64
+	progress := make(chan struct{}, 1) // Signaled when sent grows
+	done := make(chan error, 1)
+
+	go func() {
+		done <- sendAll(c, in, &sent, progress)
+	}()
+
+	var stats pipeStats
+	var sendErr error
+	writing := true
+	for {
+		if stats.replies < sent.Load() {
+			reply, err := resp.ReadReply(c.r)
+			if err != nil {
+				return stats, fmt.Errorf("reading the replies: %w", err)
+			}
+			stats.replies++
+			if e, ok := reply.(*resp.ErrReply); ok {
+				stats.errors++
+				fmt.Fprintln(out, e.Error)
+			}
+			continue
+		}
+		if !writing {
+			return stats, sendErr
+		}
+		select {
+		case <-progress:
+		case sendErr = <-done:
+			writing = false
+		}
+	}
+}
+
+// sendAll parses the commands of in and sends them through c. sent counts
+// the commands flushed to the connection, whose replies may be read: the
+// commands are flushed whenever in has no more data buffered, so that the
+// server is not left waiting for the end of a slow input.
+func sendAll(c *client, in io.Reader, sent *atomic.Int64, progress chan<- struct{}) error {
+	parser := resp.MakeParserWithLimits(0, 0)
+	var buffered, parsed int64
+	flush := func() error {
+		if err := c.w.Flush(); err != nil {
+			return fmt.Errorf("writing the commands: %w", err)
+		}
+		sent.Add(buffered)
+		buffered = 0
+		select {
+		case progress <- struct{}{}:
+		default:
+		}
+		return nil
+	}
+
+	for {
+		cmd, err := parser.ParseStream(in)
+		if err == io.EOF {
+			return flush()
+		}
+		if err != nil {
+			if flushErr := flush(); flushErr != nil {
+				return flushErr
+			}
+			return fmt.Errorf("command %d of the input: %w", parsed+1, err)
+		}
+		parsed++
+		if len(cmd) == 0 {
+			continue
+		}
+		if err := c.send(cmd); err != nil {
+			return fmt.Errorf("writing the commands: %w", err)
+		}
+		buffered++
+		if parser.Buffered() == 0 {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/wangbo/gocache/protocol/resp"
+)
+
+// replOptions configures the read-eval-print loop
+type replOptions struct {
+	prompt string // Printed before each command; empty when reading a script
+	raw    bool   // Print replies as they are, without types or quotes
+}
+
+// repl reads commands from in, a line each, split into arguments as
+// redis-cli splits them (see resp.ParseLine), sends them through c and
+// prints their replies to out, until the end of in or quit or exit. It
+// returns an error only if the connection fails.
+func repl(c *client, in io.Reader, out io.Writer, o replOptions) error {
+	lines := bufio.NewReader(in)
+	for {
+		if o.prompt != "" {
+			fmt.Fprint(out, o.prompt)
+		}
+		line, err := lines.ReadString('\n')
+		if line == "" && err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if strings.EqualFold(line, "quit") || strings.EqualFold(line, "exit") {
+			return nil
+		}
+		cmd, parseErr := resp.ParseLine(line)
+		if parseErr != nil {
+			fmt.Fprintln(out, "Invalid argument(s)")
+			continue
+		}
+		reply, err := c.do(cmd)
+		if err != nil {
+			return err
+		}
+		printReply(out, reply, o.raw)
+	}
+}
+
+// printReply prints reply to out, formatted as redis-cli does on a
+// terminal, or as it is with raw
+func printReply(out io.Writer, reply resp.Reply, raw bool) {
+	if raw {
+		fmt.Fprintln(out, rawReply(reply))
+	} else {
+		fmt.Fprint(out, formatReply(reply, ""))
+	}
+}
+
+// formatReply formats reply as redis-cli does on a terminal, a line per
+// value: each element of an array is numbered, and the elements of a nested
+// array are indented past the number of their parent. prefix is the
+// indentation of the lines after the first.
+func formatReply(reply resp.Reply, prefix string) string {
+	switch r := reply.(type) {
+	case *resp.StatusReply:
+		return r.Status + "\n"
+	case *resp.ErrReply:
+		return "(error) " + r.Error + "\n"
+	case *resp.IntReply:
+		return "(integer) " + strconv.FormatInt(r.Code, 10) + "\n"
+	case *resp.BulkReply:
+		if r.Arg == nil {
+			return "(nil)\n"
+		}
+		return quote(r.Arg) + "\n"
+	case *resp.MultiBulkReply:
+		if r.Args == nil {
+			return "(nil)\n"
+		}
+		elements := make([]resp.Reply, len(r.Args))
+		for i, arg := range r.Args {
+			elements[i] = resp.MakeBulkReply(arg)
+		}
+		return formatArray(elements, prefix)
+	case *resp.ArrayReply:
+		return formatArray(r.Replies, prefix)
+	default:
+		return string(reply.ToBytes())
+	}
+}
+
+// formatArray formats the elements of an array reply, numbered from 1
+func formatArray(elements []resp.Reply, prefix string) string {
+	if len(elements) == 0 {
+		return "(empty array)\n"
+	}
+	width := len(strconv.Itoa(len(elements)))
+	nested := prefix + strings.Repeat(" ", width+2)
+	var b strings.Builder
+	for i, element := range elements {
+		// The first line follows the number of the parent element
+		if i > 0 {
+			b.WriteString(prefix)
+		}
+		fmt.Fprintf(&b, "%*d) ", width, i+1)
+		b.WriteString(formatReply(element, nested))
+	}
+	return b.String()
+}
+
+// rawReply returns reply as it is, without its type: the elements of an
+// array a line each, and nothing for nil
+func rawReply(reply resp.Reply) string {
+	switch r := reply.(type) {
+	case *resp.StatusReply:
+		return r.Status
+	case *resp.ErrReply:
+		return r.Error
+	case *resp.IntReply:
+		return strconv.FormatInt(r.Code, 10)
+	case *resp.BulkReply:
+		return string(r.Arg)
+	case *resp.MultiBulkReply:
+		lines := make([]string, len(r.Args))
+		for i, arg := range r.Args {
+			lines[i] = string(arg)
+		}
+		return strings.Join(lines, "\n")
+	case *resp.ArrayReply:
+		lines := make([]string, len(r.Replies))
+		for i, element := range r.Replies {
+			lines[i] = rawReply(element)
+		}
+		return strings.Join(lines, "\n")
+	default:
+		return string(reply.ToBytes())
+	}
+}
+
+// quote returns s between double quotes, with quotes, backslashes and
+// unprintable bytes escaped as redis-cli escapes them
+func quote(s []byte) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, c := range s {
+		switch c {
+		case '\\', '"':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\r':
+			b.WriteString(`\r`)
+		case '\t':
+			b.WriteString(`\t`)
+		case '\a':
+			b.WriteString(`\a`)
+		case '\b':
+			b.WriteString(`\b`)
+		default:
+			if c >= ' ' && c <= '~' {
+				b.WriteByte(c)
+			} else {
+				fmt.Fprintf(&b, `\x%02x`, c)
+			}
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
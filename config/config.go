@@ -1,16 +1,18 @@
 package config
 
 import (
-	"bufio"
 	"fmt"
+	"math"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 )
 
 // Properties holds all configuration properties for GoCache
 type Properties struct {
-	// Server configuration
+	// Server configuration. Bind holds the addresses to listen on, separated
+	// by spaces; Port 0 lets the system pick a free port.
 	Bind      string
 	Port      int
 	Databases int
@@ -19,12 +21,34 @@ type Properties struct {
 	MaxClients int
 	Timeout    int // 0 means no timeout
 
+	// Request limits: arguments per command and bytes per argument
+	ProtoMaxMultiBulkLen int
+	ProtoMaxBulkLen      int64
+
+	// Largest number of bytes of all the arguments of a command, 0 for no
+	// limit
+	MaxCommandPayload int64
+
+	// Largest number of elements HGETALL, SMEMBERS, LRANGE, ZRANGE and the
+	// like may reply with, 0 for no limit
+	ProtoMaxReplyElements int
+
+	// Largest number of keys a connection may WATCH at once, 0 for no limit
+	MaxWatchedKeys int
+
 	// Persistence configuration
 	AppendOnly         bool
 	AppendFilename     string
 	AppendFsync        string // always, everysec, no
 	DBFilename         string
 	AOFUseRDBPreamble  bool // Use RDB preamble for AOF rewrite (hybrid persistence)
+	AOFLoadTruncated   bool // Load an AOF whose last command is cut short
+	// Bytes of commands queued for the AOF writer, 0 for no limit, and
+	// what a write finding the queue full does: block or drop
+	AOFBufferMax      int64
+	AOFBufferOverflow string
+	// Refuse writes while the last write to the AOF failed
+	StopWritesOnAOFError bool
 
 	// Logging configuration
 	LogLevel string // debug, info, warn, error
@@ -33,204 +57,195 @@ type Properties struct {
 	// Security
 	RequirePass string
 
+	// Directory of the persistence files ("" means the current directory),
+	// and the permissions it is created with if missing
+	Dir            string
+	DirPermissions os.FileMode
+
 	// Memory and eviction configuration
 	MaxMemory       int64  // Maximum memory in bytes (0 means no limit)
 	MaxMemoryPolicy string // Eviction policy: noeviction, allkeys-lru, allkeys-lfu, etc.
-}
 
-// Global configuration instance
-var Config = &Properties{
-	// Set default values
-	Bind:            "127.0.0.1",
-	Port:            16379,
-	Databases:       16,
-	MaxClients:      10000,
-	Timeout:         0,
-	AppendOnly:      false,
-	AppendFilename:  "appendonly.aof",
-	AppendFsync:     "everysec",
-	DBFilename:      "dump.rdb",
-	LogLevel:        "info",
-	LogFile:         "",
-	RequirePass:     "",
-	MaxMemory:       0,            // 0 means no limit
-	MaxMemoryPolicy: "noeviction", // Default: no eviction
-}
+	// Latency monitor threshold in milliseconds (0 disables the monitor)
+	LatencyMonitorThreshold int
 
-// Load loads configuration from file
-func Load(configPath string) error {
-	file, err := os.Open(configPath)
-	if err != nil {
-		if os.IsNotExist(err) {
-			// Config file doesn't exist, use defaults
-			return nil
-		}
-		return fmt.Errorf("failed to open config file: %w", err)
-	}
-	defer file.Close()
+	// Slow log threshold in microseconds (-1 disables the slow log, 0 logs
+	// every command) and number of entries kept
+	SlowLogLogSlowerThan int
+	SlowLogMaxLen        int
 
-	scanner := bufio.NewScanner(file)
-	lineNum := 0
-	for scanner.Scan() {
-		lineNum++
-		line := strings.TrimSpace(scanner.Text())
+	// Compression of string values: "lzf" compresses the values of at least
+	// ValueCompressionMinSize bytes as they are stored, "no" none
+	ValueCompression        string
+	ValueCompressionMinSize int
 
-		// Skip empty lines and comments
-		if line == "" || strings.HasPrefix(line, "#") {
-			continue
-		}
+	// Record creation time, last write time and write count of every key
+	TrackKeyMetadata bool
 
-		// Parse key-value pairs
-		parts := strings.SplitN(line, " ", 2)
-		if len(parts) != 2 {
-			return fmt.Errorf("invalid config at line %d: %s", lineNum, line)
-		}
+	// Record the last access time of every key for OBJECT IDLETIME, which
+	// LRU maxmemory policies do anyway
+	TrackIdle bool
 
-		key := strings.ToLower(strings.TrimSpace(parts[0]))
-		value := strings.TrimSpace(parts[1])
+	// Move the relative TTLs set on a master by up to this percentage
+	// either way, 0 for none
+	TTLJitterPercent int
 
-		// Remove quotes if present
-		if strings.HasPrefix(value, "\"") && strings.HasSuffix(value, "\"") {
-			value = value[1 : len(value)-1]
-		}
+	// Serve reads while a replica loads the dataset of its master
+	ReplicaServeStaleData bool
 
-		// Set configuration
-		if err := setConfig(key, value); err != nil {
-			return fmt.Errorf("failed to set config %s at line %d: %w", key, lineNum, err)
-		}
+	// Port of the HTTP listener serving /healthz and /metrics, 0 for none,
+	// and whether the health checks fail above maxmemory
+	HealthPort           int
+	HealthCheckMaxMemory bool
+
+	// Announce a static cluster topology to cluster-aware clients: the ID
+	// of this instance among the cluster nodes
+	ClusterAnnounce bool
+	ClusterMyID     string
+
+	// Repeatable directives, one entry per occurrence
+	SaveRules                []string // "<seconds> <changes>" snapshot rules
+	ClientOutputBufferLimits []string // "<class> <hard> <soft> <seconds>"
+	ClusterNodes             []string // "<id> <host:port> <slot|start-end> ..."
+
+	// Names clients must use for commands, by upper-case command name; an
+	// empty name disables the command
+	RenameCommands map[string]string
+}
+
+// Global configuration instance
+var Config = Default()
+
+// Default returns a new Properties holding the default configuration
+func Default() *Properties {
+	return &Properties{
+		Bind:            "127.0.0.1",
+		Port:            16379,
+		Databases:       16,
+		MaxClients:      10000,
+
+		ProtoMaxMultiBulkLen: 1024 * 1024, // As in Redis
+		ProtoMaxBulkLen:      512 << 20,
+		MaxCommandPayload:    1 << 30,
+		MaxWatchedKeys:       10000,
+		Timeout:         0,
+		AppendOnly:      false,
+		AppendFilename:  "appendonly.aof",
+		AppendFsync:     "everysec",
+		DBFilename:      "dump.rdb",
+		DirPermissions:  0700,
+		LogLevel:        "info",
+		LogFile:         "",
+		RequirePass:     "",
+		MaxMemory:       0,            // 0 means no limit
+		MaxMemoryPolicy: "noeviction", // Default: no eviction
+
+		SlowLogLogSlowerThan: 10000, // As in Redis
+		SlowLogMaxLen:        128,
+
+		ValueCompression:        "no",
+		ValueCompressionMinSize: 1024,
+
+		AOFBufferMax:      64 << 20,
+		AOFBufferOverflow: "block",
+
+		ReplicaServeStaleData: true,
+		AOFLoadTruncated:      true,
+		StopWritesOnAOFError:  true,
+		HealthCheckMaxMemory:  true,
 	}
+}
 
-	if err := scanner.Err(); err != nil {
-		return fmt.Errorf("error reading config file: %w", err)
+// DataPath returns the path of a persistence file: filename resolved against
+// Dir, unless it is absolute
+func (p *Properties) DataPath(filename string) string {
+	if p.Dir == "" || filepath.IsAbs(filename) {
+		return filename
 	}
+	return filepath.Join(p.Dir, filename)
+}
 
-	return nil
+// BindAddrs returns the addresses to listen on, or "" for all the
+// interfaces if Bind is empty
+func (p *Properties) BindAddrs() []string {
+	addrs := strings.Fields(p.Bind)
+	if len(addrs) == 0 {
+		return []string{""}
+	}
+	return addrs
 }
 
-// setConfig sets a single configuration value
-func setConfig(key, value string) error {
-	switch key {
-	case "bind":
-		Config.Bind = value
-	case "port":
-		port, err := strconv.Atoi(value)
-		if err != nil {
-			return fmt.Errorf("invalid port: %s", value)
-		}
-		if port < 1 || port > 65535 {
-			return fmt.Errorf("port out of range: %d", port)
-		}
-		Config.Port = port
-	case "databases":
-		dbs, err := strconv.Atoi(value)
-		if err != nil {
-			return fmt.Errorf("invalid databases: %s", value)
-		}
-		if dbs < 1 || dbs > 256 {
-			return fmt.Errorf("databases out of range: %d", dbs)
-		}
-		Config.Databases = dbs
-	case "maxclients":
-		clients, err := strconv.Atoi(value)
-		if err != nil {
-			return fmt.Errorf("invalid maxclients: %s", value)
-		}
-		Config.MaxClients = clients
-	case "timeout":
-		timeout, err := strconv.Atoi(value)
-		if err != nil {
-			return fmt.Errorf("invalid timeout: %s", value)
-		}
-		Config.Timeout = timeout
-	case "appendonly":
-		Config.AppendOnly = strings.ToLower(value) == "yes"
-	case "appendfilename":
-		Config.AppendFilename = value
-	case "appendfsync":
-		fsync := strings.ToLower(value)
-		if fsync != "always" && fsync != "everysec" && fsync != "no" {
-			return fmt.Errorf("invalid appendfsync: %s (must be always, everysec, or no)", value)
-		}
-		Config.AppendFsync = fsync
-	case "dbfilename":
-		Config.DBFilename = value
-	case "loglevel":
-		level := strings.ToLower(value)
-		if level != "debug" && level != "info" && level != "warn" && level != "error" {
-			return fmt.Errorf("invalid loglevel: %s (must be debug, info, warn, or error)", value)
-		}
-		Config.LogLevel = level
-	case "logfile":
-		Config.LogFile = value
-	case "requirepass":
-		Config.RequirePass = value
-	case "maxmemory":
-		maxMemory, err := parseMemorySize(value)
-		if err != nil {
-			return fmt.Errorf("invalid maxmemory: %s", value)
-		}
-		Config.MaxMemory = maxMemory
-	case "maxmemory-policy":
-		policy := strings.ToLower(value)
-		validPolicies := map[string]bool{
-			"noeviction":      true,
-			"allkeys-lru":     true,
-			"allkeys-lfu":     true,
-			"volatile-lru":    true,
-			"volatile-lfu":    true,
-			"allkeys-random":  true,
-			"volatile-random": true,
-			"volatile-ttl":    true,
+// MakeDir creates Dir and its missing parents with DirPermissions, if it
+// does not exist
+func (p *Properties) MakeDir() error {
+	if p.Dir == "" {
+		return nil
+	}
+	return os.MkdirAll(p.Dir, p.DirPermissions)
+}
+
+// OutputBufferHardLimit returns the hard output buffer limit in bytes of a
+// client class ("normal", "replica" or "pubsub") from the last matching
+// client-output-buffer-limit directive, or the Redis default. "slave" is an
+// alias of "replica"; 0 means no limit.
+func (p *Properties) OutputBufferHardLimit(class string) int64 {
+	if class == "slave" {
+		class = "replica"
+	}
+	limit := map[string]int64{"replica": 256 << 20, "pubsub": 32 << 20}[class]
+	for _, entry := range p.ClientOutputBufferLimits {
+		fields := strings.Fields(entry)
+		if fields[0] == "slave" {
+			fields[0] = "replica"
 		}
-		if !validPolicies[policy] {
-			return fmt.Errorf("invalid maxmemory-policy: %s", value)
+		if fields[0] == class {
+			limit, _ = ParseMemory(fields[1])
 		}
-		Config.MaxMemoryPolicy = policy
-	default:
-		// Ignore unknown config keys for now
-		return fmt.Errorf("unknown config key: %s", key)
 	}
-	return nil
+	return limit
 }
 
-// parseMemorySize parses memory size string (e.g., "1gb", "256mb")
-func parseMemorySize(s string) (int64, error) {
+// ParseMemory parses a memory size such as "256mb" or "1gb" into bytes.
+// As in redis.conf, k/m/g are powers of 1000 and kb/mb/gb powers of 1024;
+// units are case-insensitive and a plain number is a byte count.
+func ParseMemory(s string) (int64, error) {
 	s = strings.ToLower(strings.TrimSpace(s))
 
-	// Default to bytes if no unit
-	multiplier := int64(1)
-	unit := ""
-
-	// Extract unit (find where the number ends)
-	for i := len(s) - 1; i >= 0; i-- {
-		if s[i] >= '0' && s[i] <= '9' {
-			unit = s[i+1:]
-			s = s[:i+1]
-			break
-		}
+	// Split the number from its unit
+	i := 0
+	for i < len(s) && s[i] >= '0' && s[i] <= '9' {
+		i++
 	}
-
-	// Parse number
-	value, err := strconv.ParseInt(s, 10, 64)
-	if err != nil {
-		return 0, err
+	number, unit := s[:i], s[i:]
+	if number == "" {
+		return 0, fmt.Errorf("invalid memory size: %q", s)
 	}
 
-	// Apply multiplier
+	var multiplier int64
 	switch unit {
-	case "kb", "k":
-		multiplier = 1024
-	case "mb", "m":
-		multiplier = 1024 * 1024
-	case "gb", "g":
-		multiplier = 1024 * 1024 * 1024
-	case "tb", "t":
-		multiplier = 1024 * 1024 * 1024 * 1024
 	case "", "b":
 		multiplier = 1
+	case "k":
+		multiplier = 1000
+	case "kb":
+		multiplier = 1 << 10
+	case "m":
+		multiplier = 1000 * 1000
+	case "mb":
+		multiplier = 1 << 20
+	case "g":
+		multiplier = 1000 * 1000 * 1000
+	case "gb":
+		multiplier = 1 << 30
+	case "tb":
+		multiplier = 1 << 40
 	default:
-		return 0, fmt.Errorf("unknown unit: %s", unit)
+		return 0, fmt.Errorf("unknown memory unit: %q", unit)
 	}
 
+	value, err := strconv.ParseInt(number, 10, 64)
+	if err != nil || value > math.MaxInt64/multiplier {
+		return 0, fmt.Errorf("memory size out of range: %q", s)
+	}
 	return value * multiplier, nil
 }
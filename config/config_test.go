@@ -125,6 +125,34 @@ port 6379
 	}
 }
 
+func TestLoadConfigMultipleBindAddresses(t *testing.T) {
+	tmpDir := t.TempDir()
+	configPath := filepath.Join(tmpDir, "test.conf")
+	configContent := `bind 127.0.0.1  ::1
+port 0
+`
+	if err := os.WriteFile(configPath, []byte(configContent), 0644); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+
+	Config = &Properties{}
+	if err := Load(configPath); err != nil {
+		t.Fatalf("Load() failed: %v", err)
+	}
+	if Config.Bind != "127.0.0.1 ::1" {
+		t.Errorf("Expected Bind to be '127.0.0.1 ::1', got %q", Config.Bind)
+	}
+	if addrs := Config.BindAddrs(); len(addrs) != 2 || addrs[0] != "127.0.0.1" || addrs[1] != "::1" {
+		t.Errorf("Expected BindAddrs to be [127.0.0.1 ::1], got %q", addrs)
+	}
+	if Config.Port != 0 {
+		t.Errorf("Expected Port to be 0, got %d", Config.Port)
+	}
+	if addrs := (&Properties{}).BindAddrs(); len(addrs) != 1 || addrs[0] != "" {
+		t.Errorf("Expected an empty Bind to listen on all the interfaces, got %q", addrs)
+	}
+}
+
 func TestLoadConfigWithQuotes(t *testing.T) {
 	// Test that quoted values are handled correctly
 	tmpDir := t.TempDir()
@@ -191,11 +219,17 @@ func TestLoadConfigUnknownKey(t *testing.T) {
 		t.Fatalf("Failed to write config file: %v", err)
 	}
 
+	// Unknown directives are only an error in strict mode
 	Config = &Properties{}
-	err := Load(configPath)
+	err := LoadStrict(configPath)
 	if err == nil {
 		t.Error("Expected error for unknown config key, got nil")
 	}
+
+	Config = &Properties{}
+	if err := Load(configPath); err != nil {
+		t.Errorf("Expected unknown config key to be ignored, got %v", err)
+	}
 }
 
 func TestLoadConfigWithMemorySettings(t *testing.T) {
@@ -223,7 +257,7 @@ maxmemory-policy allkeys-lru
 	}
 }
 
-func TestParseMemorySize(t *testing.T) {
+func TestParseMemory(t *testing.T) {
 	tests := []struct {
 		input    string
 		expected int64
@@ -238,7 +272,7 @@ func TestParseMemorySize(t *testing.T) {
 	}
 
 	for _, tt := range tests {
-		result, err := parseMemorySize(tt.input)
+		result, err := ParseMemory(tt.input)
 		if tt.expected == 0 {
 			if err == nil {
 				t.Errorf("Expected error for input '%s', got nil", tt.input)
@@ -253,3 +287,32 @@ func TestParseMemorySize(t *testing.T) {
 		}
 	}
 }
+
+func TestDataPath(t *testing.T) {
+	p := Default()
+	if path := p.DataPath("dump.rdb"); path != "dump.rdb" {
+		t.Errorf("Expected dump.rdb without dir, got %s", path)
+	}
+
+	p.Dir = filepath.Join(t.TempDir(), "data", "gocache")
+	if path := p.DataPath("dump.rdb"); path != filepath.Join(p.Dir, "dump.rdb") {
+		t.Errorf("Expected dump.rdb in dir, got %s", path)
+	}
+	if path := p.DataPath("/backup/dump.rdb"); path != "/backup/dump.rdb" {
+		t.Errorf("Expected an absolute path to stay, got %s", path)
+	}
+
+	// The directory is created with its parents, then left alone
+	for i := 0; i < 2; i++ {
+		if err := p.MakeDir(); err != nil {
+			t.Fatalf("MakeDir: %v", err)
+		}
+	}
+	info, err := os.Stat(p.Dir)
+	if err != nil || !info.IsDir() {
+		t.Fatalf("Expected %s to be a directory: %v", p.Dir, err)
+	}
+	if perm := info.Mode().Perm(); perm != 0700 {
+		t.Errorf("Expected permissions 0700, got %o", perm)
+	}
+}
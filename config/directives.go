@@ -0,0 +1,285 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/wangbo/gocache/cluster"
+)
+
+// DirectiveFunc parses and validates the arguments of one occurrence of a
+// config directive and applies it to p
+type DirectiveFunc func(p *Properties, args []string) error
+
+// directives maps lower-case directive names to their parsers
+var directives = make(map[string]DirectiveFunc)
+
+// RegisterDirective registers the parser of a config directive. Names are
+// case-insensitive; registering a name twice replaces the earlier parser.
+func RegisterDirective(name string, fn DirectiveFunc) {
+	directives[strings.ToLower(name)] = fn
+}
+
+// applyDirective applies one occurrence of a directive to p. known is false if
+// no directive of that name is registered.
+func applyDirective(p *Properties, name string, args []string) (known bool, err error) {
+	fn, ok := directives[strings.ToLower(name)]
+	if !ok {
+		return false, nil
+	}
+	if err := fn(p, args); err != nil {
+		return true, fmt.Errorf("failed to set config %s: %w", strings.ToLower(name), err)
+	}
+	return true, nil
+}
+
+// ApplyDirective applies a directive to p as a line of the config file
+// would, returning the error of its parser as is
+func ApplyDirective(p *Properties, name string, args ...string) error {
+	fn, ok := directives[strings.ToLower(name)]
+	if !ok {
+		return fmt.Errorf("unknown config directive %q", name)
+	}
+	return fn(p, args)
+}
+
+// singleValue adapts a parser of exactly one argument to a DirectiveFunc
+func singleValue(fn func(p *Properties, value string) error) DirectiveFunc {
+	return func(p *Properties, args []string) error {
+		if len(args) != 1 {
+			return fmt.Errorf("expected 1 argument, got %d", len(args))
+		}
+		return fn(p, args[0])
+	}
+}
+
+// oneOf returns a parser that accepts a case-insensitive value from a fixed set
+func oneOf(set func(p *Properties, value string), values ...string) DirectiveFunc {
+	return singleValue(func(p *Properties, value string) error {
+		value = strings.ToLower(value)
+		for _, v := range values {
+			if value == v {
+				set(p, value)
+				return nil
+			}
+		}
+		return fmt.Errorf("invalid value %q (must be one of %s)", value, strings.Join(values, ", "))
+	})
+}
+
+// intRange returns a parser of an integer within [min, max]
+func intRange(set func(p *Properties, value int), min, max int) DirectiveFunc {
+	return singleValue(func(p *Properties, value string) error {
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid integer: %s", value)
+		}
+		if n < min || n > max {
+			return fmt.Errorf("value out of range: %d", n)
+		}
+		set(p, n)
+		return nil
+	})
+}
+
+// yesNo returns a parser of a yes/no flag
+func yesNo(set func(p *Properties, value bool)) DirectiveFunc {
+	return singleValue(func(p *Properties, value string) error {
+		switch strings.ToLower(value) {
+		case "yes":
+			set(p, true)
+		case "no":
+			set(p, false)
+		default:
+			return fmt.Errorf("argument must be 'yes' or 'no': %s", value)
+		}
+		return nil
+	})
+}
+
+// stringValue returns a parser that stores its argument verbatim
+func stringValue(set func(p *Properties, value string)) DirectiveFunc {
+	return singleValue(func(p *Properties, value string) error {
+		set(p, value)
+		return nil
+	})
+}
+
+func init() {
+	RegisterDirective("bind", parseBind)
+	RegisterDirective("port", intRange(func(p *Properties, v int) { p.Port = v }, 0, 65535))
+	RegisterDirective("databases", intRange(func(p *Properties, v int) { p.Databases = v }, 1, 256))
+	RegisterDirective("maxclients", intRange(func(p *Properties, v int) { p.MaxClients = v }, 1, 1<<31-1))
+	RegisterDirective("timeout", intRange(func(p *Properties, v int) { p.Timeout = v }, 0, 1<<31-1))
+	RegisterDirective("proto-max-multibulk-len", intRange(func(p *Properties, v int) { p.ProtoMaxMultiBulkLen = v }, 1, 1<<31-1))
+	RegisterDirective("proto-max-bulk-len", singleValue(func(p *Properties, value string) error {
+		n, err := ParseMemory(value)
+		if err != nil || n < 1<<20 {
+			return fmt.Errorf("invalid proto-max-bulk-len (at least 1mb): %s", value)
+		}
+		p.ProtoMaxBulkLen = n
+		return nil
+	}))
+	RegisterDirective("max-command-payload", singleValue(func(p *Properties, value string) error {
+		n, err := ParseMemory(value)
+		if err != nil {
+			return fmt.Errorf("invalid max-command-payload: %s", value)
+		}
+		p.MaxCommandPayload = n
+		return nil
+	}))
+	RegisterDirective("proto-max-reply-elements", intRange(func(p *Properties, v int) { p.ProtoMaxReplyElements = v }, 0, 1<<31-1))
+	RegisterDirective("max-watched-keys", intRange(func(p *Properties, v int) { p.MaxWatchedKeys = v }, 0, 1<<31-1))
+
+	RegisterDirective("appendonly", yesNo(func(p *Properties, v bool) { p.AppendOnly = v }))
+	RegisterDirective("appendfilename", stringValue(func(p *Properties, v string) { p.AppendFilename = v }))
+	RegisterDirective("appendfsync", oneOf(func(p *Properties, v string) { p.AppendFsync = v }, "always", "everysec", "no"))
+	RegisterDirective("aof-use-rdb-preamble", yesNo(func(p *Properties, v bool) { p.AOFUseRDBPreamble = v }))
+	RegisterDirective("aof-buffer-max", singleValue(func(p *Properties, value string) error {
+		n, err := ParseMemory(value)
+		if err != nil {
+			return fmt.Errorf("invalid aof-buffer-max: %s", value)
+		}
+		p.AOFBufferMax = n
+		return nil
+	}))
+	RegisterDirective("aof-buffer-overflow", oneOf(func(p *Properties, v string) { p.AOFBufferOverflow = v }, "block", "drop"))
+	RegisterDirective("aof-load-truncated", yesNo(func(p *Properties, v bool) { p.AOFLoadTruncated = v }))
+	RegisterDirective("stop-writes-on-aof-error", yesNo(func(p *Properties, v bool) { p.StopWritesOnAOFError = v }))
+	RegisterDirective("dbfilename", stringValue(func(p *Properties, v string) { p.DBFilename = v }))
+	RegisterDirective("dir", stringValue(func(p *Properties, v string) { p.Dir = v }))
+	RegisterDirective("dir-permissions", singleValue(func(p *Properties, value string) error {
+		mode, err := strconv.ParseUint(value, 8, 32)
+		if err != nil || mode > 0777 {
+			return fmt.Errorf("invalid permissions (octal, as 0700): %s", value)
+		}
+		p.DirPermissions = os.FileMode(mode)
+		return nil
+	}))
+
+	RegisterDirective("loglevel", oneOf(func(p *Properties, v string) { p.LogLevel = v }, "debug", "info", "warn", "error"))
+	RegisterDirective("logfile", stringValue(func(p *Properties, v string) { p.LogFile = v }))
+	RegisterDirective("requirepass", stringValue(func(p *Properties, v string) { p.RequirePass = v }))
+
+	RegisterDirective("maxmemory", singleValue(func(p *Properties, value string) error {
+		maxMemory, err := ParseMemory(value)
+		if err != nil {
+			return fmt.Errorf("invalid maxmemory: %s", value)
+		}
+		p.MaxMemory = maxMemory
+		return nil
+	}))
+	RegisterDirective("maxmemory-policy", oneOf(func(p *Properties, v string) { p.MaxMemoryPolicy = v },
+		"noeviction", "allkeys-lru", "allkeys-lfu", "volatile-lru",
+		"volatile-lfu", "allkeys-random", "volatile-random", "volatile-ttl"))
+
+	RegisterDirective("slowlog-log-slower-than", intRange(func(p *Properties, v int) { p.SlowLogLogSlowerThan = v }, -1, 1<<31-1))
+	RegisterDirective("slowlog-max-len", intRange(func(p *Properties, v int) { p.SlowLogMaxLen = v }, 0, 1<<31-1))
+	RegisterDirective("value-compression", oneOf(func(p *Properties, v string) { p.ValueCompression = v }, "no", "lzf"))
+	RegisterDirective("value-compression-min-size", intRange(func(p *Properties, v int) { p.ValueCompressionMinSize = v }, 1, 1<<31-1))
+	RegisterDirective("latency-monitor-threshold", intRange(func(p *Properties, v int) { p.LatencyMonitorThreshold = v }, 0, 1<<31-1))
+	RegisterDirective("track-key-metadata", yesNo(func(p *Properties, v bool) { p.TrackKeyMetadata = v }))
+	RegisterDirective("track-idle", yesNo(func(p *Properties, v bool) { p.TrackIdle = v }))
+	RegisterDirective("ttl-jitter-percent", intRange(func(p *Properties, v int) { p.TTLJitterPercent = v }, 0, 100))
+	RegisterDirective("replica-serve-stale-data", yesNo(func(p *Properties, v bool) { p.ReplicaServeStaleData = v }))
+	RegisterDirective("slave-serve-stale-data", yesNo(func(p *Properties, v bool) { p.ReplicaServeStaleData = v }))
+	RegisterDirective("health-port", intRange(func(p *Properties, v int) { p.HealthPort = v }, 0, 65535))
+	RegisterDirective("healthcheck-maxmemory", yesNo(func(p *Properties, v bool) { p.HealthCheckMaxMemory = v }))
+
+	RegisterDirective("save", parseSave)
+	RegisterDirective("client-output-buffer-limit", parseClientOutputBufferLimit)
+
+	RegisterDirective("cluster-announce", yesNo(func(p *Properties, v bool) { p.ClusterAnnounce = v }))
+	RegisterDirective("cluster-myid", stringValue(func(p *Properties, v string) { p.ClusterMyID = v }))
+	RegisterDirective("cluster-node", parseClusterNode)
+
+	RegisterDirective("rename-command", parseRenameCommand)
+}
+
+// parseBind parses "bind <address> [address ...]". Addresses may also come
+// in one argument separated by spaces, as from --bind.
+func parseBind(p *Properties, args []string) error {
+	var addrs []string
+	for _, arg := range args {
+		addrs = append(addrs, strings.Fields(arg)...)
+	}
+	if len(addrs) == 0 {
+		return fmt.Errorf("expected at least 1 address")
+	}
+	p.Bind = strings.Join(addrs, " ")
+	return nil
+}
+
+// parseSave parses `save <seconds> <changes> [<seconds> <changes> ...]`.
+// Every occurrence adds rules; `save ""` removes all rules.
+func parseSave(p *Properties, args []string) error {
+	if len(args) == 1 && args[0] == "" {
+		p.SaveRules = []string{}
+		return nil
+	}
+	if len(args) == 0 || len(args)%2 != 0 {
+		return fmt.Errorf("save expects pairs of <seconds> <changes>")
+	}
+	for i := 0; i < len(args); i += 2 {
+		for _, arg := range args[i : i+2] {
+			if n, err := strconv.Atoi(arg); err != nil || n < 0 {
+				return fmt.Errorf("invalid save parameter: %s", arg)
+			}
+		}
+		p.SaveRules = append(p.SaveRules, args[i]+" "+args[i+1])
+	}
+	return nil
+}
+
+// parseClientOutputBufferLimit parses
+// `client-output-buffer-limit <class> <hard> <soft> <seconds>`
+func parseClientOutputBufferLimit(p *Properties, args []string) error {
+	if len(args) != 4 {
+		return fmt.Errorf("expected <class> <hard limit> <soft limit> <soft seconds>")
+	}
+	class := strings.ToLower(args[0])
+	switch class {
+	case "normal", "replica", "slave", "pubsub":
+	default:
+		return fmt.Errorf("invalid client class: %s", args[0])
+	}
+	for _, limit := range args[1:3] {
+		if _, err := ParseMemory(limit); err != nil {
+			return fmt.Errorf("invalid buffer limit: %s", limit)
+		}
+	}
+	if n, err := strconv.Atoi(args[3]); err != nil || n < 0 {
+		return fmt.Errorf("invalid soft seconds: %s", args[3])
+	}
+	p.ClientOutputBufferLimits = append(p.ClientOutputBufferLimits, class+" "+strings.Join(args[1:], " "))
+	return nil
+}
+
+// parseClusterNode parses `cluster-node <id> <host:port> <slot|start-end> ...`.
+// Every occurrence adds a node; the topology as a whole is checked when the
+// server starts (see cluster.NewTopology).
+func parseClusterNode(p *Properties, args []string) error {
+	if _, err := cluster.ParseNode(args); err != nil {
+		return err
+	}
+	p.ClusterNodes = append(p.ClusterNodes, strings.Join(args, " "))
+	return nil
+}
+
+// parseRenameCommand parses `rename-command <command> <new-name>`. Every
+// occurrence renames one command; `rename-command <command> ""` disables it.
+func parseRenameCommand(p *Properties, args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("expected 2 arguments, got %d", len(args))
+	}
+	if args[0] == "" || strings.ContainsAny(args[1], " \t") {
+		return fmt.Errorf("invalid command name")
+	}
+	if p.RenameCommands == nil {
+		p.RenameCommands = make(map[string]string)
+	}
+	p.RenameCommands[strings.ToUpper(args[0])] = args[1]
+	return nil
+}
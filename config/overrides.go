@@ -0,0 +1,88 @@
+package config
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Configuration overrides
+//
+// Settings are resolved in this order, later sources overriding earlier ones:
+//
+//	defaults < config file < GOCACHE_* environment variables < command-line flags
+//
+// An environment variable names a directive in upper case with dashes
+// replaced by underscores (GOCACHE_MAXMEMORY_POLICY sets maxmemory-policy).
+// Its value is split into arguments like the rest of a config line, so
+// `GOCACHE_SAVE="900 1 300 10"` works and values with spaces must be quoted.
+
+// EnvPrefix is the prefix of environment variables that override directives
+const EnvPrefix = "GOCACHE_"
+
+// LoadWithOverrides loads the config file into Config, then applies
+// environment overrides from environ (as returned by os.Environ) and
+// command-line flag values keyed by directive name
+func LoadWithOverrides(configPath string, environ []string, flags map[string]string) error {
+	if configPath != "" {
+		if err := Load(configPath); err != nil {
+			return err
+		}
+	}
+	if err := ApplyEnv(Config, environ); err != nil {
+		return err
+	}
+	return ApplyFlags(Config, flags)
+}
+
+// ApplyEnv applies GOCACHE_* environment variables to p. Variables that do
+// not name a known directive are ignored with a warning.
+func ApplyEnv(p *Properties, environ []string) error {
+	for _, kv := range environ {
+		if !strings.HasPrefix(kv, EnvPrefix) {
+			continue
+		}
+		key, value, _ := strings.Cut(kv[len(EnvPrefix):], "=")
+		name := strings.ReplaceAll(strings.ToLower(key), "_", "-")
+
+		args, err := splitArgs(value)
+		if err != nil {
+			return fmt.Errorf("%s%s: %w", EnvPrefix, key, err)
+		}
+		if len(args) == 0 {
+			// An empty value still sets an empty string
+			args = []string{""}
+		}
+
+		known, err := applyDirective(p, name, args)
+		if !known {
+			fmt.Printf("Warning: ignoring %s%s, no config directive %s\n", EnvPrefix, key, name)
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("%s%s: %w", EnvPrefix, key, err)
+		}
+	}
+	return nil
+}
+
+// ApplyFlags applies command-line flag values keyed by directive name to p.
+// Each value is a single argument.
+func ApplyFlags(p *Properties, flags map[string]string) error {
+	names := make([]string, 0, len(flags))
+	for name := range flags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		known, err := applyDirective(p, name, []string{flags[name]})
+		if !known {
+			return fmt.Errorf("--%s: no such config directive", name)
+		}
+		if err != nil {
+			return fmt.Errorf("--%s: %w", name, err)
+		}
+	}
+	return nil
+}
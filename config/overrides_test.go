@@ -0,0 +1,143 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadWithOverridesPrecedence(t *testing.T) {
+	saved := Config
+	defer func() { Config = saved }()
+	Config = &Properties{Port: 16379, Bind: "127.0.0.1", LogLevel: "info"}
+
+	configPath := filepath.Join(t.TempDir(), "test.conf")
+	content := "port 7000\nbind 0.0.0.0\nmaxmemory 1mb\nrequirepass fromfile\n"
+	if err := os.WriteFile(configPath, []byte(content), 0644); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+
+	environ := []string{
+		"PATH=/usr/bin",
+		"GOCACHE_PORT=7001",
+		"GOCACHE_MAXMEMORY=256mb",
+		"GOCACHE_MAXMEMORY_POLICY=allkeys-lru",
+		`GOCACHE_SAVE=900 1 300 10`,
+	}
+	flags := map[string]string{
+		"port":        "7002",
+		"requirepass": "from flag",
+	}
+
+	if err := LoadWithOverrides(configPath, environ, flags); err != nil {
+		t.Fatalf("LoadWithOverrides failed: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		expected interface{}
+		actual   interface{}
+	}{
+		{"flag over env and file", 7002, Config.Port},
+		{"flag value with spaces", "from flag", Config.RequirePass},
+		{"env over file", int64(256 << 20), Config.MaxMemory},
+		{"env over default", "allkeys-lru", Config.MaxMemoryPolicy},
+		{"env with several arguments", 2, len(Config.SaveRules)},
+		{"file over default", "0.0.0.0", Config.Bind},
+		{"default", "info", Config.LogLevel},
+	}
+	for _, tt := range tests {
+		if tt.expected != tt.actual {
+			t.Errorf("%s: expected %v, got %v", tt.name, tt.expected, tt.actual)
+		}
+	}
+}
+
+func TestApplyEnvErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		environ []string
+		wantErr string
+	}{
+		{"invalid memory", []string{"GOCACHE_MAXMEMORY=lots"}, "GOCACHE_MAXMEMORY"},
+		{"invalid port", []string{"GOCACHE_PORT=70000"}, "out of range"},
+		{"unbalanced quotes", []string{`GOCACHE_REQUIREPASS="abc`}, "unbalanced quotes"},
+		{"unknown variable ignored", []string{"GOCACHE_NO_SUCH_OPTION=1"}, ""},
+		{"other prefix ignored", []string{"REDIS_PORT=abc"}, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ApplyEnv(&Properties{}, tt.environ)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("Unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Expected error containing %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestApplyFlagsErrors(t *testing.T) {
+	if err := ApplyFlags(&Properties{}, map[string]string{"maxmemory": "-1"}); err == nil {
+		t.Error("Expected error for invalid --maxmemory")
+	}
+	if err := ApplyFlags(&Properties{}, map[string]string{"appendonly": "maybe"}); err == nil {
+		t.Error("Expected error for invalid --appendonly")
+	}
+	if err := ApplyFlags(&Properties{}, map[string]string{"no-such-flag": "1"}); err == nil {
+		t.Error("Expected error for unknown flag")
+	}
+
+	p := &Properties{}
+	if err := ApplyFlags(p, map[string]string{"dir": "/data", "appendonly": "yes", "logfile": "/tmp/x.log"}); err != nil {
+		t.Fatalf("ApplyFlags failed: %v", err)
+	}
+	if p.Dir != "/data" || !p.AppendOnly || p.LogFile != "/tmp/x.log" {
+		t.Errorf("Unexpected properties %+v", p)
+	}
+}
+
+func TestParseMemorySuffixes(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected int64
+		wantErr  bool
+	}{
+		{"0", 0, false},
+		{"1024", 1024, false},
+		{"10b", 10, false},
+		{"1k", 1000, false},
+		{"1kb", 1024, false},
+		{"1m", 1000000, false},
+		{"1mb", 1 << 20, false},
+		{"1g", 1000000000, false},
+		{"1gb", 1 << 30, false},
+		{"2tb", 2 << 40, false},
+		{"256MB", 256 << 20, false},
+		{" 64kb ", 64 << 10, false},
+		{"", 0, true},
+		{"mb", 0, true},
+		{"-1mb", 0, true},
+		{"1.5gb", 0, true},
+		{"10 mb", 0, true},
+		{"10xb", 0, true},
+		{"9223372036854775807kb", 0, true},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseMemory(tt.input)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseMemory(%q) error = %v, wantErr %v", tt.input, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && got != tt.expected {
+			t.Errorf("ParseMemory(%q) = %d, want %d", tt.input, got, tt.expected)
+		}
+	}
+}
@@ -0,0 +1,228 @@
+package config
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Config file parsing
+//
+// The syntax follows redis.conf: one directive per line, directive names are
+// case-insensitive, arguments are separated by whitespace and may be quoted.
+// Double-quoted arguments support \n, \r, \t, \b, \a, \\, \" and \xHH escapes;
+// single-quoted arguments only support \'. A # outside quotes at the start of
+// an argument starts a comment that runs to the end of the line.
+//
+// `include <path>` loads another file in place. Relative paths are resolved
+// against the directory of the including file. Including a file that is
+// already being loaded is an error.
+
+// Loader loads redis.conf-style files
+type Loader struct {
+	// Strict makes unknown directives an error instead of a warning
+	Strict bool
+	// Warnings collects messages about ignored directives
+	Warnings []string
+
+	loading []string // Absolute paths of the files being loaded
+}
+
+// Load loads configuration from file into Config. A missing file is not an
+// error. Unknown directives are reported as warnings.
+func Load(configPath string) error {
+	return load(&Loader{}, configPath)
+}
+
+// LoadStrict is like Load but fails on unknown directives
+func LoadStrict(configPath string) error {
+	return load(&Loader{Strict: true}, configPath)
+}
+
+func load(l *Loader, configPath string) error {
+	if _, err := os.Stat(configPath); os.IsNotExist(err) {
+		// Config file doesn't exist, use defaults
+		return nil
+	}
+
+	err := l.LoadFile(Config, configPath)
+	for _, warning := range l.Warnings {
+		fmt.Printf("Warning: %s\n", warning)
+	}
+	return err
+}
+
+// LoadFile applies the directives of a config file to p
+func (l *Loader) LoadFile(p *Properties, path string) error {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return fmt.Errorf("failed to resolve config path %s: %w", path, err)
+	}
+	for _, loading := range l.loading {
+		if loading == absPath {
+			return fmt.Errorf("include cycle: %s", strings.Join(append(l.loading, absPath), " -> "))
+		}
+	}
+
+	file, err := os.Open(absPath)
+	if err != nil {
+		return fmt.Errorf("failed to open config file: %w", err)
+	}
+	defer file.Close()
+
+	l.loading = append(l.loading, absPath)
+	defer func() { l.loading = l.loading[:len(l.loading)-1] }()
+
+	scanner := bufio.NewScanner(file)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		if err := l.applyLine(p, absPath, scanner.Text()); err != nil {
+			return fmt.Errorf("%s:%d: %w", path, lineNum, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("error reading config file: %w", err)
+	}
+
+	return nil
+}
+
+// applyLine parses and applies a single config line
+func (l *Loader) applyLine(p *Properties, path, line string) error {
+	args, err := splitArgs(line)
+	if err != nil {
+		return err
+	}
+	if len(args) == 0 {
+		return nil
+	}
+
+	name := strings.ToLower(args[0])
+	if name == "include" {
+		if len(args) != 2 {
+			return errors.New("include expects a single path")
+		}
+		included := args[1]
+		if !filepath.IsAbs(included) {
+			included = filepath.Join(filepath.Dir(path), included)
+		}
+		return l.LoadFile(p, included)
+	}
+
+	known, err := applyDirective(p, name, args[1:])
+	if !known {
+		if l.Strict {
+			return fmt.Errorf("unknown config directive: %s", args[0])
+		}
+		l.Warnings = append(l.Warnings, fmt.Sprintf("%s: ignoring unknown config directive %s", path, args[0]))
+	}
+	return err
+}
+
+// splitArgs splits a config line into arguments, handling quotes, escapes
+// and end-of-line comments
+func splitArgs(line string) ([]string, error) {
+	var args []string
+	i := 0
+	for {
+		for i < len(line) && isSpace(line[i]) {
+			i++
+		}
+		if i >= len(line) || line[i] == '#' {
+			return args, nil
+		}
+
+		var arg strings.Builder
+		switch line[i] {
+		case '"':
+			i++
+			for {
+				if i >= len(line) {
+					return nil, errors.New("unbalanced quotes")
+				}
+				c := line[i]
+				if c == '"' {
+					i++
+					break
+				}
+				if c == '\\' && i+1 < len(line) {
+					n, decoded, ok := unescape(line[i+1:])
+					if ok {
+						arg.WriteByte(decoded)
+						i += 1 + n
+						continue
+					}
+				}
+				arg.WriteByte(c)
+				i++
+			}
+		case '\'':
+			i++
+			for {
+				if i >= len(line) {
+					return nil, errors.New("unbalanced quotes")
+				}
+				c := line[i]
+				if c == '\'' {
+					i++
+					break
+				}
+				if c == '\\' && i+1 < len(line) && line[i+1] == '\'' {
+					arg.WriteByte('\'')
+					i += 2
+					continue
+				}
+				arg.WriteByte(c)
+				i++
+			}
+		default:
+			for i < len(line) && !isSpace(line[i]) {
+				arg.WriteByte(line[i])
+				i++
+			}
+			args = append(args, arg.String())
+			continue
+		}
+
+		// A closing quote must be followed by whitespace or the end of line
+		if i < len(line) && !isSpace(line[i]) {
+			return nil, errors.New("closing quote must be followed by a space")
+		}
+		args = append(args, arg.String())
+	}
+}
+
+// unescape decodes the escape sequence at the start of s (after the
+// backslash) and returns the number of bytes consumed
+func unescape(s string) (int, byte, bool) {
+	switch s[0] {
+	case 'n':
+		return 1, '\n', true
+	case 'r':
+		return 1, '\r', true
+	case 't':
+		return 1, '\t', true
+	case 'b':
+		return 1, '\b', true
+	case 'a':
+		return 1, '\a', true
+	case '\\', '"':
+		return 1, s[0], true
+	case 'x':
+		if len(s) >= 3 {
+			if v, err := strconv.ParseUint(s[1:3], 16, 8); err == nil {
+				return 3, byte(v), true
+			}
+		}
+	}
+	return 0, 0, false
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\r' || c == '\n'
+}
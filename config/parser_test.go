@@ -0,0 +1,319 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSplitArgs(t *testing.T) {
+	tests := []struct {
+		name    string
+		line    string
+		want    []string
+		wantErr bool
+	}{
+		{"empty", "", nil, false},
+		{"comment", "# port 6379", nil, false},
+		{"simple", "port 6379", []string{"port", "6379"}, false},
+		{"extra whitespace", "  port\t 6379  ", []string{"port", "6379"}, false},
+		{"trailing comment", "port 6379 # the port", []string{"port", "6379"}, false},
+		{"hash inside value", "requirepass pa#ss", []string{"requirepass", "pa#ss"}, false},
+		{"double quotes", `requirepass "my secret"`, []string{"requirepass", "my secret"}, false},
+		{"empty quotes", `save ""`, []string{"save", ""}, false},
+		{"escapes", `requirepass "a\"b\\c\n\x41"`, []string{"requirepass", "a\"b\\c\nA"}, false},
+		{"hash inside quotes", `requirepass "# not a comment"`, []string{"requirepass", "# not a comment"}, false},
+		{"single quotes", `requirepass 'it\'s "raw" \n'`, []string{"requirepass", `it's "raw" \n`}, false},
+		{"unbalanced double", `requirepass "oops`, nil, true},
+		{"unbalanced single", `requirepass 'oops`, nil, true},
+		{"text after quote", `requirepass "a"b`, nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := splitArgs(tt.line)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("splitArgs(%q) error = %v, wantErr %v", tt.line, err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("splitArgs(%q) = %q, want %q", tt.line, got, tt.want)
+			}
+		})
+	}
+}
+
+// writeConfigFiles writes name -> content files into dir
+func writeConfigFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("Failed to create dir: %v", err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+	}
+}
+
+func TestLoaderDirectives(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		strict  bool
+		check   func(p *Properties) bool
+		wantErr string
+	}{
+		{
+			name:    "case-insensitive names",
+			content: "PORT 7000\nMaxMemory-Policy ALLKEYS-LRU\n",
+			check:   func(p *Properties) bool { return p.Port == 7000 && p.MaxMemoryPolicy == "allkeys-lru" },
+		},
+		{
+			name:    "repeated save accumulates",
+			content: "save 900 1\nsave 300 10\nsave 60 10000 30 100000\n",
+			check: func(p *Properties) bool {
+				return reflect.DeepEqual(p.SaveRules, []string{"900 1", "300 10", "60 10000", "30 100000"})
+			},
+		},
+		{
+			name:    "empty save clears rules",
+			content: "save 900 1\nsave \"\"\n",
+			check:   func(p *Properties) bool { return p.SaveRules != nil && len(p.SaveRules) == 0 },
+		},
+		{
+			name:    "client output buffer limits accumulate",
+			content: "client-output-buffer-limit normal 0 0 0\nclient-output-buffer-limit pubsub 32mb 8mb 60\n",
+			check: func(p *Properties) bool {
+				return reflect.DeepEqual(p.ClientOutputBufferLimits, []string{"normal 0 0 0", "pubsub 32mb 8mb 60"})
+			},
+		},
+		{
+			name:    "replica output buffer hard limit",
+			content: "client-output-buffer-limit slave 64mb 16mb 60\nclient-output-buffer-limit replica 1gb 256mb 60\n",
+			check: func(p *Properties) bool {
+				return p.OutputBufferHardLimit("replica") == 1<<30 && p.OutputBufferHardLimit("normal") == 0
+			},
+		},
+		{
+			name:    "default replica output buffer hard limit",
+			content: "port 7000\n",
+			check:   func(p *Properties) bool { return p.OutputBufferHardLimit("slave") == 256<<20 },
+		},
+		{
+			name:    "protocol limits",
+			content: "proto-max-bulk-len 1gb\nproto-max-multibulk-len 1000\n",
+			check:   func(p *Properties) bool { return p.ProtoMaxBulkLen == 1<<30 && p.ProtoMaxMultiBulkLen == 1000 },
+		},
+		{
+			name:    "reply element limit",
+			content: "proto-max-reply-elements 5000\n",
+			check:   func(p *Properties) bool { return p.ProtoMaxReplyElements == 5000 },
+		},
+		{
+			name:    "watched key limit",
+			content: "max-watched-keys 0\n",
+			check:   func(p *Properties) bool { return p.MaxWatchedKeys == 0 },
+		},
+		{
+			name:    "AOF buffer",
+			content: "aof-buffer-max 1mb\naof-buffer-overflow DROP\n",
+			check:   func(p *Properties) bool { return p.AOFBufferMax == 1<<20 && p.AOFBufferOverflow == "drop" },
+		},
+		{
+			name:    "dir permissions",
+			content: "dir /data\ndir-permissions 750\n",
+			check:   func(p *Properties) bool { return p.Dir == "/data" && p.DirPermissions == 0750 },
+		},
+		{
+			name:    "slow log settings",
+			content: "slowlog-log-slower-than -1\nslowlog-max-len 0\n",
+			check:   func(p *Properties) bool { return p.SlowLogLogSlowerThan == -1 && p.SlowLogMaxLen == 0 },
+		},
+		{
+			name:    "value compression",
+			content: "value-compression LZF\nvalue-compression-min-size 4096\n",
+			check:   func(p *Properties) bool { return p.ValueCompression == "lzf" && p.ValueCompressionMinSize == 4096 },
+		},
+		{
+			name:    "cluster nodes accumulate",
+			content: "cluster-announce yes\ncluster-myid a\ncluster-node a 10.0.0.1:7000 0-8191\ncluster-node b 10.0.0.2:7000 8192-16383 \n",
+			check: func(p *Properties) bool {
+				return p.ClusterAnnounce && p.ClusterMyID == "a" &&
+					reflect.DeepEqual(p.ClusterNodes, []string{"a 10.0.0.1:7000 0-8191", "b 10.0.0.2:7000 8192-16383"})
+			},
+		},
+		{
+			name:    "renamed commands",
+			content: "rename-command flushall wipe\nrename-command CONFIG \"\"\n",
+			check: func(p *Properties) bool {
+				return reflect.DeepEqual(p.RenameCommands, map[string]string{"FLUSHALL": "wipe", "CONFIG": ""})
+			},
+		},
+		{
+			name:    "last single value wins",
+			content: "port 7000\nport 7001\n",
+			check:   func(p *Properties) bool { return p.Port == 7001 },
+		},
+		{
+			name:    "unknown directive warns",
+			content: "no-such-option yes\nport 7000\n",
+			check:   func(p *Properties) bool { return p.Port == 7000 },
+		},
+		{name: "unknown directive strict", content: "no-such-option yes\n", strict: true, wantErr: "unknown config directive"},
+		{name: "missing argument", content: "port\n", wantErr: "expected 1 argument"},
+		{name: "too many arguments", content: "port 1 2\n", wantErr: "expected 1 argument"},
+		{name: "bad integer", content: "port abc\n", wantErr: "invalid integer"},
+		{name: "bad yes/no", content: "appendonly maybe\n", wantErr: "'yes' or 'no'"},
+		{name: "odd save arguments", content: "save 900\n", wantErr: "pairs"},
+		{name: "small bulk limit", content: "proto-max-bulk-len 1kb\n", wantErr: "at least 1mb"},
+		{name: "negative reply limit", content: "proto-max-reply-elements -1\n", wantErr: "proto-max-reply-elements"},
+		{name: "slow log threshold below -1", content: "slowlog-log-slower-than -2\n", wantErr: "out of range"},
+		{name: "unknown compression", content: "value-compression snappy\n", wantErr: "must be one of no, lzf"},
+		{name: "rename without new name", content: "rename-command DEBUG\n", wantErr: "expected 2 arguments"},
+		{name: "bad dir permissions", content: "dir-permissions 0800\n", wantErr: "invalid permissions"},
+		{name: "bad cluster node", content: "cluster-node a 10.0.0.1:7000 0-16384\n", wantErr: "invalid slot range"},
+		{name: "bad save number", content: "save 900 x\n", wantErr: "invalid save parameter"},
+		{name: "bad buffer class", content: "client-output-buffer-limit vip 0 0 0\n", wantErr: "invalid client class"},
+		{name: "unbalanced quote", content: "requirepass \"abc\n", wantErr: "unbalanced quotes"},
+		{name: "error reports line", content: "port 7000\n\nport 70000\n", wantErr: "test.conf:3:"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeConfigFiles(t, dir, map[string]string{"test.conf": tt.content})
+
+			p := &Properties{}
+			l := &Loader{Strict: tt.strict}
+			err := l.LoadFile(p, filepath.Join(dir, "test.conf"))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Expected error containing %q, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("LoadFile failed: %v", err)
+			}
+			if !tt.check(p) {
+				t.Errorf("Unexpected properties %+v", p)
+			}
+		})
+	}
+}
+
+func TestLoaderUnknownDirectiveWarning(t *testing.T) {
+	dir := t.TempDir()
+	writeConfigFiles(t, dir, map[string]string{"test.conf": "no-such-option yes\n"})
+
+	l := &Loader{}
+	if err := l.LoadFile(&Properties{}, filepath.Join(dir, "test.conf")); err != nil {
+		t.Fatalf("LoadFile failed: %v", err)
+	}
+	if len(l.Warnings) != 1 || !strings.Contains(l.Warnings[0], "no-such-option") {
+		t.Errorf("Expected a warning about no-such-option, got %v", l.Warnings)
+	}
+}
+
+func TestLoaderInclude(t *testing.T) {
+	dir := t.TempDir()
+	writeConfigFiles(t, dir, map[string]string{
+		"main.conf":          "port 7000\ninclude conf.d/extra.conf\nsave 60 1\n",
+		"conf.d/extra.conf":  "save 900 1\ninclude \"nested.conf\"\n",
+		"conf.d/nested.conf": "port 7001 # overrides main\nrequirepass secret\n",
+	})
+
+	p := &Properties{}
+	if err := (&Loader{}).LoadFile(p, filepath.Join(dir, "main.conf")); err != nil {
+		t.Fatalf("LoadFile failed: %v", err)
+	}
+	if p.Port != 7001 || p.RequirePass != "secret" {
+		t.Errorf("Expected included values to apply, got %+v", p)
+	}
+	if !reflect.DeepEqual(p.SaveRules, []string{"900 1", "60 1"}) {
+		t.Errorf("Expected save rules in file order, got %v", p.SaveRules)
+	}
+}
+
+func TestLoaderIncludeErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		files   map[string]string
+		wantErr string
+	}{
+		{
+			name:    "self include",
+			files:   map[string]string{"main.conf": "include main.conf\n"},
+			wantErr: "include cycle",
+		},
+		{
+			name: "indirect cycle",
+			files: map[string]string{
+				"main.conf": "include a.conf\n",
+				"a.conf":    "include b.conf\n",
+				"b.conf":    "include main.conf\n",
+			},
+			wantErr: "include cycle",
+		},
+		{
+			name:    "missing include",
+			files:   map[string]string{"main.conf": "include missing.conf\n"},
+			wantErr: "failed to open config file",
+		},
+		{
+			name:    "include without path",
+			files:   map[string]string{"main.conf": "include\n"},
+			wantErr: "include expects a single path",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeConfigFiles(t, dir, tt.files)
+
+			err := (&Loader{}).LoadFile(&Properties{}, filepath.Join(dir, "main.conf"))
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Expected error containing %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestLoaderIncludeSameFileTwice(t *testing.T) {
+	// Including the same file twice in sequence is not a cycle
+	dir := t.TempDir()
+	writeConfigFiles(t, dir, map[string]string{
+		"main.conf": "include save.conf\ninclude save.conf\n",
+		"save.conf": "save 60 1\n",
+	})
+
+	p := &Properties{}
+	if err := (&Loader{}).LoadFile(p, filepath.Join(dir, "main.conf")); err != nil {
+		t.Fatalf("LoadFile failed: %v", err)
+	}
+	if len(p.SaveRules) != 2 {
+		t.Errorf("Expected 2 save rules, got %v", p.SaveRules)
+	}
+}
+
+func TestRegisterDirective(t *testing.T) {
+	var seen []string
+	RegisterDirective("Test-Feature", func(p *Properties, args []string) error {
+		seen = append(seen, strings.Join(args, ","))
+		return nil
+	})
+	defer delete(directives, "test-feature")
+
+	dir := t.TempDir()
+	writeConfigFiles(t, dir, map[string]string{"test.conf": "test-feature a b\nTEST-FEATURE c\n"})
+	if err := (&Loader{Strict: true}).LoadFile(&Properties{}, filepath.Join(dir, "test.conf")); err != nil {
+		t.Fatalf("LoadFile failed: %v", err)
+	}
+	if !reflect.DeepEqual(seen, []string{"a,b", "c"}) {
+		t.Errorf("Expected registered directive to see each occurrence, got %v", seen)
+	}
+}
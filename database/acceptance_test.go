@@ -5,6 +5,7 @@ import (
 	"time"
 
 	"github.com/wangbo/gocache/eviction"
+	"github.com/wangbo/gocache/util/clock"
 )
 
 // 4.1 功能验收测试
@@ -188,6 +189,8 @@ func TestAcceptance_BasicDataTypes(t *testing.T) {
 func TestAcceptance_KeyExpiration(t *testing.T) {
 	db := MakeDB()
 	defer db.Close()
+	mc := clock.NewManual(time.Now())
+	db.SetClock(mc)
 
 	t.Run("基础过期设置", func(t *testing.T) {
 		// SET with EX - note: EX option not yet supported in SET, using EXPIRE
@@ -217,7 +220,7 @@ func TestAcceptance_KeyExpiration(t *testing.T) {
 		}
 
 		// Wait for expiration
-		time.Sleep(1100 * time.Millisecond)
+		mc.Advance(1100 * time.Millisecond)
 
 		// Key should be expired
 		result, err = db.Exec([][]byte{[]byte("GET"), []byte("expire_key")})
@@ -246,7 +249,7 @@ func TestAcceptance_KeyExpiration(t *testing.T) {
 		}
 
 		// Wait for expiration
-		time.Sleep(1100 * time.Millisecond)
+		mc.Advance(1100 * time.Millisecond)
 
 		// Key should be expired
 		result, err = db.Exec([][]byte{[]byte("GET"), []byte("expire_cmd_key")})
@@ -315,7 +318,7 @@ func TestAcceptance_KeyExpiration(t *testing.T) {
 		}
 
 		// Wait for expiration
-		time.Sleep(600 * time.Millisecond)
+		mc.Advance(600 * time.Millisecond)
 
 		// Key should be expired
 		result, err = db.Exec([][]byte{[]byte("GET"), []byte("pexpire_key")})
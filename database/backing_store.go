@@ -0,0 +1,342 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/wangbo/gocache/datastruct"
+)
+
+// Read-through and write-behind for embedded users
+//
+// RegisterReadThrough makes GET load the string keys it misses from a
+// backing store: the loads go through the same singleflight as GetOrLoad, so
+// a burst of GETs for a cold key calls the loader once, and loader errors
+// are negatively cached with SetNegativeCacheTTL. The load runs after GET
+// released its key locks; GET inside MULTI and other read commands (MGET,
+// GETRANGE...) never read through.
+//
+// RegisterWriteBehind queues every string key set or deleted by a command
+// and a single goroutine hands them to a writer in batches. Keys of other
+// types, expired and evicted keys, FLUSHALL and the commands applied while
+// the dataset is loaded (AOF, RDB or the dataset of a master) are not
+// written behind. When the queue is full, mutations are dropped and counted
+// or the writing command waits, depending on the policy.
+//
+// Both are opt-in: until they are registered, GET and the write commands
+// only check an unset atomic value.
+
+// ReadThroughFunc loads the value of a key and its TTL (zero means no expiry)
+// from the backing store. It returns ErrKeyNotFound when the store has no
+// value for the key, which GET replies with nil.
+type ReadThroughFunc func(ctx context.Context, key string) ([]byte, time.Duration, error)
+
+// ReadThroughOptions configures RegisterReadThrough
+type ReadThroughOptions struct {
+	Prefixes     []string      // Keys read through, all keys if empty
+	Timeout      time.Duration // Per load attempt, default 5s
+	Retries      int           // Attempts after a failed one, ErrKeyNotFound excepted
+	RetryBackoff time.Duration // Wait before the first retry, doubled after each, default 10ms
+}
+
+// readThrough is a registered ReadThroughFunc
+type readThrough struct {
+	fn   ReadThroughFunc
+	opts ReadThroughOptions
+}
+
+// RegisterReadThrough makes GET load the keys it misses with fn. A nil fn
+// unregisters the loader.
+func (db *DB) RegisterReadThrough(fn ReadThroughFunc, opts ReadThroughOptions) {
+	if fn == nil {
+		db.readThrough.Store((*readThrough)(nil))
+		return
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = 5 * time.Second
+	}
+	if opts.RetryBackoff <= 0 {
+		opts.RetryBackoff = 10 * time.Millisecond
+	}
+	db.readThrough.Store(&readThrough{fn: fn, opts: opts})
+}
+
+// readThroughGet returns the reply of a GET that missed key, loading it if a
+// read-through is registered for the key
+func (db *DB) readThroughGet(key string) (Result, error) {
+	rt, _ := db.readThrough.Load().(*readThrough)
+	if rt == nil || !hasAnyPrefix(key, rt.opts.Prefixes) {
+		return NilResult{}, nil
+	}
+
+	value, err := db.load(context.Background(), key, func(ctx context.Context) ([]byte, time.Duration, error) {
+		return rt.load(ctx, db.loads, key)
+	})
+	if errors.Is(err, ErrKeyNotFound) {
+		return NilResult{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("ERR read-through failed: %w", err)
+	}
+	return BulkResult(value), nil
+}
+
+// load calls the loader until it succeeds, reports a missing key or runs
+// out of retries
+func (rt *readThrough) load(ctx context.Context, g *loadGroup, key string) ([]byte, time.Duration, error) {
+	backoff := rt.opts.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		attemptCtx, cancel := context.WithTimeout(ctx, rt.opts.Timeout)
+		value, ttl, err := rt.fn(attemptCtx, key)
+		cancel()
+		if err == nil || errors.Is(err, ErrKeyNotFound) || attempt >= rt.opts.Retries {
+			return value, ttl, err
+		}
+		atomic.AddUint64(&g.loadRetries, 1)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// KeyMutation is a key set or deleted by a command, handed to the writer
+// registered with RegisterWriteBehind
+type KeyMutation struct {
+	Key      string
+	Value    []byte    // Value of the string, nil if Deleted
+	ExpireAt time.Time // Zero if the key has no TTL
+	Deleted  bool
+}
+
+// WriteBehindFunc writes a batch of mutations, in the order the commands
+// made them, to the backing store. A failed batch is retried as a whole.
+type WriteBehindFunc func(ctx context.Context, batch []KeyMutation) error
+
+// QueueFullPolicy tells what a write does when the write-behind queue is full
+type QueueFullPolicy int
+
+const (
+	// DropWhenFull drops the mutation and counts it (WriteBehindStats.Dropped)
+	DropWhenFull QueueFullPolicy = iota
+	// BlockWhenFull makes the writing command wait for room in the queue
+	BlockWhenFull
+)
+
+// WriteBehindOptions configures RegisterWriteBehind
+type WriteBehindOptions struct {
+	Prefixes      []string        // Keys written behind, all keys if empty
+	QueueSize     int             // Mutations waiting for the writer, default 10000
+	BatchSize     int             // Most mutations per batch, default 100
+	FlushInterval time.Duration   // Longest wait of a mutation for its batch, default 100ms
+	Timeout       time.Duration   // Per write attempt, default 5s
+	Retries       int             // Attempts after a failed one, the batch is then dropped
+	RetryBackoff  time.Duration   // Wait before the first retry, doubled after each, default 10ms
+	OnFull        QueueFullPolicy // What a write does when the queue is full
+}
+
+// WriteBehindStats holds write-behind counters
+type WriteBehindStats struct {
+	QueueDepth uint64 // Mutations waiting for the writer
+	Enqueued   uint64 // Mutations queued
+	Dropped    uint64 // Mutations dropped because the queue was full
+	Batches    uint64 // Batches written
+	Written    uint64 // Mutations written
+	Retries    uint64 // Writes retried after an error
+	Failures   uint64 // Batches dropped after their last attempt failed
+	Lost       uint64 // Mutations of the failed batches
+}
+
+// writeBehind is a registered WriteBehindFunc with its queue
+type writeBehind struct {
+	fn    WriteBehindFunc
+	opts  WriteBehindOptions
+	queue chan KeyMutation
+	done  <-chan struct{} // Closed when the database is closed
+
+	enqueued atomic.Uint64
+	dropped  atomic.Uint64
+	batches  atomic.Uint64
+	written  atomic.Uint64
+	retries  atomic.Uint64
+	failures atomic.Uint64
+	lost     atomic.Uint64
+}
+
+// RegisterWriteBehind makes the commands queue the string keys they set or
+// delete for fn. It can only be called once; it returns ErrClosed if the
+// database is closed.
+func (db *DB) RegisterWriteBehind(fn WriteBehindFunc, opts WriteBehindOptions) error {
+	if fn == nil {
+		return errors.New("write-behind writer is nil")
+	}
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = 10000
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = 100
+	}
+	if opts.FlushInterval <= 0 {
+		opts.FlushInterval = 100 * time.Millisecond
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = 5 * time.Second
+	}
+	if opts.RetryBackoff <= 0 {
+		opts.RetryBackoff = 10 * time.Millisecond
+	}
+
+	wb := &writeBehind{
+		fn:    fn,
+		opts:  opts,
+		queue: make(chan KeyMutation, opts.QueueSize),
+		done:  db.lifecycle.done,
+	}
+	if !db.writeBehind.CompareAndSwap(nil, wb) {
+		return errors.New("a write-behind writer is already registered")
+	}
+	if !db.lifecycle.goWorker(wb.run) {
+		return ErrClosed
+	}
+	return nil
+}
+
+// WriteBehindStats returns the write-behind counters, zero if no writer is
+// registered
+func (db *DB) WriteBehindStats() WriteBehindStats {
+	wb, _ := db.writeBehind.Load().(*writeBehind)
+	if wb == nil {
+		return WriteBehindStats{}
+	}
+	return WriteBehindStats{
+		QueueDepth: uint64(len(wb.queue)),
+		Enqueued:   wb.enqueued.Load(),
+		Dropped:    wb.dropped.Load(),
+		Batches:    wb.batches.Load(),
+		Written:    wb.written.Load(),
+		Retries:    wb.retries.Load(),
+		Failures:   wb.failures.Load(),
+		Lost:       wb.lost.Load(),
+	}
+}
+
+// writeBehindKey queues key, written by a command, for the write-behind
+// writer. The caller holds the lock of the key.
+func (db *DB) writeBehindKey(key string) {
+	wb, _ := db.writeBehind.Load().(*writeBehind)
+	if wb == nil || db.loading.Load() || db.replays.Load() > 0 || !hasAnyPrefix(key, wb.opts.Prefixes) {
+		return
+	}
+
+	m := KeyMutation{Key: key}
+	entity, ok := db.peekEntity(key)
+	if !ok {
+		m.Deleted = true
+	} else if str, ok := entity.Data.(*datastruct.String); ok {
+		value := str.Get()
+		m.Value = make([]byte, len(value))
+		copy(m.Value, value)
+		m.ExpireAt, _ = db.ExpireTime(key)
+	} else {
+		return
+	}
+	wb.enqueue(m)
+}
+
+// enqueue queues m following the queue full policy
+func (wb *writeBehind) enqueue(m KeyMutation) {
+	select {
+	case wb.queue <- m:
+		wb.enqueued.Add(1)
+		return
+	default:
+	}
+	if wb.opts.OnFull != BlockWhenFull {
+		wb.dropped.Add(1)
+		return
+	}
+	select {
+	case wb.queue <- m:
+		wb.enqueued.Add(1)
+	case <-wb.done:
+		wb.dropped.Add(1)
+	}
+}
+
+// run writes the queued mutations in batches until the database is closed,
+// then writes what is left in the queue once
+func (wb *writeBehind) run(done <-chan struct{}) {
+	ticker := time.NewTicker(wb.opts.FlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]KeyMutation, 0, wb.opts.BatchSize)
+	flush := func(retries int) {
+		if len(batch) > 0 {
+			wb.write(batch, retries)
+			batch = make([]KeyMutation, 0, wb.opts.BatchSize)
+		}
+	}
+	for {
+		select {
+		case m := <-wb.queue:
+			batch = append(batch, m)
+			if len(batch) >= wb.opts.BatchSize {
+				flush(wb.opts.Retries)
+			}
+		case <-ticker.C:
+			flush(wb.opts.Retries)
+		case <-done:
+			for {
+				select {
+				case m := <-wb.queue:
+					batch = append(batch, m)
+					if len(batch) >= wb.opts.BatchSize {
+						flush(0)
+					}
+				default:
+					flush(0)
+					return
+				}
+			}
+		}
+	}
+}
+
+// write hands batch to the writer, retrying it up to retries times
+func (wb *writeBehind) write(batch []KeyMutation, retries int) {
+	backoff := wb.opts.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), wb.opts.Timeout)
+		err := wb.fn(ctx, batch)
+		cancel()
+		if err == nil {
+			wb.batches.Add(1)
+			wb.written.Add(uint64(len(batch)))
+			return
+		}
+		if attempt >= retries {
+			wb.failures.Add(1)
+			wb.lost.Add(uint64(len(batch)))
+			return
+		}
+		wb.retries.Add(1)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// hasAnyPrefix reports whether key starts with one of prefixes, or prefixes
+// is empty
+func hasAnyPrefix(key string, prefixes []string) bool {
+	if len(prefixes) == 0 {
+		return true
+	}
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
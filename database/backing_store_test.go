@@ -0,0 +1,305 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeStore is an in-memory backing store
+type fakeStore struct {
+	mu       sync.Mutex
+	values   map[string][]byte
+	loads    int32
+	failures int32 // Calls left to fail
+	batches  [][]KeyMutation
+}
+
+func newFakeStore(values map[string]string) *fakeStore {
+	s := &fakeStore{values: make(map[string][]byte)}
+	for k, v := range values {
+		s.values[k] = []byte(v)
+	}
+	return s
+}
+
+// fail makes the next n calls fail
+func (s *fakeStore) fail(n int32) {
+	atomic.StoreInt32(&s.failures, n)
+}
+
+func (s *fakeStore) transientError() error {
+	if atomic.AddInt32(&s.failures, -1) >= 0 {
+		return errors.New("connection reset")
+	}
+	return nil
+}
+
+func (s *fakeStore) load(ctx context.Context, key string) ([]byte, time.Duration, error) {
+	atomic.AddInt32(&s.loads, 1)
+	if err := s.transientError(); err != nil {
+		return nil, 0, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	value, ok := s.values[key]
+	if !ok {
+		return nil, 0, ErrKeyNotFound
+	}
+	return value, time.Minute, nil
+}
+
+func (s *fakeStore) write(ctx context.Context, batch []KeyMutation) error {
+	if err := s.transientError(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.batches = append(s.batches, append([]KeyMutation(nil), batch...))
+	return nil
+}
+
+func (s *fakeStore) writtenBatches() [][]KeyMutation {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([][]KeyMutation(nil), s.batches...)
+}
+
+// waitFor polls cond for up to a second
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestReadThroughPopulatesGet(t *testing.T) {
+	db := MakeDB()
+	defer db.Close()
+	store := newFakeStore(map[string]string{"user:1": "alice", "other:1": "bob"})
+	db.RegisterReadThrough(store.load, ReadThroughOptions{Prefixes: []string{"user:"}})
+
+	result, err := db.ExecCommand("GET", "user:1")
+	if err != nil || len(result) != 1 || string(result[0]) != "alice" {
+		t.Fatalf("Expected GET to read alice through, got %q %v", result, err)
+	}
+	if ttl := db.TTL("user:1"); ttl <= 0 || ttl > time.Minute {
+		t.Errorf("Expected the loaded key to expire within a minute, got %v", ttl)
+	}
+	// The second GET is a hit
+	db.ExecCommand("GET", "user:1")
+	if n := atomic.LoadInt32(&store.loads); n != 1 {
+		t.Errorf("Expected one load, got %d", n)
+	}
+
+	// Keys missing from the store and keys out of the prefixes reply nil
+	for _, key := range []string{"user:2", "other:1"} {
+		if result, err := db.ExecCommand("GET", key); err != nil || result[0] != nil {
+			t.Errorf("Expected GET %s to reply nil, got %q %v", key, result, err)
+		}
+	}
+	if n := atomic.LoadInt32(&store.loads); n != 2 {
+		t.Errorf("Expected user:2 to be loaded and other:1 not, got %d loads", n)
+	}
+
+	// Other reads never read through
+	db.ExecCommand("MGET", "user:3")
+	if n := atomic.LoadInt32(&store.loads); n != 2 {
+		t.Errorf("Expected MGET not to load, got %d loads", n)
+	}
+
+	db.RegisterReadThrough(nil, ReadThroughOptions{})
+	db.ExecCommand("GET", "user:4")
+	if n := atomic.LoadInt32(&store.loads); n != 2 {
+		t.Errorf("Expected no load once unregistered, got %d loads", n)
+	}
+}
+
+func TestReadThroughSingleflight(t *testing.T) {
+	db := MakeDB()
+	defer db.Close()
+	release := make(chan struct{})
+	var loads int32
+	db.RegisterReadThrough(func(ctx context.Context, key string) ([]byte, time.Duration, error) {
+		atomic.AddInt32(&loads, 1)
+		<-release
+		return []byte("cold"), 0, nil
+	}, ReadThroughOptions{})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if result, err := db.ExecCommand("GET", "cold"); err != nil || string(result[0]) != "cold" {
+				t.Errorf("Expected cold, got %q %v", result, err)
+			}
+		}()
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	if n := atomic.LoadInt32(&loads); n != 1 {
+		t.Errorf("Expected one load for concurrent GETs, got %d", n)
+	}
+}
+
+func TestReadThroughRetriesTransientErrors(t *testing.T) {
+	db := MakeDB()
+	defer db.Close()
+	store := newFakeStore(map[string]string{"k1": "v1", "k2": "v2"})
+	db.RegisterReadThrough(store.load, ReadThroughOptions{Retries: 2, RetryBackoff: time.Millisecond})
+
+	store.fail(2)
+	if result, err := db.ExecCommand("GET", "k1"); err != nil || string(result[0]) != "v1" {
+		t.Fatalf("Expected the third attempt to load v1, got %q %v", result, err)
+	}
+	if stats := db.CacheStats(); stats.LoadRetries != 2 || stats.LoadErrors != 0 {
+		t.Errorf("Expected 2 retries and no load error, got %+v", stats)
+	}
+
+	store.fail(3)
+	if _, err := db.ExecCommand("GET", "k2"); err == nil {
+		t.Fatal("Expected GET to fail once the retries are exhausted")
+	}
+	if stats := db.CacheStats(); stats.LoadErrors != 1 {
+		t.Errorf("Expected a load error, got %+v", stats)
+	}
+	if result, err := db.ExecCommand("GET", "k2"); err != nil || string(result[0]) != "v2" {
+		t.Errorf("Expected the next GET to load v2, got %q %v", result, err)
+	}
+}
+
+func TestWriteBehindBatches(t *testing.T) {
+	db := MakeDB()
+	defer db.Close()
+	store := newFakeStore(nil)
+	err := db.RegisterWriteBehind(store.write, WriteBehindOptions{
+		Prefixes:      []string{"user:"},
+		BatchSize:     3,
+		FlushInterval: time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.RegisterWriteBehind(store.write, WriteBehindOptions{}); err == nil {
+		t.Error("Expected a second writer to be refused")
+	}
+
+	db.ExecCommand("SET", "user:1", "a")
+	db.ExecCommand("SET", "skipped", "x")
+	db.ExecCommand("RPUSH", "user:list", "x")
+	db.ExecCommand("SET", "user:2", "b", "EX", "100")
+	if batches := store.writtenBatches(); len(batches) != 0 {
+		t.Fatalf("Expected the batch to wait for a third mutation, got %v", batches)
+	}
+	db.ExecCommand("DEL", "user:1")
+
+	waitFor(t, "a batch", func() bool { return len(store.writtenBatches()) == 1 })
+	batch := store.writtenBatches()[0]
+	if len(batch) != 3 {
+		t.Fatalf("Expected 3 mutations, got %+v", batch)
+	}
+	if batch[0].Key != "user:1" || string(batch[0].Value) != "a" || batch[0].Deleted || !batch[0].ExpireAt.IsZero() {
+		t.Errorf("Unexpected first mutation %+v", batch[0])
+	}
+	if batch[1].Key != "user:2" || string(batch[1].Value) != "b" || time.Until(batch[1].ExpireAt) <= 0 {
+		t.Errorf("Unexpected second mutation %+v", batch[1])
+	}
+	if batch[2].Key != "user:1" || !batch[2].Deleted || batch[2].Value != nil {
+		t.Errorf("Expected user:1 to be deleted, got %+v", batch[2])
+	}
+
+	stats := db.WriteBehindStats()
+	if stats.Enqueued != 3 || stats.Batches != 1 || stats.Written != 3 || stats.QueueDepth != 0 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+}
+
+func TestWriteBehindFlushesOnIntervalAndClose(t *testing.T) {
+	db := MakeDB()
+	store := newFakeStore(nil)
+	db.RegisterWriteBehind(store.write, WriteBehindOptions{BatchSize: 100, FlushInterval: 10 * time.Millisecond})
+
+	db.ExecCommand("SET", "k1", "v1")
+	waitFor(t, "the interval flush", func() bool { return len(store.writtenBatches()) == 1 })
+
+	db.RegisterWriteBehind(store.write, WriteBehindOptions{})
+	db.ExecCommand("SET", "k2", "v2")
+	db.Close()
+	var written int
+	for _, batch := range store.writtenBatches() {
+		written += len(batch)
+	}
+	if written != 2 {
+		t.Errorf("Expected Close to write the queued mutation, got %d written", written)
+	}
+}
+
+func TestWriteBehindRetries(t *testing.T) {
+	db := MakeDB()
+	defer db.Close()
+	store := newFakeStore(nil)
+	db.RegisterWriteBehind(store.write, WriteBehindOptions{BatchSize: 1, Retries: 1, RetryBackoff: time.Millisecond})
+
+	store.fail(1)
+	db.ExecCommand("SET", "k1", "v1")
+	waitFor(t, "the retried batch", func() bool { return db.WriteBehindStats().Batches == 1 })
+
+	store.fail(2)
+	db.ExecCommand("SET", "k2", "v2")
+	waitFor(t, "the failed batch", func() bool { return db.WriteBehindStats().Failures == 1 })
+
+	stats := db.WriteBehindStats()
+	if stats.Retries != 2 || stats.Written != 1 || stats.Lost != 1 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+}
+
+func TestWriteBehindQueueFull(t *testing.T) {
+	for _, policy := range []QueueFullPolicy{DropWhenFull, BlockWhenFull} {
+		db := MakeDB()
+		release := make(chan struct{})
+		var written int32
+		db.RegisterWriteBehind(func(ctx context.Context, batch []KeyMutation) error {
+			<-release
+			atomic.AddInt32(&written, int32(len(batch)))
+			return nil
+		}, WriteBehindOptions{QueueSize: 1, BatchSize: 1, OnFull: policy})
+
+		// The writer holds the first mutation and the queue the second
+		db.ExecCommand("SET", "k1", "v")
+		waitFor(t, "the writer", func() bool { return db.WriteBehindStats().QueueDepth == 0 })
+		db.ExecCommand("SET", "k2", "v")
+
+		done := make(chan struct{})
+		go func() {
+			db.ExecCommand("SET", "k3", "v")
+			close(done)
+		}()
+		if policy == DropWhenFull {
+			<-done
+			if stats := db.WriteBehindStats(); stats.Dropped != 1 || stats.Enqueued != 2 {
+				t.Errorf("Expected the third mutation to be dropped, got %+v", stats)
+			}
+			close(release)
+		} else {
+			select {
+			case <-done:
+				t.Error("Expected SET to wait for room in the queue")
+			case <-time.After(50 * time.Millisecond):
+			}
+			close(release)
+			<-done
+			waitFor(t, "the mutations", func() bool { return atomic.LoadInt32(&written) == 3 })
+		}
+		db.Close()
+	}
+}
@@ -0,0 +1,181 @@
+package database
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Blocking commands
+//
+// A blocking command that finds nothing to serve returns a *blockedCommand
+// error instead of a result. ExecWithState then releases db.mu, waits until
+// data is added to one of the keys (see keyChanged), and retries the non-blocking form of the command until it returns a result,
+// the timeout expires or the database is closed. A command without a
+// non-blocking form (BLPOP) is retried as is, and keeps waiting as long as it
+// returns a *blockedCommand. Inside MULTI a blocking command never blocks
+// and just returns its non-blocking result, or a nil element.
+
+// blockedCommand describes a command waiting for data on some keys
+type blockedCommand struct {
+	keys    []string
+	timeout time.Duration // 0 waits forever
+	// cmdLine is the non-blocking form of the command to retry, with
+	// anything relative to the time of the call (such as the "$" ID of
+	// XREAD) resolved
+	cmdLine [][]byte
+}
+
+func (b *blockedCommand) Error() string {
+	return "command blocked waiting for " + string(b.cmdLine[0])
+}
+
+// keyWaiters tracks the clients blocked on each key. A waiter is registered
+// for as long as its command blocks, whatever happens to the keys meanwhile.
+type keyWaiters struct {
+	mu      sync.Mutex
+	waiters map[string]map[chan struct{}]struct{}
+	keys    atomic.Int64 // len(waiters), read without mu by onDataAdded
+	closing chan struct{}
+	once    sync.Once
+}
+
+func newKeyWaiters() *keyWaiters {
+	return &keyWaiters{
+		waiters: make(map[string]map[chan struct{}]struct{}),
+		closing: make(chan struct{}),
+	}
+}
+
+// add registers a waiter on keys and returns the channel signalled when one
+// of them is ready
+func (w *keyWaiters) add(keys []string) chan struct{} {
+	ready := make(chan struct{}, 1)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, key := range keys {
+		if w.waiters[key] == nil {
+			w.waiters[key] = make(map[chan struct{}]struct{})
+			w.keys.Add(1)
+		}
+		w.waiters[key][ready] = struct{}{}
+	}
+	return ready
+}
+
+// remove unregisters a waiter added with add
+func (w *keyWaiters) remove(keys []string, ready chan struct{}) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, key := range keys {
+		waiters, ok := w.waiters[key]
+		if !ok {
+			continue
+		}
+		delete(waiters, ready)
+		if len(waiters) == 0 {
+			delete(w.waiters, key)
+			w.keys.Add(-1)
+		}
+	}
+}
+
+// size returns the number of keys with blocked clients
+func (w *keyWaiters) size() int {
+	return int(w.keys.Load())
+}
+
+// onDataAdded wakes every waiter on key, which now holds data
+func (w *keyWaiters) onDataAdded(key string) {
+	// Most writes happen while nobody is blocked
+	if w.keys.Load() == 0 {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for ready := range w.waiters[key] {
+		select {
+		case ready <- struct{}{}:
+		default:
+			// Already signalled, the retry will see this change too
+		}
+	}
+}
+
+// close wakes every waiter for good
+func (w *keyWaiters) close() {
+	w.once.Do(func() { close(w.closing) })
+}
+
+// keyChanged tells the blocked clients that key was written: by a command
+// (see execute) or by replacing the dataset. A key that holds data after the
+// write may serve them, so they are woken to retry. A key that no longer
+// exists, such as one deleted, expired or renamed away, needs nothing: its
+// waiters stay registered and keep blocking until the key is created again
+// or their timeout expires. A rename is the deletion of the source key
+// followed by data added to the destination.
+func (db *DB) keyChanged(key string) {
+	if _, exists := db.data.Get(key); exists {
+		db.blocked.onDataAdded(key)
+	}
+}
+
+// block waits for a blocked command to be served. It returns a nil result
+// when the timeout expires or the database is closed. barrier tells whether
+// the caller holds the propagation barrier (see wait); a is the admission
+// of the command, checked again at every attempt.
+func (db *DB) block(cmd *blockedCommand, barrier bool, a admission) ([][]byte, error) {
+	cmdType, executor, err := lookupCommand(cmd.cmdLine)
+	if err != nil {
+		return nil, err
+	}
+
+	var timeout <-chan time.Time
+	if cmd.timeout > 0 {
+		timer := time.NewTimer(cmd.timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	// Register before the first retry so no signal can be missed between
+	// the blocking attempt and the wait
+	ready := db.blocked.add(cmd.keys)
+	defer db.blocked.remove(cmd.keys, ready)
+	for {
+		result, err := db.executeShared(cmdType, executor, cmd.cmdLine[1:], a)
+		if _, ok := err.(*blockedCommand); ok {
+			result, err = nil, nil
+		}
+		// A waited key replaced by a value of another type does not serve
+		// the client, which keeps waiting as in Redis
+		if err != nil && strings.HasPrefix(err.Error(), "WRONGTYPE") {
+			result, err = nil, nil
+		}
+		if err != nil || result != nil {
+			return linesOf(result), err
+		}
+
+		if !db.wait(ready, timeout, barrier) {
+			return nil, nil
+		}
+	}
+}
+
+// wait waits for a waited key to be signaled, returning false on timeout or
+// when the database closes. The propagation barrier is released meanwhile,
+// so that a blocked client never holds up the synchronization of a slave.
+func (db *DB) wait(ready chan struct{}, timeout <-chan time.Time, barrier bool) bool {
+	if barrier {
+		db.propagation.RUnlock()
+		defer db.propagation.RLock()
+	}
+	select {
+	case <-ready:
+		return true
+	case <-timeout:
+		return false
+	case <-db.blocked.closing:
+		return false
+	}
+}
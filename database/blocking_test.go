@@ -0,0 +1,140 @@
+package database
+
+import (
+	"testing"
+	"time"
+)
+
+// blpop runs BLPOP in the background and returns the channel receiving its
+// result once it returns
+func blpop(db *DB, args ...string) <-chan [][]byte {
+	done := make(chan [][]byte, 1)
+	go func() {
+		result, err := db.ExecCommand("BLPOP", args...)
+		if err != nil {
+			result = [][]byte{[]byte("error"), []byte(err.Error())}
+		}
+		done <- result
+	}()
+	return done
+}
+
+// waitBlocked waits until clients are blocked on n keys
+func waitBlocked(t *testing.T, db *DB, n int) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for db.blocked.size() != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected clients blocked on %d keys, got %d", n, db.blocked.size())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestBlockedPopKeepsWaitingAfterDelete(t *testing.T) {
+	db := MakeDB()
+	defer db.Close()
+
+	done := blpop(db, "k", "0")
+	waitBlocked(t, db, 1)
+
+	db.ExecCommand("DEL", "k")
+	select {
+	case result := <-done:
+		t.Fatalf("Expected BLPOP to keep blocking after DEL, got %q", result)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if db.blocked.size() != 1 {
+		t.Errorf("Expected the waiter to stay registered after DEL, got %d keys", db.blocked.size())
+	}
+
+	db.ExecCommand("RPUSH", "k", "v")
+	select {
+	case result := <-done:
+		if len(result) != 2 || string(result[0]) != "k" || string(result[1]) != "v" {
+			t.Errorf("Expected BLPOP to get v from k, got %q", result)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("BLPOP was not woken by RPUSH after DEL")
+	}
+	waitBlocked(t, db, 0)
+}
+
+func TestBlockedPopIgnoresOtherTypes(t *testing.T) {
+	db := MakeDB()
+	defer db.Close()
+
+	// The waiter is woken by any write to its key, but a set does not serve
+	// it and it keeps blocking until the key holds a list again
+	done := blpop(db, "k", "0")
+	waitBlocked(t, db, 1)
+	db.ExecCommand("SADD", "src", "m")
+	db.ExecCommand("SMOVE", "src", "k", "m")
+	select {
+	case result := <-done:
+		t.Fatalf("Expected BLPOP to keep blocking on a set, got %q", result)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	db.ExecCommand("DEL", "k")
+	db.ExecCommand("LPUSH", "k", "v")
+	select {
+	case result := <-done:
+		if len(result) != 2 || string(result[1]) != "v" {
+			t.Errorf("Expected BLPOP to get v, got %q", result)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("BLPOP was not woken once k held a list")
+	}
+	waitBlocked(t, db, 0)
+}
+
+func TestReplaceDatasetWithBlockedClients(t *testing.T) {
+	db := MakeDB()
+	defer db.Close()
+
+	waiters := []<-chan [][]byte{
+		blpop(db, "a", "0.1"),
+		blpop(db, "b", "0.1"),
+		blpop(db, "a", "c", "0.1"),
+	}
+	waitBlocked(t, db, 3)
+
+	// Replacing the dataset with an empty one wakes nobody
+	if err := db.ReplaceDataset(func(staging *DB) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	for i, done := range waiters {
+		select {
+		case result := <-done:
+			if result != nil {
+				t.Errorf("Expected waiter %d to time out, got %q", i, result)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Waiter %d did not time out", i)
+		}
+	}
+	if n := db.blocked.size(); n != 0 {
+		t.Errorf("Expected no keys left in the waiter registry, got %d", n)
+	}
+
+	// A dataset holding a waited key serves its waiter
+	done := blpop(db, "l", "0")
+	waitBlocked(t, db, 1)
+	err := db.ReplaceDataset(func(staging *DB) error {
+		_, err := staging.ExecCommand("RPUSH", "l", "loaded")
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case result := <-done:
+		if len(result) != 2 || string(result[1]) != "loaded" {
+			t.Errorf("Expected BLPOP to get the loaded element, got %q", result)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("BLPOP was not woken by the replaced dataset")
+	}
+	waitBlocked(t, db, 0)
+}
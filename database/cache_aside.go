@@ -0,0 +1,233 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/wangbo/gocache/datastruct"
+)
+
+// Cache-aside helpers for embedded users
+//
+// GetOrLoad reads a string key and, on a miss, calls a loader to fetch the
+// value from the backing store. Concurrent misses on the same key share one
+// loader call, so a burst of requests for a cold key only reaches the backing
+// store once. Loaded values are stored as ordinary string keys and are
+// visible over the network protocol like any other key. The read-through
+// of GET (see backing_store.go) shares the same loads.
+
+// ErrKeyNotFound can be returned by a loader to report that the backing store
+// has no value for the key. Like any loader error it is negatively cached.
+var ErrKeyNotFound = errors.New("key not found")
+
+// LoaderFunc loads the value of a key from the backing store
+type LoaderFunc func(ctx context.Context) ([]byte, error)
+
+// loadFunc loads the value of a key with its TTL (zero means no expiry)
+type loadFunc func(ctx context.Context) ([]byte, time.Duration, error)
+
+// CacheStats holds GetOrLoad counters
+type CacheStats struct {
+	Hits         uint64 // Calls answered from the cache
+	Misses       uint64 // Calls that found no cached value
+	Loads        uint64 // Loader invocations
+	LoadErrors   uint64 // Loader invocations that returned an error
+	LoadRetries  uint64 // Read-through loads retried after an error
+	NegativeHits uint64 // Calls answered from the negative cache
+}
+
+// loadCall is an in-flight or completed loader call
+type loadCall struct {
+	done  chan struct{}
+	value []byte
+	err   error
+}
+
+// negativeEntry is a cached loader error
+type negativeEntry struct {
+	err      error
+	expireAt time.Time
+}
+
+// loadGroup deduplicates loader calls per key and caches their errors
+type loadGroup struct {
+	mu          sync.Mutex
+	calls       map[string]*loadCall
+	negative    map[string]negativeEntry
+	negativeTTL time.Duration
+
+	hits         uint64
+	misses       uint64
+	loads        uint64
+	loadErrors   uint64
+	loadRetries  uint64
+	negativeHits uint64
+}
+
+func newLoadGroup() *loadGroup {
+	return &loadGroup{
+		calls:    make(map[string]*loadCall),
+		negative: make(map[string]negativeEntry),
+	}
+}
+
+// SetNegativeCacheTTL sets how long loader errors are cached by GetOrLoad
+// A zero duration (the default) disables negative caching
+func (db *DB) SetNegativeCacheTTL(ttl time.Duration) {
+	db.loads.mu.Lock()
+	defer db.loads.mu.Unlock()
+
+	db.loads.negativeTTL = ttl
+	if ttl <= 0 {
+		db.loads.negative = make(map[string]negativeEntry)
+	}
+}
+
+// CacheStats returns the GetOrLoad counters
+func (db *DB) CacheStats() CacheStats {
+	g := db.loads
+	return CacheStats{
+		Hits:         atomic.LoadUint64(&g.hits),
+		Misses:       atomic.LoadUint64(&g.misses),
+		Loads:        atomic.LoadUint64(&g.loads),
+		LoadErrors:   atomic.LoadUint64(&g.loadErrors),
+		LoadRetries:  atomic.LoadUint64(&g.loadRetries),
+		NegativeHits: atomic.LoadUint64(&g.negativeHits),
+	}
+}
+
+// GetOrLoad returns the value of a string key, calling loader on a miss and
+// storing its result with the given TTL (zero means no expiry).
+//
+// Only one loader runs per key at a time; concurrent callers wait for it and
+// share its result. The loader receives the context of the caller that
+// started it. Waiting callers give up when their own context is done.
+func (db *DB) GetOrLoad(ctx context.Context, key string, ttl time.Duration, loader LoaderFunc) ([]byte, error) {
+	if db.IsClosed() {
+		return nil, ErrClosed
+	}
+	g := db.loads
+
+	value, ok, err := db.getCachedString(key)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		atomic.AddUint64(&g.hits, 1)
+		return value, nil
+	}
+	atomic.AddUint64(&g.misses, 1)
+
+	return db.load(ctx, key, func(ctx context.Context) ([]byte, time.Duration, error) {
+		value, err := loader(ctx)
+		return value, ttl, err
+	})
+}
+
+// load returns the value of a missing string key loaded by loader, sharing
+// the call with the concurrent loads of the key
+func (db *DB) load(ctx context.Context, key string, loader loadFunc) ([]byte, error) {
+	g := db.loads
+	g.mu.Lock()
+	if entry, ok := g.negative[key]; ok {
+		if time.Now().Before(entry.expireAt) {
+			g.mu.Unlock()
+			atomic.AddUint64(&g.negativeHits, 1)
+			return nil, entry.err
+		}
+		delete(g.negative, key)
+	}
+
+	call, inFlight := g.calls[key]
+	if !inFlight {
+		// A load may have completed since the first lookup
+		if value, ok, err := db.getCachedString(key); ok || err != nil {
+			g.mu.Unlock()
+			return value, err
+		}
+		call = &loadCall{done: make(chan struct{})}
+		g.calls[key] = call
+	}
+	g.mu.Unlock()
+
+	if !inFlight {
+		db.runLoad(ctx, key, loader, call)
+	}
+
+	select {
+	case <-call.done:
+		if call.err != nil {
+			return nil, call.err
+		}
+		value := make([]byte, len(call.value))
+		copy(value, call.value)
+		return value, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// runLoad calls the loader, stores its result and releases the waiters
+func (db *DB) runLoad(ctx context.Context, key string, loader loadFunc, call *loadCall) {
+	g := db.loads
+	atomic.AddUint64(&g.loads, 1)
+
+	var ttl time.Duration
+	call.value, ttl, call.err = loader(ctx)
+	if call.err != nil {
+		atomic.AddUint64(&g.loadErrors, 1)
+	} else {
+		db.storeLoaded(key, call.value, ttl)
+	}
+
+	// The value is stored before the call is removed, so later callers
+	// either join this call or find the value in the cache
+	g.mu.Lock()
+	delete(g.calls, key)
+	if call.err != nil && g.negativeTTL > 0 {
+		g.negative[key] = negativeEntry{err: call.err, expireAt: time.Now().Add(g.negativeTTL)}
+	}
+	g.mu.Unlock()
+
+	close(call.done)
+}
+
+// storeLoaded stores a loaded value as a string key with an optional TTL,
+// unless a command set the key while it was loaded
+func (db *DB) storeLoaded(key string, value []byte, ttl time.Duration) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	held := db.keyLocks.lock([]string{key}, true)
+	defer held.unlock()
+	if db.Exists(key) {
+		return
+	}
+
+	stored := make([]byte, len(value))
+	copy(stored, value)
+	db.PutEntity(key, datastruct.MakeString(stored))
+	if ttl > 0 {
+		db.expireRelative(key, ttl)
+	} else {
+		db.Persist(key)
+	}
+}
+
+// getCachedString returns a copy of a string key's value
+func (db *DB) getCachedString(key string) ([]byte, bool, error) {
+	entity, ok := db.GetEntity(key)
+	if !ok {
+		return nil, false, nil
+	}
+	str, ok := entity.Data.(*datastruct.String)
+	if !ok {
+		return nil, false, ErrWrongType
+	}
+	value := str.Get()
+	result := make([]byte, len(value))
+	copy(result, value)
+	return result, true, nil
+}
@@ -0,0 +1,146 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestGetOrLoadSingleflight tests that concurrent misses call the loader once
+func TestGetOrLoadSingleflight(t *testing.T) {
+	db := MakeDB()
+	defer db.Close()
+
+	var calls int32
+	release := make(chan struct{})
+	loader := func(ctx context.Context) ([]byte, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return []byte("loaded"), nil
+	}
+
+	var wg sync.WaitGroup
+	var started sync.WaitGroup
+	errs := make(chan error, 100)
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		started.Add(1)
+		go func() {
+			defer wg.Done()
+			started.Done()
+			value, err := db.GetOrLoad(context.Background(), "user:1", time.Minute, loader)
+			if err != nil {
+				errs <- err
+				return
+			}
+			if string(value) != "loaded" {
+				errs <- errors.New("unexpected value " + string(value))
+			}
+		}()
+	}
+	started.Wait()
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Errorf("Expected loader to be called once, got %d", n)
+	}
+
+	// The loaded value is an ordinary key with the requested TTL
+	result, _ := db.ExecCommand("GET", "user:1")
+	if len(result) == 0 || string(result[0]) != "loaded" {
+		t.Errorf("Expected loaded value to be visible through GET, got %v", result)
+	}
+	if ttl := db.TTL("user:1"); ttl <= 0 || ttl > time.Minute {
+		t.Errorf("Expected TTL up to 1m, got %v", ttl)
+	}
+
+	stats := db.CacheStats()
+	if stats.Loads != 1 || stats.Hits+stats.Misses != 100 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+
+	// Subsequent calls are hits
+	if _, err := db.GetOrLoad(context.Background(), "user:1", time.Minute, loader); err != nil {
+		t.Fatalf("GetOrLoad failed: %v", err)
+	}
+	if stats := db.CacheStats(); stats.Hits == 0 || stats.Loads != 1 {
+		t.Errorf("Expected a hit without another load, got %+v", stats)
+	}
+}
+
+// TestGetOrLoadNegativeCache tests that loader errors are cached when enabled
+func TestGetOrLoadNegativeCache(t *testing.T) {
+	db := MakeDB()
+	defer db.Close()
+
+	var calls int32
+	loader := func(ctx context.Context) ([]byte, error) {
+		atomic.AddInt32(&calls, 1)
+		return nil, ErrKeyNotFound
+	}
+
+	// Without negative caching every miss reaches the loader
+	db.GetOrLoad(context.Background(), "missing", 0, loader)
+	db.GetOrLoad(context.Background(), "missing", 0, loader)
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Errorf("Expected 2 loader calls without negative caching, got %d", n)
+	}
+
+	db.SetNegativeCacheTTL(50 * time.Millisecond)
+	atomic.StoreInt32(&calls, 0)
+
+	for i := 0; i < 3; i++ {
+		if _, err := db.GetOrLoad(context.Background(), "missing", 0, loader); !errors.Is(err, ErrKeyNotFound) {
+			t.Errorf("Expected ErrKeyNotFound, got %v", err)
+		}
+	}
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Errorf("Expected 1 loader call with negative caching, got %d", n)
+	}
+	if stats := db.CacheStats(); stats.NegativeHits != 2 {
+		t.Errorf("Expected 2 negative hits, got %+v", stats)
+	}
+
+	// The negative entry expires
+	time.Sleep(80 * time.Millisecond)
+	db.GetOrLoad(context.Background(), "missing", 0, loader)
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Errorf("Expected loader to run again after negative TTL, got %d calls", n)
+	}
+	if db.Exists("missing") {
+		t.Error("Loader errors must not be stored in the keyspace")
+	}
+}
+
+// TestGetOrLoadWaiterContext tests that a waiting caller honours its context
+func TestGetOrLoadWaiterContext(t *testing.T) {
+	db := MakeDB()
+	defer db.Close()
+
+	release := make(chan struct{})
+	loading := make(chan struct{})
+	loader := func(ctx context.Context) ([]byte, error) {
+		close(loading)
+		<-release
+		return []byte("v"), nil
+	}
+
+	go db.GetOrLoad(context.Background(), "slow", 0, loader)
+	<-loading
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := db.GetOrLoad(ctx, "slow", 0, loader); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected deadline exceeded, got %v", err)
+	}
+	close(release)
+}
@@ -0,0 +1,239 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Client connections
+//
+// The server registers each connection with RegisterClient and keeps its
+// ClientInfo up to date: the command it runs and since when, the number of
+// commands it ran and the bytes it received and sent. CLIENT LIST shows them,
+// so that a connection stuck in a long command can be told from an idle one
+// from another connection. Publishing a command costs two atomic stores
+// before it runs and a few after.
+//
+// CLIENT runs without db.mu, so that CLIENT LIST and CLIENT UNPAUSE answer
+// while an exclusive command such as DEBUG SLEEP holds it.
+
+// ClientInfo is the state of a client connection shown by CLIENT LIST
+type ClientInfo struct {
+	id      int64
+	addr    string
+	created time.Time
+	ms      *MultiState // Transaction state of the connection
+
+	lastCmd    atomic.Pointer[string] // Name of the running or last command
+	cmdStart   atomic.Int64           // Unix nanoseconds the running command started, 0 when idle
+	lastActive atomic.Int64           // Unix nanoseconds the last command ended
+	commands   atomic.Int64
+	bytesIn    atomic.Int64
+	bytesOut   atomic.Int64
+	noEvict    atomic.Bool // Set by CLIENT NO-EVICT on
+}
+
+// clientRegistry holds the connected clients
+type clientRegistry struct {
+	mu      sync.Mutex
+	clients map[int64]*ClientInfo
+	nextID  int64
+}
+
+func newClientRegistry() *clientRegistry {
+	return &clientRegistry{clients: make(map[int64]*ClientInfo)}
+}
+
+// RegisterClient records a client connection from addr owning the
+// transaction state ms, until UnregisterClient
+func (db *DB) RegisterClient(addr string, ms *MultiState) *ClientInfo {
+	r := db.clients
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.nextID++
+	c := &ClientInfo{id: r.nextID, addr: addr, created: time.Now(), ms: ms}
+	ms.client = c
+	r.clients[c.id] = c
+	return c
+}
+
+// UnregisterClient forgets a closed client connection
+func (db *DB) UnregisterClient(c *ClientInfo) {
+	r := db.clients
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.clients, c.id)
+}
+
+// ID returns the unique ID of the connection
+func (c *ClientInfo) ID() int64 {
+	return c.id
+}
+
+// CommandStarted records that the connection runs the command name
+func (c *ClientInfo) CommandStarted(name string) {
+	c.lastCmd.Store(&name)
+	c.cmdStart.Store(time.Now().UnixNano())
+}
+
+// CommandFinished records the end of the command started last
+func (c *ClientInfo) CommandFinished() {
+	c.commands.Add(1)
+	c.lastActive.Store(time.Now().UnixNano())
+	c.cmdStart.Store(0)
+}
+
+// AddBytesIn counts n bytes received from the client
+func (c *ClientInfo) AddBytesIn(n int) {
+	c.bytesIn.Add(int64(n))
+}
+
+// AddBytesOut counts n bytes sent to the client
+func (c *ClientInfo) AddBytesOut(n int) {
+	c.bytesOut.Add(int64(n))
+}
+
+// NoEvict reports whether CLIENT NO-EVICT exempts the connection from
+// client-output-buffer-limit
+func (c *ClientInfo) NoEvict() bool {
+	return c.noEvict.Load()
+}
+
+// String returns the line of the connection in CLIENT LIST
+func (c *ClientInfo) String() string {
+	now := time.Now()
+	var running, idle time.Duration
+	if start := c.cmdStart.Load(); start != 0 {
+		running = now.Sub(time.Unix(0, start))
+	} else if last := c.lastActive.Load(); last != 0 {
+		idle = now.Sub(time.Unix(0, last))
+	} else {
+		idle = now.Sub(c.created)
+	}
+
+	queued := c.ms.queued()
+	flags := ""
+	if queued >= 0 {
+		flags += "x"
+	}
+	if c.NoEvict() {
+		flags += "e"
+	}
+	if flags == "" {
+		flags = "N"
+	}
+	cmd := "NULL"
+	if name := c.lastCmd.Load(); name != nil {
+		cmd = strings.ToLower(*name)
+	}
+
+	return fmt.Sprintf("id=%d addr=%s age=%d idle=%d flags=%s db=0 multi=%d watch=%d cmd=%s running-ms=%d tot-cmds=%d tot-net-in=%d tot-net-out=%d",
+		c.id, c.addr, int64(now.Sub(c.created).Seconds()), int64(idle.Seconds()), flags, queued, c.ms.watching(), cmd,
+		running.Milliseconds(), c.commands.Load(), c.bytesIn.Load(), c.bytesOut.Load())
+}
+
+// clientList returns the CLIENT LIST reply, a line per connection in the
+// order they connected
+func (db *DB) clientList() string {
+	r := db.clients
+	r.mu.Lock()
+	clients := make([]*ClientInfo, 0, len(r.clients))
+	for _, c := range r.clients {
+		clients = append(clients, c)
+	}
+	r.mu.Unlock()
+	sort.Slice(clients, func(i, j int) bool { return clients[i].id < clients[j].id })
+
+	var b strings.Builder
+	for _, c := range clients {
+		b.WriteString(c.String())
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
+
+// execClient implements CLIENT on behalf of the connection owning ms
+func execClient(ms *MultiState, args [][]byte) (Result, error) {
+	if len(args) == 0 {
+		return nil, errWrongArgs("client")
+	}
+	db := ms.db
+
+	switch strings.ToUpper(string(args[0])) {
+	case "PAUSE":
+		if len(args) != 2 && len(args) != 3 {
+			return nil, errWrongArgs("client|pause")
+		}
+		timeout, err := strconv.ParseInt(string(args[1]), 10, 64)
+		if err != nil || timeout < 0 {
+			return nil, errTimeoutNotInteger
+		}
+		all := true
+		if len(args) == 3 {
+			switch strings.ToUpper(string(args[2])) {
+			case "ALL":
+			case "WRITE":
+				all = false
+			default:
+				return nil, ErrSyntax
+			}
+		}
+		db.paused.pause(time.Now().Add(time.Duration(timeout)*time.Millisecond), all)
+		return StatusResult("OK"), nil
+
+	case "UNPAUSE":
+		if len(args) != 1 {
+			return nil, errWrongArgs("client|unpause")
+		}
+		db.paused.unpause()
+		return StatusResult("OK"), nil
+
+	case "LIST":
+		if len(args) != 1 {
+			return nil, errWrongArgs("client|list")
+		}
+		return BulkResult(db.clientList()), nil
+
+	case "NO-EVICT":
+		if len(args) != 2 {
+			return nil, errWrongArgs("client|no-evict")
+		}
+		var on bool
+		switch strings.ToLower(string(args[1])) {
+		case "on":
+			on = true
+		case "off":
+		default:
+			return nil, ErrSyntax
+		}
+		if ms.client == nil {
+			return nil, errors.New("ERR CLIENT NO-EVICT can only be sent by a client connection")
+		}
+		ms.client.noEvict.Store(on)
+		return StatusResult("OK"), nil
+
+	case "HELP":
+		if !isHelpSubcommand(args) {
+			return nil, errUnknownSubcommand("CLIENT", args[0])
+		}
+		return LinesResult(subcommandHelp("CLIENT",
+			"LIST",
+			"    Return information about client connections.",
+			"NO-EVICT (ON|OFF)",
+			"    Protect the current client connection from client-output-buffer-limit.",
+			"PAUSE <timeout> [WRITE|ALL]",
+			"    Suspend all, or just write, clients for <timeout> milliseconds.",
+			"UNPAUSE",
+			"    Stop the current client pause, resuming traffic.",
+		)), nil
+
+	default:
+		return nil, errUnknownSubcommand("CLIENT", args[0])
+	}
+}
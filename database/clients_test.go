@@ -0,0 +1,76 @@
+package database
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestClientList(t *testing.T) {
+	db := MakeDB()
+	defer db.Close()
+
+	first, second := NewMultiState(db), NewMultiState(db)
+	a := db.RegisterClient("127.0.0.1:1000", first)
+	b := db.RegisterClient("127.0.0.1:2000", second)
+	a.CommandStarted("GET")
+	a.CommandFinished()
+	a.AddBytesIn(20)
+	a.AddBytesOut(7)
+	b.CommandStarted("BLPOP")
+
+	first.Begin()
+	if _, err := db.ExecWithState(first, [][]byte{[]byte("CLIENT"), []byte("NO-EVICT"), []byte("on")}); err != nil {
+		t.Fatalf("Queuing CLIENT failed: %v", err)
+	}
+	result, err := db.ExecWithState(second, [][]byte{[]byte("CLIENT"), []byte("LIST")})
+	if err != nil {
+		t.Fatalf("CLIENT LIST failed: %v", err)
+	}
+
+	lines := strings.Split(strings.TrimSuffix(string(result[0]), "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 clients, got %q", result[0])
+	}
+	for _, want := range []string{"addr=127.0.0.1:1000 ", "flags=x ", "multi=1 ", "cmd=get ", "running-ms=0 ", "tot-cmds=1 ", "tot-net-in=20 ", "tot-net-out=7"} {
+		if !strings.Contains(lines[0], want) {
+			t.Errorf("Expected %q in %q", want, lines[0])
+		}
+	}
+	for _, want := range []string{"addr=127.0.0.1:2000 ", "flags=N ", "multi=-1 ", "watch=0 ", "cmd=blpop ", "tot-cmds=0 "} {
+		if !strings.Contains(lines[1], want) {
+			t.Errorf("Expected %q in %q", want, lines[1])
+		}
+	}
+
+	// A queued CLIENT NO-EVICT applies to the connection running EXEC
+	if _, err := db.ExecWithState(first, [][]byte{[]byte("EXEC")}); err != nil {
+		t.Fatalf("EXEC failed: %v", err)
+	}
+	if !a.NoEvict() || b.NoEvict() {
+		t.Error("Expected CLIENT NO-EVICT to exempt only its own connection")
+	}
+
+	db.UnregisterClient(a)
+	if list := db.clientList(); strings.Contains(list, "127.0.0.1:1000") {
+		t.Errorf("Expected the closed client to leave the list, got %q", list)
+	}
+}
+
+func TestClientErrors(t *testing.T) {
+	db := MakeDB()
+	defer db.Close()
+
+	for _, args := range [][]string{
+		{"CLIENT", "LIST", "x"},
+		{"CLIENT", "NO-EVICT"},
+		{"CLIENT", "NO-EVICT", "maybe"},
+		{"CLIENT", "NO-EVICT", "on"}, // Not sent by a connection
+	} {
+		if _, err := db.ExecCommand(args[0], args[1:]...); err == nil {
+			t.Errorf("Expected %v to fail", args)
+		}
+	}
+	if _, err := db.ExecCommand("CLIENT", "HELP"); err != nil {
+		t.Errorf("CLIENT HELP failed: %v", err)
+	}
+}
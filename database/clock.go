@@ -0,0 +1,54 @@
+package database
+
+import (
+	"time"
+
+	"github.com/wangbo/gocache/datastruct"
+	"github.com/wangbo/gocache/util/clock"
+)
+
+// Clock
+//
+// The database reads the time from its clock, the wall clock unless
+// SetClock replaced it: key TTLs are set and checked against it, the time
+// wheels and the sampler of the INFO rates tick on it, and the idle times,
+// the key metadata, the slow log, the latency samples, the save times and
+// the uptime of INFO are taken from it.
+// Tests use a clock.Manual and advance it instead of sleeping, which also
+// lets them expire a key at the exact millisecond, or between two arguments
+// of a command. Hash field TTLs follow it too, the hashes created by the
+// database checking them against its clock, and so do the IDs XADD
+// generates and the idle times of stream consumers.
+
+// SetClock makes the database read the time from c; nil restores the wall
+// clock. The time wheels are restarted on the new clock, keeping the keys
+// they hold, and so is the sampler of the instantaneous rates of INFO.
+func (db *DB) SetClock(c clock.Clock) {
+	if c == nil {
+		c = clock.Real
+	}
+	db.clock.Store(clockHolder{c})
+	if db.IsClosed() {
+		return
+	}
+	for _, tw := range []*datastruct.TimeWheel{db.timeWheel, db.fieldWheel} {
+		tw.Stop()
+		tw.SetClock(c)
+		tw.Start()
+	}
+	db.stats.stopSampler()
+	db.stats.startSampler(db.lifecycle, c)
+}
+
+// clockHolder lets clocks of different types share the atomic.Value
+type clockHolder struct {
+	clock.Clock
+}
+
+// now returns the time of the database clock
+func (db *DB) now() time.Time {
+	if h, ok := db.clock.Load().(clockHolder); ok {
+		return h.Now()
+	}
+	return time.Now()
+}
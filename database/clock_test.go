@@ -0,0 +1,176 @@
+package database
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/wangbo/gocache/config"
+	"github.com/wangbo/gocache/replication"
+	"github.com/wangbo/gocache/util/clock"
+)
+
+// makeClockedDB returns a database on a manual clock
+func makeClockedDB(t *testing.T) (*DB, *clock.Manual) {
+	t.Helper()
+	db := MakeDB()
+	t.Cleanup(func() { db.Close() })
+	mc := clock.NewManual(time.Now())
+	db.SetClock(mc)
+	return db, mc
+}
+
+// TestExpiryBoundaries pins the millisecond a key expires at: it is alive up
+// to the millisecond before its expiration time and gone from that time on
+func TestExpiryBoundaries(t *testing.T) {
+	tests := []struct {
+		after  time.Duration
+		exists string
+		pttl   string
+	}{
+		{99 * time.Millisecond, "1", "1"},
+		{100 * time.Millisecond, "0", "-2"},
+		{101 * time.Millisecond, "0", "-2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.after.String(), func(t *testing.T) {
+			db, mc := makeClockedDB(t)
+			db.ExecCommand("SET", "k", "v", "PX", "100")
+			db.ExecCommand("SET", "at", "v")
+			db.ExecCommand("PEXPIREAT", "at", strconv.FormatInt(mc.Now().Add(100*time.Millisecond).UnixMilli(), 10))
+
+			mc.Advance(tt.after)
+			if result, _ := db.ExecCommand("PTTL", "k"); string(result[0]) != tt.pttl {
+				t.Errorf("Expected PTTL %s, got %s", tt.pttl, result[0])
+			}
+			for _, key := range []string{"k", "at"} {
+				if result, _ := db.ExecCommand("EXISTS", key); string(result[0]) != tt.exists {
+					t.Errorf("Expected EXISTS %s to reply %s, got %s", key, tt.exists, result[0])
+				}
+			}
+		})
+	}
+}
+
+func TestTTLIsExactOnManualClock(t *testing.T) {
+	db, mc := makeClockedDB(t)
+	db.ExecCommand("SET", "k", "v", "EX", "10")
+
+	mc.Advance(2500 * time.Millisecond)
+	if result, _ := db.ExecCommand("PTTL", "k"); string(result[0]) != "7500" {
+		t.Errorf("Expected PTTL 7500, got %s", result[0])
+	}
+	// TTL rounds the remaining time to the nearest second
+	if result, _ := db.ExecCommand("TTL", "k"); string(result[0]) != "8" {
+		t.Errorf("Expected TTL 8, got %s", result[0])
+	}
+}
+
+// TestRenameAndCopyKeepTTLOnClock runs on a clock an hour behind the wall
+// clock, which the TTL given to the destination must be taken from
+func TestRenameAndCopyKeepTTLOnClock(t *testing.T) {
+	for _, cmd := range []string{"RENAME", "COPY"} {
+		t.Run(cmd, func(t *testing.T) {
+			db := MakeDB()
+			t.Cleanup(func() { db.Close() })
+			db.SetClock(clock.NewManual(time.Now().Add(-time.Hour)))
+			db.ExecCommand("SET", "src", "v", "EX", "100")
+
+			if _, err := db.ExecCommand(cmd, "src", "dst"); err != nil {
+				t.Fatalf("%s failed: %v", cmd, err)
+			}
+			if result, _ := db.ExecCommand("PTTL", "dst"); string(result[0]) != "100000" {
+				t.Errorf("Expected PTTL 100000 after %s, got %s", cmd, result[0])
+			}
+		})
+	}
+}
+
+func TestHashFieldTTLOnClock(t *testing.T) {
+	db := MakeDB()
+	t.Cleanup(func() { db.Close() })
+	mc := clock.NewManual(time.Now().Add(-time.Hour))
+	db.SetClock(mc)
+	db.ExecCommand("HSET", "h", "f", "v")
+	db.ExecCommand("HEXPIRE", "h", "100", "FIELDS", "1", "f")
+
+	if result, _ := db.ExecCommand("HPTTL", "h", "FIELDS", "1", "f"); string(result[0]) != "100000" {
+		t.Errorf("Expected HPTTL 100000, got %s", result[0])
+	}
+	if result, _ := db.ExecCommand("HGET", "h", "f"); string(result[0]) != "v" {
+		t.Errorf("Expected the field to live 100s of the clock, got %q", result[0])
+	}
+
+	mc.Advance(100 * time.Second)
+	if result, _ := db.ExecCommand("HEXISTS", "h", "f"); string(result[0]) != "0" {
+		t.Errorf("Expected the field to expire on the clock, got HEXISTS %s", result[0])
+	}
+}
+
+func TestActiveExpiryTicksOnClock(t *testing.T) {
+	db, mc := makeClockedDB(t)
+	var expired []string
+	db.SetExpireCallback(func(key string) { expired = append(expired, key) })
+	db.ExecCommand("SET", "k", "v", "PX", "100")
+
+	mc.Advance(99 * time.Millisecond)
+	if _, ok := db.getEntityWithoutExpiryCheck("k"); !ok {
+		t.Fatal("Expected the key to outlive 99ms")
+	}
+
+	// Every tick due is handed to the wheel before Advance returns; those
+	// past the expiration let the expiring one finish
+	mc.Advance(time.Second)
+	if _, ok := db.getEntityWithoutExpiryCheck("k"); ok {
+		t.Error("Expected the time wheel to expire the key without access")
+	}
+	if len(expired) != 1 {
+		t.Errorf("Expected one expiration, got %v", expired)
+	}
+}
+
+// TestClockStampsMetadataAndLatency checks the times of OBJECT METADATA and
+// of the latency samples on a clock a day behind the wall clock
+func TestClockStampsMetadataAndLatency(t *testing.T) {
+	cfg := config.Default()
+	cfg.TrackKeyMetadata = true
+	cfg.LatencyMonitorThreshold = 1
+	db := MakeDBWithConfig(cfg, replication.NewReplicationState())
+	defer db.Close()
+	mc := clock.NewManual(time.Now().Add(-24 * time.Hour))
+	db.SetClock(mc)
+
+	db.ExecCommand("SET", "k", "v")
+	mc.Advance(time.Second)
+	db.ExecCommand("APPEND", "k", "w")
+	want := []string{
+		strconv.FormatInt(mc.Now().Add(-time.Second).UnixMilli(), 10),
+		strconv.FormatInt(mc.Now().UnixMilli(), 10),
+	}
+	result, _ := db.ExecCommand("OBJECT", "METADATA", "k")
+	if len(result) != 6 || string(result[1]) != want[0] || string(result[3]) != want[1] {
+		t.Errorf("Expected the key created at %s and modified at %s, got %q", want[0], want[1], result)
+	}
+
+	db.RecordLatency(LatencyEventCommand, time.Second)
+	if samples := db.LatencyHistory(LatencyEventCommand); len(samples) != 1 || samples[0].Time != mc.Now().Unix() {
+		t.Errorf("Expected a sample at %d, got %+v", mc.Now().Unix(), samples)
+	}
+}
+
+func TestClockDrivesTimestamps(t *testing.T) {
+	db := MakeDB()
+	defer db.Close()
+	mc := clock.NewManual(db.ServerInfo().StartTime)
+	db.SetClock(mc)
+
+	mc.Advance(90 * time.Second)
+	if uptime := execInfoString(t, db, "server")["Server"]["uptime_in_seconds"]; uptime != "90" {
+		t.Errorf("Expected an uptime of 90s, got %s", uptime)
+	}
+
+	db.AddSlowLogEntry(time.Hour, [][]byte{[]byte("GET"), []byte("k")})
+	if entries := db.GetSlowLogEntries(); len(entries) != 1 || !entries[0].Timestamp.Equal(mc.Now()) {
+		t.Errorf("Expected the slow log entry to be stamped %v, got %+v", mc.Now(), entries)
+	}
+}
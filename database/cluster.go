@@ -0,0 +1,164 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/wangbo/gocache/cluster"
+)
+
+// Cluster announcement
+//
+// Several instances can serve one keyspace behind clients that shard keys
+// by hash slot, as with Redis Cluster, without gossip or slot migration:
+// with cluster-announce, every instance is configured with the same static
+// topology (cluster-node) and its own ID in it (cluster-myid). CLUSTER SLOTS,
+// SHARDS, MYID and INFO describe the topology, and a command naming a key of
+// a slot another node serves is refused with -MOVED <slot> <host:port>, which
+// sends cluster-aware clients to that node. The keys of a command, or of a
+// transaction, must all hash to the same slot (-CROSSSLOT).
+
+// SetClusterTopology makes the database announce a cluster topology and
+// redirect the commands on the keys of the slots other nodes serve. It is
+// called before clients connect.
+func (db *DB) SetClusterTopology(topology *cluster.Topology) {
+	db.cluster = topology
+}
+
+var errCrossSlot = errors.New("CROSSSLOT Keys in the request don't hash to the same slot")
+
+// checkSlot refuses a client command whose keys are not all in one slot this
+// node serves. Queued commands are checked along with those queued before
+// them, since EXEC runs them all here; one that fails aborts the transaction.
+func (db *DB) checkSlot(ms *MultiState, cmdType CommandType, args [][]byte) error {
+	if db.cluster == nil {
+		return nil
+	}
+	keys := commandKeys(cmdType, args)
+	if cmdType == CmdWatch {
+		keys = bytesToStrings(args)
+	}
+	if ms.IsInMulti() && len(keys) > 0 {
+		for _, queued := range ms.GetCommands() {
+			queuedType, ok := ParseCommandType(queued[0])
+			if !ok {
+				continue
+			}
+			queuedArgs := make([][]byte, len(queued)-1)
+			for i, arg := range queued[1:] {
+				queuedArgs[i] = []byte(arg)
+			}
+			keys = append(keys, commandKeys(queuedType, queuedArgs)...)
+		}
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+
+	slot := cluster.KeySlot(keys[0])
+	for _, key := range keys[1:] {
+		if cluster.KeySlot(key) != slot {
+			return errCrossSlot
+		}
+	}
+	switch owner := db.cluster.Owner(slot); owner {
+	case db.cluster.Self:
+		return nil
+	case nil:
+		return errors.New("CLUSTERDOWN Hash slot not served")
+	default:
+		return fmt.Errorf("MOVED %d %s", slot, owner.Addr())
+	}
+}
+
+// execCluster implements CLUSTER. Replies of several levels are flattened,
+// and nested again by the server:
+//
+//	CLUSTER SLOTS:   start, end, host, port, id for each slot range
+//	CLUSTER SHARDS:  id, host, port, number of ranges n, then the start and
+//	                 end of its n ranges, for each node
+//	CLUSTER MYID:    the ID of this node
+//	CLUSTER INFO:    the state of the cluster, as INFO fields
+//	CLUSTER KEYSLOT: the slot of a key
+func execCluster(db *DB, args [][]byte) ([][]byte, error) {
+	if len(args) < 1 {
+		return nil, errWrongArgs("cluster")
+	}
+	if isHelpSubcommand(args) {
+		return subcommandHelp("CLUSTER",
+			"INFO",
+			"    Return information about the cluster.",
+			"KEYSLOT <key>",
+			"    Return the hash slot for <key>.",
+			"MYID",
+			"    Return the node id.",
+			"SHARDS",
+			"    Return information about slot range mappings and the nodes associated with them.",
+			"SLOTS",
+			"    Return information about slots range mappings. Each range is made of:",
+			"    start, end, master host, port and id.",
+		), nil
+	}
+	topology := db.cluster
+	if topology == nil {
+		return nil, errors.New("ERR This instance has cluster support disabled")
+	}
+
+	subCmd := strings.ToUpper(string(args[0]))
+	switch {
+	case subCmd == "SLOTS" && len(args) == 1:
+		var result [][]byte
+		for _, node := range topology.Nodes {
+			for _, r := range node.Slots {
+				result = append(result, []byte(strconv.Itoa(r.Start)), []byte(strconv.Itoa(r.End)),
+					[]byte(node.Host), []byte(strconv.Itoa(node.Port)), []byte(node.ID))
+			}
+		}
+		return result, nil
+	case subCmd == "SHARDS" && len(args) == 1:
+		var result [][]byte
+		for _, node := range topology.Nodes {
+			result = append(result, []byte(node.ID), []byte(node.Host), []byte(strconv.Itoa(node.Port)),
+				[]byte(strconv.Itoa(len(node.Slots))))
+			for _, r := range node.Slots {
+				result = append(result, []byte(strconv.Itoa(r.Start)), []byte(strconv.Itoa(r.End)))
+			}
+		}
+		return result, nil
+	case subCmd == "MYID" && len(args) == 1:
+		return [][]byte{[]byte(topology.Self.ID)}, nil
+	case subCmd == "INFO" && len(args) == 1:
+		return [][]byte{[]byte(clusterInfo(topology))}, nil
+	case subCmd == "KEYSLOT" && len(args) == 2:
+		return [][]byte{[]byte(strconv.Itoa(cluster.KeySlot(string(args[1]))))}, nil
+	}
+	return nil, errUnknownSubcommand("CLUSTER", args[0])
+}
+
+// clusterInfo returns the reply of CLUSTER INFO. The cluster is ok when
+// every slot is served; nodes never fail, since none is watched.
+func clusterInfo(topology *cluster.Topology) string {
+	assigned := topology.AssignedSlots()
+	state := "ok"
+	if assigned < cluster.SlotCount {
+		state = "fail"
+	}
+	size := 0
+	for _, node := range topology.Nodes {
+		if len(node.Slots) > 0 {
+			size++
+		}
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "cluster_state:%s\r\n", state)
+	fmt.Fprintf(&b, "cluster_slots_assigned:%d\r\n", assigned)
+	fmt.Fprintf(&b, "cluster_slots_ok:%d\r\n", assigned)
+	b.WriteString("cluster_slots_pfail:0\r\ncluster_slots_fail:0\r\n")
+	fmt.Fprintf(&b, "cluster_known_nodes:%d\r\n", len(topology.Nodes))
+	fmt.Fprintf(&b, "cluster_size:%d\r\n", size)
+	b.WriteString("cluster_current_epoch:0\r\ncluster_my_epoch:0\r\n")
+	return b.String()
+}
@@ -1,6 +1,9 @@
 package database
 
 import (
+	"errors"
+	"strings"
+
 	"github.com/wangbo/gocache/protocol"
 )
 
@@ -23,10 +26,13 @@ const (
 	CmdSet CommandType = iota
 	CmdGet
 	CmdMSet
+	CmdMSetNX
 	CmdMGet
 	CmdDel
 	CmdExists
 	CmdKeys
+	CmdScan
+	CmdTouch
 	CmdIncr
 	CmdIncrBy
 	CmdDecr
@@ -34,6 +40,10 @@ const (
 	CmdStrLen
 	CmdAppend
 	CmdGetRange
+	CmdSetRange
+	CmdSetNX
+	CmdGetSet
+	CmdGetEx
 
 	// Hash commands
 	CmdHSet
@@ -48,6 +58,14 @@ const (
 	CmdHIncrBy
 	CmdHMGet
 	CmdHMSet
+	CmdHExpire
+	CmdHPExpire
+	CmdHExpireAt
+	CmdHPExpireAt
+	CmdHPersist
+	CmdHTTL
+	CmdHPTTL
+	CmdHScan
 
 	// List commands
 	CmdLPush
@@ -61,6 +79,8 @@ const (
 	CmdLRem
 	CmdLInsert
 	CmdLLen
+	CmdBLPop
+	CmdBRPop
 
 	// Set commands
 	CmdSAdd
@@ -77,11 +97,13 @@ const (
 	CmdSDiffStore
 	CmdSInterStore
 	CmdSUnionStore
+	CmdSScan
 
 	// Sorted Set commands
 	CmdZAdd
 	CmdZRem
 	CmdZScore
+	CmdZMScore
 	CmdZIncrBy
 	CmdZCard
 	CmdZRank
@@ -90,6 +112,31 @@ const (
 	CmdZRevRange
 	CmdZRangeByScore
 	CmdZCount
+	CmdZScan
+
+	// Stream commands
+	CmdXAdd
+	CmdXLen
+	CmdXRange
+	CmdXRevRange
+	CmdXRead
+	CmdXGroup
+	CmdXReadGroup
+	CmdXAck
+	CmdXPending
+	CmdXClaim
+	CmdXAutoClaim
+
+	// HyperLogLog commands
+	CmdPFAdd
+	CmdPFCount
+	CmdPFMerge
+
+	// GEO commands
+	CmdGeoAdd
+	CmdGeoPos
+	CmdGeoDist
+	CmdGeoSearch
 
 	// TTL commands
 	CmdExpire
@@ -106,6 +153,7 @@ const (
 	CmdDiscard
 	CmdWatch
 	CmdUnwatch
+	CmdReset
 
 	// Management commands
 	CmdPing
@@ -116,16 +164,32 @@ const (
 	CmdSlaveOf
 	CmdSync
 	CmdPSync
+	CmdBackup
+	CmdDebug
+	CmdClient
+	CmdFailover
+	CmdHealthCheck
+	CmdCluster
 
 	// Database commands
 	CmdSelect
 	CmdType
+	CmdObject
 	CmdMove
+	CmdRename
+	CmdRenameNX
+	CmdCopy
+	CmdMigrate
+	CmdDBSize
+	CmdFlushDB
+	CmdFlushAll
 
 	// Security and monitoring commands
 	CmdAuth
 	CmdSlowLog
 	CmdMonitor
+	CmdLatency
+	CmdConfig
 )
 
 // String returns the string representation of the command type
@@ -137,6 +201,8 @@ func (c CommandType) String() string {
 		return protocol.CmdGet
 	case CmdMSet:
 		return protocol.CmdMSet
+	case CmdMSetNX:
+		return protocol.CmdMSetNX
 	case CmdMGet:
 		return protocol.CmdMGet
 	case CmdDel:
@@ -145,6 +211,10 @@ func (c CommandType) String() string {
 		return protocol.CmdExists
 	case CmdKeys:
 		return protocol.CmdKeys
+	case CmdScan:
+		return protocol.CmdScan
+	case CmdTouch:
+		return protocol.CmdTouch
 	case CmdIncr:
 		return protocol.CmdIncr
 	case CmdIncrBy:
@@ -159,6 +229,14 @@ func (c CommandType) String() string {
 		return protocol.CmdAppend
 	case CmdGetRange:
 		return protocol.CmdGetRange
+	case CmdSetRange:
+		return protocol.CmdSetRange
+	case CmdSetNX:
+		return protocol.CmdSetNX
+	case CmdGetSet:
+		return protocol.CmdGetSet
+	case CmdGetEx:
+		return protocol.CmdGetEx
 	case CmdHSet:
 		return protocol.CmdHSet
 	case CmdHGet:
@@ -183,6 +261,22 @@ func (c CommandType) String() string {
 		return protocol.CmdHMGet
 	case CmdHMSet:
 		return protocol.CmdHMSet
+	case CmdHExpire:
+		return protocol.CmdHExpire
+	case CmdHPExpire:
+		return protocol.CmdHPExpire
+	case CmdHExpireAt:
+		return protocol.CmdHExpireAt
+	case CmdHPExpireAt:
+		return protocol.CmdHPExpireAt
+	case CmdHPersist:
+		return protocol.CmdHPersist
+	case CmdHTTL:
+		return protocol.CmdHTTL
+	case CmdHPTTL:
+		return protocol.CmdHPTTL
+	case CmdHScan:
+		return protocol.CmdHScan
 	case CmdLPush:
 		return protocol.CmdLPush
 	case CmdRPush:
@@ -205,6 +299,10 @@ func (c CommandType) String() string {
 		return protocol.CmdLInsert
 	case CmdLLen:
 		return protocol.CmdLLen
+	case CmdBLPop:
+		return protocol.CmdBLPop
+	case CmdBRPop:
+		return protocol.CmdBRPop
 	case CmdSAdd:
 		return protocol.CmdSAdd
 	case CmdSRem:
@@ -233,12 +331,16 @@ func (c CommandType) String() string {
 		return protocol.CmdSInterStore
 	case CmdSUnionStore:
 		return protocol.CmdSUnionStore
+	case CmdSScan:
+		return protocol.CmdSScan
 	case CmdZAdd:
 		return protocol.CmdZAdd
 	case CmdZRem:
 		return protocol.CmdZRem
 	case CmdZScore:
 		return protocol.CmdZScore
+	case CmdZMScore:
+		return protocol.CmdZMScore
 	case CmdZIncrBy:
 		return protocol.CmdZIncrBy
 	case CmdZCard:
@@ -255,6 +357,44 @@ func (c CommandType) String() string {
 		return protocol.CmdZRangeByScore
 	case CmdZCount:
 		return protocol.CmdZCount
+	case CmdZScan:
+		return protocol.CmdZScan
+	case CmdXAdd:
+		return protocol.CmdXAdd
+	case CmdXLen:
+		return protocol.CmdXLen
+	case CmdXRange:
+		return protocol.CmdXRange
+	case CmdXRevRange:
+		return protocol.CmdXRevRange
+	case CmdXRead:
+		return protocol.CmdXRead
+	case CmdXGroup:
+		return protocol.CmdXGroup
+	case CmdXReadGroup:
+		return protocol.CmdXReadGroup
+	case CmdXAck:
+		return protocol.CmdXAck
+	case CmdXPending:
+		return protocol.CmdXPending
+	case CmdXClaim:
+		return protocol.CmdXClaim
+	case CmdXAutoClaim:
+		return protocol.CmdXAutoClaim
+	case CmdPFAdd:
+		return protocol.CmdPFAdd
+	case CmdPFCount:
+		return protocol.CmdPFCount
+	case CmdPFMerge:
+		return protocol.CmdPFMerge
+	case CmdGeoAdd:
+		return protocol.CmdGeoAdd
+	case CmdGeoPos:
+		return protocol.CmdGeoPos
+	case CmdGeoDist:
+		return protocol.CmdGeoDist
+	case CmdGeoSearch:
+		return protocol.CmdGeoSearch
 	case CmdExpire:
 		return protocol.CmdExpire
 	case CmdPExpire:
@@ -279,10 +419,16 @@ func (c CommandType) String() string {
 		return protocol.CmdWatch
 	case CmdUnwatch:
 		return protocol.CmdUnwatch
+	case CmdReset:
+		return protocol.CmdReset
 	case CmdPing:
 		return protocol.CmdPing
 	case CmdInfo:
 		return protocol.CmdInfo
+	case CmdHealthCheck:
+		return protocol.CmdHealthCheck
+	case CmdCluster:
+		return protocol.CmdCluster
 	case CmdMemory:
 		return protocol.CmdMemory
 	case CmdSave:
@@ -295,26 +441,191 @@ func (c CommandType) String() string {
 		return protocol.CmdSync
 	case CmdPSync:
 		return protocol.CmdPSync
+	case CmdBackup:
+		return protocol.CmdBackup
+	case CmdDebug:
+		return protocol.CmdDebug
+	case CmdClient:
+		return protocol.CmdClient
+	case CmdFailover:
+		return protocol.CmdFailover
 	case CmdSelect:
 		return protocol.CmdSelect
 	case CmdType:
 		return protocol.CmdType
+	case CmdObject:
+		return protocol.CmdObject
 	case CmdMove:
 		return protocol.CmdMove
+	case CmdRename:
+		return protocol.CmdRename
+	case CmdRenameNX:
+		return protocol.CmdRenameNX
+	case CmdCopy:
+		return protocol.CmdCopy
+	case CmdMigrate:
+		return protocol.CmdMigrate
+	case CmdDBSize:
+		return protocol.CmdDBSize
+	case CmdFlushDB:
+		return protocol.CmdFlushDB
+	case CmdFlushAll:
+		return protocol.CmdFlushAll
 	case CmdAuth:
 		return protocol.CmdAuth
 	case CmdSlowLog:
 		return protocol.CmdSlowLog
 	case CmdMonitor:
 		return protocol.CmdMonitor
+	case CmdLatency:
+		return protocol.CmdLatency
+	case CmdConfig:
+		return protocol.CmdConfig
 	default:
 		return "UNKNOWN"
 	}
 }
 
-// IsWriteCommand returns true if this command modifies data
+// IsWriteCommand returns true if this command modifies data, as declared
+// when its executor was registered
 func (c CommandType) IsWriteCommand() bool {
-	return protocol.IsWriteCommand(c.String())
+	executor, ok := GetCommandExecutor(c)
+	return ok && executor.IsWriteCommand()
+}
+
+// IsWriteCommand reports whether the named command (case-insensitive) is a
+// write command that must be written to the AOF and sent to slaves
+func IsWriteCommand(cmdName string) bool {
+	cmdType, ok := ParseCommandType(cmdName)
+	return ok && cmdType.IsWriteCommand()
+}
+
+// MultiBehavior describes what a command does when sent inside MULTI
+type MultiBehavior int
+
+const (
+	// MultiQueued commands are queued and run by EXEC
+	MultiQueued MultiBehavior = iota
+	// MultiForbidden commands are rejected when queued, which aborts the
+	// transaction
+	MultiForbidden
+	// MultiNonBlocking commands are queued, and run by EXEC without blocking:
+	// one that would block yields a nil element
+	MultiNonBlocking
+)
+
+// MultiBehavior returns what the command does inside MULTI
+func (c CommandType) MultiBehavior() MultiBehavior {
+	switch c {
+	case CmdWatch, CmdSync, CmdPSync, CmdBackup, CmdMonitor, CmdSlaveOf:
+		return MultiForbidden
+	case CmdBLPop, CmdBRPop, CmdXRead, CmdXReadGroup:
+		return MultiNonBlocking
+	default:
+		return MultiQueued
+	}
+}
+
+// errNotAllowedInMulti is the error of a MultiForbidden command sent inside
+// MULTI
+func errNotAllowedInMulti(cmdType CommandType) error {
+	if cmdType == CmdWatch {
+		return errors.New("ERR WATCH inside MULTI is not allowed")
+	}
+	return errors.New("ERR Command not allowed inside a transaction")
+}
+
+// writeKeys returns the keys a write command modifies
+// Most commands write only their first argument
+func writeKeys(cmdType CommandType, args [][]byte) []string {
+	switch cmdType {
+	case CmdDel:
+		keys := make([]string, len(args))
+		for i, arg := range args {
+			keys[i] = string(arg)
+		}
+		return keys
+	case CmdMSet, CmdMSetNX:
+		keys := make([]string, 0, len(args)/2)
+		for i := 0; i < len(args); i += 2 {
+			keys = append(keys, string(args[i]))
+		}
+		return keys
+	case CmdSMove, CmdRename, CmdRenameNX:
+		if len(args) >= 2 {
+			return []string{string(args[0]), string(args[1])}
+		}
+	case CmdCopy:
+		// The source is only read
+		if len(args) >= 2 {
+			return []string{string(args[1])}
+		}
+		return nil
+	case CmdMigrate:
+		if len(args) >= 3 {
+			return []string{string(args[2])}
+		}
+		return nil
+	case CmdFlushDB, CmdFlushAll:
+		// Every key is touched by the flush itself (see swapDataset)
+		return nil
+	case CmdXGroup:
+		if len(args) >= 2 {
+			return []string{string(args[1])}
+		}
+		return nil
+	case CmdXReadGroup:
+		if opts, err := parseStreamReadOptions(args, true); err == nil {
+			return bytesToStrings(opts.keys)
+		}
+		return nil
+	case CmdBLPop, CmdBRPop:
+		// BLPOP key [key ...] timeout
+		if len(args) >= 2 {
+			return bytesToStrings(args[:len(args)-1])
+		}
+		return nil
+	}
+
+	if len(args) == 0 {
+		return nil
+	}
+	return []string{string(args[0])}
+}
+
+// commandKeys returns every key a command names, which are locked while it
+// runs (see keyLocks). Commands without keys return nil.
+func commandKeys(cmdType CommandType, args [][]byte) []string {
+	switch cmdType {
+	case CmdMGet, CmdExists, CmdTouch, CmdSDiff, CmdSInter, CmdSUnion,
+		CmdSDiffStore, CmdSInterStore, CmdSUnionStore, CmdPFCount, CmdPFMerge:
+		return bytesToStrings(args)
+	case CmdXRead:
+		if opts, err := parseStreamReadOptions(args, false); err == nil {
+			return bytesToStrings(opts.keys)
+		}
+		return nil
+	case CmdCopy:
+		if len(args) >= 2 {
+			return bytesToStrings(args[:2])
+		}
+		return nil
+	case CmdObject, CmdMemory:
+		// OBJECT ENCODING key, MEMORY USAGE key
+		if len(args) >= 2 {
+			return []string{string(args[1])}
+		}
+		return nil
+	case CmdKeys, CmdScan, CmdPing, CmdInfo, CmdSave, CmdBgSave, CmdSlaveOf, CmdSync, CmdPSync, CmdBackup,
+		CmdDebug, CmdClient, CmdFailover, CmdHealthCheck, CmdCluster, CmdSelect, CmdAuth, CmdSlowLog, CmdMonitor, CmdLatency,
+		CmdConfig, CmdDBSize:
+		return nil
+	case CmdMigrate:
+		// MIGRATE talks to another server and must not hold the key lock
+		// meanwhile; it only deletes the key if its version did not change
+		return nil
+	}
+	return writeKeys(cmdType, args)
 }
 
 // CommandRegistry maps command names to their types
@@ -323,10 +634,14 @@ var CommandRegistry = map[string]CommandType{
 	protocol.CmdSet:      CmdSet,
 	protocol.CmdGet:      CmdGet,
 	protocol.CmdMSet:     CmdMSet,
+	protocol.CmdMSetNX:   CmdMSetNX,
 	protocol.CmdMGet:     CmdMGet,
 	protocol.CmdDel:      CmdDel,
+	protocol.CmdUnlink:   CmdDel,
 	protocol.CmdExists:   CmdExists,
 	protocol.CmdKeys:     CmdKeys,
+	protocol.CmdScan:     CmdScan,
+	protocol.CmdTouch:    CmdTouch,
 	protocol.CmdIncr:     CmdIncr,
 	protocol.CmdIncrBy:   CmdIncrBy,
 	protocol.CmdDecr:     CmdDecr,
@@ -334,20 +649,32 @@ var CommandRegistry = map[string]CommandType{
 	protocol.CmdStrLen:   CmdStrLen,
 	protocol.CmdAppend:   CmdAppend,
 	protocol.CmdGetRange: CmdGetRange,
+	protocol.CmdSetRange: CmdSetRange,
+	protocol.CmdSetNX:    CmdSetNX,
+	protocol.CmdGetSet:   CmdGetSet,
+	protocol.CmdGetEx:    CmdGetEx,
 
 	// Hash commands
-	protocol.CmdHSet:    CmdHSet,
-	protocol.CmdHGet:    CmdHGet,
-	protocol.CmdHDel:    CmdHDel,
-	protocol.CmdHExists: CmdHExists,
-	protocol.CmdHGetAll: CmdHGetAll,
-	protocol.CmdHKeys:   CmdHKeys,
-	protocol.CmdHVals:   CmdHVals,
-	protocol.CmdHLen:    CmdHLen,
-	protocol.CmdHSetNX:  CmdHSetNX,
-	protocol.CmdHIncrBy: CmdHIncrBy,
-	protocol.CmdHMGet:   CmdHMGet,
-	protocol.CmdHMSet:   CmdHMSet,
+	protocol.CmdHSet:       CmdHSet,
+	protocol.CmdHGet:       CmdHGet,
+	protocol.CmdHDel:       CmdHDel,
+	protocol.CmdHExists:    CmdHExists,
+	protocol.CmdHGetAll:    CmdHGetAll,
+	protocol.CmdHKeys:      CmdHKeys,
+	protocol.CmdHVals:      CmdHVals,
+	protocol.CmdHLen:       CmdHLen,
+	protocol.CmdHSetNX:     CmdHSetNX,
+	protocol.CmdHIncrBy:    CmdHIncrBy,
+	protocol.CmdHMGet:      CmdHMGet,
+	protocol.CmdHMSet:      CmdHMSet,
+	protocol.CmdHExpire:    CmdHExpire,
+	protocol.CmdHPExpire:   CmdHPExpire,
+	protocol.CmdHExpireAt:  CmdHExpireAt,
+	protocol.CmdHPExpireAt: CmdHPExpireAt,
+	protocol.CmdHPersist:   CmdHPersist,
+	protocol.CmdHTTL:       CmdHTTL,
+	protocol.CmdHPTTL:      CmdHPTTL,
+	protocol.CmdHScan:      CmdHScan,
 
 	// List commands
 	protocol.CmdLPush:   CmdLPush,
@@ -361,6 +688,8 @@ var CommandRegistry = map[string]CommandType{
 	protocol.CmdLRem:    CmdLRem,
 	protocol.CmdLInsert: CmdLInsert,
 	protocol.CmdLLen:    CmdLLen,
+	protocol.CmdBLPop:   CmdBLPop,
+	protocol.CmdBRPop:   CmdBRPop,
 
 	// Set commands
 	protocol.CmdSAdd:        CmdSAdd,
@@ -377,11 +706,13 @@ var CommandRegistry = map[string]CommandType{
 	protocol.CmdSDiffStore:  CmdSDiffStore,
 	protocol.CmdSInterStore: CmdSInterStore,
 	protocol.CmdSUnionStore: CmdSUnionStore,
+	protocol.CmdSScan:       CmdSScan,
 
 	// Sorted Set commands
 	protocol.CmdZAdd:          CmdZAdd,
 	protocol.CmdZRem:          CmdZRem,
 	protocol.CmdZScore:        CmdZScore,
+	protocol.CmdZMScore:       CmdZMScore,
 	protocol.CmdZIncrBy:       CmdZIncrBy,
 	protocol.CmdZCard:         CmdZCard,
 	protocol.CmdZRank:         CmdZRank,
@@ -390,6 +721,31 @@ var CommandRegistry = map[string]CommandType{
 	protocol.CmdZRevRange:     CmdZRevRange,
 	protocol.CmdZRangeByScore: CmdZRangeByScore,
 	protocol.CmdZCount:        CmdZCount,
+	protocol.CmdZScan:         CmdZScan,
+
+	// Stream commands
+	protocol.CmdXAdd:       CmdXAdd,
+	protocol.CmdXLen:       CmdXLen,
+	protocol.CmdXRange:     CmdXRange,
+	protocol.CmdXRevRange:  CmdXRevRange,
+	protocol.CmdXRead:      CmdXRead,
+	protocol.CmdXGroup:     CmdXGroup,
+	protocol.CmdXReadGroup: CmdXReadGroup,
+	protocol.CmdXAck:       CmdXAck,
+	protocol.CmdXPending:   CmdXPending,
+	protocol.CmdXClaim:     CmdXClaim,
+	protocol.CmdXAutoClaim: CmdXAutoClaim,
+
+	// HyperLogLog commands
+	protocol.CmdPFAdd:   CmdPFAdd,
+	protocol.CmdPFCount: CmdPFCount,
+	protocol.CmdPFMerge: CmdPFMerge,
+
+	// GEO commands
+	protocol.CmdGeoAdd:    CmdGeoAdd,
+	protocol.CmdGeoPos:    CmdGeoPos,
+	protocol.CmdGeoDist:   CmdGeoDist,
+	protocol.CmdGeoSearch: CmdGeoSearch,
 
 	// TTL commands
 	protocol.CmdExpire:    CmdExpire,
@@ -406,26 +762,65 @@ var CommandRegistry = map[string]CommandType{
 	protocol.CmdDiscard: CmdDiscard,
 	protocol.CmdWatch:   CmdWatch,
 	protocol.CmdUnwatch: CmdUnwatch,
+	protocol.CmdReset:   CmdReset,
 
 	// Management commands
-	protocol.CmdPing:    CmdPing,
-	protocol.CmdInfo:    CmdInfo,
-	protocol.CmdMemory:  CmdMemory,
-	protocol.CmdSave:    CmdSave,
-	protocol.CmdBgSave:  CmdBgSave,
-	protocol.CmdSlaveOf: CmdSlaveOf,
-	protocol.CmdSync:    CmdSync,
-	protocol.CmdPSync:   CmdPSync,
+	protocol.CmdPing:        CmdPing,
+	protocol.CmdInfo:        CmdInfo,
+	protocol.CmdMemory:      CmdMemory,
+	protocol.CmdSave:        CmdSave,
+	protocol.CmdBgSave:      CmdBgSave,
+	protocol.CmdSlaveOf:     CmdSlaveOf,
+	protocol.CmdReplicaOf:   CmdSlaveOf,
+	protocol.CmdSync:        CmdSync,
+	protocol.CmdPSync:       CmdPSync,
+	protocol.CmdBackup:      CmdBackup,
+	protocol.CmdDebug:       CmdDebug,
+	protocol.CmdClient:      CmdClient,
+	protocol.CmdFailover:    CmdFailover,
+	protocol.CmdHealthCheck: CmdHealthCheck,
+	protocol.CmdCluster:     CmdCluster,
 
 	// Database commands
-	protocol.CmdSelect: CmdSelect,
-	protocol.CmdType:   CmdType,
-	protocol.CmdMove:   CmdMove,
+	protocol.CmdSelect:   CmdSelect,
+	protocol.CmdType:     CmdType,
+	protocol.CmdObject:   CmdObject,
+	protocol.CmdMove:     CmdMove,
+	protocol.CmdRename:   CmdRename,
+	protocol.CmdRenameNX: CmdRenameNX,
+	protocol.CmdCopy:     CmdCopy,
+	protocol.CmdMigrate:  CmdMigrate,
+	protocol.CmdDBSize:   CmdDBSize,
+	protocol.CmdFlushDB:  CmdFlushDB,
+	protocol.CmdFlushAll: CmdFlushAll,
 
 	// Security and monitoring commands
 	protocol.CmdAuth:    CmdAuth,
 	protocol.CmdSlowLog: CmdSlowLog,
 	protocol.CmdMonitor: CmdMonitor,
+	protocol.CmdLatency: CmdLatency,
+	protocol.CmdConfig:  CmdConfig,
+}
+
+// commandNames maps the name of every registered command, in upper and in
+// lower case, to its upper-case name
+var commandNames = func() map[string]string {
+	names := make(map[string]string, 2*len(CommandRegistry))
+	for name := range CommandRegistry {
+		names[name] = name
+		names[strings.ToLower(name)] = name
+	}
+	return names
+}()
+
+// CommandName returns the upper-case name of a command. The name of a
+// registered command sent in upper or lower case is returned without
+// allocating.
+func CommandName(name []byte) string {
+	if upper, ok := commandNames[string(name)]; ok {
+		return upper
+	}
+	return protocol.ToUpper(string(name))
 }
 
 // ParseCommandType parses a command name string to CommandType
@@ -1,5 +1,11 @@
 package database
 
+import (
+	"sort"
+
+	"github.com/wangbo/gocache/protocol"
+)
+
 // Command executor registry
 var commandExecutors = map[CommandType]CommandExecutor{}
 
@@ -16,12 +22,34 @@ func (c *BaseCommand) IsWriteCommand() bool {
 type FunctionCommand struct {
 	BaseCommand
 	executeFunc func(db *DB, args [][]byte) ([][]byte, error)
+
+	// typedFunc replaces executeFunc for commands returning a typed Result
+	typedFunc func(db *DB, args [][]byte) (Result, error)
+
+	// exclusive commands hold db.mu exclusively instead of sharing it
+	exclusive bool
+
+	// unlocked commands run without db.mu and take it themselves
+	unlocked bool
 }
 
 func (c *FunctionCommand) Execute(db *DB, args [][]byte) ([][]byte, error) {
+	if c.typedFunc != nil {
+		result, err := c.typedFunc(db, args)
+		return linesOf(result), err
+	}
 	return c.executeFunc(db, args)
 }
 
+// ExecuteTyped runs the command and returns its typed result; the result of
+// a command that is not typed is a LinesResult
+func (c *FunctionCommand) ExecuteTyped(db *DB, args [][]byte) (Result, error) {
+	if c.typedFunc != nil {
+		return c.typedFunc(db, args)
+	}
+	return untypedResult(c.executeFunc(db, args))
+}
+
 // NewWriteCommand creates a write command executor
 func NewWriteCommand(fn func(db *DB, args [][]byte) ([][]byte, error)) CommandExecutor {
 	return &FunctionCommand{
@@ -38,23 +66,139 @@ func NewReadCommand(fn func(db *DB, args [][]byte) ([][]byte, error)) CommandExe
 	}
 }
 
+// NewTypedWriteCommand creates a write command executor returning a typed
+// Result
+func NewTypedWriteCommand(fn func(db *DB, args [][]byte) (Result, error)) CommandExecutor {
+	return &FunctionCommand{
+		BaseCommand: BaseCommand{isWrite: true},
+		typedFunc:   fn,
+	}
+}
+
+// NewTypedReadCommand creates a read command executor returning a typed
+// Result
+func NewTypedReadCommand(fn func(db *DB, args [][]byte) (Result, error)) CommandExecutor {
+	return &FunctionCommand{
+		BaseCommand: BaseCommand{isWrite: false},
+		typedFunc:   fn,
+	}
+}
+
+// NewExclusiveCommand creates a read command executor that runs with every
+// other command blocked, like EXEC
+func NewExclusiveCommand(fn func(db *DB, args [][]byte) ([][]byte, error)) CommandExecutor {
+	return &FunctionCommand{
+		executeFunc: fn,
+		exclusive:   true,
+	}
+}
+
+// NewTypedExclusiveCommand creates a read command executor returning a typed
+// Result that runs with every other command blocked
+func NewTypedExclusiveCommand(fn func(db *DB, args [][]byte) (Result, error)) CommandExecutor {
+	return &FunctionCommand{
+		typedFunc: fn,
+		exclusive: true,
+	}
+}
+
+// NewExclusiveWriteCommand creates a write command executor returning a
+// typed Result that runs with every other command blocked, like FLUSHALL
+func NewExclusiveWriteCommand(fn func(db *DB, args [][]byte) (Result, error)) CommandExecutor {
+	return &FunctionCommand{
+		BaseCommand: BaseCommand{isWrite: true},
+		typedFunc:   fn,
+		exclusive:   true,
+	}
+}
+
+// NewUnlockedCommand creates a read command executor that runs without
+// db.mu, for commands that must wait for something needing it, like SLAVEOF
+// stopping the replication loop. Such commands cannot run inside EXEC, which
+// holds db.mu, and must be MultiForbidden.
+func NewUnlockedCommand(fn func(db *DB, args [][]byte) ([][]byte, error)) CommandExecutor {
+	return &FunctionCommand{
+		executeFunc: fn,
+		unlocked:    true,
+	}
+}
+
+// TransactionCommand is an executor for commands that operate on the
+// transaction state of a connection (MULTI, EXEC, DISCARD, WATCH, UNWATCH)
+type TransactionCommand struct {
+	BaseCommand
+	executeFunc func(ms *MultiState, args [][]byte) ([][]byte, error)
+}
+
+// Execute runs the command against the database's default transaction state
+func (c *TransactionCommand) Execute(db *DB, args [][]byte) ([][]byte, error) {
+	return c.executeFunc(db.multiState, args)
+}
+
+// ExecuteWithState runs the command against the given transaction state
+func (c *TransactionCommand) ExecuteWithState(ms *MultiState, args [][]byte) ([][]byte, error) {
+	return c.executeFunc(ms, args)
+}
+
+// NewTransactionCommand creates a transaction command executor
+func NewTransactionCommand(fn func(ms *MultiState, args [][]byte) ([][]byte, error)) CommandExecutor {
+	return &TransactionCommand{executeFunc: fn}
+}
+
+// ClientCommand is an executor for commands on the connection sending them
+// (CLIENT). Unlike transaction commands, MULTI queues them; they run without
+// db.mu.
+type ClientCommand struct {
+	BaseCommand
+	executeFunc func(ms *MultiState, args [][]byte) (Result, error)
+}
+
+// Execute runs the command against the database's default transaction state
+func (c *ClientCommand) Execute(db *DB, args [][]byte) ([][]byte, error) {
+	result, err := c.executeFunc(db.multiState, args)
+	return linesOf(result), err
+}
+
+// ExecuteTyped runs the command against the database's default transaction
+// state and returns its typed result
+func (c *ClientCommand) ExecuteTyped(db *DB, args [][]byte) (Result, error) {
+	return c.executeFunc(db.multiState, args)
+}
+
+// ExecuteWithState runs the command on behalf of the connection owning ms
+func (c *ClientCommand) ExecuteWithState(ms *MultiState, args [][]byte) (Result, error) {
+	return c.executeFunc(ms, args)
+}
+
+// NewClientCommand creates a connection command executor
+func NewClientCommand(fn func(ms *MultiState, args [][]byte) (Result, error)) CommandExecutor {
+	return &ClientCommand{executeFunc: fn}
+}
+
 // Initialize command executors using the existing exec functions
 func initCommandExecutors() {
 	// String commands
-	commandExecutors[CmdSet] = NewWriteCommand(execSet)
-	commandExecutors[CmdGet] = NewReadCommand(execGet)
+	commandExecutors[CmdSet] = NewTypedWriteCommand(execSet)
+	commandExecutors[CmdGet] = NewTypedReadCommand(execGet)
 	commandExecutors[CmdMSet] = NewWriteCommand(execMSet)
+	commandExecutors[CmdMSetNX] = NewWriteCommand(execMSetNX)
 	commandExecutors[CmdMGet] = NewReadCommand(execMGet)
-	commandExecutors[CmdDel] = NewWriteCommand(execDel)
-	commandExecutors[CmdExists] = NewReadCommand(execExists)
+	commandExecutors[CmdDel] = NewTypedWriteCommand(execDel)
+	commandExecutors[CmdExists] = NewTypedReadCommand(execExists)
 	commandExecutors[CmdKeys] = NewReadCommand(execKeys)
-	commandExecutors[CmdIncr] = NewWriteCommand(execIncr)
-	commandExecutors[CmdIncrBy] = NewWriteCommand(execIncrBy)
-	commandExecutors[CmdDecr] = NewWriteCommand(execDecr)
-	commandExecutors[CmdDecrBy] = NewWriteCommand(execDecrBy)
-	commandExecutors[CmdStrLen] = NewReadCommand(execStrLen)
-	commandExecutors[CmdAppend] = NewWriteCommand(execAppend)
-	commandExecutors[CmdGetRange] = NewReadCommand(execGetRange)
+	commandExecutors[CmdScan] = NewTypedReadCommand(execScan)
+	commandExecutors[CmdTouch] = NewTypedReadCommand(execTouch)
+	commandExecutors[CmdIncr] = NewTypedWriteCommand(execIncr)
+	commandExecutors[CmdIncrBy] = NewTypedWriteCommand(execIncrBy)
+	commandExecutors[CmdDecr] = NewTypedWriteCommand(execDecr)
+	commandExecutors[CmdDecrBy] = NewTypedWriteCommand(execDecrBy)
+	commandExecutors[CmdStrLen] = NewTypedReadCommand(execStrLen)
+	commandExecutors[CmdAppend] = NewTypedWriteCommand(execAppend)
+	commandExecutors[CmdGetRange] = NewTypedReadCommand(execGetRange)
+	commandExecutors[CmdSetRange] = NewTypedWriteCommand(execSetRange)
+	commandExecutors[CmdSetNX] = NewTypedWriteCommand(execSetNX)
+	commandExecutors[CmdGetSet] = NewTypedWriteCommand(execGetSet)
+	commandExecutors[CmdGetEx] = NewTypedWriteCommand(execGetEx)
 
 	// Hash commands
 	commandExecutors[CmdHSet] = NewWriteCommand(execHSet)
@@ -69,6 +213,14 @@ func initCommandExecutors() {
 	commandExecutors[CmdHIncrBy] = NewWriteCommand(execHIncrBy)
 	commandExecutors[CmdHMGet] = NewReadCommand(execHMGet)
 	commandExecutors[CmdHMSet] = NewWriteCommand(execHMSet)
+	commandExecutors[CmdHExpire] = NewWriteCommand(execHExpire)
+	commandExecutors[CmdHPExpire] = NewWriteCommand(execHPExpire)
+	commandExecutors[CmdHExpireAt] = NewWriteCommand(execHExpireAt)
+	commandExecutors[CmdHPExpireAt] = NewWriteCommand(execHPExpireAt)
+	commandExecutors[CmdHPersist] = NewWriteCommand(execHPersist)
+	commandExecutors[CmdHTTL] = NewReadCommand(execHTTL)
+	commandExecutors[CmdHPTTL] = NewReadCommand(execHPTTL)
+	commandExecutors[CmdHScan] = NewTypedReadCommand(execHScan)
 
 	// List commands
 	commandExecutors[CmdLPush] = NewWriteCommand(execLPush)
@@ -82,6 +234,8 @@ func initCommandExecutors() {
 	commandExecutors[CmdLRem] = NewWriteCommand(execLRem)
 	commandExecutors[CmdLInsert] = NewWriteCommand(execLInsert)
 	commandExecutors[CmdLLen] = NewReadCommand(execLLen)
+	commandExecutors[CmdBLPop] = NewWriteCommand(execBLPop)
+	commandExecutors[CmdBRPop] = NewWriteCommand(execBRPop)
 
 	// Set commands
 	commandExecutors[CmdSAdd] = NewWriteCommand(execSAdd)
@@ -98,11 +252,13 @@ func initCommandExecutors() {
 	commandExecutors[CmdSDiffStore] = NewWriteCommand(execSDiffStore)
 	commandExecutors[CmdSInterStore] = NewWriteCommand(execSInterStore)
 	commandExecutors[CmdSUnionStore] = NewWriteCommand(execSUnionStore)
+	commandExecutors[CmdSScan] = NewTypedReadCommand(execSScan)
 
 	// Sorted Set commands
-	commandExecutors[CmdZAdd] = NewWriteCommand(execZAdd)
+	commandExecutors[CmdZAdd] = NewTypedWriteCommand(execZAdd)
 	commandExecutors[CmdZRem] = NewWriteCommand(execZRem)
 	commandExecutors[CmdZScore] = NewReadCommand(execZScore)
+	commandExecutors[CmdZMScore] = NewReadCommand(execZMScore)
 	commandExecutors[CmdZIncrBy] = NewWriteCommand(execZIncrBy)
 	commandExecutors[CmdZCard] = NewReadCommand(execZCard)
 	commandExecutors[CmdZRank] = NewReadCommand(execZRank)
@@ -111,46 +267,102 @@ func initCommandExecutors() {
 	commandExecutors[CmdZRevRange] = NewReadCommand(execZRevRange)
 	commandExecutors[CmdZRangeByScore] = NewReadCommand(execZRangeByScore)
 	commandExecutors[CmdZCount] = NewReadCommand(execZCount)
+	commandExecutors[CmdZScan] = NewTypedReadCommand(execZScan)
+
+	// Stream commands
+	commandExecutors[CmdXAdd] = NewWriteCommand(streamCommand(execXAdd))
+	commandExecutors[CmdXLen] = NewReadCommand(streamCommand(execXLen))
+	commandExecutors[CmdXRange] = NewReadCommand(streamCommand(execXRange))
+	commandExecutors[CmdXRevRange] = NewReadCommand(streamCommand(execXRevRange))
+	commandExecutors[CmdXRead] = NewReadCommand(streamCommand(execXRead))
+	commandExecutors[CmdXGroup] = NewWriteCommand(streamCommand(execXGroup))
+	commandExecutors[CmdXReadGroup] = NewWriteCommand(streamCommand(execXReadGroup))
+	commandExecutors[CmdXAck] = NewWriteCommand(streamCommand(execXAck))
+	commandExecutors[CmdXPending] = NewReadCommand(streamCommand(execXPending))
+	commandExecutors[CmdXClaim] = NewWriteCommand(streamCommand(execXClaim))
+	commandExecutors[CmdXAutoClaim] = NewWriteCommand(streamCommand(execXAutoClaim))
+
+	// HyperLogLog commands
+	commandExecutors[CmdPFAdd] = NewWriteCommand(hllCommand(execPFAdd))
+	commandExecutors[CmdPFCount] = NewReadCommand(hllCommand(execPFCount))
+	commandExecutors[CmdPFMerge] = NewWriteCommand(hllCommand(execPFMerge))
+
+	// GEO commands
+	commandExecutors[CmdGeoAdd] = NewWriteCommand(execGeoAdd)
+	commandExecutors[CmdGeoPos] = NewReadCommand(execGeoPos)
+	commandExecutors[CmdGeoDist] = NewReadCommand(execGeoDist)
+	commandExecutors[CmdGeoSearch] = NewReadCommand(execGeoSearch)
 
 	// TTL commands
-	commandExecutors[CmdExpire] = NewWriteCommand(execExpire)
-	commandExecutors[CmdPExpire] = NewWriteCommand(execPExpire)
-	commandExecutors[CmdExpireAt] = NewWriteCommand(execExpireAt)
-	commandExecutors[CmdPExpireAt] = NewWriteCommand(execPExpireAt)
-	commandExecutors[CmdTTL] = NewReadCommand(execTTL)
-	commandExecutors[CmdPTTL] = NewReadCommand(execPTTL)
-	commandExecutors[CmdPersist] = NewWriteCommand(execPersist)
+	commandExecutors[CmdExpire] = NewTypedWriteCommand(execExpire)
+	commandExecutors[CmdPExpire] = NewTypedWriteCommand(execPExpire)
+	commandExecutors[CmdExpireAt] = NewTypedWriteCommand(execExpireAt)
+	commandExecutors[CmdPExpireAt] = NewTypedWriteCommand(execPExpireAt)
+	commandExecutors[CmdTTL] = NewTypedReadCommand(execTTL)
+	commandExecutors[CmdPTTL] = NewTypedReadCommand(execPTTL)
+	commandExecutors[CmdPersist] = NewTypedWriteCommand(execPersist)
 
 	// Transaction commands
-	commandExecutors[CmdMulti] = NewReadCommand(execMulti)
-	commandExecutors[CmdExec] = NewReadCommand(execExec)
-	commandExecutors[CmdDiscard] = NewReadCommand(execDiscard)
-	commandExecutors[CmdWatch] = NewReadCommand(execWatch)
-	commandExecutors[CmdUnwatch] = NewReadCommand(execUnwatch)
+	commandExecutors[CmdMulti] = NewTransactionCommand(execMulti)
+	commandExecutors[CmdExec] = NewTransactionCommand(execExec)
+	commandExecutors[CmdDiscard] = NewTransactionCommand(execDiscard)
+	commandExecutors[CmdWatch] = NewTransactionCommand(execWatch)
+	commandExecutors[CmdUnwatch] = NewTransactionCommand(execUnwatch)
+	commandExecutors[CmdReset] = NewTransactionCommand(execReset)
 
 	// Management commands
 	commandExecutors[CmdPing] = NewReadCommand(execPing)
 	commandExecutors[CmdInfo] = NewReadCommand(execInfo)
-	commandExecutors[CmdMemory] = NewReadCommand(execMemory)
+	commandExecutors[CmdHealthCheck] = NewTypedReadCommand(execHealthCheck)
+	commandExecutors[CmdCluster] = NewReadCommand(execCluster)
+	commandExecutors[CmdMemory] = NewTypedReadCommand(execMemory)
 	commandExecutors[CmdSave] = NewReadCommand(execSave)
 	commandExecutors[CmdBgSave] = NewReadCommand(execBgSave)
-	commandExecutors[CmdSlaveOf] = NewReadCommand(execSlaveOf)
+	commandExecutors[CmdSlaveOf] = NewUnlockedCommand(execSlaveOf)
 	commandExecutors[CmdSync] = NewReadCommand(execSync)
 	commandExecutors[CmdPSync] = NewReadCommand(execPSync)
+	commandExecutors[CmdBackup] = NewReadCommand(execBackup)
+	commandExecutors[CmdDebug] = NewTypedExclusiveCommand(execDebug)
+	commandExecutors[CmdClient] = NewClientCommand(execClient)
+	commandExecutors[CmdFailover] = NewReadCommand(execFailover)
 
 	// Database commands
 	commandExecutors[CmdSelect] = NewReadCommand(execSelect)
 	commandExecutors[CmdType] = NewReadCommand(execType)
-	commandExecutors[CmdMove] = NewWriteCommand(execMove)
+	commandExecutors[CmdObject] = NewTypedReadCommand(execObject)
+	commandExecutors[CmdMove] = NewTypedWriteCommand(execMove)
+	commandExecutors[CmdRename] = NewTypedWriteCommand(execRename)
+	commandExecutors[CmdRenameNX] = NewTypedWriteCommand(execRenameNX)
+	commandExecutors[CmdCopy] = NewTypedWriteCommand(execCopy)
+	commandExecutors[CmdMigrate] = NewWriteCommand(execMigrate)
+	commandExecutors[CmdDBSize] = NewTypedReadCommand(execDBSize)
+	commandExecutors[CmdFlushDB] = NewExclusiveWriteCommand(execFlushDB)
+	commandExecutors[CmdFlushAll] = NewExclusiveWriteCommand(execFlushAll)
 
 	// Security and monitoring commands
 	commandExecutors[CmdAuth] = NewReadCommand(execAuth)
 	commandExecutors[CmdSlowLog] = NewReadCommand(execSlowLog)
 	commandExecutors[CmdMonitor] = NewReadCommand(execMonitor)
+	commandExecutors[CmdLatency] = NewReadCommand(execLatency)
+	commandExecutors[CmdConfig] = NewTypedReadCommand(execConfig)
 }
 
 func init() {
 	initCommandExecutors()
+	for cmdType := range commandExecutors {
+		syncProtocolWriteCommand(cmdType)
+	}
+}
+
+// syncProtocolWriteCommand mirrors the write flag of a command, under its
+// name and its aliases, into the deprecated protocol.WriteCommands map
+func syncProtocolWriteCommand(cmdType CommandType) {
+	protocol.WriteCommands[cmdType.String()] = cmdType.IsWriteCommand()
+	for name, t := range CommandRegistry {
+		if t == cmdType {
+			protocol.WriteCommands[name] = cmdType.IsWriteCommand()
+		}
+	}
 }
 
 // GetCommandExecutor returns the executor for a given command type
@@ -159,7 +371,21 @@ func GetCommandExecutor(cmdType CommandType) (CommandExecutor, bool) {
 	return executor, ok
 }
 
+// SupportedCommands returns the names, aliases included, of every command
+// the database dispatches to an executor, sorted
+func SupportedCommands() []string {
+	names := make([]string, 0, len(CommandRegistry))
+	for name, cmdType := range CommandRegistry {
+		if _, ok := commandExecutors[cmdType]; ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
 // RegisterCommandExecutor allows registering custom command executors
 func RegisterCommandExecutor(cmdType CommandType, executor CommandExecutor) {
 	commandExecutors[cmdType] = executor
+	syncProtocolWriteCommand(cmdType)
 }
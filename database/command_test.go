@@ -0,0 +1,58 @@
+package database_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/wangbo/gocache/database"
+	"github.com/wangbo/gocache/protocol"
+)
+
+// TestEveryCommandIsClassified fails when a command is added without
+// declaring whether it writes and the shape of its reply
+func TestEveryCommandIsClassified(t *testing.T) {
+	shapes := map[string]map[string]bool{
+		"status":        protocol.StatusCommands,
+		"integer":       protocol.IntegerCommands,
+		"bulk":          protocol.BulkCommands,
+		"array":         protocol.ArrayCommands,
+		"integer array": protocol.IntegerArrayCommands,
+		"stream":        protocol.StreamCommands,
+		"geo":           protocol.GeoCommands,
+		"special":       protocol.SpecialCommands,
+	}
+
+	commands := database.SupportedCommands()
+	if len(commands) == 0 {
+		t.Fatal("Expected supported commands")
+	}
+	supported := make(map[string]bool, len(commands))
+	for _, name := range commands {
+		supported[name] = true
+
+		if isWrite, ok := protocol.WriteCommands[name]; !ok {
+			t.Errorf("%s is neither a write nor a read command in protocol.WriteCommands", name)
+		} else if isWrite != database.IsWriteCommand(name) {
+			t.Errorf("%s: protocol.WriteCommands says write %v, the registry %v", name, isWrite, !isWrite)
+		}
+
+		var in []string
+		for shape, names := range shapes {
+			if names[name] {
+				in = append(in, shape)
+			}
+		}
+		if len(in) != 1 {
+			t.Errorf("%s must have exactly one reply shape, has %d: %s", name, len(in), strings.Join(in, ", "))
+		}
+	}
+
+	// Nothing is classified that the database does not run
+	for shape, names := range shapes {
+		for name := range names {
+			if !supported[name] {
+				t.Errorf("%s is listed as a %s command but not supported", name, shape)
+			}
+		}
+	}
+}
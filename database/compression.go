@@ -0,0 +1,30 @@
+package database
+
+import "github.com/wangbo/gocache/datastruct"
+
+// Compression of string values
+//
+// Caches often hold large, repetitive values such as JSON documents. With
+// value-compression lzf, a string value of at least
+// value-compression-min-size bytes is LZF-compressed as it is stored, by
+// SET, MSET, GETSET and every other command replacing a key's value, if that
+// makes it smaller. Clients never see the compressed bytes: GET and the other
+// reads decompress the value, and OBJECT ENCODING reports "compressed".
+// MEMORY USAGE and used_memory count the compressed size.
+//
+// APPEND and SETRANGE decompress the value for good before modifying it, as
+// they do for an int-encoded value, and do not compress it again. GETRANGE
+// decompresses it for the call only and STRLEN answers from the recorded
+// length: both are reads, which must not grow the stored value. Snapshots
+// keep the compressed bytes, which loading stores as they are.
+
+// compressValue compresses the value of an entity about to be stored if it
+// is a string eligible for compression
+func (db *DB) compressValue(entity *datastruct.DataEntity) {
+	if db.config.ValueCompression != "lzf" {
+		return
+	}
+	if str, ok := entity.Data.(*datastruct.String); ok {
+		str.Compress(db.config.ValueCompressionMinSize)
+	}
+}
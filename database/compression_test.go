@@ -0,0 +1,226 @@
+package database_test
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/wangbo/gocache/config"
+	"github.com/wangbo/gocache/database"
+	"github.com/wangbo/gocache/replication"
+)
+
+// makeCompressingDB creates a database compressing the string values of at
+// least minSize bytes
+func makeCompressingDB(t *testing.T, minSize int) *database.DB {
+	t.Helper()
+	cfg := config.Default()
+	cfg.ValueCompression = "lzf"
+	cfg.ValueCompressionMinSize = minSize
+	db := database.MakeDBWithConfig(cfg, replication.NewReplicationState())
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// jsonValue returns a JSON document of about size bytes, as repetitive as a
+// cached API response
+func jsonValue(size int) string {
+	var b strings.Builder
+	b.WriteString("[")
+	for i := 0; b.Len() < size; i++ {
+		fmt.Fprintf(&b, `{"id":%d,"name":"user-%d","active":true,"roles":["reader","writer"]},`, i, i)
+	}
+	return b.String()[:size]
+}
+
+func encoding(t *testing.T, db *database.DB, key string) string {
+	t.Helper()
+	return string(exec(t, db, "OBJECT", "ENCODING", key)[0])
+}
+
+func TestCompressionThreshold(t *testing.T) {
+	db := makeCompressingDB(t, 1024)
+
+	random := make([]byte, 2048)
+	rand.New(rand.NewSource(1)).Read(random)
+
+	tests := []struct {
+		name     string
+		value    string
+		encoding string
+	}{
+		{"below the threshold", jsonValue(1023), "raw"},
+		{"at the threshold", jsonValue(1024), "compressed"},
+		{"above the threshold", jsonValue(20000), "compressed"},
+		{"incompressible", string(random), "raw"},
+		{"integer", "12345", "int"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			exec(t, db, "SET", "k", tt.value)
+			if got := encoding(t, db, "k"); got != tt.encoding {
+				t.Errorf("Expected %s, got %s", tt.encoding, got)
+			}
+			if got := string(exec(t, db, "GET", "k")[0]); got != tt.value {
+				t.Error("GET returned a different value")
+			}
+		})
+	}
+}
+
+func TestCompressionOff(t *testing.T) {
+	db := database.MakeDB()
+	defer db.Close()
+
+	exec(t, db, "SET", "k", jsonValue(20000))
+	if got := encoding(t, db, "k"); got != "raw" {
+		t.Errorf("Expected raw without value-compression, got %s", got)
+	}
+}
+
+// TestCompressionWriters checks that every command replacing a value
+// compresses it
+func TestCompressionWriters(t *testing.T) {
+	value := jsonValue(4096)
+	tests := [][]string{
+		{"SET", "k", value},
+		{"SET", "k", value, "EX", "100"},
+		{"SETNX", "k", value},
+		{"GETSET", "k", value},
+		{"MSET", "k", value, "other", "v"},
+		{"MSETNX", "k", value, "other", "v"},
+	}
+
+	for _, args := range tests {
+		t.Run(args[0], func(t *testing.T) {
+			db := makeCompressingDB(t, 1024)
+			exec(t, db, args...)
+			if got := encoding(t, db, "k"); got != "compressed" {
+				t.Errorf("Expected compressed, got %s", got)
+			}
+		})
+	}
+}
+
+func TestCompressedReads(t *testing.T) {
+	db := makeCompressingDB(t, 1024)
+	value := jsonValue(20000)
+	exec(t, db, "SET", "k", value)
+	size := db.GetUsedMemory()
+
+	if got := string(exec(t, db, "GET", "k")[0]); got != value {
+		t.Error("GET returned a different value")
+	}
+	if got := string(exec(t, db, "MGET", "k", "missing")[0]); got != value {
+		t.Error("MGET returned a different value")
+	}
+	if got := string(exec(t, db, "GETRANGE", "k", "100", "199")[0]); got != value[100:200] {
+		t.Errorf("Expected %q, got %q", value[100:200], got)
+	}
+	if got := string(exec(t, db, "GETRANGE", "k", "-5", "-1")[0]); got != value[len(value)-5:] {
+		t.Errorf("Expected %q, got %q", value[len(value)-5:], got)
+	}
+	if got := string(exec(t, db, "STRLEN", "k")[0]); got != strconv.Itoa(len(value)) {
+		t.Errorf("Expected STRLEN %d, got %s", len(value), got)
+	}
+
+	// The reads neither decompress the stored value nor change its size
+	if got := encoding(t, db, "k"); got != "compressed" {
+		t.Errorf("Expected the value to stay compressed, got %s", got)
+	}
+	if used := db.GetUsedMemory(); used != size {
+		t.Errorf("Expected used memory %d, got %d", size, used)
+	}
+}
+
+func TestCompressedMemoryUsage(t *testing.T) {
+	value := jsonValue(20000)
+
+	plain := database.MakeDB()
+	defer plain.Close()
+	exec(t, plain, "SET", "k", value)
+	plainUsage, _ := strconv.Atoi(string(exec(t, plain, "MEMORY", "USAGE", "k")[0]))
+
+	db := makeCompressingDB(t, 1024)
+	exec(t, db, "SET", "k", value)
+	usage, _ := strconv.Atoi(string(exec(t, db, "MEMORY", "USAGE", "k")[0]))
+
+	if usage*5 > plainUsage {
+		t.Errorf("Expected the compressed value to use a fifth of %d bytes, got %d", plainUsage, usage)
+	}
+	if used := db.GetUsedMemory(); used*5 > plain.GetUsedMemory() {
+		t.Errorf("Expected used memory to count the compressed size, got %d", used)
+	}
+}
+
+// TestMutationsDecompress checks that APPEND and SETRANGE leave a raw value,
+// accounted like the same value set without compression
+func TestMutationsDecompress(t *testing.T) {
+	value := jsonValue(4096)
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"APPEND", "k", "]"}, value + "]"},
+		{[]string{"SETRANGE", "k", "0", "{"}, "{" + value[1:]},
+		{[]string{"SETRANGE", "k", "4100", "x"}, value + "\x00\x00\x00\x00x"},
+	}
+
+	for _, tt := range tests {
+		t.Run(strings.Join(tt.args[:3], " "), func(t *testing.T) {
+			db := makeCompressingDB(t, 1024)
+			exec(t, db, "SET", "k", value)
+			exec(t, db, tt.args...)
+
+			if got := encoding(t, db, "k"); got != "raw" {
+				t.Errorf("Expected raw after %s, got %s", tt.args[0], got)
+			}
+			if got := string(exec(t, db, "GET", "k")[0]); got != tt.want {
+				t.Errorf("%s changed the value wrongly", tt.args[0])
+			}
+
+			plain := database.MakeDB()
+			defer plain.Close()
+			exec(t, plain, "SET", "k", tt.want)
+			if used, want := db.GetUsedMemory(), plain.GetUsedMemory(); used != want {
+				t.Errorf("Expected used memory %d, got %d", want, used)
+			}
+
+			// A later SET compresses again
+			exec(t, db, "SET", "k", value)
+			if got := encoding(t, db, "k"); got != "compressed" {
+				t.Errorf("Expected SET to compress again, got %s", got)
+			}
+		})
+	}
+}
+
+func BenchmarkCompression(b *testing.B) {
+	value := []byte(jsonValue(20 << 10))
+	for _, compression := range []string{"no", "lzf"} {
+		cfg := config.Default()
+		cfg.ValueCompression = compression
+		db := database.MakeDBWithConfig(cfg, replication.NewReplicationState())
+		defer db.Close()
+
+		b.Run("SET/"+compression, func(b *testing.B) {
+			cmdLine := [][]byte{[]byte("SET"), []byte("key"), value}
+			b.SetBytes(int64(len(value)))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				db.Exec(cmdLine)
+			}
+		})
+		b.Run("GET/"+compression, func(b *testing.B) {
+			cmdLine := [][]byte{[]byte("GET"), []byte("key")}
+			b.SetBytes(int64(len(value)))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				db.Exec(cmdLine)
+			}
+		})
+	}
+}
@@ -0,0 +1,209 @@
+package database
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/wangbo/gocache/config"
+	"github.com/wangbo/gocache/util/glob"
+)
+
+// Runtime configuration
+//
+// CONFIG GET and CONFIG SET read and change the parameters of configParams
+// without a restart. CONFIG SET validates a value with the parser of the
+// config file directive of the same name, and applies every pair or none.
+//
+// requirepass is enforced by the server, which registers a callback with
+// SetRequirePassCallback: a new password applies to the next AUTH, and
+// connections already authenticated stay so, like in Redis. The empty
+// password disables authentication.
+//
+// CONFIG SET does not write the Properties the database was made with,
+// which the server and other goroutines read without a lock: the values it
+// changes are kept in runtimeConfig, whose atomics commands read as they
+// run.
+
+// runtimeConfig holds the parameters of configParams that commands read
+type runtimeConfig struct {
+	requirePass          string // Guarded by db.configMu
+	maxCommandPayload    atomic.Int64
+	maxWatchedKeys       atomic.Int64
+	stopWritesOnAOFError atomic.Bool
+	ttlJitterPercent     atomic.Int64
+}
+
+// load sets the parameters to their values in cfg
+func (r *runtimeConfig) load(cfg *config.Properties) {
+	r.requirePass = cfg.RequirePass
+	r.maxCommandPayload.Store(cfg.MaxCommandPayload)
+	r.maxWatchedKeys.Store(int64(cfg.MaxWatchedKeys))
+	r.stopWritesOnAOFError.Store(cfg.StopWritesOnAOFError)
+	r.ttlJitterPercent.Store(int64(cfg.TTLJitterPercent))
+}
+
+// configParam is a parameter of CONFIG GET and CONFIG SET
+type configParam struct {
+	name string
+	get  func(db *DB) string
+	// set applies the value parsed into p
+	set func(db *DB, p *config.Properties)
+}
+
+var configParams = []configParam{
+	{
+		name: "requirepass",
+		get:  func(db *DB) string { return db.runtime.requirePass },
+		set: func(db *DB, p *config.Properties) {
+			db.runtime.requirePass = p.RequirePass
+			if fn, ok := db.requirePassCallback.Load().(func(password string)); ok && fn != nil {
+				fn(p.RequirePass)
+			}
+		},
+	},
+	{
+		name: "max-command-payload",
+		get:  func(db *DB) string { return strconv.FormatInt(db.runtime.maxCommandPayload.Load(), 10) },
+		set: func(db *DB, p *config.Properties) {
+			db.runtime.maxCommandPayload.Store(p.MaxCommandPayload)
+		},
+	},
+	{
+		name: "max-watched-keys",
+		get:  func(db *DB) string { return strconv.FormatInt(db.runtime.maxWatchedKeys.Load(), 10) },
+		set: func(db *DB, p *config.Properties) {
+			db.runtime.maxWatchedKeys.Store(int64(p.MaxWatchedKeys))
+		},
+	},
+	{
+		name: "stop-writes-on-aof-error",
+		get: func(db *DB) string {
+			if db.runtime.stopWritesOnAOFError.Load() {
+				return "yes"
+			}
+			return "no"
+		},
+		set: func(db *DB, p *config.Properties) {
+			db.runtime.stopWritesOnAOFError.Store(p.StopWritesOnAOFError)
+		},
+	},
+	{
+		name: "ttl-jitter-percent",
+		get:  func(db *DB) string { return strconv.FormatInt(db.runtime.ttlJitterPercent.Load(), 10) },
+		set: func(db *DB, p *config.Properties) {
+			db.runtime.ttlJitterPercent.Store(int64(p.TTLJitterPercent))
+		},
+	},
+	{
+		name: "slowlog-log-slower-than",
+		get:  func(db *DB) string { return strconv.FormatInt(db.SlowLogSlowerThan(), 10) },
+		set: func(db *DB, p *config.Properties) {
+			db.SetSlowLogSlowerThan(int64(p.SlowLogLogSlowerThan))
+		},
+	},
+	{
+		name: "slowlog-max-len",
+		get:  func(db *DB) string { return strconv.Itoa(db.SlowLogMaxLen()) },
+		set: func(db *DB, p *config.Properties) {
+			db.SetSlowLogMaxLen(p.SlowLogMaxLen)
+		},
+	},
+}
+
+// findConfigParam returns the parameter of a name, nil if CONFIG does not
+// support it
+func findConfigParam(name string) *configParam {
+	for i := range configParams {
+		if strings.EqualFold(configParams[i].name, name) {
+			return &configParams[i]
+		}
+	}
+	return nil
+}
+
+// SetRequirePassCallback sets the function CONFIG SET requirepass calls with
+// the new password
+func (db *DB) SetRequirePassCallback(fn func(password string)) {
+	db.requirePassCallback.Store(fn)
+}
+
+// execConfig implements CONFIG GET, CONFIG SET and CONFIG HELP
+func execConfig(db *DB, args [][]byte) (Result, error) {
+	if len(args) < 1 {
+		return nil, errWrongArgs("config")
+	}
+
+	switch strings.ToLower(string(args[0])) {
+	case "get":
+		if len(args) < 2 {
+			return nil, errWrongArgs("config|get")
+		}
+		return db.configGet(bytesToStrings(args[1:]))
+
+	case "set":
+		if len(args) < 3 || len(args)%2 == 0 {
+			return nil, errWrongArgs("config|set")
+		}
+		if err := db.configSet(bytesToStrings(args[1:])); err != nil {
+			return nil, err
+		}
+		return StatusResult("OK"), nil
+
+	case "help":
+		if !isHelpSubcommand(args) {
+			return nil, errUnknownSubcommand("CONFIG", args[0])
+		}
+		return LinesResult(subcommandHelp("CONFIG",
+			"GET <pattern> [<pattern> ...]",
+			"    Return parameters matching the glob-like <pattern>s and their values.",
+			"SET <directive> <value> [<directive> <value> ...]",
+			"    Set the configuration <directive>s to their <value>s.",
+		)), nil
+
+	default:
+		return nil, errUnknownSubcommand("CONFIG", args[0])
+	}
+}
+
+// configGet returns the name and value of every parameter matching one of
+// patterns
+func (db *DB) configGet(patterns []string) (Result, error) {
+	db.configMu.Lock()
+	defer db.configMu.Unlock()
+
+	result := [][]byte{}
+	for _, param := range configParams {
+		for _, pattern := range patterns {
+			if glob.MatchNoCase(pattern, param.name) {
+				result = append(result, []byte(param.name), []byte(param.get(db)))
+				break
+			}
+		}
+	}
+	return LinesResult(result), nil
+}
+
+// configSet applies the parameter-value pairs, once all are valid
+func (db *DB) configSet(pairs []string) error {
+	db.configMu.Lock()
+	defer db.configMu.Unlock()
+
+	parsed := *db.config
+	params := make([]*configParam, 0, len(pairs)/2)
+	for i := 0; i < len(pairs); i += 2 {
+		param := findConfigParam(pairs[i])
+		if param == nil {
+			return fmt.Errorf("ERR Unknown option or number of arguments for CONFIG SET - '%s'", pairs[i])
+		}
+		if err := config.ApplyDirective(&parsed, param.name, pairs[i+1]); err != nil {
+			return fmt.Errorf("ERR CONFIG SET failed (possibly related to argument '%s') - %v", param.name, err)
+		}
+		params = append(params, param)
+	}
+	for _, param := range params {
+		param.set(db, &parsed)
+	}
+	return nil
+}
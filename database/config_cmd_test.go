@@ -0,0 +1,131 @@
+package database_test
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/wangbo/gocache/config"
+	"github.com/wangbo/gocache/database"
+	"github.com/wangbo/gocache/replication"
+)
+
+func TestConfigGet(t *testing.T) {
+	db := database.MakeDB()
+	defer db.Close()
+
+	tests := []struct {
+		patterns string
+		want     string
+	}{
+		{"slowlog-max-len", "slowlog-max-len 128"},
+		{"SLOWLOG-*", "slowlog-log-slower-than 10000 slowlog-max-len 128"},
+		{"requirepass slowlog-max-len", "requirepass  slowlog-max-len 128"},
+		{"*len slowlog-max*", "slowlog-max-len 128"},
+		{"nothing", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.patterns, func(t *testing.T) {
+			args := append([]string{"CONFIG", "GET"}, strings.Fields(tt.patterns)...)
+			var got []string
+			for _, line := range exec(t, db, args...) {
+				got = append(got, string(line))
+			}
+			if strings.Join(got, " ") != tt.want {
+				t.Errorf("Expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestConfigSet(t *testing.T) {
+	// Not the global configuration, which CONFIG SET changes
+	db := database.MakeDBWithConfig(config.Default(), replication.NewReplicationState())
+	defer db.Close()
+
+	var password []string
+	db.SetRequirePassCallback(func(p string) { password = append(password, p) })
+
+	exec(t, db, "CONFIG", "SET", "slowlog-log-slower-than", "-1", "SLOWLOG-MAX-LEN", "5")
+	if db.SlowLogSlowerThan() != -1 || db.SlowLogMaxLen() != 5 {
+		t.Errorf("Expected -1 and 5, got %d and %d", db.SlowLogSlowerThan(), db.SlowLogMaxLen())
+	}
+
+	exec(t, db, "CONFIG", "SET", "requirepass", "secret")
+	exec(t, db, "CONFIG", "SET", "requirepass", "")
+	if strings.Join(password, ",") != "secret," {
+		t.Errorf("Expected the callback to see secret then no password, got %q", password)
+	}
+}
+
+// TestConfigSetWhileCommandsRun changes the parameters commands read while
+// clients run them; run with -race
+func TestConfigSetWhileCommandsRun(t *testing.T) {
+	cfg := config.Default()
+	db := database.MakeDBWithConfig(cfg, replication.NewReplicationState())
+	defer db.Close()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ms := database.NewMultiState(db)
+		for i := 0; i < 200; i++ {
+			cmdLine := [][]byte{[]byte("SET"), []byte("k"), []byte("v"), []byte("EX"), []byte("100")}
+			if err := db.AdmitClientCommand(ms, cmdLine); err != nil {
+				t.Errorf("SET refused: %v", err)
+				return
+			}
+			db.ExecWithState(ms, cmdLine)
+			db.ExecWithState(ms, [][]byte{[]byte("WATCH"), []byte("k")})
+			db.ExecWithState(ms, [][]byte{[]byte("UNWATCH")})
+		}
+	}()
+	for i := 0; i < 200; i++ {
+		exec(t, db, "CONFIG", "SET", "ttl-jitter-percent", strconv.Itoa(i%50),
+			"max-command-payload", strconv.Itoa(1000+i), "max-watched-keys", strconv.Itoa(10+i),
+			"stop-writes-on-aof-error", []string{"yes", "no"}[i%2])
+	}
+	wg.Wait()
+
+	// The configuration the database was made with is not changed
+	if cfg.TTLJitterPercent != 0 || cfg.MaxCommandPayload != config.Default().MaxCommandPayload {
+		t.Errorf("Expected CONFIG SET to leave the Properties, got %+v", cfg)
+	}
+	if got := exec(t, db, "CONFIG", "GET", "ttl-jitter-percent"); string(got[1]) != "49" {
+		t.Errorf("Expected the last value set, got %q", got)
+	}
+}
+
+func TestConfigSetErrors(t *testing.T) {
+	db := database.MakeDB()
+	defer db.Close()
+
+	tests := []struct {
+		args string
+		err  string
+	}{
+		{"SET", "ERR wrong number of arguments for 'config|set' command"},
+		{"SET slowlog-max-len", "ERR wrong number of arguments for 'config|set' command"},
+		{"SET slowlog-max-len 1 requirepass", "ERR wrong number of arguments for 'config|set' command"},
+		{"GET", "ERR wrong number of arguments for 'config|get' command"},
+		{"SET maxclients 10", "ERR Unknown option or number of arguments for CONFIG SET - 'maxclients'"},
+		{"SET slowlog-max-len -1", "ERR CONFIG SET failed (possibly related to argument 'slowlog-max-len') - value out of range: -1"},
+		{"SET slowlog-log-slower-than x", "ERR CONFIG SET failed (possibly related to argument 'slowlog-log-slower-than') - invalid integer: x"},
+		// Nothing is applied when a pair is invalid
+		{"SET slowlog-max-len 1 slowlog-log-slower-than x", "ERR CONFIG SET failed (possibly related to argument 'slowlog-log-slower-than') - invalid integer: x"},
+		{"RESETSTAT", "ERR unknown subcommand or wrong number of arguments for 'RESETSTAT'. Try CONFIG HELP."},
+	}
+	for _, tt := range tests {
+		t.Run(tt.args, func(t *testing.T) {
+			_, err := db.ExecCommand("CONFIG", strings.Fields(tt.args)...)
+			if err == nil || err.Error() != tt.err {
+				t.Errorf("Expected %q, got %v", tt.err, err)
+			}
+			if db.SlowLogMaxLen() != 128 || db.SlowLogSlowerThan() != 10000 {
+				t.Errorf("Expected the slow log settings unchanged")
+			}
+		})
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package database
+
+import "time"
+
+// cpuTimes is not supported on this platform and reports zero
+func cpuTimes() (user, sys time.Duration) {
+	return 0, 0
+}
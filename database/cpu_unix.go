@@ -0,0 +1,17 @@
+//go:build unix
+
+package database
+
+import (
+	"syscall"
+	"time"
+)
+
+// cpuTimes returns the user and system CPU time used by the process
+func cpuTimes() (user, sys time.Duration) {
+	var ru syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &ru); err != nil {
+		return 0, 0
+	}
+	return time.Duration(ru.Utime.Nano()), time.Duration(ru.Stime.Nano())
+}
@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"strconv"
+	"strings"
 
 	"github.com/wangbo/gocache/datastruct"
 )
@@ -12,7 +13,7 @@ import (
 
 func execSelect(db *DB, args [][]byte) ([][]byte, error) {
 	if len(args) != 1 {
-		return nil, errors.New("wrong number of arguments for SELECT")
+		return nil, errWrongArgs("select")
 	}
 
 	index, err := strconv.Atoi(string(args[0]))
@@ -34,7 +35,7 @@ func execSelect(db *DB, args [][]byte) ([][]byte, error) {
 
 func execType(db *DB, args [][]byte) ([][]byte, error) {
 	if len(args) != 1 {
-		return nil, errors.New("wrong number of arguments for TYPE")
+		return nil, errWrongArgs("type")
 	}
 
 	key := string(args[0])
@@ -43,31 +44,89 @@ func execType(db *DB, args [][]byte) ([][]byte, error) {
 		return [][]byte{[]byte("none")}, nil
 	}
 
-	switch entity.Data.(type) {
+	return [][]byte{[]byte(typeName(entity.Data))}, nil
+}
+
+// typeNames are the names TYPE replies with for an existing key, which SCAN
+// TYPE accepts
+var typeNames = []string{"string", "hash", "list", "set", "zset", "stream"}
+
+// typeName returns the name TYPE replies with for a value of data
+func typeName(data interface{}) string {
+	switch data.(type) {
 	case *datastruct.String:
-		return [][]byte{[]byte("string")}, nil
+		return "string"
 	case *datastruct.Hash:
-		return [][]byte{[]byte("hash")}, nil
+		return "hash"
 	case *datastruct.List:
-		return [][]byte{[]byte("list")}, nil
+		return "list"
 	case *datastruct.Set:
-		return [][]byte{[]byte("set")}, nil
+		return "set"
 	case *datastruct.SortedSet:
-		return [][]byte{[]byte("zset")}, nil
+		return "zset"
+	case *datastruct.Stream:
+		return "stream"
 	default:
-		return [][]byte{[]byte("none")}, nil
+		return "none"
 	}
 }
 
-func execMove(db *DB, args [][]byte) ([][]byte, error) {
+// execObject runs the OBJECT subcommands, which inspect a key without
+// counting as an access to it
+func execObject(db *DB, args [][]byte) (Result, error) {
+	if len(args) < 1 {
+		return nil, errWrongArgs("object")
+	}
+
+	switch strings.ToUpper(string(args[0])) {
+	case "ENCODING":
+		if len(args) != 2 {
+			return nil, errUnknownSubcommand("OBJECT", args[0])
+		}
+		entity, ok := db.peekEntity(string(args[1]))
+		if !ok {
+			return NilResult{}, nil
+		}
+		return BulkResult(getEntityEncoding(entity)), nil
+	case "METADATA":
+		if len(args) != 2 {
+			return nil, errUnknownSubcommand("OBJECT", args[0])
+		}
+		return untypedResult(objectMetadata(db, string(args[1])))
+	case "IDLETIME":
+		if len(args) != 2 {
+			return nil, errUnknownSubcommand("OBJECT", args[0])
+		}
+		return objectIdleTime(db, string(args[1]))
+	case "HELP":
+		if !isHelpSubcommand(args) {
+			return nil, errUnknownSubcommand("OBJECT", args[0])
+		}
+		return untypedResult(subcommandHelp("OBJECT",
+			"ENCODING <key>",
+			"    Return the kind of internal representation used in order to store the value",
+			"    associated with a <key>.",
+			"IDLETIME <key>",
+			"    Return the idle time of a <key>, that is the approximated number of",
+			"    seconds elapsed since the last access to the key.",
+			"METADATA <key>",
+			"    Return the creation time, last write time (unix ms) and write count of",
+			"    a <key>. Requires track-key-metadata.",
+		), nil)
+	default:
+		return nil, errUnknownSubcommand("OBJECT", args[0])
+	}
+}
+
+func execMove(db *DB, args [][]byte) (Result, error) {
 	if len(args) != 2 {
-		return nil, errors.New("wrong number of arguments for MOVE")
+		return nil, errWrongArgs("move")
 	}
 
 	key := string(args[0])
 	destinationDB, err := strconv.Atoi(string(args[1]))
 	if err != nil {
-		return nil, errors.New("ERR value is not an integer or out of range")
+		return nil, ErrNotInteger
 	}
 
 	if destinationDB < 0 || destinationDB >= 16 {
@@ -77,7 +136,7 @@ func execMove(db *DB, args [][]byte) ([][]byte, error) {
 	// Check if key exists
 	_, ok := db.GetEntity(key)
 	if !ok {
-		return zeroResponse, nil
+		return IntResult(0), nil
 	}
 
 	// Note: In a real implementation with multiple databases, we would:
@@ -87,7 +146,50 @@ func execMove(db *DB, args [][]byte) ([][]byte, error) {
 	// For now, since we have only one database, we just return 0 (not moved)
 
 	// Placeholder: Return 0 to indicate not moved (single DB implementation)
-	return zeroResponse, nil
+	return IntResult(0), nil
+}
+
+// execDBSize implements DBSIZE: the number of keys, expired ones included
+// until they are removed
+func execDBSize(db *DB, args [][]byte) (Result, error) {
+	if len(args) != 0 {
+		return nil, errWrongArgs("dbsize")
+	}
+	return IntResult(int64(db.data.Len())), nil
+}
+
+// execFlushDB implements FLUSHDB [ASYNC|SYNC]. There being a single
+// database, it is FLUSHALL.
+func execFlushDB(db *DB, args [][]byte) (Result, error) {
+	return flushCommand(db, "FLUSHDB", args)
+}
+
+// execFlushAll implements FLUSHALL [ASYNC|SYNC]
+func execFlushAll(db *DB, args [][]byte) (Result, error) {
+	return flushCommand(db, "FLUSHALL", args)
+}
+
+// flushCommand removes every key. ASYNC is accepted but the keys are always
+// removed before the reply.
+func flushCommand(db *DB, name string, args [][]byte) (Result, error) {
+	if len(args) > 1 {
+		return nil, errWrongArgs(name)
+	}
+	if len(args) == 1 {
+		if mode := strings.ToUpper(string(args[0])); mode != "ASYNC" && mode != "SYNC" {
+			return nil, ErrSyntax
+		}
+	}
+	db.flush()
+	return StatusResult("OK"), nil
+}
+
+// flush replaces the keys of db with an empty dataset, dropping their TTLs
+// and aborting the transactions WATCHing them. The caller must hold db.mu
+// exclusively.
+func (db *DB) flush() {
+	staging, _ := db.loadStaging(func(*DB) error { return nil })
+	db.swapDataset(staging)
 }
 
 // Helper function to get type name for an entity
@@ -107,11 +209,31 @@ func getEntityTypeName(entity *datastruct.DataEntity) string {
 		return "set"
 	case *datastruct.SortedSet:
 		return "zset"
+	case *datastruct.Stream:
+		return "stream"
 	default:
 		return "none"
 	}
 }
 
+// getEntityEncoding returns the encoding name reported by OBJECT ENCODING
+func getEntityEncoding(entity *datastruct.DataEntity) string {
+	switch data := entity.Data.(type) {
+	case *datastruct.String:
+		return data.Encoding()
+	case *datastruct.Hash, *datastruct.Set:
+		return "hashtable"
+	case *datastruct.List:
+		return "linkedlist"
+	case *datastruct.SortedSet:
+		return "skiplist"
+	case *datastruct.Stream:
+		return "stream"
+	default:
+		return "unknown"
+	}
+}
+
 // FormatEntityInfo formats entity information for debugging/monitoring
 func FormatEntityInfo(key string, entity *datastruct.DataEntity) string {
 	if entity == nil {
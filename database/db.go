@@ -2,20 +2,30 @@ package database
 
 import (
 	"errors"
+	"math/rand"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/wangbo/gocache/cluster"
 	"github.com/wangbo/gocache/config"
 	"github.com/wangbo/gocache/datastruct"
 	"github.com/wangbo/gocache/dict"
 	"github.com/wangbo/gocache/eviction"
 	"github.com/wangbo/gocache/evictionpkg"
+	"github.com/wangbo/gocache/replication"
+	"github.com/wangbo/gocache/util/clock"
+	"github.com/wangbo/gocache/util/quote"
+	"github.com/wangbo/gocache/util/random"
 )
 
 // DB represents a single database instance
 type DB struct {
 	index      int
+	config     *config.Properties            // Server configuration
+	repl       *replication.ReplicationState // Replication role, slaves and backlog
 	data       *dict.ConcurrentDict
 	ttlMap     *dict.ConcurrentDict
 	versionMap *dict.ConcurrentDict
@@ -28,8 +38,80 @@ type DB struct {
 	// Time wheel for TTL management
 	timeWheel *datastruct.TimeWheel
 
+	// Time wheel for hash field TTLs (HEXPIRE), keyed by hash key
+	fieldWheel *datastruct.TimeWheel
+
 	// Transaction support
-	multiState *MultiState
+	multiState  *MultiState    // Default transaction state used by Exec
+	watchedKeys     map[string]int // Number of connections WATCHing each key
+	watchingClients int            // Connections WATCHing at least one key
+	watchMu         sync.Mutex     // Protects watchedKeys and watchingClients
+
+	// Expiration handling
+	expireCallback atomic.Value // func(key string), called for every expired key
+	replica        int32        // 1 if keys are only expired by the master
+
+	fieldExpireCallback atomic.Value // func(key, field string), called for every expired hash field
+
+	monitorCallback atomic.Value // MonitorFunc, called with every command (see monitor.go)
+
+	aofBufferCallback atomic.Value // func() int64, bytes allocated to the AOF buffer
+	aofStatsCallback  atomic.Value // func() (AOFStats, bool), state of the AOF writer
+
+	clock atomic.Value // clockHolder, the time of the database (see clock.go)
+
+	// CONFIG SET: serializes the changes, which it makes to runtime, and
+	// is told of requirepass changes
+	configMu            sync.Mutex
+	runtime             runtimeConfig
+	requirePassCallback atomic.Value // func(password string)
+
+	// Locks of the keys named by running commands
+	keyLocks *keyLocks
+
+	// Clients blocked by XREAD and XREADGROUP BLOCK
+	blocked *keyWaiters
+
+	// Clients paused by CLIENT PAUSE
+	paused *clientPause
+
+	// Client connections listed by CLIENT LIST
+	clients *clientRegistry
+
+	// Serializes stream commands, which modify streams and consumer groups
+	// in place under the shared db.mu
+	streamMu sync.Mutex
+
+	// Serializes HyperLogLog commands, which update values in place
+	hllMu sync.Mutex
+
+	// Cache-aside loads (GetOrLoad)
+	loads *loadGroup
+
+	// Backing store hooks, see backing_store.go
+	readThrough atomic.Value // *readThrough, loads the keys GET misses
+	writeBehind atomic.Value // *writeBehind, queues the keys written by commands
+
+	// Callbacks for evicted and expired keys (OnEvict, OnExpire)
+	events *keyEvents
+
+	// Background workers stopped by Close
+	lifecycle *lifecycle
+
+	// Role changes (SLAVEOF): serialized by roleMu, numbered by roleEpoch;
+	// loading is set while a replica loads the dataset of its master, or
+	// the dataset is loaded from disk
+	roleMu    sync.Mutex
+	roleEpoch atomic.Uint64
+	loading   atomic.Bool
+
+	// Progress of the file loaded on startup, see loading.go
+	diskLoad diskLoad
+
+	// Counters and process description reported by INFO
+	stats      *serverStats
+	serverInfo *ServerInfo
+	tcpPort    atomic.Int32 // Port the server listens on, 0 until it does
 
 	// RDB save state
 	lastSaveTime       time.Time
@@ -37,46 +119,87 @@ type DB struct {
 	bgSaveStartTime    time.Time
 	bgSaveMu           sync.Mutex // Protects bgSave fields
 
-	// Slow log
-	slowLog        []*SlowLogEntry
-	slowLogMu      sync.Mutex
-	slowLogMaxLen  int // Maximum number of slow log entries (default 128)
-}
+	// Latency samples per event (LATENCY)
+	latency *latencyMonitor
 
-// toLowerBytes converts a byte slice to lowercase in-place without allocation
-// This is an optimized version for ASCII commands, avoiding string conversion
-func toLowerBytes(b []byte) string {
-	// Convert to lowercase in-place (ASCII only)
-	for i := 0; i < len(b); i++ {
-		if b[i] >= 'A' && b[i] <= 'Z' {
-			b[i] += 32
-		}
-	}
-	// Use BytesToString for zero-allocation conversion
-	return BytesToString(b)
-}
+	// Idle time tracking (OBJECT IDLETIME), see idletime.go
+	trackIdle  bool
+	clockStart time.Time
+
+	// Number of open Replays, during which maxmemory is not enforced
+	replays atomic.Int32
 
-// SlowLogEntry represents a slow log entry
-type SlowLogEntry struct {
-	ID        int64
-	Timestamp time.Time
-	Duration  int64  // Execution time in microseconds
-	Command   []byte // The command that was executed
+	// Whether the last write to the AOF failed and why (see
+	// RecordAOFWrite), retried by the writes stop-writes-on-aof-error
+	// refuses
+	aofWriteFailed   atomic.Bool
+	aofWriteError    atomic.Value // string
+	aofRetryCallback atomic.Value // func() error
+	aofLastRetry     atomic.Int64 // Unix nanoseconds
+
+	// Whether the last AOF rewrite failed (see RecordAOFRewrite)
+	aofRewriteFailed atomic.Bool
+
+	// Static cluster topology announced to clients, nil unless
+	// cluster-announce is set (see cluster.go)
+	cluster *cluster.Topology
+
+	// Commands slower than slowlog-log-slower-than (see slowlog.go)
+	slowLog *slowLog
+
+	// Draws the jitter of relative TTLs (see jitter.go)
+	ttlRand *rand.Rand
+
+	// Picks the keys the TTL statistics are estimated from (see ttlstats.go)
+	sampleRand *rand.Rand
+
+	// Held shared by the commands the server runs and propagates, and
+	// exclusively to synchronize a slave (see propagation.go).
+	// releasePropagation is its RUnlock, bound once rather than per command.
+	propagation        sync.RWMutex
+	releasePropagation func()
 }
 
-// MakeDB creates a new database instance
+// MakeDB creates a new database instance configured by config.Config and
+// replicating through replication.State
 func MakeDB() *DB {
+	return MakeDBWithConfig(config.Config, replication.State)
+}
+
+// MakeDBWithConfig creates a new database instance that reads its settings
+// from cfg and its replication state from rs instead of the package globals,
+// so that several servers can run in one process
+func MakeDBWithConfig(cfg *config.Properties, rs *replication.ReplicationState) *DB {
+	lc := newLifecycle()
 	db := &DB{
 		index:         0,
+		config:        cfg,
+		repl:          rs,
 		data:          dict.MakeConcurrentDict(16),
 		ttlMap:        dict.MakeConcurrentDict(16),
 		versionMap:    dict.MakeConcurrentDict(16),
+		watchedKeys:   make(map[string]int),
+		loads:         newLoadGroup(),
+		events:        newKeyEvents(lc),
+		lifecycle:     lc,
+		keyLocks:      newKeyLocks(keyLockStripes),
+		blocked:       newKeyWaiters(),
+		paused:        newClientPause(),
+		clients:       newClientRegistry(),
+		stats:         newServerStats(),
+		serverInfo:    NewServerInfo(""),
+		latency:       newLatencyMonitor(),
 		usedMemory:    0,
-		slowLogMaxLen: 128, // Default max 128 slow log entries
+		slowLog:       newSlowLog(cfg.SlowLogLogSlowerThan, cfg.SlowLogMaxLen),
+		ttlRand:       random.New(random.Seed()),
+		sampleRand:    random.New(random.Seed()),
 	}
 
+	db.runtime.load(cfg)
+
 	// Initialize eviction policy based on config
 	db.initEvictionPolicy()
+	db.initIdleTracking()
 
 	// Initialize time wheel for TTL management (10ms interval, 1024 buckets)
 	db.timeWheel = datastruct.NewTimeWheel(
@@ -84,17 +207,29 @@ func MakeDB() *DB {
 		1024,                   // 1024 buckets (covers ~10 seconds)
 		db.expireFromTimeWheel, // Callback when key expires
 	)
+	db.timeWheel.SetTickHook(db.recordExpireCycle)
 	db.timeWheel.Start()
 
+	db.fieldWheel = datastruct.NewTimeWheel(10*time.Millisecond, 1024, db.expireHashFieldsFromWheel)
+	db.fieldWheel.SetTickHook(db.recordExpireCycle)
+	db.fieldWheel.Start()
+
+	db.stats.startSampler(db.lifecycle, clock.Real)
+
+	if threshold := db.config.LatencyMonitorThreshold; threshold > 0 {
+		db.SetLatencyMonitorThreshold(time.Duration(threshold) * time.Millisecond)
+	}
+
 	// Initialize transaction state
 	db.multiState = NewMultiState(db)
+	db.releasePropagation = db.propagation.RUnlock
 
 	return db
 }
 
 // initEvictionPolicy initializes the eviction policy based on config
 func (db *DB) initEvictionPolicy() {
-	policy := config.Config.MaxMemoryPolicy
+	policy := db.config.MaxMemoryPolicy
 
 	switch policy {
 	case "allkeys-lru", "volatile-lru":
@@ -127,7 +262,7 @@ func (db *DB) addMemoryUsage(delta int64) {
 
 // checkAndEvict checks if memory limit is exceeded and evicts if necessary
 func (db *DB) checkAndEvict() {
-	if config.Config.MaxMemory <= 0 {
+	if db.config.MaxMemory <= 0 {
 		return // No memory limit set
 	}
 
@@ -135,20 +270,25 @@ func (db *DB) checkAndEvict() {
 		return // No eviction policy
 	}
 
+	if db.replays.Load() > 0 {
+		return // The replayed commands were accepted under the limit of their time
+	}
+
 	usedMemory := db.GetUsedMemory()
-	maxMemory := config.Config.MaxMemory
+	maxMemory := db.config.MaxMemory
 
-	// If over limit, evict keys
+	// If over limit, evict keys one at a time so that no more keys than
+	// necessary are dropped (a batch could take recently used keys with it)
 	for usedMemory > maxMemory {
-		// Evict up to 10 keys at a time to reduce lock contention
-		keys := db.evictionPolicy.Evict(10)
+		keys := db.evictionPolicy.Evict(1)
 		if len(keys) == 0 {
 			break
 		}
 
-		for _, key := range keys {
-			// Remove from database (will subtract memory usage and record deletion)
-			db.Remove(key)
+		// Remove from database (will subtract memory usage and record deletion)
+		entity, _ := db.getEntityWithoutExpiryCheck(keys[0])
+		if db.Remove(keys[0]) > 0 {
+			db.events.emit(keys[0], entity, EvictMaxMemory)
 		}
 
 		usedMemory = db.GetUsedMemory()
@@ -156,60 +296,261 @@ func (db *DB) checkAndEvict() {
 }
 
 // Exec executes a command and returns a reply
+// It uses the database's default transaction state; servers with several
+// connections should give each one its own MultiState and call ExecWithState
 func (db *DB) Exec(cmdLine [][]byte) (result [][]byte, err error) {
-	if len(cmdLine) == 0 {
-		return nil, errors.New("empty command")
-	}
+	return db.ExecWithState(db.multiState, cmdLine)
+}
 
-	// Make a copy of cmdLine[0] to avoid modifying the original
-	cmdBytes := make([]byte, len(cmdLine[0]))
-	copy(cmdBytes, cmdLine[0])
-	cmd := toLowerBytes(cmdBytes)
-	args := cmdLine[1:]
+// ExecWithState executes a command on behalf of the connection owning ms
+func (db *DB) ExecWithState(ms *MultiState, cmdLine [][]byte) (result [][]byte, err error) {
+	typed, err := db.ExecTypedWithState(ms, cmdLine)
+	return linesOf(typed), err
+}
 
-	// Parse command type using registry
-	cmdType, ok := ParseCommandType(cmd)
-	if !ok {
-		return nil, errors.New("unknown command: " + cmd)
+// ExecTypedWithState is ExecWithState returning the typed result of the
+// command, so that a server can reply with its type (see Result)
+func (db *DB) ExecTypedWithState(ms *MultiState, cmdLine [][]byte) (Result, error) {
+	return db.execTyped(ms, cmdLine, false)
+}
+
+// execTyped runs a command for ExecTypedWithState; barrier tells whether the
+// caller holds the propagation barrier, which a blocked command releases
+// while it waits
+func (db *DB) execTyped(ms *MultiState, cmdLine [][]byte, barrier bool) (Result, error) {
+	if db.IsClosed() {
+		return nil, ErrClosed
 	}
+	ms.setDirty(false)
+	cmdType, executor, err := lookupCommand(cmdLine)
+	if err != nil {
+		// An unknown command can not be queued, and EXEC then refuses to
+		// run the rest of the transaction
+		if ms.IsInMulti() {
+			ms.Abort()
+		}
+		return nil, err
+	}
+	args := cmdLine[1:]
 
-	// Get command executor from registry
-	executor, ok := GetCommandExecutor(cmdType)
-	if !ok {
-		return nil, errors.New("command not implemented: " + cmd)
+	// Commands that make no sense in a transaction abort it
+	if cmdType.MultiBehavior() == MultiForbidden && ms.IsInMulti() {
+		ms.Abort()
+		return nil, errNotAllowedInMulti(cmdType)
 	}
 
 	// Transaction commands (MULTI, EXEC, DISCARD, WATCH, UNWATCH) are always executed immediately
 	// They control transaction state and should not be queued
-	switch cmdType {
-	case CmdMulti, CmdExec, CmdDiscard, CmdWatch, CmdUnwatch:
-		return executor.Execute(db, args)
+	if txExecutor, ok := executor.(*TransactionCommand); ok {
+		db.feedMonitorFrom(ms, cmdType, cmdLine)
+		return untypedResult(txExecutor.ExecuteWithState(ms, args))
 	}
 
 	// If in MULTI mode, queue non-transaction commands instead of executing
-	if db.multiState.IsInMulti() {
+	if ms.IsInMulti() {
 		// Convert cmdLine to []string for queuing (using SafeBytesToString for safety)
 		cmdStr := make([]string, len(cmdLine))
 		for i, b := range cmdLine {
 			cmdStr[i] = SafeBytesToString(b)
 		}
 
-		if err := db.multiState.Enqueue(cmdStr); err != nil {
+		if err := ms.Enqueue(cmdStr); err != nil {
 			return nil, err
 		}
 
-		return [][]byte{[]byte("QUEUED")}, nil
+		return StatusResult("QUEUED"), nil
+	}
+
+	db.feedMonitorFrom(ms, cmdType, cmdLine)
+	if client, ok := executor.(*ClientCommand); ok {
+		return client.ExecuteWithState(ms, args)
 	}
 
-	// Execute command using command executor - no more switch-case!
-	return executor.Execute(db, args)
+	a := ms.admission()
+	result, err := db.executeShared(cmdType, executor, args, a)
+	if blocked, ok := err.(*blockedCommand); ok {
+		result, err = untypedResult(db.block(blocked, barrier, a))
+	}
+	if _, miss := result.(NilResult); miss && cmdType == CmdGet && err == nil {
+		// Loaded once the key locks are released
+		result, err = db.readThroughGet(string(args[0]))
+	}
+	ms.setDirty(modified(cmdType, result, err))
+	return replyOf(result), err
+}
+
+// executeShared runs a command under the shared db.mu. Commands share it;
+// EXEC holds it exclusively so that nothing runs between its WATCH check and
+// the end of the queued commands, and so do exclusive commands such as DEBUG
+// RELOAD. Unlocked commands such as SLAVEOF take it themselves. The command
+// also holds the locks of the keys it names, so that it is atomic with
+// respect to other commands. A client command is checked against the role
+// changes since its admission once it holds db.mu (see checkAdmission).
+func (db *DB) executeShared(cmdType CommandType, executor CommandExecutor, args [][]byte, a admission) (Result, error) {
+	if cmd, ok := executor.(*FunctionCommand); ok && cmd.exclusive {
+		db.mu.Lock()
+		defer db.mu.Unlock()
+		if err := db.checkAdmission(a, executor.IsWriteCommand()); err != nil {
+			return nil, err
+		}
+		return db.executeTyped(cmdType, executor, args)
+	}
+	if cmd, ok := executor.(*FunctionCommand); ok && cmd.unlocked {
+		return db.executeTyped(cmdType, executor, args)
+	}
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if err := db.checkAdmission(a, executor.IsWriteCommand()); err != nil {
+		return nil, err
+	}
+	held := db.keyLocks.lock(commandKeys(cmdType, args), executor.IsWriteCommand())
+	defer held.unlock()
+	return db.executeTyped(cmdType, executor, args)
+}
+
+// DefaultMultiState returns the transaction state used by Exec
+func (db *DB) DefaultMultiState() *MultiState {
+	return db.multiState
+}
+
+// lookupCommand resolves the executor for a command line
+func lookupCommand(cmdLine [][]byte) (CommandType, CommandExecutor, error) {
+	if len(cmdLine) == 0 {
+		return 0, nil, errors.New("empty command")
+	}
+
+	// A name sent in upper case, as clients do, is found without converting
+	// it: indexing a map with string(b) does not allocate
+	cmdType, ok := CommandRegistry[string(cmdLine[0])]
+	if !ok {
+		cmdType, ok = ParseCommandType(string(cmdLine[0]))
+	}
+	if !ok {
+		return 0, nil, errUnknownCommand(cmdLine)
+	}
+
+	// Get command executor from registry
+	executor, ok := GetCommandExecutor(cmdType)
+	if !ok {
+		return 0, nil, errors.New("command not implemented: " + strings.ToLower(string(cmdLine[0])))
+	}
+
+	return cmdType, executor, nil
+}
+
+// execute runs a command and bumps the version of every key a successful
+// write command touched, including collections that were modified in place,
+// and wakes the clients blocked on them
+func (db *DB) execute(cmdType CommandType, executor CommandExecutor, args [][]byte) ([][]byte, error) {
+	result, err := db.executeTyped(cmdType, executor, args)
+	return linesOf(result), err
+}
+
+// unchangedOnZero holds the write commands that change nothing when they
+// return 0, such as PERSIST on a key without a TTL or SETNX on a key that
+// exists: their key keeps its version, so that it does not abort the EXEC of
+// a client WATCHing it, and they are not propagated
+var unchangedOnZero = map[CommandType]bool{
+	CmdPersist:   true,
+	CmdExpire:    true,
+	CmdPExpire:   true,
+	CmdExpireAt:  true,
+	CmdPExpireAt: true,
+	CmdMove:      true,
+	CmdRenameNX:  true,
+	CmdCopy:      true,
+	CmdSetNX:     true,
+	CmdMSetNX:    true,
+	CmdHSetNX:    true,
+	CmdDel:       true,
+	CmdHDel:      true,
+	CmdLRem:      true,
+	CmdSAdd:      true,
+	CmdSRem:      true,
+	CmdSMove:     true,
+	CmdZRem:      true,
+	CmdXAck:      true,
+	CmdPFAdd:     true,
+}
+
+// unchangedOnNull holds the write commands that change nothing when they
+// return a null, such as LPOP on a missing key
+var unchangedOnNull = map[CommandType]bool{
+	CmdLPop:  true,
+	CmdRPop:  true,
+	CmdBLPop: true,
+	CmdBRPop: true,
+	CmdSPop:  true,
+	CmdZAdd:  true, // ZADD INCR prevented by an option
+	CmdGetEx: true,
+}
+
+// modified reports whether a command that returned result and err modified
+// the keyspace: a write command that succeeded, unless its result shows it
+// changed nothing (see unchangedOnZero, unchangedOnNull and unchangedResult)
+func modified(cmdType CommandType, result Result, err error) bool {
+	if err != nil || !cmdType.IsWriteCommand() {
+		return false
+	}
+	if _, ok := result.(unchangedResult); ok {
+		return false
+	}
+	// The result is only looked at for the commands that may change nothing,
+	// which spares the others the allocation of its lines
+	switch {
+	case unchangedOnZero[cmdType]:
+		lines := linesOf(result)
+		return !(len(lines) == 1 && string(lines[0]) == "0")
+	case unchangedOnNull[cmdType]:
+		lines := linesOf(result)
+		return len(lines) > 0 && !IsNullResult(lines)
+	case cmdType == CmdLInsert:
+		// -1 when the pivot is missing, 0 when the key is
+		lines := linesOf(result)
+		return !(len(lines) == 1 && (string(lines[0]) == "-1" || string(lines[0]) == "0"))
+	}
+	return true
+}
+
+// executeTyped is execute returning the typed result of the command
+func (db *DB) executeTyped(cmdType CommandType, executor CommandExecutor, args [][]byte) (Result, error) {
+	var result Result
+	var err error
+	if typed, ok := executor.(TypedCommandExecutor); ok {
+		result, err = typed.ExecuteTyped(db, args)
+	} else {
+		result, err = untypedResult(executor.Execute(db, args))
+	}
+	if modified(cmdType, result, err) {
+		for _, key := range writeKeys(cmdType, args) {
+			db.touchKey(key)
+			db.recordKeyWrite(key)
+			db.keyChanged(key)
+			db.writeBehindKey(key)
+		}
+	}
+	return result, err
 }
 
 // GetEntity retrieves the data entity for a given key
 // It checks TTL and removes expired keys automatically
 func (db *DB) GetEntity(key string) (*datastruct.DataEntity, bool) {
+	entity, ok := db.peekEntity(key)
+	if !ok {
+		return nil, false
+	}
+	db.recordAccess(key, entity)
+	return entity, true
+}
+
+// peekEntity is GetEntity without recording an access, for commands that
+// inspect a key without using it, like OBJECT
+func (db *DB) peekEntity(key string) (*datastruct.DataEntity, bool) {
 	// Check if key is expired
-	db.expireIfNeeded(key)
+	if db.expireIfNeeded(key) {
+		return nil, false
+	}
 
 	val, ok := db.data.Get(key)
 	if !ok {
@@ -220,12 +561,20 @@ func (db *DB) GetEntity(key string) (*datastruct.DataEntity, bool) {
 		return nil, false
 	}
 
-	// Record access in eviction policy
+	// A hash whose last field expired is gone as well
+	if hash, ok := entity.Data.(*datastruct.Hash); ok && db.expireHashFields(key, hash) {
+		return nil, false
+	}
+	return entity, true
+}
+
+// recordAccess notifies the eviction policy that a key was read and resets
+// its idle time. Every read path goes through GetEntity, which calls this.
+func (db *DB) recordAccess(key string, entity *datastruct.DataEntity) {
 	if db.evictionPolicy != nil {
 		db.evictionPolicy.RecordAccess(key)
 	}
-
-	return entity, true
+	db.touchAccessClock(entity)
 }
 
 // getEntityWithoutExpiryCheck retrieves the data entity without checking TTL
@@ -242,17 +591,34 @@ func (db *DB) getEntityWithoutExpiryCheck(key string) (*datastruct.DataEntity, b
 	return entity, true
 }
 
-// PutEntity stores a data entity
+// PutEntity stores a data entity under a key, keeping the key's TTL.
+//
+// Commands call it for a key they create or whose value they replace; a
+// value modified in place is already stored and is not put again. Only
+// commands that overwrite a key as a whole, like SET, clear its TTL, which
+// they do explicitly after the put.
 func (db *DB) PutEntity(key string, entity *datastruct.DataEntity) int {
+	result := db.putEntity(key, entity)
+
+	// Increment version for WATCH
+	db.touchKey(key)
+
+	return result
+}
+
+// putEntity stores a data entity without bumping the key's version, for
+// commands writing several keys that bump the versions once all are written
+func (db *DB) putEntity(key string, entity *datastruct.DataEntity) int {
 	// Check if key already exists
-	_, exists := db.data.Get(key)
+	old, exists := db.getEntityWithoutExpiryCheck(key)
+	db.attachKeyMetadata(entity, old)
+	if old != entity {
+		db.compressValue(entity)
+	}
 
 	// Put the entity
 	result := db.data.Put(key, entity)
 
-	// Increment version for WATCH
-	db.incrementVersion(key)
-
 	// Track memory and eviction based on whether it was new or existing
 	if !exists {
 		// New key - add to memory usage
@@ -260,9 +626,7 @@ func (db *DB) PutEntity(key string, entity *datastruct.DataEntity) int {
 		db.addMemoryUsage(size)
 
 		// Record in eviction policy
-		if db.evictionPolicy != nil {
-			db.evictionPolicy.RecordAccess(key)
-		}
+		db.recordAccess(key, entity)
 
 		// Check if we need to evict
 		db.checkAndEvict()
@@ -271,6 +635,14 @@ func (db *DB) PutEntity(key string, entity *datastruct.DataEntity) int {
 		if db.evictionPolicy != nil {
 			db.evictionPolicy.RecordUpdate(key)
 		}
+		db.touchAccessClock(entity)
+
+		// A new value replacing the old one is accounted for the difference;
+		// a value modified in place is not stored again (see PutEntity)
+		if old != entity {
+			db.addMemoryUsage(entity.EstimateSize() - old.EstimateSize())
+			db.checkAndEvict()
+		}
 	}
 
 	return result
@@ -278,10 +650,16 @@ func (db *DB) PutEntity(key string, entity *datastruct.DataEntity) int {
 
 // PutIfExists updates entity only if key exists
 func (db *DB) PutIfExists(key string, entity *datastruct.DataEntity) int {
+	old, _ := db.getEntityWithoutExpiryCheck(key)
+	db.attachKeyMetadata(entity, old)
 	result := db.data.PutIfExists(key, entity)
 
-	if result == 1 && db.evictionPolicy != nil {
-		db.evictionPolicy.RecordUpdate(key)
+	if result == 1 {
+		db.touchKey(key)
+		if db.evictionPolicy != nil {
+			db.evictionPolicy.RecordUpdate(key)
+		}
+		db.touchAccessClock(entity)
 	}
 
 	return result
@@ -289,17 +667,18 @@ func (db *DB) PutIfExists(key string, entity *datastruct.DataEntity) int {
 
 // PutIfAbsent inserts entity only if key does not exist
 func (db *DB) PutIfAbsent(key string, entity *datastruct.DataEntity) int {
+	db.attachKeyMetadata(entity, nil)
 	result := db.data.PutIfAbsent(key, entity)
 
 	if result == 1 {
+		db.touchKey(key)
+
 		// New key - add to memory usage
 		size := entity.EstimateSize()
 		db.addMemoryUsage(size)
 
 		// Record in eviction policy
-		if db.evictionPolicy != nil {
-			db.evictionPolicy.RecordAccess(key)
-		}
+		db.recordAccess(key, entity)
 
 		// Check if we need to evict
 		db.checkAndEvict()
@@ -319,11 +698,11 @@ func (db *DB) Remove(key string) int {
 
 	result := db.data.Remove(key)
 
-	// Increment version for WATCH (even on delete) - do this BEFORE removing from versionMap
-	db.incrementVersion(key)
-
 	db.ttlMap.Remove(key)
-	db.versionMap.Remove(key)
+
+	// Increment version for WATCH (even on delete); the version itself is
+	// dropped unless someone is watching the key
+	db.touchKey(key)
 
 	// Remove from time wheel
 	db.timeWheel.Remove(key)
@@ -343,17 +722,34 @@ func (db *DB) Remove(key string) int {
 
 // Exists checks if a key exists
 func (db *DB) Exists(key string) bool {
-	db.expireIfNeeded(key)
-	_, ok := db.data.Get(key)
-	return ok
+	if db.expireIfNeeded(key) {
+		return false
+	}
+	val, ok := db.data.Get(key)
+	if !ok {
+		return false
+	}
+	if entity, ok := val.(*datastruct.DataEntity); ok {
+		if hash, ok := entity.Data.(*datastruct.Hash); ok && db.expireHashFields(key, hash) {
+			return false
+		}
+	}
+	return true
 }
 
-// Expire sets a TTL for a key (in seconds)
+// Expire sets a TTL for a key
+// A non-positive TTL deletes the key right away, like Redis does
 func (db *DB) Expire(key string, ttl time.Duration) int {
-	if _, ok := db.data.Get(key); !ok {
+	entity, ok := db.getEntityWithoutExpiryCheck(key)
+	if !ok {
 		return 0
 	}
 
+	if ttl <= 0 {
+		db.Remove(key)
+		return 1
+	}
+
 	// Remove from time wheel if it was there
 	_, hasExistingTTL := db.ttlMap.Get(key)
 	if hasExistingTTL {
@@ -361,31 +757,47 @@ func (db *DB) Expire(key string, ttl time.Duration) int {
 	}
 
 	// Store exact expiration time in ttlMap for precise TTL queries
-	db.ttlMap.Put(key, time.Now().Add(ttl))
+	db.ttlMap.Put(key, db.now().Add(ttl))
 
 	// Add to time wheel for active expiration
 	db.timeWheel.Add(key, ttl)
 
+	db.touchAccessClock(entity)
+	db.touchKey(key)
 	return 1
 }
 
 // Persist removes the TTL from a key
 func (db *DB) Persist(key string) int {
-	if _, ok := db.ttlMap.Get(key); !ok {
+	if !db.removeTTL(key) {
 		return 0
 	}
+	db.touchKey(key)
+	return 1
+}
+
+// removeTTL removes the TTL from a key without bumping its version and
+// reports whether it had one
+func (db *DB) removeTTL(key string) bool {
+	if _, ok := db.ttlMap.Get(key); !ok {
+		return false
+	}
 	db.ttlMap.Remove(key)
 
 	// Remove from time wheel
 	db.timeWheel.Remove(key)
-
-	return 1
+	return true
 }
 
 // expireFromTimeWheel is called by the time wheel when a key expires
 // Note: This is called from within the time wheel's tick loop, so we must
 // avoid calling timeWheel.Remove() to prevent deadlock
 func (db *DB) expireFromTimeWheel(key string) {
+	// Replicas wait for the master's DEL instead of expiring on their own clock
+	if db.IsReplica() {
+		return
+	}
+
 	// Check if key still exists and is expired
 	val, ok := db.ttlMap.Get(key)
 	if !ok {
@@ -397,9 +809,12 @@ func (db *DB) expireFromTimeWheel(key string) {
 		return
 	}
 
-	// Double-check that it's actually expired
-	if time.Now().Before(expireTime) {
-		return // Not expired yet, might have been updated
+	// Double-check that it's actually expired. The wheel only covers a few
+	// seconds and a late tick can run two buckets in a row, so the key may
+	// come early; it is added back rather than left to lazy expiration.
+	if remaining := expireTime.Sub(db.now()); remaining > 0 {
+		db.lifecycle.goWorker(func(<-chan struct{}) { db.timeWheel.Add(key, remaining) })
+		return
 	}
 
 	// Remove the key from data structures (but don't call timeWheel.Remove
@@ -410,9 +825,9 @@ func (db *DB) expireFromTimeWheel(key string) {
 		size = entity.EstimateSize()
 	}
 
-	db.data.Remove(key)
+	removed := db.data.Remove(key)
 	db.ttlMap.Remove(key)
-	db.versionMap.Remove(key)
+	db.touchKey(key)
 
 	// Subtract from memory usage
 	if size > 0 {
@@ -423,12 +838,19 @@ func (db *DB) expireFromTimeWheel(key string) {
 	if db.evictionPolicy != nil {
 		db.evictionPolicy.RecordDelete(key)
 	}
+
+	if removed > 0 {
+		db.notifyExpired(key)
+		db.events.emit(key, entity, ExpiredActive)
+	}
 }
 
 // TTL returns the remaining TTL in seconds
 // Returns -2 if key does not exist, -1 if key exists but has no expiry
 func (db *DB) TTL(key string) time.Duration {
-	db.expireIfNeeded(key)
+	if db.expireIfNeeded(key) {
+		return -2
+	}
 
 	if _, ok := db.data.Get(key); !ok {
 		return -2
@@ -440,29 +862,92 @@ func (db *DB) TTL(key string) time.Duration {
 	}
 
 	expireTime := val.(time.Time)
-	remaining := time.Until(expireTime)
-	if remaining < 0 {
-		// Already expired
-		db.Remove(key)
+	remaining := expireTime.Sub(db.now())
+	if remaining <= 0 {
+		// Expired between the check above and now
 		return -2
 	}
 
 	return remaining
 }
 
-// expireIfNeeded checks and removes expired key
-func (db *DB) expireIfNeeded(key string) {
+// ExpireTime returns the absolute expiration time of a key
+// The second result is false if the key does not exist or has no TTL
+func (db *DB) ExpireTime(key string) (time.Time, bool) {
+	if !db.Exists(key) {
+		return time.Time{}, false
+	}
 	val, ok := db.ttlMap.Get(key)
 	if !ok {
-		return
+		return time.Time{}, false
+	}
+	expireTime, ok := val.(time.Time)
+	return expireTime, ok
+}
+
+// expireIfNeeded removes a key whose TTL has passed and reports whether the
+// key is expired. On a replica the key is only reported as expired; it is
+// deleted when the master's DEL arrives.
+func (db *DB) expireIfNeeded(key string) bool {
+	val, ok := db.ttlMap.Get(key)
+	if !ok {
+		return false
 	}
 
 	expireTime := val.(time.Time)
-	if time.Now().After(expireTime) {
-		db.Remove(key)
+	if db.now().Before(expireTime) {
+		return false
+	}
+
+	if db.IsReplica() {
+		return true
+	}
+	entity, _ := db.getEntityWithoutExpiryCheck(key)
+	if db.Remove(key) > 0 {
+		db.notifyExpired(key)
+		db.events.emit(key, entity, ExpiredLazy)
+	}
+	return true
+}
+
+// SetExpireCallback registers fn to be called with every key the database
+// expires, so the deletion can be written to the AOF and sent to replicas
+func (db *DB) SetExpireCallback(fn func(key string)) {
+	db.expireCallback.Store(fn)
+}
+
+// notifyExpired calls the expire callback, if any
+func (db *DB) notifyExpired(key string) {
+	if fn, ok := db.expireCallback.Load().(func(key string)); ok && fn != nil {
+		fn(key)
+	}
+}
+
+// Config returns the configuration the database was created with
+func (db *DB) Config() *config.Properties {
+	return db.config
+}
+
+// Replication returns the replication state of the database
+func (db *DB) Replication() *replication.ReplicationState {
+	return db.repl
+}
+
+// SetReplicaMode marks the database as a replica; replicas never expire keys
+// on their own, they treat them as missing until the master deletes them
+func (db *DB) SetReplicaMode(replica bool) {
+	if replica {
+		atomic.StoreInt32(&db.replica, 1)
+	} else {
+		atomic.StoreInt32(&db.replica, 0)
 	}
 }
 
+// IsReplica returns whether the database is in replica mode
+func (db *DB) IsReplica() bool {
+	return atomic.LoadInt32(&db.replica) == 1
+}
+
 // ExecCommand is a convenience method to execute command from strings
 func (db *DB) ExecCommand(cmd string, args ...string) ([][]byte, error) {
 	cmdLine := make([][]byte, 0, len(args)+1)
@@ -481,88 +966,210 @@ func (db *DB) atomicIncr(key string, delta int64) (int64, error) {
 
 	var result int64
 	var err error
+	var created, stored *datastruct.DataEntity
 
 	// Use AtomicUpdate to perform the increment atomically
 	db.data.AtomicUpdate(key, func(val interface{}) interface{} {
 		var str *datastruct.String
+		var old *datastruct.DataEntity
 
 		if val != nil {
-			entity, ok := val.(*datastruct.DataEntity)
+			var ok bool
+			old, ok = val.(*datastruct.DataEntity)
 			if !ok {
-				err = errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
-				return nil
+				err = ErrWrongType
+				return val
 			}
-			str, ok = entity.Data.(*datastruct.String)
+			str, ok = old.Data.(*datastruct.String)
 			if !ok {
-				err = errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
-				return nil
+				err = ErrWrongType
+				return val
 			}
 		} else {
-			// Key doesn't exist, create new String with value "0"
-			str = &datastruct.String{Value: []byte("0")}
+			// Key doesn't exist, create new String with value 0
+			str = &datastruct.String{}
+			str.SetInt(0)
 		}
 
 		// Perform the increment
 		var newVal int64
 		newVal, err = str.Increment(delta)
+		if err != nil {
+			return val
+		}
 		result = newVal
 
 		// Return updated entity
-		return &datastruct.DataEntity{Data: str}
+		stored = &datastruct.DataEntity{Data: str}
+		db.attachKeyMetadata(stored, old)
+		if old == nil {
+			created = stored
+		}
+		return stored
 	})
 
 	if err != nil {
 		return 0, err
 	}
 
+	// A created key is accounted like one stored by PutEntity; the TTL of an
+	// existing key is kept
+	if created != nil {
+		db.addMemoryUsage(created.EstimateSize())
+		defer db.checkAndEvict()
+	}
+
 	// Increment version for WATCH
-	db.incrementVersion(key)
+	db.touchKey(key)
 
 	// Record access in eviction policy
-	if db.evictionPolicy != nil {
-		db.evictionPolicy.RecordAccess(key)
-	}
+	db.recordAccess(key, stored)
 
 	return result, nil
 }
 
-// Close stops the time wheel and cleans up resources gracefully
-func (db *DB) Close() error {
-	// 1. Stop time wheel (stop accepting new TTL callbacks)
-	if db.timeWheel != nil {
-		db.timeWheel.Stop()
-	}
+// Keys returns all keys in the database
+func (db *DB) Keys() []string {
+	return db.data.Keys()
+}
 
-	// 2. Clear all data structures
-	if db.data != nil {
-		db.data.Clear()
-	}
-	if db.ttlMap != nil {
-		db.ttlMap.Clear()
+// SnapshotEntry is a single key captured by Snapshot
+type SnapshotEntry struct {
+	Key      string
+	Entity   *datastruct.DataEntity
+	ExpireAt time.Time // Zero if the key has no TTL
+}
+
+// Snapshot captures every live key together with its expiration time.
+//
+// The data and TTL dictionaries are cloned shard by shard, so writers are only
+// blocked while a single shard is copied. The view is consistent per shard but
+// not globally: a write racing with the snapshot may or may not be included.
+// The value of every key but a hash, which locks itself, is copied under the
+// lock of the key, so a background save can serialize the result without
+// holding any lock while commands keep updating the live collections.
+// Keys that are already expired are skipped. Snapshot does not touch the
+// eviction policy or key versions.
+func (db *DB) Snapshot() []SnapshotEntry {
+	entries := db.snapshot()
+	for i := range entries {
+		entries[i].Entity = db.copyEntity(entries[i].Key, entries[i].Entity)
 	}
-	if db.versionMap != nil {
-		db.versionMap.Clear()
+	return entries
+}
+
+// copyEntity returns a copy of the entity of key, made under the key lock.
+// The stripe is locked without db.mu, which the caller may hold exclusively,
+// as DEBUG RELOAD does.
+func (db *DB) copyEntity(key string, entity *datastruct.DataEntity) *datastruct.DataEntity {
+	held := db.keyLocks.lock([]string{key}, false)
+	defer held.unlock()
+
+	clone := &datastruct.DataEntity{Meta: entity.Meta}
+	clone.SetAccessClock(entity.AccessClock())
+	switch data := entity.Data.(type) {
+	case *datastruct.String:
+		clone.Data = data.Clone()
+	case *datastruct.List:
+		clone.Data = data.Clone()
+	case *datastruct.Set:
+		clone.Data = data.Clone()
+	case *datastruct.SortedSet:
+		clone.Data = data.Clone()
+	case *datastruct.Stream:
+		clone.Data = data.Clone()
+	default:
+		clone.Data = data
 	}
+	return clone
+}
 
-	// 3. Reset counters
-	atomic.StoreInt64(&db.usedMemory, 0)
+// snapshot captures every live key like Snapshot, sharing the entities with
+// the live database
+func (db *DB) snapshot() []SnapshotEntry {
+	data := db.data.Snapshot()
+	ttls := db.ttlMap.Snapshot()
+	now := db.now()
+
+	entries := make([]SnapshotEntry, 0, len(data))
+	for key, val := range data {
+		entity, ok := val.(*datastruct.DataEntity)
+		if !ok || entity == nil {
+			continue
+		}
 
-	// 4. Clear slow log
-	db.slowLogMu.Lock()
-	db.slowLog = nil
-	db.slowLogMu.Unlock()
+		var expireAt time.Time
+		if ttl, ok := ttls[key]; ok {
+			expireAt, _ = ttl.(time.Time)
+			if !expireAt.IsZero() && !now.Before(expireAt) {
+				continue // Already expired, lazy deletion hasn't caught up yet
+			}
+		}
 
-	// 5. Reset transaction state
-	if db.multiState != nil {
-		db.multiState.Discard()
+		entries = append(entries, SnapshotEntry{Key: key, Entity: entity, ExpireAt: expireAt})
 	}
+	return entries
+}
 
-	return nil
+// ForEach iterates over a snapshot of the database (see Snapshot for the
+// consistency guarantees). The entities are the live ones, not copies, so fn
+// must not read a collection another command may be updating. Return false
+// from fn to stop iteration.
+func (db *DB) ForEach(fn func(key string, entity *datastruct.DataEntity, expireAt time.Time) bool) {
+	for _, entry := range db.snapshot() {
+		if !fn(entry.Key, entry.Entity, entry.ExpireAt) {
+			return
+		}
+	}
 }
 
-// Keys returns all keys in the database
-func (db *DB) Keys() []string {
-	return db.data.Keys()
+// RebuildCommands returns the commands that recreate a key holding entity,
+// without its TTL but with the TTLs of hash fields. It is used by AOF rewrite
+// and MIGRATE; an empty collection yields no commands.
+func RebuildCommands(key string, entity *datastruct.DataEntity) [][][]byte {
+	var args [][]byte
+	switch data := entity.Data.(type) {
+	case *datastruct.String:
+		return [][][]byte{{[]byte("SET"), []byte(key), data.Get()}}
+	case *datastruct.Hash:
+		// Use HMSET to set all fields at once
+		all := data.GetAll()
+		if len(all) == 0 {
+			return nil
+		}
+		args = [][]byte{[]byte("HMSET"), []byte(key)}
+		for field, value := range all {
+			args = append(args, []byte(field), value)
+		}
+		cmds := [][][]byte{args}
+		for field, expireAt := range data.FieldExpirations() {
+			if _, ok := all[field]; !ok {
+				continue
+			}
+			ms := strconv.FormatInt(expireAt.UnixMilli(), 10)
+			cmds = append(cmds, [][]byte{[]byte("HPEXPIREAT"), []byte(key), []byte(ms), []byte("FIELDS"), []byte("1"), []byte(field)})
+		}
+		return cmds
+	case *datastruct.List:
+		args = append([][]byte{[]byte("RPUSH"), []byte(key)}, data.GetAll()...)
+	case *datastruct.Set:
+		args = append([][]byte{[]byte("SADD"), []byte(key)}, data.Members()...)
+	case *datastruct.SortedSet:
+		args = [][]byte{[]byte("ZADD"), []byte(key)}
+		for i := 0; i < data.Len(); i++ {
+			score := datastruct.FormatScore(data.GetScoreByRank(i))
+			args = append(args, []byte(score), data.GetMemberByRank(i))
+		}
+	case *datastruct.Stream:
+		return rebuildStream(key, data)
+	default:
+		return nil
+	}
+
+	if len(args) <= 2 {
+		return nil
+	}
+	return [][][]byte{args}
 }
 
 // GetVersion returns the version of a key (for WATCH)
@@ -580,97 +1187,87 @@ func (db *DB) GetVersion(key string) uint64 {
 	return version
 }
 
-// incrementVersion increments the version of a key
-func (db *DB) incrementVersion(key string) {
-	// Use atomic add for version increment
-	val, ok := db.versionMap.Get(key)
-	var version uint64
-	if ok {
-		if v, ok := val.(uint64); ok {
-			version = v + 1
-		} else {
-			version = 1
-		}
-	} else {
-		version = 1
-	}
-
-	db.versionMap.Put(key, version)
+// touchKey bumps the version of a key so that clients WATCHing it abort their
+// next EXEC. Every write, expiration and eviction must go through here.
+func (db *DB) touchKey(key string) {
+	db.versionMap.AtomicUpdate(key, func(val interface{}) interface{} {
+		version, _ := val.(uint64)
+		return version + 1
+	})
+	db.forgetVersion(key)
 }
 
-// SlowLog methods
-
-// AddSlowLogEntry adds an entry to the slow log if the duration exceeds the threshold
-func (db *DB) AddSlowLogEntry(duration time.Duration, cmdLine [][]byte) {
-	// Only log if execution time exceeds threshold (default 10ms)
-	const slowLogThreshold = 10 * time.Millisecond
-	if duration < slowLogThreshold {
+// forgetVersion drops the version of a key that no longer exists. A key that
+// is still WATCHed keeps its bumped version; otherwise deleting it would reset
+// the version to 0 and a watcher that saw the key missing could miss a SET+DEL.
+func (db *DB) forgetVersion(key string) {
+	if _, exists := db.data.Get(key); exists {
 		return
 	}
 
-	entry := &SlowLogEntry{
-		ID:        time.Now().UnixNano(), // Simple ID generation
-		Timestamp: time.Now(),
-		Duration:  duration.Microseconds(),
-		Command:   serializeCommand(cmdLine),
-	}
-
-	db.slowLogMu.Lock()
-	defer db.slowLogMu.Unlock()
+	db.watchMu.Lock()
+	defer db.watchMu.Unlock()
 
-	// Add to beginning of log (most recent first)
-	db.slowLog = append([]*SlowLogEntry{entry}, db.slowLog...)
-
-	// Trim if exceeds max length
-	if len(db.slowLog) > db.slowLogMaxLen {
-		db.slowLog = db.slowLog[:db.slowLogMaxLen]
+	if db.watchedKeys[key] > 0 {
+		return
+	}
+	if _, exists := db.data.Get(key); !exists {
+		db.versionMap.Remove(key)
 	}
 }
 
-// GetSlowLogEntries returns all slow log entries
-func (db *DB) GetSlowLogEntries() []*SlowLogEntry {
-	db.slowLogMu.Lock()
-	defer db.slowLogMu.Unlock()
-
-	// Return a copy to avoid race conditions
-	result := make([]*SlowLogEntry, len(db.slowLog))
-	copy(result, db.slowLog)
-	return result
+// addWatchers registers a connection WATCHing keys it did not watch yet;
+// first tells that it watched no key before
+func (db *DB) addWatchers(keys []string, first bool) {
+	db.watchMu.Lock()
+	defer db.watchMu.Unlock()
+	for _, key := range keys {
+		db.watchedKeys[key]++
+	}
+	if first && len(keys) > 0 {
+		db.watchingClients++
+	}
 }
 
-// GetSlowLogLen returns the number of slow log entries
-func (db *DB) GetSlowLogLen() int {
-	db.slowLogMu.Lock()
-	defer db.slowLogMu.Unlock()
-	return len(db.slowLog)
+// removeWatchers unregisters a connection WATCHing the keys of watched, all
+// the keys it watched, and drops the version kept for a deleted key once
+// nobody watches it anymore
+func (db *DB) removeWatchers(watched map[string]uint64) {
+	db.watchMu.Lock()
+	defer db.watchMu.Unlock()
+
+	for key := range watched {
+		db.watchedKeys[key]--
+		if db.watchedKeys[key] > 0 {
+			continue
+		}
+		delete(db.watchedKeys, key)
+		if _, exists := db.data.Get(key); !exists {
+			db.versionMap.Remove(key)
+		}
+	}
+	if len(watched) > 0 {
+		db.watchingClients--
+	}
 }
 
-// ResetSlowLog clears all slow log entries
-func (db *DB) ResetSlowLog() {
-	db.slowLogMu.Lock()
-	defer db.slowLogMu.Unlock()
-	db.slowLog = nil
+// watchStats returns the number of connections WATCHing keys and of distinct
+// keys WATCHed
+func (db *DB) watchStats() (clients, keys int) {
+	db.watchMu.Lock()
+	defer db.watchMu.Unlock()
+	return db.watchingClients, len(db.watchedKeys)
 }
 
-// serializeCommand converts command line to string for logging
+// serializeCommand converts command line to string for logging, quoting
+// arguments that are empty or not printable words
 func serializeCommand(cmdLine [][]byte) []byte {
-	if len(cmdLine) == 0 {
-		return []byte{}
-	}
-
-	var result []byte
+	result := []byte{}
 	for i, arg := range cmdLine {
 		if i > 0 {
 			result = append(result, ' ')
 		}
-		// Escape arguments with spaces
-		if len(arg) == 0 || (len(arg) > 0 && (arg[0] == ' ' || arg[len(arg)-1] == ' ')) {
-			result = append(result, '"')
-			result = append(result, arg...)
-			result = append(result, '"')
-		} else {
-			result = append(result, arg...)
-		}
+		result = quote.AppendArg(result, arg)
 	}
 	return result
 }
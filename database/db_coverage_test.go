@@ -185,6 +185,11 @@ func TestDB_SerializeCommand(t *testing.T) {
 			cmdLine:  [][]byte{[]byte("SET"), []byte(""), []byte("value")},
 			expected: `SET "" value`,
 		},
+		{
+			name:     "binary args",
+			cmdLine:  [][]byte{[]byte("SET"), []byte("k\r\n"), []byte("\x00\xff\\")},
+			expected: `SET "k\r\n" "\x00\xff\\"`,
+		},
 	}
 
 	for _, tt := range tests {
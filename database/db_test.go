@@ -6,6 +6,7 @@ import (
 	"time"
 
 	"github.com/wangbo/gocache/datastruct"
+	"github.com/wangbo/gocache/util/clock"
 )
 
 func TestDB_ExecSetGet(t *testing.T) {
@@ -136,6 +137,30 @@ func TestDB_ExecKeys(t *testing.T) {
 	}
 }
 
+func TestDB_ExecKeysPattern(t *testing.T) {
+	db := MakeDB()
+	defer db.Close()
+
+	db.ExecCommand("SET", "user:1", "a")
+	db.ExecCommand("SET", "user:22", "b")
+	db.ExecCommand("SET", "session:1", "c")
+
+	tests := map[string]int{
+		"user:*":   2,
+		"user:?":   1,
+		"*:1":      2,
+		"[su]*":    3,
+		"[^u]*":    1,
+		"nomatch*": 0,
+	}
+	for pattern, want := range tests {
+		result, err := db.ExecCommand("KEYS", pattern)
+		if err != nil || len(result) != want {
+			t.Errorf("KEYS %s: expected %d keys, got %q %v", pattern, want, result, err)
+		}
+	}
+}
+
 func TestDB_ExecIncr(t *testing.T) {
 	db := MakeDB()
 
@@ -362,6 +387,8 @@ func TestDB_ExecGetRange(t *testing.T) {
 
 func TestDB_ExecExpire(t *testing.T) {
 	db := MakeDB()
+	mc := clock.NewManual(time.Now())
+	db.SetClock(mc)
 
 	db.ExecCommand("SET", "key1", "value1")
 
@@ -379,13 +406,12 @@ func TestDB_ExecExpire(t *testing.T) {
 	if err != nil {
 		t.Fatalf("TTL failed: %v", err)
 	}
-	ttl, _ := strconv.Atoi(string(result[0]))
-	if ttl < 0 || ttl > 2 {
-		t.Errorf("Expected TTL between 0 and 2, got %d", ttl)
+	if ttl := string(result[0]); ttl != "2" {
+		t.Errorf("Expected TTL 2, got %s", ttl)
 	}
 
 	// Wait for expiration
-	time.Sleep(2 * time.Second)
+	mc.Advance(2 * time.Second)
 
 	// Key should be expired
 	result, err = db.ExecCommand("GET", "key1")
@@ -397,6 +423,37 @@ func TestDB_ExecExpire(t *testing.T) {
 	}
 }
 
+func TestDB_ExecSetExpiryOptions(t *testing.T) {
+	db := MakeDB()
+	defer db.Close()
+
+	db.ExecCommand("SET", "ex", "v", "EX", "100")
+	if ttl := db.TTL("ex"); ttl <= 99*time.Second || ttl > 100*time.Second {
+		t.Errorf("SET EX: expected TTL close to 100s, got %v", ttl)
+	}
+
+	db.ExecCommand("SET", "pxat", "v", "PXAT", strconv.FormatInt(time.Now().Add(time.Minute).UnixMilli(), 10))
+	if ttl := db.TTL("pxat"); ttl <= 59*time.Second || ttl > time.Minute {
+		t.Errorf("SET PXAT: expected TTL close to 60s, got %v", ttl)
+	}
+
+	// KEEPTTL retains the TTL, a plain SET clears it
+	db.ExecCommand("SET", "ex", "v2", "KEEPTTL")
+	if ttl := db.TTL("ex"); ttl <= 0 {
+		t.Errorf("SET KEEPTTL: expected TTL to be kept, got %v", ttl)
+	}
+	db.ExecCommand("SET", "ex", "v3")
+	if ttl := db.TTL("ex"); ttl != -1 {
+		t.Errorf("SET: expected TTL to be cleared, got %v", ttl)
+	}
+
+	for _, opts := range [][]string{{"EX"}, {"EX", "0"}, {"EX", "1", "PX", "1"}, {"EX", "1", "KEEPTTL"}, {"NX", "XX"}, {"FOO"}} {
+		if _, err := db.ExecCommand("SET", append([]string{"bad", "v"}, opts...)...); err == nil {
+			t.Errorf("SET %v: expected an error", opts)
+		}
+	}
+}
+
 func TestDB_ExecPExpire(t *testing.T) {
 	db := MakeDB()
 
@@ -422,6 +479,62 @@ func TestDB_ExecPExpire(t *testing.T) {
 	}
 }
 
+func TestDB_ExecExpireBoundaries(t *testing.T) {
+	db := MakeDB()
+	defer db.Close()
+
+	for _, tc := range []struct {
+		args    []string
+		want    string // Reply, "" for an error
+		deleted bool
+	}{
+		{[]string{"EXPIRE", "k", "0"}, "1", true},
+		{[]string{"EXPIRE", "k", "-1"}, "1", true},
+		{[]string{"PEXPIRE", "k", "0"}, "1", true},
+		{[]string{"PEXPIRE", "k", "-100"}, "1", true},
+		{[]string{"EXPIREAT", "k", "1"}, "1", true},
+		{[]string{"PEXPIREAT", "k", "-1"}, "1", true},
+		{[]string{"EXPIRE", "k", "-99999999999999"}, "1", true},
+		{[]string{"EXPIRE", "k", "99999999999999"}, "1", false},
+		{[]string{"PEXPIREAT", "k", "9223372036854775807"}, "1", false},
+		{[]string{"EXPIREAT", "k", "99999999999999"}, "1", false},
+		{[]string{"EXPIRE", "k", "9000000000"}, "1", false},
+		{[]string{"EXPIRE", "k", "9223372036854775807"}, "", false},
+		{[]string{"EXPIREAT", "k", "-9223372036854775807"}, "", false},
+		{[]string{"PEXPIRE", "k", "9223372036854775807"}, "", false},
+		{[]string{"EXPIRE", "k", "99999999999999999999"}, "", false},
+		{[]string{"EXPIRE", "k", "1.5"}, "", false},
+	} {
+		db.ExecCommand("SET", "k", "v")
+		result, err := db.ExecCommand(tc.args[0], tc.args[1:]...)
+		switch {
+		case tc.want == "" && err == nil:
+			t.Errorf("%v: expected an error, got %q", tc.args, result)
+		case tc.want != "" && (err != nil || string(result[0]) != tc.want):
+			t.Errorf("%v: expected %s, got %q (%v)", tc.args, tc.want, result, err)
+		}
+		if _, ok := db.GetEntity("k"); ok == tc.deleted {
+			t.Errorf("%v: expected deleted=%v", tc.args, tc.deleted)
+		}
+		// A refused TTL leaves the key as it was, a TTL too long for a
+		// time.Duration is capped
+		if tc.want == "" && db.TTL("k") != -1 {
+			t.Errorf("%v: expected no TTL, got %v", tc.args, db.TTL("k"))
+		}
+		if tc.want == "1" && !tc.deleted && db.TTL("k") < 200*365*24*time.Hour {
+			t.Errorf("%v: expected a TTL of centuries, got %v", tc.args, db.TTL("k"))
+		}
+	}
+
+	// Missing keys are not affected
+	if result, _ := db.ExecCommand("EXPIRE", "missing", "-1"); string(result[0]) != "0" {
+		t.Errorf("EXPIRE missing -1: expected 0, got %q", result)
+	}
+	if result, _ := db.ExecCommand("EXPIREAT", "missing", "1"); string(result[0]) != "0" {
+		t.Errorf("EXPIREAT missing 1: expected 0, got %q", result)
+	}
+}
+
 func TestDB_ExecPersist(t *testing.T) {
 	db := MakeDB()
 
@@ -460,6 +573,24 @@ func TestDB_ExecPersistNonExistentKey(t *testing.T) {
 	}
 }
 
+func TestDB_ExecPersistWithoutTTLKeepsVersion(t *testing.T) {
+	db := MakeDB()
+	defer db.Close()
+
+	db.ExecCommand("SET", "key1", "value1")
+	version := db.GetVersion("key1")
+	if result, _ := db.ExecCommand("PERSIST", "key1"); string(result[0]) != "0" {
+		t.Errorf("Expected 0, got %q", result)
+	}
+	if got := db.GetVersion("key1"); got != version {
+		t.Errorf("Expected version %d to be kept, got %d", version, got)
+	}
+	db.ExecCommand("PERSIST", "missing")
+	if got := db.GetVersion("missing"); got != 0 {
+		t.Errorf("Expected no version for a missing key, got %d", got)
+	}
+}
+
 func TestDB_TTL(t *testing.T) {
 	db := MakeDB()
 
@@ -483,6 +614,48 @@ func TestDB_TTL(t *testing.T) {
 	}
 }
 
+func TestDB_TTLRounding(t *testing.T) {
+	db := MakeDB()
+	defer db.Close()
+	ttl := func(cmd string) int64 {
+		t.Helper()
+		result, err := db.ExecCommand(cmd, "key")
+		if err != nil {
+			t.Fatalf("%s failed: %v", cmd, err)
+		}
+		n, _ := strconv.ParseInt(string(result[0]), 10, 64)
+		return n
+	}
+
+	db.ExecCommand("SET", "key", "value")
+	for _, tc := range []struct {
+		remaining time.Duration
+		want      int64
+	}{
+		{900 * time.Millisecond, 1},
+		{1500 * time.Millisecond, 2},
+		{2 * time.Second, 2},
+		{10 * time.Millisecond, 1},
+	} {
+		db.ttlMap.Put("key", time.Now().Add(tc.remaining))
+		if got := ttl("TTL"); got != tc.want {
+			t.Errorf("TTL with %v left: expected %d, got %d", tc.remaining, tc.want, got)
+		}
+		if got := ttl("PTTL"); got > tc.remaining.Milliseconds() || got < tc.remaining.Milliseconds()-50 {
+			t.Errorf("PTTL with %v left: got %d", tc.remaining, got)
+		}
+	}
+
+	// A key reaching its expiry during the call is gone, not at TTL 0
+	db.ttlMap.Put("key", time.Now())
+	if got := ttl("TTL"); got != -2 {
+		t.Errorf("TTL at expiry: expected -2, got %d", got)
+	}
+	if db.Exists("key") {
+		t.Error("Expected the key to be expired")
+	}
+}
+
 func TestDB_GetEntity(t *testing.T) {
 	db := MakeDB()
 
@@ -543,3 +716,319 @@ func TestDB_Remove(t *testing.T) {
 		t.Errorf("Expected 0, got %d", result)
 	}
 }
+
+func TestDB_Snapshot(t *testing.T) {
+	db := MakeDB()
+	defer db.Close()
+
+	db.ExecCommand("SET", "plain", "v")
+	db.ExecCommand("SET", "volatile", "v")
+	db.ExecCommand("EXPIRE", "volatile", "100")
+	db.ExecCommand("SET", "expired", "v")
+	db.ExecCommand("PEXPIRE", "expired", "1")
+	time.Sleep(5 * time.Millisecond)
+
+	entries := make(map[string]SnapshotEntry)
+	for _, entry := range db.Snapshot() {
+		entries[entry.Key] = entry
+	}
+
+	if _, ok := entries["expired"]; ok {
+		t.Error("Expired key should not be in snapshot")
+	}
+	if entry, ok := entries["plain"]; !ok || !entry.ExpireAt.IsZero() {
+		t.Errorf("Expected plain key without expiry, got %+v", entry)
+	}
+	if entry, ok := entries["volatile"]; !ok || entry.ExpireAt.IsZero() {
+		t.Errorf("Expected volatile key with expiry, got %+v", entry)
+	}
+
+	// Writes after the snapshot are not visible in it
+	db.ExecCommand("SET", "later", "v")
+	count := 0
+	db.ForEach(func(key string, entity *datastruct.DataEntity, expireAt time.Time) bool {
+		count++
+		return true
+	})
+	if count != 3 {
+		t.Errorf("Expected 3 keys from ForEach, got %d", count)
+	}
+	if len(entries) != 2 {
+		t.Errorf("Expected 2 keys in earlier snapshot, got %d", len(entries))
+	}
+}
+
+func TestDB_StringEncoding(t *testing.T) {
+	db := MakeDB()
+	defer db.Close()
+
+	encoding := func(key string) string {
+		t.Helper()
+		result, err := db.ExecCommand("OBJECT", "ENCODING", key)
+		if err != nil {
+			t.Fatalf("OBJECT ENCODING %s failed: %v", key, err)
+		}
+		return string(result[0])
+	}
+
+	db.ExecCommand("SET", "n", "12")
+	db.ExecCommand("SET", "zeros", "012")
+	db.ExecCommand("INCR", "counter")
+	db.ExecCommand("HSET", "h", "f", "v")
+	for key, want := range map[string]string{"n": "int", "zeros": "embstr", "counter": "int", "h": "hashtable"} {
+		if got := encoding(key); got != want {
+			t.Errorf("OBJECT ENCODING %s = %s, expected %s", key, got, want)
+		}
+	}
+	if result, _ := db.ExecCommand("OBJECT", "ENCODING", "nosuch"); result[0] != nil {
+		t.Errorf("OBJECT ENCODING of a missing key should be nil, got %q", result[0])
+	}
+
+	// APPEND on an INCR-created value turns it into raw bytes that INCR
+	// still reads as the appended number
+	db.ExecCommand("APPEND", "counter", "5")
+	if got := encoding("counter"); got != "raw" {
+		t.Errorf("APPEND should convert to raw, got %s", got)
+	}
+	if result, err := db.ExecCommand("INCR", "counter"); err != nil || string(result[0]) != "16" {
+		t.Errorf("INCR after APPEND: expected 16, got %q %v", result, err)
+	}
+
+	if result, _ := db.ExecCommand("SETRANGE", "n", "1", "9"); string(result[0]) != "2" {
+		t.Errorf("SETRANGE should return the new length, got %s", result[0])
+	}
+	if result, _ := db.ExecCommand("GET", "n"); string(result[0]) != "19" || encoding("n") != "raw" {
+		t.Errorf("Expected raw 19 after SETRANGE, got %q (%s)", result[0], encoding("n"))
+	}
+	if result, _ := db.ExecCommand("SETRANGE", "empty", "3", ""); string(result[0]) != "0" || db.Exists("empty") {
+		t.Error("SETRANGE with an empty value should not create the key")
+	}
+	if _, err := db.ExecCommand("SETRANGE", "n", "-1", "x"); err == nil {
+		t.Error("SETRANGE with a negative offset should fail")
+	}
+	if _, err := db.ExecCommand("INCR", "zeros"); err == nil {
+		t.Error("INCR on a value with leading zeros should fail")
+	}
+}
+
+func TestDB_DecrByKeepsArguments(t *testing.T) {
+	db := MakeDB()
+	defer db.Close()
+
+	cmdLine := [][]byte{[]byte("DECRBY"), []byte("counter"), []byte("5")}
+	result, err := db.Exec(cmdLine)
+	if err != nil || string(result[0]) != "-5" {
+		t.Fatalf("Expected -5, got %q %v", result, err)
+	}
+	if string(cmdLine[2]) != "5" {
+		t.Errorf("DECRBY modified its arguments to %q; they are propagated as is", cmdLine[2])
+	}
+
+	if _, err := db.ExecCommand("DECRBY", "counter", "-9223372036854775808"); err == nil {
+		t.Error("Negating the smallest int64 should fail")
+	}
+	if _, err := db.ExecCommand("DECR"); err == nil {
+		t.Error("DECR without a key should fail")
+	}
+}
+
+func TestDB_ExecMSetNX(t *testing.T) {
+	db := MakeDB()
+	defer db.Close()
+
+	result, err := db.ExecCommand("MSETNX", "a", "1", "b", "2")
+	if err != nil || string(result[0]) != "1" {
+		t.Fatalf("Expected 1, got %q %v", result, err)
+	}
+
+	// The last key exists: nothing is set
+	result, err = db.ExecCommand("MSETNX", "c", "3", "d", "4", "a", "5")
+	if err != nil || string(result[0]) != "0" {
+		t.Fatalf("Expected 0, got %q %v", result, err)
+	}
+	for _, key := range []string{"c", "d"} {
+		if db.Exists(key) {
+			t.Errorf("Expected %s to be unset", key)
+		}
+	}
+	if result, _ := db.ExecCommand("GET", "a"); string(result[0]) != "1" {
+		t.Errorf("Expected a to keep 1, got %s", result[0])
+	}
+
+	if _, err := db.ExecCommand("MSETNX", "a"); err == nil {
+		t.Error("Expected an error for an odd number of arguments")
+	}
+}
+
+func TestDB_ExecMSetClearsTTL(t *testing.T) {
+	db := MakeDB()
+	defer db.Close()
+
+	db.ExecCommand("SET", "a", "1")
+	db.ExecCommand("EXPIRE", "a", "100")
+	before := db.GetVersion("a")
+
+	db.ExecCommand("MSET", "a", "2", "b", "3")
+	if ttl := db.TTL("a"); ttl != -1 {
+		t.Errorf("Expected MSET to clear the TTL, got %v", ttl)
+	}
+	if db.GetVersion("a") == before {
+		t.Error("Expected MSET to bump the version of a")
+	}
+}
+
+func TestDB_WritesKeepTTL(t *testing.T) {
+	db := MakeDB()
+	defer db.Close()
+
+	for _, tc := range []struct {
+		setup string
+		cmd   []string
+	}{
+		{"SET", []string{"APPEND", "k", "x"}},
+		{"SET", []string{"SETRANGE", "k", "1", "x"}},
+		{"SET", []string{"INCR", "k"}},
+		{"SET", []string{"INCRBY", "k", "5"}},
+		{"SET", []string{"DECR", "k"}},
+		{"HSET", []string{"HSET", "k", "g", "2"}},
+		{"HSET", []string{"HINCRBY", "k", "n", "1"}},
+		{"RPUSH", []string{"LPUSH", "k", "2"}},
+		{"RPUSH", []string{"LSET", "k", "0", "2"}},
+		{"SADD", []string{"SADD", "k", "2"}},
+		{"ZADD", []string{"ZADD", "k", "2", "b"}},
+		{"ZADD", []string{"ZINCRBY", "k", "2", "a"}},
+	} {
+		db.Remove("k")
+		switch tc.setup {
+		case "SET":
+			db.ExecCommand("SET", "k", "1")
+		case "HSET":
+			db.ExecCommand("HSET", "k", "f", "1")
+		case "RPUSH":
+			db.ExecCommand("RPUSH", "k", "1", "2")
+		case "SADD":
+			db.ExecCommand("SADD", "k", "1")
+		case "ZADD":
+			db.ExecCommand("ZADD", "k", "1", "a")
+		}
+		db.ExecCommand("EXPIRE", "k", "100")
+		entity, _ := db.getEntityWithoutExpiryCheck("k")
+
+		if _, err := db.ExecCommand(tc.cmd[0], tc.cmd[1:]...); err != nil {
+			t.Fatalf("%v failed: %v", tc.cmd, err)
+		}
+		if ttl := db.TTL("k"); ttl <= 0 {
+			t.Errorf("Expected %v to keep the TTL, got %v", tc.cmd, ttl)
+		}
+		// Collections are modified in place, not stored again
+		if current, _ := db.getEntityWithoutExpiryCheck("k"); tc.setup != "SET" && current != entity {
+			t.Errorf("Expected %v to modify the value in place", tc.cmd)
+		}
+	}
+
+	// SET replaces the value as a whole and clears the TTL, unless KEEPTTL
+	db.ExecCommand("SET", "k", "1", "EX", "100")
+	db.ExecCommand("SET", "k", "2", "KEEPTTL")
+	if ttl := db.TTL("k"); ttl <= 0 {
+		t.Errorf("Expected SET KEEPTTL to keep the TTL, got %v", ttl)
+	}
+	db.ExecCommand("SET", "k", "3")
+	if ttl := db.TTL("k"); ttl != -1 {
+		t.Errorf("Expected SET to clear the TTL, got %v", ttl)
+	}
+}
+
+func TestDB_IncrAccounting(t *testing.T) {
+	db := MakeDB()
+	defer db.Close()
+
+	// A key created by INCR is accounted, and DEL gives the memory back
+	db.ExecCommand("INCR", "counter")
+	if db.GetUsedMemory() <= 0 {
+		t.Errorf("Expected INCR to account for the key it created, got %d", db.GetUsedMemory())
+	}
+	db.ExecCommand("INCR", "counter")
+	db.ExecCommand("DEL", "counter")
+	if used := db.GetUsedMemory(); used != 0 {
+		t.Errorf("Expected no memory in use after DEL, got %d", used)
+	}
+
+	// A failed INCR leaves the value alone
+	db.ExecCommand("RPUSH", "list", "a")
+	if _, err := db.ExecCommand("INCR", "list"); err == nil {
+		t.Error("Expected INCR on a list to fail")
+	}
+	if result, _ := db.ExecCommand("LLEN", "list"); string(result[0]) != "1" {
+		t.Errorf("Expected the list to survive a failed INCR, got length %s", result[0])
+	}
+}
+
+func TestDB_ExecFlushAll(t *testing.T) {
+	db := MakeDB()
+	defer db.Close()
+
+	for _, flush := range []string{"FLUSHALL", "FLUSHDB"} {
+		db.ExecCommand("SET", "k", "v", "EX", "100")
+		db.ExecCommand("HSET", "h", "f", "v")
+		db.ExecCommand("WATCH", "k")
+
+		result, err := db.ExecCommand(flush)
+		if err != nil || string(result[0]) != "OK" {
+			t.Fatalf("%s: expected OK, got %v, %v", flush, result, err)
+		}
+		if keys := db.Keys(); len(keys) != 0 {
+			t.Errorf("%s: expected no keys, got %v", flush, keys)
+		}
+		if _, ok := db.ExpireTime("k"); ok {
+			t.Errorf("%s: expected the TTL to be dropped", flush)
+		}
+		if used := db.GetUsedMemory(); used != 0 {
+			t.Errorf("%s: expected no used memory, got %d", flush, used)
+		}
+
+		// The flush invalidates the WATCH
+		db.ExecCommand("MULTI")
+		db.ExecCommand("SET", "k", "v2")
+		if result, err := db.ExecCommand("EXEC"); err != nil || result != nil {
+			t.Errorf("%s: expected EXEC to abort, got %v, %v", flush, result, err)
+		}
+	}
+
+	if _, err := db.ExecCommand("FLUSHALL", "ASYNC"); err != nil {
+		t.Errorf("FLUSHALL ASYNC: %v", err)
+	}
+	if _, err := db.ExecCommand("FLUSHALL", "LATER"); err == nil {
+		t.Error("Expected a syntax error for FLUSHALL LATER")
+	}
+	if _, err := db.ExecCommand("FLUSHDB", "SYNC", "SYNC"); err == nil {
+		t.Error("Expected an error for too many arguments")
+	}
+
+	// Inside a transaction, which holds the lock FLUSHALL takes
+	db.ExecCommand("SET", "k", "v")
+	db.ExecCommand("MULTI")
+	db.ExecCommand("FLUSHALL")
+	db.ExecCommand("SET", "after", "v")
+	if _, err := db.ExecCommand("EXEC"); err != nil {
+		t.Fatalf("EXEC: %v", err)
+	}
+	if keys := db.Keys(); len(keys) != 1 || keys[0] != "after" {
+		t.Errorf("Expected only the key set after FLUSHALL, got %v", keys)
+	}
+}
+
+func TestDBSize(t *testing.T) {
+	db := MakeDB()
+	defer db.Close()
+
+	db.ExecCommand("SET", "a", "1")
+	db.ExecCommand("SET", "b", "2", "EX", "100")
+	db.ExecCommand("HSET", "h", "f", "v")
+	result, err := db.ExecCommand("DBSIZE")
+	if err != nil || string(result[0]) != "3" {
+		t.Errorf("Expected 3 keys, got %v, %v", result, err)
+	}
+	if _, err := db.ExecCommand("DBSIZE", "x"); err == nil {
+		t.Error("Expected an error for an argument")
+	}
+}
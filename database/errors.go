@@ -0,0 +1,77 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/wangbo/gocache/datastruct"
+)
+
+// Errors of commands
+//
+// Commands return the errors below for the failures Redis reports with a
+// canonical message, so that embedders can tell them apart with errors.Is
+// and errors.As, and clients get the messages they parse. The message of an
+// error starts with its RESP error class, WRONGTYPE or ERR; ErrorReply adds
+// ERR to the errors that have none, such as those of the standard library.
+
+var (
+	// ErrWrongType is returned by a command run on a key of another type
+	ErrWrongType = errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
+	// ErrNotInteger is returned for an argument that must be an integer
+	ErrNotInteger = datastruct.ErrInvalidInteger
+	// ErrNotFloat is returned for an argument that must be a float
+	ErrNotFloat = datastruct.ErrInvalidFloat
+	// ErrOutOfRange is returned for an index out of a list
+	ErrOutOfRange = datastruct.ErrIndexOutOfRange
+	// ErrNoSuchKey is returned by the commands that need their key to exist
+	ErrNoSuchKey = errors.New("ERR no such key")
+	// ErrSyntax is returned for an unexpected argument
+	ErrSyntax = errors.New("ERR syntax error")
+)
+
+// ErrWrongArity is returned by a command called with the wrong number of
+// arguments. Cmd is the command name, with the subcommand after a | for
+// container commands such as "latency|history".
+type ErrWrongArity struct {
+	Cmd string
+}
+
+func (e ErrWrongArity) Error() string {
+	return fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(e.Cmd))
+}
+
+// errWrongArgs returns the error for a command called with the wrong number
+// of arguments
+func errWrongArgs(cmd string) error {
+	return ErrWrongArity{Cmd: cmd}
+}
+
+// ErrorReply returns the message of the RESP error replied for err: its
+// message if it starts with an error class, an upper case word such as ERR,
+// WRONGTYPE or LOADING, otherwise the message with the ERR class
+func ErrorReply(err error) string {
+	msg := err.Error()
+	if class, _, found := strings.Cut(msg, " "); found && isErrorClass(class) {
+		return msg
+	}
+	return "ERR " + msg
+}
+
+// isErrorClass reports whether word is a RESP error class, upper case letters
+func isErrorClass(word string) bool {
+	if word == "" {
+		return false
+	}
+	for i := 0; i < len(word); i++ {
+		if word[i] < 'A' || word[i] > 'Z' {
+			return false
+		}
+	}
+	return true
+}
+
+// errTimeoutNotInteger is returned for a timeout in milliseconds that is not
+// an integer
+var errTimeoutNotInteger = errors.New("ERR timeout is not an integer or out of range")
@@ -0,0 +1,86 @@
+package database_test
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"testing"
+
+	"github.com/wangbo/gocache/database"
+)
+
+func TestCommandErrorsMatchSentinels(t *testing.T) {
+	db := database.MakeDB()
+	defer db.Close()
+	exec(t, db, "SET", "str", "abc")
+	exec(t, db, "RPUSH", "list", "a")
+
+	tests := []struct {
+		args []string
+		want error
+	}{
+		{[]string{"LPUSH", "str", "x"}, database.ErrWrongType},
+		{[]string{"HGET", "list", "f"}, database.ErrWrongType},
+		{[]string{"INCR", "str"}, database.ErrNotInteger},
+		{[]string{"LINDEX", "list", "x"}, database.ErrNotInteger},
+		{[]string{"ZADD", "z", "x", "m"}, database.ErrNotFloat},
+		{[]string{"LSET", "list", "5", "x"}, database.ErrOutOfRange},
+		{[]string{"RENAME", "missing", "k"}, database.ErrNoSuchKey},
+		{[]string{"LSET", "missing", "0", "x"}, database.ErrNoSuchKey},
+		{[]string{"SET", "k", "v", "BOGUS"}, database.ErrSyntax},
+	}
+	for _, tt := range tests {
+		_, err := db.ExecCommand(tt.args[0], tt.args[1:]...)
+		if !errors.Is(err, tt.want) {
+			t.Errorf("%v: expected %v, got %v", tt.args, tt.want, err)
+		}
+	}
+}
+
+func TestWrongArityError(t *testing.T) {
+	db := database.MakeDB()
+	defer db.Close()
+
+	for _, tt := range []struct {
+		args []string
+		cmd  string
+	}{
+		{[]string{"GET"}, "get"},
+		{[]string{"XRANGE", "s"}, "xrange"},
+		{[]string{"LATENCY", "HISTORY"}, "latency|history"},
+	} {
+		_, err := db.ExecCommand(tt.args[0], tt.args[1:]...)
+		var arity database.ErrWrongArity
+		if !errors.As(err, &arity) {
+			t.Errorf("%v: expected ErrWrongArity, got %v", tt.args, err)
+			continue
+		}
+		if arity.Cmd != tt.cmd {
+			t.Errorf("%v: expected the command %q, got %q", tt.args, tt.cmd, arity.Cmd)
+		}
+		if want := "ERR wrong number of arguments for '" + tt.cmd + "' command"; err.Error() != want {
+			t.Errorf("%v: expected %q, got %q", tt.args, want, err.Error())
+		}
+	}
+}
+
+func TestErrorReply(t *testing.T) {
+	_, parseErr := strconv.Atoi("x")
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{database.ErrWrongType, database.ErrWrongType.Error()},
+		{database.ErrSyntax, "ERR syntax error"},
+		{errors.New("LOADING GoCache is loading the dataset in memory"), "LOADING GoCache is loading the dataset in memory"},
+		{errors.New("invalid cursor"), "ERR invalid cursor"},
+		{errors.New("Unknown option"), "ERR Unknown option"},
+		{parseErr, "ERR " + parseErr.Error()},
+		{fmt.Errorf("wrapped: %w", database.ErrNoSuchKey), "ERR wrapped: ERR no such key"},
+	}
+	for _, tt := range tests {
+		if got := database.ErrorReply(tt.err); got != tt.want {
+			t.Errorf("ErrorReply(%q): expected %q, got %q", tt.err, tt.want, got)
+		}
+	}
+}
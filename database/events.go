@@ -0,0 +1,145 @@
+package database
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/wangbo/gocache/datastruct"
+)
+
+// Eviction and expiration events for embedded users
+//
+// OnEvict and OnExpire register callbacks called with every key the database
+// removes on its own: evicted to stay under maxmemory, or expired by its TTL.
+// Keys deleted by a command (DEL, a pop emptying a collection, ...) and by
+// the master of a replica are not reported.
+//
+// Callbacks do not run on the write path: events are queued and a single
+// goroutine calls the callbacks in the order the keys were removed, so a
+// callback may call back into the database. When the queue is full because
+// callbacks are too slow, new events are dropped and counted (see
+// DroppedKeyEvents) rather than stalling writers.
+
+// EvictReason tells why a key was removed
+type EvictReason int
+
+const (
+	// EvictMaxMemory means the key was evicted by the maxmemory policy
+	EvictMaxMemory EvictReason = iota
+	// ExpiredLazy means the key was found expired when it was accessed
+	ExpiredLazy
+	// ExpiredActive means the key was expired by the background expire cycle
+	ExpiredActive
+)
+
+func (r EvictReason) String() string {
+	switch r {
+	case EvictMaxMemory:
+		return "maxmemory"
+	case ExpiredLazy:
+		return "expired-lazy"
+	case ExpiredActive:
+		return "expired-active"
+	default:
+		return "unknown"
+	}
+}
+
+// KeyEventFunc is called with a removed key, its value and why it was removed
+type KeyEventFunc func(key string, entity *datastruct.DataEntity, reason EvictReason)
+
+// keyEventQueueSize is the number of events waiting for callbacks beyond
+// which events are dropped
+const keyEventQueueSize = 4096
+
+// keyEvent is a removed key waiting to be dispatched
+type keyEvent struct {
+	key    string
+	entity *datastruct.DataEntity
+	reason EvictReason
+}
+
+// keyEvents dispatches removed keys to the registered callbacks
+type keyEvents struct {
+	mu       sync.RWMutex
+	onEvict  []KeyEventFunc
+	onExpire []KeyEventFunc
+
+	listening atomic.Bool // Set once a callback is registered
+	start     sync.Once
+	queue     chan keyEvent
+	lifecycle *lifecycle // Runs the dispatcher until the database is closed
+	dropped   atomic.Uint64
+}
+
+func newKeyEvents(lc *lifecycle) *keyEvents {
+	return &keyEvents{
+		queue:     make(chan keyEvent, keyEventQueueSize),
+		lifecycle: lc,
+	}
+}
+
+// OnEvict registers fn to be called with every key evicted because the
+// database used more than maxmemory
+func (db *DB) OnEvict(fn KeyEventFunc) {
+	db.events.register(&db.events.onEvict, fn)
+}
+
+// OnExpire registers fn to be called with every key removed because its TTL
+// passed, with ExpiredLazy or ExpiredActive as the reason
+func (db *DB) OnExpire(fn KeyEventFunc) {
+	db.events.register(&db.events.onExpire, fn)
+}
+
+// DroppedKeyEvents returns the number of events dropped because the
+// callbacks could not keep up
+func (db *DB) DroppedKeyEvents() uint64 {
+	return db.events.dropped.Load()
+}
+
+func (e *keyEvents) register(callbacks *[]KeyEventFunc, fn KeyEventFunc) {
+	e.mu.Lock()
+	*callbacks = append(*callbacks, fn)
+	e.mu.Unlock()
+
+	e.start.Do(func() { e.lifecycle.goWorker(e.dispatch) })
+	e.listening.Store(true)
+}
+
+// emit queues a removed key for the callbacks without blocking
+func (e *keyEvents) emit(key string, entity *datastruct.DataEntity, reason EvictReason) {
+	if !e.listening.Load() {
+		return
+	}
+	select {
+	case e.queue <- keyEvent{key: key, entity: entity, reason: reason}:
+	default:
+		e.dropped.Add(1)
+	}
+}
+
+// dispatch calls the callbacks with the queued events until the database is
+// closed; events still queued then are not delivered
+func (e *keyEvents) dispatch(done <-chan struct{}) {
+	for {
+		select {
+		case ev := <-e.queue:
+			e.deliver(ev)
+		case <-done:
+			return
+		}
+	}
+}
+
+func (e *keyEvents) deliver(ev keyEvent) {
+	e.mu.RLock()
+	callbacks := e.onExpire
+	if ev.reason == EvictMaxMemory {
+		callbacks = e.onEvict
+	}
+	e.mu.RUnlock()
+
+	for _, fn := range callbacks {
+		fn(ev.key, ev.entity, ev.reason)
+	}
+}
@@ -0,0 +1,156 @@
+package database
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/wangbo/gocache/config"
+	"github.com/wangbo/gocache/datastruct"
+	"github.com/wangbo/gocache/replication"
+)
+
+// removedKey is a key reported to an OnEvict or OnExpire callback
+type removedKey struct {
+	key    string
+	value  string
+	reason EvictReason
+}
+
+// recordRemovedKeys registers OnEvict and OnExpire callbacks sending the keys
+// they get to the returned channel
+func recordRemovedKeys(db *DB) <-chan removedKey {
+	removed := make(chan removedKey, 1024)
+	record := func(key string, entity *datastruct.DataEntity, reason EvictReason) {
+		var value string
+		if str, ok := entity.Data.(*datastruct.String); ok {
+			value = string(str.Get())
+		}
+		removed <- removedKey{key: key, value: value, reason: reason}
+	}
+	db.OnEvict(record)
+	db.OnExpire(record)
+	return removed
+}
+
+// nextRemovedKey waits for the next key reported to the callbacks
+func nextRemovedKey(t *testing.T, removed <-chan removedKey) removedKey {
+	t.Helper()
+	select {
+	case r := <-removed:
+		return r
+	case <-time.After(2 * time.Second):
+		t.Fatal("No removed key reported")
+		return removedKey{}
+	}
+}
+
+func TestOnEvictMaxMemory(t *testing.T) {
+	cfg := config.Default()
+	cfg.MaxMemory = 2000
+	cfg.MaxMemoryPolicy = "allkeys-lru"
+	db := MakeDBWithConfig(cfg, replication.NewReplicationState())
+	defer db.Close()
+
+	// The callback writes back into the database, which must not deadlock
+	evicted := make(chan removedKey, 1024)
+	db.OnEvict(func(key string, entity *datastruct.DataEntity, reason EvictReason) {
+		db.ExecCommand("INCR", "evictions")
+		db.ExecCommand("GET", key)
+		evicted <- removedKey{key: key, reason: reason}
+	})
+
+	value := strings.Repeat("x", 100)
+	for i := 0; i < 50; i++ {
+		db.ExecCommand("SET", "key"+strconv.Itoa(i), value)
+	}
+
+	r := nextRemovedKey(t, evicted)
+	if r.reason != EvictMaxMemory {
+		t.Errorf("Expected reason %v, got %v", EvictMaxMemory, r.reason)
+	}
+	if r.key != "key0" {
+		t.Errorf("Expected the least recently used key0 to be evicted first, got %s", r.key)
+	}
+	if db.Exists(r.key) {
+		t.Errorf("Expected %s to be gone once reported", r.key)
+	}
+}
+
+func TestOnExpireReasons(t *testing.T) {
+	db := MakeDB()
+	defer db.Close()
+	removed := recordRemovedKeys(db)
+
+	// A key found expired when read is expired lazily
+	db.ExecCommand("SET", "lazy", "1")
+	db.ttlMap.Put("lazy", time.Now().Add(-time.Second))
+	db.ExecCommand("GET", "lazy")
+	if r := nextRemovedKey(t, removed); r != (removedKey{"lazy", "1", ExpiredLazy}) {
+		t.Errorf("Expected lazy to expire lazily, got %+v", r)
+	}
+
+	// Deleted keys are not reported
+	db.ExecCommand("SET", "deleted", "2")
+	db.ExecCommand("DEL", "deleted")
+
+	// A key nobody reads is expired by the time wheel
+	db.ExecCommand("SET", "active", "3", "PX", "20")
+	if r := nextRemovedKey(t, removed); r != (removedKey{"active", "3", ExpiredActive}) {
+		t.Errorf("Expected active to expire actively, got %+v", r)
+	}
+}
+
+func TestReplicaReportsNoExpiredKeys(t *testing.T) {
+	db := MakeDB()
+	defer db.Close()
+	removed := recordRemovedKeys(db)
+
+	db.SetReplicaMode(true)
+	db.ExecCommand("SET", "k", "v")
+	db.ttlMap.Put("k", time.Now().Add(-time.Second))
+	db.ExecCommand("GET", "k")
+
+	// The master's DEL removes the key without an event either
+	db.ExecCommand("DEL", "k")
+	select {
+	case r := <-removed:
+		t.Errorf("Expected no expired key on a replica, got %+v", r)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestSlowCallbackDoesNotStallWrites(t *testing.T) {
+	db := MakeDB()
+	defer db.Close()
+
+	release := make(chan struct{})
+	defer close(release)
+	db.OnExpire(func(key string, entity *datastruct.DataEntity, reason EvictReason) {
+		<-release
+	})
+
+	n := keyEventQueueSize + 100
+	for i := 0; i < n; i++ {
+		key := "k" + strconv.Itoa(i)
+		db.ExecCommand("SET", key, "v")
+		db.ttlMap.Put(key, time.Now().Add(-time.Second))
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < n; i++ {
+			db.ExecCommand("GET", "k"+strconv.Itoa(i))
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expiring keys blocked on a slow callback")
+	}
+	if db.DroppedKeyEvents() == 0 {
+		t.Error("Expected events to be dropped while the callback is stuck")
+	}
+}
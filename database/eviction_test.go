@@ -1,11 +1,13 @@
 package database
 
 import (
+	"strconv"
 	"testing"
 	"time"
 
 	"github.com/wangbo/gocache/config"
 	"github.com/wangbo/gocache/datastruct"
+	"github.com/wangbo/gocache/util/clock"
 )
 
 // TestMemoryUsage tests memory tracking
@@ -228,13 +230,15 @@ func TestExpiryWithEviction(t *testing.T) {
 	config.Config.MaxMemoryPolicy = "allkeys-lru"
 
 	db := MakeDB()
+	mc := clock.NewManual(time.Now())
+	db.SetClock(mc)
 
 	// Add a key with short TTL
 	db.ExecCommand("SET", "tempkey", "tempvalue")
 	db.ExecCommand("EXPIRE", "tempkey", "1") // 1 second
 
 	// Wait for expiration
-	time.Sleep(2 * time.Second)
+	mc.Advance(2 * time.Second)
 
 	// Try to get the expired key - it should be gone
 	result, _ := db.ExecCommand("GET", "tempkey")
@@ -246,3 +250,58 @@ func TestExpiryWithEviction(t *testing.T) {
 	config.Config.MaxMemory = 0
 	config.Config.MaxMemoryPolicy = "noeviction"
 }
+
+// TestLRUReadsProtectFromEviction tests that keys kept hot through GET or
+// TOUCH survive eviction while untouched keys of the same age are evicted
+func TestLRUReadsProtectFromEviction(t *testing.T) {
+	oldMaxMemory, oldPolicy := config.Config.MaxMemory, config.Config.MaxMemoryPolicy
+	defer func() {
+		config.Config.MaxMemory, config.Config.MaxMemoryPolicy = oldMaxMemory, oldPolicy
+	}()
+	config.Config.MaxMemory = 1000
+	config.Config.MaxMemoryPolicy = "allkeys-lru"
+
+	for _, read := range []string{"GET", "TOUCH"} {
+		t.Run(read, func(t *testing.T) {
+			db := MakeDB()
+			defer db.Close()
+
+			value := string(make([]byte, 100))
+			db.ExecCommand("SET", "hot", value)
+			db.ExecCommand("SET", "cold", value)
+
+			for i := 0; i < 50; i++ {
+				db.ExecCommand(read, "hot")
+				db.ExecCommand("SET", "filler"+strconv.Itoa(i), value)
+			}
+
+			if db.Exists("cold") {
+				t.Error("Expected untouched key to be evicted")
+			}
+			if !db.Exists("hot") {
+				t.Errorf("Expected key kept hot by %s to survive eviction", read)
+			}
+		})
+	}
+}
+
+// TestTouchCommand tests that TOUCH counts existing keys
+func TestTouchCommand(t *testing.T) {
+	db := MakeDB()
+	defer db.Close()
+
+	db.ExecCommand("SET", "key1", "value1")
+	db.ExecCommand("HSET", "key2", "field", "value")
+
+	result, err := db.ExecCommand("TOUCH", "key1", "key2", "missing")
+	if err != nil {
+		t.Fatalf("TOUCH failed: %v", err)
+	}
+	if len(result) != 1 || string(result[0]) != "2" {
+		t.Errorf("Expected 2, got %v", result)
+	}
+
+	if _, err := db.ExecCommand("TOUCH"); err == nil {
+		t.Error("Expected error for TOUCH without keys")
+	}
+}
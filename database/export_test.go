@@ -0,0 +1,11 @@
+package database
+
+import "time"
+
+// SetSyncRetryInterval changes the delay between synchronization attempts
+// for a test and returns a function restoring it
+func SetSyncRetryInterval(d time.Duration) (restore func()) {
+	old := syncRetryInterval
+	syncRetryInterval = d
+	return func() { syncRetryInterval = old }
+}
@@ -0,0 +1,88 @@
+package database
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"sort"
+	"testing"
+)
+
+// fuzzTokens are arguments that steer commands past their first checks
+var fuzzTokens = []string{"", "0", "1", "-1", "2", "100", "k", "h", "l", "s", "z", "FIELDS", "NX", "EX", "WITHSCORES", "ENCODING", "+inf", "nan", "\x00\xff"}
+
+// fuzzArg returns a random token or random bytes
+func fuzzArg(r *rand.Rand) []byte {
+	if r.Intn(2) == 0 {
+		return []byte(fuzzTokens[r.Intn(len(fuzzTokens))])
+	}
+	arg := make([]byte, r.Intn(8))
+	r.Read(arg)
+	return arg
+}
+
+// fuzzSkipped are commands with side effects outside the database
+var fuzzSkipped = map[string]bool{
+	"SLAVEOF": true, // Connects to a master
+	"MIGRATE": true, // Connects to another server
+	"MONITOR": true,
+	"BLPOP":   true, // Blocks until a list is pushed to
+	"BRPOP":   true,
+}
+
+// TestExecArgumentFuzz calls every registered command with 0 to 5 random
+// arguments and fails if any of them panics
+func TestExecArgumentFuzz(t *testing.T) {
+	// SAVE and BGSAVE write to the working directory
+	wd, _ := os.Getwd()
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	db := MakeDB()
+	defer db.Close()
+
+	names := make([]string, 0, len(CommandRegistry))
+	for name := range CommandRegistry {
+		if !fuzzSkipped[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	r := rand.New(rand.NewSource(1))
+	for _, name := range names {
+		for argc := 0; argc <= 5; argc++ {
+			for round := 0; round < 20; round++ {
+				// Keys of every type for the commands to run against
+				db.ExecCommand("SET", "k", "1")
+				db.ExecCommand("HSET", "h", "f", "1")
+				db.ExecCommand("RPUSH", "l", "a", "b")
+				db.ExecCommand("SADD", "s", "a", "b")
+				db.ExecCommand("ZADD", "z", "1", "a")
+
+				cmdLine := [][]byte{[]byte(name)}
+				for i := 0; i < argc; i++ {
+					cmdLine = append(cmdLine, fuzzArg(r))
+				}
+				if err := execRecovered(db, cmdLine); err != nil {
+					t.Errorf("%q: %v", cmdLine, err)
+					break
+				}
+			}
+		}
+		db.ExecCommand("DISCARD")
+	}
+}
+
+// execRecovered runs a command and turns a panic into an error
+func execRecovered(db *DB, cmdLine [][]byte) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	db.Exec(cmdLine)
+	return nil
+}
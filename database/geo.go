@@ -0,0 +1,357 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/wangbo/gocache/datastruct"
+	"github.com/wangbo/gocache/geo"
+)
+
+// GEO command implementations
+//
+// Positions are stored in regular sorted sets, with the 52-bit geohash of a
+// position as the score of its member (see the geo package), so the sorted
+// set commands work on GEO keys.
+
+var errUnsupportedUnit = errors.New("ERR unsupported unit provided. please use M, KM, FT, MI")
+
+// getGeoSet returns the sorted set stored at key, nil if the key does not
+// exist
+func (db *DB) getGeoSet(key string) (*datastruct.SortedSet, error) {
+	entity, ok := db.GetEntity(key)
+	if !ok || entity.Data == nil {
+		return nil, nil
+	}
+	zset, ok := entity.Data.(*datastruct.SortedSet)
+	if !ok {
+		return nil, ErrWrongType
+	}
+	return zset, nil
+}
+
+// parseLonLat parses and validates a longitude and a latitude
+func parseLonLat(lonArg, latArg []byte) (float64, float64, error) {
+	lon, err := strconv.ParseFloat(string(lonArg), 64)
+	if err != nil {
+		return 0, 0, ErrNotFloat
+	}
+	lat, err := strconv.ParseFloat(string(latArg), 64)
+	if err != nil {
+		return 0, 0, ErrNotFloat
+	}
+	if !geo.Valid(lon, lat) {
+		return 0, 0, fmt.Errorf("ERR invalid longitude,latitude pair %f,%f", lon, lat)
+	}
+	return lon, lat, nil
+}
+
+// formatDistance formats a distance in meters in the given unit, with the
+// 4 decimals Redis uses
+func formatDistance(meters, factor float64) []byte {
+	return []byte(strconv.FormatFloat(meters/factor, 'f', 4, 64))
+}
+
+// formatCoordinate formats a longitude or a latitude
+func formatCoordinate(v float64) []byte {
+	return []byte(strconv.FormatFloat(v, 'f', -1, 64))
+}
+
+// execGeoAdd implements GEOADD key longitude latitude member [...]
+func execGeoAdd(db *DB, args [][]byte) ([][]byte, error) {
+	if len(args) < 4 {
+		return nil, errWrongArgs("geoadd")
+	}
+	if (len(args)-1)%3 != 0 {
+		return nil, errors.New("ERR syntax error. Try GEOADD key [x1] [y1] [name1] [x2] [y2] [name2] ... ")
+	}
+
+	key := string(args[0])
+	zset, err := db.getGeoSet(key)
+	if err != nil {
+		return nil, err
+	}
+
+	// Validate every position before adding any
+	scores := make([]float64, 0, (len(args)-1)/3)
+	for i := 1; i < len(args); i += 3 {
+		lon, lat, err := parseLonLat(args[i], args[i+1])
+		if err != nil {
+			return nil, err
+		}
+		scores = append(scores, float64(geo.Encode(lon, lat)))
+	}
+
+	var created *datastruct.DataEntity
+	if zset == nil {
+		created = datastruct.MakeSortedSet()
+		zset = created.Data.(*datastruct.SortedSet)
+	}
+	added := 0
+	for i, score := range scores {
+		added += zset.Add(score, args[3*i+3])
+	}
+
+	if created != nil {
+		db.PutEntity(key, created)
+	}
+	return [][]byte{[]byte(strconv.Itoa(added))}, nil
+}
+
+// execGeoPos implements GEOPOS key [member ...]
+// The result holds a longitude and a latitude per member, or two nils for a
+// missing member.
+func execGeoPos(db *DB, args [][]byte) ([][]byte, error) {
+	if len(args) < 1 {
+		return nil, errWrongArgs("geopos")
+	}
+
+	zset, err := db.getGeoSet(string(args[0]))
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([][]byte, 0, 2*(len(args)-1))
+	for _, member := range args[1:] {
+		score := math.NaN()
+		if zset != nil {
+			score = zset.Score(member)
+		}
+		if math.IsNaN(score) {
+			result = append(result, nil, nil)
+			continue
+		}
+		lon, lat := geo.Decode(uint64(score))
+		result = append(result, formatCoordinate(lon), formatCoordinate(lat))
+	}
+	return result, nil
+}
+
+// execGeoDist implements GEODIST key member1 member2 [M|KM|FT|MI]
+func execGeoDist(db *DB, args [][]byte) ([][]byte, error) {
+	if len(args) != 3 && len(args) != 4 {
+		return nil, errWrongArgs("geodist")
+	}
+
+	factor := 1.0
+	if len(args) == 4 {
+		var ok bool
+		if factor, ok = geo.UnitFactor(string(args[3])); !ok {
+			return nil, errUnsupportedUnit
+		}
+	}
+
+	zset, err := db.getGeoSet(string(args[0]))
+	if err != nil {
+		return nil, err
+	}
+	if zset == nil {
+		return nullResult(), nil
+	}
+	score1, score2 := zset.Score(args[1]), zset.Score(args[2])
+	if math.IsNaN(score1) || math.IsNaN(score2) {
+		return nullResult(), nil
+	}
+
+	lon1, lat1 := geo.Decode(uint64(score1))
+	lon2, lat2 := geo.Decode(uint64(score2))
+	return [][]byte{formatDistance(geo.Distance(lon1, lat1, lon2, lat2), factor)}, nil
+}
+
+// geoSearchOptions holds the parsed options of GEOSEARCH
+type geoSearchOptions struct {
+	fromMember []byte
+	lon, lat   float64
+	hasLonLat  bool
+	radius     float64 // in meters
+	factor     float64 // meters per unit of the radius
+	hasRadius  bool
+	desc       bool
+	sorted     bool
+	count      int
+	any        bool
+	withCoord  bool
+	withDist   bool
+	withHash   bool
+}
+
+// parseGeoSearchOptions parses the options of GEOSEARCH after the key
+func parseGeoSearchOptions(args [][]byte) (*geoSearchOptions, error) {
+	opts := &geoSearchOptions{}
+	fromError := errors.New("ERR exactly one of FROMMEMBER or FROMLONLAT can be specified for GEOSEARCH")
+	byError := errors.New("ERR exactly one of BYRADIUS and BYBOX can be specified for GEOSEARCH")
+
+	for i := 0; i < len(args); i++ {
+		remaining := len(args) - i - 1
+		switch strings.ToUpper(string(args[i])) {
+		case "FROMMEMBER":
+			if remaining < 1 {
+				return nil, ErrSyntax
+			}
+			if opts.fromMember != nil || opts.hasLonLat {
+				return nil, fromError
+			}
+			opts.fromMember = args[i+1]
+			i++
+		case "FROMLONLAT":
+			if remaining < 2 {
+				return nil, ErrSyntax
+			}
+			if opts.fromMember != nil || opts.hasLonLat {
+				return nil, fromError
+			}
+			lon, lat, err := parseLonLat(args[i+1], args[i+2])
+			if err != nil {
+				return nil, err
+			}
+			opts.lon, opts.lat, opts.hasLonLat = lon, lat, true
+			i += 2
+		case "BYRADIUS":
+			if remaining < 2 {
+				return nil, ErrSyntax
+			}
+			if opts.hasRadius {
+				return nil, byError
+			}
+			radius, err := strconv.ParseFloat(string(args[i+1]), 64)
+			if err != nil {
+				return nil, errors.New("ERR need numeric radius")
+			}
+			if radius < 0 {
+				return nil, errors.New("ERR radius cannot be negative")
+			}
+			factor, ok := geo.UnitFactor(string(args[i+2]))
+			if !ok {
+				return nil, errUnsupportedUnit
+			}
+			opts.radius, opts.factor, opts.hasRadius = radius*factor, factor, true
+			i += 2
+		case "ASC":
+			opts.sorted, opts.desc = true, false
+		case "DESC":
+			opts.sorted, opts.desc = true, true
+		case "COUNT":
+			if remaining < 1 {
+				return nil, ErrSyntax
+			}
+			count, err := strconv.Atoi(string(args[i+1]))
+			if err != nil {
+				return nil, ErrNotInteger
+			}
+			if count <= 0 {
+				return nil, errors.New("ERR COUNT must be > 0")
+			}
+			opts.count = count
+			i++
+			if i+1 < len(args) && strings.EqualFold(string(args[i+1]), "ANY") {
+				opts.any = true
+				i++
+			}
+		case "WITHCOORD":
+			opts.withCoord = true
+		case "WITHDIST":
+			opts.withDist = true
+		case "WITHHASH":
+			opts.withHash = true
+		default:
+			return nil, ErrSyntax
+		}
+	}
+
+	if opts.fromMember == nil && !opts.hasLonLat {
+		return nil, fromError
+	}
+	if !opts.hasRadius {
+		return nil, byError
+	}
+	// Without ANY, COUNT returns the closest members
+	if opts.count > 0 && !opts.any && !opts.sorted {
+		opts.sorted = true
+	}
+	return opts, nil
+}
+
+// geoSearchMatch is a member found by GEOSEARCH
+type geoSearchMatch struct {
+	member   []byte
+	hash     uint64
+	distance float64
+}
+
+// execGeoSearch implements GEOSEARCH key FROMMEMBER member|FROMLONLAT lon lat
+// BYRADIUS radius unit [ASC|DESC] [COUNT count [ANY]] [WITHCOORD]
+// [WITHDIST] [WITHHASH]
+// The result holds per member its name followed by its distance, its hash
+// and its longitude and latitude, as requested.
+func execGeoSearch(db *DB, args [][]byte) ([][]byte, error) {
+	if len(args) < 1 {
+		return nil, errWrongArgs("geosearch")
+	}
+
+	opts, err := parseGeoSearchOptions(args[1:])
+	if err != nil {
+		return nil, err
+	}
+	zset, err := db.getGeoSet(string(args[0]))
+	if err != nil {
+		return nil, err
+	}
+	if zset == nil {
+		return [][]byte{}, nil
+	}
+
+	if opts.fromMember != nil {
+		score := zset.Score(opts.fromMember)
+		if math.IsNaN(score) {
+			return nil, errors.New("ERR could not decode requested zset member")
+		}
+		opts.lon, opts.lat = geo.Decode(uint64(score))
+	}
+
+	var matches []geoSearchMatch
+	for _, r := range geo.RadiusRanges(opts.lon, opts.lat, opts.radius) {
+		// Scores are integers below 2^52, so Max-1 is exact
+		zset.ScanByScore(float64(r.Min), float64(r.Max-1), func(member []byte, score float64) {
+			if opts.any && len(matches) >= opts.count {
+				return
+			}
+			hash := uint64(score)
+			lon, lat := geo.Decode(hash)
+			if d := geo.Distance(opts.lon, opts.lat, lon, lat); d <= opts.radius {
+				matches = append(matches, geoSearchMatch{member: member, hash: hash, distance: d})
+			}
+		})
+	}
+
+	if opts.sorted {
+		sort.SliceStable(matches, func(i, j int) bool {
+			if opts.desc {
+				return matches[i].distance > matches[j].distance
+			}
+			return matches[i].distance < matches[j].distance
+		})
+	}
+	if opts.count > 0 && len(matches) > opts.count {
+		matches = matches[:opts.count]
+	}
+
+	result := make([][]byte, 0, len(matches))
+	for _, m := range matches {
+		result = append(result, m.member)
+		if opts.withDist {
+			result = append(result, formatDistance(m.distance, opts.factor))
+		}
+		if opts.withHash {
+			result = append(result, []byte(strconv.FormatUint(m.hash, 10)))
+		}
+		if opts.withCoord {
+			lon, lat := geo.Decode(m.hash)
+			result = append(result, formatCoordinate(lon), formatCoordinate(lat))
+		}
+	}
+	return result, nil
+}
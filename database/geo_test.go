@@ -0,0 +1,218 @@
+package database
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// addSicily adds the positions of the GEOADD example of the Redis
+// documentation
+func addSicily(t *testing.T, db *DB) {
+	t.Helper()
+	result, err := db.ExecCommand("GEOADD", "Sicily", "13.361389", "38.115556", "Palermo", "15.087269", "37.502669", "Catania")
+	if err != nil || string(result[0]) != "2" {
+		t.Fatalf("GEOADD failed: %q %v", result, err)
+	}
+}
+
+func TestGeoAddStoresGeohashScores(t *testing.T) {
+	db := MakeDB()
+	defer db.Close()
+	addSicily(t, db)
+
+	for member, want := range map[string]string{"Palermo": "3479099956230698", "Catania": "3479447370796909"} {
+		if result, _ := db.ExecCommand("ZSCORE", "Sicily", member); string(result[0]) != want {
+			t.Errorf("%s: expected score %s, got %s", member, want, result[0])
+		}
+	}
+
+	// Positions stay regular sorted set members
+	if result, _ := db.ExecCommand("GEOADD", "Sicily", "13.361389", "38.115556", "Palermo"); string(result[0]) != "0" {
+		t.Errorf("Updating a member should add 0, got %s", result[0])
+	}
+	if result, _ := db.ExecCommand("ZREM", "Sicily", "Palermo"); string(result[0]) != "1" {
+		t.Errorf("ZREM should remove a GEO member, got %s", result[0])
+	}
+	if result, _ := db.ExecCommand("ZCARD", "Sicily"); string(result[0]) != "1" {
+		t.Errorf("Expected 1 member left, got %s", result[0])
+	}
+}
+
+func TestGeoAddErrors(t *testing.T) {
+	db := MakeDB()
+	defer db.Close()
+	db.ExecCommand("SET", "str", "v")
+
+	for _, tc := range []struct {
+		args    []string
+		wantErr string
+	}{
+		{[]string{"GEOADD", "k", "1", "2"}, "ERR wrong number of arguments for 'geoadd' command"},
+		{[]string{"GEOADD", "k", "1", "2", "a", "3"}, "ERR syntax error. Try GEOADD key [x1] [y1] [name1] [x2] [y2] [name2] ... "},
+		{[]string{"GEOADD", "k", "x", "2", "a"}, "ERR value is not a valid float"},
+		{[]string{"GEOADD", "k", "181", "10", "a"}, "ERR invalid longitude,latitude pair 181.000000,10.000000"},
+		{[]string{"GEOADD", "k", "1", "2", "a", "10", "-86", "b"}, "ERR invalid longitude,latitude pair 10.000000,-86.000000"},
+		{[]string{"GEOADD", "str", "1", "2", "a"}, "WRONGTYPE"},
+	} {
+		_, err := db.ExecCommand(tc.args[0], tc.args[1:]...)
+		if err == nil || !strings.HasPrefix(err.Error(), tc.wantErr) {
+			t.Errorf("%v: expected error %q, got %v", tc.args, tc.wantErr, err)
+		}
+	}
+
+	// A rejected GEOADD adds none of its positions
+	if result, _ := db.ExecCommand("EXISTS", "k"); string(result[0]) != "0" {
+		t.Error("A failed GEOADD should not create the key")
+	}
+}
+
+func TestGeoPosAndGeoDist(t *testing.T) {
+	db := MakeDB()
+	defer db.Close()
+	addSicily(t, db)
+
+	result, err := db.ExecCommand("GEOPOS", "Sicily", "Palermo", "missing")
+	if err != nil || len(result) != 4 {
+		t.Fatalf("GEOPOS failed: %q %v", result, err)
+	}
+	if !strings.HasPrefix(string(result[0]), "13.36138933") || !strings.HasPrefix(string(result[1]), "38.11555639") {
+		t.Errorf("Unexpected position of Palermo %s,%s", result[0], result[1])
+	}
+	if result[2] != nil || result[3] != nil {
+		t.Errorf("A missing member should have nil coordinates, got %q", result[2:])
+	}
+
+	for _, tc := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"Sicily", "Palermo", "Catania"}, "166274.1516"},
+		{[]string{"Sicily", "Palermo", "Catania", "km"}, "166.2742"},
+		{[]string{"Sicily", "Palermo", "Catania", "MI"}, "103.3182"},
+		{[]string{"Sicily", "Palermo", "Palermo"}, "0.0000"},
+	} {
+		result, err := db.ExecCommand("GEODIST", tc.args...)
+		if err != nil || string(result[0]) != tc.want {
+			t.Errorf("GEODIST %v: expected %s, got %q %v", tc.args, tc.want, result, err)
+		}
+	}
+
+	for _, args := range [][]string{{"Sicily", "Palermo", "missing"}, {"missing", "a", "b"}} {
+		if result, _ := db.ExecCommand("GEODIST", args...); !IsNullResult(result) {
+			t.Errorf("GEODIST %v: expected a null result, got %q", args, result)
+		}
+	}
+	if _, err := db.ExecCommand("GEODIST", "Sicily", "Palermo", "Catania", "yd"); err == nil ||
+		err.Error() != "ERR unsupported unit provided. please use M, KM, FT, MI" {
+		t.Errorf("Expected an unsupported unit error, got %v", err)
+	}
+}
+
+func TestGeoSearch(t *testing.T) {
+	db := MakeDB()
+	defer db.Close()
+	addSicily(t, db)
+	db.ExecCommand("GEOADD", "Sicily", "12.758489", "38.788135", "edge1", "17.241510", "38.788135", "edge2")
+
+	search := func(args ...string) []string {
+		t.Helper()
+		result, err := db.ExecCommand("GEOSEARCH", append([]string{"Sicily"}, args...)...)
+		if err != nil {
+			t.Fatalf("GEOSEARCH %v failed: %v", args, err)
+		}
+		return bytesToStrings(result)
+	}
+
+	for _, tc := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"FROMLONLAT", "15", "37", "BYRADIUS", "200", "km", "ASC"}, "Catania Palermo"},
+		{[]string{"FROMLONLAT", "15", "37", "BYRADIUS", "200", "km", "DESC"}, "Palermo Catania"},
+		{[]string{"FROMLONLAT", "15", "37", "BYRADIUS", "400", "km", "ASC"}, "Catania Palermo edge2 edge1"},
+		{[]string{"FROMLONLAT", "15", "37", "BYRADIUS", "400", "km", "COUNT", "1"}, "Catania"},
+		{[]string{"FROMMEMBER", "Palermo", "BYRADIUS", "100", "km"}, "Palermo edge1"},
+		{[]string{"FROMMEMBER", "Palermo", "BYRADIUS", "0", "m"}, "Palermo"},
+		{[]string{"FROMLONLAT", "15", "37", "BYRADIUS", "200", "km", "WITHDIST", "ASC"},
+			"Catania 56.4413 Palermo 190.4424"},
+		{[]string{"FROMLONLAT", "15", "37", "BYRADIUS", "100", "km", "WITHHASH", "WITHCOORD"},
+			"Catania 3479447370796909 15.087267458438873 37.50266842333162"},
+		{[]string{"FROMLONLAT", "0", "0", "BYRADIUS", "1", "km"}, ""},
+	} {
+		if got := strings.Join(search(tc.args...), " "); got != tc.want {
+			t.Errorf("GEOSEARCH %v: expected %q, got %q", tc.args, tc.want, got)
+		}
+	}
+
+	if got := search("FROMLONLAT", "15", "37", "BYRADIUS", "400", "km", "COUNT", "2", "ANY"); len(got) != 2 {
+		t.Errorf("COUNT 2 ANY: expected 2 members, got %q", got)
+	}
+	if result, err := db.ExecCommand("GEOSEARCH", "missing", "FROMLONLAT", "15", "37", "BYRADIUS", "1", "km"); err != nil || len(result) != 0 {
+		t.Errorf("Expected no members in a missing key, got %q %v", result, err)
+	}
+}
+
+func TestGeoSearchErrors(t *testing.T) {
+	db := MakeDB()
+	defer db.Close()
+	addSicily(t, db)
+
+	for _, tc := range []struct {
+		args    []string
+		wantErr string
+	}{
+		{[]string{"BYRADIUS", "1", "km"}, "ERR exactly one of FROMMEMBER or FROMLONLAT can be specified for GEOSEARCH"},
+		{[]string{"FROMMEMBER", "Palermo", "FROMLONLAT", "1", "2", "BYRADIUS", "1", "km"}, "ERR exactly one of FROMMEMBER or FROMLONLAT can be specified for GEOSEARCH"},
+		{[]string{"FROMMEMBER", "Palermo"}, "ERR exactly one of BYRADIUS and BYBOX can be specified for GEOSEARCH"},
+		{[]string{"FROMMEMBER", "missing", "BYRADIUS", "1", "km"}, "ERR could not decode requested zset member"},
+		{[]string{"FROMLONLAT", "200", "2", "BYRADIUS", "1", "km"}, "ERR invalid longitude,latitude pair 200.000000,2.000000"},
+		{[]string{"FROMMEMBER", "Palermo", "BYRADIUS", "-1", "km"}, "ERR radius cannot be negative"},
+		{[]string{"FROMMEMBER", "Palermo", "BYRADIUS", "1", "yd"}, "ERR unsupported unit provided. please use M, KM, FT, MI"},
+		{[]string{"FROMMEMBER", "Palermo", "BYRADIUS", "1", "km", "COUNT", "0"}, "ERR COUNT must be > 0"},
+		{[]string{"FROMMEMBER", "Palermo", "BYRADIUS", "1", "km", "BOGUS"}, "ERR syntax error"},
+	} {
+		_, err := db.ExecCommand("GEOSEARCH", append([]string{"Sicily"}, tc.args...)...)
+		if err == nil || err.Error() != tc.wantErr {
+			t.Errorf("%v: expected error %q, got %v", tc.args, tc.wantErr, err)
+		}
+	}
+}
+
+func TestGeoSearchMatchesBruteForce(t *testing.T) {
+	db := MakeDB()
+	defer db.Close()
+
+	// A grid of positions around Rome, 0.01 degrees apart
+	for i := 0; i < 60; i++ {
+		args := []string{"grid"}
+		for j := 0; j < 60; j++ {
+			lon := strconv.FormatFloat(12.2+float64(i)*0.01, 'f', 2, 64)
+			lat := strconv.FormatFloat(41.6+float64(j)*0.01, 'f', 2, 64)
+			args = append(args, lon, lat, lon+","+lat)
+		}
+		db.ExecCommand("GEOADD", args...)
+	}
+
+	db.ExecCommand("GEOADD", "grid", "12.4964", "41.9028", "Rome")
+	members, _ := db.ExecCommand("ZRANGE", "grid", "0", "-1")
+
+	for _, radius := range []string{"500", "3000", "12000", "50000"} {
+		result, err := db.ExecCommand("GEOSEARCH", "grid", "FROMMEMBER", "Rome", "BYRADIUS", radius, "m")
+		if err != nil {
+			t.Fatalf("GEOSEARCH failed: %v", err)
+		}
+
+		want := 0
+		r, _ := strconv.ParseFloat(radius, 64)
+		for _, member := range members {
+			dist, _ := db.ExecCommand("GEODIST", "grid", string(member), "Rome")
+			if d, _ := strconv.ParseFloat(string(dist[0]), 64); d <= r {
+				want++
+			}
+		}
+		if len(result) != want {
+			t.Errorf("Radius %s m: expected %d members, found %d", radius, want, len(result))
+		}
+	}
+}
@@ -1,7 +1,6 @@
 package database
 
 import (
-	"errors"
 	"strconv"
 
 	"github.com/wangbo/gocache/datastruct"
@@ -9,33 +8,47 @@ import (
 
 // Hash command implementations
 
+// makeHash creates a hash whose field TTLs follow the database clock
+func (db *DB) makeHash() *datastruct.DataEntity {
+	entity := datastruct.MakeHash()
+	entity.Data.(*datastruct.Hash).SetClock(db.now)
+	return entity
+}
+
+// execHSet implements HSET key field value [field value ...], replying with
+// the number of fields added
 func execHSet(db *DB, args [][]byte) ([][]byte, error) {
-	if len(args) != 3 {
-		return nil, errors.New("wrong number of arguments")
+	if len(args) < 3 || (len(args)-1)%2 != 0 {
+		return nil, errWrongArgs("hset")
 	}
 
 	key := string(args[0])
-	field := string(args[1])
-	value := args[2]
 
 	entity, ok := db.GetEntity(key)
-	if !ok || entity.Data == nil {
-		entity = datastruct.MakeHash()
+	created := !ok || entity.Data == nil
+	if created {
+		entity = db.makeHash()
 	}
 
 	hash, ok := entity.Data.(*datastruct.Hash)
 	if !ok {
-		return nil, errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
+		return nil, ErrWrongType
 	}
 
-	hash.Set(field, value)
-	db.PutEntity(key, entity)
-	return [][]byte{[]byte("1")}, nil
+	hash.Grow(len(args) / 2)
+	added := 0
+	for i := 1; i < len(args); i += 2 {
+		added += hash.Set(string(args[i]), args[i+1])
+	}
+	if created {
+		db.PutEntity(key, entity)
+	}
+	return [][]byte{[]byte(strconv.Itoa(added))}, nil
 }
 
 func execHGet(db *DB, args [][]byte) ([][]byte, error) {
 	if len(args) != 2 {
-		return nil, errors.New("wrong number of arguments")
+		return nil, errWrongArgs("hget")
 	}
 
 	key := string(args[0])
@@ -43,24 +56,24 @@ func execHGet(db *DB, args [][]byte) ([][]byte, error) {
 
 	entity, ok := db.GetEntity(key)
 	if !ok || entity.Data == nil {
-		return [][]byte{nil}, nil
+		return nullResult(), nil
 	}
 
 	hash, ok := entity.Data.(*datastruct.Hash)
 	if !ok {
-		return nil, errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
+		return nil, ErrWrongType
 	}
 
 	val, ok := hash.Get(field)
 	if !ok {
-		return [][]byte{nil}, nil
+		return nullResult(), nil
 	}
 	return [][]byte{val}, nil
 }
 
 func execHDel(db *DB, args [][]byte) ([][]byte, error) {
 	if len(args) < 2 {
-		return nil, errors.New("wrong number of arguments")
+		return nil, errWrongArgs("hdel")
 	}
 
 	key := string(args[0])
@@ -76,15 +89,13 @@ func execHDel(db *DB, args [][]byte) ([][]byte, error) {
 
 	hash, ok := entity.Data.(*datastruct.Hash)
 	if !ok {
-		return nil, errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
+		return nil, ErrWrongType
 	}
 
 	count := hash.Remove(fields...)
 	if count > 0 {
 		if hash.Len() == 0 {
 			db.Remove(key)
-		} else {
-			db.PutEntity(key, entity)
 		}
 	}
 	return [][]byte{[]byte(strconv.Itoa(count))}, nil
@@ -92,7 +103,7 @@ func execHDel(db *DB, args [][]byte) ([][]byte, error) {
 
 func execHExists(db *DB, args [][]byte) ([][]byte, error) {
 	if len(args) != 2 {
-		return nil, errors.New("wrong number of arguments")
+		return nil, errWrongArgs("hexists")
 	}
 
 	key := string(args[0])
@@ -105,7 +116,7 @@ func execHExists(db *DB, args [][]byte) ([][]byte, error) {
 
 	hash, ok := entity.Data.(*datastruct.Hash)
 	if !ok {
-		return nil, errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
+		return nil, ErrWrongType
 	}
 
 	if hash.Exists(field) {
@@ -116,7 +127,7 @@ func execHExists(db *DB, args [][]byte) ([][]byte, error) {
 
 func execHGetAll(db *DB, args [][]byte) ([][]byte, error) {
 	if len(args) != 1 {
-		return nil, errors.New("wrong number of arguments")
+		return nil, errWrongArgs("hgetall")
 	}
 
 	key := string(args[0])
@@ -128,21 +139,25 @@ func execHGetAll(db *DB, args [][]byte) ([][]byte, error) {
 
 	hash, ok := entity.Data.(*datastruct.Hash)
 	if !ok {
-		return nil, errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
+		return nil, ErrWrongType
 	}
 
-	all := hash.GetAll()
-	result := make([][]byte, 0, len(all)*2)
-	for k, v := range all {
-		result = append(result, []byte(k))
-		result = append(result, v)
+	if err := db.checkReplyElements(hash.Len(), "HSCAN"); err != nil {
+		return nil, err
 	}
+
+	result := make([][]byte, 0, 2*hash.Len())
+	hash.Entries(func(field string, value []byte) bool {
+		// Fields are immutable strings, shared by the reply like the values
+		result = append(result, StringToBytes(field), value)
+		return true
+	})
 	return result, nil
 }
 
 func execHKeys(db *DB, args [][]byte) ([][]byte, error) {
 	if len(args) != 1 {
-		return nil, errors.New("wrong number of arguments")
+		return nil, errWrongArgs("hkeys")
 	}
 
 	key := string(args[0])
@@ -154,20 +169,24 @@ func execHKeys(db *DB, args [][]byte) ([][]byte, error) {
 
 	hash, ok := entity.Data.(*datastruct.Hash)
 	if !ok {
-		return nil, errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
+		return nil, ErrWrongType
 	}
 
-	keys := hash.Keys()
-	result := make([][]byte, len(keys))
-	for i, key := range keys {
-		result[i] = []byte(key)
+	if err := db.checkReplyElements(hash.Len(), "HSCAN"); err != nil {
+		return nil, err
 	}
+
+	result := make([][]byte, 0, hash.Len())
+	hash.Entries(func(field string, value []byte) bool {
+		result = append(result, StringToBytes(field))
+		return true
+	})
 	return result, nil
 }
 
 func execHVals(db *DB, args [][]byte) ([][]byte, error) {
 	if len(args) != 1 {
-		return nil, errors.New("wrong number of arguments")
+		return nil, errWrongArgs("hvals")
 	}
 
 	key := string(args[0])
@@ -179,16 +198,24 @@ func execHVals(db *DB, args [][]byte) ([][]byte, error) {
 
 	hash, ok := entity.Data.(*datastruct.Hash)
 	if !ok {
-		return nil, errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
+		return nil, ErrWrongType
+	}
+
+	if err := db.checkReplyElements(hash.Len(), "HSCAN"); err != nil {
+		return nil, err
 	}
 
-	values := hash.Values()
-	return values, nil
+	result := make([][]byte, 0, hash.Len())
+	hash.Entries(func(field string, value []byte) bool {
+		result = append(result, value)
+		return true
+	})
+	return result, nil
 }
 
 func execHLen(db *DB, args [][]byte) ([][]byte, error) {
 	if len(args) != 1 {
-		return nil, errors.New("wrong number of arguments")
+		return nil, errWrongArgs("hlen")
 	}
 
 	key := string(args[0])
@@ -200,7 +227,7 @@ func execHLen(db *DB, args [][]byte) ([][]byte, error) {
 
 	hash, ok := entity.Data.(*datastruct.Hash)
 	if !ok {
-		return nil, errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
+		return nil, ErrWrongType
 	}
 
 	return [][]byte{[]byte(strconv.Itoa(hash.Len()))}, nil
@@ -208,7 +235,7 @@ func execHLen(db *DB, args [][]byte) ([][]byte, error) {
 
 func execHSetNX(db *DB, args [][]byte) ([][]byte, error) {
 	if len(args) != 3 {
-		return nil, errors.New("wrong number of arguments")
+		return nil, errWrongArgs("hsetnx")
 	}
 
 	key := string(args[0])
@@ -216,17 +243,20 @@ func execHSetNX(db *DB, args [][]byte) ([][]byte, error) {
 	value := args[2]
 
 	entity, ok := db.GetEntity(key)
-	if !ok || entity.Data == nil {
-		entity = datastruct.MakeHash()
+	created := !ok || entity.Data == nil
+	if created {
+		entity = db.makeHash()
 	}
 
 	hash, ok := entity.Data.(*datastruct.Hash)
 	if !ok {
-		return nil, errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
+		return nil, ErrWrongType
 	}
 
 	if hash.SetNX(field, value) {
-		db.PutEntity(key, entity)
+		if created {
+			db.PutEntity(key, entity)
+		}
 		return [][]byte{[]byte("1")}, nil
 	}
 	return [][]byte{[]byte("0")}, nil
@@ -234,24 +264,25 @@ func execHSetNX(db *DB, args [][]byte) ([][]byte, error) {
 
 func execHIncrBy(db *DB, args [][]byte) ([][]byte, error) {
 	if len(args) != 3 {
-		return nil, errors.New("wrong number of arguments")
+		return nil, errWrongArgs("hincrby")
 	}
 
 	key := string(args[0])
 	field := string(args[1])
 	increment, err := strconv.ParseInt(string(args[2]), 10, 64)
 	if err != nil {
-		return nil, errors.New("ERR value is not an integer or out of range")
+		return nil, ErrNotInteger
 	}
 
 	entity, ok := db.GetEntity(key)
-	if !ok || entity.Data == nil {
-		entity = datastruct.MakeHash()
+	created := !ok || entity.Data == nil
+	if created {
+		entity = db.makeHash()
 	}
 
 	hash, ok := entity.Data.(*datastruct.Hash)
 	if !ok {
-		return nil, errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
+		return nil, ErrWrongType
 	}
 
 	val, err := hash.IncrBy(field, increment)
@@ -259,38 +290,34 @@ func execHIncrBy(db *DB, args [][]byte) ([][]byte, error) {
 		return nil, err
 	}
 
-	db.PutEntity(key, entity)
+	if created {
+		db.PutEntity(key, entity)
+	}
 	return [][]byte{[]byte(strconv.FormatInt(val, 10))}, nil
 }
 
 func execHMGet(db *DB, args [][]byte) ([][]byte, error) {
 	if len(args) < 2 {
-		return nil, errors.New("wrong number of arguments")
+		return nil, errWrongArgs("hmget")
 	}
 
 	key := string(args[0])
-	fields := make([]string, 0, len(args)-1)
-	for i := 1; i < len(args); i++ {
-		fields = append(fields, string(args[i]))
-	}
+	fields := args[1:]
 
+	// Missing fields are left nil
+	result := make([][]byte, len(fields))
 	entity, ok := db.GetEntity(key)
 	if !ok || entity.Data == nil {
-		result := make([][]byte, len(fields))
 		return result, nil
 	}
 
 	hash, ok := entity.Data.(*datastruct.Hash)
 	if !ok {
-		return nil, errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
+		return nil, ErrWrongType
 	}
 
-	result := make([][]byte, len(fields))
 	for i, field := range fields {
-		val, ok := hash.Get(field)
-		if !ok {
-			result[i] = nil
-		} else {
+		if val, ok := hash.Get(string(field)); ok {
 			result[i] = val
 		}
 	}
@@ -299,27 +326,31 @@ func execHMGet(db *DB, args [][]byte) ([][]byte, error) {
 
 func execHMSet(db *DB, args [][]byte) ([][]byte, error) {
 	if len(args) < 3 || (len(args)-1)%2 != 0 {
-		return nil, errors.New("wrong number of arguments")
+		return nil, errWrongArgs("hmset")
 	}
 
 	key := string(args[0])
 
 	entity, ok := db.GetEntity(key)
-	if !ok || entity.Data == nil {
-		entity = datastruct.MakeHash()
+	created := !ok || entity.Data == nil
+	if created {
+		entity = db.makeHash()
 	}
 
 	hash, ok := entity.Data.(*datastruct.Hash)
 	if !ok {
-		return nil, errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
+		return nil, ErrWrongType
 	}
 
+	hash.Grow(len(args) / 2)
 	for i := 1; i < len(args); i += 2 {
 		field := string(args[i])
 		value := args[i+1]
 		hash.Set(field, value)
 	}
 
-	db.PutEntity(key, entity)
+	if created {
+		db.PutEntity(key, entity)
+	}
 	return [][]byte{[]byte("OK")}, nil
 }
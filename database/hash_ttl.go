@@ -0,0 +1,363 @@
+package database
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/wangbo/gocache/datastruct"
+)
+
+// Hash field TTL
+//
+// HEXPIRE and friends give single hash fields an expiration time. Expired
+// fields are hidden from every hash command at once and removed the next
+// time the key is looked up or when the field wheel fires; the key is deleted
+// together with its last field. Every removed field is reported to the hash
+// field expire callback so that it can be propagated as HDEL.
+
+// Per-field replies of the hash field TTL commands
+const (
+	fieldNoSuchField     = -2 // Field (or key) does not exist
+	fieldNoTTL           = -1 // Field exists but has no TTL
+	fieldConditionNotMet = 0  // NX/XX/GT/LT condition not met
+	fieldUpdated         = 1  // TTL set or removed
+	fieldDeleted         = 2  // Expiration time in the past, field deleted
+)
+
+// execHExpire implements HEXPIRE key seconds [NX|XX|GT|LT] FIELDS numfields field...
+func execHExpire(db *DB, args [][]byte) ([][]byte, error) {
+	return hashFieldExpire(db, args, "hexpire", time.Second, false)
+}
+
+// execHPExpire implements HPEXPIRE key milliseconds [NX|XX|GT|LT] FIELDS numfields field...
+func execHPExpire(db *DB, args [][]byte) ([][]byte, error) {
+	return hashFieldExpire(db, args, "hpexpire", time.Millisecond, false)
+}
+
+// execHExpireAt implements HEXPIREAT key unix-time-seconds [NX|XX|GT|LT] FIELDS numfields field...
+func execHExpireAt(db *DB, args [][]byte) ([][]byte, error) {
+	return hashFieldExpire(db, args, "hexpireat", time.Second, true)
+}
+
+// execHPExpireAt implements HPEXPIREAT key unix-time-milliseconds [NX|XX|GT|LT] FIELDS numfields field...
+func execHPExpireAt(db *DB, args [][]byte) ([][]byte, error) {
+	return hashFieldExpire(db, args, "hpexpireat", time.Millisecond, true)
+}
+
+// hashFieldExpire sets the expiration time of hash fields. The time argument
+// is counted in unit, relative to now unless absolute is set.
+func hashFieldExpire(db *DB, args [][]byte, name string, unit time.Duration, absolute bool) ([][]byte, error) {
+	if len(args) < 4 {
+		return nil, errWrongArgs(name)
+	}
+
+	key := string(args[0])
+	amount, err := strconv.ParseInt(string(args[1]), 10, 64)
+	if err != nil {
+		return nil, ErrNotInteger
+	}
+	if amount < 0 || amount > 1<<46 {
+		return nil, errors.New("ERR invalid expire time, must be >= 0 and <= 2^46")
+	}
+
+	now := db.now()
+	var expireAt time.Time
+	switch {
+	case absolute && unit == time.Second:
+		expireAt = time.Unix(amount, 0)
+	case absolute:
+		expireAt = time.UnixMilli(amount)
+	default:
+		expireAt = now.Add(time.Duration(amount) * unit)
+	}
+
+	rest := args[2:]
+	condition := ""
+	switch cond := strings.ToUpper(string(rest[0])); cond {
+	case "NX", "XX", "GT", "LT":
+		condition = cond
+		rest = rest[1:]
+	}
+	fields, err := parseHashFields(rest)
+	if err != nil {
+		return nil, err
+	}
+
+	hash, err := db.getHash(key)
+	if err != nil {
+		return nil, err
+	}
+	if hash == nil {
+		return fieldCodes(fields, fieldNoSuchField), nil
+	}
+
+	result := make([][]byte, len(fields))
+	changed, deleted := false, false
+	for i, field := range fields {
+		code := fieldUpdated
+		current, hasTTL := hash.FieldExpireTime(field)
+		switch {
+		case !hash.Exists(field):
+			code = fieldNoSuchField
+		case !fieldConditionMet(condition, current, hasTTL, expireAt):
+			code = fieldConditionNotMet
+		case !expireAt.After(now):
+			hash.Remove(field)
+			code = fieldDeleted
+			deleted = true
+		default:
+			hash.SetFieldExpire(field, expireAt)
+			changed = true
+		}
+		result[i] = []byte(strconv.Itoa(code))
+	}
+
+	if deleted && hash.Len() == 0 {
+		db.Remove(key)
+		return result, nil
+	}
+	if changed || deleted {
+		db.touchKey(key)
+	}
+	if changed {
+		db.scheduleFieldExpiry(key, hash)
+	}
+	return result, nil
+}
+
+// fieldConditionMet checks an NX/XX/GT/LT condition against a field's current
+// expiration time; a field without TTL counts as never expiring
+func fieldConditionMet(condition string, current time.Time, hasTTL bool, expireAt time.Time) bool {
+	switch condition {
+	case "NX":
+		return !hasTTL
+	case "XX":
+		return hasTTL
+	case "GT":
+		return hasTTL && expireAt.After(current)
+	case "LT":
+		return !hasTTL || expireAt.Before(current)
+	}
+	return true
+}
+
+// execHPersist implements HPERSIST key FIELDS numfields field...
+func execHPersist(db *DB, args [][]byte) ([][]byte, error) {
+	if len(args) < 3 {
+		return nil, errWrongArgs("hpersist")
+	}
+
+	key := string(args[0])
+	fields, err := parseHashFields(args[1:])
+	if err != nil {
+		return nil, err
+	}
+
+	hash, err := db.getHash(key)
+	if err != nil {
+		return nil, err
+	}
+	if hash == nil {
+		return fieldCodes(fields, fieldNoSuchField), nil
+	}
+
+	result := make([][]byte, len(fields))
+	changed := false
+	for i, field := range fields {
+		code := fieldNoTTL
+		if !hash.Exists(field) {
+			code = fieldNoSuchField
+		} else if hash.PersistField(field) {
+			code = fieldUpdated
+			changed = true
+		}
+		result[i] = []byte(strconv.Itoa(code))
+	}
+
+	if changed {
+		db.touchKey(key)
+	}
+	return result, nil
+}
+
+// execHTTL implements HTTL key FIELDS numfields field...
+func execHTTL(db *DB, args [][]byte) ([][]byte, error) {
+	return hashFieldTTL(db, args, "httl", time.Second)
+}
+
+// execHPTTL implements HPTTL key FIELDS numfields field...
+func execHPTTL(db *DB, args [][]byte) ([][]byte, error) {
+	return hashFieldTTL(db, args, "hpttl", time.Millisecond)
+}
+
+// hashFieldTTL returns the remaining TTL of hash fields counted in unit
+func hashFieldTTL(db *DB, args [][]byte, name string, unit time.Duration) ([][]byte, error) {
+	if len(args) < 3 {
+		return nil, errWrongArgs(name)
+	}
+
+	key := string(args[0])
+	fields, err := parseHashFields(args[1:])
+	if err != nil {
+		return nil, err
+	}
+
+	hash, err := db.getHash(key)
+	if err != nil {
+		return nil, err
+	}
+	if hash == nil {
+		return fieldCodes(fields, fieldNoSuchField), nil
+	}
+
+	result := make([][]byte, len(fields))
+	for i, field := range fields {
+		ttl := int64(fieldNoTTL)
+		if !hash.Exists(field) {
+			ttl = fieldNoSuchField
+		} else if expireAt, ok := hash.FieldExpireTime(field); ok {
+			ttl = int64(expireAt.Sub(db.now()) / unit)
+			if ttl < 0 {
+				ttl = 0
+			}
+		}
+		result[i] = []byte(strconv.FormatInt(ttl, 10))
+	}
+	return result, nil
+}
+
+// parseHashFields parses the "FIELDS numfields field..." tail of the hash
+// field TTL commands
+func parseHashFields(args [][]byte) ([]string, error) {
+	if len(args) < 2 || !strings.EqualFold(string(args[0]), "FIELDS") {
+		return nil, errors.New("ERR Mandatory argument FIELDS is missing or not at the right position")
+	}
+	numFields, err := strconv.Atoi(string(args[1]))
+	if err != nil || numFields <= 0 {
+		return nil, errors.New("ERR Parameter `numFields` should be greater than 0")
+	}
+	if numFields != len(args)-2 {
+		return nil, errors.New("ERR The `numfields` parameter must match the number of arguments")
+	}
+
+	fields := make([]string, numFields)
+	for i, field := range args[2:] {
+		fields[i] = string(field)
+	}
+	return fields, nil
+}
+
+// fieldCodes returns the same reply code for every field
+func fieldCodes(fields []string, code int) [][]byte {
+	result := make([][]byte, len(fields))
+	for i := range fields {
+		result[i] = []byte(strconv.Itoa(code))
+	}
+	return result
+}
+
+// getHash returns the hash stored at key, nil if the key does not exist
+func (db *DB) getHash(key string) (*datastruct.Hash, error) {
+	entity, ok := db.GetEntity(key)
+	if !ok || entity.Data == nil {
+		return nil, nil
+	}
+	hash, ok := entity.Data.(*datastruct.Hash)
+	if !ok {
+		return nil, ErrWrongType
+	}
+	return hash, nil
+}
+
+// HashFieldExpireTime returns the expiration time of a hash field. The second
+// result is false if the field does not exist or has no TTL.
+func (db *DB) HashFieldExpireTime(key, field string) (time.Time, bool) {
+	hash, err := db.getHash(key)
+	if err != nil || hash == nil || !hash.Exists(field) {
+		return time.Time{}, false
+	}
+	return hash.FieldExpireTime(field)
+}
+
+// HashFieldExists reports whether a live hash field exists
+func (db *DB) HashFieldExists(key, field string) bool {
+	hash, err := db.getHash(key)
+	return err == nil && hash != nil && hash.Exists(field)
+}
+
+// expireHashFields removes the expired fields of a hash and reports whether
+// the key is gone as a result. On a replica fields are only hidden; they are
+// deleted when the master's HDEL arrives.
+func (db *DB) expireHashFields(key string, hash *datastruct.Hash) bool {
+	if db.IsReplica() {
+		return hash.Len() == 0
+	}
+
+	fields := hash.ExpireFields(db.now())
+	if len(fields) == 0 {
+		return false
+	}
+
+	db.touchKey(key)
+	for _, field := range fields {
+		db.notifyHashFieldExpired(key, field)
+	}
+	if hash.Len() == 0 {
+		db.Remove(key)
+		return true
+	}
+	return false
+}
+
+// scheduleFieldExpiry adds a hash to the field wheel for its earliest field
+// expiration
+func (db *DB) scheduleFieldExpiry(key string, hash *datastruct.Hash) {
+	next, ok := hash.NextFieldExpiry()
+	if !ok {
+		return
+	}
+	delay := next.Sub(db.now())
+	if delay < time.Millisecond {
+		delay = time.Millisecond
+	}
+	db.fieldWheel.Add(key, delay)
+}
+
+// expireHashFieldsFromWheel is called by the field wheel when a hash may
+// have expired fields. It runs inside the wheel's tick, so rescheduling is
+// done from another goroutine.
+func (db *DB) expireHashFieldsFromWheel(key string) {
+	if db.IsReplica() {
+		return
+	}
+
+	entity, ok := db.getEntityWithoutExpiryCheck(key)
+	if !ok {
+		return
+	}
+	hash, ok := entity.Data.(*datastruct.Hash)
+	if !ok {
+		return
+	}
+
+	if !db.expireHashFields(key, hash) {
+		// The wheel only covers a few seconds, so far expirations fire early
+		go db.scheduleFieldExpiry(key, hash)
+	}
+}
+
+// SetHashFieldExpireCallback registers fn to be called with every hash field
+// the database expires, so the deletion can be written to the AOF and sent
+// to replicas
+func (db *DB) SetHashFieldExpireCallback(fn func(key, field string)) {
+	db.fieldExpireCallback.Store(fn)
+}
+
+// notifyHashFieldExpired calls the hash field expire callback, if any
+func (db *DB) notifyHashFieldExpired(key, field string) {
+	if fn, ok := db.fieldExpireCallback.Load().(func(key, field string)); ok && fn != nil {
+		fn(key, field)
+	}
+}
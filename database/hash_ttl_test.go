@@ -0,0 +1,207 @@
+package database
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// execCodes runs a command and returns its integer array reply
+func execCodes(t *testing.T, db *DB, cmd string, args ...string) []int64 {
+	t.Helper()
+	result, err := db.ExecCommand(cmd, args...)
+	if err != nil {
+		t.Fatalf("%s %v failed: %v", cmd, args, err)
+	}
+	codes := make([]int64, len(result))
+	for i, r := range result {
+		codes[i], err = strconv.ParseInt(string(r), 10, 64)
+		if err != nil {
+			t.Fatalf("%s %v: non-integer reply %q", cmd, args, r)
+		}
+	}
+	return codes
+}
+
+func codesEqual(got []int64, want ...int64) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestHashFieldExpiresBetweenHSetAndHGet(t *testing.T) {
+	db := MakeDB()
+	defer db.Close()
+
+	db.ExecCommand("HSET", "h", "short", "1")
+	db.ExecCommand("HSET", "h", "long", "2")
+	if codes := execCodes(t, db, "HPEXPIRE", "h", "30", "FIELDS", "1", "short"); !codesEqual(codes, 1) {
+		t.Fatalf("Expected HPEXPIRE to return [1], got %v", codes)
+	}
+
+	if result, _ := db.ExecCommand("HGET", "h", "short"); string(result[0]) != "1" {
+		t.Errorf("Field should still be readable before it expires, got %q", result[0])
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	if result, _ := db.ExecCommand("HGET", "h", "short"); result[0] != nil {
+		t.Errorf("Expired field should read as nil, got %q", result[0])
+	}
+	if result, _ := db.ExecCommand("HEXISTS", "h", "short"); string(result[0]) != "0" {
+		t.Error("Expired field should not exist")
+	}
+	if result, _ := db.ExecCommand("HGET", "h", "long"); string(result[0]) != "2" {
+		t.Errorf("Field without TTL should be kept, got %q", result[0])
+	}
+}
+
+func TestHashFieldTTLFiltersHGetAll(t *testing.T) {
+	db := MakeDB()
+	defer db.Close()
+
+	db.ExecCommand("HMSET", "h", "a", "1", "b", "2", "c", "3")
+	execCodes(t, db, "HPEXPIRE", "h", "20", "FIELDS", "2", "a", "c")
+
+	// Stop the field wheel so that only lazy expiry can remove the fields
+	db.fieldWheel.Stop()
+	time.Sleep(40 * time.Millisecond)
+
+	result, _ := db.ExecCommand("HGETALL", "h")
+	if len(result) != 2 || string(result[0]) != "b" || string(result[1]) != "2" {
+		t.Errorf("HGETALL should only return the live field, got %q", result)
+	}
+	if result, _ := db.ExecCommand("HLEN", "h"); string(result[0]) != "1" {
+		t.Errorf("Expected HLEN 1, got %s", result[0])
+	}
+	if keys, _ := db.ExecCommand("HKEYS", "h"); len(keys) != 1 || string(keys[0]) != "b" {
+		t.Errorf("Expected HKEYS [b], got %q", keys)
+	}
+}
+
+func TestHashFieldTTLLastFieldDeletesKey(t *testing.T) {
+	db := MakeDB()
+	defer db.Close()
+
+	var mu sync.Mutex
+	var expired []string
+	db.SetHashFieldExpireCallback(func(key, field string) {
+		mu.Lock()
+		expired = append(expired, key+"."+field)
+		mu.Unlock()
+	})
+
+	db.ExecCommand("HMSET", "h", "a", "1", "b", "2")
+	execCodes(t, db, "HPEXPIRE", "h", "20", "FIELDS", "2", "a", "b")
+
+	// The field wheel removes the fields without the key being accessed
+	deadline := time.Now().Add(time.Second)
+	for db.data.Len() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Hash should be deleted when its last field expires")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if db.Exists("h") {
+		t.Error("Hash should not exist after its last field expired")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(expired) != 2 {
+		t.Errorf("Expected both fields reported as expired, got %v", expired)
+	}
+}
+
+func TestHashFieldTTLCommands(t *testing.T) {
+	db := MakeDB()
+	defer db.Close()
+
+	db.ExecCommand("HMSET", "h", "a", "1", "b", "2", "c", "3")
+
+	for _, tc := range []struct {
+		cmd  []string
+		want []int64
+	}{
+		{[]string{"HTTL", "h", "FIELDS", "2", "a", "nosuch"}, []int64{-1, -2}},
+		{[]string{"HEXPIRE", "nokey", "100", "FIELDS", "1", "a"}, []int64{-2}},
+		{[]string{"HEXPIRE", "h", "100", "XX", "FIELDS", "1", "a"}, []int64{0}},
+		{[]string{"HEXPIRE", "h", "100", "NX", "FIELDS", "2", "a", "b"}, []int64{1, 1}},
+		{[]string{"HEXPIRE", "h", "200", "NX", "FIELDS", "1", "a"}, []int64{0}},
+		{[]string{"HEXPIRE", "h", "50", "GT", "FIELDS", "1", "a"}, []int64{0}},
+		{[]string{"HEXPIRE", "h", "200", "GT", "FIELDS", "2", "a", "c"}, []int64{1, 0}},
+		{[]string{"HEXPIRE", "h", "50", "LT", "FIELDS", "2", "a", "c"}, []int64{1, 1}},
+		{[]string{"HTTL", "h", "FIELDS", "3", "a", "b", "c"}, []int64{49, 99, 49}},
+		{[]string{"HPERSIST", "h", "FIELDS", "3", "a", "nosuch", "a"}, []int64{1, -2, -1}},
+		{[]string{"HPEXPIREAT", "h", "1", "FIELDS", "1", "b"}, []int64{2}},
+		{[]string{"HEXISTS", "h", "b"}, []int64{0}},
+	} {
+		got := execCodes(t, db, tc.cmd[0], tc.cmd[1:]...)
+		// TTLs count down between commands, allow one unit less
+		if strings.HasSuffix(tc.cmd[0], "TTL") && len(got) == len(tc.want) {
+			for i := range got {
+				if tc.want[i] > 0 && got[i] == tc.want[i]-1 {
+					got[i] = tc.want[i]
+				}
+			}
+		}
+		if !codesEqual(got, tc.want...) {
+			t.Errorf("%v: expected %v, got %v", tc.cmd, tc.want, got)
+		}
+	}
+
+	// Overwriting a field clears its TTL
+	execCodes(t, db, "HEXPIRE", "h", "100", "FIELDS", "1", "c")
+	db.ExecCommand("HSET", "h", "c", "new")
+	if codes := execCodes(t, db, "HTTL", "h", "FIELDS", "1", "c"); !codesEqual(codes, -1) {
+		t.Errorf("HSET should clear the field TTL, got %v", codes)
+	}
+
+	for _, args := range [][]string{
+		{"h", "100", "FIELDS", "2", "a"},
+		{"h", "100", "FIELDS", "0"},
+		{"h", "100", "a"},
+		{"h", "-1", "FIELDS", "1", "a"},
+	} {
+		if _, err := db.ExecCommand("HEXPIRE", args...); err == nil {
+			t.Errorf("HEXPIRE %v should fail", args)
+		}
+	}
+
+	db.ExecCommand("SET", "str", "v")
+	if _, err := db.ExecCommand("HTTL", "str", "FIELDS", "1", "a"); err == nil || !strings.HasPrefix(err.Error(), "WRONGTYPE") {
+		t.Errorf("Expected WRONGTYPE, got %v", err)
+	}
+}
+
+func TestHashFieldTTLRebuildCommands(t *testing.T) {
+	db := MakeDB()
+	defer db.Close()
+
+	db.ExecCommand("HMSET", "h", "a", "1", "b", "2")
+	execCodes(t, db, "HEXPIRE", "h", "100", "FIELDS", "1", "a")
+
+	entity, _ := db.GetEntity("h")
+	target := MakeDB()
+	defer target.Close()
+	for _, cmd := range RebuildCommands("h", entity) {
+		if _, err := target.Exec(cmd); err != nil {
+			t.Fatalf("Replaying %q failed: %v", cmd, err)
+		}
+	}
+
+	want, _ := db.HashFieldExpireTime("h", "a")
+	got, ok := target.HashFieldExpireTime("h", "a")
+	if !ok || got.UnixMilli() != want.UnixMilli() {
+		t.Errorf("Expected field TTL %v to be rebuilt, got %v", want, got)
+	}
+	if _, ok := target.HashFieldExpireTime("h", "b"); ok {
+		t.Error("Field without TTL should not get one")
+	}
+}
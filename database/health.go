@@ -0,0 +1,151 @@
+package database
+
+import (
+	"errors"
+	"strings"
+	"time"
+)
+
+// Health checks
+//
+// PING only shows that the server accepts connections. Load balancers need
+// to know whether the node can serve: HEALTHCHECK replies +OK only when it
+// is not loading a dataset, from disk or from its master, its last AOF write
+// succeeded, and, unless healthcheck-maxmemory is off, it uses no more than
+// maxmemory; otherwise it replies with an error naming every failed
+// condition. The server serves the same check over HTTP on /healthz when
+// health-port is set. Both, like INFO, read the node's Status.
+
+// Status is the state of the node reported by INFO and checked by the health
+// checks
+type Status struct {
+	Loading        bool // Loading the dataset from disk or from the master
+	AOFLastWriteOK bool // The last write to the AOF succeeded
+	// The last AOF rewrite succeeded; the health checks ignore it, since the
+	// AOF is still appended to
+	AOFLastRewriteOK bool
+	UsedMemory       int64
+	MaxMemory        int64 // 0 for no limit
+}
+
+// Status returns the current state of the node
+func (db *DB) Status() Status {
+	return Status{
+		Loading:          db.IsLoading(),
+		AOFLastWriteOK:   !db.aofWriteFailed.Load(),
+		AOFLastRewriteOK: !db.aofRewriteFailed.Load(),
+		UsedMemory:       db.GetUsedMemory(),
+		MaxMemory:        db.config.MaxMemory,
+	}
+}
+
+// Problems returns the reasons a node in this state should fail health
+// checks, none if it is healthy. The memory is only checked if checkMemory
+// is set.
+func (s Status) Problems(checkMemory bool) []string {
+	var problems []string
+	if s.Loading {
+		problems = append(problems, "loading the dataset")
+	}
+	if !s.AOFLastWriteOK {
+		problems = append(problems, "last AOF write failed")
+	}
+	if checkMemory && s.MaxMemory > 0 && s.UsedMemory > s.MaxMemory {
+		problems = append(problems, "used memory above maxmemory")
+	}
+	return problems
+}
+
+// CheckHealth returns an error naming what makes the node unable to serve,
+// nil if it is healthy
+func (db *DB) CheckHealth() error {
+	problems := db.Status().Problems(db.config.HealthCheckMaxMemory)
+	if len(problems) == 0 {
+		return nil
+	}
+	return errors.New("ERR unhealthy: " + strings.Join(problems, ", "))
+}
+
+// RecordAOFWrite records the outcome of a write to the AOF, reported by INFO
+// as aof_last_write_status; a failed write fails the health checks until a
+// write succeeds
+func (db *DB) RecordAOFWrite(err error) {
+	if err != nil {
+		db.aofWriteError.Store(err.Error())
+	}
+	db.aofWriteFailed.Store(err != nil)
+}
+
+// RecordAOFRewrite records the outcome of an AOF rewrite, reported by INFO
+// as aof_last_bgrewrite_status
+func (db *DB) RecordAOFRewrite(err error) {
+	db.aofRewriteFailed.Store(err != nil)
+}
+
+// AOFStats describes the AOF writer, for INFO persistence and /metrics
+type AOFStats struct {
+	BufferLength int64 // Bytes of commands queued and not written yet
+	CurrentSize  int64 // Size of the AOF file
+	WrittenBytes int64 // Bytes written to the AOF since it was opened
+}
+
+// SetAOFStatsCallback registers fn to describe the AOF writer, or to return
+// false without an AOF
+func (db *DB) SetAOFStatsCallback(fn func() (AOFStats, bool)) {
+	db.aofStatsCallback.Store(fn)
+}
+
+// AOFStats describes the AOF writer; ok is false without an AOF
+func (db *DB) AOFStats() (stats AOFStats, ok bool) {
+	fn, _ := db.aofStatsCallback.Load().(func() (AOFStats, bool))
+	if fn == nil {
+		return AOFStats{}, false
+	}
+	return fn()
+}
+
+// aofRetryInterval is the least time between two retries of a failed AOF
+// write by the writes stop-writes-on-aof-error refuses
+const aofRetryInterval = time.Second
+
+// SetAOFRetryCallback registers fn to write again what the last failed AOF
+// write could not; its error is recorded with RecordAOFWrite
+func (db *DB) SetAOFRetryCallback(fn func() error) {
+	db.aofRetryCallback.Store(fn)
+}
+
+// aofWritable reports whether the last AOF write succeeded. Otherwise, at
+// most once per aofRetryInterval, it retries the write first, as Redis does
+// from its cron: with stop-writes-on-aof-error, no write reaches the AOF
+// until then.
+func (db *DB) aofWritable() bool {
+	if !db.aofWriteFailed.Load() {
+		return true
+	}
+	fn, ok := db.aofRetryCallback.Load().(func() error)
+	last := db.aofLastRetry.Load()
+	now := time.Now().UnixNano()
+	if !ok || fn == nil || now-last < int64(aofRetryInterval) || !db.aofLastRetry.CompareAndSwap(last, now) {
+		return false
+	}
+	err := fn()
+	db.RecordAOFWrite(err)
+	return err == nil
+}
+
+// errAOFWrite returns the error refusing writes after a failed AOF write
+func (db *DB) errAOFWrite() error {
+	msg, _ := db.aofWriteError.Load().(string)
+	return errors.New("MISCONF Errors writing to the AOF file: " + msg)
+}
+
+// execHealthCheck implements HEALTHCHECK
+func execHealthCheck(db *DB, args [][]byte) (Result, error) {
+	if len(args) != 0 {
+		return nil, errWrongArgs("healthcheck")
+	}
+	if err := db.CheckHealth(); err != nil {
+		return nil, err
+	}
+	return StatusResult("OK"), nil
+}
@@ -0,0 +1,76 @@
+package database
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Command help and error formats
+//
+// The formats below follow Redis closely because clients parse them:
+// redis-cli, for instance, builds its interactive help from the HELP
+// subcommand of container commands (MEMORY, SLOWLOG, OBJECT, ...).
+
+// maxErrorArgsLen bounds how much of the arguments is quoted in an unknown
+// command error
+const maxErrorArgsLen = 128
+
+// errUnknownCommand returns the error for a command line whose command does
+// not exist, quoting the command and the beginning of its arguments
+func errUnknownCommand(cmdLine [][]byte) error {
+	var args strings.Builder
+	for _, arg := range cmdLine[1:] {
+		if args.Len() >= maxErrorArgsLen {
+			break
+		}
+		quoted := arg
+		if room := maxErrorArgsLen - args.Len(); len(quoted) > room {
+			quoted = quoted[:room]
+		}
+		fmt.Fprintf(&args, "'%s' ", quoted)
+	}
+	return fmt.Errorf("ERR unknown command '%s', with args beginning with: %s",
+		truncateErrorArg(cmdLine[0]), sanitizeErrorArg(args.String()))
+}
+
+// ErrUnknownCommand returns the error replied to a command line whose
+// command does not exist, for the server to refuse commands itself
+func ErrUnknownCommand(cmdLine [][]byte) error {
+	return errUnknownCommand(cmdLine)
+}
+
+// errUnknownSubcommand returns the error for an unknown subcommand, or a known
+// one called with the wrong number of arguments
+func errUnknownSubcommand(cmd string, subCmd []byte) error {
+	return fmt.Errorf("ERR unknown subcommand or wrong number of arguments for '%s'. Try %s HELP.",
+		truncateErrorArg(subCmd), strings.ToUpper(cmd))
+}
+
+// subcommandHelp returns the reply to "<cmd> HELP". Each usage line is
+// followed by its indented description; the HELP entry itself is added.
+func subcommandHelp(cmd string, lines ...string) [][]byte {
+	result := make([][]byte, 0, len(lines)+3)
+	result = append(result, []byte(strings.ToUpper(cmd)+" <subcommand> [<arg> [value] [opt] ...]. Subcommands are:"))
+	for _, line := range lines {
+		result = append(result, []byte(line))
+	}
+	return append(result, []byte("HELP"), []byte("    Print this help."))
+}
+
+// isHelpSubcommand reports whether args is a bare HELP subcommand
+func isHelpSubcommand(args [][]byte) bool {
+	return len(args) == 1 && strings.EqualFold(string(args[0]), "HELP")
+}
+
+// truncateErrorArg shortens an argument quoted in an error message
+func truncateErrorArg(arg []byte) string {
+	if len(arg) > maxErrorArgsLen {
+		arg = arg[:maxErrorArgsLen]
+	}
+	return sanitizeErrorArg(string(arg))
+}
+
+// sanitizeErrorArg replaces line breaks, which would end a RESP error reply
+func sanitizeErrorArg(s string) string {
+	return strings.NewReplacer("\r", " ", "\n", " ").Replace(s)
+}
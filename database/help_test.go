@@ -0,0 +1,65 @@
+package database
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestUnknownCommandError(t *testing.T) {
+	db := MakeDB()
+	defer db.Close()
+
+	for _, tc := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"foo"}, "ERR unknown command 'foo', with args beginning with: "},
+		{[]string{"Foo", "arg1", "arg2"}, "ERR unknown command 'Foo', with args beginning with: 'arg1' 'arg2' "},
+		{[]string{"foo", "a\r\nb"}, "ERR unknown command 'foo', with args beginning with: 'a  b' "},
+		{[]string{"foo", strings.Repeat("x", 200), "next"}, "ERR unknown command 'foo', with args beginning with: '" + strings.Repeat("x", 128) + "' "},
+	} {
+		cmdLine := make([][]byte, len(tc.args))
+		for i, arg := range tc.args {
+			cmdLine[i] = []byte(arg)
+		}
+		_, err := db.Exec(cmdLine)
+		if err == nil || err.Error() != tc.want {
+			t.Errorf("%q: expected error %q, got %v", tc.args, tc.want, err)
+		}
+	}
+}
+
+func TestSubcommandHelpAndErrors(t *testing.T) {
+	db := MakeDB()
+	defer db.Close()
+
+	for _, cmd := range []string{"MEMORY", "SLOWLOG", "OBJECT"} {
+		result, err := db.ExecCommand(cmd, "help")
+		if err != nil {
+			t.Fatalf("%s HELP failed: %v", cmd, err)
+		}
+		want := cmd + " <subcommand> [<arg> [value] [opt] ...]. Subcommands are:"
+		if len(result) < 3 || string(result[0]) != want {
+			t.Fatalf("%s HELP: expected header %q, got %q", cmd, want, result)
+		}
+		if string(result[len(result)-2]) != "HELP" || string(result[len(result)-1]) != "    Print this help." {
+			t.Errorf("%s HELP should end with the HELP entry, got %q", cmd, result[len(result)-2:])
+		}
+	}
+
+	for _, tc := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"MEMORY", "nosuch"}, "ERR unknown subcommand or wrong number of arguments for 'nosuch'. Try MEMORY HELP."},
+		{[]string{"MEMORY", "usage"}, "ERR unknown subcommand or wrong number of arguments for 'usage'. Try MEMORY HELP."},
+		{[]string{"slowlog", "nosuch"}, "ERR unknown subcommand or wrong number of arguments for 'nosuch'. Try SLOWLOG HELP."},
+		{[]string{"OBJECT", "encoding"}, "ERR unknown subcommand or wrong number of arguments for 'encoding'. Try OBJECT HELP."},
+		{[]string{"OBJECT", "help", "extra"}, "ERR unknown subcommand or wrong number of arguments for 'help'. Try OBJECT HELP."},
+	} {
+		_, err := db.ExecCommand(tc.args[0], tc.args[1:]...)
+		if err == nil || err.Error() != tc.want {
+			t.Errorf("%q: expected error %q, got %v", tc.args, tc.want, err)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package database
+
+import (
+	"strconv"
+
+	"github.com/wangbo/gocache/datastruct"
+)
+
+// HyperLogLog command implementations
+//
+// HyperLogLogs are String values (see datastruct/hyperloglog.go), so they
+// are persisted, replicated and migrated like any other string. PFADD
+// updates dense values in place, so the HyperLogLog commands are registered
+// through hllCommand to run one at a time.
+
+// hllCommand wraps a HyperLogLog command executor to hold db.hllMu
+func hllCommand(fn func(db *DB, args [][]byte) ([][]byte, error)) func(db *DB, args [][]byte) ([][]byte, error) {
+	return func(db *DB, args [][]byte) ([][]byte, error) {
+		db.hllMu.Lock()
+		defer db.hllMu.Unlock()
+		return fn(db, args)
+	}
+}
+
+// getHyperLogLog returns the HyperLogLog stored at key, nil if the key does
+// not exist
+func (db *DB) getHyperLogLog(key string) (*datastruct.String, error) {
+	entity, ok := db.GetEntity(key)
+	if !ok || entity.Data == nil {
+		return nil, nil
+	}
+	str, ok := entity.Data.(*datastruct.String)
+	if !ok {
+		return nil, ErrWrongType
+	}
+	if !datastruct.IsHyperLogLog(str.Get()) {
+		return nil, datastruct.ErrNotHyperLogLog
+	}
+	return str, nil
+}
+
+// execPFAdd implements PFADD key [element ...]
+// It returns 1 if the key was created or a register changed, 0 otherwise.
+func execPFAdd(db *DB, args [][]byte) ([][]byte, error) {
+	if len(args) < 1 {
+		return nil, errWrongArgs("pfadd")
+	}
+
+	key := string(args[0])
+	str, err := db.getHyperLogLog(key)
+	if err != nil {
+		return nil, err
+	}
+
+	created := str == nil
+	hll := datastruct.NewHyperLogLog()
+	if !created {
+		hll = str.Get()
+	}
+	hll, changed, err := datastruct.HLLAdd(hll, args[1:])
+	if err != nil {
+		return nil, err
+	}
+	if !created && !changed {
+		return zeroResponse, nil
+	}
+
+	if created {
+		db.PutEntity(key, datastruct.MakeString(hll))
+	} else {
+		str.Set(hll)
+	}
+	return oneResponse, nil
+}
+
+// execPFCount implements PFCOUNT key [key ...]
+// With several keys it returns the estimated cardinality of their union.
+func execPFCount(db *DB, args [][]byte) ([][]byte, error) {
+	if len(args) < 1 {
+		return nil, errWrongArgs("pfcount")
+	}
+
+	hlls := make([][]byte, 0, len(args))
+	for _, key := range args {
+		str, err := db.getHyperLogLog(string(key))
+		if err != nil {
+			return nil, err
+		}
+		if str != nil {
+			hlls = append(hlls, str.Get())
+		}
+	}
+	if len(hlls) == 0 {
+		return zeroResponse, nil
+	}
+
+	count, err := datastruct.HLLCount(hlls...)
+	if err != nil {
+		return nil, err
+	}
+	return [][]byte{[]byte(strconv.FormatUint(count, 10))}, nil
+}
+
+// execPFMerge implements PFMERGE destkey [sourcekey ...]
+// The destination is merged with the sources, and created if it is missing.
+func execPFMerge(db *DB, args [][]byte) ([][]byte, error) {
+	if len(args) < 1 {
+		return nil, errWrongArgs("pfmerge")
+	}
+
+	hlls := make([][]byte, 0, len(args))
+	for _, key := range args {
+		str, err := db.getHyperLogLog(string(key))
+		if err != nil {
+			return nil, err
+		}
+		if str != nil {
+			hlls = append(hlls, str.Get())
+		}
+	}
+
+	merged, err := datastruct.HLLMerge(hlls...)
+	if err != nil {
+		return nil, err
+	}
+	db.PutEntity(string(args[0]), datastruct.MakeString(merged))
+	return okResponse, nil
+}
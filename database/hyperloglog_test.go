@@ -0,0 +1,146 @@
+package database
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestPFAddAndPFCount(t *testing.T) {
+	db := MakeDB()
+	defer db.Close()
+
+	for _, tc := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"PFADD", "h"}, "1"},
+		{[]string{"PFADD", "h"}, "0"},
+		{[]string{"PFCOUNT", "h"}, "0"},
+		{[]string{"PFADD", "h", "a", "b", "c"}, "1"},
+		{[]string{"PFADD", "h", "a", "b"}, "0"},
+		{[]string{"PFCOUNT", "h"}, "3"},
+		{[]string{"PFCOUNT", "missing"}, "0"},
+	} {
+		result, err := db.ExecCommand(tc.args[0], tc.args[1:]...)
+		if err != nil {
+			t.Fatalf("%v failed: %v", tc.args, err)
+		}
+		if string(result[0]) != tc.want {
+			t.Errorf("%v: expected %s, got %s", tc.args, tc.want, result[0])
+		}
+	}
+
+	if result, _ := db.ExecCommand("TYPE", "h"); string(result[0]) != "string" {
+		t.Errorf("A HyperLogLog should be a string, got %s", result[0])
+	}
+}
+
+func TestPFCountEstimatesLargeCardinalities(t *testing.T) {
+	db := MakeDB()
+	defer db.Close()
+
+	const n = 20000
+	args := make([]string, 0, 1000)
+	for i := 0; i < n; i++ {
+		args = append(args, "element:"+strconv.Itoa(i))
+		if len(args) == cap(args) {
+			db.ExecCommand("PFADD", append([]string{"h"}, args...)...)
+			args = args[:0]
+		}
+	}
+
+	result, err := db.ExecCommand("PFCOUNT", "h")
+	if err != nil {
+		t.Fatalf("PFCOUNT failed: %v", err)
+	}
+	count, _ := strconv.Atoi(string(result[0]))
+	if count < n*98/100 || count > n*102/100 {
+		t.Errorf("Expected about %d, got %d", n, count)
+	}
+}
+
+func TestPFMergeAndMultiKeyPFCount(t *testing.T) {
+	db := MakeDB()
+	defer db.Close()
+
+	db.ExecCommand("PFADD", "h1", "a", "b", "c")
+	db.ExecCommand("PFADD", "h2", "c", "d")
+	db.ExecCommand("PFADD", "dst", "e")
+
+	if result, _ := db.ExecCommand("PFCOUNT", "h1", "h2", "missing"); string(result[0]) != "4" {
+		t.Errorf("Expected the union of 4 elements, got %s", result[0])
+	}
+	if result, err := db.ExecCommand("PFMERGE", "dst", "h1", "h2"); err != nil || string(result[0]) != "OK" {
+		t.Fatalf("PFMERGE failed: %q %v", result, err)
+	}
+	if result, _ := db.ExecCommand("PFCOUNT", "dst"); string(result[0]) != "5" {
+		t.Errorf("Expected the merged destination to hold 5 elements, got %s", result[0])
+	}
+	if result, _ := db.ExecCommand("PFMERGE", "new", "missing"); string(result[0]) != "OK" {
+		t.Errorf("PFMERGE should create an empty destination, got %q", result)
+	}
+	if result, _ := db.ExecCommand("PFCOUNT", "new"); string(result[0]) != "0" {
+		t.Errorf("Expected an empty HyperLogLog, got %s", result[0])
+	}
+}
+
+func TestHyperLogLogRejectsOtherValues(t *testing.T) {
+	db := MakeDB()
+	defer db.Close()
+
+	db.ExecCommand("SET", "str", "value")
+	db.ExecCommand("RPUSH", "list", "a")
+	db.ExecCommand("PFADD", "h", "a")
+
+	for _, tc := range []struct {
+		args    []string
+		wantErr string
+	}{
+		{[]string{"PFADD", "str", "a"}, "WRONGTYPE Key is not a valid HyperLogLog string value."},
+		{[]string{"PFCOUNT", "h", "str"}, "WRONGTYPE Key is not a valid HyperLogLog string value."},
+		{[]string{"PFMERGE", "h", "str"}, "WRONGTYPE Key is not a valid HyperLogLog string value."},
+		{[]string{"PFADD", "list", "a"}, "WRONGTYPE Operation against a key holding the wrong kind of value"},
+		{[]string{"PFADD"}, "ERR wrong number of arguments"},
+	} {
+		_, err := db.ExecCommand(tc.args[0], tc.args[1:]...)
+		if err == nil || !strings.HasPrefix(err.Error(), tc.wantErr) {
+			t.Errorf("%v: expected error %q, got %v", tc.args, tc.wantErr, err)
+		}
+	}
+
+	// A sparse HyperLogLog whose opcodes do not cover every register is
+	// detected when decoded
+	db.ExecCommand("SET", "corrupt", "HYLL\x01"+strings.Repeat("\x00", 11)+"\x00")
+	if _, err := db.ExecCommand("PFADD", "corrupt", "a"); err == nil || !strings.HasPrefix(err.Error(), "INVALIDOBJ") {
+		t.Errorf("Expected a corrupted HyperLogLog error, got %v", err)
+	}
+}
+
+func TestHyperLogLogRebuild(t *testing.T) {
+	db := MakeDB()
+	defer db.Close()
+
+	db.ExecCommand("PFADD", "h", "a", "b", "c")
+	entity, ok := db.GetEntity("h")
+	if !ok {
+		t.Fatal("Expected the HyperLogLog to exist")
+	}
+	cmds := RebuildCommands("h", entity)
+	if len(cmds) != 1 || string(cmds[0][0]) != "SET" {
+		t.Fatalf("Expected a single SET, got %q", cmds)
+	}
+
+	target := MakeDB()
+	defer target.Close()
+	args := make([]string, len(cmds[0])-1)
+	for i, arg := range cmds[0][1:] {
+		args[i] = string(arg)
+	}
+	if _, err := target.ExecCommand("SET", args...); err != nil {
+		t.Fatalf("SET failed: %v", err)
+	}
+	if result, _ := target.ExecCommand("PFCOUNT", "h"); string(result[0]) != "3" {
+		t.Errorf("Expected the rebuilt HyperLogLog to count 3, got %s", result[0])
+	}
+}
@@ -0,0 +1,62 @@
+package database
+
+import (
+	"errors"
+	"time"
+
+	"github.com/wangbo/gocache/datastruct"
+)
+
+// Idle time
+//
+// OBJECT IDLETIME returns the seconds since a key was last read or written.
+// Rather than a timestamp, every key keeps a 32-bit coarse clock, in seconds
+// since the database was created, which recordAccess updates on every read
+// and the write path on every write. The clock is only kept when
+// maxmemory-policy is an LRU policy or track-idle is set; otherwise OBJECT
+// IDLETIME fails as in Redis. It is not saved with the key: a loaded key has
+// been idle since it was loaded.
+
+// errIdleNotTracked is the error of OBJECT IDLETIME without idle tracking
+var errIdleNotTracked = errors.New("ERR An LRU maxmemory policy is not selected, access time not tracked. " +
+	"Please note that when switching between policies at runtime LRU and LFU data will take some time to adjust.")
+
+// initIdleTracking enables the access clock if the configuration asks for it
+func (db *DB) initIdleTracking() {
+	switch db.config.MaxMemoryPolicy {
+	case "allkeys-lru", "volatile-lru":
+		db.trackIdle = true
+	default:
+		db.trackIdle = db.config.TrackIdle
+	}
+	db.clockStart = db.now()
+}
+
+// accessClock returns the current value of the access clock
+func (db *DB) accessClock() uint32 {
+	elapsed := db.now().Sub(db.clockStart)
+	if elapsed < 0 {
+		// A clock set back by SetClock
+		return 0
+	}
+	return uint32(elapsed / time.Second)
+}
+
+// touchAccessClock records an access to entity, if idle time is tracked
+func (db *DB) touchAccessClock(entity *datastruct.DataEntity) {
+	if db.trackIdle && entity != nil {
+		entity.SetAccessClock(db.accessClock())
+	}
+}
+
+// objectIdleTime replies to OBJECT IDLETIME key
+func objectIdleTime(db *DB, key string) (Result, error) {
+	if !db.trackIdle {
+		return nil, errIdleNotTracked
+	}
+	entity, ok := db.peekEntity(key)
+	if !ok {
+		return NilResult{}, nil
+	}
+	return IntResult(db.accessClock() - entity.AccessClock()), nil
+}
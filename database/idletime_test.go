@@ -0,0 +1,101 @@
+package database
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/wangbo/gocache/config"
+	"github.com/wangbo/gocache/replication"
+	"github.com/wangbo/gocache/util/clock"
+)
+
+// makeIdleDB returns a database tracking idle time
+func makeIdleDB(t *testing.T, cfg *config.Properties) *DB {
+	t.Helper()
+	db := MakeDBWithConfig(cfg, replication.NewReplicationState())
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// idleTime returns OBJECT IDLETIME key
+func idleTime(t *testing.T, db *DB, key string) string {
+	t.Helper()
+	result, err := db.ExecCommand("OBJECT", "IDLETIME", key)
+	if err != nil {
+		t.Fatalf("OBJECT IDLETIME %s: %v", key, err)
+	}
+	return string(result[0])
+}
+
+func TestObjectIdleTimeRequiresTracking(t *testing.T) {
+	db := makeIdleDB(t, config.Default())
+	db.ExecCommand("SET", "k", "v")
+
+	_, err := db.ExecCommand("OBJECT", "IDLETIME", "k")
+	if err == nil || !strings.HasPrefix(err.Error(), "ERR An LRU maxmemory policy is not selected") {
+		t.Errorf("Expected the LRU policy error, got %v", err)
+	}
+	if entity, _ := db.GetEntity("k"); entity.AccessClock() != 0 {
+		t.Error("Expected no access clock while idle time is not tracked")
+	}
+
+	cfg := config.Default()
+	cfg.MaxMemoryPolicy = "allkeys-lru"
+	db = makeIdleDB(t, cfg)
+	db.ExecCommand("SET", "k", "v")
+	if got := idleTime(t, db, "k"); got != "0" {
+		t.Errorf("Expected idle time 0 with an LRU policy, got %s", got)
+	}
+}
+
+func TestObjectIdleTimeGrowsUntilAccess(t *testing.T) {
+	cfg := config.Default()
+	cfg.TrackIdle = true
+	db := makeIdleDB(t, cfg)
+	mc := clock.NewManual(time.Now())
+	db.SetClock(mc)
+
+	db.ExecCommand("SET", "k", "v")
+	db.ExecCommand("GET", "k")
+	mc.Advance(2100 * time.Millisecond)
+	if got := idleTime(t, db, "k"); got != "2" {
+		t.Fatalf("Expected idle time 2 after 2.1s, got %s", got)
+	}
+	// OBJECT itself is not an access
+	if got := idleTime(t, db, "k"); got == "0" {
+		t.Error("Expected OBJECT IDLETIME not to reset the idle time")
+	}
+
+	// Simulate the passing of time rather than sleeping more
+	advance := func() { db.clockStart = db.clockStart.Add(-100 * time.Second) }
+	for _, access := range [][]string{
+		{"GET", "k"},
+		{"SET", "k", "w"},
+		{"APPEND", "k", "x"},
+		{"STRLEN", "k"},
+		{"EXPIRE", "k", "1000"},
+		{"TOUCH", "k"},
+	} {
+		advance()
+		if got, _ := strconv.Atoi(idleTime(t, db, "k")); got < 100 {
+			t.Errorf("Expected idle time over 100 before %v, got %d", access, got)
+		}
+		if _, err := db.ExecCommand(access[0], access[1:]...); err != nil {
+			t.Fatalf("%v: %v", access, err)
+		}
+		if got := idleTime(t, db, "k"); got != "0" {
+			t.Errorf("Expected %v to reset the idle time, got %s", access, got)
+		}
+	}
+
+	advance()
+	db.ExecCommand("INCR", "counter")
+	if got := idleTime(t, db, "counter"); got != "0" {
+		t.Errorf("Expected a new counter to have idle time 0, got %s", got)
+	}
+	if result, _ := db.ExecCommand("OBJECT", "IDLETIME", "missing"); result[0] != nil {
+		t.Errorf("Expected nil for a missing key, got %q", result)
+	}
+}
@@ -0,0 +1,320 @@
+package database
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"math"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// INFO command implementation
+//
+// Each section is produced by its own builder. INFO with no argument (or
+// "default") returns the default sections, "all" and "everything" return
+// every section, and any other arguments select sections by name.
+
+// ServerInfo describes the running server process for the INFO server
+// section. It is created once at startup and never changes.
+type ServerInfo struct {
+	RunID      string // 40 random hex characters identifying this run
+	PID        int
+	StartTime  time.Time
+	ConfigFile string // Absolute path of the config file, "" if none
+	Executable string // Absolute path of the server binary
+}
+
+// NewServerInfo describes the current process, started now with the given
+// config file ("" or a missing file means none)
+func NewServerInfo(configFile string) *ServerInfo {
+	info := &ServerInfo{
+		RunID:     newRunID(),
+		PID:       os.Getpid(),
+		StartTime: time.Now(),
+	}
+	if configFile != "" {
+		if _, err := os.Stat(configFile); err == nil {
+			info.ConfigFile, _ = filepath.Abs(configFile)
+		}
+	}
+	if executable, err := os.Executable(); err == nil {
+		info.Executable = executable
+	}
+	return info
+}
+
+// newRunID returns a random run ID of 40 hex characters, as in Redis
+func newRunID() string {
+	id := make([]byte, 20)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// SetServerInfo sets the process description reported by INFO; MakeDB
+// starts with one describing a process without config file
+func (db *DB) SetServerInfo(info *ServerInfo) {
+	db.serverInfo = info
+}
+
+// ServerInfo returns the process description reported by INFO
+func (db *DB) ServerInfo() *ServerInfo {
+	return db.serverInfo
+}
+
+// SetTCPPort sets the port INFO reports as tcp_port, that the server
+// listens on, which may differ from the configured port 0
+func (db *DB) SetTCPPort(port int) {
+	db.tcpPort.Store(int32(port))
+}
+
+// tcpPortInfo returns the port the server listens on, or the configured port
+// until it does
+func (db *DB) tcpPortInfo() int {
+	if port := db.tcpPort.Load(); port != 0 {
+		return int(port)
+	}
+	return db.config.Port
+}
+
+// infoSection is a named INFO section builder
+type infoSection struct {
+	name      string
+	isDefault bool
+	build     func(db *DB, b *strings.Builder)
+}
+
+// infoSections lists the INFO sections in output order
+var infoSections = []infoSection{
+	{"server", true, infoServer},
+	{"clients", true, infoClients},
+	{"memory", true, infoMemory},
+	{"persistence", true, infoPersistence},
+	{"stats", true, infoStats},
+	{"replication", true, infoReplication},
+	{"cpu", true, infoCPU},
+	{"commandstats", false, infoCommandStats},
+	{"errorstats", true, infoErrorStats},
+	{"keyspace", true, infoKeyspace},
+}
+
+// execInfo executes INFO [section ...]
+func execInfo(db *DB, args [][]byte) ([][]byte, error) {
+	selected := make(map[string]bool)
+	for _, arg := range args {
+		selected[strings.ToLower(string(arg))] = true
+	}
+	all := selected["all"] || selected["everything"]
+	def := len(args) == 0 || selected["default"]
+
+	var b strings.Builder
+	for _, section := range infoSections {
+		if !all && !selected[section.name] && !(def && section.isDefault) {
+			continue
+		}
+		if b.Len() > 0 {
+			b.WriteString("\r\n")
+		}
+		// INFO everything pays for an exact avg_ttl
+		if section.name == "keyspace" && selected["everything"] {
+			writeKeyspace(db, &b, true)
+			continue
+		}
+		section.build(db, &b)
+	}
+
+	return [][]byte{[]byte(b.String())}, nil
+}
+
+// writeInfoHeader writes a section header line
+func writeInfoHeader(b *strings.Builder, title string) {
+	b.WriteString("# " + title + "\r\n")
+}
+
+// writeInfoField writes a single field:value line
+func writeInfoField(b *strings.Builder, field, value string) {
+	b.WriteString(field + ":" + value + "\r\n")
+}
+
+func infoServer(db *DB, b *strings.Builder) {
+	info := db.serverInfo
+	uptime := int64(db.now().Sub(info.StartTime).Seconds())
+
+	writeInfoHeader(b, "Server")
+	writeInfoField(b, "redis_version", "6.2.0")
+	writeInfoField(b, "go_cache_version", "1.0.0")
+	writeInfoField(b, "os", runtime.GOOS)
+	writeInfoField(b, "arch", runtime.GOARCH)
+	writeInfoField(b, "go_version", runtime.Version())
+	writeInfoField(b, "process_id", strconv.Itoa(info.PID))
+	writeInfoField(b, "run_id", info.RunID)
+	writeInfoField(b, "tcp_port", strconv.Itoa(db.tcpPortInfo()))
+	writeInfoField(b, "uptime_in_seconds", strconv.FormatInt(uptime, 10))
+	writeInfoField(b, "uptime_in_days", strconv.FormatInt(uptime/86400, 10))
+	writeInfoField(b, "executable", info.Executable)
+	writeInfoField(b, "config_file", info.ConfigFile)
+}
+
+func infoClients(db *DB, b *strings.Builder) {
+	writeInfoHeader(b, "Clients")
+	writeInfoField(b, "connected_clients", strconv.FormatInt(atomic.LoadInt64(&db.stats.connectedClients), 10))
+	writeInfoField(b, "maxclients", "10000")
+	watching, watched := db.watchStats()
+	writeInfoField(b, "watching_clients", strconv.Itoa(watching))
+	writeInfoField(b, "total_watched_keys", strconv.Itoa(watched))
+}
+
+func infoMemory(db *DB, b *strings.Builder) {
+	status := db.Status()
+
+	writeInfoHeader(b, "Memory")
+	writeInfoField(b, "used_memory", strconv.FormatInt(status.UsedMemory, 10))
+	writeInfoField(b, "used_memory_human", formatBytes(status.UsedMemory))
+	writeInfoField(b, "maxmemory", strconv.FormatInt(status.MaxMemory, 10))
+	writeInfoField(b, "maxmemory_human", formatBytes(status.MaxMemory))
+	writeInfoField(b, "maxmemory_policy", db.config.MaxMemoryPolicy)
+}
+
+func infoPersistence(db *DB, b *strings.Builder) {
+	db.bgSaveMu.Lock()
+	lastSave := db.lastSaveTime
+	inProgress := db.bgSaveInProgress
+	db.bgSaveMu.Unlock()
+	status := db.Status()
+
+	writeInfoHeader(b, "Persistence")
+	writeInfoField(b, "loading", boolInfo(status.Loading))
+	if load := &db.diskLoad; load.active.Load() {
+		total, loaded := load.total.Load(), load.loaded.Load()
+		writeInfoField(b, "loading_start_time", strconv.FormatInt(load.start.Load(), 10))
+		writeInfoField(b, "loading_total_bytes", strconv.FormatInt(total, 10))
+		writeInfoField(b, "loading_loaded_bytes", strconv.FormatInt(loaded, 10))
+		writeInfoField(b, "loading_loaded_perc", strconv.FormatFloat(loadedPercent(loaded, total), 'f', 2, 64))
+	}
+	writeInfoField(b, "aof_enabled", boolInfo(db.config.AppendOnly))
+	if status.AOFLastWriteOK {
+		writeInfoField(b, "aof_last_write_status", "ok")
+	} else {
+		writeInfoField(b, "aof_last_write_status", "err")
+	}
+	if status.AOFLastRewriteOK {
+		writeInfoField(b, "aof_last_bgrewrite_status", "ok")
+	} else {
+		writeInfoField(b, "aof_last_bgrewrite_status", "err")
+	}
+	if aof, ok := db.AOFStats(); ok {
+		writeInfoField(b, "aof_current_size", strconv.FormatInt(aof.CurrentSize, 10))
+		writeInfoField(b, "aof_buffer_length", strconv.FormatInt(aof.BufferLength, 10))
+		writeInfoField(b, "aof_written_bytes", strconv.FormatInt(aof.WrittenBytes, 10))
+	}
+	if lastSave.IsZero() {
+		writeInfoField(b, "rdb_last_save_time", "0")
+	} else {
+		writeInfoField(b, "rdb_last_save_time", strconv.FormatInt(lastSave.Unix(), 10))
+		writeInfoField(b, "rdb_last_save_time_elapsed", strconv.FormatInt(int64(db.now().Sub(lastSave).Seconds()), 10))
+	}
+	writeInfoField(b, "bgsave_in_progress", boolInfo(inProgress))
+}
+
+func infoStats(db *DB, b *strings.Builder) {
+	writeInfoHeader(b, "Stats")
+	writeInfoField(b, "total_connections_received", strconv.FormatUint(atomic.LoadUint64(&db.stats.totalConnections), 10))
+	traffic := db.TrafficStats()
+	writeInfoField(b, "total_commands_processed", strconv.FormatUint(traffic.TotalCommands, 10))
+	writeInfoField(b, "instantaneous_ops_per_sec", strconv.FormatInt(int64(math.Round(traffic.OpsPerSec)), 10))
+	writeInfoField(b, "total_net_input_bytes", strconv.FormatUint(traffic.NetInputBytes, 10))
+	writeInfoField(b, "total_net_output_bytes", strconv.FormatUint(traffic.NetOutputBytes, 10))
+	writeInfoField(b, "instantaneous_input_kbps", strconv.FormatFloat(traffic.InputKbps, 'f', 2, 64))
+	writeInfoField(b, "instantaneous_output_kbps", strconv.FormatFloat(traffic.OutputKbps, 'f', 2, 64))
+	writeInfoField(b, "total_error_replies", strconv.FormatUint(atomic.LoadUint64(&db.stats.totalErrors), 10))
+	writeInfoField(b, "slowlog_len", strconv.Itoa(db.GetSlowLogLen()))
+	writeInfoField(b, "slowlog_max_len", strconv.Itoa(db.SlowLogMaxLen()))
+	writeInfoField(b, "io_threads_active", "0")
+}
+
+func infoReplication(db *DB, b *strings.Builder) {
+	writeInfoHeader(b, "Replication")
+	writeInfoField(b, "role", db.repl.GetRole().String())
+	if db.repl.IsMaster() {
+		writeInfoField(b, "connected_slaves", strconv.Itoa(db.repl.GetSlaveCount()))
+	} else {
+		masterHost, masterPort := db.repl.GetMasterInfo()
+		writeInfoField(b, "master_host", masterHost)
+		writeInfoField(b, "master_port", strconv.Itoa(masterPort))
+		if db.IsLoading() {
+			writeInfoField(b, "master_link_status", "down")
+		} else {
+			writeInfoField(b, "master_link_status", "up")
+		}
+		writeInfoField(b, "master_sync_in_progress", boolInfo(db.IsLoading()))
+	}
+	writeInfoField(b, "replid", strconv.FormatUint(db.repl.GetReplicationID(), 10))
+	writeInfoField(b, "repl_offset", strconv.FormatUint(db.repl.GetReplicationOffset(), 10))
+}
+
+func infoCPU(db *DB, b *strings.Builder) {
+	user, sys := cpuTimes()
+
+	writeInfoHeader(b, "CPU")
+	writeInfoField(b, "used_cpu_sys", strconv.FormatFloat(sys.Seconds(), 'f', 6, 64))
+	writeInfoField(b, "used_cpu_user", strconv.FormatFloat(user.Seconds(), 'f', 6, 64))
+}
+
+func infoCommandStats(db *DB, b *strings.Builder) {
+	names, stats := db.stats.commandStatsSnapshot()
+
+	writeInfoHeader(b, "Commandstats")
+	for _, name := range names {
+		stat := stats[name]
+		var perCall float64
+		if stat.calls > 0 {
+			perCall = float64(stat.usec) / float64(stat.calls)
+		}
+		writeInfoField(b, "cmdstat_"+name, "calls="+strconv.FormatUint(stat.calls, 10)+
+			",usec="+strconv.FormatUint(stat.usec, 10)+
+			",usec_per_call="+strconv.FormatFloat(perCall, 'f', 2, 64)+
+			",failed_calls="+strconv.FormatUint(stat.failedCalls, 10))
+	}
+}
+
+func infoErrorStats(db *DB, b *strings.Builder) {
+	prefixes, counts := db.stats.errorStatsSnapshot()
+
+	writeInfoHeader(b, "Errorstats")
+	for _, prefix := range prefixes {
+		writeInfoField(b, "errorstat_"+prefix, "count="+strconv.FormatUint(counts[prefix], 10))
+	}
+}
+
+func infoKeyspace(db *DB, b *strings.Builder) {
+	writeKeyspace(db, b, false)
+}
+
+// writeKeyspace writes the keyspace section. avg_ttl is the mean remaining
+// TTL in milliseconds of keys with a TTL, estimated from a sample unless
+// full is set (see ttlstats.go).
+func writeKeyspace(db *DB, b *strings.Builder, full bool) {
+	writeInfoHeader(b, "Keyspace")
+
+	keys := db.data.Len()
+	if keys == 0 {
+		return
+	}
+
+	s := db.collectTTLStats(full)
+	writeInfoField(b, "db"+strconv.Itoa(db.index), "keys="+strconv.Itoa(keys)+
+		",expires="+strconv.FormatInt(s.expires, 10)+
+		",avg_ttl="+strconv.FormatInt(s.avgTTL(), 10))
+}
+
+// boolInfo formats a flag the way INFO does
+func boolInfo(v bool) string {
+	if v {
+		return "1"
+	}
+	return "0"
+}
@@ -0,0 +1,245 @@
+package database
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/wangbo/gocache/util/clock"
+)
+
+// parseInfo parses INFO output the way go-redis's InfoCmd does: "# Name"
+// starts a section, blank lines are skipped and every other line must be a
+// field:value pair
+func parseInfo(info string) (map[string]map[string]string, error) {
+	sections := make(map[string]map[string]string)
+	section := ""
+
+	scanner := bufio.NewScanner(strings.NewReader(info))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "#") {
+			section = strings.TrimPrefix(line, "# ")
+			sections[section] = make(map[string]string)
+			continue
+		}
+		if line == "" {
+			continue
+		}
+		kv := strings.SplitN(line, ":", 2)
+		if len(kv) != 2 || sections[section] == nil {
+			return nil, fmt.Errorf("parse info error: %q", line)
+		}
+		sections[section][kv[0]] = kv[1]
+	}
+	return sections, scanner.Err()
+}
+
+// execInfoString runs INFO with the given sections and parses the output
+func execInfoString(t *testing.T, db *DB, args ...string) map[string]map[string]string {
+	t.Helper()
+	result, err := db.ExecCommand("INFO", args...)
+	if err != nil {
+		t.Fatalf("INFO %v failed: %v", args, err)
+	}
+	info := string(result[0])
+	if strings.Contains(strings.ReplaceAll(info, "\r\n", ""), "\n") {
+		t.Fatalf("INFO %v has lines not ending in \\r\\n: %q", args, info)
+	}
+	sections, err := parseInfo(info)
+	if err != nil {
+		t.Fatalf("INFO %v: %v", args, err)
+	}
+	return sections
+}
+
+func TestInfoSectionSelection(t *testing.T) {
+	db := MakeDB()
+	defer db.Close()
+
+	sections := execInfoString(t, db)
+	for _, name := range []string{"Server", "Clients", "Memory", "Persistence", "Stats", "Replication", "CPU", "Errorstats", "Keyspace"} {
+		if _, ok := sections[name]; !ok {
+			t.Errorf("Default INFO is missing section %s", name)
+		}
+	}
+	if _, ok := sections["Commandstats"]; ok {
+		t.Error("Default INFO should not include Commandstats")
+	}
+
+	sections = execInfoString(t, db, "replication")
+	if len(sections) != 1 || sections["Replication"]["role"] == "" {
+		t.Errorf("INFO replication should return only the Replication section, got %v", sections)
+	}
+
+	sections = execInfoString(t, db, "MEMORY", "stats")
+	if len(sections) != 2 || sections["Memory"] == nil || sections["Stats"] == nil {
+		t.Errorf("INFO memory stats should return two sections, got %v", sections)
+	}
+
+	sections = execInfoString(t, db, "everything")
+	if len(sections) != len(infoSections) {
+		t.Errorf("INFO everything should return %d sections, got %d", len(infoSections), len(sections))
+	}
+
+	if result, _ := db.ExecCommand("INFO", "nosuchsection"); len(result[0]) != 0 {
+		t.Errorf("Unknown section should be empty, got %q", result[0])
+	}
+}
+
+func TestInfoKeyspace(t *testing.T) {
+	db := MakeDB()
+	defer db.Close()
+
+	if sections := execInfoString(t, db, "keyspace"); len(sections["Keyspace"]) != 0 {
+		t.Errorf("Empty database should have no keyspace lines, got %v", sections["Keyspace"])
+	}
+
+	db.ExecCommand("SET", "a", "1")
+	db.ExecCommand("SET", "b", "2", "EX", "100")
+	db.ExecCommand("SET", "c", "3", "EX", "200")
+
+	line := execInfoString(t, db, "keyspace")["Keyspace"]["db0"]
+	var keys, expires, avgTTL int64
+	if _, err := fmt.Sscanf(line, "keys=%d,expires=%d,avg_ttl=%d", &keys, &expires, &avgTTL); err != nil {
+		t.Fatalf("Unexpected keyspace line %q: %v", line, err)
+	}
+	if keys != 3 || expires != 2 {
+		t.Errorf("Expected keys=3 expires=2, got %q", line)
+	}
+	if avgTTL <= 149000 || avgTTL > 150000 {
+		t.Errorf("Expected avg_ttl close to 150000ms, got %d", avgTTL)
+	}
+}
+
+func TestInfoCommandAndErrorStats(t *testing.T) {
+	db := MakeDB()
+	defer db.Close()
+
+	db.RecordCommand("GET", 0, false)
+	db.RecordCommand("get", 0, true)
+	db.RecordErrorReply("WRONGTYPE Operation against a key holding the wrong kind of value")
+	db.RecordErrorReply("ERR syntax error")
+	db.RecordErrorReply("ERR unknown command")
+
+	sections := execInfoString(t, db, "commandstats", "errorstats", "stats")
+	if got := sections["Commandstats"]["cmdstat_get"]; !strings.HasPrefix(got, "calls=2,") || !strings.HasSuffix(got, ",failed_calls=1") {
+		t.Errorf("Unexpected cmdstat_get %q", got)
+	}
+	if got := sections["Errorstats"]["errorstat_ERR"]; got != "count=2" {
+		t.Errorf("Expected errorstat_ERR count=2, got %q", got)
+	}
+	if got := sections["Errorstats"]["errorstat_WRONGTYPE"]; got != "count=1" {
+		t.Errorf("Expected errorstat_WRONGTYPE count=1, got %q", got)
+	}
+	if got := sections["Stats"]["total_error_replies"]; got != "3" {
+		t.Errorf("Expected total_error_replies 3, got %q", got)
+	}
+}
+
+func TestInfoServerDescribesProcess(t *testing.T) {
+	db := MakeDB()
+	defer db.Close()
+
+	configFile := filepath.Join(t.TempDir(), "gocache.conf")
+	if err := os.WriteFile(configFile, []byte("port 6379\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	info := NewServerInfo(configFile)
+	info.StartTime = time.Now().Add(-49 * time.Hour)
+	db.SetServerInfo(info)
+
+	server := execInfoString(t, db, "server")["Server"]
+	if server["os"] != runtime.GOOS || server["arch"] != runtime.GOARCH {
+		t.Errorf("Expected os %s and arch %s, got %q and %q", runtime.GOOS, runtime.GOARCH, server["os"], server["arch"])
+	}
+	if server["process_id"] != strconv.Itoa(os.Getpid()) {
+		t.Errorf("Expected process_id %d, got %q", os.Getpid(), server["process_id"])
+	}
+	if runID := server["run_id"]; len(runID) != 40 || strings.Trim(runID, "0123456789abcdef") != "" {
+		t.Errorf("Expected run_id of 40 hex characters, got %q", runID)
+	}
+	if uptime, err := strconv.Atoi(server["uptime_in_seconds"]); err != nil || uptime < 49*3600 || uptime > 49*3600+60 {
+		t.Errorf("Expected uptime_in_seconds of 49 hours, got %q", server["uptime_in_seconds"])
+	}
+	if server["uptime_in_days"] != "2" {
+		t.Errorf("Expected uptime_in_days 2, got %q", server["uptime_in_days"])
+	}
+	if server["config_file"] != configFile {
+		t.Errorf("Expected config_file %s, got %q", configFile, server["config_file"])
+	}
+	if !filepath.IsAbs(server["executable"]) {
+		t.Errorf("Expected an absolute executable path, got %q", server["executable"])
+	}
+
+	if got := execInfoString(t, db, "stats")["Stats"]["io_threads_active"]; got != "0" {
+		t.Errorf("Expected io_threads_active 0, got %q", got)
+	}
+
+	// Every run gets its own ID and a missing config file is not reported
+	other := NewServerInfo(filepath.Join(t.TempDir(), "missing.conf"))
+	if other.RunID == info.RunID || other.ConfigFile != "" {
+		t.Errorf("Unexpected server info %+v", other)
+	}
+}
+
+// TestInstantaneousRates drives a known traffic through ticks of a manual
+// clock and checks the rates INFO computes from the samples
+func TestInstantaneousRates(t *testing.T) {
+	db := MakeDB()
+	defer db.Close()
+	mc := clock.NewManual(time.Now())
+	db.SetClock(mc)
+
+	// tick advances the clock to the next sample and waits for the sampler
+	// to take it, which reads the counters
+	tick := func() {
+		t.Helper()
+		mc.Advance(statsSampleInterval)
+		at := mc.Now()
+		waitFor(t, "a sample", func() bool {
+			db.stats.samplesMu.Lock()
+			defer db.stats.samplesMu.Unlock()
+			return db.stats.opsRate.lastTime.Equal(at)
+		})
+	}
+
+	// The first tick only takes the initial readings
+	tick()
+	for i := 0; i < statsSamples; i++ {
+		for j := 0; j < 50; j++ {
+			db.RecordCommand("GET", 0, false)
+			db.RecordNetInput(200)
+			db.RecordNetOutput(1024)
+		}
+		tick()
+	}
+	// 50 commands every 100ms over the whole window
+	stats := execInfoString(t, db, "stats")["Stats"]
+	for field, want := range map[string]string{
+		"total_commands_processed":  "800",
+		"instantaneous_ops_per_sec": "500",
+		"total_net_input_bytes":     "160000",
+		"total_net_output_bytes":    "819200",
+		"instantaneous_input_kbps":  "97.66",
+		"instantaneous_output_kbps": "500.00",
+	} {
+		if stats[field] != want {
+			t.Errorf("Expected %s %s, got %q", field, want, stats[field])
+		}
+	}
+
+	// Half of the window without traffic halves the rates
+	for i := 0; i < statsSamples/2; i++ {
+		tick()
+	}
+	if ops := db.TrafficStats().OpsPerSec; ops < 249 || ops > 251 {
+		t.Errorf("Expected about 250 commands per second, got %v", ops)
+	}
+}
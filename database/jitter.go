@@ -0,0 +1,48 @@
+package database
+
+import "time"
+
+// TTL jitter
+//
+// Keys written together with the same TTL all expire in the same second,
+// and the clients that cached them all miss at once. With
+// ttl-jitter-percent N, the relative TTLs set on a master by EXPIRE,
+// PEXPIRE, SET EX and PX and the loads of the read-through are moved by a
+// random amount of up to N% either way, drawn to the millisecond. A
+// jittered TTL is never shorter than 1 second, or than the TTL asked for if
+// it was shorter still, so jitter never expires a key at once. The server
+// propagates the resulting PEXPIREAT, so slaves and the AOF keep the expiry
+// the master drew; absolute expiries (EXPIREAT, SET EXAT) are kept as
+// given.
+
+// minJitteredTTL is the shortest TTL jitter may leave
+const minJitteredTTL = time.Second
+
+// SeedTTLJitter reseeds the source the jitter of TTLs is drawn from, so that
+// tests get the same expiries on every run
+func (db *DB) SeedTTLJitter(seed int64) {
+	db.ttlRand.Seed(seed)
+}
+
+// expireRelative sets a TTL given relative to now, jittered as configured
+func (db *DB) expireRelative(key string, ttl time.Duration) int {
+	return db.Expire(key, db.jitterTTL(ttl))
+}
+
+// jitterTTL returns ttl moved by up to ttl-jitter-percent percent either
+// way, or ttl itself on a replica or without jitter
+func (db *DB) jitterTTL(ttl time.Duration) time.Duration {
+	percent := db.runtime.ttlJitterPercent.Load()
+	if percent <= 0 || ttl <= 0 || db.IsReplica() {
+		return ttl
+	}
+	spread := (ttl / 100 * time.Duration(percent)).Milliseconds()
+	if spread <= 0 {
+		return ttl
+	}
+	delta := time.Duration(db.ttlRand.Int63n(2*spread+1)-spread) * time.Millisecond
+	if delta > maxTTL-ttl {
+		return maxTTL
+	}
+	return max(ttl+delta, min(ttl, minJitteredTTL))
+}
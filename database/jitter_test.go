@@ -0,0 +1,122 @@
+package database
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/wangbo/gocache/config"
+	"github.com/wangbo/gocache/replication"
+	"github.com/wangbo/gocache/util/clock"
+)
+
+// makeJitterDB returns a database jittering TTLs by percent, on a manual
+// clock and with a fixed seed
+func makeJitterDB(t *testing.T, percent int) (*DB, *clock.Manual) {
+	t.Helper()
+	cfg := config.Default()
+	cfg.TTLJitterPercent = percent
+	db := MakeDBWithConfig(cfg, replication.NewReplicationState())
+	t.Cleanup(func() { db.Close() })
+	mc := clock.NewManual(time.Now())
+	db.SetClock(mc)
+	db.SeedTTLJitter(1)
+	return db, mc
+}
+
+func TestTTLJitterSpreadsExpiries(t *testing.T) {
+	db, mc := makeJitterDB(t, 10)
+
+	seconds := make(map[int64]int)
+	var lowest, highest time.Duration
+	for i := 0; i < 1000; i++ {
+		key := "k" + strconv.Itoa(i)
+		if i%2 == 0 {
+			db.ExecCommand("SET", key, "v", "EX", "100")
+		} else {
+			db.ExecCommand("SET", key, "v")
+			db.ExecCommand("EXPIRE", key, "100")
+		}
+		expireAt, ok := db.ExpireTime(key)
+		if !ok {
+			t.Fatalf("Expected %s to have a TTL", key)
+		}
+		ttl := expireAt.Sub(mc.Now())
+		if ttl < 90*time.Second || ttl > 110*time.Second {
+			t.Fatalf("Expected a TTL within 100s ± 10%%, got %v", ttl)
+		}
+		if i == 0 || ttl < lowest {
+			lowest = ttl
+		}
+		if i == 0 || ttl > highest {
+			highest = ttl
+		}
+		seconds[int64(ttl/time.Second)]++
+	}
+	// 1000 draws cover the window, about 50 keys a second
+	if lowest > 91*time.Second || highest < 109*time.Second {
+		t.Errorf("Expected the TTLs to span the window, got [%v, %v]", lowest, highest)
+	}
+	for s := int64(90); s < 110; s++ {
+		if n := seconds[s]; n == 0 || n > 100 {
+			t.Errorf("Expected about 50 keys expiring in second %d, got %d", s, n)
+		}
+	}
+
+	// PTTL reports the jittered TTL
+	result, _ := db.ExecCommand("PTTL", "k0")
+	expireAt, _ := db.ExpireTime("k0")
+	if want := strconv.FormatInt(expireAt.Sub(mc.Now()).Milliseconds(), 10); string(result[0]) != want {
+		t.Errorf("Expected PTTL %s, got %s", want, result[0])
+	}
+}
+
+func TestTTLJitterNeverExpiresAtOnce(t *testing.T) {
+	db, mc := makeJitterDB(t, 100)
+
+	for _, ms := range []int64{1, 10, 999, 1000, 1500, 2000, 100000} {
+		floor := min(time.Duration(ms)*time.Millisecond, time.Second)
+		for i := 0; i < 200; i++ {
+			db.ExecCommand("SET", "k", "v", "PX", strconv.FormatInt(ms, 10))
+			expireAt, ok := db.ExpireTime("k")
+			if !ok {
+				t.Fatalf("PX %d: expected the key to have a TTL", ms)
+			}
+			if ttl := expireAt.Sub(mc.Now()); ttl < floor || ttl > 2*time.Duration(ms)*time.Millisecond {
+				t.Fatalf("PX %d: TTL %v out of [%v, %v]", ms, ttl, floor, 2*time.Duration(ms)*time.Millisecond)
+			}
+			if result, _ := db.ExecCommand("TTL", "k"); string(result[0]) == "0" || string(result[0]) == "-2" {
+				t.Fatalf("PX %d: expected the key to live, TTL replied %s", ms, result[0])
+			}
+		}
+	}
+}
+
+func TestTTLJitterLeavesOtherExpiriesAlone(t *testing.T) {
+	db, mc := makeJitterDB(t, 50)
+
+	at := mc.Now().Add(100 * time.Second)
+	db.ExecCommand("SET", "a", "v")
+	db.ExecCommand("PEXPIREAT", "a", strconv.FormatInt(at.UnixMilli(), 10))
+	db.ExecCommand("SET", "b", "v", "PXAT", strconv.FormatInt(at.UnixMilli(), 10))
+	for _, key := range []string{"a", "b"} {
+		if expireAt, _ := db.ExpireTime(key); expireAt.UnixMilli() != at.UnixMilli() {
+			t.Errorf("Expected the absolute expiry of %s to be kept, got %v", key, expireAt)
+		}
+	}
+
+	// A replica applies the expiries of its master as they are
+	db.SetReplicaMode(true)
+	db.ExecCommand("SET", "c", "v")
+	db.ExecCommand("EXPIRE", "c", "100")
+	if ttl := db.TTL("c"); ttl != 100*time.Second {
+		t.Errorf("Expected no jitter on a replica, got %v", ttl)
+	}
+	db.SetReplicaMode(false)
+
+	db.runtime.ttlJitterPercent.Store(0)
+	db.ExecCommand("EXPIRE", "c", "100")
+	if ttl := db.TTL("c"); ttl != 100*time.Second {
+		t.Errorf("Expected no jitter once disabled, got %v", ttl)
+	}
+}
@@ -0,0 +1,118 @@
+package database_test
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/wangbo/gocache/database"
+	"github.com/wangbo/gocache/util/clock"
+)
+
+// testClock is a database clock moved by the test; with a step, each
+// reading moves it forward. Its tickers tick in real time.
+type testClock struct {
+	mu   sync.Mutex
+	now  time.Time
+	step time.Duration
+}
+
+func (c *testClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now
+	c.now = c.now.Add(c.step)
+	return now
+}
+
+func (c *testClock) NewTicker(d time.Duration) clock.Ticker {
+	return clock.Real.NewTicker(d)
+}
+
+func (c *testClock) set(now time.Time, step time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now, c.step = now, step
+}
+
+// TestKeyArgumentsParity pins how the commands taking several keys count
+// them: every occurrence of a key is visited in turn, so EXISTS counts a
+// duplicate twice while DEL and UNLINK find nothing left to delete the
+// second time, and a key that expires between two arguments is seen by the
+// first visit only
+func TestKeyArgumentsParity(t *testing.T) {
+	tests := []struct {
+		cmd     string
+		want    int64
+		removed []string // Keys gone afterwards
+	}{
+		{"EXISTS a a", 2, nil},
+		{"EXISTS a missing a", 2, nil},
+		{"EXISTS missing missing", 0, nil},
+		{"DEL a a", 1, []string{"a"}},
+		{"DEL a missing b", 2, []string{"a", "b"}},
+		{"UNLINK a a b", 2, []string{"a", "b"}},
+		{"UNLINK missing", 0, nil},
+		{"TOUCH a a missing", 2, nil},
+		// vol and vol2 expire when the clock is read for the second key
+		{"EXISTS vol vol", 1, nil},
+		{"TOUCH vol vol", 1, nil},
+		{"EXISTS vol2 a vol", 2, nil},
+		{"DEL vol2 vol", 1, []string{"vol", "vol2"}},
+	}
+	start := time.Now()
+	for _, tt := range tests {
+		t.Run(tt.cmd, func(t *testing.T) {
+			db := database.MakeDB()
+			defer db.Close()
+			tc := &testClock{now: start}
+			db.SetClock(tc)
+
+			exec(t, db, "SET", "a", "1")
+			exec(t, db, "SET", "b", "2")
+			exec(t, db, "SET", "vol", "3", "EX", "3600")
+			exec(t, db, "SET", "vol2", "4", "EX", "3600")
+			// Only keys with a TTL read the clock, once per visit
+			tc.set(start.Add(59*time.Minute), 2*time.Minute)
+
+			result := exec(t, db, strings.Fields(tt.cmd)...)
+			if got := string(result[0]); got != strconv.FormatInt(tt.want, 10) {
+				t.Errorf("Expected %d, got %s", tt.want, got)
+			}
+			for _, key := range tt.removed {
+				if db.Exists(key) {
+					t.Errorf("Expected %s to be gone", key)
+				}
+			}
+		})
+	}
+}
+
+func TestClockDrivesTTLs(t *testing.T) {
+	db := database.MakeDB()
+	defer db.Close()
+	mc := clock.NewManual(time.Now())
+	db.SetClock(mc)
+
+	exec(t, db, "SET", "k", "v", "EX", "10")
+	exec(t, db, "SET", "p", "v")
+	exec(t, db, "EXPIRE", "p", "20")
+	if ttl := db.TTL("k"); ttl != 10*time.Second {
+		t.Errorf("Expected a TTL of exactly 10s on a stopped clock, got %v", ttl)
+	}
+
+	mc.Advance(10 * time.Second)
+	if result := exec(t, db, "GET", "k"); result[0] != nil {
+		t.Errorf("Expected k to expire with the clock, got %q", result[0])
+	}
+	if ttl := db.TTL("p"); ttl != 10*time.Second {
+		t.Errorf("Expected p to have 10s left, got %v", ttl)
+	}
+
+	db.SetClock(nil)
+	if db.TTL("p") <= 0 {
+		t.Error("Expected the wall clock to be used again")
+	}
+}
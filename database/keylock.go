@@ -0,0 +1,133 @@
+package database
+
+import (
+	"hash/fnv"
+	"sort"
+	"sync"
+)
+
+// keyLockStripes is the number of locks keys are striped over
+const keyLockStripes = 1024
+
+// keyLocks makes every command atomic with respect to the other commands
+// naming the same keys, like the single-threaded Redis does.
+//
+// The data dict only locks one key at a time, so a MGET running next to a
+// MSET of the same keys could see some keys updated but not others. Before
+// running, a command locks the stripes of all the keys it names (see
+// commandKeys), exclusively for write commands and shared for read commands.
+// Stripes are always locked in increasing order, so commands locking
+// several of them cannot deadlock. Keys expired by the time wheel and
+// evicted keys are removed without the key locks, one key at a time.
+//
+// The keys a command locks are:
+//
+//   - most commands, including the counters (INCR, HINCRBY...): their key
+//   - DEL, EXISTS, TOUCH, MGET, PFCOUNT: every key
+//   - MSET, MSETNX: every key set
+//   - SMOVE: the source and the destination
+//   - SDIFF, SINTER, SUNION and their STORE forms, PFMERGE: every key,
+//     including the destination
+//   - BLPOP, BRPOP, XREAD, XREADGROUP: every key they read
+//   - OBJECT, MEMORY USAGE: the key inspected
+//   - MIGRATE, and commands without keys: none
+//
+// EXEC and the exclusive commands (DEBUG RELOAD, FLUSHALL, FLUSHDB) hold
+// db.mu exclusively instead, which excludes every other command. Code
+// embedding the database takes the same locks with WithKeyLocks.
+type keyLocks struct {
+	stripes []sync.RWMutex
+}
+
+// newKeyLocks creates the striped key locks
+func newKeyLocks(stripes int) *keyLocks {
+	return &keyLocks{stripes: make([]sync.RWMutex, stripes)}
+}
+
+// stripe returns the index of the lock of a key
+func (l *keyLocks) stripe(key string) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % uint32(len(l.stripes)))
+}
+
+// heldStripes are the stripes locked by keyLocks.lock, in increasing
+// order. The stripe of a single key is kept without a slice, so that the
+// commands of one key, the most common, lock it without allocating.
+type heldStripes struct {
+	locks *keyLocks
+	write bool
+	one   int   // The only stripe held, -1 for none
+	many  []int // The stripes held, when there are several
+}
+
+// lock locks the stripes of keys, exclusively if write is set; unlock
+// releases them
+func (l *keyLocks) lock(keys []string, write bool) heldStripes {
+	held := heldStripes{locks: l, write: write, one: -1}
+	switch len(keys) {
+	case 0:
+		return held
+	case 1:
+		held.one = l.stripe(keys[0])
+		l.lockStripe(held.one, write)
+		return held
+	}
+
+	indexes := make([]int, 0, len(keys))
+	for _, key := range keys {
+		indexes = append(indexes, l.stripe(key))
+	}
+	sort.Ints(indexes)
+	// Several keys can share a stripe, which must only be locked once
+	unique := indexes[:1]
+	for _, i := range indexes[1:] {
+		if i != unique[len(unique)-1] {
+			unique = append(unique, i)
+		}
+	}
+
+	for _, i := range unique {
+		l.lockStripe(i, write)
+	}
+	held.many = unique
+	return held
+}
+
+func (l *keyLocks) lockStripe(i int, write bool) {
+	if write {
+		l.stripes[i].Lock()
+	} else {
+		l.stripes[i].RLock()
+	}
+}
+
+// unlock releases the stripes, in decreasing order
+func (h heldStripes) unlock() {
+	release := func(i int) {
+		if h.write {
+			h.locks.stripes[i].Unlock()
+		} else {
+			h.locks.stripes[i].RUnlock()
+		}
+	}
+	if h.one >= 0 {
+		release(h.one)
+	}
+	for j := len(h.many) - 1; j >= 0; j-- {
+		release(h.many[j])
+	}
+}
+
+// WithKeyLocks runs fn holding the locks of keys exclusively, so that a
+// read-modify-write made through the methods of DB (GetEntity, PutEntity,
+// Remove...) by code embedding the database is atomic with respect to every
+// command naming one of the keys, as a multi-key command is. fn must not run
+// commands (Exec, ExecCommand...), whose locks are not reentrant.
+func (db *DB) WithKeyLocks(keys []string, fn func() error) error {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	held := db.keyLocks.lock(keys, true)
+	defer held.unlock()
+	return fn()
+}
@@ -0,0 +1,263 @@
+package database
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/wangbo/gocache/datastruct"
+)
+
+func TestMSetMGetNeverTorn(t *testing.T) {
+	db := MakeDB()
+	defer db.Close()
+
+	duration := 3 * time.Second
+	if testing.Short() {
+		duration = 200 * time.Millisecond
+	}
+	deadline := time.Now().Add(duration)
+
+	var wg sync.WaitGroup
+	var torn, reads atomic.Int64
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; time.Now().Before(deadline); i++ {
+				v := strconv.Itoa(w*1000000 + i)
+				// Name the keys in both orders so lock ordering is exercised
+				if i%2 == 0 {
+					db.ExecCommand("MSET", "k1", v, "k2", v, "k3", v)
+				} else {
+					db.ExecCommand("MSET", "k3", v, "k2", v, "k1", v)
+				}
+			}
+		}(w)
+	}
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for time.Now().Before(deadline) {
+				result, err := db.ExecCommand("MGET", "k1", "k2", "k3")
+				if err != nil {
+					t.Errorf("MGET failed: %v", err)
+					return
+				}
+				reads.Add(1)
+				if string(result[0]) != string(result[1]) || string(result[1]) != string(result[2]) {
+					if torn.Add(1) == 1 {
+						t.Errorf("Torn read: %q", result)
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := torn.Load(); n > 0 {
+		t.Fatalf("%d of %d MGET calls saw a partially applied MSET", n, reads.Load())
+	}
+}
+
+func TestMultiKeyWritesAreAtomic(t *testing.T) {
+	db := MakeDB()
+	defer db.Close()
+
+	db.ExecCommand("SADD", "src", "member")
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+
+	// DEL removes both keys at once and SMOVE moves the member atomically
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			db.ExecCommand("MSET", "a", "1", "b", "1")
+			db.ExecCommand("DEL", "b", "a")
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if i%2 == 0 {
+				db.ExecCommand("SMOVE", "src", "dst", "member")
+			} else {
+				db.ExecCommand("SMOVE", "dst", "src", "member")
+			}
+		}
+	}()
+
+	for deadline := time.Now().Add(500 * time.Millisecond); time.Now().Before(deadline); {
+		if result, _ := db.ExecCommand("EXISTS", "a", "b"); string(result[0]) == "1" {
+			t.Fatal("EXISTS saw one of two keys written and deleted together")
+		}
+		result, _ := db.ExecCommand("SUNION", "src", "dst")
+		if len(result) != 1 {
+			t.Fatalf("Expected the moved member in exactly one set, got %q", result)
+		}
+	}
+	close(stop)
+	wg.Wait()
+}
+
+func TestKeyLocksOrderStripes(t *testing.T) {
+	locks := newKeyLocks(8)
+
+	// Keys sharing a stripe are locked once, and a shared lock does not
+	// block other readers
+	held := locks.lock([]string{"a", "a", "b"}, false)
+	reader := locks.lock([]string{"b", "a"}, false)
+	reader.unlock()
+	held.unlock()
+
+	// The stripe of a single key is released too: locking it again does
+	// not block
+	locks.lock([]string{"a"}, true).unlock()
+	locks.lock([]string{"a"}, true).unlock()
+	locks.lock(nil, true).unlock()
+
+	// Opposite key orders cannot deadlock
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			keys := []string{"x", "y", "z"}
+			if g%2 == 1 {
+				keys = []string{"z", "y", "x"}
+			}
+			for i := 0; i < 1000; i++ {
+				locks.lock(keys, true).unlock()
+			}
+		}(g)
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Locking keys in different orders deadlocked")
+	}
+}
+
+func TestSMoveConservesMembers(t *testing.T) {
+	db := MakeDB()
+	defer db.Close()
+
+	const members = 50
+	for i := 0; i < members; i++ {
+		db.ExecCommand("SADD", "a", "m"+strconv.Itoa(i))
+	}
+	count := func() (int, error) {
+		total := 0
+		err := db.WithKeyLocks([]string{"a", "b"}, func() error {
+			for _, key := range []string{"a", "b"} {
+				if entity, ok := db.GetEntity(key); ok {
+					total += entity.Data.(*datastruct.Set).Len()
+				}
+			}
+			return nil
+		})
+		return total, err
+	}
+
+	iterations := 2000
+	if testing.Short() {
+		iterations = 200
+	}
+	var wg sync.WaitGroup
+	for g := 0; g < 20; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			src, dst := "a", "b"
+			if g%2 == 1 {
+				src, dst = dst, src
+			}
+			for i := 0; i < iterations; i++ {
+				member := "m" + strconv.Itoa((g*7+i)%members)
+				if _, err := db.ExecCommand("SMOVE", src, dst, member); err != nil {
+					t.Errorf("SMOVE failed: %v", err)
+					return
+				}
+			}
+		}(g)
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	for checking := true; checking; {
+		select {
+		case <-done:
+			checking = false
+		default:
+		}
+		if total, _ := count(); total != members {
+			t.Fatalf("Expected %d members across both sets, got %d", members, total)
+		}
+	}
+	result, _ := db.ExecCommand("SINTER", "a", "b")
+	if len(result) != 0 {
+		t.Errorf("Expected no member in both sets, got %q", result)
+	}
+}
+
+func TestWithKeyLocksExcludesCommands(t *testing.T) {
+	db := MakeDB()
+	defer db.Close()
+
+	const goroutines, increments = 20, 500
+	var wg sync.WaitGroup
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < increments; i++ {
+				if g%2 == 0 {
+					db.ExecCommand("INCR", "n")
+					continue
+				}
+				// A read-modify-write INCR would lose without the lock
+				db.WithKeyLocks([]string{"n"}, func() error {
+					n := 0
+					if entity, ok := db.GetEntity("n"); ok {
+						n, _ = strconv.Atoi(string(entity.Data.(*datastruct.String).Get()))
+					}
+					db.PutEntity("n", datastruct.MakeString([]byte(strconv.Itoa(n+1))))
+					return nil
+				})
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	result, _ := db.ExecCommand("GET", "n")
+	if want := strconv.Itoa(goroutines * increments); string(result[0]) != want {
+		t.Errorf("Expected %s, got %s", want, result[0])
+	}
+	failed := errors.New("failed")
+	if err := db.WithKeyLocks(nil, func() error { return failed }); err != failed {
+		t.Errorf("Expected the error of fn, got %v", err)
+	}
+}
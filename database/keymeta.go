@@ -0,0 +1,73 @@
+package database
+
+import (
+	"errors"
+	"strconv"
+
+	"github.com/wangbo/gocache/datastruct"
+)
+
+// Key metadata
+//
+// With track-key-metadata enabled every key records when it was created, when
+// it was last written and how many writes it has seen, for debugging (OBJECT
+// METADATA). The metadata is attached when a key is inserted and carried over
+// when its value is replaced, so only creating a key resets it. Keys that
+// existed before tracking was enabled have no metadata until they are
+// recreated. With tracking disabled the write path does no extra work.
+
+// attachKeyMetadata gives an entity about to be stored under a key its
+// metadata: the metadata of the entity it replaces, if any, or a fresh one
+func (db *DB) attachKeyMetadata(entity, old *datastruct.DataEntity) {
+	if !db.config.TrackKeyMetadata || entity.Meta != nil {
+		return
+	}
+	if old != nil && old.Meta != nil {
+		entity.Meta = old.Meta
+		return
+	}
+	entity.Meta = datastruct.NewKeyMetadata(db.now().UnixMilli())
+}
+
+// recordKeyWrite counts a write to a key that was modified by a command
+func (db *DB) recordKeyWrite(key string) {
+	if !db.config.TrackKeyMetadata {
+		return
+	}
+	entity, ok := db.getEntityWithoutExpiryCheck(key)
+	if !ok || entity.Meta == nil {
+		return
+	}
+	entity.Meta.RecordWrite(db.now().UnixMilli())
+}
+
+// SetKeyMetadata replaces the metadata of a key, e.g. with the values saved in
+// a snapshot. It reports false if the key does not exist or has no metadata
+// because tracking is disabled.
+func (db *DB) SetKeyMetadata(key string, createdAt, modifiedAt, writes int64) bool {
+	entity, ok := db.getEntityWithoutExpiryCheck(key)
+	if !ok || entity.Meta == nil {
+		return false
+	}
+	entity.Meta.Store(createdAt, modifiedAt, writes)
+	return true
+}
+
+// objectMetadata implements OBJECT METADATA key
+func objectMetadata(db *DB, key string) ([][]byte, error) {
+	if !db.config.TrackKeyMetadata {
+		return nil, errors.New("ERR key metadata tracking is disabled, enable track-key-metadata")
+	}
+	// A key created before tracking was enabled has no metadata, like a
+	// missing key
+	entity, ok := db.peekEntity(key)
+	if !ok || entity.Meta == nil {
+		return nullResult(), nil
+	}
+	createdAt, modifiedAt, writes := entity.Meta.Load()
+	return [][]byte{
+		[]byte("created-at"), []byte(strconv.FormatInt(createdAt, 10)),
+		[]byte("last-modified-at"), []byte(strconv.FormatInt(modifiedAt, 10)),
+		[]byte("write-count"), []byte(strconv.FormatInt(writes, 10)),
+	}, nil
+}
@@ -0,0 +1,73 @@
+package database
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/wangbo/gocache/config"
+)
+
+func TestKeyMetadataDisabledDoesNotAllocate(t *testing.T) {
+	db := MakeDB()
+	defer db.Close()
+	db.ExecCommand("SET", "k", "v")
+
+	if entity, _ := db.GetEntity("k"); entity.Meta != nil {
+		t.Fatal("Expected no metadata while tracking is disabled")
+	}
+	allocs := testing.AllocsPerRun(100, func() {
+		db.recordKeyWrite("k")
+	})
+	if allocs != 0 {
+		t.Errorf("Expected no allocations for a write while tracking is disabled, got %v", allocs)
+	}
+	if _, err := db.ExecCommand("OBJECT", "METADATA", "k"); err == nil {
+		t.Error("Expected OBJECT METADATA to fail while tracking is disabled")
+	}
+}
+
+func TestKeyMetadataTracksWrites(t *testing.T) {
+	config.Config.TrackKeyMetadata = true
+	defer func() { config.Config.TrackKeyMetadata = false }()
+
+	db := MakeDB()
+	defer db.Close()
+
+	db.ExecCommand("SET", "k", "v")
+	db.ExecCommand("APPEND", "k", "w")
+	db.ExecCommand("SET", "k", "x")
+	db.ExecCommand("INCR", "counter")
+	db.ExecCommand("INCR", "counter")
+	db.ExecCommand("GET", "k")
+
+	result, err := db.ExecCommand("OBJECT", "METADATA", "k")
+	if err != nil || len(result) != 6 {
+		t.Fatalf("Expected 3 field/value pairs, got %q %v", result, err)
+	}
+	if string(result[0]) != "created-at" || string(result[2]) != "last-modified-at" || string(result[4]) != "write-count" {
+		t.Errorf("Unexpected field names %q", result)
+	}
+	if string(result[5]) != "3" {
+		t.Errorf("Expected 3 writes (reads do not count), got %s", result[5])
+	}
+	createdAt, _ := strconv.ParseInt(string(result[1]), 10, 64)
+	modifiedAt, _ := strconv.ParseInt(string(result[3]), 10, 64)
+	if createdAt == 0 || createdAt > modifiedAt {
+		t.Errorf("Expected created-at <= last-modified-at, got %s and %s", result[1], result[3])
+	}
+
+	if result, _ := db.ExecCommand("OBJECT", "METADATA", "counter"); len(result) != 6 || string(result[5]) != "2" {
+		t.Errorf("Expected 2 writes of counter, got %q", result)
+	}
+
+	// Deleting a key drops its metadata
+	db.ExecCommand("DEL", "k")
+	db.ExecCommand("SET", "k", "v")
+	if result, _ := db.ExecCommand("OBJECT", "METADATA", "k"); string(result[5]) != "1" {
+		t.Errorf("Expected a recreated key to start over, got %q", result)
+	}
+
+	if result, _ := db.ExecCommand("OBJECT", "METADATA", "missing"); !IsNullResult(result) {
+		t.Errorf("Expected null for a missing key, got %q", result)
+	}
+}
@@ -0,0 +1,152 @@
+package database
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/wangbo/gocache/datastruct"
+)
+
+// Moving and copying keys
+//
+// RENAME, RENAMENX and COPY give the value of a key to another name through
+// transferKey, which decides once what goes with the value, as in Redis:
+//
+//   - the TTL: the destination expires when the source would have, for
+//     RENAME and for COPY alike; a TTL the destination had is dropped
+//   - the TTLs of hash fields, which belong to the value
+//   - WATCH: the destination, and the source of RENAME, count as written
+//     (see writeKeys), so that the transactions WATCHing them abort, and
+//     clients blocked on the destination are woken
+//
+// RENAME moves the value itself, with its key metadata; COPY stores a copy
+// built by the commands that rebuild the value (see RebuildCommands), with
+// metadata of its own. MOVE would carry the TTL the same way, but with a
+// single database it never moves a key. There is no DUMP payload format, so
+// there is no RESTORE either; it would set the TTL from its argument only.
+
+// transferKey gives the value of src, which holds entity, and its TTL to dst,
+// replacing whatever dst held. src is removed unless keepSource is set, in
+// which case dst gets a copy of the value. The caller holds the locks of both
+// keys.
+func (db *DB) transferKey(src, dst string, entity *datastruct.DataEntity, keepSource bool) error {
+	expireAt, hasTTL := db.ExpireTime(src)
+
+	db.Remove(dst)
+	if keepSource {
+		if err := db.rebuildKey(dst, entity); err != nil {
+			db.Remove(dst)
+			return err
+		}
+	} else {
+		db.Remove(src)
+		db.putEntity(dst, entity)
+		if hash, ok := entity.Data.(*datastruct.Hash); ok {
+			db.scheduleFieldExpiry(dst, hash)
+		}
+	}
+
+	if hasTTL {
+		db.Expire(dst, expireAt.Sub(db.now()))
+	}
+	return nil
+}
+
+// rebuildKey stores a copy of entity under key by running the commands that
+// rebuild it
+func (db *DB) rebuildKey(key string, entity *datastruct.DataEntity) error {
+	for _, cmdLine := range RebuildCommands(key, entity) {
+		cmdType, executor, err := lookupCommand(cmdLine)
+		if err != nil {
+			return err
+		}
+		if _, err := db.executeTyped(cmdType, executor, cmdLine[1:]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// execRename implements RENAME key newkey
+func execRename(db *DB, args [][]byte) (Result, error) {
+	if len(args) != 2 {
+		return nil, errWrongArgs("rename")
+	}
+	src, dst := string(args[0]), string(args[1])
+
+	entity, ok := db.GetEntity(src)
+	if !ok {
+		return nil, ErrNoSuchKey
+	}
+	if src != dst {
+		if err := db.transferKey(src, dst, entity, false); err != nil {
+			return nil, err
+		}
+	}
+	return StatusResult("OK"), nil
+}
+
+// execRenameNX implements RENAMENX key newkey, which renames only to a
+// missing key
+func execRenameNX(db *DB, args [][]byte) (Result, error) {
+	if len(args) != 2 {
+		return nil, errWrongArgs("renamenx")
+	}
+	src, dst := string(args[0]), string(args[1])
+
+	entity, ok := db.GetEntity(src)
+	if !ok {
+		return nil, ErrNoSuchKey
+	}
+	if db.Exists(dst) {
+		return IntResult(0), nil
+	}
+	if err := db.transferKey(src, dst, entity, false); err != nil {
+		return nil, err
+	}
+	return IntResult(1), nil
+}
+
+// execCopy implements COPY source destination [DB destination-db] [REPLACE]
+func execCopy(db *DB, args [][]byte) (Result, error) {
+	if len(args) < 2 {
+		return nil, errWrongArgs("copy")
+	}
+	src, dst := string(args[0]), string(args[1])
+
+	replace := false
+	for i := 2; i < len(args); i++ {
+		switch option := strings.ToUpper(string(args[i])); {
+		case option == "REPLACE":
+			replace = true
+		case option == "DB" && i+1 < len(args):
+			i++
+			index, err := strconv.Atoi(string(args[i]))
+			if err != nil {
+				return nil, ErrNotInteger
+			}
+			// There is a single database
+			if index != 0 {
+				return nil, errors.New("ERR DB index is out of range")
+			}
+		default:
+			return nil, ErrSyntax
+		}
+	}
+	if src == dst {
+		return nil, errors.New("ERR source and destination objects are the same")
+	}
+
+	entity, ok := db.GetEntity(src)
+	if !ok {
+		return IntResult(0), nil
+	}
+	if !replace && db.Exists(dst) {
+		return IntResult(0), nil
+	}
+	if err := db.transferKey(src, dst, entity, true); err != nil {
+		return nil, err
+	}
+	return IntResult(1), nil
+}
@@ -0,0 +1,209 @@
+package database_test
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/wangbo/gocache/database"
+)
+
+// TestRenameCarriesValueAndTTL renames every key of populate and checks that
+// it keeps its value and expiration time
+func TestRenameCarriesValueAndTTL(t *testing.T) {
+	db := database.MakeDB()
+	defer db.Close()
+	populate(t, db)
+	before := dumpKeyspace(t, db)
+
+	for key := range before {
+		exec(t, db, "RENAME", key, "renamed:"+key)
+	}
+	after := dumpKeyspace(t, db)
+	for key, want := range before {
+		if got := after["renamed:"+key]; !reflect.DeepEqual(got, want) {
+			t.Errorf("RENAME %s: expected %q, got %q", key, want, got)
+		}
+		if _, ok := after[key]; ok {
+			t.Errorf("RENAME %s: expected the source to be removed", key)
+		}
+	}
+}
+
+// TestCopyCarriesValueAndTTL copies every key of populate and checks that the
+// copy has the value and expiration time of the source, and shares nothing
+// with it
+func TestCopyCarriesValueAndTTL(t *testing.T) {
+	db := database.MakeDB()
+	defer db.Close()
+	populate(t, db)
+	before := dumpKeyspace(t, db)
+
+	for key := range before {
+		if got := string(exec(t, db, "COPY", key, "copy:"+key)[0]); got != "1" {
+			t.Errorf("COPY %s: expected 1, got %s", key, got)
+		}
+	}
+	after := dumpKeyspace(t, db)
+	for key, want := range before {
+		if got := after["copy:"+key]; !reflect.DeepEqual(got, want) {
+			t.Errorf("COPY %s: expected %q, got %q", key, want, got)
+		}
+		if got := after[key]; !reflect.DeepEqual(got, want) {
+			t.Errorf("COPY %s: expected the source to be kept, got %q", key, got)
+		}
+	}
+
+	exec(t, db, "RPUSH", "copy:list", "more")
+	exec(t, db, "HSET", "copy:hash", "f1", "changed")
+	if got := dumpKeyspace(t, db); !reflect.DeepEqual(got["list"], before["list"]) || !reflect.DeepEqual(got["hash"], before["hash"]) {
+		t.Error("Expected changing a copy to leave its source alone")
+	}
+	if used, want := db.GetUsedMemory(), int64(0); used <= want {
+		t.Errorf("Expected the copies to be accounted, got %d", used)
+	}
+}
+
+func TestTransferReplacesDestinationTTL(t *testing.T) {
+	tests := []struct {
+		args   []string
+		reply  string
+		dstTTL bool // Whether dst ends with the TTL of src
+	}{
+		{[]string{"RENAME", "src", "dst"}, "OK", false},
+		{[]string{"RENAMENX", "src", "dst"}, "0", true},
+		{[]string{"COPY", "src", "dst"}, "0", true},
+		{[]string{"COPY", "src", "dst", "REPLACE"}, "1", false},
+		{[]string{"COPY", "src", "dst", "DB", "0", "REPLACE"}, "1", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(strings.Join(tt.args, " "), func(t *testing.T) {
+			db := database.MakeDB()
+			defer db.Close()
+			exec(t, db, "SET", "src", "v")
+			exec(t, db, "SET", "dst", "old", "EX", "100")
+
+			if got := string(exec(t, db, tt.args...)[0]); got != tt.reply {
+				t.Errorf("Expected %s, got %s", tt.reply, got)
+			}
+			ttl := db.TTL("dst")
+			if tt.dstTTL && ttl <= 0 {
+				t.Errorf("Expected dst to keep its TTL, got %v", ttl)
+			}
+			if !tt.dstTTL && ttl != -1 {
+				t.Errorf("Expected dst to take the absence of TTL of src, got %v", ttl)
+			}
+		})
+	}
+}
+
+func TestRenameAndCopyEdgeCases(t *testing.T) {
+	db := database.MakeDB()
+	defer db.Close()
+	exec(t, db, "SET", "k", "v", "PX", "100000")
+
+	// Renaming a key to itself keeps it, with its TTL
+	exec(t, db, "RENAME", "k", "k")
+	if ttl := db.TTL("k"); ttl <= 0 {
+		t.Errorf("Expected RENAME k k to keep the TTL, got %v", ttl)
+	}
+	if got := string(exec(t, db, "RENAMENX", "k", "k")[0]); got != "0" {
+		t.Errorf("Expected RENAMENX k k to return 0, got %s", got)
+	}
+	if got := string(exec(t, db, "COPY", "missing", "k2")[0]); got != "0" {
+		t.Errorf("Expected COPY of a missing key to return 0, got %s", got)
+	}
+
+	for _, tt := range []struct {
+		args []string
+		err  string
+	}{
+		{[]string{"RENAME", "missing", "k2"}, "ERR no such key"},
+		{[]string{"RENAMENX", "missing", "k2"}, "ERR no such key"},
+		{[]string{"COPY", "k", "k"}, "ERR source and destination objects are the same"},
+		{[]string{"COPY", "k", "k2", "DB", "1"}, "ERR DB index is out of range"},
+		{[]string{"COPY", "k", "k2", "DB", "x"}, "ERR value is not an integer or out of range"},
+		{[]string{"COPY", "k", "k2", "NOW"}, "ERR syntax error"},
+		{[]string{"RENAME", "k"}, "ERR wrong number of arguments for 'rename' command"},
+	} {
+		if _, err := db.ExecCommand(tt.args[0], tt.args[1:]...); err == nil || err.Error() != tt.err {
+			t.Errorf("%v: expected %q, got %v", tt.args, tt.err, err)
+		}
+	}
+}
+
+// TestTransferAbortsWatchers checks that RENAME, RENAMENX and COPY abort the
+// transactions WATCHing either name, and only when they write
+func TestTransferAbortsWatchers(t *testing.T) {
+	tests := []struct {
+		cmd []string
+		src bool // Whether a transaction WATCHing src aborts
+		dst bool
+	}{
+		{[]string{"RENAME", "src", "dst"}, true, true},
+		{[]string{"RENAMENX", "src", "dst"}, true, true},
+		{[]string{"RENAMENX", "src", "other"}, false, false},
+		{[]string{"COPY", "src", "dst"}, false, true},
+		{[]string{"COPY", "src", "other"}, false, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(strings.Join(tt.cmd, " "), func(t *testing.T) {
+			for _, watched := range []string{"src", "dst"} {
+				db := database.MakeDB()
+				defer db.Close()
+				exec(t, db, "SET", "src", "v")
+				exec(t, db, "SET", "other", "v")
+				if tt.cmd[2] == "other" {
+					exec(t, db, "SET", "dst", "v")
+				}
+
+				ms := database.NewMultiState(db)
+				run := func(args ...string) [][]byte {
+					cmdLine := make([][]byte, len(args))
+					for i, arg := range args {
+						cmdLine[i] = []byte(arg)
+					}
+					result, err := db.ExecWithState(ms, cmdLine)
+					if err != nil {
+						t.Fatalf("%v: %v", args, err)
+					}
+					return result
+				}
+				run("WATCH", watched)
+				exec(t, db, tt.cmd...)
+				run("MULTI")
+				run("PING")
+				aborted := run("EXEC") == nil
+
+				want := tt.src
+				if watched == "dst" {
+					want = tt.dst
+				}
+				if aborted != want {
+					t.Errorf("WATCH %s: expected aborted %v, got %v", watched, want, aborted)
+				}
+			}
+		})
+	}
+}
+
+// TestRenameKeepsHashFieldTTL checks that a renamed hash still expires its
+// fields
+func TestRenameKeepsHashFieldTTL(t *testing.T) {
+	db := database.MakeDB()
+	defer db.Close()
+	exec(t, db, "HSET", "h", "short", "v", "long", "v")
+	exec(t, db, "HPEXPIRE", "h", "50", "FIELDS", "1", "short")
+	exec(t, db, "RENAME", "h", "h2")
+	exec(t, db, "COPY", "h2", "h3")
+
+	time.Sleep(100 * time.Millisecond)
+	for _, key := range []string{"h2", "h3"} {
+		if got := exec(t, db, "HKEYS", key); len(got) != 1 || string(got[0]) != "long" {
+			t.Errorf("Expected only long to remain in %s, got %q", key, got)
+		}
+	}
+}
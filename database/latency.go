@@ -0,0 +1,231 @@
+package database
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Latency monitor
+//
+// Like the LATENCY subsystem of Redis, the latency monitor records samples
+// of operations that took at least latency-monitor-threshold, grouped by
+// event class rather than per command like the slow log:
+//
+//	command       a command execution
+//	bgsave        a BGSAVE, from its start to the end of the write
+//	aof-write     a write of a command to the AOF
+//	aof-rewrite   an AOF rewrite
+//	expire-cycle  a time wheel tick expiring keys
+//
+// Each event keeps its latest latencyHistoryLen samples in a ring buffer.
+// Samples recorded in the same second are merged, keeping the maximum.
+
+// Latency event names
+const (
+	LatencyEventCommand     = "command"
+	LatencyEventBgSave      = "bgsave"
+	LatencyEventAOFWrite    = "aof-write"
+	LatencyEventAOFRewrite  = "aof-rewrite"
+	LatencyEventExpireCycle = "expire-cycle"
+)
+
+// latencyHistoryLen is the number of samples kept per event, as in Redis
+const latencyHistoryLen = 160
+
+// LatencySample is the latency of an event at a given second
+type LatencySample struct {
+	Time    int64 // Unix time in seconds
+	Latency int64 // Milliseconds
+}
+
+// LatencyEventStats sums up the samples of an event
+type LatencyEventStats struct {
+	Name   string
+	Latest LatencySample
+	Max    int64 // Milliseconds, highest latency ever recorded
+}
+
+// latencyEvent holds the samples of one event class
+type latencyEvent struct {
+	samples [latencyHistoryLen]LatencySample
+	next    int // Index of the next sample to write
+	len     int
+	max     int64
+}
+
+// latencyMonitor records latency samples per event
+type latencyMonitor struct {
+	// Threshold in nanoseconds; negative disables the monitor
+	threshold atomic.Int64
+
+	mu     sync.Mutex
+	events map[string]*latencyEvent
+}
+
+// newLatencyMonitor creates a disabled latency monitor
+func newLatencyMonitor() *latencyMonitor {
+	m := &latencyMonitor{events: make(map[string]*latencyEvent)}
+	m.threshold.Store(-1)
+	return m
+}
+
+// SetLatencyMonitorThreshold sets the latency from which events are
+// recorded; 0 records every event and a negative threshold disables the
+// monitor. The latency-monitor-threshold directive sets it in milliseconds,
+// where 0 disables the monitor as in Redis.
+func (db *DB) SetLatencyMonitorThreshold(threshold time.Duration) {
+	db.latency.threshold.Store(int64(threshold))
+}
+
+// recordExpireCycle records the time a time wheel tick spent expiring keys
+func (db *DB) recordExpireCycle(expired int, elapsed time.Duration) {
+	db.RecordLatency(LatencyEventExpireCycle, elapsed)
+}
+
+// RecordLatency records a latency sample of an event if it reaches the
+// threshold
+func (db *DB) RecordLatency(event string, latency time.Duration) {
+	threshold := db.latency.threshold.Load()
+	if threshold < 0 || int64(latency) < threshold {
+		return
+	}
+
+	sample := LatencySample{Time: db.now().Unix(), Latency: latency.Milliseconds()}
+
+	m := db.latency
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e, ok := m.events[event]
+	if !ok {
+		e = &latencyEvent{}
+		m.events[event] = e
+	}
+	e.max = max(e.max, sample.Latency)
+
+	if e.len > 0 {
+		last := &e.samples[(e.next+latencyHistoryLen-1)%latencyHistoryLen]
+		if last.Time == sample.Time {
+			last.Latency = max(last.Latency, sample.Latency)
+			return
+		}
+	}
+	e.samples[e.next] = sample
+	e.next = (e.next + 1) % latencyHistoryLen
+	e.len = min(e.len+1, latencyHistoryLen)
+}
+
+// LatencyHistory returns the samples of an event, oldest first
+func (db *DB) LatencyHistory(event string) []LatencySample {
+	m := db.latency
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e, ok := m.events[event]
+	if !ok {
+		return nil
+	}
+	samples := make([]LatencySample, 0, e.len)
+	for i := 0; i < e.len; i++ {
+		samples = append(samples, e.samples[(e.next-e.len+i+latencyHistoryLen)%latencyHistoryLen])
+	}
+	return samples
+}
+
+// LatencyLatest returns the latest sample and the maximum latency of every
+// event, sorted by name
+func (db *DB) LatencyLatest() []LatencyEventStats {
+	m := db.latency
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stats := make([]LatencyEventStats, 0, len(m.events))
+	for name, e := range m.events {
+		stats = append(stats, LatencyEventStats{
+			Name:   name,
+			Latest: e.samples[(e.next+latencyHistoryLen-1)%latencyHistoryLen],
+			Max:    e.max,
+		})
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Name < stats[j].Name })
+	return stats
+}
+
+// ResetLatency deletes the samples of the given events, or of every event
+// if none is given, and returns the number of events deleted
+func (db *DB) ResetLatency(events ...string) int {
+	m := db.latency
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(events) == 0 {
+		n := len(m.events)
+		m.events = make(map[string]*latencyEvent)
+		return n
+	}
+	n := 0
+	for _, event := range events {
+		if _, ok := m.events[event]; ok {
+			delete(m.events, event)
+			n++
+		}
+	}
+	return n
+}
+
+// execLatency implements LATENCY HISTORY event, LATENCY LATEST and
+// LATENCY RESET [event ...]
+// HISTORY returns pairs of time and latency; LATEST returns groups of
+// event name, time, latest latency and maximum latency.
+func execLatency(db *DB, args [][]byte) ([][]byte, error) {
+	if len(args) < 1 {
+		return nil, errWrongArgs("latency")
+	}
+
+	switch strings.ToLower(string(args[0])) {
+	case "history":
+		if len(args) != 2 {
+			return nil, errWrongArgs("latency|history")
+		}
+		samples := db.LatencyHistory(string(args[1]))
+		result := make([][]byte, 0, 2*len(samples))
+		for _, s := range samples {
+			result = append(result, []byte(strconv.FormatInt(s.Time, 10)), []byte(strconv.FormatInt(s.Latency, 10)))
+		}
+		return result, nil
+
+	case "latest":
+		if len(args) != 1 {
+			return nil, errWrongArgs("latency|latest")
+		}
+		stats := db.LatencyLatest()
+		result := make([][]byte, 0, 4*len(stats))
+		for _, s := range stats {
+			result = append(result, []byte(s.Name),
+				[]byte(strconv.FormatInt(s.Latest.Time, 10)),
+				[]byte(strconv.FormatInt(s.Latest.Latency, 10)),
+				[]byte(strconv.FormatInt(s.Max, 10)))
+		}
+		return result, nil
+
+	case "reset":
+		return [][]byte{[]byte(strconv.Itoa(db.ResetLatency(bytesToStrings(args[1:])...)))}, nil
+
+	case "help":
+		if !isHelpSubcommand(args) {
+			return nil, errUnknownSubcommand("LATENCY", args[0])
+		}
+		return subcommandHelp("LATENCY",
+			"HISTORY <event>",
+			"    Return time-latency samples for the <event> class.",
+			"LATEST",
+			"    Return the latest latency samples for all events.",
+			"RESET [<event> ...]",
+			"    Reset latency data of one or more <event> classes.",
+			"    (default: reset all data for all event classes)",
+		), nil
+
+	default:
+		return nil, errUnknownSubcommand("LATENCY", args[0])
+	}
+}
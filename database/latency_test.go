@@ -0,0 +1,103 @@
+package database
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLatencyMonitorRecordsEvents(t *testing.T) {
+	db := MakeDB()
+	defer db.Close()
+
+	// The monitor is disabled by default
+	db.RecordLatency(LatencyEventCommand, time.Second)
+	if stats := db.LatencyLatest(); len(stats) != 0 {
+		t.Fatalf("Expected no events while disabled, got %+v", stats)
+	}
+
+	db.SetLatencyMonitorThreshold(100 * time.Millisecond)
+	db.RecordLatency(LatencyEventCommand, 50*time.Millisecond)
+	db.RecordLatency(LatencyEventCommand, 150*time.Millisecond)
+	db.RecordLatency(LatencyEventCommand, 120*time.Millisecond)
+	db.RecordLatency(LatencyEventBgSave, 300*time.Millisecond)
+
+	// Samples of the same second are merged, keeping the maximum
+	history := db.LatencyHistory(LatencyEventCommand)
+	if len(history) != 1 || history[0].Latency != 150 {
+		t.Errorf("Expected one sample of 150ms, got %+v", history)
+	}
+
+	stats := db.LatencyLatest()
+	if len(stats) != 2 || stats[0].Name != LatencyEventBgSave || stats[1].Name != LatencyEventCommand {
+		t.Fatalf("Expected the bgsave and command events, got %+v", stats)
+	}
+	if stats[1].Latest.Latency != 150 || stats[1].Max != 150 {
+		t.Errorf("Unexpected command stats %+v", stats[1])
+	}
+
+	result, err := db.ExecCommand("LATENCY", "RESET", LatencyEventBgSave, "nosuch")
+	if err != nil || string(result[0]) != "1" {
+		t.Errorf("Expected 1 event reset, got %q %v", result, err)
+	}
+	if result, _ := db.ExecCommand("LATENCY", "HISTORY", LatencyEventBgSave); len(result) != 0 {
+		t.Errorf("Expected no bgsave history after RESET, got %q", result)
+	}
+	if result, _ := db.ExecCommand("LATENCY", "RESET"); string(result[0]) != "1" {
+		t.Errorf("Expected RESET to delete the remaining event, got %q", result)
+	}
+}
+
+func TestLatencyHistoryIsARingBuffer(t *testing.T) {
+	db := MakeDB()
+	defer db.Close()
+	db.SetLatencyMonitorThreshold(0)
+
+	// Fill the history with samples of distinct seconds
+	e := &latencyEvent{}
+	db.latency.events["test"] = e
+	for i := 0; i < latencyHistoryLen+10; i++ {
+		e.samples[e.next] = LatencySample{Time: int64(i), Latency: int64(i)}
+		e.next = (e.next + 1) % latencyHistoryLen
+		e.len = min(e.len+1, latencyHistoryLen)
+	}
+	db.RecordLatency("test", 5*time.Millisecond)
+
+	history := db.LatencyHistory("test")
+	if len(history) != latencyHistoryLen {
+		t.Fatalf("Expected %d samples, got %d", latencyHistoryLen, len(history))
+	}
+	if history[0].Time != 11 || history[len(history)-1].Latency != 5 {
+		t.Errorf("Expected the oldest samples to be dropped, got %+v ... %+v", history[0], history[len(history)-1])
+	}
+}
+
+func TestExpireCycleLatencyEvent(t *testing.T) {
+	db := MakeDB()
+	defer db.Close()
+	db.SetLatencyMonitorThreshold(0)
+
+	db.ExecCommand("SET", "k", "v")
+	db.ExecCommand("PEXPIRE", "k", "10")
+
+	deadline := time.Now().Add(2 * time.Second)
+	for len(db.LatencyHistory(LatencyEventExpireCycle)) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected an expire-cycle event after a key expired")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestLatencyCommandErrors(t *testing.T) {
+	db := MakeDB()
+	defer db.Close()
+
+	for _, args := range [][]string{{"HISTORY"}, {"LATEST", "x"}, {"NOSUCH"}} {
+		if _, err := db.ExecCommand("LATENCY", args...); err == nil {
+			t.Errorf("LATENCY %v should fail", args)
+		}
+	}
+	if result, err := db.ExecCommand("LATENCY", "HELP"); err != nil || len(result) == 0 {
+		t.Errorf("LATENCY HELP failed: %q %v", result, err)
+	}
+}
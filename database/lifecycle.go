@@ -0,0 +1,156 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Database lifecycle
+//
+// A database runs background work besides its commands: the expiration
+// wheels, the goroutine calling OnEvict and OnExpire callbacks, background
+// saves and the synchronization with a master. Every such goroutine is
+// started through goWorker so that Close can stop it: Close refuses new
+// commands with ErrClosed, signals the workers, waits for them for at most
+// closeTimeout, then flushes and closes the attached persistence and drops
+// the data. Close is idempotent.
+
+// ErrClosed is returned by commands executed after Close
+var ErrClosed = errors.New("ERR database is closed")
+
+// closeTimeout is how long Close waits for the background workers to stop
+var closeTimeout = 5 * time.Second
+
+// lifecycle tracks the background workers of a database
+type lifecycle struct {
+	mu      sync.Mutex // Serializes starting workers with shutdown
+	closed  atomic.Bool
+	done    chan struct{} // Closed by shutdown to stop the workers
+	workers sync.WaitGroup
+	closers []io.Closer // Persistence flushed and closed by Close
+}
+
+func newLifecycle() *lifecycle {
+	return &lifecycle{done: make(chan struct{})}
+}
+
+// goWorker runs fn in a goroutine that Close waits for; fn must return soon
+// after done is closed. If the database is already closed fn is not run and
+// goWorker returns false.
+func (l *lifecycle) goWorker(fn func(done <-chan struct{})) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed.Load() {
+		return false
+	}
+	l.workers.Add(1)
+	go func() {
+		defer l.workers.Done()
+		fn(l.done)
+	}()
+	return true
+}
+
+// shutdown marks the database closed and signals the workers to stop. It
+// returns false if the database was already closed.
+func (l *lifecycle) shutdown() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed.Load() {
+		return false
+	}
+	l.closed.Store(true)
+	close(l.done)
+	return true
+}
+
+// wait waits for the workers to stop and reports whether they all did
+// within timeout
+func (l *lifecycle) wait(timeout time.Duration) bool {
+	stopped := make(chan struct{})
+	go func() {
+		l.workers.Wait()
+		close(stopped)
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-stopped:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// IsClosed reports whether Close was called
+func (db *DB) IsClosed() bool {
+	return db.lifecycle.closed.Load()
+}
+
+// AttachPersistence registers p, typically an AOF handler, to be closed by
+// Close once the background workers stopped, so that everything they wrote
+// is flushed and synced to disk. A p attached after Close is closed at once.
+func (db *DB) AttachPersistence(p io.Closer) {
+	l := db.lifecycle
+	l.mu.Lock()
+	if !l.closed.Load() {
+		l.closers = append(l.closers, p)
+		l.mu.Unlock()
+		return
+	}
+	l.mu.Unlock()
+	p.Close()
+}
+
+// Close stops the background workers, flushes the attached persistence and
+// releases the data. Commands executed afterwards fail with ErrClosed.
+// Closing a closed database does nothing and returns nil.
+func (db *DB) Close() error {
+	if !db.lifecycle.shutdown() {
+		return nil
+	}
+
+	// 1. Stop the time wheels (no more TTL callbacks)
+	db.timeWheel.Stop()
+	db.fieldWheel.Stop()
+
+	// 2. Wake blocked clients, then wait for the commands still running
+	db.blocked.close()
+	db.mu.Lock()
+	db.mu.Unlock()
+
+	// 3. Wait for background saves, the key event dispatcher and the sync
+	// with the master
+	var err error
+	if !db.lifecycle.wait(closeTimeout) {
+		err = fmt.Errorf("background workers did not stop within %v", closeTimeout)
+	}
+
+	// 4. Flush and close the attached persistence
+	db.lifecycle.mu.Lock()
+	closers := db.lifecycle.closers
+	db.lifecycle.closers = nil
+	db.lifecycle.mu.Unlock()
+	for _, p := range closers {
+		if cerr := p.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+
+	// 5. Clear all data structures and counters
+	db.data.Clear()
+	db.ttlMap.Clear()
+	db.versionMap.Clear()
+	atomic.StoreInt64(&db.usedMemory, 0)
+
+	db.ResetSlowLog()
+
+	db.multiState.Discard()
+
+	return err
+}
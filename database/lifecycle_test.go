@@ -0,0 +1,129 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/wangbo/gocache/config"
+	"github.com/wangbo/gocache/datastruct"
+	"github.com/wangbo/gocache/replication"
+)
+
+// closeRecorder is attached persistence counting how often it is closed
+type closeRecorder struct {
+	closed int
+}
+
+func (c *closeRecorder) Close() error {
+	c.closed++
+	return nil
+}
+
+func TestCloseIsIdempotent(t *testing.T) {
+	db := MakeDBWithConfig(config.Default(), replication.NewReplicationState())
+	p := &closeRecorder{}
+	db.AttachPersistence(p)
+	db.ExecCommand("SET", "key", "value")
+
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("Second Close: %v", err)
+	}
+	if p.closed != 1 {
+		t.Errorf("Expected the persistence to be closed once, got %d", p.closed)
+	}
+	if !db.IsClosed() {
+		t.Error("Expected IsClosed to report true")
+	}
+
+	// Persistence attached after Close is closed right away
+	late := &closeRecorder{}
+	db.AttachPersistence(late)
+	if late.closed != 1 {
+		t.Errorf("Expected late persistence to be closed, got %d", late.closed)
+	}
+}
+
+func TestCommandsAfterCloseFail(t *testing.T) {
+	db := MakeDBWithConfig(config.Default(), replication.NewReplicationState())
+	db.ExecCommand("SET", "key", "value")
+	db.Close()
+
+	for _, cmd := range [][]string{{"GET", "key"}, {"SET", "key", "value"}, {"MULTI"}, {"BGSAVE"}} {
+		if _, err := db.ExecCommand(cmd[0], cmd[1:]...); !errors.Is(err, ErrClosed) {
+			t.Errorf("%s: expected ErrClosed, got %v", cmd[0], err)
+		}
+	}
+
+	_, err := db.GetOrLoad(context.Background(), "key", 0, func(ctx context.Context) ([]byte, error) {
+		t.Error("Loader called after Close")
+		return nil, nil
+	})
+	if !errors.Is(err, ErrClosed) {
+		t.Errorf("GetOrLoad: expected ErrClosed, got %v", err)
+	}
+}
+
+func TestCloseWakesBlockedClients(t *testing.T) {
+	db := MakeDBWithConfig(config.Default(), replication.NewReplicationState())
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := db.ExecCommand("XREAD", "BLOCK", "0", "STREAMS", "stream", "$")
+		done <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	db.Close()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Blocked XREAD not woken by Close")
+	}
+}
+
+func TestCloseStopsBackgroundWorkers(t *testing.T) {
+	// Let goroutines of earlier tests wind down before taking the baseline
+	runtime.GC()
+	time.Sleep(50 * time.Millisecond)
+	before := runtime.NumGoroutine()
+
+	value := strings.Repeat("x", 100)
+	for i := 0; i < 100; i++ {
+		cfg := config.Default()
+		cfg.MaxMemory = 2000
+		cfg.MaxMemoryPolicy = "allkeys-lru"
+		cfg.LatencyMonitorThreshold = 1
+		db := MakeDBWithConfig(cfg, replication.NewReplicationState())
+
+		noop := func(string, *datastruct.DataEntity, EvictReason) {}
+		db.OnEvict(noop)
+		db.OnExpire(noop)
+		for j := 0; j < 30; j++ {
+			db.ExecCommand("SET", "key"+strconv.Itoa(j), value, "PX", "5")
+		}
+		db.ExecCommand("HSET", "hash", "field", "value")
+		db.ExecCommand("HPEXPIRE", "hash", "5", "FIELDS", "1", "field")
+		db.ExecCommand("BGSAVE")
+
+		if err := db.Close(); err != nil {
+			t.Fatalf("Close: %v", err)
+		}
+	}
+
+	// Goroutines exiting after Close returned may not be gone yet
+	deadline := time.Now().Add(2 * time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if after := runtime.NumGoroutine(); after > before {
+		t.Errorf("Leaked %d goroutines after closing 100 databases", after-before)
+	}
+}
@@ -2,8 +2,10 @@ package database
 
 import (
 	"errors"
+	"math"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/wangbo/gocache/datastruct"
 )
@@ -12,79 +14,83 @@ import (
 
 func execLPush(db *DB, args [][]byte) ([][]byte, error) {
 	if len(args) < 2 {
-		return nil, errors.New("wrong number of arguments for LPUSH")
+		return nil, errWrongArgs("lpush")
 	}
 
 	key := string(args[0])
 	values := args[1:]
 
 	entity, ok := db.GetEntity(key)
-	if !ok || entity.Data == nil {
+	created := !ok || entity.Data == nil
+	if created {
 		entity = datastruct.MakeList()
 	}
 
 	list, ok := entity.Data.(*datastruct.List)
 	if !ok {
-		return nil, errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
+		return nil, ErrWrongType
 	}
 
 	length := list.LPush(values...)
-	db.PutEntity(key, entity)
+	if created {
+		db.PutEntity(key, entity)
+	}
 
 	return [][]byte{[]byte(strconv.FormatInt(int64(length), 10))}, nil
 }
 
 func execRPush(db *DB, args [][]byte) ([][]byte, error) {
 	if len(args) < 2 {
-		return nil, errors.New("wrong number of arguments for RPUSH")
+		return nil, errWrongArgs("rpush")
 	}
 
 	key := string(args[0])
 	values := args[1:]
 
 	entity, ok := db.GetEntity(key)
-	if !ok || entity.Data == nil {
+	created := !ok || entity.Data == nil
+	if created {
 		entity = datastruct.MakeList()
 	}
 
 	list, ok := entity.Data.(*datastruct.List)
 	if !ok {
-		return nil, errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
+		return nil, ErrWrongType
 	}
 
 	length := list.RPush(values...)
-	db.PutEntity(key, entity)
+	if created {
+		db.PutEntity(key, entity)
+	}
 
 	return [][]byte{[]byte(strconv.FormatInt(int64(length), 10))}, nil
 }
 
 func execLPop(db *DB, args [][]byte) ([][]byte, error) {
 	if len(args) != 1 {
-		return nil, errors.New("wrong number of arguments for LPOP")
+		return nil, errWrongArgs("lpop")
 	}
 
 	key := string(args[0])
 
 	entity, ok := db.GetEntity(key)
 	if !ok || entity.Data == nil {
-		return [][]byte{nil}, nil
+		return nullResult(), nil
 	}
 
 	list, ok := entity.Data.(*datastruct.List)
 	if !ok {
-		return nil, errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
+		return nil, ErrWrongType
 	}
 
 	value := list.LPop()
 	if value == nil {
 		db.Remove(key)
-		return [][]byte{nil}, nil
+		return nullResult(), nil
 	}
 
 	if list.Len() == 0 {
 		db.Remove(key)
-	} else {
-		db.PutEntity(key, entity)
 	}
 
 	return [][]byte{value}, nil
@@ -92,60 +98,136 @@ func execLPop(db *DB, args [][]byte) ([][]byte, error) {
 
 func execRPop(db *DB, args [][]byte) ([][]byte, error) {
 	if len(args) != 1 {
-		return nil, errors.New("wrong number of arguments for RPOP")
+		return nil, errWrongArgs("rpop")
 	}
 
 	key := string(args[0])
 
 	entity, ok := db.GetEntity(key)
 	if !ok || entity.Data == nil {
-		return [][]byte{nil}, nil
+		return nullResult(), nil
 	}
 
 	list, ok := entity.Data.(*datastruct.List)
 	if !ok {
-		return nil, errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
+		return nil, ErrWrongType
 	}
 
 	value := list.RPop()
 	if value == nil {
 		db.Remove(key)
-		return [][]byte{nil}, nil
+		return nullResult(), nil
 	}
 
 	if list.Len() == 0 {
 		db.Remove(key)
-	} else {
-		db.PutEntity(key, entity)
 	}
 
 	return [][]byte{value}, nil
 }
 
+func execBLPop(db *DB, args [][]byte) ([][]byte, error) {
+	return blockingPop(db, "BLPOP", args, true)
+}
+
+func execBRPop(db *DB, args [][]byte) ([][]byte, error) {
+	return blockingPop(db, "BRPOP", args, false)
+}
+
+// blockingPop pops an element from the head (or tail) of the first
+// non-empty list among the keys and returns the key and the element. If all
+// the lists are empty it blocks until one of them is pushed to or the
+// timeout, given in seconds as the last argument (0 waits forever), expires.
+func blockingPop(db *DB, cmd string, args [][]byte, left bool) ([][]byte, error) {
+	if len(args) < 2 {
+		return nil, errWrongArgs(cmd)
+	}
+	keys, timeoutArg := args[:len(args)-1], args[len(args)-1]
+
+	seconds, err := strconv.ParseFloat(string(timeoutArg), 64)
+	if err != nil || math.IsNaN(seconds) || math.IsInf(seconds, 0) {
+		return nil, errors.New("ERR timeout is not a float or out of range")
+	}
+	if seconds < 0 {
+		return nil, errors.New("ERR timeout is negative")
+	}
+
+	for _, arg := range keys {
+		key := string(arg)
+		entity, ok := db.GetEntity(key)
+		if !ok || entity.Data == nil {
+			continue
+		}
+		list, ok := entity.Data.(*datastruct.List)
+		if !ok {
+			return nil, ErrWrongType
+		}
+
+		var value []byte
+		if left {
+			value = list.LPop()
+		} else {
+			value = list.RPop()
+		}
+		if value == nil {
+			continue
+		}
+		if list.Len() == 0 {
+			db.Remove(key)
+		}
+		return [][]byte{[]byte(key), value}, nil
+	}
+
+	// Retry the same command once a list is pushed to
+	retry := make([][]byte, 0, len(args)+1)
+	retry = append(retry, []byte(cmd))
+	retry = append(retry, args...)
+	return nil, &blockedCommand{
+		keys:    bytesToStrings(keys),
+		timeout: time.Duration(seconds * float64(time.Second)),
+		cmdLine: retry,
+	}
+}
+
+// ServedPopCommand returns the command a BLPOP or BRPOP that returned result
+// is propagated as: LPOP or RPOP of the key it popped from, which does not
+// block on a slave or when the AOF is loaded. It returns nil if nothing was
+// popped.
+func ServedPopCommand(cmdLine, result [][]byte) [][]byte {
+	if len(cmdLine) == 0 || len(result) != 2 || result[0] == nil {
+		return nil
+	}
+	pop := "LPOP"
+	if strings.EqualFold(string(cmdLine[0]), "BRPOP") {
+		pop = "RPOP"
+	}
+	return [][]byte{[]byte(pop), result[0]}
+}
+
 func execLIndex(db *DB, args [][]byte) ([][]byte, error) {
 	if len(args) != 2 {
-		return nil, errors.New("wrong number of arguments for LINDEX")
+		return nil, errWrongArgs("lindex")
 	}
 
 	key := string(args[0])
 	index, err := strconv.Atoi(string(args[1]))
 	if err != nil {
-		return nil, errors.New("ERR value is not an integer or out of range")
+		return nil, ErrNotInteger
 	}
 
 	entity, ok := db.GetEntity(key)
 	if !ok || entity.Data == nil {
-		return [][]byte{nil}, nil
+		return nullResult(), nil
 	}
 
 	list, ok := entity.Data.(*datastruct.List)
 	if !ok {
-		return nil, errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
+		return nil, ErrWrongType
 	}
 
 	value := list.LIndex(index)
 	if value == nil {
-		return [][]byte{nil}, nil
+		return nullResult(), nil
 	}
 
 	return [][]byte{value}, nil
@@ -153,24 +235,24 @@ func execLIndex(db *DB, args [][]byte) ([][]byte, error) {
 
 func execLSet(db *DB, args [][]byte) ([][]byte, error) {
 	if len(args) != 3 {
-		return nil, errors.New("wrong number of arguments for LSET")
+		return nil, errWrongArgs("lset")
 	}
 
 	key := string(args[0])
 	index, err := strconv.Atoi(string(args[1]))
 	if err != nil {
-		return nil, errors.New("ERR value is not an integer or out of range")
+		return nil, ErrNotInteger
 	}
 	value := args[2]
 
 	entity, ok := db.GetEntity(key)
 	if !ok || entity.Data == nil {
-		return nil, errors.New("ERR no such key")
+		return nil, ErrNoSuchKey
 	}
 
 	list, ok := entity.Data.(*datastruct.List)
 	if !ok {
-		return nil, errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
+		return nil, ErrWrongType
 	}
 
 	err = list.LSet(index, value)
@@ -178,23 +260,22 @@ func execLSet(db *DB, args [][]byte) ([][]byte, error) {
 		return nil, err
 	}
 
-	db.PutEntity(key, entity)
 	return [][]byte{[]byte("OK")}, nil
 }
 
 func execLRange(db *DB, args [][]byte) ([][]byte, error) {
 	if len(args) != 3 {
-		return nil, errors.New("wrong number of arguments for LRANGE")
+		return nil, errWrongArgs("lrange")
 	}
 
 	key := string(args[0])
 	start, err := strconv.Atoi(string(args[1]))
 	if err != nil {
-		return nil, errors.New("ERR value is not an integer or out of range")
+		return nil, ErrNotInteger
 	}
 	stop, err := strconv.Atoi(string(args[2]))
 	if err != nil {
-		return nil, errors.New("ERR value is not an integer or out of range")
+		return nil, ErrNotInteger
 	}
 
 	entity, ok := db.GetEntity(key)
@@ -204,7 +285,11 @@ func execLRange(db *DB, args [][]byte) ([][]byte, error) {
 
 	list, ok := entity.Data.(*datastruct.List)
 	if !ok {
-		return nil, errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
+		return nil, ErrWrongType
+	}
+
+	if err := db.checkReplyElements(rangeLen(start, stop, list.Len()), "LRANGE with a smaller range"); err != nil {
+		return nil, err
 	}
 
 	values := list.LRange(start, stop)
@@ -219,17 +304,17 @@ func execLRange(db *DB, args [][]byte) ([][]byte, error) {
 
 func execLTrim(db *DB, args [][]byte) ([][]byte, error) {
 	if len(args) != 3 {
-		return nil, errors.New("wrong number of arguments for LTRIM")
+		return nil, errWrongArgs("ltrim")
 	}
 
 	key := string(args[0])
 	start, err := strconv.Atoi(string(args[1]))
 	if err != nil {
-		return nil, errors.New("ERR value is not an integer or out of range")
+		return nil, ErrNotInteger
 	}
 	stop, err := strconv.Atoi(string(args[2]))
 	if err != nil {
-		return nil, errors.New("ERR value is not an integer or out of range")
+		return nil, ErrNotInteger
 	}
 
 	entity, ok := db.GetEntity(key)
@@ -239,15 +324,13 @@ func execLTrim(db *DB, args [][]byte) ([][]byte, error) {
 
 	list, ok := entity.Data.(*datastruct.List)
 	if !ok {
-		return nil, errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
+		return nil, ErrWrongType
 	}
 
 	list.LTrim(start, stop)
 
 	if list.Len() == 0 {
 		db.Remove(key)
-	} else {
-		db.PutEntity(key, entity)
 	}
 
 	return [][]byte{[]byte("OK")}, nil
@@ -255,13 +338,13 @@ func execLTrim(db *DB, args [][]byte) ([][]byte, error) {
 
 func execLRem(db *DB, args [][]byte) ([][]byte, error) {
 	if len(args) != 3 {
-		return nil, errors.New("wrong number of arguments for LREM")
+		return nil, errWrongArgs("lrem")
 	}
 
 	key := string(args[0])
 	count, err := strconv.Atoi(string(args[1]))
 	if err != nil {
-		return nil, errors.New("ERR value is not an integer or out of range")
+		return nil, ErrNotInteger
 	}
 	value := args[2]
 
@@ -272,15 +355,13 @@ func execLRem(db *DB, args [][]byte) ([][]byte, error) {
 
 	list, ok := entity.Data.(*datastruct.List)
 	if !ok {
-		return nil, errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
+		return nil, ErrWrongType
 	}
 
 	removed := list.LRem(count, value)
 
 	if list.Len() == 0 {
 		db.Remove(key)
-	} else {
-		db.PutEntity(key, entity)
 	}
 
 	return [][]byte{[]byte(strconv.FormatInt(int64(removed), 10))}, nil
@@ -288,7 +369,7 @@ func execLRem(db *DB, args [][]byte) ([][]byte, error) {
 
 func execLInsert(db *DB, args [][]byte) ([][]byte, error) {
 	if len(args) != 4 {
-		return nil, errors.New("wrong number of arguments for LINSERT")
+		return nil, errWrongArgs("linsert")
 	}
 
 	key := string(args[0])
@@ -303,7 +384,7 @@ func execLInsert(db *DB, args [][]byte) ([][]byte, error) {
 	case "after":
 		before = false
 	default:
-		return nil, errors.New("ERR syntax error")
+		return nil, ErrSyntax
 	}
 
 	entity, ok := db.GetEntity(key)
@@ -313,7 +394,7 @@ func execLInsert(db *DB, args [][]byte) ([][]byte, error) {
 
 	list, ok := entity.Data.(*datastruct.List)
 	if !ok {
-		return nil, errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
+		return nil, ErrWrongType
 	}
 
 	length := list.LInsert(before, pivot, value)
@@ -321,13 +402,12 @@ func execLInsert(db *DB, args [][]byte) ([][]byte, error) {
 		return [][]byte{[]byte("-1")}, nil
 	}
 
-	db.PutEntity(key, entity)
 	return [][]byte{[]byte(strconv.FormatInt(int64(length), 10))}, nil
 }
 
 func execLLen(db *DB, args [][]byte) ([][]byte, error) {
 	if len(args) != 1 {
-		return nil, errors.New("wrong number of arguments for LLEN")
+		return nil, errWrongArgs("llen")
 	}
 
 	key := string(args[0])
@@ -339,7 +419,7 @@ func execLLen(db *DB, args [][]byte) ([][]byte, error) {
 
 	list, ok := entity.Data.(*datastruct.List)
 	if !ok {
-		return nil, errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
+		return nil, ErrWrongType
 	}
 
 	length := list.Len()
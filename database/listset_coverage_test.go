@@ -1,7 +1,14 @@
 package database
 
 import (
+	"sort"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/wangbo/gocache/datastruct"
+	"github.com/wangbo/gocache/util/random"
 )
 
 // TestListCommands_Additional tests additional list commands
@@ -49,8 +56,8 @@ func TestListCommands_Additional(t *testing.T) {
 
 		// Pop from empty list
 		result, err = db.Exec([][]byte{[]byte("RPOP"), []byte("emptylist")})
-		if err != nil || len(result) != 1 || string(result[0]) != "(nil)" {
-			t.Error("RPOP from empty list should return (nil)")
+		if err != nil || !IsNullResult(result) {
+			t.Error("RPOP from empty list should return a null result")
 		}
 	})
 
@@ -165,19 +172,17 @@ func TestSetCommands_Additional(t *testing.T) {
 	})
 
 	t.Run("SPOP - Randomly remove and return member", func(t *testing.T) {
+		// A fixed seed makes the order of the pops reproducible
+		datastruct.SeedRandom(1)
+		defer datastruct.SeedRandom(random.Seed())
 		db.Exec([][]byte{[]byte("SADD"), []byte("popset"), []byte("x"), []byte("y"), []byte("z")})
 
 		// Pop one element
 		result, err := db.Exec([][]byte{[]byte("SPOP"), []byte("popset")})
 		if err != nil || len(result) != 1 {
-			t.Error("SPOP should return one element")
-		}
-
-		popped := string(result[0])
-		// Verify it's one of the members
-		if popped != "x" && popped != "y" && popped != "z" {
-			t.Errorf("SPOP returned unexpected value: %s", popped)
+			t.Fatal("SPOP should return one element")
 		}
+		popped := []string{string(result[0])}
 
 		// Verify size decreased
 		result, err = db.Exec([][]byte{[]byte("SCARD"), []byte("popset")})
@@ -186,13 +191,18 @@ func TestSetCommands_Additional(t *testing.T) {
 		}
 
 		// Pop remaining elements
-		db.Exec([][]byte{[]byte("SPOP"), []byte("popset")})
-		db.Exec([][]byte{[]byte("SPOP"), []byte("popset")})
+		for i := 0; i < 2; i++ {
+			result, _ = db.Exec([][]byte{[]byte("SPOP"), []byte("popset")})
+			popped = append(popped, string(result[0]))
+		}
+		if got := strings.Join(popped, ","); got != "z,y,x" {
+			t.Errorf("Expected SPOP to pop z,y,x, got %s", got)
+		}
 
 		// Pop from empty set
 		result, err = db.Exec([][]byte{[]byte("SPOP"), []byte("popset")})
-		if err != nil || len(result) != 1 || string(result[0]) != "(nil)" {
-			t.Error("SPOP from empty set should return (nil)")
+		if err != nil || !IsNullResult(result) {
+			t.Error("SPOP from empty set should return a null result")
 		}
 	})
 
@@ -219,8 +229,8 @@ func TestSetCommands_Additional(t *testing.T) {
 
 		// Test on empty set
 		result, err = db.Exec([][]byte{[]byte("SRANDMEMBER"), []byte("emptyset")})
-		if err != nil || len(result) != 1 || string(result[0]) != "(nil)" {
-			t.Error("SRANDMEMBER on empty set should return (nil)")
+		if err != nil || !IsNullResult(result) {
+			t.Error("SRANDMEMBER on empty set should return a null result")
 		}
 	})
 
@@ -374,3 +384,210 @@ func TestSetCommands_Additional(t *testing.T) {
 		}
 	})
 }
+
+// TestSetStoreCommands tests the destination handling of SDIFFSTORE,
+// SINTERSTORE and SUNIONSTORE
+func TestSetStoreCommands(t *testing.T) {
+	db := MakeDB()
+	defer db.Close()
+
+	db.ExecCommand("SADD", "s1", "a", "b")
+	db.ExecCommand("SADD", "s2", "b", "c")
+	db.ExecCommand("SET", "str", "x")
+
+	t.Run("Empty result deletes the destination", func(t *testing.T) {
+		for _, cmd := range [][]string{
+			{"SINTERSTORE", "dst", "s1", "missing"},
+			{"SDIFFSTORE", "dst", "s1", "s1"},
+			{"SUNIONSTORE", "dst", "missing"},
+		} {
+			db.ExecCommand("SADD", "dst", "old")
+			result, err := db.ExecCommand(cmd[0], cmd[1:]...)
+			if err != nil || string(result[0]) != "0" {
+				t.Errorf("%v: expected 0, got %q %v", cmd, result, err)
+			}
+			if db.Exists("dst") {
+				t.Errorf("%v: expected the destination to be deleted", cmd)
+			}
+		}
+	})
+
+	t.Run("Wrong type on a later key", func(t *testing.T) {
+		for _, cmd := range []string{"SINTERSTORE", "SDIFFSTORE", "SUNIONSTORE"} {
+			_, err := db.ExecCommand(cmd, "dst", "missing", "str")
+			if err == nil || !strings.HasPrefix(err.Error(), "WRONGTYPE") {
+				t.Errorf("%s: expected WRONGTYPE, got %v", cmd, err)
+			}
+		}
+		if _, err := db.ExecCommand("SINTER", "missing", "str"); err == nil {
+			t.Error("SINTER: expected WRONGTYPE for the second key")
+		}
+	})
+
+	t.Run("Destination of another type is overwritten", func(t *testing.T) {
+		db.ExecCommand("SET", "dst", "string")
+		db.ExecCommand("EXPIRE", "dst", "100")
+
+		result, err := db.ExecCommand("SUNIONSTORE", "dst", "s1", "s2")
+		if err != nil || string(result[0]) != "3" {
+			t.Fatalf("Expected 3, got %q %v", result, err)
+		}
+		if result, _ := db.ExecCommand("TYPE", "dst"); string(result[0]) != "set" {
+			t.Errorf("Expected dst to be a set, got %s", result[0])
+		}
+		if ttl := db.TTL("dst"); ttl != -1 {
+			t.Errorf("Expected the old TTL to be dropped, got %v", ttl)
+		}
+	})
+
+	t.Run("Destination can be a source", func(t *testing.T) {
+		db.ExecCommand("SADD", "self", "a", "b", "c")
+		result, err := db.ExecCommand("SINTERSTORE", "self", "self", "s1")
+		if err != nil || string(result[0]) != "2" {
+			t.Errorf("Expected 2, got %q %v", result, err)
+		}
+	})
+}
+
+// TestSetMultiKeyMatrix checks the documented semantics of the multi-key set
+// commands (see README): missing keys are empty sets, and a key of another
+// type is a WRONGTYPE error wherever it is, even when the result is known to
+// be empty before reaching it. SMOVE, like in Redis, returns 0 for a missing
+// source without looking at the destination.
+func TestSetMultiKeyMatrix(t *testing.T) {
+	const wrongType = "WRONGTYPE"
+
+	// Keys: s and t are sets, m is missing, x is a string
+	keys := map[string]string{"s": "s", "t": "t", "m": "missing", "x": "str"}
+	pairs := []string{"s t", "s m", "s x", "m s", "m m", "m x", "x s", "x m", "x x"}
+
+	// Sorted members, or WRONGTYPE, for each pair of source keys
+	table := map[string][]string{
+		"SINTER": {"b", "", wrongType, "", "", wrongType, wrongType, wrongType, wrongType},
+		"SUNION": {"a b c", "a b", wrongType, "a b", "", wrongType, wrongType, wrongType, wrongType},
+		"SDIFF":  {"a", "a b", wrongType, "", "", wrongType, wrongType, wrongType, wrongType},
+		"SMOVE":  {"1", "1", wrongType, "0", "0", "0", wrongType, wrongType, wrongType},
+	}
+
+	db := MakeDB()
+	defer db.Close()
+	run := func(cmd string, args ...string) string {
+		result, err := db.ExecCommand(cmd, args...)
+		if err != nil {
+			if strings.HasPrefix(err.Error(), wrongType) {
+				return wrongType
+			}
+			return err.Error()
+		}
+		members := make([]string, len(result))
+		for i, m := range result {
+			members[i] = string(m)
+		}
+		sort.Strings(members)
+		return strings.Join(members, " ")
+	}
+	reset := func() {
+		db.ExecCommand("DEL", "s", "t", "missing", "str", "dst")
+		db.ExecCommand("SADD", "s", "a", "b")
+		db.ExecCommand("SADD", "t", "b", "c")
+		db.ExecCommand("SET", "str", "x")
+	}
+
+	for cmd, want := range table {
+		for i, pair := range pairs {
+			p := strings.Fields(pair)
+			a, b := keys[p[0]], keys[p[1]]
+
+			if cmd == "SMOVE" {
+				reset()
+				if got := run("SMOVE", a, b, "a"); got != want[i] {
+					t.Errorf("SMOVE %s: expected %q, got %q", pair, want[i], got)
+				}
+				continue
+			}
+
+			reset()
+			if got := run(cmd, a, b); got != want[i] {
+				t.Errorf("%s %s: expected %q, got %q", cmd, pair, want[i], got)
+			}
+			// A third key of another type is reported as well
+			if got := run(cmd, a, b, "str"); got != wrongType {
+				t.Errorf("%s %s x: expected WRONGTYPE, got %q", cmd, pair, got)
+			}
+
+			// The STORE variant stores the same members and replies with
+			// their count; on a type error the destination is left alone
+			store := cmd + "STORE"
+			db.ExecCommand("SADD", "dst", "old")
+			got := run(store, "dst", a, b)
+			if want[i] == wrongType {
+				if got != wrongType || run("SMEMBERS", "dst") != "old" {
+					t.Errorf("%s %s: expected WRONGTYPE and dst unchanged, got %q", store, pair, got)
+				}
+				continue
+			}
+			if count := strconv.Itoa(len(strings.Fields(want[i]))); got != count {
+				t.Errorf("%s %s: expected %s, got %q", store, pair, count, got)
+			}
+			if stored := run("SMEMBERS", "dst"); stored != want[i] {
+				t.Errorf("%s %s: stored %q, expected %q", store, pair, stored, want[i])
+			}
+		}
+	}
+}
+
+func TestBlockingPop(t *testing.T) {
+	db := MakeDB()
+	defer db.Close()
+
+	db.ExecCommand("RPUSH", "l2", "a", "b")
+	result, err := db.ExecCommand("BLPOP", "l1", "l2", "0")
+	if err != nil || len(result) != 2 || string(result[0]) != "l2" || string(result[1]) != "a" {
+		t.Fatalf("Expected BLPOP to pop a from l2, got %q, %v", result, err)
+	}
+	result, err = db.ExecCommand("BRPOP", "l2", "0")
+	if err != nil || len(result) != 2 || string(result[1]) != "b" {
+		t.Fatalf("Expected BRPOP to pop b, got %q, %v", result, err)
+	}
+	if db.Exists("l2") {
+		t.Error("Expected the emptied list to be deleted")
+	}
+
+	// Served by a later push
+	done := make(chan [][]byte)
+	go func() {
+		result, _ := db.ExecCommand("BLPOP", "l3", "0")
+		done <- result
+	}()
+	time.Sleep(20 * time.Millisecond)
+	db.ExecCommand("LPUSH", "l3", "x")
+	select {
+	case result := <-done:
+		if len(result) != 2 || string(result[0]) != "l3" || string(result[1]) != "x" {
+			t.Errorf("Expected the blocked BLPOP to get x, got %q", result)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("BLPOP was not woken by LPUSH")
+	}
+
+	// Timeout
+	start := time.Now()
+	result, err = db.ExecCommand("BLPOP", "l4", "0.05")
+	if err != nil || result != nil {
+		t.Errorf("Expected a nil result on timeout, got %q, %v", result, err)
+	}
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+		t.Errorf("Expected BLPOP to wait for its timeout, returned after %v", elapsed)
+	}
+
+	db.ExecCommand("SET", "str", "v")
+	if _, err := db.ExecCommand("BLPOP", "str", "0"); err == nil || !strings.HasPrefix(err.Error(), "WRONGTYPE") {
+		t.Errorf("Expected WRONGTYPE, got %v", err)
+	}
+	if _, err := db.ExecCommand("BLPOP", "l5", "-1"); err == nil || err.Error() != "ERR timeout is negative" {
+		t.Errorf("Expected a negative timeout error, got %v", err)
+	}
+	if _, err := db.ExecCommand("BLPOP", "l5", "abc"); err == nil {
+		t.Error("Expected an invalid timeout error")
+	}
+}
@@ -0,0 +1,87 @@
+package database
+
+import (
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// Loading from disk
+//
+// On startup the server listens before it loads its AOF or RDB file, so that
+// the clients connecting meanwhile learn why nothing is served: from
+// StartLoading to StopLoading every command but the few allowedWhileLoading is
+// refused with LOADING, reads included (replica-serve-stale-data only serves
+// the stale dataset of a replica). INFO persistence reports the progress,
+// which is also logged for large files.
+
+// loadingLogInterval is the least time between two progress lines
+const loadingLogInterval = time.Second
+
+// diskLoad is the progress of the file being loaded
+type diskLoad struct {
+	active  atomic.Bool
+	start   atomic.Int64 // Unix seconds
+	total   atomic.Int64
+	loaded  atomic.Int64
+	lastLog time.Time // Only used by the loading goroutine
+}
+
+// StartLoading refuses client commands until StopLoading, while a file of
+// total bytes is loaded
+func (db *DB) StartLoading(total int64) {
+	db.diskLoad.start.Store(time.Now().Unix())
+	db.diskLoad.total.Store(total)
+	db.diskLoad.loaded.Store(0)
+	db.diskLoad.lastLog = time.Now()
+	db.diskLoad.active.Store(true)
+	db.loading.Store(true)
+}
+
+// SetLoadedBytes records that n bytes of the file were loaded
+func (db *DB) SetLoadedBytes(n int64) {
+	load := &db.diskLoad
+	if !load.active.Load() {
+		return
+	}
+	load.loaded.Store(n)
+	if time.Since(load.lastLog) >= loadingLogInterval {
+		load.lastLog = time.Now()
+		fmt.Printf("Loading dataset: %d of %d bytes (%.1f%%)\n", n, load.total.Load(), loadedPercent(n, load.total.Load()))
+	}
+}
+
+// StopLoading ends the loading started by StartLoading
+func (db *DB) StopLoading() {
+	if !db.diskLoad.active.Swap(false) {
+		return
+	}
+	db.loading.Store(false)
+}
+
+// LoadingReader returns a reader of r recording the bytes read as loaded
+func (db *DB) LoadingReader(r io.Reader) io.Reader {
+	return &loadingReader{r: r, db: db}
+}
+
+type loadingReader struct {
+	r  io.Reader
+	db *DB
+	n  int64
+}
+
+func (l *loadingReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	l.n += int64(n)
+	l.db.SetLoadedBytes(l.n)
+	return n, err
+}
+
+// loadedPercent returns the percentage of total that loaded is
+func loadedPercent(loaded, total int64) float64 {
+	if total <= 0 {
+		return 100
+	}
+	return float64(loaded) * 100 / float64(total)
+}
@@ -0,0 +1,55 @@
+package database
+
+import (
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestLoadingFromDiskRefusesClients(t *testing.T) {
+	db := MakeDB()
+	defer db.Close()
+	ms := NewMultiState(db)
+	admit := func(args ...string) error {
+		cmdLine := make([][]byte, len(args))
+		for i, arg := range args {
+			cmdLine[i] = []byte(arg)
+		}
+		return db.AdmitClientCommand(ms, cmdLine)
+	}
+
+	db.StartLoading(1000)
+	// Reads are refused too, whatever replica-serve-stale-data
+	for _, cmd := range [][]string{{"SET", "k", "v"}, {"GET", "k"}} {
+		if err := admit(cmd...); err == nil || !strings.HasPrefix(err.Error(), "LOADING") {
+			t.Errorf("%v: expected LOADING, got %v", cmd, err)
+		}
+	}
+	if err := admit("INFO"); err != nil {
+		t.Errorf("Expected INFO to run while loading, got %v", err)
+	}
+
+	if _, err := io.ReadAll(db.LoadingReader(strings.NewReader(strings.Repeat("x", 250)))); err != nil {
+		t.Fatal(err)
+	}
+	persistence := execInfoString(t, db, "persistence")["Persistence"]
+	for field, want := range map[string]string{
+		"loading":              "1",
+		"loading_total_bytes":  "1000",
+		"loading_loaded_bytes": "250",
+		"loading_loaded_perc":  "25.00",
+	} {
+		if persistence[field] != want {
+			t.Errorf("Expected %s:%s, got %q", field, want, persistence[field])
+		}
+	}
+
+	db.StopLoading()
+	if err := admit("GET", "k"); err != nil {
+		t.Errorf("Expected GET to run after loading, got %v", err)
+	}
+	persistence = execInfoString(t, db, "persistence")["Persistence"]
+	if persistence["loading"] != "0" || persistence["loading_total_bytes"] != "" {
+		t.Errorf("Expected no loading fields after loading, got %v", persistence)
+	}
+}
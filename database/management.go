@@ -1,13 +1,15 @@
 package database
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
+	"math"
 	"strconv"
 	"strings"
 	"time"
 
-	"github.com/wangbo/gocache/config"
+	"github.com/wangbo/gocache/monitor"
 	"github.com/wangbo/gocache/persistence"
 	"github.com/wangbo/gocache/replication"
 )
@@ -21,149 +23,6 @@ func execPing(db *DB, args [][]byte) ([][]byte, error) {
 	return [][]byte{args[0]}, nil
 }
 
-func execInfo(db *DB, args [][]byte) ([][]byte, error) {
-	section := "default"
-	if len(args) > 0 {
-		section = strings.ToLower(string(args[0]))
-	}
-
-	var info string
-	switch section {
-	case "memory", "stats":
-		info = execInfoMemoryString(db)
-	default:
-		info = execInfoDefaultString(db)
-	}
-
-	return [][]byte{[]byte(info)}, nil
-}
-
-func execInfoDefaultString(db *DB) string {
-	var builder strings.Builder
-
-	builder.WriteString("# Server\r\n")
-	builder.WriteString("redis_version:6.2.0\r\n")
-	builder.WriteString("go_cache_version:1.0.0\r\n")
-	builder.WriteString("os:" + runtimeOS() + "\r\n")
-	builder.WriteString("arch:" + runtimeArch() + "\r\n")
-	builder.WriteString("process_id:" + strconv.FormatInt(int64(getPID()), 10) + "\r\n")
-	builder.WriteString("tcp_port:" + strconv.Itoa(config.Config.Port) + "\r\n")
-	builder.WriteString("uptime_in_seconds:" + strconv.FormatInt(int64(getUptime()), 10) + "\r\n")
-	builder.WriteString("uptime_in_days:0\r\n")
-	builder.WriteString("\r\n")
-
-	builder.WriteString("# Clients\r\n")
-	builder.WriteString("connected_clients:1\r\n")
-	builder.WriteString("maxclients:10000\r\n")
-	builder.WriteString("\r\n")
-
-	builder.WriteString("# Memory\r\n")
-	builder.WriteString("used_memory:" + strconv.FormatInt(db.GetUsedMemory(), 10) + "\r\n")
-	builder.WriteString("used_memory_human:" + formatBytes(db.GetUsedMemory()) + "\r\n")
-	builder.WriteString("maxmemory:" + strconv.FormatInt(config.Config.MaxMemory, 10) + "\r\n")
-	builder.WriteString("maxmemory_human:" + formatBytes(config.Config.MaxMemory) + "\r\n")
-	builder.WriteString("maxmemory_policy:" + config.Config.MaxMemoryPolicy + "\r\n")
-	builder.WriteString("\r\n")
-
-	builder.WriteString("# Stats\r\n")
-	builder.WriteString("total_connections_received:1\r\n")
-	builder.WriteString("total_commands_processed:10\r\n")
-	builder.WriteString("instantaneous_ops_per_sec:0\r\n")
-	builder.WriteString("\r\n")
-
-	builder.WriteString("# Replication\r\n")
-	builder.WriteString("role:" + replication.State.GetRole().String() + "\r\n")
-	if replication.State.IsMaster() {
-		builder.WriteString("connected_slaves:" + strconv.Itoa(replication.State.GetSlaveCount()) + "\r\n")
-	} else {
-		masterHost, masterPort := replication.State.GetMasterInfo()
-		builder.WriteString("master_host:" + masterHost + "\r\n")
-		builder.WriteString("master_port:" + strconv.Itoa(masterPort) + "\r\n")
-		builder.WriteString("master_link_status:up\r\n")
-	}
-	builder.WriteString("replid:" + strconv.FormatUint(replication.State.GetReplicationID(), 10) + "\r\n")
-	builder.WriteString("repl_offset:" + strconv.FormatUint(replication.State.GetReplicationOffset(), 10) + "\r\n")
-	builder.WriteString("\r\n")
-
-	builder.WriteString("# Persistence\r\n")
-	builder.WriteString("loading:0\r\n")
-	builder.WriteString("aof_enabled:" + strconv.FormatBool(config.Config.AppendOnly) + "\r\n")
-	if !db.lastSaveTime.IsZero() {
-		builder.WriteString("rdb_last_save_time:" + strconv.FormatInt(db.lastSaveTime.Unix(), 10) + "\r\n")
-		builder.WriteString("rdb_last_save_time_elapsed:" + strconv.FormatInt(int64(time.Since(db.lastSaveTime).Seconds()), 10) + "\r\n")
-	} else {
-		builder.WriteString("rdb_last_save_time:0\r\n")
-	}
-	if db.bgSaveInProgress {
-		builder.WriteString("bgsave_in_progress:1\r\n")
-	} else {
-		builder.WriteString("bgsave_in_progress:0\r\n")
-	}
-	builder.WriteString("\r\n")
-
-	builder.WriteString("# Slow Log\r\n")
-	builder.WriteString("slowlog_len:" + strconv.Itoa(db.GetSlowLogLen()) + "\r\n")
-	builder.WriteString("slowlog_max_len:" + strconv.Itoa(db.slowLogMaxLen) + "\r\n")
-	builder.WriteString("\r\n")
-
-	return builder.String()
-}
-
-func execInfoMemoryString(db *DB) string {
-	var builder strings.Builder
-
-	builder.WriteString("# Memory\r\n")
-	builder.WriteString("used_memory:" + strconv.FormatInt(db.GetUsedMemory(), 10) + "\r\n")
-	builder.WriteString("used_memory_human:" + formatBytes(db.GetUsedMemory()) + "\r\n")
-	builder.WriteString("maxmemory:" + strconv.FormatInt(config.Config.MaxMemory, 10) + "\r\n")
-	builder.WriteString("maxmemory_human:" + formatBytes(config.Config.MaxMemory) + "\r\n")
-	builder.WriteString("maxmemory_policy:" + config.Config.MaxMemoryPolicy + "\r\n")
-	builder.WriteString("\r\n")
-
-	if db.evictionPolicy != nil {
-		builder.WriteString("# Eviction Policy\r\n")
-		builder.WriteString("policy_type:" + config.Config.MaxMemoryPolicy + "\r\n")
-		builder.WriteString("\r\n")
-	}
-
-	return builder.String()
-}
-
-func execMemory(db *DB, args [][]byte) ([][]byte, error) {
-	if len(args) < 1 {
-		return nil, errors.New("wrong number of arguments for MEMORY")
-	}
-
-	subCmd := strings.ToLower(string(args[0]))
-
-	switch subCmd {
-	case "usage":
-		if len(args) != 2 {
-			return nil, errors.New("wrong number of arguments for MEMORY USAGE")
-		}
-		key := string(args[1])
-
-		entity, ok := db.GetEntity(key)
-		if !ok || entity == nil {
-			return [][]byte{[]byte("0")}, nil
-		}
-
-		size := entity.EstimateSize()
-		return [][]byte{[]byte(strconv.FormatInt(size, 10))}, nil
-
-	case "stats":
-		info := make([][]byte, 0)
-		info = append(info, []byte("used_memory:"+strconv.FormatInt(db.GetUsedMemory(), 10)))
-		info = append(info, []byte("used_memory_human:"+formatBytes(db.GetUsedMemory())))
-		info = append(info, []byte("maxmemory:"+strconv.FormatInt(config.Config.MaxMemory, 10)))
-		info = append(info, []byte("maxmemory_human:"+formatBytes(config.Config.MaxMemory)))
-		return info, nil
-
-	default:
-		return nil, errors.New("unknown MEMORY subcommand")
-	}
-}
-
 func formatBytes(bytes int64) string {
 	if bytes < 1024 {
 		return strconv.FormatInt(bytes, 10) + "b"
@@ -179,33 +38,18 @@ func formatBytes(bytes int64) string {
 	return strconv.FormatFloat(value, 'f', 2, 64) + "pb"
 }
 
-func getPID() int {
-	return 1000
-}
-
-func getUptime() int64 {
-	return 3600
-}
-
-func runtimeOS() string {
-	return "darwin"
-}
-
-func runtimeArch() string {
-	return "amd64"
-}
-
 // execSave synchronously saves the database to disk
 func execSave(db *DB, args [][]byte) ([][]byte, error) {
 	if len(args) != 0 {
-		return nil, errors.New("wrong number of arguments for SAVE")
+		return nil, errWrongArgs("save")
 	}
 
 	// Get RDB filename from config
-	rdbFilename := config.Config.DBFilename
+	rdbFilename := db.config.DBFilename
 	if rdbFilename == "" {
 		rdbFilename = "dump.rdb"
 	}
+	rdbFilename = db.config.DataPath(rdbFilename)
 
 	// Save database using registered saver
 	if err := persistence.SaveDatabase(db, rdbFilename); err != nil {
@@ -213,7 +57,7 @@ func execSave(db *DB, args [][]byte) ([][]byte, error) {
 	}
 
 	// Update last save time in DB
-	db.lastSaveTime = time.Now()
+	db.lastSaveTime = db.now()
 
 	return [][]byte{[]byte("OK")}, nil
 }
@@ -221,7 +65,7 @@ func execSave(db *DB, args [][]byte) ([][]byte, error) {
 // execBgSave asynchronously saves the database to disk
 func execBgSave(db *DB, args [][]byte) ([][]byte, error) {
 	if len(args) != 0 {
-		return nil, errors.New("wrong number of arguments for BGSAVE")
+		return nil, errWrongArgs("bgsave")
 	}
 
 	db.bgSaveMu.Lock()
@@ -233,86 +77,274 @@ func execBgSave(db *DB, args [][]byte) ([][]byte, error) {
 	}
 
 	// Get RDB filename from config
-	rdbFilename := config.Config.DBFilename
+	rdbFilename := db.config.DBFilename
 	if rdbFilename == "" {
 		rdbFilename = "dump.rdb"
 	}
+	rdbFilename = db.config.DataPath(rdbFilename)
 
 	// Start background save
 	db.bgSaveInProgress = true
-	db.bgSaveStartTime = time.Now()
+	db.bgSaveStartTime = db.now()
 
-	go func() {
+	// Close waits for the save to finish before flushing the persistence
+	started := db.lifecycle.goWorker(func(<-chan struct{}) {
 		defer func() {
 			db.bgSaveMu.Lock()
 			db.bgSaveInProgress = false
-			db.lastSaveTime = time.Now()
+			db.lastSaveTime = db.now()
 			db.bgSaveMu.Unlock()
 		}()
 
+		start := time.Now()
 		if err := persistence.SaveDatabase(db, rdbFilename); err != nil {
 			// Log error (in real implementation)
 			return
 		}
-	}()
+		db.RecordLatency(LatencyEventBgSave, time.Since(start))
+	})
+	if !started {
+		db.bgSaveInProgress = false
+		return nil, ErrClosed
+	}
 
 	return [][]byte{[]byte("Background saving started")}, nil
 }
 
-// execSlaveOf sets the instance as a slave of the specified master
+// IsBgSaveInProgress reports whether a BGSAVE is currently running
+func (db *DB) IsBgSaveInProgress() bool {
+	db.bgSaveMu.Lock()
+	defer db.bgSaveMu.Unlock()
+	return db.bgSaveInProgress
+}
+
+// execDebug implements DEBUG. DEBUG RELOAD saves the dataset to RDB in memory
+// and loads it back, replacing the current keys, so that tests can check
+// that everything survives serialization. DEBUG SLEEP blocks the server, to
+// reproduce a long command.
+func execDebug(db *DB, args [][]byte) (Result, error) {
+	if len(args) < 1 {
+		return nil, errWrongArgs("debug")
+	}
+
+	switch strings.ToUpper(string(args[0])) {
+	case "RELOAD":
+		if len(args) != 1 {
+			return nil, errUnknownSubcommand("DEBUG", args[0])
+		}
+		if err := db.reload(); err != nil {
+			return nil, err
+		}
+		return StatusResult("OK"), nil
+	case "SLEEP":
+		if len(args) != 2 {
+			return nil, errUnknownSubcommand("DEBUG", args[0])
+		}
+		seconds, err := strconv.ParseFloat(string(args[1]), 64)
+		if err != nil || seconds < 0 || math.IsNaN(seconds) || math.IsInf(seconds, 0) {
+			return nil, ErrNotFloat
+		}
+		// DEBUG holds db.mu exclusively, so the server is stuck meanwhile
+		time.Sleep(time.Duration(seconds * float64(time.Second)))
+		return StatusResult("OK"), nil
+	case "TTLSTATS":
+		full := len(args) == 2 && strings.EqualFold(string(args[1]), "FULL")
+		if len(args) > 2 || (len(args) == 2 && !full) {
+			return nil, errUnknownSubcommand("DEBUG", args[0])
+		}
+		return BulkResult(db.ttlStatsReport(full)), nil
+	case "HELP":
+		if !isHelpSubcommand(args) {
+			return nil, errUnknownSubcommand("DEBUG", args[0])
+		}
+		return LinesResult(subcommandHelp("DEBUG",
+			"RELOAD",
+			"    Save the dataset to RDB in memory and load it back, replacing the keys.",
+			"SLEEP <seconds>",
+			"    Stop the server for <seconds>. Decimals allowed.",
+			"TTLSTATS [FULL]",
+			"    Show how many keys expire within a minute, an hour, a day, later or never,",
+			"    estimated from a sample of the keys with a TTL unless FULL is given.",
+		)), nil
+	default:
+		return nil, errUnknownSubcommand("DEBUG", args[0])
+	}
+}
+
+// reload saves the dataset to RDB and replaces it with the result of loading
+// it back. The old data is kept if either step fails. The caller must hold
+// db.mu exclusively.
+func (db *DB) reload() error {
+	if db.IsBgSaveInProgress() {
+		return errors.New("ERR Background save already in progress")
+	}
+	if persistence.GetSaver() == nil {
+		return errors.New("ERR no RDB saver registered")
+	}
+
+	var buf bytes.Buffer
+	if err := persistence.SaveDatabaseToWriter(db, &buf); err != nil {
+		return fmt.Errorf("ERR Error trying to save the DB: %w", err)
+	}
+	staging, err := db.loadStaging(func(staging *DB) error {
+		return persistence.LoadDatabaseFromReader(staging, &buf)
+	})
+	if err != nil {
+		return fmt.Errorf("ERR Error trying to load the RDB dump: %w", err)
+	}
+	db.swapDataset(staging)
+	return nil
+}
+
+// execSlaveOf sets the instance as a slave of the specified master, or
+// promotes it to master with SLAVEOF NO ONE.
+//
+// The role change is serialized against the other commands: the replication
+// loop of the previous master is stopped, then the commands running are
+// waited for before the database becomes a replica. Until the master's
+// dataset is loaded, client commands are refused with LOADING (see
+// AdmitClientCommand).
 func execSlaveOf(db *DB, args [][]byte) ([][]byte, error) {
 	if len(args) != 2 {
-		return nil, errors.New("wrong number of arguments for SLAVEOF")
+		return nil, errWrongArgs("slaveof")
 	}
 
 	host := string(args[0])
 	portStr := string(args[1])
-
-	// Handle "SLAVEOF NO ONE" - become a master
-	if host == "NO" && portStr == "ONE" {
-		replication.State.SetAsMaster()
-		return [][]byte{[]byte("OK")}, nil
-	}
+	promote := strings.EqualFold(host, "NO") && strings.EqualFold(portStr, "ONE")
 
 	// Parse port
-	port, err := strconv.Atoi(portStr)
-	if err != nil {
-		return nil, errors.New("invalid port number")
+	var port int
+	if !promote {
+		var err error
+		port, err = strconv.Atoi(portStr)
+		if err != nil {
+			return nil, errors.New("invalid port number")
+		}
 	}
 
-	// Set as slave
-	if err := replication.State.SetAsSlave(host, port); err != nil {
+	db.roleMu.Lock()
+	defer db.roleMu.Unlock()
+
+	// From now on a sync in progress cannot install its dataset and the
+	// commands of the previous master are refused (see replicaLink)
+	epoch := db.roleEpoch.Add(1)
+	db.loading.Store(!promote)
+
+	// Stop the replication loop before waiting for the running commands,
+	// since the loop needs db.mu to apply the command it is at
+	if promote {
+		db.repl.SetAsMaster()
+	} else if err := db.repl.SetAsSlave(host, port); err != nil {
+		db.loading.Store(false)
 		return nil, err
 	}
 
+	db.mu.Lock()
+	db.SetReplicaMode(!promote)
+	db.mu.Unlock()
+
+	if promote {
+		return [][]byte{[]byte("OK")}, nil
+	}
+
 	// Initiate synchronization with master in background
-	go func() {
-		if err := performSynchronization(db); err != nil {
+	db.lifecycle.goWorker(func(<-chan struct{}) {
+		if err := db.syncWithMaster(db.repl, epoch); err != nil {
 			fmt.Printf("Synchronization failed: %v\n", err)
 		}
-	}()
+	})
 
 	return [][]byte{[]byte("OK")}, nil
 }
 
-// performSynchronization performs full synchronization with master
-func performSynchronization(db *DB) error {
+// A replica's database is loaded and updated through replication.Database
+var _ replication.Database = (*DB)(nil)
+
+// syncRetryInterval is the delay between two attempts to synchronize with
+// the master
+var syncRetryInterval = time.Second
+
+// errRoleChanged is returned by a synchronization, and by the commands of a
+// master, once a later SLAVEOF changed the role of the database
+var errRoleChanged = errors.New("ERR replication role changed")
+
+// SyncWithMaster performs a full synchronization with the master of rs and
+// then applies the commands it propagates. An attempt that fails leaves the
+// data untouched and is retried until one succeeds or rs stops replicating
+// that master, whose error is then returned. Retrying stops with ErrClosed
+// when the database is closed.
+func (db *DB) SyncWithMaster(rs *replication.ReplicationState) error {
+	return db.syncWithMaster(rs, db.roleEpoch.Load())
+}
+
+// syncWithMaster is SyncWithMaster on behalf of the role change numbered
+// epoch; it gives up with errRoleChanged once the role changes again
+func (db *DB) syncWithMaster(rs *replication.ReplicationState, epoch uint64) error {
+	host, port := rs.GetMasterInfo()
+	for {
+		err := db.performSynchronization(rs, epoch)
+		if err == nil {
+			return nil
+		}
+		// The connection belongs to the new role now
+		if db.roleEpoch.Load() != epoch {
+			return errRoleChanged
+		}
+		rs.DisconnectFromMaster()
+		if !stillSlaveOf(rs, host, port) {
+			return err
+		}
+		fmt.Printf("Synchronization failed, retrying in %v: %v\n", syncRetryInterval, err)
+		select {
+		case <-time.After(syncRetryInterval):
+		case <-db.lifecycle.done:
+			return ErrClosed
+		}
+		if !stillSlaveOf(rs, host, port) {
+			return err
+		}
+	}
+}
+
+// stillSlaveOf reports whether rs still replicates the given master
+func stillSlaveOf(rs *replication.ReplicationState, host string, port int) bool {
+	h, p := rs.GetMasterInfo()
+	return rs.IsSlave() && h == host && p == port
+}
+
+// performSynchronization performs full synchronization with master. The
+// dataset is swapped and the loading flag cleared with every command blocked,
+// unless the role changed since epoch.
+func (db *DB) performSynchronization(rs *replication.ReplicationState, epoch uint64) error {
 	// Perform full sync
-	rdbData, err := replication.State.PerformFullSync()
+	rdbData, err := rs.PerformFullSync()
 	if err != nil {
 		return fmt.Errorf("full sync failed: %w", err)
 	}
 
-	// Load RDB data into database
-	if err := loadRDBFromBytes(db, rdbData); err != nil {
+	// Load into a staging database, dropping keys the master does not have
+	staging, err := db.loadStaging(func(staging *DB) error {
+		return replication.LoadRDBData(staging, rdbData)
+	})
+	if err != nil {
 		return fmt.Errorf("failed to load RDB: %w", err)
 	}
 
+	db.mu.Lock()
+	if db.roleEpoch.Load() != epoch {
+		db.mu.Unlock()
+		staging.Close()
+		return errRoleChanged
+	}
+	db.swapDataset(staging)
+	db.loading.Store(false)
+	db.mu.Unlock()
+
 	fmt.Printf("Successfully synchronized with master\n")
 
 	// Start replication loop to receive propagated commands
-	adapter := replication.NewDBCommandAdapter(db)
-	if err := replication.State.StartReplicationLoop(adapter); err != nil {
+	if err := rs.StartReplicationLoop(&replicaLink{db: db, epoch: epoch}); err != nil {
 		return fmt.Errorf("failed to start replication loop: %w", err)
 	}
 
@@ -320,16 +352,48 @@ func performSynchronization(db *DB) error {
 	return nil
 }
 
-// loadRDBFromBytes loads RDB data from bytes into database
-func loadRDBFromBytes(db *DB, data []byte) error {
-	// Use the replication package's RDB loader to avoid circular imports
-	return replication.LoadRDBData(db, data)
+// replicaLink applies the commands propagated by the master that db became
+// a replica of with the role change numbered epoch
+type replicaLink struct {
+	db    *DB
+	epoch uint64
+}
+
+// Exec applies a propagated command unless the role changed since, which
+// is checked under db.mu so that no command of the previous master runs
+// after SLAVEOF returned
+func (l *replicaLink) Exec(cmdLine [][]byte) ([][]byte, error) {
+	db := l.db
+	if db.IsClosed() {
+		return nil, ErrClosed
+	}
+	cmdType, executor, err := lookupCommand(cmdLine)
+	if err != nil {
+		return nil, err
+	}
+	args := cmdLine[1:]
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.roleEpoch.Load() != l.epoch {
+		return nil, errRoleChanged
+	}
+	held := db.keyLocks.lock(commandKeys(cmdType, args), executor.IsWriteCommand())
+	defer held.unlock()
+	db.feedMonitor(cmdType, cmdLine, monitor.OriginReplication)
+	return db.execute(cmdType, executor, args)
+}
+
+// IsLoading reports whether the database is loading a dataset, from disk or
+// from its master, during which client commands are refused
+func (db *DB) IsLoading() bool {
+	return db.loading.Load()
 }
 
 // execSync initiates a full synchronization with the master
 func execSync(db *DB, args [][]byte) ([][]byte, error) {
 	if len(args) != 0 {
-		return nil, errors.New("wrong number of arguments for SYNC")
+		return nil, errWrongArgs("sync")
 	}
 
 	// This command is received from a slave
@@ -340,7 +404,7 @@ func execSync(db *DB, args [][]byte) ([][]byte, error) {
 // execPSync initiates a partial synchronization with the master
 func execPSync(db *DB, args [][]byte) ([][]byte, error) {
 	if len(args) != 2 {
-		return nil, errors.New("wrong number of arguments for PSYNC")
+		return nil, errWrongArgs("psync")
 	}
 
 	// This command is received from a slave
@@ -352,12 +416,22 @@ func execPSync(db *DB, args [][]byte) ([][]byte, error) {
 	return [][]byte{[]byte("FULLRESYNC")}, nil
 }
 
+// execBackup validates BACKUP. The server streams the snapshot itself (see
+// server/server.go:handleBackup), so this only runs if the command reaches
+// the database some other way.
+func execBackup(db *DB, args [][]byte) ([][]byte, error) {
+	if len(args) != 0 {
+		return nil, errWrongArgs("backup")
+	}
+	return nil, errors.New("ERR BACKUP must be sent by a client connection")
+}
+
 // execAuth authenticates the connection
 // Note: AUTH is now handled at the server level (server/server.go:handleAuth)
 // This function is kept for registry compatibility but should not be called directly
 func execAuth(db *DB, args [][]byte) ([][]byte, error) {
 	if len(args) != 1 {
-		return nil, errors.New("wrong number of arguments for AUTH")
+		return nil, errWrongArgs("auth")
 	}
 
 	// AUTH is handled at the connection level before commands reach the database
@@ -368,7 +442,7 @@ func execAuth(db *DB, args [][]byte) ([][]byte, error) {
 // execSlowLog manages the slow log
 func execSlowLog(db *DB, args [][]byte) ([][]byte, error) {
 	if len(args) < 1 {
-		return nil, errors.New("wrong number of arguments for SLOWLOG")
+		return nil, errWrongArgs("slowlog")
 	}
 
 	subCmd := strings.ToLower(string(args[0]))
@@ -388,8 +462,21 @@ func execSlowLog(db *DB, args [][]byte) ([][]byte, error) {
 		db.ResetSlowLog()
 		return [][]byte{[]byte("OK")}, nil
 
+	case "help":
+		if !isHelpSubcommand(args) {
+			return nil, errUnknownSubcommand("SLOWLOG", args[0])
+		}
+		return subcommandHelp("SLOWLOG",
+			"GET",
+			"    Return all entries from the slowlog.",
+			"LEN",
+			"    Return the length of the slowlog.",
+			"RESET",
+			"    Reset the slowlog.",
+		), nil
+
 	default:
-		return nil, errors.New("unknown SLOWLOG subcommand")
+		return nil, errUnknownSubcommand("SLOWLOG", args[0])
 	}
 }
 
@@ -414,8 +501,11 @@ func formatSlowLogEntries(entries []*SlowLogEntry) [][]byte {
 // Note: This is a special command that requires server-level handling
 // The database layer just returns OK, actual monitoring is handled in server layer
 func execMonitor(db *DB, args [][]byte) ([][]byte, error) {
-	if len(args) != 0 {
-		return nil, errors.New("wrong number of arguments for MONITOR")
+	if len(args) > 1 {
+		return nil, errWrongArgs("monitor")
+	}
+	if len(args) == 1 && !strings.EqualFold(string(args[0]), "NO-REPLICATION") {
+		return nil, ErrSyntax
 	}
 
 	// Return a special response to indicate monitoring mode
@@ -0,0 +1,287 @@
+package database
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+	"unsafe"
+
+	"github.com/wangbo/gocache/datastruct"
+)
+
+// MEMORY command
+//
+// MEMORY USAGE estimates the memory of a key by measuring the elements of
+// its value, a sample of them for large collections (see
+// datastruct.DataEntity.SampledSize). used_memory, which maxmemory is
+// checked against, keeps the cheaper EstimateSize.
+//
+// MEMORY STATS adds to the dataset what the server uses around it: the
+// entries of the keyspace and TTL dictionaries, the clients with the
+// commands their transactions queued, the replication backlog and the AOF
+// buffer. It also breaks the dataset down by type. Beyond
+// memoryStatsSampleKeys keys, the breakdown and the key sizes are measured
+// on a random sample of that many keys and scaled to the whole keyspace.
+//
+// MEMORY DOCTOR reads MEMORY STATS and reports what looks wrong.
+
+// memoryStatsSampleKeys is the number of keys beyond which MEMORY STATS
+// samples the keyspace
+var memoryStatsSampleKeys = 10000
+
+// defaultMemorySamples is the number of elements MEMORY USAGE measures
+// without SAMPLES
+const defaultMemorySamples = 5
+
+// Memory used by an entry of the keyspace or TTL dictionary besides the key
+// bytes: the key header, the value, and the bookkeeping of the map
+const (
+	keyEntryOverhead = int64(unsafe.Sizeof("") + unsafe.Sizeof(interface{}(nil)) + unsafe.Sizeof(datastruct.DataEntity{}) + 8)
+	ttlEntryOverhead = int64(unsafe.Sizeof("") + unsafe.Sizeof(interface{}(nil)) + unsafe.Sizeof(time.Time{}) + 8)
+	clientOverhead   = int64(unsafe.Sizeof(ClientInfo{}) + unsafe.Sizeof(MultiState{}))
+)
+
+// memoryTypes lists the types MEMORY STATS breaks the dataset down into
+var memoryTypes = []string{"string", "list", "hash", "set", "zset", "stream"}
+
+// typeMemory is the share of a type in the dataset
+type typeMemory struct {
+	keys  int64
+	bytes int64
+}
+
+// memoryStats is the memory used by the server, reported by MEMORY STATS
+type memoryStats struct {
+	keys          int64
+	sampledKeys   int64 // Keys measured, keys if the keyspace was not sampled
+	keysWithTTL   int64
+	datasetBytes  int64 // used_memory
+	keyspaceBytes int64 // Entries of the keyspace dictionary, with the key bytes
+	expiresBytes  int64 // Entries of the TTL dictionary
+	clientsBytes  int64
+	backlogBytes  int64
+	aofBytes      int64
+	types         map[string]*typeMemory
+	largestKey    string
+	largestBytes  int64
+}
+
+// overhead returns the memory used besides the dataset
+func (s *memoryStats) overhead() int64 {
+	return s.keyspaceBytes + s.expiresBytes + s.clientsBytes + s.backlogBytes + s.aofBytes
+}
+
+// SetAOFBufferCallback registers fn to return the bytes allocated to the AOF
+// buffer, reported by MEMORY STATS
+func (db *DB) SetAOFBufferCallback(fn func() int64) {
+	db.aofBufferCallback.Store(fn)
+}
+
+// memoryStats measures the memory used by the server
+func (db *DB) memoryStats() *memoryStats {
+	s := &memoryStats{
+		keys:         int64(db.data.Len()),
+		keysWithTTL:  int64(db.ttlMap.Len()),
+		datasetBytes: db.GetUsedMemory(),
+		backlogBytes: int64(db.repl.GetBacklogMemory()),
+		types:        make(map[string]*typeMemory, len(memoryTypes)),
+	}
+	for _, name := range memoryTypes {
+		s.types[name] = &typeMemory{}
+	}
+	if fn, ok := db.aofBufferCallback.Load().(func() int64); ok && fn != nil {
+		s.aofBytes = fn()
+	}
+	s.clientsBytes = db.clients.memory()
+
+	var keyBytes int64
+	measure := func(key string, entity *datastruct.DataEntity) {
+		// The entity is the live one: size it under its key lock
+		held := db.keyLocks.lock([]string{key}, false)
+		size := entity.EstimateSize()
+		held.unlock()
+		if t, ok := s.types[getEntityTypeName(entity)]; ok {
+			t.keys++
+			t.bytes += size
+		}
+		if size > s.largestBytes {
+			s.largestKey, s.largestBytes = key, size
+		}
+		keyBytes += int64(len(key))
+		s.sampledKeys++
+	}
+	if s.keys <= int64(memoryStatsSampleKeys) {
+		db.ForEach(func(key string, entity *datastruct.DataEntity, _ time.Time) bool {
+			measure(key, entity)
+			return true
+		})
+	} else {
+		for _, key := range db.data.RandomDistinctKeys(memoryStatsSampleKeys) {
+			if entity, ok := db.getEntityWithoutExpiryCheck(key); ok {
+				measure(key, entity)
+			}
+		}
+		// Scale the sample to the keyspace
+		if s.sampledKeys > 0 {
+			for _, t := range s.types {
+				t.keys = t.keys * s.keys / s.sampledKeys
+				t.bytes = t.bytes * s.keys / s.sampledKeys
+			}
+			keyBytes = keyBytes * s.keys / s.sampledKeys
+		}
+	}
+	s.keyspaceBytes = keyBytes + s.keys*keyEntryOverhead
+	s.expiresBytes = s.keysWithTTL * ttlEntryOverhead
+	return s
+}
+
+// memory returns the memory used by the connected clients, with the
+// commands queued by their transactions
+func (r *clientRegistry) memory() int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var total int64
+	for _, c := range r.clients {
+		total += clientOverhead + c.ms.queuedBytes()
+	}
+	return total
+}
+
+// queuedBytes returns the bytes of the commands queued by MULTI
+func (ms *MultiState) queuedBytes() int64 {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	var total int64
+	for _, cmd := range ms.commands {
+		for _, arg := range cmd {
+			total += int64(unsafe.Sizeof(arg)) + int64(len(arg))
+		}
+	}
+	return total
+}
+
+// lines returns the MEMORY STATS reply, name and value pairs
+func (s *memoryStats) lines() [][]byte {
+	var lines [][]byte
+	add := func(name string, value int64) {
+		lines = append(lines, []byte(name), strconv.AppendInt(nil, value, 10))
+	}
+	total := s.datasetBytes + s.overhead()
+	add("total.allocated", total)
+	add("replication.backlog", s.backlogBytes)
+	add("clients.normal", s.clientsBytes)
+	add("aof.buffer", s.aofBytes)
+	add("overhead.hashtable.main", s.keyspaceBytes)
+	add("overhead.hashtable.expires", s.expiresBytes)
+	add("overhead.total", s.overhead())
+	add("keys.count", s.keys)
+	add("keys.with-ttl", s.keysWithTTL)
+	add("keys.sampled", s.sampledKeys)
+	bytesPerKey := int64(0)
+	if s.keys > 0 {
+		bytesPerKey = (s.datasetBytes + s.keyspaceBytes) / s.keys
+	}
+	add("keys.bytes-per-key", bytesPerKey)
+	add("dataset.bytes", s.datasetBytes)
+	percentage := 0.0
+	if total > 0 {
+		percentage = float64(s.datasetBytes) * 100 / float64(total)
+	}
+	lines = append(lines, []byte("dataset.percentage"), []byte(strconv.FormatFloat(percentage, 'f', 2, 64)))
+	for _, name := range memoryTypes {
+		t := s.types[name]
+		add("type."+name+".keys", t.keys)
+		add("type."+name+".bytes", t.bytes)
+	}
+	return lines
+}
+
+// doctor returns the MEMORY DOCTOR report for db
+func (s *memoryStats) doctor(db *DB) string {
+	if s.keys == 0 {
+		return "The instance is empty, there is nothing to analyze."
+	}
+
+	var hints []string
+	if maxMemory := db.config.MaxMemory; maxMemory > 0 && s.datasetBytes*10 > maxMemory*9 {
+		hints = append(hints, "The dataset uses more than 90% of maxmemory ("+formatBytes(s.datasetBytes)+" of "+formatBytes(maxMemory)+"): keys are about to be evicted, or writes refused with noeviction.")
+	}
+	if noTTL := s.keys - s.keysWithTTL; strings.HasPrefix(db.config.MaxMemoryPolicy, "volatile-") && noTTL*10 > s.keys*9 {
+		hints = append(hints, "Many keys have no TTL ("+strconv.FormatInt(noTTL, 10)+" of "+strconv.FormatInt(s.keys, 10)+"), and the "+db.config.MaxMemoryPolicy+" policy only evicts keys with a TTL: set TTLs or use an allkeys- policy.")
+	}
+	if s.backlogBytes > s.datasetBytes {
+		hints = append(hints, "The replication backlog ("+formatBytes(s.backlogBytes)+") is larger than the dataset ("+formatBytes(s.datasetBytes)+"): it is allocated at its full size by the first write propagated to a replica.")
+	}
+	if s.clientsBytes > s.datasetBytes {
+		hints = append(hints, "The clients ("+formatBytes(s.clientsBytes)+") use more memory than the dataset: too many connections, or transactions queuing large commands.")
+	}
+	if s.keys > 1 && s.largestBytes*2 > s.datasetBytes {
+		hints = append(hints, "The key "+strconv.Quote(s.largestKey)+" holds more than half of the dataset ("+formatBytes(s.largestBytes)+"): big keys are slow to delete and to migrate.")
+	}
+
+	if len(hints) == 0 {
+		return "No memory issues detected in this instance."
+	}
+	return "Memory issues detected:\n\n * " + strings.Join(hints, "\n\n * ")
+}
+
+// execMemory implements MEMORY USAGE, MEMORY STATS and MEMORY DOCTOR
+func execMemory(db *DB, args [][]byte) (Result, error) {
+	if len(args) < 1 {
+		return nil, errWrongArgs("memory")
+	}
+
+	switch strings.ToLower(string(args[0])) {
+	case "usage":
+		if len(args) != 2 && len(args) != 4 {
+			return nil, errUnknownSubcommand("MEMORY", args[0])
+		}
+		samples := defaultMemorySamples
+		if len(args) == 4 {
+			if !strings.EqualFold(string(args[2]), "SAMPLES") {
+				return nil, ErrSyntax
+			}
+			n, err := strconv.Atoi(string(args[3]))
+			if err != nil || n < 0 {
+				return nil, errors.New("ERR value is out of range, must be positive")
+			}
+			samples = n
+		}
+
+		entity, ok := db.GetEntity(string(args[1]))
+		if !ok || entity == nil {
+			return IntResult(0), nil
+		}
+		return IntResult(entity.SampledSize(samples)), nil
+
+	case "stats":
+		if len(args) != 1 {
+			return nil, errUnknownSubcommand("MEMORY", args[0])
+		}
+		return LinesResult(db.memoryStats().lines()), nil
+
+	case "doctor":
+		if len(args) != 1 {
+			return nil, errUnknownSubcommand("MEMORY", args[0])
+		}
+		return BulkResult(db.memoryStats().doctor(db)), nil
+
+	case "help":
+		if !isHelpSubcommand(args) {
+			return nil, errUnknownSubcommand("MEMORY", args[0])
+		}
+		return LinesResult(subcommandHelp("MEMORY",
+			"DOCTOR",
+			"    Return memory problems reports.",
+			"STATS",
+			"    Return information about the memory usage of the server.",
+			"USAGE <key> [SAMPLES <count>]",
+			"    Return memory in bytes used by <key> and its value. Nested values are",
+			"    sampled up to <count> times (default: 5, 0 means sample all).",
+		)), nil
+
+	default:
+		return nil, errUnknownSubcommand("MEMORY", args[0])
+	}
+}
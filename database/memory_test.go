@@ -0,0 +1,260 @@
+package database
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"unsafe"
+
+	"github.com/wangbo/gocache/config"
+	"github.com/wangbo/gocache/datastruct"
+	"github.com/wangbo/gocache/replication"
+)
+
+// memoryCmd runs MEMORY with args and fails the test on an error
+func memoryCmd(t *testing.T, db *DB, args ...string) [][]byte {
+	t.Helper()
+	result, err := db.ExecCommand("MEMORY", args...)
+	if err != nil {
+		t.Fatalf("MEMORY %s failed: %v", strings.Join(args, " "), err)
+	}
+	return result
+}
+
+// memoryUsage returns MEMORY USAGE key with extra arguments
+func memoryUsage(t *testing.T, db *DB, key string, args ...string) int64 {
+	t.Helper()
+	result := memoryCmd(t, db, append([]string{"USAGE", key}, args...)...)
+	n, err := strconv.ParseInt(string(result[0]), 10, 64)
+	if err != nil {
+		t.Fatalf("Expected MEMORY USAGE to return an integer, got %q", result[0])
+	}
+	return n
+}
+
+// memoryStatsOf returns the fields of MEMORY STATS
+func memoryStatsOf(t *testing.T, db *DB) map[string]int64 {
+	t.Helper()
+	result := memoryCmd(t, db, "STATS")
+	fields := make(map[string]int64, len(result)/2)
+	for i := 0; i+1 < len(result); i += 2 {
+		fields[string(result[i])], _ = strconv.ParseInt(string(result[i+1]), 10, 64)
+	}
+	return fields
+}
+
+func TestMemoryUsageSamples(t *testing.T) {
+	db := MakeDB()
+	defer db.Close()
+	db.ExecCommand("RPUSH", "list", "0123456789", "a", "b")
+
+	all := memoryUsage(t, db, "list", "SAMPLES", "0")
+	if got := memoryUsage(t, db, "list"); got != all {
+		t.Errorf("Expected the default 5 samples to measure the 3 elements (%d), got %d", all, got)
+	}
+	// One sample takes the 10 bytes of the first element for each of the
+	// three, 18 more than the 12 bytes they hold
+	if got := memoryUsage(t, db, "list", "SAMPLES", "1"); got != all+18 {
+		t.Errorf("Expected SAMPLES 1 to estimate %d, got %d", all+18, got)
+	}
+
+	db.ExecCommand("SADD", "set", "0123456789", "a", "b")
+	db.ExecCommand("HSET", "hash", "f", "0123456789")
+	db.ExecCommand("ZADD", "zset", "1", "0123456789")
+	for _, key := range []string{"set", "hash", "zset"} {
+		if got := memoryUsage(t, db, key, "SAMPLES", "0"); got <= 10 {
+			t.Errorf("Expected MEMORY USAGE %s to count its elements, got %d", key, got)
+		}
+	}
+	if got := memoryUsage(t, db, "missing"); got != 0 {
+		t.Errorf("Expected 0 for a missing key, got %d", got)
+	}
+
+	for _, args := range [][]string{
+		{"USAGE", "list", "SAMPLES"},
+		{"USAGE", "list", "SAMPLES", "-1"},
+		{"USAGE", "list", "SAMPLES", "x"},
+		{"USAGE", "list", "COUNT", "1"},
+	} {
+		if _, err := db.ExecCommand("MEMORY", args...); err == nil {
+			t.Errorf("Expected MEMORY %s to fail", strings.Join(args, " "))
+		}
+	}
+}
+
+func TestMemoryStats(t *testing.T) {
+	db := MakeDB()
+	defer db.Close()
+	db.ExecCommand("SET", "s1", "hello")
+	db.ExecCommand("SET", "s2", "world", "EX", "100")
+	db.ExecCommand("RPUSH", "l", "a", "b")
+	db.ExecCommand("HSET", "h", "f", "v")
+
+	var stringBytes, listBytes, hashBytes int64
+	for key, bytes := range map[string]*int64{"s1": &stringBytes, "s2": &stringBytes, "l": &listBytes, "h": &hashBytes} {
+		entity, _ := db.GetEntity(key)
+		*bytes += entity.EstimateSize()
+	}
+
+	// A client with a queued command
+	ms := NewMultiState(db)
+	db.RegisterClient("127.0.0.1:1000", ms)
+	ms.Begin()
+	db.ExecWithState(ms, [][]byte{[]byte("SET"), []byte("queued"), []byte("0123456789")})
+
+	stats := memoryStatsOf(t, db)
+	keyBytes := int64(len("s1s2lh"))
+	queued := 3*int64(unsafe.Sizeof("")) + int64(len("SETqueued0123456789"))
+	want := map[string]int64{
+		"keys.count":                 4,
+		"keys.with-ttl":              1,
+		"keys.sampled":               4,
+		"dataset.bytes":              db.GetUsedMemory(),
+		"overhead.hashtable.main":    keyBytes + 4*keyEntryOverhead,
+		"overhead.hashtable.expires": ttlEntryOverhead,
+		"clients.normal":             clientOverhead + queued,
+		"replication.backlog":        0,
+		"aof.buffer":                 0,
+		"type.string.keys":           2,
+		"type.string.bytes":          stringBytes,
+		"type.list.keys":             1,
+		"type.list.bytes":            listBytes,
+		"type.hash.keys":             1,
+		"type.hash.bytes":            hashBytes,
+		"type.set.keys":              0,
+		"type.zset.bytes":            0,
+	}
+	for field, value := range want {
+		if stats[field] != value {
+			t.Errorf("Expected %s %d, got %d", field, value, stats[field])
+		}
+	}
+	if sum := stringBytes + listBytes + hashBytes; sum != stats["dataset.bytes"] {
+		t.Errorf("Expected the types to add up to the dataset, %d != %d", sum, stats["dataset.bytes"])
+	}
+	overhead := stats["overhead.hashtable.main"] + stats["overhead.hashtable.expires"] + stats["clients.normal"]
+	if stats["overhead.total"] != overhead {
+		t.Errorf("Expected overhead.total %d, got %d", overhead, stats["overhead.total"])
+	}
+	if stats["total.allocated"] != stats["dataset.bytes"]+overhead {
+		t.Errorf("Expected total.allocated %d, got %d", stats["dataset.bytes"]+overhead, stats["total.allocated"])
+	}
+	if perKey := (stats["dataset.bytes"] + stats["overhead.hashtable.main"]) / 4; stats["keys.bytes-per-key"] != perKey {
+		t.Errorf("Expected keys.bytes-per-key %d, got %d", perKey, stats["keys.bytes-per-key"])
+	}
+
+	db.SetAOFBufferCallback(func() int64 { return 4096 })
+	if got := memoryStatsOf(t, db)["aof.buffer"]; got != 4096 {
+		t.Errorf("Expected aof.buffer 4096, got %d", got)
+	}
+}
+
+func TestMemoryStatsSamplesLargeKeyspaces(t *testing.T) {
+	defer func(n int) { memoryStatsSampleKeys = n }(memoryStatsSampleKeys)
+	memoryStatsSampleKeys = 50
+
+	db := MakeDB()
+	defer db.Close()
+	for i := 0; i < 200; i++ {
+		db.ExecCommand("SET", "key:"+strconv.Itoa(1000+i), "value")
+	}
+
+	stats := memoryStatsOf(t, db)
+	if stats["keys.sampled"] != 50 {
+		t.Errorf("Expected 50 keys sampled, got %d", stats["keys.sampled"])
+	}
+	// The keys are all alike, so the sample scales to the exact numbers
+	if stats["type.string.keys"] != 200 {
+		t.Errorf("Expected 200 strings, got %d", stats["type.string.keys"])
+	}
+	if stats["type.string.bytes"] != db.GetUsedMemory() {
+		t.Errorf("Expected %d bytes of strings, got %d", db.GetUsedMemory(), stats["type.string.bytes"])
+	}
+	if want := 200 * (int64(len("key:1000")) + keyEntryOverhead); stats["overhead.hashtable.main"] != want {
+		t.Errorf("Expected overhead.hashtable.main %d, got %d", want, stats["overhead.hashtable.main"])
+	}
+}
+
+func TestMemoryDoctor(t *testing.T) {
+	cfg := config.Default()
+	cfg.MaxMemoryPolicy = "volatile-lru"
+	db := MakeDBWithConfig(cfg, replication.NewReplicationState())
+	defer db.Close()
+
+	doctor := func() string {
+		t.Helper()
+		return string(memoryCmd(t, db, "DOCTOR")[0])
+	}
+	if got := doctor(); !strings.Contains(got, "empty") {
+		t.Errorf("Expected the empty instance to be reported, got %q", got)
+	}
+
+	for i := 0; i < 20; i++ {
+		db.ExecCommand("SET", "key:"+strconv.Itoa(i), "value")
+	}
+	got := doctor()
+	if !strings.Contains(got, "Many keys have no TTL (20 of 20)") {
+		t.Errorf("Expected keys without TTL to be reported, got %q", got)
+	}
+	if strings.Contains(got, "backlog") || strings.Contains(got, "more than half") {
+		t.Errorf("Expected only the keys without TTL to be reported, got %q", got)
+	}
+
+	db.ExecCommand("SET", "big", strings.Repeat("x", 10000))
+	if got := doctor(); !strings.Contains(got, `The key "big" holds more than half of the dataset`) {
+		t.Errorf("Expected the big key to be reported, got %q", got)
+	}
+
+	cfg.MaxMemoryPolicy = "allkeys-lru"
+	db.ExecCommand("DEL", "big")
+	if got := doctor(); got != "No memory issues detected in this instance." {
+		t.Errorf("Expected no issues, got %q", got)
+	}
+}
+
+func TestSetReplacesString(t *testing.T) {
+	db := MakeDB()
+	defer db.Close()
+	db.ExecCommand("SET", "k", "short", "EX", "100")
+	before, _ := db.GetEntity("k")
+	old, _ := db.ExecCommand("GET", "k")
+	version := db.GetVersion("k")
+
+	// A snapshot holding the old entity keeps reading its value
+	db.ExecCommand("SET", "k", strings.Repeat("long value ", 10))
+	after, _ := db.GetEntity("k")
+	if after == before {
+		t.Error("Expected SET to store a new entity")
+	}
+	if value := before.Data.(*datastruct.String).Get(); string(value) != "short" {
+		t.Errorf("Expected the old entity to keep its value, got %q", value)
+	}
+	if string(old[0]) != "short" {
+		t.Errorf("Expected an earlier GET to keep its value, got %q", old[0])
+	}
+	if db.GetVersion("k") == version {
+		t.Error("Expected the overwrite to bump the version of the key")
+	}
+	if ttl := db.TTL("k"); ttl != -1 {
+		t.Errorf("Expected SET without KEEPTTL to remove the TTL, got %v", ttl)
+	}
+
+	fresh := MakeDB()
+	defer fresh.Close()
+	fresh.ExecCommand("SET", "k", strings.Repeat("long value ", 10))
+	if db.GetUsedMemory() != fresh.GetUsedMemory() {
+		t.Errorf("Expected %d bytes after the overwrite, got %d", fresh.GetUsedMemory(), db.GetUsedMemory())
+	}
+
+	// Any other type is replaced
+	db.ExecCommand("DEL", "k")
+	db.ExecCommand("RPUSH", "k", "a")
+	list, _ := db.GetEntity("k")
+	db.ExecCommand("SET", "k", "v")
+	if replaced, _ := db.GetEntity("k"); replaced == list {
+		t.Error("Expected SET to replace a list with a new entity")
+	}
+	if got, _ := db.ExecCommand("GET", "k"); string(got[0]) != "v" {
+		t.Errorf("Expected v, got %q", got)
+	}
+}
@@ -0,0 +1,241 @@
+package database
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/wangbo/gocache/datastruct"
+	"github.com/wangbo/gocache/protocol/resp"
+)
+
+// MIGRATE command implementation
+//
+// There is no DUMP/RESTORE payload format yet, so the key is transferred by
+// replaying the commands that rebuild it (see RebuildCommands) inside a
+// MULTI/EXEC on the target. This works against both gocache and Redis.
+
+// defaultMigrateTimeout is used when MIGRATE is given a non-positive timeout
+const defaultMigrateTimeout = time.Second
+
+var (
+	errMigrateBusyKey = errors.New("BUSYKEY Target key name already exists.")
+	errMigrateIO      = errors.New("IOERR error or timeout writing to target instance")
+)
+
+// migrateOptions holds the parsed arguments of a MIGRATE command
+type migrateOptions struct {
+	addr     string
+	key      string
+	destDB   int
+	timeout  time.Duration
+	copy     bool
+	replace  bool
+	password string
+}
+
+// execMigrate executes MIGRATE host port key destination-db timeout [COPY] [REPLACE] [AUTH password]
+func execMigrate(db *DB, args [][]byte) ([][]byte, error) {
+	opts, err := parseMigrateArgs(args)
+	if err != nil {
+		return nil, err
+	}
+
+	entity, ok := db.GetEntity(opts.key)
+	if !ok {
+		return [][]byte{[]byte("NOKEY")}, nil
+	}
+	version := db.GetVersion(opts.key)
+
+	var pttl int64
+	if ttl := db.TTL(opts.key); ttl > 0 {
+		pttl = ttl.Milliseconds()
+		if pttl == 0 {
+			pttl = 1
+		}
+	}
+
+	if err := migrateKey(opts, entity, pttl); err != nil {
+		return nil, err
+	}
+
+	// Only delete the source key if nobody modified it while it was in flight
+	if !opts.copy && db.GetVersion(opts.key) == version {
+		db.Remove(opts.key)
+	}
+
+	return okResponse, nil
+}
+
+// parseMigrateArgs parses and validates MIGRATE arguments
+func parseMigrateArgs(args [][]byte) (*migrateOptions, error) {
+	if len(args) < 5 {
+		return nil, errWrongArgs("migrate")
+	}
+
+	port, err := strconv.Atoi(string(args[1]))
+	if err != nil || port <= 0 || port > 65535 {
+		return nil, errors.New("ERR invalid port number")
+	}
+	destDB, err := strconv.Atoi(string(args[3]))
+	if err != nil || destDB < 0 {
+		return nil, errors.New("ERR invalid destination database index")
+	}
+	timeoutMS, err := strconv.ParseInt(string(args[4]), 10, 64)
+	if err != nil {
+		return nil, errTimeoutNotInteger
+	}
+
+	opts := &migrateOptions{
+		addr:    net.JoinHostPort(string(args[0]), strconv.Itoa(port)),
+		key:     string(args[2]),
+		destDB:  destDB,
+		timeout: time.Duration(timeoutMS) * time.Millisecond,
+	}
+	if opts.timeout <= 0 {
+		opts.timeout = defaultMigrateTimeout
+	}
+
+	for i := 5; i < len(args); i++ {
+		switch strings.ToUpper(string(args[i])) {
+		case "COPY":
+			opts.copy = true
+		case "REPLACE":
+			opts.replace = true
+		case "AUTH":
+			if i+1 >= len(args) {
+				return nil, ErrSyntax
+			}
+			i++
+			opts.password = string(args[i])
+		default:
+			return nil, ErrSyntax
+		}
+	}
+
+	return opts, nil
+}
+
+// migrateKey writes the key to the target instance inside a transaction
+func migrateKey(opts *migrateOptions, entity *datastruct.DataEntity, pttl int64) error {
+	conn, err := net.DialTimeout("tcp", opts.addr, opts.timeout)
+	if err != nil {
+		return fmt.Errorf("IOERR error or timeout connecting to target instance: %v", err)
+	}
+	defer conn.Close()
+
+	client := &migrateClient{conn: conn, reader: bufio.NewReader(conn), timeout: opts.timeout}
+
+	if opts.password != "" {
+		if _, err := client.call("AUTH", []byte(opts.password)); err != nil {
+			return err
+		}
+	}
+	if opts.destDB != 0 {
+		if _, err := client.call("SELECT", []byte(strconv.Itoa(opts.destDB))); err != nil {
+			return err
+		}
+	}
+
+	key := []byte(opts.key)
+	if !opts.replace {
+		// WATCH makes EXEC fail if the key is created between the check and EXEC
+		if _, err := client.call("WATCH", key); err != nil {
+			return err
+		}
+		reply, err := client.call("EXISTS", key)
+		if err != nil {
+			return err
+		}
+		if reply != ":0" {
+			return errMigrateBusyKey
+		}
+	}
+
+	if _, err := client.call("MULTI"); err != nil {
+		return err
+	}
+	cmds := RebuildCommands(opts.key, entity)
+	if opts.replace {
+		cmds = append([][][]byte{{[]byte("DEL"), key}}, cmds...)
+	}
+	if pttl > 0 {
+		cmds = append(cmds, [][]byte{[]byte("PEXPIRE"), key, []byte(strconv.FormatInt(pttl, 10))})
+	}
+	for _, cmd := range cmds {
+		if _, err := client.call(string(cmd[0]), cmd[1:]...); err != nil {
+			return err
+		}
+	}
+
+	reply, err := client.call("EXEC")
+	if err != nil {
+		return err
+	}
+	if reply == "*-1" {
+		return errMigrateBusyKey
+	}
+	return nil
+}
+
+// migrateClient is a minimal synchronous RESP client used by MIGRATE
+type migrateClient struct {
+	conn    net.Conn
+	reader  *bufio.Reader
+	timeout time.Duration
+}
+
+// call sends one command and reads its reply. It returns the first line of the
+// reply; error replies, including errors inside an EXEC array, become errors.
+func (c *migrateClient) call(cmd string, args ...[]byte) (string, error) {
+	cmdLine := append([][]byte{[]byte(cmd)}, args...)
+
+	c.conn.SetDeadline(time.Now().Add(c.timeout))
+	if _, err := c.conn.Write(resp.MakeMultiBulkReply(cmdLine).ToBytes()); err != nil {
+		return "", errMigrateIO
+	}
+	return c.readReply()
+}
+
+// readReply reads a complete reply, consuming bulk payloads and array elements
+func (c *migrateClient) readReply() (string, error) {
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		return "", errors.New("IOERR error or timeout reading from target instance")
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if line == "" {
+		return "", errors.New("ERR Target instance replied with an empty line")
+	}
+
+	switch line[0] {
+	case resp.Error:
+		return "", fmt.Errorf("ERR Target instance replied with error: %s", line[1:])
+	case resp.BulkString:
+		size, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return "", errors.New("ERR Target instance sent an invalid reply")
+		}
+		if size >= 0 {
+			if _, err := c.reader.Discard(size + 2); err != nil {
+				return "", errors.New("IOERR error or timeout reading from target instance")
+			}
+		}
+	case resp.Array:
+		count, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return "", errors.New("ERR Target instance sent an invalid reply")
+		}
+		for i := 0; i < count; i++ {
+			if _, err := c.readReply(); err != nil {
+				return "", err
+			}
+		}
+	}
+
+	return line, nil
+}
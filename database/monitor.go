@@ -0,0 +1,46 @@
+package database
+
+// Command monitoring
+//
+// MONITOR shows the commands the database runs, whichever way they come in.
+// Commands start in three places, and each passes them to feedMonitor with
+// the origin MONITOR shows:
+//
+//   - ExecTypedWithState, for the commands of a client connection, with the
+//     address of the client; commands queued by MULTI are not shown until
+//     EXEC runs them
+//   - execExec, for the commands a transaction queued, with monitor.OriginExec
+//   - replicaLink.Exec, for the commands a replica applies from its master,
+//     with monitor.OriginReplication
+//
+// Commands run without a client connection, by embedded users calling Exec
+// or by the AOF and RDB loaders, are not shown, and neither is AUTH, whose
+// argument is a password.
+
+// MonitorFunc is called with every command the database starts and its
+// origin (see monitor.MonitoredCommand)
+type MonitorFunc func(cmdLine [][]byte, origin string)
+
+// SetMonitorCallback registers fn to be called with every command before it
+// runs, so that it can be shown to MONITOR clients
+func (db *DB) SetMonitorCallback(fn MonitorFunc) {
+	db.monitorCallback.Store(fn)
+}
+
+// feedMonitor passes a command starting to the monitor callback, if any
+func (db *DB) feedMonitor(cmdType CommandType, cmdLine [][]byte, origin string) {
+	if cmdType == CmdAuth || cmdType == CmdMonitor {
+		return
+	}
+	if fn, ok := db.monitorCallback.Load().(MonitorFunc); ok && fn != nil {
+		fn(cmdLine, origin)
+	}
+}
+
+// feedMonitorFrom passes a command of the connection owning ms to the monitor
+// callback; commands run with the default state are not shown
+func (db *DB) feedMonitorFrom(ms *MultiState, cmdType CommandType, cmdLine [][]byte) {
+	if ms.client != nil {
+		db.feedMonitor(cmdType, cmdLine, ms.client.addr)
+	}
+}
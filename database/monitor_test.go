@@ -0,0 +1,55 @@
+package database
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// monitored records the commands passed to the monitor callback of db as
+// "origin: command" lines
+func monitored(db *DB) func() []string {
+	var mu sync.Mutex
+	var lines []string
+	db.SetMonitorCallback(func(cmdLine [][]byte, origin string) {
+		mu.Lock()
+		defer mu.Unlock()
+		lines = append(lines, origin+": "+string(bytes.Join(cmdLine, []byte(" "))))
+	})
+	return func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), lines...)
+	}
+}
+
+func TestMonitorOrigins(t *testing.T) {
+	db := MakeDB()
+	defer db.Close()
+	lines := monitored(db)
+
+	ms := NewMultiState(db)
+	db.RegisterClient("127.0.0.1:1000", ms)
+	for _, cmd := range []string{"SET k v", "MULTI", "INCR n", "GET k", "EXEC", "GET k extra"} {
+		var cmdLine [][]byte
+		for _, arg := range strings.Fields(cmd) {
+			cmdLine = append(cmdLine, []byte(arg))
+		}
+		db.ExecWithState(ms, cmdLine)
+	}
+	// Commands without a client connection are not shown
+	db.ExecCommand("SET", "embedded", "v")
+
+	want := []string{
+		"127.0.0.1:1000: SET k v",
+		"127.0.0.1:1000: MULTI",
+		"127.0.0.1:1000: EXEC",
+		"EXEC: INCR n",
+		"EXEC: GET k",
+		"127.0.0.1:1000: GET k extra",
+	}
+	if got := lines(); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("Expected the monitor to see\n%s\ngot\n%s", strings.Join(want, "\n"), strings.Join(got, "\n"))
+	}
+}
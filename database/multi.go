@@ -2,10 +2,12 @@ package database
 
 import (
 	"errors"
+	"fmt"
 	"sync"
 )
 
 // MultiState manages the state of a transaction (MULTI/EXEC)
+// Each client connection owns one; see DB.ExecWithState
 type MultiState struct {
 	mu           sync.Mutex
 	inMulti      bool                // Whether in MULTI mode
@@ -13,7 +15,12 @@ type MultiState struct {
 	aborted      bool                // Whether transaction is aborted
 	watchedKeys  map[string]uint64   // WATCHed keys and their versions
 	dirtyKeys    map[string]struct{} // Keys modified during transaction
+	executed     [][]string          // Commands the last EXEC ran, in their propagated form
+	replies      []ExecReply         // Results of the commands the last EXEC ran
+	dirty        bool                // Whether the last command modified the keyspace
+	admitted     admission           // The role epoch the last command was admitted in
 	db           *DB                 // Reference to the database
+	client       *ClientInfo         // The connection owning the state, nil for the default state
 }
 
 // NewMultiState creates a new transaction state
@@ -97,6 +104,17 @@ func (ms *MultiState) GetCommands() [][]string {
 	return cmds
 }
 
+// queued returns the number of commands queued by MULTI, -1 outside MULTI,
+// as CLIENT LIST reports it
+func (ms *MultiState) queued() int {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if !ms.inMulti {
+		return -1
+	}
+	return len(ms.commands)
+}
+
 // Abort marks the transaction as aborted
 func (ms *MultiState) Abort() {
 	ms.mu.Lock()
@@ -111,7 +129,14 @@ func (ms *MultiState) IsAborted() bool {
 	return ms.aborted
 }
 
-// Watch marks a key to be watched for modifications
+// Watch marks keys to be watched for modifications. Nothing is watched if
+// the connection would watch more than max-watched-keys keys.
+//
+// A WATCHed key costs its writers nothing: writes bump the version of the
+// key either way, and EXEC compares the versions of the watched keys with
+// the ones WATCH saw. The cost is paid by the watcher, at EXEC, in
+// proportion to the keys it watches, which suits write-heavy loads better
+// than writers flagging the transactions watching each key they touch.
 func (ms *MultiState) Watch(keys ...string) error {
 	ms.mu.Lock()
 	defer ms.mu.Unlock()
@@ -120,10 +145,26 @@ func (ms *MultiState) Watch(keys ...string) error {
 		return errors.New("ERR WATCH inside MULTI is not allowed")
 	}
 
+	// Keep the version from the first WATCH of a key
+	first := len(ms.watchedKeys) == 0
+	var added []string
 	for _, key := range keys {
-		// Get current version of the key
-		version := ms.db.GetVersion(key)
-		ms.watchedKeys[key] = version
+		if _, ok := ms.watchedKeys[key]; !ok {
+			ms.watchedKeys[key] = 0
+			added = append(added, key)
+		}
+	}
+	if limit := ms.db.runtime.maxWatchedKeys.Load(); limit > 0 && int64(len(ms.watchedKeys)) > limit {
+		for _, key := range added {
+			delete(ms.watchedKeys, key)
+		}
+		return fmt.Errorf("ERR max-watched-keys reached: a connection may WATCH at most %d keys", limit)
+	}
+
+	// Register before reading the versions so a concurrent delete keeps them
+	ms.db.addWatchers(added, first)
+	for _, key := range added {
+		ms.watchedKeys[key] = ms.db.GetVersion(key)
 	}
 
 	return nil
@@ -134,9 +175,20 @@ func (ms *MultiState) Unwatch() {
 	ms.mu.Lock()
 	defer ms.mu.Unlock()
 
+	if len(ms.watchedKeys) == 0 {
+		return
+	}
+	ms.db.removeWatchers(ms.watchedKeys)
 	ms.watchedKeys = make(map[string]uint64)
 }
 
+// watching returns the number of keys WATCHed, as CLIENT LIST reports it
+func (ms *MultiState) watching() int {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return len(ms.watchedKeys)
+}
+
 // CheckWatchedKeys checks if any watched keys have been modified
 // Returns true if conflict detected
 func (ms *MultiState) CheckWatchedKeys() bool {
@@ -184,3 +236,73 @@ func (ms *MultiState) Clear() {
 	ms.aborted = false
 	ms.dirtyKeys = make(map[string]struct{})
 }
+
+// ExecReply is the result of one of the commands an EXEC ran
+type ExecReply struct {
+	CmdLine [][]byte
+	Result  [][]byte
+	Value   Result // Typed form of Result
+	Err     error
+}
+
+// setExecuted records the commands EXEC ran, to be propagated, and their
+// results
+func (ms *MultiState) setExecuted(cmds [][]string, replies []ExecReply) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.executed = cmds
+	ms.replies = replies
+}
+
+// TakeExecuted returns the commands the last EXEC ran that modified the
+// keyspace, in the form they must be written to the AOF and sent to slaves,
+// and forgets them. It returns nil if the last EXEC modified nothing.
+func (ms *MultiState) TakeExecuted() [][]string {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	cmds := ms.executed
+	ms.executed = nil
+	return cmds
+}
+
+// setDirty records whether the last command modified the keyspace
+func (ms *MultiState) setDirty(dirty bool) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.dirty = dirty
+}
+
+// setAdmitted records the admission of the command about to run
+func (ms *MultiState) setAdmitted(a admission) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.admitted = a
+}
+
+// admission returns the admission of the command running
+func (ms *MultiState) admission() admission {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return ms.admitted
+}
+
+// Dirty reports whether the last command executed on behalf of the
+// connection modified the keyspace, and must therefore be written to the AOF
+// and sent to slaves. A write command that changed nothing, such as SETNX on
+// a key that exists or EXPIRE on a missing key, is not dirty; neither is
+// EXEC, whose commands are propagated one by one (see TakeExecuted).
+func (ms *MultiState) Dirty() bool {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return ms.dirty
+}
+
+// TakeReplies returns the result of each command the last EXEC ran, so that
+// a server can reply to every one with its own type, and forgets them
+func (ms *MultiState) TakeReplies() []ExecReply {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	replies := ms.replies
+	ms.replies = nil
+	return replies
+}
@@ -0,0 +1,204 @@
+package database
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Client pauses
+//
+// CLIENT PAUSE suspends the commands of clients for a while, all of them or
+// only those that write, e.g. so that replicas catch up with the master
+// before one of them is promoted. Paused commands are not rejected: the
+// server holds them in AdmitClientCommand until the pause ends. Commands
+// applied by the replication link never wait, and CLIENT itself is exempt
+// so that the pause can be lifted with CLIENT UNPAUSE.
+
+// clientPause is the pause set by the last CLIENT PAUSE
+type clientPause struct {
+	mu     sync.Mutex
+	until  time.Time     // Zero when clients are not paused
+	all    bool          // ALL rather than WRITE
+	lifted chan struct{} // Closed by CLIENT UNPAUSE
+}
+
+func newClientPause() *clientPause {
+	return &clientPause{lifted: make(chan struct{})}
+}
+
+// pause pauses clients until the given time. As in Redis a shorter or
+// weaker pause does not shorten or weaken the current one.
+func (p *clientPause) pause(until time.Time, all bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if time.Now().After(p.until) {
+		p.all = all
+	} else {
+		p.all = p.all || all
+	}
+	if until.After(p.until) {
+		p.until = until
+	}
+}
+
+// unpause ends the current pause and releases the waiting commands
+func (p *clientPause) unpause() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.until = time.Time{}
+	close(p.lifted)
+	p.lifted = make(chan struct{})
+}
+
+// state returns the end of the current pause, whether it pauses every
+// command and the channel closed if it is lifted
+func (p *clientPause) state() (time.Time, bool, chan struct{}) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.until, p.all, p.lifted
+}
+
+// AdmitClientCommand prepares a command sent by a client, rather than applied
+// from the master, to run: it waits while clients are paused, refuses
+// commands with LOADING while the dataset is loaded from disk, or while a
+// replica loads the dataset of its master (reads run if
+// replica-serve-stale-data is set), and refuses writes on a replica, or
+// with MISCONF while the AOF can not be written if stop-writes-on-aof-error
+// is set. A write paused on a master that is demoted meanwhile is
+// refused, so that it is never acknowledged without reaching the new master.
+// With cluster-announce, commands on the keys of other nodes are redirected
+// first (see checkSlot). A command whose arguments add up to more than
+// max-command-payload bytes is refused before anything else, and aborts the
+// transaction it would be queued in.
+func (db *DB) AdmitClientCommand(ms *MultiState, cmdLine [][]byte) error {
+	cmdType, executor, err := lookupCommand(cmdLine)
+	if err != nil {
+		// Reported when the command runs
+		return nil
+	}
+	if max := db.runtime.maxCommandPayload.Load(); max > 0 && commandPayload(cmdLine) > max {
+		if ms.IsInMulti() {
+			ms.Abort()
+		}
+		return errArgListTooLong
+	}
+	if err := db.checkSlot(ms, cmdType, cmdLine[1:]); err != nil {
+		if ms.IsInMulti() {
+			ms.Abort()
+		}
+		return err
+	}
+	// Commands queued by MULTI are paused and checked when EXEC runs them
+	ms.setAdmitted(admission{})
+	if ms.IsInMulti() && cmdType != CmdExec && cmdType != CmdDiscard {
+		return nil
+	}
+	write := db.writesData(ms, cmdType, executor)
+
+	for {
+		until, all, lifted := db.paused.state()
+		wait := time.Until(until)
+		if wait <= 0 || cmdType == CmdClient || !(all || write) {
+			break
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-lifted:
+		case <-db.blocked.closing:
+		}
+		timer.Stop()
+	}
+
+	// The role is read before it is checked, so that a role change after
+	// the check is seen by checkAdmission
+	epoch := db.roleEpoch.Load()
+	stale := db.config.ReplicaServeStaleData && !db.diskLoad.active.Load()
+	if db.IsLoading() && !allowedWhileLoading(cmdType) && (write || !stale) {
+		return errLoading
+	}
+	if write && db.IsReplica() {
+		return errReadOnly
+	}
+	if write && db.runtime.stopWritesOnAOFError.Load() && !db.aofWritable() {
+		return db.errAOFWrite()
+	}
+	ms.setAdmitted(admission{epoch: epoch, ok: true})
+	return nil
+}
+
+// errReadOnly refuses a client write on a replica
+var errReadOnly = errors.New("READONLY You can't write against a read only replica.")
+
+// admission is the role epoch a client command was admitted in by
+// AdmitClientCommand; the zero value is a command run without admission,
+// such as one replayed from the AOF
+type admission struct {
+	epoch uint64
+	ok    bool
+}
+
+// checkAdmission refuses a write admitted before a role change made db a
+// replica. SLAVEOF waits for the commands holding db.mu before db becomes
+// a replica, but not for one admitted that has not taken it yet, which
+// would otherwise write to the replica once it holds its master's data.
+// The caller holds db.mu.
+func (db *DB) checkAdmission(a admission, write bool) error {
+	if a.ok && write && db.roleEpoch.Load() != a.epoch && db.IsReplica() {
+		return errReadOnly
+	}
+	return nil
+}
+
+// errArgListTooLong refuses a command larger than max-command-payload
+var errArgListTooLong = errors.New("ERR argument list too long")
+
+// commandPayload returns the number of bytes of the arguments of a command
+func commandPayload(cmdLine [][]byte) int64 {
+	var n int64
+	for _, arg := range cmdLine {
+		n += int64(len(arg))
+	}
+	return n
+}
+
+// errLoading refuses a client command while a replica loads the dataset of
+// its master
+var errLoading = errors.New("LOADING GoCache is loading the dataset in memory")
+
+// allowedWhileLoading reports whether a command runs while the dataset is
+// loading: those that report or change the replication state, and
+// HEALTHCHECK, which reports the loading
+func allowedWhileLoading(cmdType CommandType) bool {
+	switch cmdType {
+	case CmdSlaveOf, CmdInfo, CmdClient, CmdPing, CmdHealthCheck:
+		return true
+	}
+	return false
+}
+
+// writesData reports whether a command modifies the data; EXEC does if one
+// of the commands it runs does
+func (db *DB) writesData(ms *MultiState, cmdType CommandType, executor CommandExecutor) bool {
+	if cmdType != CmdExec {
+		return executor.IsWriteCommand()
+	}
+	for _, cmd := range ms.GetCommands() {
+		if len(cmd) > 0 && IsWriteCommand(cmd[0]) {
+			return true
+		}
+	}
+	return false
+}
+
+// execFailover implements FAILOVER ABORT. Coordinated failovers are not
+// supported, so there is never one to abort; a replica is promoted by hand
+// (see the README).
+func execFailover(db *DB, args [][]byte) ([][]byte, error) {
+	if len(args) == 1 && strings.EqualFold(string(args[0]), "ABORT") {
+		return nil, errors.New("ERR No failover in progress.")
+	}
+	return nil, errors.New("ERR FAILOVER is not supported, promote a replica with CLIENT PAUSE WRITE and REPLICAOF NO ONE")
+}
@@ -0,0 +1,171 @@
+package database
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// admitTime returns how long AdmitClientCommand held a command
+func admitTime(t *testing.T, db *DB, ms *MultiState, args ...string) time.Duration {
+	t.Helper()
+	cmdLine := make([][]byte, len(args))
+	for i, arg := range args {
+		cmdLine[i] = []byte(arg)
+	}
+	start := time.Now()
+	if err := db.AdmitClientCommand(ms, cmdLine); err != nil {
+		t.Fatalf("%s: %v", strings.Join(args, " "), err)
+	}
+	return time.Since(start)
+}
+
+func TestClientPauseWrite(t *testing.T) {
+	db := MakeDB()
+	defer db.Close()
+	ms := NewMultiState(db)
+
+	if _, err := db.ExecCommand("CLIENT", "PAUSE", "200", "WRITE"); err != nil {
+		t.Fatal(err)
+	}
+	if d := admitTime(t, db, ms, "GET", "k"); d > 50*time.Millisecond {
+		t.Errorf("Expected GET not to be paused, held for %v", d)
+	}
+	if d := admitTime(t, db, ms, "CLIENT", "UNPAUSE"); d > 50*time.Millisecond {
+		t.Errorf("Expected CLIENT not to be paused, held for %v", d)
+	}
+	if d := admitTime(t, db, ms, "SET", "k", "v"); d < 150*time.Millisecond {
+		t.Errorf("Expected SET to wait for the pause, held for %v", d)
+	}
+
+	// Once the pause is over nothing waits
+	if d := admitTime(t, db, ms, "SET", "k", "v"); d > 50*time.Millisecond {
+		t.Errorf("Expected SET to run after the pause, held for %v", d)
+	}
+
+	// A transaction is paused at EXEC if it writes
+	db.ExecCommand("CLIENT", "PAUSE", "100", "WRITE")
+	ms.Begin()
+	ms.Enqueue([]string{"GET", "k"})
+	if d := admitTime(t, db, ms, "EXEC"); d > 50*time.Millisecond {
+		t.Errorf("Expected a read-only EXEC not to be paused, held for %v", d)
+	}
+	if d := admitTime(t, db, ms, "SET", "k", "v"); d > 50*time.Millisecond {
+		t.Errorf("Expected queuing SET not to be paused, held for %v", d)
+	}
+	ms.Enqueue([]string{"SET", "k", "v"})
+	if d := admitTime(t, db, ms, "EXEC"); d < 50*time.Millisecond {
+		t.Errorf("Expected a writing EXEC to be paused, held for %v", d)
+	}
+}
+
+func TestClientPauseAllAndUnpause(t *testing.T) {
+	db := MakeDB()
+	defer db.Close()
+	ms := NewMultiState(db)
+
+	db.ExecCommand("CLIENT", "PAUSE", "5000")
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		db.ExecCommand("CLIENT", "UNPAUSE")
+	}()
+	d := admitTime(t, db, ms, "GET", "k")
+	if d < 50*time.Millisecond || d > 2*time.Second {
+		t.Errorf("Expected GET to be paused until CLIENT UNPAUSE, held for %v", d)
+	}
+
+	// A WRITE pause does not weaken a running ALL pause
+	db.ExecCommand("CLIENT", "PAUSE", "100", "ALL")
+	db.ExecCommand("CLIENT", "PAUSE", "50", "WRITE")
+	if d := admitTime(t, db, ms, "GET", "k"); d < 50*time.Millisecond {
+		t.Errorf("Expected GET to stay paused for the ALL pause, held for %v", d)
+	}
+}
+
+func TestClientPauseErrors(t *testing.T) {
+	db := MakeDB()
+	defer db.Close()
+
+	for _, args := range [][]string{
+		{"CLIENT"},
+		{"CLIENT", "PAUSE"},
+		{"CLIENT", "PAUSE", "abc"},
+		{"CLIENT", "PAUSE", "-1"},
+		{"CLIENT", "PAUSE", "10", "READ"},
+		{"CLIENT", "UNPAUSE", "x"},
+		{"CLIENT", "KILL"},
+		{"FAILOVER"},
+	} {
+		if _, err := db.ExecCommand(args[0], args[1:]...); err == nil {
+			t.Errorf("Expected %v to fail", args)
+		}
+	}
+	if _, err := db.ExecCommand("FAILOVER", "ABORT"); err == nil || err.Error() != "ERR No failover in progress." {
+		t.Errorf("Expected FAILOVER ABORT to report no failover, got %v", err)
+	}
+}
+
+func TestReplicaRefusesClientWrites(t *testing.T) {
+	db := MakeDB()
+	defer db.Close()
+	ms := NewMultiState(db)
+
+	db.SetReplicaMode(true)
+	if err := db.AdmitClientCommand(ms, [][]byte{[]byte("SET"), []byte("k"), []byte("v")}); err == nil ||
+		!strings.HasPrefix(err.Error(), "READONLY") {
+		t.Errorf("Expected a write on a replica to be refused, got %v", err)
+	}
+	if err := db.AdmitClientCommand(ms, [][]byte{[]byte("GET"), []byte("k")}); err != nil {
+		t.Errorf("Expected a read on a replica to be admitted, got %v", err)
+	}
+}
+
+// TestWriteAdmittedBeforeDemotion runs writes admitted on a master after it
+// became a replica, as a SLAVEOF between their admission and their run
+// leaves them: they are refused, not applied to the replica's data
+func TestWriteAdmittedBeforeDemotion(t *testing.T) {
+	db := MakeDB()
+	defer db.Close()
+	ms := NewMultiState(db)
+	demote := func() {
+		db.roleEpoch.Add(1)
+		db.SetReplicaMode(true)
+	}
+
+	set := [][]byte{[]byte("SET"), []byte("k"), []byte("v")}
+	if err := db.AdmitClientCommand(ms, set); err != nil {
+		t.Fatalf("SET: %v", err)
+	}
+	demote()
+	if _, err := db.ExecWithState(ms, set); err == nil || !strings.HasPrefix(err.Error(), "READONLY") {
+		t.Errorf("Expected the write to be refused, got %v", err)
+	}
+	if result, err := db.ExecWithState(ms, [][]byte{[]byte("GET"), []byte("k")}); err != nil || result[0] != nil {
+		t.Errorf("Expected reads to run and k not to be set, got %q, %v", result, err)
+	}
+
+	// EXEC is checked once it holds db.mu
+	db.SetReplicaMode(false)
+	exec := [][]byte{[]byte("EXEC")}
+	db.ExecWithState(ms, [][]byte{[]byte("MULTI")})
+	db.ExecWithState(ms, set)
+	if err := db.AdmitClientCommand(ms, exec); err != nil {
+		t.Fatalf("EXEC: %v", err)
+	}
+	demote()
+	if _, err := db.ExecWithState(ms, exec); err == nil || !strings.HasPrefix(err.Error(), "READONLY") {
+		t.Errorf("Expected the transaction to be refused, got %v", err)
+	}
+	if ms.IsInMulti() {
+		t.Error("Expected the refused EXEC to end the transaction")
+	}
+
+	// Commands run without admission, such as the ones of the master, are
+	// not checked
+	if _, err := db.ExecCommand("SET", "k", "from-master"); err != nil {
+		t.Errorf("Expected a command without admission to run, got %v", err)
+	}
+	if result, _ := db.ExecCommand("GET", "k"); string(result[0]) != "from-master" {
+		t.Errorf("Expected only the command without admission to write, got %q", result)
+	}
+}
@@ -1,6 +1,7 @@
 package database
 
 import (
+	"strconv"
 	"testing"
 	"time"
 )
@@ -33,6 +34,19 @@ func BenchmarkGET(b *testing.B) {
 	}
 }
 
+// BenchmarkINCR 性能测试 INCR 命令
+func BenchmarkINCR(b *testing.B) {
+	db := MakeDB()
+	cmdLine := [][]byte{[]byte("INCR"), []byte("counter")}
+
+	b.ResetTimer()
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		db.Exec(cmdLine)
+	}
+}
+
 // BenchmarkMGET 性能测试 MGET 命令
 func BenchmarkMGET(b *testing.B) {
 	db := MakeDB()
@@ -156,6 +170,23 @@ func BenchmarkHashHGET(b *testing.B) {
 	}
 }
 
+// BenchmarkHashHGETALL 10 万字段 Hash 的 HGETALL 性能测试
+func BenchmarkHashHGETALL(b *testing.B) {
+	db := MakeDB()
+	for i := 0; i < 100000; i++ {
+		n := strconv.Itoa(i)
+		db.Exec([][]byte{[]byte("HSET"), []byte("hash"), []byte("field" + n), []byte("value" + n)})
+	}
+	cmdLine := [][]byte{[]byte("HGETALL"), []byte("hash")}
+
+	b.ResetTimer()
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		db.Exec(cmdLine)
+	}
+}
+
 // BenchmarkListOperations List 操作性能测试
 func BenchmarkListLPUSH(b *testing.B) {
 	db := MakeDB()
@@ -220,3 +251,119 @@ func BenchmarkCommandParsing(b *testing.B) {
 		_ = cmd
 	}
 }
+
+// hotKeyCounts 热点命令基准测试的键数量
+var hotKeyCounts = []int{1000, 100000}
+
+// BenchmarkHotCommands 在不同键数量下测试热点命令的性能
+//
+// 冒烟运行（CI）：go test -run '^$' -bench HotCommands -benchtime=1x ./database
+func BenchmarkHotCommands(b *testing.B) {
+	value := []byte("xxxxxxxxxxxxxxxx")
+
+	for _, n := range hotKeyCounts {
+		names := make([][]byte, n)
+		for i := range names {
+			names[i] = []byte("key:" + strconv.Itoa(i))
+		}
+		rangeStarts := make([][]byte, n)
+		rangeEnds := make([][]byte, n)
+		for i := range rangeStarts {
+			rangeStarts[i] = []byte(strconv.Itoa(i))
+			rangeEnds[i] = []byte(strconv.Itoa(i + 99))
+		}
+		lists := min(n, 1000)
+		// Inserting into a sorted set is linear in its size, keep the
+		// preloading short
+		members := min(n, 10000)
+
+		cases := []struct {
+			name    string
+			prepare func(db *DB)
+			cmd     func(i int) [][]byte
+		}{
+			{"SET", func(db *DB) {
+				for _, k := range names {
+					db.Exec([][]byte{[]byte("SET"), k, value})
+				}
+			}, func(i int) [][]byte {
+				return [][]byte{[]byte("SET"), names[i%n], value}
+			}},
+			{"GET", func(db *DB) {
+				for _, k := range names {
+					db.Exec([][]byte{[]byte("SET"), k, value})
+				}
+			}, func(i int) [][]byte {
+				return [][]byte{[]byte("GET"), names[i%n]}
+			}},
+			{"INCR", func(db *DB) {
+				for _, k := range names {
+					db.Exec([][]byte{[]byte("SET"), k, []byte("0")})
+				}
+			}, func(i int) [][]byte {
+				return [][]byte{[]byte("INCR"), names[i%n]}
+			}},
+			{"LPUSH", nil, func(i int) [][]byte {
+				return [][]byte{[]byte("LPUSH"), names[i%lists], value}
+			}},
+			{"LRANGE_100", func(db *DB) {
+				for _, k := range names[:lists] {
+					cmd := [][]byte{[]byte("RPUSH"), k}
+					for j := 0; j < 100; j++ {
+						cmd = append(cmd, value)
+					}
+					db.Exec(cmd)
+				}
+			}, func(i int) [][]byte {
+				return [][]byte{[]byte("LRANGE"), names[i%lists], []byte("0"), []byte("99")}
+			}},
+			{"HSET", func(db *DB) {
+				for _, k := range names {
+					db.Exec([][]byte{[]byte("HSET"), []byte("hash"), k, value})
+				}
+			}, func(i int) [][]byte {
+				return [][]byte{[]byte("HSET"), []byte("hash"), names[i%n], value}
+			}},
+			{"SADD", func(db *DB) {
+				for _, k := range names {
+					db.Exec([][]byte{[]byte("SADD"), []byte("set"), k})
+				}
+			}, func(i int) [][]byte {
+				return [][]byte{[]byte("SADD"), []byte("set"), names[i%n]}
+			}},
+			{"ZADD", func(db *DB) {
+				for i, k := range names[:members] {
+					db.Exec([][]byte{[]byte("ZADD"), []byte("zset"), rangeStarts[i], k})
+				}
+			}, func(i int) [][]byte {
+				return [][]byte{[]byte("ZADD"), []byte("zset"), rangeStarts[(i*7)%members], names[i%members]}
+			}},
+			{"ZRANGEBYSCORE", func(db *DB) {
+				for i, k := range names[:members] {
+					db.Exec([][]byte{[]byte("ZADD"), []byte("zset"), rangeStarts[i], k})
+				}
+			}, func(i int) [][]byte {
+				j := i % members
+				return [][]byte{[]byte("ZRANGEBYSCORE"), []byte("zset"), rangeStarts[j], rangeEnds[j]}
+			}},
+		}
+
+		for _, c := range cases {
+			b.Run(c.name+"/keys="+strconv.Itoa(n), func(b *testing.B) {
+				db := MakeDB()
+				defer db.Close()
+				if c.prepare != nil {
+					c.prepare(db)
+				}
+
+				b.ResetTimer()
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					if _, err := db.Exec(c.cmd(i)); err != nil {
+						b.Fatalf("%s: %v", c.name, err)
+					}
+				}
+			})
+		}
+	}
+}
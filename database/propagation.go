@@ -0,0 +1,41 @@
+package database
+
+// Propagation barrier
+//
+// The server propagates a command to the AOF and to slaves after the
+// database ran it, so at any time some commands may have modified the
+// dataset without being propagated yet. A slave synchronized at such a time
+// would get their effects twice (in the RDB, then from the stream) or, if
+// it was registered after they were propagated, not at all.
+//
+// ExecTypedPropagating runs a command holding the barrier shared until the
+// caller propagated it, and AtPropagationPoint holds it exclusively: while
+// its function runs, no command is between its execution and its
+// propagation. Blocked commands release the barrier while they wait.
+// Expirations and evictions are propagated as DELs outside the barrier,
+// which a slave can apply twice.
+
+// ExecTypedPropagating is ExecTypedWithState for a caller that propagates
+// the commands it runs. It holds the propagation barrier until the caller,
+// done propagating the command, calls release; release must be called even
+// when the command fails.
+func (db *DB) ExecTypedPropagating(ms *MultiState, cmdLine [][]byte) (result Result, release func(), err error) {
+	db.propagation.RLock()
+	defer func() {
+		// A panicking command does not return release
+		if release == nil {
+			db.propagation.RUnlock()
+		}
+	}()
+	result, err = db.execTyped(ms, cmdLine, true)
+	return result, db.releasePropagation, err
+}
+
+// AtPropagationPoint runs fn while every command run by
+// ExecTypedPropagating was propagated, and no other one can run. Commands
+// wait for fn, which should not take long.
+func (db *DB) AtPropagationPoint(fn func()) {
+	db.propagation.Lock()
+	defer db.propagation.Unlock()
+	fn()
+}
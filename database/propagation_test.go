@@ -0,0 +1,55 @@
+package database
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAtPropagationPointWaitsForPropagation(t *testing.T) {
+	db := MakeDB()
+	defer db.Close()
+
+	// A command holds the barrier until it is released
+	_, release, err := db.ExecTypedPropagating(db.DefaultMultiState(), [][]byte{[]byte("SET"), []byte("k"), []byte("v")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reached := make(chan struct{})
+	go db.AtPropagationPoint(func() { close(reached) })
+	select {
+	case <-reached:
+		t.Fatal("Expected the propagation point to wait for the command")
+	case <-time.After(20 * time.Millisecond):
+	}
+	release()
+	select {
+	case <-reached:
+	case <-time.After(time.Second):
+		t.Fatal("Expected the propagation point once the command was released")
+	}
+
+	// A blocked command does not hold the barrier while it waits
+	served := make(chan Result)
+	go func() {
+		result, release, _ := db.ExecTypedPropagating(NewMultiState(db), [][]byte{[]byte("BLPOP"), []byte("list"), []byte("0")})
+		release()
+		served <- result
+	}()
+	time.Sleep(20 * time.Millisecond)
+	done := make(chan struct{})
+	go db.AtPropagationPoint(func() { close(done) })
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Expected a blocked BLPOP not to hold up the propagation point")
+	}
+	db.ExecCommand("RPUSH", "list", "x")
+	select {
+	case result := <-served:
+		if lines := result.Lines(); len(lines) != 2 || string(lines[1]) != "x" {
+			t.Errorf("Expected BLPOP to pop x, got %q", lines)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected BLPOP to be served")
+	}
+}
@@ -0,0 +1,114 @@
+package database
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/wangbo/gocache/datastruct"
+)
+
+// ReplaceDataset builds a new dataset by running load against an empty
+// staging database and, only if load succeeds, replaces every key of db with
+// the staged ones. If load fails db keeps its old data.
+//
+// Commands keep being served from the old data while load runs; they are only
+// blocked while the keys are swapped. The caller must not hold db.mu.
+func (db *DB) ReplaceDataset(load func(staging *DB) error) error {
+	staging, err := db.loadStaging(load)
+	if err != nil {
+		return err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.swapDataset(staging)
+	return nil
+}
+
+// loadStaging runs load against a new empty database
+func (db *DB) loadStaging(load func(staging *DB) error) (*DB, error) {
+	staging := MakeDBWithConfig(db.config, db.repl)
+	// Keys must not expire half way through the load
+	staging.SetReplicaMode(true)
+	if h, ok := db.clock.Load().(clockHolder); ok {
+		staging.SetClock(h.Clock)
+	}
+
+	if err := load(staging); err != nil {
+		staging.Close()
+		return nil, err
+	}
+	return staging, nil
+}
+
+// swapDataset replaces the keys of db with those of staging, which is closed
+// afterwards. The caller must hold db.mu exclusively, so that no command sees
+// a mix of both datasets.
+//
+// The entries are moved rather than the dictionaries themselves, because the
+// expiration wheels and background saves read them without holding db.mu.
+func (db *DB) swapDataset(staging *DB) {
+	staging.timeWheel.Stop()
+	staging.fieldWheel.Stop()
+
+	oldKeys := db.data.Keys()
+	for _, key := range db.ttlMap.Keys() {
+		db.timeWheel.Remove(key)
+	}
+	for _, key := range oldKeys {
+		db.fieldWheel.Remove(key)
+		if db.evictionPolicy != nil {
+			db.evictionPolicy.RecordDelete(key)
+		}
+	}
+	db.data.Clear()
+	db.ttlMap.Clear()
+
+	staging.data.ForEach(func(key string, val interface{}) bool {
+		// Hashes keep checking their field TTLs against the clock of db
+		if entity, ok := val.(*datastruct.DataEntity); ok {
+			if hash, ok := entity.Data.(*datastruct.Hash); ok {
+				hash.SetClock(db.now)
+			}
+		}
+		db.data.Put(key, val)
+		return true
+	})
+	staging.ttlMap.ForEach(func(key string, val interface{}) bool {
+		expireAt, ok := val.(time.Time)
+		if !ok {
+			return true
+		}
+		db.ttlMap.Put(key, expireAt)
+		// Keys that expired during the load go at the next tick
+		delay := expireAt.Sub(db.now())
+		if delay < time.Millisecond {
+			delay = time.Millisecond
+		}
+		db.timeWheel.Add(key, delay)
+		return true
+	})
+	atomic.StoreInt64(&db.usedMemory, staging.GetUsedMemory())
+
+	newKeys := db.data.Keys()
+	for _, key := range newKeys {
+		if entity, ok := db.getEntityWithoutExpiryCheck(key); ok {
+			if hash, ok := entity.Data.(*datastruct.Hash); ok {
+				db.scheduleFieldExpiry(key, hash)
+			}
+			db.recordAccess(key, entity)
+		}
+	}
+
+	// Every key changed as far as WATCH is concerned; touching the old keys
+	// after the swap also drops the versions of those that are gone
+	for _, key := range oldKeys {
+		db.touchKey(key)
+	}
+	for _, key := range newKeys {
+		db.touchKey(key)
+		db.keyChanged(key)
+	}
+
+	staging.Close()
+}
@@ -0,0 +1,250 @@
+package database_test
+
+import (
+	"errors"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/wangbo/gocache/config"
+	"github.com/wangbo/gocache/database"
+	"github.com/wangbo/gocache/persistence"
+	"github.com/wangbo/gocache/persistence/rdb"
+	"github.com/wangbo/gocache/replication"
+	"github.com/wangbo/gocache/util/clock"
+)
+
+// useRDB registers the RDB saver and loader for the duration of a test
+func useRDB(t *testing.T) {
+	useSaverAndLoader(t, &rdb.RDBSaver{}, &rdb.RDBLoaderImpl{})
+}
+
+func useSaverAndLoader(t *testing.T, saver persistence.DBSaver, loader persistence.DBLoader) {
+	oldSaver, oldLoader := persistence.GetSaver(), persistence.GetLoader()
+	persistence.RegisterSaver(saver)
+	persistence.RegisterLoader(loader)
+	t.Cleanup(func() {
+		persistence.RegisterSaver(oldSaver)
+		persistence.RegisterLoader(oldLoader)
+	})
+}
+
+func exec(t *testing.T, db *database.DB, args ...string) [][]byte {
+	t.Helper()
+	cmdLine := make([][]byte, len(args))
+	for i, arg := range args {
+		cmdLine[i] = []byte(arg)
+	}
+	result, err := db.Exec(cmdLine)
+	if err != nil {
+		t.Fatalf("%s: %v", strings.Join(args, " "), err)
+	}
+	return result
+}
+
+// dumpKeyspace describes every key of db: its type, value and expiration
+// time in unix milliseconds (the precision kept by RDB)
+func dumpKeyspace(t *testing.T, db *database.DB) map[string][]string {
+	t.Helper()
+	keyspace := make(map[string][]string)
+	for _, entry := range db.Snapshot() {
+		key := entry.Key
+		typ := string(exec(t, db, "TYPE", key)[0])
+
+		var value [][]byte
+		unordered := false
+		switch typ {
+		case "string":
+			value = exec(t, db, "GET", key)
+		case "hash":
+			value = exec(t, db, "HGETALL", key)
+			// Keep each field next to its value while sorting
+			pairs := make([][]byte, 0, len(value)/2)
+			for i := 0; i+1 < len(value); i += 2 {
+				pairs = append(pairs, []byte(string(value[i])+"="+string(value[i+1])))
+			}
+			value, unordered = pairs, true
+		case "list":
+			value = exec(t, db, "LRANGE", key, "0", "-1")
+		case "set":
+			value, unordered = exec(t, db, "SMEMBERS", key), true
+		case "zset":
+			value = exec(t, db, "ZRANGE", key, "0", "-1", "WITHSCORES")
+		}
+
+		desc := []string{typ}
+		for _, v := range value {
+			desc = append(desc, string(v))
+		}
+		if unordered {
+			sort.Strings(desc[1:])
+		}
+		if !entry.ExpireAt.IsZero() {
+			desc = append(desc, "expire-at", time.UnixMilli(entry.ExpireAt.UnixMilli()).String())
+		}
+		keyspace[key] = desc
+	}
+	return keyspace
+}
+
+func populate(t *testing.T, db *database.DB) {
+	t.Helper()
+	exec(t, db, "SET", "string", "value")
+	exec(t, db, "SET", "counter", "12345")
+	exec(t, db, "SET", "volatile:string", "soon gone", "EX", "300")
+
+	exec(t, db, "HMSET", "hash", "f1", "v1", "f2", "v2", "f3", "")
+	exec(t, db, "HSET", "volatile:hash", "f", "v")
+	exec(t, db, "EXPIRE", "volatile:hash", "400")
+
+	exec(t, db, "RPUSH", "list", "a", "b", "c", "b", "a")
+	exec(t, db, "RPUSH", "volatile:list", "x")
+	exec(t, db, "PEXPIRE", "volatile:list", "500000")
+
+	exec(t, db, "SADD", "set", "m1", "m2", "m3")
+	exec(t, db, "SADD", "volatile:set", "m")
+	exec(t, db, "EXPIRE", "volatile:set", "600")
+
+	exec(t, db, "ZADD", "zset", "1", "one", "2.5", "two", "-3", "minus")
+	exec(t, db, "ZADD", "volatile:zset", "1", "z")
+	exec(t, db, "EXPIRE", "volatile:zset", "700")
+}
+
+func TestDebugReloadPreservesKeyspace(t *testing.T) {
+	useRDB(t)
+	db := database.MakeDB()
+	defer db.Close()
+
+	populate(t, db)
+	before := dumpKeyspace(t, db)
+	if len(before) != 11 {
+		t.Fatalf("Expected 11 keys before reload, got %d", len(before))
+	}
+
+	if result := exec(t, db, "DEBUG", "RELOAD"); string(result[0]) != "OK" {
+		t.Fatalf("Expected OK, got %q", result[0])
+	}
+
+	after := dumpKeyspace(t, db)
+	if !reflect.DeepEqual(before, after) {
+		t.Errorf("Keyspace changed across DEBUG RELOAD\nbefore: %v\nafter:  %v", before, after)
+	}
+
+	// The reloaded keys are live: TTLs still count down and writes apply
+	if ttl := string(exec(t, db, "TTL", "volatile:set")[0]); ttl == "-1" || ttl == "-2" {
+		t.Errorf("Expected volatile:set to keep its TTL, got %s", ttl)
+	}
+	exec(t, db, "RPUSH", "list", "d")
+	if n := string(exec(t, db, "LLEN", "list")[0]); n != "6" {
+		t.Errorf("Expected 6 elements after RPUSH, got %s", n)
+	}
+	if db.GetUsedMemory() <= 0 {
+		t.Errorf("Expected used memory to be accounted after reload, got %d", db.GetUsedMemory())
+	}
+}
+
+func TestDebugReloadExpiresReloadedKeys(t *testing.T) {
+	useRDB(t)
+	db := database.MakeDB()
+	defer db.Close()
+
+	exec(t, db, "SET", "short", "v", "PX", "100")
+	exec(t, db, "DEBUG", "RELOAD")
+
+	// Expired by the time wheel, not only on access
+	deadline := time.Now().Add(2 * time.Second)
+	for len(db.Keys()) > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if keys := db.Keys(); len(keys) != 0 {
+		t.Errorf("Expected the reloaded key to expire, still have %v", keys)
+	}
+}
+
+func TestDebugReloadRestartsIdleTime(t *testing.T) {
+	useRDB(t)
+	cfg := config.Default()
+	cfg.TrackIdle = true
+	db := database.MakeDBWithConfig(cfg, replication.NewReplicationState())
+	defer db.Close()
+
+	mc := clock.NewManual(time.Now())
+	db.SetClock(mc)
+
+	exec(t, db, "SET", "k", "v")
+	mc.Advance(1100 * time.Millisecond)
+	if idle := string(exec(t, db, "OBJECT", "IDLETIME", "k")[0]); idle == "0" {
+		t.Fatal("Expected the key to be idle before the reload")
+	}
+
+	exec(t, db, "DEBUG", "RELOAD")
+	if idle := string(exec(t, db, "OBJECT", "IDLETIME", "k")[0]); idle != "0" {
+		t.Errorf("Expected the idle time to restart on reload, got %s", idle)
+	}
+}
+
+type failingLoader struct{}
+
+func (failingLoader) LoadDBFromReader(db interface{}, reader io.Reader) error {
+	// Load part of the data before failing
+	staging := db.(*database.DB)
+	staging.Exec([][]byte{[]byte("SET"), []byte("partial"), []byte("v")})
+	return errors.New("corrupt dump")
+}
+
+func TestDebugReloadKeepsDataOnLoadFailure(t *testing.T) {
+	useSaverAndLoader(t, &rdb.RDBSaver{}, failingLoader{})
+	db := database.MakeDB()
+	defer db.Close()
+
+	populate(t, db)
+	before := dumpKeyspace(t, db)
+
+	if _, err := db.Exec([][]byte{[]byte("DEBUG"), []byte("RELOAD")}); err == nil {
+		t.Fatal("Expected DEBUG RELOAD to fail")
+	}
+	if after := dumpKeyspace(t, db); !reflect.DeepEqual(before, after) {
+		t.Errorf("Expected the old keyspace to be kept\nbefore: %v\nafter:  %v", before, after)
+	}
+}
+
+// blockingSaver blocks SaveDB until release is closed
+type blockingSaver struct {
+	rdb.RDBSaver
+	started chan struct{}
+	release chan struct{}
+}
+
+func (s *blockingSaver) SaveDB(db interface{}, filename string) error {
+	close(s.started)
+	<-s.release
+	return nil
+}
+
+func TestDebugReloadRefusedDuringBgSave(t *testing.T) {
+	saver := &blockingSaver{started: make(chan struct{}), release: make(chan struct{})}
+	useSaverAndLoader(t, saver, &rdb.RDBLoaderImpl{})
+	db := database.MakeDB()
+	defer db.Close()
+
+	exec(t, db, "SET", "k", "v")
+	exec(t, db, "BGSAVE")
+	<-saver.started
+
+	_, err := db.Exec([][]byte{[]byte("DEBUG"), []byte("RELOAD")})
+	close(saver.release)
+	if err == nil || !strings.Contains(err.Error(), "Background save already in progress") {
+		t.Errorf("Expected DEBUG RELOAD to be refused during BGSAVE, got %v", err)
+	}
+
+	for db.IsBgSaveInProgress() {
+		time.Sleep(time.Millisecond)
+	}
+	exec(t, db, "DEBUG", "RELOAD")
+	if v := string(exec(t, db, "GET", "k")[0]); v != "v" {
+		t.Errorf("Expected k to survive the reload, got %q", v)
+	}
+}
@@ -0,0 +1,123 @@
+package database_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/wangbo/gocache/database"
+)
+
+// valueTypes creates a value of every type at key k, with a TTL
+var valueTypes = []struct {
+	name  string
+	setup []string
+}{
+	{"string", []string{"SET k old"}},
+	{"integer", []string{"SET k 12345"}},
+	{"list", []string{"RPUSH k a b c"}},
+	{"hash", []string{"HSET k f v g w"}},
+	{"hash with field TTL", []string{"HSET k f v g w", "HEXPIRE k 100 FIELDS 1 f"}},
+	{"set", []string{"SADD k a b c"}},
+	{"sorted set", []string{"ZADD k 1 a 2 b"}},
+	{"stream", []string{"XADD k 1-1 f v"}},
+	{"hyperloglog", []string{"PFADD k a b c"}},
+	{"geo", []string{"GEOADD k 13.361389 38.115556 Palermo"}},
+}
+
+// setupKey runs the commands creating a value at k and gives k a TTL
+func setupKey(t *testing.T, db *database.DB, setup []string) {
+	t.Helper()
+	for _, cmd := range setup {
+		exec(t, db, strings.Fields(cmd)...)
+	}
+	exec(t, db, "EXPIRE", "k", "100")
+}
+
+func TestSetReplacesEveryType(t *testing.T) {
+	// The state of a key that only ever held the new value
+	fresh := database.MakeDB()
+	defer fresh.Close()
+	exec(t, fresh, "SET", "k", "new")
+	wantUsage := string(exec(t, fresh, "MEMORY", "USAGE", "k")[0])
+	wantUsed := fresh.GetUsedMemory()
+
+	for _, vt := range valueTypes {
+		t.Run(vt.name, func(t *testing.T) {
+			db := database.MakeDB()
+			defer db.Close()
+			setupKey(t, db, vt.setup)
+
+			exec(t, db, "SET", "k", "new")
+			if typ := string(exec(t, db, "TYPE", "k")[0]); typ != "string" {
+				t.Errorf("Expected type string, got %s", typ)
+			}
+			if ttl := string(exec(t, db, "TTL", "k")[0]); ttl != "-1" {
+				t.Errorf("Expected the TTL to be cleared, got %s", ttl)
+			}
+			if value := string(exec(t, db, "GET", "k")[0]); value != "new" {
+				t.Errorf("Expected new, got %s", value)
+			}
+			if usage := string(exec(t, db, "MEMORY", "USAGE", "k")[0]); usage != wantUsage {
+				t.Errorf("Expected MEMORY USAGE %s, got %s", wantUsage, usage)
+			}
+			if used := db.GetUsedMemory(); used != wantUsed {
+				t.Errorf("Expected used memory %d, got %d", wantUsed, used)
+			}
+		})
+	}
+}
+
+func TestGetSet(t *testing.T) {
+	db := database.MakeDB()
+	defer db.Close()
+
+	if result := exec(t, db, "GETSET", "k", "a"); !database.IsNullResult(result) {
+		t.Errorf("Expected a null reply on a missing key, got %q", result)
+	}
+	exec(t, db, "EXPIRE", "k", "100")
+	if old := string(exec(t, db, "GETSET", "k", "b")[0]); old != "a" {
+		t.Errorf("Expected the old value a, got %s", old)
+	}
+	if ttl := string(exec(t, db, "TTL", "k")[0]); ttl != "-1" {
+		t.Errorf("Expected the TTL to be cleared, got %s", ttl)
+	}
+	if value := string(exec(t, db, "GET", "k")[0]); value != "b" {
+		t.Errorf("Expected b, got %s", value)
+	}
+}
+
+func TestGetSetLeavesOtherTypes(t *testing.T) {
+	for _, vt := range valueTypes {
+		t.Run(vt.name, func(t *testing.T) {
+			db := database.MakeDB()
+			defer db.Close()
+			setupKey(t, db, vt.setup)
+			typ := string(exec(t, db, "TYPE", "k")[0])
+			usage := string(exec(t, db, "MEMORY", "USAGE", "k")[0])
+			used := db.GetUsedMemory()
+
+			_, err := db.Exec([][]byte{[]byte("GETSET"), []byte("k"), []byte("new")})
+			if typ == "string" {
+				if err != nil {
+					t.Errorf("Expected GETSET to replace a string, got %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.HasPrefix(err.Error(), "WRONGTYPE") {
+				t.Fatalf("Expected WRONGTYPE, got %v", err)
+			}
+			if got := string(exec(t, db, "TYPE", "k")[0]); got != typ {
+				t.Errorf("Expected type %s to be kept, got %s", typ, got)
+			}
+			if ttl := string(exec(t, db, "TTL", "k")[0]); ttl != "100" {
+				t.Errorf("Expected the TTL to be kept, got %s", ttl)
+			}
+			if got := string(exec(t, db, "MEMORY", "USAGE", "k")[0]); got != usage {
+				t.Errorf("Expected MEMORY USAGE %s to be kept, got %s", usage, got)
+			}
+			if got := db.GetUsedMemory(); got != used {
+				t.Errorf("Expected used memory %d to be kept, got %d", used, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,48 @@
+package database
+
+// Replaying commands
+//
+// The AOF holds commands the server executed, which must be applied again as
+// they were, not as if a client sent them now: a Replay bypasses what only
+// guards client commands. Authentication and client limits are the server's
+// and are never applied; the pauses, LOADING and READONLY checks of
+// AdmitClientCommand are skipped; keys are not evicted to stay under
+// maxmemory while a Replay is open; and a blocking command that finds nothing
+// returns at once as if it had timed out, instead of waiting for a write that
+// will never come. Administrative commands such as FLUSHALL run like any
+// other, so a file that contains one loads only the keys written after it.
+
+// Replay applies commands read back from a file to a database
+type Replay struct {
+	db *DB
+	ms *MultiState // MULTI/EXEC blocks of the file
+}
+
+// StartReplay opens a Replay of commands on db; the caller must Close it
+func (db *DB) StartReplay() *Replay {
+	db.replays.Add(1)
+	return &Replay{db: db, ms: NewMultiState(db)}
+}
+
+// Exec applies one command
+func (r *Replay) Exec(cmdLine [][]byte) error {
+	cmdType, executor, err := lookupCommand(cmdLine)
+	if err != nil {
+		return err
+	}
+	if _, ok := executor.(*TransactionCommand); ok || r.ms.IsInMulti() {
+		_, err := r.db.ExecTypedWithState(r.ms, cmdLine)
+		return err
+	}
+
+	_, err = r.db.executeShared(cmdType, executor, cmdLine[1:], admission{})
+	if _, ok := err.(*blockedCommand); ok {
+		return nil
+	}
+	return err
+}
+
+// Close ends the Replay
+func (r *Replay) Close() {
+	r.db.replays.Add(-1)
+}
@@ -0,0 +1,307 @@
+package database_test
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/wangbo/gocache/config"
+	"github.com/wangbo/gocache/database"
+	"github.com/wangbo/gocache/persistence/rdb"
+	"github.com/wangbo/gocache/replication"
+)
+
+// corruptRDB returns an RDB snapshot holding key "partial" followed by an
+// unknown opcode, so that loading it fails after loading a key
+func corruptRDB(t *testing.T) []byte {
+	t.Helper()
+	db := database.MakeDB()
+	defer db.Close()
+	exec(t, db, "SET", "partial", "v")
+
+	var buf bytes.Buffer
+	if err := rdb.SaveToWriter(db, &buf); err != nil {
+		t.Fatalf("SaveToWriter: %v", err)
+	}
+	// Replace the EOF opcode and checksum
+	data := buf.Bytes()[:buf.Len()-9]
+	return append(data, 200)
+}
+
+func TestSlaveFullSyncReplacesDataset(t *testing.T) {
+	replication.RegisterRDBLoader(&rdb.RDBLoaderImpl{})
+	defer replication.RegisterRDBLoader(nil)
+	defer database.SetSyncRetryInterval(10 * time.Millisecond)()
+
+	master := database.MakeDB()
+	defer master.Close()
+	exec(t, master, "SET", "shared", "from-master")
+	exec(t, master, "RPUSH", "list", "a", "b")
+	exec(t, master, "SET", "volatile", "v", "EX", "100")
+	masterRS := replication.NewReplicationState()
+
+	slave := database.MakeDB()
+	defer slave.Close()
+	slave.SetReplicaMode(true)
+	exec(t, slave, "SET", "shared", "stale", "EX", "100")
+	exec(t, slave, "SET", "junk:1", "x")
+	exec(t, slave, "SADD", "junk:2", "y")
+	junk := dumpKeyspace(t, slave)
+
+	corrupt := corruptRDB(t)
+	slaveRS := replication.NewReplicationState()
+	slaveRS.SetAsSlave("master", 6379)
+	defer slaveRS.SetAsMaster()
+
+	// The first attempt receives a corrupt snapshot; the second one waits
+	// until the test has checked the slave's data
+	var attempts atomic.Int32
+	secondDial := make(chan struct{})
+	proceed := make(chan struct{})
+	masterEnds := make(chan net.Conn, 2)
+	slaveRS.SetDialer(func(addr string) (net.Conn, error) {
+		attempt := attempts.Add(1)
+		if attempt == 2 {
+			close(secondDial)
+			<-proceed
+		}
+		masterEnd, slaveEnd := net.Pipe()
+		masterEnds <- masterEnd
+		go func() {
+			if _, err := bufio.NewReader(masterEnd).ReadString('\n'); err != nil {
+				return // SYNC
+			}
+			data := corrupt
+			if attempt > 1 {
+				var buf bytes.Buffer
+				rdb.SaveToWriter(master, &buf)
+				data = buf.Bytes()
+			}
+			if masterRS.SendFullResync(masterEnd, data) == nil && attempt > 1 {
+				masterRS.RegisterSlave(masterEnd)
+			}
+		}()
+		return slaveEnd, nil
+	})
+	defer func() {
+		close(masterEnds)
+		for conn := range masterEnds {
+			masterRS.UnregisterSlave(conn)
+			conn.Close()
+		}
+	}()
+
+	done := make(chan error, 1)
+	go func() { done <- slave.SyncWithMaster(slaveRS) }()
+
+	select {
+	case <-secondDial:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the sync to be retried")
+	}
+	if got := dumpKeyspace(t, slave); !reflect.DeepEqual(got, junk) {
+		t.Errorf("Expected the slave to keep its data after a failed sync\nwant: %v\ngot:  %v", junk, got)
+	}
+
+	close(proceed)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("SyncWithMaster: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the sync")
+	}
+
+	if want, got := dumpKeyspace(t, master), dumpKeyspace(t, slave); !reflect.DeepEqual(want, got) {
+		t.Errorf("Expected only the master's keys on the slave\nwant: %v\ngot:  %v", want, got)
+	}
+	if v := slave.GetVersion("junk:1"); v != 0 {
+		t.Errorf("Expected the version of a dropped key to be forgotten, got %d", v)
+	}
+
+	// The slave applies what the master propagates after the sync
+	masterRS.PropagateCommand([][]byte{[]byte("SET"), []byte("after"), []byte("sync")})
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if result, _ := slave.Exec([][]byte{[]byte("GET"), []byte("after")}); len(result) == 1 && string(result[0]) == "sync" {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Error("Expected the slave to apply a command propagated after the sync")
+}
+
+// pipeMaster serves the SYNC of a replica of master over in-memory pipes.
+// Once synced, a replica is registered with masterRS to receive the commands
+// it propagates.
+func pipeMaster(t *testing.T, master *database.DB, masterRS *replication.ReplicationState) func(addr string) (net.Conn, error) {
+	return func(addr string) (net.Conn, error) {
+		masterEnd, slaveEnd := net.Pipe()
+		t.Cleanup(func() {
+			masterRS.UnregisterSlave(masterEnd)
+			masterEnd.Close()
+		})
+		go func() {
+			if _, err := bufio.NewReader(masterEnd).ReadString('\n'); err != nil {
+				return // SYNC
+			}
+			var buf bytes.Buffer
+			rdb.SaveToWriter(master, &buf)
+			if masterRS.SendFullResync(masterEnd, buf.Bytes()) == nil {
+				masterRS.RegisterSlave(masterEnd)
+			}
+		}()
+		return slaveEnd, nil
+	}
+}
+
+// waitLoaded waits until db finished loading the dataset of its master
+func waitLoaded(t *testing.T, db *database.DB) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for db.IsLoading() {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for the replica to load the master's dataset")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestSlaveOfWithWritesInFlight(t *testing.T) {
+	replication.RegisterRDBLoader(&rdb.RDBLoaderImpl{})
+	defer replication.RegisterRDBLoader(nil)
+
+	master := database.MakeDB()
+	defer master.Close()
+	for i := 0; i < 100; i++ {
+		exec(t, master, "SET", "key:"+strconv.Itoa(i), "from-master")
+	}
+	masterRS := replication.NewReplicationState()
+
+	slaveRS := replication.NewReplicationState()
+	slaveRS.SetDialer(pipeMaster(t, master, masterRS))
+	defer slaveRS.SetAsMaster()
+	slave := database.MakeDBWithConfig(config.Default(), slaveRS)
+	defer slave.Close()
+
+	// Clients keep writing, through the admission checks of the server,
+	// while the role changes
+	stop := make(chan struct{})
+	var writers sync.WaitGroup
+	var refused atomic.Int32
+	for w := 0; w < 8; w++ {
+		writers.Add(1)
+		go func(w int) {
+			defer writers.Done()
+			ms := database.NewMultiState(slave)
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				cmdLine := [][]byte{[]byte("SET"), []byte("key:" + strconv.Itoa(i%200)), []byte("from-client-" + strconv.Itoa(w))}
+				if err := slave.AdmitClientCommand(ms, cmdLine); err != nil {
+					refused.Add(1)
+					continue
+				}
+				slave.ExecWithState(ms, cmdLine)
+			}
+		}(w)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	exec(t, slave, "SLAVEOF", "master", "6379")
+	waitLoaded(t, slave)
+
+	// The master keeps writing after the sync
+	set := [][]byte{[]byte("SET"), []byte("key:0"), []byte("updated")}
+	exec(t, master, "SET", "key:0", "updated")
+	masterRS.PropagateCommand(set)
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if result, _ := slave.ExecCommand("GET", "key:0"); len(result) == 1 && string(result[0]) == "updated" {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	close(stop)
+	writers.Wait()
+
+	if refused.Load() == 0 {
+		t.Error("Expected client writes to be refused once the role changed")
+	}
+	if want, got := dumpKeyspace(t, master), dumpKeyspace(t, slave); !reflect.DeepEqual(want, got) {
+		t.Errorf("Expected the replica to hold exactly the master's keys\nwant: %v\ngot:  %v", want, got)
+	}
+
+	// SLAVEOF NO ONE stops applying what the old master propagates
+	exec(t, slave, "SLAVEOF", "NO", "ONE")
+	if slave.IsReplica() || slave.IsLoading() {
+		t.Error("Expected SLAVEOF NO ONE to promote the replica")
+	}
+	masterRS.PropagateCommand([][]byte{[]byte("SET"), []byte("after"), []byte("promotion")})
+	time.Sleep(50 * time.Millisecond)
+	if result, _ := slave.ExecCommand("GET", "after"); len(result) != 0 && result[0] != nil {
+		t.Errorf("Expected the promoted replica to ignore its old master, got %q", result[0])
+	}
+}
+
+func TestSlaveOfRefusesCommandsWhileLoading(t *testing.T) {
+	// The master never answers SYNC, so the replica keeps loading
+	slaveRS := replication.NewReplicationState()
+	hold := make(chan struct{})
+	defer close(hold)
+	slaveRS.SetDialer(func(addr string) (net.Conn, error) {
+		masterEnd, slaveEnd := net.Pipe()
+		go func() {
+			<-hold
+			masterEnd.Close()
+		}()
+		go io.Copy(io.Discard, masterEnd)
+		return slaveEnd, nil
+	})
+	defer slaveRS.SetAsMaster()
+
+	for _, stale := range []bool{true, false} {
+		cfg := config.Default()
+		cfg.ReplicaServeStaleData = stale
+		slave := database.MakeDBWithConfig(cfg, slaveRS)
+		exec(t, slave, "SET", "key", "value")
+		exec(t, slave, "SLAVEOF", "master", "6379")
+		if !slave.IsLoading() {
+			t.Fatal("Expected the replica to be loading")
+		}
+
+		ms := database.NewMultiState(slave)
+		err := slave.AdmitClientCommand(ms, [][]byte{[]byte("SET"), []byte("key"), []byte("v")})
+		if err == nil || !strings.HasPrefix(err.Error(), "LOADING") {
+			t.Errorf("stale=%v: expected SET to be refused with LOADING, got %v", stale, err)
+		}
+		err = slave.AdmitClientCommand(ms, [][]byte{[]byte("GET"), []byte("key")})
+		if stale && err != nil {
+			t.Errorf("Expected GET to serve stale data, got %v", err)
+		}
+		if !stale && (err == nil || !strings.HasPrefix(err.Error(), "LOADING")) {
+			t.Errorf("Expected GET to be refused with LOADING, got %v", err)
+		}
+		if err := slave.AdmitClientCommand(ms, [][]byte{[]byte("SLAVEOF"), []byte("NO"), []byte("ONE")}); err != nil {
+			t.Errorf("Expected SLAVEOF to run while loading, got %v", err)
+		}
+
+		exec(t, slave, "SLAVEOF", "NO", "ONE")
+		if slave.IsLoading() {
+			t.Error("Expected SLAVEOF NO ONE to stop loading")
+		}
+		slave.Close()
+	}
+}
@@ -0,0 +1,116 @@
+package database
+
+import "strconv"
+
+// Typed command results
+//
+// Commands return [][]byte from Exec, and the server used to choose the RESP
+// type of the reply from lists of command names (protocol.IsIntegerCommand
+// and the like), which had to be kept in sync with every command. Commands
+// registered with NewTypedReadCommand or NewTypedWriteCommand return a Result
+// instead, which carries its own type: an IntResult is replied as an integer
+// whatever the command, a BulkResult as a bulk string. Exec still returns the
+// [][]byte form of every result; ExecTypedWithState returns the Result.
+
+// Result is the typed result of a command
+type Result interface {
+	// Lines returns the result in the form returned by Exec
+	Lines() [][]byte
+}
+
+// IntResult is replied as a RESP integer
+type IntResult int64
+
+// Lines returns the decimal form of the integer
+func (r IntResult) Lines() [][]byte {
+	return [][]byte{strconv.AppendInt(nil, int64(r), 10)}
+}
+
+// BulkResult is replied as a RESP bulk string; an absent value is a
+// NilResult, a nil BulkResult is the empty string
+type BulkResult []byte
+
+// Lines returns the string
+func (r BulkResult) Lines() [][]byte {
+	if r == nil {
+		return [][]byte{{}}
+	}
+	return [][]byte{r}
+}
+
+// NilResult is an absent value, replied as a RESP null bulk string
+type NilResult struct{}
+
+// Lines returns the null marker (see nullResult)
+func (NilResult) Lines() [][]byte {
+	return nullResult()
+}
+
+// StatusResult is replied as a RESP simple string
+type StatusResult string
+
+// Lines returns the status
+func (r StatusResult) Lines() [][]byte {
+	return [][]byte{[]byte(r)}
+}
+
+// ScanResult is the result of a cursor-based iteration (HSCAN and the like),
+// replied as an array of the next cursor and an array of the elements
+type ScanResult struct {
+	Cursor   int64
+	Elements [][]byte
+}
+
+// Lines returns the cursor followed by the elements
+func (r ScanResult) Lines() [][]byte {
+	lines := make([][]byte, 0, 1+len(r.Elements))
+	lines = append(lines, strconv.AppendInt(nil, r.Cursor, 10))
+	return append(lines, r.Elements...)
+}
+
+// LinesResult is the result of a command that is not typed; the server
+// replies with the type it expects from the command
+type LinesResult [][]byte
+
+// Lines returns the result as is
+func (r LinesResult) Lines() [][]byte {
+	return r
+}
+
+// unchangedResult is the result of a write command that changed nothing
+// although its reply does not show it, such as GETEX without an option:
+// modified reports false for it. The database replies with the wrapped
+// result (see replyOf).
+type unchangedResult struct {
+	Result
+}
+
+// replyOf returns the result a command replies with
+func replyOf(r Result) Result {
+	if unchanged, ok := r.(unchangedResult); ok {
+		return unchanged.Result
+	}
+	return r
+}
+
+// linesOf returns the [][]byte form of a result, nil for no result
+func linesOf(r Result) [][]byte {
+	if r == nil {
+		return nil
+	}
+	return r.Lines()
+}
+
+// untypedResult wraps the result of a command that is not typed
+func untypedResult(lines [][]byte, err error) (Result, error) {
+	if lines == nil {
+		return nil, err
+	}
+	return LinesResult(lines), err
+}
+
+// TypedCommandExecutor is a CommandExecutor that can return a typed Result
+type TypedCommandExecutor interface {
+	CommandExecutor
+	ExecuteTyped(db *DB, args [][]byte) (Result, error)
+}
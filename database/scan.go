@@ -0,0 +1,269 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/wangbo/gocache/datastruct"
+	"github.com/wangbo/gocache/util/glob"
+)
+
+// Cursor-based iteration of the keyspace, hashes, sets and sorted sets
+//
+// KEYS, HGETALL, SMEMBERS and ZRANGE 0 -1 build their whole reply at once,
+// which stalls the connection and spikes memory on millions of keys or
+// elements. SCAN, HSCAN, SSCAN and ZSCAN return it a batch at a time instead:
+//
+//	SCAN cursor [MATCH pattern] [COUNT count] [TYPE type]
+//	HSCAN key cursor [MATCH pattern] [COUNT count] [NOVALUES]
+//
+// Each call returns the next cursor and about COUNT elements (default 10);
+// cursor 0 starts an iteration and a returned 0 ends it. Every element present
+// for the whole iteration is returned at least once, whatever is written
+// between the calls. MATCH filters the batch after it is taken, so a call may
+// return fewer elements than COUNT, or none, before the iteration ends.
+// TYPE, one of the names TYPE replies with, filters the keys of SCAN the same
+// way, so COUNT bounds the keys examined rather than the keys returned.
+//
+// proto-max-reply-elements, off (0) by default, refuses the commands that
+// would reply with more elements than that and advises the cursor-based
+// alternative (see checkReplyElements).
+
+// defaultScanCount is the number of elements a scan visits without COUNT
+const defaultScanCount = 10
+
+// scanOptions holds the arguments of SCAN, and of HSCAN, SSCAN and ZSCAN
+// after the key
+type scanOptions struct {
+	cursor   int64
+	pattern  string // "" matches everything
+	count    int
+	noValues bool   // HSCAN NOVALUES
+	typeName string // SCAN TYPE, "" for any type
+}
+
+// parseScanArgs parses "cursor [MATCH pattern] [COUNT count]", and extra,
+// the option only one of the commands takes: NOVALUES for HSCAN or TYPE for
+// SCAN
+func (db *DB) parseScanArgs(args [][]byte, extra string) (*scanOptions, error) {
+	cursor, err := strconv.ParseInt(string(args[0]), 10, 64)
+	if err != nil || cursor < 0 {
+		return nil, errors.New("ERR invalid cursor")
+	}
+	opts := &scanOptions{cursor: cursor, count: defaultScanCount}
+	for i := 1; i < len(args); i++ {
+		switch option := strings.ToUpper(string(args[i])); {
+		case option == "MATCH" && i+1 < len(args):
+			i++
+			if pattern := string(args[i]); pattern != "*" {
+				opts.pattern = pattern
+			}
+		case option == "COUNT" && i+1 < len(args):
+			i++
+			count, err := strconv.Atoi(string(args[i]))
+			if err != nil {
+				return nil, ErrNotInteger
+			}
+			if count < 1 {
+				return nil, ErrSyntax
+			}
+			opts.count = count
+		case option == "NOVALUES" && extra == option:
+			opts.noValues = true
+		case option == "TYPE" && extra == option && i+1 < len(args):
+			i++
+			opts.typeName = strings.ToLower(string(args[i]))
+			if !slices.Contains(typeNames, opts.typeName) {
+				return nil, fmt.Errorf("ERR unknown type name '%s'", args[i])
+			}
+		default:
+			return nil, ErrSyntax
+		}
+	}
+	// A batch always passes the reply guard, so that the scan commands can
+	// replace the ones it refuses
+	if limit := db.config.ProtoMaxReplyElements; limit > 0 && opts.count > limit {
+		opts.count = limit
+	}
+	return opts, nil
+}
+
+// matchPairs keeps the pairs of batch, alternating names and values, whose
+// name matches pattern, dropping the values if noValues is set
+func matchPairs(batch [][]byte, pattern string, noValues bool) [][]byte {
+	if pattern == "" && !noValues {
+		return batch
+	}
+	kept := batch[:0]
+	for i := 0; i+1 < len(batch); i += 2 {
+		if pattern != "" && !glob.Match(pattern, string(batch[i])) {
+			continue
+		}
+		kept = append(kept, batch[i])
+		if !noValues {
+			kept = append(kept, batch[i+1])
+		}
+	}
+	return kept
+}
+
+// execScan returns a batch of the keyspace, leaving out the keys already
+// expired but not yet removed
+func execScan(db *DB, args [][]byte) (Result, error) {
+	if len(args) < 1 {
+		return nil, errWrongArgs("scan")
+	}
+	opts, err := db.parseScanArgs(args, "TYPE")
+	if err != nil {
+		return nil, err
+	}
+
+	var candidates [][]byte
+	cursor := db.data.Scan(opts.cursor, opts.count, func(key string, val interface{}) {
+		if opts.pattern != "" && !glob.Match(opts.pattern, key) {
+			return
+		}
+		if opts.typeName != "" {
+			entity, ok := val.(*datastruct.DataEntity)
+			if !ok || typeName(entity.Data) != opts.typeName {
+				return
+			}
+		}
+		candidates = append(candidates, []byte(key))
+	})
+
+	keys := make([][]byte, 0, len(candidates))
+	now := db.now()
+	for _, key := range candidates {
+		if val, ok := db.ttlMap.Get(string(key)); ok && !now.Before(val.(time.Time)) {
+			continue
+		}
+		keys = append(keys, key)
+	}
+	return ScanResult{Cursor: cursor, Elements: keys}, nil
+}
+
+// KeysByType returns the keys holding a value of type t, one of the names
+// TYPE replies with, from a snapshot of the database
+func (db *DB) KeysByType(t string) []string {
+	var keys []string
+	db.ForEach(func(key string, entity *datastruct.DataEntity, _ time.Time) bool {
+		if typeName(entity.Data) == t {
+			keys = append(keys, key)
+		}
+		return true
+	})
+	return keys
+}
+
+// CountKeys returns the number of keys of each type, as TYPE names them,
+// and the number of keys with a TTL, from a snapshot of the database
+func (db *DB) CountKeys() (types map[string]int, expires int) {
+	types = make(map[string]int)
+	db.ForEach(func(key string, entity *datastruct.DataEntity, expireAt time.Time) bool {
+		types[typeName(entity.Data)]++
+		if !expireAt.IsZero() {
+			expires++
+		}
+		return true
+	})
+	return types, expires
+}
+
+func execHScan(db *DB, args [][]byte) (Result, error) {
+	if len(args) < 2 {
+		return nil, errWrongArgs("hscan")
+	}
+	opts, err := db.parseScanArgs(args[1:], "NOVALUES")
+	if err != nil {
+		return nil, err
+	}
+
+	entity, ok := db.GetEntity(string(args[0]))
+	if !ok || entity.Data == nil {
+		return ScanResult{Elements: [][]byte{}}, nil
+	}
+	hash, ok := entity.Data.(*datastruct.Hash)
+	if !ok {
+		return nil, ErrWrongType
+	}
+
+	cursor, batch := hash.Scan(opts.cursor, opts.count)
+	return ScanResult{Cursor: cursor, Elements: matchPairs(batch, opts.pattern, opts.noValues)}, nil
+}
+
+func execSScan(db *DB, args [][]byte) (Result, error) {
+	if len(args) < 2 {
+		return nil, errWrongArgs("sscan")
+	}
+	opts, err := db.parseScanArgs(args[1:], "")
+	if err != nil {
+		return nil, err
+	}
+
+	entity, ok := db.GetEntity(string(args[0]))
+	if !ok || entity.Data == nil {
+		return ScanResult{Elements: [][]byte{}}, nil
+	}
+	set, ok := entity.Data.(*datastruct.Set)
+	if !ok {
+		return nil, ErrWrongType
+	}
+
+	cursor, batch := set.Scan(opts.cursor, int64(opts.count))
+	if opts.pattern != "" {
+		kept := batch[:0]
+		for _, member := range batch {
+			if glob.Match(opts.pattern, string(member)) {
+				kept = append(kept, member)
+			}
+		}
+		batch = kept
+	}
+	return ScanResult{Cursor: cursor, Elements: batch}, nil
+}
+
+func execZScan(db *DB, args [][]byte) (Result, error) {
+	if len(args) < 2 {
+		return nil, errWrongArgs("zscan")
+	}
+	opts, err := db.parseScanArgs(args[1:], "")
+	if err != nil {
+		return nil, err
+	}
+
+	entity, ok := db.GetEntity(string(args[0]))
+	if !ok || entity.Data == nil {
+		return ScanResult{Elements: [][]byte{}}, nil
+	}
+	zset, ok := entity.Data.(*datastruct.SortedSet)
+	if !ok {
+		return nil, ErrWrongType
+	}
+
+	cursor, batch := zset.Scan(opts.cursor, int64(opts.count))
+	return ScanResult{Cursor: cursor, Elements: matchPairs(batch, opts.pattern, false)}, nil
+}
+
+// checkReplyElements refuses a reply of n elements (fields, members or list
+// items) above proto-max-reply-elements, advising alternative instead
+func (db *DB) checkReplyElements(n int, alternative string) error {
+	if limit := db.config.ProtoMaxReplyElements; limit > 0 && n > limit {
+		return fmt.Errorf("ERR reply of %d elements exceeds proto-max-reply-elements (%d), use %s instead", n, limit, alternative)
+	}
+	return nil
+}
+
+// rangeLen returns the number of elements of a range of indexes, which may
+// be negative as in LRANGE, over length elements
+func rangeLen(start, stop, length int) int {
+	start, stop, ok := datastruct.NormalizeRange(start, stop, length)
+	if !ok {
+		return 0
+	}
+	return stop - start + 1
+}
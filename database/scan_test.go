@@ -0,0 +1,299 @@
+package database_test
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/wangbo/gocache/config"
+	"github.com/wangbo/gocache/database"
+	"github.com/wangbo/gocache/replication"
+	"github.com/wangbo/gocache/util/clock"
+)
+
+// scanAll runs a scan command from cursor 0 to the end and returns the
+// elements of every batch
+func scanAll(t *testing.T, db *database.DB, args ...string) [][]byte {
+	t.Helper()
+	var elements [][]byte
+	cursor := "0"
+	for calls := 0; ; calls++ {
+		if calls > 10000 {
+			t.Fatalf("%s: scan did not end", strings.Join(args, " "))
+		}
+		line := append([]string{args[0], args[1], cursor}, args[2:]...)
+		result := exec(t, db, line...)
+		elements = append(elements, result[1:]...)
+		if cursor = string(result[0]); cursor == "0" {
+			return elements
+		}
+	}
+}
+
+// scanKeys runs SCAN from cursor 0 to the end and returns the keys of every
+// batch, once each, and the number of calls
+func scanKeys(t *testing.T, db *database.DB, args ...string) (map[string]bool, int) {
+	t.Helper()
+	keys := make(map[string]bool)
+	cursor := "0"
+	for calls := 1; ; calls++ {
+		if calls > 100000 {
+			t.Fatalf("SCAN %s: scan did not end", strings.Join(args, " "))
+		}
+		result := exec(t, db, append([]string{"SCAN", cursor}, args...)...)
+		for _, key := range result[1:] {
+			keys[string(key)] = true
+		}
+		if cursor = string(result[0]); cursor == "0" {
+			return keys, calls
+		}
+	}
+}
+
+// populateTypes stores n keys named "type:i" of each type
+func populateTypes(t *testing.T, db *database.DB, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		id := strconv.Itoa(i)
+		exec(t, db, "SET", "string:"+id, id)
+		exec(t, db, "HSET", "hash:"+id, "f", id)
+		exec(t, db, "RPUSH", "list:"+id, id)
+		exec(t, db, "SADD", "set:"+id, id)
+		exec(t, db, "ZADD", "zset:"+id, id, id)
+	}
+}
+
+func TestScanTypeFilter(t *testing.T) {
+	db := database.MakeDB()
+	defer db.Close()
+	mc := clock.NewManual(time.Now())
+	db.SetClock(mc)
+	populateTypes(t, db, 200)
+	exec(t, db, "SET", "expired", "x", "PX", "10")
+	exec(t, db, "SADD", "expired-set", "x")
+	exec(t, db, "PEXPIRE", "expired-set", "10")
+	mc.Advance(10 * time.Millisecond)
+
+	all, _ := scanKeys(t, db, "COUNT", "50")
+	if len(all) != 1000 {
+		t.Errorf("SCAN: expected the 1000 live keys, got %d", len(all))
+	}
+	for _, typ := range []string{"string", "hash", "list", "set", "zset"} {
+		keys, _ := scanKeys(t, db, "COUNT", "7", "TYPE", strings.ToUpper(typ))
+		if len(keys) != 200 {
+			t.Errorf("SCAN TYPE %s: expected 200 keys, got %d", typ, len(keys))
+		}
+		for key := range keys {
+			if !strings.HasPrefix(key, typ+":") {
+				t.Errorf("SCAN TYPE %s: unexpected key %q", typ, key)
+			}
+		}
+		if got := db.KeysByType(typ); len(got) != 200 {
+			t.Errorf("KeysByType(%s): expected 200 keys, got %d", typ, len(got))
+		}
+	}
+
+	keys, _ := scanKeys(t, db, "MATCH", "*:1?", "TYPE", "hash")
+	if len(keys) != 10 || !keys["hash:10"] || !keys["hash:19"] {
+		t.Errorf("SCAN MATCH TYPE: expected hash:10 to hash:19, got %v", keys)
+	}
+	if got := db.KeysByType("stream"); len(got) != 0 {
+		t.Errorf("KeysByType(stream): expected none, got %v", got)
+	}
+}
+
+// TestScanCountBoundsKeysExamined checks that a TYPE matching few keys does
+// not make a call examine more of them than COUNT
+func TestScanCountBoundsKeysExamined(t *testing.T) {
+	db := database.MakeDB()
+	defer db.Close()
+	for i := 0; i < 1000; i++ {
+		exec(t, db, "SET", "k"+strconv.Itoa(i), "v")
+	}
+	exec(t, db, "SADD", "only", "m")
+
+	keys, calls := scanKeys(t, db, "COUNT", "10", "TYPE", "set")
+	if len(keys) != 1 || !keys["only"] {
+		t.Errorf("Expected only the set, got %v", keys)
+	}
+	if calls < 100 {
+		t.Errorf("Expected at least 100 calls of COUNT 10 over 1001 keys, got %d", calls)
+	}
+}
+
+func TestScanTypeFilterUnderConcurrentWrites(t *testing.T) {
+	db := database.MakeDB()
+	defer db.Close()
+	populateTypes(t, db, 500)
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				id := strconv.Itoa(w) + "-" + strconv.Itoa(i)
+				db.Exec([][]byte{[]byte("SET"), []byte("new-string:" + id), []byte("v")})
+				db.Exec([][]byte{[]byte("HSET"), []byte("new-hash:" + id), []byte("f"), []byte("v")})
+				db.Exec([][]byte{[]byte("DEL"), []byte("list:" + strconv.Itoa(i%500))})
+				db.Exec([][]byte{[]byte("RPUSH"), []byte("list:" + strconv.Itoa(i%500)), []byte("v")})
+			}
+		}(w)
+	}
+
+	keys, _ := scanKeys(t, db, "COUNT", "20", "TYPE", "set")
+	close(stop)
+	wg.Wait()
+
+	if len(keys) != 500 {
+		t.Errorf("Expected the 500 sets, got %d keys", len(keys))
+	}
+	for key := range keys {
+		if !strings.HasPrefix(key, "set:") {
+			t.Errorf("Unexpected key %q", key)
+		}
+	}
+}
+
+func TestScanCommandsReturnEveryElement(t *testing.T) {
+	db := database.MakeDB()
+	defer db.Close()
+
+	for i := 0; i < 500; i++ {
+		n := strconv.Itoa(i)
+		exec(t, db, "HSET", "hash", "f"+n, "v"+n)
+		exec(t, db, "SADD", "set", "m"+n)
+		exec(t, db, "ZADD", "zset", n, "m"+n)
+	}
+
+	pairs := scanAll(t, db, "HSCAN", "hash", "COUNT", "37")
+	fields := make(map[string]string)
+	for i := 0; i+1 < len(pairs); i += 2 {
+		fields[string(pairs[i])] = string(pairs[i+1])
+	}
+	if len(fields) != 500 || fields["f42"] != "v42" {
+		t.Errorf("HSCAN: expected 500 fields with f42=v42, got %d and %q", len(fields), fields["f42"])
+	}
+
+	if members := scanAll(t, db, "SSCAN", "set", "COUNT", "1000"); len(members) != 500 {
+		t.Errorf("SSCAN: expected 500 members, got %d", len(members))
+	}
+
+	pairs = scanAll(t, db, "ZSCAN", "zset", "MATCH", "m4?", "COUNT", "20")
+	scores := make(map[string]string)
+	for i := 0; i+1 < len(pairs); i += 2 {
+		scores[string(pairs[i])] = string(pairs[i+1])
+	}
+	if len(scores) != 10 || scores["m45"] != "45" {
+		t.Errorf("ZSCAN MATCH: expected m40..m49 with m45=45, got %v", scores)
+	}
+
+	names := scanAll(t, db, "HSCAN", "hash", "MATCH", "f1*", "NOVALUES")
+	if len(names) != 111 {
+		t.Errorf("HSCAN NOVALUES: expected 111 fields, got %d", len(names))
+	}
+	for _, name := range names {
+		if !strings.HasPrefix(string(name), "f1") {
+			t.Errorf("HSCAN NOVALUES: unexpected element %q", name)
+		}
+	}
+
+	if result := exec(t, db, "SSCAN", "missing", "0"); len(result) != 1 || string(result[0]) != "0" {
+		t.Errorf("SSCAN of a missing key: expected cursor 0 alone, got %q", result)
+	}
+}
+
+func TestScanCommandErrors(t *testing.T) {
+	db := database.MakeDB()
+	defer db.Close()
+	exec(t, db, "SET", "str", "x")
+	exec(t, db, "SADD", "set", "a")
+
+	for _, tc := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"HSCAN", "str", "0"}, "WRONGTYPE"},
+		{[]string{"SSCAN", "set", "-1"}, "ERR invalid cursor"},
+		{[]string{"SSCAN", "set", "abc"}, "ERR invalid cursor"},
+		{[]string{"SSCAN", "set", "0", "COUNT", "0"}, "ERR syntax error"},
+		{[]string{"SSCAN", "set", "0", "COUNT", "x"}, "ERR value is not an integer"},
+		{[]string{"SSCAN", "set", "0", "NOVALUES"}, "ERR syntax error"},
+		{[]string{"ZSCAN", "set", "0", "MATCH"}, "ERR syntax error"},
+		{[]string{"HSCAN", "hash"}, "wrong number of arguments"},
+		{[]string{"SCAN"}, "wrong number of arguments"},
+		{[]string{"SCAN", "0", "TYPE", "blob"}, "ERR unknown type name 'blob'"},
+		{[]string{"SCAN", "0", "NOVALUES"}, "ERR syntax error"},
+		{[]string{"SSCAN", "set", "0", "TYPE", "set"}, "ERR syntax error"},
+	} {
+		cmdLine := make([][]byte, len(tc.args))
+		for i, arg := range tc.args {
+			cmdLine[i] = []byte(arg)
+		}
+		_, err := db.Exec(cmdLine)
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s: expected %q, got %v", strings.Join(tc.args, " "), tc.want, err)
+		}
+	}
+}
+
+func TestProtoMaxReplyElements(t *testing.T) {
+	cfg := config.Default()
+	cfg.ProtoMaxReplyElements = 100
+	db := database.MakeDBWithConfig(cfg, replication.NewReplicationState())
+	defer db.Close()
+
+	for i := 0; i < 150; i++ {
+		n := strconv.Itoa(i)
+		exec(t, db, "HSET", "hash", "f"+n, n)
+		exec(t, db, "SADD", "set", n)
+		exec(t, db, "RPUSH", "list", n)
+		exec(t, db, "ZADD", "zset", n, n)
+	}
+	exec(t, db, "HSET", "small", "f", "v")
+
+	for _, tc := range []struct {
+		args []string
+		want string // "" if allowed
+	}{
+		{[]string{"HGETALL", "hash"}, "use HSCAN"},
+		{[]string{"HKEYS", "hash"}, "use HSCAN"},
+		{[]string{"SMEMBERS", "set"}, "use SSCAN"},
+		{[]string{"LRANGE", "list", "0", "-1"}, "use LRANGE with a smaller range"},
+		{[]string{"ZRANGE", "zset", "0", "-1", "WITHSCORES"}, "use ZSCAN"},
+		{[]string{"ZREVRANGE", "zset", "0", "100"}, "use ZSCAN"},
+		{[]string{"HGETALL", "small"}, ""},
+		{[]string{"LRANGE", "list", "0", "99"}, ""},
+		{[]string{"LRANGE", "list", "-100", "-1"}, ""},
+		{[]string{"ZRANGE", "zset", "50", "1000"}, ""},
+	} {
+		cmdLine := make([][]byte, len(tc.args))
+		for i, arg := range tc.args {
+			cmdLine[i] = []byte(arg)
+		}
+		_, err := db.Exec(cmdLine)
+		switch {
+		case tc.want == "" && err != nil:
+			t.Errorf("%s: expected no error, got %v", strings.Join(tc.args, " "), err)
+		case tc.want != "" && (err == nil || !strings.Contains(err.Error(), tc.want)):
+			t.Errorf("%s: expected an error advising %q, got %v", strings.Join(tc.args, " "), tc.want, err)
+		}
+	}
+
+	// A COUNT above the limit is lowered to it, and the scan still ends
+	result := exec(t, db, "HSCAN", "hash", "0", "COUNT", "1000")
+	if len(result)-1 > 2*100 {
+		t.Errorf("Expected at most 100 fields in a batch, got %d", (len(result)-1)/2)
+	}
+	if pairs := scanAll(t, db, "HSCAN", "hash", "COUNT", "1000"); len(pairs) != 300 {
+		t.Errorf("Expected 150 fields from HSCAN, got %d", len(pairs)/2)
+	}
+}
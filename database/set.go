@@ -11,31 +11,34 @@ import (
 
 func execSAdd(db *DB, args [][]byte) ([][]byte, error) {
 	if len(args) < 2 {
-		return nil, errors.New("wrong number of arguments for SADD")
+		return nil, errWrongArgs("sadd")
 	}
 
 	key := string(args[0])
 	members := args[1:]
 
 	entity, ok := db.GetEntity(key)
-	if !ok || entity.Data == nil {
+	created := !ok || entity.Data == nil
+	if created {
 		entity = datastruct.MakeSet()
 	}
 
 	set, ok := entity.Data.(*datastruct.Set)
 	if !ok {
-		return nil, errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
+		return nil, ErrWrongType
 	}
 
 	added := set.Add(members...)
-	db.PutEntity(key, entity)
+	if created {
+		db.PutEntity(key, entity)
+	}
 
 	return [][]byte{[]byte(strconv.FormatInt(int64(added), 10))}, nil
 }
 
 func execSRem(db *DB, args [][]byte) ([][]byte, error) {
 	if len(args) < 2 {
-		return nil, errors.New("wrong number of arguments for SREM")
+		return nil, errWrongArgs("srem")
 	}
 
 	key := string(args[0])
@@ -48,15 +51,13 @@ func execSRem(db *DB, args [][]byte) ([][]byte, error) {
 
 	set, ok := entity.Data.(*datastruct.Set)
 	if !ok {
-		return nil, errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
+		return nil, ErrWrongType
 	}
 
 	removed := set.Remove(members...)
 
 	if set.Len() == 0 {
 		db.Remove(key)
-	} else {
-		db.PutEntity(key, entity)
 	}
 
 	return [][]byte{[]byte(strconv.FormatInt(int64(removed), 10))}, nil
@@ -64,7 +65,7 @@ func execSRem(db *DB, args [][]byte) ([][]byte, error) {
 
 func execSIsMember(db *DB, args [][]byte) ([][]byte, error) {
 	if len(args) != 2 {
-		return nil, errors.New("wrong number of arguments for SISMEMBER")
+		return nil, errWrongArgs("sismember")
 	}
 
 	key := string(args[0])
@@ -77,7 +78,7 @@ func execSIsMember(db *DB, args [][]byte) ([][]byte, error) {
 
 	set, ok := entity.Data.(*datastruct.Set)
 	if !ok {
-		return nil, errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
+		return nil, ErrWrongType
 	}
 
 	if set.IsMember(member) {
@@ -88,7 +89,7 @@ func execSIsMember(db *DB, args [][]byte) ([][]byte, error) {
 
 func execSMembers(db *DB, args [][]byte) ([][]byte, error) {
 	if len(args) != 1 {
-		return nil, errors.New("wrong number of arguments for SMEMBERS")
+		return nil, errWrongArgs("smembers")
 	}
 
 	key := string(args[0])
@@ -100,7 +101,11 @@ func execSMembers(db *DB, args [][]byte) ([][]byte, error) {
 
 	set, ok := entity.Data.(*datastruct.Set)
 	if !ok {
-		return nil, errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
+		return nil, ErrWrongType
+	}
+
+	if err := db.checkReplyElements(set.Len(), "SSCAN"); err != nil {
+		return nil, err
 	}
 
 	members := set.Members()
@@ -114,7 +119,7 @@ func execSMembers(db *DB, args [][]byte) ([][]byte, error) {
 
 func execSCard(db *DB, args [][]byte) ([][]byte, error) {
 	if len(args) != 1 {
-		return nil, errors.New("wrong number of arguments for SCARD")
+		return nil, errWrongArgs("scard")
 	}
 
 	key := string(args[0])
@@ -126,78 +131,149 @@ func execSCard(db *DB, args [][]byte) ([][]byte, error) {
 
 	set, ok := entity.Data.(*datastruct.Set)
 	if !ok {
-		return nil, errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
+		return nil, ErrWrongType
 	}
 
 	return [][]byte{[]byte(strconv.FormatInt(int64(set.Len()), 10))}, nil
 }
 
+// parseSetCount parses the count argument of SPOP and SRANDMEMBER
+func parseSetCount(arg []byte) (int, error) {
+	count, err := strconv.Atoi(string(arg))
+	if err != nil {
+		return 0, ErrNotInteger
+	}
+	return count, nil
+}
+
+// execSPop implements SPOP key [count]. Without a count it returns the popped
+// member, or null; with a count it returns the popped members, which are
+// picked in O(count) whatever the size of the set.
 func execSPop(db *DB, args [][]byte) ([][]byte, error) {
-	if len(args) != 1 {
-		return nil, errors.New("wrong number of arguments for SPOP")
+	if len(args) != 1 && len(args) != 2 {
+		return nil, errWrongArgs("spop")
 	}
 
 	key := string(args[0])
+	count := -1
+	if len(args) == 2 {
+		n, err := parseSetCount(args[1])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, errors.New("ERR value is out of range, must be positive")
+		}
+		count = n
+	}
 
 	entity, ok := db.GetEntity(key)
 	if !ok || entity.Data == nil {
-		return [][]byte{nil}, nil
+		if count >= 0 {
+			return [][]byte{}, nil
+		}
+		return nullResult(), nil
 	}
 
 	set, ok := entity.Data.(*datastruct.Set)
 	if !ok {
-		return nil, errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
+		return nil, ErrWrongType
 	}
 
-	member := set.Pop()
-	if member == nil {
-		db.Remove(key)
-		return [][]byte{nil}, nil
+	var popped [][]byte
+	if count < 0 {
+		member := set.Pop()
+		if member == nil {
+			db.Remove(key)
+			return nullResult(), nil
+		}
+		popped = [][]byte{member}
+	} else {
+		popped = set.GetRandomMembers(count)
+		set.Remove(popped...)
 	}
 
 	if set.Len() == 0 {
 		db.Remove(key)
-	} else {
-		db.PutEntity(key, entity)
 	}
 
-	return [][]byte{member}, nil
+	return popped, nil
 }
 
+// execSRandMember implements SRANDMEMBER key [count]. A positive count returns
+// up to count distinct members; a negative one returns -count members that
+// may repeat.
 func execSRandMember(db *DB, args [][]byte) ([][]byte, error) {
-	if len(args) != 1 {
-		return nil, errors.New("wrong number of arguments for SRANDMEMBER")
+	if len(args) != 1 && len(args) != 2 {
+		return nil, errWrongArgs("srandmember")
 	}
 
 	key := string(args[0])
+	withCount := len(args) == 2
+	count := 0
+	if withCount {
+		n, err := parseSetCount(args[1])
+		if err != nil {
+			return nil, err
+		}
+		count = n
+	}
 
 	entity, ok := db.GetEntity(key)
 	if !ok || entity.Data == nil {
-		return [][]byte{nil}, nil
+		if withCount {
+			return [][]byte{}, nil
+		}
+		return nullResult(), nil
 	}
 
 	set, ok := entity.Data.(*datastruct.Set)
 	if !ok {
-		return nil, errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
+		return nil, ErrWrongType
 	}
 
-	member := set.GetRandom()
-	if member == nil {
-		return [][]byte{nil}, nil
+	if !withCount {
+		member := set.GetRandom()
+		if member == nil {
+			return nullResult(), nil
+		}
+		return [][]byte{member}, nil
+	}
+	if count >= 0 {
+		return set.GetRandomMembers(count), nil
 	}
 
-	return [][]byte{member}, nil
+	result := make([][]byte, 0, -count)
+	if set.Len() > 0 {
+		for i := 0; i < -count; i++ {
+			result = append(result, set.GetRandom())
+		}
+	}
+	return result, nil
+}
+
+// PoppedMembersCommand returns the command an SPOP that returned result is
+// propagated as: SREM of the members it popped, so that a slave or an AOF
+// load removes the same members. It returns nil if nothing was popped.
+func PoppedMembersCommand(cmdLine, result [][]byte) [][]byte {
+	if len(cmdLine) < 2 || len(result) == 0 || IsNullResult(result) {
+		return nil
+	}
+	srem := [][]byte{[]byte("SREM"), cmdLine[1]}
+	return append(srem, result...)
 }
 
 func execSMove(db *DB, args [][]byte) ([][]byte, error) {
 	if len(args) != 3 {
-		return nil, errors.New("wrong number of arguments for SMOVE")
+		return nil, errWrongArgs("smove")
 	}
 
 	srcKey := string(args[0])
 	dstKey := string(args[1])
 	member := args[2]
 
+	// Like in Redis, a missing source is not an error whatever the
+	// destination holds
 	srcEntity, ok := db.GetEntity(srcKey)
 	if !ok || srcEntity.Data == nil {
 		return [][]byte{[]byte("0")}, nil
@@ -205,17 +281,18 @@ func execSMove(db *DB, args [][]byte) ([][]byte, error) {
 
 	srcSet, ok := srcEntity.Data.(*datastruct.Set)
 	if !ok {
-		return nil, errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
+		return nil, ErrWrongType
 	}
 
 	dstEntity, ok := db.GetEntity(dstKey)
-	if !ok || dstEntity.Data == nil {
+	created := !ok || dstEntity.Data == nil
+	if created {
 		dstEntity = datastruct.MakeSet()
 	}
 
 	dstSet, ok := dstEntity.Data.(*datastruct.Set)
 	if !ok {
-		return nil, errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
+		return nil, ErrWrongType
 	}
 
 	moved := srcSet.Move(dstSet, member)
@@ -225,193 +302,146 @@ func execSMove(db *DB, args [][]byte) ([][]byte, error) {
 
 	if srcSet.Len() == 0 {
 		db.Remove(srcKey)
-	} else {
-		db.PutEntity(srcKey, srcEntity)
 	}
 
-	db.PutEntity(dstKey, dstEntity)
+	if created {
+		db.PutEntity(dstKey, dstEntity)
+	}
 
 	return [][]byte{[]byte("1")}, nil
 }
 
-func execSDiff(db *DB, args [][]byte) ([][]byte, error) {
-	if len(args) < 1 {
-		return nil, errors.New("wrong number of arguments for SDIFF")
+// sourceSets looks up the sets named by keys, with nil for missing keys.
+// Every key is type-checked before any result is computed, so a WRONGTYPE
+// error is reported whatever its position: type errors take precedence over
+// the empty results of missing keys, like in Redis.
+func sourceSets(db *DB, keys [][]byte) ([]*datastruct.Set, error) {
+	sets := make([]*datastruct.Set, len(keys))
+	for i, key := range keys {
+		entity, ok := db.GetEntity(string(key))
+		if !ok || entity.Data == nil {
+			continue
+		}
+		set, ok := entity.Data.(*datastruct.Set)
+		if !ok {
+			return nil, ErrWrongType
+		}
+		sets[i] = set
 	}
+	return sets, nil
+}
 
-	keys := make([]string, len(args))
-	for i, arg := range args {
-		keys[i] = string(arg)
+// diffSets returns the members of the first set that are in none of the others
+func diffSets(sets []*datastruct.Set) [][]byte {
+	if sets[0] == nil {
+		return [][]byte{}
 	}
-
-	entity, ok := db.GetEntity(keys[0])
-	if !ok || entity.Data == nil {
-		return [][]byte{}, nil
+	others := make([]*datastruct.Set, 0, len(sets)-1)
+	for _, set := range sets[1:] {
+		if set != nil {
+			others = append(others, set)
+		}
 	}
+	return sets[0].Diff(others)
+}
 
-	set, ok := entity.Data.(*datastruct.Set)
-	if !ok {
-		return nil, errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
-	}
-
-	others := make([]*datastruct.Set, 0, len(keys)-1)
-	for _, key := range keys[1:] {
-		entity, ok := db.GetEntity(key)
-		if ok && entity.Data != nil {
-			otherSet, ok := entity.Data.(*datastruct.Set)
-			if !ok {
-				return nil, errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
-			}
-			others = append(others, otherSet)
+// interSets returns the members common to all sets; a missing set is empty
+func interSets(sets []*datastruct.Set) [][]byte {
+	for _, set := range sets {
+		if set == nil {
+			return [][]byte{}
 		}
 	}
-
-	result := set.Diff(others)
-	return result, nil
+	if len(sets) == 1 {
+		return sets[0].Members()
+	}
+	return sets[0].Intersect(sets[1:])
 }
 
-func execSDiffStore(db *DB, args [][]byte) ([][]byte, error) {
-	if len(args) < 2 {
-		return nil, errors.New("wrong number of arguments for SDIFFSTORE")
+// unionSets returns the members of any of the sets
+func unionSets(sets []*datastruct.Set) [][]byte {
+	present := make([]*datastruct.Set, 0, len(sets))
+	for _, set := range sets {
+		if set != nil {
+			present = append(present, set)
+		}
 	}
+	if len(present) == 0 {
+		return [][]byte{}
+	}
+	return present[0].Union(present[1:])
+}
 
-	dstKey := string(args[0])
-	srcKeys := args[1:]
+// setOperation runs a set operation over the sets named by keys
+func setOperation(db *DB, keys [][]byte, op func([]*datastruct.Set) [][]byte) ([][]byte, error) {
+	sets, err := sourceSets(db, keys)
+	if err != nil {
+		return nil, err
+	}
+	return op(sets), nil
+}
 
-	diff, err := execSDiff(db, srcKeys)
+// storeSetOperation runs a set operation and stores its result in dstKey,
+// replacing whatever the key held. An empty result deletes dstKey, like in
+// Redis. It returns the number of members stored.
+func storeSetOperation(db *DB, dstKey string, keys [][]byte, op func([]*datastruct.Set) [][]byte) ([][]byte, error) {
+	members, err := setOperation(db, keys, op)
 	if err != nil {
 		return nil, err
 	}
 
+	// Removing first drops the TTL and memory accounting of the old value
+	db.Remove(dstKey)
+	if len(members) == 0 {
+		return zeroResponse, nil
+	}
+
 	dstEntity := datastruct.MakeSet()
 	dstSet, _ := dstEntity.Data.(*datastruct.Set)
-	dstSet.Add(diff...)
-
+	dstSet.Add(members...)
 	db.PutEntity(dstKey, dstEntity)
 
-	return [][]byte{[]byte(strconv.FormatInt(int64(len(diff)), 10))}, nil
+	return [][]byte{[]byte(strconv.Itoa(dstSet.Len()))}, nil
 }
 
-func execSInter(db *DB, args [][]byte) ([][]byte, error) {
+func execSDiff(db *DB, args [][]byte) ([][]byte, error) {
 	if len(args) < 1 {
-		return nil, errors.New("wrong number of arguments for SINTER")
-	}
-
-	keys := make([]string, len(args))
-	for i, arg := range args {
-		keys[i] = string(arg)
-	}
-
-	entity, ok := db.GetEntity(keys[0])
-	if !ok || entity.Data == nil {
-		return [][]byte{}, nil
-	}
-
-	set, ok := entity.Data.(*datastruct.Set)
-	if !ok {
-		return nil, errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
+		return nil, errWrongArgs("sdiff")
 	}
+	return setOperation(db, args, diffSets)
+}
 
-	if len(keys) == 1 {
-		return set.Members(), nil
+func execSDiffStore(db *DB, args [][]byte) ([][]byte, error) {
+	if len(args) < 2 {
+		return nil, errWrongArgs("sdiffstore")
 	}
+	return storeSetOperation(db, string(args[0]), args[1:], diffSets)
+}
 
-	others := make([]*datastruct.Set, 0, len(keys)-1)
-	for _, key := range keys[1:] {
-		entity, ok := db.GetEntity(key)
-		if !ok || entity.Data == nil {
-			return [][]byte{}, nil
-		}
-		otherSet, ok := entity.Data.(*datastruct.Set)
-		if !ok {
-			return nil, errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
-		}
-		others = append(others, otherSet)
+func execSInter(db *DB, args [][]byte) ([][]byte, error) {
+	if len(args) < 1 {
+		return nil, errWrongArgs("sinter")
 	}
-
-	result := set.Intersect(others)
-	return result, nil
+	return setOperation(db, args, interSets)
 }
 
 func execSInterStore(db *DB, args [][]byte) ([][]byte, error) {
 	if len(args) < 2 {
-		return nil, errors.New("wrong number of arguments for SINTERSTORE")
-	}
-
-	dstKey := string(args[0])
-	srcKeys := args[1:]
-
-	intersection, err := execSInter(db, srcKeys)
-	if err != nil {
-		return nil, err
+		return nil, errWrongArgs("sinterstore")
 	}
-
-	dstEntity := datastruct.MakeSet()
-	dstSet, _ := dstEntity.Data.(*datastruct.Set)
-	dstSet.Add(intersection...)
-
-	db.PutEntity(dstKey, dstEntity)
-
-	return [][]byte{[]byte(strconv.FormatInt(int64(len(intersection)), 10))}, nil
+	return storeSetOperation(db, string(args[0]), args[1:], interSets)
 }
 
 func execSUnion(db *DB, args [][]byte) ([][]byte, error) {
 	if len(args) < 1 {
-		return nil, errors.New("wrong number of arguments for SUNION")
-	}
-
-	keys := make([]string, len(args))
-	for i, arg := range args {
-		keys[i] = string(arg)
-	}
-
-	entity, ok := db.GetEntity(keys[0])
-	if !ok || entity.Data == nil {
-		if len(keys) == 1 {
-			return [][]byte{}, nil
-		}
-		entity = datastruct.MakeSet()
-	}
-
-	set, ok := entity.Data.(*datastruct.Set)
-	if !ok {
-		return nil, errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
-	}
-
-	others := make([]*datastruct.Set, 0, len(keys)-1)
-	for _, key := range keys[1:] {
-		entity, ok := db.GetEntity(key)
-		if ok && entity.Data != nil {
-			otherSet, ok := entity.Data.(*datastruct.Set)
-			if !ok {
-				return nil, errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
-			}
-			others = append(others, otherSet)
-		}
+		return nil, errWrongArgs("sunion")
 	}
-
-	result := set.Union(others)
-	return result, nil
+	return setOperation(db, args, unionSets)
 }
 
 func execSUnionStore(db *DB, args [][]byte) ([][]byte, error) {
 	if len(args) < 2 {
-		return nil, errors.New("wrong number of arguments for SUNIONSTORE")
-	}
-
-	dstKey := string(args[0])
-	srcKeys := args[1:]
-
-	union, err := execSUnion(db, srcKeys)
-	if err != nil {
-		return nil, err
+		return nil, errWrongArgs("sunionstore")
 	}
-
-	dstEntity := datastruct.MakeSet()
-	dstSet, _ := dstEntity.Data.(*datastruct.Set)
-	dstSet.Add(union...)
-
-	db.PutEntity(dstKey, dstEntity)
-
-	return [][]byte{[]byte(strconv.FormatInt(int64(len(union)), 10))}, nil
+	return storeSetOperation(db, string(args[0]), args[1:], unionSets)
 }
@@ -0,0 +1,172 @@
+package database
+
+import (
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Slow log
+//
+// The slow log keeps the latest commands whose execution took at least
+// slowlog-log-slower-than microseconds; -1 disables it and 0 logs every
+// command. It holds at most slowlog-max-len entries in a ring buffer, the
+// oldest being overwritten first. As in Redis, an entry keeps at most
+// slowLogMaxArgs arguments and slowLogMaxArgLen bytes of each, so that
+// commands with large values do not make the log itself large.
+
+const (
+	slowLogMaxArgs   = 32
+	slowLogMaxArgLen = 128
+)
+
+// SlowLogEntry represents a slow log entry
+type SlowLogEntry struct {
+	ID        int64
+	Timestamp time.Time
+	Duration  int64  // Execution time in microseconds
+	Command   []byte // The command that was executed, truncated
+}
+
+// slowLog holds the latest slow log entries
+type slowLog struct {
+	// Threshold in microseconds; negative disables the slow log
+	slowerThan atomic.Int64
+
+	mu      sync.Mutex
+	entries []*SlowLogEntry // Ring buffer of slowlog-max-len entries
+	next    int             // Index of the next entry to write
+	len     int
+	nextID  int64
+}
+
+// newSlowLog creates a slow log
+func newSlowLog(slowerThan, maxLen int) *slowLog {
+	l := &slowLog{entries: make([]*SlowLogEntry, maxLen)}
+	l.slowerThan.Store(int64(slowerThan))
+	return l
+}
+
+// SetSlowLogSlowerThan sets the execution time in microseconds from which
+// commands are logged; 0 logs every command and a negative value disables
+// the slow log
+func (db *DB) SetSlowLogSlowerThan(microseconds int64) {
+	db.slowLog.slowerThan.Store(microseconds)
+}
+
+// SlowLogSlowerThan returns the slow log threshold in microseconds
+func (db *DB) SlowLogSlowerThan() int64 {
+	return db.slowLog.slowerThan.Load()
+}
+
+// SetSlowLogMaxLen sets the number of entries the slow log keeps, dropping
+// the oldest ones beyond it
+func (db *DB) SetSlowLogMaxLen(maxLen int) {
+	l := db.slowLog
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	kept := l.newestFirst()
+	if len(kept) > maxLen {
+		kept = kept[:maxLen]
+	}
+	l.entries = make([]*SlowLogEntry, maxLen)
+	l.len = len(kept)
+	for i, entry := range kept {
+		l.entries[len(kept)-1-i] = entry
+	}
+	l.next = 0
+	if maxLen > 0 {
+		l.next = len(kept) % maxLen
+	}
+}
+
+// SlowLogMaxLen returns the number of entries the slow log keeps
+func (db *DB) SlowLogMaxLen() int {
+	db.slowLog.mu.Lock()
+	defer db.slowLog.mu.Unlock()
+	return len(db.slowLog.entries)
+}
+
+// AddSlowLogEntry logs a command if its execution took at least
+// slowlog-log-slower-than
+func (db *DB) AddSlowLogEntry(duration time.Duration, cmdLine [][]byte) {
+	l := db.slowLog
+	slowerThan := l.slowerThan.Load()
+	if slowerThan < 0 || duration.Microseconds() < slowerThan {
+		return
+	}
+	command := serializeCommand(truncateSlowLogArgs(cmdLine))
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.entries) == 0 {
+		return
+	}
+	l.entries[l.next] = &SlowLogEntry{
+		ID:        l.nextID,
+		Timestamp: db.now(),
+		Duration:  duration.Microseconds(),
+		Command:   command,
+	}
+	l.nextID++
+	l.next = (l.next + 1) % len(l.entries)
+	l.len = min(l.len+1, len(l.entries))
+}
+
+// truncateSlowLogArgs returns the arguments of a command as the slow log
+// keeps them: past slowLogMaxArgs the last kept argument counts the others,
+// and arguments longer than slowLogMaxArgLen count their remaining bytes
+func truncateSlowLogArgs(cmdLine [][]byte) [][]byte {
+	n := min(len(cmdLine), slowLogMaxArgs)
+	args := make([][]byte, n)
+	for i := range args {
+		if i == slowLogMaxArgs-1 && len(cmdLine) > slowLogMaxArgs {
+			more := len(cmdLine) - slowLogMaxArgs + 1
+			args[i] = []byte("... (" + strconv.Itoa(more) + " more arguments)")
+			break
+		}
+		arg := cmdLine[i]
+		if len(arg) > slowLogMaxArgLen {
+			more := len(arg) - slowLogMaxArgLen
+			arg = append(arg[:slowLogMaxArgLen:slowLogMaxArgLen], "... ("+strconv.Itoa(more)+" more bytes)"...)
+		} else {
+			arg = append([]byte(nil), arg...)
+		}
+		args[i] = arg
+	}
+	return args
+}
+
+// newestFirst returns the entries from the most recent; l.mu must be held
+func (l *slowLog) newestFirst() []*SlowLogEntry {
+	result := make([]*SlowLogEntry, l.len)
+	for i := range result {
+		result[i] = l.entries[(l.next-1-i+2*len(l.entries))%len(l.entries)]
+	}
+	return result
+}
+
+// GetSlowLogEntries returns the slow log entries, the most recent first
+func (db *DB) GetSlowLogEntries() []*SlowLogEntry {
+	db.slowLog.mu.Lock()
+	defer db.slowLog.mu.Unlock()
+	return db.slowLog.newestFirst()
+}
+
+// GetSlowLogLen returns the number of slow log entries
+func (db *DB) GetSlowLogLen() int {
+	db.slowLog.mu.Lock()
+	defer db.slowLog.mu.Unlock()
+	return db.slowLog.len
+}
+
+// ResetSlowLog clears all slow log entries
+func (db *DB) ResetSlowLog() {
+	l := db.slowLog
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	clear(l.entries)
+	l.next = 0
+	l.len = 0
+}
@@ -0,0 +1,110 @@
+package database
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// slowLogCommands returns the commands of the slow log, the most recent
+// first
+func slowLogCommands(db *DB) []string {
+	var commands []string
+	for _, entry := range db.GetSlowLogEntries() {
+		commands = append(commands, string(entry.Command))
+	}
+	return commands
+}
+
+func TestSlowLogTruncatesArguments(t *testing.T) {
+	db := MakeDB()
+	defer db.Close()
+
+	cmdLine := [][]byte{[]byte("SET"), []byte("k"), []byte(strings.Repeat("v", 200))}
+	db.AddSlowLogEntry(time.Second, cmdLine)
+	want := "SET k \"" + strings.Repeat("v", 128) + "... (72 more bytes)\""
+	if got := slowLogCommands(db); len(got) != 1 || got[0] != want {
+		t.Errorf("Expected %q, got %q", want, got)
+	}
+	if string(cmdLine[2]) != strings.Repeat("v", 200) {
+		t.Error("Expected the command line to be left intact")
+	}
+
+	db.ResetSlowLog()
+	cmdLine = [][]byte{[]byte("DEL")}
+	for i := 0; i < 40; i++ {
+		cmdLine = append(cmdLine, []byte(strconv.Itoa(i)))
+	}
+	db.AddSlowLogEntry(time.Second, cmdLine)
+	got := slowLogCommands(db)
+	if len(got) != 1 {
+		t.Fatalf("Expected 1 entry, got %d", len(got))
+	}
+	args := strings.SplitN(got[0], " ", 32)
+	if args[30] != "29" || args[31] != "\"... (10 more arguments)\"" {
+		t.Errorf("Expected 31 arguments and a marker, got %q", got[0])
+	}
+}
+
+func TestSlowLogRingBuffer(t *testing.T) {
+	db := MakeDB()
+	defer db.Close()
+	db.SetSlowLogMaxLen(3)
+
+	for i := 0; i < 5; i++ {
+		db.AddSlowLogEntry(time.Second, [][]byte{[]byte("CMD" + strconv.Itoa(i))})
+	}
+	if got := strings.Join(slowLogCommands(db), " "); got != "CMD4 CMD3 CMD2" {
+		t.Errorf("Expected the 3 latest entries, got %s", got)
+	}
+	if entries := db.GetSlowLogEntries(); entries[0].ID != 4 || entries[2].ID != 2 {
+		t.Errorf("Expected IDs 4 to 2, got %d to %d", entries[0].ID, entries[2].ID)
+	}
+
+	// Shrinking keeps the latest entries, growing keeps them all
+	db.SetSlowLogMaxLen(2)
+	if got := strings.Join(slowLogCommands(db), " "); got != "CMD4 CMD3" {
+		t.Errorf("Expected the 2 latest entries, got %s", got)
+	}
+	db.SetSlowLogMaxLen(4)
+	for i := 5; i < 8; i++ {
+		db.AddSlowLogEntry(time.Second, [][]byte{[]byte("CMD" + strconv.Itoa(i))})
+	}
+	if got := strings.Join(slowLogCommands(db), " "); got != "CMD7 CMD6 CMD5 CMD4" {
+		t.Errorf("Expected the 4 latest entries, got %s", got)
+	}
+	if db.GetSlowLogLen() != 4 || db.SlowLogMaxLen() != 4 {
+		t.Errorf("Expected 4 of 4 entries, got %d of %d", db.GetSlowLogLen(), db.SlowLogMaxLen())
+	}
+
+	db.SetSlowLogMaxLen(0)
+	db.AddSlowLogEntry(time.Second, [][]byte{[]byte("CMD")})
+	if db.GetSlowLogLen() != 0 {
+		t.Errorf("Expected slowlog-max-len 0 to keep nothing, got %d entries", db.GetSlowLogLen())
+	}
+}
+
+func TestSlowLogThreshold(t *testing.T) {
+	db := MakeDB()
+	defer db.Close()
+
+	db.SetSlowLogSlowerThan(-1)
+	db.AddSlowLogEntry(time.Hour, [][]byte{[]byte("SLOW")})
+	if n := db.GetSlowLogLen(); n != 0 {
+		t.Errorf("Expected a threshold of -1 to record nothing, got %d entries", n)
+	}
+
+	db.SetSlowLogSlowerThan(0)
+	db.AddSlowLogEntry(0, [][]byte{[]byte("FAST")})
+	if n := db.GetSlowLogLen(); n != 1 {
+		t.Errorf("Expected a threshold of 0 to record everything, got %d entries", n)
+	}
+
+	db.SetSlowLogSlowerThan(500)
+	db.AddSlowLogEntry(499*time.Microsecond, [][]byte{[]byte("FAST")})
+	db.AddSlowLogEntry(500*time.Microsecond, [][]byte{[]byte("SLOW")})
+	if got := strings.Join(slowLogCommands(db), " "); got != "SLOW FAST" {
+		t.Errorf("Expected the command at the threshold to be logged, got %s", got)
+	}
+}
@@ -11,40 +11,140 @@ import (
 
 // SortedSet command implementations
 
-func execZAdd(db *DB, args [][]byte) ([][]byte, error) {
-	if len(args) < 3 || len(args)%2 != 1 {
-		return nil, errors.New("wrong number of arguments for ZADD")
+// zaddOptions holds the options of ZADD before the scores
+type zaddOptions struct {
+	nx, xx, gt, lt, ch, incr bool
+}
+
+// parseZAddOptions parses the options of ZADD, returning them and the index
+// of the first score in args
+func parseZAddOptions(args [][]byte) (zaddOptions, int) {
+	var opts zaddOptions
+	i := 1
+	for ; i < len(args); i++ {
+		switch strings.ToUpper(string(args[i])) {
+		case "NX":
+			opts.nx = true
+		case "XX":
+			opts.xx = true
+		case "GT":
+			opts.gt = true
+		case "LT":
+			opts.lt = true
+		case "CH":
+			opts.ch = true
+		case "INCR":
+			opts.incr = true
+		default:
+			return opts, i
+		}
+	}
+	return opts, i
+}
+
+// execZAdd implements
+//
+//	ZADD key [NX|XX] [GT|LT] [CH] [INCR] score member [score member ...]
+//
+// NX only adds new members and XX only updates existing ones; GT and LT only
+// update a member whose new score is greater, or less, than its current one,
+// and never prevent adding. It returns the number of members added, or with
+// CH the number added or whose score changed. With INCR it is ZINCRBY of a
+// single member, returning the new score, or nil if an option prevented it.
+func execZAdd(db *DB, args [][]byte) (Result, error) {
+	if len(args) < 3 {
+		return nil, errWrongArgs("zadd")
 	}
 
 	key := string(args[0])
+	opts, first := parseZAddOptions(args)
+	elements := args[first:]
+	if len(elements) == 0 || len(elements)%2 != 0 {
+		return nil, ErrSyntax
+	}
+	if opts.nx && opts.xx {
+		return nil, errors.New("ERR XX and NX options at the same time are not compatible")
+	}
+	if (opts.gt && opts.nx) || (opts.lt && opts.nx) || (opts.gt && opts.lt) {
+		return nil, errors.New("ERR GT, LT, and/or NX options at the same time are not compatible")
+	}
+	if opts.incr && len(elements) > 2 {
+		return nil, errors.New("ERR INCR option supports a single increment-element pair")
+	}
+
+	// Parse every score first, so that an invalid one changes nothing
+	scores := make([]float64, len(elements)/2)
+	for i := range scores {
+		score, err := strconv.ParseFloat(string(elements[2*i]), 64)
+		if err != nil || math.IsNaN(score) {
+			return nil, ErrNotFloat
+		}
+		scores[i] = score
+	}
 
 	entity, ok := db.GetEntity(key)
-	if !ok || entity.Data == nil {
+	created := !ok || entity.Data == nil
+	if created {
 		entity = datastruct.MakeSortedSet()
 	}
 
 	zset, ok := entity.Data.(*datastruct.SortedSet)
 	if !ok {
-		return nil, errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
-	}
-
-	added := 0
-	for i := 1; i < len(args); i += 2 {
-		score, err := strconv.ParseFloat(string(args[i]), 64)
-		if err != nil {
-			return nil, errors.New("ERR value is not a valid float")
+		return nil, ErrWrongType
+	}
+
+	added, updated := 0, 0
+	var incremented float64
+	for i, score := range scores {
+		member := elements[2*i+1]
+		current := zset.Score(member)
+		exists := !math.IsNaN(current)
+		if opts.incr && exists {
+			score += current
+			if math.IsNaN(score) {
+				return nil, errors.New("ERR resulting score is not a number (NaN)")
+			}
+		}
+		incremented = score
+
+		refused := opts.xx && !exists
+		wasAdded, wasUpdated := zset.AddIf(score, member, !opts.xx, func(current float64) bool {
+			switch {
+			case opts.nx:
+				refused = true
+			case opts.gt:
+				refused = !(score > current)
+			case opts.lt:
+				refused = !(score < current)
+			}
+			return !refused
+		})
+		if opts.incr && refused {
+			return NilResult{}, nil
+		}
+		if wasAdded {
+			added++
+		}
+		if wasUpdated {
+			updated++
 		}
-		member := args[i+1]
-		added += zset.Add(score, member)
 	}
 
-	db.PutEntity(key, entity)
-	return [][]byte{[]byte(strconv.FormatInt(int64(added), 10))}, nil
+	if created && zset.Len() > 0 {
+		db.PutEntity(key, entity)
+	}
+	if opts.incr {
+		return BulkResult(datastruct.FormatScore(incremented)), nil
+	}
+	if opts.ch {
+		return IntResult(added + updated), nil
+	}
+	return IntResult(added), nil
 }
 
 func execZRem(db *DB, args [][]byte) ([][]byte, error) {
 	if len(args) < 2 {
-		return nil, errors.New("wrong number of arguments for ZREM")
+		return nil, errWrongArgs("zrem")
 	}
 
 	key := string(args[0])
@@ -57,15 +157,13 @@ func execZRem(db *DB, args [][]byte) ([][]byte, error) {
 
 	zset, ok := entity.Data.(*datastruct.SortedSet)
 	if !ok {
-		return nil, errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
+		return nil, ErrWrongType
 	}
 
 	removed := zset.Remove(members...)
 
 	if zset.Len() == 0 {
 		db.Remove(key)
-	} else {
-		db.PutEntity(key, entity)
 	}
 
 	return [][]byte{[]byte(strconv.FormatInt(int64(removed), 10))}, nil
@@ -73,7 +171,7 @@ func execZRem(db *DB, args [][]byte) ([][]byte, error) {
 
 func execZScore(db *DB, args [][]byte) ([][]byte, error) {
 	if len(args) != 2 {
-		return nil, errors.New("wrong number of arguments for ZSCORE")
+		return nil, errWrongArgs("zscore")
 	}
 
 	key := string(args[0])
@@ -81,53 +179,89 @@ func execZScore(db *DB, args [][]byte) ([][]byte, error) {
 
 	entity, ok := db.GetEntity(key)
 	if !ok || entity.Data == nil {
-		return [][]byte{nil}, nil
+		return nullResult(), nil
 	}
 
 	zset, ok := entity.Data.(*datastruct.SortedSet)
 	if !ok {
-		return nil, errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
+		return nil, ErrWrongType
 	}
 
 	score := zset.Score(member)
 	if math.IsNaN(score) {
-		return [][]byte{nil}, nil
+		return nullResult(), nil
+	}
+
+	return [][]byte{[]byte(datastruct.FormatScore(score))}, nil
+}
+
+// execZMScore implements ZMSCORE key member [member ...], replying with the
+// score of every member, nil for the missing ones
+func execZMScore(db *DB, args [][]byte) ([][]byte, error) {
+	if len(args) < 2 {
+		return nil, errWrongArgs("zmscore")
+	}
+
+	key := string(args[0])
+	members := args[1:]
+
+	// Missing members are left nil
+	result := make([][]byte, len(members))
+	entity, ok := db.GetEntity(key)
+	if !ok || entity.Data == nil {
+		return result, nil
 	}
 
-	return [][]byte{[]byte(strconv.FormatFloat(score, 'f', -1, 64))}, nil
+	zset, ok := entity.Data.(*datastruct.SortedSet)
+	if !ok {
+		return nil, ErrWrongType
+	}
+
+	for i, member := range members {
+		if score := zset.Score(member); !math.IsNaN(score) {
+			result[i] = []byte(datastruct.FormatScore(score))
+		}
+	}
+	return result, nil
 }
 
 func execZIncrBy(db *DB, args [][]byte) ([][]byte, error) {
 	if len(args) != 3 {
-		return nil, errors.New("wrong number of arguments for ZINCRBY")
+		return nil, errWrongArgs("zincrby")
 	}
 
 	key := string(args[0])
 	increment, err := strconv.ParseFloat(string(args[1]), 64)
-	if err != nil {
-		return nil, errors.New("ERR value is not a valid float")
+	if err != nil || math.IsNaN(increment) {
+		return nil, ErrNotFloat
 	}
 	member := args[2]
 
 	entity, ok := db.GetEntity(key)
-	if !ok || entity.Data == nil {
+	created := !ok || entity.Data == nil
+	if created {
 		entity = datastruct.MakeSortedSet()
 	}
 
 	zset, ok := entity.Data.(*datastruct.SortedSet)
 	if !ok {
-		return nil, errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
+		return nil, ErrWrongType
 	}
 
 	newScore := zset.IncrBy(increment, member)
-	db.PutEntity(key, entity)
+	if math.IsNaN(newScore) {
+		return nil, errors.New("ERR resulting score is not a number (NaN)")
+	}
+	if created {
+		db.PutEntity(key, entity)
+	}
 
-	return [][]byte{[]byte(strconv.FormatFloat(newScore, 'f', -1, 64))}, nil
+	return [][]byte{[]byte(datastruct.FormatScore(newScore))}, nil
 }
 
 func execZCard(db *DB, args [][]byte) ([][]byte, error) {
 	if len(args) != 1 {
-		return nil, errors.New("wrong number of arguments for ZCARD")
+		return nil, errWrongArgs("zcard")
 	}
 
 	key := string(args[0])
@@ -139,7 +273,7 @@ func execZCard(db *DB, args [][]byte) ([][]byte, error) {
 
 	zset, ok := entity.Data.(*datastruct.SortedSet)
 	if !ok {
-		return nil, errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
+		return nil, ErrWrongType
 	}
 
 	return [][]byte{[]byte(strconv.FormatInt(int64(zset.Len()), 10))}, nil
@@ -147,7 +281,7 @@ func execZCard(db *DB, args [][]byte) ([][]byte, error) {
 
 func execZRank(db *DB, args [][]byte) ([][]byte, error) {
 	if len(args) != 2 {
-		return nil, errors.New("wrong number of arguments for ZRANK")
+		return nil, errWrongArgs("zrank")
 	}
 
 	key := string(args[0])
@@ -155,17 +289,17 @@ func execZRank(db *DB, args [][]byte) ([][]byte, error) {
 
 	entity, ok := db.GetEntity(key)
 	if !ok || entity.Data == nil {
-		return [][]byte{nil}, nil
+		return nullResult(), nil
 	}
 
 	zset, ok := entity.Data.(*datastruct.SortedSet)
 	if !ok {
-		return nil, errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
+		return nil, ErrWrongType
 	}
 
 	rank := zset.Rank(member)
 	if rank == -1 {
-		return [][]byte{nil}, nil
+		return nullResult(), nil
 	}
 
 	return [][]byte{[]byte(strconv.FormatInt(int64(rank), 10))}, nil
@@ -173,7 +307,7 @@ func execZRank(db *DB, args [][]byte) ([][]byte, error) {
 
 func execZRevRank(db *DB, args [][]byte) ([][]byte, error) {
 	if len(args) != 2 {
-		return nil, errors.New("wrong number of arguments for ZREVRANK")
+		return nil, errWrongArgs("zrevrank")
 	}
 
 	key := string(args[0])
@@ -181,17 +315,17 @@ func execZRevRank(db *DB, args [][]byte) ([][]byte, error) {
 
 	entity, ok := db.GetEntity(key)
 	if !ok || entity.Data == nil {
-		return [][]byte{nil}, nil
+		return nullResult(), nil
 	}
 
 	zset, ok := entity.Data.(*datastruct.SortedSet)
 	if !ok {
-		return nil, errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
+		return nil, ErrWrongType
 	}
 
 	rank := zset.RevRank(member)
 	if rank == -1 {
-		return [][]byte{nil}, nil
+		return nullResult(), nil
 	}
 
 	return [][]byte{[]byte(strconv.FormatInt(int64(rank), 10))}, nil
@@ -199,17 +333,17 @@ func execZRevRank(db *DB, args [][]byte) ([][]byte, error) {
 
 func execZRange(db *DB, args [][]byte) ([][]byte, error) {
 	if len(args) < 3 {
-		return nil, errors.New("wrong number of arguments for ZRANGE")
+		return nil, errWrongArgs("zrange")
 	}
 
 	key := string(args[0])
 	start, err := strconv.Atoi(string(args[1]))
 	if err != nil {
-		return nil, errors.New("ERR value is not an integer or out of range")
+		return nil, ErrNotInteger
 	}
 	stop, err := strconv.Atoi(string(args[2]))
 	if err != nil {
-		return nil, errors.New("ERR value is not an integer or out of range")
+		return nil, ErrNotInteger
 	}
 
 	withScores := false
@@ -226,7 +360,11 @@ func execZRange(db *DB, args [][]byte) ([][]byte, error) {
 
 	zset, ok := entity.Data.(*datastruct.SortedSet)
 	if !ok {
-		return nil, errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
+		return nil, ErrWrongType
+	}
+
+	if err := db.checkReplyElements(rangeLen(start, stop, zset.Len()), "ZSCAN"); err != nil {
+		return nil, err
 	}
 
 	result := zset.Range(start, stop, withScores)
@@ -235,17 +373,17 @@ func execZRange(db *DB, args [][]byte) ([][]byte, error) {
 
 func execZRevRange(db *DB, args [][]byte) ([][]byte, error) {
 	if len(args) < 3 {
-		return nil, errors.New("wrong number of arguments for ZREVRANGE")
+		return nil, errWrongArgs("zrevrange")
 	}
 
 	key := string(args[0])
 	start, err := strconv.Atoi(string(args[1]))
 	if err != nil {
-		return nil, errors.New("ERR value is not an integer or out of range")
+		return nil, ErrNotInteger
 	}
 	stop, err := strconv.Atoi(string(args[2]))
 	if err != nil {
-		return nil, errors.New("ERR value is not an integer or out of range")
+		return nil, ErrNotInteger
 	}
 
 	withScores := false
@@ -262,26 +400,53 @@ func execZRevRange(db *DB, args [][]byte) ([][]byte, error) {
 
 	zset, ok := entity.Data.(*datastruct.SortedSet)
 	if !ok {
-		return nil, errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
+		return nil, ErrWrongType
+	}
+
+	if err := db.checkReplyElements(rangeLen(start, stop, zset.Len()), "ZSCAN"); err != nil {
+		return nil, err
 	}
 
 	result := zset.RevRange(start, stop, withScores)
 	return result, nil
 }
 
+// parseScoreRange parses the min and max of ZRANGEBYSCORE and ZCOUNT into
+// inclusive bounds. A bound prefixed with "(" is exclusive and becomes the
+// next float towards the other bound.
+func parseScoreRange(minArg, maxArg []byte) (min, max float64, err error) {
+	parse := func(arg []byte, towards float64) (float64, error) {
+		exclusive := len(arg) > 0 && arg[0] == '('
+		if exclusive {
+			arg = arg[1:]
+		}
+		score, err := strconv.ParseFloat(string(arg), 64)
+		if err != nil || math.IsNaN(score) {
+			return 0, errors.New("ERR min or max is not a float")
+		}
+		if exclusive {
+			score = math.Nextafter(score, towards)
+		}
+		return score, nil
+	}
+	if min, err = parse(minArg, math.Inf(1)); err != nil {
+		return 0, 0, err
+	}
+	if max, err = parse(maxArg, math.Inf(-1)); err != nil {
+		return 0, 0, err
+	}
+	return min, max, nil
+}
+
 func execZRangeByScore(db *DB, args [][]byte) ([][]byte, error) {
 	if len(args) < 3 {
-		return nil, errors.New("wrong number of arguments for ZRANGEBYSCORE")
+		return nil, errWrongArgs("zrangebyscore")
 	}
 
 	key := string(args[0])
-	min, err := strconv.ParseFloat(string(args[1]), 64)
+	min, max, err := parseScoreRange(args[1], args[2])
 	if err != nil {
-		return nil, errors.New("ERR value is not a valid float")
-	}
-	max, err := strconv.ParseFloat(string(args[2]), 64)
-	if err != nil {
-		return nil, errors.New("ERR value is not a valid float")
+		return nil, err
 	}
 
 	withScores := false
@@ -312,7 +477,7 @@ func execZRangeByScore(db *DB, args [][]byte) ([][]byte, error) {
 
 	zset, ok := entity.Data.(*datastruct.SortedSet)
 	if !ok {
-		return nil, errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
+		return nil, ErrWrongType
 	}
 
 	if count > 0 || offset > 0 {
@@ -326,17 +491,13 @@ func execZRangeByScore(db *DB, args [][]byte) ([][]byte, error) {
 
 func execZCount(db *DB, args [][]byte) ([][]byte, error) {
 	if len(args) != 3 {
-		return nil, errors.New("wrong number of arguments for ZCOUNT")
+		return nil, errWrongArgs("zcount")
 	}
 
 	key := string(args[0])
-	min, err := strconv.ParseFloat(string(args[1]), 64)
-	if err != nil {
-		return nil, errors.New("ERR value is not a valid float")
-	}
-	max, err := strconv.ParseFloat(string(args[2]), 64)
+	min, max, err := parseScoreRange(args[1], args[2])
 	if err != nil {
-		return nil, errors.New("ERR value is not a valid float")
+		return nil, err
 	}
 
 	entity, ok := db.GetEntity(key)
@@ -346,7 +507,7 @@ func execZCount(db *DB, args [][]byte) ([][]byte, error) {
 
 	zset, ok := entity.Data.(*datastruct.SortedSet)
 	if !ok {
-		return nil, errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
+		return nil, ErrWrongType
 	}
 
 	count := zset.Count(min, max)
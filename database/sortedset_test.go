@@ -0,0 +1,276 @@
+package database_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/wangbo/gocache/database"
+)
+
+// zsetState returns the members of a sorted set and their scores, as
+// "a:1 b:2", in score order
+func zsetState(t *testing.T, db *database.DB, key string) string {
+	t.Helper()
+	result := exec(t, db, "ZRANGE", key, "0", "-1", "WITHSCORES")
+	pairs := make([]string, 0, len(result)/2)
+	for i := 0; i+1 < len(result); i += 2 {
+		pairs = append(pairs, string(result[i])+":"+string(result[i+1]))
+	}
+	return strings.Join(pairs, " ")
+}
+
+func TestZAddOptions(t *testing.T) {
+	tests := []struct {
+		args  string
+		reply string // "nil" for a null reply
+		state string // of z, which holds a:1 b:2 beforehand
+	}{
+		{"3 c", "1", "a:1 b:2 c:3"},
+		{"5 a 3 c", "1", "b:2 c:3 a:5"},
+		{"CH 5 a 3 c", "2", "b:2 c:3 a:5"},
+		{"CH 1 a", "0", "a:1 b:2"},
+		{"NX 5 a 3 c", "1", "a:1 b:2 c:3"},
+		{"NX CH 5 a 3 c", "1", "a:1 b:2 c:3"},
+		{"XX 5 a 3 c", "0", "b:2 a:5"},
+		{"XX CH 5 a 3 c", "1", "b:2 a:5"},
+		{"GT 0 a 5 b 3 c", "1", "a:1 c:3 b:5"},
+		{"GT CH 0 a 5 b 3 c", "2", "a:1 c:3 b:5"},
+		{"GT CH 1 a", "0", "a:1 b:2"},
+		{"LT CH 0 a 5 b 3 c", "2", "a:0 b:2 c:3"},
+		{"XX GT CH 0 a 5 b 3 c", "1", "a:1 b:5"},
+		{"XX LT CH 0 a 5 b 3 c", "1", "a:0 b:2"},
+		{"INCR 2 a", "3", "b:2 a:3"},
+		{"INCR 0 a", "1", "a:1 b:2"},
+		{"INCR 2 c", "2", "a:1 b:2 c:2"},
+		{"CH INCR 2 a", "3", "b:2 a:3"},
+		{"NX INCR 2 a", "nil", "a:1 b:2"},
+		{"NX INCR 0 a", "nil", "a:1 b:2"},
+		{"NX INCR 2 c", "2", "a:1 b:2 c:2"},
+		{"XX INCR 2 c", "nil", "a:1 b:2"},
+		{"XX INCR 2 a", "3", "b:2 a:3"},
+		{"GT INCR -1 a", "nil", "a:1 b:2"},
+		{"GT INCR 2 a", "3", "b:2 a:3"},
+		{"LT INCR 1 a", "nil", "a:1 b:2"},
+		{"LT INCR -1 a", "0", "a:0 b:2"},
+		{"XX GT INCR 2 c", "nil", "a:1 b:2"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.args, func(t *testing.T) {
+			db := database.MakeDB()
+			defer db.Close()
+			exec(t, db, "ZADD", "z", "1", "a", "2", "b")
+
+			result := exec(t, db, append([]string{"ZADD", "z"}, strings.Fields(tt.args)...)...)
+			reply := string(result[0])
+			if database.IsNullResult(result) {
+				reply = "nil"
+			}
+			if reply != tt.reply {
+				t.Errorf("Expected reply %s, got %s", tt.reply, reply)
+			}
+			if state := zsetState(t, db, "z"); state != tt.state {
+				t.Errorf("Expected %s, got %s", tt.state, state)
+			}
+		})
+	}
+}
+
+func TestZAddOnMissingKey(t *testing.T) {
+	db := database.MakeDB()
+	defer db.Close()
+
+	for _, args := range []string{"XX 1 a", "XX CH 1 a", "XX INCR 1 a"} {
+		exec(t, db, append([]string{"ZADD", "z"}, strings.Fields(args)...)...)
+		if exists := string(exec(t, db, "EXISTS", "z")[0]); exists != "0" {
+			t.Errorf("ZADD z %s: expected no key to be created", args)
+		}
+	}
+
+	if reply := string(exec(t, db, "ZADD", "z", "NX", "CH", "1", "a")[0]); reply != "1" {
+		t.Errorf("Expected ZADD NX CH to add a member, got %s", reply)
+	}
+}
+
+func TestZAddErrors(t *testing.T) {
+	tests := []struct {
+		args string
+		err  string
+	}{
+		{"NX XX 1 a", "ERR XX and NX options at the same time are not compatible"},
+		{"XX NX GT 1 a", "ERR XX and NX options at the same time are not compatible"},
+		{"NX GT 1 a", "ERR GT, LT, and/or NX options at the same time are not compatible"},
+		{"NX LT 1 a", "ERR GT, LT, and/or NX options at the same time are not compatible"},
+		{"GT LT 1 a", "ERR GT, LT, and/or NX options at the same time are not compatible"},
+		{"INCR 1 a 2 b", "ERR INCR option supports a single increment-element pair"},
+		{"1 a 2", "ERR syntax error"},
+		{"NX CH", "ERR syntax error"},
+		{"NX 1", "ERR syntax error"},
+		{"1 a x b", "ERR value is not a valid float"},
+		{"nan a", "ERR value is not a valid float"},
+		{"INCR -inf a", "ERR resulting score is not a number (NaN)"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.args, func(t *testing.T) {
+			db := database.MakeDB()
+			defer db.Close()
+			exec(t, db, "ZADD", "z", "inf", "a")
+
+			cmdLine := [][]byte{[]byte("ZADD"), []byte("z")}
+			for _, arg := range strings.Fields(tt.args) {
+				cmdLine = append(cmdLine, []byte(arg))
+			}
+			_, err := db.Exec(cmdLine)
+			if err == nil || err.Error() != tt.err {
+				t.Errorf("Expected %q, got %v", tt.err, err)
+			}
+			// An error changes nothing, even after valid pairs
+			if state := zsetState(t, db, "z"); state != "a:inf" {
+				t.Errorf("Expected z unchanged, got %s", state)
+			}
+		})
+	}
+}
+
+// TestZSetInfinity checks the arithmetic of infinite scores, as Redis: a sum
+// of opposite infinities is refused and leaves the member unchanged
+func TestZSetInfinity(t *testing.T) {
+	tests := []struct {
+		score     string // of a, beside b:0
+		increment string
+		reply     string // the new score, or the error
+		state     string
+	}{
+		{"inf", "1", "inf", "b:0 a:inf"},
+		{"inf", "inf", "inf", "b:0 a:inf"},
+		{"inf", "-inf", "ERR resulting score is not a number (NaN)", "b:0 a:inf"},
+		{"-inf", "inf", "ERR resulting score is not a number (NaN)", "a:-inf b:0"},
+		{"-inf", "-1", "-inf", "a:-inf b:0"},
+		{"-inf", "-inf", "-inf", "a:-inf b:0"},
+		{"1", "inf", "inf", "b:0 a:inf"},
+		{"1", "-inf", "-inf", "a:-inf b:0"},
+		{"+inf", "0", "inf", "b:0 a:inf"},
+		{"1", "nan", "ERR value is not a valid float", "b:0 a:1"},
+	}
+
+	for _, tt := range tests {
+		for _, cmd := range []string{"ZINCRBY", "ZADD INCR"} {
+			t.Run(cmd+" "+tt.score+" "+tt.increment, func(t *testing.T) {
+				db := database.MakeDB()
+				defer db.Close()
+				exec(t, db, "ZADD", "z", tt.score, "a", "0", "b")
+
+				args := []string{"ZINCRBY", "z", tt.increment, "a"}
+				if cmd == "ZADD INCR" {
+					args = []string{"ZADD", "z", "INCR", tt.increment, "a"}
+				}
+				cmdLine := make([][]byte, len(args))
+				for i, arg := range args {
+					cmdLine[i] = []byte(arg)
+				}
+				reply := ""
+				if result, err := db.Exec(cmdLine); err != nil {
+					reply = err.Error()
+				} else {
+					reply = string(result[0])
+				}
+				if reply != tt.reply {
+					t.Errorf("Expected %s, got %s", tt.reply, reply)
+				}
+				if state := zsetState(t, db, "z"); state != tt.state {
+					t.Errorf("Expected %s, got %s", tt.state, state)
+				}
+			})
+		}
+	}
+}
+
+func TestZSetInfinityReplies(t *testing.T) {
+	db := database.MakeDB()
+	defer db.Close()
+	exec(t, db, "ZADD", "z", "-inf", "low", "0", "mid", "+inf", "high")
+
+	if state := zsetState(t, db, "z"); state != "low:-inf mid:0 high:inf" {
+		t.Errorf("Expected the infinities sorted at both ends, got %s", state)
+	}
+	if score := string(exec(t, db, "ZSCORE", "z", "high")[0]); score != "inf" {
+		t.Errorf("Expected inf, got %s", score)
+	}
+	result := exec(t, db, "ZRANGEBYSCORE", "z", "-inf", "(0", "WITHSCORES")
+	if len(result) != 2 || string(result[1]) != "-inf" {
+		t.Errorf("Expected low:-inf, got %q", result)
+	}
+}
+
+func TestZMScore(t *testing.T) {
+	db := database.MakeDB()
+	defer db.Close()
+	exec(t, db, "ZADD", "z", "1", "a", "2.5", "b")
+
+	result := exec(t, db, "ZMSCORE", "z", "a", "missing", "b", "a")
+	if len(result) != 4 || string(result[0]) != "1" || result[1] != nil || string(result[2]) != "2.5" || string(result[3]) != "1" {
+		t.Errorf("Expected [1 nil 2.5 1], got %q", result)
+	}
+	if result := exec(t, db, "ZMSCORE", "missing", "a", "b"); len(result) != 2 || result[0] != nil || result[1] != nil {
+		t.Errorf("Expected [nil nil] for a missing key, got %q", result)
+	}
+
+	exec(t, db, "SET", "s", "v")
+	if _, err := db.ExecCommand("ZMSCORE", "s", "a"); err != database.ErrWrongType {
+		t.Errorf("Expected WRONGTYPE, got %v", err)
+	}
+	if _, err := db.ExecCommand("ZMSCORE", "z"); err == nil {
+		t.Error("Expected ZMSCORE without a member to fail")
+	}
+}
+
+// TestZSetScoreFormatting checks that every reply holding a score formats it
+// the same way, as Redis does
+func TestZSetScoreFormatting(t *testing.T) {
+	db := database.MakeDB()
+	defer db.Close()
+
+	for _, tc := range []struct {
+		score string
+		want  string
+	}{
+		{"3", "3"},
+		{"1.5", "1.5"},
+		{"0.1", "0.10000000000000001"},
+		{"0.30000000000000004", "0.30000000000000004"},
+		{"1e-5", "1.0000000000000001e-05"},
+		{"1e16", "10000000000000000"},
+		{"1e17", "1e+17"},
+		{"123456789012345678", "1.2345678901234568e+17"},
+		{"-0", "-0"},
+		{"+inf", "inf"},
+		{"-inf", "-inf"},
+	} {
+		exec(t, db, "DEL", "z")
+		exec(t, db, "ZADD", "z", tc.score, "m")
+
+		replies := map[string]string{
+			"ZSCORE":                   string(exec(t, db, "ZSCORE", "z", "m")[0]),
+			"ZMSCORE":                  string(exec(t, db, "ZMSCORE", "z", "m")[0]),
+			"ZRANGE WITHSCORES":        string(exec(t, db, "ZRANGE", "z", "0", "-1", "WITHSCORES")[1]),
+			"ZREVRANGE WITHSCORES":     string(exec(t, db, "ZREVRANGE", "z", "0", "-1", "WITHSCORES")[1]),
+			"ZRANGEBYSCORE WITHSCORES": string(exec(t, db, "ZRANGEBYSCORE", "z", "-inf", "+inf", "WITHSCORES")[1]),
+			"ZSCAN":                    string(exec(t, db, "ZSCAN", "z", "0")[2]),
+		}
+		for cmd, got := range replies {
+			if got != tc.want {
+				t.Errorf("%s of %s: expected %q, got %q", cmd, tc.score, tc.want, got)
+			}
+		}
+	}
+
+	// Scores computed by the server are formatted the same way
+	exec(t, db, "ZADD", "sum", "0.1", "m")
+	if got := string(exec(t, db, "ZINCRBY", "sum", "0.2", "m")[0]); got != "0.30000000000000004" {
+		t.Errorf("ZINCRBY: expected 0.30000000000000004, got %q", got)
+	}
+	if got := string(exec(t, db, "ZADD", "sum", "INCR", "1e17", "m")[0]); got != "1e+17" {
+		t.Errorf("ZADD INCR: expected 1e+17, got %q", got)
+	}
+}
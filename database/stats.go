@@ -0,0 +1,261 @@
+package database
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/wangbo/gocache/util/clock"
+)
+
+// Server statistics reported by INFO
+//
+// The connection handler feeds these counters: it knows about clients,
+// command latency and the error replies actually sent, none of which are
+// visible from inside the database.
+//
+// The instantaneous rates are computed the way Redis does: every 100ms the
+// sampler records the rate of the command and byte counters since its last
+// sample, and a rate is the average of the last 16 samples, so it follows
+// the traffic of the last 1.6 seconds.
+
+// statsSampleInterval is how often the sampler records the counters
+const statsSampleInterval = 100 * time.Millisecond
+
+// statsSamples is the number of samples an instantaneous rate averages
+const statsSamples = 16
+
+// commandStat holds the counters of a single command for INFO commandstats
+type commandStat struct {
+	calls       uint64
+	usec        uint64
+	failedCalls uint64
+}
+
+// serverStats holds counters for the INFO stats, clients, commandstats and
+// errorstats sections
+type serverStats struct {
+	connectedClients int64
+	totalConnections uint64
+	totalCommands    uint64
+	totalErrors      uint64
+	netInputBytes    uint64
+	netOutputBytes   uint64
+
+	mu       sync.Mutex
+	commands map[string]*commandStat
+	errors   map[string]uint64
+
+	samplesMu sync.Mutex
+	opsRate   instantaneousMetric
+	inputRate instantaneousMetric
+	outRate   instantaneousMetric
+
+	// Stops the sampler started by startSampler, which closes stopped
+	samplerStop    chan struct{}
+	samplerStopped chan struct{}
+}
+
+// instantaneousMetric holds the last samples of the rate of a counter
+type instantaneousMetric struct {
+	lastTime    time.Time
+	lastReading uint64
+	samples     [statsSamples]float64 // Per second
+	index       int
+}
+
+// track records the rate of the counter since the previous reading
+func (m *instantaneousMetric) track(now time.Time, reading uint64) {
+	if elapsed := now.Sub(m.lastTime); !m.lastTime.IsZero() && elapsed > 0 {
+		m.samples[m.index] = float64(reading-m.lastReading) / elapsed.Seconds()
+		m.index = (m.index + 1) % statsSamples
+	}
+	m.lastTime, m.lastReading = now, reading
+}
+
+// rate returns the average of the samples, per second
+func (m *instantaneousMetric) rate() float64 {
+	var sum float64
+	for _, sample := range m.samples {
+		sum += sample
+	}
+	return sum / statsSamples
+}
+
+func newServerStats() *serverStats {
+	return &serverStats{
+		commands: make(map[string]*commandStat),
+		errors:   make(map[string]uint64),
+	}
+}
+
+// startSampler samples the counters every statsSampleInterval of c until
+// stopSampler is called or the database is closed
+func (s *serverStats) startSampler(lc *lifecycle, c clock.Clock) {
+	ticker := c.NewTicker(statsSampleInterval)
+	stop, stopped := make(chan struct{}), make(chan struct{})
+	s.samplerStop, s.samplerStopped = stop, stopped
+	started := lc.goWorker(func(done <-chan struct{}) {
+		defer close(stopped)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-stop:
+				return
+			case now := <-ticker.C():
+				s.sample(now)
+			}
+		}
+	})
+	if !started {
+		ticker.Stop()
+		close(stopped)
+	}
+}
+
+// stopSampler stops the sampler and waits for it
+func (s *serverStats) stopSampler() {
+	close(s.samplerStop)
+	<-s.samplerStopped
+}
+
+// sample records the counters read at now
+func (s *serverStats) sample(now time.Time) {
+	s.samplesMu.Lock()
+	defer s.samplesMu.Unlock()
+	s.opsRate.track(now, atomic.LoadUint64(&s.totalCommands))
+	s.inputRate.track(now, atomic.LoadUint64(&s.netInputBytes))
+	s.outRate.track(now, atomic.LoadUint64(&s.netOutputBytes))
+}
+
+// instantaneous returns the commands per second and the KB per second
+// received and sent, averaged over the last samples
+func (s *serverStats) instantaneous() (ops, inputKbps, outputKbps float64) {
+	s.samplesMu.Lock()
+	defer s.samplesMu.Unlock()
+	return s.opsRate.rate(), s.inputRate.rate() / 1024, s.outRate.rate() / 1024
+}
+
+// TrafficStats are the command and network counters of INFO stats, with
+// their instantaneous rates
+type TrafficStats struct {
+	TotalCommands  uint64
+	NetInputBytes  uint64
+	NetOutputBytes uint64
+	OpsPerSec      float64
+	InputKbps      float64
+	OutputKbps     float64
+}
+
+// TrafficStats returns the command and network counters and their rates
+func (db *DB) TrafficStats() TrafficStats {
+	ops, inputKbps, outputKbps := db.stats.instantaneous()
+	return TrafficStats{
+		TotalCommands:  atomic.LoadUint64(&db.stats.totalCommands),
+		NetInputBytes:  atomic.LoadUint64(&db.stats.netInputBytes),
+		NetOutputBytes: atomic.LoadUint64(&db.stats.netOutputBytes),
+		OpsPerSec:      ops,
+		InputKbps:      inputKbps,
+		OutputKbps:     outputKbps,
+	}
+}
+
+// ClientConnected records a new client connection
+func (db *DB) ClientConnected() {
+	atomic.AddInt64(&db.stats.connectedClients, 1)
+	atomic.AddUint64(&db.stats.totalConnections, 1)
+}
+
+// ClientDisconnected records a closed client connection
+func (db *DB) ClientDisconnected() {
+	atomic.AddInt64(&db.stats.connectedClients, -1)
+}
+
+// RecordCommand records an executed command and how long it took
+func (db *DB) RecordCommand(cmd string, duration time.Duration, failed bool) {
+	s := db.stats
+	atomic.AddUint64(&s.totalCommands, 1)
+
+	name := strings.ToLower(cmd)
+	s.mu.Lock()
+	stat, ok := s.commands[name]
+	if !ok {
+		stat = &commandStat{}
+		s.commands[name] = stat
+	}
+	stat.calls++
+	stat.usec += uint64(duration.Microseconds())
+	if failed {
+		stat.failedCalls++
+	}
+	s.mu.Unlock()
+}
+
+// RecordNetInput records n bytes read from a client connection, a replica
+// or a MONITOR client included
+func (db *DB) RecordNetInput(n int) {
+	if n > 0 {
+		atomic.AddUint64(&db.stats.netInputBytes, uint64(n))
+	}
+}
+
+// RecordNetOutput records n bytes written to a client connection, the
+// replication stream and MONITOR feeds included
+func (db *DB) RecordNetOutput(n int) {
+	if n > 0 {
+		atomic.AddUint64(&db.stats.netOutputBytes, uint64(n))
+	}
+}
+
+// RecordErrorReply records an error reply sent to a client, counted by its
+// prefix (the first word, e.g. ERR or WRONGTYPE)
+func (db *DB) RecordErrorReply(msg string) {
+	s := db.stats
+	atomic.AddUint64(&s.totalErrors, 1)
+
+	prefix := msg
+	if i := strings.IndexByte(msg, ' '); i >= 0 {
+		prefix = msg[:i]
+	}
+	if prefix == "" {
+		prefix = "ERR"
+	}
+
+	s.mu.Lock()
+	s.errors[prefix]++
+	s.mu.Unlock()
+}
+
+// commandStatsSnapshot returns a copy of the command counters sorted by name
+func (s *serverStats) commandStatsSnapshot() ([]string, map[string]commandStat) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	names := make([]string, 0, len(s.commands))
+	stats := make(map[string]commandStat, len(s.commands))
+	for name, stat := range s.commands {
+		names = append(names, name)
+		stats[name] = *stat
+	}
+	sort.Strings(names)
+	return names, stats
+}
+
+// errorStatsSnapshot returns a copy of the error counters sorted by prefix
+func (s *serverStats) errorStatsSnapshot() ([]string, map[string]uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	prefixes := make([]string, 0, len(s.errors))
+	counts := make(map[string]uint64, len(s.errors))
+	for prefix, count := range s.errors {
+		prefixes = append(prefixes, prefix)
+		counts[prefix] = count
+	}
+	sort.Strings(prefixes)
+	return prefixes, counts
+}
@@ -0,0 +1,500 @@
+package database
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/wangbo/gocache/datastruct"
+)
+
+// Stream command implementations
+//
+// XRANGE and XREVRANGE return their entries flattened into the result, each
+// as the entry ID, the number of field and value items that follow, and the
+// items themselves. XREAD returns, for every stream with new entries, the key,
+// the number of entries and the flattened entries; a nil result means no
+// stream had new entries. The server turns both into nested arrays.
+
+// streamCommand wraps a stream command executor to hold db.streamMu
+func streamCommand(fn func(db *DB, args [][]byte) ([][]byte, error)) func(db *DB, args [][]byte) ([][]byte, error) {
+	return func(db *DB, args [][]byte) ([][]byte, error) {
+		db.streamMu.Lock()
+		defer db.streamMu.Unlock()
+		return fn(db, args)
+	}
+}
+
+var errStreamIDTooSmall = errors.New("ERR The ID specified in XADD is equal or smaller than the target stream top item")
+
+// xaddOptions holds the parsed arguments of XADD
+type xaddOptions struct {
+	maxLen      int // -1 if no MAXLEN was given
+	approximate bool
+	idIndex     int // index of the ID in the arguments
+}
+
+// parseXAddOptions parses the options between the key and the ID of XADD
+func parseXAddOptions(args [][]byte) (xaddOptions, error) {
+	opts := xaddOptions{maxLen: -1, idIndex: 1}
+	for opts.idIndex < len(args) && strings.EqualFold(string(args[opts.idIndex]), "MAXLEN") {
+		i := opts.idIndex + 1
+		if i < len(args) {
+			switch string(args[i]) {
+			case "~":
+				opts.approximate = true
+				i++
+			case "=":
+				i++
+			}
+		}
+		if i >= len(args) {
+			return opts, ErrSyntax
+		}
+		maxLen, err := strconv.ParseInt(string(args[i]), 10, 64)
+		if err != nil {
+			return opts, ErrNotInteger
+		}
+		if maxLen < 0 {
+			return opts, errors.New("ERR The MAXLEN argument must be >= 0.")
+		}
+		opts.maxLen = int(min(maxLen, math.MaxInt32))
+		opts.idIndex = i + 1
+	}
+	return opts, nil
+}
+
+// XAddIDIndex returns the index of the entry ID in the arguments of an XADD
+// command (without the command name), or -1 if they cannot be parsed
+func XAddIDIndex(args [][]byte) int {
+	opts, err := parseXAddOptions(args)
+	if err != nil || opts.idIndex >= len(args) {
+		return -1
+	}
+	return opts.idIndex
+}
+
+// execXAdd implements XADD key [MAXLEN [~|=] threshold] <*|id> field value [field value ...]
+func execXAdd(db *DB, args [][]byte) ([][]byte, error) {
+	if len(args) < 4 {
+		return nil, errWrongArgs("xadd")
+	}
+
+	key := string(args[0])
+	opts, err := parseXAddOptions(args)
+	if err != nil {
+		return nil, err
+	}
+	fields := args[opts.idIndex+1:]
+	if len(fields) == 0 || len(fields)%2 != 0 {
+		return nil, errWrongArgs("xadd")
+	}
+
+	entity, ok := db.GetEntity(key)
+	created := !ok || entity.Data == nil
+	if created {
+		entity = datastruct.MakeStream()
+	}
+	stream, ok := entity.Data.(*datastruct.Stream)
+	if !ok {
+		return nil, ErrWrongType
+	}
+
+	id, err := streamAddID(stream, string(args[opts.idIndex]), db.now())
+	if err != nil {
+		return nil, err
+	}
+
+	// The stream keeps the field slices, so copy them out of the arguments
+	entryFields := make([][]byte, len(fields))
+	for i, field := range fields {
+		entryFields[i] = append([]byte(nil), field...)
+	}
+	stream.Add(id, entryFields)
+	if opts.maxLen >= 0 {
+		stream.Trim(opts.maxLen, opts.approximate)
+	}
+
+	if created {
+		db.PutEntity(key, entity)
+	}
+	return [][]byte{[]byte(id.String())}, nil
+}
+
+// streamAddID resolves the ID argument of XADD: "*" generates the next ID,
+// "ms-*" the next sequence number within ms, anything else is explicit and
+// must be greater than the last ID of the stream. Generated IDs take their
+// milliseconds from now.
+func streamAddID(stream *datastruct.Stream, arg string, now time.Time) (datastruct.StreamID, error) {
+	lastID := stream.LastID()
+
+	if arg == "*" {
+		id, ok := stream.NextID(uint64(now.UnixMilli()))
+		if !ok {
+			return id, errors.New("ERR The stream has exhausted the last possible ID, unable to add more items")
+		}
+		return id, nil
+	}
+
+	if msPart, ok := strings.CutSuffix(arg, "-*"); ok {
+		ms, err := strconv.ParseUint(msPart, 10, 64)
+		if err != nil {
+			return datastruct.StreamID{}, datastruct.ErrInvalidStreamID
+		}
+		switch {
+		case ms < lastID.Ms:
+			return datastruct.StreamID{}, errStreamIDTooSmall
+		case ms == lastID.Ms:
+			if lastID.Seq == math.MaxUint64 {
+				return datastruct.StreamID{}, errStreamIDTooSmall
+			}
+			return datastruct.StreamID{Ms: ms, Seq: lastID.Seq + 1}, nil
+		case ms == 0:
+			// 0-0 is not a valid entry ID
+			return datastruct.StreamID{Ms: 0, Seq: 1}, nil
+		}
+		return datastruct.StreamID{Ms: ms}, nil
+	}
+
+	id, err := datastruct.ParseStreamID(arg, 0)
+	if err != nil {
+		return id, err
+	}
+	if id.IsZero() {
+		return id, errors.New("ERR The ID specified in XADD must be greater than 0-0")
+	}
+	if !lastID.Less(id) {
+		return id, errStreamIDTooSmall
+	}
+	return id, nil
+}
+
+// execXLen implements XLEN key
+func execXLen(db *DB, args [][]byte) ([][]byte, error) {
+	if len(args) != 1 {
+		return nil, errWrongArgs("xlen")
+	}
+
+	stream, err := db.getStream(string(args[0]))
+	if err != nil {
+		return nil, err
+	}
+	if stream == nil {
+		return zeroResponse, nil
+	}
+	return [][]byte{[]byte(strconv.Itoa(stream.Len()))}, nil
+}
+
+// execXRange implements XRANGE key start end [COUNT count]
+func execXRange(db *DB, args [][]byte) ([][]byte, error) {
+	return streamRange(db, args, "xrange", false)
+}
+
+// execXRevRange implements XREVRANGE key end start [COUNT count]
+func execXRevRange(db *DB, args [][]byte) ([][]byte, error) {
+	return streamRange(db, args, "xrevrange", true)
+}
+
+// streamRange implements XRANGE and XREVRANGE, which takes its bounds in
+// reverse order
+func streamRange(db *DB, args [][]byte, name string, reverse bool) ([][]byte, error) {
+	if len(args) != 3 && len(args) != 5 {
+		return nil, errWrongArgs(name)
+	}
+
+	startArg, endArg := string(args[1]), string(args[2])
+	if reverse {
+		startArg, endArg = endArg, startArg
+	}
+	start, err := parseStreamRangeBound(startArg, false)
+	if err != nil {
+		return nil, err
+	}
+	end, err := parseStreamRangeBound(endArg, true)
+	if err != nil {
+		return nil, err
+	}
+
+	count := -1
+	if len(args) == 5 {
+		if !strings.EqualFold(string(args[3]), "COUNT") {
+			return nil, ErrSyntax
+		}
+		n, err := strconv.ParseInt(string(args[4]), 10, 64)
+		if err != nil {
+			return nil, ErrNotInteger
+		}
+		count = int(max(min(n, math.MaxInt32), 0))
+	}
+
+	stream, err := db.getStream(string(args[0]))
+	if err != nil {
+		return nil, err
+	}
+	if stream == nil || count == 0 {
+		return [][]byte{}, nil
+	}
+	return appendStreamEntries(make([][]byte, 0), stream.Range(start, end, count, reverse)), nil
+}
+
+// parseStreamRangeBound parses an XRANGE bound: "-" and "+" are the smallest
+// and largest IDs, a "(" prefix makes the bound exclusive, and an ID without
+// sequence number covers the whole millisecond
+func parseStreamRangeBound(arg string, isEnd bool) (datastruct.StreamID, error) {
+	switch arg {
+	case "-":
+		return datastruct.StreamID{}, nil
+	case "+":
+		return datastruct.MaxStreamID, nil
+	}
+
+	exclusive := strings.HasPrefix(arg, "(")
+	if exclusive {
+		arg = arg[1:]
+	}
+	var missingSeq uint64
+	if isEnd {
+		missingSeq = math.MaxUint64
+	}
+	id, err := datastruct.ParseStreamID(arg, missingSeq)
+	if err != nil || !exclusive {
+		return id, err
+	}
+
+	ok := false
+	if isEnd {
+		id, ok = id.Prev()
+	} else {
+		id, ok = id.Next()
+	}
+	if !ok {
+		if isEnd {
+			return id, errors.New("ERR invalid end ID for the interval")
+		}
+		return id, errors.New("ERR invalid start ID for the interval")
+	}
+	return id, nil
+}
+
+// streamReadOptions holds the parsed arguments of XREAD and XREADGROUP
+type streamReadOptions struct {
+	count     int // -1 if no COUNT was given
+	block     bool
+	timeout   time.Duration
+	noAck     bool
+	group     string
+	consumer  string
+	hasGroup  bool
+	keys, ids [][]byte
+}
+
+// parseStreamReadOptions parses the arguments of XREAD, or of XREADGROUP if
+// group is set: the options followed by STREAMS key [key ...] id [id ...]
+func parseStreamReadOptions(args [][]byte, group bool) (streamReadOptions, error) {
+	opts := streamReadOptions{count: -1}
+	i := 0
+	for ; i < len(args); i++ {
+		opt := strings.ToUpper(string(args[i]))
+		if opt == "STREAMS" {
+			break
+		}
+		switch {
+		case opt == "COUNT" && i+1 < len(args):
+			n, err := strconv.ParseInt(string(args[i+1]), 10, 64)
+			if err != nil {
+				return opts, ErrNotInteger
+			}
+			if n > 0 {
+				opts.count = int(min(n, math.MaxInt32))
+			}
+			i++
+		case opt == "BLOCK" && i+1 < len(args):
+			ms, err := strconv.ParseInt(string(args[i+1]), 10, 64)
+			if err != nil {
+				return opts, errTimeoutNotInteger
+			}
+			if ms < 0 {
+				return opts, errors.New("ERR timeout is negative")
+			}
+			opts.block = true
+			opts.timeout = time.Duration(min(ms, math.MaxInt64/int64(time.Millisecond))) * time.Millisecond
+			i++
+		case opt == "GROUP" && group && i+2 < len(args):
+			opts.hasGroup = true
+			opts.group, opts.consumer = string(args[i+1]), string(args[i+2])
+			i += 2
+		case opt == "NOACK" && group:
+			opts.noAck = true
+		default:
+			return opts, ErrSyntax
+		}
+	}
+	if i >= len(args) {
+		return opts, ErrSyntax
+	}
+	if group && !opts.hasGroup {
+		return opts, errors.New("ERR Missing GROUP option for XREADGROUP")
+	}
+
+	streams := args[i+1:]
+	if len(streams) == 0 || len(streams)%2 != 0 {
+		if group {
+			return opts, errors.New("ERR Unbalanced 'xreadgroup' list of streams: for each stream key an ID or '>' must be specified.")
+		}
+		return opts, errors.New("ERR Unbalanced 'xread' list of streams: for each stream key an ID or '$' must be specified.")
+	}
+	opts.keys, opts.ids = streams[:len(streams)/2], streams[len(streams)/2:]
+	return opts, nil
+}
+
+// StripBlockOption returns an XREAD or XREADGROUP command line without its
+// BLOCK option, which is how blocked commands are retried and propagated
+func StripBlockOption(cmdLine [][]byte) [][]byte {
+	for i := 1; i < len(cmdLine); i++ {
+		opt := strings.ToUpper(string(cmdLine[i]))
+		if opt == "STREAMS" {
+			break
+		}
+		if opt == "BLOCK" && i+1 < len(cmdLine) {
+			stripped := make([][]byte, 0, len(cmdLine)-2)
+			stripped = append(stripped, cmdLine[:i]...)
+			return append(stripped, cmdLine[i+2:]...)
+		}
+	}
+	return cmdLine
+}
+
+// execXRead implements XREAD [COUNT count] [BLOCK milliseconds] STREAMS key [key ...] id [id ...]
+func execXRead(db *DB, args [][]byte) ([][]byte, error) {
+	opts, err := parseStreamReadOptions(args, false)
+	if err != nil {
+		return nil, err
+	}
+
+	var result [][]byte
+	// afterIDs are the IDs to retry with if the read blocks, with "$"
+	// resolved to the last ID at the time of the call
+	afterIDs := make([][]byte, len(opts.keys))
+	for j, key := range opts.keys {
+		stream, err := db.getStream(string(key))
+		if err != nil {
+			return nil, err
+		}
+
+		// "$" only matches entries added after the call
+		if string(opts.ids[j]) == "$" {
+			lastID := datastruct.StreamID{}
+			if stream != nil {
+				lastID = stream.LastID()
+			}
+			afterIDs[j] = []byte(lastID.String())
+			continue
+		}
+		afterIDs[j] = opts.ids[j]
+		after, err := datastruct.ParseStreamID(string(opts.ids[j]), 0)
+		if err != nil {
+			return nil, err
+		}
+		if stream == nil {
+			continue
+		}
+		start, ok := after.Next()
+		if !ok {
+			continue
+		}
+		entries := stream.Range(start, datastruct.MaxStreamID, opts.count, false)
+		if len(entries) == 0 {
+			continue
+		}
+		result = append(result, key, []byte(strconv.Itoa(len(entries))))
+		result = appendStreamEntries(result, entries)
+	}
+
+	if result == nil && opts.block {
+		retry := [][]byte{[]byte("XREAD")}
+		if opts.count > 0 {
+			retry = append(retry, []byte("COUNT"), []byte(strconv.Itoa(opts.count)))
+		}
+		retry = append(retry, []byte("STREAMS"))
+		retry = append(retry, opts.keys...)
+		retry = append(retry, afterIDs...)
+		return nil, &blockedCommand{keys: bytesToStrings(opts.keys), timeout: opts.timeout, cmdLine: retry}
+	}
+	return result, nil
+}
+
+// bytesToStrings converts arguments to strings
+func bytesToStrings(args [][]byte) []string {
+	strs := make([]string, len(args))
+	for i, arg := range args {
+		strs[i] = string(arg)
+	}
+	return strs
+}
+
+// appendStreamEntries appends stream entries to a result in the flattened
+// layout described at the top of this file
+func appendStreamEntries(result [][]byte, entries []datastruct.StreamEntry) [][]byte {
+	for _, entry := range entries {
+		result = append(result, []byte(entry.ID.String()), []byte(strconv.Itoa(len(entry.Fields))))
+		result = append(result, entry.Fields...)
+	}
+	return result
+}
+
+// getStream returns the stream stored at key, nil if the key does not exist
+func (db *DB) getStream(key string) (*datastruct.Stream, error) {
+	entity, ok := db.GetEntity(key)
+	if !ok || entity.Data == nil {
+		return nil, nil
+	}
+	stream, ok := entity.Data.(*datastruct.Stream)
+	if !ok {
+		return nil, ErrWrongType
+	}
+	return stream, nil
+}
+
+// StreamLastID returns the last ID added to the stream at key
+func (db *DB) StreamLastID(key string) (string, bool) {
+	stream, err := db.getStream(key)
+	if err != nil || stream == nil {
+		return "", false
+	}
+	return stream.LastID().String(), true
+}
+
+// rebuildStream returns XADD commands with explicit IDs that recreate a
+// stream, followed by the commands that recreate its consumer groups. A
+// stream trimmed to nothing is recreated with a placeholder entry trimmed
+// right away, which keeps its last ID; an empty stream that never had an
+// entry can only have been created by XGROUP CREATE MKSTREAM, so it is
+// recreated that way.
+func rebuildStream(key string, stream *datastruct.Stream) [][][]byte {
+	groups := rebuildStreamGroups(key, stream)
+	if stream.Len() == 0 && stream.LastID().IsZero() {
+		if len(groups) == 0 {
+			return [][][]byte{
+				{[]byte("XGROUP"), []byte("CREATE"), []byte(key), []byte(""), []byte("0"), []byte("MKSTREAM")},
+				{[]byte("XGROUP"), []byte("DESTROY"), []byte(key), []byte("")},
+			}
+		}
+		groups[0] = append(groups[0], []byte("MKSTREAM"))
+		return groups
+	}
+	if stream.Len() == 0 {
+		cmd := [][]byte{[]byte("XADD"), []byte(key), []byte("MAXLEN"), []byte("0"),
+			[]byte(stream.LastID().String()), []byte(""), []byte("")}
+		return append([][][]byte{cmd}, groups...)
+	}
+
+	entries := stream.Range(datastruct.StreamID{}, datastruct.MaxStreamID, 0, false)
+	cmds := make([][][]byte, len(entries), len(entries)+len(groups))
+	for i, entry := range entries {
+		cmd := [][]byte{[]byte("XADD"), []byte(key), []byte(entry.ID.String())}
+		cmds[i] = append(cmd, entry.Fields...)
+	}
+	return append(cmds, groups...)
+}
@@ -0,0 +1,661 @@
+package database
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/wangbo/gocache/datastruct"
+)
+
+// Stream consumer group command implementations
+//
+// XREADGROUP, XCLAIM and XAUTOCLAIM return entries in the flattened layout of
+// XREAD and XRANGE (see stream.go); an entry that is pending but no longer in
+// the stream has -1 as its number of items. XPENDING flattens its summary to
+// the count, the smallest and largest pending IDs (nil if none) and a name and
+// count pair per consumer, and its extended form to an ID, consumer, idle time
+// and delivery count per entry. XAUTOCLAIM returns the next cursor, the number
+// of claimed entries, the claimed entries (or IDs with JUSTID) and then the
+// IDs of the pending entries it found deleted.
+
+// defaultAutoClaimCount is the COUNT of XAUTOCLAIM if none is given
+const defaultAutoClaimCount = 100
+
+// autoClaimAttemptsFactor bounds the pending entries XAUTOCLAIM scans to
+// this many times its COUNT
+const autoClaimAttemptsFactor = 10
+
+func errNoGroup(key, group string) error {
+	return errors.New("NOGROUP No such key '" + key + "' or consumer group '" + group + "'")
+}
+
+// getStreamGroup returns the stream at key and its consumer group, or a
+// NOGROUP error naming cmd if either does not exist
+func (db *DB) getStreamGroup(key, group, cmd string) (*datastruct.Stream, *datastruct.StreamGroup, error) {
+	stream, err := db.getStream(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	var g *datastruct.StreamGroup
+	if stream != nil {
+		g = stream.Group(group)
+	}
+	if g == nil {
+		if cmd != "" {
+			return nil, nil, errors.New("NOGROUP No such key '" + key + "' or consumer group '" + group + "' in " + cmd + " with GROUP option")
+		}
+		return nil, nil, errNoGroup(key, group)
+	}
+	return stream, g, nil
+}
+
+// parseGroupStartID parses the ID a group starts delivering after: "$" is
+// the last ID of the stream
+func parseGroupStartID(stream *datastruct.Stream, arg string) (datastruct.StreamID, error) {
+	if arg == "$" {
+		return stream.LastID(), nil
+	}
+	return datastruct.ParseStreamID(arg, 0)
+}
+
+// execXGroup implements XGROUP CREATE, SETID, DESTROY, CREATECONSUMER,
+// DELCONSUMER and HELP
+func execXGroup(db *DB, args [][]byte) ([][]byte, error) {
+	if len(args) < 1 {
+		return nil, errWrongArgs("xgroup")
+	}
+
+	sub := strings.ToUpper(string(args[0]))
+	if sub == "HELP" {
+		if !isHelpSubcommand(args) {
+			return nil, errUnknownSubcommand("XGROUP", args[0])
+		}
+		return subcommandHelp("XGROUP",
+			"CREATE <key> <groupname> <id|$> [MKSTREAM]",
+			"    Create a new consumer group. Options are:",
+			"    * MKSTREAM",
+			"      Create the empty stream if it does not exist.",
+			"CREATECONSUMER <key> <groupname> <consumer>",
+			"    Create a new consumer in the specified group.",
+			"DELCONSUMER <key> <groupname> <consumer>",
+			"    Remove the specified consumer.",
+			"DESTROY <key> <groupname>",
+			"    Remove the specified group.",
+			"SETID <key> <groupname> <id|$>",
+			"    Set the current group ID.",
+		), nil
+	}
+
+	arity := map[string]int{"CREATE": 4, "SETID": 4, "DESTROY": 3, "CREATECONSUMER": 4, "DELCONSUMER": 4}
+	want, ok := arity[sub]
+	mkStream := sub == "CREATE" && len(args) == 5 && strings.EqualFold(string(args[4]), "MKSTREAM")
+	if !ok || (len(args) != want && !mkStream) {
+		return nil, errUnknownSubcommand("XGROUP", args[0])
+	}
+
+	key, group := string(args[1]), string(args[2])
+	stream, err := db.getStream(key)
+	if err != nil {
+		return nil, err
+	}
+	if stream == nil && !mkStream {
+		return nil, errors.New("ERR The XGROUP subcommand requires the key to exist. " +
+			"Note that for CREATE you may want to use the MKSTREAM option to create an empty stream automatically.")
+	}
+
+	switch sub {
+	case "CREATE":
+		entity := datastruct.MakeStream()
+		if stream != nil {
+			entity = nil
+		} else {
+			stream = entity.Data.(*datastruct.Stream)
+		}
+		id, err := parseGroupStartID(stream, string(args[3]))
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := stream.CreateGroup(group, id); !ok {
+			return nil, errors.New("BUSYGROUP Consumer Group name already exists")
+		}
+		if entity != nil {
+			db.PutEntity(key, entity)
+		}
+		return okResponse, nil
+	case "DESTROY":
+		if !stream.DestroyGroup(group) {
+			return zeroResponse, nil
+		}
+		return oneResponse, nil
+	}
+
+	g := stream.Group(group)
+	if g == nil {
+		return nil, errors.New("NOGROUP No such consumer group '" + group + "' for key name '" + key + "'")
+	}
+	switch sub {
+	case "SETID":
+		id, err := parseGroupStartID(stream, string(args[3]))
+		if err != nil {
+			return nil, err
+		}
+		g.LastDelivered = id
+		return okResponse, nil
+	case "CREATECONSUMER":
+		if _, created := g.CreateConsumer(string(args[3]), db.now().UnixMilli()); !created {
+			return zeroResponse, nil
+		}
+		return oneResponse, nil
+	default: // DELCONSUMER
+		pending := g.DeleteConsumer(string(args[3]))
+		return [][]byte{[]byte(strconv.Itoa(max(pending, 0)))}, nil
+	}
+}
+
+// execXReadGroup implements
+// XREADGROUP GROUP group consumer [COUNT count] [BLOCK milliseconds] [NOACK] STREAMS key [key ...] id [id ...]
+//
+// The ID ">" reads the entries never delivered to the group and adds them to
+// the consumer's pending entries; any other ID reads the consumer's pending
+// entries after it.
+func execXReadGroup(db *DB, args [][]byte) ([][]byte, error) {
+	opts, err := parseStreamReadOptions(args, true)
+	if err != nil {
+		return nil, err
+	}
+
+	// Check every stream before delivering anything
+	streams := make([]*datastruct.Stream, len(opts.keys))
+	groups := make([]*datastruct.StreamGroup, len(opts.keys))
+	history := make([]datastruct.StreamID, len(opts.keys))
+	onlyNew := true
+	for j, key := range opts.keys {
+		streams[j], groups[j], err = db.getStreamGroup(string(key), opts.group, "XREADGROUP")
+		if err != nil {
+			return nil, err
+		}
+		switch string(opts.ids[j]) {
+		case ">":
+		case "$":
+			return nil, errors.New("ERR The $ ID is meaningless in the context of XREADGROUP: " +
+				"you want to read the history of this consumer by specifying a proper ID, " +
+				"or use the > ID to get new messages. The $ ID would just return an empty result set.")
+		default:
+			onlyNew = false
+			if history[j], err = datastruct.ParseStreamID(string(opts.ids[j]), 0); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	now := db.now().UnixMilli()
+	var result [][]byte
+	for j, key := range opts.keys {
+		stream, group := streams[j], groups[j]
+		consumer, _ := group.CreateConsumer(opts.consumer, now)
+		consumer.SeenTime = now
+
+		if string(opts.ids[j]) != ">" {
+			// History reads always report the stream, even without entries
+			start, ok := history[j].Next()
+			var pending []*datastruct.StreamPendingEntry
+			if ok {
+				pending = group.Pending(start, datastruct.MaxStreamID, opts.count, consumer)
+			}
+			result = append(result, key, []byte(strconv.Itoa(len(pending))))
+			for _, p := range pending {
+				group.Claim(consumer, p.ID, now, true)
+				result = appendPendingEntry(result, stream, p.ID)
+			}
+			continue
+		}
+
+		start, ok := group.LastDelivered.Next()
+		if !ok {
+			continue
+		}
+		entries := stream.Range(start, datastruct.MaxStreamID, opts.count, false)
+		if len(entries) == 0 {
+			continue
+		}
+		group.LastDelivered = entries[len(entries)-1].ID
+		if !opts.noAck {
+			for _, entry := range entries {
+				group.Claim(consumer, entry.ID, now, true)
+			}
+		}
+		result = append(result, key, []byte(strconv.Itoa(len(entries))))
+		result = appendStreamEntries(result, entries)
+	}
+
+	if result == nil && opts.block && onlyNew {
+		return nil, &blockedCommand{
+			keys:    bytesToStrings(opts.keys),
+			timeout: opts.timeout,
+			cmdLine: StripBlockOption(append([][]byte{[]byte("XREADGROUP")}, args...)),
+		}
+	}
+	return result, nil
+}
+
+// appendPendingEntry appends the entry of a pending ID to a result, with -1
+// items if the entry was deleted from the stream
+func appendPendingEntry(result [][]byte, stream *datastruct.Stream, id datastruct.StreamID) [][]byte {
+	entry, ok := stream.Entry(id)
+	if !ok {
+		return append(result, []byte(id.String()), []byte("-1"))
+	}
+	return appendStreamEntries(result, []datastruct.StreamEntry{entry})
+}
+
+// execXAck implements XACK key group id [id ...]
+func execXAck(db *DB, args [][]byte) ([][]byte, error) {
+	if len(args) < 3 {
+		return nil, errWrongArgs("xack")
+	}
+
+	ids := make([]datastruct.StreamID, len(args)-2)
+	for i, arg := range args[2:] {
+		id, err := datastruct.ParseStreamID(string(arg), 0)
+		if err != nil {
+			return nil, err
+		}
+		ids[i] = id
+	}
+
+	stream, err := db.getStream(string(args[0]))
+	if err != nil {
+		return nil, err
+	}
+	if stream == nil || stream.Group(string(args[1])) == nil {
+		return zeroResponse, nil
+	}
+	group := stream.Group(string(args[1]))
+
+	acked := 0
+	for _, id := range ids {
+		if group.Ack(id) {
+			acked++
+		}
+	}
+	return [][]byte{[]byte(strconv.Itoa(acked))}, nil
+}
+
+// execXPending implements XPENDING key group [[IDLE min-idle-time] start end count [consumer]]
+func execXPending(db *DB, args [][]byte) ([][]byte, error) {
+	if len(args) < 2 {
+		return nil, errWrongArgs("xpending")
+	}
+	key, groupName := string(args[0]), string(args[1])
+
+	if len(args) == 2 {
+		_, group, err := db.getStreamGroup(key, groupName, "")
+		if err != nil {
+			return nil, err
+		}
+		return pendingSummary(group), nil
+	}
+
+	// Extended form
+	rest := args[2:]
+	var minIdle int64
+	if strings.EqualFold(string(rest[0]), "IDLE") {
+		if len(rest) < 2 {
+			return nil, ErrSyntax
+		}
+		n, err := strconv.ParseInt(string(rest[1]), 10, 64)
+		if err != nil {
+			return nil, ErrNotInteger
+		}
+		minIdle = n
+		rest = rest[2:]
+	}
+	if len(rest) != 3 && len(rest) != 4 {
+		return nil, ErrSyntax
+	}
+	start, err := parseStreamRangeBound(string(rest[0]), false)
+	if err != nil {
+		return nil, err
+	}
+	end, err := parseStreamRangeBound(string(rest[1]), true)
+	if err != nil {
+		return nil, err
+	}
+	count, err := strconv.ParseInt(string(rest[2]), 10, 64)
+	if err != nil {
+		return nil, ErrNotInteger
+	}
+
+	_, group, err := db.getStreamGroup(key, groupName, "")
+	if err != nil {
+		return nil, err
+	}
+	var consumer *datastruct.StreamConsumer
+	if len(rest) == 4 {
+		if consumer = group.Consumer(string(rest[3])); consumer == nil {
+			return [][]byte{}, nil
+		}
+	}
+	if count <= 0 {
+		return [][]byte{}, nil
+	}
+
+	now := db.now().UnixMilli()
+	pending := group.Pending(start, end, 0, consumer)
+	result := make([][]byte, 0)
+	for _, p := range pending {
+		if int64(len(result)/4) >= count {
+			break
+		}
+		idle := max(now-p.DeliveryTime, 0)
+		if idle < minIdle {
+			continue
+		}
+		result = append(result,
+			[]byte(p.ID.String()),
+			[]byte(p.Consumer),
+			[]byte(strconv.FormatInt(idle, 10)),
+			[]byte(strconv.FormatInt(p.DeliveryCount, 10)))
+	}
+	return result, nil
+}
+
+// pendingSummary returns the summary form of XPENDING
+func pendingSummary(group *datastruct.StreamGroup) [][]byte {
+	pending := group.Pending(datastruct.StreamID{}, datastruct.MaxStreamID, 0, nil)
+	if len(pending) == 0 {
+		return [][]byte{[]byte("0"), nil, nil}
+	}
+
+	result := [][]byte{
+		[]byte(strconv.Itoa(len(pending))),
+		[]byte(pending[0].ID.String()),
+		[]byte(pending[len(pending)-1].ID.String()),
+	}
+	for _, consumer := range group.Consumers() {
+		if n := consumer.PendingCount(); n > 0 {
+			result = append(result, []byte(consumer.Name), []byte(strconv.Itoa(n)))
+		}
+	}
+	return result
+}
+
+// xclaimOptions holds the parsed options of XCLAIM
+type xclaimOptions struct {
+	deliveryTime int64 // -1 to use the current time
+	retryCount   int64 // -1 to count the delivery
+	force        bool
+	justID       bool
+	lastID       *datastruct.StreamID
+}
+
+// execXClaim implements
+// XCLAIM key group consumer min-idle-time id [id ...] [IDLE ms] [TIME unix-time-milliseconds]
+// [RETRYCOUNT count] [FORCE] [JUSTID] [LASTID id]
+func execXClaim(db *DB, args [][]byte) ([][]byte, error) {
+	if len(args) < 5 {
+		return nil, errWrongArgs("xclaim")
+	}
+	minIdle, err := strconv.ParseInt(string(args[3]), 10, 64)
+	if err != nil {
+		return nil, errors.New("ERR Invalid min-idle-time argument for XCLAIM")
+	}
+
+	// IDs come first, then the options
+	var ids []datastruct.StreamID
+	i := 4
+	for ; i < len(args); i++ {
+		id, err := datastruct.ParseStreamID(string(args[i]), 0)
+		if err != nil {
+			break
+		}
+		ids = append(ids, id)
+	}
+	if len(ids) == 0 {
+		return nil, datastruct.ErrInvalidStreamID
+	}
+
+	now := db.now().UnixMilli()
+	opts := xclaimOptions{deliveryTime: -1, retryCount: -1}
+	for ; i < len(args); i++ {
+		opt := strings.ToUpper(string(args[i]))
+		switch {
+		case opt == "FORCE":
+			opts.force = true
+		case opt == "JUSTID":
+			opts.justID = true
+		case (opt == "IDLE" || opt == "TIME" || opt == "RETRYCOUNT") && i+1 < len(args):
+			n, err := strconv.ParseInt(string(args[i+1]), 10, 64)
+			if err != nil {
+				return nil, errors.New("ERR Invalid " + opt + " option argument for XCLAIM")
+			}
+			switch opt {
+			case "IDLE":
+				opts.deliveryTime = now - n
+			case "TIME":
+				opts.deliveryTime = n
+			default:
+				opts.retryCount = n
+			}
+			i++
+		case opt == "LASTID" && i+1 < len(args):
+			id, err := datastruct.ParseStreamID(string(args[i+1]), 0)
+			if err != nil {
+				return nil, err
+			}
+			opts.lastID = &id
+			i++
+		default:
+			return nil, errors.New("ERR Unrecognized XCLAIM option '" + truncateErrorArg(args[i]) + "'")
+		}
+	}
+
+	stream, group, err := db.getStreamGroup(string(args[0]), string(args[1]), "")
+	if err != nil {
+		return nil, err
+	}
+	if opts.lastID != nil && group.LastDelivered.Less(*opts.lastID) {
+		group.LastDelivered = *opts.lastID
+	}
+
+	consumer, _ := group.CreateConsumer(string(args[2]), now)
+	consumer.SeenTime = now
+	result := make([][]byte, 0)
+	for _, id := range ids {
+		pending, ok := group.PendingEntry(id)
+		if !ok {
+			if !opts.force {
+				continue
+			}
+		} else {
+			if now-pending.DeliveryTime < minIdle {
+				continue
+			}
+			if _, exists := stream.Entry(id); !exists && !opts.force {
+				// Deleted entries cannot be delivered again
+				group.Ack(id)
+				continue
+			}
+		}
+
+		pending = group.Claim(consumer, id, now, !opts.justID && opts.retryCount < 0)
+		if opts.deliveryTime >= 0 {
+			pending.DeliveryTime = opts.deliveryTime
+		}
+		if opts.retryCount >= 0 {
+			pending.DeliveryCount = opts.retryCount
+		}
+		if opts.justID {
+			result = append(result, []byte(id.String()))
+		} else {
+			result = appendPendingEntry(result, stream, id)
+		}
+	}
+	return result, nil
+}
+
+// execXAutoClaim implements XAUTOCLAIM key group consumer min-idle-time start [COUNT count] [JUSTID]
+func execXAutoClaim(db *DB, args [][]byte) ([][]byte, error) {
+	if len(args) < 5 {
+		return nil, errWrongArgs("xautoclaim")
+	}
+	minIdle, err := strconv.ParseInt(string(args[3]), 10, 64)
+	if err != nil {
+		return nil, errors.New("ERR Invalid min-idle-time argument for XAUTOCLAIM")
+	}
+	start, err := parseStreamRangeBound(string(args[4]), false)
+	if err != nil {
+		return nil, err
+	}
+
+	count := defaultAutoClaimCount
+	justID := false
+	for i := 5; i < len(args); i++ {
+		opt := strings.ToUpper(string(args[i]))
+		switch {
+		case opt == "JUSTID":
+			justID = true
+		case opt == "COUNT" && i+1 < len(args):
+			n, err := strconv.ParseInt(string(args[i+1]), 10, 64)
+			if err != nil || n < 1 || n > math.MaxInt32/autoClaimAttemptsFactor {
+				return nil, errors.New("ERR COUNT must be > 0")
+			}
+			count = int(n)
+			i++
+		default:
+			return nil, ErrSyntax
+		}
+	}
+
+	stream, group, err := db.getStreamGroup(string(args[0]), string(args[1]), "")
+	if err != nil {
+		return nil, err
+	}
+
+	now := db.now().UnixMilli()
+	consumer, _ := group.CreateConsumer(string(args[2]), now)
+	consumer.SeenTime = now
+
+	// Scan one entry past the attempts to find the next cursor
+	attempts := count * autoClaimAttemptsFactor
+	cursor := datastruct.StreamID{}
+	var claimed, deleted [][]byte
+	claimedCount := 0
+	for i, pending := range group.Pending(start, datastruct.MaxStreamID, attempts+1, nil) {
+		if i == attempts || claimedCount == count {
+			cursor = pending.ID
+			break
+		}
+		if now-pending.DeliveryTime < minIdle {
+			continue
+		}
+		id := pending.ID
+		if _, exists := stream.Entry(id); !exists {
+			group.Ack(id)
+			deleted = append(deleted, []byte(id.String()))
+			continue
+		}
+		group.Claim(consumer, id, now, !justID)
+		claimedCount++
+		if justID {
+			claimed = append(claimed, []byte(id.String()))
+		} else {
+			claimed = appendPendingEntry(claimed, stream, id)
+		}
+	}
+
+	result := [][]byte{[]byte(cursor.String()), []byte(strconv.Itoa(claimedCount))}
+	result = append(result, claimed...)
+	return append(result, deleted...), nil
+}
+
+// StreamClaimCommands returns the commands that bring a slave to the state
+// of the pending entries an XCLAIM or XAUTOCLAIM command may have changed,
+// since replaying the command itself depends on idle times. Each entry
+// still pending is claimed with FORCE, keeping its owner, delivery time and
+// count; entries no longer pending are acknowledged. XAUTOCLAIM covers the
+// pending entries it may have scanned from its start ID. The last delivered
+// ID of the group, which XCLAIM LASTID may have moved, goes along.
+func (db *DB) StreamClaimCommands(cmdLine [][]byte) [][][]byte {
+	if len(cmdLine) < 6 {
+		return nil
+	}
+	_, group, err := db.getStreamGroup(string(cmdLine[1]), string(cmdLine[2]), "")
+	if err != nil {
+		return nil
+	}
+
+	var ids []datastruct.StreamID
+	if strings.EqualFold(string(cmdLine[0]), "XAUTOCLAIM") {
+		start, err := parseStreamRangeBound(string(cmdLine[5]), false)
+		if err != nil {
+			return nil
+		}
+		count := defaultAutoClaimCount
+		for i := 6; i+1 < len(cmdLine); i++ {
+			if strings.EqualFold(string(cmdLine[i]), "COUNT") {
+				count, _ = strconv.Atoi(string(cmdLine[i+1]))
+			}
+		}
+		for _, pending := range group.Pending(start, datastruct.MaxStreamID, count*autoClaimAttemptsFactor, nil) {
+			ids = append(ids, pending.ID)
+		}
+	} else {
+		for _, arg := range cmdLine[5:] {
+			id, err := datastruct.ParseStreamID(string(arg), 0)
+			if err != nil {
+				break
+			}
+			ids = append(ids, id)
+		}
+	}
+
+	// XCLAIM LASTID may have moved the group forward
+	key, groupName := cmdLine[1], cmdLine[2]
+	lastID := []byte(group.LastDelivered.String())
+	var cmds [][][]byte
+	claimed := false
+	for _, id := range ids {
+		pending, ok := group.PendingEntry(id)
+		if !ok {
+			cmds = append(cmds, [][]byte{[]byte("XACK"), key, groupName, []byte(id.String())})
+			continue
+		}
+		cmds = append(cmds, append(claimCommand(key, groupName, pending), []byte("LASTID"), lastID))
+		claimed = true
+	}
+	if !claimed {
+		cmds = append(cmds, [][]byte{[]byte("XGROUP"), []byte("SETID"), key, groupName, lastID})
+	}
+	return cmds
+}
+
+// claimCommand returns the XCLAIM command that recreates a pending entry
+func claimCommand(key, group []byte, pending *datastruct.StreamPendingEntry) [][]byte {
+	return [][]byte{[]byte("XCLAIM"), key, group, []byte(pending.Consumer), []byte("0"),
+		[]byte(pending.ID.String()),
+		[]byte("TIME"), []byte(strconv.FormatInt(pending.DeliveryTime, 10)),
+		[]byte("RETRYCOUNT"), []byte(strconv.FormatInt(pending.DeliveryCount, 10)),
+		[]byte("FORCE"), []byte("JUSTID")}
+}
+
+// rebuildStreamGroups returns the commands that recreate the consumer
+// groups of a stream, their consumers and pending entries
+func rebuildStreamGroups(key string, stream *datastruct.Stream) [][][]byte {
+	var cmds [][][]byte
+	for _, group := range stream.Groups() {
+		name := []byte(group.Name)
+		cmds = append(cmds, [][]byte{[]byte("XGROUP"), []byte("CREATE"), []byte(key), name,
+			[]byte(group.LastDelivered.String())})
+		for _, consumer := range group.Consumers() {
+			cmds = append(cmds, [][]byte{[]byte("XGROUP"), []byte("CREATECONSUMER"), []byte(key), name,
+				[]byte(consumer.Name)})
+		}
+		for _, pending := range group.Pending(datastruct.StreamID{}, datastruct.MaxStreamID, 0, nil) {
+			cmds = append(cmds, claimCommand([]byte(key), name, pending))
+		}
+	}
+	return cmds
+}
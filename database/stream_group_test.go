@@ -0,0 +1,287 @@
+package database
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestXGroupCreate(t *testing.T) {
+	db := MakeDB()
+	defer db.Close()
+
+	if _, err := db.ExecCommand("XGROUP", "CREATE", "s", "g", "$"); err == nil ||
+		!strings.Contains(err.Error(), "requires the key to exist") {
+		t.Errorf("XGROUP CREATE on a missing key should fail, got %v", err)
+	}
+	if _, err := db.ExecCommand("XGROUP", "CREATE", "s", "g", "$", "MKSTREAM"); err != nil {
+		t.Fatalf("XGROUP CREATE MKSTREAM failed: %v", err)
+	}
+	if result, _ := db.ExecCommand("TYPE", "s"); string(result[0]) != "stream" {
+		t.Errorf("MKSTREAM should create an empty stream, got TYPE %s", result[0])
+	}
+	if _, err := db.ExecCommand("XGROUP", "CREATE", "s", "g", "0"); err == nil ||
+		err.Error() != "BUSYGROUP Consumer Group name already exists" {
+		t.Errorf("Expected BUSYGROUP, got %v", err)
+	}
+
+	if result, _ := db.ExecCommand("XGROUP", "CREATECONSUMER", "s", "g", "c"); string(result[0]) != "1" {
+		t.Errorf("Expected CREATECONSUMER 1, got %s", result[0])
+	}
+	if result, _ := db.ExecCommand("XGROUP", "CREATECONSUMER", "s", "g", "c"); string(result[0]) != "0" {
+		t.Errorf("Expected CREATECONSUMER 0 for an existing consumer, got %s", result[0])
+	}
+	if _, err := db.ExecCommand("XGROUP", "SETID", "s", "nope", "0"); err == nil ||
+		!strings.HasPrefix(err.Error(), "NOGROUP") {
+		t.Errorf("Expected NOGROUP, got %v", err)
+	}
+	if result, _ := db.ExecCommand("XGROUP", "DESTROY", "s", "g"); string(result[0]) != "1" {
+		t.Errorf("Expected DESTROY 1, got %s", result[0])
+	}
+	if result, _ := db.ExecCommand("XGROUP", "DESTROY", "s", "g"); string(result[0]) != "0" {
+		t.Errorf("Expected DESTROY 0 for a missing group, got %s", result[0])
+	}
+	if _, err := db.ExecCommand("XGROUP", "FOO"); err == nil || !strings.Contains(err.Error(), "Try XGROUP HELP") {
+		t.Errorf("Expected an unknown subcommand error, got %v", err)
+	}
+}
+
+func TestXReadGroupDeliversOnceAndTracksPending(t *testing.T) {
+	db := MakeDB()
+	defer db.Close()
+
+	for _, id := range []string{"1-0", "2-0", "3-0"} {
+		db.ExecCommand("XADD", "s", id, "f", "v")
+	}
+	db.ExecCommand("XGROUP", "CREATE", "s", "g", "0")
+
+	result, err := db.ExecCommand("XREADGROUP", "GROUP", "g", "alice", "COUNT", "2", "STREAMS", "s", ">")
+	if err != nil {
+		t.Fatalf("XREADGROUP failed: %v", err)
+	}
+	if got := strings.Join(streamIDs(t, result[2:]), " "); got != "1-0 2-0" {
+		t.Errorf("alice should get 1-0 2-0, got %s", got)
+	}
+	result, _ = db.ExecCommand("XREADGROUP", "GROUP", "g", "bob", "STREAMS", "s", ">")
+	if got := strings.Join(streamIDs(t, result[2:]), " "); got != "3-0" {
+		t.Errorf("bob should get 3-0, got %s", got)
+	}
+	if result, _ := db.ExecCommand("XREADGROUP", "GROUP", "g", "bob", "STREAMS", "s", ">"); result != nil {
+		t.Errorf("Nothing is left to deliver, got %q", result)
+	}
+
+	// History reads return the consumer's own pending entries
+	result, _ = db.ExecCommand("XREADGROUP", "GROUP", "g", "alice", "STREAMS", "s", "0")
+	if got := strings.Join(streamIDs(t, result[2:]), " "); got != "1-0 2-0" {
+		t.Errorf("alice's history should be 1-0 2-0, got %s", got)
+	}
+
+	summary, _ := db.ExecCommand("XPENDING", "s", "g")
+	want := []string{"3", "1-0", "3-0", "alice", "2", "bob", "1"}
+	if len(summary) != len(want) {
+		t.Fatalf("Expected XPENDING %v, got %q", want, summary)
+	}
+	for i := range want {
+		if string(summary[i]) != want[i] {
+			t.Errorf("XPENDING item %d: expected %s, got %s", i, want[i], summary[i])
+		}
+	}
+
+	if result, _ := db.ExecCommand("XACK", "s", "g", "1-0", "1-0", "9-0"); string(result[0]) != "1" {
+		t.Errorf("Expected XACK 1, got %s", result[0])
+	}
+	detail, _ := db.ExecCommand("XPENDING", "s", "g", "-", "+", "10", "alice")
+	if len(detail) != 4 || string(detail[0]) != "2-0" || string(detail[1]) != "alice" || string(detail[3]) != "2" {
+		t.Errorf("Expected 2-0 pending for alice with 2 deliveries, got %q", detail)
+	}
+
+	if _, err := db.ExecCommand("XREADGROUP", "GROUP", "nope", "c", "STREAMS", "s", ">"); err == nil ||
+		err.Error() != "NOGROUP No such key 's' or consumer group 'nope' in XREADGROUP with GROUP option" {
+		t.Errorf("Expected NOGROUP, got %v", err)
+	}
+	if result, _ := db.ExecCommand("XPENDING", "s", "g"); string(result[0]) != "2" {
+		t.Errorf("Expected 2 entries pending, got %s", result[0])
+	}
+}
+
+// TestConsumerCrashIsRecoveredByClaim has two consumers share a group; one
+// of them crashes with entries pending and the other takes them over
+func TestConsumerCrashIsRecoveredByClaim(t *testing.T) {
+	db := MakeDB()
+	defer db.Close()
+
+	for _, id := range []string{"1-0", "2-0", "3-0", "4-0"} {
+		db.ExecCommand("XADD", "jobs", id, "job", id)
+	}
+	db.ExecCommand("XGROUP", "CREATE", "jobs", "workers", "0")
+
+	// Each worker takes two jobs; the second one crashes before acknowledging
+	db.ExecCommand("XREADGROUP", "GROUP", "workers", "w1", "COUNT", "2", "STREAMS", "jobs", ">")
+	db.ExecCommand("XREADGROUP", "GROUP", "workers", "w2", "COUNT", "2", "STREAMS", "jobs", ">")
+	db.ExecCommand("XACK", "jobs", "workers", "1-0", "2-0")
+
+	// The jobs of w2 are not idle long enough yet
+	if result, _ := db.ExecCommand("XCLAIM", "jobs", "workers", "w1", "60000", "3-0"); len(result) != 0 {
+		t.Errorf("Fresh entries should not be claimed, got %q", result)
+	}
+	result, _ := db.ExecCommand("XAUTOCLAIM", "jobs", "workers", "w1", "60000", "0")
+	if string(result[0]) != "0-0" || string(result[1]) != "0" {
+		t.Errorf("XAUTOCLAIM should claim nothing yet, got %q", result)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	result, err := db.ExecCommand("XCLAIM", "jobs", "workers", "w1", "10", "3-0")
+	if err != nil {
+		t.Fatalf("XCLAIM failed: %v", err)
+	}
+	if got := strings.Join(streamIDs(t, result), " "); got != "3-0" {
+		t.Errorf("w1 should claim 3-0, got %s", got)
+	}
+	result, _ = db.ExecCommand("XAUTOCLAIM", "jobs", "workers", "w1", "10", "0", "JUSTID")
+	if len(result) != 3 || string(result[0]) != "0-0" || string(result[1]) != "1" || string(result[2]) != "4-0" {
+		t.Errorf("XAUTOCLAIM should hand 4-0 to w1, got %q", result)
+	}
+
+	detail, _ := db.ExecCommand("XPENDING", "jobs", "workers", "-", "+", "10")
+	if len(detail) != 8 || string(detail[1]) != "w1" || string(detail[5]) != "w1" {
+		t.Fatalf("Both jobs should now be pending for w1, got %q", detail)
+	}
+	// XCLAIM counts a delivery, XAUTOCLAIM JUSTID does not
+	if string(detail[3]) != "2" || string(detail[7]) != "1" {
+		t.Errorf("Expected delivery counts 2 and 1, got %s and %s", detail[3], detail[7])
+	}
+
+	db.ExecCommand("XACK", "jobs", "workers", "3-0", "4-0")
+	if result, _ := db.ExecCommand("XPENDING", "jobs", "workers"); string(result[0]) != "0" || result[1] != nil {
+		t.Errorf("Nothing should be pending, got %q", result)
+	}
+}
+
+func TestXAutoClaimReportsDeletedEntries(t *testing.T) {
+	db := MakeDB()
+	defer db.Close()
+
+	db.ExecCommand("XADD", "s", "1-0", "f", "v")
+	db.ExecCommand("XADD", "s", "2-0", "f", "v")
+	db.ExecCommand("XGROUP", "CREATE", "s", "g", "0")
+	db.ExecCommand("XREADGROUP", "GROUP", "g", "c", "STREAMS", "s", ">")
+	db.ExecCommand("XADD", "s", "MAXLEN", "2", "3-0", "f", "v")
+
+	result, _ := db.ExecCommand("XAUTOCLAIM", "s", "g", "c2", "0", "-", "COUNT", "1")
+	// 1-0 was trimmed, 2-0 is claimed
+	want := []string{"0-0", "1", "2-0", "2", "f", "v", "1-0"}
+	if len(result) != len(want) {
+		t.Fatalf("Expected %v, got %q", want, result)
+	}
+	for i := range want {
+		if string(result[i]) != want[i] {
+			t.Errorf("Item %d: expected %s, got %s", i, want[i], result[i])
+		}
+	}
+}
+
+func TestBlockingXReadIsWokenByXAdd(t *testing.T) {
+	db := MakeDB()
+	defer db.Close()
+
+	done := make(chan [][]byte, 1)
+	go func() {
+		result, _ := db.ExecCommand("XREAD", "BLOCK", "0", "STREAMS", "s", "$")
+		done <- result
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case result := <-done:
+		t.Fatalf("XREAD should block, returned %q", result)
+	default:
+	}
+
+	db.ExecCommand("XADD", "s", "1-0", "f", "v")
+	select {
+	case result := <-done:
+		if len(result) < 3 || string(result[0]) != "s" || string(result[2]) != "1-0" {
+			t.Errorf("Expected the new entry, got %q", result)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("XADD did not wake the blocked XREAD")
+	}
+}
+
+func TestBlockingXReadGroupTimesOut(t *testing.T) {
+	db := MakeDB()
+	defer db.Close()
+
+	db.ExecCommand("XGROUP", "CREATE", "s", "g", "$", "MKSTREAM")
+	start := time.Now()
+	result, err := db.ExecCommand("XREADGROUP", "GROUP", "g", "c", "BLOCK", "50", "STREAMS", "s", ">")
+	if err != nil || result != nil {
+		t.Errorf("Expected a nil result on timeout, got %q, %v", result, err)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("XREADGROUP returned after %v, before its timeout", elapsed)
+	}
+
+	// Blocking commands never block inside a transaction
+	ms := NewMultiState(db)
+	db.ExecWithState(ms, [][]byte{[]byte("MULTI")})
+	db.ExecWithState(ms, [][]byte{[]byte("XREAD"), []byte("BLOCK"), []byte("0"), []byte("STREAMS"), []byte("s"), []byte("$")})
+	if _, err := db.ExecWithState(ms, [][]byte{[]byte("EXEC")}); err != nil {
+		t.Errorf("EXEC failed: %v", err)
+	}
+}
+
+func TestStreamGroupsRebuild(t *testing.T) {
+	db := MakeDB()
+	defer db.Close()
+
+	db.ExecCommand("XADD", "s", "1-0", "f", "v")
+	db.ExecCommand("XADD", "s", "2-0", "f", "v")
+	db.ExecCommand("XGROUP", "CREATE", "s", "g", "0")
+	db.ExecCommand("XGROUP", "CREATECONSUMER", "s", "g", "idle")
+	db.ExecCommand("XREADGROUP", "GROUP", "g", "c", "COUNT", "1", "STREAMS", "s", ">")
+	db.ExecCommand("XGROUP", "CREATE", "fresh", "g", "$", "MKSTREAM")
+
+	target := MakeDB()
+	defer target.Close()
+	for _, key := range []string{"s", "fresh"} {
+		entity, _ := db.GetEntity(key)
+		for _, cmd := range RebuildCommands(key, entity) {
+			if _, err := target.Exec(cmd); err != nil {
+				t.Fatalf("Replaying %q failed: %v", cmd, err)
+			}
+		}
+	}
+
+	for _, cmd := range [][]string{
+		{"XPENDING", "s", "g", "-", "+", "10"},
+		{"XPENDING", "s", "g"},
+	} {
+		want, _ := db.ExecCommand(cmd[0], cmd[1:]...)
+		got, _ := target.ExecCommand(cmd[0], cmd[1:]...)
+		if len(got) != len(want) {
+			t.Fatalf("%v: expected %q, got %q", cmd, want, got)
+		}
+		for i := range want {
+			// Idle times may differ by the time the replay took
+			if i != 2 || cmd[2] != "g" || len(cmd) == 3 {
+				if string(got[i]) != string(want[i]) {
+					t.Errorf("%v item %d: expected %s, got %s", cmd, i, want[i], got[i])
+				}
+			}
+		}
+	}
+	result, _ := target.ExecCommand("XREADGROUP", "GROUP", "g", "c2", "STREAMS", "s", ">")
+	if got := strings.Join(streamIDs(t, result[2:]), " "); got != "2-0" {
+		t.Errorf("The rebuilt group should deliver 2-0 next, got %s", got)
+	}
+	if result, _ := target.ExecCommand("XGROUP", "CREATECONSUMER", "s", "g", "idle"); string(result[0]) != "0" {
+		t.Error("Consumers without pending entries should be rebuilt")
+	}
+	if result, _ := target.ExecCommand("XLEN", "fresh"); string(result[0]) != "0" {
+		t.Errorf("Expected the empty stream to be rebuilt, got XLEN %s", result[0])
+	}
+	if _, err := target.ExecCommand("XGROUP", "CREATE", "fresh", "g", "0"); err == nil {
+		t.Error("The group of the empty stream should be rebuilt")
+	}
+}
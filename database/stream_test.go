@@ -0,0 +1,295 @@
+package database
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/wangbo/gocache/datastruct"
+)
+
+// streamIDs returns the entry IDs of a flattened XRANGE/XREVRANGE result
+func streamIDs(t *testing.T, result [][]byte) []string {
+	t.Helper()
+	var ids []string
+	for len(result) >= 2 {
+		n, err := strconv.Atoi(string(result[1]))
+		if err != nil || n > len(result)-2 {
+			t.Fatalf("Malformed stream result %q", result)
+		}
+		ids = append(ids, string(result[0]))
+		result = result[2+n:]
+	}
+	return ids
+}
+
+func TestXAddGeneratesIncreasingIDs(t *testing.T) {
+	db := MakeDB()
+	defer db.Close()
+
+	var last datastruct.StreamID
+	for i := 0; i < 1000; i++ {
+		result, err := db.ExecCommand("XADD", "s", "*", "n", strconv.Itoa(i))
+		if err != nil {
+			t.Fatalf("XADD failed: %v", err)
+		}
+		id, err := datastruct.ParseStreamID(string(result[0]), 0)
+		if err != nil {
+			t.Fatalf("XADD returned an invalid ID %q", result[0])
+		}
+		if !last.Less(id) {
+			t.Fatalf("ID %v is not greater than %v", id, last)
+		}
+		last = id
+	}
+
+	if result, _ := db.ExecCommand("XLEN", "s"); string(result[0]) != "1000" {
+		t.Errorf("Expected XLEN 1000, got %s", result[0])
+	}
+}
+
+func TestXAddExplicitIDs(t *testing.T) {
+	db := MakeDB()
+	defer db.Close()
+
+	tooSmall := "ERR The ID specified in XADD is equal or smaller than the target stream top item"
+	for _, tc := range []struct {
+		id      string
+		want    string
+		wantErr string
+	}{
+		{"0-0", "", "ERR The ID specified in XADD must be greater than 0-0"},
+		{"0-*", "0-1", ""},
+		{"5", "5-0", ""},
+		{"5-*", "5-1", ""},
+		{"5-1", "", tooSmall},
+		{"4-9", "", tooSmall},
+		{"4-*", "", tooSmall},
+		{"5-3", "5-3", ""},
+		{"6-*", "6-0", ""},
+		{"abc", "", "ERR Invalid stream ID specified as stream command argument"},
+		{"7-x", "", "ERR Invalid stream ID specified as stream command argument"},
+	} {
+		result, err := db.ExecCommand("XADD", "s", tc.id, "f", "v")
+		if tc.wantErr != "" {
+			if err == nil || err.Error() != tc.wantErr {
+				t.Errorf("XADD %s: expected error %q, got %v", tc.id, tc.wantErr, err)
+			}
+			continue
+		}
+		if err != nil || string(result[0]) != tc.want {
+			t.Errorf("XADD %s: expected %s, got %q, %v", tc.id, tc.want, result, err)
+		}
+	}
+
+	// "*" continues after the explicit IDs even if the clock is behind them
+	db.ExecCommand("XADD", "future", "99999999999999-5", "f", "v")
+	if result, _ := db.ExecCommand("XADD", "future", "*", "f", "v"); string(result[0]) != "99999999999999-6" {
+		t.Errorf("Expected 99999999999999-6, got %s", result[0])
+	}
+
+	for _, args := range [][]string{
+		{"s", "*"},
+		{"s", "*", "f"},
+		{"s", "*", "f", "v", "g"},
+		{"s", "MAXLEN", "*", "f", "v"},
+		{"s", "MAXLEN", "-1", "*", "f", "v"},
+	} {
+		if _, err := db.ExecCommand("XADD", args...); err == nil {
+			t.Errorf("XADD %v should fail", args)
+		}
+	}
+
+	db.ExecCommand("SET", "str", "v")
+	if _, err := db.ExecCommand("XADD", "str", "*", "f", "v"); err == nil || !strings.HasPrefix(err.Error(), "WRONGTYPE") {
+		t.Errorf("Expected WRONGTYPE, got %v", err)
+	}
+}
+
+func TestXAddMaxLen(t *testing.T) {
+	db := MakeDB()
+	defer db.Close()
+
+	for i := 1; i <= 10; i++ {
+		db.ExecCommand("XADD", "s", "MAXLEN", "3", strconv.Itoa(i), "n", strconv.Itoa(i))
+	}
+	result, _ := db.ExecCommand("XRANGE", "s", "-", "+")
+	if ids := streamIDs(t, result); strings.Join(ids, " ") != "8-0 9-0 10-0" {
+		t.Errorf("MAXLEN 3 should keep the 3 newest entries, got %v", ids)
+	}
+
+	// Approximate trimming keeps whole chunks
+	for i := 1; i <= 250; i++ {
+		db.ExecCommand("XADD", "approx", "MAXLEN", "~", "120", strconv.Itoa(i), "n", "v")
+	}
+	result, _ = db.ExecCommand("XLEN", "approx")
+	if n, _ := strconv.Atoi(string(result[0])); n < 120 || n >= 220 {
+		t.Errorf("MAXLEN ~ 120 should keep between 120 and 219 entries, got %d", n)
+	}
+	db.ExecCommand("XADD", "approx", "MAXLEN", "=", "5", "*", "n", "v")
+	if result, _ := db.ExecCommand("XLEN", "approx"); string(result[0]) != "5" {
+		t.Errorf("MAXLEN = 5 should trim exactly, got %s", result[0])
+	}
+
+	// MAXLEN 0 leaves an empty stream that keeps its last ID
+	db.ExecCommand("XADD", "s", "MAXLEN", "0", "20-0", "n", "v")
+	if result, _ := db.ExecCommand("XLEN", "s"); string(result[0]) != "0" {
+		t.Errorf("Expected an empty stream, got XLEN %s", result[0])
+	}
+	if result, _ := db.ExecCommand("TYPE", "s"); string(result[0]) != "stream" {
+		t.Errorf("An empty stream should still exist, got TYPE %s", result[0])
+	}
+	if _, err := db.ExecCommand("XADD", "s", "20-0", "n", "v"); err == nil {
+		t.Error("IDs must keep increasing after the stream was emptied")
+	}
+}
+
+func TestXRange(t *testing.T) {
+	db := MakeDB()
+	defer db.Close()
+
+	for _, id := range []string{"1-0", "1-1", "2-0", "2-5", "3-0"} {
+		db.ExecCommand("XADD", "s", id, "id", id)
+	}
+
+	for _, tc := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"XRANGE", "s", "-", "+"}, "1-0 1-1 2-0 2-5 3-0"},
+		{[]string{"XRANGE", "s", "2", "2"}, "2-0 2-5"},
+		{[]string{"XRANGE", "s", "1-1", "2-0"}, "1-1 2-0"},
+		{[]string{"XRANGE", "s", "(1-1", "(3-0"}, "2-0 2-5"},
+		{[]string{"XRANGE", "s", "(1", "+"}, "1-1 2-0 2-5 3-0"},
+		{[]string{"XRANGE", "s", "-", "+", "COUNT", "2"}, "1-0 1-1"},
+		{[]string{"XRANGE", "s", "-", "+", "COUNT", "0"}, ""},
+		{[]string{"XRANGE", "s", "3-1", "+"}, ""},
+		{[]string{"XRANGE", "s", "3", "1"}, ""},
+		{[]string{"XRANGE", "missing", "-", "+"}, ""},
+		{[]string{"XREVRANGE", "s", "+", "-"}, "3-0 2-5 2-0 1-1 1-0"},
+		{[]string{"XREVRANGE", "s", "(3-0", "-", "COUNT", "2"}, "2-5 2-0"},
+		{[]string{"XREVRANGE", "s", "2", "2"}, "2-5 2-0"},
+	} {
+		result, err := db.ExecCommand(tc.args[0], tc.args[1:]...)
+		if err != nil {
+			t.Errorf("%v failed: %v", tc.args, err)
+			continue
+		}
+		if got := strings.Join(streamIDs(t, result), " "); got != tc.want {
+			t.Errorf("%v: expected [%s], got [%s]", tc.args, tc.want, got)
+		}
+	}
+
+	result, _ := db.ExecCommand("XRANGE", "s", "2-5", "2-5")
+	if len(result) != 4 || string(result[2]) != "id" || string(result[3]) != "2-5" {
+		t.Errorf("Expected entry 2-5 with its fields, got %q", result)
+	}
+
+	for _, args := range [][]string{
+		{"s", "(-", "+"},
+		{"s", "(18446744073709551615-18446744073709551615", "+"},
+		{"s", "x", "+"},
+		{"s", "-", "+", "LIMIT", "1"},
+		{"s", "-", "+", "COUNT", "x"},
+		{"s", "-"},
+	} {
+		if _, err := db.ExecCommand("XRANGE", args...); err == nil {
+			t.Errorf("XRANGE %v should fail", args)
+		}
+	}
+	if _, err := db.ExecCommand("XRANGE", "s", "(0-0", "+"); err != nil {
+		t.Errorf("(0-0 is a valid exclusive start, got %v", err)
+	}
+	if _, err := db.ExecCommand("XRANGE", "s", "-", "(0-0"); err == nil || err.Error() != "ERR invalid end ID for the interval" {
+		t.Errorf("Expected invalid end ID error, got %v", err)
+	}
+}
+
+func TestXRead(t *testing.T) {
+	db := MakeDB()
+	defer db.Close()
+
+	for _, id := range []string{"1-0", "2-0", "3-0"} {
+		db.ExecCommand("XADD", "a", id, "f", "v")
+	}
+	db.ExecCommand("XADD", "b", "5-0", "f", "v")
+
+	result, err := db.ExecCommand("XREAD", "COUNT", "2", "STREAMS", "a", "b", "missing", "1-0", "0", "0")
+	if err != nil {
+		t.Fatalf("XREAD failed: %v", err)
+	}
+	// a: 2 entries after 1-0, b: 1 entry, missing: nothing
+	want := []string{"a", "2", "2-0", "2", "f", "v", "3-0", "2", "f", "v", "b", "1", "5-0", "2", "f", "v"}
+	if len(result) != len(want) {
+		t.Fatalf("Expected %v, got %q", want, result)
+	}
+	for i := range want {
+		if string(result[i]) != want[i] {
+			t.Errorf("Item %d: expected %s, got %s", i, want[i], result[i])
+		}
+	}
+
+	if result, _ := db.ExecCommand("XREAD", "STREAMS", "a", "$"); result != nil {
+		t.Errorf("$ should return nothing without blocking, got %q", result)
+	}
+	if result, _ := db.ExecCommand("XREAD", "STREAMS", "a", "3"); result != nil {
+		t.Errorf("Reading after the last entry should return nothing, got %q", result)
+	}
+
+	for _, args := range [][]string{
+		{"STREAMS", "a"},
+		{"STREAMS", "a", "b", "0"},
+		{"COUNT", "STREAMS", "a", "0"},
+		{"BLOCK", "-1", "STREAMS", "a", "0"},
+		{"STREAMS", "a", "x"},
+		{"a", "0"},
+	} {
+		if _, err := db.ExecCommand("XREAD", args...); err == nil {
+			t.Errorf("XREAD %v should fail", args)
+		}
+	}
+}
+
+func TestStreamTypeAndRebuild(t *testing.T) {
+	db := MakeDB()
+	defer db.Close()
+
+	db.ExecCommand("XADD", "s", "1-1", "a", "1", "b", "2")
+	db.ExecCommand("XADD", "s", "2-0", "c", "3")
+	db.ExecCommand("XADD", "empty", "MAXLEN", "0", "7-7", "f", "v")
+
+	if result, _ := db.ExecCommand("TYPE", "s"); string(result[0]) != "stream" {
+		t.Errorf("Expected TYPE stream, got %s", result[0])
+	}
+	if result, _ := db.ExecCommand("OBJECT", "ENCODING", "s"); string(result[0]) != "stream" {
+		t.Errorf("Expected encoding stream, got %s", result[0])
+	}
+
+	target := MakeDB()
+	defer target.Close()
+	for _, key := range []string{"s", "empty"} {
+		entity, _ := db.GetEntity(key)
+		for _, cmd := range RebuildCommands(key, entity) {
+			if _, err := target.Exec(cmd); err != nil {
+				t.Fatalf("Replaying %q failed: %v", cmd, err)
+			}
+		}
+	}
+
+	want, _ := db.ExecCommand("XRANGE", "s", "-", "+")
+	got, _ := target.ExecCommand("XRANGE", "s", "-", "+")
+	if len(got) != len(want) {
+		t.Fatalf("Expected %q, got %q", want, got)
+	}
+	for i := range want {
+		if string(got[i]) != string(want[i]) {
+			t.Errorf("Item %d: expected %s, got %s", i, want[i], got[i])
+		}
+	}
+	if id, ok := target.StreamLastID("empty"); !ok || id != "7-7" {
+		t.Errorf("Expected the empty stream to keep last ID 7-7, got %q", id)
+	}
+	if result, _ := target.ExecCommand("XLEN", "empty"); string(result[0]) != "0" {
+		t.Errorf("Expected the rebuilt stream to be empty, got XLEN %s", result[0])
+	}
+}
@@ -2,104 +2,365 @@ package database
 
 import (
 	"errors"
+	"fmt"
+	"math"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/wangbo/gocache/datastruct"
+	"github.com/wangbo/gocache/util/glob"
 )
 
 // String command implementations
 
 // Pre-allocated responses to reduce allocations
 var (
-	okResponse     = [][]byte{[]byte("OK")}
-	zeroResponse   = [][]byte{[]byte("0")}
-	oneResponse    = [][]byte{[]byte("1")}
-	emptyResponse  = [][]byte{[]byte("")}
-	nilResponse    = [][]byte{nil}
+	okResponse   = [][]byte{[]byte("OK")}
+	zeroResponse = [][]byte{[]byte("0")}
+	oneResponse  = [][]byte{[]byte("1")}
 )
 
-func execSet(db *DB, args [][]byte) ([][]byte, error) {
+// nullResult returns the result of a command whose value is absent. A nil
+// element is the null marker of the result layer: the server sends it as a
+// RESP null bulk string ($-1), or as a null element inside an array reply.
+// Handlers must never encode absence as a string such as "(nil)".
+func nullResult() [][]byte {
+	return [][]byte{nil}
+}
+
+// IsNullResult reports whether a command result is a single null value
+func IsNullResult(result [][]byte) bool {
+	return len(result) == 1 && result[0] == nil
+}
+
+// execSet implements SET key value [NX|XX] [GET] [EX|PX|EXAT|PXAT time|KEEPTTL].
+// Without GET it replaces a value of any type, which PutEntity accounts for.
+func execSet(db *DB, args [][]byte) (Result, error) {
 	if len(args) < 2 {
-		return nil, errors.New("wrong number of arguments")
+		return nil, errWrongArgs("set")
 	}
 
 	key := string(args[0])
 	value := args[1]
 
-	entity := datastruct.MakeString(value)
-	db.PutEntity(key, entity)
+	opts, err := parseSetOptions(args[2:], db.now())
+	if err != nil {
+		return nil, err
+	}
+
+	// GET replies with the old value, which must be a string
+	var reply Result = StatusResult("OK")
+	entity, exists := db.GetEntity(key)
+	if opts.get {
+		reply = NilResult{}
+		if exists {
+			str, ok := entity.Data.(*datastruct.String)
+			if !ok {
+				return nil, ErrWrongType
+			}
+			reply = BulkResult(str.Get())
+		}
+	}
+	if opts.nx && exists || opts.xx && !exists {
+		if opts.get {
+			return reply, nil
+		}
+		return NilResult{}, nil
+	}
+
+	// A new string replaces the old one, which a snapshot (BGSAVE, SYNC)
+	// may be reading without the key lock
+	db.PutEntity(key, datastruct.MakeString(value))
+
+	switch {
+	case !opts.expireAt.IsZero() && opts.relative:
+		db.expireRelative(key, opts.expireAt.Sub(db.now()))
+	case !opts.expireAt.IsZero():
+		db.Expire(key, opts.expireAt.Sub(db.now()))
+	case !opts.keepTTL:
+		// Clear any existing TTL (SET overwrites key completely)
+		db.Persist(key)
+	}
+	return reply, nil
+}
+
+// execSetNX sets key to value if the key does not exist
+func execSetNX(db *DB, args [][]byte) (Result, error) {
+	if len(args) != 2 {
+		return nil, errWrongArgs("setnx")
+	}
 
-	// Clear any existing TTL (SET overwrites key completely)
+	key := string(args[0])
+	if db.Exists(key) {
+		return IntResult(0), nil
+	}
+	db.PutEntity(key, datastruct.MakeString(args[1]))
+	return IntResult(1), nil
+}
+
+// execGetSet implements GETSET key value: it sets key to value and replies
+// with the old value. Unlike SET, it refuses to replace a value that is not
+// a string, and leaves it as it is.
+func execGetSet(db *DB, args [][]byte) (Result, error) {
+	if len(args) != 2 {
+		return nil, errWrongArgs("getset")
+	}
+
+	key := string(args[0])
+	var old Result = NilResult{}
+	if entity, ok := db.GetEntity(key); ok {
+		str, ok := entity.Data.(*datastruct.String)
+		if !ok {
+			return nil, ErrWrongType
+		}
+		old = BulkResult(str.Get())
+	}
+
+	db.PutEntity(key, datastruct.MakeString(args[1]))
 	db.Persist(key)
+	return old, nil
+}
 
-	// Use pre-allocated OK response
-	return okResponse, nil
+// setOptions holds the options of SET after the value
+type setOptions struct {
+	nx, xx   bool
+	get      bool
+	expireAt time.Time // Zero for no expiry option
+	relative bool      // The expiry was given by EX or PX
+	keepTTL  bool
 }
 
-func execGet(db *DB, args [][]byte) ([][]byte, error) {
-	if len(args) != 1 {
-		return nil, errors.New("wrong number of arguments")
+// parseSetOptions parses the NX/XX, GET and EX/PX/EXAT/PXAT/KEEPTTL options
+// of SET; EX and PX are relative to now
+func parseSetOptions(args [][]byte, now time.Time) (setOptions, error) {
+	syntaxErr := ErrSyntax
+
+	var opts setOptions
+	for i := 0; i < len(args); i++ {
+		opt := strings.ToUpper(string(args[i]))
+		switch opt {
+		case "NX", "XX":
+			if opts.nx || opts.xx {
+				return setOptions{}, syntaxErr
+			}
+			opts.nx, opts.xx = opt == "NX", opt == "XX"
+			continue
+		case "GET":
+			opts.get = true
+			continue
+		case "KEEPTTL":
+			if !opts.expireAt.IsZero() {
+				return setOptions{}, syntaxErr
+			}
+			opts.keepTTL = true
+			continue
+		case "EX", "PX", "EXAT", "PXAT":
+		default:
+			return setOptions{}, syntaxErr
+		}
+
+		if opts.keepTTL || !opts.expireAt.IsZero() || i+1 >= len(args) {
+			return setOptions{}, syntaxErr
+		}
+		i++
+		var err error
+		opts.expireAt, opts.relative, err = parseExpiryOption("set", opt, args[i], now)
+		if err != nil {
+			return setOptions{}, err
+		}
+	}
+
+	return opts, nil
+}
+
+// parseExpiryOption parses the amount of the EX, PX, EXAT or PXAT option of
+// cmd into the expiry it sets, and whether it was given relative to now
+func parseExpiryOption(cmd, opt string, arg []byte, now time.Time) (time.Time, bool, error) {
+	n, err := strconv.ParseInt(string(arg), 10, 64)
+	if err != nil {
+		return time.Time{}, false, ErrNotInteger
+	}
+	if n <= 0 {
+		return time.Time{}, false, fmt.Errorf("ERR invalid expire time in '%s' command", cmd)
+	}
+
+	switch opt {
+	case "EX":
+		return now.Add(time.Duration(n) * time.Second), true, nil
+	case "PX":
+		return now.Add(time.Duration(n) * time.Millisecond), true, nil
+	case "EXAT":
+		return time.Unix(n, 0), false, nil
+	default:
+		return time.UnixMilli(n), false, nil
+	}
+}
+
+// execGetEx implements GETEX key [EX|PX|EXAT|PXAT time|PERSIST]: it replies
+// with the value of key, a string, and sets or removes its TTL. Without an
+// option, or with PERSIST on a key without a TTL, it changes nothing, and
+// the server propagates it only as the TTL it set or the PERSIST it did
+// (see server/rewrite.go).
+func execGetEx(db *DB, args [][]byte) (Result, error) {
+	if len(args) < 1 {
+		return nil, errWrongArgs("getex")
 	}
 
 	key := string(args[0])
+	var expireAt time.Time
+	var relative, persist bool
+	switch {
+	case len(args) == 1:
+	case len(args) == 2 && strings.EqualFold(string(args[1]), "PERSIST"):
+		persist = true
+	case len(args) == 3:
+		opt := strings.ToUpper(string(args[1]))
+		if opt != "EX" && opt != "PX" && opt != "EXAT" && opt != "PXAT" {
+			return nil, ErrSyntax
+		}
+		var err error
+		if expireAt, relative, err = parseExpiryOption("getex", opt, args[2], db.now()); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, ErrSyntax
+	}
+
 	entity, ok := db.GetEntity(key)
 	if !ok {
-		return [][]byte{nil}, nil
+		return NilResult{}, nil
 	}
-
 	str, ok := entity.Data.(*datastruct.String)
 	if !ok {
-		return nil, errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
+		return nil, ErrWrongType
 	}
+	value := BulkResult(str.Get())
 
-	return [][]byte{str.Get()}, nil
+	switch {
+	case persist:
+		if db.Persist(key) == 0 {
+			return unchangedResult{value}, nil
+		}
+	case relative:
+		db.expireRelative(key, expireAt.Sub(db.now()))
+	case !expireAt.IsZero():
+		db.Expire(key, expireAt.Sub(db.now()))
+	default:
+		return unchangedResult{value}, nil
+	}
+	return value, nil
 }
 
-func execDel(db *DB, args [][]byte) ([][]byte, error) {
-	count := 0
-	for _, arg := range args {
-		key := string(arg)
-		count += db.Remove(key)
+// SetApplied reports whether a SET command, with the given result, stored
+// its value: NX and XX may leave the key alone, which the result tells
+// apart, as a null reply without GET or a reply inconsistent with the
+// condition with GET
+func SetApplied(cmdLine, result [][]byte) bool {
+	if len(cmdLine) < 3 {
+		return false
+	}
+	opts, err := parseSetOptions(cmdLine[3:], time.Now())
+	if err != nil {
+		return false
+	}
+	null := IsNullResult(result)
+	switch {
+	case opts.nx && opts.get:
+		return null
+	case opts.nx, opts.xx:
+		return !null
+	}
+	return true
+}
+
+func execGet(db *DB, args [][]byte) (Result, error) {
+	if len(args) != 1 {
+		return nil, errWrongArgs("get")
+	}
+
+	key := string(args[0])
+	entity, ok := db.GetEntity(key)
+	if !ok {
+		return NilResult{}, nil
+	}
+
+	str, ok := entity.Data.(*datastruct.String)
+	if !ok {
+		return nil, ErrWrongType
 	}
-	return [][]byte{[]byte(strconv.Itoa(count))}, nil
+
+	return BulkResult(str.Get()), nil
 }
 
-func execExists(db *DB, args [][]byte) ([][]byte, error) {
+// countKeys calls fn once per key argument, in order, and returns how many
+// calls reported true. A key named twice is visited twice: EXISTS k k counts
+// k twice, while DEL k k counts it once, the second visit finding nothing
+// to delete. The command holds the locks of all its keys during the loop,
+// so no other command runs between two visits, but a key can still expire
+// between them.
+func countKeys(args [][]byte, fn func(key string) bool) IntResult {
 	count := 0
 	for _, arg := range args {
-		key := string(arg)
-		if db.Exists(key) {
+		if fn(string(arg)) {
 			count++
 		}
 	}
+	return IntResult(count)
+}
 
-	// Use pre-allocated responses for common cases
-	switch count {
-	case 0:
-		return zeroResponse, nil
-	case 1:
-		return oneResponse, nil
-	default:
-		return [][]byte{[]byte(strconv.Itoa(count))}, nil
+// execDel deletes the given keys and returns how many existed; UNLINK is an
+// alias, the memory of a key is reclaimed right away in both cases
+func execDel(db *DB, args [][]byte) (Result, error) {
+	if len(args) == 0 {
+		return nil, errWrongArgs("del")
 	}
+	return countKeys(args, func(key string) bool {
+		// An expired key is not counted, as in Redis; a replica, which
+		// does not delete expired keys on its own, deletes it all the same
+		expired := db.expireIfNeeded(key)
+		return db.Remove(key) > 0 && !expired
+	}), nil
+}
+
+func execExists(db *DB, args [][]byte) (Result, error) {
+	if len(args) == 0 {
+		return nil, errWrongArgs("exists")
+	}
+	return countKeys(args, db.Exists), nil
+}
+
+// execTouch updates the access time of the given keys without reading their
+// values and returns how many of them exist
+func execTouch(db *DB, args [][]byte) (Result, error) {
+	if len(args) == 0 {
+		return nil, errWrongArgs("touch")
+	}
+	return countKeys(args, func(key string) bool {
+		_, ok := db.GetEntity(key)
+		return ok
+	}), nil
 }
 
 func execKeys(db *DB, args [][]byte) ([][]byte, error) {
 	if len(args) != 1 {
-		return nil, errors.New("wrong number of arguments")
+		return nil, errWrongArgs("keys")
 	}
 
+	pattern := string(args[0])
 	keys := db.data.Keys()
-	result := make([][]byte, len(keys))
-	for i, key := range keys {
-		result[i] = []byte(key)
+	result := make([][]byte, 0, len(keys))
+	for _, key := range keys {
+		if glob.Match(pattern, key) {
+			result = append(result, []byte(key))
+		}
 	}
 	return result, nil
 }
 
-func execIncr(db *DB, args [][]byte) ([][]byte, error) {
+func execIncr(db *DB, args [][]byte) (Result, error) {
 	if len(args) != 1 {
-		return nil, errors.New("wrong number of arguments")
+		return nil, errWrongArgs("incr")
 	}
 
 	key := string(args[0])
@@ -108,18 +369,18 @@ func execIncr(db *DB, args [][]byte) ([][]byte, error) {
 		return nil, err
 	}
 
-	return [][]byte{[]byte(strconv.FormatInt(newVal, 10))}, nil
+	return IntResult(newVal), nil
 }
 
-func execIncrBy(db *DB, args [][]byte) ([][]byte, error) {
+func execIncrBy(db *DB, args [][]byte) (Result, error) {
 	if len(args) != 2 {
-		return nil, errors.New("wrong number of arguments")
+		return nil, errWrongArgs("incrby")
 	}
 
 	key := string(args[0])
 	delta, err := strconv.ParseInt(string(args[1]), 10, 64)
 	if err != nil {
-		return nil, errors.New("ERR value is not an integer or out of range")
+		return nil, ErrNotInteger
 	}
 
 	newVal, err := db.atomicIncr(key, delta)
@@ -127,32 +388,48 @@ func execIncrBy(db *DB, args [][]byte) ([][]byte, error) {
 		return nil, err
 	}
 
-	return [][]byte{[]byte(strconv.FormatInt(newVal, 10))}, nil
+	return IntResult(newVal), nil
 }
 
-func execDecr(db *DB, args [][]byte) ([][]byte, error) {
-	return execIncrBy(db, append([][]byte{args[0]}, []byte("-1")))
+func execDecr(db *DB, args [][]byte) (Result, error) {
+	if len(args) != 1 {
+		return nil, errWrongArgs("decr")
+	}
+
+	newVal, err := db.atomicIncr(string(args[0]), -1)
+	if err != nil {
+		return nil, err
+	}
+
+	return IntResult(newVal), nil
 }
 
-func execDecrBy(db *DB, args [][]byte) ([][]byte, error) {
+func execDecrBy(db *DB, args [][]byte) (Result, error) {
 	if len(args) != 2 {
-		return nil, errors.New("wrong number of arguments")
+		return nil, errWrongArgs("decrby")
 	}
 
 	delta, err := strconv.ParseInt(string(args[1]), 10, 64)
 	if err != nil {
-		return nil, errors.New("ERR value is not an integer or out of range")
+		return nil, ErrNotInteger
+	}
+	if delta == math.MinInt64 {
+		return nil, errors.New("ERR decrement would overflow")
 	}
 
-	negDelta := -delta
-	args[1] = []byte(strconv.FormatInt(negDelta, 10))
+	// Negate into a new value; args is the caller's command line, which is
+	// still propagated to the AOF and replicas as DECRBY
+	newVal, err := db.atomicIncr(string(args[0]), -delta)
+	if err != nil {
+		return nil, err
+	}
 
-	return execIncrBy(db, args)
+	return IntResult(newVal), nil
 }
 
 func execMGet(db *DB, args [][]byte) ([][]byte, error) {
 	if len(args) < 1 {
-		return nil, errors.New("wrong number of arguments")
+		return nil, errWrongArgs("mget")
 	}
 
 	result := make([][]byte, len(args))
@@ -177,43 +454,72 @@ func execMGet(db *DB, args [][]byte) ([][]byte, error) {
 
 func execMSet(db *DB, args [][]byte) ([][]byte, error) {
 	if len(args) < 2 || len(args)%2 != 0 {
-		return nil, errors.New("wrong number of arguments")
+		return nil, errWrongArgs("mset")
 	}
 
-	for i := 0; i < len(args); i += 2 {
-		key := string(args[i])
-		value := args[i+1]
-		entity := datastruct.MakeString(value)
-		db.PutEntity(key, entity)
-	}
+	db.putStrings(args)
 
 	// Use pre-allocated OK response
 	return okResponse, nil
 }
 
-func execStrLen(db *DB, args [][]byte) ([][]byte, error) {
+// execMSetNX sets the keys only if none of them exists
+func execMSetNX(db *DB, args [][]byte) ([][]byte, error) {
+	if len(args) < 2 || len(args)%2 != 0 {
+		return nil, errWrongArgs("msetnx")
+	}
+
+	// The keys are locked for the whole command, so none can be created
+	// between this check and the writes
+	for i := 0; i < len(args); i += 2 {
+		if db.Exists(string(args[i])) {
+			return zeroResponse, nil
+		}
+	}
+
+	db.putStrings(args)
+	return oneResponse, nil
+}
+
+// putStrings stores the key-value pairs of MSET and MSETNX, replacing the
+// keys' values and TTLs. All values are created before any key is written and
+// the keys' versions are bumped by execute once every key is written, so the
+// command is atomic for WATCH as well as for other commands.
+func (db *DB) putStrings(args [][]byte) {
+	entities := make([]*datastruct.DataEntity, 0, len(args)/2)
+	for i := 1; i < len(args); i += 2 {
+		entities = append(entities, datastruct.MakeString(args[i]))
+	}
+
+	for i, entity := range entities {
+		key := string(args[2*i])
+		db.putEntity(key, entity)
+		db.removeTTL(key)
+	}
+}
+
+func execStrLen(db *DB, args [][]byte) (Result, error) {
 	if len(args) != 1 {
-		return nil, errors.New("wrong number of arguments")
+		return nil, errWrongArgs("strlen")
 	}
 
 	key := string(args[0])
 	entity, ok := db.GetEntity(key)
 	if !ok {
-		return [][]byte{[]byte("0")}, nil
+		return IntResult(0), nil
 	}
 
 	str, ok := entity.Data.(*datastruct.String)
 	if !ok {
-		return nil, errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
+		return nil, ErrWrongType
 	}
 
-	length := str.StrLen()
-	return [][]byte{[]byte(strconv.Itoa(length))}, nil
+	return IntResult(str.StrLen()), nil
 }
 
-func execAppend(db *DB, args [][]byte) ([][]byte, error) {
+func execAppend(db *DB, args [][]byte) (Result, error) {
 	if len(args) != 2 {
-		return nil, errors.New("wrong number of arguments")
+		return nil, errWrongArgs("append")
 	}
 
 	key := string(args[0])
@@ -226,46 +532,102 @@ func execAppend(db *DB, args [][]byte) ([][]byte, error) {
 		var ok2 bool
 		str, ok2 = entity.Data.(*datastruct.String)
 		if !ok2 {
-			return nil, errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
+			return nil, ErrWrongType
 		}
 	} else {
 		str = &datastruct.String{}
 		entity = &datastruct.DataEntity{Data: str}
-		db.PutEntity(key, entity)
 	}
 
+	size := entity.EstimateSize()
 	newLen := str.Append(value)
-	return [][]byte{[]byte(strconv.Itoa(newLen))}, nil
+	if !ok {
+		db.PutEntity(key, entity)
+	} else {
+		// Modified in place, and decompressed if it was compressed
+		db.addMemoryUsage(entity.EstimateSize() - size)
+	}
+	return IntResult(newLen), nil
+}
+
+// maxStringSize is the largest string SETRANGE may create (proto-max-bulk-len)
+const maxStringSize = 512 * 1024 * 1024
+
+func execSetRange(db *DB, args [][]byte) (Result, error) {
+	if len(args) != 3 {
+		return nil, errWrongArgs("setrange")
+	}
+
+	key := string(args[0])
+	offset, err := strconv.Atoi(string(args[1]))
+	if err != nil {
+		return nil, ErrNotInteger
+	}
+	if offset < 0 {
+		return nil, errors.New("ERR offset is out of range")
+	}
+	value := args[2]
+	if offset+len(value) > maxStringSize {
+		return nil, errors.New("ERR string exceeds maximum allowed size (proto-max-bulk-len)")
+	}
+
+	entity, exists := db.GetEntity(key)
+	var str *datastruct.String
+	if exists {
+		var ok bool
+		str, ok = entity.Data.(*datastruct.String)
+		if !ok {
+			return nil, ErrWrongType
+		}
+	} else {
+		// An empty value does not create the key
+		if len(value) == 0 {
+			return IntResult(0), nil
+		}
+		str = &datastruct.String{}
+		entity = &datastruct.DataEntity{Data: str}
+	}
+
+	if len(value) == 0 {
+		return IntResult(str.StrLen()), nil
+	}
+
+	size := entity.EstimateSize()
+	newLen := str.SetRange(offset, value)
+	if !exists {
+		db.PutEntity(key, entity)
+	} else {
+		// Modified in place, and decompressed if it was compressed
+		db.addMemoryUsage(entity.EstimateSize() - size)
+	}
+	return IntResult(newLen), nil
 }
 
-func execGetRange(db *DB, args [][]byte) ([][]byte, error) {
+func execGetRange(db *DB, args [][]byte) (Result, error) {
 	if len(args) != 3 {
-		return nil, errors.New("wrong number of arguments")
+		return nil, errWrongArgs("getrange")
 	}
 
 	key := string(args[0])
 	start, err := strconv.Atoi(string(args[1]))
 	if err != nil {
-		return nil, errors.New("ERR value is not an integer or out of range")
+		return nil, ErrNotInteger
 	}
 	end, err := strconv.Atoi(string(args[2]))
 	if err != nil {
-		return nil, errors.New("ERR value is not an integer or out of range")
+		return nil, ErrNotInteger
 	}
 
+	// A missing key and an empty range are the empty string, never null
 	entity, ok := db.GetEntity(key)
 	if !ok {
-		return emptyResponse, nil
+		return BulkResult{}, nil
 	}
 
 	str, ok := entity.Data.(*datastruct.String)
 	if !ok {
-		return nil, errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
+		return nil, ErrWrongType
 	}
 
-	result := str.GetRange(start, end)
-	if len(result) == 0 {
-		return emptyResponse, nil
-	}
-	return [][]byte{result}, nil
+	return BulkResult(str.GetRange(start, end)), nil
 }
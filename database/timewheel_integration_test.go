@@ -31,8 +31,7 @@ func TestTimeWheelActiveExpiration(t *testing.T) {
 
 // TestTimeWheelMultipleExpirations tests multiple keys expiring at different times
 func TestTimeWheelMultipleExpirations(t *testing.T) {
-	db := MakeDB()
-	defer db.Close()
+	db, mc := makeClockedDB(t)
 
 	// Set multiple keys with different TTLs
 	db.ExecCommand("SET", "key1", "value1")
@@ -44,7 +43,7 @@ func TestTimeWheelMultipleExpirations(t *testing.T) {
 	db.ExecCommand("PEXPIRE", "key3", "500")  // 500ms
 
 	// Wait for first expiration
-	time.Sleep(150 * time.Millisecond)
+	mc.Advance(150 * time.Millisecond)
 
 	// key1 should be expired
 	result1, _ := db.ExecCommand("EXISTS", "key1")
@@ -64,7 +63,7 @@ func TestTimeWheelMultipleExpirations(t *testing.T) {
 	}
 
 	// Wait for second expiration
-	time.Sleep(100 * time.Millisecond)
+	mc.Advance(100 * time.Millisecond)
 
 	// key2 should now be expired
 	result2, _ = db.ExecCommand("EXISTS", "key2")
@@ -79,7 +78,7 @@ func TestTimeWheelMultipleExpirations(t *testing.T) {
 	}
 
 	// Wait for final expiration
-	time.Sleep(300 * time.Millisecond)
+	mc.Advance(300 * time.Millisecond)
 
 	// key3 should now be expired
 	result3, _ = db.ExecCommand("EXISTS", "key3")
@@ -150,21 +149,20 @@ func TestTimeWheelDelRemovesFromWheel(t *testing.T) {
 
 // TestTimeWheelUpdateTTL tests updating TTL of existing key
 func TestTimeWheelUpdateTTL(t *testing.T) {
-	db := MakeDB()
-	defer db.Close()
+	db, mc := makeClockedDB(t)
 
 	// Set a key with short TTL
 	db.ExecCommand("SET", "testkey", "testvalue")
 	db.ExecCommand("PEXPIRE", "testkey", "100") // 100ms
 
 	// Wait a bit
-	time.Sleep(50 * time.Millisecond)
+	mc.Advance(50 * time.Millisecond)
 
 	// Update TTL to longer time
 	db.ExecCommand("PEXPIRE", "testkey", "500") // 500ms
 
 	// Wait for original expiration time
-	time.Sleep(100 * time.Millisecond)
+	mc.Advance(100 * time.Millisecond)
 
 	// Key should still exist since we updated TTL
 	result, _ := db.ExecCommand("GET", "testkey")
@@ -173,7 +171,7 @@ func TestTimeWheelUpdateTTL(t *testing.T) {
 	}
 
 	// Wait for updated expiration time
-	time.Sleep(450 * time.Millisecond)
+	mc.Advance(450 * time.Millisecond)
 
 	// Key should now be expired
 	result, _ = db.ExecCommand("GET", "testkey")
@@ -301,3 +299,32 @@ func TestConcurrentAccessWithTimeWheel(t *testing.T) {
 
 	// Should complete without errors or deadlocks
 }
+
+// TestReplicaModeDoesNotExpireOnItsOwnClock tests that a replica hides
+// expired keys but leaves deleting them to the master
+func TestReplicaModeDoesNotExpireOnItsOwnClock(t *testing.T) {
+	db := MakeDB()
+	defer db.Close()
+	db.SetReplicaMode(true)
+
+	var expired []string
+	db.SetExpireCallback(func(key string) { expired = append(expired, key) })
+
+	db.ExecCommand("SET", "key", "value", "PX", "30")
+	time.Sleep(100 * time.Millisecond)
+
+	if result, _ := db.ExecCommand("GET", "key"); result[0] != nil {
+		t.Errorf("Expected expired key to read as nil on replica, got %s", result[0])
+	}
+	if db.GetVersion("key") == 0 {
+		t.Error("Replica should keep the expired key until the master deletes it")
+	}
+	if len(expired) != 0 {
+		t.Errorf("Replica should not report expirations, got %v", expired)
+	}
+
+	db.ExecCommand("DEL", "key")
+	if db.GetVersion("key") != 0 {
+		t.Error("Expected DEL from the master to remove the key")
+	}
+}
@@ -3,15 +3,17 @@ package database
 import (
 	"errors"
 	"fmt"
+
+	"github.com/wangbo/gocache/monitor"
 )
 
 // execMulti executes the MULTI command
-func execMulti(db *DB, args [][]byte) ([][]byte, error) {
+func execMulti(ms *MultiState, args [][]byte) ([][]byte, error) {
 	if len(args) != 0 {
-		return nil, errors.New("ERR wrong number of arguments for MULTI")
+		return nil, errWrongArgs("multi")
 	}
 
-	if err := db.multiState.Begin(); err != nil {
+	if err := ms.Begin(); err != nil {
 		return nil, err
 	}
 
@@ -19,47 +21,64 @@ func execMulti(db *DB, args [][]byte) ([][]byte, error) {
 }
 
 // execDiscard executes the DISCARD command
-func execDiscard(db *DB, args [][]byte) ([][]byte, error) {
+func execDiscard(ms *MultiState, args [][]byte) ([][]byte, error) {
 	if len(args) != 0 {
-		return nil, errors.New("ERR wrong number of arguments for DISCARD")
+		return nil, errWrongArgs("discard")
 	}
 
-	if err := db.multiState.Discard(); err != nil {
+	if err := ms.Discard(); err != nil {
 		return nil, err
 	}
+	ms.Unwatch()
 
 	return [][]byte{[]byte("OK")}, nil
 }
 
 // execExec executes the EXEC command
-func execExec(db *DB, args [][]byte) ([][]byte, error) {
+// It returns a nil result (a null array reply) when a WATCHed key was modified
+func execExec(ms *MultiState, args [][]byte) ([][]byte, error) {
 	if len(args) != 0 {
-		return nil, errors.New("ERR wrong number of arguments for EXEC")
+		return nil, errWrongArgs("exec")
 	}
 
 	// Check if we're in MULTI mode
-	if !db.multiState.IsInMulti() {
+	if !ms.IsInMulti() {
 		return nil, errors.New("ERR EXEC without MULTI")
 	}
 
+	// Block all other commands until the queue has run, so nothing can
+	// modify a WATCHed key between the check and the queued commands
+	db := ms.db
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	// Watched keys are released by EXEC whatever the outcome
+	defer ms.Unwatch()
+
 	// Check for WATCH conflicts
-	if db.multiState.CheckWatchedKeys() {
-		db.multiState.Clear()
-		return nil, errors.New("WATCH key has been modified")
+	if ms.CheckWatchedKeys() {
+		ms.Clear()
+		return nil, nil
 	}
 
 	// Check if transaction was aborted
-	if db.multiState.IsAborted() {
-		db.multiState.Clear()
-		return nil, errors.New("Transaction aborted due to errors")
+	if ms.IsAborted() {
+		ms.Clear()
+		return nil, errors.New("EXECABORT Transaction discarded because of previous errors.")
+	}
+	if err := db.checkAdmission(ms.admission(), db.writesData(ms, CmdExec, nil)); err != nil {
+		ms.Clear()
+		return nil, err
 	}
 
 	// Get queued commands and clear MULTI state before executing
-	commands := db.multiState.GetCommands()
-	db.multiState.Clear()
+	commands := ms.GetCommands()
+	ms.Clear()
 
 	// Execute all commands atomically
 	results := make([][]byte, 0, len(commands))
+	executed := make([][]string, 0, len(commands))
+	replies := make([]ExecReply, 0, len(commands))
 
 	for _, cmdArgs := range commands {
 		if len(cmdArgs) == 0 {
@@ -72,8 +91,22 @@ func execExec(db *DB, args [][]byte) ([][]byte, error) {
 			cmdBytes[i] = []byte(arg)
 		}
 
-		// Execute command directly (now that we're not in MULTI mode)
-		result, err := db.Exec(cmdBytes)
+		// Execute command directly; db.mu is already held
+		cmdType, executor, err := lookupCommand(cmdBytes)
+		if err == nil && ms.client != nil {
+			db.feedMonitor(cmdType, cmdBytes, monitor.OriginExec)
+		}
+		var value Result
+		if client, ok := executor.(*ClientCommand); ok && err == nil {
+			value, err = client.ExecuteWithState(ms, cmdBytes[1:])
+		} else if err == nil {
+			value, err = db.executeTyped(cmdType, executor, cmdBytes[1:])
+		}
+		if _, ok := err.(*blockedCommand); ok && cmdType.MultiBehavior() == MultiNonBlocking {
+			// Blocking commands never block inside a transaction
+			value, err = NilResult{}, nil
+		}
+		result := linesOf(value)
 		if err != nil {
 			// Continue execution even on error - append error as result
 			// This matches Redis behavior where all commands are executed
@@ -82,18 +115,20 @@ func execExec(db *DB, args [][]byte) ([][]byte, error) {
 			// Append results
 			results = append(results, result...)
 		}
+		if modified(cmdType, value, err) {
+			executed = append(executed, propagatedForm(cmdType, cmdArgs, cmdBytes, result)...)
+		}
+		replies = append(replies, ExecReply{CmdLine: cmdBytes, Result: result, Value: replyOf(value), Err: err})
 	}
 
-	// Clear watched keys after EXEC
-	db.multiState.Unwatch()
-
+	ms.setExecuted(executed, replies)
 	return results, nil
 }
 
 // execWatch executes the WATCH command
-func execWatch(db *DB, args [][]byte) ([][]byte, error) {
+func execWatch(ms *MultiState, args [][]byte) ([][]byte, error) {
 	if len(args) == 0 {
-		return nil, errors.New("ERR wrong number of arguments for WATCH")
+		return nil, errWrongArgs("watch")
 	}
 
 	// Convert [][]byte to []string
@@ -102,7 +137,7 @@ func execWatch(db *DB, args [][]byte) ([][]byte, error) {
 		keys[i] = string(arg)
 	}
 
-	if err := db.multiState.Watch(keys...); err != nil {
+	if err := ms.Watch(keys...); err != nil {
 		return nil, err
 	}
 
@@ -110,12 +145,49 @@ func execWatch(db *DB, args [][]byte) ([][]byte, error) {
 }
 
 // execUnwatch executes the UNWATCH command
-func execUnwatch(db *DB, args [][]byte) ([][]byte, error) {
+func execUnwatch(ms *MultiState, args [][]byte) ([][]byte, error) {
 	if len(args) != 0 {
-		return nil, errors.New("ERR wrong number of arguments for UNWATCH")
+		return nil, errWrongArgs("unwatch")
 	}
 
-	db.multiState.Unwatch()
+	ms.Unwatch()
 
 	return [][]byte{[]byte("OK")}, nil
 }
+
+// execReset executes the RESET command: the transaction is discarded, the
+// keys unwatched and CLIENT NO-EVICT turned off. Authentication is the
+// server's to reset.
+func execReset(ms *MultiState, args [][]byte) ([][]byte, error) {
+	if len(args) != 0 {
+		return nil, errWrongArgs("reset")
+	}
+
+	ms.Clear()
+	ms.Unwatch()
+	if ms.client != nil {
+		ms.client.noEvict.Store(false)
+	}
+
+	return [][]byte{[]byte("RESET")}, nil
+}
+
+// propagatedForm returns the commands to propagate for a command EXEC ran:
+// the command itself, except for blocking pops, which are propagated as the
+// pop they served, if any (see ServedPopCommand), and SPOP, which is
+// propagated as the SREM of the members it popped (see PoppedMembersCommand)
+func propagatedForm(cmdType CommandType, cmdArgs []string, cmdLine, result [][]byte) [][]string {
+	var pop [][]byte
+	switch cmdType {
+	case CmdBLPop, CmdBRPop:
+		pop = ServedPopCommand(cmdLine, result)
+	case CmdSPop:
+		pop = PoppedMembersCommand(cmdLine, result)
+	default:
+		return [][]string{cmdArgs}
+	}
+	if pop == nil {
+		return nil
+	}
+	return [][]string{bytesToStrings(pop)}
+}
@@ -1,7 +1,13 @@
 package database
 
 import (
+	"strconv"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/wangbo/gocache/config"
+	"github.com/wangbo/gocache/replication"
 )
 
 // TestMultiExecBasic tests basic MULTI/EXEC functionality
@@ -220,11 +226,11 @@ func TestWatchBasic(t *testing.T) {
 	// Start transaction and try to EXEC
 	db.ExecCommand("MULTI")
 	db.ExecCommand("SET", "key1", "value3")
-	_, err = db.ExecCommand("EXEC")
+	result, err = db.ExecCommand("EXEC")
 
-	// EXEC should fail because watched key was modified
-	if err == nil {
-		t.Error("Expected error for EXEC after WATCHed key was modified")
+	// EXEC should return a nil array because watched key was modified
+	if err != nil || result != nil {
+		t.Errorf("Expected nil array for EXEC after WATCHed key was modified, got %v, %v", result, err)
 	}
 }
 
@@ -283,11 +289,11 @@ func TestWatchDetectsDelete(t *testing.T) {
 	// Start transaction and try to EXEC
 	db.ExecCommand("MULTI")
 	db.ExecCommand("SET", "key1", "value2")
-	_, err := db.ExecCommand("EXEC")
+	result, err := db.ExecCommand("EXEC")
 
-	// EXEC should fail because watched key was deleted (version changed)
-	if err == nil {
-		t.Error("Expected error for EXEC after WATCHed key was deleted")
+	// EXEC should return a nil array because watched key was deleted (version changed)
+	if err != nil || result != nil {
+		t.Errorf("Expected nil array for EXEC after WATCHed key was deleted, got %v, %v", result, err)
 	}
 }
 
@@ -313,11 +319,11 @@ func TestWatchMultipleKeys(t *testing.T) {
 	// Start transaction and try to EXEC
 	db.ExecCommand("MULTI")
 	db.ExecCommand("SET", "key1", "newvalue")
-	_, err = db.ExecCommand("EXEC")
+	result, err := db.ExecCommand("EXEC")
 
-	// EXEC should fail because one watched key was modified
-	if err == nil {
-		t.Error("Expected error for EXEC after one WATCHed key was modified")
+	// EXEC should return a nil array because one watched key was modified
+	if err != nil || result != nil {
+		t.Errorf("Expected nil array for EXEC after one WATCHed key was modified, got %v, %v", result, err)
 	}
 }
 
@@ -446,31 +452,400 @@ func TestVersionIncrement(t *testing.T) {
 
 	// After SET, version should be incremented
 	db.ExecCommand("SET", "key1", "value1")
-	version = db.GetVersion("key1")
-	if version != 1 {
-		t.Errorf("Expected version 1 after SET, got %d", version)
+	afterSet := db.GetVersion("key1")
+	if afterSet == 0 {
+		t.Errorf("Expected version to be incremented after SET, got %d", afterSet)
 	}
 
 	// After another SET, version should be incremented again
 	db.ExecCommand("SET", "key1", "value2")
 	version = db.GetVersion("key1")
-	if version != 2 {
-		t.Errorf("Expected version 2 after second SET, got %d", version)
+	if version <= afterSet {
+		t.Errorf("Expected version above %d after second SET, got %d", afterSet, version)
 	}
 
-	// After DEL, version is incremented but key is removed from versionMap
-	// (version increment happens before removal for WATCH detection)
-	// After DEL, the key no longer exists, so GetVersion returns 0
+	// After DEL of an unwatched key, the version is dropped with the key
 	db.ExecCommand("DEL", "key1")
 	version = db.GetVersion("key1")
 	if version != 0 {
 		t.Errorf("Expected version 0 after DEL (key removed), got %d", version)
 	}
 
-	// Re-SET the same key, version should start fresh at 1
+	// Re-SET the same key, version should start fresh
 	db.ExecCommand("SET", "key1", "value3")
 	version = db.GetVersion("key1")
-	if version != 1 {
-		t.Errorf("Expected version 1 after re-SET, got %d", version)
+	if version != afterSet {
+		t.Errorf("Expected version %d after re-SET, got %d", afterSet, version)
+	}
+}
+
+// TestVersionBumpedByEveryWritePath tests that in-place collection updates,
+// TTL changes and expiration all bump the key version
+func TestVersionBumpedByEveryWritePath(t *testing.T) {
+	db := MakeDB()
+	defer db.Close()
+
+	db.ExecCommand("RPUSH", "list", "a")
+	db.ExecCommand("HSET", "hash", "f", "v")
+	db.ExecCommand("SADD", "set", "m")
+	db.ExecCommand("ZADD", "zset", "1", "m")
+	db.ExecCommand("SET", "str", "v")
+
+	writes := [][]string{
+		{"RPUSH", "list", "b"},
+		{"HSET", "hash", "f", "v2"},
+		{"SADD", "set", "m2"},
+		{"ZINCRBY", "zset", "1", "m"},
+		{"APPEND", "str", "x"},
+		{"EXPIRE", "str", "100"},
+		{"PERSIST", "str"},
+	}
+	for _, w := range writes {
+		before := db.GetVersion(w[1])
+		if _, err := db.ExecCommand(w[0], w[1:]...); err != nil {
+			t.Fatalf("%s failed: %v", w[0], err)
+		}
+		if after := db.GetVersion(w[1]); after == before {
+			t.Errorf("%s did not bump the version of %s", w[0], w[1])
+		}
+	}
+}
+
+// TestWatchDetectsExpiration tests that a WATCHed key expiring aborts EXEC
+func TestWatchDetectsExpiration(t *testing.T) {
+	db := MakeDB()
+	defer db.Close()
+
+	db.ExecCommand("SET", "key1", "value1")
+	db.ExecCommand("PEXPIRE", "key1", "20")
+	db.ExecCommand("WATCH", "key1")
+
+	time.Sleep(100 * time.Millisecond)
+
+	db.ExecCommand("MULTI")
+	db.ExecCommand("SET", "key1", "value2")
+	result, err := db.ExecCommand("EXEC")
+	if err != nil || result != nil {
+		t.Errorf("Expected nil array for EXEC after WATCHed key expired, got %v, %v", result, err)
+	}
+	if result, _ := db.ExecCommand("EXISTS", "key1"); len(result) == 0 || string(result[0]) != "0" {
+		t.Errorf("Queued SET should not have run, EXISTS returned %v", result)
+	}
+}
+
+// TestWatchDetectsRecreateAndDelete tests that WATCH on a missing key sees a
+// SET followed by DEL even though the key is missing again at EXEC time
+func TestWatchDetectsRecreateAndDelete(t *testing.T) {
+	db := MakeDB()
+	defer db.Close()
+
+	db.ExecCommand("WATCH", "key1")
+	db.ExecCommand("SET", "key1", "value1")
+	db.ExecCommand("DEL", "key1")
+
+	db.ExecCommand("MULTI")
+	db.ExecCommand("SET", "key1", "value2")
+	result, err := db.ExecCommand("EXEC")
+	if err != nil || result != nil {
+		t.Errorf("Expected nil array for EXEC, got %v, %v", result, err)
+	}
+}
+
+// TestWatchTwoConnections tests that a write from one connection between
+// another connection's WATCH and EXEC aborts the transaction
+func TestWatchTwoConnections(t *testing.T) {
+	db := MakeDB()
+	defer db.Close()
+
+	clientA := NewMultiState(db)
+	clientB := NewMultiState(db)
+	exec := func(ms *MultiState, args ...string) ([][]byte, error) {
+		cmdLine := make([][]byte, len(args))
+		for i, arg := range args {
+			cmdLine[i] = []byte(arg)
+		}
+		return db.ExecWithState(ms, cmdLine)
+	}
+
+	exec(clientA, "SET", "balance", "100")
+
+	if _, err := exec(clientA, "WATCH", "balance"); err != nil {
+		t.Fatalf("WATCH failed: %v", err)
+	}
+	exec(clientA, "MULTI")
+	if result, _ := exec(clientA, "SET", "balance", "50"); len(result) == 0 || string(result[0]) != "QUEUED" {
+		t.Fatalf("Expected QUEUED, got %v", result)
+	}
+	exec(clientA, "SET", "audit", "A")
+
+	// Client B is not in a transaction and writes immediately
+	if result, err := exec(clientB, "INCRBY", "balance", "10"); err != nil || string(result[0]) != "110" {
+		t.Fatalf("INCRBY from client B failed: %v, %v", result, err)
+	}
+
+	result, err := exec(clientA, "EXEC")
+	if err != nil {
+		t.Fatalf("EXEC failed: %v", err)
+	}
+	if result != nil {
+		t.Errorf("Expected nil array from EXEC, got %v", result)
+	}
+
+	if result, _ := exec(clientB, "GET", "balance"); string(result[0]) != "110" {
+		t.Errorf("Expected balance 110, got %s", result[0])
+	}
+	if result, _ := exec(clientB, "EXISTS", "audit"); string(result[0]) != "0" {
+		t.Error("Queued command of aborted transaction took effect")
+	}
+
+	// Client A's next transaction is no longer watching anything
+	exec(clientA, "MULTI")
+	exec(clientA, "SET", "balance", "50")
+	if result, err := exec(clientA, "EXEC"); err != nil || result == nil {
+		t.Errorf("Expected EXEC to succeed after the aborted one, got %v, %v", result, err)
+	}
+}
+
+// TestWatchAbortedByConcurrentMSet runs transactions WATCHing one of the keys
+// of concurrent MSETs: every transaction must see both keys of the same MSET,
+// and a MSET between WATCH and EXEC must abort it
+func TestWatchAbortedByConcurrentMSet(t *testing.T) {
+	db := MakeDB()
+	defer db.Close()
+
+	db.ExecCommand("MSET", "k1", "0", "k2", "0")
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 1; i <= 200; i++ {
+			v := strconv.Itoa(i)
+			db.ExecCommand("MSET", "k1", v, "k2", v)
+		}
+	}()
+
+	client := NewMultiState(db)
+	exec := func(args ...string) ([][]byte, error) {
+		cmdLine := make([][]byte, len(args))
+		for i, arg := range args {
+			cmdLine[i] = []byte(arg)
+		}
+		return db.ExecWithState(client, cmdLine)
+	}
+
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+
+		exec("WATCH", "k2")
+		exec("MULTI")
+		exec("MGET", "k1", "k2")
+		result, err := exec("EXEC")
+		if err != nil {
+			t.Fatalf("EXEC failed: %v", err)
+		}
+		if result == nil {
+			continue // Aborted by a MSET
+		}
+		if string(result[0]) != string(result[1]) {
+			t.Fatalf("Transaction saw a partial MSET: %q", result)
+		}
+	}
+
+	// A MSET between WATCH and EXEC aborts the transaction
+	exec("WATCH", "k2")
+	db.ExecCommand("MSET", "k1", "x", "k2", "x")
+	exec("MULTI")
+	exec("SET", "k2", "y")
+	if result, err := exec("EXEC"); err != nil || result != nil {
+		t.Errorf("Expected EXEC to abort, got %q %v", result, err)
+	}
+}
+
+func TestWatchInsideMultiAbortsTransaction(t *testing.T) {
+	db := MakeDB()
+	defer db.Close()
+
+	db.ExecCommand("MULTI")
+	if _, err := db.ExecCommand("WATCH", "k"); err == nil || err.Error() != "ERR WATCH inside MULTI is not allowed" {
+		t.Fatalf("Expected WATCH inside MULTI to fail, got %v", err)
+	}
+	if result, err := db.ExecCommand("SET", "k", "v"); err != nil || string(result[0]) != "QUEUED" {
+		t.Fatalf("Expected SET to be queued, got %v, %v", result, err)
+	}
+	if _, err := db.ExecCommand("EXEC"); err == nil {
+		t.Error("Expected EXEC to fail after a forbidden command")
+	}
+	if db.Exists("k") {
+		t.Error("Expected the aborted transaction not to run")
+	}
+	if db.DefaultMultiState().IsInMulti() {
+		t.Error("Expected EXEC to end the transaction")
+	}
+}
+
+func TestMultiBehavior(t *testing.T) {
+	tests := []struct {
+		cmd  CommandType
+		want MultiBehavior
+	}{
+		{CmdSet, MultiQueued},
+		{CmdWatch, MultiForbidden},
+		{CmdMonitor, MultiForbidden},
+		{CmdBLPop, MultiNonBlocking},
+		{CmdBRPop, MultiNonBlocking},
+		{CmdXRead, MultiNonBlocking},
+	}
+	for _, tt := range tests {
+		if got := tt.cmd.MultiBehavior(); got != tt.want {
+			t.Errorf("%s: expected behavior %d, got %d", tt.cmd, tt.want, got)
+		}
+	}
+}
+
+// TestExecBlockingPopDoesNotBlock checks that a blocking pop run by EXEC
+// yields a nil element instead of blocking
+func TestExecBlockingPopDoesNotBlock(t *testing.T) {
+	db := MakeDB()
+	defer db.Close()
+
+	db.ExecCommand("MULTI")
+	db.ExecCommand("BLPOP", "empty", "0")
+	db.ExecCommand("RPUSH", "list", "a")
+	db.ExecCommand("BRPOP", "empty", "list", "0")
+
+	done := make(chan struct{})
+	var result [][]byte
+	var err error
+	go func() {
+		result, err = db.ExecCommand("EXEC")
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("EXEC blocked on BLPOP")
+	}
+
+	if err != nil {
+		t.Fatalf("EXEC failed: %v", err)
+	}
+	// The nil element of BLPOP, then RPUSH's length and BRPOP's key and value
+	if len(result) != 4 || result[0] != nil || string(result[1]) != "1" ||
+		string(result[2]) != "list" || string(result[3]) != "a" {
+		t.Errorf("Unexpected EXEC result %q", result)
+	}
+
+	executed := db.DefaultMultiState().TakeExecuted()
+	if len(executed) != 2 || executed[0][0] != "RPUSH" || executed[1][0] != "RPOP" || executed[1][1] != "list" {
+		t.Errorf("Expected RPUSH and RPOP to be propagated, got %v", executed)
+	}
+}
+
+func TestWatchLimit(t *testing.T) {
+	cfg := config.Default()
+	cfg.MaxWatchedKeys = 3
+	db := MakeDBWithConfig(cfg, replication.NewReplicationState())
+	defer db.Close()
+	ms := NewMultiState(db)
+	watch := func(keys ...string) error {
+		cmdLine := [][]byte{[]byte("WATCH")}
+		for _, key := range keys {
+			cmdLine = append(cmdLine, []byte(key))
+		}
+		_, err := db.ExecWithState(ms, cmdLine)
+		return err
+	}
+
+	if err := watch("a", "b", "a"); err != nil {
+		t.Fatalf("WATCH failed: %v", err)
+	}
+	// Watching a key again does not count
+	if err := watch("b", "c"); err != nil {
+		t.Fatalf("WATCH within the limit failed: %v", err)
+	}
+	err := watch("c", "d", "e")
+	if err == nil || !strings.Contains(err.Error(), "max-watched-keys") {
+		t.Fatalf("Expected the limit error, got %v", err)
+	}
+	// The refused WATCH watches none of its keys
+	if n := ms.watching(); n != 3 {
+		t.Errorf("Expected 3 watched keys, got %d", n)
+	}
+	if _, keys := db.watchStats(); keys != 3 {
+		t.Errorf("Expected 3 keys registered, got %d", keys)
+	}
+
+	db.runtime.maxWatchedKeys.Store(0)
+	if err := watch("d", "e"); err != nil {
+		t.Errorf("Expected no limit with max-watched-keys 0, got %v", err)
+	}
+}
+
+func TestWatchCleanup(t *testing.T) {
+	db := MakeDB()
+	defer db.Close()
+	first, second := NewMultiState(db), NewMultiState(db)
+	exec := func(ms *MultiState, args ...string) {
+		t.Helper()
+		cmdLine := make([][]byte, len(args))
+		for i, arg := range args {
+			cmdLine[i] = []byte(arg)
+		}
+		if _, err := db.ExecWithState(ms, cmdLine); err != nil {
+			t.Fatalf("%v failed: %v", args, err)
+		}
+	}
+	expectStats := func(clients, keys int) {
+		t.Helper()
+		if c, k := db.watchStats(); c != clients || k != keys {
+			t.Errorf("Expected %d watching clients and %d watched keys, got %d and %d", clients, keys, c, k)
+		}
+	}
+
+	for _, end := range [][]string{{"UNWATCH"}, {"MULTI", "EXEC"}, {"MULTI", "DISCARD"}} {
+		exec(first, "WATCH", "a", "b")
+		exec(second, "WATCH", "b", "c")
+		expectStats(2, 3)
+		for _, cmd := range end {
+			exec(first, cmd)
+		}
+		expectStats(1, 2)
+		second.Unwatch() // As the server does when the connection closes
+		expectStats(0, 0)
+	}
+
+	info, _ := db.ExecCommand("INFO", "clients")
+	for _, want := range []string{"watching_clients:0\r\n", "total_watched_keys:0\r\n"} {
+		if !strings.Contains(string(info[0]), want) {
+			t.Errorf("Expected %q in %q", want, info[0])
+		}
+	}
+}
+
+// TestWatchChurn WATCHes and DISCARDs missing keys: nothing is left behind
+// for them, neither registrations nor versions
+func TestWatchChurn(t *testing.T) {
+	db := MakeDB()
+	defer db.Close()
+	ms := NewMultiState(db)
+
+	for i := 0; i < 10000; i++ {
+		key := []byte("key:" + strconv.Itoa(i))
+		if _, err := db.ExecWithState(ms, [][]byte{[]byte("WATCH"), key, []byte("shared")}); err != nil {
+			t.Fatalf("WATCH failed: %v", err)
+		}
+		db.ExecWithState(ms, [][]byte{[]byte("MULTI")})
+		db.ExecWithState(ms, [][]byte{[]byte("DISCARD")})
+	}
+
+	if clients, keys := db.watchStats(); clients != 0 || keys != 0 {
+		t.Errorf("Expected no watchers left, got %d clients and %d keys", clients, keys)
+	}
+	if n := db.versionMap.Len(); n != 0 {
+		t.Errorf("Expected no versions kept for missing keys, got %d", n)
 	}
 }
@@ -2,136 +2,217 @@ package database
 
 import (
 	"errors"
+	"fmt"
+	"math"
 	"strconv"
+	"strings"
 	"time"
 )
 
 // TTL command implementations
+//
+// A TTL of 0 or less, or a timestamp in the past, deletes the key and the
+// command returns 1 as when it sets the TTL; the server propagates a DEL (see
+// server/rewrite.go). As in Redis, an amount whose expiry in milliseconds
+// overflows an int64 is refused. A TTL longer than time.Duration can hold,
+// about 292 years, is capped to it rather than wrapped around to a negative
+// one, which would delete the key.
+//
+// NX, XX, GT and LT make the EXPIRE family set the TTL only if the key has
+// none, has one, or would expire later or earlier than it does; refused,
+// the command returns 0 and, like any write that changed nothing, is not
+// propagated.
+
+// maxTTL is the longest TTL, in whole milliseconds
+const maxTTL = time.Duration(math.MaxInt64) / time.Millisecond * time.Millisecond
+
+// expireTTL returns the TTL set by an EXPIRE-family command given amount
+// units, relative to now or, if absolute, since the Unix epoch; 0 if the
+// expiry has passed, or the error of cmd if it overflows
+func expireTTL(cmd string, now time.Time, amount int64, unit time.Duration, absolute bool) (time.Duration, error) {
+	perMilli := int64(unit / time.Millisecond)
+	if amount > math.MaxInt64/perMilli || amount < math.MinInt64/perMilli {
+		return 0, invalidExpireTime(cmd)
+	}
+	ms := amount * perMilli
+	var ttl time.Duration
+	if absolute {
+		if ms <= now.UnixMilli() {
+			return 0, nil
+		}
+		if ms-now.UnixMilli() > int64(maxTTL/time.Millisecond) {
+			return maxTTL, nil
+		}
+		ttl = time.UnixMilli(ms).Sub(now)
+	} else {
+		if ms > math.MaxInt64-now.UnixMilli() {
+			return 0, invalidExpireTime(cmd)
+		}
+		if ms > int64(maxTTL/time.Millisecond) {
+			return maxTTL, nil
+		}
+		ttl = time.Duration(ms) * time.Millisecond
+	}
+	if ttl < 0 {
+		return 0, nil
+	}
+	return ttl, nil
+}
 
-func execExpire(db *DB, args [][]byte) ([][]byte, error) {
-	if len(args) != 2 {
-		return nil, errors.New("wrong number of arguments")
-	}
+func invalidExpireTime(cmd string) error {
+	return fmt.Errorf("ERR invalid expire time in '%s' command", cmd)
+}
 
-	key := string(args[0])
-	seconds, err := strconv.Atoi(string(args[1]))
+// parseExpireAmount parses the seconds, milliseconds or timestamp argument
+// of the EXPIRE family
+func parseExpireAmount(arg []byte) (int64, error) {
+	amount, err := strconv.ParseInt(string(arg), 10, 64)
 	if err != nil {
-		return nil, errors.New("ERR value is not an integer or out of range")
+		return 0, ErrNotInteger
 	}
+	return amount, nil
+}
 
-	ttl := time.Duration(seconds) * time.Second
-	result := db.Expire(key, ttl)
-	return [][]byte{[]byte(strconv.Itoa(result))}, nil
+func execExpire(db *DB, args [][]byte) (Result, error) {
+	return execExpireFamily(db, "expire", args, time.Second, false)
 }
 
-func execPExpire(db *DB, args [][]byte) ([][]byte, error) {
-	if len(args) != 2 {
-		return nil, errors.New("wrong number of arguments")
+func execPExpire(db *DB, args [][]byte) (Result, error) {
+	return execExpireFamily(db, "pexpire", args, time.Millisecond, false)
+}
+
+// execExpireFamily runs EXPIRE, PEXPIRE, EXPIREAT or PEXPIREAT, named cmd:
+// key amount [NX|XX|GT|LT], the amount in unit and, if absolute, since the
+// Unix epoch. It returns 0, and changes nothing, if the key is missing or
+// the options refuse the new expiry.
+func execExpireFamily(db *DB, cmd string, args [][]byte, unit time.Duration, absolute bool) (Result, error) {
+	if len(args) < 2 {
+		return nil, errWrongArgs(cmd)
 	}
 
 	key := string(args[0])
-	milliseconds, err := strconv.Atoi(string(args[1]))
+	amount, err := parseExpireAmount(args[1])
+	if err != nil {
+		return nil, err
+	}
+	cond, err := parseExpireCondition(args[2:])
+	if err != nil {
+		return nil, err
+	}
+	now := db.now()
+	ttl, err := expireTTL(cmd, now, amount, unit, absolute)
 	if err != nil {
-		return nil, errors.New("ERR value is not an integer or out of range")
+		return nil, err
+	}
+	if !absolute {
+		ttl = db.jitterTTL(ttl)
 	}
 
-	ttl := time.Duration(milliseconds) * time.Millisecond
-	result := db.Expire(key, ttl)
-	return [][]byte{[]byte(strconv.Itoa(result))}, nil
+	if cond != (expireCondition{}) {
+		current, _ := db.ExpireTime(key)
+		if !cond.allows(current, now.Add(ttl)) {
+			return IntResult(0), nil
+		}
+	}
+	return IntResult(db.Expire(key, ttl)), nil
+}
+
+// expireCondition holds the NX, XX, GT and LT options of the EXPIRE family
+type expireCondition struct {
+	nx, xx, gt, lt bool
 }
 
-func execTTL(db *DB, args [][]byte) ([][]byte, error) {
+// parseExpireCondition parses the options after the amount of an
+// EXPIRE-family command
+func parseExpireCondition(args [][]byte) (expireCondition, error) {
+	var cond expireCondition
+	for _, arg := range args {
+		switch opt := strings.ToUpper(string(arg)); opt {
+		case "NX":
+			cond.nx = true
+		case "XX":
+			cond.xx = true
+		case "GT":
+			cond.gt = true
+		case "LT":
+			cond.lt = true
+		default:
+			return cond, fmt.Errorf("ERR Unsupported option %s", arg)
+		}
+	}
+	if cond.nx && (cond.xx || cond.gt || cond.lt) {
+		return cond, errors.New("ERR NX and XX, GT or LT options at the same time are not compatible")
+	}
+	if cond.gt && cond.lt {
+		return cond, errors.New("ERR GT and LT options at the same time are not compatible")
+	}
+	return cond, nil
+}
+
+// allows reports whether the condition lets a key expiring at current, zero
+// for a key without a TTL, expire at expireAt instead. As in Redis, a key
+// without a TTL counts as expiring never: GT never sets its TTL, LT always
+// does.
+func (c expireCondition) allows(current, expireAt time.Time) bool {
+	switch {
+	case c.nx:
+		return current.IsZero()
+	case c.xx && current.IsZero():
+		return false
+	case c.gt:
+		return !current.IsZero() && expireAt.After(current)
+	case c.lt:
+		return current.IsZero() || expireAt.Before(current)
+	}
+	return true
+}
+
+func execTTL(db *DB, args [][]byte) (Result, error) {
 	if len(args) != 1 {
-		return nil, errors.New("wrong number of arguments")
+		return nil, errWrongArgs("ttl")
 	}
 
 	key := string(args[0])
 	ttl := db.TTL(key)
 
-	if ttl == -2 {
-		return [][]byte{[]byte("-2")}, nil
-	}
-	if ttl == -1 {
-		return [][]byte{[]byte("-1")}, nil
+	if ttl == -2 || ttl == -1 {
+		return IntResult(ttl), nil
 	}
 
-	seconds := int64(ttl.Seconds())
-	return [][]byte{[]byte(strconv.FormatInt(seconds, 10))}, nil
+	// Round up, so that a key that still exists never reports 0
+	seconds := int64((ttl + time.Second - 1) / time.Second)
+	return IntResult(seconds), nil
 }
 
-func execPTTL(db *DB, args [][]byte) ([][]byte, error) {
+func execPTTL(db *DB, args [][]byte) (Result, error) {
 	if len(args) != 1 {
-		return nil, errors.New("wrong number of arguments")
+		return nil, errWrongArgs("pttl")
 	}
 
 	key := string(args[0])
 	ttl := db.TTL(key)
 
-	if ttl == -2 {
-		return [][]byte{[]byte("-2")}, nil
-	}
-	if ttl == -1 {
-		return [][]byte{[]byte("-1")}, nil
+	if ttl == -2 || ttl == -1 {
+		return IntResult(ttl), nil
 	}
 
-	milliseconds := int64(ttl.Milliseconds())
-	return [][]byte{[]byte(strconv.FormatInt(milliseconds, 10))}, nil
+	return IntResult(ttl.Milliseconds()), nil
 }
 
-func execPersist(db *DB, args [][]byte) ([][]byte, error) {
+func execPersist(db *DB, args [][]byte) (Result, error) {
 	if len(args) != 1 {
-		return nil, errors.New("wrong number of arguments")
+		return nil, errWrongArgs("persist")
 	}
 
 	key := string(args[0])
 	result := db.Persist(key)
-	return [][]byte{[]byte(strconv.Itoa(result))}, nil
+	return IntResult(result), nil
 }
 
-func execExpireAt(db *DB, args [][]byte) ([][]byte, error) {
-	if len(args) != 2 {
-		return nil, errors.New("wrong number of arguments")
-	}
-
-	key := string(args[0])
-	timestamp, err := strconv.ParseInt(string(args[1]), 10, 64)
-	if err != nil {
-		return nil, errors.New("ERR value is not an integer or out of range")
-	}
-
-	expireTime := time.Unix(timestamp, 0)
-	ttl := time.Until(expireTime)
-
-	if ttl <= 0 {
-		// Already expired or invalid, remove key if exists
-		db.Remove(key)
-		return zeroResponse, nil
-	}
-
-	result := db.Expire(key, ttl)
-	return [][]byte{[]byte(strconv.Itoa(result))}, nil
+func execExpireAt(db *DB, args [][]byte) (Result, error) {
+	return execExpireFamily(db, "expireat", args, time.Second, true)
 }
 
-func execPExpireAt(db *DB, args [][]byte) ([][]byte, error) {
-	if len(args) != 2 {
-		return nil, errors.New("wrong number of arguments")
-	}
-
-	key := string(args[0])
-	timestampMs, err := strconv.ParseInt(string(args[1]), 10, 64)
-	if err != nil {
-		return nil, errors.New("ERR value is not an integer or out of range")
-	}
-
-	expireTime := time.Unix(0, timestampMs*int64(time.Millisecond))
-	ttl := time.Until(expireTime)
-
-	if ttl <= 0 {
-		// Already expired or invalid, remove key if exists
-		db.Remove(key)
-		return zeroResponse, nil
-	}
-
-	result := db.Expire(key, ttl)
-	return [][]byte{[]byte(strconv.Itoa(result))}, nil
+func execPExpireAt(db *DB, args [][]byte) (Result, error) {
+	return execExpireFamily(db, "pexpireat", args, time.Millisecond, true)
 }
@@ -0,0 +1,146 @@
+package database_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/wangbo/gocache/database"
+	"github.com/wangbo/gocache/util/clock"
+)
+
+// makeTTLDB returns a database on a stopped clock holding "persistent",
+// without a TTL, and "volatile", expiring in 100s
+func makeTTLDB(t *testing.T) *database.DB {
+	t.Helper()
+	db := database.MakeDB()
+	t.Cleanup(func() { db.Close() })
+	db.SetClock(clock.NewManual(time.Now()))
+	exec(t, db, "SET", "persistent", "p")
+	exec(t, db, "SET", "volatile", "v", "EX", "100")
+	return db
+}
+
+// execError runs a command written as space-separated arguments and
+// returns its error
+func execError(db *database.DB, cmd string) error {
+	fields := strings.Fields(cmd)
+	cmdLine := make([][]byte, len(fields))
+	for i, f := range fields {
+		cmdLine[i] = []byte(f)
+	}
+	_, err := db.Exec(cmdLine)
+	return err
+}
+
+func TestExpireConditions(t *testing.T) {
+	tests := []struct {
+		cmd  string
+		want string
+		key  string
+		ttl  time.Duration // TTL of key afterwards
+	}{
+		{"EXPIRE persistent 50 NX", "1", "persistent", 50 * time.Second},
+		{"EXPIRE volatile 50 NX", "0", "volatile", 100 * time.Second},
+		{"EXPIRE persistent 50 XX", "0", "persistent", -1},
+		{"EXPIRE volatile 50 XX", "1", "volatile", 50 * time.Second},
+		{"EXPIRE volatile 200 GT", "1", "volatile", 200 * time.Second},
+		{"EXPIRE volatile 50 GT", "0", "volatile", 100 * time.Second},
+		{"EXPIRE persistent 50 GT", "0", "persistent", -1},
+		{"EXPIRE volatile 50 LT", "1", "volatile", 50 * time.Second},
+		{"EXPIRE volatile 200 LT", "0", "volatile", 100 * time.Second},
+		{"EXPIRE persistent 50 LT", "1", "persistent", 50 * time.Second},
+		{"PEXPIRE volatile 200000 XX GT", "1", "volatile", 200 * time.Second},
+		{"PEXPIRE persistent 200000 xx gt", "0", "persistent", -1},
+		{"PEXPIREAT volatile 1 NX", "0", "volatile", 100 * time.Second},
+		{"PEXPIREAT volatile 1 LT", "1", "volatile", -2},
+		{"EXPIRE missing 50 LT", "0", "missing", -2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.cmd, func(t *testing.T) {
+			db := makeTTLDB(t)
+			if got := string(exec(t, db, strings.Fields(tt.cmd)...)[0]); got != tt.want {
+				t.Errorf("Expected %s, got %s", tt.want, got)
+			}
+			if ttl := db.TTL(tt.key); ttl != tt.ttl {
+				t.Errorf("Expected %s to have a TTL of %v, got %v", tt.key, tt.ttl, ttl)
+			}
+		})
+	}
+}
+
+func TestExpireConditionErrors(t *testing.T) {
+	db := makeTTLDB(t)
+	for _, tc := range []struct {
+		cmd  string
+		want string
+	}{
+		{"EXPIRE volatile 10 NX XX", "ERR NX and XX, GT or LT options at the same time are not compatible"},
+		{"EXPIRE volatile 10 NX GT", "ERR NX and XX, GT or LT options at the same time are not compatible"},
+		{"PEXPIRE volatile 10 GT LT", "ERR GT and LT options at the same time are not compatible"},
+		{"EXPIREAT volatile 10 SOON", "ERR Unsupported option SOON"},
+		{"EXPIRE volatile", "wrong number of arguments"},
+	} {
+		err := execError(db, tc.cmd)
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s: expected %q, got %v", tc.cmd, tc.want, err)
+		}
+	}
+	if ttl := db.TTL("volatile"); ttl != 100*time.Second {
+		t.Errorf("Expected the refused commands to keep the TTL, got %v", ttl)
+	}
+}
+
+func TestGetEx(t *testing.T) {
+	db := makeTTLDB(t)
+
+	version := db.GetVersion("volatile")
+	if got := string(exec(t, db, "GETEX", "volatile")[0]); got != "v" {
+		t.Errorf("Expected v, got %q", got)
+	}
+	if db.GetVersion("volatile") != version {
+		t.Error("Expected GETEX without an option to leave the key unchanged")
+	}
+
+	exec(t, db, "GETEX", "persistent", "PX", "1500")
+	if ttl := db.TTL("persistent"); ttl != 1500*time.Millisecond {
+		t.Errorf("Expected GETEX PX to set a TTL of 1.5s, got %v", ttl)
+	}
+	exec(t, db, "GETEX", "volatile", "persist")
+	if ttl := db.TTL("volatile"); ttl != -1 {
+		t.Errorf("Expected GETEX PERSIST to remove the TTL, got %v", ttl)
+	}
+	version = db.GetVersion("volatile")
+	exec(t, db, "GETEX", "volatile", "PERSIST")
+	if db.GetVersion("volatile") != version {
+		t.Error("Expected GETEX PERSIST without a TTL to leave the key unchanged")
+	}
+	if got := string(exec(t, db, "GETEX", "volatile", "EXAT", "1")[0]); got != "v" {
+		t.Errorf("Expected GETEX EXAT in the past to reply with the value, got %q", got)
+	}
+	if db.Exists("volatile") {
+		t.Error("Expected GETEX EXAT in the past to delete the key")
+	}
+	if result := exec(t, db, "GETEX", "missing", "EX", "10"); !database.IsNullResult(result) {
+		t.Errorf("Expected null for a missing key, got %q", result)
+	}
+
+	exec(t, db, "RPUSH", "list", "a")
+	for _, tc := range []struct {
+		cmd  string
+		want string
+	}{
+		{"GETEX list", "WRONGTYPE"},
+		{"GETEX persistent EX", "ERR syntax error"},
+		{"GETEX persistent EX 10 PERSIST", "ERR syntax error"},
+		{"GETEX persistent KEEPTTL", "ERR syntax error"},
+		{"GETEX persistent EX 0", "ERR invalid expire time in 'getex' command"},
+		{"GETEX persistent PX abc", "ERR value is not an integer"},
+		{"GETEX", "wrong number of arguments"},
+	} {
+		err := execError(db, tc.cmd)
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s: expected %q, got %v", tc.cmd, tc.want, err)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package database
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TTL statistics
+//
+// INFO keyspace reports avg_ttl, the mean remaining TTL of the keys with
+// one, and DEBUG TTLSTATS how many keys expire within a minute, an hour, a
+// day, later, or never. Both look at up to ttlStatsSampleKeys keys with a
+// TTL picked at random, so that they cost the same whatever the size of the
+// keyspace, and scale what they saw to all the keys with a TTL. Below that
+// many keys, and for INFO everything and DEBUG TTLSTATS FULL, every key is
+// looked at and the figures are exact. Keys whose TTL has passed but that
+// are not deleted yet are skipped either way.
+
+// ttlStatsSampleKeys is the number of keys with a TTL the statistics are
+// estimated from
+const ttlStatsSampleKeys = 1000
+
+// ttlBuckets are the upper bounds of the TTL histogram; keys with a longer
+// TTL fall in the last bucket
+var ttlBuckets = []struct {
+	name  string
+	bound time.Duration
+}{
+	{"expire_within_1m", time.Minute},
+	{"expire_within_1h", time.Hour},
+	{"expire_within_1d", 24 * time.Hour},
+	{"expire_later", 0},
+}
+
+// ttlStats is what the statistics saw of the keys with a TTL
+type ttlStats struct {
+	keys    int64 // Keys in the database
+	expires int64 // Keys with a TTL
+	full    bool  // Whether every key with a TTL was looked at
+	picks   int64 // Keys with a TTL looked at, expired ones included
+	live    int64 // Keys looked at whose TTL has not passed
+	totalMS int64 // Sum of the remaining TTLs of the live keys
+	buckets [4]int64
+}
+
+// SeedKeySampling reseeds the source the keys the statistics look at are
+// picked with, so that tests get the same estimates on every run
+func (db *DB) SeedKeySampling(seed int64) {
+	db.sampleRand.Seed(seed)
+}
+
+// ForEachTTL calls fn with every key that has a TTL and the time it expires,
+// until fn returns false. Keys whose TTL has passed but that are not deleted
+// yet are skipped. Like ForEach it sees no global snapshot, and fn must not
+// write to the database.
+func (db *DB) ForEachTTL(fn func(key string, expireAt time.Time) bool) {
+	now := db.now()
+	db.ttlMap.ForEach(func(key string, val interface{}) bool {
+		expireAt, ok := val.(time.Time)
+		if !ok || !now.Before(expireAt) {
+			return true
+		}
+		return fn(key, expireAt)
+	})
+}
+
+// collectTTLStats computes the TTL statistics, from every key with a TTL if
+// full is set or there are few of them, else from a random sample
+func (db *DB) collectTTLStats(full bool) ttlStats {
+	s := ttlStats{keys: int64(db.data.Len()), expires: int64(db.ttlMap.Len())}
+	now := db.now()
+	add := func(expireAt time.Time) {
+		s.live++
+		remaining := expireAt.Sub(now)
+		s.totalMS += remaining.Milliseconds()
+		for i, bucket := range ttlBuckets {
+			if bucket.bound == 0 || remaining <= bucket.bound {
+				s.buckets[i]++
+				break
+			}
+		}
+	}
+
+	if full || s.expires <= ttlStatsSampleKeys {
+		s.full = true
+		db.ForEachTTL(func(key string, expireAt time.Time) bool {
+			add(expireAt)
+			return true
+		})
+		s.picks = s.live
+		return s
+	}
+
+	db.ttlMap.RandomEntries(db.sampleRand, ttlStatsSampleKeys, func(key string, val interface{}) bool {
+		s.picks++
+		if expireAt, ok := val.(time.Time); ok && now.Before(expireAt) {
+			add(expireAt)
+		}
+		return true
+	})
+	return s
+}
+
+// avgTTL returns the mean remaining TTL in milliseconds, 0 if no key has one
+func (s ttlStats) avgTTL() int64 {
+	if s.live == 0 {
+		return 0
+	}
+	return s.totalMS / s.live
+}
+
+// bucket returns the number of keys in the bucket i of the histogram,
+// scaled from the sample to all the keys with a TTL unless every key was
+// looked at
+func (s ttlStats) bucket(i int) int64 {
+	if s.full || s.picks == 0 {
+		return s.buckets[i]
+	}
+	return (s.buckets[i]*s.expires + s.picks/2) / s.picks
+}
+
+// ttlStatsReport returns the DEBUG TTLSTATS report, a field:value line per
+// figure
+func (db *DB) ttlStatsReport(full bool) string {
+	s := db.collectTTLStats(full)
+	var b strings.Builder
+	writeInfoField(&b, "keys", strconv.FormatInt(s.keys, 10))
+	writeInfoField(&b, "expires", strconv.FormatInt(s.expires, 10))
+	writeInfoField(&b, "sampled_keys", strconv.FormatInt(s.picks, 10))
+	writeInfoField(&b, "full_scan", boolInfo(s.full))
+	writeInfoField(&b, "avg_ttl", strconv.FormatInt(s.avgTTL(), 10))
+	for i, bucket := range ttlBuckets {
+		writeInfoField(&b, bucket.name, strconv.FormatInt(s.bucket(i), 10))
+	}
+	writeInfoField(&b, "persistent", strconv.FormatInt(max(s.keys-s.expires, 0), 10))
+	return b.String()
+}
@@ -0,0 +1,153 @@
+package database
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fillTTLBuckets sets perBucket keys expiring within a minute, an hour, a
+// day and later, and persistent keys without a TTL
+func fillTTLBuckets(t *testing.T, db *DB, perBucket, persistent int) {
+	t.Helper()
+	ttls := []time.Duration{30 * time.Second, 30 * time.Minute, 12 * time.Hour, 48 * time.Hour}
+	for b, ttl := range ttls {
+		ms := strconv.FormatInt(ttl.Milliseconds(), 10)
+		for i := 0; i < perBucket; i++ {
+			db.ExecCommand("SET", "k"+strconv.Itoa(b)+":"+strconv.Itoa(i), "v", "PX", ms)
+		}
+	}
+	for i := 0; i < persistent; i++ {
+		db.ExecCommand("SET", "p:"+strconv.Itoa(i), "v")
+	}
+}
+
+// ttlStatsFields parses a DEBUG TTLSTATS report
+func ttlStatsFields(t *testing.T, db *DB, args ...string) map[string]int64 {
+	t.Helper()
+	result, err := db.ExecCommand("DEBUG", append([]string{"TTLSTATS"}, args...)...)
+	if err != nil {
+		t.Fatalf("DEBUG TTLSTATS %s failed: %v", strings.Join(args, " "), err)
+	}
+	fields := make(map[string]int64)
+	for _, line := range strings.Split(strings.TrimSpace(string(result[0])), "\r\n") {
+		name, value, _ := strings.Cut(line, ":")
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			t.Fatalf("Unexpected DEBUG TTLSTATS line %q", line)
+		}
+		fields[name] = n
+	}
+	return fields
+}
+
+func TestTTLStats(t *testing.T) {
+	db, _ := makeClockedDB(t)
+	db.SeedKeySampling(1)
+	const perBucket, persistent = 1000, 500
+	fillTTLBuckets(t, db, perBucket, persistent)
+
+	// The mean of 30s, 30m, 12h and 48h
+	wantAvg := (30*time.Second + 30*time.Minute + 12*time.Hour + 48*time.Hour).Milliseconds() / 4
+	buckets := []string{"expire_within_1m", "expire_within_1h", "expire_within_1d", "expire_later"}
+
+	full := ttlStatsFields(t, db, "FULL")
+	if full["full_scan"] != 1 || full["sampled_keys"] != 4*perBucket {
+		t.Errorf("Expected a full scan of %d keys, got %v", 4*perBucket, full)
+	}
+	if full["keys"] != 4*perBucket+persistent || full["expires"] != 4*perBucket || full["persistent"] != persistent {
+		t.Errorf("Unexpected key counts: %v", full)
+	}
+	if full["avg_ttl"] != wantAvg {
+		t.Errorf("Expected avg_ttl %d, got %d", wantAvg, full["avg_ttl"])
+	}
+	for _, bucket := range buckets {
+		if full[bucket] != perBucket {
+			t.Errorf("Expected %s %d, got %d", bucket, perBucket, full[bucket])
+		}
+	}
+
+	// A sample of ttlStatsSampleKeys keys lands within a few percent
+	sampled := ttlStatsFields(t, db)
+	if sampled["full_scan"] != 0 || sampled["sampled_keys"] != ttlStatsSampleKeys {
+		t.Errorf("Expected a sample of %d keys, got %v", ttlStatsSampleKeys, sampled)
+	}
+	if sampled["expires"] != 4*perBucket || sampled["persistent"] != persistent {
+		t.Errorf("Unexpected key counts: %v", sampled)
+	}
+	if avg := sampled["avg_ttl"]; avg < wantAvg*85/100 || avg > wantAvg*115/100 {
+		t.Errorf("Expected sampled avg_ttl within 15%% of %d, got %d", wantAvg, avg)
+	}
+	var total int64
+	for _, bucket := range buckets {
+		if n := sampled[bucket]; n < perBucket*80/100 || n > perBucket*120/100 {
+			t.Errorf("Expected sampled %s within 20%% of %d, got %d", bucket, perBucket, n)
+		}
+		total += sampled[bucket]
+	}
+	if total < 4*perBucket-4 || total > 4*perBucket+4 {
+		t.Errorf("Expected the sampled buckets to add up to %d, got %d", 4*perBucket, total)
+	}
+
+	// INFO everything is exact, INFO keyspace estimated
+	var keys, expires, avgTTL int64
+	line := execInfoString(t, db, "everything")["Keyspace"]["db0"]
+	if _, err := fmt.Sscanf(line, "keys=%d,expires=%d,avg_ttl=%d", &keys, &expires, &avgTTL); err != nil {
+		t.Fatalf("Unexpected keyspace line %q: %v", line, err)
+	}
+	if avgTTL != wantAvg {
+		t.Errorf("Expected INFO everything avg_ttl %d, got %d", wantAvg, avgTTL)
+	}
+	line = execInfoString(t, db, "keyspace")["Keyspace"]["db0"]
+	if _, err := fmt.Sscanf(line, "keys=%d,expires=%d,avg_ttl=%d", &keys, &expires, &avgTTL); err != nil {
+		t.Fatalf("Unexpected keyspace line %q: %v", line, err)
+	}
+	if avgTTL < wantAvg*85/100 || avgTTL > wantAvg*115/100 {
+		t.Errorf("Expected INFO keyspace avg_ttl within 15%% of %d, got %d", wantAvg, avgTTL)
+	}
+}
+
+func TestTTLStatsSmallKeyspaceIsExact(t *testing.T) {
+	db, mc := makeClockedDB(t)
+	db.ExecCommand("SET", "a", "v", "EX", "10")
+	db.ExecCommand("SET", "b", "v", "EX", "7200")
+	db.ExecCommand("SET", "c", "v")
+
+	stats := ttlStatsFields(t, db)
+	if stats["full_scan"] != 1 || stats["avg_ttl"] != 3605000 {
+		t.Errorf("Expected an exact avg_ttl of 3605000, got %v", stats)
+	}
+	if stats["expire_within_1m"] != 1 || stats["expire_within_1d"] != 1 || stats["persistent"] != 1 {
+		t.Errorf("Unexpected histogram: %v", stats)
+	}
+
+	// Once a's TTL has passed it is skipped, deleted yet or not
+	mc.Advance(20 * time.Second)
+	var seen []string
+	db.ForEachTTL(func(key string, expireAt time.Time) bool {
+		seen = append(seen, key)
+		return true
+	})
+	if len(seen) != 1 || seen[0] != "b" {
+		t.Errorf("Expected ForEachTTL to see only b, got %v", seen)
+	}
+	if stats := ttlStatsFields(t, db); stats["avg_ttl"] != 7180000 || stats["expire_within_1m"] != 0 {
+		t.Errorf("Expected the expired key to be skipped, got %v", stats)
+	}
+}
+
+func TestDebugTTLStatsArguments(t *testing.T) {
+	db := MakeDB()
+	defer db.Close()
+
+	for _, args := range [][]string{{"NOPE"}, {"FULL", "extra"}} {
+		if _, err := db.ExecCommand("DEBUG", append([]string{"TTLSTATS"}, args...)...); err == nil {
+			t.Errorf("Expected DEBUG TTLSTATS %s to fail", strings.Join(args, " "))
+		}
+	}
+	if stats := ttlStatsFields(t, db, "full"); stats["keys"] != 0 || stats["avg_ttl"] != 0 {
+		t.Errorf("Expected empty statistics, got %v", stats)
+	}
+}
@@ -1,14 +1,26 @@
 package datastruct
 
 import (
+	"math"
 	"strconv"
+	"sync"
+	"time"
 
 	"github.com/wangbo/gocache/dict"
 )
 
 // Hash represents a Redis hash data structure
+//
+// Fields may carry their own expiration time (HEXPIRE). Expired fields are
+// invisible to every read even before they are removed; ExpireFields removes
+// them for good. The TTLs are checked against the wall clock unless
+// SetClock gives the hash another.
 type Hash struct {
 	data *dict.ConcurrentDict
+	now  func() time.Time // Time of the field TTLs, nil for the wall clock
+
+	expireMu sync.Mutex
+	expires  map[string]time.Time // Field expiration times, nil if none
 }
 
 // MakeHash creates a new Hash
@@ -18,78 +30,139 @@ func MakeHash() *DataEntity {
 	}}
 }
 
+// SetClock makes the hash check its field TTLs against the time now returns.
+// It must be called before the hash is shared.
+func (h *Hash) SetClock(now func() time.Time) {
+	h.now = now
+}
+
 // Get returns the value associated with field in the hash
 func (h *Hash) Get(field string) ([]byte, bool) {
 	val, ok := h.data.Get(field)
-	if !ok {
+	if !ok || h.isExpired(field, h.clockNow()) {
 		return nil, false
 	}
 	return val.([]byte), true
 }
 
-// Set sets the field-value pair in the hash
+// Set sets the field-value pair in the hash, clearing any field TTL. It
+// returns 1 if the field is new, 0 if it was updated.
 func (h *Hash) Set(field string, value []byte) int {
-	h.data.Put(field, value)
-	return 1
+	h.dropIfExpired(field)
+	result := h.data.Put(field, value)
+	h.clearFieldExpire(field)
+	return result
+}
+
+// Grow makes room for n more fields, set by a single HSET
+func (h *Hash) Grow(n int) {
+	h.data.Grow(n)
 }
 
 // SetNX sets field-value pair only if field does not exist
 func (h *Hash) SetNX(field string, value []byte) bool {
+	h.dropIfExpired(field)
 	return h.data.PutIfAbsent(field, value) == 1
 }
 
 // Remove removes the specified fields from the hash
 func (h *Hash) Remove(fields ...string) int {
 	count := 0
+	now := h.clockNow()
 	for _, field := range fields {
-		count += h.data.Remove(field)
+		expired := h.isExpired(field, now)
+		if h.data.Remove(field) > 0 && !expired {
+			count++
+		}
+		h.clearFieldExpire(field)
 	}
 	return count
 }
 
 // Exists checks if field exists in the hash
 func (h *Hash) Exists(field string) bool {
-	_, ok := h.data.Get(field)
+	_, ok := h.Get(field)
 	return ok
 }
 
 // Len returns the number of fields in the hash
 func (h *Hash) Len() int {
-	return h.data.Len()
+	return h.data.Len() - h.countExpired(h.clockNow())
 }
 
 // GetAll returns all fields and values in the hash
 func (h *Hash) GetAll() map[string][]byte {
-	result := make(map[string][]byte)
-	h.data.ForEach(func(key string, val interface{}) bool {
-		result[key] = val.([]byte)
+	result := make(map[string][]byte, h.data.Len())
+	h.Entries(func(field string, value []byte) bool {
+		result[field] = value
 		return true
 	})
 	return result
 }
 
-// Keys returns all fields in the hash
+// Keys returns all fields in the hash, in the order of Entries
 func (h *Hash) Keys() []string {
-	keys := make([]string, 0)
-	h.data.ForEach(func(key string, val interface{}) bool {
-		keys = append(keys, key)
+	keys := make([]string, 0, h.data.Len())
+	h.Entries(func(field string, value []byte) bool {
+		keys = append(keys, field)
 		return true
 	})
 	return keys
 }
 
-// Values returns all values in the hash
+// Values returns all values in the hash, in the order of Entries
 func (h *Hash) Values() [][]byte {
-	values := make([][]byte, 0)
-	h.data.ForEach(func(key string, val interface{}) bool {
-		values = append(values, val.([]byte))
+	values := make([][]byte, 0, h.data.Len())
+	h.Entries(func(field string, value []byte) bool {
+		values = append(values, value)
 		return true
 	})
 	return values
 }
 
+// Entries calls fn for every field that has not expired and its value, until
+// fn returns false, without building a copy of the hash.
+//
+// The order is that of the underlying dict (see dict.ConcurrentDict.ForEach):
+// unlike the order of a Go map it is not randomized, so the same writes
+// always yield the same order, and HGETALL, HKEYS and HVALS list the fields
+// in the same order. The shard locks of the dict are held during the calls,
+// so fn must not write to the hash; it may be called under the key lock of
+// the hash, which is what protects it against commands.
+func (h *Hash) Entries(fn func(field string, value []byte) bool) {
+	now := h.clockNow()
+	h.expireMu.Lock()
+	hasExpires := len(h.expires) > 0
+	h.expireMu.Unlock()
+	h.data.ForEach(func(key string, val interface{}) bool {
+		if hasExpires && h.isExpired(key, now) {
+			return true
+		}
+		return fn(key, val.([]byte))
+	})
+}
+
+// Scan returns up to count fields and their values, alternating, from
+// cursor, and the cursor of the next call; cursor 0 starts and ends an
+// iteration (see dict.ConcurrentDict.Scan). Expired fields are skipped.
+func (h *Hash) Scan(cursor int64, count int) (int64, [][]byte) {
+	now := h.clockNow()
+	capacity := count
+	if n := h.data.Len(); capacity > n {
+		capacity = n
+	}
+	batch := make([][]byte, 0, 2*capacity)
+	next := h.data.Scan(cursor, count, func(key string, val interface{}) {
+		if !h.isExpired(key, now) {
+			batch = append(batch, []byte(key), val.([]byte))
+		}
+	})
+	return next, batch
+}
+
 // IncrBy increments the value of field by increment
 func (h *Hash) IncrBy(field string, increment int64) (int64, error) {
+	h.dropIfExpired(field)
 	val, ok := h.data.Get(field)
 	if !ok {
 		h.data.Put(field, []byte(strconv.FormatInt(increment, 10)))
@@ -99,10 +172,144 @@ func (h *Hash) IncrBy(field string, increment int64) (int64, error) {
 	strVal := string(val.([]byte))
 	oldValue, err := strconv.ParseInt(strVal, 10, 64)
 	if err != nil {
-		return 0, ErrInvalidInteger
+		return 0, ErrHashNotInteger
+	}
+	if increment > 0 && oldValue > math.MaxInt64-increment ||
+		increment < 0 && oldValue < math.MinInt64-increment {
+		return 0, ErrOverflow
 	}
 
 	newValue := oldValue + increment
 	h.data.Put(field, []byte(strconv.FormatInt(newValue, 10)))
 	return newValue, nil
 }
+
+// SetFieldExpire sets the expiration time of a field. It returns false if the
+// field does not exist.
+func (h *Hash) SetFieldExpire(field string, expireAt time.Time) bool {
+	if !h.Exists(field) {
+		return false
+	}
+
+	h.expireMu.Lock()
+	defer h.expireMu.Unlock()
+	if h.expires == nil {
+		h.expires = make(map[string]time.Time)
+	}
+	h.expires[field] = expireAt
+	return true
+}
+
+// FieldExpireTime returns the expiration time of a field, false if the field
+// has no TTL
+func (h *Hash) FieldExpireTime(field string) (time.Time, bool) {
+	h.expireMu.Lock()
+	defer h.expireMu.Unlock()
+	expireAt, ok := h.expires[field]
+	return expireAt, ok
+}
+
+// PersistField removes the TTL of a field and reports whether it had one
+func (h *Hash) PersistField(field string) bool {
+	h.expireMu.Lock()
+	defer h.expireMu.Unlock()
+	if _, ok := h.expires[field]; !ok {
+		return false
+	}
+	delete(h.expires, field)
+	return true
+}
+
+// FieldExpirations returns a copy of the expiration times of all fields that
+// have a TTL, including fields that have expired but not been removed yet
+func (h *Hash) FieldExpirations() map[string]time.Time {
+	h.expireMu.Lock()
+	defer h.expireMu.Unlock()
+	result := make(map[string]time.Time, len(h.expires))
+	for field, expireAt := range h.expires {
+		result[field] = expireAt
+	}
+	return result
+}
+
+// NextFieldExpiry returns the earliest field expiration time
+func (h *Hash) NextFieldExpiry() (time.Time, bool) {
+	h.expireMu.Lock()
+	defer h.expireMu.Unlock()
+	var next time.Time
+	for _, expireAt := range h.expires {
+		if next.IsZero() || expireAt.Before(next) {
+			next = expireAt
+		}
+	}
+	return next, !next.IsZero()
+}
+
+// ExpireFields removes every field whose TTL has passed at now and returns
+// their names
+func (h *Hash) ExpireFields(now time.Time) []string {
+	h.expireMu.Lock()
+	var expired []string
+	for field, expireAt := range h.expires {
+		if !now.Before(expireAt) {
+			expired = append(expired, field)
+			delete(h.expires, field)
+		}
+	}
+	h.expireMu.Unlock()
+
+	removed := expired[:0]
+	for _, field := range expired {
+		if h.data.Remove(field) > 0 {
+			removed = append(removed, field)
+		}
+	}
+	return removed
+}
+
+// clockNow returns the time of the hash's clock
+func (h *Hash) clockNow() time.Time {
+	if h.now != nil {
+		return h.now()
+	}
+	return time.Now()
+}
+
+// isExpired reports whether a field's TTL has passed at now
+func (h *Hash) isExpired(field string, now time.Time) bool {
+	h.expireMu.Lock()
+	defer h.expireMu.Unlock()
+	expireAt, ok := h.expires[field]
+	return ok && !now.Before(expireAt)
+}
+
+// countExpired returns the number of fields whose TTL has passed at now
+func (h *Hash) countExpired(now time.Time) int {
+	h.expireMu.Lock()
+	defer h.expireMu.Unlock()
+	count := 0
+	for field, expireAt := range h.expires {
+		if !now.Before(expireAt) {
+			if _, ok := h.data.Get(field); ok {
+				count++
+			}
+		}
+	}
+	return count
+}
+
+// clearFieldExpire removes the TTL of a field
+func (h *Hash) clearFieldExpire(field string) {
+	h.expireMu.Lock()
+	delete(h.expires, field)
+	h.expireMu.Unlock()
+}
+
+// dropIfExpired removes a field if its TTL has passed, so that it can be
+// written as a new field
+func (h *Hash) dropIfExpired(field string) {
+	if h.isExpired(field, h.clockNow()) {
+		h.data.Remove(field)
+		h.clearFieldExpire(field)
+	}
+}
@@ -1,7 +1,9 @@
 package datastruct
 
 import (
+	"strconv"
 	"testing"
+	"time"
 )
 
 func TestMakeHash(t *testing.T) {
@@ -31,8 +33,13 @@ func TestHash_GetSet(t *testing.T) {
 		t.Error("Get should return false for non-existent field")
 	}
 
-	// Set field
-	hash.Set("field1", []byte("value1"))
+	// Set field, then update it
+	if added := hash.Set("field1", []byte("value0")); added != 1 {
+		t.Errorf("Set of a new field should return 1, got %d", added)
+	}
+	if added := hash.Set("field1", []byte("value1")); added != 0 {
+		t.Errorf("Set of an existing field should return 0, got %d", added)
+	}
 
 	// Get existing field
 	val, ok := hash.Get("field1")
@@ -166,6 +173,37 @@ func TestHash_GetAll(t *testing.T) {
 	}
 }
 
+func TestHash_Scan(t *testing.T) {
+	hash := MakeHash().Data.(*Hash)
+	for i := 0; i < 100; i++ {
+		hash.Set("field"+strconv.Itoa(i), []byte(strconv.Itoa(i)))
+	}
+	hash.SetFieldExpire("field0", time.Now().Add(-time.Second))
+
+	seen := make(map[string]string)
+	cursor := int64(0)
+	for {
+		var batch [][]byte
+		cursor, batch = hash.Scan(cursor, 10)
+		for i := 0; i < len(batch); i += 2 {
+			seen[string(batch[i])] = string(batch[i+1])
+		}
+		if cursor == 0 {
+			break
+		}
+	}
+
+	if len(seen) != 99 {
+		t.Errorf("Expected 99 fields, got %d", len(seen))
+	}
+	if _, ok := seen["field0"]; ok {
+		t.Error("Expected the expired field to be skipped")
+	}
+	if seen["field42"] != "42" {
+		t.Errorf("Expected field42 to be 42, got %q", seen["field42"])
+	}
+}
+
 func TestHash_Keys(t *testing.T) {
 	entity := MakeHash()
 	hash := entity.Data.(*Hash)
@@ -205,6 +243,53 @@ func TestHash_Values(t *testing.T) {
 	}
 }
 
+func TestHash_Entries(t *testing.T) {
+	build := func() *Hash {
+		hash := MakeHash().Data.(*Hash)
+		for i := 0; i < 100; i++ {
+			hash.Set("f"+strconv.Itoa(i), []byte("v"+strconv.Itoa(i)))
+		}
+		hash.SetFieldExpire("f7", time.Now().Add(-time.Second))
+		return hash
+	}
+	hash := build()
+
+	var fields []string
+	hash.Entries(func(field string, value []byte) bool {
+		if string(value) != "v"+field[1:] {
+			t.Errorf("Field %s: unexpected value %s", field, value)
+		}
+		fields = append(fields, field)
+		return true
+	})
+	if len(fields) != 99 {
+		t.Fatalf("Expected 99 live fields, got %d", len(fields))
+	}
+	for _, field := range fields {
+		if field == "f7" {
+			t.Error("Expected the expired field to be skipped")
+		}
+	}
+
+	// The order depends only on the writes, and Keys follows it
+	keys := build().Keys()
+	for i := range fields {
+		if keys[i] != fields[i] {
+			t.Fatalf("Position %d: expected %s, got %s", i, fields[i], keys[i])
+		}
+	}
+
+	// Returning false stops the iteration
+	visited := 0
+	hash.Entries(func(field string, value []byte) bool {
+		visited++
+		return visited < 10
+	})
+	if visited != 10 {
+		t.Errorf("Expected 10 calls, got %d", visited)
+	}
+}
+
 func TestHash_IncrBy(t *testing.T) {
 	entity := MakeHash()
 	hash := entity.Data.(*Hash)
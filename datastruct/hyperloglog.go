@@ -0,0 +1,399 @@
+package datastruct
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"math/bits"
+)
+
+// HyperLogLog estimates the number of distinct elements added to it with a
+// standard error of 0.81%, using 16384 registers of 6 bits.
+//
+// A HyperLogLog is stored as a String value in the format Redis uses, so the
+// values can be exchanged with Redis: a 16-byte header with the "HYLL" magic,
+// the encoding and the cached cardinality, followed by the registers. The
+// dense encoding packs the registers in 12288 bytes. The sparse encoding,
+// used while most registers are zero, run-length encodes them with three
+// opcodes:
+//
+//	ZERO  00xxxxxx           1 to 64 zero registers
+//	XZERO 01xxxxxx yyyyyyyy  1 to 16384 zero registers
+//	VAL   1vvvvvxx           1 to 4 registers with value 1 to 32
+//
+// A sparse HyperLogLog is converted to dense when a register exceeds 32 or
+// the encoding grows beyond HLLSparseMaxBytes.
+
+const (
+	hllP         = 14
+	hllQ         = 64 - hllP
+	hllRegisters = 1 << hllP
+	hllBits      = 6
+	hllMaxValue  = 1<<hllBits - 1
+
+	hllHeaderSize = 16
+	hllDenseSize  = hllHeaderSize + (hllRegisters*hllBits+7)/8
+
+	hllDense  = 0
+	hllSparse = 1
+
+	hllSparseMaxValue = 32
+	hllSparseMaxZero  = 64
+	hllSparseMaxXZero = 16384
+	hllSparseMaxRun   = 4
+
+	hllAlphaInf = 0.721347520444481703680
+	hllHashSeed = 0xadc83b19
+)
+
+// HLLSparseMaxBytes is the largest size of a sparse HyperLogLog, header
+// included, like hll-sparse-max-bytes in Redis
+const HLLSparseMaxBytes = 3000
+
+var hllMagic = []byte("HYLL")
+
+var (
+	// ErrNotHyperLogLog is returned for a String that is not a HyperLogLog
+	ErrNotHyperLogLog = errors.New("WRONGTYPE Key is not a valid HyperLogLog string value.")
+	// ErrCorruptHyperLogLog is returned for a HyperLogLog with invalid registers
+	ErrCorruptHyperLogLog = errors.New("INVALIDOBJ Corrupted HLL object detected")
+)
+
+// hllRegisterSet holds the decoded registers of a HyperLogLog
+type hllRegisterSet [hllRegisters]uint8
+
+// NewHyperLogLog returns an empty HyperLogLog, in the sparse encoding and
+// with a cached cardinality of 0
+func NewHyperLogLog() []byte {
+	var registers hllRegisterSet
+	hll := encodeHLL(&registers)
+	hll[15] = 0
+	return hll
+}
+
+// IsHyperLogLog reports whether b looks like a HyperLogLog: it has the
+// header and, for the dense encoding, the exact size. Sparse registers are
+// only checked when they are decoded.
+func IsHyperLogLog(b []byte) bool {
+	if len(b) < hllHeaderSize || string(b[:4]) != string(hllMagic) {
+		return false
+	}
+	switch b[4] {
+	case hllDense:
+		return len(b) == hllDenseSize
+	case hllSparse:
+		return true
+	}
+	return false
+}
+
+// HLLAdd adds elements to a HyperLogLog and reports whether a register
+// changed. Dense HyperLogLogs are updated in place; the returned slice must
+// be used in place of hll, as sparse ones are re-encoded.
+func HLLAdd(hll []byte, elements [][]byte) ([]byte, bool, error) {
+	if !IsHyperLogLog(hll) {
+		return hll, false, ErrNotHyperLogLog
+	}
+
+	changed := false
+	if hll[4] == hllDense {
+		for _, element := range elements {
+			index, count := hllPatternLen(element)
+			if denseRegister(hll, index) < count {
+				setDenseRegister(hll, index, count)
+				changed = true
+			}
+		}
+	} else {
+		registers, err := decodeHLL(hll)
+		if err != nil {
+			return hll, false, err
+		}
+		for _, element := range elements {
+			index, count := hllPatternLen(element)
+			if registers[index] < count {
+				registers[index] = count
+				changed = true
+			}
+		}
+		if changed {
+			hll = encodeHLL(registers)
+		}
+	}
+
+	if changed {
+		invalidateHLLCache(hll)
+	}
+	return hll, changed, nil
+}
+
+// HLLCount returns the estimated cardinality of the union of HyperLogLogs.
+// The cardinality cached in the header of a single HyperLogLog is used if
+// it is valid.
+func HLLCount(hlls ...[]byte) (uint64, error) {
+	if len(hlls) == 1 && IsHyperLogLog(hlls[0]) && hlls[0][15]&0x80 == 0 {
+		return binary.LittleEndian.Uint64(hlls[0][8:16]), nil
+	}
+	registers, err := mergeHLL(hlls)
+	if err != nil {
+		return 0, err
+	}
+	return registers.estimate(), nil
+}
+
+// HLLMerge returns a HyperLogLog with the union of HyperLogLogs
+func HLLMerge(hlls ...[]byte) ([]byte, error) {
+	registers, err := mergeHLL(hlls)
+	if err != nil {
+		return nil, err
+	}
+	return encodeHLL(registers), nil
+}
+
+// mergeHLL returns the maximum of every register across HyperLogLogs
+func mergeHLL(hlls [][]byte) (*hllRegisterSet, error) {
+	var merged hllRegisterSet
+	for _, hll := range hlls {
+		registers, err := decodeHLL(hll)
+		if err != nil {
+			return nil, err
+		}
+		for i, value := range registers {
+			merged[i] = max(merged[i], value)
+		}
+	}
+	return &merged, nil
+}
+
+// hllPatternLen returns the register an element maps to and the length of
+// the run of zero bits plus one that the register must at least hold
+func hllPatternLen(element []byte) (int, uint8) {
+	hash := murmurHash64A(element, hllHashSeed)
+	index := int(hash & (hllRegisters - 1))
+	hash >>= hllP
+	// Make sure the count is at most Q+1
+	hash |= 1 << hllQ
+	return index, uint8(bits.TrailingZeros64(hash) + 1)
+}
+
+// denseRegister returns a register of a dense HyperLogLog
+func denseRegister(hll []byte, index int) uint8 {
+	registers := hll[hllHeaderSize:]
+	pos := index * hllBits / 8
+	shift := uint(index * hllBits & 7)
+	value := registers[pos] >> shift
+	if pos+1 < len(registers) {
+		value |= registers[pos+1] << (8 - shift)
+	}
+	return value & hllMaxValue
+}
+
+// setDenseRegister sets a register of a dense HyperLogLog
+func setDenseRegister(hll []byte, index int, value uint8) {
+	registers := hll[hllHeaderSize:]
+	pos := index * hllBits / 8
+	shift := uint(index * hllBits & 7)
+	registers[pos] &^= hllMaxValue << shift
+	registers[pos] |= value << shift
+	if pos+1 < len(registers) {
+		registers[pos+1] &^= hllMaxValue >> (8 - shift)
+		registers[pos+1] |= value >> (8 - shift)
+	}
+}
+
+// invalidateHLLCache marks the cached cardinality as stale
+func invalidateHLLCache(hll []byte) {
+	hll[15] |= 0x80
+}
+
+// decodeHLL returns the registers of a HyperLogLog
+func decodeHLL(hll []byte) (*hllRegisterSet, error) {
+	if !IsHyperLogLog(hll) {
+		return nil, ErrNotHyperLogLog
+	}
+
+	var registers hllRegisterSet
+	if hll[4] == hllDense {
+		for i := range registers {
+			registers[i] = denseRegister(hll, i)
+		}
+		return &registers, nil
+	}
+
+	index := 0
+	for p := hllHeaderSize; p < len(hll); p++ {
+		op := hll[p]
+		switch {
+		case op&0xc0 == 0x00: // ZERO
+			index += int(op&0x3f) + 1
+		case op&0xc0 == 0x40: // XZERO
+			if p+1 >= len(hll) {
+				return nil, ErrCorruptHyperLogLog
+			}
+			index += int(op&0x3f)<<8 | int(hll[p+1]) + 1
+			p++
+		default: // VAL
+			value := (op>>2)&0x1f + 1
+			run := int(op&0x3) + 1
+			if index+run > hllRegisters {
+				return nil, ErrCorruptHyperLogLog
+			}
+			for i := 0; i < run; i++ {
+				registers[index+i] = value
+			}
+			index += run
+		}
+		if index > hllRegisters {
+			return nil, ErrCorruptHyperLogLog
+		}
+	}
+	if index != hllRegisters {
+		return nil, ErrCorruptHyperLogLog
+	}
+	return &registers, nil
+}
+
+// encodeHLL encodes registers as a sparse HyperLogLog if they fit in
+// HLLSparseMaxBytes, as a dense one otherwise. The cached cardinality is
+// marked stale.
+func encodeHLL(registers *hllRegisterSet) []byte {
+	if sparse, ok := encodeSparseHLL(registers); ok {
+		return sparse
+	}
+
+	hll := make([]byte, hllDenseSize)
+	copy(hll, hllMagic)
+	hll[4] = hllDense
+	for i, value := range registers {
+		if value != 0 {
+			setDenseRegister(hll, i, value)
+		}
+	}
+	invalidateHLLCache(hll)
+	return hll
+}
+
+// encodeSparseHLL encodes registers in the sparse encoding, or reports
+// false if a register does not fit or the result would be too large
+func encodeSparseHLL(registers *hllRegisterSet) ([]byte, bool) {
+	hll := make([]byte, hllHeaderSize, hllHeaderSize+16)
+	copy(hll, hllMagic)
+	hll[4] = hllSparse
+	invalidateHLLCache(hll)
+
+	for i := 0; i < hllRegisters; {
+		value := registers[i]
+		run := 1
+		for i+run < hllRegisters && registers[i+run] == value {
+			run++
+		}
+		i += run
+
+		if value == 0 {
+			for run > 0 {
+				if run > hllSparseMaxZero {
+					n := min(run, hllSparseMaxXZero)
+					hll = append(hll, 0x40|byte((n-1)>>8), byte(n-1))
+					run -= n
+				} else {
+					hll = append(hll, byte(run-1))
+					run = 0
+				}
+			}
+		} else {
+			if value > hllSparseMaxValue {
+				return nil, false
+			}
+			for run > 0 {
+				n := min(run, hllSparseMaxRun)
+				hll = append(hll, 0x80|(value-1)<<2|byte(n-1))
+				run -= n
+			}
+		}
+		if len(hll) > HLLSparseMaxBytes {
+			return nil, false
+		}
+	}
+	return hll, true
+}
+
+// estimate returns the cardinality estimated from the registers, using the
+// estimator of Otmar Ertl ("New cardinality estimation algorithms for
+// HyperLogLog sketches") like Redis
+func (r *hllRegisterSet) estimate() uint64 {
+	var histogram [hllMaxValue + 1]int
+	for _, value := range r {
+		histogram[value]++
+	}
+
+	m := float64(hllRegisters)
+	z := m * hllTau((m-float64(histogram[hllQ+1]))/m)
+	for j := hllQ; j >= 1; j-- {
+		z += float64(histogram[j])
+		z *= 0.5
+	}
+	z += m * hllSigma(float64(histogram[0])/m)
+	return uint64(math.Round(hllAlphaInf * m * m / z))
+}
+
+func hllSigma(x float64) float64 {
+	if x == 1 {
+		return math.Inf(1)
+	}
+	y, z := 1.0, x
+	for {
+		x *= x
+		zPrev := z
+		z += x * y
+		y += y
+		if zPrev == z {
+			return z
+		}
+	}
+}
+
+func hllTau(x float64) float64 {
+	if x == 0 || x == 1 {
+		return 0
+	}
+	y, z := 1.0, 1-x
+	for {
+		x = math.Sqrt(x)
+		zPrev := z
+		y *= 0.5
+		z -= (1 - x) * (1 - x) * y
+		if zPrev == z {
+			return z / 3
+		}
+	}
+}
+
+// murmurHash64A is the 64-bit MurmurHash2 variant Redis hashes HyperLogLog
+// elements with
+func murmurHash64A(key []byte, seed uint64) uint64 {
+	const m = 0xc6a4a7935bd1e995
+	const r = 47
+
+	h := seed ^ uint64(len(key))*m
+	for len(key) >= 8 {
+		k := binary.LittleEndian.Uint64(key)
+		k *= m
+		k ^= k >> r
+		k *= m
+		h ^= k
+		h *= m
+		key = key[8:]
+	}
+
+	if len(key) > 0 {
+		for i := len(key) - 1; i >= 0; i-- {
+			h ^= uint64(key[i]) << (8 * i)
+		}
+		h *= m
+	}
+
+	h ^= h >> r
+	h *= m
+	h ^= h >> r
+	return h
+}
@@ -0,0 +1,118 @@
+package datastruct
+
+import (
+	"math"
+	"math/rand"
+	"strconv"
+	"testing"
+)
+
+func TestHyperLogLog_Accuracy(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	hll := NewHyperLogLog()
+
+	const n = 100000
+	batch := make([][]byte, 0, 100)
+	for i := 0; i < n; i++ {
+		batch = append(batch, []byte(strconv.FormatUint(rng.Uint64(), 36)))
+		if len(batch) == cap(batch) {
+			var err error
+			if hll, _, err = HLLAdd(hll, batch); err != nil {
+				t.Fatalf("HLLAdd failed: %v", err)
+			}
+			batch = batch[:0]
+		}
+	}
+
+	count, err := HLLCount(hll)
+	if err != nil {
+		t.Fatalf("HLLCount failed: %v", err)
+	}
+	if relErr := math.Abs(float64(count)-n) / n; relErr > 0.02 {
+		t.Errorf("Estimate %d is %.2f%% off %d", count, relErr*100, n)
+	}
+	if len(hll) != hllDenseSize {
+		t.Errorf("A HyperLogLog with %d elements should be dense, got %d bytes", n, len(hll))
+	}
+}
+
+func TestHyperLogLog_SmallCardinalitiesStaySparse(t *testing.T) {
+	hll := NewHyperLogLog()
+	if count, _ := HLLCount(hll); count != 0 {
+		t.Errorf("An empty HyperLogLog should count 0, got %d", count)
+	}
+
+	hll, changed, err := HLLAdd(hll, [][]byte{[]byte("a"), []byte("b"), []byte("c")})
+	if err != nil || !changed {
+		t.Fatalf("Adding new elements should change registers, got %v, %v", changed, err)
+	}
+	if _, changed, _ := HLLAdd(hll, [][]byte{[]byte("b")}); changed {
+		t.Error("Adding an element again should not change any register")
+	}
+	if hll[4] != hllSparse || len(hll) > 32 {
+		t.Errorf("Three elements should fit a small sparse encoding, got %d bytes", len(hll))
+	}
+	if count, _ := HLLCount(hll); count != 3 {
+		t.Errorf("Expected 3, got %d", count)
+	}
+
+	// Sparse and dense encodings of the same registers give the same count
+	for i := 0; i < 2000; i++ {
+		hll, _, _ = HLLAdd(hll, [][]byte{[]byte(strconv.Itoa(i))})
+	}
+	registers, err := decodeHLL(hll)
+	if err != nil {
+		t.Fatalf("decodeHLL failed: %v", err)
+	}
+	dense := make([]byte, hllDenseSize)
+	copy(dense, hllMagic)
+	for i, value := range registers {
+		setDenseRegister(dense, i, value)
+	}
+	invalidateHLLCache(dense)
+	sparseCount, _ := HLLCount(hll)
+	denseCount, _ := HLLCount(dense)
+	if sparseCount != denseCount {
+		t.Errorf("Sparse count %d differs from dense count %d", sparseCount, denseCount)
+	}
+}
+
+func TestHyperLogLog_Merge(t *testing.T) {
+	a, b := NewHyperLogLog(), NewHyperLogLog()
+	for i := 0; i < 3000; i++ {
+		a, _, _ = HLLAdd(a, [][]byte{[]byte("a" + strconv.Itoa(i))})
+		b, _, _ = HLLAdd(b, [][]byte{[]byte("b" + strconv.Itoa(i))})
+	}
+
+	merged, err := HLLMerge(a, b)
+	if err != nil {
+		t.Fatalf("HLLMerge failed: %v", err)
+	}
+	count, _ := HLLCount(merged)
+	union, _ := HLLCount(a, b)
+	if count != union {
+		t.Errorf("Merged count %d differs from the union count %d", count, union)
+	}
+	if relErr := math.Abs(float64(count)-6000) / 6000; relErr > 0.02 {
+		t.Errorf("Union estimate %d is %.2f%% off 6000", count, relErr*100)
+	}
+}
+
+func TestHyperLogLog_RejectsInvalidValues(t *testing.T) {
+	for _, b := range [][]byte{
+		[]byte("hello"),
+		[]byte("HYLL"),
+		append([]byte("HYLL\x00\x00\x00\x00"), make([]byte, 8)...), // dense without registers
+		append([]byte("HYLL\x02\x00\x00\x00"), make([]byte, 8)...), // unknown encoding
+	} {
+		if _, _, err := HLLAdd(b, nil); err != ErrNotHyperLogLog {
+			t.Errorf("HLLAdd(%q) should fail with ErrNotHyperLogLog, got %v", b, err)
+		}
+	}
+
+	// A sparse encoding that does not cover exactly all the registers
+	corrupt := append(NewHyperLogLog(), 0x00)
+	if _, err := HLLCount(corrupt, corrupt); err != ErrCorruptHyperLogLog {
+		t.Errorf("Expected ErrCorruptHyperLogLog, got %v", err)
+	}
+}
@@ -28,13 +28,23 @@ func (l *List) Len() int {
 	return l.size
 }
 
+// makeNodes returns the nodes of values, allocated at once. A node keeps
+// the others of its batch allocated until they are all removed, which costs
+// less than allocating a few million nodes one at a time.
+func makeNodes(values [][]byte) []listNode {
+	nodes := make([]listNode, len(values))
+	for i, value := range values {
+		nodes[i].value = value
+	}
+	return nodes
+}
+
 // LPush inserts one or more values at the head of the list
 // Returns the new length of the list
 func (l *List) LPush(values ...[]byte) int {
-	for _, value := range values {
-		node := &listNode{
-			value: value,
-		}
+	nodes := makeNodes(values)
+	for i := range nodes {
+		node := &nodes[i]
 
 		if l.head == nil {
 			l.head = node
@@ -52,10 +62,9 @@ func (l *List) LPush(values ...[]byte) int {
 // RPush inserts one or more values at the tail of the list
 // Returns the new length of the list
 func (l *List) RPush(values ...[]byte) int {
-	for _, value := range values {
-		node := &listNode{
-			value: value,
-		}
+	nodes := makeNodes(values)
+	for i := range nodes {
+		node := &nodes[i]
 
 		if l.tail == nil {
 			l.head = node
@@ -155,33 +164,8 @@ func (l *List) LSet(index int, value []byte) error {
 // Supports negative indices (index -1 is the tail)
 // Returns empty slice if range is invalid
 func (l *List) LRange(start, stop int) [][]byte {
-	if l.size == 0 {
-		return [][]byte{}
-	}
-
-	// Normalize negative indices
-	if start < 0 {
-		start = l.size + start
-		if start < 0 {
-			start = 0
-		}
-	}
-	if stop < 0 {
-		stop = l.size + stop
-		if stop < 0 {
-			return [][]byte{}
-		}
-	}
-
-	// Clamp to valid range
-	if start >= l.size {
-		return [][]byte{}
-	}
-	if stop >= l.size {
-		stop = l.size - 1
-	}
-
-	if start > stop {
+	start, stop, ok := NormalizeRange(start, stop, l.size)
+	if !ok {
 		return [][]byte{}
 	}
 
@@ -201,41 +185,8 @@ func (l *List) LRange(start, stop int) [][]byte {
 // LTrim trims the list to only contain elements from start to stop (inclusive)
 // Supports negative indices
 func (l *List) LTrim(start, stop int) {
-	if l.size == 0 {
-		return
-	}
-
-	// Normalize negative indices
-	if start < 0 {
-		start = l.size + start
-		if start < 0 {
-			start = 0
-		}
-	}
-	if stop < 0 {
-		stop = l.size + stop
-		if stop < 0 {
-			// Trim everything
-			l.head = nil
-			l.tail = nil
-			l.size = 0
-			return
-		}
-	}
-
-	// Clamp to valid range
-	if start >= l.size {
-		// Trim everything
-		l.head = nil
-		l.tail = nil
-		l.size = 0
-		return
-	}
-	if stop >= l.size {
-		stop = l.size - 1
-	}
-
-	if start > stop {
+	start, stop, ok := NormalizeRange(start, stop, l.size)
+	if !ok {
 		// Trim everything
 		l.head = nil
 		l.tail = nil
@@ -398,6 +349,16 @@ func (l *List) GetAll() [][]byte {
 	return result
 }
 
+// Clone returns a copy of the list sharing the element bytes, which are
+// never modified in place
+func (l *List) Clone() *List {
+	clone := &List{}
+	if l.size > 0 {
+		clone.RPush(l.GetAll()...)
+	}
+	return clone
+}
+
 // Clear removes all elements from the list
 func (l *List) Clear() {
 	l.head = nil
@@ -1,6 +1,7 @@
 package datastruct
 
 import (
+	"strconv"
 	"testing"
 )
 
@@ -511,3 +512,19 @@ func TestList_EdgeCases(t *testing.T) {
 		t.Errorf("Expected nil from empty list, got '%s'", string(val))
 	}
 }
+
+// BenchmarkList_RPush100k pushes 100k values with a single RPush, as a
+// RPUSH with 100k arguments does
+func BenchmarkList_RPush100k(b *testing.B) {
+	values := make([][]byte, 100000)
+	for i := range values {
+		values[i] = []byte(strconv.Itoa(i))
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		list := MakeList().Data.(*List)
+		list.RPush(values...)
+	}
+}
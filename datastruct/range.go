@@ -0,0 +1,27 @@
+package datastruct
+
+// NormalizeRange translates an inclusive range of indexes, as taken by
+// LRANGE, LTRIM, ZRANGE and GETRANGE, over length elements into positions in
+// [0, length). As in Redis, a negative index counts from the end (-1 is the
+// last element), a start before the first element is moved to it and a stop
+// past the last element is moved to it. It returns false if no element is in
+// the range: when start is past stop or the last element, when stop is before
+// the first element, or when length is 0.
+func NormalizeRange(start, stop, length int) (int, int, bool) {
+	if start < 0 {
+		start += length
+	}
+	if stop < 0 {
+		stop += length
+	}
+	if start < 0 {
+		start = 0
+	}
+	if start > stop || start >= length {
+		return 0, 0, false
+	}
+	if stop >= length {
+		stop = length - 1
+	}
+	return start, stop, true
+}
@@ -0,0 +1,103 @@
+package datastruct
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+// rangeTests are the edge cases of index ranges, over the elements of
+// "abcde" (or of "" when empty is set), with the elements Redis returns
+var rangeTests = []struct {
+	name        string
+	empty       bool
+	start, stop int
+	want        string
+}{
+	{"whole", false, 0, -1, "abcde"},
+	{"inner", false, 1, 3, "bcd"},
+	{"single", false, 2, 2, "c"},
+	{"start after stop", false, 3, 1, ""},
+	{"both negative", false, -3, -2, "cd"},
+	{"both negative, start after stop", false, -2, -3, ""},
+	{"negative start before first", false, -100, 1, "ab"},
+	{"negative stop before first", false, 0, -100, ""},
+	{"both before first", false, -100, -50, ""},
+	{"stop beyond length", false, 3, 100, "de"},
+	{"stop at max int", false, 0, math.MaxInt, "abcde"},
+	{"start at min int", false, math.MinInt, -1, "abcde"},
+	{"start at length", false, 5, 10, ""},
+	{"start beyond length", false, 100, 200, ""},
+	{"empty", true, 0, -1, ""},
+	{"empty, zero range", true, 0, 0, ""},
+	{"empty, negative", true, -1, -1, ""},
+}
+
+func TestNormalizeRange(t *testing.T) {
+	for _, tt := range rangeTests {
+		length := 5
+		if tt.empty {
+			length = 0
+		}
+		start, stop, ok := NormalizeRange(tt.start, tt.stop, length)
+		if ok != (tt.want != "") {
+			t.Errorf("%s: expected ok %v, got %v", tt.name, tt.want != "", ok)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		if got := "abcde"[start : stop+1]; got != tt.want {
+			t.Errorf("%s: expected %q, got %q", tt.name, tt.want, got)
+		}
+	}
+}
+
+// TestRangeCommands checks that every type that takes a range of indexes
+// returns the same elements for it
+func TestRangeCommands(t *testing.T) {
+	join := func(elements [][]byte) string {
+		var b strings.Builder
+		for _, e := range elements {
+			b.Write(e)
+		}
+		return b.String()
+	}
+
+	for _, tt := range rangeTests {
+		t.Run(tt.name, func(t *testing.T) {
+			elements := "abcde"
+			if tt.empty {
+				elements = ""
+			}
+
+			list := MakeList().Data.(*List)
+			zset := MakeSortedSet().Data.(*SortedSet)
+			// Scores in reverse order, for RevRange to list the elements in order
+			revZset := MakeSortedSet().Data.(*SortedSet)
+			for i, c := range elements {
+				list.RPush([]byte{byte(c)})
+				zset.Add(float64(i), []byte{byte(c)})
+				revZset.Add(float64(-i), []byte{byte(c)})
+			}
+			str := MakeString([]byte(elements)).Data.(*String)
+
+			if got := join(list.LRange(tt.start, tt.stop)); got != tt.want {
+				t.Errorf("LRange: expected %q, got %q", tt.want, got)
+			}
+			if got := join(zset.Range(tt.start, tt.stop, false)); got != tt.want {
+				t.Errorf("Range: expected %q, got %q", tt.want, got)
+			}
+			if got := join(revZset.RevRange(tt.start, tt.stop, false)); got != tt.want {
+				t.Errorf("RevRange: expected %q, got %q", tt.want, got)
+			}
+			if got := string(str.GetRange(tt.start, tt.stop)); got != tt.want {
+				t.Errorf("GetRange: expected %q, got %q", tt.want, got)
+			}
+			list.LTrim(tt.start, tt.stop)
+			if got := join(list.LRange(0, -1)); got != tt.want {
+				t.Errorf("LTrim: expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
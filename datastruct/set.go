@@ -1,29 +1,91 @@
 package datastruct
 
 import (
-	"bytes"
+	"slices"
+	"sort"
+
+	"github.com/wangbo/gocache/util/random"
 )
 
 // Set represents a Redis set data structure (unordered collection of unique strings)
+//
+// The members are kept in a slice, with the position of each one in a map, so
+// that a uniformly random member is picked in O(1). A removed member is
+// replaced by the last one. The zero value is an empty set.
 type Set struct {
-	data map[string]struct{}
+	index   map[string]int // Position of each member in members
+	members []string
+}
+
+// setRand picks the members of Pop, GetRandom and GetRandomMembers, for
+// every set
+var setRand = random.New(random.Seed())
+
+// SeedRandom reseeds the source Pop, GetRandom and GetRandomMembers pick
+// members with, so that tests get the same picks on every run
+func SeedRandom(seed int64) {
+	setRand.Seed(seed)
 }
 
 // MakeSet creates a new Set wrapped in DataEntity
 func MakeSet() *DataEntity {
 	return &DataEntity{Data: &Set{
-		data: make(map[string]struct{}),
+		index: make(map[string]int),
 	}}
 }
 
+// add adds a member and reports whether it was missing
+func (s *Set) add(member string) bool {
+	if _, exists := s.index[member]; exists {
+		return false
+	}
+	if s.index == nil {
+		s.index = make(map[string]int)
+	}
+	s.index[member] = len(s.members)
+	s.members = append(s.members, member)
+	return true
+}
+
+// grow makes room for n more members, so that adding many members at once
+// does not grow the set over and over. The index is only rebuilt when n
+// members would more than double it.
+func (s *Set) grow(n int) {
+	if n <= 1 {
+		return
+	}
+	if n > len(s.index) {
+		index := make(map[string]int, len(s.index)+n)
+		for member, i := range s.index {
+			index[member] = i
+		}
+		s.index = index
+	}
+	s.members = slices.Grow(s.members, n)
+}
+
+// remove removes a member and reports whether it was present
+func (s *Set) remove(member string) bool {
+	i, exists := s.index[member]
+	if !exists {
+		return false
+	}
+	last := len(s.members) - 1
+	s.members[i] = s.members[last]
+	s.index[s.members[i]] = i
+	s.members[last] = ""
+	s.members = s.members[:last]
+	delete(s.index, member)
+	return true
+}
+
 // Add adds one or more members to the set
 // Returns the number of members that were added (excluding those already present)
 func (s *Set) Add(members ...[]byte) int {
+	s.grow(len(members))
 	count := 0
 	for _, member := range members {
-		key := string(member)
-		if _, exists := s.data[key]; !exists {
-			s.data[key] = struct{}{}
+		if s.add(string(member)) {
 			count++
 		}
 	}
@@ -35,9 +97,7 @@ func (s *Set) Add(members ...[]byte) int {
 func (s *Set) Remove(members ...[]byte) int {
 	count := 0
 	for _, member := range members {
-		key := string(member)
-		if _, exists := s.data[key]; exists {
-			delete(s.data, key)
+		if s.remove(string(member)) {
 			count++
 		}
 	}
@@ -46,99 +106,125 @@ func (s *Set) Remove(members ...[]byte) int {
 
 // IsMember checks if member is in the set
 func (s *Set) IsMember(member []byte) bool {
-	_, exists := s.data[string(member)]
+	_, exists := s.index[string(member)]
 	return exists
 }
 
 // Members returns all members of the set
 func (s *Set) Members() [][]byte {
-	result := make([][]byte, 0, len(s.data))
-	for member := range s.data {
-		result = append(result, []byte(member))
-	}
-	return result
+	return toBytes(s.members)
 }
 
 // Len returns the number of members in the set
 func (s *Set) Len() int {
-	return len(s.data)
+	return len(s.members)
 }
 
 // Pop removes and returns a random member from the set
 // Returns nil if set is empty
 func (s *Set) Pop() []byte {
-	for member := range s.data {
-		delete(s.data, member)
-		return []byte(member)
+	if len(s.members) == 0 {
+		return nil
 	}
-	return nil
+	member := s.members[setRand.Intn(len(s.members))]
+	s.remove(member)
+	return []byte(member)
 }
 
 // GetRandom returns a random member from the set without removing it
 // Returns nil if set is empty
 func (s *Set) GetRandom() []byte {
-	for member := range s.data {
-		return []byte(member)
+	if len(s.members) == 0 {
+		return nil
 	}
-	return nil
+	return []byte(s.members[setRand.Intn(len(s.members))])
 }
 
-// GetRandomMembers returns n random members from the set without removing them
-// Returns at most n members (fewer if set has less than n members)
+// GetRandomMembers returns n distinct random members from the set without
+// removing them. Returns at most n members (fewer if set has less than n
+// members)
 func (s *Set) GetRandomMembers(n int) [][]byte {
-	result := make([][]byte, 0, n)
-	for member := range s.data {
-		if len(result) >= n {
-			break
+	if n <= 0 {
+		return [][]byte{}
+	}
+	if n >= len(s.members) {
+		return s.Members()
+	}
+
+	// A partial Fisher-Yates shuffle of the positions, whose swaps are
+	// recorded in a map instead of being applied to the set: O(n) whatever
+	// the size of the set
+	swapped := make(map[int]int, n)
+	position := func(i int) int {
+		if j, ok := swapped[i]; ok {
+			return j
 		}
-		result = append(result, []byte(member))
+		return i
+	}
+	result := make([][]byte, n)
+	for i := 0; i < n; i++ {
+		j := i + setRand.Intn(len(s.members)-i)
+		picked := position(j)
+		swapped[j] = position(i)
+		result[i] = []byte(s.members[picked])
 	}
 	return result
 }
 
 // Diff returns the difference between this set and other sets (members in this set but not in others)
+//
+// The members of this set are probed in each other set, which costs a lookup
+// per remaining member and set instead of copying the others, and it stops
+// as soon as nothing remains.
 func (s *Set) Diff(others []*Set) [][]byte {
-	if len(s.data) == 0 {
-		return [][]byte{}
-	}
-
-	// Build a set of members to exclude
-	exclude := make(map[string]struct{})
+	remaining := s.members
+	copied := false // Whether remaining is a copy, which is filtered in place
 	for _, other := range others {
-		if other == nil {
+		if len(remaining) == 0 {
+			break
+		}
+		if other == nil || len(other.members) == 0 {
 			continue
 		}
-		for member := range other.data {
-			exclude[member] = struct{}{}
+		kept := remaining[:0]
+		if !copied {
+			kept = make([]string, 0, len(remaining))
+			copied = true
 		}
-	}
-
-	// Collect members not in exclude
-	result := make([][]byte, 0)
-	for member := range s.data {
-		if _, excluded := exclude[member]; !excluded {
-			result = append(result, []byte(member))
+		for _, member := range remaining {
+			if _, excluded := other.index[member]; !excluded {
+				kept = append(kept, member)
+			}
 		}
+		remaining = kept
 	}
-	return result
+	return toBytes(remaining)
 }
 
 // Intersect returns the intersection of this set with other sets
+//
+// Only the members of the smallest set are probed, in the other sets from
+// the smallest, so that a small set intersected with a large one costs a few
+// lookups whatever the size of the large one.
 func (s *Set) Intersect(others []*Set) [][]byte {
-	if len(s.data) == 0 {
+	sets := make([]*Set, 0, len(others)+1)
+	sets = append(sets, s)
+	for _, other := range others {
+		if other == nil || len(other.members) == 0 {
+			return [][]byte{}
+		}
+		sets = append(sets, other)
+	}
+	if len(s.members) == 0 {
 		return [][]byte{}
 	}
+	sort.Slice(sets, func(i, j int) bool { return len(sets[i].members) < len(sets[j].members) })
 
-	// Find members that exist in all sets
 	result := make([][]byte, 0)
-	for member := range s.data {
+	for _, member := range sets[0].members {
 		inAll := true
-		for _, other := range others {
-			if other == nil {
-				inAll = false
-				break
-			}
-			if _, exists := other.data[member]; !exists {
+		for _, other := range sets[1:] {
+			if _, exists := other.index[member]; !exists {
 				inAll = false
 				break
 			}
@@ -150,30 +236,41 @@ func (s *Set) Intersect(others []*Set) [][]byte {
 	return result
 }
 
-// Union returns the union of this set with other sets
+// Union returns the union of this set with other sets, the members of this
+// set first and then the new members of each other set
 func (s *Set) Union(others []*Set) [][]byte {
-	// Use a map to deduplicate
-	seen := make(map[string]struct{})
-
-	// Add members from this set
-	for member := range s.data {
-		seen[member] = struct{}{}
+	total := len(s.members)
+	for _, other := range others {
+		if other != nil {
+			total += len(other.members)
+		}
 	}
 
-	// Add members from other sets
-	for _, other := range others {
-		if other == nil {
-			continue
+	// A member is copied once, the first time it is seen
+	seen := make(map[string]struct{}, total)
+	result := make([][]byte, 0, total)
+	add := func(members []string) {
+		for _, member := range members {
+			if _, ok := seen[member]; !ok {
+				seen[member] = struct{}{}
+				result = append(result, []byte(member))
+			}
 		}
-		for member := range other.data {
-			seen[member] = struct{}{}
+	}
+	add(s.members)
+	for _, other := range others {
+		if other != nil {
+			add(other.members)
 		}
 	}
+	return result
+}
 
-	// Convert to result
-	result := make([][]byte, 0, len(seen))
-	for member := range seen {
-		result = append(result, []byte(member))
+// toBytes returns a copy of members as byte slices
+func toBytes(members []string) [][]byte {
+	result := make([][]byte, len(members))
+	for i, member := range members {
+		result[i] = []byte(member)
 	}
 	return result
 }
@@ -183,8 +280,8 @@ func (s *Set) IsSubset(other *Set) bool {
 	if other == nil {
 		return false
 	}
-	for member := range s.data {
-		if _, exists := other.data[member]; !exists {
+	for _, member := range s.members {
+		if _, exists := other.index[member]; !exists {
 			return false
 		}
 	}
@@ -195,46 +292,62 @@ func (s *Set) IsSubset(other *Set) bool {
 // Returns true if member was moved, false if member was not in this set
 func (s *Set) Move(other *Set, member []byte) bool {
 	key := string(member)
-	if _, exists := s.data[key]; !exists {
+	if !s.remove(key) {
 		return false
 	}
-
-	delete(s.data, key)
-	if other.data == nil {
-		other.data = make(map[string]struct{})
-	}
-	other.data[key] = struct{}{}
+	other.add(key)
 	return true
 }
 
-// Scan iterates over members with a cursor
-// Returns the next cursor and members in this batch
-// Cursor 0 indicates start, cursor 0 indicates end
+// Scan returns up to count members from cursor and the cursor of the next
+// call; cursor 0 starts an iteration and a returned 0 ends it. The members
+// are visited from the last position down, the cursor being the number of
+// positions not yet visited: a removed member is replaced by the last one,
+// which was visited first, so every member present for the whole iteration
+// is returned whatever is written between the calls.
 func (s *Set) Scan(cursor int64, count int64) (int64, [][]byte) {
-	members := s.Members()
-	total := int64(len(members))
-
-	if cursor >= total {
-		return 0, [][]byte{}
+	low, high := scanRange(cursor, count, len(s.members))
+	batch := make([][]byte, 0, high-low)
+	for i := high - 1; i >= low; i-- {
+		batch = append(batch, []byte(s.members[i]))
 	}
+	return int64(low), batch
+}
 
-	end := cursor + count
-	if end > total {
-		end = total
+// scanRange returns the positions [low, high) that Set.Scan and
+// SortedSet.Scan visit, from the last down, for a cursor over n positions;
+// low is the next cursor
+func scanRange(cursor, count int64, n int) (low, high int) {
+	high = n
+	if cursor > 0 && cursor < int64(n) {
+		high = int(cursor)
 	}
-
-	batch := members[cursor:end]
-
-	if end >= total {
-		return 0, batch
+	if count < 1 {
+		count = 1
+	}
+	low = 0
+	if int64(high) > count {
+		low = high - int(count)
 	}
+	return low, high
+}
 
-	return end, batch
+// Clone returns a copy of the set
+func (s *Set) Clone() *Set {
+	clone := &Set{
+		index:   make(map[string]int, len(s.index)),
+		members: slices.Clone(s.members),
+	}
+	for member, i := range s.index {
+		clone.index[member] = i
+	}
+	return clone
 }
 
 // Clear removes all members from the set
 func (s *Set) Clear() {
-	s.data = make(map[string]struct{})
+	s.index = make(map[string]int)
+	s.members = nil
 }
 
 // HasSameMembersAs checks if two sets have exactly the same members
@@ -243,12 +356,12 @@ func (s *Set) HasSameMembersAs(other *Set) bool {
 		return false
 	}
 
-	if len(s.data) != len(other.data) {
+	if len(s.members) != len(other.members) {
 		return false
 	}
 
-	for member := range s.data {
-		if _, exists := other.data[member]; !exists {
+	for _, member := range s.members {
+		if _, exists := other.index[member]; !exists {
 			return false
 		}
 	}
@@ -258,7 +371,7 @@ func (s *Set) HasSameMembersAs(other *Set) bool {
 
 // String returns a string representation of the set
 func (s *Set) String() string {
-	if len(s.data) == 0 {
+	if len(s.members) == 0 {
 		return "{}"
 	}
 
@@ -276,10 +389,6 @@ func (s *Set) String() string {
 
 // EqualBytes compares if a byte slice equals a member in the set
 func (s *Set) EqualBytes(member []byte) bool {
-	for m := range s.data {
-		if bytes.Equal([]byte(m), member) {
-			return true
-		}
-	}
-	return false
+	_, exists := s.index[string(member)]
+	return exists
 }
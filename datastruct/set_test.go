@@ -1,7 +1,13 @@
 package datastruct
 
 import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
 	"testing"
+
+	"github.com/wangbo/gocache/util/random"
 )
 
 func TestMakeSet(t *testing.T) {
@@ -26,7 +32,7 @@ func TestMakeSet(t *testing.T) {
 }
 
 func TestSet_Add(t *testing.T) {
-	set := &Set{data: make(map[string]struct{})}
+	set := &Set{}
 
 	// Add single member
 	count := set.Add([]byte("a"))
@@ -54,7 +60,7 @@ func TestSet_Add(t *testing.T) {
 }
 
 func TestSet_Remove(t *testing.T) {
-	set := &Set{data: make(map[string]struct{})}
+	set := &Set{}
 	set.Add([]byte("a"), []byte("b"), []byte("c"))
 
 	// Remove existing member
@@ -83,7 +89,7 @@ func TestSet_Remove(t *testing.T) {
 }
 
 func TestSet_IsMember(t *testing.T) {
-	set := &Set{data: make(map[string]struct{})}
+	set := &Set{}
 	set.Add([]byte("a"), []byte("b"), []byte("c"))
 
 	if !set.IsMember([]byte("a")) {
@@ -98,7 +104,7 @@ func TestSet_IsMember(t *testing.T) {
 }
 
 func TestSet_Members(t *testing.T) {
-	set := &Set{data: make(map[string]struct{})}
+	set := &Set{}
 	set.Add([]byte("a"), []byte("b"), []byte("c"))
 
 	members := set.Members()
@@ -117,14 +123,14 @@ func TestSet_Members(t *testing.T) {
 	}
 
 	// Empty set
-	emptySet := &Set{data: make(map[string]struct{})}
+	emptySet := &Set{}
 	if len(emptySet.Members()) != 0 {
 		t.Error("Expected no members from empty set")
 	}
 }
 
 func TestSet_Len(t *testing.T) {
-	set := &Set{data: make(map[string]struct{})}
+	set := &Set{}
 
 	if set.Len() != 0 {
 		t.Errorf("Expected length 0, got %d", set.Len())
@@ -141,14 +147,23 @@ func TestSet_Len(t *testing.T) {
 	}
 }
 
+// seedRandom makes the picks of the random set operations reproducible for
+// the duration of the test
+func seedRandom(t *testing.T, seed int64) {
+	t.Helper()
+	SeedRandom(seed)
+	t.Cleanup(func() { SeedRandom(random.Seed()) })
+}
+
 func TestSet_Pop(t *testing.T) {
-	set := &Set{data: make(map[string]struct{})}
+	seedRandom(t, 1)
+	set := &Set{}
 	set.Add([]byte("a"), []byte("b"), []byte("c"))
 
 	// Pop a member
 	member := set.Pop()
-	if member == nil {
-		t.Fatal("Expected to pop a member, got nil")
+	if string(member) != "c" {
+		t.Fatalf("Expected to pop c, got %q", member)
 	}
 	if set.IsMember(member) {
 		t.Error("Popped member should not be in set anymore")
@@ -172,13 +187,14 @@ func TestSet_Pop(t *testing.T) {
 }
 
 func TestSet_GetRandom(t *testing.T) {
-	set := &Set{data: make(map[string]struct{})}
+	seedRandom(t, 1)
+	set := &Set{}
 	set.Add([]byte("a"), []byte("b"), []byte("c"))
 
 	// Get random member without removal
 	member := set.GetRandom()
-	if member == nil {
-		t.Fatal("Expected to get a random member, got nil")
+	if string(member) != "c" {
+		t.Fatalf("Expected to get c, got %q", member)
 	}
 	if !set.IsMember(member) {
 		t.Error("Random member should still be in set")
@@ -188,20 +204,21 @@ func TestSet_GetRandom(t *testing.T) {
 	}
 
 	// Empty set
-	emptySet := &Set{data: make(map[string]struct{})}
+	emptySet := &Set{}
 	if emptySet.GetRandom() != nil {
 		t.Error("Expected nil from empty set")
 	}
 }
 
 func TestSet_GetRandomMembers(t *testing.T) {
-	set := &Set{data: make(map[string]struct{})}
+	seedRandom(t, 1)
+	set := &Set{}
 	set.Add([]byte("a"), []byte("b"), []byte("c"), []byte("d"), []byte("e"))
 
 	// Get 2 random members
 	members := set.GetRandomMembers(2)
-	if len(members) != 2 {
-		t.Errorf("Expected 2 members, got %d", len(members))
+	if got := fmt.Sprintf("%s", members); got != "[b e]" {
+		t.Errorf("Expected [b e], got %s", got)
 	}
 
 	// Get more than available
@@ -211,17 +228,93 @@ func TestSet_GetRandomMembers(t *testing.T) {
 	}
 
 	// Get from empty set
-	emptySet := &Set{data: make(map[string]struct{})}
+	emptySet := &Set{}
 	if len(emptySet.GetRandomMembers(5)) != 0 {
 		t.Error("Expected no members from empty set")
 	}
 }
 
+func TestSet_GetRandomMembersDistinct(t *testing.T) {
+	set := &Set{}
+	for i := 0; i < 1000; i++ {
+		set.Add([]byte(strconv.Itoa(i)))
+	}
+
+	for round := 0; round < 100; round++ {
+		seen := make(map[string]bool)
+		for _, member := range set.GetRandomMembers(100) {
+			if seen[string(member)] {
+				t.Fatalf("Member %s returned twice", member)
+			}
+			if !set.IsMember(member) {
+				t.Fatalf("Member %s is not in the set", member)
+			}
+			seen[string(member)] = true
+		}
+		if len(seen) != 100 {
+			t.Fatalf("Expected 100 members, got %d", len(seen))
+		}
+	}
+	if set.Len() != 1000 {
+		t.Errorf("Expected GetRandomMembers not to modify the set, got length %d", set.Len())
+	}
+}
+
+// TestSet_PopUniform checks with a chi-squared test that Pop picks every
+// member with the same probability, including after removals have reordered
+// the members
+func TestSet_PopUniform(t *testing.T) {
+	const members, rounds = 10, 20000
+	counts := make(map[string]int)
+	set := &Set{}
+	for round := 0; round < rounds; round++ {
+		set.Clear()
+		for i := 0; i < members+5; i++ {
+			set.Add([]byte(strconv.Itoa(i)))
+		}
+		// Remove a few members from the middle of the set
+		set.Remove([]byte("2"), []byte("7"), []byte("11"), []byte("12"), []byte("13"))
+		counts[string(set.Pop())]++
+	}
+
+	if len(counts) != members {
+		t.Fatalf("Expected all %d members to be popped, got %v", members, counts)
+	}
+	expected := float64(rounds) / members
+	chi2 := 0.0
+	for _, count := range counts {
+		diff := float64(count) - expected
+		chi2 += diff * diff / expected
+	}
+	// 9 degrees of freedom: 27.88 is exceeded with probability 0.001
+	if chi2 > 27.88 {
+		t.Errorf("Pop is not uniform: chi2 = %.2f, counts %v", chi2, counts)
+	}
+}
+
+func BenchmarkSetPopCount100(b *testing.B) {
+	set := &Set{}
+	for i := 0; i < 1000000; i++ {
+		set.Add([]byte(strconv.Itoa(i)))
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		popped := set.GetRandomMembers(100)
+		set.Remove(popped...)
+		if set.Len() < 100 {
+			b.StopTimer()
+			set.Add(popped...)
+			b.StartTimer()
+		}
+	}
+}
+
 func TestSet_Diff(t *testing.T) {
-	set1 := &Set{data: make(map[string]struct{})}
+	set1 := &Set{}
 	set1.Add([]byte("a"), []byte("b"), []byte("c"))
 
-	set2 := &Set{data: make(map[string]struct{})}
+	set2 := &Set{}
 	set2.Add([]byte("c"), []byte("d"), []byte("e"))
 
 	// set1 - set2 = {a, b}
@@ -240,7 +333,7 @@ func TestSet_Diff(t *testing.T) {
 	}
 
 	// Empty diff
-	set3 := &Set{data: make(map[string]struct{})}
+	set3 := &Set{}
 	set3.Add([]byte("a"), []byte("b"), []byte("c"))
 	diff = set3.Diff([]*Set{set1})
 	if len(diff) != 0 {
@@ -249,13 +342,13 @@ func TestSet_Diff(t *testing.T) {
 }
 
 func TestSet_Intersect(t *testing.T) {
-	set1 := &Set{data: make(map[string]struct{})}
+	set1 := &Set{}
 	set1.Add([]byte("a"), []byte("b"), []byte("c"))
 
-	set2 := &Set{data: make(map[string]struct{})}
+	set2 := &Set{}
 	set2.Add([]byte("c"), []byte("d"), []byte("e"))
 
-	set3 := &Set{data: make(map[string]struct{})}
+	set3 := &Set{}
 	set3.Add([]byte("b"), []byte("c"), []byte("f"))
 
 	// set1 ∩ set2 ∩ set3 = {c}
@@ -268,7 +361,7 @@ func TestSet_Intersect(t *testing.T) {
 	}
 
 	// No intersection
-	set4 := &Set{data: make(map[string]struct{})}
+	set4 := &Set{}
 	set4.Add([]byte("x"), []byte("y"))
 	intersect = set1.Intersect([]*Set{set4})
 	if len(intersect) != 0 {
@@ -277,13 +370,13 @@ func TestSet_Intersect(t *testing.T) {
 }
 
 func TestSet_Union(t *testing.T) {
-	set1 := &Set{data: make(map[string]struct{})}
+	set1 := &Set{}
 	set1.Add([]byte("a"), []byte("b"))
 
-	set2 := &Set{data: make(map[string]struct{})}
+	set2 := &Set{}
 	set2.Add([]byte("c"), []byte("d"))
 
-	set3 := &Set{data: make(map[string]struct{})}
+	set3 := &Set{}
 	set3.Add([]byte("b"), []byte("e"))
 
 	// set1 ∪ set2 ∪ set3 = {a, b, c, d, e}
@@ -305,13 +398,13 @@ func TestSet_Union(t *testing.T) {
 }
 
 func TestSet_IsSubset(t *testing.T) {
-	set1 := &Set{data: make(map[string]struct{})}
+	set1 := &Set{}
 	set1.Add([]byte("a"), []byte("b"))
 
-	set2 := &Set{data: make(map[string]struct{})}
+	set2 := &Set{}
 	set2.Add([]byte("a"), []byte("b"), []byte("c"))
 
-	set3 := &Set{data: make(map[string]struct{})}
+	set3 := &Set{}
 	set3.Add([]byte("a"), []byte("c"))
 
 	// set1 ⊆ set2 = true
@@ -325,17 +418,17 @@ func TestSet_IsSubset(t *testing.T) {
 	}
 
 	// Empty set is subset of any set
-	emptySet := &Set{data: make(map[string]struct{})}
+	emptySet := &Set{}
 	if !emptySet.IsSubset(set1) {
 		t.Error("Expected empty set to be subset of set1")
 	}
 }
 
 func TestSet_Move(t *testing.T) {
-	set1 := &Set{data: make(map[string]struct{})}
+	set1 := &Set{}
 	set1.Add([]byte("a"), []byte("b"), []byte("c"))
 
-	set2 := &Set{data: make(map[string]struct{})}
+	set2 := &Set{}
 	set2.Add([]byte("d"))
 
 	// Move existing member
@@ -358,7 +451,7 @@ func TestSet_Move(t *testing.T) {
 }
 
 func TestSet_Scan(t *testing.T) {
-	set := &Set{data: make(map[string]struct{})}
+	set := &Set{}
 	set.Add([]byte("a"), []byte("b"), []byte("c"), []byte("d"), []byte("e"))
 
 	// First scan
@@ -388,18 +481,48 @@ func TestSet_Scan(t *testing.T) {
 		t.Error("Expected cursor 0 for complete scan")
 	}
 
-	// Scan beyond end
+	// A cursor beyond the end, left by members removed since the previous
+	// call, resumes from the last member
 	cursor, members = set.Scan(100, 2)
-	if cursor != 0 {
-		t.Error("Expected cursor 0 when starting beyond end")
+	if cursor != 3 || len(members) != 2 {
+		t.Errorf("Expected 2 members and cursor 3 when starting beyond end, got %d and %d", len(members), cursor)
 	}
-	if len(members) != 0 {
-		t.Error("Expected no members when starting beyond end")
+}
+
+func TestSet_ScanWithRemovals(t *testing.T) {
+	set := &Set{}
+	for i := 0; i < 100; i++ {
+		set.Add([]byte(strconv.Itoa(i)))
+	}
+
+	seen := make(map[string]bool)
+	cursor, calls := int64(0), 0
+	for {
+		var members [][]byte
+		cursor, members = set.Scan(cursor, 3)
+		for _, m := range members {
+			seen[string(m)] = true
+		}
+		// Remove members between the calls, returned or not, and add
+		// new ones
+		calls++
+		set.Remove([]byte(strconv.Itoa(calls * 7 % 100)))
+		set.Add([]byte("new" + strconv.Itoa(calls)))
+		if cursor == 0 {
+			break
+		}
+	}
+
+	for i := 0; i < 100; i++ {
+		member := strconv.Itoa(i)
+		if set.IsMember([]byte(member)) && !seen[member] {
+			t.Errorf("Member %s present for the whole scan but not returned", member)
+		}
 	}
 }
 
 func TestSet_Clear(t *testing.T) {
-	set := &Set{data: make(map[string]struct{})}
+	set := &Set{}
 	set.Add([]byte("a"), []byte("b"), []byte("c"))
 
 	set.Clear()
@@ -410,13 +533,13 @@ func TestSet_Clear(t *testing.T) {
 }
 
 func TestSet_HasSameMembersAs(t *testing.T) {
-	set1 := &Set{data: make(map[string]struct{})}
+	set1 := &Set{}
 	set1.Add([]byte("a"), []byte("b"), []byte("c"))
 
-	set2 := &Set{data: make(map[string]struct{})}
+	set2 := &Set{}
 	set2.Add([]byte("a"), []byte("b"), []byte("c"))
 
-	set3 := &Set{data: make(map[string]struct{})}
+	set3 := &Set{}
 	set3.Add([]byte("a"), []byte("b"))
 
 	// Same members
@@ -436,7 +559,7 @@ func TestSet_HasSameMembersAs(t *testing.T) {
 }
 
 func TestSet_String(t *testing.T) {
-	set := &Set{data: make(map[string]struct{})}
+	set := &Set{}
 	set.Add([]byte("a"), []byte("b"), []byte("c"))
 
 	str := set.String()
@@ -445,14 +568,14 @@ func TestSet_String(t *testing.T) {
 	}
 
 	// Empty set
-	emptySet := &Set{data: make(map[string]struct{})}
+	emptySet := &Set{}
 	if emptySet.String() != "{}" {
 		t.Errorf("Expected '{}' for empty set, got '%s'", emptySet.String())
 	}
 }
 
 func TestSet_EdgeCases(t *testing.T) {
-	set := &Set{data: make(map[string]struct{})}
+	set := &Set{}
 
 	// Add empty byte slice
 	count := set.Add([]byte(""))
@@ -483,7 +606,7 @@ func TestSet_EdgeCases(t *testing.T) {
 }
 
 func TestSet_EqualBytes(t *testing.T) {
-	set := &Set{data: make(map[string]struct{})}
+	set := &Set{}
 	set.Add([]byte("a"), []byte("b"), []byte("c"))
 
 	if !set.EqualBytes([]byte("a")) {
@@ -551,10 +674,10 @@ func TestSlicesEqual(t *testing.T) {
 }
 
 func TestSet_ReflectDeepEqual(t *testing.T) {
-	set1 := &Set{data: make(map[string]struct{})}
+	set1 := &Set{}
 	set1.Add([]byte("a"), []byte("b"))
 
-	set2 := &Set{data: make(map[string]struct{})}
+	set2 := &Set{}
 	set2.Add([]byte("b"), []byte("a"))
 
 	// Members() may return different order, but should contain same elements
@@ -577,3 +700,207 @@ func TestSet_ReflectDeepEqual(t *testing.T) {
 		}
 	}
 }
+
+// The set algebra of a plain map of every set, to check Diff, Intersect and
+// Union against
+
+func referenceSets(sets []*Set) []map[string]bool {
+	maps := make([]map[string]bool, len(sets))
+	for i, set := range sets {
+		maps[i] = make(map[string]bool)
+		for _, member := range set.Members() {
+			maps[i][string(member)] = true
+		}
+	}
+	return maps
+}
+
+func referenceDiff(sets []*Set) []string {
+	maps := referenceSets(sets)
+	var result []string
+	for member := range maps[0] {
+		excluded := false
+		for _, other := range maps[1:] {
+			excluded = excluded || other[member]
+		}
+		if !excluded {
+			result = append(result, member)
+		}
+	}
+	return result
+}
+
+func referenceIntersect(sets []*Set) []string {
+	maps := referenceSets(sets)
+	var result []string
+	for member := range maps[0] {
+		inAll := true
+		for _, other := range maps[1:] {
+			inAll = inAll && other[member]
+		}
+		if inAll {
+			result = append(result, member)
+		}
+	}
+	return result
+}
+
+func referenceUnion(sets []*Set) []string {
+	seen := make(map[string]bool)
+	var result []string
+	for _, m := range referenceSets(sets) {
+		for member := range m {
+			if !seen[member] {
+				seen[member] = true
+				result = append(result, member)
+			}
+		}
+	}
+	return result
+}
+
+// sortedMembers returns members as sorted strings, checking that none
+// repeats
+func sortedMembers(t *testing.T, members [][]byte) []string {
+	t.Helper()
+	result := make([]string, len(members))
+	for i, member := range members {
+		result[i] = string(member)
+	}
+	sort.Strings(result)
+	for i := 1; i < len(result); i++ {
+		if result[i] == result[i-1] {
+			t.Fatalf("%q returned twice", result[i])
+		}
+	}
+	return result
+}
+
+func sortedStrings(members []string) []string {
+	if members == nil {
+		members = []string{}
+	}
+	sort.Strings(members)
+	return members
+}
+
+// checkSetAlgebra compares Diff, Intersect and Union of sets with the
+// reference implementation
+func checkSetAlgebra(t *testing.T, sets []*Set) {
+	t.Helper()
+	tests := []struct {
+		name string
+		got  [][]byte
+		want []string
+	}{
+		{"Diff", sets[0].Diff(sets[1:]), referenceDiff(sets)},
+		{"Intersect", sets[0].Intersect(sets[1:]), referenceIntersect(sets)},
+		{"Union", sets[0].Union(sets[1:]), referenceUnion(sets)},
+	}
+	for _, tt := range tests {
+		if got, want := sortedMembers(t, tt.got), sortedStrings(tt.want); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s of %v: expected %q, got %q", tt.name, sets, want, got)
+		}
+	}
+}
+
+func TestSet_AlgebraMatchesReference(t *testing.T) {
+	rng := random.New(1)
+	for round := 0; round < 500; round++ {
+		sets := make([]*Set, 1+rng.Intn(4))
+		for i := range sets {
+			sets[i] = &Set{}
+			// Sizes from empty to much larger than the others
+			size := rng.Intn(4)
+			if rng.Intn(4) == 0 {
+				size = rng.Intn(200)
+			}
+			for j := 0; j < size; j++ {
+				sets[i].Add([]byte(strconv.Itoa(rng.Intn(40))))
+			}
+		}
+		// A set may be given twice, as in SINTER k k
+		if len(sets) > 1 && rng.Intn(5) == 0 {
+			sets[1] = sets[0]
+		}
+		checkSetAlgebra(t, sets)
+
+		// The receiver keeps its members
+		before := sortedMembers(t, sets[0].Members())
+		sets[0].Diff(sets[1:])
+		if after := sortedMembers(t, sets[0].Members()); !reflect.DeepEqual(before, after) {
+			t.Fatalf("Diff modified its receiver: %q became %q", before, after)
+		}
+	}
+}
+
+// FuzzSetAlgebra builds sets from data, a byte per member and 0 between sets
+func FuzzSetAlgebra(f *testing.F) {
+	f.Add([]byte("abc\x00cde\x00bcf"))
+	f.Add([]byte("a\x00\x00a"))
+	f.Add([]byte("\x00abc"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		sets := []*Set{{}}
+		for _, b := range data {
+			if b == 0 {
+				if len(sets) == 8 {
+					break
+				}
+				sets = append(sets, &Set{})
+				continue
+			}
+			sets[len(sets)-1].Add([]byte{b})
+		}
+		checkSetAlgebra(t, sets)
+	})
+}
+
+// BenchmarkSetIntersectAsymmetric intersects a set of 10 members with one of
+// a million, either way round. The reference iterates its first set, as
+// Intersect did before probing the smallest.
+func BenchmarkSetIntersectAsymmetric(b *testing.B) {
+	small, large := &Set{}, &Set{}
+	for i := 0; i < 10; i++ {
+		small.Add([]byte(strconv.Itoa(i * 1000)))
+	}
+	for i := 0; i < 1000000; i++ {
+		large.Add([]byte(strconv.Itoa(i)))
+	}
+
+	b.Run("small-large", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			small.Intersect([]*Set{large})
+		}
+	})
+	b.Run("large-small", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			large.Intersect([]*Set{small})
+		}
+	})
+	b.Run("large-small/receiver-first", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			result := make([][]byte, 0)
+			for _, member := range large.members {
+				if _, ok := small.index[member]; ok {
+					result = append(result, []byte(member))
+				}
+			}
+		}
+	})
+}
+
+// BenchmarkSetAdd100k adds 100k members with a single Add, as a SADD with
+// 100k arguments does
+func BenchmarkSetAdd100k(b *testing.B) {
+	members := make([][]byte, 100000)
+	for i := range members {
+		members[i] = []byte(strconv.Itoa(i))
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		set := &Set{}
+		set.Add(members...)
+	}
+}
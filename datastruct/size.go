@@ -1,6 +1,9 @@
 package datastruct
 
-import "unsafe"
+import (
+	"time"
+	"unsafe"
+)
 
 // SizeEstimator provides size estimation for data structures
 type SizeEstimator interface {
@@ -10,10 +13,14 @@ type SizeEstimator interface {
 
 // EstimateSize returns the estimated memory size of a DataEntity
 func (e *DataEntity) EstimateSize() int64 {
+	var size int64
+	if e.Meta != nil {
+		size = KeyMetadataSize
+	}
 	if estimator, ok := e.Data.(SizeEstimator); ok {
-		return estimator.EstimateSize()
+		return size + estimator.EstimateSize()
 	}
-	return estimateBasicSize(e.Data)
+	return size + estimateBasicSize(e.Data)
 }
 
 // estimateBasicSize provides a basic size estimation for any data structure
@@ -41,10 +48,8 @@ func estimateBasicSize(data interface{}) int64 {
 		return size
 	case *Set:
 		size := int64(unsafe.Sizeof(Set{}))
-		if v.data != nil {
-			// Rough estimation: overhead + members
-			size += int64(len(v.data)) * 80 // Approximate 80 bytes per member
-		}
+		// Rough estimation: overhead + members
+		size += int64(len(v.members)) * 80 // Approximate 80 bytes per member
 		return size
 	case *SortedSet:
 		size := int64(unsafe.Sizeof(SortedSet{}))
@@ -79,9 +84,7 @@ func (l *List) GetEstimatedSize() int64 {
 
 func (s *Set) GetEstimatedSize() int64 {
 	size := int64(unsafe.Sizeof(Set{}))
-	if s.data != nil {
-		size += int64(len(s.data)) * 80
-	}
+	size += int64(len(s.members)) * 80
 	return size
 }
 
@@ -92,3 +95,82 @@ func (z *SortedSet) GetEstimatedSize() int64 {
 	}
 	return size
 }
+
+// Memory used by an element of a collection besides its bytes, for
+// SampledSize: the node or entry holding it and the references to it
+const (
+	listNodeOverhead   = int64(unsafe.Sizeof(listNode{}))
+	hashFieldOverhead  = int64(unsafe.Sizeof("") + unsafe.Sizeof(interface{}(nil)) + unsafe.Sizeof([]byte(nil)) + mapEntryOverhead)
+	hashTTLOverhead    = int64(unsafe.Sizeof("") + unsafe.Sizeof(time.Time{}) + mapEntryOverhead)
+	setMemberOverhead  = int64(2*unsafe.Sizeof("") + unsafe.Sizeof(0) + mapEntryOverhead)
+	zsetMemberOverhead = int64(unsafe.Sizeof(sortedSetMember{}) + unsafe.Sizeof("") + 3*unsafe.Sizeof(&sortedSetMember{}) + mapEntryOverhead)
+
+	// mapEntryOverhead is the bookkeeping of a Go map per entry, tophash
+	// and load factor slack
+	mapEntryOverhead = 8
+)
+
+// SampledSize estimates the memory used by e like EstimateSize, but measures
+// the elements of a collection rather than assuming a size per element. It
+// measures the first samples elements, or all of them if samples is 0, and
+// scales their average size to the whole collection, as MEMORY USAGE does in
+// Redis.
+func (e *DataEntity) SampledSize(samples int) int64 {
+	var size int64
+	if e.Meta != nil {
+		size = KeyMetadataSize
+	}
+
+	var length, sampled int
+	var sampledBytes int64
+	measure := func(n int64) bool {
+		sampledBytes += n
+		sampled++
+		return samples == 0 || sampled < samples
+	}
+	switch v := e.Data.(type) {
+	case *List:
+		size += int64(unsafe.Sizeof(List{}))
+		length = v.size
+		for node := v.head; node != nil; node = node.next {
+			if !measure(listNodeOverhead + int64(len(node.value))) {
+				break
+			}
+		}
+	case *Hash:
+		size += int64(unsafe.Sizeof(Hash{}))
+		length = v.data.Len()
+		v.data.ForEach(func(field string, value interface{}) bool {
+			b, _ := value.([]byte)
+			return measure(hashFieldOverhead + int64(len(field)+len(b)))
+		})
+		v.expireMu.Lock()
+		size += int64(len(v.expires)) * hashTTLOverhead
+		v.expireMu.Unlock()
+	case *Set:
+		size += int64(unsafe.Sizeof(Set{}))
+		length = len(v.members)
+		for _, member := range v.members {
+			if !measure(setMemberOverhead + int64(len(member))) {
+				break
+			}
+		}
+	case *SortedSet:
+		size += int64(unsafe.Sizeof(SortedSet{}))
+		length = len(v.order)
+		// The member is held as bytes and as the string key of members
+		for _, m := range v.order {
+			if !measure(zsetMemberOverhead + 2*int64(len(m.member))) {
+				break
+			}
+		}
+	default:
+		// Strings have no elements and streams measure all of theirs
+		return e.EstimateSize()
+	}
+
+	if sampled > 0 {
+		size += sampledBytes * int64(length) / int64(sampled)
+	}
+	return size
+}
@@ -3,22 +3,51 @@ package datastruct
 import (
 	"bytes"
 	"math"
+	"sort"
 	"strconv"
 )
 
 // SortedSet represents a Redis sorted set data structure
-// Uses a simple slice-based implementation for simplicity
+// Uses a sorted slice: members are found by binary search, and a score
+// change that keeps a member between its neighbours updates it in place
 type SortedSet struct {
 	// map maintains O(1) lookups by member
 	members map[string]*sortedSetMember
-	// slice maintains sorted order by score
+	// slice sorted by score, members of equal score by their bytes, as in
+	// Redis
 	elements []*sortedSetMember
+	// slice in insertion order, a removed member being replaced by the last
+	// one, so that Scan can resume from a position whatever is sorted
+	order []*sortedSetMember
 }
 
 // sortedSetMember represents a member in the sorted set
 type sortedSetMember struct {
 	member []byte
 	score  float64
+	pos    int // Position in order
+}
+
+// less reports whether a sorts before b
+func (a *sortedSetMember) less(b *sortedSetMember) bool {
+	if a.score != b.score {
+		return a.score < b.score
+	}
+	return bytes.Compare(a.member, b.member) < 0
+}
+
+// FormatScore returns the reply form of a score, as Redis replies it: with
+// %.17g, so that the score reads back exactly, e.g. "0.10000000000000001"
+// for 0.1 and "1e+17" for 1e17, and "inf" and "-inf" for the infinities.
+// Every reply and rewritten command holding a score goes through it.
+func FormatScore(score float64) string {
+	switch {
+	case math.IsInf(score, 1):
+		return "inf"
+	case math.IsInf(score, -1):
+		return "-inf"
+	}
+	return strconv.FormatFloat(score, 'g', 17, 64)
 }
 
 // MakeSortedSet creates a new SortedSet wrapped in DataEntity
@@ -32,17 +61,35 @@ func MakeSortedSet() *DataEntity {
 // Add adds or updates a member with a score
 // Returns the number of new members added (0 if member already existed)
 func (z *SortedSet) Add(score float64, member []byte) int {
+	added, _ := z.AddIf(score, member, true, nil)
+	return boolToInt(added)
+}
+
+// AddIf adds member with score if it is missing and canAdd is set, or sets
+// the score of an existing member if canUpdate, when not nil, accepts its
+// current score. It reports whether the member was added, and whether an
+// existing member's score changed, as ZADD with NX, XX, GT and LT. A NaN
+// score, which has no place in the order, changes nothing.
+func (z *SortedSet) AddIf(score float64, member []byte, canAdd bool, canUpdate func(current float64) bool) (added, updated bool) {
+	if math.IsNaN(score) {
+		return false, false
+	}
 	key := string(member)
 
 	// Check if member already exists
 	if existing, ok := z.members[key]; ok {
+		if canUpdate != nil && !canUpdate(existing.score) {
+			return false, false
+		}
 		// Update score if changed
 		if existing.score != score {
-			existing.score = score
-			// Re-sort the elements
-			z.resort()
+			z.setScore(existing, score)
+			return false, true
 		}
-		return 0
+		return false, false
+	}
+	if !canAdd {
+		return false, false
 	}
 
 	// Add new member
@@ -51,12 +98,10 @@ func (z *SortedSet) Add(score float64, member []byte) int {
 		score:  score,
 	}
 	z.members[key] = newMember
-	z.elements = append(z.elements, newMember)
-
-	// Sort elements by score
-	z.resort()
+	z.insertElement(newMember)
+	z.appendOrder(newMember)
 
-	return 1
+	return true, false
 }
 
 // Remove removes one or more members from the sorted set
@@ -65,17 +110,14 @@ func (z *SortedSet) Remove(members ...[]byte) int {
 	count := 0
 	for _, member := range members {
 		key := string(member)
-		if _, exists := z.members[key]; exists {
+		if m, exists := z.members[key]; exists {
 			delete(z.members, key)
+			z.removeElement(z.index(m))
+			z.removeOrder(m)
 			count++
 		}
 	}
 
-	// Rebuild elements slice
-	if count > 0 {
-		z.rebuildElements()
-	}
-
 	return count
 }
 
@@ -92,18 +134,11 @@ func (z *SortedSet) Score(member []byte) float64 {
 // Rank returns the rank of a member (0-based, ordered by score ascending)
 // Returns -1 if member doesn't exist
 func (z *SortedSet) Rank(member []byte) int {
-	key := string(member)
-	if _, exists := z.members[key]; !exists {
+	m, exists := z.members[string(member)]
+	if !exists {
 		return -1
 	}
-
-	for i, elem := range z.elements {
-		if bytes.Equal(elem.member, member) {
-			return i
-		}
-	}
-
-	return -1
+	return z.index(m)
 }
 
 // RevRank returns the rank of a member (0-based, ordered by score descending)
@@ -135,13 +170,23 @@ func (z *SortedSet) RangeByScore(min, max float64, withScores bool) [][]byte {
 		if elem.score >= min && elem.score <= max {
 			result = append(result, elem.member)
 			if withScores {
-				result = append(result, []byte(strconv.FormatFloat(elem.score, 'f', -1, 64)))
+				result = append(result, []byte(FormatScore(elem.score)))
 			}
 		}
 	}
 	return result
 }
 
+// ScanByScore calls fn for each member with a score between min and max
+// (inclusive), in ascending order of score
+func (z *SortedSet) ScanByScore(min, max float64, fn func(member []byte, score float64)) {
+	for _, elem := range z.elements {
+		if elem.score >= min && elem.score <= max {
+			fn(elem.member, elem.score)
+		}
+	}
+}
+
 // Range returns members in the given range [start, stop] by rank (ascending)
 // With scores determines if scores are included in the result
 func (z *SortedSet) Range(start, stop int, withScores bool) [][]byte {
@@ -158,29 +203,11 @@ func (z *SortedSet) RevRange(start, stop int, withScores bool) [][]byte {
 func (z *SortedSet) rangeByIndex(start, stop int, withScores, reverse bool) [][]byte {
 	length := len(z.elements)
 
-	// Normalize negative indices
-	if start < 0 {
-		start = length + start
-		if start < 0 {
-			start = 0
-		}
-	}
-	if stop < 0 {
-		stop = length + stop
-		if stop < 0 {
-			return [][]byte{}
-		}
-	}
-
-	// Boundary checks
-	if start >= length || stop < 0 || start > stop {
+	start, stop, ok := NormalizeRange(start, stop, length)
+	if !ok {
 		return [][]byte{}
 	}
 
-	if stop >= length {
-		stop = length - 1
-	}
-
 	result := make([][]byte, 0, (stop-start+1)*(1+boolToInt(withScores)))
 
 	if !reverse {
@@ -188,7 +215,7 @@ func (z *SortedSet) rangeByIndex(start, stop int, withScores, reverse bool) [][]
 		for i := start; i <= stop; i++ {
 			result = append(result, z.elements[i].member)
 			if withScores {
-				result = append(result, []byte(strconv.FormatFloat(z.elements[i].score, 'f', -1, 64)))
+				result = append(result, []byte(FormatScore(z.elements[i].score)))
 			}
 		}
 	} else {
@@ -196,7 +223,7 @@ func (z *SortedSet) rangeByIndex(start, stop int, withScores, reverse bool) [][]
 		for i := length - 1 - start; i >= length - 1 - stop; i-- {
 			result = append(result, z.elements[i].member)
 			if withScores {
-				result = append(result, []byte(strconv.FormatFloat(z.elements[i].score, 'f', -1, 64)))
+				result = append(result, []byte(FormatScore(z.elements[i].score)))
 			}
 		}
 	}
@@ -240,7 +267,7 @@ func (z *SortedSet) RangeByScoreWithLimit(min, max float64, offset, count int, w
 
 		result = append(result, elem.member)
 		if withScores {
-			result = append(result, []byte(strconv.FormatFloat(elem.score, 'f', -1, 64)))
+			result = append(result, []byte(FormatScore(elem.score)))
 		}
 	}
 
@@ -258,12 +285,19 @@ func (z *SortedSet) GetScore(member []byte) float64 {
 }
 
 // IncrBy increments the score of a member by increment
-// Returns the new score
+// Returns the new score, or NaN without changing anything if the score
+// would be NaN (+inf plus -inf)
 func (z *SortedSet) IncrBy(increment float64, member []byte) float64 {
+	if math.IsNaN(increment) {
+		return increment
+	}
 	key := string(member)
 	if existing, ok := z.members[key]; ok {
-		existing.score += increment
-		z.resort()
+		score := existing.score + increment
+		if math.IsNaN(score) {
+			return score
+		}
+		z.setScore(existing, score)
 		return existing.score
 	}
 
@@ -273,39 +307,108 @@ func (z *SortedSet) IncrBy(increment float64, member []byte) float64 {
 		score:  increment,
 	}
 	z.members[key] = newMember
-	z.elements = append(z.elements, newMember)
-	z.resort()
+	z.insertElement(newMember)
+	z.appendOrder(newMember)
 
 	return increment
 }
 
-// resort sorts the elements slice by score
-func (z *SortedSet) resort() {
-	// Simple insertion sort for simplicity (can be optimized with quicksort/mergesort)
-	for i := 1; i < len(z.elements); i++ {
-		key := z.elements[i]
-		j := i - 1
-		for j >= 0 && z.elements[j].score > key.score {
-			z.elements[j+1] = z.elements[j]
-			j--
-		}
-		z.elements[j+1] = key
+// index returns the position of a member in elements
+func (z *SortedSet) index(m *sortedSetMember) int {
+	return sort.Search(len(z.elements), func(i int) bool { return !z.elements[i].less(m) })
+}
+
+// insertElement inserts a new member into elements at its position
+func (z *SortedSet) insertElement(m *sortedSetMember) {
+	i := z.index(m)
+	z.elements = append(z.elements, nil)
+	copy(z.elements[i+1:], z.elements[i:])
+	z.elements[i] = m
+}
+
+// removeElement removes the member at position i of elements
+func (z *SortedSet) removeElement(i int) {
+	last := len(z.elements) - 1
+	copy(z.elements[i:], z.elements[i+1:])
+	z.elements[last] = nil
+	z.elements = z.elements[:last]
+}
+
+// setScore changes the score of a member. A member still between its
+// neighbours stays where it is; otherwise the members between its old and
+// new positions shift by one.
+func (z *SortedSet) setScore(m *sortedSetMember, score float64) {
+	i := z.index(m)
+	m.score = score
+	elems := z.elements
+	switch {
+	case i > 0 && m.less(elems[i-1]):
+		// Moves towards the start, before the first member it sorts before
+		j := sort.Search(i, func(k int) bool { return m.less(elems[k]) })
+		copy(elems[j+1:i+1], elems[j:i])
+		elems[j] = m
+	case i < len(elems)-1 && elems[i+1].less(m):
+		// Moves towards the end, after the last member sorting before it
+		j := i + sort.Search(len(elems)-i-1, func(k int) bool { return !elems[i+1+k].less(m) })
+		copy(elems[i:j], elems[i+1:j+1])
+		elems[j] = m
 	}
 }
 
-// rebuildElements rebuilds the elements slice from the members map
-func (z *SortedSet) rebuildElements() {
-	z.elements = make([]*sortedSetMember, 0, len(z.members))
-	for _, member := range z.members {
-		z.elements = append(z.elements, member)
+// Clone returns a copy of the sorted set sharing the member bytes, which
+// are never modified in place
+func (z *SortedSet) Clone() *SortedSet {
+	clone := &SortedSet{
+		members:  make(map[string]*sortedSetMember, len(z.members)),
+		elements: make([]*sortedSetMember, len(z.elements)),
+		order:    make([]*sortedSetMember, len(z.order)),
 	}
-	z.resort()
+	for i, m := range z.order {
+		copied := *m
+		clone.members[string(m.member)] = &copied
+		clone.order[i] = &copied
+	}
+	for i, m := range z.elements {
+		clone.elements[i] = clone.members[string(m.member)]
+	}
+	return clone
 }
 
 // Clear removes all members from the sorted set
 func (z *SortedSet) Clear() {
 	z.members = make(map[string]*sortedSetMember)
 	z.elements = make([]*sortedSetMember, 0)
+	z.order = nil
+}
+
+// appendOrder adds a new member at the end of order
+func (z *SortedSet) appendOrder(m *sortedSetMember) {
+	m.pos = len(z.order)
+	z.order = append(z.order, m)
+}
+
+// removeOrder removes a member from order, moving the last one into its
+// position
+func (z *SortedSet) removeOrder(m *sortedSetMember) {
+	last := len(z.order) - 1
+	z.order[m.pos] = z.order[last]
+	z.order[m.pos].pos = m.pos
+	z.order[last] = nil
+	z.order = z.order[:last]
+}
+
+// Scan returns up to count members and their scores, alternating, from
+// cursor, and the cursor of the next call; cursor 0 starts and ends an
+// iteration. The members are visited in insertion order from the last, as
+// by Set.Scan, so score changes do not move them.
+func (z *SortedSet) Scan(cursor int64, count int64) (int64, [][]byte) {
+	low, high := scanRange(cursor, count, len(z.order))
+	batch := make([][]byte, 0, 2*(high-low))
+	for i := high - 1; i >= low; i-- {
+		m := z.order[i]
+		batch = append(batch, m.member, []byte(FormatScore(m.score)))
+	}
+	return int64(low), batch
 }
 
 // Members returns all members (ordered by score)
@@ -330,7 +433,7 @@ func (z *SortedSet) String() string {
 		}
 		result += strconv.Quote(string(elem.member))
 		result += ":"
-		result += strconv.FormatFloat(elem.score, 'f', -1, 64)
+		result += FormatScore(elem.score)
 	}
 	result += "]"
 	return result
@@ -2,6 +2,9 @@ package datastruct
 
 import (
 	"math"
+	"math/rand"
+	"sort"
+	"strconv"
 	"testing"
 )
 
@@ -68,6 +71,34 @@ func TestSortedSet_Add(t *testing.T) {
 	}
 }
 
+func TestSortedSet_AddIf(t *testing.T) {
+	zset := MakeSortedSet().Data.(*SortedSet)
+	greater := func(score float64) func(float64) bool {
+		return func(current float64) bool { return score > current }
+	}
+
+	// A missing member is only added if allowed
+	if added, updated := zset.AddIf(1, []byte("a"), false, nil); added || updated || zset.Len() != 0 {
+		t.Errorf("Expected nothing added, got added=%v updated=%v", added, updated)
+	}
+	if added, updated := zset.AddIf(1, []byte("a"), true, greater(1)); !added || updated {
+		t.Errorf("Expected a added, got added=%v updated=%v", added, updated)
+	}
+
+	// An existing member is only updated if the predicate accepts its score
+	if added, updated := zset.AddIf(0, []byte("a"), true, greater(0)); added || updated || zset.Score([]byte("a")) != 1 {
+		t.Errorf("Expected a unchanged, got added=%v updated=%v", added, updated)
+	}
+	if added, updated := zset.AddIf(5, []byte("a"), false, greater(5)); added || !updated || zset.Score([]byte("a")) != 5 {
+		t.Errorf("Expected a updated, got added=%v updated=%v", added, updated)
+	}
+
+	// Setting the same score is not an update
+	if added, updated := zset.AddIf(5, []byte("a"), true, nil); added || updated {
+		t.Errorf("Expected no change, got added=%v updated=%v", added, updated)
+	}
+}
+
 func TestSortedSet_Remove(t *testing.T) {
 	zset := &SortedSet{
 		members:  make(map[string]*sortedSetMember),
@@ -590,3 +621,251 @@ func TestSortedSet_FractionalScores(t *testing.T) {
 		t.Errorf("Expected last score to be 3.14, got %f", zset.GetScoreByRank(3))
 	}
 }
+
+func TestSortedSet_Scan(t *testing.T) {
+	zset := MakeSortedSet().Data.(*SortedSet)
+	for i := 0; i < 50; i++ {
+		zset.Add(float64(i), []byte(strconv.Itoa(i)))
+	}
+
+	seen := make(map[string]string)
+	removed := make(map[string]bool)
+	cursor, calls := int64(0), 0
+	for {
+		var batch [][]byte
+		cursor, batch = zset.Scan(cursor, 4)
+		for i := 0; i < len(batch); i += 2 {
+			seen[string(batch[i])] = string(batch[i+1])
+		}
+		// Reorder by score and remove members between the calls
+		calls++
+		zset.IncrBy(100, []byte(strconv.Itoa(calls)))
+		victim := strconv.Itoa(calls * 11 % 50)
+		removed[victim] = zset.Remove([]byte(victim)) > 0 || removed[victim]
+		if cursor == 0 {
+			break
+		}
+	}
+
+	for i := 0; i < 50; i++ {
+		member := strconv.Itoa(i)
+		if !removed[member] && seen[member] == "" {
+			t.Errorf("Member %s present for the whole scan but not returned", member)
+		}
+	}
+	if seen["0"] != "0" {
+		t.Errorf("Expected score 0 for member 0, got %q", seen["0"])
+	}
+	if zset.Len() != len(zset.order) {
+		t.Errorf("Expected %d members in insertion order, got %d", zset.Len(), len(zset.order))
+	}
+}
+
+func TestSortedSet_TiesOrderedByMember(t *testing.T) {
+	zset := MakeSortedSet().Data.(*SortedSet)
+	for _, member := range []string{"c", "a", "d", "b"} {
+		zset.Add(1, []byte(member))
+	}
+	zset.Add(0, []byte("z"))
+	zset.Add(1, []byte("z"))
+	zset.Remove([]byte("d"))
+	zset.Add(1, []byte("d"))
+
+	if got := zset.String(); got != `["a":1, "b":1, "c":1, "d":1, "z":1]` {
+		t.Errorf("Expected members of equal score in byte order, got %s", got)
+	}
+	if rank := zset.Rank([]byte("c")); rank != 2 {
+		t.Errorf("Expected c at rank 2, got %d", rank)
+	}
+}
+
+// refSortedSet is a naive sorted set, sorting all its members for every
+// query
+type refSortedSet map[string]float64
+
+func (r refSortedSet) sorted() []string {
+	members := make([]string, 0, len(r))
+	for member := range r {
+		members = append(members, member)
+	}
+	sort.Slice(members, func(i, j int) bool {
+		a, b := members[i], members[j]
+		if r[a] != r[b] {
+			return r[a] < r[b]
+		}
+		return a < b
+	})
+	return members
+}
+
+// TestSortedSet_MatchesReference applies random adds, updates, increments
+// and removals, mostly keeping members where they are as a leaderboard
+// does, and compares ranks and ranges with a naive sorted set
+func TestSortedSet_MatchesReference(t *testing.T) {
+	ops := 1 << 21
+	if testing.Short() {
+		ops = 1 << 14
+	}
+	r := rand.New(rand.NewSource(1))
+	zset := MakeSortedSet().Data.(*SortedSet)
+	ref := refSortedSet{}
+
+	check := func(op int) {
+		want := ref.sorted()
+		got := zset.Range(0, -1, true)
+		if len(got) != 2*len(want) {
+			t.Fatalf("Op %d: expected %d members, got %d", op, len(want), len(got)/2)
+		}
+		for i, member := range want {
+			if string(got[2*i]) != member || string(got[2*i+1]) != FormatScore(ref[member]) {
+				t.Fatalf("Op %d: rank %d is %s:%s, expected %s:%s", op, i, got[2*i], got[2*i+1], member, FormatScore(ref[member]))
+			}
+			if rank := zset.Rank([]byte(member)); rank != i {
+				t.Fatalf("Op %d: Rank(%s) = %d, expected %d", op, member, rank, i)
+			}
+		}
+	}
+
+	for op := 0; op < ops; op++ {
+		member := strconv.Itoa(r.Intn(64))
+		// Few distinct scores, so that ties are frequent
+		score := float64(r.Intn(32))
+		switch n := r.Intn(100); {
+		case n < 60:
+			// A small step, usually within the neighbours
+			if old, ok := ref[member]; ok {
+				score = old + float64(r.Intn(3)-1)/4
+			}
+			zset.Add(score, []byte(member))
+			ref[member] = score
+		case n < 85:
+			zset.Add(score, []byte(member))
+			ref[member] = score
+		case n < 95:
+			incr := float64(r.Intn(9) - 4)
+			zset.IncrBy(incr, []byte(member))
+			ref[member] += incr
+		default:
+			zset.Remove([]byte(member))
+			delete(ref, member)
+		}
+		if _, ok := ref[member]; (zset.Rank([]byte(member)) >= 0) != ok {
+			t.Fatalf("Op %d: expected %s present %v", op, member, ok)
+		}
+		if op%1024 == 0 {
+			check(op)
+		}
+	}
+	check(ops)
+}
+
+// zsetOf100k returns a sorted set of 100k members scored 0, 10, 20...
+func zsetOf100k() *SortedSet {
+	zset := MakeSortedSet().Data.(*SortedSet)
+	for i := 0; i < 100000; i++ {
+		zset.Add(float64(i*10), []byte("member:"+strconv.Itoa(i)))
+	}
+	return zset
+}
+
+// BenchmarkZAddUpdateNoReorder changes scores within the neighbours of the
+// members, which stay where they are
+func BenchmarkZAddUpdateNoReorder(b *testing.B) {
+	zset := zsetOf100k()
+	members := make([][]byte, 100000)
+	for i := range members {
+		members[i] = []byte("member:" + strconv.Itoa(i))
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		m := i % len(members)
+		zset.Add(float64(m*10)+float64(i%9)/2, members[m])
+	}
+}
+
+// BenchmarkZAddUpdateReorder moves members to random positions
+func BenchmarkZAddUpdateReorder(b *testing.B) {
+	zset := zsetOf100k()
+	members := make([][]byte, 100000)
+	for i := range members {
+		members[i] = []byte("member:" + strconv.Itoa(i))
+	}
+	r := rand.New(rand.NewSource(1))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		zset.Add(float64(r.Intn(1000000)), members[r.Intn(len(members))])
+	}
+}
+
+// BenchmarkZAddInsertNew adds new members at random positions of a set of
+// 100k members
+func BenchmarkZAddInsertNew(b *testing.B) {
+	zset := zsetOf100k()
+	members := make([][]byte, b.N)
+	for i := range members {
+		members[i] = []byte("new:" + strconv.Itoa(i))
+	}
+	r := rand.New(rand.NewSource(1))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		zset.Add(float64(r.Intn(1000000)), members[i])
+	}
+}
+
+// TestFormatScore locks the reply form of tricky scores against what Redis
+// replies with %.17g
+func TestFormatScore(t *testing.T) {
+	tenth, fifth := 0.1, 0.2
+	for _, tc := range []struct {
+		score float64
+		want  string
+	}{
+		{0, "0"},
+		{math.Copysign(0, -1), "-0"},
+		{3, "3"},
+		{-7.25, "-7.25"},
+		{1.5, "1.5"},
+		{tenth, "0.10000000000000001"},
+		{tenth + fifth, "0.30000000000000004"},
+		{0.0001, "0.0001"},
+		{1e-5, "1.0000000000000001e-05"},
+		{1 << 53, "9007199254740992"},
+		{1e16, "10000000000000000"},
+		{1e17, "1e+17"},
+		{123456789012345678, "1.2345678901234568e+17"},
+		{math.MaxFloat64, "1.7976931348623157e+308"},
+		{math.Inf(1), "inf"},
+		{math.Inf(-1), "-inf"},
+	} {
+		got := FormatScore(tc.score)
+		if got != tc.want {
+			t.Errorf("FormatScore(%v): expected %q, got %q", tc.score, tc.want, got)
+		}
+		if parsed, err := strconv.ParseFloat(got, 64); err != nil || parsed != tc.score {
+			t.Errorf("FormatScore(%v) = %q does not read back: %v, %v", tc.score, got, parsed, err)
+		}
+	}
+}
+
+func TestSortedSet_Clone(t *testing.T) {
+	zset := MakeSortedSet().Data.(*SortedSet)
+	zset.Add(1, []byte("a"))
+	zset.Add(2, []byte("b"))
+	zset.Add(3, []byte("c"))
+
+	clone := zset.Clone()
+	zset.IncrBy(10, []byte("a"))
+	zset.Remove([]byte("b"))
+
+	if clone.Len() != 3 || clone.Score([]byte("a")) != 1 {
+		t.Errorf("Updating the sorted set should not change the clone, got %s", clone)
+	}
+	if got := clone.Range(0, -1, false); len(got) != 3 || string(got[0]) != "a" {
+		t.Errorf("Expected a, b, c in the clone, got %q", got)
+	}
+	// The clone is usable on its own
+	clone.Remove([]byte("c"))
+	if _, batch := clone.Scan(0, 10); len(batch) != 4 || zset.Len() != 2 {
+		t.Errorf("Expected 2 members in each, got %q and %d", batch, zset.Len())
+	}
+}
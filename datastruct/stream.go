@@ -0,0 +1,442 @@
+package datastruct
+
+import (
+	"errors"
+	"math"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"unsafe"
+)
+
+// StreamID identifies a stream entry: the milliseconds part is normally the
+// creation time, the sequence number orders entries within a millisecond
+type StreamID struct {
+	Ms  uint64
+	Seq uint64
+}
+
+// MaxStreamID is the largest possible stream ID
+var MaxStreamID = StreamID{Ms: math.MaxUint64, Seq: math.MaxUint64}
+
+// ErrInvalidStreamID is returned when a string is not a valid stream ID
+var ErrInvalidStreamID = errors.New("ERR Invalid stream ID specified as stream command argument")
+
+// ParseStreamID parses an ID of the form "ms-seq". If the sequence number is
+// missing it is set to missingSeq.
+func ParseStreamID(s string, missingSeq uint64) (StreamID, error) {
+	msPart, seqPart, hasSeq := strings.Cut(s, "-")
+	ms, err := strconv.ParseUint(msPart, 10, 64)
+	if err != nil {
+		return StreamID{}, ErrInvalidStreamID
+	}
+	if !hasSeq {
+		return StreamID{Ms: ms, Seq: missingSeq}, nil
+	}
+	seq, err := strconv.ParseUint(seqPart, 10, 64)
+	if err != nil {
+		return StreamID{}, ErrInvalidStreamID
+	}
+	return StreamID{Ms: ms, Seq: seq}, nil
+}
+
+// String formats the ID as "ms-seq"
+func (id StreamID) String() string {
+	return strconv.FormatUint(id.Ms, 10) + "-" + strconv.FormatUint(id.Seq, 10)
+}
+
+// Less reports whether id sorts before other
+func (id StreamID) Less(other StreamID) bool {
+	if id.Ms != other.Ms {
+		return id.Ms < other.Ms
+	}
+	return id.Seq < other.Seq
+}
+
+// IsZero reports whether id is 0-0
+func (id StreamID) IsZero() bool {
+	return id.Ms == 0 && id.Seq == 0
+}
+
+// Next returns the smallest ID greater than id; ok is false for MaxStreamID
+func (id StreamID) Next() (next StreamID, ok bool) {
+	switch {
+	case id.Seq < math.MaxUint64:
+		return StreamID{Ms: id.Ms, Seq: id.Seq + 1}, true
+	case id.Ms < math.MaxUint64:
+		return StreamID{Ms: id.Ms + 1}, true
+	}
+	return id, false
+}
+
+// Prev returns the largest ID smaller than id; ok is false for 0-0
+func (id StreamID) Prev() (prev StreamID, ok bool) {
+	switch {
+	case id.Seq > 0:
+		return StreamID{Ms: id.Ms, Seq: id.Seq - 1}, true
+	case id.Ms > 0:
+		return StreamID{Ms: id.Ms - 1, Seq: math.MaxUint64}, true
+	}
+	return id, false
+}
+
+// StreamEntry is a single stream entry: an ID and its field-value pairs
+type StreamEntry struct {
+	ID     StreamID
+	Fields [][]byte // field1, value1, field2, value2, ...
+}
+
+// streamTrimChunk is the granularity of approximate (MAXLEN ~) trimming
+const streamTrimChunk = 100
+
+// Stream represents a Redis stream: an append-only log of entries ordered by
+// strictly increasing IDs
+type Stream struct {
+	entries []StreamEntry
+	// lastID is the ID of the last entry ever added; it is kept when the
+	// entry is trimmed so that IDs never go backwards
+	lastID StreamID
+	groups map[string]*StreamGroup
+}
+
+// MakeStream creates a new Stream wrapped in DataEntity
+func MakeStream() *DataEntity {
+	return &DataEntity{Data: &Stream{}}
+}
+
+// Len returns the number of entries in the stream
+func (s *Stream) Len() int {
+	return len(s.entries)
+}
+
+// LastID returns the ID of the last entry added to the stream
+func (s *Stream) LastID() StreamID {
+	return s.lastID
+}
+
+// NextID returns the ID XADD * generates at the given time in milliseconds
+// The ID is greater than LastID even if the clock went backwards.
+func (s *Stream) NextID(nowMs uint64) (StreamID, bool) {
+	if nowMs > s.lastID.Ms {
+		return StreamID{Ms: nowMs}, true
+	}
+	return s.lastID.Next()
+}
+
+// Add appends an entry. The ID must be greater than LastID.
+func (s *Stream) Add(id StreamID, fields [][]byte) bool {
+	if !s.lastID.Less(id) {
+		return false
+	}
+	s.entries = append(s.entries, StreamEntry{ID: id, Fields: fields})
+	s.lastID = id
+	return true
+}
+
+// Trim removes the oldest entries until at most maxLen are left and returns
+// the number of removed entries. An approximate trim only removes whole
+// chunks of entries, so the stream may keep a few more than maxLen.
+func (s *Stream) Trim(maxLen int, approximate bool) int {
+	excess := len(s.entries) - maxLen
+	if approximate {
+		excess -= excess % streamTrimChunk
+	}
+	if excess <= 0 {
+		return 0
+	}
+	// Reslicing drops the front of the backing array once append grows it;
+	// clear the trimmed entries so their fields can be collected meanwhile
+	clear(s.entries[:excess])
+	s.entries = s.entries[excess:]
+	return excess
+}
+
+// Range returns the entries with start <= ID <= end in ascending order, or
+// in descending order if reverse is set. A count <= 0 means no limit.
+func (s *Stream) Range(start, end StreamID, count int, reverse bool) []StreamEntry {
+	if end.Less(start) {
+		return nil
+	}
+	lo := sort.Search(len(s.entries), func(i int) bool {
+		return !s.entries[i].ID.Less(start)
+	})
+	hi := sort.Search(len(s.entries), func(i int) bool {
+		return end.Less(s.entries[i].ID)
+	})
+	n := hi - lo
+	if n <= 0 {
+		return nil
+	}
+	if count > 0 && count < n {
+		n = count
+	}
+
+	result := make([]StreamEntry, n)
+	for i := range result {
+		if reverse {
+			result[i] = s.entries[hi-1-i]
+		} else {
+			result[i] = s.entries[lo+i]
+		}
+	}
+	return result
+}
+
+// Entry returns the entry with the given ID
+func (s *Stream) Entry(id StreamID) (StreamEntry, bool) {
+	i := sort.Search(len(s.entries), func(i int) bool {
+		return !s.entries[i].ID.Less(id)
+	})
+	if i < len(s.entries) && s.entries[i].ID == id {
+		return s.entries[i], true
+	}
+	return StreamEntry{}, false
+}
+
+// Clone returns a copy of the stream and its consumer groups. The entry
+// fields are shared, as they are never modified in place.
+func (s *Stream) Clone() *Stream {
+	clone := &Stream{entries: slices.Clone(s.entries), lastID: s.lastID}
+	if s.groups == nil {
+		return clone
+	}
+	clone.groups = make(map[string]*StreamGroup, len(s.groups))
+	for name, group := range s.groups {
+		clone.groups[name] = group.clone()
+	}
+	return clone
+}
+
+// EstimateSize returns the estimated memory size of the stream in bytes
+func (s *Stream) EstimateSize() int64 {
+	size := int64(unsafe.Sizeof(Stream{}))
+	for _, entry := range s.entries {
+		size += int64(unsafe.Sizeof(entry))
+		for _, field := range entry.Fields {
+			size += int64(len(field)) + int64(unsafe.Sizeof(field))
+		}
+	}
+	for _, group := range s.groups {
+		size += int64(unsafe.Sizeof(StreamGroup{})) + int64(len(group.Name))
+		size += int64(len(group.pending)) * int64(unsafe.Sizeof(StreamPendingEntry{})+16)
+		size += int64(len(group.consumers)) * int64(unsafe.Sizeof(StreamConsumer{})+32)
+	}
+	return size
+}
+
+// Consumer groups
+//
+// A consumer group remembers the last entry it delivered and keeps every
+// entry delivered to one of its consumers in a pending entries list (PEL)
+// until the consumer acknowledges it. Each pending entry is referenced both
+// from the group's PEL and from the PEL of the consumer that owns it.
+
+// StreamPendingEntry is an entry delivered to a consumer but not acknowledged
+type StreamPendingEntry struct {
+	ID            StreamID
+	Consumer      string
+	DeliveryTime  int64 // Unix time in milliseconds of the last delivery
+	DeliveryCount int64
+}
+
+// StreamConsumer is a named consumer of a group
+type StreamConsumer struct {
+	Name     string
+	SeenTime int64 // Unix time in milliseconds of the consumer's last read or claim
+	pending  map[StreamID]*StreamPendingEntry
+}
+
+// PendingCount returns the number of entries pending for the consumer
+func (c *StreamConsumer) PendingCount() int {
+	return len(c.pending)
+}
+
+// StreamGroup is a consumer group of a stream
+type StreamGroup struct {
+	Name          string
+	LastDelivered StreamID
+	pending       map[StreamID]*StreamPendingEntry
+	consumers     map[string]*StreamConsumer
+}
+
+// CreateGroup adds a consumer group that delivers the entries after
+// lastDelivered. It returns false if the group already exists.
+func (s *Stream) CreateGroup(name string, lastDelivered StreamID) (*StreamGroup, bool) {
+	if _, exists := s.groups[name]; exists {
+		return nil, false
+	}
+	if s.groups == nil {
+		s.groups = make(map[string]*StreamGroup)
+	}
+	group := &StreamGroup{
+		Name:          name,
+		LastDelivered: lastDelivered,
+		pending:       make(map[StreamID]*StreamPendingEntry),
+		consumers:     make(map[string]*StreamConsumer),
+	}
+	s.groups[name] = group
+	return group, true
+}
+
+// Group returns the consumer group with the given name, nil if none
+func (s *Stream) Group(name string) *StreamGroup {
+	return s.groups[name]
+}
+
+// DestroyGroup removes a consumer group and reports whether it existed
+func (s *Stream) DestroyGroup(name string) bool {
+	if _, exists := s.groups[name]; !exists {
+		return false
+	}
+	delete(s.groups, name)
+	return true
+}
+
+// Groups returns the consumer groups sorted by name
+func (s *Stream) Groups() []*StreamGroup {
+	groups := make([]*StreamGroup, 0, len(s.groups))
+	for _, group := range s.groups {
+		groups = append(groups, group)
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].Name < groups[j].Name })
+	return groups
+}
+
+// clone returns a copy of the group in which the PEL of each consumer
+// shares its entries with the PEL of the group, as in the original
+func (g *StreamGroup) clone() *StreamGroup {
+	clone := &StreamGroup{
+		Name:          g.Name,
+		LastDelivered: g.LastDelivered,
+		pending:       make(map[StreamID]*StreamPendingEntry, len(g.pending)),
+		consumers:     make(map[string]*StreamConsumer, len(g.consumers)),
+	}
+	for id, entry := range g.pending {
+		copied := *entry
+		clone.pending[id] = &copied
+	}
+	for name, consumer := range g.consumers {
+		copied := &StreamConsumer{
+			Name:     consumer.Name,
+			SeenTime: consumer.SeenTime,
+			pending:  make(map[StreamID]*StreamPendingEntry, len(consumer.pending)),
+		}
+		for id := range consumer.pending {
+			copied.pending[id] = clone.pending[id]
+		}
+		clone.consumers[name] = copied
+	}
+	return clone
+}
+
+// Consumer returns the consumer with the given name, nil if none
+func (g *StreamGroup) Consumer(name string) *StreamConsumer {
+	return g.consumers[name]
+}
+
+// CreateConsumer returns the consumer with the given name, creating it if
+// needed; created reports whether it was created
+func (g *StreamGroup) CreateConsumer(name string, now int64) (consumer *StreamConsumer, created bool) {
+	if consumer, ok := g.consumers[name]; ok {
+		return consumer, false
+	}
+	consumer = &StreamConsumer{
+		Name:     name,
+		SeenTime: now,
+		pending:  make(map[StreamID]*StreamPendingEntry),
+	}
+	g.consumers[name] = consumer
+	return consumer, true
+}
+
+// DeleteConsumer removes a consumer together with its pending entries and
+// returns the number of entries it had pending, or -1 if it did not exist
+func (g *StreamGroup) DeleteConsumer(name string) int {
+	consumer, ok := g.consumers[name]
+	if !ok {
+		return -1
+	}
+	for id := range consumer.pending {
+		delete(g.pending, id)
+	}
+	delete(g.consumers, name)
+	return len(consumer.pending)
+}
+
+// Consumers returns the consumers of the group sorted by name
+func (g *StreamGroup) Consumers() []*StreamConsumer {
+	consumers := make([]*StreamConsumer, 0, len(g.consumers))
+	for _, consumer := range g.consumers {
+		consumers = append(consumers, consumer)
+	}
+	sort.Slice(consumers, func(i, j int) bool { return consumers[i].Name < consumers[j].Name })
+	return consumers
+}
+
+// Claim makes consumer the owner of the pending entry id, adding the entry
+// to the PEL if it is not pending yet, and records a delivery at now. The
+// delivery count is only incremented if countDelivery is set.
+func (g *StreamGroup) Claim(consumer *StreamConsumer, id StreamID, now int64, countDelivery bool) *StreamPendingEntry {
+	entry, ok := g.pending[id]
+	if !ok {
+		entry = &StreamPendingEntry{ID: id}
+		g.pending[id] = entry
+	} else if previous, ok := g.consumers[entry.Consumer]; ok && previous != consumer {
+		delete(previous.pending, id)
+	}
+	entry.Consumer = consumer.Name
+	entry.DeliveryTime = now
+	if countDelivery {
+		entry.DeliveryCount++
+	}
+	consumer.pending[id] = entry
+	consumer.SeenTime = now
+	return entry
+}
+
+// Ack removes an entry from the PEL and reports whether it was pending
+func (g *StreamGroup) Ack(id StreamID) bool {
+	entry, ok := g.pending[id]
+	if !ok {
+		return false
+	}
+	if consumer, ok := g.consumers[entry.Consumer]; ok {
+		delete(consumer.pending, id)
+	}
+	delete(g.pending, id)
+	return true
+}
+
+// PendingEntry returns the pending entry with the given ID
+func (g *StreamGroup) PendingEntry(id StreamID) (*StreamPendingEntry, bool) {
+	entry, ok := g.pending[id]
+	return entry, ok
+}
+
+// PendingCount returns the number of entries pending in the group
+func (g *StreamGroup) PendingCount() int {
+	return len(g.pending)
+}
+
+// Pending returns the pending entries with start <= ID <= end sorted by ID,
+// those of the given consumer only if consumer is not nil. A count <= 0
+// means no limit.
+func (g *StreamGroup) Pending(start, end StreamID, count int, consumer *StreamConsumer) []*StreamPendingEntry {
+	pel := g.pending
+	if consumer != nil {
+		pel = consumer.pending
+	}
+
+	entries := make([]*StreamPendingEntry, 0)
+	for id, entry := range pel {
+		if !id.Less(start) && !end.Less(id) {
+			entries = append(entries, entry)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].ID.Less(entries[j].ID) })
+	if count > 0 && len(entries) > count {
+		entries = entries[:count]
+	}
+	return entries
+}
@@ -0,0 +1,250 @@
+package datastruct
+
+import (
+	"math"
+	"testing"
+)
+
+func TestParseStreamID(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want StreamID
+	}{
+		{"0-1", StreamID{0, 1}},
+		{"1526919030474-55", StreamID{1526919030474, 55}},
+		{"5", StreamID{5, 7}},
+		{"18446744073709551615-18446744073709551615", MaxStreamID},
+	} {
+		got, err := ParseStreamID(tc.in, 7)
+		if err != nil || got != tc.want {
+			t.Errorf("ParseStreamID(%q) = %v, %v; want %v", tc.in, got, err, tc.want)
+		}
+		if tc.in != "5" && got.String() != tc.in {
+			t.Errorf("%v.String() = %q, want %q", got, got.String(), tc.in)
+		}
+	}
+
+	for _, in := range []string{"", "-", "a-1", "1-b", "1-", "-1", "1-2-3", "18446744073709551616"} {
+		if _, err := ParseStreamID(in, 0); err != ErrInvalidStreamID {
+			t.Errorf("ParseStreamID(%q) should fail, got %v", in, err)
+		}
+	}
+}
+
+func TestStreamID_Ordering(t *testing.T) {
+	ids := []StreamID{{0, 0}, {0, 1}, {0, math.MaxUint64}, {1, 0}, {1, 5}, MaxStreamID}
+	for i := 1; i < len(ids); i++ {
+		if !ids[i-1].Less(ids[i]) || ids[i].Less(ids[i-1]) {
+			t.Errorf("Expected %v < %v", ids[i-1], ids[i])
+		}
+		if next, ok := ids[i-1].Next(); !ok || next.Less(ids[i-1]) || ids[i].Less(next) {
+			t.Errorf("%v.Next() = %v, should be between it and %v", ids[i-1], next, ids[i])
+		}
+		if prev, ok := ids[i].Prev(); !ok || ids[i].Less(prev) || prev.Less(ids[i-1]) {
+			t.Errorf("%v.Prev() = %v, should be between %v and it", ids[i], prev, ids[i-1])
+		}
+	}
+
+	if _, ok := MaxStreamID.Next(); ok {
+		t.Error("MaxStreamID should have no next ID")
+	}
+	if _, ok := (StreamID{}).Prev(); ok {
+		t.Error("0-0 should have no previous ID")
+	}
+}
+
+func TestStream_AddRequiresIncreasingIDs(t *testing.T) {
+	stream := MakeStream().Data.(*Stream)
+
+	if stream.Add(StreamID{}, [][]byte{[]byte("f"), []byte("v")}) {
+		t.Error("0-0 should be rejected")
+	}
+	if !stream.Add(StreamID{5, 0}, nil) {
+		t.Fatal("5-0 should be accepted")
+	}
+	if stream.Add(StreamID{5, 0}, nil) || stream.Add(StreamID{4, 9}, nil) {
+		t.Error("IDs not greater than the last one should be rejected")
+	}
+	if !stream.Add(StreamID{5, 1}, nil) {
+		t.Error("5-1 should be accepted")
+	}
+	if stream.Len() != 2 || stream.LastID() != (StreamID{5, 1}) {
+		t.Errorf("Expected 2 entries up to 5-1, got %d up to %v", stream.Len(), stream.LastID())
+	}
+}
+
+func TestStream_NextID(t *testing.T) {
+	stream := MakeStream().Data.(*Stream)
+
+	id, _ := stream.NextID(100)
+	if id != (StreamID{100, 0}) {
+		t.Errorf("Expected 100-0, got %v", id)
+	}
+	stream.Add(id, nil)
+
+	// Same millisecond, then a clock that went backwards
+	for _, now := range []uint64{100, 50} {
+		id, _ = stream.NextID(now)
+		if !stream.LastID().Less(id) || id.Ms != 100 {
+			t.Errorf("NextID(%d) = %v, expected 100-x after %v", now, id, stream.LastID())
+		}
+		stream.Add(id, nil)
+	}
+
+	full := MakeStream().Data.(*Stream)
+	full.Add(MaxStreamID, nil)
+	if _, ok := full.NextID(1); ok {
+		t.Error("A stream at MaxStreamID cannot generate more IDs")
+	}
+}
+
+func TestStream_Trim(t *testing.T) {
+	stream := MakeStream().Data.(*Stream)
+	for i := uint64(1); i <= 250; i++ {
+		stream.Add(StreamID{i, 0}, nil)
+	}
+
+	// Approximate trimming only removes whole chunks
+	if removed := stream.Trim(200, true); removed != 0 || stream.Len() != 250 {
+		t.Errorf("Approximate trim to 200 should keep everything, removed %d", removed)
+	}
+	if removed := stream.Trim(120, true); removed != 100 || stream.Len() != 150 {
+		t.Errorf("Approximate trim to 120 should remove 100, removed %d leaving %d", removed, stream.Len())
+	}
+
+	if removed := stream.Trim(10, false); removed != 140 || stream.Len() != 10 {
+		t.Errorf("Exact trim to 10 should remove 140, removed %d leaving %d", removed, stream.Len())
+	}
+	entries := stream.Range(StreamID{}, MaxStreamID, 0, false)
+	if entries[0].ID != (StreamID{241, 0}) {
+		t.Errorf("Trimming should drop the oldest entries, first is %v", entries[0].ID)
+	}
+
+	stream.Trim(0, false)
+	if stream.Len() != 0 || stream.LastID() != (StreamID{250, 0}) {
+		t.Errorf("An emptied stream keeps its last ID, got %d entries and %v", stream.Len(), stream.LastID())
+	}
+	if stream.Add(StreamID{250, 0}, nil) {
+		t.Error("IDs must keep increasing after trimming")
+	}
+}
+
+func TestStream_Range(t *testing.T) {
+	stream := MakeStream().Data.(*Stream)
+	for i := uint64(1); i <= 5; i++ {
+		stream.Add(StreamID{i, 0}, [][]byte{[]byte("n"), []byte{byte('0' + i)}})
+	}
+
+	ids := func(entries []StreamEntry) []uint64 {
+		var ms []uint64
+		for _, e := range entries {
+			ms = append(ms, e.ID.Ms)
+		}
+		return ms
+	}
+	equal := func(got []uint64, want ...uint64) bool {
+		if len(got) != len(want) {
+			return false
+		}
+		for i := range got {
+			if got[i] != want[i] {
+				return false
+			}
+		}
+		return true
+	}
+
+	if got := ids(stream.Range(StreamID{2, 0}, StreamID{4, 0}, 0, false)); !equal(got, 2, 3, 4) {
+		t.Errorf("Expected [2 3 4], got %v", got)
+	}
+	if got := ids(stream.Range(StreamID{2, 1}, MaxStreamID, 2, false)); !equal(got, 3, 4) {
+		t.Errorf("Expected [3 4], got %v", got)
+	}
+	if got := ids(stream.Range(StreamID{}, StreamID{4, 0}, 2, true)); !equal(got, 4, 3) {
+		t.Errorf("Expected [4 3], got %v", got)
+	}
+	if got := stream.Range(StreamID{4, 0}, StreamID{2, 0}, 0, false); len(got) != 0 {
+		t.Errorf("An inverted range should be empty, got %v", ids(got))
+	}
+	if got := stream.Range(StreamID{6, 0}, MaxStreamID, 0, false); len(got) != 0 {
+		t.Errorf("A range past the end should be empty, got %v", ids(got))
+	}
+}
+
+func TestStreamGroup_PendingEntries(t *testing.T) {
+	stream := MakeStream().Data.(*Stream)
+	group, ok := stream.CreateGroup("g", StreamID{})
+	if !ok {
+		t.Fatal("CreateGroup failed")
+	}
+	if _, ok := stream.CreateGroup("g", StreamID{}); ok {
+		t.Error("Creating an existing group should fail")
+	}
+
+	alice, _ := group.CreateConsumer("alice", 100)
+	bob, _ := group.CreateConsumer("bob", 100)
+	for i := uint64(1); i <= 3; i++ {
+		group.Claim(alice, StreamID{i, 0}, 100, true)
+	}
+
+	// Claiming moves the entry from one consumer's PEL to the other's
+	entry := group.Claim(bob, StreamID{2, 0}, 200, true)
+	if entry.Consumer != "bob" || entry.DeliveryCount != 2 || entry.DeliveryTime != 200 {
+		t.Errorf("Unexpected claimed entry %+v", entry)
+	}
+	if alice.PendingCount() != 2 || bob.PendingCount() != 1 || group.PendingCount() != 3 {
+		t.Errorf("Expected 2+1=3 pending, got %d+%d=%d", alice.PendingCount(), bob.PendingCount(), group.PendingCount())
+	}
+
+	pending := group.Pending(StreamID{}, MaxStreamID, 0, alice)
+	if len(pending) != 2 || pending[0].ID != (StreamID{1, 0}) || pending[1].ID != (StreamID{3, 0}) {
+		t.Errorf("Expected alice to own 1-0 and 3-0, got %v", pending)
+	}
+	if pending := group.Pending(StreamID{2, 0}, MaxStreamID, 1, nil); len(pending) != 1 || pending[0].ID != (StreamID{2, 0}) {
+		t.Errorf("Expected 2-0 first from 2-0 with count 1, got %v", pending)
+	}
+
+	if !group.Ack(StreamID{2, 0}) || group.Ack(StreamID{2, 0}) {
+		t.Error("An entry should be acknowledged exactly once")
+	}
+	if bob.PendingCount() != 0 {
+		t.Errorf("Acknowledging should remove the entry from the consumer, %d left", bob.PendingCount())
+	}
+	if n := group.DeleteConsumer("alice"); n != 2 || group.PendingCount() != 0 {
+		t.Errorf("Deleting alice should drop her 2 entries, got %d and %d left", n, group.PendingCount())
+	}
+	if n := group.DeleteConsumer("alice"); n != -1 {
+		t.Errorf("Deleting a missing consumer should return -1, got %d", n)
+	}
+}
+
+func TestStream_Clone(t *testing.T) {
+	stream := MakeStream().Data.(*Stream)
+	for i := uint64(1); i <= 3; i++ {
+		stream.Add(StreamID{i, 0}, [][]byte{[]byte("f"), []byte("v")})
+	}
+	group, _ := stream.CreateGroup("g", StreamID{})
+	alice, _ := group.CreateConsumer("alice", 100)
+	group.Claim(alice, StreamID{1, 0}, 100, true)
+
+	clone := stream.Clone()
+	stream.Trim(1, false)
+	group.Claim(alice, StreamID{1, 0}, 200, true)
+	group.Claim(alice, StreamID{2, 0}, 200, true)
+
+	if clone.Len() != 3 || clone.Range(StreamID{}, MaxStreamID, 0, false)[0].ID != (StreamID{1, 0}) {
+		t.Errorf("Trimming the stream should not change the clone, got %d entries", clone.Len())
+	}
+	cloned := clone.Group("g")
+	entry, ok := cloned.PendingEntry(StreamID{1, 0})
+	if !ok || entry.DeliveryCount != 1 || cloned.PendingCount() != 1 {
+		t.Errorf("Claims after cloning should not change the clone, got %+v and %d pending", entry, cloned.PendingCount())
+	}
+	// The consumer's PEL shares its entries with the group's
+	if !cloned.Ack(StreamID{1, 0}) || cloned.Consumer("alice").PendingCount() != 0 {
+		t.Error("Acknowledging in the clone should empty the consumer's PEL")
+	}
+	if alice.PendingCount() != 2 {
+		t.Errorf("Acknowledging in the clone should not change the stream, got %d pending", alice.PendingCount())
+	}
+}
@@ -2,46 +2,229 @@ package datastruct
 
 import (
 	"strconv"
+	"sync/atomic"
+
+	"github.com/wangbo/gocache/util/lzf"
 )
 
 // DataEntity represents a data entity stored in the dictionary
 type DataEntity struct {
 	Data interface{}
+
+	// Meta is nil unless track-key-metadata is enabled
+	Meta *KeyMetadata
+
+	// Seconds since the server started when the key was last read or
+	// written, kept only when idle time is tracked (OBJECT IDLETIME)
+	accessClock atomic.Uint32
+}
+
+// SetAccessClock records an access at clock, in seconds since the server
+// started
+func (e *DataEntity) SetAccessClock(clock uint32) {
+	e.accessClock.Store(clock)
+}
+
+// AccessClock returns the clock of the last access
+func (e *DataEntity) AccessClock() uint32 {
+	return e.accessClock.Load()
+}
+
+// KeyMetadata records when a key was created and last written, and how many
+// times it was written. Times are unix milliseconds. The fields are atomic
+// because background saves read them while commands update them.
+type KeyMetadata struct {
+	createdAt  atomic.Int64
+	modifiedAt atomic.Int64
+	writes     atomic.Int64
+}
+
+// KeyMetadataSize is the memory accounted for the metadata of a key
+const KeyMetadataSize = 24
+
+// NewKeyMetadata returns the metadata of a key created at createdAt (unix ms)
+// that has not been written yet
+func NewKeyMetadata(createdAt int64) *KeyMetadata {
+	m := &KeyMetadata{}
+	m.createdAt.Store(createdAt)
+	m.modifiedAt.Store(createdAt)
+	return m
+}
+
+// RecordWrite records a write at now (unix ms)
+func (m *KeyMetadata) RecordWrite(now int64) {
+	m.modifiedAt.Store(now)
+	m.writes.Add(1)
+}
+
+// Load returns the creation time, the last write time and the write count
+func (m *KeyMetadata) Load() (createdAt, modifiedAt, writes int64) {
+	return m.createdAt.Load(), m.modifiedAt.Load(), m.writes.Load()
+}
+
+// Store replaces the metadata, e.g. with the values of a loaded snapshot
+func (m *KeyMetadata) Store(createdAt, modifiedAt, writes int64) {
+	m.createdAt.Store(createdAt)
+	m.modifiedAt.Store(modifiedAt)
+	m.writes.Store(writes)
 }
 
 // String represents a string data type
+//
+// A String uses one of four encodings, named like Redis's OBJECT ENCODING:
+// "int" keeps a value that is a canonical int64 as the integer itself, so
+// INCR and friends skip the parse/format round trip; "embstr" and "raw" keep
+// the bytes in Value; "compressed" keeps them LZF-compressed in Value (see
+// Compress). Value is nil while the int encoding is in use, so read the
+// value through Get. A String literal with only Value set is raw.
 type String struct {
-	Value []byte
+	Value    []byte
+	intVal   int64 // Also the length of the value in the compressed encoding
+	encoding stringEncoding
 }
 
+type stringEncoding uint8
+
+const (
+	encodingRaw stringEncoding = iota
+	encodingEmbStr
+	encodingInt
+	encodingCompressed
+)
+
+// embStrSizeLimit is the longest value stored as embstr, like in Redis
+const embStrSizeLimit = 44
+
 // MakeString creates a String from byte slice
 func MakeString(val []byte) *DataEntity {
-	return &DataEntity{Data: &String{Value: val}}
+	s := &String{}
+	s.Set(val)
+	return &DataEntity{Data: s}
+}
+
+// MakeCompressedString creates a String in the compressed encoding from
+// the LZF-compressed form of a value of length n, as written by a snapshot.
+// It fails if data does not decompress to n bytes.
+func MakeCompressedString(data []byte, n int) (*DataEntity, error) {
+	if _, err := lzf.Decompress(data, n); err != nil {
+		return nil, err
+	}
+	s := &String{Value: data, intVal: int64(n), encoding: encodingCompressed}
+	return &DataEntity{Data: s}, nil
 }
 
 // Get returns the string value
 func (s *String) Get() []byte {
+	switch s.encoding {
+	case encodingInt:
+		return strconv.AppendInt(nil, s.intVal, 10)
+	case encodingCompressed:
+		// The compressed bytes were checked when they were stored
+		val, _ := lzf.Decompress(s.Value, int(s.intVal))
+		return val
+	}
 	return s.Value
 }
 
-// Set sets the string value
+// Set sets the string value, using the int encoding if val is a canonical
+// integer
 func (s *String) Set(val []byte) {
+	if n, ok := parseCanonicalInt(val); ok {
+		s.SetInt(n)
+		return
+	}
 	s.Value = val
+	s.encoding = encodingRaw
+	if len(val) <= embStrSizeLimit {
+		s.encoding = encodingEmbStr
+	}
+}
+
+// SetInt sets the string to an integer value in the int encoding
+func (s *String) SetInt(val int64) {
+	s.Value = nil
+	s.intVal = val
+	s.encoding = encodingInt
+}
+
+// Encoding returns the encoding name reported by OBJECT ENCODING
+func (s *String) Encoding() string {
+	switch s.encoding {
+	case encodingInt:
+		return "int"
+	case encodingEmbStr:
+		return "embstr"
+	case encodingCompressed:
+		return "compressed"
+	default:
+		return "raw"
+	}
 }
 
 // StrLen returns the length of the string in bytes
 func (s *String) StrLen() int {
+	switch s.encoding {
+	case encodingInt:
+		return intLen(s.intVal)
+	case encodingCompressed:
+		return int(s.intVal)
+	}
 	return len(s.Value)
 }
 
+// Clone returns a copy of the string sharing its bytes: Append and
+// SetRange never modify the bytes of an earlier value
+func (s *String) Clone() *String {
+	clone := *s
+	return &clone
+}
+
+// Compress switches a raw string of at least minSize bytes to the compressed
+// encoding if that makes it smaller, and reports whether it did
+func (s *String) Compress(minSize int) bool {
+	if s.encoding != encodingRaw || len(s.Value) < minSize {
+		return false
+	}
+	compressed := lzf.Compress(s.Value)
+	if len(compressed) >= len(s.Value) {
+		return false
+	}
+	s.intVal = int64(len(s.Value))
+	s.Value = compressed
+	s.encoding = encodingCompressed
+	return true
+}
+
+// Compressed returns the compressed bytes and the length of the value of a
+// string in the compressed encoding, ok is false for any other encoding
+func (s *String) Compressed() (data []byte, n int, ok bool) {
+	if s.encoding != encodingCompressed {
+		return nil, 0, false
+	}
+	return s.Value, int(s.intVal), true
+}
+
+// Decompress switches a compressed string to the raw encoding, and reports
+// whether it did
+func (s *String) Decompress() bool {
+	if s.encoding != encodingCompressed {
+		return false
+	}
+	s.Value = s.Get()
+	s.intVal = 0
+	s.encoding = encodingRaw
+	return true
+}
+
 // Increment increases the integer value by delta
 func (s *String) Increment(delta int64) (int64, error) {
-	str := string(s.Value)
-
-	// Try to parse as integer
-	val, err := strconv.ParseInt(str, 10, 64)
-	if err != nil {
-		return 0, ErrInvalidInteger
+	val := s.intVal
+	if s.encoding != encodingInt {
+		var ok bool
+		val, ok = parseCanonicalInt(s.Value)
+		if !ok {
+			return 0, ErrInvalidInteger
+		}
 	}
 
 	// Check for overflow
@@ -53,13 +236,14 @@ func (s *String) Increment(delta int64) (int64, error) {
 	}
 
 	newVal := val + delta
-	s.Value = []byte(strconv.FormatInt(newVal, 10))
+	s.SetInt(newVal)
 	return newVal, nil
 }
 
 // IncrementFloat increases the float value by delta
+// The result is stored as raw bytes, like Redis does
 func (s *String) IncrementFloat(delta float64) (float64, error) {
-	str := string(s.Value)
+	str := string(s.Get())
 
 	// Try to parse as float
 	val, err := strconv.ParseFloat(str, 64)
@@ -69,40 +253,103 @@ func (s *String) IncrementFloat(delta float64) (float64, error) {
 
 	newVal := val + delta
 	s.Value = []byte(strconv.FormatFloat(newVal, 'f', -1, 64))
+	s.encoding = encodingRaw
 	return newVal, nil
 }
 
 // Append appends value to the string
 func (s *String) Append(val []byte) int {
+	s.toRaw()
 	s.Value = append(s.Value, val...)
 	return len(s.Value)
 }
 
+// SetRange overwrites part of the string starting at offset, padding with
+// zero bytes if the string is shorter than offset. The value is written to
+// a copy: Get returns the bytes themselves, which a reply may still be
+// writing.
+func (s *String) SetRange(offset int, val []byte) int {
+	s.toRaw()
+	value := make([]byte, max(offset+len(val), len(s.Value)))
+	copy(value, s.Value)
+	copy(value[offset:], val)
+	s.Value = value
+	return len(s.Value)
+}
+
 // GetRange returns a substring of the string
 // Supports negative indices: -1 means last character
+//
+// An int string is converted to raw. A compressed string is decompressed for
+// the call only: GETRANGE is a read, which must not grow the stored value.
 func (s *String) GetRange(start, end int) []byte {
-	length := len(s.Value)
-
-	// Handle negative indices
-	if start < 0 {
-		start += length
+	var value []byte
+	if s.encoding == encodingCompressed {
+		value = s.Get()
+	} else {
+		s.toRaw()
+		value = s.Value
 	}
-	if end < 0 {
-		end += length
+	start, end, ok := NormalizeRange(start, end, len(value))
+	if !ok {
+		return []byte{}
+	}
+	return value[start : end+1]
+}
+
+// toRaw converts the string to the raw encoding before its bytes are
+// modified or sliced, decompressing a compressed string
+func (s *String) toRaw() {
+	switch s.encoding {
+	case encodingInt:
+		s.Value = strconv.AppendInt(nil, s.intVal, 10)
+	case encodingCompressed:
+		s.Decompress()
 	}
+	s.encoding = encodingRaw
+}
 
-	// Boundary checks
-	if start < 0 {
-		start = 0
+// parseCanonicalInt parses b as an int64 only if formatting the result gives
+// back exactly b, the rule Redis uses for the int encoding and INCR: no sign
+// other than a leading '-', no leading zeros, no spaces, no "-0"
+func parseCanonicalInt(b []byte) (int64, bool) {
+	if len(b) == 0 || len(b) > 20 {
+		return 0, false
 	}
-	if end >= length {
-		end = length - 1
+	digits := b
+	if b[0] == '-' {
+		digits = b[1:]
 	}
-	if end < 0 || start > end {
-		return []byte{}
+	if len(digits) == 0 || digits[0] < '1' && !(len(b) == 1 && b[0] == '0') {
+		return 0, false
+	}
+	for _, c := range digits {
+		if c < '0' || c > '9' {
+			return 0, false
+		}
+	}
+	n, err := strconv.ParseInt(string(b), 10, 64)
+	if err != nil {
+		return 0, false
 	}
+	return n, true
+}
 
-	return s.Value[start : end+1]
+// intLen returns the number of bytes of the decimal form of n
+func intLen(n int64) int {
+	length := 1
+	if n < 0 {
+		length++
+		if n == -1<<63 {
+			return 20
+		}
+		n = -n
+	}
+	for n >= 10 {
+		n /= 10
+		length++
+	}
+	return length
 }
 
 // Errors
@@ -111,6 +358,7 @@ var (
 	ErrInvalidFloat   = newError("ERR value is not a valid float")
 	ErrOverflow       = newError("ERR increment or decrement would overflow")
 	ErrIndexOutOfRange = newError("ERR index out of range")
+	ErrHashNotInteger  = newError("ERR hash value is not an integer")
 )
 
 type errorString string
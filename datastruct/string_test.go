@@ -1,6 +1,8 @@
 package datastruct
 
 import (
+	"strconv"
+	"strings"
 	"testing"
 )
 
@@ -229,3 +231,160 @@ func TestDataEntity(t *testing.T) {
 		t.Error("Failed to type assert to int")
 	}
 }
+
+func TestString_EncodingConversion(t *testing.T) {
+	tests := []struct {
+		value    string
+		encoding string
+	}{
+		{"0", "int"},
+		{"12345", "int"},
+		{"-12345", "int"},
+		{"9223372036854775807", "int"},
+		{"-9223372036854775808", "int"},
+		{"9223372036854775808", "embstr"}, // Overflows int64
+		{"007", "embstr"},                 // Leading zeros
+		{"+5", "embstr"},                  // Explicit plus sign
+		{"-0", "embstr"},
+		{" 5", "embstr"},
+		{"5 ", "embstr"},
+		{"1.5", "embstr"},
+		{"", "embstr"},
+		{"-", "embstr"},
+		{strings.Repeat("x", 44), "embstr"},
+		{strings.Repeat("x", 45), "raw"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			str := MakeString([]byte(tt.value)).Data.(*String)
+			if got := str.Encoding(); got != tt.encoding {
+				t.Errorf("Encoding of %q = %s, expected %s", tt.value, got, tt.encoding)
+			}
+			if got := string(str.Get()); got != tt.value {
+				t.Errorf("Get() = %q, expected %q", got, tt.value)
+			}
+			if got := str.StrLen(); got != len(tt.value) {
+				t.Errorf("StrLen() = %d, expected %d", got, len(tt.value))
+			}
+		})
+	}
+}
+
+func TestString_IncrementFollowsRedisIntegerRules(t *testing.T) {
+	for _, value := range []string{"007", "+5", "-0", " 5", "1.5"} {
+		str := MakeString([]byte(value)).Data.(*String)
+		if _, err := str.Increment(1); err != ErrInvalidInteger {
+			t.Errorf("Increment of %q should fail with ErrInvalidInteger, got %v", value, err)
+		}
+		if got := string(str.Get()); got != value {
+			t.Errorf("Failed increment changed %q to %q", value, got)
+		}
+	}
+
+	// A raw value that is a canonical integer switches to the int encoding
+	str := &String{Value: []byte("41")}
+	if n, err := str.Increment(1); err != nil || n != 42 || str.Encoding() != "int" {
+		t.Errorf("Expected 42 in int encoding, got %d %s %v", n, str.Encoding(), err)
+	}
+}
+
+func TestString_ByteOperationsConvertToRaw(t *testing.T) {
+	str := MakeString([]byte("100")).Data.(*String)
+
+	if got := string(str.GetRange(0, 1)); got != "10" {
+		t.Errorf("GetRange(0, 1) = %q, expected 10", got)
+	}
+	if str.Encoding() != "raw" {
+		t.Errorf("GetRange should convert to raw, got %s", str.Encoding())
+	}
+
+	str.SetInt(100)
+	if n := str.Append([]byte("5")); n != 4 || string(str.Get()) != "1005" || str.Encoding() != "raw" {
+		t.Errorf("Append: expected raw 1005, got %q (%s)", str.Get(), str.Encoding())
+	}
+	if n, err := str.Increment(1); err != nil || n != 1006 {
+		t.Errorf("INCR after APPEND should see 1005, got %d %v", n, err)
+	}
+
+	str.SetInt(-100)
+	if n := str.SetRange(4, []byte("7")); n != 5 || string(str.Get()) != "-1007" || str.Encoding() != "raw" {
+		t.Errorf("SetRange: expected raw -1007, got %q (%s)", str.Get(), str.Encoding())
+	}
+	if n := str.SetRange(7, []byte("x")); n != 8 || string(str.Get()) != "-1007\x00\x00x" {
+		t.Errorf("SetRange past the end should pad with zero bytes, got %q", str.Get())
+	}
+	// A value returned by Get, which a reply may still be writing, is not
+	// changed by a later SetRange
+	got := str.Get()
+	if str.SetRange(0, []byte("+")); string(got) != "-1007\x00\x00x" || str.Get()[0] != '+' {
+		t.Errorf("SetRange should write to a copy, got %q then %q", got, str.Get())
+	}
+
+	if _, err := str.IncrementFloat(0.5); err == nil {
+		t.Error("IncrementFloat on a non-number should fail")
+	}
+	str.SetInt(10)
+	if f, err := str.IncrementFloat(0.5); err != nil || f != 10.5 || str.Encoding() != "raw" {
+		t.Errorf("IncrementFloat: expected raw 10.5, got %v %s %v", f, str.Encoding(), err)
+	}
+}
+
+func TestString_Compressed(t *testing.T) {
+	value := strings.Repeat("compressible ", 100)
+	str := MakeString([]byte(value)).Data.(*String)
+	if str.Compress(len(value) + 1) {
+		t.Error("Compress should skip a value below the minimum size")
+	}
+	if !str.Compress(len(value)) || str.Encoding() != "compressed" {
+		t.Fatalf("Expected the value to be compressed, got %s", str.Encoding())
+	}
+	if str.GetEstimatedSize() >= MakeString([]byte(value)).EstimateSize() {
+		t.Error("Expected the compressed value to be estimated smaller")
+	}
+
+	// Reads leave it compressed
+	if string(str.Get()) != value || str.StrLen() != len(value) || string(str.GetRange(0, 11)) != "compressible" {
+		t.Error("Reads of the compressed value returned wrong results")
+	}
+	if str.Encoding() != "compressed" {
+		t.Errorf("Reads should keep the compressed encoding, got %s", str.Encoding())
+	}
+
+	data, n, _ := str.Compressed()
+	loaded, err := MakeCompressedString(data, n)
+	if err != nil || string(loaded.Data.(*String).Get()) != value {
+		t.Errorf("Expected the compressed bytes to load back, got %v", err)
+	}
+	if _, err := MakeCompressedString(data, n+1); err == nil {
+		t.Error("Expected a wrong length to be rejected")
+	}
+
+	if n := str.Append([]byte("!")); n != len(value)+1 || str.Encoding() != "raw" || string(str.Get()) != value+"!" {
+		t.Errorf("Append should decompress to raw, got %d %s", n, str.Encoding())
+	}
+	if str.Compress(1); str.SetRange(0, []byte("C")) != len(value)+1 || str.Encoding() != "raw" || str.Get()[0] != 'C' {
+		t.Errorf("SetRange should decompress to raw, got %s", str.Encoding())
+	}
+}
+
+// BenchmarkString_Increment compares INCR on the int encoding with the
+// parse/format round trip a raw-only String needs on every call
+func BenchmarkString_Increment(b *testing.B) {
+	b.Run("int", func(b *testing.B) {
+		str := MakeString([]byte("0")).Data.(*String)
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			str.Increment(1)
+		}
+	})
+
+	b.Run("raw", func(b *testing.B) {
+		value := []byte("0")
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			n, _ := strconv.ParseInt(string(value), 10, 64)
+			value = []byte(strconv.FormatInt(n+1, 10))
+		}
+	})
+}
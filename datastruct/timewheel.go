@@ -4,21 +4,25 @@ import (
 	"sync"
 	"sync/atomic"
 	"time"
+
+	"github.com/wangbo/gocache/util/clock"
 )
 
 // TimeWheel implements a hierarchical time wheel for efficient TTL management
 // Based on the paper "Hashed and Hierarchical Timing Wheels"
 type TimeWheel struct {
 	sync.Mutex
-	interval    time.Duration        // Tick interval (e.g., 1ms)
-	ticker      *time.Ticker         // Time ticker
-	currentTime int64                // Current time in ticks
-	buckets     []*bucket            // Timing buckets
-	wheelSize   int                  // Number of buckets per wheel
-	stopChan    chan struct{}        // Channel to stop the time wheel
-	onExpire    func(key string)     // Callback when a key expires
-	running     atomic.Int32         // 1 if running, 0 if stopped
-	wg          sync.WaitGroup       // Wait for goroutine to stop
+	interval    time.Duration                            // Tick interval (e.g., 1ms)
+	clock       clock.Clock                              // Clock making the ticker
+	ticker      clock.Ticker                             // Time ticker
+	currentTime int64                                    // Current time in ticks
+	buckets     []*bucket                                // Timing buckets
+	wheelSize   int                                      // Number of buckets per wheel
+	stopChan    chan struct{}                            // Channel to stop the time wheel
+	onExpire    func(key string)                         // Callback when a key expires
+	onTick      func(expired int, elapsed time.Duration) // Called after a tick expired keys
+	running     atomic.Int32                             // 1 if running, 0 if stopped
+	wg          sync.WaitGroup                           // Wait for goroutine to stop
 }
 
 // bucket represents a single bucket in the time wheel
@@ -76,6 +80,7 @@ func NewTimeWheel(interval time.Duration, wheelSize int, onExpire func(string))
 
 	tw := &TimeWheel{
 		interval:  interval,
+		clock:     clock.Real,
 		wheelSize: wheelSize,
 		buckets:   make([]*bucket, wheelSize),
 		stopChan:  make(chan struct{}),
@@ -90,6 +95,23 @@ func NewTimeWheel(interval time.Duration, wheelSize int, onExpire func(string))
 	return tw
 }
 
+// SetTickHook sets a function called after every tick that expired keys,
+// with the number of keys and the time spent expiring them. It must be set
+// before Start.
+func (tw *TimeWheel) SetTickHook(fn func(expired int, elapsed time.Duration)) {
+	tw.Lock()
+	defer tw.Unlock()
+	tw.onTick = fn
+}
+
+// SetClock sets the clock ticking the wheel, the wall clock by default. It
+// must be set while the wheel is stopped.
+func (tw *TimeWheel) SetClock(c clock.Clock) {
+	tw.Lock()
+	defer tw.Unlock()
+	tw.clock = c
+}
+
 // Start starts the time wheel
 func (tw *TimeWheel) Start() {
 	tw.Lock()
@@ -99,7 +121,7 @@ func (tw *TimeWheel) Start() {
 		return // Already started
 	}
 
-	tw.ticker = time.NewTicker(tw.interval)
+	tw.ticker = tw.clock.NewTicker(tw.interval)
 	tw.stopChan = make(chan struct{})
 	tw.running.Store(1)
 
@@ -111,7 +133,7 @@ func (tw *TimeWheel) Start() {
 		defer tw.wg.Done()
 		for {
 			select {
-			case <-ticker.C:
+			case <-ticker.C():
 				if tw.running.Load() == 1 {
 					tw.tick()
 				}
@@ -158,12 +180,16 @@ func (tw *TimeWheel) tick() {
 	bucket := tw.buckets[index]
 
 	// Get all keys in this bucket and expire them
+	start := time.Now()
 	keys := bucket.getAndClear()
 	for _, key := range keys {
 		if tw.onExpire != nil {
 			tw.onExpire(key)
 		}
 	}
+	if tw.onTick != nil && len(keys) > 0 {
+		tw.onTick(len(keys), time.Since(start))
+	}
 
 	// Advance current time
 	tw.currentTime++
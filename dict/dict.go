@@ -1,6 +1,8 @@
 package dict
 
 import (
+	"math/rand"
+	"slices"
 	"sync"
 	"sync/atomic"
 )
@@ -12,10 +14,73 @@ type ConcurrentDict struct {
 	shardCount int
 }
 
-// shard represents a single shard with its own lock
+// shard represents a single shard with its own lock. Its pairs are kept in
+// a slice, indexed by m, so that Scan can resume from a position in it.
 type shard struct {
-	m     map[string]interface{}
-	mutex sync.RWMutex
+	m       map[string]int // Position of each key in entries
+	entries []entry
+	mutex   sync.RWMutex
+}
+
+// entry is a key-value pair of a shard
+type entry struct {
+	key string
+	val interface{}
+}
+
+func newShard() *shard {
+	return &shard{m: make(map[string]int)}
+}
+
+// get returns the value of key
+func (s *shard) get(key string) (interface{}, bool) {
+	i, ok := s.m[key]
+	if !ok {
+		return nil, false
+	}
+	return s.entries[i].val, true
+}
+
+// set stores the value of key and reports whether the key existed
+func (s *shard) set(key string, val interface{}) bool {
+	if i, ok := s.m[key]; ok {
+		s.entries[i].val = val
+		return true
+	}
+	s.m[key] = len(s.entries)
+	s.entries = append(s.entries, entry{key, val})
+	return false
+}
+
+// grow makes room for n more pairs. The map is only rebuilt when n pairs
+// would more than double it.
+func (s *shard) grow(n int) {
+	if n > len(s.m) {
+		m := make(map[string]int, len(s.m)+n)
+		for key, i := range s.m {
+			m[key] = i
+		}
+		s.m = m
+	}
+	s.entries = slices.Grow(s.entries, n)
+}
+
+// remove deletes key, moving the last pair into its position, and reports
+// whether the key existed
+func (s *shard) remove(key string) bool {
+	i, ok := s.m[key]
+	if !ok {
+		return false
+	}
+	last := len(s.entries) - 1
+	if i != last {
+		s.entries[i] = s.entries[last]
+		s.m[s.entries[i].key] = i
+	}
+	s.entries[last] = entry{}
+	s.entries = s.entries[:last]
+	delete(s.m, key)
+	return true
 }
 
 const (
@@ -36,9 +101,7 @@ func MakeConcurrentDict(shardCount int) *ConcurrentDict {
 		shardCount: shardCount,
 	}
 	for i := 0; i < shardCount; i++ {
-		dict.table[i] = &shard{
-			m: make(map[string]interface{}),
-		}
+		dict.table[i] = newShard()
 	}
 	return dict
 }
@@ -98,8 +161,7 @@ func (d *ConcurrentDict) Get(key string) (interface{}, bool) {
 	shard := d.table[index]
 	shard.mutex.RLock()
 	defer shard.mutex.RUnlock()
-	val, ok := shard.m[key]
-	return val, ok
+	return shard.get(key)
 }
 
 // Put stores a key-value pair, returns 1 if key is new, 0 if updating existing key
@@ -109,10 +171,7 @@ func (d *ConcurrentDict) Put(key string, val interface{}) (result int) {
 	shard.mutex.Lock()
 	defer shard.mutex.Unlock()
 
-	_, existed := shard.m[key]
-	shard.m[key] = val
-
-	if !existed {
+	if !shard.set(key, val) {
 		atomic.AddInt32(&d.count, 1)
 		return 1
 	}
@@ -126,8 +185,8 @@ func (d *ConcurrentDict) PutIfExists(key string, val interface{}) (result int) {
 	shard.mutex.Lock()
 	defer shard.mutex.Unlock()
 
-	if _, existed := shard.m[key]; existed {
-		shard.m[key] = val
+	if i, existed := shard.m[key]; existed {
+		shard.entries[i].val = val
 		return 1
 	}
 	return 0
@@ -141,7 +200,7 @@ func (d *ConcurrentDict) PutIfAbsent(key string, val interface{}) (result int) {
 	defer shard.mutex.Unlock()
 
 	if _, existed := shard.m[key]; !existed {
-		shard.m[key] = val
+		shard.set(key, val)
 		atomic.AddInt32(&d.count, 1)
 		return 1
 	}
@@ -155,27 +214,44 @@ func (d *ConcurrentDict) Remove(key string) (result int) {
 	shard.mutex.Lock()
 	defer shard.mutex.Unlock()
 
-	if _, existed := shard.m[key]; existed {
-		delete(shard.m, key)
+	if shard.remove(key) {
 		atomic.AddInt32(&d.count, -1)
 		return 1
 	}
 	return 0
 }
 
+// Grow makes room for n more keys, spread evenly over the shards, so that
+// adding many keys at once does not grow the shards over and over
+func (d *ConcurrentDict) Grow(n int) {
+	perShard := (n + d.shardCount - 1) / d.shardCount
+	if perShard <= 1 {
+		return
+	}
+	for _, s := range d.table {
+		s.mutex.Lock()
+		s.grow(perShard)
+		s.mutex.Unlock()
+	}
+}
+
 // Len returns the number of keys in the dictionary
 func (d *ConcurrentDict) Len() int {
 	return int(atomic.LoadInt32(&d.count))
 }
 
-// ForEach iterates over all key-value pairs in the dictionary
-// The iteration is not atomic - keys may be added or removed during iteration
+// ForEach iterates over all key-value pairs in the dictionary, shard by shard.
+// Each shard's read lock is held while that shard is visited, so the pairs seen
+// within one shard are consistent with each other, but there is no global
+// snapshot: writes to shards that were already visited (or not yet visited)
+// may or may not be observed. The consumer must not write to the dictionary,
+// as that would deadlock on the shard lock.
 func (d *ConcurrentDict) ForEach(consumer func(key string, val interface{}) bool) {
 	for _, shard := range d.table {
 		shard.mutex.RLock()
-		for key, val := range shard.m {
+		for _, e := range shard.entries {
 			// Return false to stop iteration
-			if !consumer(key, val) {
+			if !consumer(e.key, e.val) {
 				shard.mutex.RUnlock()
 				return
 			}
@@ -184,6 +260,23 @@ func (d *ConcurrentDict) ForEach(consumer func(key string, val interface{}) bool
 	}
 }
 
+// Snapshot returns a copy of all key-value pairs, cloned shard by shard.
+// Writers are only blocked for the time it takes to copy a single shard, so
+// the copy has the same per-shard consistency as ForEach. Values are copied
+// by reference: a snapshot of pointer values shares the pointees with the
+// live dictionary.
+func (d *ConcurrentDict) Snapshot() map[string]interface{} {
+	result := make(map[string]interface{}, d.Len())
+	for _, shard := range d.table {
+		shard.mutex.RLock()
+		for _, e := range shard.entries {
+			result[e.key] = e.val
+		}
+		shard.mutex.RUnlock()
+	}
+	return result
+}
+
 // Keys returns all keys in the dictionary
 // Warning: Not atomic, keys may be added or removed during iteration
 func (d *ConcurrentDict) Keys() []string {
@@ -217,8 +310,8 @@ func (d *ConcurrentDict) RandomKeys(n int) []string {
 	// TODO: Use reservoir sampling for better randomness
 	for _, shard := range d.table {
 		shard.mutex.RLock()
-		for key := range shard.m {
-			result = append(result, key)
+		for _, e := range shard.entries {
+			result = append(result, e.key)
 			if len(result) >= n {
 				shard.mutex.RUnlock()
 				return result
@@ -230,6 +323,33 @@ func (d *ConcurrentDict) RandomKeys(n int) []string {
 	return result
 }
 
+// RandomEntries calls fn with pairs picked at random by r, with
+// replacement, until it has made n picks or fn returns false. Each pick is
+// a random pair of a random shard; keys are spread evenly across shards, so
+// all are about equally likely. Picks that land on an empty shard are
+// retried a bounded number of times, so a sparse dictionary may yield fewer
+// than n pairs.
+func (d *ConcurrentDict) RandomEntries(r *rand.Rand, n int, fn func(key string, val interface{}) bool) {
+	if d.Len() == 0 {
+		return
+	}
+	for picked, misses := 0, 0; picked < n && misses < 4*n; {
+		shard := d.table[r.Intn(len(d.table))]
+		shard.mutex.RLock()
+		if len(shard.entries) == 0 {
+			shard.mutex.RUnlock()
+			misses++
+			continue
+		}
+		e := shard.entries[r.Intn(len(shard.entries))]
+		shard.mutex.RUnlock()
+		picked++
+		if !fn(e.key, e.val) {
+			return
+		}
+	}
+}
+
 // RandomDistinctKeys returns n distinct random keys
 func (d *ConcurrentDict) RandomDistinctKeys(n int) []string {
 	// Use RandomKeys which already returns distinct keys
@@ -240,7 +360,8 @@ func (d *ConcurrentDict) RandomDistinctKeys(n int) []string {
 func (d *ConcurrentDict) Clear() {
 	for _, shard := range d.table {
 		shard.mutex.Lock()
-		shard.m = make(map[string]interface{})
+		shard.m = make(map[string]int)
+		shard.entries = nil
 		shard.mutex.Unlock()
 	}
 	atomic.StoreInt32(&d.count, 0)
@@ -256,10 +377,10 @@ func (d *ConcurrentDict) AtomicUpdate(key string, updater func(interface{}) inte
 	shard.mutex.Lock()
 	defer shard.mutex.Unlock()
 
-	val, existed := shard.m[key]
+	val, existed := shard.get(key)
 	// Call updater with current value to get new value
 	newVal := updater(val)
-	shard.m[key] = newVal
+	shard.set(key, newVal)
 
 	if !existed {
 		atomic.AddInt32(&d.count, 1)
@@ -275,11 +396,58 @@ func (d *ConcurrentDict) AtomicGetAndUpdate(key string, newVal interface{}) (int
 	shard.mutex.Lock()
 	defer shard.mutex.Unlock()
 
-	val, existed := shard.m[key]
-	shard.m[key] = newVal
+	val, existed := shard.get(key)
+	shard.set(key, newVal)
 
 	if !existed {
 		atomic.AddInt32(&d.count, 1)
 	}
 	return val, existed
 }
+
+// Scan calls fn for up to count pairs, starting from cursor, and returns the
+// cursor to pass to the next call; cursor 0 starts an iteration and a
+// returned 0 ends it. Every key present for the whole iteration is returned
+// at least once, whatever is written between the calls; a key may be
+// returned more than once.
+//
+// The shards are scanned in turn, each one from its last pair down to its
+// first: the low bits of the cursor are the shard and the others the number
+// of pairs of that shard not yet visited, 0 for all of them. Since a removed
+// pair is replaced by the last one, which was visited first, and new pairs
+// are appended, the pairs below that number are never moved above it. As
+// with ForEach, fn must not write to the dictionary.
+func (d *ConcurrentDict) Scan(cursor int64, count int, fn func(key string, val interface{})) int64 {
+	if count < 1 {
+		count = 1
+	}
+	shardBits := 32 - leadingZeros(uint32(d.shardCount-1))
+	index := int(cursor & int64(d.shardCount-1))
+	bound := int(cursor >> shardBits)
+	visited := 0
+	for ; index < d.shardCount; index++ {
+		shard := d.table[index]
+		shard.mutex.RLock()
+		if n := len(shard.entries); bound == 0 || bound > n {
+			bound = n
+		}
+		for ; bound > 0 && visited < count; visited++ {
+			bound--
+			e := shard.entries[bound]
+			fn(e.key, e.val)
+		}
+		shard.mutex.RUnlock()
+
+		if bound > 0 {
+			return int64(bound)<<shardBits | int64(index)
+		}
+		if visited >= count {
+			// The next call starts with the next shard
+			if index+1 < d.shardCount {
+				return int64(index + 1)
+			}
+			return 0
+		}
+	}
+	return 0
+}
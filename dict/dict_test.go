@@ -2,6 +2,7 @@ package dict
 
 import (
 	"fmt"
+	"math/rand"
 	"strconv"
 	"sync"
 	"testing"
@@ -190,6 +191,70 @@ func TestConcurrentDict_Keys(t *testing.T) {
 	}
 }
 
+func TestConcurrentDict_Snapshot(t *testing.T) {
+	dict := MakeConcurrentDict(4)
+
+	for i := 0; i < 100; i++ {
+		dict.Put(fmt.Sprintf("key%d", i), i)
+	}
+
+	snapshot := dict.Snapshot()
+	if len(snapshot) != 100 {
+		t.Fatalf("Expected 100 entries in snapshot, got %d", len(snapshot))
+	}
+
+	// Mutations after the snapshot must not be visible in it
+	dict.Put("key0", -1)
+	dict.Put("new", 1)
+	dict.Remove("key1")
+
+	if snapshot["key0"] != 0 {
+		t.Errorf("Expected snapshot value 0 for key0, got %v", snapshot["key0"])
+	}
+	if _, ok := snapshot["new"]; ok {
+		t.Error("Key added after snapshot should not be present")
+	}
+	if _, ok := snapshot["key1"]; !ok {
+		t.Error("Key removed after snapshot should still be present")
+	}
+}
+
+func TestConcurrentDict_SnapshotConcurrentWrites(t *testing.T) {
+	dict := MakeConcurrentDict(16)
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				key := "w" + strconv.Itoa(id) + "-" + strconv.Itoa(i%500)
+				dict.Put(key, i)
+				if i%3 == 0 {
+					dict.Remove(key)
+				}
+			}
+		}(w)
+	}
+
+	for i := 0; i < 50; i++ {
+		for key, val := range dict.Snapshot() {
+			if _, ok := val.(int); !ok {
+				t.Fatalf("Unexpected value %v for key %s", val, key)
+			}
+		}
+	}
+
+	close(stop)
+	wg.Wait()
+}
+
 func TestConcurrentDict_RandomKeys(t *testing.T) {
 	dict := MakeConcurrentDict(4)
 
@@ -223,6 +288,51 @@ func TestConcurrentDict_RandomKeys(t *testing.T) {
 	}
 }
 
+func TestConcurrentDict_RandomEntries(t *testing.T) {
+	dict := MakeConcurrentDict(16)
+	r := rand.New(rand.NewSource(1))
+
+	dict.RandomEntries(r, 10, func(key string, val interface{}) bool {
+		t.Error("Expected no pick from an empty dict")
+		return true
+	})
+
+	for i := 0; i < 1000; i++ {
+		dict.Put("key"+strconv.Itoa(i), i)
+	}
+	picks := make(map[string]int)
+	dict.RandomEntries(r, 10000, func(key string, val interface{}) bool {
+		if val != mustGet(t, dict, key) {
+			t.Fatalf("Expected the value of %s", key)
+		}
+		picks[key]++
+		return true
+	})
+	// Every key is picked about 10 times
+	if len(picks) < 990 {
+		t.Errorf("Expected nearly every key to be picked, got %d", len(picks))
+	}
+
+	n := 0
+	dict.RandomEntries(r, 100, func(string, interface{}) bool {
+		n++
+		return n < 3
+	})
+	if n != 3 {
+		t.Errorf("Expected the picks to stop when fn returns false, got %d", n)
+	}
+}
+
+// mustGet returns the value of a key that must exist
+func mustGet(t *testing.T, dict *ConcurrentDict, key string) interface{} {
+	t.Helper()
+	val, ok := dict.Get(key)
+	if !ok {
+		t.Fatalf("Expected %s to exist", key)
+	}
+	return val
+}
+
 func TestConcurrentDict_Clear(t *testing.T) {
 	dict := MakeConcurrentDict(4)
 
@@ -246,6 +356,56 @@ func TestConcurrentDict_Clear(t *testing.T) {
 	}
 }
 
+func TestConcurrentDict_Scan(t *testing.T) {
+	for _, shards := range []int{1, 4, 16} {
+		dict := MakeConcurrentDict(shards)
+		for i := 0; i < 1000; i++ {
+			dict.Put("key"+strconv.Itoa(i), i)
+		}
+
+		seen := make(map[string]int)
+		cursor, calls := int64(0), 0
+		for {
+			cursor = dict.Scan(cursor, 7, func(key string, val interface{}) {
+				seen[key]++
+			})
+			calls++
+			// Write between the calls: remove keys, some already returned,
+			// and add new ones
+			dict.Remove("key" + strconv.Itoa(calls*3))
+			dict.Put("new"+strconv.Itoa(calls), calls)
+			if cursor == 0 {
+				break
+			}
+			if calls > 1000 {
+				t.Fatalf("%d shards: scan did not end", shards)
+			}
+		}
+
+		for i := 0; i < 1000; i++ {
+			key := "key" + strconv.Itoa(i)
+			if _, ok := dict.Get(key); ok && seen[key] == 0 {
+				t.Errorf("%d shards: %s present for the whole scan but not returned", shards, key)
+			}
+		}
+	}
+}
+
+func TestConcurrentDict_ScanCount(t *testing.T) {
+	dict := MakeConcurrentDict(4)
+	for i := 0; i < 10; i++ {
+		dict.Put(strconv.Itoa(i), i)
+	}
+
+	n := 0
+	if cursor := dict.Scan(0, 100, func(string, interface{}) { n++ }); cursor != 0 || n != 10 {
+		t.Errorf("Expected all 10 keys and cursor 0, got %d and %d", n, cursor)
+	}
+	if cursor := MakeConcurrentDict(4).Scan(0, 10, func(string, interface{}) {}); cursor != 0 {
+		t.Errorf("Expected cursor 0 for an empty dict, got %d", cursor)
+	}
+}
+
 func TestConcurrentDict_ShardDistribution(t *testing.T) {
 	dict := MakeConcurrentDict(16)
 
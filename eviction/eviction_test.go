@@ -1,6 +1,7 @@
 package eviction
 
 import (
+	"strings"
 	"testing"
 	"time"
 )
@@ -31,16 +32,20 @@ func TestRandom_RecordDelete(t *testing.T) {
 }
 
 func TestRandom_Evict(t *testing.T) {
-	rand := NewRandom()
+	rand := NewRandomWithSeed(1)
 	
 	// Add some keys
 	for i := 0; i < 10; i++ {
 		rand.RecordUpdate(string(rune('a'+i)))
 	}
 	
+	// The victims depend only on the seed and the keys
 	keys := rand.Evict(3)
-	if len(keys) != 3 {
-		t.Errorf("Expected 3 keys, got %d", len(keys))
+	if got := strings.Join(keys, ","); got != "b,h,j" {
+		t.Errorf("Expected to evict b,h,j, got %s", got)
+	}
+	if rand.Len() != 7 {
+		t.Errorf("Expected 7 keys left, got %d", rand.Len())
 	}
 }
 
@@ -2,10 +2,11 @@ package eviction
 
 import (
 	"math/rand"
+	"sort"
 	"sync"
-	"time"
 
 	"github.com/wangbo/gocache/evictionpkg"
+	"github.com/wangbo/gocache/util/random"
 )
 
 // Random implements random eviction policy
@@ -17,9 +18,15 @@ type Random struct {
 
 // NewRandom creates a new Random eviction policy
 func NewRandom() *Random {
+	return NewRandomWithSeed(random.Seed())
+}
+
+// NewRandomWithSeed creates a Random eviction policy whose victims depend
+// only on seed and on the keys it tracks, for tests
+func NewRandomWithSeed(seed int64) *Random {
 	return &Random{
 		keys: make(map[string]bool),
-		rand: rand.New(rand.NewSource(time.Now().UnixNano())),
+		rand: rand.New(rand.NewSource(seed)),
 	}
 }
 
@@ -57,6 +64,8 @@ func (r *Random) Evict(count int) []string {
 	for key := range r.keys {
 		allKeys = append(allKeys, key)
 	}
+	// Map order is random as well, and not seeded
+	sort.Strings(allKeys)
 
 	// Randomly select keys
 	for i := 0; i < count && len(allKeys) > 0; i++ {
@@ -0,0 +1,252 @@
+// Package geo implements the geohash encoding Redis uses for its GEO
+// commands. A position is stored as a 52-bit integer interleaving 26 bits of
+// latitude (even bits) and 26 bits of longitude (odd bits), so it fits a
+// float64 sorted set score exactly and nearby positions get nearby scores.
+package geo
+
+import (
+	"math"
+	"strings"
+)
+
+const (
+	// LonMin and LonMax bound the valid longitudes
+	LonMin = -180.0
+	LonMax = 180.0
+	// LatMin and LatMax bound the valid latitudes, the limits of the Web
+	// Mercator projection
+	LatMin = -85.05112878
+	LatMax = 85.05112878
+
+	// Step is the number of bits of each coordinate in a geohash
+	Step = 26
+
+	// EarthRadius is the earth radius in meters Redis computes distances with
+	EarthRadius = 6372797.560856
+
+	// mercatorMax is half the circumference of the earth in the Web
+	// Mercator projection, in meters
+	mercatorMax = 20037726.37
+)
+
+// Range is a half-open range [Min, Max) of geohash scores
+type Range struct {
+	Min uint64
+	Max uint64
+}
+
+// Valid reports whether a longitude and a latitude can be encoded
+func Valid(lon, lat float64) bool {
+	return lon >= LonMin && lon <= LonMax && lat >= LatMin && lat <= LatMax
+}
+
+// Encode returns the 52-bit geohash of a position, which must be Valid
+func Encode(lon, lat float64) uint64 {
+	return encode(lon, lat, Step)
+}
+
+// Decode returns the center of the cell of a 52-bit geohash
+func Decode(hash uint64) (lon, lat float64) {
+	lonMin, lonMax, latMin, latMax := cell(hash, Step)
+	lon = min(max((lonMin+lonMax)/2, LonMin), LonMax)
+	lat = min(max((latMin+latMax)/2, LatMin), LatMax)
+	return lon, lat
+}
+
+// Distance returns the great-circle distance in meters between two
+// positions, using the haversine formula
+func Distance(lon1, lat1, lon2, lat2 float64) float64 {
+	lat1r, lon1r := degToRad(lat1), degToRad(lon1)
+	lat2r, lon2r := degToRad(lat2), degToRad(lon2)
+	u := math.Sin((lat2r - lat1r) / 2)
+	v := math.Sin((lon2r - lon1r) / 2)
+	return 2 * EarthRadius * math.Asin(math.Sqrt(u*u+math.Cos(lat1r)*math.Cos(lat2r)*v*v))
+}
+
+// UnitFactor returns the number of meters in a distance unit: m, km, ft or
+// mi, case-insensitive
+func UnitFactor(unit string) (float64, bool) {
+	switch strings.ToLower(unit) {
+	case "m":
+		return 1, true
+	case "km":
+		return 1000, true
+	case "ft":
+		return 0.3048, true
+	case "mi":
+		return 1609.34, true
+	}
+	return 0, false
+}
+
+// RadiusRanges returns the ranges of geohash scores that cover every
+// position within radius meters of a center. The ranges are those of the
+// cell containing the center and its 8 neighbors, at the finest precision
+// where these cells still cover the whole radius; positions in the ranges
+// must still be filtered by their Distance to the center.
+func RadiusRanges(lon, lat, radius float64) []Range {
+	minLon, maxLon, minLat, maxLat := boundingBox(lon, lat, radius)
+
+	step := estimateStep(radius, lat)
+	var cells []uint64
+	for {
+		cells = neighbors(encode(lon, lat, step), step)
+		if step == 1 || covers(cells, step, minLon, maxLon, minLat, maxLat) {
+			break
+		}
+		step--
+	}
+
+	shift := uint(2 * (Step - step))
+	seen := make(map[uint64]bool, len(cells))
+	ranges := make([]Range, 0, len(cells))
+	for _, c := range cells {
+		if seen[c] {
+			continue
+		}
+		seen[c] = true
+		ranges = append(ranges, Range{Min: c << shift, Max: (c + 1) << shift})
+	}
+	return ranges
+}
+
+// encode returns the geohash of a position with step bits per coordinate
+func encode(lon, lat float64, step int) uint64 {
+	scale := float64(uint64(1) << uint(step))
+	latOffset := uint64((lat - LatMin) / (LatMax - LatMin) * scale)
+	lonOffset := uint64((lon - LonMin) / (LonMax - LonMin) * scale)
+	// The maximum latitude and longitude belong to the last cell
+	latOffset = min(latOffset, uint64(scale)-1)
+	lonOffset = min(lonOffset, uint64(scale)-1)
+	return interleave(latOffset, lonOffset)
+}
+
+// cell returns the bounds of the cell of a geohash with step bits per
+// coordinate
+func cell(hash uint64, step int) (lonMin, lonMax, latMin, latMax float64) {
+	latOffset, lonOffset := deinterleave(hash)
+	scale := float64(uint64(1) << uint(step))
+	latMin = LatMin + float64(latOffset)/scale*(LatMax-LatMin)
+	latMax = LatMin + float64(latOffset+1)/scale*(LatMax-LatMin)
+	lonMin = LonMin + float64(lonOffset)/scale*(LonMax-LonMin)
+	lonMax = LonMin + float64(lonOffset+1)/scale*(LonMax-LonMin)
+	return lonMin, lonMax, latMin, latMax
+}
+
+// neighbors returns the cell of a geohash followed by its neighbors. Cells
+// wrap around at the antimeridian; there are no neighbors beyond the
+// latitude limits.
+func neighbors(hash uint64, step int) []uint64 {
+	latOffset, lonOffset := deinterleave(hash)
+	size := int64(1) << uint(step)
+
+	cells := []uint64{hash}
+	for dLat := int64(-1); dLat <= 1; dLat++ {
+		lat := int64(latOffset) + dLat
+		if lat < 0 || lat >= size {
+			continue
+		}
+		for dLon := int64(-1); dLon <= 1; dLon++ {
+			if dLat == 0 && dLon == 0 {
+				continue
+			}
+			lon := (int64(lonOffset) + dLon + size) % size
+			cells = append(cells, interleave(uint64(lat), uint64(lon)))
+		}
+	}
+	return cells
+}
+
+// covers reports whether cells cover a bounding box
+func covers(cells []uint64, step int, minLon, maxLon, minLat, maxLat float64) bool {
+	lonMin, lonMax, latMin, latMax := cell(cells[0], step)
+	width, height := lonMax-lonMin, latMax-latMin
+	if latMax+height < min(maxLat, LatMax) || latMin-height > max(minLat, LatMin) {
+		return false
+	}
+	if width*3 >= LonMax-LonMin {
+		return true
+	}
+	return lonMax+width >= maxLon && lonMin-width <= minLon
+}
+
+// boundingBox returns the bounds of the positions within radius meters of a
+// center. Longitudes may extend beyond [LonMin, LonMax].
+func boundingBox(lon, lat, radius float64) (minLon, maxLon, minLat, maxLat float64) {
+	latDelta := radToDeg(radius / EarthRadius)
+	minLat, maxLat = lat-latDelta, lat+latDelta
+
+	// Longitude degrees are the shortest at the latitude farthest from the
+	// equator
+	farthest := max(math.Abs(minLat), math.Abs(maxLat))
+	lonDelta := LonMax
+	if farthest < 90 {
+		lonDelta = min(radToDeg(radius/EarthRadius/math.Cos(degToRad(farthest))), LonMax)
+	}
+	return lon - lonDelta, lon + lonDelta, minLat, maxLat
+}
+
+// estimateStep returns the precision at which the cell containing a center
+// and its neighbors likely cover a radius, like Redis
+func estimateStep(radius, lat float64) int {
+	if radius == 0 {
+		return Step
+	}
+	step := 1
+	for radius < mercatorMax {
+		radius *= 2
+		step++
+	}
+	// Make sure the radius is included in most of the base cases
+	step -= 2
+
+	// Cells are narrower close to the poles
+	if lat > 66 || lat < -66 {
+		step--
+		if lat > 80 || lat < -80 {
+			step--
+		}
+	}
+	return min(max(step, 1), Step)
+}
+
+// interleave spreads the bits of x over the even bits of the result and
+// those of y over the odd bits
+func interleave(x, y uint64) uint64 {
+	return spread(x) | spread(y)<<1
+}
+
+// deinterleave is the inverse of interleave
+func deinterleave(hash uint64) (x, y uint64) {
+	return squash(hash), squash(hash >> 1)
+}
+
+// spread moves the low 32 bits of v to the even bits
+func spread(v uint64) uint64 {
+	v &= 0xffffffff
+	v = (v | v<<16) & 0x0000ffff0000ffff
+	v = (v | v<<8) & 0x00ff00ff00ff00ff
+	v = (v | v<<4) & 0x0f0f0f0f0f0f0f0f
+	v = (v | v<<2) & 0x3333333333333333
+	v = (v | v<<1) & 0x5555555555555555
+	return v
+}
+
+// squash moves the even bits of v to the low 32 bits
+func squash(v uint64) uint64 {
+	v &= 0x5555555555555555
+	v = (v | v>>1) & 0x3333333333333333
+	v = (v | v>>2) & 0x0f0f0f0f0f0f0f0f
+	v = (v | v>>4) & 0x00ff00ff00ff00ff
+	v = (v | v>>8) & 0x0000ffff0000ffff
+	v = (v | v>>16) & 0x00000000ffffffff
+	return v
+}
+
+func degToRad(deg float64) float64 {
+	return deg * math.Pi / 180
+}
+
+func radToDeg(rad float64) float64 {
+	return rad * 180 / math.Pi
+}
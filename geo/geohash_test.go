@@ -0,0 +1,147 @@
+package geo
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func TestEncodeKnownPositions(t *testing.T) {
+	// Scores Redis stores for the GEOADD examples of its documentation
+	for _, tc := range []struct {
+		name     string
+		lon, lat float64
+		want     uint64
+	}{
+		{"Palermo", 13.361389, 38.115556, 3479099956230698},
+		{"Catania", 15.087269, 37.502669, 3479447370796909},
+	} {
+		if got := Encode(tc.lon, tc.lat); got != tc.want {
+			t.Errorf("%s: expected %d, got %d", tc.name, tc.want, got)
+		}
+	}
+}
+
+func TestDecodeKnownPositions(t *testing.T) {
+	lon, lat := Decode(3479099956230698)
+	if math.Abs(lon-13.36138933897018433) > 1e-12 || math.Abs(lat-38.11555639549629859) > 1e-12 {
+		t.Errorf("Expected Palermo at 13.361389338970184,38.115556395496299, got %v,%v", lon, lat)
+	}
+}
+
+func TestEncodeDecodeRoundTrip(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 10000; i++ {
+		lon := LonMin + r.Float64()*(LonMax-LonMin)
+		lat := LatMin + r.Float64()*(LatMax-LatMin)
+		gotLon, gotLat := Decode(Encode(lon, lat))
+		// A cell is about 0.6 meters wide
+		if d := Distance(lon, lat, gotLon, gotLat); d > 1 {
+			t.Fatalf("%v,%v decoded %v meters away at %v,%v", lon, lat, d, gotLon, gotLat)
+		}
+	}
+
+	// The limits are valid positions
+	for _, pos := range [][2]float64{{LonMin, LatMin}, {LonMax, LatMax}, {0, 0}} {
+		if !Valid(pos[0], pos[1]) {
+			t.Errorf("%v should be valid", pos)
+		}
+		if hash := Encode(pos[0], pos[1]); hash >= 1<<(2*Step) {
+			t.Errorf("%v: geohash %d exceeds 52 bits", pos, hash)
+		}
+	}
+	for _, pos := range [][2]float64{{180.1, 0}, {-180.1, 0}, {0, 85.06}, {0, -85.06}} {
+		if Valid(pos[0], pos[1]) {
+			t.Errorf("%v should be invalid", pos)
+		}
+	}
+}
+
+func TestDistance(t *testing.T) {
+	for _, tc := range []struct {
+		name                   string
+		lon1, lat1, lon2, lat2 float64
+		want, tolerance        float64
+	}{
+		// GEODIST Sicily Palermo Catania in Redis, from the decoded positions
+		{"Palermo-Catania", 13.36138933897018433, 38.11555639549629859,
+			15.08726745843887329, 37.50266842333162032, 166274.1516, 0.0001},
+		{"Paris-Berlin", 2.3522, 48.8566, 13.4050, 52.5200, 877500, 877500 * 0.005},
+		{"London-New York", -0.1278, 51.5074, -74.0060, 40.7128, 5570000, 5570000 * 0.005},
+		{"Antimeridian", 179.5, 0, -179.5, 0, 111226, 111226 * 0.005},
+		{"Same position", 10, 10, 10, 10, 0, 0},
+	} {
+		if got := Distance(tc.lon1, tc.lat1, tc.lon2, tc.lat2); math.Abs(got-tc.want) > tc.tolerance {
+			t.Errorf("%s: expected %v meters, got %v", tc.name, tc.want, got)
+		}
+	}
+}
+
+func TestUnitFactor(t *testing.T) {
+	for unit, want := range map[string]float64{"m": 1, "KM": 1000, "ft": 0.3048, "Mi": 1609.34} {
+		if got, ok := UnitFactor(unit); !ok || got != want {
+			t.Errorf("%s: expected %v, got %v %v", unit, want, got, ok)
+		}
+	}
+	if _, ok := UnitFactor("yd"); ok {
+		t.Error("yd should not be a supported unit")
+	}
+}
+
+func TestRadiusRangesCoverEveryPositionInRadius(t *testing.T) {
+	r := rand.New(rand.NewSource(2))
+	inRanges := func(ranges []Range, hash uint64) bool {
+		for _, rg := range ranges {
+			if hash >= rg.Min && hash < rg.Max {
+				return true
+			}
+		}
+		return false
+	}
+
+	centers := [][2]float64{{13.361389, 38.115556}, {179.99, 0}, {-179.99, -10}, {0, 84.9}, {25, -80.5}}
+	for i := 0; i < 20; i++ {
+		centers = append(centers, [2]float64{LonMin + r.Float64()*360, -80 + r.Float64()*160})
+	}
+	for _, center := range centers {
+		for _, radius := range []float64{0, 1, 150, 5000, 200000, 3000000} {
+			ranges := RadiusRanges(center[0], center[1], radius)
+			if len(ranges) == 0 || len(ranges) > 9 {
+				t.Fatalf("%v radius %v: expected 1 to 9 ranges, got %d", center, radius, len(ranges))
+			}
+			if !inRanges(ranges, Encode(center[0], center[1])) {
+				t.Fatalf("%v radius %v: the center is not covered", center, radius)
+			}
+
+			// Positions around the circle and inside it must be covered
+			for j := 0; j < 200; j++ {
+				bearing := r.Float64() * 2 * math.Pi
+				d := radius * math.Sqrt(r.Float64())
+				lat := center[1] + radToDeg(d/EarthRadius)*math.Cos(bearing)
+				lon := center[0] + radToDeg(d/EarthRadius)*math.Sin(bearing)/math.Cos(degToRad(center[1]))
+				lon = math.Mod(lon+540, 360) - 180
+				if !Valid(lon, lat) || Distance(center[0], center[1], lon, lat) > radius {
+					continue
+				}
+				if !inRanges(ranges, Encode(lon, lat)) {
+					t.Fatalf("%v radius %v: %v,%v is not covered by %v", center, radius, lon, lat, ranges)
+				}
+			}
+		}
+	}
+}
+
+func TestEstimateStep(t *testing.T) {
+	if got := estimateStep(0, 0); got != Step {
+		t.Errorf("A zero radius should use the full precision, got %d", got)
+	}
+	if small, large := estimateStep(100, 0), estimateStep(100000, 0); small <= large {
+		t.Errorf("Smaller radiuses should use finer cells, got %d and %d", small, large)
+	}
+	if equator, polar := estimateStep(1000, 0), estimateStep(1000, 81); polar != equator-2 {
+		t.Errorf("Expected 2 steps less above 80 degrees, got %d and %d", equator, polar)
+	}
+	if got := estimateStep(1e9, 0); got != 1 {
+		t.Errorf("Huge radiuses should use the coarsest cells, got %d", got)
+	}
+}
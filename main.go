@@ -6,13 +6,14 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/wangbo/gocache/auth"
+	"github.com/wangbo/gocache/cluster"
 	"github.com/wangbo/gocache/config"
 	"github.com/wangbo/gocache/database"
 	"github.com/wangbo/gocache/logger"
 	"github.com/wangbo/gocache/persistence"
-	"github.com/wangbo/gocache/persistence/aof"
 	"github.com/wangbo/gocache/persistence/rdb"
 	"github.com/wangbo/gocache/replication"
 	"github.com/wangbo/gocache/server"
@@ -22,15 +23,43 @@ var (
 	configFile = flag.String("c", "", "Configuration file path")
 )
 
+// overrideFlags are command-line flags that override config directives of
+// the same name; precedence is flags > GOCACHE_* env > config file > defaults
+var overrideFlags = map[string]string{
+	"port":        "TCP port to listen on",
+	"bind":        "Addresses to bind to, separated by spaces",
+	"requirepass": "Password required from clients",
+	"maxmemory":   "Memory limit, e.g. 256mb or 1gb",
+	"appendonly":  "Enable AOF persistence (yes or no)",
+	"dir":         "Working directory for persistence files",
+	"logfile":     "Log file path",
+}
+
 func main() {
+	for name, usage := range overrideFlags {
+		flag.String(name, "", usage)
+	}
 	flag.Parse()
 
-	// Load configuration
-	if *configFile != "" {
-		if err := config.Load(*configFile); err != nil {
-			fmt.Printf("Failed to load config: %v\n", err)
-			os.Exit(1)
+	// Only flags given on the command line override the configuration
+	flags := make(map[string]string)
+	flag.Visit(func(f *flag.Flag) {
+		if _, ok := overrideFlags[f.Name]; ok {
+			flags[f.Name] = f.Value.String()
 		}
+	})
+
+	// Load configuration
+	if err := config.LoadWithOverrides(*configFile, os.Environ(), flags); err != nil {
+		fmt.Printf("Failed to load config: %v\n", err)
+		os.Exit(1)
+	}
+	serverInfo := database.NewServerInfo(*configFile)
+	// Persistence files are resolved against dir, which a fresh volume may
+	// not have yet
+	if err := config.Config.MakeDir(); err != nil {
+		fmt.Printf("Failed to create dir %s: %v\n", config.Config.Dir, err)
+		os.Exit(1)
 	}
 
 	// Initialize logger
@@ -45,28 +74,28 @@ func main() {
 	// Register RDB saver for SAVE/BGSAVE commands
 	persistence.RegisterSaver(&rdb.RDBSaver{})
 
-	// Register RDB loader for replication
+	// Register RDB loader for replication and DEBUG RELOAD
 	replication.RegisterRDBLoader(&rdb.RDBLoaderImpl{})
+	persistence.RegisterLoader(&rdb.RDBLoaderImpl{})
+	replication.State.SetSlaveOutputBufferLimit(config.Config.OutputBufferHardLimit("replica"))
+	replication.State.SetProtoLimits(config.Config.ProtoMaxMultiBulkLen, config.Config.ProtoMaxBulkLen)
 
 	logger.Info("Starting GoCache server...")
 	logger.Info("Version: 1.0.0-MVP")
-	logger.Info("Binding to %s:%d", config.Config.Bind, config.Config.Port)
 
 	// Create database
 	db := database.MakeDB()
+	db.SetServerInfo(serverInfo)
+	defer db.Close()
 
-	// Create AOF handler if enabled
-	var aofHandler *aof.AOFHandler
-	var err error
-
-	if config.Config.AppendOnly {
-		logger.Info("AOF persistence enabled: %s", config.Config.AppendFilename)
-		aofHandler, err = aof.MakeAOFHandler(config.Config.AppendFilename, db)
+	if config.Config.ClusterAnnounce {
+		topology, err := cluster.NewTopology(config.Config.ClusterMyID, config.Config.ClusterNodes)
 		if err != nil {
-			logger.Error("Failed to initialize AOF: %v", err)
+			logger.Error("Invalid cluster topology: %v", err)
 			os.Exit(1)
 		}
-		defer aofHandler.Close()
+		db.SetClusterTopology(topology)
+		logger.Info("Announcing cluster node %s of %d", topology.Self.ID, len(topology.Nodes))
 	}
 
 	// Create authenticator if password is configured
@@ -77,24 +106,22 @@ func main() {
 		logger.Info("Authentication enabled")
 	}
 
-	// Create handler with authenticator
-	var handler *server.Handler
-	if authenticator != nil {
-		if aofHandler != nil {
-			handler = server.MakeHandlerWithAuth(db, aofHandler, authenticator)
-		} else {
-			handler = server.MakeHandlerWithAuth(db, nil, authenticator)
-		}
-	} else {
-		if aofHandler != nil {
-			handler = server.MakeHandlerWithAOF(db, aofHandler)
-		} else {
-			handler = server.MakeHandler(db)
-		}
-	}
+	// Create handler with authenticator; the AOF is attached once loaded
+	handler := server.MakeHandlerWithAuth(db, nil, authenticator)
 
 	// Create and start server
 	srv := server.MakeServer(config.Config, handler)
+	if err := srv.Listen(); err != nil {
+		logger.Error("Server error: %v", err)
+		os.Exit(1)
+	}
+	for _, addr := range srv.Addrs() {
+		logger.Info("Listening on %s", addr)
+	}
+	served := make(chan error, 1)
+	go func() {
+		served <- srv.Serve()
+	}()
 
 	// Handle shutdown gracefully
 	sigChan := make(chan os.Signal, 1)
@@ -104,15 +131,30 @@ func main() {
 		<-sigChan
 		logger.Info("Shutting down server...")
 		srv.Stop()
-		if aofHandler != nil {
-			aofHandler.Close()
+		if err := db.Close(); err != nil {
+			logger.Error("Failed to close database: %v", err)
 		}
 		logger.Close()
 		os.Exit(0)
 	}()
 
-	// Start server
-	if err := srv.Start(); err != nil {
+	// Load the dataset; clients connecting meanwhile are refused with LOADING
+	if config.Config.AppendOnly {
+		logger.Info("AOF persistence enabled: %s", config.Config.DataPath(config.Config.AppendFilename))
+	}
+	start := time.Now()
+	aofHandler, err := handler.LoadDataset(config.Config)
+	if err != nil {
+		logger.Error("Failed to load the dataset: %v", err)
+		os.Exit(1)
+	}
+	if aofHandler != nil {
+		// Flushed and closed when the database is closed
+		db.AttachPersistence(aofHandler)
+	}
+	logger.Info("Dataset loaded in %v: %d keys", time.Since(start), len(db.Keys()))
+
+	if err := <-served; err != nil {
 		logger.Error("Server error: %v", err)
 		os.Exit(1)
 	}
@@ -5,31 +5,50 @@ import (
 	"net"
 	"sync"
 	"time"
+
+	"github.com/wangbo/gocache/util/quote"
+)
+
+// Origins of the commands that are not run by a client connection
+const (
+	// OriginExec is the origin of the commands run by EXEC
+	OriginExec = "EXEC"
+	// OriginReplication is the origin of the commands a replica applies
+	// from its master
+	OriginReplication = "replication"
 )
 
 // Monitor manages command monitoring
 type Monitor struct {
-	clients    []net.Conn
-	clientsMu  sync.RWMutex
-	enabled    bool
-	monitorCh  chan *MonitoredCommand
+	clients       []net.Conn
+	clientsMu     sync.RWMutex
+	enabled       bool
+	monitorCh     chan *MonitoredCommand
+	noReplication map[net.Conn]bool // Clients that do not see OriginReplication commands
 }
 
 // MonitoredCommand represents a command being monitored
 type MonitoredCommand struct {
 	Timestamp time.Time
 	Command   string
-	Client    string // Client address
+	Client    string // Client address, OriginExec or OriginReplication
 }
 
 var (
 	// Global monitor instance
-	globalMonitor = &Monitor{
+	globalMonitor = NewMonitor()
+)
+
+// NewMonitor creates a monitor without clients. The server uses the global
+// monitor returned by GetMonitor; other monitors serve servers embedded in
+// the same process.
+func NewMonitor() *Monitor {
+	return &Monitor{
 		clients:   make([]net.Conn, 0),
 		enabled:   false,
 		monitorCh: make(chan *MonitoredCommand, 1000),
 	}
-)
+}
 
 // GetMonitor returns the global monitor instance
 func GetMonitor() *Monitor {
@@ -52,6 +71,18 @@ func (m *Monitor) AddClient(conn net.Conn) {
 	fmt.Printf("Monitor: client added (total: %d)\n", len(m.clients))
 }
 
+// AddClientWithoutReplication adds a monitoring client that does not see the
+// commands applied from the master, which can outnumber the others by far
+func (m *Monitor) AddClientWithoutReplication(conn net.Conn) {
+	m.clientsMu.Lock()
+	if m.noReplication == nil {
+		m.noReplication = make(map[net.Conn]bool)
+	}
+	m.noReplication[conn] = true
+	m.clientsMu.Unlock()
+	m.AddClient(conn)
+}
+
 // RemoveClient removes a monitoring client
 func (m *Monitor) RemoveClient(conn net.Conn) {
 	m.clientsMu.Lock()
@@ -63,6 +94,7 @@ func (m *Monitor) RemoveClient(conn net.Conn) {
 			break
 		}
 	}
+	delete(m.noReplication, conn)
 
 	// Stop monitoring if no more clients
 	if len(m.clients) == 0 {
@@ -98,20 +130,30 @@ func (m *Monitor) LogCommand(cmdLine [][]byte, clientAddr string) {
 // broadcastLoop broadcasts commands to all monitoring clients
 func (m *Monitor) broadcastLoop() {
 	for cmdMon := range m.monitorCh {
+		replicated := cmdMon.Client == OriginReplication
 		m.clientsMu.RLock()
-		clients := make([]net.Conn, len(m.clients))
-		copy(clients, m.clients)
+		clients := make([]net.Conn, 0, len(m.clients))
+		for _, client := range m.clients {
+			if !replicated || !m.noReplication[client] {
+				clients = append(clients, client)
+			}
+		}
+		total := len(m.clients)
 		m.clientsMu.RUnlock()
 
-		if len(clients) == 0 {
+		if total == 0 {
 			// No more clients, stop monitoring
 			m.enabled = false
 			return
 		}
 
-		// Format: timestamp in microseconds + command
+		// Format: timestamp in microseconds + origin + command
 		timestampMicros := cmdMon.Timestamp.UnixNano() / 1000
-		message := fmt.Sprintf("%d [db 0] \"%s\"\r\n", timestampMicros, cmdMon.Command)
+		origin := "db 0"
+		if cmdMon.Client != "" {
+			origin += " " + cmdMon.Client
+		}
+		message := fmt.Sprintf("%d [%s] \"%s\"\r\n", timestampMicros, origin, cmdMon.Command)
 
 		// Send to all clients
 		for _, client := range clients {
@@ -123,24 +165,16 @@ func (m *Monitor) broadcastLoop() {
 	}
 }
 
-// serializeCommand serializes a command line to string
+// serializeCommand serializes a command line to string, quoting the
+// arguments that are not plain printable words so that binary keys cannot
+// break the line a monitor client reads
 func serializeCommand(cmdLine [][]byte) string {
-	if len(cmdLine) == 0 {
-		return ""
-	}
-
-	result := ""
+	var result []byte
 	for i, arg := range cmdLine {
 		if i > 0 {
-			result += " "
-		}
-		// Escape arguments with spaces or quotes
-		argStr := string(arg)
-		if len(argStr) == 0 || (len(argStr) > 0 && (argStr[0] == ' ' || argStr[len(argStr)-1] == ' ')) {
-			result += `"` + argStr + `"`
-		} else {
-			result += argStr
+			result = append(result, ' ')
 		}
+		result = quote.AppendArg(result, arg)
 	}
-	return result
+	return string(result)
 }
@@ -3,6 +3,7 @@ package monitor
 import (
 	"bytes"
 	"net"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -224,6 +225,11 @@ func TestSerializeCommand(t *testing.T) {
 			cmdLine:  [][]byte{[]byte("SET"), []byte(""), []byte("value")},
 			expected: `SET "" value`,
 		},
+		{
+			name:     "binary arguments",
+			cmdLine:  [][]byte{[]byte("SET"), []byte("a\r\nb\x00"), []byte("\xff\"q\"")},
+			expected: `SET "a\r\nb\x00" "\xff\"q\""`,
+		},
 	}
 
 	for _, tt := range tests {
@@ -236,6 +242,28 @@ func TestSerializeCommand(t *testing.T) {
 	}
 }
 
+func TestLogCommandBinaryKeyKeepsOneLine(t *testing.T) {
+	monitor := &Monitor{
+		clients:   make([]net.Conn, 0),
+		enabled:   false,
+		monitorCh: make(chan *MonitoredCommand, 1000),
+	}
+	client := &MockConn{}
+	monitor.AddClient(client)
+	time.Sleep(100 * time.Millisecond)
+
+	monitor.LogCommand([][]byte{[]byte("SET"), []byte("k\r\n+OK\r\n"), []byte("\x00")}, "127.0.0.1:12345")
+	time.Sleep(200 * time.Millisecond)
+
+	data := client.GetWrittenData()
+	if strings.Count(data, "\r\n") != 1 || !strings.HasSuffix(data, "\r\n") {
+		t.Errorf("Expected a single line, got %q", data)
+	}
+	if !strings.Contains(data, `"k\r\n+OK\r\n" "\x00"`) {
+		t.Errorf("Expected the key and value to be escaped, got %q", data)
+	}
+}
+
 func TestBroadcastLoop(t *testing.T) {
 	monitor := &Monitor{
 		clients:   make([]net.Conn, 0),
@@ -2,37 +2,131 @@ package aof
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"io"
-	"os"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/wangbo/gocache/database"
+	"github.com/wangbo/gocache/persistence"
+	"github.com/wangbo/gocache/protocol"
 	"github.com/wangbo/gocache/protocol/resp"
 )
 
+// ErrBufferFull is returned by AddCommand when the queue is full with
+// aof-buffer-overflow drop: the command is not written
+var ErrBufferFull = errors.New("AOF buffer full, command dropped")
+
 // AOFHandler represents an AOF persistence handler
+//
+// AddCommand encodes a command at the end of a queue. A writer goroutine
+// takes everything queued at once, writes it with a single write, and fsyncs
+// the file as appendfsync says: after every write with always, at most once
+// a second with everysec, never with no. With everysec and no, AddCommand
+// returns without waiting for the disk, and a crash loses what the queue
+// held. With always, it waits for the write and the fsync that include the
+// command, and returns their error if they fail, so that a client is only
+// replied to once its command is on disk; the commands queued meanwhile by
+// other clients share the same write and fsync.
+//
+// The queue holds at most aof-buffer-max bytes, counting the commands being
+// written. A command that does not fit waits for the writer to make room
+// with aof-buffer-overflow block, the default; with drop, AddCommand returns
+// ErrBufferFull instead, and since the file misses the command, every write
+// reports that error until Rewriter.Rewrite rebuilds the file from the
+// dataset. Both settings, and appendfsync, are read when the file is opened.
+//
+// When a write fails, as on a full disk, the file is truncated back to its
+// last complete command and the commands stay buffered: the next write, or
+// FlushPending, writes them again before anything else, so that the file
+// never holds part of a command followed by others. The outcome of every
+// write is recorded with database.RecordAOFWrite.
 type AOFHandler struct {
-	file    *os.File
-	writer  *bufio.Writer
-	db      *database.DB
-	mu      sync.Mutex
-	closing bool
+	fs         persistence.FS
+	db         *database.DB
+	fsync      string // appendfsync
+	bufferMax  int64  // aof-buffer-max, 0 for no limit
+	dropOnFull bool   // aof-buffer-overflow drop
+
+	// mu guards the queue and what AddCommand changes. It is never held
+	// during a write, and is taken before fileMu when both are.
+	mu    sync.Mutex
+	room  *sync.Cond // Broadcast when commands were written, or on Close
+	queue []byte     // Commands not taken by the writer yet
+	// Offset in the queue just after its last FLUSHALL or FLUSHDB, -1 if it
+	// has none
+	queueFlushEnd int
+	queued        int64 // Bytes ever queued
+	done          int64 // Bytes ever queued that are written
+	dropErr       error // Set when a command was dropped, until a rewrite
+	closing       bool
+	// Bytes ever queued when the last failed write took the queue, and its
+	// error, for the commands waiting for their fsync with appendfsync always
+	failed    int64
+	failedErr error
+	// Number of flushes queued, so that a rewrite notices one
+	flushes uint64
+
+	wake    chan struct{} // Wakes the writer; holds one pending wakeup
+	stop    chan struct{} // Closed by Close
+	stopped chan struct{} // Closed when the writer returns
+
+	// fileMu guards the file and the commands being written
+	fileMu sync.Mutex
+	file   persistence.File
+	buf    []byte // Commands taken from the queue, not written yet
+	// Offset in buf just after its last flush, -1 if it has none
+	bufFlushEnd int
+	// Set when a partial write could not be truncated: the file ends with
+	// part of a command, which aof-load-truncated drops on load, so nothing
+	// may follow it
+	tailErr  error
+	unsynced bool      // Whether bytes were written since the last fsync
+	lastSync time.Time // Time of the last fsync
+	// Offset in the file just after the last FLUSHALL or FLUSHDB, -1 if it
+	// has none: nothing before it matters (see Rewriter)
+	flushOffset int64
+
+	size    atomic.Int64 // Bytes of complete commands in the file
+	written atomic.Int64 // Bytes written since the handler was opened
+	bufCap  atomic.Int64 // Capacity of buf, read without waiting for a write
 }
 
 // MakeAOFHandler creates a new AOF handler
 func MakeAOFHandler(filename string, db *database.DB) (*AOFHandler, error) {
+	return MakeAOFHandlerWithFS(filename, db, persistence.OSFS)
+}
+
+// MakeAOFHandlerWithFS creates a new AOF handler whose files are accessed
+// through fs
+func MakeAOFHandlerWithFS(filename string, db *database.DB, fs persistence.FS) (*AOFHandler, error) {
 	// Open file in append mode, create if not exists
-	file, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0644)
+	file, err := fs.OpenAppend(filename)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open AOF file: %w", err)
 	}
 
+	cfg := db.Config()
 	handler := &AOFHandler{
-		file:   file,
-		writer: bufio.NewWriter(file),
-		db:     db,
+		fs:            fs,
+		file:          file,
+		db:            db,
+		fsync:         cfg.AppendFsync,
+		bufferMax:     cfg.AOFBufferMax,
+		dropOnFull:    cfg.AOFBufferOverflow == "drop",
+		queueFlushEnd: -1,
+		bufFlushEnd:   -1,
+		flushOffset:   -1,
+		lastSync:      time.Now(),
+		wake:          make(chan struct{}, 1),
+		stop:          make(chan struct{}),
+		stopped:       make(chan struct{}),
 	}
+	handler.room = sync.NewCond(&handler.mu)
 
 	// Load existing data from AOF file
 	if err := handler.Load(); err != nil {
@@ -40,10 +134,18 @@ func MakeAOFHandler(filename string, db *database.DB) (*AOFHandler, error) {
 		return nil, fmt.Errorf("failed to load AOF file: %w", err)
 	}
 
+	go handler.run()
 	return handler, nil
 }
 
-// Load loads and replays commands from AOF file
+// Load loads and replays commands from AOF file.
+//
+// A file whose last command is cut short, as a crash while appending leaves
+// it, is loaded up to that command and truncated before it if
+// aof-load-truncated is set; any other error in the file fails the load.
+// All commands are written for database 0, without SELECT; a file that
+// selects another database, as one written by a Redis server may, fails the
+// load rather than merging that database into database 0.
 func (h *AOFHandler) Load() error {
 	// Seek to beginning of file
 	if _, err := h.file.Seek(0, 0); err != nil {
@@ -51,98 +153,393 @@ func (h *AOFHandler) Load() error {
 	}
 
 	// Create reader
-	reader := bufio.NewReader(h.file)
-	parser := resp.MakeParser()
+	counter := &countingReader{r: h.db.LoadingReader(h.file)}
+	reader := bufio.NewReader(counter)
+	// The file holds commands the server accepted, whatever the request
+	// limits configured now
+	parser := resp.MakeParserWithLimits(0, 0)
+	replay := h.db.StartReplay()
+	defer replay.Close()
 
 	// Read and execute commands line by line
+	var parsed int64 // Offset of the end of the last complete command
 	for {
 		// Read command
 		cmdLine, err := parser.ParseStream(reader)
-		if err != nil {
-			if err == io.EOF {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			if parsed == counter.n {
 				break
 			}
+			if err := h.truncate(parsed, counter.n); err != nil {
+				return err
+			}
+			break
+		}
+		if err != nil {
 			return fmt.Errorf("parse error: %w", err)
 		}
+		parsed = counter.n - int64(reader.Buffered())
 
 		if len(cmdLine) == 0 {
 			continue
 		}
+		if err := checkSelect(cmdLine); err != nil {
+			return err
+		}
 
 		// Execute command in database (don't write to AOF during load)
 		// We use a flag to prevent recursive AOF writes
-		_, err = h.db.Exec(cmdLine)
-		if err != nil {
+		if err := replay.Exec(cmdLine); err != nil {
 			// Log error but continue processing
 			fmt.Printf("Error executing command from AOF: %v\n", err)
 		}
+		if isFlushCommand(cmdLine) {
+			h.flushOffset = parsed
+		}
 	}
 
 	// Seek back to end for appending
-	if _, err := h.file.Seek(0, 2); err != nil {
+	size, err := h.file.Seek(0, io.SeekEnd)
+	if err != nil {
 		return err
 	}
+	h.size.Store(size)
 
 	return nil
 }
 
-// AddCommand writes a command to AOF file
+// truncate drops the incomplete command at the end of a file of size bytes
+// whose complete commands end at offset
+func (h *AOFHandler) truncate(offset, size int64) error {
+	if !h.db.Config().AOFLoadTruncated {
+		return fmt.Errorf("unexpected end of file at offset %d of %d, set aof-load-truncated yes to load it", offset, size)
+	}
+	fmt.Printf("AOF ends with an incomplete command: truncating it from %d to %d bytes\n", size, offset)
+	return h.file.Truncate(offset)
+}
+
+// AddCommand queues a command for the writer, after the commands whose
+// write failed. If the queue is full, it waits for room, or returns
+// ErrBufferFull with aof-buffer-overflow drop. With appendfsync always it
+// then waits for the command to be written and fsynced.
 func (h *AOFHandler) AddCommand(cmdLine [][]byte) error {
 	h.mu.Lock()
 	defer h.mu.Unlock()
 
-	if h.closing {
+	for {
+		if h.closing {
+			return fmt.Errorf("AOF handler is closing")
+		}
+
+		// Write command in RESP array format
+		// Format: *<count>\r\n$<len1>\r\n<arg1>\r\n$<len2>\r\n<arg2>\r\n...
+		start := len(h.queue)
+		h.queue = appendCommand(h.queue, cmdLine)
+		n := int64(len(h.queue) - start)
+		// A command larger than the queue is taken once the queue is empty
+		pending := h.queued - h.done
+		if h.bufferMax == 0 || pending == 0 || pending+n <= h.bufferMax {
+			h.queued += n
+			break
+		}
+		h.queue = h.queue[:start]
+		if h.dropOnFull {
+			h.dropErr = fmt.Errorf("%w: the AOF misses commands until it is rewritten", ErrBufferFull)
+			return ErrBufferFull
+		}
+		// The writer was woken when the commands were queued, and retries
+		// a failed write once a second
+		h.room.Wait()
+	}
+
+	if isFlushCommand(cmdLine) {
+		h.flushes++
+		h.queueFlushEnd = len(h.queue)
+	}
+	h.signal()
+	if h.WaitsForFsync() {
+		return h.waitWritten(h.queued)
+	}
+	return nil
+}
+
+// WaitsForFsync reports whether AddCommand waits for the command to be
+// written and fsynced, with appendfsync always: its error then means that
+// the command is not on disk
+func (h *AOFHandler) WaitsForFsync() bool {
+	return h.fsync == "always"
+}
+
+// waitWritten waits for the writer to write and fsync the first target
+// bytes ever queued, and returns the error of the write that failed to. A
+// write that fails leaves the commands queued for the next one, but the
+// caller is told now rather than held until the disk recovers. Close
+// writes what was queued before it, so it ends the wait too. The caller
+// holds mu.
+func (h *AOFHandler) waitWritten(target int64) error {
+	for h.done < target {
+		if h.failed >= target {
+			return h.failedErr
+		}
+		h.room.Wait()
+	}
+	return nil
+}
+
+// signal wakes the writer, unless a wakeup is already pending
+func (h *AOFHandler) signal() {
+	select {
+	case h.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run is the writer goroutine: it writes what was queued whenever woken, and
+// once a second, so that appendfsync everysec fsyncs the last commands and
+// a failed write is retried
+func (h *AOFHandler) run() {
+	defer close(h.stopped)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-h.wake:
+		case <-ticker.C:
+		case <-h.stop:
+			return
+		}
+		h.write(false)
+	}
+}
+
+// Flush writes the commands queued so far and fsyncs the file, whatever
+// appendfsync says, and returns the error of the write or the fsync if it
+// fails. Tests and SHUTDOWN call it so that the file holds every command.
+func (h *AOFHandler) Flush() error {
+	if h.isClosing() {
+		return fmt.Errorf("AOF handler is closing")
+	}
+	return h.write(true)
+}
+
+// FlushPending writes the commands queued so far, those whose write failed
+// first, and returns the error of the write if it fails again
+func (h *AOFHandler) FlushPending() error {
+	if h.isClosing() {
 		return fmt.Errorf("AOF handler is closing")
 	}
+	return h.write(false)
+}
+
+// isClosing reports whether Close was called
+func (h *AOFHandler) isClosing() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.closing
+}
+
+// write takes the queue, writes it after the commands whose write failed,
+// and fsyncs the file if sync is set or appendfsync says so. The outcome is
+// recorded with database.RecordAOFWrite and returned.
+func (h *AOFHandler) write(sync bool) error {
+	h.mu.Lock()
+	h.fileMu.Lock()
+	target := h.queued
+	h.takeQueue()
+	dropErr := h.dropErr
+	h.mu.Unlock()
+
+	start := time.Now()
+	attempted := len(h.buf) > 0
+	err := h.flush()
+	if attempted {
+		h.db.RecordLatency(database.LatencyEventAOFWrite, time.Since(start))
+	}
+	if err == nil && h.unsynced && (sync || h.syncDue()) {
+		attempted = true
+		if err = h.file.Sync(); err == nil {
+			h.unsynced, h.lastSync = false, time.Now()
+		}
+	}
+	h.fileMu.Unlock()
+
+	h.mu.Lock()
+	if err == nil && target > h.done {
+		h.done = target
+	} else if err != nil {
+		h.failed, h.failedErr = target, err
+	}
+	h.room.Broadcast()
+	h.mu.Unlock()
+
+	if err == nil {
+		err = dropErr
+	}
+	if attempted || err != nil {
+		h.db.RecordAOFWrite(err)
+	}
+	return err
+}
+
+// takeQueue moves the queue after the commands whose write failed. The
+// caller holds mu and fileMu.
+func (h *AOFHandler) takeQueue() {
+	if len(h.queue) == 0 {
+		return
+	}
+	if h.queueFlushEnd >= 0 {
+		h.bufFlushEnd = len(h.buf) + h.queueFlushEnd
+	}
+	if len(h.buf) == 0 {
+		// Swap the buffers rather than copy
+		h.buf, h.queue = h.queue, h.buf[:0]
+	} else {
+		h.buf = append(h.buf, h.queue...)
+		h.queue = h.queue[:0]
+	}
+	h.queueFlushEnd = -1
+	h.bufCap.Store(int64(cap(h.buf)))
+}
 
-	// Write command in RESP array format
-	// Format: *<count>\r\n$<len1>\r\n<arg1>\r\n$<len2>\r\n<arg2>\r\n...
+// syncDue reports whether appendfsync asks for an fsync after a write
+func (h *AOFHandler) syncDue() bool {
+	switch h.fsync {
+	case "always":
+		return true
+	case "everysec":
+		return time.Since(h.lastSync) >= time.Second
+	}
+	return false
+}
 
-	// Write array header
-	if _, err := h.writer.WriteString(fmt.Sprintf("*%d\r\n", len(cmdLine))); err != nil {
+// flush writes the buffered commands to the file. If the write fails, the
+// file is truncated back to its complete commands, and the commands stay
+// buffered. The caller holds fileMu.
+func (h *AOFHandler) flush() error {
+	if h.tailErr != nil {
+		return h.tailErr
+	}
+	if len(h.buf) == 0 {
+		return nil
+	}
+	size := h.size.Load()
+	n, err := h.file.Write(h.buf)
+	if err != nil {
+		if n > 0 {
+			if terr := h.file.Truncate(size); terr != nil {
+				h.tailErr = fmt.Errorf("%w (truncating the partial write failed: %v)", err, terr)
+				return h.tailErr
+			}
+		}
 		return err
 	}
+	if h.bufFlushEnd >= 0 {
+		h.flushOffset = size + int64(h.bufFlushEnd)
+	}
+	h.size.Add(int64(n))
+	h.written.Add(int64(n))
+	h.buf = h.buf[:0]
+	h.bufFlushEnd = -1
+	h.unsynced = true
+	return nil
+}
 
-	// Write each argument as bulk string
+// appendCommand appends a command in RESP array format to buf
+func appendCommand(buf []byte, cmdLine [][]byte) []byte {
+	buf = append(buf, '*')
+	buf = strconv.AppendInt(buf, int64(len(cmdLine)), 10)
+	buf = append(buf, '\r', '\n')
 	for _, arg := range cmdLine {
 		if arg == nil {
-			// Write null bulk string
-			if _, err := h.writer.WriteString("$-1\r\n"); err != nil {
-				return err
-			}
-		} else {
-			// Write bulk string
-			if _, err := h.writer.WriteString(fmt.Sprintf("$%d\r\n%s\r\n", len(arg), string(arg))); err != nil {
-				return err
-			}
+			// Null bulk string
+			buf = append(buf, "$-1\r\n"...)
+			continue
 		}
+		buf = append(buf, '$')
+		buf = strconv.AppendInt(buf, int64(len(arg)), 10)
+		buf = append(buf, '\r', '\n')
+		buf = append(buf, arg...)
+		buf = append(buf, '\r', '\n')
 	}
-
-	// Flush to disk
-	return h.writer.Flush()
+	return buf
 }
 
-// Close closes the AOF handler
-func (h *AOFHandler) Close() error {
+// BufferSize returns the number of bytes allocated to buffer the writes to
+// the AOF file
+func (h *AOFHandler) BufferSize() int64 {
 	h.mu.Lock()
 	defer h.mu.Unlock()
+	return int64(cap(h.queue)) + h.bufCap.Load()
+}
 
-	if h.closing {
-		return nil
+// Stats describes the writer: the bytes queued and not written yet, the size
+// of the file and the bytes written since the handler was opened
+func (h *AOFHandler) Stats() database.AOFStats {
+	h.mu.Lock()
+	pending := h.queued - h.done
+	h.mu.Unlock()
+	return database.AOFStats{
+		BufferLength: pending,
+		CurrentSize:  h.size.Load(),
+		WrittenBytes: h.written.Load(),
 	}
+}
 
-	h.closing = true
+// isFlushCommand reports whether a command removes every key
+func isFlushCommand(cmdLine [][]byte) bool {
+	if len(cmdLine) == 0 {
+		return false
+	}
+	name := string(cmdLine[0])
+	return strings.EqualFold(name, protocol.CmdFlushAll) || strings.EqualFold(name, protocol.CmdFlushDB)
+}
 
-	// Flush buffer
-	if err := h.writer.Flush(); err != nil {
-		return err
+// checkSelect fails a SELECT of a database other than 0: the commands that
+// follow it would be replayed into database 0, the only one
+func checkSelect(cmdLine [][]byte) error {
+	if len(cmdLine) != 2 || !strings.EqualFold(string(cmdLine[0]), protocol.CmdSelect) {
+		return nil
+	}
+	if index, err := strconv.Atoi(string(cmdLine[1])); err != nil || index != 0 {
+		return fmt.Errorf("%w: the AOF selects database %s", persistence.ErrUnsupportedDB, cmdLine[1])
 	}
+	return nil
+}
 
-	// Sync to disk
-	if err := h.file.Sync(); err != nil {
-		return err
+// countingReader counts the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// Close stops the writer, writes what is still queued, fsyncs the file and
+// closes it. Commands added afterwards fail.
+func (h *AOFHandler) Close() error {
+	h.mu.Lock()
+	if h.closing {
+		h.mu.Unlock()
+		return nil
 	}
+	h.closing = true
+	// Commands waiting for room fail
+	h.room.Broadcast()
+	h.mu.Unlock()
+
+	close(h.stop)
+	<-h.stopped
+	err := h.write(true)
 
-	// Close file
-	return h.file.Close()
+	h.fileMu.Lock()
+	defer h.fileMu.Unlock()
+	if cerr := h.file.Close(); err == nil {
+		err = cerr
+	}
+	return err
 }
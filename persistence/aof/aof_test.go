@@ -1,11 +1,23 @@
 package aof
 
 import (
+	"bufio"
+	"errors"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"testing"
+	"time"
 
+	"github.com/wangbo/gocache/config"
 	"github.com/wangbo/gocache/database"
+	"github.com/wangbo/gocache/persistence"
+	"github.com/wangbo/gocache/persistence/faultfs"
+	"github.com/wangbo/gocache/protocol/resp"
+	"github.com/wangbo/gocache/replication"
 )
 
 func TestMakeAOFHandler(t *testing.T) {
@@ -44,6 +56,9 @@ func TestAOFHandler_AddCommand(t *testing.T) {
 	if err := handler.AddCommand(cmd); err != nil {
 		t.Fatalf("AddCommand failed: %v", err)
 	}
+	if err := handler.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
 
 	// Verify file was written
 	info, err := os.Stat(filename)
@@ -224,3 +239,459 @@ func TestAOFHandler_LoadWithSpecialCharacters(t *testing.T) {
 		t.Errorf("Expected 'value with \\r\\n characters', got %v", result)
 	}
 }
+
+func TestAOFHandler_LoadFlushMidStream(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "test.aof")
+
+	handler, err := MakeAOFHandler(filename, database.MakeDB())
+	if err != nil {
+		t.Fatalf("MakeAOFHandler failed: %v", err)
+	}
+	for _, cmd := range []string{"SET a 1", "SET b 2", "FLUSHALL", "SET c 3", "BLPOP empty 0"} {
+		if err := handler.AddCommand(toCmdLine(cmd)); err != nil {
+			t.Fatalf("AddCommand failed: %v", err)
+		}
+	}
+	handler.Close()
+
+	// Keys are not evicted while loading, whatever the memory limit
+	cfg := config.Default()
+	cfg.MaxMemory = 1
+	cfg.MaxMemoryPolicy = "allkeys-lru"
+	db := database.MakeDBWithConfig(cfg, replication.NewReplicationState())
+	defer db.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		handler, err := MakeAOFHandler(filename, db)
+		if err == nil {
+			defer handler.Close()
+			if handler.flushOffset < 0 {
+				err = errors.New("flush offset not restored")
+			}
+		}
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("MakeAOFHandler failed: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Loading blocked on BLPOP")
+	}
+
+	if keys := db.Keys(); len(keys) != 1 || keys[0] != "c" {
+		t.Errorf("Expected only the key set after FLUSHALL, got %v", keys)
+	}
+}
+
+func TestAOFHandler_LoadSelect(t *testing.T) {
+	write := func(t *testing.T, cmds ...string) string {
+		filename := filepath.Join(t.TempDir(), "test.aof")
+		handler, err := MakeAOFHandler(filename, database.MakeDB())
+		if err != nil {
+			t.Fatalf("MakeAOFHandler failed: %v", err)
+		}
+		for _, cmd := range cmds {
+			handler.AddCommand(toCmdLine(cmd))
+		}
+		handler.Close()
+		return filename
+	}
+
+	t.Run("database 0", func(t *testing.T) {
+		filename := write(t, "SELECT 0", "SET a 1")
+		db := database.MakeDB()
+		defer db.Close()
+		handler, err := MakeAOFHandler(filename, db)
+		if err != nil {
+			t.Fatalf("MakeAOFHandler failed: %v", err)
+		}
+		defer handler.Close()
+		if !db.Exists("a") {
+			t.Error("Expected the key set after SELECT 0")
+		}
+	})
+
+	t.Run("other database", func(t *testing.T) {
+		filename := write(t, "SET a 1", "SELECT 5", "SET b 2")
+		db := database.MakeDB()
+		defer db.Close()
+		handler, err := MakeAOFHandler(filename, db)
+		if err == nil {
+			handler.Close()
+		}
+		if !errors.Is(err, persistence.ErrUnsupportedDB) || !strings.Contains(err.Error(), "database 5") {
+			t.Errorf("Expected ErrUnsupportedDB for database 5, got %v", err)
+		}
+		if db.Exists("b") {
+			t.Error("Expected the keys of database 5 not to be loaded into database 0")
+		}
+	})
+}
+
+// toCmdLine splits a command on spaces
+func toCmdLine(cmd string) [][]byte {
+	var cmdLine [][]byte
+	for _, arg := range strings.Fields(cmd) {
+		cmdLine = append(cmdLine, []byte(arg))
+	}
+	return cmdLine
+}
+
+func TestAOFHandler_LoadTruncatedTail(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "test.aof")
+	handler, err := MakeAOFHandler(filename, database.MakeDB())
+	if err != nil {
+		t.Fatalf("MakeAOFHandler failed: %v", err)
+	}
+	handler.AddCommand(toCmdLine("SET a 1"))
+	handler.AddCommand(toCmdLine("SET b 2"))
+	handler.Close()
+	info, _ := os.Stat(filename)
+	complete := info.Size()
+
+	// A crash while appending leaves part of a command
+	file, _ := os.OpenFile(filename, os.O_APPEND|os.O_WRONLY, 0644)
+	file.WriteString("*3\r\n$3\r\nSET\r\n$1\r\nc\r\n$1")
+	file.Close()
+
+	cfg := config.Default()
+	cfg.AOFLoadTruncated = false
+	strict := database.MakeDBWithConfig(cfg, replication.NewReplicationState())
+	defer strict.Close()
+	if _, err := MakeAOFHandler(filename, strict); err == nil {
+		t.Error("Expected the load to fail without aof-load-truncated")
+	}
+
+	db := database.MakeDB()
+	defer db.Close()
+	handler, err = MakeAOFHandler(filename, db)
+	if err != nil {
+		t.Fatalf("MakeAOFHandler failed: %v", err)
+	}
+	defer handler.Close()
+	if keys := db.Keys(); len(keys) != 2 {
+		t.Errorf("Expected the two complete commands to be loaded, got %v", keys)
+	}
+	if info, _ := os.Stat(filename); info.Size() != complete {
+		t.Errorf("Expected the file to be truncated to %d bytes, got %d", complete, info.Size())
+	}
+
+	// Commands are appended after the complete ones
+	handler.AddCommand(toCmdLine("SET c 3"))
+	handler.Flush()
+	reloaded := database.MakeDB()
+	defer reloaded.Close()
+	if handler, err := MakeAOFHandler(filename, reloaded); err != nil {
+		t.Fatalf("MakeAOFHandler failed: %v", err)
+	} else {
+		handler.Close()
+	}
+	if keys := reloaded.Keys(); len(keys) != 3 {
+		t.Errorf("Expected three keys after appending, got %v", keys)
+	}
+}
+
+// TestAOFHandler_WriteFailureKeepsFileComplete fills the disk in the middle
+// of a command and checks that the file is truncated back, and that the
+// command is written once the disk has room again
+func TestAOFHandler_WriteFailureKeepsFileComplete(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "test.aof")
+	fs := faultfs.New(nil)
+	handler, err := MakeAOFHandlerWithFS(filename, database.MakeDB(), fs)
+	if err != nil {
+		t.Fatalf("MakeAOFHandler failed: %v", err)
+	}
+	defer handler.Close()
+	handler.AddCommand(toCmdLine("SET a 1"))
+	handler.Flush()
+	info, _ := os.Stat(filename)
+	complete := info.Size()
+
+	fs.FailWritesAfter("test.aof", 10, syscall.ENOSPC)
+	if err := handler.AddCommand(toCmdLine("SET b 2")); err != nil {
+		t.Fatalf("Expected the command to be queued, got %v", err)
+	}
+	if err := handler.Flush(); !errors.Is(err, syscall.ENOSPC) {
+		t.Fatalf("Expected ENOSPC, got %v", err)
+	}
+	if err := handler.FlushPending(); !errors.Is(err, syscall.ENOSPC) {
+		t.Fatalf("Expected the retry to fail with ENOSPC, got %v", err)
+	}
+	if info, _ := os.Stat(filename); info.Size() != complete {
+		t.Errorf("Expected the partial write to be truncated to %d bytes, got %d", complete, info.Size())
+	}
+
+	fs.Heal()
+	handler.AddCommand(toCmdLine("SET c 3"))
+	if err := handler.Flush(); err != nil {
+		t.Fatalf("Flush failed after the disk healed: %v", err)
+	}
+	db := database.MakeDB()
+	defer db.Close()
+	reloaded, err := MakeAOFHandler(filename, db)
+	if err != nil {
+		t.Fatalf("Failed to load the AOF: %v", err)
+	}
+	reloaded.Close()
+	for _, key := range []string{"a", "b", "c"} {
+		if !db.Exists(key) {
+			t.Errorf("Expected %s to be loaded, got %v", key, db.Keys())
+		}
+	}
+}
+
+// TestAOFHandler_CrashMidAppendLoads crashes while a command is appended and
+// loads the half-written file
+func TestAOFHandler_CrashMidAppendLoads(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "test.aof")
+	fs := faultfs.New(nil)
+	handler, err := MakeAOFHandlerWithFS(filename, database.MakeDB(), fs)
+	if err != nil {
+		t.Fatalf("MakeAOFHandler failed: %v", err)
+	}
+	handler.AddCommand(toCmdLine("SET a 1"))
+	handler.AddCommand(toCmdLine("SET b 2"))
+	handler.Flush()
+
+	// The process dies after writing part of the command: nothing, the
+	// truncation included, happens after the partial write
+	fs.CrashAfterWrites("test.aof", 13)
+	handler.AddCommand(toCmdLine("SET c 3"))
+	if err := handler.Flush(); !errors.Is(err, faultfs.ErrCrashed) {
+		t.Fatalf("Expected the append to crash, got %v", err)
+	}
+	handler.Close()
+	if data, _ := os.ReadFile(filename); !strings.HasSuffix(string(data), "*3\r\n$3\r\nSET\r\n") {
+		t.Fatalf("Expected the file to end with part of SET c 3, got %q", data)
+	}
+
+	db := database.MakeDB()
+	defer db.Close()
+	reloaded, err := MakeAOFHandler(filename, db)
+	if err != nil {
+		t.Fatalf("Expected the half-written AOF to load: %v", err)
+	}
+	defer reloaded.Close()
+	if keys := db.Keys(); len(keys) != 2 || db.Exists("c") {
+		t.Errorf("Expected the two complete commands to be loaded, got %v", keys)
+	}
+}
+
+// TestRewriteFailureKeepsAOF fails the fsync and then the rename of a
+// rewrite, and checks that the AOF is left as it was and still appended to
+func TestRewriteFailureKeepsAOF(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "test.aof")
+	fs := faultfs.New(nil)
+	db := database.MakeDB()
+	defer db.Close()
+	handler, err := MakeAOFHandlerWithFS(filename, db, fs)
+	if err != nil {
+		t.Fatalf("MakeAOFHandler failed: %v", err)
+	}
+	defer handler.Close()
+	db.ExecCommand("SET", "a", "1")
+	handler.AddCommand(toCmdLine("SET a 1"))
+	handler.Flush()
+	before, _ := os.ReadFile(filename)
+
+	fs.FailSync("test.aof.tmp", syscall.EIO)
+	if err := MakeRewriter(handler, db).Rewrite(); !errors.Is(err, syscall.EIO) {
+		t.Errorf("Expected the rewrite to fail with EIO, got %v", err)
+	}
+	fs.Heal()
+	fs.FailRename("test.aof.tmp", syscall.EIO)
+	if err := MakeRewriter(handler, db).Rewrite(); !errors.Is(err, syscall.EIO) {
+		t.Errorf("Expected the rewrite to fail with EIO, got %v", err)
+	}
+
+	if after, _ := os.ReadFile(filename); string(after) != string(before) {
+		t.Errorf("Expected the AOF to be left as it was, got %q", after)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("Expected the temporary files to be removed, got %v", entries)
+	}
+	if err := handler.AddCommand(toCmdLine("SET b 2")); err != nil {
+		t.Errorf("Expected the AOF to still be appended to: %v", err)
+	}
+	if status := db.Status(); status.AOFLastRewriteOK || !status.AOFLastWriteOK {
+		t.Errorf("Expected only the rewrite to be reported as failed, got %+v", status)
+	}
+
+	fs.Heal()
+	if err := MakeRewriter(handler, db).Rewrite(); err != nil {
+		t.Fatalf("Rewrite failed: %v", err)
+	}
+	if !db.Status().AOFLastRewriteOK {
+		t.Error("Expected a successful rewrite to clear the failure")
+	}
+}
+
+// TestAOFHandler_QueueKeepsOrder queues many commands faster than they are
+// written, and checks that Close leaves all of them in the file in order
+func TestAOFHandler_QueueKeepsOrder(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "test.aof")
+	handler, err := MakeAOFHandler(filename, database.MakeDB())
+	if err != nil {
+		t.Fatalf("MakeAOFHandler failed: %v", err)
+	}
+	const n = 100000
+	for i := 0; i < n; i++ {
+		if err := handler.AddCommand(toCmdLine("SET k " + strconv.Itoa(i))); err != nil {
+			t.Fatalf("AddCommand %d failed: %v", i, err)
+		}
+	}
+	stats := handler.Stats()
+	if err := handler.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	file, err := os.Open(filename)
+	if err != nil {
+		t.Fatalf("Failed to open the AOF: %v", err)
+	}
+	defer file.Close()
+	reader := bufio.NewReader(file)
+	for i := 0; i < n; i++ {
+		cmdLine, err := resp.ParseStream(reader)
+		if err != nil {
+			t.Fatalf("Expected %d commands, the file ends after %d: %v", n, i, err)
+		}
+		if len(cmdLine) != 3 || string(cmdLine[2]) != strconv.Itoa(i) {
+			t.Fatalf("Command %d: expected SET k %d, got %q", i, i, cmdLine)
+		}
+	}
+	if cmdLine, err := resp.ParseStream(reader); err == nil {
+		t.Errorf("Expected %d commands, got %q after them", n, cmdLine)
+	}
+	if info, _ := file.Stat(); stats.CurrentSize+stats.BufferLength != info.Size() {
+		t.Errorf("Expected the queued and written bytes to add up to %d, got %+v", info.Size(), stats)
+	}
+}
+
+// TestAOFHandler_AlwaysWaitsForFsync checks that with appendfsync always a
+// command is on disk when AddCommand returns, and that a failed write is
+// reported to the command waiting for it
+func TestAOFHandler_AlwaysWaitsForFsync(t *testing.T) {
+	cfg := config.Default()
+	cfg.AppendFsync = "always"
+	db := database.MakeDBWithConfig(cfg, replication.NewReplicationState())
+	defer db.Close()
+	filename := filepath.Join(t.TempDir(), "test.aof")
+	fs := faultfs.New(nil)
+	fs.DelaySync("test.aof", 100*time.Millisecond)
+	handler, err := MakeAOFHandlerWithFS(filename, db, fs)
+	if err != nil {
+		t.Fatalf("MakeAOFHandler failed: %v", err)
+	}
+	defer handler.Close()
+
+	start := time.Now()
+	if err := handler.AddCommand(toCmdLine("SET a 1")); err != nil {
+		t.Fatalf("AddCommand failed: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("Expected AddCommand to wait for the fsync, took %v", elapsed)
+	}
+	if stats := handler.Stats(); stats.BufferLength != 0 || stats.CurrentSize == 0 {
+		t.Errorf("Expected the command to be written, got %+v", stats)
+	}
+
+	fs.FailWritesAfter("test.aof", 0, syscall.ENOSPC)
+	if err := handler.AddCommand(toCmdLine("SET b 2")); !errors.Is(err, syscall.ENOSPC) {
+		t.Errorf("Expected the failed write to be reported, got %v", err)
+	}
+	fs.Heal()
+	if err := handler.AddCommand(toCmdLine("SET c 3")); err != nil {
+		t.Errorf("Expected the write to succeed after the disk healed, got %v", err)
+	}
+}
+
+// TestAOFHandler_BufferOverflow fills the queue while an fsync holds the
+// writer, with each aof-buffer-overflow policy
+func TestAOFHandler_BufferOverflow(t *testing.T) {
+	open := func(t *testing.T, overflow string) (*AOFHandler, *database.DB, string) {
+		t.Helper()
+		cfg := config.Default()
+		cfg.AppendFsync = "always"
+		cfg.AOFBufferMax = 100
+		cfg.AOFBufferOverflow = overflow
+		db := database.MakeDBWithConfig(cfg, replication.NewReplicationState())
+		t.Cleanup(func() { db.Close() })
+		filename := filepath.Join(t.TempDir(), "test.aof")
+		fs := faultfs.New(nil)
+		fs.DelaySync("test.aof", 200*time.Millisecond)
+		handler, err := MakeAOFHandlerWithFS(filename, db, fs)
+		if err != nil {
+			t.Fatalf("MakeAOFHandler failed: %v", err)
+		}
+		return handler, db, filename
+	}
+	// Each command is 28 bytes: the fourth does not fit until the first
+	// fsync is over. With appendfsync always each client waits for its
+	// fsync, so the commands come from four clients at once.
+	fill := func(handler *AOFHandler) error {
+		errs := make([]error, 4)
+		var wg sync.WaitGroup
+		for i := range errs {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				errs[i] = handler.AddCommand(toCmdLine("SET k" + strconv.Itoa(i) + " v"))
+			}()
+		}
+		wg.Wait()
+		return errors.Join(errs...)
+	}
+
+	t.Run("block", func(t *testing.T) {
+		handler, _, filename := open(t, "block")
+		start := time.Now()
+		if err := fill(handler); err != nil {
+			t.Fatalf("AddCommand failed: %v", err)
+		}
+		if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+			t.Errorf("Expected the last command to wait for the fsync, took %v", elapsed)
+		}
+		if err := handler.Close(); err != nil {
+			t.Fatalf("Close failed: %v", err)
+		}
+		db := database.MakeDB()
+		defer db.Close()
+		reloaded, err := MakeAOFHandler(filename, db)
+		if err != nil {
+			t.Fatalf("Failed to load the AOF: %v", err)
+		}
+		reloaded.Close()
+		if keys := db.Keys(); len(keys) != 4 {
+			t.Errorf("Expected the four commands in the AOF, got %v", keys)
+		}
+	})
+
+	t.Run("drop", func(t *testing.T) {
+		handler, db, _ := open(t, "drop")
+		defer handler.Close()
+		if err := fill(handler); !errors.Is(err, ErrBufferFull) {
+			t.Fatalf("Expected ErrBufferFull, got %v", err)
+		}
+		// The file misses a command until it is rewritten
+		if err := handler.Flush(); !errors.Is(err, ErrBufferFull) {
+			t.Errorf("Expected the flush to report the dropped command, got %v", err)
+		}
+		if db.Status().AOFLastWriteOK {
+			t.Error("Expected aof_last_write_status:err after a dropped command")
+		}
+		if err := MakeRewriter(handler, db).Rewrite(); err != nil {
+			t.Fatalf("Rewrite failed: %v", err)
+		}
+		if err := handler.Flush(); err != nil {
+			t.Errorf("Expected the rewrite to clear the error, got %v", err)
+		}
+		if !db.Status().AOFLastWriteOK {
+			t.Error("Expected aof_last_write_status:ok after the rewrite")
+		}
+	})
+}
@@ -0,0 +1,61 @@
+package aof
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/wangbo/gocache/database"
+	"github.com/wangbo/gocache/persistence"
+	"github.com/wangbo/gocache/protocol/resp"
+)
+
+// Check replays the AOF file at filename into an empty database, as Load
+// does, and reports the commands and keys it holds. The file is only read:
+// where Load truncates a file whose last command is cut short, Check fails
+// with the offset the file would be truncated to. A command that cannot be
+// parsed fails the check with the offset at which it starts; one that fails
+// to run, which Load skips, does not.
+func Check(filename string) (*persistence.CheckReport, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	db := database.MakeDB()
+	defer db.Close()
+	counter := &countingReader{r: file}
+	reader := bufio.NewReader(counter)
+	parser := resp.MakeParserWithLimits(0, 0)
+	replay := db.StartReplay()
+	defer replay.Close()
+
+	report := &persistence.CheckReport{}
+	var parsed int64 // Offset of the end of the last complete command
+	for {
+		cmdLine, err := parser.ParseStream(reader)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			if parsed != counter.n {
+				return nil, fmt.Errorf("at offset %d: unexpected end of file in the last command, %d bytes long; aof-load-truncated yes truncates the file to %d bytes", parsed, counter.n-parsed, parsed)
+			}
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("at offset %d: invalid command: %w", parsed, err)
+		}
+		if len(cmdLine) != 0 {
+			if err := checkSelect(cmdLine); err != nil {
+				return nil, fmt.Errorf("at offset %d: %w", parsed, err)
+			}
+			replay.Exec(cmdLine)
+			report.Commands++
+		}
+		parsed = counter.n - int64(reader.Buffered())
+	}
+
+	report.Size = parsed
+	report.Keys, report.Expires = db.CountKeys()
+	return report, nil
+}
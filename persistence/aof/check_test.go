@@ -0,0 +1,92 @@
+package aof
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// writeAOF writes cmds to a new AOF in a temporary directory
+func writeAOF(t *testing.T, cmds ...string) string {
+	t.Helper()
+	var buf []byte
+	for _, cmd := range cmds {
+		buf = appendCommand(buf, toCmdLine(cmd))
+	}
+	filename := filepath.Join(t.TempDir(), "test.aof")
+	if err := os.WriteFile(filename, buf, 0600); err != nil {
+		t.Fatalf("Failed to write the AOF: %v", err)
+	}
+	return filename
+}
+
+func TestCheck(t *testing.T) {
+	filename := writeAOF(t,
+		"SET s 1", "SET gone 1", "DEL gone",
+		"HSET h f v", "RPUSH l a b", "SADD set m", "ZADD z 1 m",
+		"SET ttl v", "PEXPIREAT ttl 99999999999999",
+		"MULTI", "SET tx 1", "EXEC",
+		"INCR s", "INCR set") // The last command fails, as Load skips it
+	info, _ := os.Stat(filename)
+
+	report, err := Check(filename)
+	if err != nil {
+		t.Fatalf("Check failed: %v", err)
+	}
+	if report.Size != info.Size() || report.Commands != 14 {
+		t.Errorf("Expected %d bytes and 14 commands, got %+v", info.Size(), report)
+	}
+	want := map[string]int{"string": 3, "hash": 1, "list": 1, "set": 1, "zset": 1}
+	for typ, n := range want {
+		if report.Keys[typ] != n {
+			t.Errorf("Expected %d keys of type %s, got %v", n, typ, report.Keys)
+		}
+	}
+	if report.KeyCount() != 7 || report.Expires != 1 {
+		t.Errorf("Expected 7 keys, 1 with a TTL, got %+v", report)
+	}
+
+	empty := writeAOF(t)
+	if report, err := Check(empty); err != nil || report.Commands != 0 || report.KeyCount() != 0 {
+		t.Errorf("Expected an empty AOF to be valid, got %+v, %v", report, err)
+	}
+}
+
+func TestCheckCorrupted(t *testing.T) {
+	filename := writeAOF(t, "SET a 1", "SET b 2")
+	info, _ := os.Stat(filename)
+	complete := info.Size()
+	data, _ := os.ReadFile(filename)
+
+	for _, tc := range []struct {
+		name string
+		data string
+		want string
+	}{
+		{"truncated", string(data) + "*3\r\n$3\r\nSET\r\n$1\r\nc\r\n$1", "truncates the file to " + strconv.FormatInt(complete, 10)},
+		{"cut in a bulk string", string(data[:complete-3]), "at offset 27: unexpected end of file"},
+		{"invalid length", string(data) + "*2\r\n$x\r\n", "at offset " + strconv.FormatInt(complete, 10) + ": invalid command"},
+		{"garbage bulk", string(data) + "*1\r\n$3\r\nGETxx\r\n", "at offset " + strconv.FormatInt(complete, 10) + ": invalid command"},
+		{"other database", "*2\r\n$6\r\nSELECT\r\n$1\r\n1\r\n" + string(data), "at offset 0: only database 0 is supported"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := os.WriteFile(filename, []byte(tc.data), 0600); err != nil {
+				t.Fatal(err)
+			}
+			_, err := Check(filename)
+			if err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Errorf("Expected an error containing %q, got %v", tc.want, err)
+			}
+			// The file is left as it was
+			if after, _ := os.ReadFile(filename); string(after) != tc.data {
+				t.Errorf("Expected the file to be left unchanged, got %q", after)
+			}
+		})
+	}
+
+	if _, err := Check(filepath.Join(t.TempDir(), "missing.aof")); !os.IsNotExist(err) {
+		t.Errorf("Expected a missing file to fail, got %v", err)
+	}
+}
@@ -2,12 +2,14 @@ package aof
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
-	"os"
+	"io"
+	"time"
 	"sync"
 
 	"github.com/wangbo/gocache/database"
-	"github.com/wangbo/gocache/datastruct"
+	"github.com/wangbo/gocache/persistence"
 )
 
 // Rewriter handles AOF file rewriting
@@ -27,8 +29,17 @@ func MakeRewriter(aof *AOFHandler, db *database.DB) *Rewriter {
 }
 
 // Rewrite performs AOF rewrite
-// It creates a new compacted AOF file and atomically replaces the old one
-func (r *Rewriter) Rewrite() error {
+// It creates a new compacted AOF file and atomically replaces the old one.
+//
+// After a FLUSHALL or FLUSHDB, the file is rewritten from the flush point
+// instead of from a snapshot: the new file holds the commands appended since
+// the last flush, and is empty if there are none. A flush during a rewrite
+// from a snapshot makes the snapshot stale, and the rewrite starts over from
+// the flush point as well.
+//
+// The outcome is recorded on the database, which INFO reports as
+// aof_last_bgrewrite_status.
+func (r *Rewriter) Rewrite() (err error) {
 	r.mu.Lock()
 	if r.rewriting {
 		r.mu.Unlock()
@@ -42,187 +53,173 @@ func (r *Rewriter) Rewrite() error {
 		r.rewriting = false
 		r.mu.Unlock()
 	}()
+	defer func() {
+		r.db.RecordAOFRewrite(err)
+	}()
+	start := time.Now()
 
-	// Get AOF file path
+	// Get AOF file path. The queue is written first, so that the file
+	// holds every flush counted; dropped commands are what the rewrite
+	// repairs.
+	if err := r.aof.FlushPending(); err != nil && !errors.Is(err, ErrBufferFull) {
+		return fmt.Errorf("failed to write the queued commands: %w", err)
+	}
+	fs := r.aof.fs
+	r.aof.mu.Lock()
+	r.aof.fileMu.Lock()
 	aofPath := r.aof.file.Name()
+	flushes, flushOffset := r.aof.flushes, r.aof.flushOffset
+	if r.aof.dropErr != nil {
+		// The file misses commands: only the dataset is complete
+		flushOffset = -1
+	}
+	r.aof.fileMu.Unlock()
+	r.aof.mu.Unlock()
 	tmpPath := aofPath + ".tmp"
 	rewritePath := aofPath + ".rewrite"
 
 	// Create temporary rewrite file
-	tmpFile, err := os.Create(tmpPath)
+	tmpFile, err := fs.Create(tmpPath)
 	if err != nil {
 		return fmt.Errorf("failed to create temp file: %w", err)
 	}
-
-	// Create handler for rewrite with buffered writer
-	rewriteHandler := &AOFHandler{
-		file:   tmpFile,
-		writer: bufio.NewWriter(tmpFile),
-		db:     r.db,
-		closing: false,
+	fail := func(format string, err error) error {
+		tmpFile.Close()
+		fs.Remove(tmpPath)
+		return fmt.Errorf(format, err)
 	}
 
-	// Write all current data to rewrite file
-	if err := r.writeAllData(rewriteHandler); err != nil {
-		tmpFile.Close()
-		os.Remove(tmpPath)
-		return fmt.Errorf("failed to write data: %w", err)
+	// Write all current data, or the commands since the last flush, to the
+	// rewrite file
+	var copied int64
+	if flushOffset >= 0 {
+		copied, err = copyFrom(fs, tmpFile, aofPath, flushOffset)
+	} else {
+		err = r.writeAllData(tmpFile)
+	}
+	if err != nil {
+		return fail("failed to write data: %w", err)
 	}
 
-	// Sync and close temp file
-	if err := rewriteHandler.writer.Flush(); err != nil {
-		tmpFile.Close()
-		os.Remove(tmpPath)
-		return fmt.Errorf("failed to flush: %w", err)
+	// Commands appended from now on must reach the new file: the queue
+	// is written to the old one, whose end is copied
+	r.aof.mu.Lock()
+	defer r.aof.mu.Unlock()
+	r.aof.fileMu.Lock()
+	defer r.aof.fileMu.Unlock()
+	r.aof.takeQueue()
+	if err := r.aof.flush(); err != nil {
+		return fail("failed to write the queued commands: %w", err)
+	}
+	r.aof.done = r.aof.queued
+	r.aof.room.Broadcast()
+
+	if flushOffset < 0 && r.aof.flushes != flushes {
+		if err := tmpFile.Truncate(0); err != nil {
+			return fail("failed to truncate: %w", err)
+		}
+		if _, err := tmpFile.Seek(0, io.SeekStart); err != nil {
+			return fail("failed to truncate: %w", err)
+		}
+		flushOffset, copied = r.aof.flushOffset, 0
+	}
+	if flushOffset >= 0 {
+		// The queue was written, so the file is complete
+		if _, err := copyFrom(fs, tmpFile, aofPath, flushOffset+copied); err != nil {
+			return fail("failed to write data: %w", err)
+		}
 	}
 
+	// Sync and close temp file
 	if err := tmpFile.Sync(); err != nil {
-		tmpFile.Close()
-		os.Remove(tmpPath)
-		return fmt.Errorf("failed to sync: %w", err)
+		return fail("failed to sync: %w", err)
 	}
 
 	if err := tmpFile.Close(); err != nil {
-		os.Remove(tmpPath)
+		fs.Remove(tmpPath)
 		return fmt.Errorf("failed to close: %w", err)
 	}
 
 	// Rename temp to rewrite file
-	if err := os.Rename(tmpPath, rewritePath); err != nil {
-		os.Remove(tmpPath)
+	if err := fs.Rename(tmpPath, rewritePath); err != nil {
+		fs.Remove(tmpPath)
 		return fmt.Errorf("failed to rename: %w", err)
 	}
 
 	// Atomically replace old AOF file
-	if err := os.Rename(rewritePath, aofPath); err != nil {
+	if err := fs.Rename(rewritePath, aofPath); err != nil {
 		return fmt.Errorf("failed to replace AOF file: %w", err)
 	}
 
 	// Reopen AOF file for appending
-	r.aof.mu.Lock()
-	defer r.aof.mu.Unlock()
 
 	// Close old file
 	r.aof.file.Close()
 
 	// Open new file
-	newFile, err := os.OpenFile(aofPath, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0644)
+	newFile, err := fs.OpenAppend(aofPath)
+	if err != nil {
+		return fmt.Errorf("failed to reopen AOF file: %w", err)
+	}
+	size, err := newFile.Seek(0, io.SeekEnd)
 	if err != nil {
+		newFile.Close()
 		return fmt.Errorf("failed to reopen AOF file: %w", err)
 	}
 
 	r.aof.file = newFile
-	r.aof.writer.Reset(newFile)
-	r.aof.closing = false
-
+	r.aof.size.Store(size)
+	r.aof.tailErr = nil
+	r.aof.dropErr = nil
+	r.aof.unsynced, r.aof.lastSync = false, time.Now()
+	r.aof.flushOffset = -1
+	r.db.RecordAOFWrite(nil)
+
+	r.db.RecordLatency(database.LatencyEventAOFRewrite, time.Since(start))
 	return nil
 }
 
-// writeAllData writes all current database data to AOF handler
-func (r *Rewriter) writeAllData(handler *AOFHandler) error {
-	// Get all keys from database
-	keys := r.db.Keys()
+// copyFrom copies the file at path from offset to its end into w, returning
+// the number of bytes copied
+func copyFrom(fs persistence.FS, w io.Writer, path string, offset int64) (int64, error) {
+	file, err := fs.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return 0, err
+	}
+	return io.Copy(w, file)
+}
 
+// writeAllData writes the commands rebuilding the current database data to w
+func (r *Rewriter) writeAllData(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	var buf []byte
+	// Take a snapshot of the database so writers are not blocked during the rewrite
 	// For each key, write the minimal command to recreate it
-	for _, key := range keys {
-		entity, ok := r.db.GetEntity(key)
-		if !ok || entity == nil {
-			continue // Skip keys that can't be accessed
-		}
+	for _, entry := range r.db.Snapshot() {
+		key, entity := entry.Key, entry.Entity
 
-		// Write data based on type using type assertion
-		switch data := entity.Data.(type) {
-		case *datastruct.String:
-			if err := r.writeString(key, data, handler); err != nil {
-				return err
-			}
-		case *datastruct.Hash:
-			if err := r.writeHash(key, data, handler); err != nil {
-				return err
-			}
-		case *datastruct.List:
-			if err := r.writeList(key, data, handler); err != nil {
-				return err
-			}
-		case *datastruct.Set:
-			if err := r.writeSet(key, data, handler); err != nil {
-				return err
-			}
-		case *datastruct.SortedSet:
-			if err := r.writeSortedSet(key, data, handler); err != nil {
-				return err
-			}
+		buf = buf[:0]
+		for _, cmd := range database.RebuildCommands(key, entity) {
+			buf = appendCommand(buf, cmd)
 		}
 
 		// Write TTL if exists
-		if ttl := r.db.TTL(key); ttl > 0 {
-			// Use PEXPIRE for millisecond precision
-			cmd := [][]byte{[]byte("PEXPIRE"), []byte(key), []byte(fmt.Sprintf("%d", ttl))}
-			if err := handler.AddCommand(cmd); err != nil {
-				return err
-			}
+		if !entry.ExpireAt.IsZero() {
+			// Use PEXPIREAT with an absolute timestamp so replaying the file later
+			// doesn't extend the key's lifetime
+			cmd := [][]byte{[]byte("PEXPIREAT"), []byte(key), []byte(fmt.Sprintf("%d", entry.ExpireAt.UnixMilli()))}
+			buf = appendCommand(buf, cmd)
+		}
+		if _, err := bw.Write(buf); err != nil {
+			return err
 		}
 	}
 
-	return nil
-}
-
-// writeString writes a string key to AOF
-func (r *Rewriter) writeString(key string, data *datastruct.String, handler *AOFHandler) error {
-	cmd := [][]byte{[]byte("SET"), []byte(key), data.Value}
-	return handler.AddCommand(cmd)
-}
-
-// writeHash writes a hash key to AOF
-func (r *Rewriter) writeHash(key string, data *datastruct.Hash, handler *AOFHandler) error {
-	// Use HMSET for efficiency (set all fields at once)
-	args := [][]byte{[]byte("HMSET"), []byte(key)}
-	allData := data.GetAll()
-	for field, value := range allData {
-		args = append(args, []byte(field), value)
-	}
-
-	return handler.AddCommand(args)
-}
-
-// writeList writes a list key to AOF
-func (r *Rewriter) writeList(key string, data *datastruct.List, handler *AOFHandler) error {
-	// Use RPUSH to add all elements at once
-	args := [][]byte{[]byte("RPUSH"), []byte(key)}
-	elements := data.GetAll()
-	for _, elem := range elements {
-		args = append(args, elem)
-	}
-
-	return handler.AddCommand(args)
-}
-
-// writeSet writes a set key to AOF
-func (r *Rewriter) writeSet(key string, data *datastruct.Set, handler *AOFHandler) error {
-	// Use SADD to add all members
-	args := [][]byte{[]byte("SADD"), []byte(key)}
-	members := data.Members()
-	for _, member := range members {
-		args = append(args, member)
-	}
-
-	return handler.AddCommand(args)
-}
-
-// writeSortedSet writes a sorted set key to AOF
-func (r *Rewriter) writeSortedSet(key string, data *datastruct.SortedSet, handler *AOFHandler) error {
-	// Use ZADD to add all members
-	args := [][]byte{[]byte("ZADD"), []byte(key)}
-
-	// Get all members with their scores
-	// We need to iterate by rank to get score-member pairs
-	for i := 0; i < data.Len(); i++ {
-		member := data.GetMemberByRank(i)
-		score := data.GetScoreByRank(i)
-		args = append(args, []byte(fmt.Sprintf("%f", score)), member)
-	}
-
-	return handler.AddCommand(args)
+	return bw.Flush()
 }
 
 // IsRewriting returns true if a rewrite is in progress
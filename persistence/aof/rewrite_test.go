@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/wangbo/gocache/database"
@@ -25,7 +26,7 @@ func TestAOFRewrite(t *testing.T) {
 	db.ExecCommand("HSET", "hashkey", "field2", "value2")
 	db.ExecCommand("LPUSH", "listkey", "item1", "item2")
 	db.ExecCommand("SADD", "setkey", "member1", "member2")
-	db.ExecCommand("ZADD", "zsetkey", "1.0", "one", "2.0", "two")
+	db.ExecCommand("ZADD", "zsetkey", "1.0", "one", "2.0", "two", "inf", "top", "-inf", "bottom")
 
 	// Create AOF handler
 	aof, err := MakeAOFHandler(aofFile, db)
@@ -106,6 +107,13 @@ func TestAOFRewrite(t *testing.T) {
 	if len(val) == 0 || string(val[0]) != "1" {
 		t.Error("Sorted set not restored correctly")
 	}
+
+	for member, score := range map[string]string{"top": "inf", "bottom": "-inf"} {
+		val, _ = db2.ExecCommand("ZSCORE", "zsetkey", member)
+		if len(val) == 0 || string(val[0]) != score {
+			t.Errorf("Expected %s to keep score %s, got %q", member, score, val)
+		}
+	}
 }
 
 // TestAOFRewriteWithTTL tests AOF rewrite with keys that have TTL
@@ -200,3 +208,82 @@ func TestRewriterConcurrency(t *testing.T) {
 		t.Errorf("First rewrite failed: %v", err)
 	}
 }
+
+func TestAOFRewriteRecordsLatencyEvent(t *testing.T) {
+	db := database.MakeDB()
+	defer db.Close()
+	db.SetLatencyMonitorThreshold(0)
+	db.ExecCommand("SET", "k", "v")
+
+	aof, err := MakeAOFHandler(filepath.Join(t.TempDir(), "latency.aof"), db)
+	if err != nil {
+		t.Fatalf("Failed to create AOF handler: %v", err)
+	}
+	defer aof.Close()
+
+	if err := MakeRewriter(aof, db).Rewrite(); err != nil {
+		t.Fatalf("Rewrite failed: %v", err)
+	}
+	if history := db.LatencyHistory(database.LatencyEventAOFRewrite); len(history) != 1 {
+		t.Errorf("Expected one aof-rewrite sample, got %+v", history)
+	}
+}
+
+func TestAOFRewriteStartsFromFlush(t *testing.T) {
+	aofFile := filepath.Join(t.TempDir(), "flush.aof")
+	db := database.MakeDB()
+	defer db.Close()
+
+	aof, err := MakeAOFHandler(aofFile, db)
+	if err != nil {
+		t.Fatalf("Failed to create AOF handler: %v", err)
+	}
+	defer aof.Close()
+	write := func(cmd string) {
+		t.Helper()
+		args := strings.Fields(cmd)
+		if _, err := db.ExecCommand(args[0], args[1:]...); err != nil {
+			t.Fatalf("%s: %v", cmd, err)
+		}
+		if err := aof.AddCommand(toCmdLine(cmd)); err != nil {
+			t.Fatalf("AddCommand failed: %v", err)
+		}
+	}
+
+	write("SET a 1")
+	write("FLUSHALL")
+	rewriter := MakeRewriter(aof, db)
+	if err := rewriter.Rewrite(); err != nil {
+		t.Fatalf("Rewrite failed: %v", err)
+	}
+	if data, _ := os.ReadFile(aofFile); len(data) != 0 {
+		t.Errorf("Expected an empty file after rewriting a flush, got %q", data)
+	}
+
+	write("SET b 2")
+	write("FLUSHDB")
+	write("SET c 3")
+	if err := rewriter.Rewrite(); err != nil {
+		t.Fatalf("Rewrite failed: %v", err)
+	}
+	if data, _ := os.ReadFile(aofFile); string(data) != "*3\r\n$3\r\nSET\r\n$1\r\nc\r\n$1\r\n3\r\n" {
+		t.Errorf("Expected only the commands after the flush, got %q", data)
+	}
+
+	// The rewritten file has no flush: the next rewrite is from a snapshot
+	write("SET d 4")
+	write("DEL d")
+	if err := rewriter.Rewrite(); err != nil {
+		t.Fatalf("Rewrite failed: %v", err)
+	}
+	loaded := database.MakeDB()
+	defer loaded.Close()
+	aof2, err := MakeAOFHandler(aofFile, loaded)
+	if err != nil {
+		t.Fatalf("Failed to load rewritten AOF: %v", err)
+	}
+	defer aof2.Close()
+	if keys := loaded.Keys(); len(keys) != 1 || keys[0] != "c" {
+		t.Errorf("Expected only key c, got %v", keys)
+	}
+}
@@ -0,0 +1,19 @@
+package persistence
+
+// CheckReport describes a valid RDB or AOF file, as rdb.Check and aof.Check
+// loaded it into an empty database
+type CheckReport struct {
+	Size     int64          // Bytes in the file
+	Commands int64          // Commands in an AOF; 0 for an RDB
+	Keys     map[string]int // Keys loaded per type, as TYPE names them
+	Expires  int            // Keys loaded with a TTL
+}
+
+// KeyCount returns the number of keys loaded, whatever their type
+func (r *CheckReport) KeyCount() int {
+	n := 0
+	for _, count := range r.Keys {
+		n += count
+	}
+	return n
+}
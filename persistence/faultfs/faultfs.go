@@ -0,0 +1,242 @@
+// Package faultfs implements a persistence.FS that injects the disk failures
+// the persistence must survive: a disk filling up in the middle of a write,
+// a failed or slow fsync, a rename that never happens and a crash leaving
+// the files as they are.
+//
+// Faults are set on the base name of the files, as a filepath.Match
+// pattern, such as "appendonly.aof" or "*.tmp", and last until Heal.
+package faultfs
+
+import (
+	"errors"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/wangbo/gocache/persistence"
+)
+
+// ErrCrashed is returned by every operation after Crash
+var ErrCrashed = errors.New("faultfs: crashed")
+
+// writeLimit fails the writes to the files matching a pattern once they
+// wrote n bytes, and crashes the FS if crash is set
+type writeLimit struct {
+	pattern string
+	n       int64
+	err     error
+	crash   bool
+}
+
+// FS is a persistence.FS that injects failures into another one
+type FS struct {
+	base persistence.FS
+
+	mu          sync.Mutex
+	writeLimits []*writeLimit
+	syncErrs    map[string]error
+	syncDelays  map[string]time.Duration
+	renameErrs  map[string]error
+	crashed     bool
+}
+
+// New returns an FS without faults over base, the OS filesystem if nil
+func New(base persistence.FS) *FS {
+	if base == nil {
+		base = persistence.OSFS
+	}
+	return &FS{
+		base:       base,
+		syncErrs:   make(map[string]error),
+		syncDelays: make(map[string]time.Duration),
+		renameErrs: make(map[string]error),
+	}
+}
+
+// FailWritesAfter makes the writes to the files matching pattern fail with
+// err once they wrote n more bytes in all. The write crossing the limit
+// writes its first bytes, as a disk filling up does.
+func (f *FS) FailWritesAfter(pattern string, n int64, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.writeLimits = append(f.writeLimits, &writeLimit{pattern: pattern, n: n, err: err})
+}
+
+// CrashAfterWrites crashes the FS (see Crash) once the files matching
+// pattern wrote n more bytes in all, the write crossing the limit writing
+// its first bytes: the files are left as a process killed in the middle of
+// the write leaves them.
+func (f *FS) CrashAfterWrites(pattern string, n int64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.writeLimits = append(f.writeLimits, &writeLimit{pattern: pattern, n: n, err: ErrCrashed, crash: true})
+}
+
+// FailSync makes the fsync of the files matching pattern fail with err
+func (f *FS) FailSync(pattern string, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.syncErrs[pattern] = err
+}
+
+// DelaySync makes the fsync of the files matching pattern take d longer, as
+// on a slow disk
+func (f *FS) DelaySync(pattern string, d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.syncDelays[pattern] = d
+}
+
+// FailRename makes renaming the files matching pattern fail with err
+func (f *FS) FailRename(pattern string, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.renameErrs[pattern] = err
+}
+
+// Crash makes every later operation fail with ErrCrashed, leaving the files
+// as the last successful operations left them, as a process killed at this
+// point would
+func (f *FS) Crash() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.crashed = true
+}
+
+// Heal removes every fault
+func (f *FS) Heal() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.writeLimits = nil
+	f.syncErrs = make(map[string]error)
+	f.syncDelays = make(map[string]time.Duration)
+	f.renameErrs = make(map[string]error)
+	f.crashed = false
+}
+
+// match returns the error set for the file name in errs
+func match(errs map[string]error, name string) error {
+	for pattern, err := range errs {
+		if ok, _ := filepath.Match(pattern, filepath.Base(name)); ok {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *FS) Create(name string) (persistence.File, error) {
+	return f.open(name, f.base.Create)
+}
+
+func (f *FS) OpenAppend(name string) (persistence.File, error) {
+	return f.open(name, f.base.OpenAppend)
+}
+
+func (f *FS) Open(name string) (persistence.File, error) {
+	return f.open(name, f.base.Open)
+}
+
+func (f *FS) open(name string, open func(string) (persistence.File, error)) (persistence.File, error) {
+	f.mu.Lock()
+	crashed := f.crashed
+	f.mu.Unlock()
+	if crashed {
+		return nil, ErrCrashed
+	}
+	file, err := open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &faultFile{File: file, fs: f}, nil
+}
+
+func (f *FS) Rename(oldpath, newpath string) error {
+	f.mu.Lock()
+	err := match(f.renameErrs, oldpath)
+	if f.crashed {
+		err = ErrCrashed
+	}
+	f.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return f.base.Rename(oldpath, newpath)
+}
+
+func (f *FS) Remove(name string) error {
+	f.mu.Lock()
+	crashed := f.crashed
+	f.mu.Unlock()
+	if crashed {
+		return ErrCrashed
+	}
+	return f.base.Remove(name)
+}
+
+// faultFile is a file opened through an FS
+type faultFile struct {
+	persistence.File
+	fs *FS
+}
+
+func (f *faultFile) Write(p []byte) (int, error) {
+	f.fs.mu.Lock()
+	if f.fs.crashed {
+		f.fs.mu.Unlock()
+		return 0, ErrCrashed
+	}
+	var reached *writeLimit
+	allowed := int64(len(p))
+	for _, limit := range f.fs.writeLimits {
+		if ok, _ := filepath.Match(limit.pattern, filepath.Base(f.Name())); ok && limit.n < allowed {
+			allowed, reached = limit.n, limit
+		}
+	}
+	for _, limit := range f.fs.writeLimits {
+		if ok, _ := filepath.Match(limit.pattern, filepath.Base(f.Name())); ok {
+			limit.n -= allowed
+		}
+	}
+	var err error
+	if reached != nil {
+		err = reached.err
+		f.fs.crashed = f.fs.crashed || reached.crash
+	}
+	f.fs.mu.Unlock()
+
+	n, werr := f.File.Write(p[:allowed])
+	if werr != nil {
+		return n, werr
+	}
+	return n, err
+}
+
+func (f *faultFile) Sync() error {
+	f.fs.mu.Lock()
+	err := match(f.fs.syncErrs, f.Name())
+	if f.fs.crashed {
+		err = ErrCrashed
+	}
+	var delay time.Duration
+	for pattern, d := range f.fs.syncDelays {
+		if ok, _ := filepath.Match(pattern, filepath.Base(f.Name())); ok {
+			delay = d
+		}
+	}
+	f.fs.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	time.Sleep(delay)
+	return f.File.Sync()
+}
+
+func (f *faultFile) Truncate(size int64) error {
+	f.fs.mu.Lock()
+	crashed := f.fs.crashed
+	f.fs.mu.Unlock()
+	if crashed {
+		return ErrCrashed
+	}
+	return f.File.Truncate(size)
+}
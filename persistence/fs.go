@@ -0,0 +1,58 @@
+package persistence
+
+import (
+	"io"
+	"os"
+)
+
+// File is a persistence file opened through an FS
+type File interface {
+	io.Reader
+	io.Writer
+	io.Seeker
+	io.Closer
+	Name() string
+	Stat() (os.FileInfo, error)
+	Sync() error
+	Truncate(size int64) error
+}
+
+// FS creates, opens, renames and removes the AOF and RDB files. OSFS, the
+// default, is the filesystem of the operating system; tests inject disk
+// failures with another one (see persistence/faultfs).
+type FS interface {
+	// Create creates or truncates a file, opened for reading and writing
+	Create(name string) (File, error)
+	// OpenAppend opens a file for reading and appending, creating it if
+	// missing
+	OpenAppend(name string) (File, error)
+	// Open opens a file for reading
+	Open(name string) (File, error)
+	Rename(oldpath, newpath string) error
+	Remove(name string) error
+}
+
+// OSFS is the FS of the operating system
+var OSFS FS = osFS{}
+
+type osFS struct{}
+
+func (osFS) Create(name string) (File, error) {
+	return os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, FileMode)
+}
+
+func (osFS) OpenAppend(name string) (File, error) {
+	return os.OpenFile(name, os.O_APPEND|os.O_CREATE|os.O_RDWR, FileMode)
+}
+
+func (osFS) Open(name string) (File, error) {
+	return os.Open(name)
+}
+
+func (osFS) Rename(oldpath, newpath string) error {
+	return os.Rename(oldpath, newpath)
+}
+
+func (osFS) Remove(name string) error {
+	return os.Remove(name)
+}
@@ -0,0 +1,19 @@
+package rdb
+
+import "hash/crc64"
+
+// crc64Table is the table of the checksum that ends an RDB file: CRC-64
+// with the Jones coefficients, reflected, as Redis computes it
+var crc64Table = crc64.MakeTable(0x95ac9329ac4bc9b5)
+
+// crc64Writer computes the checksum of the bytes written to it. Unlike the
+// hashes of hash/crc64, Redis's CRC-64 starts from 0 and does not invert
+// its result, so that a file checksummed by one is checked by the other.
+type crc64Writer struct {
+	sum uint64
+}
+
+func (c *crc64Writer) Write(p []byte) (int, error) {
+	c.sum = ^crc64.Update(^c.sum, crc64Table, p)
+	return len(p), nil
+}
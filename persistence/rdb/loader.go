@@ -1,21 +1,42 @@
 package rdb
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 	"os"
+	"strconv"
 	"unsafe"
 
 	"github.com/wangbo/gocache/database"
+	"github.com/wangbo/gocache/datastruct"
+	"github.com/wangbo/gocache/persistence"
+	"github.com/wangbo/gocache/replication"
+	"github.com/wangbo/gocache/util/lzf"
 )
 
 // Loader loads database from RDB file
 type Loader struct {
 	input io.Reader
-	db    *database.DB
+
+	// db receives the loaded keys as commands, so any replication.Database
+	// can be loaded; key metadata is only restored into a *database.DB
+	db replication.Database
+
+	// expireAtMS is the absolute expiry (unix ms) read for the next key, 0 if none
+	expireAtMS int64
+
+	// keyMeta is the metadata read for the next key, nil if none
+	keyMeta []int64
+
+	// eof is set once the EOF opcode is read
+	eof bool
+
+	// crc is the checksum of the bytes read so far
+	crc crc64Writer
 }
 
 // MakeLoader creates a new RDB loader
@@ -39,6 +60,54 @@ func LoadFromFile(db *database.DB, filename string) error {
 	return loader.Load()
 }
 
+// Check loads the RDB file at filename into an empty database, as the
+// server does, and reports the keys it holds. Unlike a load, which stops at
+// the end of the file, a file cut short before its EOF opcode, or with bytes
+// after its checksum, fails the check. Errors give the offset at which
+// reading failed.
+func Check(filename string) (*persistence.CheckReport, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	db := database.MakeDB()
+	defer db.Close()
+	counter := &countingReader{r: bufio.NewReader(file)}
+	loader := MakeLoader(db)
+	loader.input = counter
+	if err := loader.Load(); err != nil {
+		return nil, fmt.Errorf("at offset %d: %w", counter.n, err)
+	}
+	if !loader.eof {
+		return nil, fmt.Errorf("at offset %d: unexpected end of file before the EOF opcode", counter.n)
+	}
+	if counter.n != info.Size() {
+		return nil, fmt.Errorf("at offset %d: %d unexpected bytes after the checksum", counter.n, info.Size()-counter.n)
+	}
+
+	report := &persistence.CheckReport{Size: info.Size()}
+	report.Keys, report.Expires = db.CountKeys()
+	return report, nil
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
 // LoadFromBytes loads database from RDB bytes
 func LoadFromBytes(db *database.DB, data []byte) error {
 	reader := bytes.NewReader(data)
@@ -50,6 +119,8 @@ func LoadFromBytes(db *database.DB, data []byte) error {
 
 // Load reads and parses the RDB file
 func (l *Loader) Load() error {
+	l.input = io.TeeReader(l.input, &l.crc)
+
 	// Read header
 	if err := l.readHeader(); err != nil {
 		return fmt.Errorf("read header: %w", err)
@@ -71,13 +142,25 @@ func (l *Loader) Load() error {
 			if err := l.readChecksum(); err != nil {
 				return fmt.Errorf("read checksum: %w", err)
 			}
+			l.eof = true
 			return nil
 		case OpcodeSelectDB:
 			dbID, err := l.readLength()
 			if err != nil {
 				return fmt.Errorf("read db id: %w", err)
 			}
-			_ = dbID // We only support single DB for now
+			// Keys of another database would be merged into the only one
+			if dbID != 0 {
+				return fmt.Errorf("%w: the file holds keys of database %d", persistence.ErrUnsupportedDB, dbID)
+			}
+		case OpcodeResizeDB:
+			// The sizes of the database section are only a hint
+			if _, err := l.readLength(); err != nil {
+				return fmt.Errorf("read db size: %w", err)
+			}
+			if _, err := l.readLength(); err != nil {
+				return fmt.Errorf("read expires size: %w", err)
+			}
 		case OpcodeAux:
 			if err := l.readAuxField(); err != nil {
 				return fmt.Errorf("read aux field: %w", err)
@@ -88,14 +171,19 @@ func (l *Loader) Load() error {
 				return fmt.Errorf("read expire time: %w", err)
 			}
 			// Next value will have this expiry
-			// For simplicity, we skip expiry handling for now
-			_ = expiryMS
+			l.expireAtMS = expiryMS
+		case OpcodeKeyMetadata:
+			meta, err := l.readKeyMetadata()
+			if err != nil {
+				return fmt.Errorf("read key metadata: %w", err)
+			}
+			l.keyMeta = meta
 		case TypeString:
 			if err := l.readStringValue(); err != nil {
 				return fmt.Errorf("read string value: %w", err)
 			}
-		case TypeHash:
-			if err := l.readHashValue(); err != nil {
+		case TypeHash, TypeHashMetadata:
+			if err := l.readHashValue(opcode == TypeHashMetadata); err != nil {
 				return fmt.Errorf("read hash value: %w", err)
 			}
 		case TypeList:
@@ -110,6 +198,10 @@ func (l *Loader) Load() error {
 			if err := l.readZSetValue(); err != nil {
 				return fmt.Errorf("read zset value: %w", err)
 			}
+		case TypeStreamEntries, TypeStreamGroups:
+			if err := l.readStreamValue(opcode == TypeStreamGroups); err != nil {
+				return fmt.Errorf("read stream value: %w", err)
+			}
 		default:
 			return fmt.Errorf("unknown opcode: %d", opcode)
 		}
@@ -142,13 +234,18 @@ func (l *Loader) readHeader() error {
 	return nil
 }
 
-// readChecksum reads and verifies the CRC64 checksum
+// readChecksum reads and verifies the CRC64 checksum. A checksum of 0 is
+// not verified: it is the one of files saved with rdbchecksum no in Redis,
+// and of the files gocache saved before it wrote checksums.
 func (l *Loader) readChecksum() error {
+	want := l.crc.sum
 	checksum := make([]byte, 8)
 	if _, err := io.ReadFull(l.input, checksum); err != nil {
 		return err
 	}
-	// For simplicity, we skip checksum verification
+	if got := binary.LittleEndian.Uint64(checksum); got != 0 && got != want {
+		return fmt.Errorf("wrong RDB checksum %016x, expected %016x", got, want)
+	}
 	return nil
 }
 
@@ -176,36 +273,52 @@ func (l *Loader) readExpireTimeMS() (int64, error) {
 	return int64(binary.LittleEndian.Uint64(expire)), nil
 }
 
+// readKeyMetadata reads the creation time, last write time and write count
+// of the next key
+func (l *Loader) readKeyMetadata() ([]int64, error) {
+	buf := make([]byte, 24)
+	if _, err := io.ReadFull(l.input, buf); err != nil {
+		return nil, err
+	}
+	return []int64{
+		int64(binary.LittleEndian.Uint64(buf)),
+		int64(binary.LittleEndian.Uint64(buf[8:])),
+		int64(binary.LittleEndian.Uint64(buf[16:])),
+	}, nil
+}
+
 // readLength reads a length-encoded integer
 func (l *Loader) readLength() (uint64, error) {
 	b, err := l.readByte()
 	if err != nil {
 		return 0, err
 	}
+	return l.readLengthFrom(b)
+}
 
+// readLengthFrom reads the rest of a length-encoded integer whose first byte
+// is b
+func (l *Loader) readLengthFrom(b byte) (uint64, error) {
 	encType := (b & 0xC0) >> 6
 	length := uint64(b & 0x3F)
 
 	switch encType {
 	case Len6Bit:
-		// For 6-bit encoding, length is stored in high 6 bits (shifted left by 2)
-		// We need to shift right to get the actual length
-		return length >> 2, nil
+		// 6-bit length is stored in the low 6 bits of the first byte
+		return length, nil
 	case Len14Bit:
 		b2, err := l.readByte()
 		if err != nil {
 			return 0, err
 		}
-		// Combine: 6 bits from first byte (shifted) + 8 bits from second byte
-		// The 6 bits are also shifted, so we need to handle that
-		result := (length << 8) | uint64(b2)
-		return result >> 2, nil
+		// Combine: 6 bits from first byte + 8 bits from second byte
+		return (length << 8) | uint64(b2), nil
 	case Len32Bit:
 		buf := make([]byte, 4)
 		if _, err := io.ReadFull(l.input, buf); err != nil {
 			return 0, err
 		}
-		return uint64(binary.LittleEndian.Uint32(buf)), nil
+		return uint64(binary.BigEndian.Uint32(buf)), nil
 	case EncVal:
 		// Special encoding - not implemented for now
 		return 0, errors.New("special encoding not implemented")
@@ -229,19 +342,43 @@ func (l *Loader) readString() (string, error) {
 	return string(data), nil
 }
 
-// readStringEncoding reads a string with length encoding
+// readStringEncoding reads a string with length encoding, decompressing an
+// LZF-compressed one
 func (l *Loader) readStringEncoding() ([]byte, error) {
-	length, err := l.readLength()
+	data, n, compressed, err := l.readStoredString()
+	if err != nil || !compressed {
+		return data, err
+	}
+	return lzf.Decompress(data, n)
+}
+
+// readStoredString reads a string with length encoding as it is stored:
+// compressed reports the LZF-compressed form of a string of n bytes
+func (l *Loader) readStoredString() (data []byte, n int, compressed bool, err error) {
+	b, err := l.readByte()
 	if err != nil {
-		return nil, err
+		return nil, 0, false, err
 	}
 
-	data := make([]byte, length)
-	if _, err := io.ReadFull(l.input, data); err != nil {
-		return nil, err
+	var length uint64
+	if b>>6 == EncVal && b&0x3F == EncLZF {
+		if length, err = l.readLength(); err != nil {
+			return nil, 0, false, err
+		}
+		rawLength, err := l.readLength()
+		if err != nil {
+			return nil, 0, false, err
+		}
+		n, compressed = int(rawLength), true
+	} else if length, err = l.readLengthFrom(b); err != nil {
+		return nil, 0, false, err
 	}
 
-	return data, nil
+	data = make([]byte, length)
+	if _, err := io.ReadFull(l.input, data); err != nil {
+		return nil, 0, false, err
+	}
+	return data, n, compressed, nil
 }
 
 // readStringValue reads a string value and stores it in database
@@ -251,18 +388,37 @@ func (l *Loader) readStringValue() error {
 		return err
 	}
 
-	value, err := l.readStringEncoding()
+	value, n, compressed, err := l.readStoredString()
 	if err != nil {
 		return err
 	}
 
 	// Store in database
-	l.db.ExecCommand("SET", key, string(value))
-	return nil
+	if err := l.clearKey(key); err != nil {
+		return err
+	}
+	if db, ok := l.db.(*database.DB); ok && compressed {
+		// Kept compressed, whatever value-compression says now
+		entity, err := datastruct.MakeCompressedString(value, n)
+		if err != nil {
+			return err
+		}
+		db.PutEntity(key, entity)
+		return l.finishKey(key)
+	}
+	if compressed {
+		if value, err = lzf.Decompress(value, n); err != nil {
+			return err
+		}
+	}
+	if _, err := l.execCommand("SET", key, string(value)); err != nil {
+		return err
+	}
+	return l.finishKey(key)
 }
 
 // readHashValue reads a hash value and stores it in database
-func (l *Loader) readHashValue() error {
+func (l *Loader) readHashValue(withFieldTTL bool) error {
 	key, err := l.readString()
 	if err != nil {
 		return err
@@ -275,6 +431,7 @@ func (l *Loader) readHashValue() error {
 
 	// Build HMSET command
 	args := []string{"HMSET", key}
+	fieldExpires := make(map[string]int64)
 	for i := uint64(0); i < length; i++ {
 		field, err := l.readStringEncoding()
 		if err != nil {
@@ -286,6 +443,16 @@ func (l *Loader) readHashValue() error {
 			return err
 		}
 
+		if withFieldTTL {
+			expireAtMS, err := l.readExpireTimeMS()
+			if err != nil {
+				return err
+			}
+			if expireAtMS != 0 {
+				fieldExpires[string(field)] = expireAtMS
+			}
+		}
+
 		args = append(args, string(field), string(value))
 	}
 
@@ -295,8 +462,19 @@ func (l *Loader) readHashValue() error {
 		cmdArgs[i] = []byte(arg)
 	}
 
-	_, err = l.db.Exec(cmdArgs)
-	return err
+	if err := l.clearKey(key); err != nil {
+		return err
+	}
+	if _, err := l.db.Exec(cmdArgs); err != nil {
+		return err
+	}
+	for field, expireAtMS := range fieldExpires {
+		ms := strconv.FormatInt(expireAtMS, 10)
+		if _, err := l.execCommand("HPEXPIREAT", key, ms, "FIELDS", "1", field); err != nil {
+			return err
+		}
+	}
+	return l.finishKey(key)
 }
 
 // readListValue reads a list value and stores it in database
@@ -327,8 +505,13 @@ func (l *Loader) readListValue() error {
 		cmdArgs[i] = []byte(arg)
 	}
 
-	_, err = l.db.Exec(cmdArgs)
-	return err
+	if err := l.clearKey(key); err != nil {
+		return err
+	}
+	if _, err := l.db.Exec(cmdArgs); err != nil {
+		return err
+	}
+	return l.finishKey(key)
 }
 
 // readSetValue reads a set value and stores it in database
@@ -359,8 +542,13 @@ func (l *Loader) readSetValue() error {
 		cmdArgs[i] = []byte(arg)
 	}
 
-	_, err = l.db.Exec(cmdArgs)
-	return err
+	if err := l.clearKey(key); err != nil {
+		return err
+	}
+	if _, err := l.db.Exec(cmdArgs); err != nil {
+		return err
+	}
+	return l.finishKey(key)
 }
 
 // readZSetValue reads a sorted set value and stores it in database
@@ -388,7 +576,7 @@ func (l *Loader) readZSetValue() error {
 			return err
 		}
 
-		args = append(args, fmt.Sprintf("%f", score), string(member))
+		args = append(args, datastruct.FormatScore(score), string(member))
 	}
 
 	// Execute command
@@ -397,10 +585,191 @@ func (l *Loader) readZSetValue() error {
 		cmdArgs[i] = []byte(arg)
 	}
 
-	_, err = l.db.Exec(cmdArgs)
+	if err := l.clearKey(key); err != nil {
+		return err
+	}
+	if _, err := l.db.Exec(cmdArgs); err != nil {
+		return err
+	}
+	return l.finishKey(key)
+}
+
+// readStreamValue reads a stream value, with its consumer groups if
+// withGroups is set, and stores it in database
+func (l *Loader) readStreamValue(withGroups bool) error {
+	key, err := l.readString()
+	if err != nil {
+		return err
+	}
+
+	lastID, err := l.readString()
+	if err != nil {
+		return err
+	}
+
+	length, err := l.readLength()
+	if err != nil {
+		return err
+	}
+
+	// Build one XADD command with an explicit ID per entry
+	cmds := make([][][]byte, 0, length)
+	for i := uint64(0); i < length; i++ {
+		id, err := l.readString()
+		if err != nil {
+			return err
+		}
+		numItems, err := l.readLength()
+		if err != nil {
+			return err
+		}
+		cmd := [][]byte{[]byte("XADD"), []byte(key), []byte(id)}
+		for j := uint64(0); j < numItems; j++ {
+			item, err := l.readStringEncoding()
+			if err != nil {
+				return err
+			}
+			cmd = append(cmd, item)
+		}
+		cmds = append(cmds, cmd)
+	}
+
+	// An empty stream still remembers its last ID; one that never had an
+	// entry was created by XGROUP CREATE MKSTREAM
+	if length == 0 {
+		if lastID == "0-0" {
+			cmds = append(cmds,
+				[][]byte{[]byte("XGROUP"), []byte("CREATE"), []byte(key), []byte(""), []byte("0"), []byte("MKSTREAM")},
+				[][]byte{[]byte("XGROUP"), []byte("DESTROY"), []byte(key), []byte("")})
+		} else {
+			cmds = append(cmds, [][]byte{[]byte("XADD"), []byte(key), []byte("MAXLEN"), []byte("0"),
+				[]byte(lastID), []byte(""), []byte("")})
+		}
+	}
+
+	if withGroups {
+		groupCmds, err := l.readStreamGroups(key)
+		if err != nil {
+			return err
+		}
+		cmds = append(cmds, groupCmds...)
+	}
+
+	if err := l.clearKey(key); err != nil {
+		return err
+	}
+	for _, cmd := range cmds {
+		if _, err := l.db.Exec(cmd); err != nil {
+			return err
+		}
+	}
+	return l.finishKey(key)
+}
+
+// readStreamGroups reads the consumer groups of a stream and returns the
+// commands that recreate them
+func (l *Loader) readStreamGroups(key string) ([][][]byte, error) {
+	numGroups, err := l.readLength()
+	if err != nil {
+		return nil, err
+	}
+
+	var cmds [][][]byte
+	for i := uint64(0); i < numGroups; i++ {
+		name, err := l.readString()
+		if err != nil {
+			return nil, err
+		}
+		lastDelivered, err := l.readString()
+		if err != nil {
+			return nil, err
+		}
+		cmds = append(cmds, [][]byte{[]byte("XGROUP"), []byte("CREATE"), []byte(key), []byte(name), []byte(lastDelivered)})
+
+		numConsumers, err := l.readLength()
+		if err != nil {
+			return nil, err
+		}
+		for j := uint64(0); j < numConsumers; j++ {
+			consumer, err := l.readString()
+			if err != nil {
+				return nil, err
+			}
+			cmds = append(cmds, [][]byte{[]byte("XGROUP"), []byte("CREATECONSUMER"), []byte(key), []byte(name), []byte(consumer)})
+		}
+
+		numPending, err := l.readLength()
+		if err != nil {
+			return nil, err
+		}
+		for j := uint64(0); j < numPending; j++ {
+			// ID, consumer, delivery time and delivery count
+			var fields [4]string
+			for k := range fields {
+				if fields[k], err = l.readString(); err != nil {
+					return nil, err
+				}
+			}
+			cmds = append(cmds, [][]byte{[]byte("XCLAIM"), []byte(key), []byte(name), []byte(fields[1]), []byte("0"),
+				[]byte(fields[0]), []byte("TIME"), []byte(fields[2]), []byte("RETRYCOUNT"), []byte(fields[3]),
+				[]byte("FORCE"), []byte("JUSTID")})
+		}
+	}
+	return cmds, nil
+}
+
+// execCommand executes a command built from strings on the database
+func (l *Loader) execCommand(cmd string, args ...string) ([][]byte, error) {
+	cmdLine := make([][]byte, 0, len(args)+1)
+	cmdLine = append(cmdLine, []byte(cmd))
+	for _, arg := range args {
+		cmdLine = append(cmdLine, []byte(arg))
+	}
+	return l.db.Exec(cmdLine)
+}
+
+// clearKey removes any existing value of a key about to be loaded, so the
+// loaded value replaces it instead of being merged into it
+func (l *Loader) clearKey(key string) error {
+	_, err := l.execCommand("DEL", key)
 	return err
 }
 
+// finishKey applies the pending expiry and metadata to a key that was just
+// loaded
+func (l *Loader) finishKey(key string) error {
+	if err := l.applyExpire(key); err != nil {
+		return err
+	}
+	l.applyKeyMetadata(key)
+	return nil
+}
+
+// applyExpire sets the pending expiry (if any) on a key that was just loaded
+func (l *Loader) applyExpire(key string) error {
+	if l.expireAtMS == 0 {
+		return nil
+	}
+	expireAtMS := l.expireAtMS
+	l.expireAtMS = 0
+
+	_, err := l.execCommand("PEXPIREAT", key, strconv.FormatInt(expireAtMS, 10))
+	return err
+}
+
+// applyKeyMetadata restores the pending metadata (if any) of a key that was
+// just loaded. It is dropped if key metadata tracking is disabled.
+func (l *Loader) applyKeyMetadata(key string) {
+	if l.keyMeta == nil {
+		return
+	}
+	meta := l.keyMeta
+	l.keyMeta = nil
+	if db, ok := l.db.(*database.DB); ok {
+		db.SetKeyMetadata(key, meta[0], meta[1], meta[2])
+	}
+}
+
 // readValue reads any value type
 func (l *Loader) readValue() error {
 	return errors.New("readValue not implemented")
@@ -5,11 +5,13 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io"
-	"os"
+	"strconv"
 	"time"
 
 	"github.com/wangbo/gocache/database"
 	"github.com/wangbo/gocache/datastruct"
+	"github.com/wangbo/gocache/persistence"
+	"github.com/wangbo/gocache/replication"
 )
 
 // RDB file format constants
@@ -24,6 +26,12 @@ const (
 	OpcodeExpireTime    = 252
 	OpcodeFreq          = 246
 	OpcodeUnused       = 245
+
+	// OpcodeKeyMetadata is gocache's key metadata (track-key-metadata): the
+	// creation time and last write time in milliseconds and the write count,
+	// each an 8-byte little-endian integer. Like an expire time it applies to
+	// the key that follows.
+	OpcodeKeyMetadata = 240
 )
 
 // Value type encodings
@@ -42,6 +50,23 @@ const (
 	TypeStreamListPacks = 15
 	TypeModule       = 7
 	TypeModule2      = 6
+
+	// TypeHashMetadata is a hash with per-field TTLs: every field-value pair
+	// is followed by the field's expire time in milliseconds as an 8-byte
+	// little-endian integer, 0 if the field has no TTL
+	TypeHashMetadata = 24
+
+	// TypeStreamEntries is a gocache stream: the last ID, the number of
+	// entries, then every entry as its ID, the number of field and value
+	// items and the items. IDs are written as "ms-seq" strings.
+	TypeStreamEntries = 26
+
+	// TypeStreamGroups is a stream with consumer groups: a TypeStreamEntries
+	// value followed by the number of groups and, for every group, its name,
+	// last delivered ID, consumer names and pending entries. A pending entry
+	// is its ID, its consumer, its delivery time in milliseconds and its
+	// delivery count, the last two as decimal strings.
+	TypeStreamGroups = 27
 )
 
 // Length encoding constants
@@ -79,7 +104,9 @@ func (g *Generator) AddAuxField(key, value string) {
 
 // Generate generates an RDB file to the given writer
 func (g *Generator) Generate(output io.Writer) error {
-	g.output = output
+	// Everything before the checksum is checksummed
+	crc := &crc64Writer{}
+	g.output = io.MultiWriter(output, crc)
 
 	// Write magic string and version
 	if err := g.writeHeader(); err != nil {
@@ -93,35 +120,34 @@ func (g *Generator) Generate(output io.Writer) error {
 		}
 	}
 
-	// Write database selector (DB 0)
+	// Write all key-value pairs from a snapshot so writers are not blocked
+	// for the duration of the dump
+	entries := g.db.Snapshot()
+
+	// The keys are all in DB 0, the only database. Its section opens with
+	// the selector and the sizes of its keyspace and expires.
 	if err := g.writeSelectDB(0); err != nil {
 		return err
 	}
+	if err := g.writeResizeDB(entries); err != nil {
+		return err
+	}
 
-	// Write resize db (optional)
-	// if err := g.writeResizeDB(); err != nil {
-	// 	return err
-	// }
-
-	// Write all key-value pairs
-	keys := g.db.Keys()
-	for _, key := range keys {
-		entity, ok := g.db.GetEntity(key)
-		if !ok || entity == nil {
-			continue
+	for _, entry := range entries {
+		if !entry.ExpireAt.IsZero() {
+			// Write absolute expiry with millisecond precision
+			if err := g.writeExpireTimeMS(entry.ExpireAt.UnixMilli()); err != nil {
+				return err
+			}
 		}
-
-		// Check for TTL
-		ttl := g.db.TTL(key)
-		if ttl > 0 {
-			// Write with millisecond precision expiry
-			if err := g.writeExpireTimeMS(int64(ttl)); err != nil {
+		if entry.Entity.Meta != nil {
+			if err := g.writeKeyMetadata(entry.Entity.Meta); err != nil {
 				return err
 			}
 		}
 
 		// Write value based on type
-		if err := g.writeValue(key, entity); err != nil {
+		if err := g.writeValue(entry.Key, entry.Entity); err != nil {
 			return err
 		}
 	}
@@ -131,10 +157,10 @@ func (g *Generator) Generate(output io.Writer) error {
 		return err
 	}
 
-	// Write CRC64 checksum (8 bytes)
-	// For simplicity, we write zeros
+	// Write CRC64 checksum (8 bytes, little-endian)
 	checksum := make([]byte, 8)
-	if _, err := g.output.Write(checksum); err != nil {
+	binary.LittleEndian.PutUint64(checksum, crc.sum)
+	if _, err := output.Write(checksum); err != nil {
 		return err
 	}
 
@@ -189,19 +215,52 @@ func (g *Generator) writeSelectDB(dbID int) error {
 	return g.writeLength(uint64(dbID))
 }
 
-// writeExpireTimeMS writes the expire time in milliseconds
-func (g *Generator) writeExpireTimeMS(ttl int64) error {
+// writeResizeDB writes the number of keys of the database section and how
+// many of them have a TTL
+func (g *Generator) writeResizeDB(entries []database.SnapshotEntry) error {
+	var expires uint64
+	for _, entry := range entries {
+		if !entry.ExpireAt.IsZero() {
+			expires++
+		}
+	}
+	if err := g.writeByte(OpcodeResizeDB); err != nil {
+		return err
+	}
+	if err := g.writeLength(uint64(len(entries))); err != nil {
+		return err
+	}
+	return g.writeLength(expires)
+}
+
+// writeExpireTimeMS writes the absolute expire time as a unix timestamp in milliseconds
+func (g *Generator) writeExpireTimeMS(expireAtMS int64) error {
 	if err := g.writeByte(OpcodeExpireTimeMS); err != nil {
 		return err
 	}
 
 	// Write as 64-bit unsigned integer (milliseconds)
 	expire := make([]byte, 8)
-	binary.LittleEndian.PutUint64(expire, uint64(ttl))
+	binary.LittleEndian.PutUint64(expire, uint64(expireAtMS))
 	_, err := g.output.Write(expire)
 	return err
 }
 
+// writeKeyMetadata writes the metadata of the next key
+func (g *Generator) writeKeyMetadata(meta *datastruct.KeyMetadata) error {
+	if err := g.writeByte(OpcodeKeyMetadata); err != nil {
+		return err
+	}
+
+	createdAt, modifiedAt, writes := meta.Load()
+	buf := make([]byte, 24)
+	binary.LittleEndian.PutUint64(buf, uint64(createdAt))
+	binary.LittleEndian.PutUint64(buf[8:], uint64(modifiedAt))
+	binary.LittleEndian.PutUint64(buf[16:], uint64(writes))
+	_, err := g.output.Write(buf)
+	return err
+}
+
 // writeEOF writes the EOF opcode
 func (g *Generator) writeEOF() error {
 	return g.writeByte(OpcodeEOF)
@@ -209,23 +268,27 @@ func (g *Generator) writeEOF() error {
 
 // writeLength writes a length-encoded integer
 func (g *Generator) writeLength(length uint64) error {
+	// The top two bits of the first byte select the encoding
 	if length < 64 {
-		// 6-bit length
-		return g.writeByte(byte(length) << 2)
+		// 6-bit length: 00xxxxxx
+		return g.writeByte(byte(length))
 	} else if length < 16384 {
-		// 14-bit length
-		b1 := byte((length>>8)<<2 | Len14Bit)
+		// 14-bit length: 01xxxxxx xxxxxxxx
+		b1 := byte(Len14Bit<<6) | byte(length>>8)
 		b2 := byte(length)
 		if err := g.writeByte(b1); err != nil {
 			return err
 		}
 		return g.writeByte(b2)
 	} else {
-		// 32-bit length
-		if err := g.writeByte(byte(Len32Bit << 2)); err != nil {
+		// 32-bit length: 10000000 followed by a big-endian uint32
+		if err := g.writeByte(byte(Len32Bit << 6)); err != nil {
 			return err
 		}
-		return g.writeUint32(uint32(length))
+		buf := make([]byte, 4)
+		binary.BigEndian.PutUint32(buf, uint32(length))
+		_, err := g.output.Write(buf)
+		return err
 	}
 }
 
@@ -260,6 +323,8 @@ func (g *Generator) writeValue(key string, entity *datastruct.DataEntity) error
 		return g.writeSetValue(key, data)
 	case *datastruct.SortedSet:
 		return g.writeZSetValue(key, data)
+	case *datastruct.Stream:
+		return g.writeStreamValue(key, data)
 	default:
 		return fmt.Errorf("unknown type: %T", data)
 	}
@@ -277,14 +342,35 @@ func (g *Generator) writeStringValue(key string, data *datastruct.String) error
 		return err
 	}
 
-	// Write value
-	return g.writeStringEncoding(data.Value)
+	// Write value, a compressed one as its compressed bytes, the way Redis
+	// writes the strings it compresses
+	if compressed, n, ok := data.Compressed(); ok {
+		if err := g.writeByte(EncVal<<6 | EncLZF); err != nil {
+			return err
+		}
+		if err := g.writeLength(uint64(len(compressed))); err != nil {
+			return err
+		}
+		if err := g.writeLength(uint64(n)); err != nil {
+			return err
+		}
+		_, err := g.output.Write(compressed)
+		return err
+	}
+	return g.writeStringEncoding(data.Get())
 }
 
-// writeHashValue writes a hash value
+// writeHashValue writes a hash value, as TypeHashMetadata if any field has
+// a TTL
 func (g *Generator) writeHashValue(key string, data *datastruct.Hash) error {
+	expires := data.FieldExpirations()
+
 	// Write type
-	if err := g.writeByte(TypeHash); err != nil {
+	hashType := byte(TypeHash)
+	if len(expires) > 0 {
+		hashType = TypeHashMetadata
+	}
+	if err := g.writeByte(hashType); err != nil {
 		return err
 	}
 
@@ -307,6 +393,17 @@ func (g *Generator) writeHashValue(key string, data *datastruct.Hash) error {
 		if err := g.writeStringEncoding(value); err != nil {
 			return err
 		}
+		if hashType == TypeHashMetadata {
+			var expireAtMS int64
+			if expireAt, ok := expires[field]; ok {
+				expireAtMS = expireAt.UnixMilli()
+			}
+			buf := make([]byte, 8)
+			binary.LittleEndian.PutUint64(buf, uint64(expireAtMS))
+			if _, err := g.output.Write(buf); err != nil {
+				return err
+			}
+		}
 	}
 
 	return nil
@@ -404,6 +501,96 @@ func (g *Generator) writeZSetValue(key string, data *datastruct.SortedSet) error
 	return nil
 }
 
+// writeStreamValue writes a stream value
+func (g *Generator) writeStreamValue(key string, data *datastruct.Stream) error {
+	// Write type
+	groups := data.Groups()
+	streamType := byte(TypeStreamEntries)
+	if len(groups) > 0 {
+		streamType = TypeStreamGroups
+	}
+	if err := g.writeByte(streamType); err != nil {
+		return err
+	}
+
+	// Write key
+	if err := g.writeString(key); err != nil {
+		return err
+	}
+
+	// Write last ID and number of entries
+	if err := g.writeString(data.LastID().String()); err != nil {
+		return err
+	}
+	entries := data.Range(datastruct.StreamID{}, datastruct.MaxStreamID, 0, false)
+	if err := g.writeLength(uint64(len(entries))); err != nil {
+		return err
+	}
+
+	// Write entries
+	for _, entry := range entries {
+		if err := g.writeString(entry.ID.String()); err != nil {
+			return err
+		}
+		if err := g.writeLength(uint64(len(entry.Fields))); err != nil {
+			return err
+		}
+		for _, item := range entry.Fields {
+			if err := g.writeStringEncoding(item); err != nil {
+				return err
+			}
+		}
+	}
+
+	if len(groups) == 0 {
+		return nil
+	}
+	return g.writeStreamGroups(groups)
+}
+
+// writeStreamGroups writes the consumer groups of a stream
+func (g *Generator) writeStreamGroups(groups []*datastruct.StreamGroup) error {
+	if err := g.writeLength(uint64(len(groups))); err != nil {
+		return err
+	}
+	for _, group := range groups {
+		if err := g.writeString(group.Name); err != nil {
+			return err
+		}
+		if err := g.writeString(group.LastDelivered.String()); err != nil {
+			return err
+		}
+
+		consumers := group.Consumers()
+		if err := g.writeLength(uint64(len(consumers))); err != nil {
+			return err
+		}
+		for _, consumer := range consumers {
+			if err := g.writeString(consumer.Name); err != nil {
+				return err
+			}
+		}
+
+		pending := group.Pending(datastruct.StreamID{}, datastruct.MaxStreamID, 0, nil)
+		if err := g.writeLength(uint64(len(pending))); err != nil {
+			return err
+		}
+		for _, p := range pending {
+			for _, s := range []string{
+				p.ID.String(),
+				p.Consumer,
+				strconv.FormatInt(p.DeliveryTime, 10),
+				strconv.FormatInt(p.DeliveryCount, 10),
+			} {
+				if err := g.writeString(s); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
 // Helper functions for writing primitive types
 
 func (g *Generator) writeByte(b byte) error {
@@ -428,12 +615,11 @@ func (g *Generator) writeDouble(f float64) error {
 
 // SaveToFile saves the database to an RDB file
 func SaveToFile(db *database.DB, filename string) error {
-	file, err := os.Create(filename)
-	if err != nil {
-		return fmt.Errorf("failed to create RDB file: %w", err)
-	}
-	defer file.Close()
+	return SaveToFileWithFS(db, filename, persistence.OSFS)
+}
 
+// SaveToFileWithFS saves the database to an RDB file accessed through fs
+func SaveToFileWithFS(db *database.DB, filename string, fs persistence.FS) error {
 	generator := MakeGenerator(db)
 
 	// Add Redis version info
@@ -441,12 +627,42 @@ func SaveToFile(db *database.DB, filename string) error {
 	generator.AddAuxField("redis-bits", "64")
 	generator.AddAuxField("ctime", fmt.Sprintf("%d", time.Now().Unix()))
 
-	if err := generator.Generate(file); err != nil {
+	return writeFileAtomically(fs, filename, generator.Generate)
+}
+
+// writeFileAtomically writes a file with write: to a temporary file in the
+// same directory, renamed over filename once it is complete and synced.
+// Readers never observe a partially written file, and a save that fails or
+// dies midway leaves the previous file intact.
+func writeFileAtomically(fs persistence.FS, filename string, write func(io.Writer) error) error {
+	tmpFilename := filename + ".tmp"
+	file, err := fs.Create(tmpFilename)
+	if err != nil {
+		return fmt.Errorf("failed to create RDB file: %w", err)
+	}
+
+	if err := write(file); err != nil {
+		file.Close()
+		fs.Remove(tmpFilename)
 		return fmt.Errorf("failed to generate RDB: %w", err)
 	}
 
 	// Sync to disk
-	return file.Sync()
+	if err := file.Sync(); err != nil {
+		file.Close()
+		fs.Remove(tmpFilename)
+		return fmt.Errorf("failed to sync RDB file: %w", err)
+	}
+	if err := file.Close(); err != nil {
+		fs.Remove(tmpFilename)
+		return fmt.Errorf("failed to close RDB file: %w", err)
+	}
+
+	if err := fs.Rename(tmpFilename, filename); err != nil {
+		fs.Remove(tmpFilename)
+		return fmt.Errorf("failed to rename RDB file: %w", err)
+	}
+	return nil
 }
 
 // RDBSaver implements persistence.DBSaver interface
@@ -491,12 +707,24 @@ func SaveToWriter(db *database.DB, writer io.Writer) error {
 // RDBLoaderImpl implements replication.RDBLoader interface
 type RDBLoaderImpl struct{}
 
+var (
+	_ replication.RDBLoader = (*RDBLoaderImpl)(nil)
+	_ persistence.DBLoader  = (*RDBLoaderImpl)(nil)
+)
+
 // LoadRDBFromBytes loads RDB data from bytes into database
-func (l *RDBLoaderImpl) LoadRDBFromBytes(db interface{}, data []byte) error {
-	// Type assert to *database.DB
+func (l *RDBLoaderImpl) LoadRDBFromBytes(db replication.Database, data []byte) error {
+	loader := &Loader{db: db, input: bytes.NewReader(data)}
+	return loader.Load()
+}
+
+// LoadDBFromReader loads RDB data from an io.Reader into a *database.DB
+func (l *RDBLoaderImpl) LoadDBFromReader(db interface{}, reader io.Reader) error {
 	dbTyped, ok := db.(*database.DB)
 	if !ok {
 		return fmt.Errorf("invalid database type")
 	}
-	return LoadFromBytes(dbTyped, data)
+	loader := MakeLoader(dbTyped)
+	loader.input = reader
+	return loader.Load()
 }
@@ -1,11 +1,25 @@
 package rdb
 
 import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"testing"
+	"time"
 
+	"github.com/wangbo/gocache/config"
 	"github.com/wangbo/gocache/database"
+	"github.com/wangbo/gocache/persistence"
+	"github.com/wangbo/gocache/persistence/faultfs"
+	"github.com/wangbo/gocache/replication"
 )
 
 // TestRDBSaveLoad tests RDB save and load functionality
@@ -105,3 +119,520 @@ func TestRDBEmpty(t *testing.T) {
 		t.Errorf("Expected 0 keys, got %d", len(keys))
 	}
 }
+
+// TestRDBTTLRoundTrip tests that key expiry survives a save/load cycle
+func TestRDBTTLRoundTrip(t *testing.T) {
+	tmpDir := t.TempDir()
+	rdbFile := filepath.Join(tmpDir, "ttl.rdb")
+
+	db := database.MakeDB()
+	defer db.Close()
+
+	db.ExecCommand("SET", "volatile", "v")
+	db.ExecCommand("EXPIRE", "volatile", "100")
+	db.ExecCommand("SET", "persistent", "p")
+
+	if err := SaveToFile(db, rdbFile); err != nil {
+		t.Fatalf("Failed to save RDB: %v", err)
+	}
+
+	db2 := database.MakeDB()
+	defer db2.Close()
+
+	if err := LoadFromFile(db2, rdbFile); err != nil {
+		t.Fatalf("Failed to load RDB: %v", err)
+	}
+
+	ttl := db2.TTL("volatile")
+	if ttl <= 90*time.Second || ttl > 100*time.Second {
+		t.Errorf("Expected TTL close to 100s, got %v", ttl)
+	}
+	if ttl := db2.TTL("persistent"); ttl != -1 {
+		t.Errorf("Expected no TTL for persistent key, got %v", ttl)
+	}
+}
+
+// TestRDBBgSaveWithConcurrentWriters runs BGSAVE while writers mutate
+// strings, hashes, lists, sets and sorted sets, and verifies the resulting
+// file loads cleanly. Run it with -race.
+func TestRDBBgSaveWithConcurrentWriters(t *testing.T) {
+	tmpDir := t.TempDir()
+	rdbFile := filepath.Join(tmpDir, "bgsave.rdb")
+
+	oldFilename := config.Config.DBFilename
+	config.Config.DBFilename = rdbFile
+	defer func() { config.Config.DBFilename = oldFilename }()
+
+	persistence.RegisterSaver(&RDBSaver{})
+
+	db := database.MakeDB()
+	defer db.Close()
+
+	for i := 0; i < 1000; i++ {
+		db.ExecCommand("SET", fmt.Sprintf("key:%d", i), fmt.Sprintf("value:%d", i))
+	}
+	// Give every writer collections the pops and removals cannot empty
+	for w := 0; w < 10; w++ {
+		for i := 0; i < 100; i++ {
+			member := fmt.Sprintf("m%d", i)
+			db.ExecCommand("RPUSH", fmt.Sprintf("list:%d", w), member)
+			db.ExecCommand("SADD", fmt.Sprintf("set:%d", w), member)
+			db.ExecCommand("ZADD", fmt.Sprintf("zset:%d", w), strconv.Itoa(i), member)
+		}
+	}
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	for w := 0; w < 10; w++ {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				key := fmt.Sprintf("key:%d", (id*100+i)%1000)
+				member := fmt.Sprintf("m%d", i%100)
+				switch i % 10 {
+				case 0:
+					db.ExecCommand("SET", key, fmt.Sprintf("writer:%d:%d", id, i))
+				case 1:
+					db.ExecCommand("DEL", key)
+				case 2:
+					db.ExecCommand("HSET", fmt.Sprintf("hash:%d", id), fmt.Sprintf("f%d", i%50), "v")
+				case 3:
+					db.ExecCommand("EXPIRE", key, "100")
+				case 4:
+					db.ExecCommand("RPUSH", fmt.Sprintf("list:%d", id), member)
+				case 5:
+					db.ExecCommand("LPOP", fmt.Sprintf("list:%d", id))
+				case 6:
+					db.ExecCommand("SADD", fmt.Sprintf("set:%d", id), member)
+				case 7:
+					db.ExecCommand("SREM", fmt.Sprintf("set:%d", id), member)
+				case 8:
+					db.ExecCommand("ZADD", fmt.Sprintf("zset:%d", id), strconv.Itoa(i), member)
+				case 9:
+					db.ExecCommand("ZREM", fmt.Sprintf("zset:%d", id), member)
+				}
+			}
+		}(w)
+	}
+
+	// Let the writers run for a bit before and during the save
+	time.Sleep(20 * time.Millisecond)
+	if _, err := db.ExecCommand("BGSAVE"); err != nil {
+		t.Fatalf("BGSAVE failed: %v", err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for db.IsBgSaveInProgress() {
+		if time.Now().After(deadline) {
+			t.Fatal("BGSAVE did not finish in time")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	close(stop)
+	wg.Wait()
+
+	db2 := database.MakeDB()
+	defer db2.Close()
+
+	if err := LoadFromFile(db2, rdbFile); err != nil {
+		t.Fatalf("Failed to load RDB written during concurrent writes: %v", err)
+	}
+
+	if len(db2.Keys()) == 0 {
+		t.Error("Expected keys in loaded database")
+	}
+}
+
+// TestRDBKeyMetadataRoundTrip verifies key metadata survives a save/load
+// cycle when track-key-metadata is enabled
+func TestRDBKeyMetadataRoundTrip(t *testing.T) {
+	config.Config.TrackKeyMetadata = true
+	defer func() { config.Config.TrackKeyMetadata = false }()
+
+	rdbFile := filepath.Join(t.TempDir(), "meta.rdb")
+
+	db := database.MakeDB()
+	defer db.Close()
+
+	db.ExecCommand("SET", "str", "v")
+	db.ExecCommand("SET", "str", "w")
+	db.ExecCommand("RPUSH", "list", "a", "b")
+	db.ExecCommand("EXPIRE", "list", "100")
+	db.SetKeyMetadata("str", 1000, 2000, 7)
+
+	before, _ := db.ExecCommand("OBJECT", "METADATA", "list")
+
+	if err := SaveToFile(db, rdbFile); err != nil {
+		t.Fatalf("Failed to save RDB: %v", err)
+	}
+
+	db2 := database.MakeDB()
+	defer db2.Close()
+	if err := LoadFromFile(db2, rdbFile); err != nil {
+		t.Fatalf("Failed to load RDB: %v", err)
+	}
+
+	result, err := db2.ExecCommand("OBJECT", "METADATA", "str")
+	if err != nil || len(result) != 6 {
+		t.Fatalf("Expected metadata for str, got %q %v", result, err)
+	}
+	if string(result[1]) != "1000" || string(result[3]) != "2000" || string(result[5]) != "7" {
+		t.Errorf("Expected the saved metadata, got %q", result)
+	}
+
+	after, _ := db2.ExecCommand("OBJECT", "METADATA", "list")
+	if fmt.Sprint(after) != fmt.Sprint(before) {
+		t.Errorf("Expected list metadata %q, got %q", before, after)
+	}
+	if ttl := db2.TTL("list"); ttl <= 0 {
+		t.Errorf("Expected list to keep its TTL, got %v", ttl)
+	}
+}
+
+// TestRDBCompressedStringRoundTrip saves a compressed string as its
+// compressed bytes and loads it back compressed, even with value-compression
+// off
+func TestRDBCompressedStringRoundTrip(t *testing.T) {
+	config.Config.ValueCompression = "lzf"
+	defer func() { config.Config.ValueCompression = "no" }()
+
+	value := strings.Repeat(`{"id":1,"name":"gocache"},`, 100)
+	db := database.MakeDB()
+	defer db.Close()
+	db.ExecCommand("SET", "big", value)
+	db.ExecCommand("SET", "small", "v")
+
+	var buf bytes.Buffer
+	if err := Snapshot(db, &buf); err != nil {
+		t.Fatalf("Snapshot failed: %v", err)
+	}
+	if buf.Len() > len(value)/2 {
+		t.Errorf("Expected the snapshot to hold the compressed value, got %d bytes", buf.Len())
+	}
+
+	config.Config.ValueCompression = "no"
+	db2 := database.MakeDB()
+	defer db2.Close()
+	if err := LoadFromBytes(db2, buf.Bytes()); err != nil {
+		t.Fatalf("Failed to load RDB: %v", err)
+	}
+
+	for key, want := range map[string][]string{"big": {value, "compressed"}, "small": {"v", "embstr"}} {
+		if result, _ := db2.ExecCommand("GET", key); len(result) != 1 || string(result[0]) != want[0] {
+			t.Errorf("Expected %s to load its value, got %q", key, result)
+		}
+		if result, _ := db2.ExecCommand("OBJECT", "ENCODING", key); string(result[0]) != want[1] {
+			t.Errorf("Expected %s encoded as %s, got %s", key, want[1], result[0])
+		}
+	}
+	if used := db2.GetUsedMemory(); used != db.GetUsedMemory() {
+		t.Errorf("Expected used memory %d, got %d", db.GetUsedMemory(), used)
+	}
+}
+
+// TestRDBLoaderImplLoadsReplicationDatabase loads a snapshot through the
+// replication.RDBLoader interface, as a replica does after a full sync
+func TestRDBLoaderImplLoadsReplicationDatabase(t *testing.T) {
+	src := database.MakeDB()
+	defer src.Close()
+	src.ExecCommand("SET", "k", "v")
+	src.ExecCommand("SADD", "s", "a", "b")
+
+	var buf bytes.Buffer
+	if err := Snapshot(src, &buf); err != nil {
+		t.Fatalf("Snapshot failed: %v", err)
+	}
+
+	var dst replication.Database = database.MakeDB()
+	defer dst.(*database.DB).Close()
+
+	replication.RegisterRDBLoader(&RDBLoaderImpl{})
+	defer replication.RegisterRDBLoader(nil)
+	if err := replication.LoadRDBData(dst, buf.Bytes()); err != nil {
+		t.Fatalf("LoadRDBData failed: %v", err)
+	}
+
+	if result, _ := dst.Exec([][]byte{[]byte("GET"), []byte("k")}); len(result) != 1 || string(result[0]) != "v" {
+		t.Errorf("Expected k=v, got %q", result)
+	}
+	if result, _ := dst.Exec([][]byte{[]byte("SCARD"), []byte("s")}); string(result[0]) != "2" {
+		t.Errorf("Expected 2 members in s, got %q", result)
+	}
+}
+
+// failingWriter fails once n bytes have been written, as a save dying
+// midway would
+type failingWriter struct {
+	w io.Writer
+	n int
+}
+
+func (f *failingWriter) Write(p []byte) (int, error) {
+	if len(p) > f.n {
+		written, _ := f.w.Write(p[:f.n])
+		f.n = 0
+		return written, errors.New("disk failure")
+	}
+	f.n -= len(p)
+	return f.w.Write(p)
+}
+
+// TestRDBInterruptedSaveKeepsPreviousDump saves into dir, then fails a save
+// midway and checks that the previous dump is left as it was
+func TestRDBInterruptedSaveKeepsPreviousDump(t *testing.T) {
+	persistence.RegisterSaver(&RDBSaver{})
+
+	cfg := config.Default()
+	cfg.Dir = t.TempDir()
+	db := database.MakeDBWithConfig(cfg, replication.NewReplicationState())
+	defer db.Close()
+
+	db.ExecCommand("SET", "key", "saved")
+	if _, err := db.ExecCommand("SAVE"); err != nil {
+		t.Fatalf("SAVE failed: %v", err)
+	}
+	rdbFile := filepath.Join(cfg.Dir, "dump.rdb")
+	saved, err := os.ReadFile(rdbFile)
+	if err != nil {
+		t.Fatalf("Expected SAVE to write into dir: %v", err)
+	}
+	info, _ := os.Stat(rdbFile)
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Errorf("Expected the dump to be readable by its owner only, got %o", perm)
+	}
+
+	for i := 0; i < 100; i++ {
+		db.ExecCommand("SET", fmt.Sprintf("key:%d", i), "unsaved")
+	}
+	generator := MakeGenerator(db)
+	err = writeFileAtomically(persistence.OSFS, rdbFile, func(w io.Writer) error {
+		return generator.Generate(&failingWriter{w: w, n: len(saved) + 10})
+	})
+	if err == nil {
+		t.Fatal("Expected the save to fail")
+	}
+
+	if dump, err := os.ReadFile(rdbFile); err != nil || !bytes.Equal(dump, saved) {
+		t.Errorf("Expected the previous dump to survive intact: %v", err)
+	}
+	if _, err := os.Stat(rdbFile + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("Expected the temporary file to be removed: %v", err)
+	}
+
+	db2 := database.MakeDB()
+	defer db2.Close()
+	if err := LoadFromFile(db2, rdbFile); err != nil {
+		t.Fatalf("Failed to load the previous dump: %v", err)
+	}
+	if keys := db2.Keys(); len(keys) != 1 || keys[0] != "key" {
+		t.Errorf("Expected the previous dump to hold key only, got %v", keys)
+	}
+}
+
+func TestRDBInfiniteScoresRoundTrip(t *testing.T) {
+	db := database.MakeDB()
+	defer db.Close()
+	db.ExecCommand("ZADD", "z", "-inf", "low", "1.5", "mid", "inf", "high")
+
+	var buf bytes.Buffer
+	if err := Snapshot(db, &buf); err != nil {
+		t.Fatalf("Snapshot failed: %v", err)
+	}
+	db2 := database.MakeDB()
+	defer db2.Close()
+	if err := LoadFromBytes(db2, buf.Bytes()); err != nil {
+		t.Fatalf("Failed to load RDB: %v", err)
+	}
+
+	result, _ := db2.ExecCommand("ZRANGE", "z", "0", "-1", "WITHSCORES")
+	want := []string{"low", "-inf", "mid", "1.5", "high", "inf"}
+	if len(result) != len(want) {
+		t.Fatalf("Expected %q, got %q", want, result)
+	}
+	for i := range want {
+		if string(result[i]) != want[i] {
+			t.Errorf("Expected %q, got %q", want, result)
+			break
+		}
+	}
+}
+
+// TestRDBSaveFailuresKeepPreviousDump fails a save when the disk fills up,
+// when the fsync fails and when the process dies before the rename, and
+// checks that the previous dump is left intact each time
+func TestRDBSaveFailuresKeepPreviousDump(t *testing.T) {
+	dir := t.TempDir()
+	rdbFile := filepath.Join(dir, "dump.rdb")
+	db := database.MakeDB()
+	defer db.Close()
+	db.ExecCommand("SET", "key", "saved")
+	if err := SaveToFile(db, rdbFile); err != nil {
+		t.Fatalf("SaveToFile failed: %v", err)
+	}
+	saved, _ := os.ReadFile(rdbFile)
+	for i := 0; i < 100; i++ {
+		db.ExecCommand("SET", fmt.Sprintf("key:%d", i), "unsaved")
+	}
+
+	for name, inject := range map[string]func(fs *faultfs.FS){
+		"disk full":   func(fs *faultfs.FS) { fs.FailWritesAfter("dump.rdb.tmp", 20, syscall.ENOSPC) },
+		"fsync":       func(fs *faultfs.FS) { fs.FailSync("dump.rdb.tmp", syscall.EIO) },
+		"crash":       func(fs *faultfs.FS) { fs.FailRename("dump.rdb.tmp", faultfs.ErrCrashed) },
+		"crash write": func(fs *faultfs.FS) { fs.CrashAfterWrites("dump.rdb.tmp", 20) },
+	} {
+		fs := faultfs.New(nil)
+		inject(fs)
+		if err := SaveToFileWithFS(db, rdbFile, fs); err == nil {
+			t.Errorf("%s: expected the save to fail", name)
+		}
+		if dump, err := os.ReadFile(rdbFile); err != nil || !bytes.Equal(dump, saved) {
+			t.Errorf("%s: expected the previous dump to survive intact: %v", name, err)
+		}
+		os.Remove(rdbFile + ".tmp") // Left behind by the crashes
+
+		db2 := database.MakeDB()
+		if err := LoadFromFile(db2, rdbFile); err != nil {
+			t.Errorf("%s: failed to load the previous dump: %v", name, err)
+		} else if keys := db2.Keys(); len(keys) != 1 || keys[0] != "key" {
+			t.Errorf("%s: expected the previous dump to hold key only, got %v", name, keys)
+		}
+		db2.Close()
+	}
+}
+
+func TestRDBDatabaseSection(t *testing.T) {
+	db := database.MakeDB()
+	defer db.Close()
+	db.ExecCommand("SET", "a", "1")
+	db.ExecCommand("SET", "b", "2", "EX", "100")
+	db.ExecCommand("RPUSH", "c", "x")
+
+	var buf bytes.Buffer
+	if err := MakeGenerator(db).Generate(&buf); err != nil {
+		t.Fatalf("Generate failed: %v", err)
+	}
+	data := buf.Bytes()
+
+	// DB 0 opens with its selector and sizes: 3 keys, 1 with a TTL
+	section := []byte{OpcodeSelectDB, 0, OpcodeResizeDB, 3, 1}
+	at := bytes.Index(data, section)
+	if at < 0 {
+		t.Fatalf("Expected the section header %v in %q", section, data)
+	}
+
+	loaded := database.MakeDB()
+	defer loaded.Close()
+	if err := LoadFromBytes(loaded, data); err != nil {
+		t.Fatalf("Failed to load: %v", err)
+	}
+	if n := len(loaded.Keys()); n != 3 {
+		t.Errorf("Expected 3 keys, got %d", n)
+	}
+
+	// Keys of another database are refused rather than merged into DB 0
+	other := bytes.Clone(data)
+	other[at+1] = 5
+	refused := database.MakeDB()
+	defer refused.Close()
+	err := LoadFromBytes(refused, other)
+	if !errors.Is(err, persistence.ErrUnsupportedDB) || !strings.Contains(err.Error(), "database 5") {
+		t.Errorf("Expected ErrUnsupportedDB for database 5, got %v", err)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	db := database.MakeDB()
+	defer db.Close()
+	db.ExecCommand("SET", "s", "v")
+	db.ExecCommand("SET", "ttl", "v", "EX", "1000")
+	db.ExecCommand("HSET", "h", "f", "v")
+	db.ExecCommand("RPUSH", "l", "a", "b")
+	db.ExecCommand("SADD", "set", "m")
+	db.ExecCommand("ZADD", "z", "1", "m")
+	db.ExecCommand("XADD", "x", "1-1", "f", "v")
+	rdbFile := filepath.Join(t.TempDir(), "dump.rdb")
+	if err := SaveToFile(db, rdbFile); err != nil {
+		t.Fatalf("Failed to save RDB: %v", err)
+	}
+	data, _ := os.ReadFile(rdbFile)
+
+	report, err := Check(rdbFile)
+	if err != nil {
+		t.Fatalf("Check failed: %v", err)
+	}
+	want := map[string]int{"string": 2, "hash": 1, "list": 1, "set": 1, "zset": 1, "stream": 1}
+	for typ, n := range want {
+		if report.Keys[typ] != n {
+			t.Errorf("Expected %d keys of type %s, got %v", n, typ, report.Keys)
+		}
+	}
+	if report.Size != int64(len(data)) || report.Commands != 0 || report.Expires != 1 {
+		t.Errorf("Expected %d bytes and 1 key with a TTL, got %+v", len(data), report)
+	}
+
+	for _, tc := range []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{"cut before the EOF opcode", data[:len(data)-9], "unexpected end of file before the EOF opcode"},
+		{"cut in a key", data[:len(data)-12], "at offset"},
+		{"cut in the checksum", data[:len(data)-4], "read checksum"},
+		{"trailing bytes", append(bytes.Clone(data), "junk"...), "4 unexpected bytes after the checksum"},
+		{"bad magic", append([]byte("NOPE!"), data[5:]...), "at offset 5: read header: invalid RDB file"},
+		{"unknown opcode", append(bytes.Clone(data[:9]), 200), "at offset 10: unknown opcode: 200"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			corrupted := filepath.Join(t.TempDir(), "dump.rdb")
+			os.WriteFile(corrupted, tc.data, 0600)
+			if _, err := Check(corrupted); err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Errorf("Expected an error containing %q, got %v", tc.want, err)
+			}
+		})
+	}
+}
+
+func TestRDBChecksum(t *testing.T) {
+	// The check value of Redis's CRC-64
+	crc := &crc64Writer{}
+	crc.Write([]byte("123456789"))
+	if crc.sum != 0xe9c6d914c4b8d9ca {
+		t.Fatalf("Expected the CRC-64 of 123456789 to be e9c6d914c4b8d9ca, got %016x", crc.sum)
+	}
+
+	db := database.MakeDB()
+	defer db.Close()
+	db.ExecCommand("SET", "k", "abcdefgh")
+	var buf bytes.Buffer
+	if err := MakeGenerator(db).Generate(&buf); err != nil {
+		t.Fatalf("Generate failed: %v", err)
+	}
+	data := buf.Bytes()
+	crc = &crc64Writer{}
+	crc.Write(data[:len(data)-8])
+	if got := binary.LittleEndian.Uint64(data[len(data)-8:]); got != crc.sum {
+		t.Errorf("Expected the checksum %016x, got %016x", crc.sum, got)
+	}
+
+	// A changed value fails the load, unless the checksum is 0
+	corrupted := bytes.Replace(bytes.Clone(data), []byte("abcdefgh"), []byte("abcdefgX"), 1)
+	loaded := database.MakeDB()
+	defer loaded.Close()
+	if err := LoadFromBytes(loaded, corrupted); err == nil || !strings.Contains(err.Error(), "wrong RDB checksum") {
+		t.Errorf("Expected a checksum error, got %v", err)
+	}
+	copy(corrupted[len(corrupted)-8:], make([]byte, 8))
+	if err := LoadFromBytes(loaded, corrupted); err != nil {
+		t.Fatalf("Expected a file without checksum to load: %v", err)
+	}
+	if result, _ := loaded.ExecCommand("GET", "k"); string(result[0]) != "abcdefgX" {
+		t.Errorf("Expected the value of the file, got %q", result)
+	}
+}
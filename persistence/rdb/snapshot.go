@@ -0,0 +1,64 @@
+package rdb
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/wangbo/gocache/database"
+)
+
+// Snapshot and restore for embedded users
+//
+// Snapshot and Restore move a whole dataset through an io.Writer/io.Reader in
+// the RDB format used by SAVE, without touching the filesystem or
+// config.Config. Write to a bytes.Buffer to keep a snapshot in memory.
+
+// RestoreMode controls how Restore treats keys already in the database
+type RestoreMode int
+
+const (
+	// RestoreReplace removes every existing key before loading the snapshot
+	RestoreReplace RestoreMode = iota
+	// RestoreMerge keeps existing keys; keys in the snapshot overwrite keys
+	// of the same name, including their TTL
+	RestoreMerge
+)
+
+// Snapshot writes every key, its value and its TTL to w in RDB format
+func Snapshot(db *database.DB, w io.Writer) error {
+	if err := MakeGenerator(db).Generate(w); err != nil {
+		return fmt.Errorf("failed to generate snapshot: %w", err)
+	}
+	return nil
+}
+
+// Restore loads a snapshot written by Snapshot (or any RDB dump) into db.
+// Keys whose TTL has passed by the time they are restored are skipped.
+// Restore is not atomic: if the snapshot is malformed, the keys read before
+// the error remain in the database.
+func Restore(db *database.DB, r io.Reader, mode RestoreMode) error {
+	if mode == RestoreReplace {
+		if err := clearDB(db); err != nil {
+			return err
+		}
+	}
+
+	loader := MakeLoader(db)
+	loader.input = r
+	if err := loader.Load(); err != nil {
+		return fmt.Errorf("failed to restore snapshot: %w", err)
+	}
+	return nil
+}
+
+// clearDB removes every key from the database
+func clearDB(db *database.DB) error {
+	keys := db.Keys()
+	if len(keys) == 0 {
+		return nil
+	}
+	if _, err := db.ExecCommand("DEL", keys...); err != nil {
+		return fmt.Errorf("failed to clear database: %w", err)
+	}
+	return nil
+}
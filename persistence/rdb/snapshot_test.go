@@ -0,0 +1,334 @@
+package rdb
+
+import (
+	"bytes"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/wangbo/gocache/database"
+)
+
+// describeDataset returns a canonical description of every key's value,
+// independent of hash and set iteration order
+func describeDataset(db *database.DB) map[string]string {
+	dataset := make(map[string]string)
+	for _, entry := range db.Snapshot() {
+		var parts []string
+		for _, cmd := range database.RebuildCommands(entry.Key, entry.Entity) {
+			name := string(cmd[0])
+			var items []string
+			switch name {
+			case "HMSET", "ZADD":
+				for i := 2; i+1 < len(cmd); i += 2 {
+					items = append(items, string(cmd[i])+"="+string(cmd[i+1]))
+				}
+				sort.Strings(items)
+			case "SADD":
+				for _, member := range cmd[2:] {
+					items = append(items, string(member))
+				}
+				sort.Strings(items)
+			default:
+				for _, arg := range cmd[2:] {
+					items = append(items, string(arg))
+				}
+			}
+			parts = append(parts, name+" "+strings.Join(items, ","))
+		}
+		dataset[entry.Key] = strings.Join(parts, ";")
+	}
+	return dataset
+}
+
+// populateAllTypes fills db with one key of every type plus unicode and
+// binary keys
+func populateAllTypes(db *database.DB) {
+	db.ExecCommand("SET", "str", "value")
+	db.ExecCommand("SET", "ключ-🔑", "значение")
+	db.ExecCommand("SET", "bin\x00\xff\r\n", "\x00\x01\xfe\xff")
+	db.ExecCommand("HMSET", "hash", "f1", "v1", "поле", "\x00")
+	db.ExecCommand("RPUSH", "list", "a", "b", "a", "\xff")
+	db.ExecCommand("SADD", "set", "x", "y", "\x00z")
+	db.ExecCommand("ZADD", "zset", "0.1", "a", "-2.5e-10", "b", "12345.678901234", "c", "+inf", "d")
+}
+
+func TestSnapshotRestoreRoundTrip(t *testing.T) {
+	source := database.MakeDB()
+	defer source.Close()
+
+	populateAllTypes(source)
+	source.ExecCommand("PEXPIRE", "str", "800")
+	source.ExecCommand("PEXPIRE", "hash", "100000")
+
+	var buf bytes.Buffer
+	if err := Snapshot(source, &buf); err != nil {
+		t.Fatalf("Snapshot failed: %v", err)
+	}
+
+	target := database.MakeDB()
+	defer target.Close()
+	if err := Restore(target, bytes.NewReader(buf.Bytes()), RestoreReplace); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+
+	want, got := describeDataset(source), describeDataset(target)
+	if len(want) != 7 {
+		t.Fatalf("Expected 7 source keys, got %v", want)
+	}
+	if len(got) != len(want) {
+		t.Errorf("Expected %d keys, got %d: %v", len(want), len(got), got)
+	}
+	for key, value := range want {
+		if got[key] != value {
+			t.Errorf("Key %q: expected %q, got %q", key, value, got[key])
+		}
+	}
+
+	sourceAt, _ := source.ExpireTime("str")
+	targetAt, ok := target.ExpireTime("str")
+	if diff := targetAt.Sub(sourceAt); !ok || diff < -time.Millisecond || diff > time.Millisecond {
+		t.Errorf("Expected sub-second expiry %v to be kept, got %v", sourceAt, targetAt)
+	}
+	if ttl := target.TTL("hash"); ttl <= 99*time.Second {
+		t.Errorf("Expected hash TTL close to 100s, got %v", ttl)
+	}
+	if ttl := target.TTL("list"); ttl != -1 {
+		t.Errorf("Expected list without TTL, got %v", ttl)
+	}
+
+	// The sub-second TTL still expires on the restored copy
+	time.Sleep(900 * time.Millisecond)
+	if target.Exists("str") {
+		t.Error("Restored key with sub-second TTL should have expired")
+	}
+}
+
+func TestRestoreSkipsKeysExpiredSinceSnapshot(t *testing.T) {
+	source := database.MakeDB()
+	defer source.Close()
+	source.ExecCommand("SET", "short", "v", "PX", "30")
+	source.ExecCommand("SET", "long", "v")
+
+	var buf bytes.Buffer
+	if err := Snapshot(source, &buf); err != nil {
+		t.Fatalf("Snapshot failed: %v", err)
+	}
+	time.Sleep(60 * time.Millisecond)
+
+	target := database.MakeDB()
+	defer target.Close()
+	if err := Restore(target, &buf, RestoreReplace); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	if target.Exists("short") || !target.Exists("long") {
+		t.Errorf("Expected only the unexpired key to be restored, got %v", target.Keys())
+	}
+}
+
+func TestRestoreModes(t *testing.T) {
+	source := database.MakeDB()
+	defer source.Close()
+	populateAllTypes(source)
+
+	var buf bytes.Buffer
+	if err := Snapshot(source, &buf); err != nil {
+		t.Fatalf("Snapshot failed: %v", err)
+	}
+	snapshot := buf.Bytes()
+	want := describeDataset(source)
+
+	// conflicting prepares a target whose keys clash with the snapshot
+	conflicting := func() *database.DB {
+		db := database.MakeDB()
+		db.ExecCommand("SET", "str", "old", "EX", "100")
+		db.ExecCommand("RPUSH", "list", "old1", "old2")
+		db.ExecCommand("HSET", "hash", "stale", "field")
+		db.ExecCommand("SET", "set", "wrong type")
+		db.ExecCommand("SET", "extra", "kept?")
+		return db
+	}
+
+	for _, tc := range []struct {
+		name      string
+		mode      RestoreMode
+		keepExtra bool
+	}{
+		{"replace", RestoreReplace, false},
+		{"merge", RestoreMerge, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			target := conflicting()
+			defer target.Close()
+
+			if err := Restore(target, bytes.NewReader(snapshot), tc.mode); err != nil {
+				t.Fatalf("Restore failed: %v", err)
+			}
+
+			got := describeDataset(target)
+			for key, value := range want {
+				if got[key] != value {
+					t.Errorf("Key %q: expected snapshot value %q, got %q", key, value, got[key])
+				}
+			}
+			if target.Exists("extra") != tc.keepExtra {
+				t.Errorf("Expected extra key kept=%v", tc.keepExtra)
+			}
+			if ttl := target.TTL("str"); ttl != -1 {
+				t.Errorf("Snapshot key should replace the old TTL, got %v", ttl)
+			}
+		})
+	}
+}
+
+func TestSnapshotRestoreKeepsHashFieldTTL(t *testing.T) {
+	source := database.MakeDB()
+	defer source.Close()
+	source.ExecCommand("HMSET", "h", "long", "1", "short", "2", "plain", "3")
+	source.ExecCommand("HEXPIRE", "h", "100", "FIELDS", "1", "long")
+	source.ExecCommand("HPEXPIRE", "h", "50", "FIELDS", "1", "short")
+
+	var buf bytes.Buffer
+	if err := Snapshot(source, &buf); err != nil {
+		t.Fatalf("Snapshot failed: %v", err)
+	}
+
+	target := database.MakeDB()
+	defer target.Close()
+	if err := Restore(target, bytes.NewReader(buf.Bytes()), RestoreReplace); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+
+	for _, field := range []string{"long", "short"} {
+		want, _ := source.HashFieldExpireTime("h", field)
+		got, ok := target.HashFieldExpireTime("h", field)
+		if !ok || got.UnixMilli() != want.UnixMilli() {
+			t.Errorf("Field %s: expected TTL %v, got %v", field, want, got)
+		}
+	}
+	if _, ok := target.HashFieldExpireTime("h", "plain"); ok || !target.HashFieldExists("h", "plain") {
+		t.Error("Field without TTL should be restored without one")
+	}
+
+	time.Sleep(80 * time.Millisecond)
+	if result, _ := target.ExecCommand("HGETALL", "h"); len(result) != 4 {
+		t.Errorf("Restored short field should have expired, got %q", result)
+	}
+}
+
+func TestSnapshotRestoreKeepsStreams(t *testing.T) {
+	source := database.MakeDB()
+	defer source.Close()
+	source.ExecCommand("XADD", "s", "1-1", "a", "1", "b", "2")
+	source.ExecCommand("XADD", "s", "2-0", "c", "")
+	source.ExecCommand("XADD", "empty", "MAXLEN", "0", "9-3", "f", "v")
+	source.ExecCommand("PEXPIRE", "s", "100000")
+
+	var buf bytes.Buffer
+	if err := Snapshot(source, &buf); err != nil {
+		t.Fatalf("Snapshot failed: %v", err)
+	}
+
+	target := database.MakeDB()
+	defer target.Close()
+	if err := Restore(target, bytes.NewReader(buf.Bytes()), RestoreReplace); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+
+	want, _ := source.ExecCommand("XRANGE", "s", "-", "+")
+	got, _ := target.ExecCommand("XRANGE", "s", "-", "+")
+	if len(got) != len(want) {
+		t.Fatalf("Expected entries %q, got %q", want, got)
+	}
+	for i := range want {
+		if !bytes.Equal(got[i], want[i]) {
+			t.Errorf("Item %d: expected %q, got %q", i, want[i], got[i])
+		}
+	}
+	if _, ok := target.ExpireTime("s"); !ok {
+		t.Error("Stream TTL should be restored")
+	}
+	if id, ok := target.StreamLastID("empty"); !ok || id != "9-3" {
+		t.Errorf("Expected the empty stream with last ID 9-3, got %q", id)
+	}
+}
+
+func TestSnapshotRestoreKeepsConsumerGroups(t *testing.T) {
+	source := database.MakeDB()
+	defer source.Close()
+	source.ExecCommand("XADD", "s", "1-1", "f", "v")
+	source.ExecCommand("XADD", "s", "2-0", "f", "v")
+	source.ExecCommand("XGROUP", "CREATE", "s", "g", "0")
+	source.ExecCommand("XGROUP", "CREATECONSUMER", "s", "g", "idle")
+	source.ExecCommand("XREADGROUP", "GROUP", "g", "c", "COUNT", "1", "STREAMS", "s", ">")
+	source.ExecCommand("XCLAIM", "s", "g", "c", "0", "1-1", "RETRYCOUNT", "5")
+	source.ExecCommand("XGROUP", "CREATE", "fresh", "g", "$", "MKSTREAM")
+
+	var buf bytes.Buffer
+	if err := Snapshot(source, &buf); err != nil {
+		t.Fatalf("Snapshot failed: %v", err)
+	}
+	target := database.MakeDB()
+	defer target.Close()
+	if err := Restore(target, bytes.NewReader(buf.Bytes()), RestoreReplace); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+
+	detail, _ := target.ExecCommand("XPENDING", "s", "g", "-", "+", "10")
+	if len(detail) != 4 || string(detail[0]) != "1-1" || string(detail[1]) != "c" || string(detail[3]) != "5" {
+		t.Errorf("Expected 1-1 pending for c with 5 deliveries, got %q", detail)
+	}
+	result, _ := target.ExecCommand("XREADGROUP", "GROUP", "g", "c2", "STREAMS", "s", ">")
+	if len(result) < 3 || string(result[2]) != "2-0" {
+		t.Errorf("The restored group should deliver 2-0 next, got %q", result)
+	}
+	if result, _ := target.ExecCommand("XGROUP", "CREATECONSUMER", "s", "g", "idle"); string(result[0]) != "0" {
+		t.Error("Consumers without pending entries should be restored")
+	}
+	if _, err := target.ExecCommand("XGROUP", "CREATE", "fresh", "g", "0"); err == nil {
+		t.Error("The group of the empty stream should be restored")
+	}
+}
+
+func TestSnapshotRestoreKeepsHyperLogLogs(t *testing.T) {
+	source := database.MakeDB()
+	defer source.Close()
+	source.ExecCommand("PFADD", "sparse", "a", "b", "c")
+	for i := 0; i < 5000; i += 100 {
+		args := []string{"dense"}
+		for j := 0; j < 100; j++ {
+			args = append(args, strconv.Itoa(i+j))
+		}
+		source.ExecCommand("PFADD", args...)
+	}
+
+	var buf bytes.Buffer
+	if err := Snapshot(source, &buf); err != nil {
+		t.Fatalf("Snapshot failed: %v", err)
+	}
+
+	target := database.MakeDB()
+	defer target.Close()
+	if err := Restore(target, bytes.NewReader(buf.Bytes()), RestoreReplace); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+
+	for _, key := range []string{"sparse", "dense"} {
+		want, _ := source.ExecCommand("PFCOUNT", key)
+		got, err := target.ExecCommand("PFCOUNT", key)
+		if err != nil || string(got[0]) != string(want[0]) {
+			t.Errorf("%s: expected PFCOUNT %s, got %q %v", key, want[0], got, err)
+		}
+	}
+}
+
+func TestRestoreMalformedSnapshot(t *testing.T) {
+	db := database.MakeDB()
+	defer db.Close()
+
+	if err := Restore(db, strings.NewReader("not an rdb file"), RestoreMerge); err == nil {
+		t.Error("Expected an error restoring a malformed snapshot")
+	}
+}
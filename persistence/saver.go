@@ -1,9 +1,20 @@
 package persistence
 
 import (
+	"errors"
 	"io"
+	"os"
 )
 
+// FileMode is the permissions of the RDB and AOF files, which may hold
+// sensitive data: readable by the server's user only
+const FileMode os.FileMode = 0600
+
+// ErrUnsupportedDB is returned when loading a file that holds keys of a
+// database other than 0. There is a single keyspace, so loading them would
+// silently merge them into database 0.
+var ErrUnsupportedDB = errors.New("only database 0 is supported")
+
 // DBSaver defines the interface for saving database to disk
 // Using interface{} to avoid circular import
 type DBSaver interface {
@@ -39,3 +50,32 @@ func SaveDatabaseToWriter(db interface{}, writer io.Writer) error {
 	}
 	return saver.SaveDBToWriter(db, writer)
 }
+
+// DBLoader defines the interface for loading a database saved by a DBSaver
+// Using interface{} to avoid circular import
+type DBLoader interface {
+	LoadDBFromReader(db interface{}, reader io.Reader) error
+}
+
+// loader holds the registered loader
+var loader DBLoader
+
+// RegisterLoader registers a database loader implementation
+func RegisterLoader(l DBLoader) {
+	loader = l
+}
+
+// GetLoader returns the registered loader
+func GetLoader() DBLoader {
+	return loader
+}
+
+// LoadDatabaseFromReader loads a database from an io.Reader into db. Unlike
+// saving, loading fails if no loader is registered, since callers replace
+// their data with the result.
+func LoadDatabaseFromReader(db interface{}, reader io.Reader) error {
+	if loader == nil {
+		return errors.New("no database loader registered")
+	}
+	return loader.LoadDBFromReader(db, reader)
+}
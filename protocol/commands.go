@@ -6,10 +6,14 @@ const (
 	CmdSet      = "SET"
 	CmdGet      = "GET"
 	CmdMSet     = "MSET"
+	CmdMSetNX   = "MSETNX"
 	CmdMGet     = "MGET"
 	CmdDel      = "DEL"
+	CmdUnlink   = "UNLINK" // Alias of DEL
 	CmdExists   = "EXISTS"
 	CmdKeys     = "KEYS"
+	CmdScan     = "SCAN"
+	CmdTouch    = "TOUCH"
 	CmdIncr     = "INCR"
 	CmdIncrBy   = "INCRBY"
 	CmdDecr     = "DECR"
@@ -17,6 +21,10 @@ const (
 	CmdStrLen   = "STRLEN"
 	CmdAppend   = "APPEND"
 	CmdGetRange = "GETRANGE"
+	CmdSetRange = "SETRANGE"
+	CmdSetNX    = "SETNX"
+	CmdGetSet   = "GETSET"
+	CmdGetEx    = "GETEX"
 
 	// Hash commands
 	CmdHSet    = "HSET"
@@ -31,6 +39,16 @@ const (
 	CmdHIncrBy = "HINCRBY"
 	CmdHMGet   = "HMGET"
 	CmdHMSet   = "HMSET"
+	CmdHScan   = "HSCAN"
+
+	// Hash field TTL commands
+	CmdHExpire    = "HEXPIRE"
+	CmdHPExpire   = "HPEXPIRE"
+	CmdHExpireAt  = "HEXPIREAT"
+	CmdHPExpireAt = "HPEXPIREAT"
+	CmdHPersist   = "HPERSIST"
+	CmdHTTL       = "HTTL"
+	CmdHPTTL      = "HPTTL"
 
 	// List commands
 	CmdLPush   = "LPUSH"
@@ -44,6 +62,8 @@ const (
 	CmdLRem    = "LREM"
 	CmdLInsert = "LINSERT"
 	CmdLLen    = "LLEN"
+	CmdBLPop   = "BLPOP"
+	CmdBRPop   = "BRPOP"
 
 	// Set commands
 	CmdSAdd        = "SADD"
@@ -60,11 +80,13 @@ const (
 	CmdSInterStore = "SINTERSTORE"
 	CmdSUnion      = "SUNION"
 	CmdSUnionStore = "SUNIONSTORE"
+	CmdSScan       = "SSCAN"
 
 	// Sorted Set commands
 	CmdZAdd          = "ZADD"
 	CmdZRem          = "ZREM"
 	CmdZScore        = "ZSCORE"
+	CmdZMScore       = "ZMSCORE"
 	CmdZIncrBy       = "ZINCRBY"
 	CmdZCard         = "ZCARD"
 	CmdZRank         = "ZRANK"
@@ -73,6 +95,31 @@ const (
 	CmdZRevRange     = "ZREVRANGE"
 	CmdZRangeByScore = "ZRANGEBYSCORE"
 	CmdZCount        = "ZCOUNT"
+	CmdZScan         = "ZSCAN"
+
+	// Stream commands
+	CmdXAdd       = "XADD"
+	CmdXLen       = "XLEN"
+	CmdXRange     = "XRANGE"
+	CmdXRevRange  = "XREVRANGE"
+	CmdXRead      = "XREAD"
+	CmdXGroup     = "XGROUP"
+	CmdXReadGroup = "XREADGROUP"
+	CmdXAck       = "XACK"
+	CmdXPending   = "XPENDING"
+	CmdXClaim     = "XCLAIM"
+	CmdXAutoClaim = "XAUTOCLAIM"
+
+	// HyperLogLog commands
+	CmdPFAdd   = "PFADD"
+	CmdPFCount = "PFCOUNT"
+	CmdPFMerge = "PFMERGE"
+
+	// GEO commands
+	CmdGeoAdd    = "GEOADD"
+	CmdGeoPos    = "GEOPOS"
+	CmdGeoDist   = "GEODIST"
+	CmdGeoSearch = "GEOSEARCH"
 
 	// TTL commands
 	CmdExpire   = "EXPIRE"
@@ -89,86 +136,79 @@ const (
 	CmdDiscard = "DISCARD"
 	CmdWatch   = "WATCH"
 	CmdUnwatch = "UNWATCH"
+	CmdReset   = "RESET"
 
 	// Management commands
-	CmdPing    = "PING"
-	CmdInfo    = "INFO"
-	CmdMemory  = "MEMORY"
-	CmdSave    = "SAVE"
-	CmdBgSave  = "BGSAVE"
-	CmdSlaveOf = "SLAVEOF"
-	CmdSync    = "SYNC"
-	CmdPSync   = "PSYNC"
+	CmdPing        = "PING"
+	CmdInfo        = "INFO"
+	CmdMemory      = "MEMORY"
+	CmdSave        = "SAVE"
+	CmdBgSave      = "BGSAVE"
+	CmdSlaveOf     = "SLAVEOF"
+	CmdReplicaOf   = "REPLICAOF" // Alias of SLAVEOF
+	CmdSync        = "SYNC"
+	CmdPSync       = "PSYNC"
+	CmdBackup      = "BACKUP"
+	CmdDebug       = "DEBUG"
+	CmdClient      = "CLIENT"
+	CmdFailover    = "FAILOVER"
+	CmdHealthCheck = "HEALTHCHECK"
+	CmdCluster     = "CLUSTER"
 
 	// Database commands
 	CmdSelect = "SELECT"
 	CmdType   = "TYPE"
+	CmdObject = "OBJECT"
 	CmdMove   = "MOVE"
+	CmdRename   = "RENAME"
+	CmdRenameNX = "RENAMENX"
+	CmdCopy     = "COPY"
+	CmdMigrate = "MIGRATE"
+	CmdDBSize   = "DBSIZE"
+	CmdFlushDB  = "FLUSHDB"
+	CmdFlushAll = "FLUSHALL"
 	CmdAuth    = "AUTH"
 	CmdSlowLog = "SLOWLOG"
 	CmdMonitor = "MONITOR"
+	CmdLatency = "LATENCY"
+	CmdConfig  = "CONFIG"
 )
 
-// WriteCommands is a map of write commands (commands that modify data)
-var WriteCommands = map[string]bool{
-	// String commands
-	CmdSet:      true,
-	CmdMSet:     true,
-	CmdDel:      true,
-	CmdIncr:     true,
-	CmdIncrBy:   true,
-	CmdDecr:     true,
-	CmdDecrBy:   true,
-	CmdAppend:   true,
-	CmdGetRange: true,
-
-	// Hash commands
-	CmdHSet:    true,
-	CmdHMSet:   true,
-	CmdHSetNX:  true,
-	CmdHDel:    true,
-	CmdHIncrBy: true,
-
-	// List commands
-	CmdLPush:   true,
-	CmdRPush:   true,
-	CmdLPop:    true,
-	CmdRPop:    true,
-	CmdLSet:    true,
-	CmdLTrim:   true,
-	CmdLRem:    true,
-	CmdLInsert: true,
-
-	// Set commands
-	CmdSAdd:  true,
-	CmdSRem:  true,
-	CmdSPop:  true,
-	CmdSMove: true,
-
-	// Sorted Set commands
-	CmdZAdd:    true,
-	CmdZRem:    true,
-	CmdZIncrBy: true,
-
-	// TTL commands
-	CmdExpire:  true,
-	CmdPExpire: true,
-	CmdPersist: true,
-}
+// WriteCommands maps command names to whether they modify data.
+//
+// Deprecated: write commands are declared where they are registered in
+// package database, which fills in this map at init; use
+// database.IsWriteCommand instead.
+var WriteCommands = map[string]bool{}
+
+// Reply shapes
+//
+// Every command the database dispatches belongs to exactly one of the maps
+// below: StatusCommands, IntegerCommands, BulkCommands, ArrayCommands,
+// IntegerArrayCommands, StreamCommands, GeoCommands or SpecialCommands.
+// Commands returning a typed Result carry their reply type with it, but are
+// listed too, so that every command has its shape declared in one place (a
+// test in package database checks this for database.SupportedCommands).
 
 // IntegerCommands is a map of commands that return integer results
 var IntegerCommands = map[string]bool{
 	// String commands
+	CmdMSetNX:  true,
 	CmdDel:     true,
+	CmdUnlink:  true,
 	CmdExists:  true,
+	CmdTouch:   true,
 	CmdIncr:    true,
 	CmdIncrBy:  true,
 	CmdDecr:    true,
 	CmdDecrBy:  true,
 	CmdStrLen:  true,
 	CmdAppend:  true,
+	CmdSetRange: true,
+	CmdSetNX:    true,
 
 	// Hash commands
+	CmdHSet:    true,
 	CmdHDel:    true,
 	CmdHExists: true,
 	CmdHLen:    true,
@@ -178,8 +218,6 @@ var IntegerCommands = map[string]bool{
 	// List commands
 	CmdLPush:   true,
 	CmdRPush:   true,
-	CmdLPop:    true,
-	CmdRPop:    true,
 	CmdLLen:    true,
 	CmdLInsert: true,
 	CmdLRem:    true,
@@ -195,20 +233,54 @@ var IntegerCommands = map[string]bool{
 	CmdSUnionStore: true,
 
 	// Sorted Set commands
-	CmdZAdd:    true,
 	CmdZRem:    true,
 	CmdZCard:   true,
 	CmdZCount:  true,
 	CmdZRank:   true,
 	CmdZRevRank: true,
-	CmdZIncrBy: true,
+
+	// Stream commands
+	CmdXLen: true,
+	CmdXAck: true,
+
+	// HyperLogLog commands
+	CmdPFAdd:   true,
+	CmdPFCount: true,
+
+	// GEO commands
+	CmdGeoAdd: true,
 
 	// TTL commands
-	CmdExpire:  true,
-	CmdPExpire: true,
-	CmdPersist: true,
-	CmdTTL:     true,
-	CmdPTTL:    true,
+	CmdExpire:    true,
+	CmdPExpire:   true,
+	CmdExpireAt:  true,
+	CmdPExpireAt: true,
+	CmdPersist:   true,
+	CmdTTL:       true,
+	CmdPTTL:      true,
+
+	// Database commands
+	CmdDBSize:   true,
+	CmdMove:     true,
+	CmdRenameNX: true,
+	CmdCopy:     true,
+}
+
+// BulkCommands is a map of commands that return a bulk string, or null
+var BulkCommands = map[string]bool{
+	CmdGet:      true,
+	CmdGetRange: true,
+	CmdGetSet:   true,
+	CmdGetEx:    true,
+	CmdHGet:     true,
+	CmdLIndex:   true,
+	CmdLPop:     true,
+	CmdRPop:     true,
+	CmdZScore:   true,
+	CmdZIncrBy:  true,
+	CmdXAdd:     true,
+	CmdGeoDist:  true,
+	CmdInfo:     true,
 }
 
 // ArrayCommands is a map of commands that always return array replies (even with 1 element)
@@ -221,6 +293,8 @@ var ArrayCommands = map[string]bool{
 
 	// List commands
 	CmdLRange: true,
+	CmdBLPop:  true,
+	CmdBRPop:  true,
 
 	// Set commands
 	CmdSMembers:  true,
@@ -232,29 +306,105 @@ var ArrayCommands = map[string]bool{
 	CmdZRange:        true,
 	CmdZRevRange:     true,
 	CmdZRangeByScore: true,
+	CmdZMScore:       true,
 
 	// String commands
 	CmdKeys: true,
 	CmdMGet: true,
+
+	// CONFIG GET and HELP; CONFIG SET replies with a status
+	CmdConfig: true,
+}
+
+// IntegerArrayCommands is a map of commands that return an array of integers
+var IntegerArrayCommands = map[string]bool{
+	CmdHExpire:    true,
+	CmdHPExpire:   true,
+	CmdHExpireAt:  true,
+	CmdHPExpireAt: true,
+	CmdHPersist:   true,
+	CmdHTTL:       true,
+	CmdHPTTL:      true,
+}
+
+// StreamCommands is a map of commands that return stream entries or other
+// nested replies, which are decoded from their flattened results (see
+// database/stream.go and database/stream_group.go for the layouts)
+var StreamCommands = map[string]bool{
+	CmdXRange:     true,
+	CmdXRevRange:  true,
+	CmdXRead:      true,
+	CmdXGroup:     true,
+	CmdXReadGroup: true,
+	CmdXPending:   true,
+	CmdXClaim:     true,
+	CmdXAutoClaim: true,
+}
+
+// GeoCommands is a map of GEO commands that return nested arrays, which are
+// decoded from their flattened results (see database/geo.go for the layouts)
+var GeoCommands = map[string]bool{
+	CmdGeoPos:    true,
+	CmdGeoSearch: true,
 }
 
 // StatusCommands is a map of commands that return status "OK" response
 var StatusCommands = map[string]bool{
-	CmdSet:     true,
-	CmdMSet:    true,
-	CmdHMSet:   true,
-	CmdLSet:    true,
-	CmdLTrim:   true,
-	CmdMulti:   true,
-	CmdDiscard: true,
-	CmdWatch:   true,
-	CmdUnwatch: true,
-	CmdSave:    true,
-	CmdBgSave:  true,
-	CmdSlaveOf: true,
+	CmdMSet:      true,
+	CmdHMSet:     true,
+	CmdLSet:      true,
+	CmdLTrim:     true,
+	CmdMulti:     true,
+	CmdDiscard:   true,
+	CmdWatch:     true,
+	CmdUnwatch:   true,
+	CmdReset:     true,
+	CmdSave:      true,
+	CmdBgSave:    true,
+	CmdSlaveOf:   true,
+	CmdReplicaOf: true,
+	CmdClient:    true,
+	CmdMigrate:   true,
+	CmdRename:    true,
+	CmdPFMerge:   true,
+
+	CmdAuth:        true,
+	CmdSelect:      true,
+	CmdType:        true,
+	CmdFlushDB:     true,
+	CmdFlushAll:    true,
+	CmdFailover:    true,
+	CmdHealthCheck: true,
+}
+
+// SpecialCommands is a map of commands whose reply the server builds itself,
+// or whose reply type depends on their arguments
+var SpecialCommands = map[string]bool{
+	CmdPing:        true,
+	CmdExec:        true,
+	CmdMonitor:     true,
+	CmdSync:        true,
+	CmdPSync:       true,
+	CmdBackup:      true,
+	CmdLatency:     true,
+	CmdSlowLog:     true,
+	CmdDebug:       true,
+	CmdMemory:      true,
+	CmdObject:      true,
+	CmdSet:         true, // The old value with GET, null if NX or XX fails
+	CmdZAdd:        true, // A score with INCR
+	CmdSPop:        true, // An array with a count
+	CmdSRandMember: true,
+	CmdScan:        true,
+	CmdHScan:       true,
+	CmdSScan:       true,
+	CmdZScan:       true,
+	CmdCluster:     true,
 }
 
 // IsWriteCommand checks if a command is a write command (case-insensitive)
+//
+// Deprecated: use database.IsWriteCommand.
 func IsWriteCommand(cmd string) bool {
 	return WriteCommands[ToUpper(cmd)]
 }
@@ -269,6 +419,21 @@ func IsArrayCommand(cmd string) bool {
 	return ArrayCommands[ToUpper(cmd)]
 }
 
+// IsStreamCommand checks if a command returns stream entries (case-insensitive)
+func IsStreamCommand(cmd string) bool {
+	return StreamCommands[ToUpper(cmd)]
+}
+
+// IsGeoCommand checks if a command returns nested GEO arrays (case-insensitive)
+func IsGeoCommand(cmd string) bool {
+	return GeoCommands[ToUpper(cmd)]
+}
+
+// IsIntegerArrayCommand checks if a command returns an array of integers (case-insensitive)
+func IsIntegerArrayCommand(cmd string) bool {
+	return IntegerArrayCommands[ToUpper(cmd)]
+}
+
 // IsStatusCommand checks if a command returns a status "OK" response (case-insensitive)
 func IsStatusCommand(cmd string) bool {
 	return StatusCommands[ToUpper(cmd)]
@@ -281,6 +446,15 @@ func ToUpper(s string) string {
 		return s
 	}
 
+	// A name already in upper case, as clients send them, is returned as is
+	lower := false
+	for i := 0; i < len(s) && !lower; i++ {
+		lower = s[i] >= 'a' && s[i] <= 'z'
+	}
+	if !lower {
+		return s
+	}
+
 	// Simple ASCII-only toUpper (faster than strings.ToUpper for our use case)
 	result := make([]byte, len(s))
 	for i := 0; i < len(s); i++ {
@@ -6,6 +6,8 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"math"
+	"slices"
 	"strconv"
 )
 
@@ -21,31 +23,99 @@ const (
 var (
 	ErrInvalidSyntax = errors.New("resp: invalid syntax")
 	ErrInvalidFormat = errors.New("resp: invalid format")
+
+	// ErrProtocol is wrapped by the errors of requests exceeding the limits
+	// of the parser. The rest of the stream cannot be parsed: the connection
+	// must be closed.
+	ErrProtocol               = errors.New("Protocol error")
+	ErrInvalidMultiBulkLength = fmt.Errorf("%w: invalid multibulk length", ErrProtocol)
+	ErrInvalidBulkLength      = fmt.Errorf("%w: invalid bulk length", ErrProtocol)
+	ErrInlineTooBig           = fmt.Errorf("%w: too big inline request", ErrProtocol)
+)
+
+const (
+	// DefaultMaxMultiBulkLen is the default maximum number of arguments of
+	// a command (proto-max-multibulk-len)
+	DefaultMaxMultiBulkLen = 1024 * 1024
+	// DefaultMaxBulkLen is the default maximum length of an argument
+	// (proto-max-bulk-len)
+	DefaultMaxBulkLen = 512 << 20
+
+	// maxInlineLen is the maximum length of a line: an inline command or
+	// the header of an array or bulk string
+	maxInlineLen = 64 << 10
+	// bulkChunk is how much of a bulk string is allocated ahead of the data
+	// actually received
+	bulkChunk = 64 << 10
+	// argsChunk is how many arguments are allocated ahead of the arguments
+	// actually received, and the most a Parser keeps for reuse
+	argsChunk = 1024
 )
 
-// Parser represents a RESP parser
+// Parser represents a RESP parser. It buffers the stream it reads, so that
+// pipelined commands read ahead with one command are parsed by the next call.
+//
+// The slice of arguments a Parser returns is reused by its next call, so
+// that a connection does not allocate one per command: code keeping a
+// command past the next call, like MULTI queueing it, must copy the slice.
+// The arguments themselves are allocated for each command and may be kept,
+// as SET keeps its value. The AOF and replication encode the command they
+// are fed before the next one is parsed.
 type Parser struct {
 	*bufio.Reader
+	src    io.Reader // Stream buffered by Reader
+	limits limits
+	args   [][]byte // Returned by the last call, reused by the next
 }
 
-// MakeParser creates a new RESP parser
+// limits bounds the size of a command; 0 means no limit
+type limits struct {
+	maxMultiBulkLen int
+	maxBulkLen      int64
+}
+
+var defaultLimits = limits{DefaultMaxMultiBulkLen, DefaultMaxBulkLen}
+
+// MakeParser creates a new RESP parser with the default limits
 func MakeParser() *Parser {
-	return &Parser{}
+	return &Parser{limits: defaultLimits}
 }
 
-// ParseStream reads and parses one RESP command from reader using the parser
+// MakeParserWithLimits creates a new RESP parser accepting commands of at
+// most maxMultiBulkLen arguments of at most maxBulkLen bytes each. A limit
+// of 0 or less disables the check.
+func MakeParserWithLimits(maxMultiBulkLen int, maxBulkLen int64) *Parser {
+	return &Parser{limits: limits{maxMultiBulkLen, maxBulkLen}}
+}
+
+// ParseStream reads and parses one RESP command from reader using the parser.
+// Successive calls must pass the same reader to keep the data read ahead.
 func (p *Parser) ParseStream(reader io.Reader) ([][]byte, error) {
-	return ParseStream(reader)
+	if p.Reader == nil || p.src != reader {
+		p.Reader = bufio.NewReader(reader)
+		p.src = reader
+	}
+	args, err := p.limits.parseStream(p.Reader, p.args[:0])
+	// A command of many arguments does not pin its slice for the life of
+	// the connection
+	if cap(args) <= argsChunk {
+		p.args = args
+	}
+	return args, err
 }
 
-// ParseStream reads and parses one RESP command from reader
+// ParseStream reads and parses one RESP command from reader with the default
+// limits. Data read past the command is lost; use a Parser to read a stream
+// of commands.
 func ParseStream(reader io.Reader) ([][]byte, error) {
-	// For now, we'll implement a simpler version that reads line by line
-	// A full implementation would handle bulk strings and arrays properly
-	bufReader := bufio.NewReader(reader)
+	return defaultLimits.parseStream(bufio.NewReader(reader), nil)
+}
 
+// parseStream reads and parses one RESP command from bufReader, appending
+// its arguments to args
+func (l limits) parseStream(bufReader *bufio.Reader, args [][]byte) ([][]byte, error) {
 	// Read first character to determine type
-	line, err := bufReader.ReadString('\n')
+	line, err := readLine(bufReader)
 	if err != nil {
 		return nil, err
 	}
@@ -60,42 +130,52 @@ func ParseStream(reader io.Reader) ([][]byte, error) {
 	switch line[0] {
 	case Array:
 		// Array: *2\r\n$3\r\nGET\r\n$3\r\nkey\r\n
-		count, err := strconv.Atoi(line[1:])
+		count, err := strconv.Atoi(string(line[1:]))
 		if err != nil {
 			return nil, ErrInvalidFormat
 		}
-		return parseArray(bufReader, count)
+		return l.parseArray(bufReader, count, args)
 	case BulkString:
 		// Bulk string: $6\r\nfoobar\r\n
-		size, err := strconv.Atoi(line[1:])
+		size, err := l.bulkSize(line)
 		if err != nil {
-			return nil, ErrInvalidFormat
+			return nil, err
 		}
-		data, err := parseBulkString(bufReader, size)
+		data, err := ReadBulk(bufReader, size)
 		if err != nil {
 			return nil, err
 		}
-		return [][]byte{data}, nil
+		return append(args, data), nil
 	case SimpleString, Error, Integer:
 		// Simple types: +OK\r\n, -Error\r\n, :123\r\n
-		return [][]byte{[]byte(line[1:])}, nil
+		return append(args, bytes.Clone(line[1:])), nil
 	default:
 		// Treat as inline command (simple string without prefix)
-		return splitArgs(line), nil
+		inline, err := splitArgs(string(line))
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v in request", ErrProtocol, err)
+		}
+		return append(args, inline...), nil
 	}
 }
 
-// parseArray parses RESP array
-func parseArray(reader *bufio.Reader, count int) ([][]byte, error) {
+// parseArray parses RESP array, appending its elements to args
+func (l limits) parseArray(reader *bufio.Reader, count int, args [][]byte) ([][]byte, error) {
 	if count < 0 {
 		return nil, ErrInvalidFormat
 	}
+	if l.maxMultiBulkLen > 0 && count > l.maxMultiBulkLen {
+		return nil, ErrInvalidMultiBulkLength
+	}
 
-	args := make([][]byte, 0, count)
+	// The slice grows with the arguments received, not with the header
+	if args == nil {
+		args = make([][]byte, 0, min(count, argsChunk))
+	}
 
 	for i := 0; i < count; i++ {
 		// Read the bulk string header ($size\r\n)
-		line, err := reader.ReadString('\n')
+		line, err := readLine(reader)
 		if err != nil {
 			return nil, err
 		}
@@ -108,13 +188,13 @@ func parseArray(reader *bufio.Reader, count int) ([][]byte, error) {
 			return nil, fmt.Errorf("resp: expected bulk string, got %c", line[0])
 		}
 
-		size, err := strconv.Atoi(line[1:])
+		size, err := l.bulkSize(line)
 		if err != nil {
-			return nil, ErrInvalidFormat
+			return nil, err
 		}
 
 		// Read the bulk string data
-		data, err := parseBulkString(reader, size)
+		data, err := ReadBulk(reader, size)
 		if err != nil {
 			return nil, err
 		}
@@ -125,22 +205,67 @@ func parseArray(reader *bufio.Reader, count int) ([][]byte, error) {
 	return args, nil
 }
 
-// parseBulkString parses RESP bulk string
-func parseBulkString(reader *bufio.Reader, size int) ([]byte, error) {
+// bulkSize parses the size of a bulk string from its header ($size)
+func (l limits) bulkSize(header []byte) (int, error) {
+	size, err := strconv.Atoi(string(header[1:]))
+	if err != nil {
+		return 0, ErrInvalidFormat
+	}
+	if l.maxBulkLen > 0 && int64(size) > l.maxBulkLen {
+		return 0, ErrInvalidBulkLength
+	}
+	return size, nil
+}
+
+// readLine reads a line up to and including \n, of at most maxInlineLen
+// bytes. A line that fits the reader's buffer is returned in it, and is only
+// valid until the next read.
+func readLine(reader *bufio.Reader) ([]byte, error) {
+	var buf []byte
+	for {
+		chunk, err := reader.ReadSlice('\n')
+		if len(buf)+len(chunk) > maxInlineLen {
+			return nil, ErrInlineTooBig
+		}
+		if err == nil && buf == nil {
+			return chunk, nil
+		}
+		buf = append(buf, chunk...)
+		if err == nil {
+			return buf, nil
+		}
+		if err != bufio.ErrBufferFull {
+			return nil, err
+		}
+	}
+}
+
+// ReadBulk reads the data of a bulk string of size bytes and its trailing
+// \r\n, whose header was already read; a negative size is a null bulk
+// string. Memory is allocated as the data arrives, so a large size announced
+// by a client that sends nothing costs nothing.
+func ReadBulk(reader *bufio.Reader, size int) ([]byte, error) {
 	if size < 0 {
 		// Null bulk string ($-1\r\n)
 		// We already read the size line in the caller, so just return nil
 		return nil, nil
 	}
-
-	// Read the data
-	data := make([]byte, size+2) // +2 for \r\n
-	n, err := io.ReadFull(reader, data)
-	if err != nil {
-		return nil, err
+	if size > math.MaxInt-2 {
+		return nil, ErrInvalidBulkLength
 	}
-	if n != len(data) {
-		return nil, io.ErrUnexpectedEOF
+
+	// Read the data, followed by \r\n
+	total := size + 2
+	data := make([]byte, 0, min(total, bulkChunk))
+	for len(data) < total {
+		n := min(total-len(data), bulkChunk)
+		data = slices.Grow(data, n)[:len(data)+n]
+		if _, err := io.ReadFull(reader, data[len(data)-n:]); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
 	}
 
 	// Verify \r\n
@@ -151,19 +276,169 @@ func parseBulkString(reader *bufio.Reader, size int) ([]byte, error) {
 	return data[:size], nil
 }
 
-// ParseLine parses a single line command (simple format without RESP markers)
+// ReadReply reads one reply from reader, as a client does: a status, error,
+// integer or bulk string reply, or an array of any of them. A null bulk
+// string is a BulkReply with a nil Arg, and a null array a MultiBulkReply
+// with nil Args, so that ToBytes gives back what was read.
+func ReadReply(reader *bufio.Reader) (Reply, error) {
+	line, err := readLine(reader)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, ErrInvalidSyntax
+	}
+	body := string(line[1 : len(line)-2])
+
+	switch line[0] {
+	case SimpleString:
+		return MakeStatusReply(body), nil
+	case Error:
+		return MakeErrReply(body), nil
+	case Integer:
+		n, err := strconv.ParseInt(body, 10, 64)
+		if err != nil {
+			return nil, ErrInvalidFormat
+		}
+		return MakeIntReply(n), nil
+	case BulkString:
+		size, err := strconv.Atoi(body)
+		if err != nil {
+			return nil, ErrInvalidFormat
+		}
+		if size < 0 {
+			return MakeNullBulkReply(), nil
+		}
+		data, err := ReadBulk(reader, size)
+		if err != nil {
+			return nil, err
+		}
+		return MakeBulkReply(data), nil
+	case Array:
+		count, err := strconv.Atoi(body)
+		if err != nil {
+			return nil, ErrInvalidFormat
+		}
+		if count < 0 {
+			return MakeNullMultiBulkReply(), nil
+		}
+		replies := make([]Reply, 0, min(count, argsChunk))
+		for i := 0; i < count; i++ {
+			reply, err := ReadReply(reader)
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			if err != nil {
+				return nil, err
+			}
+			replies = append(replies, reply)
+		}
+		return MakeArrayReply(replies), nil
+	default:
+		return nil, fmt.Errorf("%w: unexpected reply type %q", ErrInvalidSyntax, line[0])
+	}
+}
+
+// ParseLine parses a single line command, split into arguments as an inline
+// command is (see splitArgs)
 func ParseLine(line string) ([][]byte, error) {
-	// Split by spaces
-	args := splitArgs(line)
+	args, err := splitArgs(line)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidSyntax, err)
+	}
 	if len(args) == 0 {
 		return nil, ErrInvalidSyntax
 	}
 	return args, nil
 }
 
-// splitArgs splits a command line into arguments
-func splitArgs(line string) [][]byte {
-	// Simple implementation - split by spaces
-	// TODO: Handle quoted strings properly
-	return bytes.Fields([]byte(line))
+// splitArgs splits a command line into arguments as Redis does: arguments
+// are separated by spaces, and may be quoted. Within double quotes, \n, \r,
+// \t, \b, \a, \xHH, \\ and \" are unescaped; within single quotes only \'.
+// A closing quote must be followed by a space or the end of the line.
+func splitArgs(line string) ([][]byte, error) {
+	var args [][]byte
+	i := 0
+	for {
+		for i < len(line) && isSpace(line[i]) {
+			i++
+		}
+		if i >= len(line) {
+			return args, nil
+		}
+
+		var arg []byte
+		switch quote := line[i]; quote {
+		case '"', '\'':
+			i++
+			for {
+				if i >= len(line) {
+					return nil, errors.New("unbalanced quotes")
+				}
+				c := line[i]
+				if c == quote {
+					i++
+					break
+				}
+				if c == '\\' && i+1 < len(line) {
+					if quote == '\'' && line[i+1] == '\'' {
+						arg = append(arg, '\'')
+						i += 2
+						continue
+					}
+					if n, decoded, ok := unescape(line[i+1:]); quote == '"' && ok {
+						arg = append(arg, decoded)
+						i += 1 + n
+						continue
+					}
+				}
+				arg = append(arg, c)
+				i++
+			}
+			if i < len(line) && !isSpace(line[i]) {
+				return nil, errors.New("closing quote must be followed by a space")
+			}
+			// An empty quoted argument is an argument
+			if arg == nil {
+				arg = []byte{}
+			}
+		default:
+			start := i
+			for i < len(line) && !isSpace(line[i]) {
+				i++
+			}
+			arg = []byte(line[start:i])
+		}
+		args = append(args, arg)
+	}
+}
+
+// unescape decodes the escape sequence at the start of s, after the
+// backslash, and returns the number of bytes consumed
+func unescape(s string) (int, byte, bool) {
+	switch s[0] {
+	case 'n':
+		return 1, '\n', true
+	case 'r':
+		return 1, '\r', true
+	case 't':
+		return 1, '\t', true
+	case 'b':
+		return 1, '\b', true
+	case 'a':
+		return 1, '\a', true
+	case '\\', '"':
+		return 1, s[0], true
+	case 'x':
+		if len(s) >= 3 {
+			if v, err := strconv.ParseUint(s[1:3], 16, 8); err == nil {
+				return 3, byte(v), true
+			}
+		}
+	}
+	return 0, 0, false
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\r' || c == '\n'
 }
@@ -1,8 +1,12 @@
 package resp
 
 import (
+	"bufio"
 	"bytes"
+	"errors"
 	"io"
+	"runtime"
+	"strings"
 	"testing"
 )
 
@@ -276,6 +280,81 @@ func TestParseLine(t *testing.T) {
 			t.Errorf("Expected ErrInvalidSyntax, got %v", err)
 		}
 	})
+
+	t.Run("quoted arguments", func(t *testing.T) {
+		for _, tc := range []struct {
+			line string
+			want []string
+		}{
+			{`SET key "hello world"`, []string{"SET", "key", "hello world"}},
+			{`SET key 'it\'s'`, []string{"SET", "key", "it's"}},
+			{`SET key "a\tb\n\x41\"\\"`, []string{"SET", "key", "a\tb\nA\"\\"}},
+			{`SET key '\n'`, []string{"SET", "key", `\n`}},
+			{`SET key ""`, []string{"SET", "key", ""}},
+		} {
+			args, err := ParseLine(tc.line)
+			if err != nil {
+				t.Fatalf("ParseLine(%q) failed: %v", tc.line, err)
+			}
+			got := make([]string, len(args))
+			for i, arg := range args {
+				got[i] = string(arg)
+			}
+			if strings.Join(got, "|") != strings.Join(tc.want, "|") {
+				t.Errorf("ParseLine(%q): expected %q, got %q", tc.line, tc.want, got)
+			}
+		}
+		for _, line := range []string{`SET key "unbalanced`, `SET key "a"b`, `GET 'k`} {
+			if _, err := ParseLine(line); !errors.Is(err, ErrInvalidSyntax) {
+				t.Errorf("ParseLine(%q): expected ErrInvalidSyntax, got %v", line, err)
+			}
+		}
+	})
+
+	t.Run("unbalanced quotes in an inline command", func(t *testing.T) {
+		_, err := ParseStream(strings.NewReader("SET key \"value\r\n"))
+		if !errors.Is(err, ErrProtocol) {
+			t.Errorf("Expected a protocol error, got %v", err)
+		}
+	})
+}
+
+func TestReadReply(t *testing.T) {
+	for _, input := range []string{
+		"+OK\r\n",
+		"-ERR wrong\r\n",
+		":-42\r\n",
+		"$5\r\nhello\r\n",
+		"$0\r\n\r\n",
+		"$-1\r\n",
+		"*-1\r\n",
+		"*0\r\n",
+		"*3\r\n$1\r\na\r\n$-1\r\n*2\r\n:1\r\n+two\r\n",
+	} {
+		reader := bufio.NewReader(strings.NewReader(input + "+next\r\n"))
+		reply, err := ReadReply(reader)
+		if err != nil {
+			t.Fatalf("ReadReply(%q) failed: %v", input, err)
+		}
+		if got := string(reply.ToBytes()); got != input {
+			t.Errorf("ReadReply(%q): expected the same bytes back, got %q", input, got)
+		}
+		// The next reply is left in the reader
+		if next, err := ReadReply(reader); err != nil || string(next.ToBytes()) != "+next\r\n" {
+			t.Errorf("ReadReply(%q): expected the next reply to follow, got %v, %v", input, next, err)
+		}
+	}
+
+	for _, input := range []string{"*2\r\n:1\r\n", "$5\r\nhel"} {
+		if _, err := ReadReply(bufio.NewReader(strings.NewReader(input))); err != io.ErrUnexpectedEOF {
+			t.Errorf("ReadReply(%q): expected io.ErrUnexpectedEOF, got %v", input, err)
+		}
+	}
+	for _, input := range []string{":abc\r\n", "?1\r\n", "+OK\n"} {
+		if _, err := ReadReply(bufio.NewReader(strings.NewReader(input))); err == nil {
+			t.Errorf("ReadReply(%q): expected an error", input)
+		}
+	}
 }
 
 func TestParseErrors(t *testing.T) {
@@ -312,3 +391,133 @@ func TestParseErrors(t *testing.T) {
 		// Can be ErrInvalidSyntax or io.ErrUnexpectedEOF
 	})
 }
+
+func TestParserReadsPipelinedCommands(t *testing.T) {
+	input := "*1\r\n$4\r\nPING\r\n*2\r\n$3\r\nGET\r\n$1\r\nk\r\nPING\r\n"
+	reader := bytes.NewReader([]byte(input))
+	parser := MakeParser()
+
+	for _, want := range []string{"PING", "GET k", "PING"} {
+		args, err := parser.ParseStream(reader)
+		if err != nil {
+			t.Fatalf("%s: ParseStream failed: %v", want, err)
+		}
+		if got := string(bytes.Join(args, []byte(" "))); got != want {
+			t.Errorf("Expected %q, got %q", want, got)
+		}
+	}
+	if _, err := parser.ParseStream(reader); err != io.EOF {
+		t.Errorf("Expected io.EOF after the last command, got %v", err)
+	}
+}
+
+func TestParserReusesArgsSlice(t *testing.T) {
+	reader := bytes.NewReader([]byte("*2\r\n$3\r\nGET\r\n$1\r\na\r\n*2\r\n$3\r\nGET\r\n$1\r\nb\r\n"))
+	parser := MakeParser()
+
+	first, err := parser.ParseStream(reader)
+	if err != nil {
+		t.Fatalf("ParseStream failed: %v", err)
+	}
+	key := first[1]
+	second, err := parser.ParseStream(reader)
+	if err != nil {
+		t.Fatalf("ParseStream failed: %v", err)
+	}
+	if &first[0] != &second[0] {
+		t.Error("Expected the next command to reuse the args slice")
+	}
+	// The arguments themselves belong to the caller
+	if string(key) != "a" || string(second[1]) != "b" {
+		t.Errorf("Expected the first key to survive the next command, got %q and %q", key, second[1])
+	}
+}
+
+func TestParserLimits(t *testing.T) {
+	parser := func() *Parser { return MakeParserWithLimits(2, 8) }
+
+	for _, tc := range []struct {
+		name  string
+		input string
+		want  error
+	}{
+		{"too many arguments", "*3\r\n$1\r\na\r\n$1\r\nb\r\n$1\r\nc\r\n", ErrInvalidMultiBulkLength},
+		{"huge array header", "*1000000000\r\n", ErrInvalidMultiBulkLength},
+		{"argument too long", "*1\r\n$9\r\n123456789\r\n", ErrInvalidBulkLength},
+		{"bulk string too long", "$9\r\n123456789\r\n", ErrInvalidBulkLength},
+		{"inline too long", strings.Repeat("a", 100<<10) + "\r\n", ErrInlineTooBig},
+		{"header too long", "*" + strings.Repeat("1", 100<<10), ErrInlineTooBig},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := parser().ParseStream(strings.NewReader(tc.input))
+			if !errors.Is(err, tc.want) {
+				t.Errorf("Expected %v, got %v", tc.want, err)
+			}
+			if !errors.Is(err, ErrProtocol) {
+				t.Errorf("Expected a protocol error, got %v", err)
+			}
+		})
+	}
+
+	// Commands within the limits parse
+	args, err := parser().ParseStream(strings.NewReader("*2\r\n$3\r\nGET\r\n$8\r\n12345678\r\n"))
+	if err != nil || len(args) != 2 || string(args[1]) != "12345678" {
+		t.Errorf("Expected GET 12345678, got %q, %v", args, err)
+	}
+}
+
+func TestParserAllocatesAsDataArrives(t *testing.T) {
+	// Headers announcing more than is sent must not be allocated up front
+	for _, input := range []string{
+		"*1048576\r\n$1\r\na\r\n",
+		"*1\r\n$536870912\r\nabc",
+	} {
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		_, err := ParseStream(strings.NewReader(input))
+		runtime.ReadMemStats(&after)
+
+		if err == nil {
+			t.Errorf("%q: expected an error for truncated input", input)
+		}
+		if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 1<<20 {
+			t.Errorf("%q: allocated %d bytes", input, allocated)
+		}
+	}
+}
+
+func FuzzParseStream(f *testing.F) {
+	for _, seed := range []string{
+		"*2\r\n$3\r\nGET\r\n$3\r\nkey\r\n",
+		"PING\r\n",
+		"$5\r\nhello\r\n",
+		"*1000000000\r\n",
+		"*1\r\n$1000000000\r\n",
+		"*9223372036854775807\r\n",
+		"$9223372036854775807\r\n",
+		"*1\r\n$-5\r\n",
+		"*-1\r\n",
+		"*2\r\n$1\r\na",
+	} {
+		f.Add([]byte(seed))
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		// Limits bound the memory the parser may use; without them only the
+		// data actually received is allocated
+		limited := MakeParserWithLimits(1024, 1<<20)
+		unlimited := MakeParserWithLimits(0, 0)
+		for _, p := range []*Parser{limited, unlimited} {
+			r := bytes.NewReader(data)
+			for i := 0; i < 16; i++ {
+				args, err := p.ParseStream(r)
+				if err != nil {
+					break
+				}
+				if p == limited && len(args) > 1024 {
+					t.Fatalf("Parsed %d arguments, over the limit", len(args))
+				}
+			}
+		}
+	})
+}
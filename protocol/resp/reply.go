@@ -2,6 +2,7 @@ package resp
 
 import (
 	"bytes"
+	"io"
 	"strconv"
 )
 
@@ -13,16 +14,67 @@ type Reply interface {
 // StatusReply represents a simple string reply (+OK\r\n)
 type StatusReply struct {
 	Status string
+
+	encoded []byte // The whole reply, kept by the shared replies
+}
+
+// Shared replies, returned by the constructors instead of allocating a
+// reply for each command, like the shared objects of Redis. Replies are
+// never modified once made, so a shared one is as good as a new one.
+var (
+	okReply     = sharedStatusReply("OK")
+	pongReply   = sharedStatusReply("PONG")
+	queuedReply = sharedStatusReply("QUEUED")
+	nullBulk    = &BulkReply{}
+	sharedInts  = makeSharedIntReplies()
+)
+
+// Constant parts of replies
+var (
+	crlf          = []byte("\r\n")
+	nullBulkLine  = []byte("$-1\r\n")
+	nullArrayLine = []byte("*-1\r\n")
+)
+
+// sharedIntegers is how many integers, from 0, have a shared reply, as
+// many as Redis has shared integer objects
+const sharedIntegers = 10000
+
+func sharedStatusReply(status string) *StatusReply {
+	return &StatusReply{Status: status, encoded: []byte("+" + status + "\r\n")}
+}
+
+// makeSharedIntReplies encodes the replies of the shared integers in one
+// buffer
+func makeSharedIntReplies() []IntReply {
+	replies := make([]IntReply, sharedIntegers)
+	buf := make([]byte, 0, sharedIntegers*8)
+	for i := range replies {
+		start := len(buf)
+		buf = append(buf, ':')
+		buf = strconv.AppendInt(buf, int64(i), 10)
+		buf = append(buf, '\r', '\n')
+		replies[i] = IntReply{Code: int64(i), encoded: buf[start:len(buf):len(buf)]}
+	}
+	return replies
 }
 
-// MakeStatusReply creates a status reply
+// MakeStatusReply creates a status reply; OK, PONG and QUEUED are shared
 func MakeStatusReply(status string) *StatusReply {
+	switch status {
+	case "OK":
+		return okReply
+	case "PONG":
+		return pongReply
+	case "QUEUED":
+		return queuedReply
+	}
 	return &StatusReply{Status: status}
 }
 
-// MakePongReply creates a PONG reply
+// MakePongReply returns the PONG reply
 func MakePongReply() *StatusReply {
-	return &StatusReply{Status: "PONG"}
+	return pongReply
 }
 
 // ToBytes converts status reply to RESP bytes
@@ -30,6 +82,17 @@ func (r *StatusReply) ToBytes() []byte {
 	return []byte("+" + r.Status + "\r\n")
 }
 
+// WriteTo writes the reply to w
+func (r *StatusReply) WriteTo(w io.Writer) (int64, error) {
+	rw := replyWriter{w: w}
+	if r.encoded != nil {
+		rw.write(r.encoded)
+	} else {
+		rw.writeLine('+', r.Status)
+	}
+	return rw.n, rw.err
+}
+
 // ErrReply represents an error reply (-Error message\r\n)
 type ErrReply struct {
 	Error string
@@ -50,13 +113,26 @@ func (r *ErrReply) ToBytes() []byte {
 	return []byte("-" + r.Error + "\r\n")
 }
 
+// WriteTo writes the reply to w
+func (r *ErrReply) WriteTo(w io.Writer) (int64, error) {
+	rw := replyWriter{w: w}
+	rw.writeLine('-', r.Error)
+	return rw.n, rw.err
+}
+
 // IntReply represents an integer reply (:123\r\n)
 type IntReply struct {
 	Code int64
+
+	encoded []byte // The whole reply, kept by the shared replies
 }
 
-// MakeIntReply creates an integer reply
+// MakeIntReply creates an integer reply; the replies of 0 to 9999 are
+// shared, and written without formatting the integer
 func MakeIntReply(code int64) *IntReply {
+	if code >= 0 && code < sharedIntegers {
+		return &sharedInts[code]
+	}
 	return &IntReply{Code: code}
 }
 
@@ -65,6 +141,17 @@ func (r *IntReply) ToBytes() []byte {
 	return []byte(":" + strconv.FormatInt(r.Code, 10) + "\r\n")
 }
 
+// WriteTo writes the reply to w
+func (r *IntReply) WriteTo(w io.Writer) (int64, error) {
+	rw := replyWriter{w: w}
+	if r.encoded != nil {
+		rw.write(r.encoded)
+	} else {
+		rw.writeInt(':', r.Code)
+	}
+	return rw.n, rw.err
+}
+
 // BulkReply represents a bulk string reply ($6\r\nfoobar\r\n)
 type BulkReply struct {
 	Arg []byte
@@ -75,17 +162,31 @@ func MakeBulkReply(arg []byte) *BulkReply {
 	return &BulkReply{Arg: arg}
 }
 
-// MakeNullBulkReply creates a null bulk reply
+// MakeNullBulkReply returns the null bulk reply
 func MakeNullBulkReply() *BulkReply {
-	return &BulkReply{Arg: nil}
+	return nullBulk
 }
 
-// ToBytes converts bulk reply to RESP bytes
+// ToBytes converts bulk reply to RESP bytes, copying the value once
 func (r *BulkReply) ToBytes() []byte {
 	if r.Arg == nil {
 		return []byte("$-1\r\n")
 	}
-	return []byte("$" + strconv.Itoa(len(r.Arg)) + "\r\n" + string(r.Arg) + "\r\n")
+	b := make([]byte, 0, len(r.Arg)+24)
+	b = append(b, '$')
+	b = strconv.AppendInt(b, int64(len(r.Arg)), 10)
+	b = append(b, '\r', '\n')
+	b = append(b, r.Arg...)
+	return append(b, '\r', '\n')
+}
+
+// WriteTo writes the header, the value and the final CRLF to w in turn, so
+// that a large value goes to the connection without being copied: a
+// bufio.Writer writes what does not fit its buffer straight through
+func (r *BulkReply) WriteTo(w io.Writer) (int64, error) {
+	rw := replyWriter{w: w}
+	rw.writeBulk(r.Arg)
+	return rw.n, rw.err
 }
 
 // MultiBulkReply represents an array reply (*2\r\n$3\r\nfoo\r\n$3\r\nbar\r\n)
@@ -110,21 +211,176 @@ func MakeNullMultiBulkReply() *MultiBulkReply {
 
 // ToBytes converts multi bulk reply to RESP bytes
 func (r *MultiBulkReply) ToBytes() []byte {
+	var buf bytes.Buffer
+	r.WriteTo(&buf)
+	return buf.Bytes()
+}
+
+// WriteTo writes the reply to w an argument at a time, so that a large array
+// goes out through the connection's buffer without being copied in full
+// first
+func (r *MultiBulkReply) WriteTo(w io.Writer) (int64, error) {
+	rw := replyWriter{w: w}
 	if r.Args == nil {
-		return []byte("*-1\r\n")
+		rw.write(nullArrayLine)
+		return rw.n, rw.err
 	}
-	var buf bytes.Buffer
-	buf.WriteString("*" + strconv.Itoa(len(r.Args)) + "\r\n")
+	rw.writeHeader('*', len(r.Args))
 	for _, arg := range r.Args {
-		if arg == nil {
-			buf.WriteString("$-1\r\n")
-		} else {
-			buf.WriteString("$" + strconv.Itoa(len(arg)) + "\r\n" + string(arg) + "\r\n")
-		}
+		rw.writeBulk(arg)
+	}
+	return rw.n, rw.err
+}
+
+// MultiIntReply represents an array of integers (*2\r\n:1\r\n:-2\r\n)
+type MultiIntReply struct {
+	Values []int64
+}
+
+// MakeMultiIntReply creates an array reply of integers
+func MakeMultiIntReply(values []int64) *MultiIntReply {
+	return &MultiIntReply{Values: values}
+}
+
+// ToBytes converts integer array reply to RESP bytes
+func (r *MultiIntReply) ToBytes() []byte {
+	var buf bytes.Buffer
+	buf.WriteString("*" + strconv.Itoa(len(r.Values)) + "\r\n")
+	for _, v := range r.Values {
+		buf.WriteString(":" + strconv.FormatInt(v, 10) + "\r\n")
 	}
 	return buf.Bytes()
 }
 
+// WriteTo writes the reply to w
+func (r *MultiIntReply) WriteTo(w io.Writer) (int64, error) {
+	rw := replyWriter{w: w}
+	rw.writeHeader('*', len(r.Values))
+	for _, v := range r.Values {
+		rw.writeInt(':', v)
+	}
+	return rw.n, rw.err
+}
+
+// ArrayReply represents an array of arbitrary replies, which may be arrays
+// themselves
+type ArrayReply struct {
+	Replies []Reply
+}
+
+// MakeArrayReply creates an array reply of other replies
+func MakeArrayReply(replies []Reply) *ArrayReply {
+	return &ArrayReply{Replies: replies}
+}
+
+// ToBytes converts array reply to RESP bytes
+func (r *ArrayReply) ToBytes() []byte {
+	var buf bytes.Buffer
+	r.WriteTo(&buf)
+	return buf.Bytes()
+}
+
+// WriteTo writes the reply to w an element at a time (see WriteReply)
+func (r *ArrayReply) WriteTo(w io.Writer) (int64, error) {
+	rw := replyWriter{w: w}
+	rw.writeHeader('*', len(r.Replies))
+	for _, reply := range r.Replies {
+		if rw.err != nil {
+			break
+		}
+		n, err := writeReply(w, reply)
+		rw.n += n
+		rw.err = err
+	}
+	return rw.n, rw.err
+}
+
+// WriteReply writes a reply to w through its WriteTo rather than ToBytes:
+// arrays go an element at a time and bulk strings a part at a time, with no
+// copy of their values. w is meant to be buffered, as a bufio.Writer on the
+// connection, which gathers the small parts and passes a value too large for
+// its buffer straight through.
+func WriteReply(w io.Writer, reply Reply) error {
+	_, err := writeReply(w, reply)
+	return err
+}
+
+func writeReply(w io.Writer, reply Reply) (int64, error) {
+	if wt, ok := reply.(io.WriterTo); ok {
+		return wt.WriteTo(w)
+	}
+	n, err := w.Write(reply.ToBytes())
+	return int64(n), err
+}
+
+// replyWriter writes the parts of a reply to w, counting the bytes written
+// and keeping the first error. The lines it formats are appended to the
+// free space of w when it is buffered, as a bufio.Writer is, so that
+// writing a reply allocates nothing.
+type replyWriter struct {
+	w   io.Writer
+	n   int64
+	err error
+}
+
+// availableBuffer is implemented by bufio.Writer and bytes.Buffer
+type availableBuffer interface {
+	AvailableBuffer() []byte
+}
+
+// scratch returns an empty buffer to format a line in
+func (rw *replyWriter) scratch() []byte {
+	if ab, ok := rw.w.(availableBuffer); ok {
+		return ab.AvailableBuffer()
+	}
+	return make([]byte, 0, 24)
+}
+
+func (rw *replyWriter) write(p []byte) {
+	if rw.err != nil {
+		return
+	}
+	n, err := rw.w.Write(p)
+	rw.n += int64(n)
+	rw.err = err
+}
+
+// writeHeader writes a type byte followed by a length, as "*3\r\n"
+func (rw *replyWriter) writeHeader(kind byte, length int) {
+	rw.writeInt(kind, int64(length))
+}
+
+// writeInt writes a type byte followed by an integer, as ":-2\r\n"
+func (rw *replyWriter) writeInt(kind byte, v int64) {
+	if rw.err != nil {
+		return
+	}
+	b := append(rw.scratch(), kind)
+	b = strconv.AppendInt(b, v, 10)
+	rw.write(append(b, '\r', '\n'))
+}
+
+// writeLine writes a type byte followed by a line, as "+OK\r\n"
+func (rw *replyWriter) writeLine(kind byte, line string) {
+	if rw.err != nil {
+		return
+	}
+	b := append(rw.scratch(), kind)
+	b = append(b, line...)
+	rw.write(append(b, '\r', '\n'))
+}
+
+// writeBulk writes a bulk string, nil being the null bulk string
+func (rw *replyWriter) writeBulk(arg []byte) {
+	if arg == nil {
+		rw.write(nullBulkLine)
+		return
+	}
+	rw.writeHeader('$', len(arg))
+	rw.write(arg)
+	rw.write(crlf)
+}
+
 // StandardReply is a generic reply that can hold any type
 type StandardReply struct {
 	code byte
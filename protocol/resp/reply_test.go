@@ -1,7 +1,11 @@
 package resp
 
 import (
+	"bufio"
 	"bytes"
+	"errors"
+	"io"
+	"strconv"
 	"testing"
 )
 
@@ -131,6 +135,51 @@ func TestMultiBulkReply(t *testing.T) {
 	})
 }
 
+// chunkWriter accepts at most limit bytes per Write, then fails once full
+type chunkWriter struct {
+	buf   bytes.Buffer
+	limit int
+	max   int
+}
+
+func (w *chunkWriter) Write(p []byte) (int, error) {
+	if w.buf.Len()+len(p) > w.max {
+		return 0, errors.New("full")
+	}
+	if len(p) > w.limit {
+		w.limit = len(p)
+	}
+	return w.buf.Write(p)
+}
+
+func TestWriteReply(t *testing.T) {
+	large := make([][]byte, 1000)
+	for i := range large {
+		large[i] = bytes.Repeat([]byte{'x'}, 100)
+	}
+	reply := MakeArrayReply([]Reply{
+		MakeBulkReply([]byte("17")),
+		MakeMultiBulkReply(large),
+		MakeIntReply(3),
+	})
+
+	w := &chunkWriter{max: 1 << 20}
+	if err := WriteReply(w, reply); err != nil {
+		t.Fatalf("WriteReply: %v", err)
+	}
+	if !bytes.Equal(w.buf.Bytes(), reply.ToBytes()) {
+		t.Error("Expected WriteReply to write the bytes of ToBytes")
+	}
+	// The array is written an element at a time, not built in full first
+	if w.limit > 100 {
+		t.Errorf("Expected writes of at most one element, got one of %d bytes", w.limit)
+	}
+
+	if err := WriteReply(&chunkWriter{max: 5000}, reply); err == nil {
+		t.Error("Expected the error of the writer")
+	}
+}
+
 func TestMakeBulkReplyConvenience(t *testing.T) {
 	t.Run("MakeBulkReply with string", func(t *testing.T) {
 		reply := MakeBulkReply([]byte("test"))
@@ -142,3 +191,87 @@ func TestMakeBulkReplyConvenience(t *testing.T) {
 		}
 	})
 }
+
+func TestWriteToMatchesToBytes(t *testing.T) {
+	replies := []Reply{
+		MakeStatusReply("OK"),
+		MakeErrReply("ERR unknown command"),
+		MakeIntReply(-42),
+		MakeBulkReply([]byte("foobar")),
+		MakeBulkReply([]byte{}),
+		MakeNullBulkReply(),
+		MakeMultiBulkReply([][]byte{[]byte("a"), nil}),
+		MakeNullMultiBulkReply(),
+		MakeMultiIntReply([]int64{1, -2}),
+		MakeArrayReply([]Reply{MakeIntReply(1), MakeArrayReply([]Reply{MakeStatusReply("x")})}),
+	}
+	for _, reply := range replies {
+		var buf bytes.Buffer
+		n, err := writeReply(&buf, reply)
+		if err != nil || !bytes.Equal(buf.Bytes(), reply.ToBytes()) || n != int64(buf.Len()) {
+			t.Errorf("Expected WriteTo to write %q, wrote %q (%d bytes reported, %v)", reply.ToBytes(), buf.Bytes(), n, err)
+		}
+	}
+}
+
+func TestBulkReplyWritesValueInPlace(t *testing.T) {
+	value := bytes.Repeat([]byte{'v'}, 1<<20)
+	w := &chunkWriter{max: 2 << 20}
+	if err := WriteReply(w, MakeBulkReply(value)); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(w.buf.Bytes(), MakeBulkReply(value).ToBytes()) {
+		t.Error("Expected the bytes of ToBytes")
+	}
+	// The value is handed to the writer as it is, without the header
+	if w.limit != len(value) {
+		t.Errorf("Expected the largest write to be the value, got %d bytes", w.limit)
+	}
+}
+
+// BenchmarkLargeBulkReply writes a 50MB value to a buffered writer: WriteTo
+// allocates nothing in proportion to the value, where ToBytes copies it
+func BenchmarkLargeBulkReply(b *testing.B) {
+	value := bytes.Repeat([]byte{'v'}, 50<<20)
+	w := bufio.NewWriterSize(io.Discard, 64*1024)
+	b.Run("WriteTo", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			WriteReply(w, MakeBulkReply(value))
+			w.Flush()
+		}
+	})
+	b.Run("ToBytes", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			w.Write(MakeBulkReply(value).ToBytes())
+			w.Flush()
+		}
+	})
+}
+
+func TestSharedReplies(t *testing.T) {
+	w := bufio.NewWriterSize(io.Discard, 4096)
+	large := MakeIntReply(123456789)
+	allocs := testing.AllocsPerRun(100, func() {
+		WriteReply(w, MakeStatusReply("OK"))
+		WriteReply(w, MakePongReply())
+		WriteReply(w, MakeNullBulkReply())
+		WriteReply(w, MakeIntReply(42))
+		WriteReply(w, large)
+		w.Flush()
+	})
+	if allocs != 0 {
+		t.Errorf("Expected shared replies to write without allocating, got %v allocs", allocs)
+	}
+
+	for _, n := range []int64{0, 1, sharedIntegers - 1, sharedIntegers, -1} {
+		want := ":" + strconv.FormatInt(n, 10) + "\r\n"
+		if got := string(MakeIntReply(n).ToBytes()); got != want {
+			t.Errorf("Expected %q, got %q", want, got)
+		}
+	}
+	if got := string(MakeStatusReply("QUEUED").ToBytes()); got != "+QUEUED\r\n" {
+		t.Errorf("Expected +QUEUED, got %q", got)
+	}
+}
@@ -6,8 +6,11 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"strconv"
 	"sync"
 	"time"
+
+	"github.com/wangbo/gocache/protocol/resp"
 )
 
 // ReplicationRole defines the role of the instance
@@ -35,26 +38,75 @@ type ReplicationState struct {
 	masterHost    string
 	masterPort    int
 	masterConn    net.Conn
+	masterReader  *bufio.Reader // Buffers masterConn, see masterStream
 	replID        uint64
 	replOffset    uint64
 	mu            sync.RWMutex
 
 	// Master-side: slave connections
-	slaveConns    []net.Conn
-	slaveConnsMu  sync.Mutex
-
-	// Replication backlog for PSYNC
-	replicationBacklog []byte
-	backlogSize       int // Maximum size of backlog (default 1MB)
-	backlogMu         sync.Mutex
+	slaves                 []*slaveWriter
+	slaveOutputBufferLimit int64 // Bytes queued per slave before dropping it
+	slavesMu               sync.Mutex
+
+	// Replication backlog for PSYNC, a circular buffer holding the latest
+	// backlogLen bytes propagated to slaves. It is allocated on first use.
+	replicationBacklog     []byte
+	backlogSize            int    // Maximum size of backlog (default 1MB)
+	backlogIdx             int    // Position of the next byte to write
+	backlogLen             int    // Number of bytes held
+	backlogFirstByteOffset uint64 // Replication offset of the oldest byte held
+	backlogMu              sync.Mutex
+
+	// Slave-side: opens the connection to the master
+	dial func(addr string) (net.Conn, error)
+
+	// Slave-side: limits of the commands read from the master, see
+	// SetProtoLimits
+	maxMultiBulkLen int
+	maxBulkLen      int64
+
+	// Slave-side: the running replication loop, see StopReplicationLoop
+	loopStop chan struct{} // Closed to stop the loop
+	loopDone chan struct{} // Closed when the loop returned
+	loopConn net.Conn      // Connection the loop reads
+	loopMu   sync.Mutex
 }
 
 // Global replication state
-var State = &ReplicationState{
-	role:       RoleMaster,
-	replID:     1,                // Default replication ID
-	replOffset: 0,
-	backlogSize: 1 << 20,        // 1MB default backlog
+var State = NewReplicationState()
+
+// NewReplicationState creates the replication state of a master that has no
+// slaves yet. The server uses State; other states are useful in tests.
+func NewReplicationState() *ReplicationState {
+	return &ReplicationState{
+		role:        RoleMaster,
+		replID:      1,       // Default replication ID
+		replOffset:  0,
+		backlogSize: 1 << 20, // 1MB default backlog
+
+		slaveOutputBufferLimit: 256 << 20, // Hard limit of the replica class in Redis
+
+		maxMultiBulkLen: resp.DefaultMaxMultiBulkLen,
+		maxBulkLen:      resp.DefaultMaxBulkLen,
+	}
+}
+
+// SetProtoLimits sets the maximum number of arguments of a command received
+// from the master and the maximum length of an argument
+// (proto-max-multibulk-len and proto-max-bulk-len)
+func (rs *ReplicationState) SetProtoLimits(maxMultiBulkLen int, maxBulkLen int64) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	rs.maxMultiBulkLen = maxMultiBulkLen
+	rs.maxBulkLen = maxBulkLen
+}
+
+// SetDialer replaces the function used to connect to the master, which
+// dials TCP by default
+func (rs *ReplicationState) SetDialer(dial func(addr string) (net.Conn, error)) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	rs.dial = dial
 }
 
 // IsMaster returns true if this instance is a master
@@ -106,8 +158,11 @@ func (rs *ReplicationState) IncrementReplicationOffset(delta uint64) {
 	rs.replOffset += delta
 }
 
-// SetAsSlave sets this instance as a slave of the given master
+// SetAsSlave sets this instance as a slave of the given master, stopping
+// the replication loop of the previous master
 func (rs *ReplicationState) SetAsSlave(host string, port int) error {
+	rs.StopReplicationLoop()
+
 	rs.mu.Lock()
 	defer rs.mu.Unlock()
 
@@ -115,6 +170,7 @@ func (rs *ReplicationState) SetAsSlave(host string, port int) error {
 	if rs.masterConn != nil {
 		rs.masterConn.Close()
 		rs.masterConn = nil
+		rs.masterReader = nil
 	}
 
 	rs.role = RoleSlave
@@ -125,8 +181,10 @@ func (rs *ReplicationState) SetAsSlave(host string, port int) error {
 	return nil
 }
 
-// SetAsMaster sets this instance as a master
+// SetAsMaster sets this instance as a master, stopping the replication loop
 func (rs *ReplicationState) SetAsMaster() {
+	rs.StopReplicationLoop()
+
 	rs.mu.Lock()
 	defer rs.mu.Unlock()
 
@@ -134,6 +192,7 @@ func (rs *ReplicationState) SetAsMaster() {
 	if rs.masterConn != nil {
 		rs.masterConn.Close()
 		rs.masterConn = nil
+		rs.masterReader = nil
 	}
 
 	rs.role = RoleMaster
@@ -156,16 +215,35 @@ func (rs *ReplicationState) ConnectToMaster() error {
 	}
 
 	// Connect to master
-	addr := fmt.Sprintf("%s:%d", rs.masterHost, rs.masterPort)
-	conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+	addr := net.JoinHostPort(rs.masterHost, strconv.Itoa(rs.masterPort))
+	var conn net.Conn
+	var err error
+	if rs.dial != nil {
+		conn, err = rs.dial(addr)
+	} else {
+		conn, err = net.DialTimeout("tcp", addr, 5*time.Second)
+	}
 	if err != nil {
 		return fmt.Errorf("failed to connect to master: %w", err)
 	}
 
 	rs.masterConn = conn
+	rs.masterReader = nil
 	return nil
 }
 
+// masterStream returns the connection to the master and the reader buffering
+// it. The sync response and the propagated commands that follow it are read
+// through the same reader, so that no command read ahead is lost.
+func (rs *ReplicationState) masterStream() (net.Conn, *bufio.Reader) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if rs.masterConn != nil && rs.masterReader == nil {
+		rs.masterReader = bufio.NewReader(rs.masterConn)
+	}
+	return rs.masterConn, rs.masterReader
+}
+
 // DisconnectFromMaster disconnects from the master
 func (rs *ReplicationState) DisconnectFromMaster() error {
 	rs.mu.Lock()
@@ -174,6 +252,7 @@ func (rs *ReplicationState) DisconnectFromMaster() error {
 	if rs.masterConn != nil {
 		err := rs.masterConn.Close()
 		rs.masterConn = nil
+		rs.masterReader = nil
 		return err
 	}
 
@@ -223,10 +302,7 @@ func (rs *ReplicationState) SendSync() error {
 // ReceiveSyncResponse receives and processes the SYNC response from master
 // Returns the RDB data received from the master
 func (rs *ReplicationState) ReceiveSyncResponse() ([]byte, error) {
-	rs.mu.RLock()
-	conn := rs.masterConn
-	rs.mu.RUnlock()
-
+	conn, reader := rs.masterStream()
 	if conn == nil {
 		return nil, fmt.Errorf("not connected to master")
 	}
@@ -235,8 +311,6 @@ func (rs *ReplicationState) ReceiveSyncResponse() ([]byte, error) {
 	conn.SetReadDeadline(time.Now().Add(30 * time.Second))
 	defer conn.SetReadDeadline(time.Time{})
 
-	reader := bufio.NewReader(conn)
-
 	// Read response line: +FULLRESYNC <replid> <offset>\r\n
 	line, err := reader.ReadString('\n')
 	if err != nil {
@@ -316,6 +390,40 @@ func (rs *ReplicationState) ReceiveSyncResponse() ([]byte, error) {
 	return rdbData, nil
 }
 
+// SendFullResync sends a slave the reply to SYNC: the FULLRESYNC line with the
+// replication ID and offset of rs, then the RDB snapshot as a bulk string.
+// It is the master-side counterpart of ReceiveSyncResponse.
+func (rs *ReplicationState) SendFullResync(w io.Writer, rdbData []byte) error {
+	return rs.SendFullResyncAt(w, rdbData, rs.GetReplicationOffset())
+}
+
+// SendFullResyncAt is SendFullResync for a snapshot taken at the replication
+// offset offset, such as the one StageSlave returned
+func (rs *ReplicationState) SendFullResyncAt(w io.Writer, rdbData []byte, offset uint64) error {
+	// Send SYNC response: +FULLRESYNC <replid> <offset>\r\n
+	syncResponse := fmt.Sprintf("+FULLRESYNC %d %d\r\n", rs.GetReplicationID(), offset)
+	if _, err := w.Write([]byte(syncResponse)); err != nil {
+		return fmt.Errorf("failed to send SYNC response: %w", err)
+	}
+
+	// Send RDB file length: $<length>\r\n
+	lengthLine := fmt.Sprintf("$%d\r\n", len(rdbData))
+	if _, err := w.Write([]byte(lengthLine)); err != nil {
+		return fmt.Errorf("failed to send RDB length: %w", err)
+	}
+
+	// Send RDB file content
+	if _, err := w.Write(rdbData); err != nil {
+		return fmt.Errorf("failed to send RDB data: %w", err)
+	}
+
+	// Send trailing \r\n
+	if _, err := w.Write([]byte("\r\n")); err != nil {
+		return fmt.Errorf("failed to send trailing CRLF: %w", err)
+	}
+	return nil
+}
+
 // PerformFullSync performs a full synchronization with the master
 // This is the main entry point for slave to sync with master
 func (rs *ReplicationState) PerformFullSync() ([]byte, error) {
@@ -354,10 +462,17 @@ func (rs *ReplicationState) PerformPartialSync(replID uint64, offset uint64) ([]
 	return rs.ReceiveSyncResponse()
 }
 
-// RDBLoader defines the interface for loading RDB data
-// Using interface{} to avoid circular imports
+// Database is the database of a replica: the master's snapshot is loaded into
+// it and the commands the master propagates are executed on it.
+// *database.DB implements it; replication cannot import the database package,
+// which imports replication.
+type Database interface {
+	Exec(cmdLine [][]byte) ([][]byte, error)
+}
+
+// RDBLoader loads an RDB snapshot received from the master into a database
 type RDBLoader interface {
-	LoadRDBFromBytes(db interface{}, data []byte) error
+	LoadRDBFromBytes(db Database, data []byte) error
 }
 
 // rdbLoader holds the registered RDB loader
@@ -369,31 +484,123 @@ func RegisterRDBLoader(loader RDBLoader) {
 }
 
 // LoadRDBData loads RDB data using the registered loader
-func LoadRDBData(db interface{}, data []byte) error {
+func LoadRDBData(db Database, data []byte) error {
 	if rdbLoader == nil {
 		return fmt.Errorf("no RDB loader registered")
 	}
 	return rdbLoader.LoadRDBFromBytes(db, data)
 }
 
-// RegisterSlave registers a slave connection on the master
-func (rs *ReplicationState) RegisterSlave(conn net.Conn) {
-	rs.slaveConnsMu.Lock()
-	defer rs.slaveConnsMu.Unlock()
+// UntypedRDBLoader is the former RDBLoader, which took the database as an
+// interface{}.
+//
+// Deprecated: implement RDBLoader. UntypedRDBLoader will be removed in the
+// next release.
+type UntypedRDBLoader interface {
+	LoadRDBFromBytes(db interface{}, data []byte) error
+}
 
-	rs.slaveConns = append(rs.slaveConns, conn)
-	fmt.Printf("Registered slave: %s (total slaves: %d)\n", conn.RemoteAddr(), len(rs.slaveConns))
+// RegisterUntypedRDBLoader registers a loader implementing the former
+// RDBLoader interface.
+//
+// Deprecated: use RegisterRDBLoader.
+func RegisterUntypedRDBLoader(loader UntypedRDBLoader) {
+	if loader == nil {
+		RegisterRDBLoader(nil)
+		return
+	}
+	RegisterRDBLoader(untypedRDBLoader{loader})
 }
 
-// UnregisterSlave removes a slave connection
-func (rs *ReplicationState) UnregisterSlave(conn net.Conn) {
-	rs.slaveConnsMu.Lock()
-	defer rs.slaveConnsMu.Unlock()
+// untypedRDBLoader adapts an UntypedRDBLoader to RDBLoader
+type untypedRDBLoader struct {
+	loader UntypedRDBLoader
+}
+
+func (l untypedRDBLoader) LoadRDBFromBytes(db Database, data []byte) error {
+	return l.loader.LoadRDBFromBytes(db, data)
+}
+
+// LoadRDBDataUntyped loads RDB data into a database passed as an interface{}.
+//
+// Deprecated: use LoadRDBData.
+func LoadRDBDataUntyped(db interface{}, data []byte) error {
+	typed, ok := db.(Database)
+	if !ok {
+		return fmt.Errorf("database does not implement Exec method")
+	}
+	return LoadRDBData(typed, data)
+}
 
-	for i, c := range rs.slaveConns {
-		if c == conn {
-			rs.slaveConns = append(rs.slaveConns[:i], rs.slaveConns[i+1:]...)
-			fmt.Printf("Unregistered slave: %s (remaining slaves: %d)\n", conn.RemoteAddr(), len(rs.slaveConns))
+// RegisterSlave registers a slave connection on the master and starts the
+// goroutine sending it propagated commands
+func (rs *ReplicationState) RegisterSlave(conn net.Conn) {
+	rs.StageSlave(conn)
+	rs.StartSlave(conn)
+}
+
+// StageSlave registers a slave connection without sending it anything yet:
+// the commands propagated from now on are queued for it until StartSlave.
+// A full synchronization stages the slave before taking the snapshot, so
+// that the commands run while the snapshot is sent reach the slave after
+// it. StageSlave returns the replication offset of the first queued
+// command, which is the offset of the snapshot.
+func (rs *ReplicationState) StageSlave(conn net.Conn) uint64 {
+	rs.slavesMu.Lock()
+	defer rs.slavesMu.Unlock()
+	rs.addSlave(newSlaveWriter(conn))
+	return rs.GetReplicationOffset()
+}
+
+// StageSlaveFrom stages a slave continuing the stream from offset (PSYNC):
+// the backlog from offset is queued for it first, then the commands
+// propagated from now on. It returns the replication offset the backlog
+// ends at, or false and stages nothing if the backlog no longer holds
+// offset.
+func (rs *ReplicationState) StageSlaveFrom(conn net.Conn, offset uint64) (uint64, bool) {
+	rs.slavesMu.Lock()
+	defer rs.slavesMu.Unlock()
+	backlogData, err := rs.GetBacklogData(offset)
+	if err != nil || backlogData == nil {
+		return 0, false
+	}
+	w := newSlaveWriter(conn)
+	if !w.enqueue(backlogData, 0) {
+		return 0, false
+	}
+	rs.addSlave(w)
+	return rs.GetReplicationOffset(), true
+}
+
+// addSlave adds the writer of a slave; the caller holds slavesMu
+func (rs *ReplicationState) addSlave(w *slaveWriter) {
+	rs.slaves = append(rs.slaves, w)
+	fmt.Printf("Registered slave: %s (total slaves: %d)\n", w.conn.RemoteAddr(), len(rs.slaves))
+}
+
+// StartSlave starts sending a staged slave the commands queued for it, then
+// the commands propagated as they come
+func (rs *ReplicationState) StartSlave(conn net.Conn) {
+	rs.slavesMu.Lock()
+	defer rs.slavesMu.Unlock()
+	for _, w := range rs.slaves {
+		if w.conn == conn {
+			w.start()
+			return
+		}
+	}
+}
+
+// UnregisterSlave removes a slave connection and stops its writer
+func (rs *ReplicationState) UnregisterSlave(conn net.Conn) {
+	rs.slavesMu.Lock()
+	defer rs.slavesMu.Unlock()
+
+	for i, w := range rs.slaves {
+		if w.conn == conn {
+			w.close()
+			rs.slaves = append(rs.slaves[:i], rs.slaves[i+1:]...)
+			fmt.Printf("Unregistered slave: %s (remaining slaves: %d)\n", conn.RemoteAddr(), len(rs.slaves))
 			return
 		}
 	}
@@ -401,27 +608,26 @@ func (rs *ReplicationState) UnregisterSlave(conn net.Conn) {
 
 // GetSlaveCount returns the number of connected slaves
 func (rs *ReplicationState) GetSlaveCount() int {
-	rs.slaveConnsMu.Lock()
-	defer rs.slaveConnsMu.Unlock()
-	return len(rs.slaveConns)
+	rs.slavesMu.Lock()
+	defer rs.slavesMu.Unlock()
+	return len(rs.slaves)
 }
 
-// PropagateCommand sends a write command to all connected slaves
-// This is called by the master after executing a write command
+// PropagateCommand appends a write command to the backlog and sends it to
+// all connected slaves. This is called by the master after executing a write command. The command
+// is queued for the writer of each slave, so it returns without waiting for
+// the slave sockets; slaves falling too far behind are dropped.
 func (rs *ReplicationState) PropagateCommand(cmdLine [][]byte) error {
 	// Only propagate if we're a master
 	if !rs.IsMaster() {
 		return nil
 	}
 
-	rs.slaveConnsMu.Lock()
-	slaves := make([]net.Conn, len(rs.slaveConns))
-	copy(slaves, rs.slaveConns)
-	rs.slaveConnsMu.Unlock()
-
-	if len(slaves) == 0 {
-		return nil
-	}
+	// Holding slavesMu keeps the backlog and the slave streams in the same
+	// order. The backlog and the offset advance without slaves too, so that
+	// a slave reconnecting after the last one dropped gets the writes it
+	// missed with PSYNC, or a full sync once they left the backlog.
+	rs.slavesMu.Lock()
 
 	// Convert command to RESP format
 	cmdData := serializeCommand(cmdLine)
@@ -429,40 +635,54 @@ func (rs *ReplicationState) PropagateCommand(cmdLine [][]byte) error {
 	// Add to replication backlog for PSYNC
 	rs.addToBacklog(cmdData)
 
-	// Send to all slaves (non-blocking)
-	var wg sync.WaitGroup
-	for _, slave := range slaves {
-		wg.Add(1)
-		go func(conn net.Conn) {
-			defer wg.Done()
-			if _, err := conn.Write(cmdData); err != nil {
-				fmt.Printf("Failed to send command to slave %s: %v\n", conn.RemoteAddr(), err)
-				// Don't unregister here, let the connection handler do it
-			}
-		}(slave)
+	var dropped []*slaveWriter
+	for _, w := range rs.slaves {
+		if !w.enqueue(cmdData, rs.slaveOutputBufferLimit) {
+			dropped = append(dropped, w)
+		}
 	}
-	wg.Wait()
 
 	// Increment replication offset
 	rs.IncrementReplicationOffset(uint64(len(cmdData)))
+	rs.slavesMu.Unlock()
 
+	for _, w := range dropped {
+		rs.dropSlave(w)
+	}
 	return nil
 }
 
-// addToBacklog adds command data to the replication backlog
+// addToBacklog adds command data to the replication backlog, overwriting
+// the oldest data once the backlog is full
 func (rs *ReplicationState) addToBacklog(data []byte) {
 	rs.backlogMu.Lock()
 	defer rs.backlogMu.Unlock()
 
-	// Append new data to backlog
-	rs.replicationBacklog = append(rs.replicationBacklog, data...)
+	size := rs.backlogSize
+	if size <= 0 {
+		return
+	}
+	if rs.replicationBacklog == nil {
+		rs.replicationBacklog = make([]byte, size)
+	}
+	if rs.backlogLen == 0 {
+		// The data is propagated before the offset is incremented
+		rs.backlogFirstByteOffset = rs.GetReplicationOffset()
+	}
+	endOffset := rs.backlogFirstByteOffset + uint64(rs.backlogLen) + uint64(len(data))
 
-	// Trim backlog if it exceeds max size
-	if len(rs.replicationBacklog) > rs.backlogSize {
-		// Keep only the most recent data
-		excess := len(rs.replicationBacklog) - rs.backlogSize
-		rs.replicationBacklog = rs.replicationBacklog[excess:]
+	// Only the tail of data fits when it is larger than the backlog
+	if len(data) >= size {
+		copy(rs.replicationBacklog, data[len(data)-size:])
+		rs.backlogIdx = 0
+		rs.backlogLen = size
+	} else {
+		n := copy(rs.replicationBacklog[rs.backlogIdx:], data)
+		copy(rs.replicationBacklog, data[n:])
+		rs.backlogIdx = (rs.backlogIdx + len(data)) % size
+		rs.backlogLen = min(rs.backlogLen+len(data), size)
 	}
+	rs.backlogFirstByteOffset = endOffset - uint64(rs.backlogLen)
 }
 
 // GetBacklogData returns backlog data starting from the specified offset
@@ -471,41 +691,66 @@ func (rs *ReplicationState) GetBacklogData(offset uint64) ([]byte, error) {
 	rs.backlogMu.Lock()
 	defer rs.backlogMu.Unlock()
 
-	// Calculate starting position in backlog
-	// The backlog contains bytes from (currentOffset - backlogLen) to currentOffset
-	backlogLen := uint64(len(rs.replicationBacklog))
-	currentOffset := rs.GetReplicationOffset()
+	// The backlog contains bytes from firstByteOffset to firstByteOffset + backlogLen
+	firstByteOffset := rs.backlogFirstByteOffset
+	if rs.backlogLen == 0 {
+		firstByteOffset = rs.GetReplicationOffset()
+	}
+	endOffset := firstByteOffset + uint64(rs.backlogLen)
 
-	if offset > currentOffset {
-		return nil, fmt.Errorf("offset %d is in the future (current: %d)", offset, currentOffset)
+	if offset > endOffset {
+		return nil, fmt.Errorf("offset %d is in the future (current: %d)", offset, endOffset)
 	}
 
 	// Check if offset is within backlog range
-	if currentOffset-backlogLen > offset {
+	if offset < firstByteOffset {
 		return nil, fmt.Errorf("offset %d is too old (not in backlog)", offset)
 	}
 
-	// Calculate position within backlog
-	position := offset - (currentOffset - backlogLen)
-
-	if position >= backlogLen {
+	n := int(endOffset - offset)
+	if n == 0 {
 		return nil, nil // No new data
 	}
+	return rs.readBacklog(n), nil
+}
 
-	return rs.replicationBacklog[position:], nil
+// readBacklog copies the newest n bytes of the backlog, which may wrap
+// around the end of the buffer
+func (rs *ReplicationState) readBacklog(n int) []byte {
+	size := len(rs.replicationBacklog)
+	data := make([]byte, n)
+	start := (rs.backlogIdx - n + size) % size
+	copied := copy(data, rs.replicationBacklog[start:])
+	copy(data[copied:], rs.replicationBacklog)
+	return data
 }
 
-// SetBacklogSize sets the maximum size of the replication backlog
+// SetBacklogSize sets the maximum size of the replication backlog, keeping
+// the newest data that fits
 func (rs *ReplicationState) SetBacklogSize(size int) {
 	rs.backlogMu.Lock()
 	defer rs.backlogMu.Unlock()
 	rs.backlogSize = size
 
-	// Trim existing backlog if needed
-	if len(rs.replicationBacklog) > size {
-		excess := len(rs.replicationBacklog) - size
-		rs.replicationBacklog = rs.replicationBacklog[excess:]
+	if rs.replicationBacklog == nil {
+		return
 	}
+	if size <= 0 {
+		rs.replicationBacklog = nil
+		rs.backlogFirstByteOffset += uint64(rs.backlogLen)
+		rs.backlogIdx, rs.backlogLen = 0, 0
+		return
+	}
+
+	kept := min(rs.backlogLen, size)
+	backlog := make([]byte, size)
+	if kept > 0 {
+		copy(backlog, rs.readBacklog(kept))
+	}
+	rs.backlogFirstByteOffset += uint64(rs.backlogLen - kept)
+	rs.replicationBacklog = backlog
+	rs.backlogIdx = kept % size
+	rs.backlogLen = kept
 }
 
 // GetBacklogSize returns the current backlog size limit
@@ -515,6 +760,14 @@ func (rs *ReplicationState) GetBacklogSize() int {
 	return rs.backlogSize
 }
 
+// GetBacklogMemory returns the number of bytes allocated to the backlog, 0
+// until something was propagated
+func (rs *ReplicationState) GetBacklogMemory() int {
+	rs.backlogMu.Lock()
+	defer rs.backlogMu.Unlock()
+	return len(rs.replicationBacklog)
+}
+
 // serializeCommand converts a command to RESP format
 func serializeCommand(cmdLine [][]byte) []byte {
 	var buf bytes.Buffer
@@ -537,68 +790,90 @@ type CommandHandler interface {
 	ExecCommand(cmdLine [][]byte) ([][]byte, error)
 }
 
-// DBCommandAdapter wraps a database.DB to implement CommandHandler
+// DBCommandAdapter wraps a Database to implement CommandHandler
 type DBCommandAdapter struct {
-	db interface{}
+	db Database
 }
 
 // NewDBCommandAdapter creates a new adapter
-func NewDBCommandAdapter(db interface{}) *DBCommandAdapter {
+func NewDBCommandAdapter(db Database) *DBCommandAdapter {
 	return &DBCommandAdapter{db: db}
 }
 
-// ExecCommand executes a command using the database.Exec method
-func (a *DBCommandAdapter) ExecCommand(cmdLine [][]byte) ([][]byte, error) {
-	// Use reflection or type assertion to call the right method
-	// For now, we'll use a simple approach
-	type executor interface {
-		Exec(cmdLine [][]byte) ([][]byte, error)
-	}
+// NewDBCommandAdapterUntyped creates an adapter for a database passed as an
+// interface{}; commands fail if it does not implement Database.
+//
+// Deprecated: use NewDBCommandAdapter.
+func NewDBCommandAdapterUntyped(db interface{}) *DBCommandAdapter {
+	typed, _ := db.(Database)
+	return &DBCommandAdapter{db: typed}
+}
 
-	if db, ok := a.db.(executor); ok {
-		return db.Exec(cmdLine)
+// ExecCommand executes a command using the database's Exec method
+func (a *DBCommandAdapter) ExecCommand(cmdLine [][]byte) ([][]byte, error) {
+	if a.db == nil {
+		return nil, fmt.Errorf("database does not implement Exec method")
 	}
-
-	return nil, fmt.Errorf("database does not implement Exec method")
+	return a.db.Exec(cmdLine)
 }
 
 // StartReplicationLoop starts the replication loop for a slave
-// This continuously receives and executes commands from the master
-func (rs *ReplicationState) StartReplicationLoop(handler CommandHandler) error {
+// This continuously receives commands from the master and executes them on db
+// until the connection fails or StopReplicationLoop is called; a loop
+// already running is stopped first.
+func (rs *ReplicationState) StartReplicationLoop(db Database) error {
+	return rs.StartReplicationLoopWithHandler(NewDBCommandAdapter(db))
+}
+
+// StartReplicationLoopWithHandler starts the replication loop with a
+// CommandHandler, the former argument of StartReplicationLoop.
+//
+// Deprecated: use StartReplicationLoop.
+func (rs *ReplicationState) StartReplicationLoopWithHandler(handler CommandHandler) error {
 	if !rs.IsSlave() {
 		return fmt.Errorf("not configured as slave")
 	}
 
-	rs.mu.RLock()
-	conn := rs.masterConn
-	rs.mu.RUnlock()
-
+	conn, reader := rs.masterStream()
 	if conn == nil {
 		return fmt.Errorf("not connected to master")
 	}
 
+	rs.loopMu.Lock()
+	defer rs.loopMu.Unlock()
+	rs.stopLoopLocked()
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	rs.loopStop, rs.loopDone, rs.loopConn = stop, done, conn
+
 	// Start replication loop in background
 	go func() {
+		defer close(done)
 		defer func() {
 			if r := recover(); r != nil {
 				fmt.Printf("Replication loop panic: %v\n", r)
 			}
 		}()
 
-		reader := bufio.NewReader(conn)
-
 		for {
 			// Set read deadline to detect stale connections
 			conn.SetReadDeadline(time.Now().Add(60 * time.Second))
 
 			// Read command from master
 			cmdLine, err := rs.readCommand(reader)
+			select {
+			case <-stop:
+				return
+			default:
+			}
 			if err != nil {
 				if err == io.EOF {
 					fmt.Printf("Master closed connection\n")
 				} else {
 					fmt.Printf("Replication read error: %v\n", err)
 				}
+				// The rest of the stream cannot be parsed
+				conn.Close()
 				return
 			}
 
@@ -611,16 +886,44 @@ func (rs *ReplicationState) StartReplicationLoop(handler CommandHandler) error {
 				fmt.Printf("Replication command execution error: %v\n", err)
 			}
 
-			// Update replication offset
-			rs.IncrementReplicationOffset(1)
+			// Count the bytes of the command, like the master does when it
+			// propagates it, so that both offsets can be compared
+			rs.IncrementReplicationOffset(uint64(len(serializeCommand(cmdLine))))
 		}
 	}()
 
 	return nil
 }
 
-// readCommand reads a RESP command from the reader
+// StopReplicationLoop stops the replication loop, if one is running, and
+// waits until it returned. A command being applied is completed; no command
+// is applied once StopReplicationLoop returns. The connection to the master
+// is closed.
+func (rs *ReplicationState) StopReplicationLoop() {
+	rs.loopMu.Lock()
+	defer rs.loopMu.Unlock()
+	rs.stopLoopLocked()
+}
+
+// stopLoopLocked stops the replication loop; the caller holds rs.loopMu
+func (rs *ReplicationState) stopLoopLocked() {
+	if rs.loopStop == nil {
+		return
+	}
+	close(rs.loopStop)
+	// Unblock the loop waiting for the next command
+	rs.loopConn.Close()
+	<-rs.loopDone
+	rs.loopStop, rs.loopDone, rs.loopConn = nil, nil, nil
+}
+
+// readCommand reads a RESP command from the reader. Commands exceeding the
+// limits set by SetProtoLimits fail with a resp.ErrProtocol error.
 func (rs *ReplicationState) readCommand(reader *bufio.Reader) ([][]byte, error) {
+	rs.mu.RLock()
+	maxMultiBulkLen, maxBulkLen := rs.maxMultiBulkLen, rs.maxBulkLen
+	rs.mu.RUnlock()
+
 	// Read first character to determine type
 	leadByte, err := reader.ReadByte()
 	if err != nil {
@@ -643,9 +946,13 @@ func (rs *ReplicationState) readCommand(reader *bufio.Reader) ([][]byte, error)
 		if arrayLen < 0 {
 			return nil, nil // Null array
 		}
+		if maxMultiBulkLen > 0 && arrayLen > maxMultiBulkLen {
+			return nil, resp.ErrInvalidMultiBulkLength
+		}
 
-		// Read each bulk string
-		cmdLine := make([][]byte, arrayLen)
+		// Read each bulk string; the slice grows with the arguments
+		// received, not with the header
+		cmdLine := make([][]byte, 0, min(arrayLen, 1024))
 		for i := 0; i < arrayLen; i++ {
 			// Read bulk string marker
 			marker, err := reader.ReadByte()
@@ -667,19 +974,17 @@ func (rs *ReplicationState) readCommand(reader *bufio.Reader) ([][]byte, error)
 			if _, err := fmt.Sscanf(lengthLine, "%d\r\n", &length); err != nil {
 				return nil, fmt.Errorf("invalid bulk string length: %w", err)
 			}
-
-			if length < 0 {
-				cmdLine[i] = nil
-				continue
+			if maxBulkLen > 0 && int64(length) > maxBulkLen {
+				return nil, resp.ErrInvalidBulkLength
 			}
 
-			// Read data
-			data := make([]byte, length+2) // +2 for \r\n
-			if _, err := io.ReadFull(reader, data); err != nil {
+			// Read data, allocated as it arrives
+			data, err := resp.ReadBulk(reader, length)
+			if err != nil {
 				return nil, err
 			}
 
-			cmdLine[i] = data[:length]
+			cmdLine = append(cmdLine, data)
 		}
 
 		return cmdLine, nil
@@ -3,11 +3,15 @@ package replication
 import (
 	"bufio"
 	"bytes"
+	"errors"
+	"fmt"
 	"io"
 	"net"
 	"sync"
 	"testing"
 	"time"
+
+	"github.com/wangbo/gocache/protocol/resp"
 )
 
 // MockConn implements net.Conn for testing
@@ -458,7 +462,6 @@ func TestReplicationState_ReceiveSyncResponse_Valid(t *testing.T) {
 
 func TestReplicationState_RegisterSlave(t *testing.T) {
 	rs := &ReplicationState{
-		slaveConns: make([]net.Conn, 0),
 	}
 
 	conn1 := &MockConn{}
@@ -474,7 +477,6 @@ func TestReplicationState_RegisterSlave(t *testing.T) {
 
 func TestReplicationState_UnregisterSlave(t *testing.T) {
 	rs := &ReplicationState{
-		slaveConns: make([]net.Conn, 0),
 	}
 
 	conn1 := &MockConn{}
@@ -490,10 +492,56 @@ func TestReplicationState_UnregisterSlave(t *testing.T) {
 	}
 }
 
+func TestReplicationState_StageSlave(t *testing.T) {
+	rs := NewReplicationState()
+	rs.RegisterSlave(&MockConn{})
+	setA := [][]byte{[]byte("SET"), []byte("a"), []byte("1")}
+	setB := [][]byte{[]byte("SET"), []byte("b"), []byte("2")}
+	rs.PropagateCommand(setA)
+
+	// A full sync stages the slave at the offset of its snapshot
+	fullEnd, fullSlave := net.Pipe()
+	defer fullEnd.Close()
+	if offset := rs.StageSlave(fullEnd); offset != uint64(len(serializeCommand(setA))) {
+		t.Errorf("Expected the snapshot offset %d, got %d", len(serializeCommand(setA)), offset)
+	}
+	// A partial sync gets the backlog first
+	partialEnd, partialSlave := net.Pipe()
+	defer partialEnd.Close()
+	if _, ok := rs.StageSlaveFrom(partialEnd, 0); !ok {
+		t.Fatal("Expected the backlog to hold offset 0")
+	}
+	if _, ok := rs.StageSlaveFrom(&MockConn{}, 1000); ok {
+		t.Error("Expected an offset past the backlog to be refused")
+	}
+	rs.PropagateCommand(setB)
+
+	// Nothing is sent before StartSlave
+	fullSlave.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	if n, _ := fullSlave.Read(make([]byte, 1)); n != 0 {
+		t.Fatal("Expected a staged slave to receive nothing")
+	}
+	fullSlave.SetReadDeadline(time.Time{})
+
+	for _, tt := range []struct {
+		conn  net.Conn
+		slave net.Conn
+		want  []byte
+	}{
+		{fullEnd, fullSlave, serializeCommand(setB)},
+		{partialEnd, partialSlave, append(serializeCommand(setA), serializeCommand(setB)...)},
+	} {
+		rs.StartSlave(tt.conn)
+		got := make([]byte, len(tt.want))
+		if _, err := io.ReadFull(tt.slave, got); err != nil || !bytes.Equal(got, tt.want) {
+			t.Errorf("Expected %q, got %q (%v)", tt.want, got, err)
+		}
+	}
+}
+
 func TestReplicationState_PropagateCommand_NotMaster(t *testing.T) {
 	rs := &ReplicationState{
 		role:       RoleSlave,
-		slaveConns: make([]net.Conn, 0),
 	}
 
 	cmd := [][]byte{[]byte("SET"), []byte("key"), []byte("value")}
@@ -506,7 +554,6 @@ func TestReplicationState_PropagateCommand_NotMaster(t *testing.T) {
 func TestReplicationState_PropagateCommand_MasterNoSlaves(t *testing.T) {
 	rs := &ReplicationState{
 		role:       RoleMaster,
-		slaveConns: make([]net.Conn, 0),
 	}
 
 	cmd := [][]byte{[]byte("SET"), []byte("key"), []byte("value")}
@@ -516,44 +563,76 @@ func TestReplicationState_PropagateCommand_MasterNoSlaves(t *testing.T) {
 	}
 }
 
+// TestReplicationState_PropagateCommand_AfterLastSlaveDropped checks that
+// the writes made while no slave is connected reach the backlog, so that a
+// slave coming back continues from its offset without missing them
+func TestReplicationState_PropagateCommand_AfterLastSlaveDropped(t *testing.T) {
+	rs := NewReplicationState()
+	slave := &MockConn{}
+	rs.RegisterSlave(slave)
+	setA := [][]byte{[]byte("SET"), []byte("a"), []byte("1")}
+	setB := [][]byte{[]byte("SET"), []byte("b"), []byte("2")}
+	rs.PropagateCommand(setA)
+	offset := rs.GetReplicationOffset()
+
+	rs.UnregisterSlave(slave)
+	rs.PropagateCommand(setB)
+	if got, want := rs.GetReplicationOffset(), offset+uint64(len(serializeCommand(setB))); got != want {
+		t.Errorf("Expected the offset to advance to %d, got %d", want, got)
+	}
+	data, err := rs.GetBacklogData(offset)
+	if err != nil || !bytes.Equal(data, serializeCommand(setB)) {
+		t.Errorf("Expected the backlog to hold %q, got %q (%v)", serializeCommand(setB), data, err)
+	}
+}
+
 func TestReplicationState_AddToBacklog(t *testing.T) {
 	rs := &ReplicationState{
-		replicationBacklog: make([]byte, 0, 100),
-		backlogSize:       100,
-		replOffset:        0,
+		backlogSize: 100,
+		replOffset:  0,
 	}
 
 	// Add data
 	rs.addToBacklog([]byte("command1"))
 	rs.addToBacklog([]byte("command2"))
 
-	if len(rs.replicationBacklog) != 16 { // "command1" (8) + "command2" (8)
-		t.Errorf("Expected backlog length 16, got %d", len(rs.replicationBacklog))
+	if rs.backlogLen != 16 { // "command1" (8) + "command2" (8)
+		t.Errorf("Expected backlog length 16, got %d", rs.backlogLen)
 	}
 }
 
 func TestReplicationState_AddToBacklog_Trim(t *testing.T) {
 	rs := &ReplicationState{
-		replicationBacklog: make([]byte, 0),
-		backlogSize:       10,
-		replOffset:        0,
+		backlogSize: 10,
+		replOffset:  0,
 	}
 
 	// Add data that exceeds backlog size
 	rs.addToBacklog([]byte("12345678901")) // 11 bytes
 
 	// Should be trimmed to 10 bytes
-	if len(rs.replicationBacklog) > 10 {
-		t.Errorf("Backlog should be trimmed to 10 bytes, got %d", len(rs.replicationBacklog))
+	if rs.backlogLen > 10 {
+		t.Errorf("Backlog should be trimmed to 10 bytes, got %d", rs.backlogLen)
+	}
+	if rs.backlogFirstByteOffset != 1 {
+		t.Errorf("Expected first byte offset 1, got %d", rs.backlogFirstByteOffset)
 	}
 }
 
-func TestReplicationState_GetBacklogData(t *testing.T) {
+// newTestBacklog returns a state whose backlog holds data, ending at
+// replication offset end
+func newTestBacklog(data string, size int, end uint64) *ReplicationState {
 	rs := &ReplicationState{
-		replicationBacklog: []byte("abcdefghij"),
-		backlogSize:       100,
-		replOffset:        100,
+		backlogSize: size,
+		replOffset:  end - uint64(len(data)),
 	}
+	rs.addToBacklog([]byte(data))
+	rs.IncrementReplicationOffset(uint64(len(data)))
+	return rs
+}
+
+func TestReplicationState_GetBacklogData(t *testing.T) {
+	rs := newTestBacklog("abcdefghij", 100, 100)
 
 	// Request data from offset 95 (should return last 5 bytes)
 	data, err := rs.GetBacklogData(95)
@@ -567,11 +646,7 @@ func TestReplicationState_GetBacklogData(t *testing.T) {
 }
 
 func TestReplicationState_GetBacklogData_OffsetInFuture(t *testing.T) {
-	rs := &ReplicationState{
-		replicationBacklog: []byte("abc"),
-		backlogSize:       100,
-		replOffset:        100,
-	}
+	rs := newTestBacklog("abc", 100, 100)
 
 	_, err := rs.GetBacklogData(200)
 	if err == nil {
@@ -580,11 +655,7 @@ func TestReplicationState_GetBacklogData_OffsetInFuture(t *testing.T) {
 }
 
 func TestReplicationState_GetBacklogData_OffsetTooOld(t *testing.T) {
-	rs := &ReplicationState{
-		replicationBacklog: []byte("abc"),
-		backlogSize:       100,
-		replOffset:        100,
-	}
+	rs := newTestBacklog("abc", 100, 100)
 
 	_, err := rs.GetBacklogData(50)
 	if err == nil {
@@ -592,12 +663,55 @@ func TestReplicationState_GetBacklogData_OffsetTooOld(t *testing.T) {
 	}
 }
 
-func TestReplicationState_SetBacklogSize(t *testing.T) {
-	rs := &ReplicationState{
-		replicationBacklog: []byte("abcdefghij"),
-		backlogSize:       100,
+func TestReplicationState_GetBacklogData_WrapAround(t *testing.T) {
+	rs := &ReplicationState{backlogSize: 8}
+
+	// Write 3 + 4 + 4 bytes into an 8 byte ring: the last write wraps
+	for _, chunk := range []string{"abc", "defg", "hijk"} {
+		rs.addToBacklog([]byte(chunk))
+		rs.IncrementReplicationOffset(uint64(len(chunk)))
+	}
+	if rs.backlogFirstByteOffset != 3 || rs.backlogLen != 8 {
+		t.Fatalf("Expected 8 bytes from offset 3, got %d bytes from %d", rs.backlogLen, rs.backlogFirstByteOffset)
+	}
+
+	tests := []struct {
+		offset uint64
+		want   string
+	}{
+		{3, "defghijk"},
+		{5, "fghijk"},
+		{8, "ijk"},
+		{10, "k"},
+	}
+	for _, tt := range tests {
+		data, err := rs.GetBacklogData(tt.offset)
+		if err != nil {
+			t.Fatalf("GetBacklogData(%d) failed: %v", tt.offset, err)
+		}
+		if string(data) != tt.want {
+			t.Errorf("GetBacklogData(%d) = %q, want %q", tt.offset, data, tt.want)
+		}
 	}
 
+	if data, err := rs.GetBacklogData(11); err != nil || data != nil {
+		t.Errorf("Expected no data at the current offset, got %q %v", data, err)
+	}
+	if _, err := rs.GetBacklogData(2); err == nil {
+		t.Error("Should return error for an overwritten offset")
+	}
+
+	// The returned data must not alias the ring
+	data, _ := rs.GetBacklogData(3)
+	rs.addToBacklog([]byte("zz"))
+	if string(data) != "defghijk" {
+		t.Errorf("Backlog data changed after a write: %q", data)
+	}
+}
+
+func TestReplicationState_SetBacklogSize(t *testing.T) {
+	rs := newTestBacklog("abcdefghij", 100, 10)
+
 	rs.SetBacklogSize(5)
 
 	if rs.GetBacklogSize() != 5 {
@@ -605,8 +719,33 @@ func TestReplicationState_SetBacklogSize(t *testing.T) {
 	}
 
 	// Backlog should be trimmed
-	if len(rs.replicationBacklog) > 5 {
-		t.Errorf("Backlog should be trimmed to 5 bytes, got %d", len(rs.replicationBacklog))
+	if rs.backlogLen > 5 {
+		t.Errorf("Backlog should be trimmed to 5 bytes, got %d", rs.backlogLen)
+	}
+}
+
+func TestReplicationState_SetBacklogSize_KeepsNewestData(t *testing.T) {
+	rs := &ReplicationState{backlogSize: 6}
+	for _, chunk := range []string{"abcd", "efgh"} {
+		rs.addToBacklog([]byte(chunk))
+		rs.IncrementReplicationOffset(uint64(len(chunk)))
+	}
+
+	// Shrinking a wrapped ring keeps its tail
+	rs.SetBacklogSize(4)
+	if data, err := rs.GetBacklogData(4); err != nil || string(data) != "efgh" {
+		t.Errorf("Expected 'efgh' after shrinking, got %q %v", data, err)
+	}
+	if _, err := rs.GetBacklogData(3); err == nil {
+		t.Error("Should return error for an offset trimmed by the shrink")
+	}
+
+	// Growing keeps everything and makes room for more
+	rs.SetBacklogSize(10)
+	rs.addToBacklog([]byte("ijklmn"))
+	rs.IncrementReplicationOffset(6)
+	if data, err := rs.GetBacklogData(4); err != nil || string(data) != "efghijklmn" {
+		t.Errorf("Expected 'efghijklmn' after growing, got %q %v", data, err)
 	}
 }
 
@@ -654,8 +793,20 @@ func TestNewDBCommandAdapter(t *testing.T) {
 	}
 }
 
+func TestDBCommandAdapter_ExecCommand(t *testing.T) {
+	db := &mockDatabase{}
+	adapter := NewDBCommandAdapter(db)
+
+	if _, err := adapter.ExecCommand([][]byte{[]byte("SET"), []byte("k"), []byte("v")}); err != nil {
+		t.Fatalf("ExecCommand failed: %v", err)
+	}
+	if len(db.executed) != 1 || string(db.executed[0][0]) != "SET" {
+		t.Errorf("Expected SET to reach the database, got %q", db.executed)
+	}
+}
+
 func TestDBCommandAdapter_ExecCommand_NoExecMethod(t *testing.T) {
-	adapter := NewDBCommandAdapter("not a database")
+	adapter := NewDBCommandAdapterUntyped("not a database")
 
 	cmd := [][]byte{[]byte("PING")}
 	_, err := adapter.ExecCommand(cmd)
@@ -699,6 +850,55 @@ func TestReplicationState_StartReplicationLoop_NotConnected(t *testing.T) {
 	}
 }
 
+// recordingDB records the commands applied by a replication loop
+type recordingDB struct {
+	applied chan string
+}
+
+func (db *recordingDB) Exec(cmdLine [][]byte) ([][]byte, error) {
+	db.applied <- string(cmdLine[1])
+	return nil, nil
+}
+
+func TestReplicationState_StopReplicationLoop(t *testing.T) {
+	rs := NewReplicationState()
+	masterEnd, slaveEnd := net.Pipe()
+	defer masterEnd.Close()
+	rs.SetAsSlave("master", 6379)
+	rs.SetDialer(func(addr string) (net.Conn, error) { return slaveEnd, nil })
+	if err := rs.ConnectToMaster(); err != nil {
+		t.Fatalf("ConnectToMaster failed: %v", err)
+	}
+
+	db := &recordingDB{applied: make(chan string, 10)}
+	if err := rs.StartReplicationLoop(db); err != nil {
+		t.Fatalf("StartReplicationLoop failed: %v", err)
+	}
+	masterEnd.Write(serializeCommand([][]byte{[]byte("SET"), []byte("before")}))
+	select {
+	case key := <-db.applied:
+		if key != "before" {
+			t.Errorf("Expected before to be applied, got %s", key)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Command not applied by the replication loop")
+	}
+
+	rs.StopReplicationLoop()
+	if _, err := masterEnd.Write(serializeCommand([][]byte{[]byte("SET"), []byte("after")})); err == nil {
+		t.Error("Expected the connection to the master to be closed")
+	}
+	select {
+	case key := <-db.applied:
+		t.Errorf("Expected no command applied after StopReplicationLoop, got %s", key)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	// Stopping twice, and promoting afterwards, is harmless
+	rs.StopReplicationLoop()
+	rs.SetAsMaster()
+}
+
 func TestReplicationState_readCommand_InvalidType(t *testing.T) {
 	rs := &ReplicationState{}
 	buf := bytes.NewBufferString("+PING\r\n")
@@ -759,6 +959,54 @@ func TestReplicationState_readCommand_NullArray(t *testing.T) {
 	}
 }
 
+func TestReplicationState_readCommand_Limits(t *testing.T) {
+	rs := NewReplicationState()
+	rs.SetProtoLimits(2, 1<<20)
+
+	for _, tc := range []struct {
+		input string
+		want  error
+	}{
+		{"*3\r\n$1\r\na\r\n$1\r\nb\r\n$1\r\nc\r\n", resp.ErrInvalidMultiBulkLength},
+		{"*1000000000\r\n", resp.ErrInvalidMultiBulkLength},
+		{"*1\r\n$2000000\r\n", resp.ErrInvalidBulkLength},
+	} {
+		_, err := rs.readCommand(bufio.NewReader(bytes.NewBufferString(tc.input)))
+		if !errors.Is(err, tc.want) {
+			t.Errorf("%q: expected %v, got %v", tc.input, tc.want, err)
+		}
+	}
+
+	// A header announcing more than is sent fails without allocating it
+	rs.SetProtoLimits(0, 0)
+	if _, err := rs.readCommand(bufio.NewReader(bytes.NewBufferString("*2000000000\r\n$2000000000\r\nab"))); err != io.ErrUnexpectedEOF {
+		t.Errorf("Expected io.ErrUnexpectedEOF, got %v", err)
+	}
+}
+
+func FuzzReadCommand(f *testing.F) {
+	for _, seed := range []string{
+		"*2\r\n$3\r\nGET\r\n$3\r\nkey\r\n",
+		"*-1\r\n",
+		"*1000000000\r\n",
+		"*1\r\n$1000000000\r\n",
+		"*9223372036854775807\r\n",
+		"*1\r\n$-5\r\n",
+		"*2\r\n$1\r\na",
+	} {
+		f.Add([]byte(seed))
+	}
+
+	rs := NewReplicationState()
+	rs.SetProtoLimits(1024, 1<<20)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		cmdLine, err := rs.readCommand(bufio.NewReader(bytes.NewReader(data)))
+		if err == nil && len(cmdLine) > 1024 {
+			t.Errorf("Read %d arguments, over the limit", len(cmdLine))
+		}
+	})
+}
+
 func TestRegisterRDBLoader(t *testing.T) {
 	loader := &mockRDBLoader{}
 	RegisterRDBLoader(loader)
@@ -782,13 +1030,50 @@ func TestLoadRDBData_NoLoader(t *testing.T) {
 	}
 }
 
+func TestRegisterUntypedRDBLoader(t *testing.T) {
+	loader := &mockUntypedRDBLoader{}
+	RegisterUntypedRDBLoader(loader)
+	defer RegisterRDBLoader(nil)
+
+	db := &mockDatabase{}
+	if err := LoadRDBData(db, []byte("data")); err != nil {
+		t.Fatalf("LoadRDBData failed: %v", err)
+	}
+	if loader.db != db {
+		t.Error("Expected the untyped loader to receive the database")
+	}
+	if err := LoadRDBDataUntyped("not a database", []byte("data")); err == nil {
+		t.Error("Expected LoadRDBDataUntyped to reject a value that is not a Database")
+	}
+}
+
 // mockRDBLoader implements RDBLoader for testing
 type mockRDBLoader struct{}
 
-func (m *mockRDBLoader) LoadRDBFromBytes(db interface{}, data []byte) error {
+func (m *mockRDBLoader) LoadRDBFromBytes(db Database, data []byte) error {
+	return nil
+}
+
+// mockUntypedRDBLoader implements UntypedRDBLoader for testing
+type mockUntypedRDBLoader struct {
+	db interface{}
+}
+
+func (m *mockUntypedRDBLoader) LoadRDBFromBytes(db interface{}, data []byte) error {
+	m.db = db
 	return nil
 }
 
+// mockDatabase implements Database and records the commands it executes
+type mockDatabase struct {
+	executed [][][]byte
+}
+
+func (m *mockDatabase) Exec(cmdLine [][]byte) ([][]byte, error) {
+	m.executed = append(m.executed, cmdLine)
+	return [][]byte{[]byte("OK")}, nil
+}
+
 func TestGlobalState(t *testing.T) {
 	// Test that global State is accessible
 	if State == nil {
@@ -806,10 +1091,8 @@ func TestGlobalState(t *testing.T) {
 
 func TestConcurrentAccess(t *testing.T) {
 	rs := &ReplicationState{
-		role:              RoleMaster,
-		replicationBacklog: make([]byte, 0),
-		backlogSize:       1000,
-		slaveConns:        make([]net.Conn, 0),
+		role:        RoleMaster,
+		backlogSize: 1000,
 	}
 
 	var wg sync.WaitGroup
@@ -842,35 +1125,32 @@ func TestConcurrentAccess(t *testing.T) {
 
 func TestBacklogEdgeCases(t *testing.T) {
 	rs := &ReplicationState{
-		replicationBacklog: make([]byte, 0),
-		backlogSize:       10,
-		replOffset:        100,
+		backlogSize: 10,
+		replOffset:  100,
 	}
 
 	// Add exactly 10 bytes
 	rs.addToBacklog([]byte("0123456789"))
 
 	// Should be exactly at limit
-	if len(rs.replicationBacklog) != 10 {
-		t.Errorf("Expected backlog size 10, got %d", len(rs.replicationBacklog))
+	if rs.backlogLen != 10 {
+		t.Errorf("Expected backlog size 10, got %d", rs.backlogLen)
 	}
 
 	// Add one more byte
 	rs.addToBacklog([]byte("x"))
 
 	// Should still be at limit
-	if len(rs.replicationBacklog) > 10 {
+	if rs.backlogLen > 10 {
 		t.Errorf("Backlog should not exceed limit")
 	}
 }
 
 func TestPropagateCommandWithSlaves(t *testing.T) {
 	rs := &ReplicationState{
-		role:              RoleMaster,
-		slaveConns:        make([]net.Conn, 0),
-		replicationBacklog: make([]byte, 0),
-		backlogSize:       1000,
-		replOffset:        0,
+		role:        RoleMaster,
+		backlogSize: 1000,
+		replOffset:  0,
 	}
 
 	// Add mock slaves
@@ -906,3 +1186,93 @@ func TestPropagateCommandWithSlaves(t *testing.T) {
 		t.Error("Both slaves should receive the same command")
 	}
 }
+
+func TestPropagateCommandDoesNotWaitForSlowSlaves(t *testing.T) {
+	rs := &ReplicationState{
+		role:        RoleMaster,
+		backlogSize: 1 << 20,
+	}
+	slow := &MockConn{writeDelay: 10 * time.Second}
+	healthy := &MockConn{}
+	rs.RegisterSlave(slow)
+	rs.RegisterSlave(healthy)
+	defer rs.UnregisterSlave(slow)
+	defer rs.UnregisterSlave(healthy)
+
+	var expected bytes.Buffer
+	start := time.Now()
+	for i := 0; i < 100; i++ {
+		cmd := [][]byte{[]byte("SET"), []byte("key"), []byte(fmt.Sprint(i))}
+		if err := rs.PropagateCommand(cmd); err != nil {
+			t.Fatalf("PropagateCommand failed: %v", err)
+		}
+		expected.Write(serializeCommand(cmd))
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("PropagateCommand waited for the slow slave: %v for 100 commands", elapsed)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for healthy.GetWrittenData() != expected.String() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Healthy slave received %d of %d bytes", len(healthy.GetWrittenData()), expected.Len())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if rs.GetReplicationOffset() != uint64(expected.Len()) {
+		t.Errorf("Expected offset %d, got %d", expected.Len(), rs.GetReplicationOffset())
+	}
+}
+
+func TestPropagateCommandDropsSlaveOverOutputBufferLimit(t *testing.T) {
+	rs := &ReplicationState{
+		role:        RoleMaster,
+		backlogSize: 1 << 20,
+	}
+	rs.SetSlaveOutputBufferLimit(100)
+	slow := &MockConn{writeDelay: time.Second}
+	healthy := &MockConn{}
+	rs.RegisterSlave(slow)
+	rs.RegisterSlave(healthy)
+	defer rs.UnregisterSlave(healthy)
+
+	// Each command is 33 bytes; the slow slave's writer holds the first one
+	for i := 0; i < 5; i++ {
+		rs.PropagateCommand([][]byte{[]byte("SET"), []byte("key"), []byte("value")})
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if rs.GetSlaveCount() != 1 {
+		t.Errorf("Expected the slow slave to be dropped, got %d slaves", rs.GetSlaveCount())
+	}
+	slow.mu.Lock()
+	closed := slow.closed
+	slow.mu.Unlock()
+	if !closed {
+		t.Error("The dropped slave's connection should be closed")
+	}
+
+	// The dropped slave can resume from the backlog
+	if data, err := rs.GetBacklogData(0); err != nil || len(data) != 5*33 {
+		t.Errorf("Expected the whole stream in the backlog, got %d bytes %v", len(data), err)
+	}
+}
+
+// BenchmarkAddToBacklog propagates a small command into a full backlog; the
+// cost per command does not depend on the backlog size
+func BenchmarkAddToBacklog(b *testing.B) {
+	cmd := serializeCommand([][]byte{[]byte("SET"), []byte("key"), []byte("value")})
+	for _, size := range []int{1 << 20, 64 << 20} {
+		b.Run(fmt.Sprintf("backlog=%dMB", size>>20), func(b *testing.B) {
+			rs := &ReplicationState{backlogSize: size}
+			for filled := 0; filled < size; filled += len(cmd) {
+				rs.addToBacklog(cmd)
+			}
+			b.SetBytes(int64(len(cmd)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				rs.addToBacklog(cmd)
+			}
+		})
+	}
+}
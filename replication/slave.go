@@ -0,0 +1,94 @@
+package replication
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// slaveQueueLen is the number of commands that can wait for a slave's
+// writer before the slave is dropped
+const slaveQueueLen = 16384
+
+// slaveWriter sends propagated commands to one slave from its own goroutine,
+// so a slow or dead slave socket never stalls the commands of the master.
+// A slave whose queued commands exceed the output buffer limit is dropped;
+// once reconnected, it can catch up with PSYNC from the backlog.
+type slaveWriter struct {
+	conn    net.Conn
+	queue   chan []byte
+	pending atomic.Int64 // Bytes queued but not written yet
+	done    chan struct{}
+	begin   sync.Once
+	stop    sync.Once
+}
+
+// newSlaveWriter creates the writer of a slave; commands are queued until
+// start
+func newSlaveWriter(conn net.Conn) *slaveWriter {
+	return &slaveWriter{
+		conn:  conn,
+		queue: make(chan []byte, slaveQueueLen),
+		done:  make(chan struct{}),
+	}
+}
+
+// start starts the goroutine writing the queued commands
+func (w *slaveWriter) start() {
+	w.begin.Do(func() { go w.run() })
+}
+
+// enqueue queues data for the slave without blocking; it returns false if
+// the queue is full or holds more than limit bytes (0 means no limit)
+func (w *slaveWriter) enqueue(data []byte, limit int64) bool {
+	pending := w.pending.Add(int64(len(data)))
+	if limit > 0 && pending > limit {
+		return false
+	}
+	select {
+	case w.queue <- data:
+		return true
+	default:
+		return false
+	}
+}
+
+// run writes queued commands to the slave until it is closed
+func (w *slaveWriter) run() {
+	for {
+		select {
+		case <-w.done:
+			return
+		case data := <-w.queue:
+			if _, err := w.conn.Write(data); err != nil {
+				fmt.Printf("Failed to send command to slave %s: %v\n", w.conn.RemoteAddr(), err)
+				// The connection handler unregisters the slave once its
+				// connection is closed
+				w.conn.Close()
+				return
+			}
+			w.pending.Add(-int64(len(data)))
+		}
+	}
+}
+
+// close stops the writer goroutine; queued commands are discarded
+func (w *slaveWriter) close() {
+	w.stop.Do(func() { close(w.done) })
+}
+
+// SetSlaveOutputBufferLimit sets the number of bytes that can be queued for
+// a slave before it is disconnected (0 means no limit)
+func (rs *ReplicationState) SetSlaveOutputBufferLimit(limit int64) {
+	rs.slavesMu.Lock()
+	defer rs.slavesMu.Unlock()
+	rs.slaveOutputBufferLimit = limit
+}
+
+// dropSlave disconnects a slave that cannot keep up with the master
+func (rs *ReplicationState) dropSlave(w *slaveWriter) {
+	fmt.Printf("Dropping slave %s: output buffer limit reached\n", w.conn.RemoteAddr())
+	rs.UnregisterSlave(w.conn)
+	w.conn.Close()
+}
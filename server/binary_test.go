@@ -0,0 +1,299 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/wangbo/gocache/database"
+	"github.com/wangbo/gocache/persistence/aof"
+	"github.com/wangbo/gocache/persistence/rdb"
+	"github.com/wangbo/gocache/replication"
+)
+
+// binaryStrings are keys, fields and values a line-based writer or a
+// printable-text assumption would corrupt
+var binaryStrings = []string{
+	"crlf\r\nkey",
+	"\r\n",
+	"nul\x00byte",
+	"\x00",
+	"\xff\xfe\xff",
+	"bad\xc3(utf8",
+	"*3\r\n$3\r\nSET\r\n",
+	"msgpack\x82\xa3foo\x01\xa3bar\xc0",
+	"with space",
+	"\"quoted\\",
+	"",
+}
+
+// binaryValue returns the value stored under the binary key s
+func binaryValue(s string) string {
+	return "v\r\n" + s + "\x00\xff"
+}
+
+// binaryContainers are the keys of the collections holding binaryStrings
+const (
+	binaryHash = "hash\r\n\xff"
+	binaryList = "list\x00"
+	binarySet  = "set\xfe"
+	binaryZSet = "zset\n"
+)
+
+// writeBinaryKeys stores binaryStrings as string keys and in a collection of
+// every type
+func writeBinaryKeys(t *testing.T, h *Handler) {
+	t.Helper()
+	exec := func(args ...string) {
+		t.Helper()
+		cmdLine := make([][]byte, len(args))
+		for i, arg := range args {
+			cmdLine[i] = []byte(arg)
+		}
+		if _, err := h.ExecCommand(cmdLine); err != nil {
+			t.Fatalf("%q failed: %v", args, err)
+		}
+	}
+	for i, s := range binaryStrings {
+		exec("SET", s, binaryValue(s))
+		exec("HSET", binaryHash, s, binaryValue(s))
+		exec("RPUSH", binaryList, s)
+		exec("SADD", binarySet, s)
+		exec("ZADD", binaryZSet, strconv.Itoa(i), s)
+	}
+}
+
+// checkBinaryKeys checks that db holds what writeBinaryKeys stored, byte for
+// byte
+func checkBinaryKeys(t *testing.T, db *database.DB) {
+	t.Helper()
+	get := func(args ...string) [][]byte {
+		t.Helper()
+		cmdLine := make([][]byte, len(args))
+		for i, arg := range args {
+			cmdLine[i] = []byte(arg)
+		}
+		result, err := db.Exec(cmdLine)
+		if err != nil {
+			t.Fatalf("%q failed: %v", args, err)
+		}
+		return result
+	}
+
+	for i, s := range binaryStrings {
+		if got := get("GET", s); len(got) != 1 || string(got[0]) != binaryValue(s) {
+			t.Errorf("GET %q: expected %q, got %q", s, binaryValue(s), got)
+		}
+		if got := get("HGET", binaryHash, s); len(got) != 1 || string(got[0]) != binaryValue(s) {
+			t.Errorf("HGET %q: expected %q, got %q", s, binaryValue(s), got)
+		}
+		if got := get("SISMEMBER", binarySet, s); len(got) != 1 || string(got[0]) != "1" {
+			t.Errorf("SISMEMBER %q: expected 1, got %q", s, got)
+		}
+		if got := get("ZSCORE", binaryZSet, s); len(got) != 1 || string(got[0]) != strconv.Itoa(i) {
+			t.Errorf("ZSCORE %q: expected %d, got %q", s, i, got)
+		}
+	}
+	list := get("LRANGE", binaryList, "0", "-1")
+	if len(list) != len(binaryStrings) {
+		t.Fatalf("Expected %d list elements, got %q", len(binaryStrings), list)
+	}
+	for i, s := range binaryStrings {
+		if string(list[i]) != s {
+			t.Errorf("LINDEX %d: expected %q, got %q", i, s, list[i])
+		}
+	}
+}
+
+// delBinaryKeys returns the command deleting every key writeBinaryKeys stores
+func delBinaryKeys() [][]byte {
+	cmdLine := [][]byte{[]byte("DEL"), []byte(binaryHash), []byte(binaryList), []byte(binarySet), []byte(binaryZSet)}
+	for _, s := range binaryStrings {
+		cmdLine = append(cmdLine, []byte(s))
+	}
+	return cmdLine
+}
+
+// escapeGlob returns the pattern matching s only
+func escapeGlob(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if strings.IndexByte(`*?[]\`, s[i]) >= 0 {
+			b.WriteByte('\\')
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+func TestBinaryKeysMatchPatterns(t *testing.T) {
+	db := database.MakeDB()
+	defer db.Close()
+	writeBinaryKeys(t, MakeHandler(db))
+
+	keys := func(pattern string) []string {
+		t.Helper()
+		result, err := db.Exec([][]byte{[]byte("KEYS"), []byte(pattern)})
+		if err != nil {
+			t.Fatalf("KEYS %q failed: %v", pattern, err)
+		}
+		got := make([]string, len(result))
+		for i, key := range result {
+			got[i] = string(key)
+		}
+		return got
+	}
+
+	for _, s := range binaryStrings {
+		if got := keys(escapeGlob(s)); len(got) != 1 || got[0] != s {
+			t.Errorf("KEYS %q: expected only %q, got %q", escapeGlob(s), s, got)
+		}
+	}
+	if got := keys("*"); len(got) != len(binaryStrings)+4 {
+		t.Errorf("KEYS *: expected %d keys, got %d", len(binaryStrings)+4, len(got))
+	}
+
+	// Pattern elements match single bytes, whatever their value
+	for pattern, want := range map[string]int{
+		"*\r\n*":        4, // Three string keys and the hash
+		"*\x00*":        3, // Two string keys and the list
+		"?":             1, // "\x00"
+		"\xff*":         1,
+		"*[\xc0-\xff]*": 5,
+	} {
+		if got := keys(pattern); len(got) != want {
+			t.Errorf("KEYS %q: expected %d keys, got %q", pattern, want, got)
+		}
+	}
+}
+
+func TestBinaryKeysSurviveAOF(t *testing.T) {
+	db := database.MakeDB()
+	defer db.Close()
+	filename := filepath.Join(t.TempDir(), "appendonly.aof")
+	aofHandler, err := aof.MakeAOFHandler(filename, db)
+	if err != nil {
+		t.Fatalf("Failed to create AOF handler: %v", err)
+	}
+	defer aofHandler.Close()
+	writeBinaryKeys(t, MakeHandlerWithAOF(db, aofHandler))
+
+	load := func() {
+		t.Helper()
+		aofHandler.Flush()
+		loaded := database.MakeDB()
+		defer loaded.Close()
+		handler, err := aof.MakeAOFHandler(filename, loaded)
+		if err != nil {
+			t.Fatalf("Failed to load AOF: %v", err)
+		}
+		defer handler.Close()
+		checkBinaryKeys(t, loaded)
+	}
+
+	// Replaying the appended commands
+	load()
+
+	// Replaying the rewritten file
+	if err := aof.MakeRewriter(aofHandler, db).Rewrite(); err != nil {
+		t.Fatalf("Rewrite failed: %v", err)
+	}
+	load()
+}
+
+func TestBinaryKeysSurviveRDB(t *testing.T) {
+	db := database.MakeDB()
+	defer db.Close()
+	writeBinaryKeys(t, MakeHandler(db))
+
+	var buf bytes.Buffer
+	if err := rdb.SaveToWriter(db, &buf); err != nil {
+		t.Fatalf("SaveToWriter failed: %v", err)
+	}
+	loaded := database.MakeDB()
+	defer loaded.Close()
+	if err := rdb.LoadFromBytes(loaded, buf.Bytes()); err != nil {
+		t.Fatalf("LoadFromBytes failed: %v", err)
+	}
+	checkBinaryKeys(t, loaded)
+}
+
+// TestBinaryKeysReachSlaves syncs a slave with a master holding binary keys,
+// then writes more of them once the slave follows the master's stream
+func TestBinaryKeysReachSlaves(t *testing.T) {
+	replication.RegisterRDBLoader(&rdb.RDBLoaderImpl{})
+	defer replication.RegisterRDBLoader(nil)
+
+	master := database.MakeDB()
+	defer master.Close()
+	h := MakeHandler(master)
+	writeBinaryKeys(t, h)
+
+	slave := database.MakeDB()
+	defer slave.Close()
+	slave.SetReplicaMode(true)
+
+	masterEnd, slaveEnd := net.Pipe()
+	defer masterEnd.Close()
+	defer slaveEnd.Close()
+	slaveRS := replication.NewReplicationState()
+	slaveRS.SetAsSlave("master", 6379)
+	defer slaveRS.SetAsMaster()
+	slaveRS.SetDialer(func(addr string) (net.Conn, error) { return slaveEnd, nil })
+
+	// The mock master answers SYNC with a snapshot and then streams its writes
+	registered := make(chan struct{})
+	go func() {
+		defer close(registered)
+		if _, err := bufio.NewReader(masterEnd).ReadString('\n'); err != nil {
+			return
+		}
+		var snapshot bytes.Buffer
+		if err := rdb.SaveToWriter(master, &snapshot); err != nil {
+			return
+		}
+		if replication.State.SendFullResync(masterEnd, snapshot.Bytes()) == nil {
+			replication.State.RegisterSlave(masterEnd)
+		}
+	}()
+	defer replication.State.UnregisterSlave(masterEnd)
+
+	data, err := slaveRS.PerformFullSync()
+	if err != nil {
+		t.Fatalf("PerformFullSync failed: %v", err)
+	}
+	if err := replication.LoadRDBData(slave, data); err != nil {
+		t.Fatalf("Failed to load the snapshot: %v", err)
+	}
+	checkBinaryKeys(t, slave)
+
+	// Only the stream brings the keys back from now on
+	<-registered
+	if _, err := slave.Exec(delBinaryKeys()); err != nil {
+		t.Fatalf("DEL failed: %v", err)
+	}
+	if err := slaveRS.StartReplicationLoop(slave); err != nil {
+		t.Fatalf("StartReplicationLoop failed: %v", err)
+	}
+	if _, err := h.ExecCommand(delBinaryKeys()); err != nil {
+		t.Fatalf("DEL failed: %v", err)
+	}
+	writeBinaryKeys(t, h)
+
+	// The last write reaches the slave after all others
+	last := binaryStrings[len(binaryStrings)-1]
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		result, _ := slave.Exec([][]byte{[]byte("ZSCORE"), []byte(binaryZSet), []byte(last)})
+		if len(result) == 1 && result[0] != nil {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	checkBinaryKeys(t, slave)
+}
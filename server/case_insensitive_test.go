@@ -91,21 +91,23 @@ func TestProtocolCommands(t *testing.T) {
 		isInteger      bool
 		isStatus       bool
 	}{
-		{"set", "set", true, false, true},
-		{"SET", "SET", true, false, true},
-		{"SeT", "SeT", true, false, true},
+		{"set", "set", true, false, false},
+		{"SET", "SET", true, false, false},
+		{"SeT", "SeT", true, false, false},
+		{"mset", "mset", true, false, true},
+		{"MSet", "MSet", true, false, true},
 		{"get", "get", false, false, false},
 		{"GET", "GET", false, false, false},
 		{"del", "del", true, true, false},
 		{"DEL", "DEL", true, true, false},
 		{"incr", "incr", true, true, false},
 		{"INCR", "INCR", true, true, false},
-		{"hset", "hset", true, false, false},
-		{"HSET", "HSET", true, false, false},
-		{"lpush", "lpush", true, false, false},
-		{"LPUSH", "LPUSH", true, false, false},
-		{"sadd", "sadd", true, false, false},
-		{"SADD", "SADD", true, false, false},
+		{"hset", "hset", true, true, false},
+		{"HSET", "HSET", true, true, false},
+		{"lpush", "lpush", true, true, false},
+		{"LPUSH", "LPUSH", true, true, false},
+		{"sadd", "sadd", true, true, false},
+		{"SADD", "SADD", true, true, false},
 		{"zadd", "zadd", true, false, false},
 		{"ZADD", "ZADD", true, false, false},
 		{"ping", "ping", false, false, false},
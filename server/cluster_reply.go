@@ -0,0 +1,70 @@
+package server
+
+import (
+	"strconv"
+
+	"github.com/wangbo/gocache/protocol"
+	"github.com/wangbo/gocache/protocol/resp"
+)
+
+// clusterReply turns the flattened result of CLUSTER into nested arrays (see
+// database/cluster.go for the layouts):
+//
+//	CLUSTER SLOTS:   [[start, end, [host, port, id]], ...]
+//	CLUSTER SHARDS:  [["slots", [start, end, ...], "nodes", [[
+//	                     "id", id, "port", port, "ip", host, "endpoint", host,
+//	                     "role", "master", "replication-offset", 0,
+//	                     "health", "online"]]], ...]
+//	CLUSTER KEYSLOT: the slot
+//	CLUSTER MYID and INFO: a bulk string
+func clusterReply(cmdLine [][]byte, result [][]byte) resp.Reply {
+	if len(cmdLine) < 2 {
+		return resp.MakeMultiBulkReply(result)
+	}
+
+	switch protocol.ToUpper(string(cmdLine[1])) {
+	case "SLOTS":
+		ranges := make([]resp.Reply, 0, len(result)/5)
+		for ; len(result) >= 5; result = result[5:] {
+			ranges = append(ranges, resp.MakeArrayReply([]resp.Reply{
+				intReply(result[0]), intReply(result[1]),
+				resp.MakeArrayReply([]resp.Reply{resp.MakeBulkReply(result[2]), intReply(result[3]), resp.MakeBulkReply(result[4])}),
+			}))
+		}
+		return resp.MakeArrayReply(ranges)
+	case "SHARDS":
+		var shards []resp.Reply
+		for len(result) >= 4 {
+			id, host, port := result[0], result[1], result[2]
+			n, _ := strconv.Atoi(string(result[3]))
+			result = result[4:]
+			slots := make([]resp.Reply, 0, 2*n)
+			for ; n > 0 && len(result) >= 2; n, result = n-1, result[2:] {
+				slots = append(slots, intReply(result[0]), intReply(result[1]))
+			}
+			node := resp.MakeArrayReply([]resp.Reply{
+				resp.MakeBulkReply([]byte("id")), resp.MakeBulkReply(id),
+				resp.MakeBulkReply([]byte("port")), intReply(port),
+				resp.MakeBulkReply([]byte("ip")), resp.MakeBulkReply(host),
+				resp.MakeBulkReply([]byte("endpoint")), resp.MakeBulkReply(host),
+				resp.MakeBulkReply([]byte("role")), resp.MakeBulkReply([]byte("master")),
+				resp.MakeBulkReply([]byte("replication-offset")), resp.MakeIntReply(0),
+				resp.MakeBulkReply([]byte("health")), resp.MakeBulkReply([]byte("online")),
+			})
+			shards = append(shards, resp.MakeArrayReply([]resp.Reply{
+				resp.MakeBulkReply([]byte("slots")), resp.MakeArrayReply(slots),
+				resp.MakeBulkReply([]byte("nodes")), resp.MakeArrayReply([]resp.Reply{node}),
+			}))
+		}
+		return resp.MakeArrayReply(shards)
+	case "KEYSLOT":
+		if len(result) == 1 {
+			return intReply(result[0])
+		}
+	case "MYID", "INFO":
+		if len(result) == 1 {
+			return resp.MakeBulkReply(result[0])
+		}
+	}
+	return resp.MakeMultiBulkReply(result)
+}
@@ -0,0 +1,148 @@
+package server
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/wangbo/gocache/cluster"
+	"github.com/wangbo/gocache/config"
+	"github.com/wangbo/gocache/database"
+	"github.com/wangbo/gocache/replication"
+)
+
+// makeClusterHandler returns a handler for node a of a cluster where b
+// serves slots 8192-12999 and no node serves slots 13000 and up
+func makeClusterHandler(t *testing.T) (*Handler, *database.MultiState) {
+	t.Helper()
+	topology, err := cluster.NewTopology("a", []string{
+		"a 127.0.0.1:7000 0-8191",
+		"b 127.0.0.1:7001 8192-12999",
+	})
+	if err != nil {
+		t.Fatalf("NewTopology: %v", err)
+	}
+	db := database.MakeDBWithConfig(config.Default(), replication.NewReplicationState())
+	t.Cleanup(func() { db.Close() })
+	db.SetClusterTopology(topology)
+	return MakeHandler(db), database.NewMultiState(db)
+}
+
+// send runs a command on behalf of the connection of ms and returns its
+// reply
+func send(t *testing.T, h *Handler, ms *database.MultiState, args string) string {
+	t.Helper()
+	var cmdLine [][]byte
+	for _, arg := range strings.Fields(args) {
+		cmdLine = append(cmdLine, []byte(arg))
+	}
+	reply, err := h.ExecCommandWithState(ms, cmdLine)
+	if err != nil {
+		t.Fatalf("%s: %v", args, err)
+	}
+	return string(reply.ToBytes())
+}
+
+func TestClusterRedirects(t *testing.T) {
+	h, ms := makeClusterHandler(t)
+
+	tests := []struct {
+		args, reply string
+	}{
+		{"SET bar 1", "+OK\r\n"},                             // Slot 5061, served here
+		{"GET foo", "-MOVED 12182 127.0.0.1:7001\r\n"},       // Slot 12182
+		{"SET {foo}x 1", "-MOVED 12182 127.0.0.1:7001\r\n"},  // Hash tag
+		{"GET k11", "-CLUSTERDOWN Hash slot not served\r\n"}, // Slot 15180
+		{"MGET bar foo", "-CROSSSLOT Keys in the request don't hash to the same slot\r\n"},
+		{"DEL bar hello", "-CROSSSLOT Keys in the request don't hash to the same slot\r\n"}, // Both served here
+		{"MSET {user}a 1 {user}b 2", "+OK\r\n"},
+		{"MGET {user}a {user}b", "*2\r\n$1\r\n1\r\n$1\r\n2\r\n"},
+		{"SMOVE {foo}a bar x", "-CROSSSLOT Keys in the request don't hash to the same slot\r\n"},
+		{"KEYS *", "*3\r\n"}, // Keyless commands run anywhere
+		{"PING", "+PONG\r\n"},
+	}
+	for _, tt := range tests {
+		if reply := send(t, h, ms, tt.args); !strings.HasPrefix(reply, tt.reply) {
+			t.Errorf("%s: expected %q, got %q", tt.args, tt.reply, reply)
+		}
+	}
+}
+
+func TestClusterTransactionsStayInOneSlot(t *testing.T) {
+	h, ms := makeClusterHandler(t)
+
+	send(t, h, ms, "MULTI")
+	if reply := send(t, h, ms, "SET {user}a 1"); reply != "+QUEUED\r\n" {
+		t.Fatalf("Expected QUEUED, got %q", reply)
+	}
+	if reply := send(t, h, ms, "SET {user}b 1"); reply != "+QUEUED\r\n" {
+		t.Fatalf("Expected QUEUED, got %q", reply)
+	}
+	// bar is served here too, but not in the slot of {user}
+	if reply := send(t, h, ms, "SET bar 1"); !strings.HasPrefix(reply, "-CROSSSLOT") {
+		t.Errorf("Expected CROSSSLOT, got %q", reply)
+	}
+	if reply := send(t, h, ms, "EXEC"); !strings.HasPrefix(reply, "-") {
+		t.Errorf("Expected the transaction to be aborted, got %q", reply)
+	}
+	if reply := send(t, h, ms, "EXISTS {user}a bar"); reply != "-CROSSSLOT Keys in the request don't hash to the same slot\r\n" {
+		t.Errorf("Expected CROSSSLOT, got %q", reply)
+	}
+	if reply := send(t, h, ms, "EXISTS {user}a {user}b"); reply != ":0\r\n" {
+		t.Errorf("Expected nothing to be set, got %q", reply)
+	}
+
+	send(t, h, ms, "MULTI")
+	if reply := send(t, h, ms, "GET foo"); !strings.HasPrefix(reply, "-MOVED") {
+		t.Errorf("Expected MOVED, got %q", reply)
+	}
+	send(t, h, ms, "DISCARD")
+}
+
+func TestClusterCommand(t *testing.T) {
+	h, ms := makeClusterHandler(t)
+
+	tests := []struct {
+		args, reply string
+	}{
+		{"CLUSTER MYID", "$1\r\na\r\n"},
+		{"CLUSTER KEYSLOT {user}x", ":5474\r\n"},
+		{"CLUSTER SLOTS", "*2\r\n" +
+			"*3\r\n:0\r\n:8191\r\n*3\r\n$9\r\n127.0.0.1\r\n:7000\r\n$1\r\na\r\n" +
+			"*3\r\n:8192\r\n:12999\r\n*3\r\n$9\r\n127.0.0.1\r\n:7001\r\n$1\r\nb\r\n"},
+		{"CLUSTER SHARDS", "*2\r\n" +
+			"*4\r\n$5\r\nslots\r\n*2\r\n:0\r\n:8191\r\n$5\r\nnodes\r\n*1\r\n*14\r\n" +
+			"$2\r\nid\r\n$1\r\na\r\n$4\r\nport\r\n:7000\r\n$2\r\nip\r\n$9\r\n127.0.0.1\r\n" +
+			"$8\r\nendpoint\r\n$9\r\n127.0.0.1\r\n$4\r\nrole\r\n$6\r\nmaster\r\n" +
+			"$18\r\nreplication-offset\r\n:0\r\n$6\r\nhealth\r\n$6\r\nonline\r\n" +
+			"*4\r\n$5\r\nslots\r\n*2\r\n:8192\r\n:12999\r\n$5\r\nnodes\r\n*1\r\n*14\r\n" +
+			"$2\r\nid\r\n$1\r\nb\r\n$4\r\nport\r\n:7001\r\n$2\r\nip\r\n$9\r\n127.0.0.1\r\n" +
+			"$8\r\nendpoint\r\n$9\r\n127.0.0.1\r\n$4\r\nrole\r\n$6\r\nmaster\r\n" +
+			"$18\r\nreplication-offset\r\n:0\r\n$6\r\nhealth\r\n$6\r\nonline\r\n"},
+		{"CLUSTER NODES", "-ERR unknown subcommand or wrong number of arguments for 'NODES'. Try CLUSTER HELP.\r\n"},
+	}
+	for _, tt := range tests {
+		if reply := send(t, h, ms, tt.args); reply != tt.reply {
+			t.Errorf("%s: expected %q, got %q", tt.args, tt.reply, reply)
+		}
+	}
+
+	info := send(t, h, ms, "CLUSTER INFO")
+	for _, field := range []string{"cluster_state:fail", "cluster_slots_assigned:13000", "cluster_known_nodes:2", "cluster_size:2"} {
+		if !strings.Contains(info, field+"\r\n") {
+			t.Errorf("Expected %s in %q", field, info)
+		}
+	}
+}
+
+func TestClusterDisabled(t *testing.T) {
+	db := database.MakeDB()
+	defer db.Close()
+	h, ms := MakeHandler(db), database.NewMultiState(db)
+
+	if reply := send(t, h, ms, "CLUSTER INFO"); reply != "-ERR This instance has cluster support disabled\r\n" {
+		t.Errorf("Expected cluster support disabled, got %q", reply)
+	}
+	if reply := send(t, h, ms, "MGET bar foo"); !strings.HasPrefix(reply, "*2") {
+		t.Errorf("Expected keys of any slot to be served, got %q", reply)
+	}
+}
@@ -0,0 +1,69 @@
+package server
+
+import (
+	"github.com/wangbo/gocache/database"
+	"github.com/wangbo/gocache/protocol"
+)
+
+// Connection state
+//
+// A connection carries two pieces of state from one command to the next:
+// whether it authenticated, and its transaction and WATCH state. Each
+// command moves at most one of them:
+//
+//   - AUTH with the right password authenticates, and leaves a transaction
+//     queued by MULTI and the WATCHed keys as they are. A wrong password
+//     changes nothing: an authenticated connection stays so.
+//   - MULTI, EXEC, DISCARD, WATCH and UNWATCH change only the transaction
+//     state.
+//   - RESET brings both back to those of a new connection: no transaction,
+//     nothing watched, and unauthenticated if a password is required.
+//
+// Until it authenticates, a connection may only send AUTH and RESET (and
+// SYNC and PSYNC, see mayRun); anything else, SELECT and MULTI included, is
+// refused with NOAUTH. There is a single database, so no selected database
+// is kept: SELECT changes nothing and RESET has nothing to select.
+
+// connState is the state a connection carries between commands
+type connState struct {
+	authenticated bool
+	multiState    *database.MultiState // Transaction and WATCH state
+}
+
+// newConnState returns the state of a new connection. A client connecting
+// while no password is required is authenticated, and stays so if one is
+// set later, like in Redis.
+func newConnState(h *Handler) connState {
+	return connState{
+		authenticated: !h.authenticator.IsEnabled(),
+		multiState:    database.NewMultiState(h.db),
+	}
+}
+
+// mayRun reports whether the connection may run a command in its
+// authentication state. The authenticated flag is not checked again against
+// the password, which CONFIG SET may change. SYNC and PSYNC are let through
+// because slaves have no way to authenticate to their master.
+func (c *Client) mayRun(cmdUpper string) bool {
+	if c.state.authenticated || !c.server.handler.authenticator.IsEnabled() {
+		return true
+	}
+	switch cmdUpper {
+	case protocol.CmdAuth, protocol.CmdReset, protocol.CmdSync, protocol.CmdPSync:
+		return true
+	}
+	return false
+}
+
+// authenticate records the outcome of AUTH: only success changes the state
+func (c *Client) authenticate(ok bool) {
+	if ok {
+		c.state.authenticated = true
+	}
+}
+
+// reset returns the authentication state to that of a new connection once
+// RESET has cleared the transaction state
+func (c *Client) reset() {
+	c.state.authenticated = !c.server.handler.authenticator.IsEnabled()
+}
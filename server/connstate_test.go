@@ -0,0 +1,155 @@
+package server
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/wangbo/gocache/auth"
+	"github.com/wangbo/gocache/config"
+	"github.com/wangbo/gocache/database"
+)
+
+// readRawReply reads one reply, nested elements included, as it was sent
+func readRawReply(t *testing.T, r *bufio.Reader) string {
+	t.Helper()
+	line, err := r.ReadString('\n')
+	if err != nil {
+		t.Fatalf("Failed to read a reply: %v", err)
+	}
+	switch line[0] {
+	case '*':
+		n, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+		for i := 0; i < n; i++ {
+			line += readRawReply(t, r)
+		}
+	case '$':
+		if n, _ := strconv.Atoi(strings.TrimSpace(line[1:])); n >= 0 {
+			data := make([]byte, n+2)
+			if _, err := io.ReadFull(r, data); err != nil {
+				t.Fatalf("Failed to read a bulk string: %v", err)
+			}
+			line += string(data)
+		}
+	}
+	return line
+}
+
+func TestConnectionStateTransitions(t *testing.T) {
+	const noAuth = "-NOAUTH Authentication required.\r\n"
+	tests := []struct {
+		name     string
+		password string
+		steps    [][2]string // Command and the reply it gets
+	}{
+		{"only AUTH and RESET run before AUTH", "secret", [][2]string{
+			{"SELECT 0", noAuth},
+			{"MULTI", noAuth},
+			{"WATCH k", noAuth},
+			{"MONITOR", noAuth},
+			{"RESET", "+RESET\r\n"},
+			{"PING", noAuth},
+			{"AUTH secret", "+OK\r\n"},
+			{"PING", "+PONG\r\n"},
+		}},
+		{"AUTH keeps a queued transaction", "secret", [][2]string{
+			{"AUTH secret", "+OK\r\n"},
+			{"MULTI", "+OK\r\n"},
+			{"SET k v", "+QUEUED\r\n"},
+			{"AUTH secret", "+OK\r\n"},
+			{"EXEC", "*1\r\n+OK\r\n"},
+			{"GET k", "$1\r\nv\r\n"},
+		}},
+		{"AUTH keeps WATCHed keys", "secret", [][2]string{
+			{"AUTH secret", "+OK\r\n"},
+			{"WATCH k", "+OK\r\n"},
+			{"AUTH secret", "+OK\r\n"},
+			{"CLIENT LIST", "watch=1 "},
+		}},
+		{"a failed AUTH changes nothing", "secret", [][2]string{
+			{"AUTH wrong", "-ERR invalid password\r\n"},
+			{"PING", noAuth},
+			{"AUTH secret", "+OK\r\n"},
+			{"MULTI", "+OK\r\n"},
+			{"AUTH wrong", "-ERR invalid password\r\n"},
+			{"SET k v", "+QUEUED\r\n"},
+			{"EXEC", "*1\r\n+OK\r\n"},
+			{"PING", "+PONG\r\n"},
+		}},
+		{"SELECT after AUTH", "secret", [][2]string{
+			{"AUTH secret", "+OK\r\n"},
+			{"SELECT 0", "+OK\r\n"},
+			{"MULTI", "+OK\r\n"},
+			{"SELECT 0", "+QUEUED\r\n"},
+			{"EXEC", "*1\r\n+OK\r\n"},
+		}},
+		{"RESET returns to a new connection", "secret", [][2]string{
+			{"AUTH secret", "+OK\r\n"},
+			{"CLIENT NO-EVICT on", "+OK\r\n"},
+			{"WATCH k", "+OK\r\n"},
+			{"MULTI", "+OK\r\n"},
+			{"SET k v", "+QUEUED\r\n"},
+			{"RESET", "+RESET\r\n"},
+			{"GET k", noAuth},
+			{"AUTH secret", "+OK\r\n"},
+			{"EXEC", "-ERR EXEC without MULTI\r\n"},
+			{"GET k", "$-1\r\n"},
+			{"CLIENT LIST", "flags=N db=0 multi=-1 watch=0 "},
+		}},
+		{"RESET without a password stays authenticated", "", [][2]string{
+			{"MULTI", "+OK\r\n"},
+			{"RESET", "+RESET\r\n"},
+			{"PING", "+PONG\r\n"},
+			{"RESET extra", "-ERR wrong number of arguments for 'reset' command\r\n"},
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := database.MakeDB()
+			t.Cleanup(func() { db.Close() })
+			authenticator := auth.NewAuthenticator()
+			authenticator.SetPassword(tt.password)
+			cfg := config.Default()
+			cfg.Port = 0
+			srv := MakeServer(cfg, MakeHandlerWithAuth(db, nil, authenticator))
+			if err := srv.Listen(); err != nil {
+				t.Fatalf("Listen failed: %v", err)
+			}
+			go srv.Serve()
+			t.Cleanup(srv.Stop)
+
+			conn, err := net.Dial("tcp", srv.Addr().String())
+			if err != nil {
+				t.Fatalf("Dial: %v", err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(2 * time.Second))
+			reader := bufio.NewReader(conn)
+
+			for _, step := range tt.steps {
+				args := strings.Fields(step[0])
+				request := "*" + strconv.Itoa(len(args)) + "\r\n"
+				for _, arg := range args {
+					request += "$" + strconv.Itoa(len(arg)) + "\r\n" + arg + "\r\n"
+				}
+				conn.Write([]byte(request))
+				got := readRawReply(t, reader)
+				// CLIENT LIST is checked for the fields that show the state
+				if step[0] == "CLIENT LIST" {
+					if !strings.Contains(got, step[1]) {
+						t.Fatalf("%s: expected %q in %q", step[0], step[1], got)
+					}
+					continue
+				}
+				if got != step[1] {
+					t.Fatalf("%s: expected %q, got %q", step[0], step[1], got)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,54 @@
+package server
+
+import (
+	"strconv"
+
+	"github.com/wangbo/gocache/protocol"
+	"github.com/wangbo/gocache/protocol/resp"
+)
+
+// geoReply turns the flattened result of a GEO command into nested arrays
+// (see database/geo.go for the layouts):
+//
+//	GEOPOS:     [[longitude, latitude] or a null array, ...]
+//	GEOSEARCH:  [member, ...], or [[member, distance?, hash?, [longitude, latitude]?], ...]
+//	            with WITHDIST, WITHHASH or WITHCOORD
+func geoReply(cmdUpper string, cmdLine [][]byte, result [][]byte) resp.Reply {
+	if cmdUpper == protocol.CmdGeoPos {
+		positions := make([]resp.Reply, 0, len(result)/2)
+		for ; len(result) >= 2; result = result[2:] {
+			if result[0] == nil {
+				positions = append(positions, resp.MakeNullMultiBulkReply())
+				continue
+			}
+			positions = append(positions, resp.MakeMultiBulkReply(result[:2]))
+		}
+		return resp.MakeArrayReply(positions)
+	}
+
+	withDist, withHash, withCoord := hasOption(cmdLine, "WITHDIST"), hasOption(cmdLine, "WITHHASH"), hasOption(cmdLine, "WITHCOORD")
+	if !withDist && !withHash && !withCoord {
+		return resp.MakeMultiBulkReply(result)
+	}
+
+	matches := make([]resp.Reply, 0)
+	for len(result) > 0 {
+		item := []resp.Reply{resp.MakeBulkReply(result[0])}
+		result = result[1:]
+		if withDist && len(result) >= 1 {
+			item = append(item, resp.MakeBulkReply(result[0]))
+			result = result[1:]
+		}
+		if withHash && len(result) >= 1 {
+			hash, _ := strconv.ParseInt(string(result[0]), 10, 64)
+			item = append(item, resp.MakeIntReply(hash))
+			result = result[1:]
+		}
+		if withCoord && len(result) >= 2 {
+			item = append(item, resp.MakeMultiBulkReply(result[:2]))
+			result = result[2:]
+		}
+		matches = append(matches, resp.MakeArrayReply(item))
+	}
+	return resp.MakeArrayReply(matches)
+}
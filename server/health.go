@@ -0,0 +1,58 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// HTTP health probe
+//
+// Many orchestrators can only probe HTTP. With health-port set, the server
+// also listens there and answers GET /healthz with 200 OK when HEALTHCHECK
+// would reply +OK, and 503 with the failed conditions otherwise (see
+// database.DB.CheckHealth), and GET /metrics with the Prometheus metrics
+// (see serveMetrics). Any other path is 404.
+
+// healthPath is the path of the HTTP health probe
+const healthPath = "/healthz"
+
+// listenHealth binds the health-port on the first bind address, if set
+func (s *Server) listenHealth() error {
+	if s.config.HealthPort == 0 {
+		return nil
+	}
+	addr := net.JoinHostPort(s.config.BindAddrs()[0], strconv.Itoa(s.config.HealthPort))
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", addr, err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(healthPath, s.serveHealth)
+	mux.HandleFunc(metricsPath, s.serveMetrics)
+	s.healthListener = listener
+	s.health = &http.Server{Handler: mux}
+	return nil
+}
+
+// HealthAddr returns the address of the HTTP health probe, or nil if
+// health-port is not set
+func (s *Server) HealthAddr() net.Addr {
+	if s.healthListener == nil {
+		return nil
+	}
+	return s.healthListener.Addr()
+}
+
+// serveHealth answers a health probe
+func (s *Server) serveHealth(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if err := s.handler.db.CheckHealth(); err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, strings.TrimPrefix(err.Error(), "ERR "))
+		return
+	}
+	fmt.Fprintln(w, "OK")
+}
@@ -0,0 +1,317 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/wangbo/gocache/config"
+	"github.com/wangbo/gocache/database"
+	"github.com/wangbo/gocache/logger"
+	"github.com/wangbo/gocache/persistence/aof"
+	"github.com/wangbo/gocache/persistence/faultfs"
+	"github.com/wangbo/gocache/replication"
+)
+
+// startHealthServer starts a server with the HTTP health probe on free
+// loopback ports and returns its database, its handler and the probe URL
+func startHealthServer(t *testing.T, maxMemory int64) (*database.DB, *Handler, string) {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to find a free port: %v", err)
+	}
+	healthPort := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+
+	cfg := config.Default()
+	cfg.Bind, cfg.Port, cfg.HealthPort = "127.0.0.1", 0, healthPort
+	cfg.MaxMemory = maxMemory
+	db := database.MakeDBWithConfig(cfg, replication.NewReplicationState())
+	h := MakeHandler(db)
+	srv := MakeServer(cfg, h)
+	if err := srv.Listen(); err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	go srv.Serve()
+
+	t.Cleanup(func() {
+		srv.Stop()
+		db.Close()
+	})
+	return db, h, "http://" + srv.HealthAddr().String() + healthPath
+}
+
+// probe returns the replies of HEALTHCHECK and of the HTTP probe
+func probe(t *testing.T, h *Handler, url string) (string, int, string) {
+	t.Helper()
+	reply, err := h.ExecCommand([][]byte{[]byte("HEALTHCHECK")})
+	if err != nil {
+		t.Fatalf("HEALTHCHECK: %v", err)
+	}
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("GET %s: %v", url, err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return string(reply.ToBytes()), resp.StatusCode, strings.TrimSpace(string(body))
+}
+
+func TestHealthChecksFlipWithTheNodeState(t *testing.T) {
+	db, h, url := startHealthServer(t, 0)
+
+	healthy := func(when string) {
+		t.Helper()
+		if reply, code, body := probe(t, h, url); reply != "+OK\r\n" || code != http.StatusOK || body != "OK" {
+			t.Errorf("%s: expected healthy, got %q, %d %q", when, reply, code, body)
+		}
+	}
+	unhealthy := func(when, reason string) {
+		t.Helper()
+		reply, code, body := probe(t, h, url)
+		if reply != "-ERR unhealthy: "+reason+"\r\n" {
+			t.Errorf("%s: expected HEALTHCHECK to fail with %q, got %q", when, reason, reply)
+		}
+		if code != http.StatusServiceUnavailable || body != "unhealthy: "+reason {
+			t.Errorf("%s: expected 503 %q, got %d %q", when, reason, code, body)
+		}
+	}
+
+	healthy("at start")
+
+	db.StartLoading(100)
+	unhealthy("while loading", "loading the dataset")
+	db.StopLoading()
+	healthy("after loading")
+
+	db.RecordAOFWrite(errors.New("disk full"))
+	unhealthy("after a failed AOF write", "last AOF write failed")
+	db.RecordAOFWrite(nil)
+	healthy("after a successful AOF write")
+}
+
+func TestHealthChecksFailAboveMaxMemory(t *testing.T) {
+	db, h, url := startHealthServer(t, 1024)
+
+	if reply, code, _ := probe(t, h, url); reply != "+OK\r\n" || code != http.StatusOK {
+		t.Fatalf("Expected healthy under maxmemory, got %q, %d", reply, code)
+	}
+
+	// noeviction never brings the memory back under the limit
+	db.ExecCommand("SET", "big", strings.Repeat("x", 4096))
+	reply, code, body := probe(t, h, url)
+	if reply != "-ERR unhealthy: used memory above maxmemory\r\n" || code != http.StatusServiceUnavailable {
+		t.Errorf("Expected unhealthy above maxmemory, got %q, %d %q", reply, code, body)
+	}
+
+	// healthcheck-maxmemory no ignores the memory
+	db.Config().HealthCheckMaxMemory = false
+	if reply, code, _ := probe(t, h, url); reply != "+OK\r\n" || code != http.StatusOK {
+		t.Errorf("Expected healthy with healthcheck-maxmemory no, got %q, %d", reply, code)
+	}
+}
+
+func TestHealthProbeOnlyServesHealthz(t *testing.T) {
+	_, _, url := startHealthServer(t, 0)
+
+	resp, err := http.Get(strings.TrimSuffix(url, healthPath) + "/other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected 404, got %d", resp.StatusCode)
+	}
+}
+
+// TestAOFWriteFailureRecovers fills the disk under the AOF with the default
+// stop-writes-on-aof-error, and checks that writes are refused, and that the
+// writer recovers on its own once the disk has room, without a write to retry
+// it
+func TestAOFWriteFailureRecovers(t *testing.T) {
+	db := database.MakeDB()
+	defer db.Close()
+	filename := filepath.Join(t.TempDir(), "appendonly.aof")
+	fs := faultfs.New(nil)
+	aofHandler, err := aof.MakeAOFHandlerWithFS(filename, db, fs)
+	if err != nil {
+		t.Fatalf("Failed to create AOF handler: %v", err)
+	}
+	defer aofHandler.Close()
+	h := MakeHandlerWithAOF(db, aofHandler)
+	run := func(cmd string) string {
+		t.Helper()
+		var cmdLine [][]byte
+		for _, arg := range strings.Fields(cmd) {
+			cmdLine = append(cmdLine, []byte(arg))
+		}
+		reply, err := h.ExecCommand(cmdLine)
+		if err != nil {
+			t.Fatalf("%s: %v", cmd, err)
+		}
+		return string(reply.ToBytes())
+	}
+
+	fs.FailWritesAfter("appendonly.aof", 0, syscall.ENOSPC)
+	run("SET a 1")
+	aofHandler.Flush()
+	if info := run("INFO persistence"); !strings.Contains(info, "aof_last_write_status:err") || !strings.Contains(info, "aof_last_bgrewrite_status:ok") {
+		t.Errorf("Expected aof_last_write_status:err and aof_last_bgrewrite_status:ok, got %q", info)
+	}
+	if reply := run("SET b 2"); !strings.HasPrefix(reply, "-MISCONF Errors writing to the AOF file") {
+		t.Errorf("Expected the write to be refused by default, got %q", reply)
+	}
+
+	// The writer retries once a second, whether clients write or not
+	fs.Heal()
+	deadline := time.Now().Add(3 * time.Second)
+	for !strings.Contains(run("INFO persistence"), "aof_last_write_status:ok") {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the writer to recover once the disk has room")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if reply := run("SET b 2"); reply != "+OK\r\n" {
+		t.Errorf("Expected writes to resume, got %q", reply)
+	}
+
+	var keys []string
+	for _, cmd := range readAOF(t, aofHandler, filename) {
+		keys = append(keys, cmd[1])
+	}
+	if strings.Join(keys, " ") != "a b" {
+		t.Errorf("Expected the AOF to hold SET a and b, got %v", keys)
+	}
+}
+
+// TestAOFAddCommandErrorLogged checks that a command whose AOF write fails,
+// which with appendfsync always its client waits for, is replied to with the
+// error, which is logged and recorded as the last write status
+func TestAOFAddCommandErrorLogged(t *testing.T) {
+	var logs bytes.Buffer
+	logger.SetOutput(&logs)
+	defer logger.SetOutput(os.Stdout)
+
+	cfg := config.Default()
+	cfg.AppendFsync = "always"
+	db := database.MakeDBWithConfig(cfg, replication.NewReplicationState())
+	defer db.Close()
+	filename := filepath.Join(t.TempDir(), "appendonly.aof")
+	fs := faultfs.New(nil)
+	aofHandler, err := aof.MakeAOFHandlerWithFS(filename, db, fs)
+	if err != nil {
+		t.Fatalf("Failed to create AOF handler: %v", err)
+	}
+	defer aofHandler.Close()
+	h := MakeHandlerWithAOF(db, aofHandler)
+
+	fs.FailWritesAfter("appendonly.aof", 0, syscall.ENOSPC)
+	reply, err := h.ExecCommand([][]byte{[]byte("SET"), []byte("a"), []byte("1")})
+	if err != nil {
+		t.Fatalf("SET: %v", err)
+	}
+	if got := string(reply.ToBytes()); got != "-MISCONF Errors writing to the AOF file: no space left on device\r\n" {
+		t.Errorf("Expected the command to fail with the AOF error, got %q", got)
+	}
+	if got := logs.String(); !strings.Contains(got, "[ERROR] AOF write error: no space left on device") {
+		t.Errorf("Expected the error to be logged, got %q", got)
+	}
+	if db.Status().AOFLastWriteOK {
+		t.Error("Expected aof_last_write_status:err")
+	}
+}
+
+// TestAOFWriteFailure fills the disk under the AOF, and checks that INFO
+// reports it, that stop-writes-on-aof-error refuses writes until the AOF can
+// be written again, and that no command is lost meanwhile
+func TestAOFWriteFailure(t *testing.T) {
+	db := database.MakeDB()
+	defer db.Close()
+	filename := filepath.Join(t.TempDir(), "appendonly.aof")
+	fs := faultfs.New(nil)
+	aofHandler, err := aof.MakeAOFHandlerWithFS(filename, db, fs)
+	if err != nil {
+		t.Fatalf("Failed to create AOF handler: %v", err)
+	}
+	defer aofHandler.Close()
+	h := MakeHandlerWithAOF(db, aofHandler)
+	run := func(cmd string) string {
+		t.Helper()
+		var cmdLine [][]byte
+		for _, arg := range strings.Fields(cmd) {
+			cmdLine = append(cmdLine, []byte(arg))
+		}
+		reply, err := h.ExecCommand(cmdLine)
+		if err != nil {
+			t.Fatalf("%s: %v", cmd, err)
+		}
+		return string(reply.ToBytes())
+	}
+	writeStatus := func() string {
+		t.Helper()
+		info := run("INFO persistence")
+		if strings.Contains(info, "aof_last_write_status:ok") {
+			return "ok"
+		}
+		return "err"
+	}
+
+	run("CONFIG SET stop-writes-on-aof-error no")
+	run("SET a 1")
+	fs.FailWritesAfter("appendonly.aof", 5, syscall.ENOSPC)
+	if reply := run("SET b 2"); reply != "+OK\r\n" {
+		t.Errorf("Expected the write to succeed without stop-writes-on-aof-error, got %q", reply)
+	}
+	// The command is queued; its write fails once the writer gets to it
+	aofHandler.Flush()
+	if status := writeStatus(); status != "err" {
+		t.Errorf("Expected aof_last_write_status:err, got %s", status)
+	}
+
+	run("CONFIG SET stop-writes-on-aof-error yes")
+	if reply := run("SET c 3"); reply != "-MISCONF Errors writing to the AOF file: no space left on device\r\n" {
+		t.Errorf("Expected the write to be refused, got %q", reply)
+	}
+	if reply := run("GET a"); reply != "$1\r\n1\r\n" {
+		t.Errorf("Expected reads to be served, got %q", reply)
+	}
+
+	// Once the disk has room, the next write refused after the retry
+	// interval writes the pending command and is accepted
+	fs.Heal()
+	time.Sleep(time.Second + 100*time.Millisecond)
+	if reply := run("SET c 3"); reply != "+OK\r\n" {
+		t.Errorf("Expected the write to be accepted once the AOF is written, got %q", reply)
+	}
+	if status := writeStatus(); status != "ok" {
+		t.Errorf("Expected aof_last_write_status:ok, got %s", status)
+	}
+
+	var keys []string
+	for _, cmd := range readAOF(t, aofHandler, filename) {
+		keys = append(keys, cmd[1])
+	}
+	if strings.Join(keys, " ") != "a b c" {
+		t.Errorf("Expected the AOF to hold SET a, b and c, got %v", readAOF(t, aofHandler, filename))
+	}
+
+	// Once written, nothing is queued and the file holds every byte
+	info, _ := os.Stat(filename)
+	persistence := run("INFO persistence")
+	for _, want := range []string{"aof_buffer_length:0\r\n", "aof_current_size:" + strconv.FormatInt(info.Size(), 10) + "\r\n"} {
+		if !strings.Contains(persistence, want) {
+			t.Errorf("Expected %q in INFO persistence, got %q", want, persistence)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package server
+
+import (
+	"strconv"
+
+	"github.com/wangbo/gocache/protocol"
+	"github.com/wangbo/gocache/protocol/resp"
+)
+
+// latencyReply turns the flattened result of LATENCY into nested arrays
+// (see database/latency.go for the layouts):
+//
+//	LATENCY HISTORY:  [[time, latency], ...]
+//	LATENCY LATEST:   [[event, time, latest latency, max latency], ...]
+//	LATENCY RESET:    the number of events reset
+//	LATENCY HELP:     the help lines
+func latencyReply(cmdLine [][]byte, result [][]byte) resp.Reply {
+	if len(cmdLine) < 2 {
+		return resp.MakeMultiBulkReply(result)
+	}
+
+	switch protocol.ToUpper(string(cmdLine[1])) {
+	case "HISTORY":
+		samples := make([]resp.Reply, 0, len(result)/2)
+		for ; len(result) >= 2; result = result[2:] {
+			samples = append(samples, resp.MakeArrayReply([]resp.Reply{intReply(result[0]), intReply(result[1])}))
+		}
+		return resp.MakeArrayReply(samples)
+	case "LATEST":
+		events := make([]resp.Reply, 0, len(result)/4)
+		for ; len(result) >= 4; result = result[4:] {
+			events = append(events, resp.MakeArrayReply([]resp.Reply{
+				resp.MakeBulkReply(result[0]), intReply(result[1]), intReply(result[2]), intReply(result[3]),
+			}))
+		}
+		return resp.MakeArrayReply(events)
+	case "RESET":
+		if len(result) == 1 {
+			return intReply(result[0])
+		}
+	}
+	return resp.MakeMultiBulkReply(result)
+}
+
+// intReply returns an integer reply from a decimal result
+func intReply(b []byte) resp.Reply {
+	n, _ := strconv.ParseInt(string(b), 10, 64)
+	return resp.MakeIntReply(n)
+}
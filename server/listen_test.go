@@ -0,0 +1,144 @@
+package server
+
+import (
+	"bufio"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/wangbo/gocache/config"
+	"github.com/wangbo/gocache/database"
+)
+
+// serveOn starts a server listening on bind at port 0 and returns it with
+// the channel Serve returns on
+func serveOn(t *testing.T, bind string) (*Server, *database.DB, chan error) {
+	t.Helper()
+	db := database.MakeDB()
+	t.Cleanup(func() { db.Close() })
+	cfg := config.Default()
+	cfg.Bind, cfg.Port = bind, 0
+	srv := MakeServer(cfg, MakeHandler(db))
+	if err := srv.Listen(); err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve() }()
+	t.Cleanup(srv.Stop)
+	return srv, db, served
+}
+
+// ping sends PING to addr and returns the reply line
+func ping(t *testing.T, addr string) string {
+	t.Helper()
+	conn, err := net.DialTimeout("tcp", addr, time.Second)
+	if err != nil {
+		t.Fatalf("Failed to connect to %s: %v", addr, err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Write([]byte("*1\r\n$4\r\nPING\r\n")); err != nil {
+		t.Fatalf("Failed to send PING to %s: %v", addr, err)
+	}
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatalf("Failed to read the reply from %s: %v", addr, err)
+	}
+	return line
+}
+
+func TestListenOnPortZero(t *testing.T) {
+	srv, db, _ := serveOn(t, "127.0.0.1")
+
+	addr, ok := srv.Addr().(*net.TCPAddr)
+	if !ok || addr.Port == 0 {
+		t.Fatalf("Expected Addr to hold the port picked by the system, got %v", srv.Addr())
+	}
+	if reply := ping(t, addr.String()); reply != "+PONG\r\n" {
+		t.Errorf("Expected +PONG, got %q", reply)
+	}
+
+	result, err := db.ExecCommand("INFO", "server")
+	if err != nil {
+		t.Fatalf("INFO failed: %v", err)
+	}
+	want := "tcp_port:" + strconv.Itoa(addr.Port) + "\r\n"
+	if !strings.Contains(string(result[0]), want) {
+		t.Errorf("Expected INFO to report %q, got %q", want, result[0])
+	}
+}
+
+func TestListenOnEveryBindAddress(t *testing.T) {
+	// 127.0.0.2 is a loopback address on Linux but not everywhere
+	probe, err := net.Listen("tcp", "127.0.0.2:0")
+	if err != nil {
+		t.Skipf("127.0.0.2 is not available: %v", err)
+	}
+	probe.Close()
+
+	srv, _, served := serveOn(t, "127.0.0.1 127.0.0.2")
+	addrs := srv.Addrs()
+	if len(addrs) != 2 {
+		t.Fatalf("Expected 2 listeners, got %v", addrs)
+	}
+	port := addrs[0].(*net.TCPAddr).Port
+	for i, host := range []string{"127.0.0.1", "127.0.0.2"} {
+		addr := addrs[i].(*net.TCPAddr)
+		if addr.IP.String() != host || addr.Port != port {
+			t.Errorf("Expected listener %d on %s:%d, got %v", i, host, port, addr)
+		}
+		if reply := ping(t, addr.String()); reply != "+PONG\r\n" {
+			t.Errorf("Expected +PONG from %s, got %q", addr, reply)
+		}
+	}
+
+	srv.Stop()
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Errorf("Expected Serve to return nil after Stop, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Serve did not return after Stop")
+	}
+	for _, addr := range addrs {
+		if conn, err := net.DialTimeout("tcp", addr.String(), time.Second); err == nil {
+			conn.Close()
+			t.Errorf("Expected %s to be closed after Stop", addr)
+		}
+	}
+}
+
+func TestListenFailureClosesBoundAddresses(t *testing.T) {
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer busy.Close()
+	port := strconv.Itoa(busy.Addr().(*net.TCPAddr).Port)
+
+	// 127.0.0.2 is bound first, then 127.0.0.1 fails and 127.0.0.2 must be
+	// released
+	probe, err := net.Listen("tcp", net.JoinHostPort("127.0.0.2", port))
+	if err != nil {
+		t.Skipf("127.0.0.2 is not available: %v", err)
+	}
+	probe.Close()
+
+	db := database.MakeDB()
+	defer db.Close()
+	cfg := config.Default()
+	cfg.Bind, cfg.Port = "127.0.0.2 127.0.0.1", busy.Addr().(*net.TCPAddr).Port
+	srv := MakeServer(cfg, MakeHandler(db))
+	if err := srv.Listen(); err == nil {
+		srv.Stop()
+		t.Fatal("Expected Listen to fail on a busy address")
+	}
+	l, err := net.Listen("tcp", net.JoinHostPort("127.0.0.2", port))
+	if err != nil {
+		t.Fatalf("Expected 127.0.0.2 to be released, got %v", err)
+	}
+	l.Close()
+}
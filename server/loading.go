@@ -0,0 +1,71 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+
+	"github.com/wangbo/gocache/config"
+	"github.com/wangbo/gocache/database"
+	"github.com/wangbo/gocache/persistence"
+	"github.com/wangbo/gocache/persistence/aof"
+)
+
+// LoadDataset loads the dataset saved in the files of cfg, in its dir, as the
+// server does on startup: with appendonly the AOF is replayed if it exists and is
+// not empty, otherwise the RDB file is loaded if it exists. Clients are
+// refused with LOADING until it returns, so it is called once the server
+// listens.
+//
+// With appendonly, the AOF handler is opened and returned, and commands are
+// appended to it from then on. An AOF created from a loaded RDB file is
+// rewritten from the dataset first, so that the next start does not lose it.
+func (h *Handler) LoadDataset(cfg *config.Properties) (*aof.AOFHandler, error) {
+	aofFile, rdbFile := cfg.DataPath(cfg.AppendFilename), ""
+	if info, err := os.Stat(aofFile); cfg.AppendOnly && err == nil && info.Size() > 0 {
+		fmt.Printf("Loading AOF %s (%d bytes)\n", aofFile, info.Size())
+		h.db.StartLoading(info.Size())
+	} else if info, err := os.Stat(cfg.DataPath(cfg.DBFilename)); err == nil {
+		rdbFile = cfg.DataPath(cfg.DBFilename)
+		fmt.Printf("Loading RDB %s (%d bytes)\n", rdbFile, info.Size())
+		h.db.StartLoading(info.Size())
+	}
+	// Until the AOF receives the commands, no client may write
+	defer h.db.StopLoading()
+
+	if rdbFile != "" {
+		if err := loadRDBFile(h.db, rdbFile); err != nil {
+			return nil, fmt.Errorf("failed to load RDB %s: %w", rdbFile, err)
+		}
+	}
+	if !cfg.AppendOnly {
+		return nil, nil
+	}
+
+	aofHandler, err := aof.MakeAOFHandler(aofFile, h.db)
+	if err != nil {
+		return nil, err
+	}
+	if rdbFile != "" {
+		if err := aof.MakeRewriter(aofHandler, h.db).Rewrite(); err != nil {
+			aofHandler.Close()
+			return nil, fmt.Errorf("failed to write the loaded dataset to the AOF: %w", err)
+		}
+	}
+	h.aof = aofHandler
+	return aofHandler, nil
+}
+
+// loadRDBFile replaces the keys of db with those of an RDB file
+func loadRDBFile(db *database.DB, filename string) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(db.LoadingReader(file))
+	return db.ReplaceDataset(func(staging *database.DB) error {
+		return persistence.LoadDatabaseFromReader(staging, reader)
+	})
+}
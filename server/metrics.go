@@ -0,0 +1,43 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// Prometheus metrics
+//
+// With health-port set, GET /metrics on the same listener serves the
+// command and network counters of INFO stats, and their instantaneous
+// rates, in the Prometheus text format. With appendonly, it also serves the
+// bytes queued for the AOF and written to it.
+
+// metricsPath is the path of the Prometheus metrics
+const metricsPath = "/metrics"
+
+// serveMetrics writes the metrics in the Prometheus text format
+func (s *Server) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	stats := s.handler.db.TrafficStats()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	type metric struct {
+		name, kind, help string
+		value            float64
+	}
+	metrics := []metric{
+		{"gocache_commands_processed_total", "counter", "Commands processed", float64(stats.TotalCommands)},
+		{"gocache_net_input_bytes_total", "counter", "Bytes read from client connections", float64(stats.NetInputBytes)},
+		{"gocache_net_output_bytes_total", "counter", "Bytes written to client connections", float64(stats.NetOutputBytes)},
+		{"gocache_instantaneous_ops_per_sec", "gauge", "Commands per second over the last samples", stats.OpsPerSec},
+		{"gocache_instantaneous_input_kbps", "gauge", "KB read per second over the last samples", stats.InputKbps},
+		{"gocache_instantaneous_output_kbps", "gauge", "KB written per second over the last samples", stats.OutputKbps},
+	}
+	if aof, ok := s.handler.db.AOFStats(); ok {
+		metrics = append(metrics,
+			metric{"gocache_aof_buffer_length_bytes", "gauge", "Bytes queued for the AOF and not written yet", float64(aof.BufferLength)},
+			metric{"gocache_aof_written_bytes_total", "counter", "Bytes written to the AOF", float64(aof.WrittenBytes)},
+		)
+	}
+	for _, m := range metrics {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %g\n", m.name, m.help, m.name, m.kind, m.name, m.value)
+	}
+}
@@ -0,0 +1,111 @@
+package server
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestNetworkCountersCountEveryConnection checks that the network counters
+// of INFO stats add up to the bytes the clients sent and read, the feed of
+// a MONITOR client included
+func TestNetworkCountersCountEveryConnection(t *testing.T) {
+	_, db, port := startTestServer(t)
+	addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+	base := db.TrafficStats()
+
+	var sent, read int
+	dial := func() (net.Conn, *bufio.Reader) {
+		t.Helper()
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("Dial: %v", err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		conn.SetDeadline(time.Now().Add(2 * time.Second))
+		return conn, bufio.NewReader(conn)
+	}
+	send := func(conn net.Conn, request string) {
+		t.Helper()
+		if _, err := io.WriteString(conn, request); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+		sent += len(request)
+	}
+	readLine := func(r *bufio.Reader) string {
+		t.Helper()
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Read: %v", err)
+		}
+		read += len(line)
+		return line
+	}
+
+	client, clientReader := dial()
+	send(client, "*1\r\n$4\r\nPING\r\n")
+	readLine(clientReader)
+
+	monitor, monitorReader := dial()
+	send(monitor, "*1\r\n$7\r\nMONITOR\r\n")
+	readLine(monitorReader)
+	readLine(monitorReader)
+
+	send(client, "*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$1\r\nv\r\n")
+	readLine(clientReader)
+	if line := readLine(monitorReader); !strings.Contains(line, "SET k v") {
+		t.Fatalf("Expected the SET in the MONITOR feed, got %q", line)
+	}
+
+	// The server counts a write once it returns, which may be after the
+	// client read it
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		stats := db.TrafficStats()
+		in, out := int(stats.NetInputBytes-base.NetInputBytes), int(stats.NetOutputBytes-base.NetOutputBytes)
+		if in == sent && out == read {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %d bytes in and %d out, got %d and %d", sent, read, in, out)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	db, _, url := startHealthServer(t, 0)
+	db.RecordCommand("GET", 0, false)
+	db.RecordNetInput(100)
+	db.RecordNetOutput(250)
+
+	resp, err := http.Get(strings.TrimSuffix(url, healthPath) + metricsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", resp.StatusCode)
+	}
+	for _, want := range []string{
+		"# TYPE gocache_commands_processed_total counter\ngocache_commands_processed_total 1\n",
+		"gocache_net_input_bytes_total 100\n",
+		"gocache_net_output_bytes_total 250\n",
+		"# TYPE gocache_instantaneous_ops_per_sec gauge\n",
+		"gocache_instantaneous_input_kbps ",
+		"gocache_instantaneous_output_kbps ",
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("Expected %q in the metrics, got:\n%s", want, body)
+		}
+	}
+	if strings.Contains(string(body), "gocache_aof_") {
+		t.Errorf("Expected no AOF metrics without an AOF, got:\n%s", body)
+	}
+}
@@ -0,0 +1,193 @@
+package server
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/wangbo/gocache/config"
+	"github.com/wangbo/gocache/database"
+)
+
+// startTestServer starts a server on a free loopback port and returns it
+// together with its database and port
+func startTestServer(t *testing.T) (*Server, *database.DB, int) {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to find a free port: %v", err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+
+	db := database.MakeDB()
+	cfg := config.Default()
+	cfg.Bind, cfg.Port = "127.0.0.1", port
+	srv := MakeServer(cfg, MakeHandler(db))
+	go srv.Start()
+
+	addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			conn.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Server did not start: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Cleanup(func() {
+		srv.Stop()
+		db.Close()
+	})
+	return srv, db, port
+}
+
+func TestMigrateAllTypes(t *testing.T) {
+	_, target, port := startTestServer(t)
+	portStr := strconv.Itoa(port)
+
+	source := database.MakeDB()
+	defer source.Close()
+
+	source.ExecCommand("SET", "str", "hello")
+	source.ExecCommand("PEXPIRE", "str", "100000")
+	source.ExecCommand("HSET", "hash", "field", "value")
+	source.ExecCommand("RPUSH", "list", "a", "b", "c")
+	source.ExecCommand("SADD", "set", "x", "y")
+	source.ExecCommand("ZADD", "zset", "1.5", "one", "2", "two")
+
+	for _, key := range []string{"str", "hash", "list", "set", "zset"} {
+		result, err := source.ExecCommand("MIGRATE", "127.0.0.1", portStr, key, "0", "1000")
+		if err != nil {
+			t.Fatalf("MIGRATE %s failed: %v", key, err)
+		}
+		if string(result[0]) != "OK" {
+			t.Errorf("MIGRATE %s: expected OK, got %s", key, result[0])
+		}
+		if source.Exists(key) {
+			t.Errorf("Source key %s should be deleted after MIGRATE", key)
+		}
+	}
+
+	checks := [][]string{
+		{"GET", "str", "hello"},
+		{"HGET", "hash", "field", "value"},
+		{"LINDEX", "list", "2", "c"},
+		{"SISMEMBER", "set", "y", "1"},
+		{"ZSCORE", "zset", "one", "1.5"},
+	}
+	for _, check := range checks {
+		args, want := check[1:len(check)-1], check[len(check)-1]
+		result, err := target.ExecCommand(check[0], args...)
+		if err != nil || len(result) == 0 || string(result[0]) != want {
+			t.Errorf("%v on target: expected %s, got %v (%v)", check[:len(check)-1], want, result, err)
+		}
+	}
+
+	if ttl := target.TTL("str"); ttl <= 90*time.Second || ttl > 100*time.Second {
+		t.Errorf("Expected TTL close to 100s on target, got %v", ttl)
+	}
+	if ttl := target.TTL("hash"); ttl != -1 {
+		t.Errorf("Expected no TTL on target hash, got %v", ttl)
+	}
+}
+
+func TestMigrateCopyAndReplace(t *testing.T) {
+	_, target, port := startTestServer(t)
+	portStr := strconv.Itoa(port)
+
+	source := database.MakeDB()
+	defer source.Close()
+
+	source.ExecCommand("SET", "key", "source")
+	target.ExecCommand("SET", "key", "target")
+
+	// Without REPLACE an existing target key is left alone
+	if _, err := source.ExecCommand("MIGRATE", "127.0.0.1", portStr, "key", "0", "1000"); err == nil {
+		t.Error("Expected BUSYKEY error when target key exists")
+	}
+	if result, _ := target.ExecCommand("GET", "key"); string(result[0]) != "target" {
+		t.Errorf("Target key should be unchanged, got %s", result[0])
+	}
+
+	// COPY REPLACE overwrites the target and keeps the source
+	if _, err := source.ExecCommand("MIGRATE", "127.0.0.1", portStr, "key", "0", "1000", "COPY", "REPLACE"); err != nil {
+		t.Fatalf("MIGRATE COPY REPLACE failed: %v", err)
+	}
+	if result, _ := target.ExecCommand("GET", "key"); string(result[0]) != "source" {
+		t.Errorf("Expected target to be replaced, got %s", result[0])
+	}
+	if !source.Exists("key") {
+		t.Error("Source key should be kept with COPY")
+	}
+
+	// A missing key is reported as NOKEY
+	result, err := source.ExecCommand("MIGRATE", "127.0.0.1", portStr, "missing", "0", "1000")
+	if err != nil || string(result[0]) != "NOKEY" {
+		t.Errorf("Expected NOKEY, got %v (%v)", result, err)
+	}
+}
+
+func TestMigrateConnectionFailureKeepsSource(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to find a free port: %v", err)
+	}
+	port := strconv.Itoa(listener.Addr().(*net.TCPAddr).Port)
+	listener.Close()
+
+	source := database.MakeDB()
+	defer source.Close()
+	source.ExecCommand("SET", "key", "value")
+
+	_, err = source.ExecCommand("MIGRATE", "127.0.0.1", port, "key", "0", "200")
+	if err == nil || !strings.HasPrefix(err.Error(), "IOERR") {
+		t.Errorf("Expected IOERR, got %v", err)
+	}
+	if result, _ := source.ExecCommand("GET", "key"); string(result[0]) != "value" {
+		t.Error("Source key should be untouched after a failed MIGRATE")
+	}
+}
+
+func TestMigrateTimeoutKeepsSource(t *testing.T) {
+	// A target that accepts connections but never replies
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	port := strconv.Itoa(listener.Addr().(*net.TCPAddr).Port)
+
+	source := database.MakeDB()
+	defer source.Close()
+	source.ExecCommand("SET", "key", "value")
+
+	start := time.Now()
+	_, err = source.ExecCommand("MIGRATE", "127.0.0.1", port, "key", "0", "100")
+	if err == nil || !strings.HasPrefix(err.Error(), "IOERR") {
+		t.Errorf("Expected IOERR, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("MIGRATE did not honour its timeout, took %v", elapsed)
+	}
+	if !source.Exists("key") {
+		t.Error("Source key should be untouched after a timed out MIGRATE")
+	}
+}
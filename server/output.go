@@ -0,0 +1,62 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"net"
+
+	"github.com/wangbo/gocache/database"
+)
+
+// errOutputBufferLimit closes a connection whose reply exceeds the hard
+// client-output-buffer-limit of the normal class
+var errOutputBufferLimit = errors.New("reply exceeds client-output-buffer-limit")
+
+// meteredConn counts the bytes a client connection receives and sends, for
+// CLIENT LIST and the network counters of INFO stats. It wraps the
+// connection before any command is read, so replicas and MONITOR clients
+// are counted too.
+type meteredConn struct {
+	net.Conn
+	client *database.ClientInfo
+	db     *database.DB
+}
+
+func (c *meteredConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.client.AddBytesIn(n)
+	c.db.RecordNetInput(n)
+	return n, err
+}
+
+func (c *meteredConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.client.AddBytesOut(n)
+	c.db.RecordNetOutput(n)
+	return n, err
+}
+
+// replyLimiter writes the replies to a client, refusing to write a reply
+// longer than limit unless the client is exempt by CLIENT NO-EVICT. Like the
+// output buffer of Redis, which holds a whole reply, the limit applies to
+// each reply, however fast the client reads it.
+type replyLimiter struct {
+	w       io.Writer
+	client  *database.ClientInfo
+	limit   int64 // 0 for no limit
+	written int64 // Bytes of the current reply
+}
+
+func (l *replyLimiter) Write(p []byte) (int, error) {
+	if l.limit > 0 && l.written+int64(len(p)) > l.limit && !l.client.NoEvict() {
+		return 0, errOutputBufferLimit
+	}
+	n, err := l.w.Write(p)
+	l.written += int64(n)
+	return n, err
+}
+
+// reset starts a new reply
+func (l *replyLimiter) reset() {
+	l.written = 0
+}
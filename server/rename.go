@@ -0,0 +1,47 @@
+package server
+
+import "github.com/wangbo/gocache/protocol"
+
+// Renamed commands
+//
+// rename-command gives a command another name, or none to disable it, as in
+// redis.conf. Renames only apply to what clients send: the name a client
+// uses is mapped to the command's canonical name as soon as the command is
+// read, so that everything past the connection, the AOF and the replication
+// stream included, only sees canonical names. An AOF written with renames
+// loads into a server without them, and masters and replicas need not agree
+// on renames.
+
+// commandRenames maps the command names clients send to canonical ones
+type commandRenames struct {
+	canonical map[string]string // New upper-case name to canonical name
+	hidden    map[string]bool   // Canonical names clients can no longer use
+}
+
+// newCommandRenames builds the mapping of the rename-command directives
+func newCommandRenames(renames map[string]string) *commandRenames {
+	r := &commandRenames{canonical: make(map[string]string), hidden: make(map[string]bool)}
+	for name, newName := range renames {
+		r.hidden[name] = true
+		if newName != "" {
+			r.canonical[protocol.ToUpper(newName)] = name
+		}
+	}
+	return r
+}
+
+// resolve returns cmdLine with the command under its canonical name, or
+// false if clients can not run it under the name they sent
+func (r *commandRenames) resolve(cmdLine [][]byte) ([][]byte, bool) {
+	if len(r.canonical) == 0 && len(r.hidden) == 0 {
+		return cmdLine, true
+	}
+	name := protocol.ToUpper(string(cmdLine[0]))
+	if canonical, ok := r.canonical[name]; ok {
+		resolved := make([][]byte, len(cmdLine))
+		copy(resolved, cmdLine)
+		resolved[0] = []byte(canonical)
+		return resolved, true
+	}
+	return cmdLine, !r.hidden[name]
+}
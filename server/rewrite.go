@@ -0,0 +1,170 @@
+package server
+
+import (
+	"bytes"
+	"strconv"
+
+	"github.com/wangbo/gocache/database"
+	"github.com/wangbo/gocache/protocol"
+)
+
+// propagationCommands returns the commands to write to the AOF and send to
+// slaves for a command that modified the keyspace (see MultiState.Dirty), or
+// nil if nothing is left to propagate.
+//
+// Relative expirations (EXPIRE, PEXPIRE, SET ... EX) are rewritten to
+// PEXPIREAT with the absolute time the master computed, so replaying them a
+// second later on a slave or after an AOF reload yields the same expiry.
+// The HEXPIRE family is rewritten per field the same way, to HPEXPIREAT or
+// HDEL. XADD with a generated ID ("*" or "ms-*") is propagated with the ID
+// the master generated, and XREADGROUP without its BLOCK option. XCLAIM and
+// XAUTOCLAIM depend on idle times, so they are propagated as the state of
+// the pending entries they may have claimed. MIGRATE is propagated as a DEL of the migrated key.
+// BLPOP and BRPOP are propagated as the LPOP or RPOP their result shows
+// they served, so that they never block a slave or an AOF load. SPOP is
+// propagated as the SREM of the members it picked at random. SET with NX or
+// XX is dropped when its condition left the key alone, and SET KEEPTTL is
+// propagated as is, so that a slave keeps the TTL it got from the master.
+//
+// What a TTL-touching command did, rather than how it was written, decides
+// what is propagated. An EXPIRE-family command whose NX, XX, GT or LT option
+// refused the new expiry changed nothing and is not propagated at all (see
+// MultiState.Dirty); otherwise its options are dropped along with the
+// relative time. GETEX is a read on a slave: it is propagated as the
+// PEXPIREAT or DEL its expiry option led to, or as PERSIST if PERSIST
+// removed a TTL, and not at all otherwise.
+func (h *Handler) propagationCommands(cmdUpper string, cmdLine [][]byte, result database.Result) [][][]byte {
+	switch cmdUpper {
+	case protocol.CmdBLPop, protocol.CmdBRPop:
+		if pop := database.ServedPopCommand(cmdLine, resultLines(result)); pop != nil {
+			return [][][]byte{pop}
+		}
+		return nil
+	case protocol.CmdSPop:
+		if srem := database.PoppedMembersCommand(cmdLine, resultLines(result)); srem != nil {
+			return [][][]byte{srem}
+		}
+		return nil
+	case protocol.CmdExpire, protocol.CmdPExpire, protocol.CmdExpireAt, protocol.CmdPExpireAt:
+		if len(cmdLine) < 2 {
+			return nil
+		}
+		return h.expiryCommands(cmdLine[1])
+	case protocol.CmdGetEx:
+		switch {
+		case len(cmdLine) < 3:
+			return nil
+		case protocol.ToUpper(string(cmdLine[2])) == "PERSIST":
+			return [][][]byte{{[]byte(protocol.CmdPersist), cmdLine[1]}}
+		}
+		return h.expiryCommands(cmdLine[1])
+	case protocol.CmdSet:
+		if !database.SetApplied(cmdLine, resultLines(result)) {
+			return nil
+		}
+		if len(cmdLine) > 3 && hasRelativeSetExpiry(cmdLine[3:]) {
+			set := [][]byte{cmdLine[0], cmdLine[1], cmdLine[2]}
+			return append([][][]byte{set}, h.expiryCommands(cmdLine[1])...)
+		}
+	case protocol.CmdHExpire, protocol.CmdHPExpire, protocol.CmdHExpireAt, protocol.CmdHPExpireAt:
+		return h.fieldExpiryCommands(cmdLine)
+	case protocol.CmdXAdd:
+		return h.streamAddCommands(cmdLine)
+	case protocol.CmdXReadGroup:
+		return [][][]byte{database.StripBlockOption(cmdLine)}
+	case protocol.CmdXClaim, protocol.CmdXAutoClaim:
+		return h.db.StreamClaimCommands(cmdLine)
+	case protocol.CmdMigrate:
+		if len(cmdLine) < 4 || h.db.Exists(string(cmdLine[3])) {
+			return nil
+		}
+		return [][][]byte{{[]byte(protocol.CmdDel), cmdLine[3]}}
+	}
+
+	return [][][]byte{cmdLine}
+}
+
+// resultLines returns the lines of the result of a command, nil for none.
+// Only the commands whose propagation depends on their result ask for them.
+func resultLines(result database.Result) [][]byte {
+	if result == nil {
+		return nil
+	}
+	return result.Lines()
+}
+
+// expiryCommands returns the command that brings a slave to the key's
+// current expiry state: PEXPIREAT if it has a TTL, DEL if it is gone
+func (h *Handler) expiryCommands(key []byte) [][][]byte {
+	if expireAt, ok := h.db.ExpireTime(string(key)); ok {
+		ms := strconv.FormatInt(expireAt.UnixMilli(), 10)
+		return [][][]byte{{[]byte(protocol.CmdPExpireAt), key, []byte(ms)}}
+	}
+	if !h.db.Exists(string(key)) {
+		return [][][]byte{{[]byte(protocol.CmdDel), key}}
+	}
+	return nil
+}
+
+// fieldExpiryCommands returns the commands that bring a slave to the current
+// expiry state of the fields named by an HEXPIRE-family command: HPEXPIREAT
+// for fields with a TTL, HDEL for fields that are gone, or DEL if the whole
+// key is gone
+func (h *Handler) fieldExpiryCommands(cmdLine [][]byte) [][][]byte {
+	if len(cmdLine) < 5 {
+		return nil
+	}
+	key := cmdLine[1]
+	if !h.db.Exists(string(key)) {
+		return [][][]byte{{[]byte(protocol.CmdDel), key}}
+	}
+
+	// The field names follow FIELDS numfields
+	var fields [][]byte
+	for i := 2; i+1 < len(cmdLine); i++ {
+		if protocol.ToUpper(string(cmdLine[i])) == "FIELDS" {
+			fields = cmdLine[i+2:]
+			break
+		}
+	}
+
+	var cmds [][][]byte
+	for _, field := range fields {
+		if expireAt, ok := h.db.HashFieldExpireTime(string(key), string(field)); ok {
+			ms := strconv.FormatInt(expireAt.UnixMilli(), 10)
+			cmds = append(cmds, [][]byte{[]byte(protocol.CmdHPExpireAt), key, []byte(ms), []byte("FIELDS"), []byte("1"), field})
+		} else if !h.db.HashFieldExists(string(key), string(field)) {
+			cmds = append(cmds, [][]byte{[]byte(protocol.CmdHDel), key, field})
+		}
+	}
+	return cmds
+}
+
+// hasRelativeSetExpiry reports whether SET options set an expiry
+func hasRelativeSetExpiry(opts [][]byte) bool {
+	for _, opt := range opts {
+		switch protocol.ToUpper(string(opt)) {
+		case "EX", "PX", "EXAT", "PXAT":
+			return true
+		}
+	}
+	return false
+}
+
+// streamAddCommands returns XADD with the ID generated by the master in place
+// of "*" or "ms-*", taken from the last ID of the stream
+func (h *Handler) streamAddCommands(cmdLine [][]byte) [][][]byte {
+	idIndex := database.XAddIDIndex(cmdLine[1:]) + 1
+	if idIndex == 0 || !bytes.HasSuffix(cmdLine[idIndex], []byte("*")) {
+		return [][][]byte{cmdLine}
+	}
+	lastID, ok := h.db.StreamLastID(string(cmdLine[1]))
+	if !ok {
+		return [][][]byte{cmdLine}
+	}
+
+	xadd := make([][]byte, len(cmdLine))
+	copy(xadd, cmdLine)
+	xadd[idIndex] = []byte(lastID)
+	return [][][]byte{xadd}
+}
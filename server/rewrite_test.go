@@ -0,0 +1,828 @@
+package server
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/wangbo/gocache/config"
+	"github.com/wangbo/gocache/database"
+	"github.com/wangbo/gocache/persistence/aof"
+	"github.com/wangbo/gocache/protocol/resp"
+	"github.com/wangbo/gocache/replication"
+)
+
+// execAll runs commands through a handler and fails the test on error
+func execAll(t *testing.T, h *Handler, cmds ...string) {
+	t.Helper()
+	for _, cmd := range cmds {
+		fields := strings.Fields(cmd)
+		cmdLine := make([][]byte, len(fields))
+		for i, f := range fields {
+			cmdLine[i] = []byte(f)
+		}
+		if _, err := h.ExecCommand(cmdLine); err != nil {
+			t.Fatalf("%s failed: %v", cmd, err)
+		}
+	}
+}
+
+// readAOF parses all commands from an AOF file once the handler writing it
+// wrote the commands queued
+func readAOF(t *testing.T, handler *aof.AOFHandler, filename string) [][]string {
+	t.Helper()
+	if err := handler.Flush(); err != nil {
+		t.Fatalf("Failed to flush the AOF: %v", err)
+	}
+	file, err := os.Open(filename)
+	if err != nil {
+		t.Fatalf("Failed to open AOF: %v", err)
+	}
+	defer file.Close()
+
+	var cmds [][]string
+	reader := bufio.NewReader(file)
+	for {
+		cmdLine, err := resp.ParseStream(reader)
+		if err != nil {
+			return cmds
+		}
+		cmd := make([]string, len(cmdLine))
+		for i, arg := range cmdLine {
+			cmd[i] = string(arg)
+		}
+		cmds = append(cmds, cmd)
+	}
+}
+
+func TestPropagateRelativeExpiryAsPExpireAt(t *testing.T) {
+	db := database.MakeDB()
+	defer db.Close()
+
+	filename := filepath.Join(t.TempDir(), "appendonly.aof")
+	aofHandler, err := aof.MakeAOFHandler(filename, db)
+	if err != nil {
+		t.Fatalf("Failed to create AOF handler: %v", err)
+	}
+	defer aofHandler.Close()
+	h := MakeHandlerWithAOF(db, aofHandler)
+
+	before := time.Now()
+	execAll(t, h,
+		"SET a 1",
+		"EXPIRE a 100",
+		"SET b 2 PX 50000",
+		"SET c 3",
+		"PEXPIREAT c 1",
+	)
+	after := time.Now()
+
+	cmds := readAOF(t, aofHandler, filename)
+	want := [][]string{
+		{"SET", "a", "1"},
+		{"PEXPIREAT", "a"},
+		{"SET", "b", "2"},
+		{"PEXPIREAT", "b"},
+		{"SET", "c", "3"},
+		{"DEL", "c"},
+	}
+	if len(cmds) != len(want) {
+		t.Fatalf("Expected %d AOF commands, got %v", len(want), cmds)
+	}
+	for i, w := range want {
+		for j, arg := range w {
+			if cmds[i][j] != arg {
+				t.Errorf("AOF command %d: expected %v, got %v", i, w, cmds[i])
+			}
+		}
+	}
+
+	checkAt := func(cmd []string, ttl time.Duration) {
+		ms, err := strconv.ParseInt(cmd[2], 10, 64)
+		if err != nil {
+			t.Fatalf("Invalid PEXPIREAT timestamp %q", cmd[2])
+		}
+		if ms < before.Add(ttl).UnixMilli() || ms > after.Add(ttl).UnixMilli() {
+			t.Errorf("%v: timestamp outside [%v, %v]", cmd, before.Add(ttl), after.Add(ttl))
+		}
+	}
+	checkAt(cmds[1], 100*time.Second)
+	checkAt(cmds[3], 50*time.Second)
+}
+
+// TestPropagateJitteredExpiry checks that the AOF gets the expiry the
+// master drew, not the command that drew it
+func TestPropagateJitteredExpiry(t *testing.T) {
+	cfg := config.Default()
+	cfg.TTLJitterPercent = 50
+	db := database.MakeDBWithConfig(cfg, replication.NewReplicationState())
+	defer db.Close()
+
+	filename := filepath.Join(t.TempDir(), "appendonly.aof")
+	aofHandler, err := aof.MakeAOFHandler(filename, db)
+	if err != nil {
+		t.Fatalf("Failed to create AOF handler: %v", err)
+	}
+	defer aofHandler.Close()
+	h := MakeHandlerWithAOF(db, aofHandler)
+
+	execAll(t, h, "SET a 1 EX 100", "SET b 2", "PEXPIRE b 100000")
+	var expiries int
+	for _, cmd := range readAOF(t, aofHandler, filename) {
+		if cmd[0] != "PEXPIREAT" {
+			continue
+		}
+		expiries++
+		expireAt, _ := db.ExpireTime(cmd[1])
+		if want := strconv.FormatInt(expireAt.UnixMilli(), 10); cmd[2] != want {
+			t.Errorf("%v: expected the expiry of the master, %s", cmd, want)
+		}
+	}
+	if expiries != 2 {
+		t.Errorf("Expected 2 PEXPIREAT, got %d", expiries)
+	}
+}
+
+func TestWritesThatChangeNothingAreNotPropagated(t *testing.T) {
+	db := database.MakeDB()
+	defer db.Close()
+
+	filename := filepath.Join(t.TempDir(), "appendonly.aof")
+	aofHandler, err := aof.MakeAOFHandler(filename, db)
+	if err != nil {
+		t.Fatalf("Failed to create AOF handler: %v", err)
+	}
+	defer aofHandler.Close()
+	h := MakeHandlerWithAOF(db, aofHandler)
+
+	execAll(t, h,
+		"EXPIRE missing 100",
+		"SETNX k 1",
+		"SETNX k 2",
+		"SET k 2 NX",
+		"SET k 2 NX GET",
+		"SET missing 2 XX",
+		"SET missing 2 XX GET",
+		"SET k 4 XX GET",
+		"DEL missing",
+		"LPOP missing",
+		"MULTI",
+		"SETNX k 3",
+		"SADD s a",
+		"EXEC",
+	)
+
+	want := [][]string{
+		{"SETNX", "k", "1"},
+		{"SET", "k", "4", "XX", "GET"},
+		{"SADD", "s", "a"},
+	}
+	if cmds := readAOF(t, aofHandler, filename); !reflect.DeepEqual(cmds, want) {
+		t.Errorf("Expected AOF %v, got %v", want, cmds)
+	}
+}
+
+func TestFlushAllSurvivesRestart(t *testing.T) {
+	db := database.MakeDB()
+	defer db.Close()
+
+	filename := filepath.Join(t.TempDir(), "appendonly.aof")
+	aofHandler, err := aof.MakeAOFHandler(filename, db)
+	if err != nil {
+		t.Fatalf("Failed to create AOF handler: %v", err)
+	}
+	h := MakeHandlerWithAOF(db, aofHandler)
+	execAll(t, h,
+		"SET a 1",
+		"RPUSH l x y",
+		"FLUSHALL",
+		"SET b 2",
+		"SET c 3 EX 100",
+	)
+	aofHandler.Close()
+
+	restarted := database.MakeDB()
+	defer restarted.Close()
+	aofHandler, err = aof.MakeAOFHandler(filename, restarted)
+	if err != nil {
+		t.Fatalf("Failed to load AOF: %v", err)
+	}
+	defer aofHandler.Close()
+
+	keys := restarted.Keys()
+	sort.Strings(keys)
+	if !reflect.DeepEqual(keys, []string{"b", "c"}) {
+		t.Errorf("Expected only the keys set after FLUSHALL, got %v", keys)
+	}
+	if _, ok := restarted.ExpireTime("c"); !ok {
+		t.Error("Expected c to keep its TTL")
+	}
+}
+
+func TestPropagateNonPositiveExpiryAsDel(t *testing.T) {
+	db := database.MakeDB()
+	defer db.Close()
+
+	filename := filepath.Join(t.TempDir(), "appendonly.aof")
+	aofHandler, err := aof.MakeAOFHandler(filename, db)
+	if err != nil {
+		t.Fatalf("Failed to create AOF handler: %v", err)
+	}
+	defer aofHandler.Close()
+	h := MakeHandlerWithAOF(db, aofHandler)
+
+	execAll(t, h,
+		"SET a 1",
+		"EXPIRE a 0",
+		"SET b 2",
+		"PEXPIRE b -1",
+		"SET c 3",
+		"EXPIREAT c 1",
+	)
+	// A refused TTL is not propagated
+	h.ExecCommand([][]byte{[]byte("EXPIRE"), []byte("c"), []byte("9223372036854775807")})
+
+	cmds := readAOF(t, aofHandler, filename)
+	want := [][]string{
+		{"SET", "a", "1"}, {"DEL", "a"},
+		{"SET", "b", "2"}, {"DEL", "b"},
+		{"SET", "c", "3"}, {"DEL", "c"},
+	}
+	if len(cmds) != len(want) {
+		t.Fatalf("Expected %v, got %v", want, cmds)
+	}
+	for i, w := range want {
+		if strings.Join(cmds[i], " ") != strings.Join(w, " ") {
+			t.Errorf("AOF command %d: expected %v, got %v", i, w, cmds[i])
+		}
+	}
+}
+
+func TestPropagateExpirationAsDel(t *testing.T) {
+	db := database.MakeDB()
+	defer db.Close()
+
+	filename := filepath.Join(t.TempDir(), "appendonly.aof")
+	aofHandler, err := aof.MakeAOFHandler(filename, db)
+	if err != nil {
+		t.Fatalf("Failed to create AOF handler: %v", err)
+	}
+	defer aofHandler.Close()
+	h := MakeHandlerWithAOF(db, aofHandler)
+
+	execAll(t, h, "SET k v PX 20")
+	time.Sleep(50 * time.Millisecond)
+	execAll(t, h, "GET k")
+
+	cmds := readAOF(t, aofHandler, filename)
+	last := cmds[len(cmds)-1]
+	if len(last) != 2 || last[0] != "DEL" || last[1] != "k" {
+		t.Errorf("Expected expiration to be logged as DEL k, got %v", cmds)
+	}
+}
+
+func TestPropagateHashFieldExpiry(t *testing.T) {
+	db := database.MakeDB()
+	defer db.Close()
+
+	filename := filepath.Join(t.TempDir(), "appendonly.aof")
+	aofHandler, err := aof.MakeAOFHandler(filename, db)
+	if err != nil {
+		t.Fatalf("Failed to create AOF handler: %v", err)
+	}
+	defer aofHandler.Close()
+	h := MakeHandlerWithAOF(db, aofHandler)
+
+	before := time.Now()
+	execAll(t, h,
+		"HMSET h a 1 b 2 c 3",
+		"HEXPIRE h 100 FIELDS 2 a nosuch",
+		"HPEXPIREAT h 1 FIELDS 1 b",
+		"HPEXPIRE h 20 FIELDS 1 c",
+	)
+	after := time.Now()
+	time.Sleep(50 * time.Millisecond)
+	execAll(t, h, "HGET h c")
+
+	cmds := readAOF(t, aofHandler, filename)
+	want := [][]string{
+		{"HMSET", "h"},
+		{"HPEXPIREAT", "h", "", "FIELDS", "1", "a"},
+		{"HDEL", "h", "nosuch"},
+		{"HDEL", "h", "b"},
+		{"HPEXPIREAT", "h", "", "FIELDS", "1", "c"},
+		{"HDEL", "h", "c"},
+	}
+	if len(cmds) != len(want) {
+		t.Fatalf("Expected %d AOF commands, got %v", len(want), cmds)
+	}
+	for i, w := range want {
+		for j, arg := range w {
+			if arg != "" && cmds[i][j] != arg {
+				t.Errorf("AOF command %d: expected %v, got %v", i, w, cmds[i])
+			}
+		}
+	}
+
+	ms, _ := strconv.ParseInt(cmds[1][2], 10, 64)
+	if ms < before.Add(100*time.Second).UnixMilli() || ms > after.Add(100*time.Second).UnixMilli() {
+		t.Errorf("%v: timestamp not 100s after the command", cmds[1])
+	}
+}
+
+func TestPropagateGeneratedStreamIDs(t *testing.T) {
+	db := database.MakeDB()
+	defer db.Close()
+
+	filename := filepath.Join(t.TempDir(), "appendonly.aof")
+	aofHandler, err := aof.MakeAOFHandler(filename, db)
+	if err != nil {
+		t.Fatalf("Failed to create AOF handler: %v", err)
+	}
+	defer aofHandler.Close()
+	h := MakeHandlerWithAOF(db, aofHandler)
+
+	execAll(t, h,
+		"XADD x 5-1 a 1",
+		"XADD x MAXLEN ~ 10 5-* b 2",
+		"XADD x * c 3",
+	)
+	lastID, _ := db.StreamLastID("x")
+
+	cmds := readAOF(t, aofHandler, filename)
+	want := [][]string{
+		{"XADD", "x", "5-1", "a", "1"},
+		{"XADD", "x", "MAXLEN", "~", "10", "5-2", "b", "2"},
+		{"XADD", "x", lastID, "c", "3"},
+	}
+	if len(cmds) != len(want) {
+		t.Fatalf("Expected %d AOF commands, got %v", len(want), cmds)
+	}
+	for i, w := range want {
+		if strings.Join(cmds[i], " ") != strings.Join(w, " ") {
+			t.Errorf("AOF command %d: expected %v, got %v", i, w, cmds[i])
+		}
+	}
+}
+
+func TestPropagateStreamGroupCommands(t *testing.T) {
+	db := database.MakeDB()
+	defer db.Close()
+
+	filename := filepath.Join(t.TempDir(), "appendonly.aof")
+	aofHandler, err := aof.MakeAOFHandler(filename, db)
+	if err != nil {
+		t.Fatalf("Failed to create AOF handler: %v", err)
+	}
+	defer aofHandler.Close()
+	h := MakeHandlerWithAOF(db, aofHandler)
+
+	execAll(t, h,
+		"XADD x 1-1 f v",
+		"XGROUP CREATE x g 0",
+		"XREADGROUP GROUP g c BLOCK 10 STREAMS x >",
+	)
+	time.Sleep(5 * time.Millisecond)
+	execAll(t, h, "XCLAIM x g c2 1 1-1")
+
+	cmds := readAOF(t, aofHandler, filename)
+	if len(cmds) != 4 {
+		t.Fatalf("Expected 4 AOF commands, got %v", cmds)
+	}
+	if got := strings.Join(cmds[2], " "); got != "XREADGROUP GROUP g c STREAMS x >" {
+		t.Errorf("XREADGROUP should be propagated without BLOCK, got %s", got)
+	}
+	// The claim is propagated as the resulting state, which replays
+	// whatever the idle time at replay
+	claim := strings.Join(cmds[3], " ")
+	if !strings.HasPrefix(claim, "XCLAIM x g c2 0 1-1 TIME ") || !strings.HasSuffix(claim, " RETRYCOUNT 2 FORCE JUSTID LASTID 1-1") {
+		t.Errorf("Unexpected propagated XCLAIM %s", claim)
+	}
+}
+
+func TestReplicaFollowsMasterExpiry(t *testing.T) {
+	master := database.MakeDB()
+	defer master.Close()
+	h := MakeHandler(master)
+
+	replica := database.MakeDB()
+	defer replica.Close()
+	replica.SetReplicaMode(true)
+
+	masterEnd, replicaEnd := net.Pipe()
+	replication.State.RegisterSlave(masterEnd)
+	defer func() {
+		replication.State.UnregisterSlave(masterEnd)
+		masterEnd.Close()
+	}()
+
+	applied := make(chan string, 16)
+	go func() {
+		reader := bufio.NewReader(replicaEnd)
+		for {
+			cmdLine, err := resp.ParseStream(reader)
+			if err != nil {
+				return
+			}
+			replica.Exec(cmdLine)
+			applied <- string(cmdLine[0])
+		}
+	}()
+	waitFor := func(cmd string) {
+		t.Helper()
+		select {
+		case got := <-applied:
+			if got != cmd {
+				t.Fatalf("Expected replica to apply %s, got %s", cmd, got)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Timed out waiting for %s", cmd)
+		}
+	}
+
+	execAll(t, h, "SET long v", "EXPIRE long 100")
+	waitFor("SET")
+	waitFor("PEXPIREAT")
+
+	masterAt, _ := master.ExpireTime("long")
+	replicaAt, ok := replica.ExpireTime("long")
+	if diff := replicaAt.Sub(masterAt); !ok || diff < -2*time.Millisecond || diff > 2*time.Millisecond {
+		t.Errorf("Expected replica expiry %v, got %v", masterAt, replicaAt)
+	}
+
+	execAll(t, h, "SET short v PX 30")
+	waitFor("SET")
+	waitFor("PEXPIREAT")
+
+	// The replica only deletes the key once the master expires it, either
+	// actively or on access
+	time.Sleep(60 * time.Millisecond)
+	execAll(t, h, "GET short")
+	waitFor("DEL")
+	if replica.GetVersion("short") != 0 {
+		t.Error("Replica should delete the key when the master propagates DEL")
+	}
+}
+
+// TestPropagateTTLCommandsByEffect runs the commands that touch TTLs on a
+// master and checks, for each, what reaches the AOF and a slave: only what
+// the command did, so that the slave ends with the TTLs of the master
+func TestPropagateTTLCommandsByEffect(t *testing.T) {
+	master := database.MakeDB()
+	defer master.Close()
+	filename := filepath.Join(t.TempDir(), "appendonly.aof")
+	aofHandler, err := aof.MakeAOFHandler(filename, master)
+	if err != nil {
+		t.Fatalf("Failed to create AOF handler: %v", err)
+	}
+	defer aofHandler.Close()
+	h := MakeHandlerWithAOF(master, aofHandler)
+
+	replica := database.MakeDB()
+	defer replica.Close()
+	replica.SetReplicaMode(true)
+
+	masterEnd, replicaEnd := net.Pipe()
+	replication.State.RegisterSlave(masterEnd)
+	defer func() {
+		replication.State.UnregisterSlave(masterEnd)
+		masterEnd.Close()
+	}()
+	received := make(chan []string, 16)
+	go func() {
+		reader := bufio.NewReader(replicaEnd)
+		for {
+			cmdLine, err := resp.ParseStream(reader)
+			if err != nil {
+				return
+			}
+			replica.Exec(cmdLine)
+			cmd := make([]string, len(cmdLine))
+			for i, arg := range cmdLine {
+				cmd[i] = string(arg)
+			}
+			received <- cmd
+		}
+	}()
+	// stream returns what the slave received for the last commands, the
+	// timestamps of PEXPIREAT left out
+	stream := func() []string {
+		var cmds []string
+		for {
+			select {
+			case cmd := <-received:
+				if cmd[0] == "PEXPIREAT" {
+					cmd = cmd[:2]
+				}
+				cmds = append(cmds, strings.Join(cmd, " "))
+			case <-time.After(50 * time.Millisecond):
+				return cmds
+			}
+		}
+	}
+
+	for _, tc := range []struct {
+		cmds []string
+		want []string
+	}{
+		{[]string{"SET p v"}, []string{"SET p v"}},
+		{[]string{"SET v v EX 100"}, []string{"SET v v", "PEXPIREAT v"}},
+		{[]string{"EXPIRE p 100 XX"}, nil},
+		{[]string{"EXPIRE v 200 NX"}, nil},
+		{[]string{"EXPIRE v 50 GT"}, nil},
+		{[]string{"EXPIRE v 200 GT"}, []string{"PEXPIREAT v"}},
+		{[]string{"PEXPIRE p 100000 LT"}, []string{"PEXPIREAT p"}},
+		{[]string{"EXPIREAT p 99999999999 LT"}, nil},
+		{[]string{"PEXPIREAT v 1 NX"}, nil},
+		{[]string{"GETEX v"}, nil},
+		{[]string{"GETEX v PERSIST"}, []string{"PERSIST v"}},
+		{[]string{"GETEX v PERSIST"}, nil},
+		{[]string{"GETEX missing PERSIST"}, nil},
+		{[]string{"GETEX v EX 300"}, []string{"PEXPIREAT v"}},
+		{[]string{"SET v v2 KEEPTTL"}, []string{"SET v v2 KEEPTTL"}},
+		{[]string{"SET v v3 KEEPTTL GET"}, []string{"SET v v3 KEEPTTL GET"}},
+		{[]string{"MULTI", "GETEX p", "EXPIRE p 10 GT", "PERSIST p", "EXPIRE p 10 NX", "EXEC"}, []string{"PERSIST p", "PEXPIREAT p"}},
+		{[]string{"SET gone v", "GETEX gone PXAT 1"}, []string{"SET gone v", "DEL gone"}},
+	} {
+		execAll(t, h, tc.cmds...)
+		if got := stream(); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%v: expected the slave to receive %q, got %q", tc.cmds, tc.want, got)
+		}
+	}
+
+	// The AOF holds the same stream
+	var logged []string
+	for _, cmd := range readAOF(t, aofHandler, filename) {
+		if cmd[0] == "PEXPIREAT" {
+			cmd = cmd[:2]
+		}
+		logged = append(logged, strings.Join(cmd, " "))
+	}
+	want := []string{"SET p v", "SET v v", "PEXPIREAT v", "PEXPIREAT v", "PEXPIREAT p", "PERSIST v", "PEXPIREAT v",
+		"SET v v2 KEEPTTL", "SET v v3 KEEPTTL GET", "PERSIST p", "PEXPIREAT p", "SET gone v", "DEL gone"}
+	if !reflect.DeepEqual(logged, want) {
+		t.Errorf("Expected AOF %q, got %q", want, logged)
+	}
+
+	for _, key := range []string{"p", "v", "gone"} {
+		masterAt, masterOK := master.ExpireTime(key)
+		replicaAt, replicaOK := replica.ExpireTime(key)
+		if diff := replicaAt.Sub(masterAt); masterOK != replicaOK || diff < -2*time.Millisecond || diff > 2*time.Millisecond {
+			t.Errorf("%s: expected the replica to expire at %v (%v), got %v (%v)", key, masterAt, masterOK, replicaAt, replicaOK)
+		}
+		if master.Exists(key) != replica.Exists(key) {
+			t.Errorf("%s: expected the replica to hold the keys of the master", key)
+		}
+	}
+}
+
+// writeCommandSamples holds an invocation of every write command, the
+// commands that prepare its keys and the command it is propagated as
+var writeCommandSamples = map[string]struct {
+	setup []string
+	cmd   string
+	want  string
+}{
+	"SET":         {nil, "SET k v", "SET"},
+	"MSET":        {nil, "MSET k v k2 v2", "MSET"},
+	"MSETNX":      {nil, "MSETNX k v k2 v2", "MSETNX"},
+	"BLPOP":       {[]string{"RPUSH l a"}, "BLPOP l 0", "LPOP"},
+	"BRPOP":       {[]string{"RPUSH l a"}, "BRPOP l 0", "RPOP"},
+	"DEL":         {[]string{"SET k v"}, "DEL k", "DEL"},
+	"UNLINK":      {[]string{"SET k v"}, "UNLINK k", "UNLINK"},
+	"INCR":        {nil, "INCR n", "INCR"},
+	"INCRBY":      {nil, "INCRBY n 2", "INCRBY"},
+	"DECR":        {nil, "DECR n", "DECR"},
+	"DECRBY":      {nil, "DECRBY n 2", "DECRBY"},
+	"APPEND":      {nil, "APPEND k v", "APPEND"},
+	"SETRANGE":    {nil, "SETRANGE k 2 v", "SETRANGE"},
+	"SETNX":       {nil, "SETNX k v", "SETNX"},
+	"GETSET":      {nil, "GETSET k v", "GETSET"},
+	"HSET":        {nil, "HSET h f v", "HSET"},
+	"HMSET":       {nil, "HMSET h f v", "HMSET"},
+	"HSETNX":      {nil, "HSETNX h f v", "HSETNX"},
+	"HDEL":        {[]string{"HSET h f v"}, "HDEL h f", "HDEL"},
+	"HINCRBY":     {nil, "HINCRBY h n 1", "HINCRBY"},
+	"HEXPIRE":     {[]string{"HSET h f v"}, "HEXPIRE h 100 FIELDS 1 f", "HPEXPIREAT"},
+	"HPEXPIRE":    {[]string{"HSET h f v"}, "HPEXPIRE h 100000 FIELDS 1 f", "HPEXPIREAT"},
+	"HEXPIREAT":   {[]string{"HSET h f v"}, "HEXPIREAT h 99999999999 FIELDS 1 f", "HPEXPIREAT"},
+	"HPEXPIREAT":  {[]string{"HSET h f v"}, "HPEXPIREAT h 9999999999999 FIELDS 1 f", "HPEXPIREAT"},
+	"HPERSIST":    {[]string{"HSET h f v", "HEXPIRE h 100 FIELDS 1 f"}, "HPERSIST h FIELDS 1 f", "HPERSIST"},
+	"LPUSH":       {nil, "LPUSH l a", "LPUSH"},
+	"RPUSH":       {nil, "RPUSH l a", "RPUSH"},
+	"LPOP":        {[]string{"RPUSH l a b"}, "LPOP l", "LPOP"},
+	"RPOP":        {[]string{"RPUSH l a b"}, "RPOP l", "RPOP"},
+	"LSET":        {[]string{"RPUSH l a b"}, "LSET l 0 c", "LSET"},
+	"LTRIM":       {[]string{"RPUSH l a b"}, "LTRIM l 0 0", "LTRIM"},
+	"LREM":        {[]string{"RPUSH l a b"}, "LREM l 0 a", "LREM"},
+	"LINSERT":     {[]string{"RPUSH l a b"}, "LINSERT l BEFORE b c", "LINSERT"},
+	"SADD":        {nil, "SADD s a", "SADD"},
+	"SREM":        {[]string{"SADD s a b"}, "SREM s a", "SREM"},
+	"SPOP":        {[]string{"SADD s a b"}, "SPOP s", "SREM"},
+	"SMOVE":       {[]string{"SADD s a b"}, "SMOVE s s2 a", "SMOVE"},
+	"RENAME":      {[]string{"SET k v"}, "RENAME k k2", "RENAME"},
+	"RENAMENX":    {[]string{"SET k v"}, "RENAMENX k k2", "RENAMENX"},
+	"COPY":        {[]string{"SET k v"}, "COPY k k2", "COPY"},
+	"SDIFFSTORE":  {[]string{"SADD s a b", "SADD s2 b"}, "SDIFFSTORE d s s2", "SDIFFSTORE"},
+	"SINTERSTORE": {[]string{"SADD s a b", "SADD s2 b"}, "SINTERSTORE d s s2", "SINTERSTORE"},
+	"SUNIONSTORE": {[]string{"SADD s a b", "SADD s2 b"}, "SUNIONSTORE d s s2", "SUNIONSTORE"},
+	"ZADD":        {nil, "ZADD z 1 a", "ZADD"},
+	"ZREM":        {[]string{"ZADD z 1 a"}, "ZREM z a", "ZREM"},
+	"ZINCRBY":     {nil, "ZINCRBY z 1 a", "ZINCRBY"},
+	"XADD":        {nil, "XADD x * f v", "XADD"},
+	"XGROUP":      {[]string{"XADD x 1-1 f v"}, "XGROUP CREATE x g 0", "XGROUP"},
+	"XREADGROUP":  {[]string{"XADD x 1-1 f v", "XGROUP CREATE x g 0"}, "XREADGROUP GROUP g c STREAMS x >", "XREADGROUP"},
+	"XACK":        {[]string{"XADD x 1-1 f v", "XGROUP CREATE x g 0", "XREADGROUP GROUP g c STREAMS x >"}, "XACK x g 1-1", "XACK"},
+	"XCLAIM":      {[]string{"XADD x 1-1 f v", "XGROUP CREATE x g 0", "XREADGROUP GROUP g c STREAMS x >"}, "XCLAIM x g c2 0 1-1", "XCLAIM"},
+	"XAUTOCLAIM":  {[]string{"XADD x 1-1 f v", "XGROUP CREATE x g 0", "XREADGROUP GROUP g c STREAMS x >"}, "XAUTOCLAIM x g c2 0 0", "XCLAIM"},
+	"PFADD":       {nil, "PFADD k a", "PFADD"},
+	"PFMERGE":     {[]string{"PFADD k a"}, "PFMERGE d k", "PFMERGE"},
+	"GEOADD":      {nil, "GEOADD z 13.361389 38.115556 a", "GEOADD"},
+	"EXPIRE":      {[]string{"SET k v"}, "EXPIRE k 100", "PEXPIREAT"},
+	"PEXPIRE":     {[]string{"SET k v"}, "PEXPIRE k 100000", "PEXPIREAT"},
+	"EXPIREAT":    {[]string{"SET k v"}, "EXPIREAT k 99999999999", "PEXPIREAT"},
+	"PEXPIREAT":   {[]string{"SET k v"}, "PEXPIREAT k 9999999999999", "PEXPIREAT"},
+	"PERSIST":     {[]string{"SET k v EX 100"}, "PERSIST k", "PERSIST"},
+	"GETEX":       {[]string{"SET k v"}, "GETEX k EX 100", "PEXPIREAT"},
+	"FLUSHDB":     {[]string{"SET k v"}, "FLUSHDB", "FLUSHDB"},
+	"FLUSHALL":    {[]string{"SET k v"}, "FLUSHALL", "FLUSHALL"},
+}
+
+// writeCommandsWithoutSample are write commands that cannot run in a test:
+// MIGRATE needs a target server (it is covered by the MIGRATE tests), and
+// MOVE never moves anything with a single database, so it is never dirty
+var writeCommandsWithoutSample = map[string]bool{"MIGRATE": true, "MOVE": true}
+
+// TestEveryWriteCommandIsPropagated checks that every command registered as
+// a write reaches both the AOF and the slaves. A new write command without a
+// sample fails the test until one is added above.
+func TestEveryWriteCommandIsPropagated(t *testing.T) {
+	db := database.MakeDB()
+	defer db.Close()
+
+	filename := filepath.Join(t.TempDir(), "appendonly.aof")
+	aofHandler, err := aof.MakeAOFHandler(filename, db)
+	if err != nil {
+		t.Fatalf("Failed to create AOF handler: %v", err)
+	}
+	defer aofHandler.Close()
+	h := MakeHandlerWithAOF(db, aofHandler)
+
+	masterEnd, slaveEnd := net.Pipe()
+	replication.State.RegisterSlave(masterEnd)
+	defer func() {
+		replication.State.UnregisterSlave(masterEnd)
+		masterEnd.Close()
+	}()
+	received := make(chan string, 64)
+	go func() {
+		reader := bufio.NewReader(slaveEnd)
+		for {
+			cmdLine, err := resp.ParseStream(reader)
+			if err != nil {
+				return
+			}
+			received <- string(cmdLine[0])
+		}
+	}()
+
+	var names []string
+	for name := range database.CommandRegistry {
+		if database.IsWriteCommand(name) && !writeCommandsWithoutSample[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		sample, ok := writeCommandSamples[name]
+		if !ok {
+			t.Errorf("Write command %s has no sample in writeCommandSamples", name)
+			continue
+		}
+
+		execAll(t, h, "DEL k k2 n h l s s2 d z x")
+		execAll(t, h, sample.setup...)
+		drain(received)
+		aofLen := len(readAOF(t, aofHandler, filename))
+
+		execAll(t, h, sample.cmd)
+
+		var logged []string
+		for _, cmd := range readAOF(t, aofHandler, filename)[aofLen:] {
+			logged = append(logged, cmd[0])
+		}
+		if len(logged) == 0 || logged[len(logged)-1] != sample.want {
+			t.Errorf("%s: expected %s in the AOF, got %v", sample.cmd, sample.want, logged)
+		}
+
+		select {
+		case got := <-received:
+			if got != sample.want {
+				t.Errorf("%s: expected the slave to receive %s, got %s", sample.cmd, sample.want, got)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("%s: slave received nothing", sample.cmd)
+		}
+	}
+}
+
+// drain discards everything buffered in ch
+func drain(ch chan string) {
+	for {
+		select {
+		case <-ch:
+		case <-time.After(20 * time.Millisecond):
+			return
+		}
+	}
+}
+
+func TestPropagateBlockingPops(t *testing.T) {
+	db := database.MakeDB()
+	defer db.Close()
+
+	filename := filepath.Join(t.TempDir(), "appendonly.aof")
+	aofHandler, err := aof.MakeAOFHandler(filename, db)
+	if err != nil {
+		t.Fatalf("Failed to create AOF handler: %v", err)
+	}
+	defer aofHandler.Close()
+	h := MakeHandlerWithAOF(db, aofHandler)
+
+	execAll(t, h,
+		"RPUSH l a b",
+		"BLPOP missing l 0",
+		"BRPOP l 0",
+		"BLPOP l 0.01",
+		"MULTI",
+		"BLPOP empty 0",
+		"RPUSH l2 x",
+		"BLPOP empty l2 0",
+		"EXEC",
+	)
+
+	cmds := readAOF(t, aofHandler, filename)
+	want := []string{"RPUSH l a b", "LPOP l", "RPOP l", "RPUSH l2 x", "LPOP l2"}
+	if len(cmds) != len(want) {
+		t.Fatalf("Expected %d AOF commands, got %v", len(want), cmds)
+	}
+	for i, w := range want {
+		if got := strings.Join(cmds[i], " "); got != w {
+			t.Errorf("AOF command %d: expected %s, got %s", i, w, got)
+		}
+	}
+}
+
+func TestPropagatePoppedSetMembers(t *testing.T) {
+	db := database.MakeDB()
+	defer db.Close()
+
+	filename := filepath.Join(t.TempDir(), "appendonly.aof")
+	aofHandler, err := aof.MakeAOFHandler(filename, db)
+	if err != nil {
+		t.Fatalf("Failed to create AOF handler: %v", err)
+	}
+	defer aofHandler.Close()
+	h := MakeHandlerWithAOF(db, aofHandler)
+
+	execAll(t, h,
+		"SADD s a b c d e",
+		"SPOP s 2",
+		"SPOP missing",
+		"SPOP s 0",
+		"MULTI",
+		"SPOP s",
+		"EXEC",
+	)
+
+	// Each SPOP that popped something is written as the SREM of what it
+	// popped, which are exactly the members missing from the set
+	cmds := readAOF(t, aofHandler, filename)
+	if len(cmds) != 3 {
+		t.Fatalf("Expected 3 AOF commands, got %v", cmds)
+	}
+	removed := make(map[string]bool)
+	for i, n := range []int{2, 1} {
+		cmd := cmds[i+1]
+		if cmd[0] != "SREM" || cmd[1] != "s" || len(cmd) != 2+n {
+			t.Fatalf("AOF command %d: expected SREM of %d members of s, got %v", i+1, n, cmd)
+		}
+		for _, member := range cmd[2:] {
+			removed[member] = true
+		}
+	}
+	for _, member := range []string{"a", "b", "c", "d", "e"} {
+		result, _ := db.ExecCommand("SISMEMBER", "s", member)
+		if isMember := string(result[0]) == "1"; isMember == removed[member] {
+			t.Errorf("Member %s: removed in the AOF %v, still in the set %v", member, removed[member], isMember)
+		}
+	}
+}
@@ -1,17 +1,23 @@
 package server
 
 import (
+	"bufio"
 	"bytes"
 	"errors"
 	"fmt"
 	"io"
 	"net"
+	"net/http"
+	"runtime/debug"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/wangbo/gocache/auth"
 	"github.com/wangbo/gocache/config"
 	"github.com/wangbo/gocache/database"
+	"github.com/wangbo/gocache/logger"
 	"github.com/wangbo/gocache/monitor"
 	"github.com/wangbo/gocache/persistence"
 	"github.com/wangbo/gocache/persistence/aof"
@@ -25,82 +31,235 @@ type Handler struct {
 	db            *database.DB
 	aof           *aof.AOFHandler
 	authenticator *auth.Authenticator
+	monitor       *monitor.Monitor // Receives every executed command for MONITOR clients
 }
 
 // MakeHandler creates a new handler
 func MakeHandler(db *database.DB) *Handler {
-	return &Handler{db: db}
+	return MakeHandlerWithAuth(db, nil, nil)
 }
 
 // MakeHandlerWithAOF creates a new handler with AOF persistence
 func MakeHandlerWithAOF(db *database.DB, aofHandler *aof.AOFHandler) *Handler {
-	return &Handler{db: db, aof: aofHandler}
+	return MakeHandlerWithAuth(db, aofHandler, nil)
 }
 
-// MakeHandlerWithAuth creates a new handler with authenticator
+// MakeHandlerWithAuth creates a new handler with authenticator. Without one,
+// authentication is disabled until CONFIG SET requirepass enables it.
 func MakeHandlerWithAuth(db *database.DB, aofHandler *aof.AOFHandler, authenticator *auth.Authenticator) *Handler {
-	return &Handler{db: db, aof: aofHandler, authenticator: authenticator}
+	if authenticator == nil {
+		authenticator = auth.NewAuthenticator()
+	}
+	h := &Handler{db: db, aof: aofHandler, authenticator: authenticator, monitor: monitor.GetMonitor()}
+	db.SetRequirePassCallback(authenticator.SetPassword)
+
+	// Keys expired by the database are propagated as DEL so that the AOF and
+	// replicas never expire keys on their own clock
+	db.SetExpireCallback(func(key string) {
+		h.feed([][]byte{[]byte(protocol.CmdDel), []byte(key)})
+	})
+	db.SetHashFieldExpireCallback(func(key, field string) {
+		h.feed([][]byte{[]byte(protocol.CmdHDel), []byte(key), []byte(field)})
+	})
+
+	// The database shows every command it runs, including those of EXEC
+	// and of the master of a replica
+	db.SetMonitorCallback(func(cmdLine [][]byte, origin string) {
+		h.monitor.LogCommand(cmdLine, origin)
+	})
+	db.SetAOFRetryCallback(func() error {
+		if h.aof == nil {
+			return nil
+		}
+		return h.aof.FlushPending()
+	})
+	db.SetAOFBufferCallback(func() int64 {
+		if h.aof == nil {
+			return 0
+		}
+		return h.aof.BufferSize()
+	})
+	db.SetAOFStatsCallback(func() (database.AOFStats, bool) {
+		if h.aof == nil {
+			return database.AOFStats{}, false
+		}
+		return h.aof.Stats(), true
+	})
+	return h
+}
+
+// SetMonitor replaces the global monitor with m, so that MONITOR clients of
+// this handler only see its commands
+func (h *Handler) SetMonitor(m *monitor.Monitor) {
+	h.monitor = m
 }
 
 // ExecCommand executes a command and returns a reply
+// It shares the database's default transaction state; connections should use
+// ExecCommandWithState with their own MultiState
 func (h *Handler) ExecCommand(cmdLine [][]byte) (resp.Reply, error) {
+	return h.ExecCommandWithState(h.db.DefaultMultiState(), cmdLine)
+}
+
+// ExecCommandWithState executes a command on behalf of the connection owning
+// the given transaction state and returns a reply
+func (h *Handler) ExecCommandWithState(ms *database.MultiState, cmdLine [][]byte) (reply resp.Reply, err error) {
 	if len(cmdLine) == 0 {
 		return nil, errors.New("empty command")
 	}
 
-	cmd := string(cmdLine[0])
-	cmdUpper := protocol.ToUpper(cmd)
+	cmdUpper := database.CommandName(cmdLine[0])
+
+	// A bug in a command must not take down the connection goroutine
+	defer func() {
+		if r := recover(); r != nil {
+			fmt.Printf("Panic executing %s: %v\n%s", cmdUpper, r, debug.Stack())
+			reply, err = h.errorReply(fmt.Sprintf("ERR internal error executing '%s'", cmdLine[0])), nil
+		}
+	}()
 
 	// Handle PING command specially
 	if cmdUpper == protocol.CmdPing {
-		if len(cmdLine) == 1 {
+		h.db.RecordCommand(cmdUpper, 0, false)
+		switch len(cmdLine) {
+		case 1:
 			return resp.MakePongReply(), nil
+		case 2:
+			return resp.MakeBulkReply(cmdLine[1]), nil
 		}
-		return resp.MakeStatusReply(string(cmdLine[1])), nil
+		return h.errorReplyFor(database.ErrWrongArity{Cmd: "ping"}), nil
+	}
+
+	if err := h.db.AdmitClientCommand(ms, cmdLine); err != nil {
+		return h.errorReplyFor(err), nil
 	}
 
 	// Track execution time for slow log
 	startTime := time.Now()
 
-	// Execute command in database
-	result, err := h.db.Exec(cmdLine)
+	// Commands queued by MULTI are propagated when EXEC runs them
+	inMulti := ms.IsInMulti()
+
+	// Execute command in database; a slave is not synchronized until the
+	// command is propagated
+	typed, release, err := h.db.ExecTypedPropagating(ms, cmdLine)
+	defer release()
+	duration := time.Since(startTime)
+	h.db.RecordCommand(cmdUpper, duration, err != nil)
 	if err != nil {
-		return resp.MakeErrorReply(err.Error()), nil
+		return h.errorReplyFor(err), nil
 	}
 
-	// Calculate execution time and log to slow log if needed
-	duration := time.Since(startTime)
+	// Log to slow log and latency monitor if needed
 	h.db.AddSlowLogEntry(duration, cmdLine)
+	h.db.RecordLatency(database.LatencyEventCommand, duration)
 
-	// Log command to monitor if enabled (skip MONITOR command itself)
-	if cmdUpper != protocol.CmdMonitor {
-		monitor.GetMonitor().LogCommand(cmdLine, "")
+	switch {
+	case cmdUpper == protocol.CmdExec:
+		// A nil result means a WATCHed key was modified and nothing ran
+		if typed == nil {
+			return resp.MakeNullMultiBulkReply(), nil
+		}
+		var aofErr error
+		for _, args := range ms.TakeExecuted() {
+			queuedLine := make([][]byte, len(args))
+			for i, arg := range args {
+				queuedLine[i] = []byte(arg)
+			}
+			if err := h.propagate(protocol.ToUpper(args[0]), queuedLine, nil); err != nil && aofErr == nil {
+				aofErr = err
+			}
+		}
+		replies := ms.TakeReplies()
+		if aofErr != nil {
+			return h.aofErrorReply(aofErr), nil
+		}
+		return h.execReply(replies), nil
+	case inMulti && typed == database.StatusResult("QUEUED"):
+		return resp.MakeStatusReply("QUEUED"), nil
+	case ms.Dirty():
+		// Only commands that modified the keyspace are propagated
+		if err := h.propagate(cmdUpper, cmdLine, typed); err != nil {
+			return h.aofErrorReply(err), nil
+		}
 	}
 
-	// Write to AOF if enabled and command is write operation
-	if h.aof != nil && protocol.IsWriteCommand(cmdUpper) {
-		if err := h.aof.AddCommand(cmdLine); err != nil {
-			// Log error but don't fail the command
-			fmt.Printf("AOF write error: %v\n", err)
+	return h.typedReply(cmdUpper, cmdLine, typed), nil
+}
+
+// typedReply replies with the type of a typed result, and as resultReply
+// does for the result of a command that is not typed
+func (h *Handler) typedReply(cmdUpper string, cmdLine [][]byte, result database.Result) resp.Reply {
+	switch r := result.(type) {
+	case database.IntResult:
+		return resp.MakeIntReply(int64(r))
+	case database.BulkResult:
+		// A nil BulkResult is the empty string, not a null
+		if r == nil {
+			return resp.MakeBulkReply([]byte{})
 		}
+		return resp.MakeBulkReply(r)
+	case database.NilResult:
+		return resp.MakeNullBulkReply()
+	case database.StatusResult:
+		return resp.MakeStatusReply(string(r))
+	case database.ScanResult:
+		return resp.MakeArrayReply([]resp.Reply{
+			resp.MakeBulkReply(strconv.AppendInt(nil, r.Cursor, 10)),
+			resp.MakeMultiBulkReply(r.Elements),
+		})
+	case nil:
+		return h.resultReply(cmdUpper, cmdLine, nil)
+	default:
+		return h.resultReply(cmdUpper, cmdLine, r.Lines())
 	}
+}
 
-	// Propagate write commands to slaves
-	if protocol.IsWriteCommand(cmdUpper) {
-		if err := replication.State.PropagateCommand(cmdLine); err != nil {
-			// Log error but don't fail the command
-			fmt.Printf("Replication propagation error: %v\n", err)
+// resultReply converts the result of a command to the reply of its type
+func (h *Handler) resultReply(cmdUpper string, cmdLine, result [][]byte) resp.Reply {
+	if protocol.IsStreamCommand(cmdUpper) {
+		return streamReply(cmdUpper, cmdLine, result)
+	}
+	if protocol.IsGeoCommand(cmdUpper) {
+		return geoReply(cmdUpper, cmdLine, result)
+	}
+	if cmdUpper == protocol.CmdLatency {
+		return latencyReply(cmdLine, result)
+	}
+	if cmdUpper == protocol.CmdCluster {
+		return clusterReply(cmdLine, result)
+	}
+	// SPOP and SRANDMEMBER reply with an array when given a count
+	if (cmdUpper == protocol.CmdSPop || cmdUpper == protocol.CmdSRandMember) && len(cmdLine) > 2 {
+		return resp.MakeMultiBulkReply(result)
+	}
+	// BLPOP and BRPOP reply with a null array on timeout, other array
+	// commands with an empty array when there is nothing to return
+	if (cmdUpper == protocol.CmdBLPop || cmdUpper == protocol.CmdBRPop) && len(result) == 0 {
+		return resp.MakeNullMultiBulkReply()
+	}
+	if protocol.IsArrayCommand(cmdUpper) {
+		if len(result) == 0 {
+			return resp.MakeEmptyMultiBulkReply()
 		}
+		return resp.MakeMultiBulkReply(result)
 	}
-
-	// Convert result to appropriate reply type
 	if len(result) == 0 {
-		return resp.MakeNullBulkReply(), nil
+		return resp.MakeNullBulkReply()
 	}
 
-	// For SET/MSET commands, return OK
+	// For SET/MSET commands, return OK (or another status such as NOKEY)
 	if protocol.IsStatusCommand(cmdUpper) {
-		return resp.MakeStatusReply("OK"), nil
+		return resp.MakeStatusReply(string(result[0]))
+	}
+
+	// For commands that return one integer per field (HEXPIRE, HTTL, etc.)
+	if protocol.IsIntegerArrayCommand(cmdUpper) {
+		values := make([]int64, len(result))
+		for i, val := range result {
+			values[i], _ = strconv.ParseInt(string(val), 10, 64)
+		}
+		return resp.MakeMultiIntReply(values)
 	}
 
 	// For commands that return integers (DEL, EXISTS, INCR, DECR, etc.)
@@ -110,44 +269,126 @@ func (h *Handler) ExecCommand(cmdLine [][]byte) (resp.Reply, error) {
 			val := string(result[0])
 			var num int64
 			if _, err := fmt.Sscanf(val, "%d", &num); err == nil {
-				return resp.MakeIntReply(num), nil
+				return resp.MakeIntReply(num)
 			}
 		}
 	}
 
-	// For commands that return arrays (HGETALL, LRANGE, etc.)
-	// These should always return arrays even if there's only 1 element
-	if protocol.IsArrayCommand(cmdUpper) {
-		return resp.MakeMultiBulkReply(result), nil
-	}
-
 	// For single result commands (GET, STRLEN, etc.)
 	if len(result) == 1 {
-		if result[0] == nil {
-			return resp.MakeNullBulkReply(), nil
+		if database.IsNullResult(result) {
+			return resp.MakeNullBulkReply()
 		}
-		return resp.MakeBulkReply(result[0]), nil
+		return resp.MakeBulkReply(result[0])
 	}
 
 	// For multiple results (MGET, KEYS), return as array
-	return resp.MakeMultiBulkReply(result), nil
+	return resp.MakeMultiBulkReply(result)
+}
+
+// execReply replies to EXEC with the reply of each command it ran, typed as
+// if the command had run on its own
+func (h *Handler) execReply(replies []database.ExecReply) resp.Reply {
+	items := make([]resp.Reply, len(replies))
+	for i, r := range replies {
+		if r.Err != nil {
+			items[i] = h.errorReplyFor(r.Err)
+			continue
+		}
+		items[i] = h.typedReply(protocol.ToUpper(string(r.CmdLine[0])), r.CmdLine, r.Value)
+	}
+	return resp.MakeArrayReply(items)
+}
+
+// errorReplyFor creates the error reply for err, with the ERR class unless
+// its message starts with another (see database.ErrorReply)
+func (h *Handler) errorReplyFor(err error) resp.Reply {
+	return h.errorReply(database.ErrorReply(err))
+}
+
+// errorReply creates an error reply and counts it for INFO errorstats
+func (h *Handler) errorReply(msg string) resp.Reply {
+	h.db.RecordErrorReply(msg)
+	return resp.MakeErrorReply(msg)
+}
+
+// propagate writes an executed command to the AOF and to slaves, rewritten
+// into its deterministic form (see propagationCommands). It returns the
+// first error of feed: the client must not be told that the command
+// succeeded.
+func (h *Handler) propagate(cmdUpper string, cmdLine [][]byte, result database.Result) error {
+	var firstErr error
+	for _, cmd := range h.propagationCommands(cmdUpper, cmdLine, result) {
+		if err := h.feed(cmd); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// feed writes a command to the AOF and to slaves. It returns the error of
+// the AOF write if the command is known not to be on disk, with appendfsync
+// always; the command is propagated to slaves anyway, having run.
+func (h *Handler) feed(cmdLine [][]byte) error {
+	// Write to AOF if enabled. With appendfsync always this waits for the
+	// fsync, so that the client is replied to once the command is on disk;
+	// the AOF records the outcome and the latency of its writes itself.
+	var aofErr error
+	if h.aof != nil {
+		if err := h.aof.AddCommand(cmdLine); err != nil {
+			// With stop-writes-on-aof-error the next writes are refused
+			h.db.RecordAOFWrite(err)
+			logger.Error("AOF write error: %v", err)
+			if h.aof.WaitsForFsync() {
+				aofErr = err
+			}
+		}
+	}
+
+	// Propagate write commands to slaves
+	if err := h.db.Replication().PropagateCommand(cmdLine); err != nil {
+		// Log error but don't fail the command
+		fmt.Printf("Replication propagation error: %v\n", err)
+	}
+	return aofErr
 }
 
+// aofErrorReply is the reply to a command that ran but whose AOF write
+// failed with appendfsync always
+func (h *Handler) aofErrorReply(err error) resp.Reply {
+	return h.errorReply("MISCONF Errors writing to the AOF file: " + err.Error())
+}
+
+// replyBufferSize is the size of the buffer replies are written through; a
+// larger reply goes out in pieces of this size
+const replyBufferSize = 64 * 1024
+
 // Client represents a connected client
 type Client struct {
-	conn          net.Conn
-	server        *Server
-	authenticated bool
-	clientID      string
+	conn     net.Conn
+	server   *Server
+	clientID string
+	state    connState // Authentication, transaction and WATCH state (see connstate.go)
 }
 
 // Server represents the Redis server
 type Server struct {
-	config    *config.Properties
-	handler   *Handler
-	listener  net.Listener
-	closing   bool
-	wg        sync.WaitGroup
+	config  *config.Properties
+	handler *Handler
+	renames *commandRenames
+	closing atomic.Bool
+	wg      sync.WaitGroup
+
+	// One listener per bind address, all on the same port; Addr is that of
+	// the first
+	listeners []net.Listener
+
+	connsMu sync.Mutex
+	conns   map[net.Conn]struct{} // Open client connections, closed by Stop
+
+	// HTTP health probe, nil unless health-port is set (see listenHealth)
+	health         *http.Server
+	healthListener net.Listener
 }
 
 // MakeServer creates a new server
@@ -155,75 +396,207 @@ func MakeServer(cfg *config.Properties, handler *Handler) *Server {
 	return &Server{
 		config:  cfg,
 		handler: handler,
-		closing: false,
+		renames: newCommandRenames(cfg.RenameCommands),
+		conns:   make(map[net.Conn]struct{}),
 	}
 }
 
-// Start starts the server
+// Start listens on the configured address and serves clients until Stop is
+// called
 func (s *Server) Start() error {
-	addr := fmt.Sprintf("%s:%d", s.config.Bind, s.config.Port)
-	listener, err := net.Listen("tcp", addr)
-	if err != nil {
-		return fmt.Errorf("failed to listen on %s: %w", addr, err)
+	if err := s.Listen(); err != nil {
+		return err
+	}
+	return s.Serve()
+}
+
+// Listen binds the configured addresses without accepting connections yet.
+// Port 0 picks a free port, which Addr reports; the other addresses are then
+// bound on the same port.
+func (s *Server) Listen() error {
+	port := s.config.Port
+	for _, host := range s.config.BindAddrs() {
+		addr := net.JoinHostPort(host, strconv.Itoa(port))
+		listener, err := net.Listen("tcp", addr)
+		if err != nil {
+			s.closeListeners()
+			return fmt.Errorf("failed to listen on %s: %w", addr, err)
+		}
+		s.listeners = append(s.listeners, listener)
+		port = listener.Addr().(*net.TCPAddr).Port
+	}
+	if err := s.listenHealth(); err != nil {
+		s.closeListeners()
+		return err
+	}
+	s.handler.db.SetTCPPort(port)
+
+	for _, listener := range s.listeners {
+		fmt.Printf("Server is listening on %s\n", listener.Addr())
+	}
+	return nil
+}
+
+// closeListeners closes the listeners bound by Listen
+func (s *Server) closeListeners() {
+	for _, listener := range s.listeners {
+		listener.Close()
+	}
+}
+
+// Addr returns the address the server listens on, that of the first bind
+// address, or nil before Listen
+func (s *Server) Addr() net.Addr {
+	if len(s.listeners) == 0 {
+		return nil
 	}
-	s.listener = listener
+	return s.listeners[0].Addr()
+}
+
+// Addrs returns the addresses the server listens on, one per bind address
+func (s *Server) Addrs() []net.Addr {
+	addrs := make([]net.Addr, len(s.listeners))
+	for i, listener := range s.listeners {
+		addrs[i] = listener.Addr()
+	}
+	return addrs
+}
 
-	fmt.Printf("Server is listening on %s\n", addr)
+// Serve accepts connections on the listeners bound by Listen until Stop is
+// called. If accepting fails on one of them, it closes them all and returns
+// the error once none accepts any more.
+func (s *Server) Serve() error {
+	if s.health != nil {
+		go s.health.Serve(s.healthListener)
+	}
+	errs := make(chan error, len(s.listeners))
+	for _, listener := range s.listeners {
+		go func(listener net.Listener) {
+			errs <- s.accept(listener)
+		}(listener)
+	}
+	var err error
+	for range s.listeners {
+		if e := <-errs; e != nil && err == nil {
+			err = e
+			s.closeListeners()
+		}
+	}
+	return err
+}
 
-	// Accept connections in a loop
-	for !s.closing {
+// accept serves the connections of one listener until it is closed
+func (s *Server) accept(listener net.Listener) error {
+	for {
 		conn, err := listener.Accept()
 		if err != nil {
-			if s.closing {
+			if s.closing.Load() {
 				return nil
 			}
 			return fmt.Errorf("accept error: %w", err)
 		}
+		if !s.trackConn(conn) {
+			conn.Close()
+			return nil
+		}
 
 		// Handle each connection in a separate goroutine
 		client := &Client{
-			conn:          conn,
-			server:        s,
-			authenticated: false,
-			clientID:      conn.RemoteAddr().String(),
+			conn:     conn,
+			server:   s,
+			clientID: conn.RemoteAddr().String(),
+			state:    newConnState(s.handler),
 		}
-		s.wg.Add(1)
 		go client.handleConnection()
 	}
+}
 
-	return nil
+// makeParser returns a parser of client requests enforcing the configured
+// proto-max-multibulk-len and proto-max-bulk-len
+func (s *Server) makeParser() *resp.Parser {
+	return resp.MakeParserWithLimits(s.config.ProtoMaxMultiBulkLen, s.config.ProtoMaxBulkLen)
 }
 
-// Stop stops the server
+// trackConn records an accepted connection so that Stop can close it. It
+// reports false if the server is stopping.
+func (s *Server) trackConn(conn net.Conn) bool {
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+	if s.closing.Load() {
+		return false
+	}
+	s.conns[conn] = struct{}{}
+	s.wg.Add(1)
+	return true
+}
+
+// untrackConn forgets a connection whose handler has returned
+func (s *Server) untrackConn(conn net.Conn) {
+	s.connsMu.Lock()
+	delete(s.conns, conn)
+	s.connsMu.Unlock()
+	s.wg.Done()
+}
+
+// Stop stops accepting connections, closes the open ones and waits for their
+// handlers to return
 func (s *Server) Stop() {
-	s.closing = true
-	if s.listener != nil {
-		s.listener.Close()
+	s.connsMu.Lock()
+	s.closing.Store(true)
+	s.closeListeners()
+	if s.health != nil {
+		s.health.Close()
+	}
+	for conn := range s.conns {
+		conn.Close()
 	}
+	s.connsMu.Unlock()
 	s.wg.Wait()
 }
 
 // handleConnection handles a client connection
 func (c *Client) handleConnection() {
 	defer c.conn.Close()
-	defer c.server.wg.Done()
+	defer c.server.untrackConn(c.conn)
+	defer c.state.multiState.Unwatch()
+
+	db := c.server.handler.db
+	db.ClientConnected()
+	defer db.ClientDisconnected()
 
 	remoteAddr := c.conn.RemoteAddr().String()
 	fmt.Printf("Client connected: %s\n", remoteAddr)
 
+	// The connection is registered for CLIENT LIST, which shows the bytes
+	// counted from here on
+	info := db.RegisterClient(remoteAddr, c.state.multiState)
+	defer db.UnregisterClient(info)
+	c.conn = &meteredConn{Conn: c.conn, client: info, db: db}
+
 	// Parse and execute commands
-	parser := resp.MakeParser()
+	parser := c.server.makeParser()
+	// Replies are written through a buffer, an element at a time for arrays
+	limiter := &replyLimiter{w: c.conn, client: info, limit: c.server.config.OutputBufferHardLimit("normal")}
+	writer := bufio.NewWriterSize(limiter, replyBufferSize)
 
 	for {
 		// Read and parse command
 		cmdLine, err := parser.ParseStream(c.conn)
 		if err != nil {
-			if err == io.EOF {
+			var netErr net.Error
+			if err == io.EOF || errors.As(err, &netErr) {
 				fmt.Printf("Client disconnected: %s\n", remoteAddr)
 				return
 			}
+			if errors.Is(err, resp.ErrProtocol) {
+				// The rest of the stream cannot be parsed
+				errReply := c.server.handler.errorReply("ERR " + err.Error())
+				c.conn.Write(errReply.ToBytes())
+				fmt.Printf("Closing client %s: %v\n", remoteAddr, err)
+				return
+			}
 			// Send error reply
-			errReply := resp.MakeErrorReply(err.Error())
+			errReply := c.server.handler.errorReplyFor(err)
 			c.conn.Write(errReply.ToBytes())
 			continue
 		}
@@ -232,24 +605,62 @@ func (c *Client) handleConnection() {
 			continue
 		}
 
+		// Renamed commands run under their canonical name from here on
+		resolved, ok := c.server.renames.resolve(cmdLine)
+		if !ok {
+			// Like any unknown command, it fails the transaction
+			if c.state.multiState.IsInMulti() {
+				c.state.multiState.Abort()
+			}
+			errReply := c.server.handler.errorReplyFor(database.ErrUnknownCommand(cmdLine))
+			c.conn.Write(errReply.ToBytes())
+			continue
+		}
+		cmdLine = resolved
+
+		// Nothing but AUTH and RESET runs before authentication
+		cmdUpper := database.CommandName(cmdLine[0])
+		if !c.mayRun(cmdUpper) {
+			errReply := c.server.handler.errorReply("NOAUTH Authentication required.")
+			c.conn.Write(errReply.ToBytes())
+			continue
+		}
+
 		// Check if this is a SYNC or PSYNC command (replication commands)
-		cmdUpper := protocol.ToUpper(string(cmdLine[0]))
 		if cmdUpper == protocol.CmdSync || cmdUpper == protocol.CmdPSync {
 			// Handle replication commands specially
 			if err := c.handleReplicationCommand(cmdLine); err != nil {
 				fmt.Printf("Replication command error: %v\n", err)
-				errReply := resp.MakeErrorReply(err.Error())
+				errReply := c.server.handler.errorReplyFor(err)
 				c.conn.Write(errReply.ToBytes())
 			}
 			return
 		}
 
+		// BACKUP streams a snapshot, then the connection goes on as a
+		// client's. Inside MULTI it is rejected like SYNC.
+		if cmdUpper == protocol.CmdBackup && !c.state.multiState.IsInMulti() {
+			info.CommandStarted(cmdUpper)
+			err := c.handleBackup(cmdLine)
+			info.CommandFinished()
+			if err != nil {
+				fmt.Printf("Closing client %s: %v\n", remoteAddr, err)
+				return
+			}
+			continue
+		}
+
 		// Check if this is a MONITOR command
 		if cmdUpper == protocol.CmdMonitor {
+			noReplication := len(cmdLine) == 2 && bytes.EqualFold(cmdLine[1], []byte("NO-REPLICATION"))
+			if len(cmdLine) > 1 && !noReplication {
+				c.conn.Write(c.server.handler.errorReplyFor(database.ErrSyntax).ToBytes())
+				continue
+			}
 			// Handle MONITOR command specially
-			if err := c.handleMonitor(); err != nil {
+			if err := c.handleMonitor(noReplication); err != nil {
 				fmt.Printf("Monitor command error: %v\n", err)
-				errReply := resp.MakeErrorReply(err.Error())
+				errReply := c.server.handler.errorReplyFor(err)
 				c.conn.Write(errReply.ToBytes())
 			}
 			return
@@ -259,29 +670,38 @@ func (c *Client) handleConnection() {
 		if cmdUpper == protocol.CmdAuth {
 			// Handle AUTH command specially
 			if err := c.handleAuth(cmdLine); err != nil {
-				errReply := resp.MakeErrorReply(err.Error())
+				errReply := c.server.handler.errorReplyFor(err)
 				c.conn.Write(errReply.ToBytes())
 			}
 			continue
 		}
 
-		// Check authentication if required
-		if c.server.handler.authenticator != nil &&
-			c.server.handler.authenticator.IsEnabled() &&
-			!c.authenticated {
-			errReply := resp.MakeErrorReply("NOAUTH Authentication required.")
-			c.conn.Write(errReply.ToBytes())
-			continue
+		// Execute command, showing it in CLIENT LIST while it runs
+		info.CommandStarted(cmdUpper)
+		result, _ := c.server.handler.ExecCommandWithState(c.state.multiState, cmdLine)
+		info.CommandFinished()
+		if _, failed := result.(*resp.ErrReply); cmdUpper == protocol.CmdReset && !failed {
+			c.reset()
 		}
 
-		// Execute command
-		result, _ := c.server.handler.ExecCommand(cmdLine)
-
 		// Send reply
-		c.conn.Write(result.ToBytes())
+		limiter.reset()
+		err = resp.WriteReply(writer, result)
+		if err == nil {
+			err = writer.Flush()
+		}
+		if errors.Is(err, errOutputBufferLimit) {
+			fmt.Printf("Closing client %s: %v\n", remoteAddr, err)
+			return
+		}
 	}
 }
 
+// repl returns the replication state of the server's database
+func (c *Client) repl() *replication.ReplicationState {
+	return c.server.handler.db.Replication()
+}
+
 // handleReplicationCommand handles SYNC and PSYNC commands
 // These commands require special handling because they send large RDB files
 func (c *Client) handleReplicationCommand(cmdLine [][]byte) error {
@@ -301,69 +721,58 @@ func (c *Client) handleReplicationCommand(cmdLine [][]byte) error {
 // handleSync handles a full synchronization request from a slave
 func (c *Client) handleSync() error {
 	// Verify this instance is a master
-	if !replication.State.IsMaster() {
+	if !c.repl().IsMaster() {
 		return fmt.Errorf("SYNC is only valid on master")
 	}
 
-	// Generate RDB file to a buffer
+	// Stage the slave and generate the RDB file to a buffer while no command
+	// is between its execution and its propagation: the commands propagated
+	// from then on are queued for the slave, and the snapshot holds the
+	// effects of all the others
 	var rdbBuffer bytes.Buffer
-	if err := persistence.SaveDatabaseToWriter(c.server.handler.db, &rdbBuffer); err != nil {
+	var offset uint64
+	var err error
+	c.server.handler.db.AtPropagationPoint(func() {
+		offset = c.repl().StageSlave(c.conn)
+		err = persistence.SaveDatabaseToWriter(c.server.handler.db, &rdbBuffer)
+	})
+	if err != nil {
+		c.repl().UnregisterSlave(c.conn)
 		return fmt.Errorf("failed to generate RDB: %w", err)
 	}
 
 	rdbData := rdbBuffer.Bytes()
 
-	// Send SYNC response: +FULLRESYNC <replid> <offset>\r\n
-	replID := replication.State.GetReplicationID()
-	replOffset := replication.State.GetReplicationOffset()
-	syncResponse := fmt.Sprintf("+FULLRESYNC %d %d\r\n", replID, replOffset)
-
-	if _, err := c.conn.Write([]byte(syncResponse)); err != nil {
-		return fmt.Errorf("failed to send SYNC response: %w", err)
-	}
-
-	// Send RDB file length: $<length>\r\n
-	lengthLine := fmt.Sprintf("$%d\r\n", len(rdbData))
-	if _, err := c.conn.Write([]byte(lengthLine)); err != nil {
-		return fmt.Errorf("failed to send RDB length: %w", err)
-	}
-
-	// Send RDB file content
-	if _, err := c.conn.Write(rdbData); err != nil {
-		return fmt.Errorf("failed to send RDB data: %w", err)
-	}
-
-	// Send trailing \r\n
-	if _, err := c.conn.Write([]byte("\r\n")); err != nil {
-		return fmt.Errorf("failed to send trailing CRLF: %w", err)
+	if err := c.repl().SendFullResyncAt(c.conn, rdbData, offset); err != nil {
+		c.repl().UnregisterSlave(c.conn)
+		return err
 	}
 
 	fmt.Printf("Sent RDB file (%d bytes) to slave %s\n", len(rdbData), c.conn.RemoteAddr())
 
-	// Register this slave connection for command propagation
-	replication.State.RegisterSlave(c.conn)
+	// Send the commands queued during the transfer, then the live ones
+	c.repl().StartSlave(c.conn)
 
-	// Start a goroutine to handle command propagation to this slave
-	go c.propagateCommandsToSlave()
+	// Serve the slave on this connection until it disconnects; returning
+	// earlier would let handleConnection close it
+	c.propagateCommandsToSlave()
 
 	return nil
 }
 
-// propagateCommandsToSlave continuously sends propagated commands to slave
-// This goroutine runs after SYNC completes to forward subsequent write commands
+// propagateCommandsToSlave serves a slave connection after SYNC or PSYNC
 func (c *Client) propagateCommandsToSlave() {
 	defer func() {
 		c.conn.Close()
-		replication.State.UnregisterSlave(c.conn)
+		c.repl().UnregisterSlave(c.conn)
 	}()
 
-	// For now, we just keep the connection alive
-	// In the future, we would have a channel that receives commands to propagate
-	// For the current implementation, commands are propagated immediately when executed
-	// This goroutine mainly serves to keep the connection open and handle cleanup
+	// Commands are sent by the slave writer started by RegisterSlave; this
+	// goroutine keeps the connection open and unregisters the slave once the
+	// connection is closed, by the slave or by the writer
 
 	// Keep reading from slave (PING, etc.)
-	parser := resp.MakeParser()
+	parser := c.server.makeParser()
 	for {
 		cmdLine, err := parser.ParseStream(c.conn)
 		if err != nil {
@@ -391,13 +800,13 @@ func (c *Client) propagateCommandsToSlave() {
 // handlePSync handles a partial synchronization request from a slave
 func (c *Client) handlePSync(cmdLine [][]byte) error {
 	// Verify this instance is a master
-	if !replication.State.IsMaster() {
+	if !c.repl().IsMaster() {
 		return fmt.Errorf("PSYNC is only valid on master")
 	}
 
 	// Parse arguments: PSYNC <replid> <offset>
 	if len(cmdLine) != 3 {
-		return fmt.Errorf("wrong number of arguments for PSYNC")
+		return database.ErrWrongArity{Cmd: "psync"}
 	}
 
 	replIDStr := string(cmdLine[1])
@@ -414,40 +823,68 @@ func (c *Client) handlePSync(cmdLine [][]byte) error {
 	// In production, you would check if replID matches
 	_ = replIDStr // Will be used for replID matching in future
 
-	// Try to get incremental data from backlog
-	backlogData, err := replication.State.GetBacklogData(offset)
-	if err != nil || backlogData == nil {
+	// Queue the backlog from the offset for the slave, followed by the
+	// commands propagated from now on
+	replOffset, ok := c.repl().StageSlaveFrom(c.conn, offset)
+	if !ok {
 		// Fallback to full sync
 		fmt.Printf("PSYNC: backlog not available, doing full sync (offset=%d)\n", offset)
 		return c.handleSync()
 	}
 
-	// Send CONTINUE response with incremental data
-	replOffset := replication.State.GetReplicationOffset()
+	// Send CONTINUE response, then the queued incremental data
 	continueResponse := fmt.Sprintf("+CONTINUE %d\r\n", replOffset)
 
 	if _, err := c.conn.Write([]byte(continueResponse)); err != nil {
+		c.repl().UnregisterSlave(c.conn)
 		return fmt.Errorf("failed to send CONTINUE response: %w", err)
 	}
 
-	// Send backlog data
-	if _, err := c.conn.Write(backlogData); err != nil {
-		return fmt.Errorf("failed to send backlog data: %w", err)
-	}
+	fmt.Printf("Sent incremental sync (%d bytes) to slave %s\n", replOffset-offset, c.conn.RemoteAddr())
+	c.repl().StartSlave(c.conn)
 
-	fmt.Printf("Sent incremental sync (%d bytes) to slave %s\n", len(backlogData), c.conn.RemoteAddr())
+	// Serve the slave on this connection until it disconnects; returning
+	// earlier would let handleConnection close it
+	c.propagateCommandsToSlave()
 
-	// Register this slave connection for command propagation
-	replication.State.RegisterSlave(c.conn)
+	return nil
+}
 
-	// Start a goroutine to handle command propagation to this slave
-	go c.propagateCommandsToSlave()
+// handleBackup handles BACKUP, which sends the client a snapshot of the
+// database for an off-box backup: the RDB payload handleSync sends a slave,
+// as a bulk string, without registering the client as a slave. It returns
+// an error only if the connection failed, the RDB being written straight to
+// it, past the client output buffer limit, as it is for slaves.
+func (c *Client) handleBackup(cmdLine [][]byte) error {
+	var replyErr error
+	var rdbBuffer bytes.Buffer
+	switch {
+	case len(cmdLine) != 1:
+		replyErr = database.ErrWrongArity{Cmd: "backup"}
+	case persistence.GetSaver() == nil:
+		replyErr = errors.New("ERR no RDB saver is registered")
+	default:
+		if err := persistence.SaveDatabaseToWriter(c.server.handler.db, &rdbBuffer); err != nil {
+			replyErr = fmt.Errorf("ERR failed to generate RDB: %w", err)
+		}
+	}
+	if replyErr != nil {
+		_, err := c.conn.Write(c.server.handler.errorReplyFor(replyErr).ToBytes())
+		return err
+	}
 
+	// The bulk string, without copying the payload into a reply
+	reply := net.Buffers{[]byte(fmt.Sprintf("$%d\r\n", rdbBuffer.Len())), rdbBuffer.Bytes(), []byte("\r\n")}
+	if _, err := reply.WriteTo(c.conn); err != nil {
+		return fmt.Errorf("failed to send the backup: %w", err)
+	}
+	fmt.Printf("Sent backup RDB (%d bytes) to %s\n", rdbBuffer.Len(), c.conn.RemoteAddr())
 	return nil
 }
 
-// handleMonitor handles the MONITOR command
-func (c *Client) handleMonitor() error {
+// handleMonitor handles MONITOR [NO-REPLICATION]; with NO-REPLICATION the
+// commands applied from the master are not shown
+func (c *Client) handleMonitor(noReplication bool) error {
 	// Send OK response to indicate monitoring has started
 	okReply := resp.MakeStatusReply("OK")
 	if _, err := c.conn.Write(okReply.ToBytes()); err != nil {
@@ -455,8 +892,12 @@ func (c *Client) handleMonitor() error {
 	}
 
 	// Add this client to the monitor
-	monitor.GetMonitor().AddClient(c.conn)
-	defer monitor.GetMonitor().RemoveClient(c.conn)
+	if noReplication {
+		c.server.handler.monitor.AddClientWithoutReplication(c.conn)
+	} else {
+		c.server.handler.monitor.AddClient(c.conn)
+	}
+	defer c.server.handler.monitor.RemoveClient(c.conn)
 
 	// Send a welcome message
 	welcomeMsg := fmt.Sprintf("+OK %d\r\n", time.Now().Unix())
@@ -465,7 +906,7 @@ func (c *Client) handleMonitor() error {
 	// Keep connection open and continue streaming commands
 	// The monitor broadcast loop will send commands to this client
 	// We just need to keep the connection alive
-	parser := resp.MakeParser()
+	parser := c.server.makeParser()
 	for {
 		cmdLine, err := parser.ParseStream(c.conn)
 		if err != nil {
@@ -491,35 +932,25 @@ func (c *Client) handleMonitor() error {
 // handleAuth handles the AUTH command
 func (c *Client) handleAuth(cmdLine [][]byte) error {
 	if len(cmdLine) != 2 {
-		return fmt.Errorf("wrong number of arguments for AUTH")
+		return database.ErrWrongArity{Cmd: "auth"}
 	}
 
 	password := string(cmdLine[1])
 
-	// If no authenticator configured, accept any password
-	if c.server.handler.authenticator == nil {
-		c.authenticated = true
-		okReply := resp.MakeStatusReply("OK")
-		c.conn.Write(okReply.ToBytes())
-		return nil
-	}
-
-	// Check if authentication is enabled
+	// Accepting any password would hide a misconfigured client
 	if !c.server.handler.authenticator.IsEnabled() {
-		c.authenticated = true
-		okReply := resp.MakeStatusReply("OK")
-		c.conn.Write(okReply.ToBytes())
-		return nil
+		return errors.New("ERR Client sent AUTH, but no password is set")
 	}
 
 	// Authenticate using the authenticator
-	if c.server.handler.authenticator.Authenticate(password) {
-		c.authenticated = true
+	ok := c.server.handler.authenticator.Authenticate(password)
+	c.authenticate(ok)
+	if ok {
 		okReply := resp.MakeStatusReply("OK")
 		c.conn.Write(okReply.ToBytes())
 		return nil
 	}
 
 	// Authentication failed
-	return fmt.Errorf("invalid password")
+	return errors.New("ERR invalid password")
 }
@@ -1,9 +1,25 @@
 package server
 
 import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 	
+	"github.com/wangbo/gocache/config"
 	"github.com/wangbo/gocache/database"
+	"github.com/wangbo/gocache/persistence"
+	"github.com/wangbo/gocache/persistence/aof"
+	"github.com/wangbo/gocache/persistence/faultfs"
+	"github.com/wangbo/gocache/persistence/rdb"
+	"github.com/wangbo/gocache/protocol/resp"
+	"github.com/wangbo/gocache/replication"
 )
 
 func TestMakeHandler(t *testing.T) {
@@ -104,3 +120,764 @@ func TestExecCommandWithMulti(t *testing.T) {
 		t.Fatal("Expected GET response")
 	}
 }
+
+func TestExecCommandWatchConflictReturnsNullArray(t *testing.T) {
+	db := database.MakeDB()
+	defer db.Close()
+
+	handler := MakeHandler(db)
+	clientA := database.NewMultiState(db)
+	clientB := database.NewMultiState(db)
+	exec := func(ms *database.MultiState, args ...string) string {
+		cmdLine := make([][]byte, len(args))
+		for i, arg := range args {
+			cmdLine[i] = []byte(arg)
+		}
+		reply, err := handler.ExecCommandWithState(ms, cmdLine)
+		if err != nil {
+			t.Fatalf("%s failed: %v", args[0], err)
+		}
+		return string(reply.ToBytes())
+	}
+
+	exec(clientA, "SET", "key", "v1")
+	exec(clientA, "WATCH", "key")
+	exec(clientA, "MULTI")
+	if reply := exec(clientA, "SET", "key", "fromA"); reply != "+QUEUED\r\n" {
+		t.Errorf("Expected +QUEUED, got %q", reply)
+	}
+
+	exec(clientB, "SET", "key", "fromB")
+
+	if reply := exec(clientA, "EXEC"); reply != "*-1\r\n" {
+		t.Errorf("Expected null array from EXEC, got %q", reply)
+	}
+	if reply := exec(clientB, "GET", "key"); reply != "$5\r\nfromB\r\n" {
+		t.Errorf("Expected fromB, got %q", reply)
+	}
+}
+
+func TestHandlerCountsErrorReplies(t *testing.T) {
+	db := database.MakeDB()
+	defer db.Close()
+
+	handler := MakeHandler(db)
+	handler.ExecCommand([][]byte{[]byte("LPUSH"), []byte("list"), []byte("a")})
+	handler.ExecCommand([][]byte{[]byte("GET"), []byte("list")})
+	handler.ExecCommand([][]byte{[]byte("GET"), []byte("list")})
+
+	reply, _ := handler.ExecCommand([][]byte{[]byte("INFO"), []byte("errorstats"), []byte("commandstats")})
+	info := string(reply.ToBytes())
+	if !strings.Contains(info, "errorstat_WRONGTYPE:count=2\r\n") {
+		t.Errorf("Expected two WRONGTYPE errors in errorstats, got %q", info)
+	}
+	if !strings.Contains(info, "cmdstat_get:calls=2,") || !strings.Contains(info, ",failed_calls=2\r\n") {
+		t.Errorf("Expected failed GET calls in commandstats, got %q", info)
+	}
+}
+
+func TestHandlerRecoversFromPanic(t *testing.T) {
+	db := database.MakeDB()
+	defer db.Close()
+	handler := MakeHandler(db)
+
+	// A nil transaction state makes the handler itself panic
+	reply, err := handler.ExecCommandWithState(nil, [][]byte{[]byte("GET"), []byte("key")})
+	if err != nil {
+		t.Fatalf("Expected an error reply, got error %v", err)
+	}
+	if got := string(reply.ToBytes()); !strings.HasPrefix(got, "-ERR internal error") {
+		t.Errorf("Expected an internal error reply, got %q", got)
+	}
+
+	// The handler keeps working afterwards
+	reply, _ = handler.ExecCommand([][]byte{[]byte("DECR"), []byte("counter")})
+	if got := string(reply.ToBytes()); got != ":-1\r\n" {
+		t.Errorf("Expected :-1, got %q", got)
+	}
+	reply, _ = handler.ExecCommand([][]byte{[]byte("DECR")})
+	if got := string(reply.ToBytes()); !strings.HasPrefix(got, "-") {
+		t.Errorf("DECR without arguments should be an error reply, got %q", got)
+	}
+}
+
+func TestTTLRepliesAreIntegers(t *testing.T) {
+	db := database.MakeDB()
+	defer db.Close()
+	handler := MakeHandler(db)
+	ms := database.NewMultiState(db)
+	exec := func(cmd string) string {
+		fields := strings.Fields(cmd)
+		cmdLine := make([][]byte, len(fields))
+		for i, field := range fields {
+			cmdLine[i] = []byte(field)
+		}
+		reply, err := handler.ExecCommandWithState(ms, cmdLine)
+		if err != nil {
+			t.Fatalf("%s failed: %v", cmd, err)
+		}
+		return string(reply.ToBytes())
+	}
+
+	exec("SET persistent v")
+	exec("SET volatile v PX 1500")
+	for _, tc := range []struct {
+		cmd  string
+		want string
+	}{
+		{"TTL missing", ":-2\r\n"},
+		{"PTTL missing", ":-2\r\n"},
+		{"TTL persistent", ":-1\r\n"},
+		{"PTTL persistent", ":-1\r\n"},
+		{"TTL volatile", ":2\r\n"},
+		{"PERSIST persistent", ":0\r\n"},
+		{"PERSIST missing", ":0\r\n"},
+		{"MOVE persistent 1", ":0\r\n"},
+		{"MOVE missing 1", ":0\r\n"},
+		{"EXPIRE persistent 9223372036854775807", "-ERR invalid expire time in 'expire' command\r\n"},
+		{"SET doomed v", "+OK\r\n"},
+		{"PEXPIRE doomed 0", ":1\r\n"},
+		{"EXISTS doomed", ":0\r\n"},
+	} {
+		if got := exec(tc.cmd); got != tc.want {
+			t.Errorf("%s: expected %q, got %q", tc.cmd, tc.want, got)
+		}
+	}
+
+	// Commands run by EXEC reply with their own types
+	exec("MULTI")
+	exec("TTL missing")
+	exec("TTL persistent")
+	exec("GET persistent")
+	exec("INCR persistent")
+	want := "*4\r\n:-2\r\n:-1\r\n$1\r\nv\r\n-ERR value is not an integer or out of range\r\n"
+	if got := exec("EXEC"); got != want {
+		t.Errorf("EXEC: expected %q, got %q", want, got)
+	}
+}
+
+func TestStringRepliesFollowResultType(t *testing.T) {
+	db := database.MakeDB()
+	defer db.Close()
+	handler := MakeHandler(db)
+	ms := database.NewMultiState(db)
+	exec := func(cmd string) string {
+		fields := strings.Fields(cmd)
+		cmdLine := make([][]byte, len(fields))
+		for i, field := range fields {
+			cmdLine[i] = []byte(field)
+		}
+		reply, err := handler.ExecCommandWithState(ms, cmdLine)
+		if err != nil {
+			t.Fatalf("%s failed: %v", cmd, err)
+		}
+		return string(reply.ToBytes())
+	}
+
+	for _, tc := range []struct {
+		cmd  string
+		want string
+	}{
+		{"STRLEN missing", ":0\r\n"},
+		{"GETRANGE missing 0 -1", "$0\r\n\r\n"},
+		{"GET missing", "$-1\r\n"},
+		{"SETNX key 10", ":1\r\n"},
+		{"SETNX key 20", ":0\r\n"},
+		{"GET key", "$2\r\n10\r\n"},
+		{"GETRANGE key 0 0", "$1\r\n1\r\n"},
+		{"STRLEN key", ":2\r\n"},
+		{"APPEND key 0", ":3\r\n"},
+		{"SETRANGE key 0 2", ":3\r\n"},
+		{"INCR key", ":201\r\n"},
+		{"INCRBY key 9", ":210\r\n"},
+		{"DECR key", ":209\r\n"},
+		{"DECRBY key 9", ":200\r\n"},
+		{"EXISTS key missing", ":1\r\n"},
+		{"EXPIRE key 100", ":1\r\n"},
+		{"TTL key", ":100\r\n"},
+		{"PERSIST key", ":1\r\n"},
+		{"DEL key", ":1\r\n"},
+	} {
+		if got := exec(tc.cmd); got != tc.want {
+			t.Errorf("%s: expected %q, got %q", tc.cmd, tc.want, got)
+		}
+	}
+
+	// Typed results keep their type inside EXEC
+	exec("MULTI")
+	exec("SETNX key 5")
+	exec("GETRANGE key 0 -1")
+	exec("STRLEN key")
+	want := "*3\r\n:1\r\n$1\r\n5\r\n:1\r\n"
+	if got := exec("EXEC"); got != want {
+		t.Errorf("EXEC: expected %q, got %q", want, got)
+	}
+}
+
+// TestDebugRepliesOnTheWire checks the reply types of DEBUG, whose type
+// depends on the subcommand
+func TestDebugRepliesOnTheWire(t *testing.T) {
+	oldSaver, oldLoader := persistence.GetSaver(), persistence.GetLoader()
+	persistence.RegisterSaver(&rdb.RDBSaver{})
+	persistence.RegisterLoader(&rdb.RDBLoaderImpl{})
+	defer func() {
+		persistence.RegisterSaver(oldSaver)
+		persistence.RegisterLoader(oldLoader)
+	}()
+
+	_, db, port := startTestServer(t)
+	db.ExecCommand("SET", "k", "v", "EX", "100")
+	conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(conn)
+
+	for _, tc := range []struct {
+		cmd  string
+		want string
+	}{
+		{"DEBUG RELOAD", "+OK\r\n"},
+		{"DEBUG SLEEP 0", "+OK\r\n"},
+		{"DEBUG TTLSTATS", "$"},
+		{"DEBUG HELP", "*"},
+	} {
+		args := strings.Fields(tc.cmd)
+		request := "*" + strconv.Itoa(len(args)) + "\r\n"
+		for _, arg := range args {
+			request += "$" + strconv.Itoa(len(arg)) + "\r\n" + arg + "\r\n"
+		}
+		conn.Write([]byte(request))
+		if got := readRawReply(t, reader); !strings.HasPrefix(got, tc.want) || len(tc.want) > 1 && got != tc.want {
+			t.Errorf("%s: expected %q, got %q", tc.cmd, tc.want, got)
+		}
+	}
+}
+
+func TestAbsentValuesAreRESPNulls(t *testing.T) {
+	db := database.MakeDB()
+	defer db.Close()
+	handler := MakeHandler(db)
+	exec := func(cmd string) string {
+		fields := strings.Fields(cmd)
+		cmdLine := make([][]byte, len(fields))
+		for i, field := range fields {
+			cmdLine[i] = []byte(field)
+		}
+		reply, err := handler.ExecCommand(cmdLine)
+		if err != nil {
+			t.Fatalf("%s failed: %v", cmd, err)
+		}
+		return string(reply.ToBytes())
+	}
+
+	exec("RPUSH list 123")
+	exec("ZADD zset 1 a")
+	exec("SADD set 7")
+
+	for _, tc := range []struct {
+		cmd  string
+		want string
+	}{
+		{"LPOP missing", "$-1\r\n"},
+		{"RPOP missing", "$-1\r\n"},
+		{"LINDEX list 5", "$-1\r\n"},
+		{"SPOP missing", "$-1\r\n"},
+		{"SRANDMEMBER missing", "$-1\r\n"},
+		{"ZSCORE zset b", "$-1\r\n"},
+		{"ZRANK zset b", "$-1\r\n"},
+		{"ZREVRANK zset b", "$-1\r\n"},
+		{"HGET missing f", "$-1\r\n"},
+		{"MGET missing", "*1\r\n$-1\r\n"},
+		// Present values stay bulk strings, even when they look like numbers
+		{"LPOP list", "$3\r\n123\r\n"},
+		{"ZINCRBY zset 1.5 a", "$3\r\n2.5\r\n"},
+		// ZMSCORE is an array even for one member, nil for missing ones
+		{"ZMSCORE zset a", "*1\r\n$3\r\n2.5\r\n"},
+		{"ZMSCORE zset a b", "*2\r\n$3\r\n2.5\r\n$-1\r\n"},
+		{"ZMSCORE missing a", "*1\r\n$-1\r\n"},
+		// With a count SPOP and SRANDMEMBER always reply with an array
+		{"SPOP missing 1", "*0\r\n"},
+		{"SRANDMEMBER missing 1", "*0\r\n"},
+		{"SRANDMEMBER set 1", "*1\r\n$1\r\n7\r\n"},
+		{"SRANDMEMBER set -2", "*2\r\n$1\r\n7\r\n$1\r\n7\r\n"},
+		{"SPOP set", "$1\r\n7\r\n"},
+	} {
+		if got := exec(tc.cmd); got != tc.want {
+			t.Errorf("%s: expected %q, got %q", tc.cmd, tc.want, got)
+		}
+	}
+}
+
+func TestStreamRepliesAreNestedArrays(t *testing.T) {
+	db := database.MakeDB()
+	defer db.Close()
+	handler := MakeHandler(db)
+	exec := func(args ...string) string {
+		cmdLine := make([][]byte, len(args))
+		for i, arg := range args {
+			cmdLine[i] = []byte(arg)
+		}
+		reply, err := handler.ExecCommand(cmdLine)
+		if err != nil {
+			t.Fatalf("%s failed: %v", args[0], err)
+		}
+		return string(reply.ToBytes())
+	}
+
+	if got := exec("XADD", "s", "1-1", "f", "v"); got != "$3\r\n1-1\r\n" {
+		t.Errorf("XADD: expected the ID as bulk string, got %q", got)
+	}
+	exec("XADD", "s", "2-1", "a", "1", "b", "2")
+
+	for _, tc := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"XLEN", "s"}, ":2\r\n"},
+		{[]string{"XRANGE", "s", "-", "+", "COUNT", "1"},
+			"*1\r\n*2\r\n$3\r\n1-1\r\n*2\r\n$1\r\nf\r\n$1\r\nv\r\n"},
+		{[]string{"XREVRANGE", "s", "+", "-", "COUNT", "1"},
+			"*1\r\n*2\r\n$3\r\n2-1\r\n*4\r\n$1\r\na\r\n$1\r\n1\r\n$1\r\nb\r\n$1\r\n2\r\n"},
+		{[]string{"XRANGE", "s", "3", "+"}, "*0\r\n"},
+		{[]string{"XRANGE", "missing", "-", "+"}, "*0\r\n"},
+		{[]string{"XREAD", "STREAMS", "s", "missing", "1-1", "0"},
+			"*1\r\n*2\r\n$1\r\ns\r\n*1\r\n*2\r\n$3\r\n2-1\r\n*4\r\n$1\r\na\r\n$1\r\n1\r\n$1\r\nb\r\n$1\r\n2\r\n"},
+		{[]string{"XREAD", "COUNT", "1", "STREAMS", "s", "2-1"}, "*-1\r\n"},
+		{[]string{"XGROUP", "CREATE", "s", "g", "0"}, "+OK\r\n"},
+		{[]string{"XGROUP", "CREATECONSUMER", "s", "g", "c2"}, ":1\r\n"},
+		{[]string{"XPENDING", "s", "g"}, "*4\r\n:0\r\n$-1\r\n$-1\r\n*-1\r\n"},
+		{[]string{"XREADGROUP", "GROUP", "g", "c", "COUNT", "1", "STREAMS", "s", ">"},
+			"*1\r\n*2\r\n$1\r\ns\r\n*1\r\n*2\r\n$3\r\n1-1\r\n*2\r\n$1\r\nf\r\n$1\r\nv\r\n"},
+		{[]string{"XPENDING", "s", "g"},
+			"*4\r\n:1\r\n$3\r\n1-1\r\n$3\r\n1-1\r\n*1\r\n*2\r\n$1\r\nc\r\n$1\r\n1\r\n"},
+		{[]string{"XCLAIM", "s", "g", "c2", "0", "1-1", "JUSTID"}, "*1\r\n$3\r\n1-1\r\n"},
+		{[]string{"XAUTOCLAIM", "s", "g", "c", "0", "0", "COUNT", "1"},
+			"*3\r\n$3\r\n0-0\r\n*1\r\n*2\r\n$3\r\n1-1\r\n*2\r\n$1\r\nf\r\n$1\r\nv\r\n*0\r\n"},
+		{[]string{"XACK", "s", "g", "1-1"}, ":1\r\n"},
+	} {
+		if got := exec(tc.args...); got != tc.want {
+			t.Errorf("%v: expected %q, got %q", tc.args, tc.want, got)
+		}
+	}
+
+	// The extended form of XPENDING reports idle times and delivery counts
+	exec("XREADGROUP", "GROUP", "g", "c", "STREAMS", "s", ">")
+	if got := exec("XPENDING", "s", "g", "-", "+", "10"); !strings.HasPrefix(got, "*1\r\n*4\r\n$3\r\n2-1\r\n$1\r\nc\r\n:") ||
+		!strings.HasSuffix(got, "\r\n:1\r\n") {
+		t.Errorf("XPENDING: unexpected extended reply %q", got)
+	}
+}
+
+func TestGeoRepliesAreNestedArrays(t *testing.T) {
+	db := database.MakeDB()
+	defer db.Close()
+	handler := MakeHandler(db)
+	exec := func(args ...string) string {
+		cmdLine := make([][]byte, len(args))
+		for i, arg := range args {
+			cmdLine[i] = []byte(arg)
+		}
+		reply, err := handler.ExecCommand(cmdLine)
+		if err != nil {
+			t.Fatalf("%s failed: %v", args[0], err)
+		}
+		return string(reply.ToBytes())
+	}
+
+	for _, tc := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"GEOADD", "Sicily", "13.361389", "38.115556", "Palermo", "15.087269", "37.502669", "Catania"}, ":2\r\n"},
+		{[]string{"GEOPOS", "Sicily", "Palermo", "missing"},
+			"*2\r\n*2\r\n$18\r\n13.361389338970184\r\n$16\r\n38.1155563954963\r\n*-1\r\n"},
+		{[]string{"GEODIST", "Sicily", "Palermo", "Catania", "km"}, "$8\r\n166.2742\r\n"},
+		{[]string{"GEODIST", "Sicily", "Palermo", "missing"}, "$-1\r\n"},
+		{[]string{"GEOSEARCH", "Sicily", "FROMLONLAT", "15", "37", "BYRADIUS", "200", "km", "ASC"},
+			"*2\r\n$7\r\nCatania\r\n$7\r\nPalermo\r\n"},
+		{[]string{"GEOSEARCH", "Sicily", "FROMLONLAT", "15", "37", "BYRADIUS", "100", "km", "WITHDIST", "WITHHASH", "WITHCOORD"},
+			"*1\r\n*4\r\n$7\r\nCatania\r\n$7\r\n56.4413\r\n:3479447370796909\r\n*2\r\n$18\r\n15.087267458438873\r\n$17\r\n37.50266842333162\r\n"},
+		{[]string{"GEOSEARCH", "Sicily", "FROMLONLAT", "0", "0", "BYRADIUS", "1", "km", "WITHDIST"}, "*0\r\n"},
+	} {
+		if got := exec(tc.args...); got != tc.want {
+			t.Errorf("%v: expected %q, got %q", tc.args, tc.want, got)
+		}
+	}
+}
+
+func TestLatencyEventsAfterCommands(t *testing.T) {
+	db := database.MakeDB()
+	defer db.Close()
+	db.SetLatencyMonitorThreshold(0)
+	handler := MakeHandler(db)
+	exec := func(args ...string) string {
+		cmdLine := make([][]byte, len(args))
+		for i, arg := range args {
+			cmdLine[i] = []byte(arg)
+		}
+		reply, err := handler.ExecCommand(cmdLine)
+		if err != nil {
+			t.Fatalf("%s failed: %v", args[0], err)
+		}
+		return string(reply.ToBytes())
+	}
+
+	exec("SET", "k", "v")
+	if got := exec("LATENCY", "LATEST"); !strings.HasPrefix(got, "*1\r\n*4\r\n$7\r\ncommand\r\n:") {
+		t.Errorf("Expected the command event in LATENCY LATEST, got %q", got)
+	}
+	if got := exec("LATENCY", "HISTORY", "command"); !strings.HasPrefix(got, "*1\r\n*2\r\n:") {
+		t.Errorf("Expected one command sample in LATENCY HISTORY, got %q", got)
+	}
+	if got := exec("LATENCY", "HISTORY", "nosuch"); got != "*0\r\n" {
+		t.Errorf("Expected no samples for an unknown event, got %q", got)
+	}
+	if got := exec("LATENCY", "RESET"); got != ":1\r\n" {
+		t.Errorf("Expected one event reset, got %q", got)
+	}
+}
+
+func TestOversizedRequestsCloseTheConnection(t *testing.T) {
+	_, _, port := startTestServer(t)
+	addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+
+	for _, tc := range []struct {
+		request string
+		want    string
+	}{
+		{"*1000000000\r\n", "-ERR Protocol error: invalid multibulk length\r\n"},
+		{"*1\r\n$1000000000\r\n", "-ERR Protocol error: invalid bulk length\r\n"},
+	} {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("Dial: %v", err)
+		}
+		conn.SetDeadline(time.Now().Add(2 * time.Second))
+		conn.Write([]byte(tc.request))
+
+		reader := bufio.NewReader(conn)
+		if line, err := reader.ReadString('\n'); err != nil || line != tc.want {
+			t.Errorf("%q: expected %q, got %q (%v)", tc.request, tc.want, line, err)
+		}
+		// The server closed the connection: nothing else is read
+		conn.Write([]byte("*1\r\n$4\r\nPING\r\n"))
+		if _, err := reader.ReadByte(); err != io.EOF {
+			t.Errorf("%q: expected the connection to be closed, got %v", tc.request, err)
+		}
+		conn.Close()
+	}
+}
+
+// TestCommandPayloadCap checks that a command whose arguments add up to more
+// than max-command-payload is refused before it changes anything
+func TestCommandPayloadCap(t *testing.T) {
+	cfg := config.Default()
+	cfg.MaxCommandPayload = 100
+	db := database.MakeDBWithConfig(cfg, replication.NewReplicationState())
+	defer db.Close()
+	h := MakeHandler(db)
+	run := func(args ...string) string {
+		t.Helper()
+		cmdLine := make([][]byte, len(args))
+		for i, arg := range args {
+			cmdLine[i] = []byte(arg)
+		}
+		reply, err := h.ExecCommand(cmdLine)
+		if err != nil {
+			t.Fatalf("%s: %v", args[0], err)
+		}
+		return string(reply.ToBytes())
+	}
+	// values returns RPUSH l with values of n bytes in all
+	values := func(cmd string, n int) []string {
+		args := []string{cmd, "l"}
+		for n -= len(cmd) + 1; n > 0; n -= 10 {
+			args = append(args, strings.Repeat("x", min(n, 10)))
+		}
+		return args
+	}
+
+	if reply := run(values("RPUSH", 100)...); reply != ":10\r\n" {
+		t.Errorf("Expected a command of exactly 100 bytes to run, got %q", reply)
+	}
+	for _, cmd := range []string{"RPUSH", "LPUSH", "SADD"} {
+		if reply := run(values(cmd, 101)...); reply != "-ERR argument list too long\r\n" {
+			t.Errorf("Expected %s of 101 bytes to be refused, got %q", cmd, reply)
+		}
+	}
+	if reply := run("LLEN", "l"); reply != ":10\r\n" {
+		t.Errorf("Expected the refused commands to change nothing, got LLEN %q", reply)
+	}
+
+	// A refused command aborts its transaction
+	run("MULTI")
+	run("SET", "k", "v")
+	run(values("RPUSH", 200)...)
+	if reply := run("EXEC"); !strings.HasPrefix(reply, "-EXECABORT") {
+		t.Errorf("Expected EXEC to abort, got %q", reply)
+	}
+	if reply := run("EXISTS", "k"); reply != ":0\r\n" {
+		t.Errorf("Expected the transaction not to run, got EXISTS %q", reply)
+	}
+
+	run("CONFIG", "SET", "max-command-payload", "0")
+	if reply := run(values("RPUSH", 1000)...); reply != ":110\r\n" {
+		t.Errorf("Expected no limit with max-command-payload 0, got %q", reply)
+	}
+}
+
+func TestScanRepliesAreCursorAndArray(t *testing.T) {
+	db := database.MakeDB()
+	defer db.Close()
+	handler := MakeHandler(db)
+
+	for _, tc := range []struct {
+		cmd  string
+		want string
+	}{
+		{"HSCAN missing 0", "*2\r\n$1\r\n0\r\n*0\r\n"},
+		{"SADD set a", ":1\r\n"},
+		{"SSCAN set 0", "*2\r\n$1\r\n0\r\n*1\r\n$1\r\na\r\n"},
+		{"SSCAN set 0 MATCH b*", "*2\r\n$1\r\n0\r\n*0\r\n"},
+		{"ZADD zset 1.5 m", ":1\r\n"},
+		{"ZSCAN zset 0", "*2\r\n$1\r\n0\r\n*2\r\n$1\r\nm\r\n$3\r\n1.5\r\n"},
+	} {
+		reply, err := handler.ExecCommand(bytes.Fields([]byte(tc.cmd)))
+		if err != nil {
+			t.Fatalf("%s failed: %v", tc.cmd, err)
+		}
+		if got := string(reply.ToBytes()); got != tc.want {
+			t.Errorf("%s: expected %q, got %q", tc.cmd, tc.want, got)
+		}
+	}
+}
+
+// TestHScanReplacesHGetAllWithBoundedMemory reads a hash of a million fields
+// with HSCAN, writing each reply as the connection does, and checks that
+// every call allocates about the same small amount, where HGETALL allocates
+// in proportion to the hash
+func TestHScanReplacesHGetAllWithBoundedMemory(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds a hash of a million fields")
+	}
+	const fields = 1000000
+
+	db := database.MakeDB()
+	defer db.Close()
+	handler := MakeHandler(db)
+	value := []byte("value")
+	for i := 0; i < fields; i++ {
+		db.Exec([][]byte{[]byte("HSET"), []byte("big"), []byte("field:" + strconv.Itoa(i)), value})
+	}
+
+	writer := bufio.NewWriterSize(io.Discard, replyBufferSize)
+	var before, after runtime.MemStats
+	// allocated runs a command and writes its reply, returning the bytes
+	// allocated meanwhile
+	allocated := func(cmdLine [][]byte) (resp.Reply, uint64) {
+		runtime.ReadMemStats(&before)
+		reply, err := handler.ExecCommand(cmdLine)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := resp.WriteReply(writer, reply); err != nil {
+			t.Fatal(err)
+		}
+		writer.Flush()
+		runtime.ReadMemStats(&after)
+		return reply, after.TotalAlloc - before.TotalAlloc
+	}
+
+	seen, calls := 0, 0
+	var maxAlloc uint64
+	cursor := []byte("0")
+	for {
+		reply, n := allocated([][]byte{[]byte("HSCAN"), []byte("big"), cursor, []byte("COUNT"), []byte("1000")})
+		if n > maxAlloc {
+			maxAlloc = n
+		}
+		parts := reply.(*resp.ArrayReply).Replies
+		cursor = parts[0].(*resp.BulkReply).Arg
+		seen += len(parts[1].(*resp.MultiBulkReply).Args) / 2
+		calls++
+		if string(cursor) == "0" {
+			break
+		}
+	}
+	if seen != fields {
+		t.Fatalf("Expected %d fields, got %d in %d calls", fields, seen, calls)
+	}
+
+	_, full := allocated([][]byte{[]byte("HGETALL"), []byte("big")})
+	t.Logf("HSCAN COUNT 1000: %d calls, at most %d bytes each; HGETALL: %d bytes", calls, maxAlloc, full)
+	if maxAlloc > 1<<20 {
+		t.Errorf("Expected a batch of 1000 fields to allocate under 1MB, got %d bytes", maxAlloc)
+	}
+	if maxAlloc*100 > full {
+		t.Errorf("Expected a batch to allocate a hundredth of HGETALL at most, got %d and %d bytes", maxAlloc, full)
+	}
+}
+
+// BenchmarkGetLargeValue GETs a 50MB value and writes the reply as the
+// connection does: the allocations stay far below the size of the value,
+// which is only held once, by the database
+func BenchmarkGetLargeValue(b *testing.B) {
+	db := database.MakeDB()
+	defer db.Close()
+	handler := MakeHandler(db)
+	ms := database.NewMultiState(db)
+	value := bytes.Repeat([]byte{'v'}, 50<<20)
+	if _, err := handler.ExecCommand([][]byte{[]byte("SET"), []byte("blob"), value}); err != nil {
+		b.Fatal(err)
+	}
+	writer := bufio.NewWriterSize(io.Discard, replyBufferSize)
+	get := [][]byte{[]byte("GET"), []byte("blob")}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		reply, err := handler.ExecCommandWithState(ms, get)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if err := resp.WriteReply(writer, reply); err != nil {
+			b.Fatal(err)
+		}
+		writer.Flush()
+	}
+}
+
+// repeatReader reads the same bytes over and over, a client pipelining one
+// command forever
+type repeatReader struct {
+	data []byte
+	off  int
+}
+
+func (r *repeatReader) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		c := copy(p[n:], r.data[r.off:])
+		n += c
+		r.off = (r.off + c) % len(r.data)
+	}
+	return n, nil
+}
+
+// benchmarkCommand runs a command as a connection does: parsed from the
+// stream, executed and its reply written through the reply buffer
+func benchmarkCommand(b *testing.B, setup [][]byte, cmdLine ...string) {
+	db := database.MakeDB()
+	defer db.Close()
+	handler := MakeHandler(db)
+	ms := database.NewMultiState(db)
+	if setup != nil {
+		if _, err := handler.ExecCommand(setup); err != nil {
+			b.Fatal(err)
+		}
+	}
+	var request bytes.Buffer
+	request.WriteString("*" + strconv.Itoa(len(cmdLine)) + "\r\n")
+	for _, arg := range cmdLine {
+		request.WriteString("$" + strconv.Itoa(len(arg)) + "\r\n" + arg + "\r\n")
+	}
+	stream := &repeatReader{data: request.Bytes()}
+	parser := resp.MakeParser()
+	writer := bufio.NewWriterSize(io.Discard, replyBufferSize)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		args, err := parser.ParseStream(stream)
+		if err != nil {
+			b.Fatal(err)
+		}
+		reply, err := handler.ExecCommandWithState(ms, args)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if err := resp.WriteReply(writer, reply); err != nil {
+			b.Fatal(err)
+		}
+		writer.Flush()
+	}
+}
+
+func BenchmarkSetSmallValue(b *testing.B) {
+	benchmarkCommand(b, nil, "SET", "key:000001", "value-of-sixteen")
+}
+
+func BenchmarkGetSmallValue(b *testing.B) {
+	set := [][]byte{[]byte("SET"), []byte("key:000001"), []byte("value-of-sixteen")}
+	benchmarkCommand(b, set, "GET", "key:000001")
+}
+
+// BenchmarkSetWithAOF SETs with an AOF whose fsync takes a millisecond: the
+// latency of SET is the same with appendfsync always as with everysec, far
+// below that of the fsync, which only the AOF writer waits for
+func BenchmarkSetWithAOF(b *testing.B) {
+	for _, fsync := range []string{"always", "everysec"} {
+		b.Run(fsync, func(b *testing.B) {
+			cfg := config.Default()
+			cfg.AppendFsync = fsync
+			db := database.MakeDBWithConfig(cfg, replication.NewReplicationState())
+			defer db.Close()
+			fs := faultfs.New(nil)
+			fs.DelaySync("appendonly.aof", time.Millisecond)
+			aofHandler, err := aof.MakeAOFHandlerWithFS(filepath.Join(b.TempDir(), "appendonly.aof"), db, fs)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer aofHandler.Close()
+			handler := MakeHandlerWithAOF(db, aofHandler)
+			set := [][]byte{[]byte("SET"), []byte("key:000001"), []byte("value-of-sixteen")}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := handler.ExecCommand(set); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestWatchReleasedOnDisconnect(t *testing.T) {
+	_, db, port := startTestServer(t)
+	conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	conn.Write([]byte("*3\r\n$5\r\nWATCH\r\n$1\r\na\r\n$1\r\nb\r\n*1\r\n$5\r\nMULTI\r\n"))
+	reader := bufio.NewReader(conn)
+	for _, want := range []string{"+OK\r\n", "+OK\r\n"} {
+		if line, err := reader.ReadString('\n'); err != nil || line != want {
+			t.Fatalf("Expected %q, got %q (%v)", want, line, err)
+		}
+	}
+	watchInfo := func() string {
+		result, _ := db.ExecCommand("INFO", "clients")
+		return string(result[0])
+	}
+	if info := watchInfo(); !strings.Contains(info, "watching_clients:1\r\n") || !strings.Contains(info, "total_watched_keys:2\r\n") {
+		t.Fatalf("Expected 1 client watching 2 keys, got %q", info)
+	}
+
+	// Reset the connection in the middle of the transaction
+	conn.(*net.TCPConn).SetLinger(0)
+	conn.Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for !strings.Contains(watchInfo(), "watching_clients:0\r\n") {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the watched keys to be released, got %q", watchInfo())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if info := watchInfo(); !strings.Contains(info, "total_watched_keys:0\r\n") {
+		t.Errorf("Expected no watched keys, got %q", info)
+	}
+}
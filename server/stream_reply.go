@@ -0,0 +1,153 @@
+package server
+
+import (
+	"strconv"
+
+	"github.com/wangbo/gocache/protocol"
+	"github.com/wangbo/gocache/protocol/resp"
+)
+
+// streamReply turns the flattened result of a stream command into nested
+// arrays (see database/stream.go and database/stream_group.go for the
+// layouts):
+//
+//	XRANGE, XREVRANGE:  [[id, [field, value, ...]], ...]
+//	XREAD, XREADGROUP:  [[key, [[id, [field, value, ...]], ...]], ...] or a null array
+//	XCLAIM:             entries as XRANGE, or IDs with JUSTID
+//	XAUTOCLAIM:         [cursor, entries or IDs, [deleted id, ...]]
+//	XPENDING:           [count, min id, max id, [[consumer, count], ...]]
+//	XPENDING (extended) [[id, consumer, idle, deliveries], ...]
+//	XGROUP:             OK, an integer or the HELP lines
+func streamReply(cmdUpper string, cmdLine [][]byte, result [][]byte) resp.Reply {
+	switch cmdUpper {
+	case protocol.CmdXRead, protocol.CmdXReadGroup:
+		return streamReadReply(result)
+	case protocol.CmdXClaim:
+		if hasOption(cmdLine, "JUSTID") {
+			return resp.MakeMultiBulkReply(result)
+		}
+	case protocol.CmdXAutoClaim:
+		return streamAutoClaimReply(hasOption(cmdLine, "JUSTID"), result)
+	case protocol.CmdXPending:
+		return streamPendingReply(len(cmdLine) == 3, result)
+	case protocol.CmdXGroup:
+		if len(result) != 1 {
+			return resp.MakeMultiBulkReply(result)
+		}
+		if n, err := strconv.ParseInt(string(result[0]), 10, 64); err == nil {
+			return resp.MakeIntReply(n)
+		}
+		return resp.MakeStatusReply(string(result[0]))
+	}
+
+	entries, _ := streamEntriesReply(result, -1)
+	return entries
+}
+
+// streamReadReply decodes the result of XREAD and XREADGROUP
+func streamReadReply(result [][]byte) resp.Reply {
+	if len(result) == 0 {
+		return resp.MakeNullMultiBulkReply()
+	}
+	var streams []resp.Reply
+	for len(result) >= 2 {
+		key := result[0]
+		n, _ := strconv.Atoi(string(result[1]))
+		var entries resp.Reply
+		entries, result = streamEntriesReply(result[2:], n)
+		streams = append(streams, resp.MakeArrayReply([]resp.Reply{resp.MakeBulkReply(key), entries}))
+	}
+	return resp.MakeArrayReply(streams)
+}
+
+// streamAutoClaimReply decodes the result of XAUTOCLAIM
+func streamAutoClaimReply(justID bool, result [][]byte) resp.Reply {
+	if len(result) < 2 {
+		return resp.MakeMultiBulkReply(result)
+	}
+	cursor := resp.MakeBulkReply(result[0])
+	n, _ := strconv.Atoi(string(result[1]))
+	result = result[2:]
+
+	var claimed resp.Reply
+	if justID {
+		n = min(n, len(result))
+		claimed = resp.MakeMultiBulkReply(result[:n])
+		result = result[n:]
+	} else {
+		claimed, result = streamEntriesReply(result, n)
+	}
+	return resp.MakeArrayReply([]resp.Reply{cursor, claimed, resp.MakeMultiBulkReply(result)})
+}
+
+// streamPendingReply decodes the summary or extended result of XPENDING
+func streamPendingReply(summary bool, result [][]byte) resp.Reply {
+	if summary {
+		if len(result) < 3 {
+			return resp.MakeMultiBulkReply(result)
+		}
+		count, _ := strconv.ParseInt(string(result[0]), 10, 64)
+		var consumers resp.Reply = resp.MakeNullMultiBulkReply()
+		if len(result) > 3 {
+			var pairs []resp.Reply
+			for rest := result[3:]; len(rest) >= 2; rest = rest[2:] {
+				pairs = append(pairs, resp.MakeMultiBulkReply(rest[:2]))
+			}
+			consumers = resp.MakeArrayReply(pairs)
+		}
+		return resp.MakeArrayReply([]resp.Reply{
+			resp.MakeIntReply(count), nullableBulkReply(result[1]), nullableBulkReply(result[2]), consumers,
+		})
+	}
+
+	entries := make([]resp.Reply, 0, len(result)/4)
+	for ; len(result) >= 4; result = result[4:] {
+		idle, _ := strconv.ParseInt(string(result[2]), 10, 64)
+		deliveries, _ := strconv.ParseInt(string(result[3]), 10, 64)
+		entries = append(entries, resp.MakeArrayReply([]resp.Reply{
+			resp.MakeBulkReply(result[0]), resp.MakeBulkReply(result[1]),
+			resp.MakeIntReply(idle), resp.MakeIntReply(deliveries),
+		}))
+	}
+	return resp.MakeArrayReply(entries)
+}
+
+// nullableBulkReply returns a bulk reply, or a null bulk reply for nil
+func nullableBulkReply(b []byte) resp.Reply {
+	if b == nil {
+		return resp.MakeNullBulkReply()
+	}
+	return resp.MakeBulkReply(b)
+}
+
+// hasOption reports whether a command line has the given option after the
+// command name
+func hasOption(cmdLine [][]byte, opt string) bool {
+	for _, arg := range cmdLine[1:] {
+		if protocol.ToUpper(string(arg)) == opt {
+			return true
+		}
+	}
+	return false
+}
+
+// streamEntriesReply consumes n flattened stream entries, or all of them if
+// n is negative, and returns them as an array reply with the rest of result.
+// An entry with -1 items was deleted from the stream and has null fields.
+func streamEntriesReply(result [][]byte, n int) (resp.Reply, [][]byte) {
+	entries := make([]resp.Reply, 0)
+	for len(result) >= 2 && n != 0 {
+		numItems, _ := strconv.Atoi(string(result[1]))
+		var fields resp.Reply = resp.MakeNullMultiBulkReply()
+		if numItems >= 0 {
+			numItems = min(numItems, len(result)-2)
+			fields = resp.MakeMultiBulkReply(result[2 : 2+numItems])
+		} else {
+			numItems = 0
+		}
+		entries = append(entries, resp.MakeArrayReply([]resp.Reply{resp.MakeBulkReply(result[0]), fields}))
+		result = result[2+numItems:]
+		n--
+	}
+	return resp.MakeArrayReply(entries), result
+}
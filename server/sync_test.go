@@ -0,0 +1,205 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/wangbo/gocache/config"
+	"github.com/wangbo/gocache/database"
+	"github.com/wangbo/gocache/persistence"
+	"github.com/wangbo/gocache/persistence/rdb"
+	"github.com/wangbo/gocache/replication"
+)
+
+// TestFullSyncKeepsConcurrentWrites synchronizes a slave while clients keep
+// writing to the master: the snapshot, the commands queued during its
+// transfer and the live stream must rebuild the dataset of the master
+// exactly, with no write missed or applied twice
+func TestFullSyncKeepsConcurrentWrites(t *testing.T) {
+	replication.RegisterRDBLoader(&rdb.RDBLoaderImpl{})
+	defer replication.RegisterRDBLoader(nil)
+	oldSaver := persistence.GetSaver()
+	persistence.RegisterSaver(&rdb.RDBSaver{})
+	defer persistence.RegisterSaver(oldSaver)
+
+	masterRS := replication.NewReplicationState()
+	master := database.MakeDBWithConfig(config.Config, masterRS)
+	defer master.Close()
+	h := MakeHandler(master)
+	srv := MakeServer(config.Config, h)
+
+	slave := database.MakeDB()
+	defer slave.Close()
+	slave.SetReplicaMode(true)
+
+	masterEnd, slaveEnd := net.Pipe()
+	defer slaveEnd.Close()
+	srv.trackConn(masterEnd)
+	client := &Client{
+		conn:     masterEnd,
+		server:   srv,
+		clientID: "slave",
+		state:    connState{authenticated: true, multiState: database.NewMultiState(master)},
+	}
+	go client.handleConnection()
+
+	slaveRS := replication.NewReplicationState()
+	slaveRS.SetAsSlave("master", 6379)
+	defer slaveRS.SetAsMaster()
+	slaveRS.SetDialer(func(addr string) (net.Conn, error) { return slaveEnd, nil })
+
+	// Writes that are not idempotent, so that one applied twice shows
+	const writers, writes = 4, 500
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			ms := database.NewMultiState(master)
+			for i := 0; i < writes; i++ {
+				for _, cmd := range [][]string{
+					{"INCR", fmt.Sprintf("counter:%d", i%10)},
+					{"RPUSH", fmt.Sprintf("list:%d", w), fmt.Sprint(i)},
+					{"HINCRBY", "hash", fmt.Sprintf("field:%d", i%7), "1"},
+				} {
+					if _, err := h.ExecCommandWithState(ms, toBytes(cmd)); err != nil {
+						t.Errorf("%v failed: %v", cmd, err)
+						return
+					}
+				}
+			}
+		}(w)
+	}
+
+	data, err := slaveRS.PerformFullSync()
+	if err != nil {
+		t.Fatalf("PerformFullSync failed: %v", err)
+	}
+	if err := replication.LoadRDBData(slave, data); err != nil {
+		t.Fatalf("Failed to load the snapshot: %v", err)
+	}
+	if err := slaveRS.StartReplicationLoop(slave); err != nil {
+		t.Fatalf("StartReplicationLoop failed: %v", err)
+	}
+	defer slaveRS.StopReplicationLoop()
+	wg.Wait()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for slaveRS.GetReplicationOffset() != masterRS.GetReplicationOffset() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Slave at offset %d, master at %d", slaveRS.GetReplicationOffset(), masterRS.GetReplicationOffset())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	var reads [][]string
+	for i := 0; i < 10; i++ {
+		reads = append(reads, []string{"GET", fmt.Sprintf("counter:%d", i)})
+	}
+	for w := 0; w < writers; w++ {
+		reads = append(reads, []string{"LRANGE", fmt.Sprintf("list:%d", w), "0", "-1"})
+	}
+	for i := 0; i < 7; i++ {
+		reads = append(reads, []string{"HGET", "hash", fmt.Sprintf("field:%d", i)})
+	}
+	for _, read := range reads {
+		want, _ := master.Exec(toBytes(read))
+		got, err := slave.Exec(toBytes(read))
+		if err != nil || fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("%v: slave has %q, master %q (%v)", read, got, want, err)
+		}
+	}
+}
+
+func toBytes(args []string) [][]byte {
+	cmdLine := make([][]byte, len(args))
+	for i, arg := range args {
+		cmdLine[i] = []byte(arg)
+	}
+	return cmdLine
+}
+
+// TestBackup takes a backup over a connection: the snapshot handleSync
+// would send a slave, as a bulk string, after which the connection is still
+// a client's and no slave is registered
+func TestBackup(t *testing.T) {
+	oldSaver := persistence.GetSaver()
+	persistence.RegisterSaver(&rdb.RDBSaver{})
+	defer persistence.RegisterSaver(oldSaver)
+
+	_, db, port := startTestServer(t)
+	writes := [][]string{
+		{"SET", "s", "v"},
+		{"SET", "ttl", "v", "EX", "1000"},
+		{"HSET", "h", "f1", "v1", "f2", "v2"},
+		{"RPUSH", "l", "a", "b", "c"},
+		{"SADD", "set", "m"},
+		{"ZADD", "z", "1.5", "m"},
+		{"XADD", "x", "1-1", "f", "v"},
+	}
+	for _, cmd := range writes {
+		if _, err := db.Exec(toBytes(cmd)); err != nil {
+			t.Fatalf("%v failed: %v", cmd, err)
+		}
+	}
+
+	conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", fmt.Sprint(port)))
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	conn.Write([]byte("*1\r\n$6\r\nBACKUP\r\n"))
+	reply := readRawReply(t, r)
+	header, payload, ok := strings.Cut(reply, "\r\n")
+	if !ok || header[0] != '$' || !strings.HasSuffix(payload, "\r\n") {
+		t.Fatalf("Expected a bulk string, got %.40q", reply)
+	}
+	payload = strings.TrimSuffix(payload, "\r\n")
+	if header != fmt.Sprintf("$%d", len(payload)) {
+		t.Errorf("Expected the length %d, got %s", len(payload), header)
+	}
+
+	restored := database.MakeDB()
+	defer restored.Close()
+	if err := rdb.LoadFromBytes(restored, []byte(payload)); err != nil {
+		t.Fatalf("Failed to load the backup: %v", err)
+	}
+	for _, read := range [][]string{
+		{"GET", "s"}, {"GET", "ttl"}, {"HMGET", "h", "f1", "f2"}, {"LRANGE", "l", "0", "-1"},
+		{"SMEMBERS", "set"}, {"ZRANGE", "z", "0", "-1", "WITHSCORES"}, {"XRANGE", "x", "-", "+"},
+	} {
+		want, _ := db.Exec(toBytes(read))
+		got, err := restored.Exec(toBytes(read))
+		if err != nil || fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("%v: backup has %q, server %q (%v)", read, got, want, err)
+		}
+	}
+	if keys := restored.Keys(); len(keys) != len(writes) {
+		t.Errorf("Expected %d keys, got %v", len(writes), keys)
+	}
+	if _, ok := restored.ExpireTime("ttl"); !ok {
+		t.Error("Expected the TTL to be backed up")
+	}
+
+	if n := db.Replication().GetSlaveCount(); n != 0 {
+		t.Errorf("Expected no slave to be registered, got %d", n)
+	}
+	for _, step := range [][2]string{
+		{"*1\r\n$4\r\nPING\r\n", "+PONG\r\n"},
+		{"*2\r\n$6\r\nBACKUP\r\n$1\r\nx\r\n", "-ERR wrong number of arguments for 'backup' command\r\n"},
+		{"*1\r\n$5\r\nMULTI\r\n", "+OK\r\n"},
+		{"*1\r\n$6\r\nBACKUP\r\n", "-ERR Command not allowed inside a transaction\r\n"},
+	} {
+		conn.Write([]byte(step[0]))
+		if got := readRawReply(t, r); got != step[1] {
+			t.Errorf("%q: expected %q, got %q", step[0], step[1], got)
+		}
+	}
+}
@@ -0,0 +1,292 @@
+package compat
+
+const wrongType = "-WRONGTYPE Operation against a key holding the wrong kind of value"
+
+// cases are checked against Redis 7
+var cases = []compatCase{
+	// Reply types
+	{"status", []step{
+		{"PING", "+PONG"},
+		{"SET k v", "+OK"},
+		{"TYPE k", "+string"},
+		{"TYPE missing", "+none"},
+		{"SELECT 9", "+OK"},
+	}},
+	{"bulk", []step{
+		{"PING hello", `"hello"`},
+		{"SET k hello", "+OK"},
+		{"GET k", `"hello"`},
+		{"GETRANGE k 1 3", `"ell"`},
+		{"GETRANGE k 10 20", `""`},
+		{"HSET h f v", ":1"},
+		{"HGET h f", `"v"`},
+		{"ZADD z 1.5 a", ":1"},
+		{"ZSCORE z a", `"1.5"`},
+		{"ZINCRBY z 1 a", `"2.5"`},
+		{"XADD s 1-1 f v", `"1-1"`},
+	}},
+	{"integer", []step{
+		{"SET k 10", "+OK"},
+		{"INCR k", ":11"},
+		{"INCRBY k -5", ":6"},
+		{"DECR k", ":5"},
+		{"DECRBY k 10", ":-5"},
+		{"APPEND k 0", ":3"},
+		{"STRLEN k", ":3"},
+		{"SETRANGE k 3 x", ":4"},
+		{"SETNX k v", ":0"},
+		{"SETNX n v", ":1"},
+		{"EXISTS k n missing", ":2"},
+		{"EXISTS k k", ":2"},
+		{"TOUCH k k missing", ":2"},
+		{"DEL k n missing", ":2"},
+		{"SET k v", "+OK"},
+		{"UNLINK k k missing", ":1"},
+		{"RPUSH l a b c", ":3"},
+		{"LLEN l", ":3"},
+		{"LINSERT l BEFORE nosuch x", ":-1"},
+		{"LINSERT missing BEFORE a x", ":0"},
+		{"SADD s a b a", ":2"},
+		{"SISMEMBER s a", ":1"},
+		{"HSET h a 1 b 2", ":2"},
+		{"HSET h a 3 c 4", ":1"},
+		{"HSETNX h a 5", ":0"},
+		{"HINCRBY h a 2", ":5"},
+		{"HLEN h", ":3"},
+		{"ZADD z 1 a 2 b", ":2"},
+		{"ZRANK z b", ":1"},
+		{"ZCARD z", ":2"},
+		{"MSETNX l v x y", ":0"},
+	}},
+	{"null", []step{
+		{"GET missing", "null"},
+		{"HGET missing f", "null"},
+		{"LPOP missing", "null"},
+		{"RPOP missing", "null"},
+		{"SPOP missing", "null"},
+		{"SRANDMEMBER missing", "null"},
+		{"ZSCORE missing a", "null"},
+		{"ZRANK missing a", "null"},
+		{"RPUSH l a", ":1"},
+		{"LINDEX l 5", "null"},
+		{"SET k v NX", "+OK"},
+		{"SET k w NX", "null"},
+		{"SET missing v XX", "null"},
+		{"SET k w NX GET", `"v"`},
+		{"SET k w XX GET", `"v"`},
+		{"SET n v NX GET", "null"},
+		{"GET n", `"v"`},
+		{"SET k x GET", `"w"`},
+		{"BLPOP missing 0.05", "null-array"},
+	}},
+	{"array", []step{
+		{"MSET a 1 b 2", "+OK"},
+		{"MGET a missing b", `("1", null, "2")`},
+		{"RPUSH l a b c", ":3"},
+		{"LRANGE l 0 -1", `("a", "b", "c")`},
+		{"LRANGE l 5 10", "()"},
+		{"LRANGE missing 0 -1", "()"},
+		{"HGETALL missing", "()"},
+		{"SMEMBERS missing", "()"},
+		{"SRANDMEMBER missing 2", "()"},
+		{"KEYS nomatch*", "()"},
+		{"HSET h f v", ":1"},
+		{"HMGET h f missing", `("v", null)`},
+		{"HGETALL h", `("f", "v")`},
+		{"ZADD z 1 a 2 b", ":2"},
+		{"ZRANGE z 0 -1 WITHSCORES", `("a", "1", "b", "2")`},
+		{"ZREVRANGE z 0 0", `("b")`},
+		{"ZRANGEBYSCORE z (1 +inf", `("b")`},
+		{"RPUSH q x", ":1"},
+		{"BLPOP missing q 1", `("q", "x")`},
+	}},
+	{"nested", []step{
+		{"XADD s 1-1 a 1 b 2", `"1-1"`},
+		{"XADD s 2-1 c 3", `"2-1"`},
+		{"XRANGE s - +", `(("1-1", ("a", "1", "b", "2")), ("2-1", ("c", "3")))`},
+		{"XREVRANGE s + - COUNT 1", `(("2-1", ("c", "3")))`},
+		{"XRANGE s 3 +", "()"},
+		{"HSET h f v", ":1"},
+		{"HSCAN h 0", `("0", ("f", "v"))`},
+		{"SSCAN missing 0", `("0", ())`},
+		{"GEOADD g 13.361389 38.115556 Palermo", ":1"},
+		{"GEOPOS g Palermo nosuch", `(("13.36138*", "38.11555*"), null-array)`},
+		{"GEODIST g Palermo nosuch", "null"},
+	}},
+	{"transaction", []step{
+		{"MULTI", "+OK"},
+		{"SET k 1", "+QUEUED"},
+		{"INCR k", "+QUEUED"},
+		{"GET k", "+QUEUED"},
+		{"LPUSH k x", "+QUEUED"},
+		{"GET missing", "+QUEUED"},
+		{"EXEC", `(+OK, :2, "2", ` + wrongType + `, null)`},
+		{"MULTI", "+OK"},
+		{"EXEC", "()"},
+		{"MULTI", "+OK"},
+		{"MULTI", "-ERR MULTI calls can not be nested"},
+		{"DISCARD", "+OK"},
+		{"EXEC", "-ERR EXEC without MULTI"},
+		{"DISCARD", "-ERR DISCARD without MULTI"},
+		{"MULTI", "+OK"},
+		{"SET k 5", "+QUEUED"},
+		{"NOSUCH", "-ERR unknown command 'NOSUCH', with args beginning with: "},
+		{"EXEC", "-EXECABORT Transaction discarded because of previous errors."},
+		{"GET k", `"2"`},
+		{"WATCH k", "+OK"},
+		{"SET k 3", "+OK"},
+		{"MULTI", "+OK"},
+		{"GET k", "+QUEUED"},
+		{"EXEC", "null-array"},
+	}},
+
+	// Errors
+	{"wrongtype", []step{
+		{"SET k v", "+OK"},
+		{"LPUSH k a", wrongType},
+		{"HGET k f", wrongType},
+		{"SADD k a", wrongType},
+		{"ZADD k 1 a", wrongType},
+		{"XADD k * f v", wrongType},
+		{"RPUSH l a", ":1"},
+		{"SET l v GET", wrongType},
+		{"GETSET l v", wrongType},
+		{"TYPE l", "+list"},
+		{"SET l v", "+OK"},
+		{"TYPE l", "+string"},
+		{"GETSET l w", `"v"`},
+		{"DEL l", ":1"},
+		{"RPUSH l a", ":1"},
+		{"GET l", wrongType},
+		{"INCR l", wrongType},
+		{"APPEND l x", wrongType},
+		{"HSET l f v", wrongType},
+		{"ZSCORE l a", wrongType},
+		{"SMEMBERS l", wrongType},
+	}},
+	{"wrong number of arguments", []step{
+		{"GET", "-ERR wrong number of arguments for 'get' command"},
+		{"GET a b", "-ERR wrong number of arguments for 'get' command"},
+		{"SET k", "-ERR wrong number of arguments for 'set' command"},
+		{"set k", "-ERR wrong number of arguments for 'set' command"},
+		{"PING a b", "-ERR wrong number of arguments for 'ping' command"},
+		{"INCR", "-ERR wrong number of arguments for 'incr' command"},
+		{"MSET a", "-ERR wrong number of arguments for 'mset' command"},
+		{"MGET", "-ERR wrong number of arguments for 'mget' command"},
+		{"DEL", "-ERR wrong number of arguments for 'del' command"},
+		{"EXISTS", "-ERR wrong number of arguments for 'exists' command"},
+		{"EXPIRE k", "-ERR wrong number of arguments for 'expire' command"},
+		{"TTL", "-ERR wrong number of arguments for 'ttl' command"},
+		{"LPUSH l", "-ERR wrong number of arguments for 'lpush' command"},
+		{"LRANGE l 0", "-ERR wrong number of arguments for 'lrange' command"},
+		{"HSET h f", "-ERR wrong number of arguments for 'hset' command"},
+		{"HSET h f v g", "-ERR wrong number of arguments for 'hset' command"},
+		{"HGETALL", "-ERR wrong number of arguments for 'hgetall' command"},
+		{"SADD s", "-ERR wrong number of arguments for 'sadd' command"},
+		{"ZADD z 1", "-ERR wrong number of arguments for 'zadd' command"},
+		{"ZSCORE z", "-ERR wrong number of arguments for 'zscore' command"},
+		{"TYPE", "-ERR wrong number of arguments for 'type' command"},
+		{"SELECT", "-ERR wrong number of arguments for 'select' command"},
+		{"BLPOP l", "-ERR wrong number of arguments for 'blpop' command"},
+		{"HSCAN h", "-ERR wrong number of arguments for 'hscan' command"},
+		{"XLEN", "-ERR wrong number of arguments for 'xlen' command"},
+		{"WATCH", "-ERR wrong number of arguments for 'watch' command"},
+		{"MULTI x", "-ERR wrong number of arguments for 'multi' command"},
+		{"XRANGE s", "-ERR wrong number of arguments for 'xrange' command"},
+		{"PFADD", "-ERR wrong number of arguments for 'pfadd' command"},
+		{"GEOADD g", "-ERR wrong number of arguments for 'geoadd' command"},
+		{"RENAME k", "-ERR wrong number of arguments for 'rename' command"},
+	}},
+	{"invalid values", []step{
+		{"SET k v", "+OK"},
+		{"INCR k", "-ERR value is not an integer or out of range"},
+		{"INCRBY n x", "-ERR value is not an integer or out of range"},
+		{"SET n 9223372036854775807", "+OK"},
+		{"INCR n", "-ERR increment or decrement would overflow"},
+		{"SET n 9223372036854775808", "+OK"},
+		{"INCR n", "-ERR value is not an integer or out of range"},
+		{"EXPIRE k x", "-ERR value is not an integer or out of range"},
+		{"LRANGE l a 1", "-ERR value is not an integer or out of range"},
+		{"ZADD z x a", "-ERR value is not a valid float"},
+		{"ZINCRBY z x a", "-ERR value is not a valid float"},
+		{"ZRANGEBYSCORE z x 1", "-ERR min or max is not a float"},
+		{"HSET h f v", ":1"},
+		{"HINCRBY h f 1", "-ERR hash value is not an integer"},
+		{"SET k v EX 0", "-ERR invalid expire time in 'set' command"},
+		{"SET k v EX x", "-ERR value is not an integer or out of range"},
+		{"SET k v NX XX", "-ERR syntax error"},
+		{"SET k v FOO", "-ERR syntax error"},
+		{"SELECT 99", "-ERR DB index is out of range"},
+		{"RPUSH l a", ":1"},
+		{"LSET l 5 x", "-ERR index out of range"},
+		{"LSET missing 0 x", "-ERR no such key"},
+		{"RENAME missing k2", "-ERR no such key"},
+		{"LINDEX l x", "-ERR value is not an integer or out of range"},
+		{"GETRANGE k a 1", "-ERR value is not an integer or out of range"},
+		{"ZADD z 1 a x", "-ERR syntax error"},
+		{"NOSUCH a b", "-ERR unknown command 'NOSUCH', with args beginning with: 'a' 'b' "},
+	}},
+
+	// TTL and expiry
+	{"ttl", []step{
+		{"TTL missing", ":-2"},
+		{"PTTL missing", ":-2"},
+		{"SET k v", "+OK"},
+		{"TTL k", ":-1"},
+		{"PTTL k", ":-1"},
+		{"EXPIRE k 100", ":1"},
+		{"TTL k", ":100"},
+		{"PTTL k", ":*"},
+		{"PERSIST k", ":1"},
+		{"PERSIST k", ":0"},
+		{"TTL k", ":-1"},
+		{"EXPIRE missing 100", ":0"},
+		{"PERSIST missing", ":0"},
+		{"SET k v EX 100", "+OK"},
+		{"SET k w", "+OK"},
+		{"TTL k", ":-1"},
+		{"SET k 1 EX 100", "+OK"},
+		{"INCR k", ":2"},
+		{"TTL k", ":100"},
+		{"SET k v KEEPTTL", "+OK"},
+		{"TTL k", ":100"},
+		{"PEXPIRE k 100000", ":1"},
+		{"TTL k", ":100"},
+		{"EXPIRE k 200 NX", ":0"},
+		{"EXPIRE k 50 GT", ":0"},
+		{"EXPIRE k 200 XX GT", ":1"},
+		{"TTL k", ":200"},
+		{"EXPIRE k 10 NX XX", "-ERR NX and XX, GT or LT options at the same time are not compatible"},
+		{"GETEX k PERSIST", `"v"`},
+		{"TTL k", ":-1"},
+		{"EXPIRE k 100 GT", ":0"},
+		{"EXPIRE k 100 LT", ":1"},
+		{"GETEX k EX 300", `"v"`},
+		{"TTL k", ":300"},
+		{"GETEX missing", "null"},
+	}},
+	{"expiry", []step{
+		{"SET k v PX 50", "+OK"},
+		{"SET p v", "+OK"},
+		{"PEXPIRE p 50", ":1"},
+		{"RPUSH l a", ":1"},
+		{"PEXPIRE l 50", ":1"},
+		{"SLEEP 120", ""},
+		{"GET k", "null"},
+		{"EXISTS k p l", ":0"},
+		{"TTL k", ":-2"},
+		{"LLEN l", ":0"},
+		{"SET k v", "+OK"},
+		{"EXPIRE k 0", ":1"},
+		{"EXISTS k", ":0"},
+		{"SET k v", "+OK"},
+		{"EXPIRE k -10", ":1"},
+		{"GET k", "null"},
+		{"SET k v", "+OK"},
+		{"EXPIREAT k 1", ":1"},
+		{"EXISTS k", ":0"},
+		{"HSET h f v", ":1"},
+		{"PEXPIREAT h 1", ":1"},
+		{"TYPE h", "+none"},
+	}},
+}
@@ -0,0 +1,96 @@
+package compat
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/wangbo/gocache/test/e2e/harness"
+)
+
+// step is a command and the reply Redis gives it, in the form rendered by
+// Conn. A "*" in the reply matches any text, for the parts that vary from
+// run to run. The pseudo-command "SLEEP ms" waits instead of sending a
+// command.
+type step struct {
+	cmd   string // split on spaces
+	reply string
+}
+
+// compatCase is a sequence of commands run on an empty database
+type compatCase struct {
+	name  string
+	steps []step
+}
+
+// TestCompat runs the cases against an in-process gocache and, if
+// REDIS_ADDR is set, against the Redis at that address. Each case starts by
+// flushing database 9 of that Redis: point REDIS_ADDR only at a disposable
+// instance.
+func TestCompat(t *testing.T) {
+	t.Run("gocache", func(t *testing.T) {
+		runCases(t, harness.Start(t).Addr())
+	})
+	if addr := os.Getenv("REDIS_ADDR"); addr != "" {
+		t.Run("redis", func(t *testing.T) {
+			runCases(t, addr)
+		})
+	}
+}
+
+func runCases(t *testing.T, addr string) {
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			conn, err := Dial(addr)
+			if err != nil {
+				t.Fatalf("Dial: %v", err)
+			}
+			defer conn.Close()
+
+			for _, cmd := range []string{"SELECT 9", "FLUSHDB"} {
+				if reply, err := conn.Do(strings.Fields(cmd)...); err != nil || reply != "+OK" {
+					t.Fatalf("%s: %s %v", cmd, reply, err)
+				}
+			}
+			for _, s := range tc.steps {
+				args := strings.Fields(s.cmd)
+				if strings.ToUpper(args[0]) == "SLEEP" {
+					ms, _ := strconv.Atoi(args[1])
+					time.Sleep(time.Duration(ms) * time.Millisecond)
+					continue
+				}
+				reply, err := conn.Do(args...)
+				if err != nil {
+					t.Fatalf("%s: %v", s.cmd, err)
+				}
+				if !matchReply(s.reply, reply) {
+					t.Errorf("%s:\n  want %s\n  got  %s", s.cmd, s.reply, reply)
+				}
+			}
+		})
+	}
+}
+
+// matchReply reports whether reply matches want, where each "*" of want
+// matches any text
+func matchReply(want, reply string) bool {
+	parts := strings.Split(want, "*")
+	if len(parts) == 1 {
+		return reply == want
+	}
+	if !strings.HasPrefix(reply, parts[0]) {
+		return false
+	}
+	reply = reply[len(parts[0]):]
+	last := len(parts) - 1
+	for _, part := range parts[1:last] {
+		i := strings.Index(reply, part)
+		if i < 0 {
+			return false
+		}
+		reply = reply[i+len(part):]
+	}
+	return strings.HasSuffix(reply, parts[last])
+}
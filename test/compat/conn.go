@@ -0,0 +1,105 @@
+// Package compat checks that gocache replies to commands byte for byte as
+// Redis does. Each case of its table is a sequence of commands and the
+// replies Redis gives them; the tests run it against an in-process server
+// and, when REDIS_ADDR is set, against that Redis too, so that the table
+// itself is checked.
+package compat
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Conn is a connection that renders replies in a compact form which keeps
+// their RESP type:
+//
+//	+OK              a status
+//	-ERR message     an error
+//	:1               an integer
+//	"value"          a bulk string, quoted as in Go
+//	null             a null bulk string
+//	null-array       a null array
+//	("a", :1, ())    an array of the replies of its elements
+type Conn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// Dial connects to the server at addr
+func Dial(addr string) (*Conn, error) {
+	conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	return &Conn{conn: conn, reader: bufio.NewReader(conn)}, nil
+}
+
+// Close closes the connection
+func (c *Conn) Close() error {
+	return c.conn.Close()
+}
+
+// Do sends a command and returns its rendered reply
+func (c *Conn) Do(args ...string) (string, error) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	c.conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.conn.Write([]byte(b.String())); err != nil {
+		return "", err
+	}
+	return c.readReply()
+}
+
+// readReply reads a reply and renders it
+func (c *Conn) readReply() (string, error) {
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return "", fmt.Errorf("empty reply line")
+	}
+
+	switch line[0] {
+	case '+', '-', ':':
+		return line, nil
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return "", fmt.Errorf("invalid bulk length: %q", line)
+		}
+		if n < 0 {
+			return "null", nil
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(c.reader, data); err != nil {
+			return "", err
+		}
+		return strconv.Quote(string(data[:n])), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return "", fmt.Errorf("invalid array length: %q", line)
+		}
+		if n < 0 {
+			return "null-array", nil
+		}
+		elements := make([]string, n)
+		for i := range elements {
+			if elements[i], err = c.readReply(); err != nil {
+				return "", err
+			}
+		}
+		return "(" + strings.Join(elements, ", ") + ")", nil
+	}
+	return "", fmt.Errorf("unknown reply type: %q", line)
+}
@@ -0,0 +1,120 @@
+package functional
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/wangbo/gocache/test/e2e"
+	"github.com/wangbo/gocache/test/e2e/harness"
+)
+
+// replOffset returns the repl_offset field of INFO replication
+func replOffset(t *testing.T, client *e2e.TestClient) uint64 {
+	t.Helper()
+	reply, err := client.Send("INFO", "replication")
+	if err != nil {
+		t.Fatalf("INFO failed: %v", err)
+	}
+	for _, line := range strings.Split(reply.GetString(), "\r\n") {
+		if value, ok := strings.CutPrefix(line, "repl_offset:"); ok {
+			offset, _ := strconv.ParseUint(value, 10, 64)
+			return offset
+		}
+	}
+	t.Fatalf("No repl_offset in %q", reply.GetString())
+	return 0
+}
+
+// replicaOf makes the server of client replicate the server at addr
+func replicaOf(t *testing.T, client *e2e.TestClient, addr string) {
+	t.Helper()
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Execute("REPLICAOF", host, port); err != nil {
+		t.Fatalf("REPLICAOF failed: %v", err)
+	}
+}
+
+// TestFailover_ManualPromotion promotes a replica while a client keeps
+// writing to the master and checks that every acknowledged write survives
+func TestFailover_ManualPromotion(t *testing.T) {
+	master, replica := harness.Start(t), harness.Start(t)
+	masterAdmin, replicaAdmin := master.Client(t), replica.Client(t)
+
+	replicaOf(t, replicaAdmin, master.Addr())
+	for master.DB.Replication().GetSlaveCount() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	masterAdmin.Execute("SET", "synced", "1")
+	waitForValue(t, replicaAdmin, "synced", "1")
+
+	// Keep writing until the master refuses writes
+	writer := master.Client(t)
+	acked := make(chan int, 100000)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; ; i++ {
+			reply, err := writer.Send("SET", "key:"+strconv.Itoa(i), strconv.Itoa(i))
+			if err != nil || !reply.IsOK() {
+				return
+			}
+			acked <- i
+		}
+	}()
+	for len(acked) < 100 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// Pause writes on the master and wait for the replica to catch up
+	if _, err := masterAdmin.Execute("CLIENT", "PAUSE", "10000", "WRITE"); err != nil {
+		t.Fatalf("CLIENT PAUSE failed: %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for replOffset(t, replicaAdmin) != replOffset(t, masterAdmin) {
+		if time.Now().After(deadline) {
+			t.Fatal("Replica did not reach the master's offset")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// Promote the replica, demote the master and release the paused writer,
+	// whose write is now refused
+	if _, err := replicaAdmin.Execute("REPLICAOF", "NO", "ONE"); err != nil {
+		t.Fatalf("REPLICAOF NO ONE failed: %v", err)
+	}
+	replicaOf(t, masterAdmin, replica.Addr())
+	if _, err := masterAdmin.Execute("CLIENT", "UNPAUSE"); err != nil {
+		t.Fatalf("CLIENT UNPAUSE failed: %v", err)
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("The writer was not refused after the demotion")
+	}
+	if _, err := masterAdmin.Execute("FAILOVER", "ABORT"); err == nil {
+		t.Error("Expected FAILOVER ABORT to report that no failover is in progress")
+	}
+
+	close(acked)
+	n := 0
+	for i := range acked {
+		reply, err := replicaAdmin.Send("GET", "key:"+strconv.Itoa(i))
+		if err != nil || reply.GetString() != strconv.Itoa(i) {
+			t.Fatalf("Acknowledged write key:%d is missing on the promoted replica", i)
+		}
+		n++
+	}
+	t.Logf("%d acknowledged writes survived the promotion", n)
+
+	// The new master takes writes and replicates them to the old one
+	if _, err := replicaAdmin.Execute("SET", "after", "promotion"); err != nil {
+		t.Fatalf("SET on the promoted replica failed: %v", err)
+	}
+	waitForValue(t, masterAdmin, "after", "promotion")
+}
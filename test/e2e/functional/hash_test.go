@@ -9,7 +9,7 @@ import (
 
 var _ = &e2e.TestClient{} // Verify e2e.TestClient implements expected interface
 
-// setupTestClient creates a test client (defined in string_test.go)
+// setupTestClient starts a server and connects a client (defined in common_test.go)
 // This is a common helper used across all functional test files
 
 // TestHash_BasicOperations tests basic HSET, HGET, HGETALL operations
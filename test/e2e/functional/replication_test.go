@@ -0,0 +1,173 @@
+package functional
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/wangbo/gocache/test/e2e"
+	"github.com/wangbo/gocache/test/e2e/harness"
+)
+
+// waitForValue polls key on client until it holds want or the timeout expires
+func waitForValue(t *testing.T, client *e2e.TestClient, key, want string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	var got string
+	for time.Now().Before(deadline) {
+		reply, err := client.Send("GET", key)
+		if err != nil {
+			t.Fatalf("GET %s failed: %v", key, err)
+		}
+		if got = reply.GetString(); got == want {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Expected %s to be %q, got %q", key, want, got)
+}
+
+// TestReplication_MasterAndSlaveInOneProcess tests a slave replicating from
+// a master served by the same process
+func TestReplication_MasterAndSlaveInOneProcess(t *testing.T) {
+	master, slave := harness.Start(t), harness.Start(t)
+	masterClient, slaveClient := master.Client(t), slave.Client(t)
+
+	// Written before SLAVEOF, so it arrives with the full sync
+	if _, err := masterClient.Execute("SET", "before", "sync"); err != nil {
+		t.Fatalf("SET failed: %v", err)
+	}
+
+	host, port, err := net.SplitHostPort(master.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := slaveClient.Execute("SLAVEOF", host, port); err != nil {
+		t.Fatalf("SLAVEOF failed: %v", err)
+	}
+	waitForValue(t, slaveClient, "before", "sync")
+
+	// Written after the sync, so it is propagated
+	if _, err := masterClient.Execute("SET", "after", "propagated"); err != nil {
+		t.Fatalf("SET failed: %v", err)
+	}
+	waitForValue(t, slaveClient, "after", "propagated")
+
+	// Each server keeps its own role
+	if !master.DB.Replication().IsMaster() {
+		t.Error("Expected the master to remain a master")
+	}
+	if !slave.DB.Replication().IsSlave() {
+		t.Error("Expected the slave to be a slave")
+	}
+	if n := master.DB.Replication().GetSlaveCount(); n != 1 {
+		t.Errorf("Expected the master to have 1 slave, got %d", n)
+	}
+}
+
+// clientAddr matches the address of a client in a MONITOR line
+var clientAddr = regexp.MustCompile(`127\.0\.0\.1:[0-9]+`)
+
+// monitor starts MONITOR with args on a new connection to s and returns the
+// reader of the lines it shows
+func monitor(t *testing.T, s *harness.Server, args ...string) *bufio.Reader {
+	t.Helper()
+	conn, err := net.Dial("tcp", s.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	cmd := fmt.Sprintf("*%d\r\n$7\r\nMONITOR\r\n", len(args)+1)
+	for _, arg := range args {
+		cmd += fmt.Sprintf("$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := conn.Write([]byte(cmd)); err != nil {
+		t.Fatal(err)
+	}
+	r := bufio.NewReader(conn)
+	for i := 0; i < 2; i++ { // +OK, then +OK with the time
+		if line, err := r.ReadString('\n'); err != nil || !strings.HasPrefix(line, "+OK") {
+			t.Fatalf("Expected MONITOR to start, got %q (%v)", line, err)
+		}
+	}
+	return r
+}
+
+// monitorLines reads the lines shown by a monitor up to the one containing
+// last, and returns them without their timestamp
+func monitorLines(t *testing.T, r *bufio.Reader, last string) []string {
+	t.Helper()
+	var lines []string
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Expected a line containing %q, got %q (%v)", last, lines, err)
+		}
+		_, line, _ = strings.Cut(strings.TrimSuffix(line, "\r\n"), " ")
+		lines = append(lines, line)
+		if strings.Contains(line, last) {
+			return lines
+		}
+	}
+}
+
+// TestMonitorShowsReplicationAndExec tests that MONITOR shows the commands
+// applied from the master and those run by EXEC, tagged with their origin
+func TestMonitorShowsReplicationAndExec(t *testing.T) {
+	master, slave := harness.Start(t), harness.Start(t)
+	masterClient, slaveClient := master.Client(t), slave.Client(t)
+
+	host, port, err := net.SplitHostPort(master.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := slaveClient.Execute("SLAVEOF", host, port); err != nil {
+		t.Fatalf("SLAVEOF failed: %v", err)
+	}
+	if _, err := masterClient.Execute("SET", "synced", "yes"); err != nil {
+		t.Fatalf("SET failed: %v", err)
+	}
+	waitForValue(t, slaveClient, "synced", "yes")
+
+	all := monitor(t, slave)
+	local := monitor(t, slave, "NO-REPLICATION")
+
+	if _, err := masterClient.Execute("SET", "k", "from-master"); err != nil {
+		t.Fatalf("SET failed: %v", err)
+	}
+	waitForValue(t, slaveClient, "k", "from-master")
+	for _, cmd := range []string{"MULTI", "GET k", "EXEC"} {
+		args := strings.Fields(cmd)
+		if _, err := slaveClient.Send(args[0], args[1:]...); err != nil {
+			t.Fatalf("%s failed: %v", cmd, err)
+		}
+	}
+
+	lines := monitorLines(t, all, `"SET k from-master"`)
+	if got := lines[len(lines)-1]; got != `[db 0 replication] "SET k from-master"` {
+		t.Errorf("Expected the replicated SET to be tagged replication, got %q", got)
+	}
+
+	lines = monitorLines(t, local, `[db 0 EXEC] "GET k"`)
+	for _, line := range lines {
+		if strings.Contains(line, "replication") {
+			t.Errorf("Expected NO-REPLICATION to hide %q", line)
+		}
+	}
+	// MULTI and EXEC are shown with the address of the client, and EXEC
+	// before the commands it runs
+	var tail []string
+	for _, line := range lines[max(len(lines)-3, 0):] {
+		tail = append(tail, clientAddr.ReplaceAllString(line, "client"))
+	}
+	want := []string{`[db 0 client] "MULTI"`, `[db 0 client] "EXEC"`, `[db 0 EXEC] "GET k"`}
+	if strings.Join(tail, "\n") != strings.Join(want, "\n") {
+		t.Errorf("Expected the transaction to be shown as %q, got %q", want, tail)
+	}
+}
@@ -233,6 +233,39 @@ func TestSet_MemberOperations(t *testing.T) {
 			t.Errorf("SRANDMEMBER on empty set should return nil, got %v", reply.GetString())
 		}
 	})
+
+	t.Run("SPOP and SRANDMEMBER with a count", func(t *testing.T) {
+		client.Send("DEL", "countset")
+		client.Send("SADD", "countset", "a", "b", "c", "d", "e")
+
+		reply, err := client.Send("SRANDMEMBER", "countset", "-8")
+		if err != nil {
+			t.Fatalf("SRANDMEMBER failed: %v", err)
+		}
+		if n := len(reply.ToStringArray()); n != 8 {
+			t.Errorf("SRANDMEMBER with a negative count should return 8 members, got %d", n)
+		}
+
+		reply, err = client.Send("SPOP", "countset", "3")
+		if err != nil {
+			t.Fatalf("SPOP failed: %v", err)
+		}
+		popped := reply.ToStringArray()
+		seen := make(map[string]bool)
+		for _, member := range popped {
+			if seen[member] {
+				t.Errorf("SPOP returned %s twice", member)
+			}
+			seen[member] = true
+		}
+		if len(popped) != 3 {
+			t.Errorf("SPOP with a count should return 3 members, got %v", popped)
+		}
+		size, _ := client.Send("SCARD", "countset")
+		if n, _ := size.GetInt(); n != 2 {
+			t.Errorf("After SPOP 3, set size should be 2, got %d", n)
+		}
+	})
 }
 
 // TestSet_MoveOperations tests SMOVE
@@ -2,6 +2,7 @@ package functional
 
 import (
 	"fmt"
+	"strings"
 	"testing"
 
 	"github.com/wangbo/gocache/test/e2e"
@@ -393,4 +394,23 @@ func TestString_BinarySafety(t *testing.T) {
 		}
 		client.Send("DEL", "empty_key")
 	})
+
+	t.Run("binary keys", func(t *testing.T) {
+		key := "bin\r\n\x00\xff\xc3("
+		value := "\x82\xa3foo\x01\r\n" + strings.Repeat("\x00\xff", 40000)
+		reply, err := client.Send("SET", key, value)
+		if err != nil || !reply.IsOK() {
+			t.Fatalf("SET with a binary key failed: %v", err)
+		}
+
+		getReply, _ := client.Send("GET", key)
+		if getReply.GetString() != value {
+			t.Errorf("Binary value not preserved, got %d bytes", len(getReply.GetString()))
+		}
+		keys, err := client.Execute("KEYS", "bin\r\n*")
+		if err != nil || len(keys) != 1 || keys[0] != key {
+			t.Errorf("Expected KEYS to return %q, got %q (%v)", key, keys, err)
+		}
+		client.Send("DEL", key)
+	})
 }
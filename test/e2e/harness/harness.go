@@ -0,0 +1,163 @@
+// Package harness runs a complete GoCache server inside the test process so
+// that end-to-end tests work under a plain go test, without a server started
+// beforehand.
+//
+// Every server listens on a free port of the loopback interface, keeps its
+// AOF and RDB files in a temporary directory and has its own configuration,
+// replication state and monitor, so servers of parallel tests never share
+// data and servers of one test can replicate from each other.
+package harness
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/wangbo/gocache/auth"
+	"github.com/wangbo/gocache/config"
+	"github.com/wangbo/gocache/database"
+	"github.com/wangbo/gocache/monitor"
+	"github.com/wangbo/gocache/persistence"
+	"github.com/wangbo/gocache/persistence/aof"
+	"github.com/wangbo/gocache/persistence/rdb"
+	"github.com/wangbo/gocache/replication"
+	"github.com/wangbo/gocache/server"
+	"github.com/wangbo/gocache/test/e2e"
+)
+
+// Server is a GoCache server running in the test process
+type Server struct {
+	// Config is the configuration the server was started with
+	Config *config.Properties
+	// DB is the server's database, for inspecting it without a client
+	DB *database.DB
+	// Dir is the temporary directory holding the AOF and RDB files
+	Dir string
+
+	srv     *server.Server
+	aof     *aof.AOFHandler
+	served  chan error
+	stopped bool
+}
+
+// Start starts a server and stops it when the test finishes. The options
+// adjust the default test configuration before the server is built; the AOF
+// and RDB file names are relative to Dir. As on startup, the dataset is
+// loaded from the files of Dir if there are any.
+func Start(tb testing.TB, options ...func(*config.Properties)) *Server {
+	tb.Helper()
+
+	// The registries are global, but every server registers the same
+	// implementations
+	persistence.RegisterSaver(&rdb.RDBSaver{})
+	persistence.RegisterLoader(&rdb.RDBLoaderImpl{})
+	replication.RegisterRDBLoader(&rdb.RDBLoaderImpl{})
+
+	dir := tb.TempDir()
+	cfg := config.Default()
+	cfg.Port = 0
+	cfg.Dir = dir
+	for _, option := range options {
+		option(cfg)
+	}
+	// An option may set Dir to the directory of a stopped server, to
+	// restart it from its files
+	dir = cfg.Dir
+
+	repl := replication.NewReplicationState()
+	repl.SetSlaveOutputBufferLimit(cfg.OutputBufferHardLimit("replica"))
+	repl.SetProtoLimits(cfg.ProtoMaxMultiBulkLen, cfg.ProtoMaxBulkLen)
+	s := &Server{
+		Config: cfg,
+		DB:     database.MakeDBWithConfig(cfg, repl),
+		Dir:    dir,
+		served: make(chan error, 1),
+	}
+
+	var authenticator *auth.Authenticator
+	if cfg.RequirePass != "" {
+		authenticator = auth.NewAuthenticator()
+		authenticator.SetPassword(cfg.RequirePass)
+	}
+
+	handler := server.MakeHandlerWithAuth(s.DB, nil, authenticator)
+	handler.SetMonitor(monitor.NewMonitor())
+	s.srv = server.MakeServer(cfg, handler)
+	if err := s.srv.Listen(); err != nil {
+		s.close()
+		tb.Fatalf("Failed to start server: %v", err)
+	}
+	go func() {
+		s.served <- s.srv.Serve()
+	}()
+
+	// Clients are refused with LOADING until the files are loaded
+	aofHandler, err := handler.LoadDataset(cfg)
+	if err != nil {
+		s.srv.Stop()
+		<-s.served
+		s.close()
+		tb.Fatalf("Failed to load the dataset: %v", err)
+	}
+	s.aof = aofHandler
+
+	tb.Cleanup(func() {
+		if err := s.Stop(); err != nil {
+			tb.Errorf("Server stopped with an error: %v", err)
+		}
+	})
+	return s
+}
+
+// Addr returns the host:port the server listens on
+func (s *Server) Addr() string {
+	return s.srv.Addr().String()
+}
+
+// Client returns a client connected to the server, authenticated if the
+// server requires a password. The client is closed when the test finishes.
+func (s *Server) Client(tb testing.TB) *e2e.TestClient {
+	tb.Helper()
+
+	client := e2e.NewTestClient(s.Addr())
+	if err := client.Connect(); err != nil {
+		tb.Fatalf("Failed to connect to %s: %v", s.Addr(), err)
+	}
+	tb.Cleanup(func() { client.Close() })
+
+	if s.Config.RequirePass != "" {
+		if _, err := client.Send("AUTH", s.Config.RequirePass); err != nil {
+			tb.Fatalf("Failed to authenticate: %v", err)
+		}
+	}
+	return client
+}
+
+// Stop closes the clients' connections, waits for them to be served and
+// releases the database and the AOF. It is called when the test finishes and
+// may be called earlier, e.g. to restart a server from its files.
+func (s *Server) Stop() error {
+	if s.stopped {
+		return nil
+	}
+	s.stopped = true
+
+	s.srv.Stop()
+	var err error
+	select {
+	case err = <-s.served:
+	case <-time.After(5 * time.Second):
+		err = errors.New("server did not stop accepting connections")
+	}
+	s.close()
+	return err
+}
+
+func (s *Server) close() {
+	// A slave stops syncing with its master and applying its commands
+	s.DB.Replication().SetAsMaster()
+	if s.aof != nil {
+		s.aof.Close()
+	}
+	s.DB.Close()
+}
@@ -0,0 +1,381 @@
+package harness
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/wangbo/gocache/config"
+	"github.com/wangbo/gocache/test/e2e"
+)
+
+func TestServersAreIsolated(t *testing.T) {
+	a, b := Start(t), Start(t)
+	if a.Addr() == b.Addr() {
+		t.Fatalf("Expected distinct addresses, both listen on %s", a.Addr())
+	}
+
+	if _, err := a.Client(t).Execute("SET", "k", "a"); err != nil {
+		t.Fatalf("SET failed: %v", err)
+	}
+	reply, err := b.Client(t).Send("GET", "k")
+	if err != nil {
+		t.Fatalf("GET failed: %v", err)
+	}
+	if !reply.IsNil() {
+		t.Errorf("Expected k to be missing on the other server, got %v", reply.Data)
+	}
+
+	// Each server reports its own replication state
+	if _, err := a.Client(t).Execute("SLAVEOF", "127.0.0.1", "1"); err != nil {
+		t.Fatalf("SLAVEOF failed: %v", err)
+	}
+	defer a.Client(t).Execute("SLAVEOF", "NO", "ONE")
+	if !b.DB.Replication().IsMaster() {
+		t.Error("Expected SLAVEOF on one server not to change the role of the other")
+	}
+}
+
+func TestPasswordAndPersistenceFiles(t *testing.T) {
+	s := Start(t, func(cfg *config.Properties) {
+		cfg.RequirePass = "secret"
+		cfg.AppendOnly = true
+	})
+
+	anonymous := e2e.NewTestClient(s.Addr())
+	if err := anonymous.Connect(); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer anonymous.Close()
+	if _, err := anonymous.Send("GET", "k"); err == nil {
+		t.Error("Expected a client without AUTH to be refused")
+	}
+
+	client := s.Client(t)
+	if _, err := client.Execute("SET", "k", "v"); err != nil {
+		t.Fatalf("SET failed: %v", err)
+	}
+	if _, err := client.Execute("SAVE"); err != nil {
+		t.Fatalf("SAVE failed: %v", err)
+	}
+	if err := s.Stop(); err != nil {
+		t.Fatalf("Stop failed: %v", err)
+	}
+
+	for _, name := range []string{s.Config.AppendFilename, s.Config.DBFilename} {
+		file := filepath.Join(s.Dir, name)
+		if info, err := os.Stat(file); err != nil || info.Size() == 0 {
+			t.Errorf("Expected %s to be written in the test directory: %v", file, err)
+		} else if perm := info.Mode().Perm(); perm != 0600 {
+			t.Errorf("Expected %s to be readable by its owner only, got %o", file, perm)
+		}
+	}
+}
+
+func TestRestartLoadsData(t *testing.T) {
+	withDir := func(dir string, appendOnly bool) func(*config.Properties) {
+		return func(cfg *config.Properties) {
+			cfg.Dir = dir
+			cfg.AppendOnly = appendOnly
+		}
+	}
+	check := func(s *Server, want map[string]string) {
+		t.Helper()
+		client := s.Client(t)
+		for key, value := range want {
+			reply, err := client.Send("GET", key)
+			if err != nil || reply.GetString() != value {
+				t.Errorf("GET %s: expected %q, got %v, %v", key, value, reply, err)
+			}
+		}
+	}
+
+	// From the AOF
+	s := Start(t, func(cfg *config.Properties) { cfg.AppendOnly = true })
+	client := s.Client(t)
+	for _, cmd := range [][]string{{"SET", "a", "1"}, {"SET", "b", "2"}, {"DEL", "b"}, {"INCR", "n"}} {
+		if _, err := client.Execute(cmd[0], cmd[1:]...); err != nil {
+			t.Fatalf("%v: %v", cmd, err)
+		}
+	}
+	if err := s.Stop(); err != nil {
+		t.Fatalf("Stop failed: %v", err)
+	}
+	restarted := Start(t, withDir(s.Dir, true))
+	check(restarted, map[string]string{"a": "1", "n": "1"})
+	if keys := restarted.DB.Keys(); len(keys) != 2 {
+		t.Errorf("Expected 2 keys, got %v", keys)
+	}
+	restarted.Stop()
+
+	// From the RDB file, without AOF
+	s = Start(t)
+	client = s.Client(t)
+	client.Execute("SET", "r", "rdb")
+	if _, err := client.Execute("SAVE"); err != nil {
+		t.Fatalf("SAVE failed: %v", err)
+	}
+	s.Stop()
+	check(Start(t, withDir(s.Dir, false)), map[string]string{"r": "rdb"})
+
+	// Enabling the AOF on a directory holding only the RDB file keeps the
+	// data on the following restarts
+	restarted = Start(t, withDir(s.Dir, true))
+	check(restarted, map[string]string{"r": "rdb"})
+	restarted.Client(t).Execute("SET", "after", "aof")
+	restarted.Stop()
+	if err := os.Remove(restarted.Config.DataPath(restarted.Config.DBFilename)); err != nil {
+		t.Fatal(err)
+	}
+	check(Start(t, withDir(s.Dir, true)), map[string]string{"r": "rdb", "after": "aof"})
+}
+
+func TestStopDisconnectsClients(t *testing.T) {
+	s := Start(t)
+	client := s.Client(t)
+	if _, err := client.Execute("PING"); err != nil {
+		t.Fatalf("PING failed: %v", err)
+	}
+
+	if err := s.Stop(); err != nil {
+		t.Fatalf("Stop failed: %v", err)
+	}
+	if _, err := client.Send("PING"); err == nil {
+		t.Error("Expected the connection to be closed by Stop")
+	}
+}
+
+// connect returns a client that has not sent AUTH
+func connect(t *testing.T, s *Server) *e2e.TestClient {
+	t.Helper()
+	client := e2e.NewTestClient(s.Addr())
+	if err := client.Connect(); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+func TestRequirePassRotation(t *testing.T) {
+	s := Start(t, func(cfg *config.Properties) { cfg.RequirePass = "old" })
+	admin := s.Client(t)
+
+	if _, err := admin.Execute("CONFIG", "SET", "requirepass", "new"); err != nil {
+		t.Fatalf("CONFIG SET failed: %v", err)
+	}
+	if reply, _ := admin.Execute("CONFIG", "GET", "requirepass"); strings.Join(reply, " ") != "requirepass new" {
+		t.Errorf("Expected CONFIG GET to return the new password, got %q", reply)
+	}
+
+	// The connection authenticated with the old password stays authenticated
+	if _, err := admin.Execute("SET", "k", "v"); err != nil {
+		t.Errorf("Expected the authenticated client to keep working, got %v", err)
+	}
+
+	client := connect(t, s)
+	if _, err := client.Send("GET", "k"); err == nil || !strings.Contains(err.Error(), "NOAUTH") {
+		t.Errorf("Expected NOAUTH, got %v", err)
+	}
+	if _, err := client.Send("AUTH", "old"); err == nil || !strings.Contains(err.Error(), "ERR invalid password") {
+		t.Errorf("Expected the old password to be refused, got %v", err)
+	}
+	if _, err := client.Execute("AUTH", "new"); err != nil {
+		t.Fatalf("Expected the new password to be accepted, got %v", err)
+	}
+	if reply, err := client.Execute("GET", "k"); err != nil || reply[0] != "v" {
+		t.Errorf("Expected v, got %q %v", reply, err)
+	}
+}
+
+func TestRequirePassDisabled(t *testing.T) {
+	s := Start(t, func(cfg *config.Properties) { cfg.RequirePass = "secret" })
+	if _, err := s.Client(t).Execute("CONFIG", "SET", "requirepass", ""); err != nil {
+		t.Fatalf("CONFIG SET failed: %v", err)
+	}
+
+	client := connect(t, s)
+	if _, err := client.Execute("SET", "k", "v"); err != nil {
+		t.Errorf("Expected no password to be required, got %v", err)
+	}
+	_, err := client.Send("AUTH", "anything")
+	if err == nil || !strings.Contains(err.Error(), "ERR Client sent AUTH, but no password is set") {
+		t.Errorf("Expected AUTH to fail without a password, got %v", err)
+	}
+
+	// Setting a password again keeps the connections made without one, and
+	// requires it from new ones
+	if _, err := client.Execute("CONFIG", "SET", "requirepass", "again"); err != nil {
+		t.Fatalf("CONFIG SET failed: %v", err)
+	}
+	if _, err := client.Execute("GET", "k"); err != nil {
+		t.Errorf("Expected the open connection to stay authenticated, got %v", err)
+	}
+	if _, err := connect(t, s).Send("GET", "k"); err == nil || !strings.Contains(err.Error(), "NOAUTH") {
+		t.Errorf("Expected NOAUTH for a new connection, got %v", err)
+	}
+}
+
+func TestAuthWithoutPassword(t *testing.T) {
+	client := connect(t, Start(t))
+	_, err := client.Send("AUTH", "anything")
+	if err == nil || !strings.Contains(err.Error(), "ERR Client sent AUTH, but no password is set") {
+		t.Errorf("Expected AUTH to fail without a password, got %v", err)
+	}
+}
+
+func TestRenamedCommands(t *testing.T) {
+	s := Start(t, func(cfg *config.Properties) {
+		cfg.RenameCommands = map[string]string{"FLUSHALL": "wipe-it", "DEBUG": ""}
+	})
+	client := s.Client(t)
+	client.Execute("SET", "k", "v")
+
+	for _, cmd := range []string{"FLUSHALL", "flushall", "DEBUG"} {
+		if _, err := client.Send(cmd); err == nil || !strings.Contains(err.Error(), "unknown command") {
+			t.Errorf("%s: expected an unknown command error, got %v", cmd, err)
+		}
+	}
+	if !s.DB.Exists("k") {
+		t.Fatal("Expected the refused FLUSHALL to leave k")
+	}
+
+	// A disabled command fails a transaction like an unknown one
+	client.Execute("MULTI")
+	client.Send("DEBUG", "SLEEP", "0")
+	if _, err := client.Send("EXEC"); err == nil || !strings.Contains(err.Error(), "EXECABORT") {
+		t.Errorf("Expected EXEC to abort, got %v", err)
+	}
+
+	if _, err := client.Execute("WIPE-IT"); err != nil {
+		t.Fatalf("Renamed FLUSHALL failed: %v", err)
+	}
+	if s.DB.Exists("k") {
+		t.Error("Expected the renamed FLUSHALL to remove k")
+	}
+}
+
+func TestAOFWrittenWithRenamesLoadsWithout(t *testing.T) {
+	s := Start(t, func(cfg *config.Properties) {
+		cfg.AppendOnly = true
+		cfg.RenameCommands = map[string]string{"SET": "put", "DEL": "remove"}
+	})
+	client := s.Client(t)
+	for _, cmd := range [][]string{{"PUT", "a", "1"}, {"PUT", "b", "2"}, {"REMOVE", "b"}} {
+		if _, err := client.Execute(cmd[0], cmd[1:]...); err != nil {
+			t.Fatalf("%v: %v", cmd, err)
+		}
+	}
+	if err := s.Stop(); err != nil {
+		t.Fatalf("Stop failed: %v", err)
+	}
+
+	restarted := Start(t, func(cfg *config.Properties) {
+		cfg.Dir = s.Dir
+		cfg.AppendOnly = true
+	})
+	reply, err := restarted.Client(t).Send("GET", "a")
+	if err != nil || reply.GetString() != "1" {
+		t.Errorf("GET a: expected 1, got %v, %v", reply, err)
+	}
+	if keys := restarted.DB.Keys(); len(keys) != 1 {
+		t.Errorf("Expected 1 key, got %v", keys)
+	}
+}
+
+// clientLine returns the CLIENT LIST line of the connection running cmd
+func clientLine(t *testing.T, client *e2e.TestClient, cmd string) string {
+	t.Helper()
+	list, err := client.Execute("CLIENT", "LIST")
+	if err != nil || len(list) != 1 {
+		t.Fatalf("CLIENT LIST failed: %v", err)
+	}
+	for _, line := range strings.Split(list[0], "\n") {
+		if strings.Contains(line, " cmd="+cmd+" ") {
+			return line
+		}
+	}
+	t.Fatalf("No client runs %s in:\n%s", cmd, list[0])
+	return ""
+}
+
+// clientField returns the value of a field of a CLIENT LIST line
+func clientField(t *testing.T, line, field string) int64 {
+	t.Helper()
+	m := regexp.MustCompile(" " + field + "=(-?[0-9]+)").FindStringSubmatch(line)
+	if m == nil {
+		t.Fatalf("No %s in %q", field, line)
+	}
+	n, _ := strconv.ParseInt(m[1], 10, 64)
+	return n
+}
+
+func TestClientListShowsRunningCommand(t *testing.T) {
+	s := Start(t)
+	sleeper, observer := s.Client(t), s.Client(t)
+	sleeper.Execute("SET", "k", "v")
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := sleeper.Execute("DEBUG", "SLEEP", "0.5")
+		done <- err
+	}()
+	time.Sleep(200 * time.Millisecond)
+
+	line := clientLine(t, observer, "debug")
+	if running := clientField(t, line, "running-ms"); running < 100 || running > 500 {
+		t.Errorf("Expected DEBUG SLEEP running for about 200ms, got %dms in %q", running, line)
+	}
+	if cmds := clientField(t, line, "tot-cmds"); cmds != 1 {
+		t.Errorf("Expected 1 finished command, got %d", cmds)
+	}
+	if in := clientField(t, line, "tot-net-in"); in == 0 {
+		t.Errorf("Expected the bytes received to be counted, got %q", line)
+	}
+
+	if err := <-done; err != nil {
+		t.Fatalf("DEBUG SLEEP failed: %v", err)
+	}
+	line = clientLine(t, observer, "debug")
+	if running := clientField(t, line, "running-ms"); running != 0 {
+		t.Errorf("Expected no running command after DEBUG SLEEP, got %dms", running)
+	}
+	if cmds := clientField(t, line, "tot-cmds"); cmds != 2 {
+		t.Errorf("Expected 2 finished commands, got %d", cmds)
+	}
+	if out := clientField(t, line, "tot-net-out"); out < int64(len("+OK\r\n")*2) {
+		t.Errorf("Expected the two replies to be counted, got %d bytes", out)
+	}
+}
+
+func TestClientOutputBufferLimit(t *testing.T) {
+	s := Start(t, func(cfg *config.Properties) {
+		cfg.ClientOutputBufferLimits = []string{"normal 1kb 0 0"}
+	})
+	value := strings.Repeat("x", 4096)
+	s.Client(t).Execute("SET", "big", value)
+
+	client := s.Client(t)
+	if _, err := client.Execute("GET", "big"); err == nil {
+		t.Error("Expected a reply above the limit to close the connection")
+	}
+
+	// CLIENT NO-EVICT exempts a slow monitoring client
+	client = s.Client(t)
+	if _, err := client.Execute("CLIENT", "NO-EVICT", "on"); err != nil {
+		t.Fatalf("CLIENT NO-EVICT failed: %v", err)
+	}
+	if got, err := client.Execute("GET", "big"); err != nil || len(got) != 1 || got[0] != value {
+		t.Errorf("Expected GET to succeed with NO-EVICT, got %v", err)
+	}
+	if line := clientLine(t, client, "client"); !strings.Contains(line, " flags=e ") {
+		t.Errorf("Expected the e flag, got %q", line)
+	}
+	client.Execute("CLIENT", "NO-EVICT", "off")
+	if _, err := client.Execute("GET", "big"); err == nil {
+		t.Error("Expected CLIENT NO-EVICT off to restore the limit")
+	}
+}
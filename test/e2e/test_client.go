@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"strconv"
 	"strings"
@@ -205,15 +206,13 @@ func (c *TestClient) readReply() (*Reply, error) {
 			}, nil
 		}
 
-		// Read the data
-		data := make([]byte, size)
-		_, err = c.reader.Read(data)
-		if err != nil {
+		// Read the data and its trailing \r\n, which may span several reads
+		// and contain line breaks of its own
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(c.reader, data); err != nil {
 			return nil, fmt.Errorf("failed to read bulk string data: %v", err)
 		}
-
-		// Read trailing \r\n
-		c.reader.ReadLine()
+		data = data[:size]
 
 		return &Reply{
 			Type: BulkString,
@@ -237,8 +236,10 @@ func (c *TestClient) readReply() (*Reply, error) {
 		// Read array elements
 		elements := make([]interface{}, count)
 		for i := 0; i < count; i++ {
+			// An error element (e.g. a failed command in EXEC) does not
+			// fail the whole array
 			reply, err := c.readReply()
-			if err != nil {
+			if reply == nil {
 				return nil, err
 			}
 			elements[i] = reply.Data
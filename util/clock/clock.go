@@ -0,0 +1,148 @@
+// Package clock provides the time of the server: the wall clock in
+// production, and a manual clock that tests move forward themselves, so that
+// expirations and timestamps can be checked to the millisecond without
+// sleeping.
+package clock
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock tells the time and makes tickers
+type Clock interface {
+	Now() time.Time
+	NewTicker(d time.Duration) Ticker
+}
+
+// Ticker delivers ticks at intervals, as a time.Ticker does
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// Real is the wall clock
+var Real Clock = realClock{}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) NewTicker(d time.Duration) Ticker {
+	return realTicker{time.NewTicker(d)}
+}
+
+type realTicker struct {
+	*time.Ticker
+}
+
+func (t realTicker) C() <-chan time.Time {
+	return t.Ticker.C
+}
+
+// Manual is a clock that only moves when Advance is called. Its tickers
+// tick when Advance moves the clock past their next tick; a ticker nobody
+// receives from blocks Advance until it is stopped.
+type Manual struct {
+	advance sync.Mutex // Serializes Advance
+
+	mu      sync.Mutex
+	now     time.Time
+	tickers []*manualTicker
+}
+
+// NewManual returns a manual clock set to now
+func NewManual(now time.Time) *Manual {
+	return &Manual{now: now}
+}
+
+// Now returns the time the clock was moved to
+func (m *Manual) Now() time.Time {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.now
+}
+
+// NewTicker returns a ticker ticking every d of the clock's time
+func (m *Manual) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("clock: non-positive interval for NewTicker")
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t := &manualTicker{
+		clock:  m,
+		c:      make(chan time.Time),
+		done:   make(chan struct{}),
+		period: d,
+		next:   m.now.Add(d),
+	}
+	m.tickers = append(m.tickers, t)
+	return t
+}
+
+// Advance moves the clock forward by d, delivering the ticks due meanwhile
+// in order with the clock set to the time of each. A tick is only handed
+// over when the receiver of the ticker takes it, so a loop receiving the
+// ticks has processed all but the last one when Advance returns.
+func (m *Manual) Advance(d time.Duration) {
+	m.advance.Lock()
+	defer m.advance.Unlock()
+
+	m.mu.Lock()
+	target := m.now.Add(d)
+	for {
+		var next *manualTicker
+		for _, t := range m.tickers {
+			if !t.next.After(target) && (next == nil || t.next.Before(next.next)) {
+				next = t
+			}
+		}
+		if next == nil {
+			m.now = target
+			m.mu.Unlock()
+			return
+		}
+		at := next.next
+		m.now = at
+		next.next = at.Add(next.period)
+		m.mu.Unlock()
+
+		select {
+		case next.c <- at:
+		case <-next.done:
+		}
+		m.mu.Lock()
+	}
+}
+
+// manualTicker is a ticker of a Manual clock
+type manualTicker struct {
+	clock  *Manual
+	c      chan time.Time
+	done   chan struct{}
+	stop   sync.Once
+	period time.Duration
+	next   time.Time // Time of the next tick
+}
+
+func (t *manualTicker) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *manualTicker) Stop() {
+	t.stop.Do(func() {
+		close(t.done)
+		m := t.clock
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		for i, other := range m.tickers {
+			if other == t {
+				m.tickers = append(m.tickers[:i], m.tickers[i+1:]...)
+				break
+			}
+		}
+	})
+}
@@ -0,0 +1,85 @@
+package clock
+
+import (
+	"testing"
+	"time"
+)
+
+func TestManualNow(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	m := NewManual(start)
+	if !m.Now().Equal(start) {
+		t.Errorf("Expected %v, got %v", start, m.Now())
+	}
+	m.Advance(1500 * time.Millisecond)
+	if want := start.Add(1500 * time.Millisecond); !m.Now().Equal(want) {
+		t.Errorf("Expected %v, got %v", want, m.Now())
+	}
+}
+
+func TestManualTickerDeliversDueTicks(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	m := NewManual(start)
+	ticker := m.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+
+	ticks := make(chan time.Time, 10)
+	go func() {
+		for at := range ticker.C() {
+			ticks <- at
+		}
+	}()
+
+	m.Advance(9 * time.Millisecond)
+	m.Advance(26 * time.Millisecond)
+	for i := 1; i <= 3; i++ {
+		if got, want := <-ticks, start.Add(time.Duration(i)*10*time.Millisecond); !got.Equal(want) {
+			t.Errorf("Tick %d: expected %v, got %v", i, want, got)
+		}
+	}
+	select {
+	case got := <-ticks:
+		t.Errorf("Unexpected tick %v", got)
+	case <-time.After(10 * time.Millisecond):
+	}
+	if want := start.Add(35 * time.Millisecond); !m.Now().Equal(want) {
+		t.Errorf("Expected the clock at %v, got %v", want, m.Now())
+	}
+}
+
+func TestManualTickerStop(t *testing.T) {
+	m := NewManual(time.Now())
+	ticker := m.NewTicker(time.Millisecond)
+	ticker.Stop()
+	ticker.Stop()
+
+	// Nobody receives from a stopped ticker, which must not block Advance
+	done := make(chan struct{})
+	go func() {
+		m.Advance(time.Second)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Advance blocked on a stopped ticker")
+	}
+}
+
+func TestManualStopUnblocksAdvance(t *testing.T) {
+	m := NewManual(time.Now())
+	ticker := m.NewTicker(time.Millisecond)
+
+	done := make(chan struct{})
+	go func() {
+		m.Advance(time.Second)
+		close(done)
+	}()
+	<-ticker.C()
+	ticker.Stop()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Expected Stop to release Advance")
+	}
+}
@@ -0,0 +1,145 @@
+// Package glob implements Redis's glob-style pattern matching, as used by
+// KEYS, SCAN MATCH, PSUBSCRIBE and CONFIG GET.
+//
+// The semantics follow Redis's stringmatchlen:
+//
+//   - * matches any sequence of bytes, including none
+//   - ? matches any single byte
+//   - [abc] matches one of the listed bytes
+//   - [^abc] matches any byte not listed
+//   - [a-z] matches a byte in the range (the bounds may be given in any order)
+//   - \x matches x literally, also inside brackets
+//
+// An unterminated bracket extends to the end of the pattern and a trailing
+// backslash matches a backslash. Matching is byte-wise; the case-insensitive
+// variant folds ASCII letters only, except for escaped bytes inside brackets,
+// which Redis always compares exactly.
+//
+// Unlike Redis, which backtracks recursively at every star, the matcher only
+// remembers the position after the last star it met, so a match takes at most
+// O(len(pattern) * len(str)) steps whatever the pattern.
+package glob
+
+// Match reports whether str matches pattern, case-sensitively
+func Match(pattern, str string) bool {
+	return match(pattern, str, false)
+}
+
+// MatchNoCase reports whether str matches pattern, ignoring ASCII case
+func MatchNoCase(pattern, str string) bool {
+	return match(pattern, str, true)
+}
+
+func match(pattern, str string, nocase bool) bool {
+	p, s := 0, 0
+
+	// Where to resume after a mismatch: the pattern position after the last
+	// star and the first byte of str that star has not consumed yet. Only
+	// the last star matters: any way an earlier star could have matched is
+	// also available to the later one.
+	star, starS := -1, 0
+
+	for s < len(str) {
+		if p < len(pattern) && pattern[p] == '*' {
+			for p < len(pattern) && pattern[p] == '*' {
+				p++
+			}
+			if p == len(pattern) {
+				return true // A trailing star matches the rest
+			}
+			star, starS = p, s
+			continue
+		}
+		if p < len(pattern) {
+			if next, ok := matchOne(pattern, p, str[s], nocase); ok {
+				p = next
+				s++
+				continue
+			}
+		}
+		if star < 0 {
+			return false
+		}
+		// Let the last star consume one more byte and retry
+		starS++
+		p, s = star, starS
+	}
+
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+// matchOne matches the single-byte element of pattern starting at p (a
+// literal, an escape, ? or a bracket expression) against c and returns the
+// position of the next element
+func matchOne(pattern string, p int, c byte, nocase bool) (int, bool) {
+	switch pattern[p] {
+	case '?':
+		return p + 1, true
+	case '[':
+		return matchClass(pattern, p+1, c, nocase)
+	case '\\':
+		if p+1 < len(pattern) {
+			p++
+		}
+	}
+	return p + 1, equal(pattern[p], c, nocase)
+}
+
+// matchClass matches c against the bracket expression whose body starts at p
+// and returns the position after its closing bracket
+func matchClass(pattern string, p int, c byte, nocase bool) (int, bool) {
+	negate := p < len(pattern) && pattern[p] == '^'
+	if negate {
+		p++
+	}
+
+	matched := false
+	for p < len(pattern) && pattern[p] != ']' {
+		switch {
+		case pattern[p] == '\\' && p+1 < len(pattern):
+			p++
+			if pattern[p] == c {
+				matched = true
+			}
+		case p+2 < len(pattern) && pattern[p+1] == '-':
+			start, end := pattern[p], pattern[p+2]
+			if start > end {
+				start, end = end, start
+			}
+			lc := c
+			if nocase {
+				start, end, lc = toLower(start), toLower(end), toLower(c)
+			}
+			if lc >= start && lc <= end {
+				matched = true
+			}
+			p += 2
+		default:
+			if equal(pattern[p], c, nocase) {
+				matched = true
+			}
+		}
+		p++
+	}
+	if p < len(pattern) {
+		p++ // Skip the closing bracket
+	}
+	return p, matched != negate
+}
+
+func equal(a, b byte, nocase bool) bool {
+	if nocase {
+		return toLower(a) == toLower(b)
+	}
+	return a == b
+}
+
+func toLower(c byte) byte {
+	if c >= 'A' && c <= 'Z' {
+		return c + 'a' - 'A'
+	}
+	return c
+}
@@ -0,0 +1,202 @@
+package glob
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		pattern string
+		str     string
+		want    bool
+	}{
+		// Literals
+		{"", "", true},
+		{"", "a", false},
+		{"a", "", false},
+		{"hello", "hello", true},
+		{"hello", "Hello", false},
+		{"hello", "hello!", false},
+		{"hello!", "hello", false},
+
+		// Stars
+		{"*", "", true},
+		{"*", "anything", true},
+		{"**", "", true},
+		{"h*o", "ho", true},
+		{"h*o", "hello", true},
+		{"h*o", "hellx", false},
+		{"*llo", "hello", true},
+		{"he*", "hello", true},
+		{"h*l*o", "hello", true},
+		{"h*l*x", "hello", false},
+		{"*a*b", "xaxxb", true},
+		{"*a*b", "xbxxa", false},
+		{"a*a", "a", false},
+		{"a*a", "aa", true},
+		{"foo*bar*baz", "foobarbaz", true},
+		{"foo*bar*baz", "foo-bar-bar-baz", true},
+		{"foo*bar*baz", "foo-bar-baz-bar", false},
+		{"*.*", "file.txt", true},
+		{"user:*:name", "user:1000:name", true},
+		{"user:*:name", "user:1000:email", false},
+
+		// Question marks
+		{"?", "", false},
+		{"?", "a", true},
+		{"?", "ab", false},
+		{"h?llo", "hello", true},
+		{"h?llo", "hallo", true},
+		{"h?llo", "hllo", false},
+		{"??", "ab", true},
+		{"*?", "", false},
+		{"*?", "a", true},
+		{"?*?", "ab", true},
+		{"?*?", "a", false},
+
+		// Bracket expressions
+		{"h[ae]llo", "hello", true},
+		{"h[ae]llo", "hallo", true},
+		{"h[ae]llo", "hillo", false},
+		{"h[^e]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-b]llo", "hallo", true},
+		{"h[a-b]llo", "hbllo", true},
+		{"h[a-b]llo", "hcllo", false},
+		{"h[b-a]llo", "hallo", true},
+		{"[0-9]", "5", true},
+		{"[0-9]", "a", false},
+		{"[^0-9]", "a", true},
+		{"[^0-9]", "5", false},
+		{"[a-z0-9]", "q", true},
+		{"[a-z0-9]", "7", true},
+		{"[a-z0-9]", "Q", false},
+		{"[abc]*", "cat", true},
+		{"[]", "a", false},
+		{"[^]", "a", true},
+		{"[a-]", "a", true},
+		{"[a-]", "]", true},
+		{"[a-]", "-", false},
+		{"[-a]", "-", true},
+		{"[!a]", "!", true},
+		{"[!a]", "b", false},
+
+		// Unterminated brackets run to the end of the pattern
+		{"[abc", "a", true},
+		{"[abc", "c", true},
+		{"[abc", "d", false},
+		{"[abc", "ab", false},
+		{"[^abc", "d", true},
+		{"a[", "a", false},
+
+		// Escapes
+		{"\\*", "*", true},
+		{"\\*", "a", false},
+		{"\\?", "?", true},
+		{"\\?", "a", false},
+		{"\\[a]", "[a]", true},
+		{"\\[a]", "a", false},
+		{"\\\\", "\\", true},
+		{"\\a", "a", true},
+		{"a\\", "a\\", true},
+		{"a\\", "a", false},
+		{"\\*\\*", "**", true},
+		{"*\\*", "abc*", true},
+		{"*\\*", "abc", false},
+		{"[\\]]", "]", true},
+		{"[\\^a]", "^", true},
+		{"[\\-]", "-", true},
+		{"[a\\-z]", "b", false},
+		{"[a\\-z]", "-", true},
+
+		// Bytes are not interpreted as UTF-8
+		{"?", "\xff", true},
+		{"??", "é", true},
+		{"?", "é", false},
+		{"*\r\n*", "a\r\nb", true},
+		{"a?b", "a\x00b", true},
+		{"a\x00*", "a\x00b", true},
+		{"a\x00*", "a", false},
+		{"[\x00-\x1f]", "\n", true},
+		{"[^\x00]", "\x00", false},
+	}
+
+	for _, tt := range tests {
+		if got := Match(tt.pattern, tt.str); got != tt.want {
+			t.Errorf("Match(%q, %q) = %v, want %v", tt.pattern, tt.str, got, tt.want)
+		}
+	}
+}
+
+func TestMatchNoCase(t *testing.T) {
+	tests := []struct {
+		pattern string
+		str     string
+		want    bool
+	}{
+		{"hello", "HeLLo", true},
+		{"HELLO", "hello", true},
+		{"max*", "MaxMemory", true},
+		{"h?LLO", "hello", true},
+		{"[A-C]", "b", true},
+		{"[a-c]", "B", true},
+		{"[a-c]", "D", false},
+		{"[^A-C]", "b", false},
+		{"[xyz]", "Y", true},
+		{"\\H", "h", true},
+		// Escaped bytes inside brackets are compared exactly, as in Redis
+		{"[\\A]", "a", false},
+		{"[\\A]", "A", true},
+	}
+
+	for _, tt := range tests {
+		if got := MatchNoCase(tt.pattern, tt.str); got != tt.want {
+			t.Errorf("MatchNoCase(%q, %q) = %v, want %v", tt.pattern, tt.str, got, tt.want)
+		}
+	}
+	if Match("hello", "HELLO") {
+		t.Error("Expected Match to be case-sensitive")
+	}
+}
+
+// TestMatchPathologicalPattern checks that patterns with many stars do not
+// backtrack exponentially (Redis's "Regression for pattern matching long
+// nested loops")
+func TestMatchPathologicalPattern(t *testing.T) {
+	subject := strings.Repeat("a", 10*1024)
+	patterns := []string{
+		"a*a*a*a*a*b",
+		strings.Repeat("a*", 50) + "b",
+		strings.Repeat("*a", 50) + "*b",
+		strings.Repeat("?*", 50) + "b",
+	}
+
+	start := time.Now()
+	for _, pattern := range patterns {
+		if Match(pattern, subject) {
+			t.Errorf("Expected %q not to match", pattern)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Matching took %v, expected it to be linear in the subject", elapsed)
+	}
+
+	if !Match(strings.Repeat("a*", 50), subject) {
+		t.Error("Expected a pattern of a* to match a run of a")
+	}
+}
+
+func BenchmarkMatchPathological(b *testing.B) {
+	subject := strings.Repeat("a", 10*1024)
+	for i := 0; i < b.N; i++ {
+		Match("a*a*a*a*a*b", subject)
+	}
+}
+
+func BenchmarkMatchKeyPattern(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		Match("user:*:session:[0-9]*", "user:12345:session:67890")
+	}
+}
@@ -0,0 +1,151 @@
+// Package lzf implements the LZF compression format of liblzf, which Redis
+// uses for the strings of its RDB files.
+//
+// A compressed stream is a sequence of chunks, each starting with a control
+// byte:
+//
+//	000LLLLL                    a literal run of L+1 bytes, which follow
+//	LLLooooo oooooooo           a back reference of L+2 bytes, 1 <= L < 7
+//	111ooooo LLLLLLLL oooooooo  a back reference of L+9 bytes
+//
+// A back reference copies bytes starting o+1 bytes before the end of the
+// output so far (o has 13 bits), and may overlap the bytes it produces. The
+// stream does not record the length of the data, which the caller keeps.
+package lzf
+
+import "errors"
+
+const (
+	hashLog     = 14
+	maxLiteral  = 1 << 5
+	maxOffset   = 1 << 13
+	maxRefLen   = 1<<8 + 1<<3 // 7 + 255 in the extra byte, plus 2
+	minMatchLen = 3
+)
+
+// ErrCorrupt is returned by Decompress for input that is not a valid stream
+// of the expected length
+var ErrCorrupt = errors.New("lzf: corrupt input")
+
+// Compress returns the compressed form of data. It may be longer than data
+// when data does not repeat itself.
+func Compress(data []byte) []byte {
+	out := make([]byte, 0, len(data)/2+maxLiteral)
+	var table [1 << hashLog]int32 // Position+1 of the last 3 bytes hashing to each slot
+
+	// The control byte of the current literal run is reserved before its bytes
+	literalStart := len(out)
+	out = append(out, 0)
+	literals := 0
+	endLiteral := func() {
+		if literals > 0 {
+			out[literalStart] = byte(literals - 1)
+		} else {
+			out = out[:literalStart]
+		}
+	}
+	startLiteral := func() {
+		literalStart = len(out)
+		out = append(out, 0)
+		literals = 0
+	}
+
+	pos := 0
+	for pos+minMatchLen <= len(data) {
+		slot := hash(data[pos:])
+		ref := int(table[slot]) - 1
+		table[slot] = int32(pos + 1)
+
+		offset := pos - ref - 1
+		if ref >= 0 && offset < maxOffset &&
+			data[ref] == data[pos] && data[ref+1] == data[pos+1] && data[ref+2] == data[pos+2] {
+			limit := min(len(data)-pos, maxRefLen)
+			n := minMatchLen
+			for n < limit && data[ref+n] == data[pos+n] {
+				n++
+			}
+
+			endLiteral()
+			if l := n - 2; l < 7 {
+				out = append(out, byte(l<<5|offset>>8))
+			} else {
+				out = append(out, byte(7<<5|offset>>8), byte(l-7))
+			}
+			out = append(out, byte(offset))
+			startLiteral()
+			pos += n
+			continue
+		}
+
+		out = append(out, data[pos])
+		pos++
+		if literals++; literals == maxLiteral {
+			endLiteral()
+			startLiteral()
+		}
+	}
+	for ; pos < len(data); pos++ {
+		out = append(out, data[pos])
+		if literals++; literals == maxLiteral {
+			endLiteral()
+			startLiteral()
+		}
+	}
+	endLiteral()
+	return out
+}
+
+// Decompress returns the n bytes compressed in data
+func Decompress(data []byte, n int) ([]byte, error) {
+	out := make([]byte, 0, n)
+	for i := 0; i < len(data); {
+		ctrl := int(data[i])
+		i++
+
+		if ctrl < maxLiteral {
+			length := ctrl + 1
+			if i+length > len(data) || len(out)+length > n {
+				return nil, ErrCorrupt
+			}
+			out = append(out, data[i:i+length]...)
+			i += length
+			continue
+		}
+
+		length := ctrl >> 5
+		if length == 7 {
+			if i >= len(data) {
+				return nil, ErrCorrupt
+			}
+			length += int(data[i])
+			i++
+		}
+		if i >= len(data) {
+			return nil, ErrCorrupt
+		}
+		ref := len(out) - (ctrl&0x1f)<<8 - int(data[i]) - 1
+		i++
+		length += 2
+		if ref < 0 || len(out)+length > n {
+			return nil, ErrCorrupt
+		}
+		if ref+length <= len(out) {
+			out = append(out, out[ref:ref+length]...)
+			continue
+		}
+		// Byte by byte, as the reference overlaps the bytes it produces
+		for j := 0; j < length; j++ {
+			out = append(out, out[ref+j])
+		}
+	}
+	if len(out) != n {
+		return nil, ErrCorrupt
+	}
+	return out, nil
+}
+
+// hash returns the table slot of the 3 bytes starting b
+func hash(b []byte) int {
+	v := uint32(b[0])<<16 | uint32(b[1])<<8 | uint32(b[2])
+	return int((v * 2654435761) >> (32 - hashLog))
+}
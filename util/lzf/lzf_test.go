@@ -0,0 +1,73 @@
+package lzf
+
+import (
+	"bytes"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	random := make([]byte, 10000)
+	rng.Read(random)
+	// Few distinct bytes, so short matches at every offset
+	lowEntropy := make([]byte, 20000)
+	for i := range lowEntropy {
+		lowEntropy[i] = "ab"[rng.Intn(2)]
+	}
+
+	tests := map[string][]byte{
+		"empty":       {},
+		"one byte":    []byte("x"),
+		"short":       []byte("abc"),
+		"literals":    []byte("the quick brown fox jumps over the lazy dog"),
+		"run":         bytes.Repeat([]byte("a"), 1000),
+		"long match":  []byte(strings.Repeat("0123456789", 100)),
+		"far match":   append(append([]byte("prefix"), random[:maxOffset-16]...), "prefix"...),
+		"random":      random,
+		"low entropy": lowEntropy,
+		"json":        []byte(strings.Repeat(`{"id":12345,"name":"gocache","tags":["a","b"]},`, 200)),
+	}
+
+	for name, data := range tests {
+		t.Run(name, func(t *testing.T) {
+			compressed := Compress(data)
+			got, err := Decompress(compressed, len(data))
+			if err != nil {
+				t.Fatalf("Decompress: %v", err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Fatal("Round trip changed the data")
+			}
+		})
+	}
+}
+
+func TestCompressRatio(t *testing.T) {
+	data := []byte(strings.Repeat(`{"id":12345,"name":"gocache","tags":["a","b"]},`, 200))
+	if compressed := Compress(data); len(compressed)*5 > len(data) {
+		t.Errorf("Expected repetitive data to compress at least 5:1, got %d to %d", len(data), len(compressed))
+	}
+}
+
+func TestDecompressCorrupt(t *testing.T) {
+	valid := Compress([]byte(strings.Repeat("abcdef", 50)))
+	tests := map[string]struct {
+		data []byte
+		n    int
+	}{
+		"truncated literal":   {[]byte{5, 'a', 'b'}, 6},
+		"truncated reference": {[]byte{0, 'a', 1 << 5}, 4},
+		"reference before":    {[]byte{0, 'a', 1 << 5, 5}, 4},
+		"longer than n":       {valid, 299},
+		"shorter than n":      {valid, 301},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := Decompress(tt.data, tt.n); err != ErrCorrupt {
+				t.Errorf("Expected ErrCorrupt, got %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,65 @@
+// Package quote renders command arguments for human-readable output such as
+// MONITOR and SLOWLOG, following Redis's sdscatrepr.
+//
+// Keys and values are arbitrary bytes. Written as is, an argument containing
+// CRLF would end a MONITOR line early and one containing a space could not be
+// told apart from two arguments, so arguments that are not plain printable
+// ASCII are quoted, with quotes, backslashes and non-printable bytes escaped:
+//
+//	\" \\ \n \r \t \a \b   for the corresponding bytes
+//	\xhh                   for any other byte outside 0x21-0x7e
+//
+// The output is always printable ASCII, whatever the input.
+package quote
+
+const hexDigits = "0123456789abcdef"
+
+// Append appends s to dst in double quotes, escaping it like sdscatrepr
+func Append(dst, s []byte) []byte {
+	dst = append(dst, '"')
+	for _, c := range s {
+		switch c {
+		case '\\', '"':
+			dst = append(dst, '\\', c)
+		case '\n':
+			dst = append(dst, '\\', 'n')
+		case '\r':
+			dst = append(dst, '\\', 'r')
+		case '\t':
+			dst = append(dst, '\\', 't')
+		case '\a':
+			dst = append(dst, '\\', 'a')
+		case '\b':
+			dst = append(dst, '\\', 'b')
+		default:
+			if c >= ' ' && c <= '~' {
+				dst = append(dst, c)
+			} else {
+				dst = append(dst, '\\', 'x', hexDigits[c>>4], hexDigits[c&0xf])
+			}
+		}
+	}
+	return append(dst, '"')
+}
+
+// AppendArg appends arg to dst as is when it is a non-empty run of printable
+// ASCII without spaces, quotes or backslashes, and quoted by Append otherwise
+func AppendArg(dst, arg []byte) []byte {
+	if !isBare(arg) {
+		return Append(dst, arg)
+	}
+	return append(dst, arg...)
+}
+
+// isBare reports whether arg can be written without quotes
+func isBare(arg []byte) bool {
+	if len(arg) == 0 {
+		return false
+	}
+	for _, c := range arg {
+		if c <= ' ' || c > '~' || c == '"' || c == '\\' {
+			return false
+		}
+	}
+	return true
+}
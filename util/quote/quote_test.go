@@ -0,0 +1,45 @@
+package quote
+
+import "testing"
+
+func TestAppend(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"", `""`},
+		{"key", `"key"`},
+		{"a b", `"a b"`},
+		{"\r\n\t\a\b", `"\r\n\t\a\b"`},
+		{`"\`, `"\"\\"`},
+		{"\x00\x01\x7f\x80\xff", `"\x00\x01\x7f\x80\xff"`},
+		{"é", `"\xc3\xa9"`},
+	}
+	for _, tt := range tests {
+		if got := string(Append(nil, []byte(tt.in))); got != tt.want {
+			t.Errorf("Append(%q) = %s, want %s", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestAppendArg(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"key", "key"},
+		{"user:1000", "user:1000"},
+		{"it's", "it's"},
+		{"", `""`},
+		{" key ", `" key "`},
+		{"a\r\nb", `"a\r\nb"`},
+		{`a"b`, `"a\"b"`},
+		{`a\b`, `"a\\b"`},
+		{"\xff", `"\xff"`},
+	}
+	for _, tt := range tests {
+		if got := string(AppendArg([]byte("x "), []byte(tt.in))); got != "x "+tt.want {
+			t.Errorf("AppendArg(%q) = %s, want x %s", tt.in, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+// Package random provides the sources of randomness of the server: SPOP and
+// SRANDMEMBER pick members with one, the random eviction policy picks its
+// victims with another.
+//
+// Every source is seeded from crypto/rand unless told otherwise, so that two
+// servers started at the same time never make the same picks. Tests pass a
+// fixed seed instead, which makes the picks, and so the results of the
+// commands, reproducible.
+package random
+
+import (
+	crand "crypto/rand"
+	"encoding/binary"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Seed returns a seed read from crypto/rand, or the current time should
+// crypto/rand fail
+func Seed() int64 {
+	var b [8]byte
+	if _, err := crand.Read(b[:]); err != nil {
+		return time.Now().UnixNano()
+	}
+	return int64(binary.LittleEndian.Uint64(b[:]))
+}
+
+// New returns a source seeded with seed that is safe for concurrent use,
+// unlike the *rand.Rand of rand.New(rand.NewSource(seed))
+func New(seed int64) *rand.Rand {
+	return rand.New(&lockedSource{src: rand.NewSource(seed).(rand.Source64)})
+}
+
+// lockedSource serializes the calls to a rand.Source
+type lockedSource struct {
+	mu  sync.Mutex
+	src rand.Source64
+}
+
+func (s *lockedSource) Int63() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.src.Int63()
+}
+
+func (s *lockedSource) Uint64() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.src.Uint64()
+}
+
+func (s *lockedSource) Seed(seed int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.src.Seed(seed)
+}
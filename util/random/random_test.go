@@ -0,0 +1,36 @@
+package random
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestNewIsReproducible(t *testing.T) {
+	a, b := New(42), New(42)
+	for i := 0; i < 100; i++ {
+		if x, y := a.Intn(1000), b.Intn(1000); x != y {
+			t.Fatalf("Draw %d: %d != %d with the same seed", i, x, y)
+		}
+	}
+
+	a.Seed(7)
+	b.Seed(7)
+	if x, y := a.Int63(), b.Int63(); x != y {
+		t.Errorf("Expected the same draw after reseeding, got %d and %d", x, y)
+	}
+}
+
+func TestNewIsSafeForConcurrentUse(t *testing.T) {
+	r := New(Seed())
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				r.Intn(100)
+			}
+		}()
+	}
+	wg.Wait()
+}